@@ -13,6 +13,7 @@ import { getSourceData } from '../../../helpers/trackers/trackers';
 import IconTooltip from './IconTooltip';
 
 const DomainCell = ({
+    anonymized,
     answer_dnssec,
     client_proto,
     domain,
@@ -40,6 +41,7 @@ const DomainCell = ({
 
     const protocol = t(SCHEME_TO_PROTOCOL_MAP[client_proto]) || '';
     const ip = type ? `${t('type_table_header')}: ${type}` : '';
+    const anonymizedLabel = anonymized ? t('query_log_anonymized') : '';
 
     const requestDetailsObj = {
         time_table_header: formatTime(time, LONG_TIME_FORMAT),
@@ -47,6 +49,7 @@ const DomainCell = ({
         domain,
         type_table_header: type,
         protocol,
+        query_log_anonymized: anonymized && t('query_log_anonymized_desc'),
     };
 
     const sourceData = getSourceData(tracker);
@@ -81,7 +84,7 @@ const DomainCell = ({
         'px-2 d-flex justify-content-center flex-column': isDetailed,
     });
 
-    const details = [ip, protocol].filter(Boolean)
+    const details = [ip, protocol, anonymizedLabel].filter(Boolean)
         .join(', ');
 
     return <div className="d-flex o-hidden logs__cell logs__cell logs__cell--domain" role="gridcell">
@@ -107,6 +110,7 @@ const DomainCell = ({
 };
 
 DomainCell.propTypes = {
+    anonymized: propTypes.bool,
     answer_dnssec: propTypes.bool.isRequired,
     client_proto: propTypes.string.isRequired,
     domain: propTypes.string.isRequired,
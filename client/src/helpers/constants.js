@@ -537,8 +537,10 @@ export const BLOCK_ACTIONS = {
 export const SCHEME_TO_PROTOCOL_MAP = {
     dnscrypt: 'dnscrypt',
     doh: 'dns_over_https',
+    doh3: 'dns_over_http3',
     dot: 'dns_over_tls',
     doq: 'dns_over_quic',
+    unix: 'unix_socket',
     '': 'plain_dns',
 };
 
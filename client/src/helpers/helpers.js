@@ -58,6 +58,7 @@ export const formatDetailedDateTime = (dateTime) => formatDateTime(
 
 export const normalizeLogs = (logs) => logs.map((log) => {
     const {
+        anonymized,
         answer,
         answer_dnssec,
         client,
@@ -97,6 +98,7 @@ export const normalizeLogs = (logs) => logs.map((log) => {
         time,
         domain,
         type,
+        anonymized: !!anonymized,
         response: processResponse(answer),
         reason,
         client,
@@ -0,0 +1,483 @@
+package filtering
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// The compiled index of a filter list allows matching the simple rules of the
+// list, which are most of the rules of the large lists, without keeping them
+// in memory.  Those are the /etc/hosts-style rules, including the plain
+// domains, and the ||domain^ rules without modifiers.  The index only contains
+// the hashes of the domains of these rules and the offsets of the rules within
+// the list file, so that the text of a rule is only read when its hash
+// matches.  The rest of the rules are passed to urlfilter as usual.
+//
+// The index file consists of the header and of the sections of little-endian
+// integers following it:
+//
+//   magic        [8]byte, see indexMagic
+//   source size  uint64, the size of the list file
+//   source mtime int64, the modification time of the list file in nanoseconds
+//   nNet         uint64, the number of the ||domain^ rules
+//   nHost        uint64, the number of the domains of the /etc/hosts rules
+//   nOther       uint64, the number of the other rules
+//   netHashes    [nNet]uint64, the sorted hashes of the domains
+//   netOffsets   [nNet]uint32, the offsets of the corresponding rules
+//   hostHashes   [nHost]uint64, the sorted hashes of the domains
+//   hostOffsets  [nHost]uint32, the offsets of the corresponding rules
+//   otherOffsets [nOther]uint32, the offsets of the other rules
+//
+// The index is rebuilt when the size or the modification time of the list file
+// changes.
+
+// indexMagic is the magic number and the version of the index format.
+const indexMagic = "AGHRIX01"
+
+// indexHeaderLen is the length of the header of the index.
+const indexHeaderLen = len(indexMagic) + 5*8
+
+// errBadIndex is returned when the index file is malformed.
+const errBadIndex errorString = "bad index"
+
+// errorString is the constant error type of the package.
+type errorString string
+
+// Error implements the error interface for errorString.
+func (s errorString) Error() (msg string) {
+	return string(s)
+}
+
+// hashDomain returns the 64-bit FNV-1a hash of domain.  It doesn't allocate.
+func hashDomain(domain string) (h uint64) {
+	const (
+		offset64 = 14695981039346656037
+		prime64  = 1099511628211
+	)
+
+	h = offset64
+	for i := 0; i < len(domain); i++ {
+		h ^= uint64(domain[i])
+		h *= prime64
+	}
+
+	return h
+}
+
+// simpleNetworkDomain returns the domain of the ||domain^ rule without
+// modifiers in line.  ok is false if line isn't such a rule.  Only the lowercase
+// domains are accepted, so that the matching stays the same as urlfilter's.
+func simpleNetworkDomain(line string) (domain string, ok bool) {
+	if !strings.HasPrefix(line, "||") || !strings.HasSuffix(line, "^") {
+		return "", false
+	}
+
+	domain = line[2 : len(line)-1]
+	if domain == "" || domain[0] == '.' || domain[len(domain)-1] == '.' {
+		return "", false
+	}
+
+	for i := 0; i < len(domain); i++ {
+		c := domain[i]
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '.' && c != '-' && c != '_' {
+			return "", false
+		}
+	}
+
+	return domain, true
+}
+
+// indexEntry is an entry of a section of the index before it's written.
+type indexEntry struct {
+	hash   uint64
+	offset uint32
+}
+
+// indexBuilder collects the entries of the index of a list.
+type indexBuilder struct {
+	net   []indexEntry
+	host  []indexEntry
+	other []uint32
+}
+
+// add classifies the line found at offset.
+func (b *indexBuilder) add(line string, offset uint32) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+
+	if domain, ok := simpleNetworkDomain(line); ok {
+		b.net = append(b.net, indexEntry{hash: hashDomain(domain), offset: offset})
+
+		return
+	}
+
+	r, err := rules.NewRule(line, 0)
+	if err != nil || r == nil {
+		// Comments and invalid rules.
+		return
+	}
+
+	switch r := r.(type) {
+	case *rules.HostRule:
+		for _, h := range r.Hostnames {
+			b.host = append(b.host, indexEntry{hash: hashDomain(h), offset: offset})
+		}
+	case *rules.NetworkRule:
+		b.other = append(b.other, offset)
+	default:
+		// Cosmetic rules are ignored.
+	}
+}
+
+// buildIndex scans the list file src and writes the index to dst.
+func buildIndex(src *os.File, fi os.FileInfo, dst string) (err error) {
+	if fi.Size() > math.MaxUint32 {
+		return fmt.Errorf("list is too large to be indexed: %d bytes", fi.Size())
+	}
+
+	b := &indexBuilder{}
+	r := bufio.NewReader(src)
+	var offset uint32
+	for {
+		var line string
+		line, err = r.ReadString('\n')
+		if len(line) > 0 {
+			b.add(line, offset)
+			offset += uint32(len(line))
+		}
+
+		if errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return fmt.Errorf("reading list: %w", err)
+		}
+	}
+
+	for _, sec := range [][]indexEntry{b.net, b.host} {
+		sec := sec
+		sort.Slice(sec, func(i, j int) bool {
+			if sec[i].hash != sec[j].hash {
+				return sec[i].hash < sec[j].hash
+			}
+
+			return sec[i].offset < sec[j].offset
+		})
+	}
+
+	data := make([]byte, indexHeaderLen, indexHeaderLen+12*(len(b.net)+len(b.host))+4*len(b.other))
+	copy(data, indexMagic)
+	le := binary.LittleEndian
+	le.PutUint64(data[8:], uint64(fi.Size()))
+	le.PutUint64(data[16:], uint64(fi.ModTime().UnixNano()))
+	le.PutUint64(data[24:], uint64(len(b.net)))
+	le.PutUint64(data[32:], uint64(len(b.host)))
+	le.PutUint64(data[40:], uint64(len(b.other)))
+
+	var buf [8]byte
+	for _, sec := range [][]indexEntry{b.net, b.host} {
+		for _, e := range sec {
+			le.PutUint64(buf[:], e.hash)
+			data = append(data, buf[:8]...)
+		}
+
+		for _, e := range sec {
+			le.PutUint32(buf[:], e.offset)
+			data = append(data, buf[:4]...)
+		}
+	}
+
+	for _, off := range b.other {
+		le.PutUint32(buf[:], off)
+		data = append(data, buf[:4]...)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("creating index: %w", err)
+	}
+
+	_, err = tmp.Write(data)
+	cerr := tmp.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+
+		return fmt.Errorf("writing index: %w", err)
+	}
+
+	return nil
+}
+
+// compiledList is a filter list matched via its compiled index.
+type compiledList struct {
+	// src is the list file, from which the rules are read by their
+	// offsets.
+	src *os.File
+
+	// data is the memory-mapped index.
+	data []byte
+
+	// unmap releases data.
+	unmap func() (err error)
+
+	// id is the ID of the list.
+	id int
+
+	// The offsets of the sections within data.
+	netHashes, netOffsets   int
+	hostHashes, hostOffsets int
+	otherOffsets            int
+
+	// The numbers of the entries of the sections.
+	nNet, nHost, nOther int
+}
+
+// openCompiledList opens the compiled list for the list file at path using the
+// index at indexPath.  The index is rebuilt if it's missing, malformed, or
+// describes another version of the list file.
+func openCompiledList(id int, path, indexPath string) (cl *compiledList, err error) {
+	src, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			_ = src.Close()
+		}
+	}()
+
+	fi, err := src.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	cl = &compiledList{
+		src: src,
+		id:  id,
+	}
+
+	err = cl.mapIndex(indexPath, fi)
+	if err == nil {
+		return cl, nil
+	}
+
+	err = buildIndex(src, fi, indexPath)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cl.mapIndex(indexPath, fi)
+	if err != nil {
+		return nil, fmt.Errorf("opening index: %w", err)
+	}
+
+	return cl, nil
+}
+
+// mapIndex maps the index at indexPath and checks that it describes the list
+// file described by fi.
+func (cl *compiledList) mapIndex(indexPath string, fi os.FileInfo) (err error) {
+	data, unmap, err := mapFile(indexPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			_ = unmap()
+		}
+	}()
+
+	if len(data) < indexHeaderLen || string(data[:len(indexMagic)]) != indexMagic {
+		return errBadIndex
+	}
+
+	le := binary.LittleEndian
+	if le.Uint64(data[8:]) != uint64(fi.Size()) || int64(le.Uint64(data[16:])) != fi.ModTime().UnixNano() {
+		return errBadIndex
+	}
+
+	nNet, nHost, nOther := le.Uint64(data[24:]), le.Uint64(data[32:]), le.Uint64(data[40:])
+	if want := uint64(indexHeaderLen) + 12*(nNet+nHost) + 4*nOther; uint64(len(data)) != want {
+		return errBadIndex
+	}
+
+	cl.data, cl.unmap = data, unmap
+	cl.nNet, cl.nHost, cl.nOther = int(nNet), int(nHost), int(nOther)
+	cl.netHashes = indexHeaderLen
+	cl.netOffsets = cl.netHashes + 8*cl.nNet
+	cl.hostHashes = cl.netOffsets + 4*cl.nNet
+	cl.hostOffsets = cl.hostHashes + 8*cl.nHost
+	cl.otherOffsets = cl.hostOffsets + 4*cl.nHost
+
+	return nil
+}
+
+// close releases the resources of cl.
+func (cl *compiledList) close() (err error) {
+	err = cl.unmap()
+	cerr := cl.src.Close()
+	if err == nil {
+		err = cerr
+	}
+
+	return err
+}
+
+// ruleAt reads the rule at offset from the list file.
+func (cl *compiledList) ruleAt(offset uint32) (text string, err error) {
+	const chunk = 256
+
+	var line []byte
+	buf := make([]byte, chunk)
+	for off := int64(offset); ; off += chunk {
+		n, rerr := cl.src.ReadAt(buf, off)
+		if i := indexByte(buf[:n], '\n'); i >= 0 {
+			line = append(line, buf[:i]...)
+
+			break
+		}
+
+		line = append(line, buf[:n]...)
+		if errors.Is(rerr, io.EOF) {
+			break
+		} else if rerr != nil {
+			return "", rerr
+		}
+	}
+
+	return strings.TrimSpace(string(line)), nil
+}
+
+// indexByte returns the index of the first c in b or -1.
+func indexByte(b []byte, c byte) (i int) {
+	for i = range b {
+		if b[i] == c {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// offsets returns the offsets of the entries of the section with hash.
+func (cl *compiledList) offsets(hashes, offsets, n int, hash uint64) (offs []uint32) {
+	le := binary.LittleEndian
+	hashAt := func(i int) (h uint64) {
+		return le.Uint64(cl.data[hashes+8*i:])
+	}
+
+	for i := sort.Search(n, func(i int) bool { return hashAt(i) >= hash }); i < n && hashAt(i) == hash; i++ {
+		offs = append(offs, le.Uint32(cl.data[offsets+4*i:]))
+	}
+
+	return offs
+}
+
+// otherRules returns the text of the rules which aren't matched via the index.
+func (cl *compiledList) otherRules() (text string, err error) {
+	b := &strings.Builder{}
+	le := binary.LittleEndian
+	for i := 0; i < cl.nOther; i++ {
+		var r string
+		r, err = cl.ruleAt(le.Uint32(cl.data[cl.otherOffsets+4*i:]))
+		if err != nil {
+			return "", err
+		}
+
+		b.WriteString(r)
+		b.WriteByte('\n')
+	}
+
+	return b.String(), nil
+}
+
+// matchNetwork returns the first ||domain^ rule of cl matching host, which is
+// either the domain itself or its subdomain, unless disabled contains it.
+func (cl *compiledList) matchNetwork(host string, disabled map[string]struct{}) (nr *rules.NetworkRule, err error) {
+	for d := host; d != ""; {
+		for _, off := range cl.offsets(cl.netHashes, cl.netOffsets, cl.nNet, hashDomain(d)) {
+			var text string
+			text, err = cl.ruleAt(off)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := disabled[text]; ok {
+				continue
+			}
+
+			if domain, ok := simpleNetworkDomain(text); !ok || domain != d {
+				// A collision of the hashes.
+				continue
+			}
+
+			return rules.NewNetworkRule(text, cl.id)
+		}
+
+		i := strings.IndexByte(d, '.')
+		if i < 0 {
+			break
+		}
+
+		d = d[i+1:]
+	}
+
+	return nil, nil
+}
+
+// matchHosts returns the /etc/hosts rules of cl matching host.
+func (cl *compiledList) matchHosts(host string) (hrs []*rules.HostRule, err error) {
+	for _, off := range cl.offsets(cl.hostHashes, cl.hostOffsets, cl.nHost, hashDomain(host)) {
+		var text string
+		text, err = cl.ruleAt(off)
+		if err != nil {
+			return nil, err
+		}
+
+		hr, herr := rules.NewHostRule(text, cl.id)
+		if herr == nil && hr.Match(host) {
+			hrs = append(hrs, hr)
+		}
+	}
+
+	return hrs, nil
+}
+
+// badfilterTargets adds the texts of the rules disabled by the $badfilter rules
+// found in the text of the rules to targets.
+func badfilterTargets(text string, targets map[string]struct{}) {
+	for _, line := range strings.Split(text, "\n") {
+		if !strings.Contains(line, "badfilter") {
+			continue
+		}
+
+		nr, err := rules.NewNetworkRule(line, 0)
+		if err != nil || !nr.IsOptionEnabled(rules.OptionBadfilter) {
+			continue
+		}
+
+		t := strings.Replace(line, "$badfilter", "", 1)
+		t = strings.Replace(t, ",badfilter", "", 1)
+		targets[t] = struct{}{}
+	}
+}
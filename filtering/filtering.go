@@ -0,0 +1,566 @@
+// Package filtering implements the rule-based DNS filtering engine of AdGuard
+// Home.  It matches hostnames against the filtering rules and maps the search
+// engines to their safe search versions, and doesn't depend on the rest of
+// AdGuard Home, so that other Go programs can use it.
+package filtering
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+
+	"github.com/AdguardTeam/urlfilter"
+	"github.com/AdguardTeam/urlfilter/filterlist"
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+)
+
+// UserRulesID is the ID of the filter list containing the user rules.
+const UserRulesID = 0
+
+// List is a filter list.
+type List struct {
+	// Data is the text of the rules divided by '\n'.  It's only used if
+	// FilePath is empty.
+	Data []byte
+
+	// FilePath is the path to the file containing the rules.  A missing
+	// file is treated as an empty list.
+	FilePath string
+
+	// IndexPath, if not empty, is the path to the compiled index of the
+	// blocklist at FilePath.  The simple rules of such a list are matched
+	// via the memory-mapped index instead of being kept in memory, and the
+	// index is rebuilt when the file changes.  It's ignored for the
+	// allowlists and on the platforms which don't support it, like Windows.
+	IndexPath string
+
+	// ID is the ID of the list reported in the matched rules.
+	ID int64
+
+	// Allowlist is true if the rules of the list only allow the matched
+	// hosts.
+	Allowlist bool
+}
+
+// ClientContext is the information about the client making the request used
+// by the rules with the $client and $ctag modifiers.
+type ClientContext struct {
+	// Name is the name of the client.
+	Name string
+
+	// IP is the IP address of the client.
+	IP net.IP
+
+	// Tags are the sorted tags of the client.
+	Tags []string
+
+	// SafeSearch is true if the safe search is enforced for the client.
+	SafeSearch bool
+}
+
+// Reason is the reason of the match.
+type Reason int
+
+// Reasons of the match.
+const (
+	// NotMatched means that no rule has matched the host.
+	NotMatched Reason = iota
+
+	// Allowed means that the host is explicitly allowed.
+	Allowed
+
+	// Blocked means that the host is blocked.
+	Blocked
+
+	// Rewritten means that a $dnsrewrite rule has been applied.
+	Rewritten
+
+	// SafeSearch means that the host is a search engine redirected to its
+	// safe search version.
+	SafeSearch
+)
+
+// String implements the fmt.Stringer interface for Reason.
+func (r Reason) String() (s string) {
+	switch r {
+	case NotMatched:
+		return "NotMatched"
+	case Allowed:
+		return "Allowed"
+	case Blocked:
+		return "Blocked"
+	case Rewritten:
+		return "Rewritten"
+	case SafeSearch:
+		return "SafeSearch"
+	default:
+		return fmt.Sprintf("Reason(%d)", int(r))
+	}
+}
+
+// Rule is a matched rule.
+type Rule struct {
+	// Text is the text of the rule.
+	Text string
+
+	// IP is the IP address of the host.  It's nil unless the rule uses the
+	// /etc/hosts syntax.  It's empty and not nil if the rule uses that
+	// syntax but the type of the question doesn't match the address.
+	IP net.IP
+
+	// FilterListID is the ID of the list containing the rule.
+	FilterListID int64
+}
+
+// Rewrite is the result of applying the $dnsrewrite rules or the safe search.
+// Either CanonName or RCode and Response are set.
+type Rewrite struct {
+	// Response are the records of the response by their type.
+	Response map[rules.RRType][]rules.RRValue
+
+	// CanonName is the new CNAME of the host.
+	CanonName string
+
+	// RCode is the response code.
+	RCode rules.RCode
+}
+
+// Result is the result of matching a host.
+type Result struct {
+	// Rewrite is the $dnsrewrite or the safe search result.  It's nil
+	// unless Reason is Rewritten or SafeSearch.
+	Rewrite *Rewrite
+
+	// Rules are the matched rules.  They're empty if Reason is NotMatched
+	// or SafeSearch.
+	Rules []Rule
+
+	// Reason is the reason of the match.
+	Reason Reason
+}
+
+// Engine matches hostnames against filtering rules.  It's safe for concurrent
+// use, but Close mustn't be called concurrently with Match.
+type Engine struct {
+	block        *urlfilter.DNSEngine
+	blockStorage *filterlist.RuleStorage
+	allow        *urlfilter.DNSEngine
+	allowStorage *filterlist.RuleStorage
+
+	// compiled are the blocklists matched via their indexes.
+	compiled []*compiledList
+
+	// disabled are the texts of the rules disabled by the $badfilter
+	// rules, since the rules of the compiled lists aren't seen by
+	// urlfilter.
+	disabled map[string]struct{}
+}
+
+// NewEngine returns a new engine built from lists and userRules.  userRules are
+// the blocking rules with UserRulesID as the filter list ID.
+func NewEngine(lists []List, userRules []string) (e *Engine, err error) {
+	e = &Engine{
+		disabled: map[string]struct{}{},
+	}
+	defer func() {
+		if err != nil {
+			e.closeCompiled()
+		}
+	}()
+
+	var block, allow []filterlist.RuleList
+	for _, l := range lists {
+		var rl filterlist.RuleList
+		rl, err = e.newRuleList(l)
+		if err != nil {
+			return nil, err
+		}
+
+		if l.Allowlist {
+			allow = append(allow, rl)
+		} else {
+			block = append(block, rl)
+		}
+	}
+
+	if len(userRules) > 0 {
+		text := strings.Join(userRules, "\n")
+		badfilterTargets(text, e.disabled)
+		block = append(block, &filterlist.StringRuleList{
+			ID:             UserRulesID,
+			RulesText:      text,
+			IgnoreCosmetic: true,
+		})
+	}
+
+	e.blockStorage, err = filterlist.NewRuleStorage(block)
+	if err != nil {
+		return nil, fmt.Errorf("creating rule storage: %w", err)
+	}
+
+	e.allowStorage, err = filterlist.NewRuleStorage(allow)
+	if err != nil {
+		_ = e.blockStorage.Close()
+
+		return nil, fmt.Errorf("creating allowlist rule storage: %w", err)
+	}
+
+	e.block = urlfilter.NewDNSEngine(e.blockStorage)
+	e.allow = urlfilter.NewDNSEngine(e.allowStorage)
+
+	return e, nil
+}
+
+// newRuleList returns the rule list for l.  If l is compiled, the rule list
+// only contains the rules which aren't matched via the index.
+func (e *Engine) newRuleList(l List) (rl filterlist.RuleList, err error) {
+	if l.FilePath == "" {
+		text := string(l.Data)
+		badfilterTargets(text, e.disabled)
+
+		return &filterlist.StringRuleList{
+			ID:             int(l.ID),
+			RulesText:      text,
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	if _, err = os.Stat(l.FilePath); err != nil {
+		return &filterlist.StringRuleList{
+			ID:             int(l.ID),
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	if l.IndexPath != "" && !l.Allowlist && compiledSupported {
+		var cl *compiledList
+		cl, err = openCompiledList(int(l.ID), l.FilePath, l.IndexPath)
+		if err != nil {
+			return nil, fmt.Errorf("compiling %s: %w", l.FilePath, err)
+		}
+
+		e.compiled = append(e.compiled, cl)
+
+		var text string
+		text, err = cl.otherRules()
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", l.FilePath, err)
+		}
+
+		badfilterTargets(text, e.disabled)
+
+		return &filterlist.StringRuleList{
+			ID:             int(l.ID),
+			RulesText:      text,
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	if runtime.GOOS == "windows" {
+		// On Windows we don't pass a file to urlfilter because it's
+		// difficult to update this file while it's being used.
+		var data []byte
+		data, err = ioutil.ReadFile(l.FilePath)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", l.FilePath, err)
+		}
+
+		return &filterlist.StringRuleList{
+			ID:             int(l.ID),
+			RulesText:      string(data),
+			IgnoreCosmetic: true,
+		}, nil
+	}
+
+	rl, err = filterlist.NewFileRuleList(int(l.ID), l.FilePath, true)
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", l.FilePath, err)
+	}
+
+	return rl, nil
+}
+
+// closeCompiled closes the files of the compiled lists.
+func (e *Engine) closeCompiled() (err error) {
+	for _, cl := range e.compiled {
+		cerr := cl.close()
+		if err == nil {
+			err = cerr
+		}
+	}
+
+	e.compiled = nil
+
+	return err
+}
+
+// Close closes the files of the lists.  e mustn't be used after that.
+func (e *Engine) Close() (err error) {
+	err = e.closeCompiled()
+	if err != nil {
+		return fmt.Errorf("closing compiled lists: %w", err)
+	}
+
+	err = e.blockStorage.Close()
+	if err != nil {
+		return fmt.Errorf("closing rule storage: %w", err)
+	}
+
+	err = e.allowStorage.Close()
+	if err != nil {
+		return fmt.Errorf("closing allowlist rule storage: %w", err)
+	}
+
+	return nil
+}
+
+// Match matches the lowercased host, requested with the question of type
+// qtype, against the rules.  cli may be nil.  The allowlists have priority
+// over the other lists.  If no rule matches and cli enforces the safe search,
+// the search engines are redirected to their safe search versions.
+func (e *Engine) Match(host string, qtype uint16, cli *ClientContext) (res Result, err error) {
+	req := urlfilter.DNSRequest{
+		Hostname: host,
+		DNSType:  qtype,
+	}
+
+	if cli != nil {
+		req.SortedClientTags = cli.Tags
+		req.ClientName = cli.Name
+		if cli.IP != nil {
+			// TODO(e.burkov): Wait for urlfilter update to pass
+			// net.IP.
+			req.ClientIP = cli.IP.String()
+		}
+	}
+
+	if dnsres, ok := e.allow.MatchRequest(req); ok {
+		return allowlistResult(dnsres)
+	}
+
+	dnsres, ok := e.block.MatchRequest(req)
+
+	// Check DNS rewrites first, because the API there is a bit awkward.
+	if dnsr := dnsres.DNSRewrites(); len(dnsr) > 0 {
+		res = rewriteResult(dnsr)
+		if res.Rewrite.CanonName != host {
+			return res, nil
+		}
+
+		// A rewrite of a host to itself.  Go on and try matching
+		// other things.
+	}
+
+	// The exceptions and the other network rules with modifiers are never
+	// compiled, so those matched by urlfilter have priority.
+	if dnsres.NetworkRule == nil && len(e.compiled) > 0 {
+		var compiledOK bool
+		compiledOK, err = e.matchCompiled(host, &dnsres)
+		if err != nil {
+			return Result{}, err
+		}
+
+		ok = ok || compiledOK
+	}
+
+	if !ok {
+		return safeSearchResult(host, cli), nil
+	}
+
+	return blocklistResult(qtype, dnsres), nil
+}
+
+// safeSearchResult returns the result of redirecting host to its safe search
+// version if cli enforces the safe search.  The safe search versions with the
+// IPv4 addresses are returned as the A records regardless of the type of the
+// question.
+func safeSearchResult(host string, cli *ClientContext) (res Result) {
+	if cli == nil || !cli.SafeSearch {
+		return Result{}
+	}
+
+	safe, ok := SafeSearchHost(host)
+	if !ok {
+		return Result{}
+	}
+
+	rw := &Rewrite{}
+	if ip := net.ParseIP(safe).To4(); ip != nil {
+		rw.Response = map[rules.RRType][]rules.RRValue{
+			dns.TypeA: {ip},
+		}
+	} else {
+		rw.CanonName = safe
+	}
+
+	return Result{
+		Rewrite: rw,
+		Reason:  SafeSearch,
+	}
+}
+
+// matchCompiled matches host against the compiled lists and adds the matched
+// rules to dnsres the way urlfilter does: the network rules have priority over
+// the /etc/hosts rules, which are all returned.
+func (e *Engine) matchCompiled(host string, dnsres *urlfilter.DNSResult) (ok bool, err error) {
+	host = strings.ToLower(host)
+
+	for _, cl := range e.compiled {
+		var nr *rules.NetworkRule
+		nr, err = cl.matchNetwork(host, e.disabled)
+		if err != nil {
+			return false, fmt.Errorf("matching list %d: %w", cl.id, err)
+		} else if nr != nil {
+			dnsres.NetworkRule = nr
+
+			return true, nil
+		}
+	}
+
+	for _, cl := range e.compiled {
+		var hrs []*rules.HostRule
+		hrs, err = cl.matchHosts(host)
+		if err != nil {
+			return false, fmt.Errorf("matching list %d: %w", cl.id, err)
+		}
+
+		for _, hr := range hrs {
+			if hr.IP.To4() != nil {
+				dnsres.HostRulesV4 = append(dnsres.HostRulesV4, hr)
+			} else {
+				dnsres.HostRulesV6 = append(dnsres.HostRulesV6, hr)
+			}
+
+			ok = true
+		}
+	}
+
+	return ok, nil
+}
+
+// newResult returns a result with a single matched rule.
+func newResult(rule rules.Rule, reason Reason) (res Result) {
+	return Result{
+		Rules: []Rule{{
+			Text:         rule.Text(),
+			FilterListID: int64(rule.GetFilterListID()),
+		}},
+		Reason: reason,
+	}
+}
+
+// allowlistResult returns the result of a match by an allowlist.
+func allowlistResult(dnsres urlfilter.DNSResult) (res Result, err error) {
+	var rule rules.Rule
+	if dnsres.NetworkRule != nil {
+		rule = dnsres.NetworkRule
+	} else if len(dnsres.HostRulesV4) > 0 {
+		rule = dnsres.HostRulesV4[0]
+	} else if len(dnsres.HostRulesV6) > 0 {
+		rule = dnsres.HostRulesV6[0]
+	}
+
+	if rule == nil {
+		return Result{}, fmt.Errorf("invalid dns result: rules are empty")
+	}
+
+	return newResult(rule, Allowed), nil
+}
+
+// blocklistResult returns the result of a match by the other lists.
+func blocklistResult(qtype uint16, dnsres urlfilter.DNSResult) (res Result) {
+	if dnsres.NetworkRule != nil {
+		reason := Blocked
+		if dnsres.NetworkRule.Whitelist {
+			reason = Allowed
+		}
+
+		return newResult(dnsres.NetworkRule, reason)
+	}
+
+	if qtype == dns.TypeA && dnsres.HostRulesV4 != nil {
+		rule := dnsres.HostRulesV4[0]
+		res = newResult(rule, Blocked)
+		res.Rules[0].IP = rule.IP.To4()
+
+		return res
+	}
+
+	if qtype == dns.TypeAAAA && dnsres.HostRulesV6 != nil {
+		rule := dnsres.HostRulesV6[0]
+		res = newResult(rule, Blocked)
+		res.Rules[0].IP = rule.IP.To16()
+
+		return res
+	}
+
+	if dnsres.HostRulesV4 != nil || dnsres.HostRulesV6 != nil {
+		// Question type doesn't match the host rules.  Return the first
+		// matched host rule, but without an IP address.
+		var rule rules.Rule
+		if dnsres.HostRulesV4 != nil {
+			rule = dnsres.HostRulesV4[0]
+		} else {
+			rule = dnsres.HostRulesV6[0]
+		}
+
+		res = newResult(rule, Blocked)
+		res.Rules[0].IP = net.IP{}
+
+		return res
+	}
+
+	return Result{}
+}
+
+// rewriteResult returns the result of applying the $dnsrewrite rules in dnsr,
+// which mustn't be empty.
+func rewriteResult(dnsr []*rules.NetworkRule) (res Result) {
+	res = Result{
+		Rewrite: &Rewrite{
+			Response: map[rules.RRType][]rules.RRValue{},
+		},
+		Reason: Rewritten,
+	}
+
+	for _, nr := range dnsr {
+		rule := Rule{
+			Text:         nr.RuleText,
+			FilterListID: int64(nr.GetFilterListID()),
+		}
+
+		dr := nr.DNSRewrite
+		if dr.NewCNAME != "" {
+			// NewCNAME rules have a higher priority than the other
+			// rules.
+			return Result{
+				Rewrite: &Rewrite{
+					CanonName: dr.NewCNAME,
+				},
+				Rules:  []Rule{rule},
+				Reason: Rewritten,
+			}
+		}
+
+		if dr.RCode != dns.RcodeSuccess {
+			// RcodeRefused and other such codes have higher priority.
+			// Return immediately.
+			return Result{
+				Rewrite: &Rewrite{
+					RCode: dr.RCode,
+				},
+				Rules:  []Rule{rule},
+				Reason: Rewritten,
+			}
+		}
+
+		res.Rewrite.Response[dr.RRType] = append(res.Rewrite.Response[dr.RRType], dr.Value)
+		res.Rules = append(res.Rules, rule)
+	}
+
+	return res
+}
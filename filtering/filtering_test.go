@@ -0,0 +1,581 @@
+package filtering
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/urlfilter/rules"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEngine(t testing.TB, lists []List, userRules []string) (e *Engine) {
+	t.Helper()
+
+	e, err := NewEngine(lists, userRules)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, e.Close())
+	})
+
+	return e
+}
+
+func TestEngine_Match(t *testing.T) {
+	const listText = "||blocked.example^\n" +
+		"||allowed.example^\n" +
+		"1.2.3.4 hosts.example\n" +
+		"::1 hosts6.example\n" +
+		"||cname.example^$dnsrewrite=other.example\n" +
+		"||self.example^$dnsrewrite=self.example\n" +
+		"||self.example^\n" +
+		"||refused.example^$dnsrewrite=REFUSED\n" +
+		"||records.example^$dnsrewrite=NOERROR;A;1.2.3.4\n" +
+		"||records.example^$dnsrewrite=NOERROR;A;1.2.3.5\n" +
+		"@@||exception.example^\n" +
+		"||exception.example^\n" +
+		"||ctag.example^$ctag=device_phone\n" +
+		"||client.example^$client=1.2.3.4\n" +
+		"||pixabay.com^\n"
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt")
+	err := ioutil.WriteFile(path, []byte(listText), 0o644)
+	require.NoError(t, err)
+
+	e := newTestEngine(t, []List{{
+		FilePath: path,
+		ID:       1,
+	}, {
+		FilePath: filepath.Join(dir, "missing.txt"),
+		ID:       2,
+	}, {
+		Data:      []byte("||allowed.example^\n"),
+		ID:        3,
+		Allowlist: true,
+	}}, []string{"||user.example^"})
+
+	testCases := []struct {
+		cli   *ClientContext
+		want  Result
+		name  string
+		host  string
+		qtype uint16
+	}{{
+		cli:   nil,
+		want:  Result{},
+		name:  "not_matched",
+		host:  "example.org",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules:  []Rule{{Text: "||blocked.example^", FilterListID: 1}},
+			Reason: Blocked,
+		},
+		name:  "blocked",
+		host:  "sub.blocked.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules:  []Rule{{Text: "||user.example^", FilterListID: UserRulesID}},
+			Reason: Blocked,
+		},
+		name:  "user_rules",
+		host:  "user.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules:  []Rule{{Text: "||allowed.example^", FilterListID: 3}},
+			Reason: Allowed,
+		},
+		name:  "allowlist",
+		host:  "allowed.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules:  []Rule{{Text: "@@||exception.example^", FilterListID: 1}},
+			Reason: Allowed,
+		},
+		name:  "exception",
+		host:  "exception.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules: []Rule{{
+				Text:         "1.2.3.4 hosts.example",
+				IP:           net.IP{1, 2, 3, 4},
+				FilterListID: 1,
+			}},
+			Reason: Blocked,
+		},
+		name:  "hosts",
+		host:  "hosts.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules: []Rule{{
+				Text:         "::1 hosts6.example",
+				IP:           net.IP{},
+				FilterListID: 1,
+			}},
+			Reason: Blocked,
+		},
+		name:  "hosts_other_type",
+		host:  "hosts6.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rewrite: &Rewrite{CanonName: "other.example"},
+			Rules: []Rule{{
+				Text:         "||cname.example^$dnsrewrite=other.example",
+				FilterListID: 1,
+			}},
+			Reason: Rewritten,
+		},
+		name:  "cname",
+		host:  "cname.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rules:  []Rule{{Text: "||self.example^", FilterListID: 1}},
+			Reason: Blocked,
+		},
+		name:  "cname_self",
+		host:  "self.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rewrite: &Rewrite{RCode: dns.RcodeRefused},
+			Rules: []Rule{{
+				Text:         "||refused.example^$dnsrewrite=REFUSED",
+				FilterListID: 1,
+			}},
+			Reason: Rewritten,
+		},
+		name:  "refused",
+		host:  "refused.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: nil,
+		want: Result{
+			Rewrite: &Rewrite{
+				Response: map[rules.RRType][]rules.RRValue{
+					dns.TypeA: {net.IPv4(1, 2, 3, 4), net.IPv4(1, 2, 3, 5)},
+				},
+				RCode: dns.RcodeSuccess,
+			},
+			Rules: []Rule{{
+				Text:         "||records.example^$dnsrewrite=NOERROR;A;1.2.3.4",
+				FilterListID: 1,
+			}, {
+				Text:         "||records.example^$dnsrewrite=NOERROR;A;1.2.3.5",
+				FilterListID: 1,
+			}},
+			Reason: Rewritten,
+		},
+		name:  "records",
+		host:  "records.example",
+		qtype: dns.TypeA,
+	}, {
+		cli:   nil,
+		want:  Result{},
+		name:  "ctag_no_client",
+		host:  "ctag.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			Tags: []string{"device_phone"},
+		},
+		want: Result{
+			Rules: []Rule{{
+				Text:         "||ctag.example^$ctag=device_phone",
+				FilterListID: 1,
+			}},
+			Reason: Blocked,
+		},
+		name:  "ctag",
+		host:  "ctag.example",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			IP: net.IP{1, 2, 3, 4},
+		},
+		want: Result{
+			Rules: []Rule{{
+				Text:         "||client.example^$client=1.2.3.4",
+				FilterListID: 1,
+			}},
+			Reason: Blocked,
+		},
+		name:  "client",
+		host:  "client.example",
+		qtype: dns.TypeA,
+	}, {
+		cli:   nil,
+		want:  Result{},
+		name:  "safesearch_no_client",
+		host:  "www.bing.com",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			SafeSearch: true,
+		},
+		want: Result{
+			Rewrite: &Rewrite{CanonName: "strict.bing.com"},
+			Reason:  SafeSearch,
+		},
+		name:  "safesearch_host",
+		host:  "www.bing.com",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			SafeSearch: true,
+		},
+		want: Result{
+			Rewrite: &Rewrite{
+				Response: map[rules.RRType][]rules.RRValue{
+					dns.TypeA: {net.IP{213, 180, 193, 56}},
+				},
+			},
+			Reason: SafeSearch,
+		},
+		name:  "safesearch_ip",
+		host:  "yandex.ru",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			SafeSearch: true,
+		},
+		want: Result{
+			Rules:  []Rule{{Text: "||pixabay.com^", FilterListID: 1}},
+			Reason: Blocked,
+		},
+		name:  "safesearch_blocked",
+		host:  "pixabay.com",
+		qtype: dns.TypeA,
+	}, {
+		cli: &ClientContext{
+			SafeSearch: true,
+		},
+		want:  Result{},
+		name:  "safesearch_not_engine",
+		host:  "example.org",
+		qtype: dns.TypeA,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			res, merr := e.Match(tc.host, tc.qtype, tc.cli)
+			require.NoError(t, merr)
+
+			assert.Equal(t, tc.want, res)
+		})
+	}
+}
+
+func TestReason_String(t *testing.T) {
+	assert.Equal(t, "Blocked", Blocked.String())
+	assert.Equal(t, "Reason(42)", Reason(42).String())
+}
+
+// benchListSize is the number of rules in the benchmark list.
+const benchListSize = 100_000
+
+// newBenchEngine returns an engine with a large list of rules in a file, like
+// the ones used in production.
+func newBenchEngine(b *testing.B) (e *Engine) {
+	b.Helper()
+
+	sb := &strings.Builder{}
+	for i := 0; i < benchListSize; i++ {
+		_, _ = fmt.Fprintf(sb, "||host%d.example^\n", i)
+	}
+
+	path := filepath.Join(b.TempDir(), "list.txt")
+	err := ioutil.WriteFile(path, []byte(sb.String()), 0o644)
+	require.NoError(b, err)
+
+	return newTestEngine(b, []List{{
+		FilePath: path,
+		ID:       1,
+	}}, []string{"@@||host0.example^"})
+}
+
+func BenchmarkNewEngine(b *testing.B) {
+	sb := &strings.Builder{}
+	for i := 0; i < benchListSize; i++ {
+		_, _ = fmt.Fprintf(sb, "||host%d.example^\n", i)
+	}
+
+	lists := []List{{
+		Data: []byte(sb.String()),
+		ID:   1,
+	}}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		e, err := NewEngine(lists, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+
+		_ = e.Close()
+	}
+}
+
+func BenchmarkEngine_Match(b *testing.B) {
+	e := newBenchEngine(b)
+	cli := &ClientContext{
+		IP: net.IP{1, 2, 3, 4},
+	}
+
+	hosts := []struct {
+		name string
+		host string
+	}{{
+		name: "blocked",
+		host: "sub.host5000.example",
+	}, {
+		name: "not_matched",
+		host: "www.example.org",
+	}}
+
+	for _, h := range hosts {
+		b.Run(h.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := e.Match(h.host, dns.TypeA, cli)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+
+	b.Run("parallel", func(b *testing.B) {
+		b.RunParallel(func(pb *testing.PB) {
+			for pb.Next() {
+				_, _ = e.Match("sub.host5000.example", dns.TypeA, cli)
+			}
+		})
+	})
+}
+
+func TestEngine_Match_compiled(t *testing.T) {
+	const listText = "! Comment\n" +
+		"||blocked.example^\n" +
+		"||Upper.example^\n" +
+		"1.2.3.4 hosts.example hosts-alias.example\n" +
+		"::1 hosts.example\n" +
+		"0.0.0.0 zero.example\n" +
+		"plain.example\n" +
+		"||important.example^$important\n" +
+		"@@||important.example^\n" +
+		"@@||exception.example^\n" +
+		"||exception.example^\n" +
+		"||disabled.example^\n" +
+		"||disabled.example^$badfilter\n" +
+		"||client.example^$client=1.2.3.4\n" +
+		"||self.example^$dnsrewrite=self.example\n" +
+		"||self.example^\n" +
+		"##.banner\n"
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt")
+	err := ioutil.WriteFile(path, []byte(listText), 0o644)
+	require.NoError(t, err)
+
+	userRules := []string{"@@||allowed.blocked.example^", "||user.example^"}
+	plain := newTestEngine(t, []List{{FilePath: path, ID: 1}}, userRules)
+
+	indexPath := filepath.Join(dir, "list.txt.idx")
+	compiled := newTestEngine(t, []List{{FilePath: path, IndexPath: indexPath, ID: 1}}, userRules)
+	if compiledSupported {
+		require.Len(t, compiled.compiled, 1)
+		assert.FileExists(t, indexPath)
+	}
+
+	cli := &ClientContext{IP: net.IP{1, 2, 3, 4}}
+	for _, host := range []string{
+		"example.org",
+		"blocked.example",
+		"sub.blocked.example",
+		"allowed.blocked.example",
+		"upper.example",
+		"hosts.example",
+		"hosts-alias.example",
+		"sub.hosts.example",
+		"zero.example",
+		"plain.example",
+		"important.example",
+		"exception.example",
+		"disabled.example",
+		"client.example",
+		"self.example",
+		"user.example",
+	} {
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			want, merr := plain.Match(host, qtype, cli)
+			require.NoError(t, merr)
+
+			got, merr := compiled.Match(host, qtype, cli)
+			require.NoError(t, merr)
+
+			assert.Equal(t, want, got, "%s %s", host, dns.TypeToString[qtype])
+		}
+	}
+}
+
+func TestOpenCompiledList(t *testing.T) {
+	if !compiledSupported {
+		t.Skip("compiled lists aren't supported")
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "list.txt")
+	indexPath := path + ".idx"
+
+	require.NoError(t, ioutil.WriteFile(path, []byte("||first.example^\n"), 0o644))
+
+	cl, err := openCompiledList(1, path, indexPath)
+	require.NoError(t, err)
+
+	nr, err := cl.matchNetwork("first.example", nil)
+	require.NoError(t, err)
+	require.NotNil(t, nr)
+	assert.Equal(t, "||first.example^", nr.Text())
+	require.NoError(t, cl.close())
+
+	fi, err := os.Stat(indexPath)
+	require.NoError(t, err)
+
+	t.Run("reuse", func(t *testing.T) {
+		cl, err = openCompiledList(1, path, indexPath)
+		require.NoError(t, err)
+		require.NoError(t, cl.close())
+
+		var newFI os.FileInfo
+		newFI, err = os.Stat(indexPath)
+		require.NoError(t, err)
+		assert.Equal(t, fi.ModTime(), newFI.ModTime())
+	})
+
+	t.Run("rebuild", func(t *testing.T) {
+		err = ioutil.WriteFile(path, []byte("||second.example^\n"), 0o644)
+		require.NoError(t, err)
+
+		cl, err = openCompiledList(1, path, indexPath)
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, cl.close()) })
+
+		nr, err = cl.matchNetwork("first.example", nil)
+		require.NoError(t, err)
+		assert.Nil(t, nr)
+
+		nr, err = cl.matchNetwork("sub.second.example", nil)
+		require.NoError(t, err)
+		require.NotNil(t, nr)
+		assert.Equal(t, "||second.example^", nr.Text())
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		require.NoError(t, ioutil.WriteFile(indexPath, []byte("garbage"), 0o644))
+
+		cl, err = openCompiledList(1, path, indexPath)
+		require.NoError(t, err)
+		t.Cleanup(func() { assert.NoError(t, cl.close()) })
+
+		nr, err = cl.matchNetwork("second.example", nil)
+		require.NoError(t, err)
+		assert.NotNil(t, nr)
+	})
+}
+
+// memBenchListSize is the number of rules in the list used to measure the
+// memory used by the engines.
+const memBenchListSize = 2_000_000
+
+// heapInuse returns the number of bytes of the heap in use after a garbage
+// collection.
+func heapInuse() (n uint64) {
+	runtime.GC()
+
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	return ms.HeapInuse
+}
+
+// BenchmarkNewEngine_memory reports the heap used by the engines built from a
+// list of memBenchListSize rules, most of which are simple, with and without
+// compiling it.
+func BenchmarkNewEngine_memory(b *testing.B) {
+	dir := b.TempDir()
+	path := filepath.Join(dir, "list.txt")
+
+	f, err := os.Create(path)
+	require.NoError(b, err)
+
+	w := bufio.NewWriter(f)
+	for i := 0; i < memBenchListSize; i++ {
+		switch i % 10 {
+		case 0:
+			_, _ = fmt.Fprintf(w, "0.0.0.0 host%d.example\n", i)
+		case 1:
+			_, _ = fmt.Fprintf(w, "||host%d.example^$important\n", i)
+		default:
+			_, _ = fmt.Fprintf(w, "||host%d.example^\n", i)
+		}
+	}
+	require.NoError(b, w.Flush())
+	require.NoError(b, f.Close())
+
+	indexPath := filepath.Join(dir, "list.txt.idx")
+	benchCases := []struct {
+		list List
+		name string
+	}{{
+		list: List{FilePath: path, ID: 1},
+		name: "plain",
+	}, {
+		list: List{FilePath: path, IndexPath: indexPath, ID: 1},
+		name: "compiled",
+	}}
+
+	for _, bc := range benchCases {
+		b.Run(bc.name, func(b *testing.B) {
+			var used uint64
+			for i := 0; i < b.N; i++ {
+				before := heapInuse()
+
+				e, nerr := NewEngine([]List{bc.list}, nil)
+				require.NoError(b, nerr)
+
+				_, nerr = e.Match("sub.host5002.example", dns.TypeA, nil)
+				require.NoError(b, nerr)
+
+				used += heapInuse() - before
+				require.NoError(b, e.Close())
+			}
+
+			b.ReportMetric(float64(used)/float64(b.N)/(1<<20), "heap-MB")
+		})
+	}
+}
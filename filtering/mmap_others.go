@@ -0,0 +1,13 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package filtering
+
+// mapFile isn't supported on the current platform.
+func mapFile(path string) (data []byte, unmap func() (err error), err error) {
+	return nil, nil, errorString("mapping files isn't supported")
+}
+
+// compiledSupported is true if the compiled lists may be used on the current
+// platform.  On Windows, the list files must not be kept open, since it's
+// difficult to update them then.
+const compiledSupported = false
@@ -0,0 +1,36 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package filtering
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// mapFile maps the file at path into memory for reading.
+func mapFile(path string) (data []byte, unmap func() (err error), err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	} else if fi.Size() == 0 {
+		return nil, func() (err error) { return nil }, nil
+	}
+
+	data, err = syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, fmt.Errorf("mapping %s: %w", path, err)
+	}
+
+	return data, func() (err error) { return syscall.Munmap(data) }, nil
+}
+
+// compiledSupported is true if the compiled lists may be used on the current
+// platform.
+const compiledSupported = true
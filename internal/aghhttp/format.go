@@ -0,0 +1,95 @@
+package aghhttp
+
+import (
+	"encoding/csv"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Format is the format of the body of a response.
+type Format string
+
+// Format values.
+const (
+	FormatJSON Format = "json"
+	FormatCSV  Format = "csv"
+)
+
+// ResponseFormat returns the format of the response to r.  The "format"
+// parameter from p, if any, overrides the Accept header of r.  The unknown
+// media types in the Accept header are ignored, so JSON is returned unless
+// CSV is preferred explicitly.
+func ResponseFormat(r *http.Request, p *Params) (f Format) {
+	f = FormatJSON
+	if acceptsCSV(r.Header.Get("Accept")) {
+		f = FormatCSV
+	}
+
+	return Format(p.Enum("format", string(f), string(FormatJSON), string(FormatCSV)))
+}
+
+// acceptsCSV returns true if the Accept header value accept prefers CSV over
+// JSON.  The media types matching both of them prefer JSON.
+func acceptsCSV(accept string) (ok bool) {
+	var csvQ, jsonQ float64
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if qs, has := params["q"]; has {
+			q, err = strconv.ParseFloat(qs, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch mt {
+		case "text/csv":
+			if q > csvQ {
+				csvQ = q
+			}
+		case "application/json", "application/*", "*/*":
+			if q > jsonQ {
+				jsonQ = q
+			}
+		}
+	}
+
+	return csvQ > jsonQ
+}
+
+// CSVWriter writes the rows of a CSV response.  The values are quoted when
+// necessary, and the rows are sent as they're written, so that the large
+// responses aren't kept in memory.
+type CSVWriter struct {
+	w *csv.Writer
+}
+
+// NewCSVWriter sets the headers of the CSV response to w and writes the header
+// row with the names of the columns.
+func NewCSVWriter(w http.ResponseWriter, columns ...string) (cw *CSVWriter, err error) {
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+
+	cw = &CSVWriter{
+		w: csv.NewWriter(w),
+	}
+
+	return cw, cw.Write(columns...)
+}
+
+// Write writes a row with the values.
+func (cw *CSVWriter) Write(vals ...string) (err error) {
+	return cw.w.Write(vals)
+}
+
+// Flush writes the buffered rows.  It must be called after the last row.
+func (cw *CSVWriter) Flush() (err error) {
+	cw.w.Flush()
+
+	return cw.w.Error()
+}
@@ -0,0 +1,98 @@
+package aghhttp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseFormat(t *testing.T) {
+	testCases := []struct {
+		name    string
+		accept  string
+		query   string
+		want    Format
+		wantErr bool
+	}{{
+		name:   "none",
+		accept: "",
+		want:   FormatJSON,
+	}, {
+		name:   "csv",
+		accept: "text/csv",
+		want:   FormatCSV,
+	}, {
+		name:   "json",
+		accept: "application/json",
+		want:   FormatJSON,
+	}, {
+		name:   "unknown",
+		accept: "application/xml",
+		want:   FormatJSON,
+	}, {
+		name:   "invalid",
+		accept: "!!!",
+		want:   FormatJSON,
+	}, {
+		name:   "any",
+		accept: "text/csv, */*",
+		want:   FormatJSON,
+	}, {
+		name:   "quality_csv",
+		accept: "application/json;q=0.5, text/csv",
+		want:   FormatCSV,
+	}, {
+		name:   "quality_json",
+		accept: "text/csv;q=0.1, */*;q=0.8",
+		want:   FormatJSON,
+	}, {
+		name:   "param_csv",
+		accept: "application/json",
+		query:  "format=csv",
+		want:   FormatCSV,
+	}, {
+		name:   "param_json",
+		accept: "text/csv",
+		query:  "format=json",
+		want:   FormatJSON,
+	}, {
+		name:    "param_unknown",
+		accept:  "text/csv",
+		query:   "format=xml",
+		want:    FormatCSV,
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/?"+tc.query, nil)
+			r.Header.Set("Accept", tc.accept)
+
+			p := QueryParams(r.URL.Query())
+			assert.Equal(t, tc.want, ResponseFormat(r, p))
+
+			if tc.wantErr {
+				assert.Error(t, p.Err())
+			} else {
+				assert.NoError(t, p.Err())
+			}
+		})
+	}
+}
+
+func TestCSVWriter(t *testing.T) {
+	w := httptest.NewRecorder()
+
+	cw, err := NewCSVWriter(w, "name", "count")
+	require.NoError(t, err)
+
+	require.NoError(t, cw.Write("example.org", "1"))
+	require.NoError(t, cw.Write(`a,"b"`, "2"))
+	require.NoError(t, cw.Flush())
+
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+	assert.Equal(t, "name,count\nexample.org,1\n\"a,\"\"b\"\"\",2\n", w.Body.String())
+}
@@ -0,0 +1,275 @@
+// Package aghhttp contains helpers for the HTTP API handlers.
+package aghhttp
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ParamError is returned when a request parameter is invalid.
+type ParamError struct {
+	// Name is the name of the parameter.
+	Name string
+
+	// Expected describes the expected format of the value.
+	Expected string
+
+	// Value is the invalid value.  It's empty if the parameter is required
+	// but missing.
+	Value string
+}
+
+// Error implements the error interface for *ParamError.
+func (err *ParamError) Error() (msg string) {
+	if err.Value == "" {
+		return fmt.Sprintf("parameter %q is required: expected %s", err.Name, err.Expected)
+	}
+
+	return fmt.Sprintf("parameter %q: expected %s, got %q", err.Name, err.Expected, err.Value)
+}
+
+// Params are the parameters of a request, either from the query string or
+// from a JSON object in the body.  The accessors return the default value if
+// the parameter is missing or invalid.  Only the first error is kept, and it
+// should be checked with Err after all the parameters are read.
+type Params struct {
+	values map[string]string
+	err    error
+}
+
+// QueryParams returns the parameters from the query string q.  Only the first
+// value of each parameter is used.  The empty values are considered missing.
+func QueryParams(q url.Values) (p *Params) {
+	p = &Params{
+		values: make(map[string]string, len(q)),
+	}
+
+	for name, vals := range q {
+		if len(vals) > 0 && vals[0] != "" {
+			p.values[name] = vals[0]
+		}
+	}
+
+	return p
+}
+
+// JSONParams returns the parameters from the JSON object read from r.  The
+// strings are unquoted, and the other values are used as they are in the JSON.
+// The null values are considered missing.
+func JSONParams(r io.Reader) (p *Params, err error) {
+	var obj map[string]json.RawMessage
+	err = json.NewDecoder(r).Decode(&obj)
+	if err != nil {
+		return nil, fmt.Errorf("decoding json object: %w", err)
+	}
+
+	p = &Params{
+		values: make(map[string]string, len(obj)),
+	}
+
+	for name, raw := range obj {
+		s := string(raw)
+		if s == "null" {
+			continue
+		}
+
+		if strings.HasPrefix(s, `"`) {
+			err = json.Unmarshal(raw, &s)
+			if err != nil {
+				return nil, fmt.Errorf("decoding json field %q: %w", name, err)
+			}
+		}
+
+		p.values[name] = s
+	}
+
+	return p, nil
+}
+
+// Err returns the first error encountered by the accessors, if any.  It's
+// always a *ParamError.
+func (p *Params) Err() (err error) {
+	return p.err
+}
+
+// Has returns true if the parameter is present.
+func (p *Params) Has(name string) (ok bool) {
+	_, ok = p.values[name]
+
+	return ok
+}
+
+// Value parses the parameter using parse.  expected describes the expected
+// format of the value and is used in the error.  ok is true if the parameter is
+// present and valid.
+func (p *Params) Value(name, expected string, parse func(s string) (err error)) (ok bool) {
+	s, has := p.values[name]
+	if !has {
+		return false
+	}
+
+	if parse(s) != nil {
+		p.setErr(name, expected, s)
+
+		return false
+	}
+
+	return true
+}
+
+// Required sets an error if any of the parameters is missing.
+func (p *Params) Required(names ...string) {
+	for _, name := range names {
+		if !p.Has(name) {
+			p.setErr(name, "a value", "")
+		}
+	}
+}
+
+// setErr sets the error unless there is one already.
+func (p *Params) setErr(name, expected, val string) {
+	if p.err == nil {
+		p.err = &ParamError{
+			Name:     name,
+			Expected: expected,
+			Value:    val,
+		}
+	}
+}
+
+// String returns the value of the parameter or def.
+func (p *Params) String(name, def string) (v string) {
+	if s, ok := p.values[name]; ok {
+		return s
+	}
+
+	return def
+}
+
+// Bool returns the value of the boolean parameter or def.  The values "true",
+// "1", "yes", "on" and "false", "0", "no", "off" are accepted regardless of
+// the case.
+func (p *Params) Bool(name string, def bool) (v bool) {
+	ok := p.Value(name, "true or false", func(s string) (err error) {
+		switch strings.ToLower(s) {
+		case "true", "1", "yes", "on":
+			v = true
+		case "false", "0", "no", "off":
+			v = false
+		default:
+			return strconv.ErrSyntax
+		}
+
+		return nil
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
+
+// Int returns the value of the integer parameter or def.  The value must be
+// within [min, max].
+func (p *Params) Int(name string, def, min, max int64) (v int64) {
+	expected := fmt.Sprintf("an integer from %d to %d", min, max)
+	ok := p.Value(name, expected, func(s string) (err error) {
+		v, err = strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+
+		if v < min || v > max {
+			return strconv.ErrRange
+		}
+
+		return nil
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
+
+// Enum returns the value of the parameter or def.  The value must be one of
+// valid.
+func (p *Params) Enum(name, def string, valid ...string) (v string) {
+	expected := "one of " + strings.Join(valid, ", ")
+	ok := p.Value(name, expected, func(s string) (err error) {
+		for _, val := range valid {
+			if s == val {
+				v = s
+
+				return nil
+			}
+		}
+
+		return strconv.ErrSyntax
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
+
+// Duration returns the value of the duration parameter, such as "1h30m", or
+// def.  The value mustn't be negative.
+func (p *Params) Duration(name string, def time.Duration) (v time.Duration) {
+	ok := p.Value(name, "a non-negative duration, such as 1h30m", func(s string) (err error) {
+		v, err = time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+
+		if v < 0 {
+			return strconv.ErrRange
+		}
+
+		return nil
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
+
+// IP returns the value of the IP address parameter or def.
+func (p *Params) IP(name string, def net.IP) (v net.IP) {
+	ok := p.Value(name, "an ip address", func(s string) (err error) {
+		v = net.ParseIP(s)
+		if v == nil {
+			return strconv.ErrSyntax
+		}
+
+		return nil
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
+
+// CIDR returns the value of the network parameter in the CIDR notation, such
+// as "192.168.0.0/16", or def.
+func (p *Params) CIDR(name string, def *net.IPNet) (v *net.IPNet) {
+	ok := p.Value(name, "a network in cidr notation", func(s string) (err error) {
+		_, v, err = net.ParseCIDR(s)
+
+		return err
+	})
+	if !ok {
+		return def
+	}
+
+	return v
+}
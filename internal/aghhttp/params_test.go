@@ -0,0 +1,119 @@
+package aghhttp
+
+import (
+	"net"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParams(t *testing.T) {
+	q := url.Values{
+		"bool":     []string{"Yes"},
+		"bad_bool": []string{"maybe"},
+		"int":      []string{"42"},
+		"big_int":  []string{"1000"},
+		"enum":     []string{"append"},
+		"dur":      []string{"1h30m"},
+		"ip":       []string{"1.2.3.4"},
+		"cidr":     []string{"192.168.0.0/16"},
+		"empty":    []string{""},
+	}
+
+	p := QueryParams(q)
+
+	t.Run("valid", func(t *testing.T) {
+		assert.True(t, p.Bool("bool", false))
+		assert.EqualValues(t, 42, p.Int("int", 0, 0, 100))
+		assert.Equal(t, "append", p.Enum("enum", "replace", "replace", "append"))
+		assert.Equal(t, 90*time.Minute, p.Duration("dur", 0))
+		assert.Equal(t, net.IPv4(1, 2, 3, 4), p.IP("ip", nil))
+
+		n := p.CIDR("cidr", nil)
+		require.NotNil(t, n)
+		assert.Equal(t, "192.168.0.0/16", n.String())
+
+		require.NoError(t, p.Err())
+	})
+
+	t.Run("missing", func(t *testing.T) {
+		assert.False(t, p.Has("empty"))
+		assert.True(t, p.Bool("empty", true))
+		assert.EqualValues(t, 5, p.Int("none", 5, 0, 100))
+		assert.Equal(t, "def", p.String("none", "def"))
+
+		require.NoError(t, p.Err())
+	})
+
+	testCases := []struct {
+		get        func(p *Params)
+		name       string
+		wantErrMsg string
+	}{{
+		get:        func(p *Params) { p.Bool("bad_bool", false) },
+		name:       "bool",
+		wantErrMsg: `parameter "bad_bool": expected true or false, got "maybe"`,
+	}, {
+		get:        func(p *Params) { p.Int("big_int", 0, 0, 100) },
+		name:       "int_range",
+		wantErrMsg: `parameter "big_int": expected an integer from 0 to 100, got "1000"`,
+	}, {
+		get:        func(p *Params) { p.Enum("enum", "", "a", "b") },
+		name:       "enum",
+		wantErrMsg: `parameter "enum": expected one of a, b, got "append"`,
+	}, {
+		get:        func(p *Params) { p.IP("cidr", nil) },
+		name:       "ip",
+		wantErrMsg: `parameter "cidr": expected an ip address, got "192.168.0.0/16"`,
+	}, {
+		get:        func(p *Params) { p.Required("none") },
+		name:       "required",
+		wantErrMsg: `parameter "none" is required: expected a value`,
+	}, {
+		get: func(p *Params) {
+			p.Bool("bad_bool", false)
+			p.Int("big_int", 0, 0, 100)
+		},
+		name:       "first",
+		wantErrMsg: `parameter "bad_bool": expected true or false, got "maybe"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tp := QueryParams(q)
+			tc.get(tp)
+
+			err := tp.Err()
+			require.Error(t, err)
+
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+
+			var perr *ParamError
+			assert.ErrorAs(t, err, &perr)
+		})
+	}
+}
+
+func TestJSONParams(t *testing.T) {
+	const data = `{"enabled":true,"interval":90,"mode":"append","dur":"10s",` +
+		`"str_bool":"on","none":null}`
+
+	p, err := JSONParams(strings.NewReader(data))
+	require.NoError(t, err)
+
+	assert.True(t, p.Bool("enabled", false))
+	assert.True(t, p.Bool("str_bool", false))
+	assert.EqualValues(t, 90, p.Int("interval", 0, 1, 90))
+	assert.Equal(t, "append", p.String("mode", ""))
+	assert.Equal(t, 10*time.Second, p.Duration("dur", 0))
+	assert.False(t, p.Has("none"))
+
+	require.NoError(t, p.Err())
+
+	_, err = JSONParams(strings.NewReader(`[1, 2]`))
+	assert.Error(t, err)
+}
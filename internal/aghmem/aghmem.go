@@ -0,0 +1,206 @@
+// Package aghmem contains the utilities for keeping the memory usage of
+// AdGuard Home within the configured budget.
+package aghmem
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Consumer is a subsystem which uses a considerable amount of memory.
+type Consumer interface {
+	// MemUsage returns the estimate of the memory currently used by the
+	// consumer in bytes.
+	MemUsage() (n uint64)
+
+	// ShedMem asks the consumer to free about n bytes of memory.  freed is
+	// the estimate of the memory actually freed.  Consumers which can't
+	// free any memory should return 0.
+	ShedMem(n uint64) (freed uint64)
+}
+
+// Usage is the memory usage of a single consumer.
+type Usage struct {
+	// Name is the name of the consumer.
+	Name string `json:"name"`
+
+	// Bytes is the estimate of the memory used by the consumer.
+	Bytes uint64 `json:"bytes"`
+
+	// Priority is the priority of the consumer.  Consumers with lower
+	// priority are asked to free memory first.
+	Priority int `json:"priority"`
+}
+
+// consumer is a registered Consumer.
+type consumer struct {
+	c    Consumer
+	name string
+	prio int
+}
+
+// Manager keeps the total memory usage of the registered consumers within the
+// budget.  All methods are safe for concurrent use.
+type Manager struct {
+	// mu protects consumers.
+	mu        *sync.Mutex
+	consumers []*consumer
+
+	// done is closed when the manager is closed.
+	done chan struct{}
+
+	// budget is the maximum total memory usage of the consumers in bytes.
+	// Zero means no limit.
+	budget uint64
+}
+
+// NewManager returns a new *Manager with the budget in bytes.  If budget is
+// zero, the memory usage is only reported and never limited.
+func NewManager(budget uint64) (m *Manager) {
+	return &Manager{
+		mu:     &sync.Mutex{},
+		done:   make(chan struct{}),
+		budget: budget,
+	}
+}
+
+// Register adds c to the list of consumers managed by m.  Consumers with lower
+// prio are asked to free memory before the ones with higher prio, and the
+// largest ones go first among the consumers with the same prio.
+func (m *Manager) Register(name string, prio int, c Consumer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.consumers = append(m.consumers, &consumer{
+		c:    c,
+		name: name,
+		prio: prio,
+	})
+}
+
+// Budget returns the memory budget of m in bytes.
+func (m *Manager) Budget() (budget uint64) {
+	return m.budget
+}
+
+// Usage returns the current memory usage of every registered consumer sorted
+// in the order in which they're asked to free memory.
+func (m *Manager) Usage() (u []Usage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cus := m.usage()
+	u = make([]Usage, len(cus))
+	for i, cu := range cus {
+		u[i] = Usage{
+			Name:     cu.name,
+			Bytes:    cu.bytes,
+			Priority: cu.prio,
+		}
+	}
+
+	return u
+}
+
+// consumerUsage is the memory usage of a registered consumer.
+type consumerUsage struct {
+	*consumer
+	bytes uint64
+}
+
+// usage returns the current memory usage of the consumers in the shedding
+// order.  m.mu is expected to be locked.
+func (m *Manager) usage() (cus []consumerUsage) {
+	cus = make([]consumerUsage, len(m.consumers))
+	for i, c := range m.consumers {
+		cus[i] = consumerUsage{
+			consumer: c,
+			bytes:    c.c.MemUsage(),
+		}
+	}
+
+	sort.SliceStable(cus, func(i, j int) (less bool) {
+		if cus[i].prio != cus[j].prio {
+			return cus[i].prio < cus[j].prio
+		}
+
+		return cus[i].bytes > cus[j].bytes
+	})
+
+	return cus
+}
+
+// Check asks the consumers to free memory if their total memory usage exceeds
+// the budget.  freed is the estimate of the memory freed.
+func (m *Manager) Check() (freed uint64) {
+	if m.budget == 0 {
+		return 0
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	cus := m.usage()
+
+	var total uint64
+	for _, cu := range cus {
+		total += cu.bytes
+	}
+
+	if total <= m.budget {
+		return 0
+	}
+
+	excess := total - m.budget
+	log.Debug("aghmem: usage %d exceeds budget %d", total, m.budget)
+
+	for _, cu := range cus {
+		if freed >= excess {
+			break
+		}
+
+		if cu.bytes == 0 {
+			continue
+		}
+
+		n := cu.c.ShedMem(excess - freed)
+		log.Debug("aghmem: %s freed %d bytes", cu.name, n)
+
+		freed += n
+	}
+
+	if freed < excess {
+		log.Info("aghmem: could only free %d of %d bytes", freed, excess)
+	}
+
+	return freed
+}
+
+// Start starts checking the memory usage every ivl in a separate goroutine.
+func (m *Manager) Start(ivl time.Duration) {
+	if m.budget == 0 {
+		return
+	}
+
+	go func() {
+		t := time.NewTicker(ivl)
+		defer t.Stop()
+
+		for {
+			select {
+			case <-t.C:
+				m.Check()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops checking the memory usage.  It must only be called once.
+func (m *Manager) Close() {
+	close(m.done)
+}
@@ -0,0 +1,129 @@
+package aghmem
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testConsumer is a Consumer for tests.
+type testConsumer struct {
+	usage uint64
+	// canShed is the maximum amount of memory the consumer is able to free.
+	canShed uint64
+	// asked is the number of times ShedMem has been called.
+	asked int
+}
+
+// MemUsage implements the Consumer interface for *testConsumer.
+func (c *testConsumer) MemUsage() (n uint64) {
+	return c.usage
+}
+
+// ShedMem implements the Consumer interface for *testConsumer.
+func (c *testConsumer) ShedMem(n uint64) (freed uint64) {
+	c.asked++
+
+	freed = n
+	if freed > c.canShed {
+		freed = c.canShed
+	}
+
+	c.usage -= freed
+	c.canShed -= freed
+
+	return freed
+}
+
+func TestManager_Usage(t *testing.T) {
+	m := NewManager(0)
+
+	m.Register("small", 1, &testConsumer{usage: 10})
+	m.Register("big", 1, &testConsumer{usage: 100})
+	m.Register("first", 0, &testConsumer{usage: 1})
+
+	assert.Equal(t, []Usage{{
+		Name:     "first",
+		Bytes:    1,
+		Priority: 0,
+	}, {
+		Name:     "big",
+		Bytes:    100,
+		Priority: 1,
+	}, {
+		Name:     "small",
+		Bytes:    10,
+		Priority: 1,
+	}}, m.Usage())
+}
+
+func TestManager_Check(t *testing.T) {
+	testCases := []struct {
+		name       string
+		budget     uint64
+		wantFreed  uint64
+		wantLow    uint64
+		wantHigh   uint64
+		wantLAsked int
+		wantHAsked int
+	}{{
+		name:       "no_limit",
+		budget:     0,
+		wantFreed:  0,
+		wantLow:    100,
+		wantHigh:   100,
+		wantLAsked: 0,
+		wantHAsked: 0,
+	}, {
+		name:       "within_budget",
+		budget:     200,
+		wantFreed:  0,
+		wantLow:    100,
+		wantHigh:   100,
+		wantLAsked: 0,
+		wantHAsked: 0,
+	}, {
+		name:       "low_prio_only",
+		budget:     150,
+		wantFreed:  50,
+		wantLow:    50,
+		wantHigh:   100,
+		wantLAsked: 1,
+		wantHAsked: 0,
+	}, {
+		name:       "both",
+		budget:     80,
+		wantFreed:  120,
+		wantLow:    40,
+		wantHigh:   40,
+		wantLAsked: 1,
+		wantHAsked: 1,
+	}, {
+		name:       "not_enough",
+		budget:     10,
+		wantFreed:  120,
+		wantLow:    40,
+		wantHigh:   40,
+		wantLAsked: 1,
+		wantHAsked: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			low := &testConsumer{usage: 100, canShed: 60}
+			high := &testConsumer{usage: 100, canShed: 60}
+
+			m := NewManager(tc.budget)
+			m.Register("high", 1, high)
+			m.Register("low", 0, low)
+
+			require.Equal(t, tc.wantFreed, m.Check())
+
+			assert.Equal(t, tc.wantLow, low.usage)
+			assert.Equal(t, tc.wantHigh, high.usage)
+			assert.Equal(t, tc.wantLAsked, low.asked)
+			assert.Equal(t, tc.wantHAsked, high.asked)
+		})
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"unicode/utf8"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
 	"golang.org/x/net/idna"
@@ -110,6 +111,75 @@ func ValidateDomainName(name string) (err error) {
 	return nil
 }
 
+// CanonicalDomain returns the canonical form of the domain name name, which is
+// lowercased and has no trailing dot, so that "Example.LAN." and "example.lan"
+// are the same name.  The root domain is returned as is.
+func CanonicalDomain(name string) (canon string) {
+	if name != "." {
+		name = strings.TrimSuffix(name, ".")
+	}
+
+	return strings.ToLower(name)
+}
+
+// idnaProfile maps the internationalized domain names the same way for the
+// filtering rules and for the requests.  It's the IDNA2008 lookup mapping of
+// UTS #46, which also lowercases the names and maps the compatibility forms,
+// like the full-width letters.  The underscores, which are common within the
+// blocklists, are allowed.
+var idnaProfile = idna.New(
+	idna.MapForLookup(),
+	idna.StrictDomainName(false),
+	idna.BidiRule(),
+	idna.Transitional(false),
+)
+
+// HasIDN returns true if s contains non-ASCII characters or punycoded labels,
+// so that the domain names within it need the IDNA mapping.
+func HasIDN(s string) (ok bool) {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return true
+		}
+	}
+
+	return strings.Contains(s, "xn--") || strings.Contains(s, "XN--")
+}
+
+// NormalizeDomain returns the canonical form of the domain name name, see
+// CanonicalDomain, with the internationalized labels mapped through IDNA and
+// written in punycode, so that "ПРИМЕР.РФ." and "xn--e1afmkfd.xn--p1ai" are
+// the same name.  err is only returned if name can't be mapped.
+func NormalizeDomain(name string) (norm string, err error) {
+	norm = CanonicalDomain(name)
+	if !HasIDN(norm) {
+		return norm, nil
+	}
+
+	norm, err = idnaProfile.ToASCII(norm)
+	if err != nil {
+		return "", fmt.Errorf("mapping %q: %w", name, err)
+	}
+
+	return norm, nil
+}
+
+// UnicodeDomain returns the Unicode display form of the domain name name with
+// punycoded labels.  name is returned as is if there are no such labels or if
+// they are invalid.
+func UnicodeDomain(name string) (u string) {
+	if !HasIDN(name) {
+		return name
+	}
+
+	u, err := idnaProfile.ToUnicode(name)
+	if err != nil {
+		return name
+	}
+
+	return u
+}
+
 // The maximum lengths of generated hostnames for different IP versions.
 const (
 	ipv4HostnameMaxLen = len("192-168-100-10-")
@@ -145,6 +145,114 @@ func TestValidateDomainName(t *testing.T) {
 	}
 }
 
+func TestCanonicalDomain(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want string
+	}{{
+		in:   "example.lan",
+		want: "example.lan",
+	}, {
+		in:   "example.lan.",
+		want: "example.lan",
+	}, {
+		in:   "Example.LAN.",
+		want: "example.lan",
+	}, {
+		in:   "*.example.lan.",
+		want: "*.example.lan",
+	}, {
+		in:   ".",
+		want: ".",
+	}, {
+		in:   "",
+		want: "",
+	}}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, CanonicalDomain(tc.in), tc.in)
+	}
+}
+
+func TestNormalizeDomain(t *testing.T) {
+	testCases := []struct {
+		name    string
+		in      string
+		want    string
+		wantErr bool
+	}{{
+		name: "ascii",
+		in:   "Example.LAN.",
+		want: "example.lan",
+	}, {
+		name: "unicode",
+		in:   "пример.рф",
+		want: "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "unicode_upper",
+		in:   "ПРИМЕР.РФ.",
+		want: "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "punycode_upper",
+		in:   "XN--E1AFMKFD.XN--P1AI",
+		want: "xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "full_width",
+		in:   "ｅｘａｍｐｌｅ.com",
+		want: "example.com",
+	}, {
+		// The Cyrillic "а" isn't mapped to the Latin "a".
+		name: "homoglyph",
+		in:   "p\u0430ypal.com",
+		want: "xn--pypal-4ve.com",
+	}, {
+		name: "mixed_script",
+		in:   "\u0430\u0440\u0440\u04cf\u0435.com",
+		want: "xn--80ak6aa92e.com",
+	}, {
+		name: "wildcard",
+		in:   "*.пример.рф",
+		want: "*.xn--e1afmkfd.xn--p1ai",
+	}, {
+		name: "underscore",
+		in:   "ad_server.пример.рф",
+		want: "ad_server.xn--e1afmkfd.xn--p1ai",
+	}, {
+		name:    "bad_punycode",
+		in:      "xn--a.com",
+		wantErr: true,
+	}, {
+		name:    "disallowed",
+		in:      "\u2488.com",
+		wantErr: true,
+	}, {
+		name:    "bidi",
+		in:      "\u0627\u0644a.com",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			norm, err := NormalizeDomain(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, norm)
+		})
+	}
+}
+
+func TestUnicodeDomain(t *testing.T) {
+	assert.Equal(t, "пример.рф", UnicodeDomain("xn--e1afmkfd.xn--p1ai"))
+	assert.Equal(t, "p\u0430ypal.com", UnicodeDomain("xn--pypal-4ve.com"))
+	assert.Equal(t, "example.com", UnicodeDomain("example.com"))
+	assert.Equal(t, "xn--a.com", UnicodeDomain("xn--a.com"))
+}
+
 func TestGenerateHostName(t *testing.T) {
 	testCases := []struct {
 		name string
@@ -133,6 +133,8 @@ func (ehc *EtcHostsContainer) Process(host string, qtype uint16) []net.IP {
 	}
 
 	var ipsCopy []net.IP
+	host = CanonicalDomain(host)
+
 	ehc.lock.RLock()
 	defer ehc.lock.RUnlock()
 
@@ -282,6 +284,8 @@ func (ehc *EtcHostsContainer) load(table map[string][]net.IP, tableRev map[strin
 				host = host[:sharp]
 			}
 
+			host = CanonicalDomain(host)
+
 			ehc.updateTable(table, host, ip)
 			ehc.updateTableRev(tableRev, host, ip)
 			if sharp >= 0 {
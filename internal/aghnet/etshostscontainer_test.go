@@ -51,6 +51,7 @@ func TestEtcHostsContainerResolution(t *testing.T) {
 	assertWriting(t, f,
 		"  127.0.0.1   host  localhost # comment \n",
 		"  ::1   localhost#comment  \n",
+		"192.168.1.2 Router.LAN. nas.lan\n",
 	)
 	ehc.Init(f.Name())
 
@@ -69,6 +70,24 @@ func TestEtcHostsContainerResolution(t *testing.T) {
 		assert.Nil(t, ips)
 	})
 
+	t.Run("fqdn", func(t *testing.T) {
+		for _, host := range []string{
+			"router.lan",
+			"router.lan.",
+			"ROUTER.lan",
+			"nas.lan",
+			"nas.lan.",
+		} {
+			ips := ehc.Process(host, dns.TypeA)
+			require.Len(t, ips, 1, host)
+			assert.Equal(t, net.IP{192, 168, 1, 2}, ips[0].To4(), host)
+		}
+
+		names, ok := ehc.List()["192.168.1.2"]
+		require.True(t, ok)
+		assert.Equal(t, []string{"router.lan", "nas.lan"}, names)
+	})
+
 	t.Run("hosts_file", func(t *testing.T) {
 		names, ok := ehc.List()["127.0.0.1"]
 		require.True(t, ok)
@@ -0,0 +1,338 @@
+package aghnet
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The states of an interface in IfaceChange.
+const (
+	IfaceStateAdded   = "added"
+	IfaceStateRemoved = "removed"
+	IfaceStateUp      = "up"
+	IfaceStateDown    = "down"
+)
+
+// IfaceChange is a change of a network interface.
+type IfaceChange struct {
+	// Iface is the name of the interface.
+	Iface string `json:"iface"`
+
+	// State is one of the IfaceState* constants, if the interface has
+	// appeared, disappeared, or has been brought up or down.
+	State string `json:"state,omitempty"`
+
+	// Added are the IP addresses, which the interface has got.
+	Added []string `json:"added,omitempty"`
+
+	// Removed are the IP addresses, which the interface has lost.
+	Removed []string `json:"removed,omitempty"`
+}
+
+// ifaceState is the state of a network interface.
+type ifaceState struct {
+	// addrs are the sorted IP addresses of the interface.
+	addrs []string
+
+	up bool
+}
+
+// ifacesSnapshot is the state of all the network interfaces by name.
+type ifacesSnapshot map[string]ifaceState
+
+// snapshotIfaces returns the current state of the network interfaces.
+func snapshotIfaces() (s ifacesSnapshot, err error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("getting network interfaces: %w", err)
+	}
+
+	s = make(ifacesSnapshot, len(ifaces))
+	for _, iface := range ifaces {
+		var addrs []net.Addr
+		addrs, err = iface.Addrs()
+		if err != nil {
+			return nil, fmt.Errorf("getting addresses for %q: %w", iface.Name, err)
+		}
+
+		st := ifaceState{
+			up: iface.Flags&net.FlagUp != 0,
+		}
+
+		for _, a := range addrs {
+			if ipnet, ok := a.(*net.IPNet); ok {
+				st.addrs = append(st.addrs, ipnet.IP.String())
+			}
+		}
+
+		sort.Strings(st.addrs)
+		s[iface.Name] = st
+	}
+
+	return s, nil
+}
+
+// diffAddrs returns the addresses of cur missing from prev and vice versa.
+// Both must be sorted.
+func diffAddrs(prev, cur []string) (added, removed []string) {
+	prevSet := aghstrings.NewSet(prev...)
+	curSet := aghstrings.NewSet(cur...)
+	for _, a := range cur {
+		if !prevSet.Has(a) {
+			added = append(added, a)
+		}
+	}
+
+	for _, a := range prev {
+		if !curSet.Has(a) {
+			removed = append(removed, a)
+		}
+	}
+
+	return added, removed
+}
+
+// diffIfaces returns the changes of the interfaces from prev to cur sorted by
+// the name of the interface.
+func diffIfaces(prev, cur ifacesSnapshot) (changes []IfaceChange) {
+	for name, st := range cur {
+		prevSt, ok := prev[name]
+
+		c := IfaceChange{Iface: name}
+		switch {
+		case !ok:
+			c.State = IfaceStateAdded
+		case st.up && !prevSt.up:
+			c.State = IfaceStateUp
+		case !st.up && prevSt.up:
+			c.State = IfaceStateDown
+		default:
+			// Go on.
+		}
+
+		c.Added, c.Removed = diffAddrs(prevSt.addrs, st.addrs)
+		if c.State != "" || len(c.Added) != 0 || len(c.Removed) != 0 {
+			changes = append(changes, c)
+		}
+	}
+
+	for name, st := range prev {
+		if _, ok := cur[name]; !ok {
+			changes = append(changes, IfaceChange{
+				Iface:   name,
+				State:   IfaceStateRemoved,
+				Removed: st.addrs,
+			})
+		}
+	}
+
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].Iface < changes[j].Iface
+	})
+
+	return changes
+}
+
+// ifaceNotifier signals that the network interfaces may have changed.
+type ifaceNotifier interface {
+	// events returns the channel, which receives a value each time the
+	// interfaces may have changed.
+	events() (ch <-chan struct{})
+
+	// close stops the notifier.
+	close() (err error)
+}
+
+// pollNotifier is an ifaceNotifier, which signals periodically.  It's used
+// where the notifications of the operating system aren't supported.
+type pollNotifier struct {
+	ticker *time.Ticker
+	ch     chan struct{}
+	done   chan struct{}
+}
+
+// newPollNotifier returns a new notifier, which signals each ivl.
+func newPollNotifier(ivl time.Duration) (n *pollNotifier) {
+	n = &pollNotifier{
+		ticker: time.NewTicker(ivl),
+		ch:     make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+
+	go n.poll()
+
+	return n
+}
+
+// poll forwards the ticks of n.ticker until n is closed.
+func (n *pollNotifier) poll() {
+	defer agherr.LogPanic("ifacewatch: polling")
+
+	for {
+		select {
+		case <-n.ticker.C:
+			signalIfaces(n.ch)
+		case <-n.done:
+			return
+		}
+	}
+}
+
+// events implements the ifaceNotifier interface for *pollNotifier.
+func (n *pollNotifier) events() (ch <-chan struct{}) {
+	return n.ch
+}
+
+// close implements the ifaceNotifier interface for *pollNotifier.
+func (n *pollNotifier) close() (err error) {
+	n.ticker.Stop()
+	close(n.done)
+
+	return nil
+}
+
+// signalIfaces sends a signal into ch unless there is one pending already.
+func signalIfaces(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// IfaceWatcherConfig is the configuration of an IfaceWatcher.
+type IfaceWatcherConfig struct {
+	// OnChange is called with the changes of the interfaces.  It must not
+	// be nil.
+	OnChange func(changes []IfaceChange)
+
+	// Debounce is the period without further notifications, after which
+	// the changes are reported, so that a flapping interface is only
+	// reported once it settles or once MaxDelay passes.
+	Debounce time.Duration
+
+	// MaxDelay is the longest period for which the changes may be delayed
+	// by the notifications.
+	MaxDelay time.Duration
+
+	// PollIvl is the interval of the checks of the interfaces, where the
+	// notifications of the operating system aren't supported.
+	PollIvl time.Duration
+}
+
+// IfaceWatcher reports the changes of the network interfaces and of their
+// addresses.
+type IfaceWatcher struct {
+	conf     IfaceWatcherConfig
+	notifier ifaceNotifier
+
+	// snapshot returns the current state of the interfaces.  It's replaced
+	// in tests.
+	snapshot func() (s ifacesSnapshot, err error)
+
+	// now returns the current time.  It's replaced in tests.
+	now func() (t time.Time)
+
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewIfaceWatcher returns a new watcher of the network interfaces.  It uses
+// the notifications of the operating system, if supported, and polls the
+// interfaces otherwise.
+func NewIfaceWatcher(conf IfaceWatcherConfig) (w *IfaceWatcher) {
+	n, err := newOSIfaceNotifier()
+	if err != nil {
+		log.Info("ifacewatch: falling back to polling: %s", err)
+
+		n = newPollNotifier(conf.PollIvl)
+	}
+
+	return &IfaceWatcher{
+		conf:     conf,
+		notifier: n,
+		snapshot: snapshotIfaces,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start starts watching the interfaces.
+func (w *IfaceWatcher) Start() {
+	prev, err := w.snapshot()
+	if err != nil {
+		log.Error("ifacewatch: %s", err)
+	}
+
+	go w.watch(prev)
+}
+
+// Close stops watching the interfaces.
+func (w *IfaceWatcher) Close() (err error) {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		err = w.notifier.close()
+	})
+
+	return err
+}
+
+// watch reports the changes of the interfaces from the state prev until w is
+// closed.
+func (w *IfaceWatcher) watch(prev ifacesSnapshot) {
+	defer agherr.LogPanic("ifacewatch: watching")
+
+	timer := time.NewTimer(w.conf.Debounce)
+	if !timer.Stop() {
+		<-timer.C
+	}
+	defer timer.Stop()
+
+	var pending bool
+	var pendingSince time.Time
+	for {
+		select {
+		case <-w.notifier.events():
+			now := w.now()
+			if !pending {
+				pending, pendingSince = true, now
+			} else if now.Sub(pendingSince) >= w.conf.MaxDelay {
+				// Let the timer fire, so that the changes of a
+				// flapping interface aren't delayed forever.
+				continue
+			} else if !timer.Stop() {
+				<-timer.C
+			}
+
+			timer.Reset(w.conf.Debounce)
+		case <-timer.C:
+			pending = false
+			prev = w.report(prev)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+// report reports the changes of the interfaces since the state prev and
+// returns the current state.
+func (w *IfaceWatcher) report(prev ifacesSnapshot) (cur ifacesSnapshot) {
+	cur, err := w.snapshot()
+	if err != nil {
+		log.Error("ifacewatch: %s", err)
+
+		return prev
+	}
+
+	if changes := diffIfaces(prev, cur); len(changes) != 0 {
+		w.conf.OnChange(changes)
+	}
+
+	return cur
+}
@@ -0,0 +1,66 @@
+// +build linux
+
+package aghnet
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// netlinkNotifier is an ifaceNotifier, which receives the notifications about
+// the links and the addresses from the kernel.
+type netlinkNotifier struct {
+	conn *netlink.Conn
+	ch   chan struct{}
+}
+
+// newOSIfaceNotifier returns a new netlink notifier.
+func newOSIfaceNotifier() (n ifaceNotifier, err error) {
+	conn, err := netlink.Dial(unix.NETLINK_ROUTE, &netlink.Config{
+		Groups: unix.RTMGRP_LINK | unix.RTMGRP_IPV4_IFADDR | unix.RTMGRP_IPV6_IFADDR,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("dialing netlink: %w", err)
+	}
+
+	nn := &netlinkNotifier{
+		conn: conn,
+		ch:   make(chan struct{}, 1),
+	}
+
+	go nn.receive()
+
+	return nn, nil
+}
+
+// receive signals on each message from the kernel until n is closed.
+func (n *netlinkNotifier) receive() {
+	defer agherr.LogPanic("ifacewatch: netlink")
+
+	for {
+		_, err := n.conn.Receive()
+		if err != nil {
+			// The error is returned once the connection is closed
+			// as well.
+			log.Debug("ifacewatch: receiving from netlink: %s", err)
+
+			return
+		}
+
+		signalIfaces(n.ch)
+	}
+}
+
+// events implements the ifaceNotifier interface for *netlinkNotifier.
+func (n *netlinkNotifier) events() (ch <-chan struct{}) {
+	return n.ch
+}
+
+// close implements the ifaceNotifier interface for *netlinkNotifier.
+func (n *netlinkNotifier) close() (err error) {
+	return n.conn.Close()
+}
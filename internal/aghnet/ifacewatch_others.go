@@ -0,0 +1,13 @@
+// +build !linux
+
+package aghnet
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+)
+
+// newOSIfaceNotifier returns an error, since the notifications about the
+// network interfaces aren't supported, so that they are polled instead.
+func newOSIfaceNotifier() (n ifaceNotifier, err error) {
+	return nil, agherr.Error("interface notifications are not supported on this platform")
+}
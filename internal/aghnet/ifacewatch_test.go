@@ -0,0 +1,111 @@
+package aghnet
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffIfaces(t *testing.T) {
+	prev := ifacesSnapshot{
+		"eth0":  {addrs: []string{"192.168.0.2", "fe80::1"}, up: true},
+		"eth1":  {addrs: []string{"10.0.0.2"}, up: true},
+		"wlan0": {up: true},
+		"lo":    {addrs: []string{"127.0.0.1"}, up: true},
+	}
+	cur := ifacesSnapshot{
+		"eth0":  {addrs: []string{"192.168.0.3", "fe80::1"}, up: true},
+		"wlan0": {up: false},
+		"lo":    {addrs: []string{"127.0.0.1"}, up: true},
+		"tun0":  {addrs: []string{"10.8.0.1"}, up: true},
+	}
+
+	assert.Equal(t, []IfaceChange{{
+		Iface:   "eth0",
+		Added:   []string{"192.168.0.3"},
+		Removed: []string{"192.168.0.2"},
+	}, {
+		Iface:   "eth1",
+		State:   IfaceStateRemoved,
+		Removed: []string{"10.0.0.2"},
+	}, {
+		Iface: "tun0",
+		State: IfaceStateAdded,
+		Added: []string{"10.8.0.1"},
+	}, {
+		Iface: "wlan0",
+		State: IfaceStateDown,
+	}}, diffIfaces(prev, cur))
+
+	assert.Empty(t, diffIfaces(cur, cur))
+}
+
+// testNotifier is an ifaceNotifier for tests.
+type testNotifier struct {
+	ch chan struct{}
+}
+
+// events implements the ifaceNotifier interface for *testNotifier.
+func (n *testNotifier) events() (ch <-chan struct{}) { return n.ch }
+
+// close implements the ifaceNotifier interface for *testNotifier.
+func (n *testNotifier) close() (err error) { return nil }
+
+func TestIfaceWatcher_debounce(t *testing.T) {
+	const debounce = 50 * time.Millisecond
+
+	var mu sync.Mutex
+	up := true
+	snapshot := func() (s ifacesSnapshot, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return ifacesSnapshot{"eth0": {up: up}}, nil
+	}
+
+	reported := make(chan []IfaceChange, 10)
+	n := &testNotifier{ch: make(chan struct{})}
+	w := &IfaceWatcher{
+		conf: IfaceWatcherConfig{
+			OnChange: func(changes []IfaceChange) { reported <- changes },
+			Debounce: debounce,
+			MaxDelay: time.Hour,
+		},
+		notifier: n,
+		snapshot: snapshot,
+		now:      time.Now,
+		done:     make(chan struct{}),
+	}
+
+	w.Start()
+	t.Cleanup(func() { require.NoError(t, w.Close()) })
+
+	// Flap the interface, so that it ends up down.
+	for i := 0; i < 5; i++ {
+		mu.Lock()
+		up = !up
+		mu.Unlock()
+
+		n.ch <- struct{}{}
+	}
+
+	select {
+	case changes := <-reported:
+		assert.Equal(t, []IfaceChange{{Iface: "eth0", State: IfaceStateDown}}, changes)
+	case <-time.After(10 * debounce):
+		t.Fatal("no changes reported")
+	}
+
+	// Nothing is reported once the interface is back in the reported
+	// state.
+	n.ch <- struct{}{}
+
+	select {
+	case changes := <-reported:
+		t.Fatalf("unexpected changes: %v", changes)
+	case <-time.After(3 * debounce):
+	}
+}
@@ -0,0 +1,292 @@
+package aghnet
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// OutboundPurpose is the purpose of the connections to the external hosts,
+// which AdGuard Home makes on its own.
+type OutboundPurpose string
+
+// OutboundPurpose values.
+const (
+	OutboundFilters      OutboundPurpose = "filters"
+	OutboundUpdates      OutboundPurpose = "updates"
+	OutboundWebhooks     OutboundPurpose = "webhooks"
+	OutboundWHOIS        OutboundPurpose = "whois"
+	OutboundSafeBrowsing OutboundPurpose = "safebrowsing"
+	OutboundParental     OutboundPurpose = "parental"
+)
+
+// OutboundPurposes are all the OutboundPurpose values.
+var OutboundPurposes = []OutboundPurpose{
+	OutboundFilters,
+	OutboundUpdates,
+	OutboundWebhooks,
+	OutboundWHOIS,
+	OutboundSafeBrowsing,
+	OutboundParental,
+}
+
+// ErrOutboundDisabled is returned when the connections for a purpose are
+// disabled.
+const ErrOutboundDisabled agherr.Error = "outbound connections disabled"
+
+// OutboundDestination is an external host contacted for a purpose.
+type OutboundDestination struct {
+	// LastContact is the time of the last connection to the host.  It's
+	// zero if there have been none.
+	LastContact time.Time
+
+	// Purpose is the purpose of the connections.
+	Purpose OutboundPurpose
+
+	// Host is the hostname or the IP address of the host.
+	Host string
+
+	// Contacts is the number of the connections to the host.
+	Contacts uint64
+
+	// Refused is the number of the connections refused since either the
+	// purpose or the host is disabled.
+	Refused uint64
+}
+
+// outboundKey identifies an OutboundDestination.
+type outboundKey struct {
+	purpose OutboundPurpose
+	host    string
+}
+
+// Outbound controls and records the connections to the external hosts, which
+// AdGuard Home makes on its own, such as the filter list downloads and the
+// update checks.  The connections to the upstream DNS servers aren't
+// controlled.  A nil *Outbound allows everything and records nothing.
+type Outbound struct {
+	// mu protects all the fields.
+	mu sync.Mutex
+
+	// disabled are the disabled purposes.
+	disabled map[OutboundPurpose]bool
+
+	// disabledHosts are the hosts, which are disabled for all purposes.
+	disabledHosts map[string]bool
+
+	// dests are the destinations by their purposes and hosts.
+	dests map[outboundKey]*OutboundDestination
+
+	// offline disables all the purposes.
+	offline bool
+}
+
+// NewOutbound returns a new *Outbound allowing everything.
+func NewOutbound() (o *Outbound) {
+	return &Outbound{
+		disabled:      map[OutboundPurpose]bool{},
+		disabledHosts: map[string]bool{},
+		dests:         map[outboundKey]*OutboundDestination{},
+	}
+}
+
+// SetConfig disables the purposes in disabled and the hosts in disabledHosts,
+// or everything if offline is true.
+func (o *Outbound) SetConfig(offline bool, disabled []OutboundPurpose, disabledHosts []string) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.offline = offline
+	o.disabled = make(map[OutboundPurpose]bool, len(disabled))
+	for _, p := range disabled {
+		o.disabled[p] = true
+	}
+
+	o.disabledHosts = make(map[string]bool, len(disabledHosts))
+	for _, h := range disabledHosts {
+		o.disabledHosts[strings.ToLower(h)] = true
+	}
+}
+
+// Allowed returns true if the connections to host for p are allowed.  host
+// may be empty, and then only p is checked.
+func (o *Outbound) Allowed(p OutboundPurpose, host string) (ok bool) {
+	if o == nil {
+		return true
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return o.allowedLocked(p, strings.ToLower(host))
+}
+
+// allowedLocked returns true if the connections to the lowercased host for p
+// are allowed.  o.mu is expected to be locked.
+func (o *Outbound) allowedLocked(p OutboundPurpose, host string) (ok bool) {
+	return !o.offline && !o.disabled[p] && !o.disabledHosts[host]
+}
+
+// destLocked returns the destination for p and host, creating it if
+// necessary.  o.mu is expected to be locked.
+func (o *Outbound) destLocked(p OutboundPurpose, host string) (d *OutboundDestination) {
+	k := outboundKey{purpose: p, host: strings.ToLower(host)}
+	d, ok := o.dests[k]
+	if !ok {
+		d = &OutboundDestination{
+			Purpose: p,
+			Host:    k.host,
+		}
+		o.dests[k] = d
+	}
+
+	return d
+}
+
+// Expect adds host to the destinations of p, if it isn't there, so that it's
+// reported before it's contacted.
+func (o *Outbound) Expect(p OutboundPurpose, host string) {
+	if o == nil || host == "" {
+		return
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.destLocked(p, host)
+}
+
+// Check returns an error if the connection to host for p isn't allowed and
+// records the connection otherwise.  host may also contain a port or be a URL.
+// The returned error is ErrOutboundDisabled wrapped.
+func (o *Outbound) Check(p OutboundPurpose, host string) (err error) {
+	if o == nil {
+		return nil
+	}
+
+	host = outboundHost(host)
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	d := o.destLocked(p, host)
+	if !o.allowedLocked(p, d.Host) {
+		d.Refused++
+		log.Debug("outbound: refusing connection to %s for %s", host, p)
+
+		return fmt.Errorf("%s to %s: %w", p, host, ErrOutboundDisabled)
+	}
+
+	d.Contacts++
+	d.LastContact = time.Now()
+
+	return nil
+}
+
+// outboundHost returns the hostname from addr, which may be a hostname, a
+// host and a port, or a URL.
+func outboundHost(addr string) (host string) {
+	if strings.Contains(addr, "://") {
+		if u, err := url.Parse(addr); err == nil {
+			return u.Hostname()
+		}
+	}
+
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+
+	return addr
+}
+
+// Destinations returns the copies of all the destinations sorted by the
+// purpose and the host.
+func (o *Outbound) Destinations() (dests []*OutboundDestination) {
+	if o == nil {
+		return nil
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	dests = make([]*OutboundDestination, 0, len(o.dests))
+	for _, d := range o.dests {
+		cp := *d
+		dests = append(dests, &cp)
+	}
+
+	sort.Slice(dests, func(i, j int) (less bool) {
+		a, b := dests[i], dests[j]
+		if a.Purpose != b.Purpose {
+			return a.Purpose < b.Purpose
+		}
+
+		return a.Host < b.Host
+	})
+
+	return dests
+}
+
+// DialContextFunc is the signature of the DialContext functions.
+type DialContextFunc = func(ctx context.Context, network, addr string) (conn net.Conn, err error)
+
+// DialContext returns the dial function checking the connections made with
+// dial for p.
+func (o *Outbound) DialContext(p OutboundPurpose, dial DialContextFunc) (checked DialContextFunc) {
+	return func(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+		err = o.Check(p, addr)
+		if err != nil {
+			return nil, err
+		}
+
+		return dial(ctx, network, addr)
+	}
+}
+
+// outboundTransport is an http.RoundTripper checking the requests for a
+// purpose.
+type outboundTransport struct {
+	o       *Outbound
+	rt      http.RoundTripper
+	purpose OutboundPurpose
+}
+
+// type check
+var _ http.RoundTripper = (*outboundTransport)(nil)
+
+// RoundTrip implements the http.RoundTripper interface for *outboundTransport.
+func (t *outboundTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	err = t.o.Check(t.purpose, req.URL.Hostname())
+	if err != nil {
+		return nil, err
+	}
+
+	return t.rt.RoundTrip(req)
+}
+
+// HTTPClient returns a copy of c, which checks the requests made with it for
+// p, including the redirects.  The default transport is used if c has none.
+func (o *Outbound) HTTPClient(p OutboundPurpose, c *http.Client) (checked *http.Client) {
+	cp := *c
+	rt := cp.Transport
+	if rt == nil {
+		rt = http.DefaultTransport
+	}
+
+	cp.Transport = &outboundTransport{
+		o:       o,
+		rt:      rt,
+		purpose: p,
+	}
+
+	return &cp
+}
@@ -0,0 +1,113 @@
+package aghnet
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOutbound_Check(t *testing.T) {
+	o := NewOutbound()
+
+	o.Expect(OutboundFilters, "Filters.example")
+	require.NoError(t, o.Check(OutboundFilters, "https://filters.example/list.txt"))
+	require.NoError(t, o.Check(OutboundWHOIS, "whois.example:43"))
+
+	o.SetConfig(false, []OutboundPurpose{OutboundWHOIS}, []string{"Blocked.example"})
+
+	assert.True(t, o.Allowed(OutboundFilters, ""))
+	assert.False(t, o.Allowed(OutboundWHOIS, ""))
+	assert.False(t, o.Allowed(OutboundFilters, "blocked.example"))
+
+	err := o.Check(OutboundWHOIS, "whois.example:43")
+	assert.True(t, errors.Is(err, ErrOutboundDisabled))
+
+	err = o.Check(OutboundFilters, "blocked.example")
+	assert.True(t, errors.Is(err, ErrOutboundDisabled))
+
+	dests := o.Destinations()
+	require.Len(t, dests, 3)
+
+	assert.Equal(t, "blocked.example", dests[0].Host)
+	assert.Equal(t, uint64(0), dests[0].Contacts)
+	assert.Equal(t, uint64(1), dests[0].Refused)
+	assert.True(t, dests[0].LastContact.IsZero())
+
+	assert.Equal(t, "filters.example", dests[1].Host)
+	assert.Equal(t, uint64(1), dests[1].Contacts)
+	assert.False(t, dests[1].LastContact.IsZero())
+
+	assert.Equal(t, OutboundWHOIS, dests[2].Purpose)
+	assert.Equal(t, uint64(1), dests[2].Contacts)
+	assert.Equal(t, uint64(1), dests[2].Refused)
+
+	t.Run("offline", func(t *testing.T) {
+		o.SetConfig(true, nil, nil)
+
+		for _, p := range OutboundPurposes {
+			assert.False(t, o.Allowed(p, ""))
+		}
+
+		err = o.Check(OutboundFilters, "filters.example")
+		assert.True(t, errors.Is(err, ErrOutboundDisabled))
+	})
+
+	t.Run("nil", func(t *testing.T) {
+		var nilOut *Outbound
+
+		assert.True(t, nilOut.Allowed(OutboundFilters, ""))
+		assert.NoError(t, nilOut.Check(OutboundFilters, "filters.example"))
+		assert.Empty(t, nilOut.Destinations())
+	})
+}
+
+func TestOutbound_HTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+
+	o := NewOutbound()
+	c := o.HTTPClient(OutboundUpdates, srv.Client())
+
+	resp, err := c.Get(srv.URL)
+	require.NoError(t, err)
+	require.NoError(t, resp.Body.Close())
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	o.SetConfig(false, []OutboundPurpose{OutboundUpdates}, nil)
+
+	_, err = c.Get(srv.URL)
+	assert.True(t, errors.Is(err, ErrOutboundDisabled))
+
+	dests := o.Destinations()
+	require.Len(t, dests, 1)
+	assert.Equal(t, uint64(1), dests[0].Contacts)
+	assert.Equal(t, uint64(1), dests[0].Refused)
+}
+
+func TestOutbound_DialContext(t *testing.T) {
+	o := NewOutbound()
+	o.SetConfig(false, nil, []string{"whois.example"})
+
+	dialed := false
+	dial := o.DialContext(OutboundWHOIS, func(_ context.Context, _, _ string) (conn net.Conn, err error) {
+		dialed = true
+
+		return nil, nil
+	})
+
+	_, err := dial(context.Background(), "tcp", "whois.example:43")
+	assert.True(t, errors.Is(err, ErrOutboundDisabled))
+	assert.False(t, dialed)
+
+	_, err = dial(context.Background(), "tcp", "other.example:43")
+	assert.NoError(t, err)
+	assert.True(t, dialed)
+}
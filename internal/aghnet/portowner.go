@@ -0,0 +1,18 @@
+package aghnet
+
+// PortOwner is the process which listens on a port.
+type PortOwner struct {
+	// Name is the name of the process' executable.
+	Name string
+
+	// PID is the ID of the process.
+	PID int
+}
+
+// FindPortOwner returns the process which listens on port with the protocol
+// proto, either "tcp" or "udp".  The process can only be found on some
+// platforms and only if its sockets are visible to the current user, so o is
+// nil and err is not when it can't be found.
+func FindPortOwner(proto string, port int) (o *PortOwner, err error) {
+	return findPortOwner(proto, port)
+}
@@ -0,0 +1,126 @@
+// +build linux
+
+package aghnet
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+)
+
+// The states of the sockets within /proc/net, see include/net/tcp_states.h in
+// the Linux sources.  The unconnected UDP sockets are in the TCP_CLOSE state.
+const (
+	sockStateListen = "0A"
+	sockStateClose  = "07"
+)
+
+// errNoPortOwner is returned when no visible socket listens on the port.
+const errNoPortOwner agherr.Error = "no visible process listens on the port"
+
+func findPortOwner(proto string, port int) (o *PortOwner, err error) {
+	state := sockStateListen
+	if proto == "udp" {
+		state = sockStateClose
+	}
+
+	inodes := map[string]struct{}{}
+	for _, fn := range []string{proto, proto + "6"} {
+		var f *os.File
+		f, err = os.Open(filepath.Join("/proc/net", fn))
+		if err != nil {
+			// IPv6 may be disabled.
+			continue
+		}
+
+		err = procNetInodes(f, port, state, inodes)
+		_ = f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("parsing /proc/net/%s: %w", fn, err)
+		}
+	}
+
+	if len(inodes) == 0 {
+		return nil, errNoPortOwner
+	}
+
+	return socketsOwner(inodes)
+}
+
+// procNetInodes adds to inodes the inodes of the sockets in the /proc/net
+// table from r which are bound to port and are in state.
+func procNetInodes(r io.Reader, port int, state string, inodes map[string]struct{}) (err error) {
+	s := bufio.NewScanner(r)
+
+	// Skip the header.
+	s.Scan()
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+
+		laddr := fields[1]
+		i := strings.LastIndexByte(laddr, ':')
+		if i < 0 || fields[3] != state {
+			continue
+		}
+
+		var p uint64
+		p, err = strconv.ParseUint(laddr[i+1:], 16, 16)
+		if err != nil {
+			return fmt.Errorf("bad local address %q: %w", laddr, err)
+		}
+
+		if int(p) == port && fields[9] != "0" {
+			inodes[fields[9]] = struct{}{}
+		}
+	}
+
+	return s.Err()
+}
+
+// socketsOwner returns the first process which has one of the sockets with
+// inodes open.
+func socketsOwner(inodes map[string]struct{}) (o *PortOwner, err error) {
+	fds, err := filepath.Glob("/proc/[0-9]*/fd/*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fd := range fds {
+		var link string
+		link, err = os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+
+		if _, ok := inodes[strings.TrimSuffix(link[len("socket:["):], "]")]; !ok {
+			continue
+		}
+
+		procDir := filepath.Dir(filepath.Dir(fd))
+		o = &PortOwner{}
+		o.PID, err = strconv.Atoi(filepath.Base(procDir))
+		if err != nil {
+			return nil, err
+		}
+
+		var comm []byte
+		comm, err = ioutil.ReadFile(filepath.Join(procDir, "comm"))
+		if err == nil {
+			o.Name = strings.TrimSpace(string(comm))
+		}
+
+		return o, nil
+	}
+
+	return nil, errNoPortOwner
+}
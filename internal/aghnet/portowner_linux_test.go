@@ -0,0 +1,40 @@
+// +build linux
+
+package aghnet
+
+import (
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcNetInodes(t *testing.T) {
+	const table = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode` + nl +
+		`   0: 00000000:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1001 1 0000000000000000 100 0 0 10 0` + nl +
+		`   1: 0100007F:0035 0100007F:D431 01 00000000:00000000 00:00000000 00000000     0        0 1002 1 0000000000000000 100 0 0 10 0` + nl +
+		`   2: 0100007F:0BB8 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 1003 1 0000000000000000 100 0 0 10 0` + nl +
+		`   3: 0100007F:0035 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 0 1 0000000000000000 100 0 0 10 0` + nl
+
+	inodes := map[string]struct{}{}
+	err := procNetInodes(strings.NewReader(table), 53, sockStateListen, inodes)
+	require.NoError(t, err)
+
+	assert.Equal(t, map[string]struct{}{"1001": {}}, inodes)
+}
+
+func TestFindPortOwner(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	o, err := FindPortOwner("tcp", l.Addr().(*net.TCPAddr).Port)
+	require.NoError(t, err)
+	require.NotNil(t, o)
+
+	assert.Equal(t, os.Getpid(), o.PID)
+	assert.NotEmpty(t, o.Name)
+}
@@ -0,0 +1,12 @@
+// +build !linux
+
+package aghnet
+
+import (
+	"fmt"
+	"runtime"
+)
+
+func findPortOwner(string, int) (o *PortOwner, err error) {
+	return nil, fmt.Errorf("cannot find port owner: not supported on %s", runtime.GOOS)
+}
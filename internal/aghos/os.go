@@ -3,6 +3,7 @@ package aghos
 
 import (
 	"fmt"
+	"os"
 	"os/exec"
 	"syscall"
 )
@@ -24,6 +25,18 @@ func HaveAdminRights() (bool, error) {
 	return haveAdminRights()
 }
 
+// FreeSpace returns the number of bytes available to the unprivileged users on
+// the file system containing path.
+func FreeSpace(path string) (free uint64, err error) {
+	return freeSpace(path)
+}
+
+// FileOwner returns the ID of the user owning the file described by fi.  ok is
+// false if the owners can't be determined on the current platform.
+func FileOwner(fi os.FileInfo) (uid int, ok bool) {
+	return fileOwner(fi)
+}
+
 // SendProcessSignal sends signal to a process.
 func SendProcessSignal(pid int, sig syscall.Signal) error {
 	return sendProcessSignal(pid, sig)
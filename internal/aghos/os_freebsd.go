@@ -27,6 +27,25 @@ func haveAdminRights() (bool, error) {
 	return os.Getuid() == 0, nil
 }
 
+func freeSpace(path string) (free uint64, err error) {
+	var st syscall.Statfs_t
+	err = syscall.Statfs(path, &st)
+	if err != nil {
+		return 0, err
+	}
+
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+func fileOwner(fi os.FileInfo) (uid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return 0, false
+	}
+
+	return int(st.Uid), true
+}
+
 func sendProcessSignal(pid int, sig syscall.Signal) error {
 	return syscall.Kill(pid, sig)
 }
@@ -4,6 +4,7 @@ package aghos
 
 import (
 	"fmt"
+	"os"
 	"syscall"
 
 	"golang.org/x/sys/windows"
@@ -37,6 +38,21 @@ func haveAdminRights() (bool, error) {
 	return true, nil
 }
 
+func freeSpace(path string) (free uint64, err error) {
+	p, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	err = windows.GetDiskFreeSpaceEx(p, &free, nil, nil)
+
+	return free, err
+}
+
+func fileOwner(_ os.FileInfo) (uid int, ok bool) {
+	return 0, false
+}
+
 func sendProcessSignal(pid int, sig syscall.Signal) error {
 	return fmt.Errorf("not supported on Windows")
 }
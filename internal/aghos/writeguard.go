@@ -0,0 +1,141 @@
+package aghos
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ReadOnlyRetryIvl is the minimum interval between the attempts to write the
+// files of a subsystem in the memory-only mode.
+const ReadOnlyRetryIvl = 1 * time.Minute
+
+// IsReadOnly returns true if err is caused by the file system being read-only.
+func IsReadOnly(err error) (ok bool) {
+	return errors.Is(err, syscall.EROFS)
+}
+
+// WriteGuard tracks the writes of the files of a single subsystem.  Once a
+// write fails since the file system is read-only, the subsystem is in the
+// memory-only mode: it keeps the data, which it would write, in memory and
+// only retries writing once in ReadOnlyRetryIvl.  The first successful write
+// ends the mode.
+//
+// A nil *WriteGuard never enters the memory-only mode, so that the failed
+// writes are handled as any other errors.
+type WriteGuard struct {
+	// onChange, if not nil, is called when the subsystem enters or leaves
+	// the memory-only mode.
+	onChange func(name string, memOnly bool)
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// since is the time when the memory-only mode has been entered.
+	since time.Time
+
+	// lastTry is the time of the latest write attempted in the memory-only
+	// mode.
+	lastTry time.Time
+
+	// name is the name of the subsystem used in the log and passed to
+	// onChange.
+	name string
+
+	memOnly bool
+}
+
+// NewWriteGuard returns a new *WriteGuard of the subsystem with name.
+// onChange may be nil.
+func NewWriteGuard(name string, onChange func(name string, memOnly bool)) (g *WriteGuard) {
+	return &WriteGuard{
+		onChange: onChange,
+		name:     name,
+	}
+}
+
+// Name returns the name of the subsystem.
+func (g *WriteGuard) Name() (name string) {
+	if g == nil {
+		return ""
+	}
+
+	return g.name
+}
+
+// Allow returns false if the subsystem is in the memory-only mode and the
+// latest write has been attempted less than ReadOnlyRetryIvl before now.
+func (g *WriteGuard) Allow(now time.Time) (ok bool) {
+	if g == nil {
+		return true
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return !g.memOnly || now.Sub(g.lastTry) >= ReadOnlyRetryIvl
+}
+
+// Report records the result of the write attempted at now.  memOnly is true
+// if the write has failed since the file system is read-only, so that the
+// data must be kept in memory.
+func (g *WriteGuard) Report(err error, now time.Time) (memOnly bool) {
+	if g == nil {
+		return false
+	}
+
+	g.mu.Lock()
+	// Other errors say nothing about the file system being writable
+	// again, so they don't change the mode.
+	memOnly = IsReadOnly(err) || (err != nil && g.memOnly)
+	changed := memOnly != g.memOnly
+	g.memOnly = memOnly
+	g.lastTry = now
+	if changed && memOnly {
+		g.since = now
+	}
+	g.mu.Unlock()
+
+	if !changed {
+		return memOnly
+	}
+
+	if memOnly {
+		log.Error("%s: file system is read-only, keeping data in memory only: %s", g.name, err)
+	} else {
+		log.Info("%s: file system is writable again, data is persisted", g.name)
+	}
+
+	if g.onChange != nil {
+		g.onChange(g.name, memOnly)
+	}
+
+	return memOnly
+}
+
+// MemoryOnly returns true if the subsystem is in the memory-only mode.
+func (g *WriteGuard) MemoryOnly() (ok bool) {
+	ok, _ = g.State()
+
+	return ok
+}
+
+// State returns true and the time the memory-only mode has been entered if the
+// subsystem is in that mode.
+func (g *WriteGuard) State() (memOnly bool, since time.Time) {
+	if g == nil {
+		return false, time.Time{}
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if !g.memOnly {
+		return false, time.Time{}
+	}
+
+	return true, g.since
+}
@@ -0,0 +1,50 @@
+package aghos
+
+import (
+	"fmt"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteGuard(t *testing.T) {
+	var changes []bool
+	g := NewWriteGuard("test", func(name string, memOnly bool) {
+		assert.Equal(t, "test", name)
+		changes = append(changes, memOnly)
+	})
+
+	now := time.Now()
+	assert.True(t, g.Allow(now))
+	assert.False(t, g.Report(assert.AnError, now))
+	assert.False(t, g.MemoryOnly())
+
+	rofs := fmt.Errorf("writing: %w", syscall.EROFS)
+	assert.True(t, g.Report(rofs, now))
+	assert.False(t, g.Allow(now.Add(ReadOnlyRetryIvl/2)))
+	assert.True(t, g.Allow(now.Add(ReadOnlyRetryIvl)))
+
+	memOnly, since := g.State()
+	assert.True(t, memOnly)
+	assert.Equal(t, now, since)
+
+	// Other errors don't end the mode.
+	later := now.Add(ReadOnlyRetryIvl)
+	assert.True(t, g.Report(assert.AnError, later))
+	assert.False(t, g.Allow(later))
+
+	assert.False(t, g.Report(nil, later.Add(ReadOnlyRetryIvl)))
+	assert.False(t, g.MemoryOnly())
+	assert.Equal(t, []bool{true, false}, changes)
+}
+
+func TestWriteGuard_nil(t *testing.T) {
+	var g *WriteGuard
+
+	assert.True(t, g.Allow(time.Now()))
+	assert.False(t, g.Report(syscall.EROFS, time.Now()))
+	assert.False(t, g.MemoryOnly())
+	assert.Empty(t, g.Name())
+}
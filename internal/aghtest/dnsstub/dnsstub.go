@@ -0,0 +1,253 @@
+// Package dnsstub contains a scriptable DNS server used as the upstream server
+// in the integration tests.
+package dnsstub
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/require"
+)
+
+// Response is the scripted response to the queries for a name.
+type Response struct {
+	// Answer are the answer records.  The records with the empty owner
+	// names are sent with the name from the question.
+	Answer []dns.RR
+
+	// Rcode is the response code.
+	Rcode int
+
+	// Delay is the time for which the response is delayed.
+	Delay time.Duration
+
+	// DropEvery, if not zero, makes the server leave every DropEvery-th
+	// query for the name unanswered.  One means that none of the queries
+	// are answered.
+	DropEvery uint32
+
+	// Malformed makes the server respond with the bytes which aren't a valid
+	// DNS message.
+	Malformed bool
+}
+
+// malformedResp is the response sent instead of a DNS message.  It's shorter
+// than the DNS header.
+var malformedResp = []byte{0x00, 0x01, 0x81, 0x80, 0x00}
+
+// Server is a DNS server answering the queries over both UDP and TCP with the
+// scripted responses.  The queries for the names without the responses are
+// answered with NXDOMAIN.  The UDP responses are truncated to the size
+// advertised by the client, so that the client retries over TCP.
+type Server struct {
+	udp *dns.Server
+	tcp *dns.Server
+
+	// mu protects responses and queries.
+	mu        sync.Mutex
+	responses map[string]*Response
+	queries   map[string]uint32
+
+	addr string
+}
+
+// maxListenAttempts is the maximum number of the attempts to listen on the
+// same port over both UDP and TCP.
+const maxListenAttempts = 10
+
+// New returns a new running server listening on the same random port of the
+// loopback interface over both UDP and TCP.  It's shut down in the cleanup of
+// t.
+func New(t testing.TB) (s *Server) {
+	t.Helper()
+
+	s = &Server{
+		responses: map[string]*Response{},
+		queries:   map[string]uint32{},
+	}
+
+	pc, l := listen(t)
+	s.addr = pc.LocalAddr().String()
+
+	s.udp = s.serve(t, &dns.Server{PacketConn: pc})
+	s.tcp = s.serve(t, &dns.Server{Listener: l})
+
+	t.Cleanup(func() {
+		_ = s.udp.Shutdown()
+		_ = s.tcp.Shutdown()
+	})
+
+	return s
+}
+
+// listen returns the UDP and the TCP listeners on the same random port of the
+// loopback interface.
+func listen(t testing.TB) (pc net.PacketConn, l net.Listener) {
+	t.Helper()
+
+	var err error
+	for i := 0; i < maxListenAttempts; i++ {
+		pc, err = net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		l, err = net.Listen("tcp", pc.LocalAddr().String())
+		if err == nil {
+			return pc, l
+		}
+
+		_ = pc.Close()
+	}
+
+	require.NoError(t, err)
+
+	return nil, nil
+}
+
+// serve starts srv with s as the handler and waits until it's started.
+func (s *Server) serve(t testing.TB, srv *dns.Server) (started *dns.Server) {
+	t.Helper()
+
+	ch := make(chan struct{})
+	srv.Handler = s
+	srv.NotifyStartedFunc = func() { close(ch) }
+
+	go func() {
+		_ = srv.ActivateAndServe()
+	}()
+
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("dnsstub: server hasn't started")
+	}
+
+	return srv
+}
+
+// Addr returns the address of s, on which it listens over both UDP and TCP.
+func (s *Server) Addr() (addr string) {
+	return s.addr
+}
+
+// Set scripts the response to the queries for name.  r mustn't be modified
+// after that.
+func (s *Server) Set(name string, r *Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.responses[strings.ToLower(dns.Fqdn(name))] = r
+}
+
+// Queries returns the number of the queries for name received by s, including
+// the unanswered ones.
+func (s *Server) Queries(name string) (n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queries[strings.ToLower(dns.Fqdn(name))]
+}
+
+// response counts the query for name and returns its scripted response along
+// with the number of the queries for name, including this one.
+func (s *Server) response(name string) (r *Response, n uint32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.queries[name]++
+
+	return s.responses[name], s.queries[name]
+}
+
+// type check
+var _ dns.Handler = (*Server)(nil)
+
+// ServeDNS implements the dns.Handler interface for *Server.
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	if len(req.Question) != 1 {
+		dns.HandleFailed(w, req)
+
+		return
+	}
+
+	qname := req.Question[0].Name
+	r, n := s.response(strings.ToLower(qname))
+	if r == nil {
+		_ = w.WriteMsg((&dns.Msg{}).SetRcode(req, dns.RcodeNameError))
+
+		return
+	}
+
+	if r.DropEvery != 0 && n%r.DropEvery == 0 {
+		return
+	}
+
+	time.Sleep(r.Delay)
+
+	if r.Malformed {
+		_, _ = w.Write(malformedResp)
+
+		return
+	}
+
+	resp := (&dns.Msg{}).SetRcode(req, r.Rcode)
+	for _, rr := range r.Answer {
+		rr = dns.Copy(rr)
+		if hdr := rr.Header(); hdr.Name == "" {
+			hdr.Name = qname
+		}
+
+		resp.Answer = append(resp.Answer, rr)
+	}
+
+	if _, ok := w.LocalAddr().(*net.UDPAddr); ok {
+		size := dns.MinMsgSize
+		if opt := req.IsEdns0(); opt != nil {
+			size = int(opt.UDPSize())
+		}
+
+		resp.Truncate(size)
+	}
+
+	_ = w.WriteMsg(resp)
+}
+
+// A returns a new A record with ip and ttl and without the owner name.
+func A(ip net.IP, ttl uint32) (rr dns.RR) {
+	return &dns.A{
+		Hdr: dns.RR_Header{
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		A: ip,
+	}
+}
+
+// AAAA returns a new AAAA record with ip and ttl and without the owner name.
+func AAAA(ip net.IP, ttl uint32) (rr dns.RR) {
+	return &dns.AAAA{
+		Hdr: dns.RR_Header{
+			Rrtype: dns.TypeAAAA,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		AAAA: ip,
+	}
+}
+
+// CNAME returns a new CNAME record with target and ttl and without the owner
+// name.
+func CNAME(target string, ttl uint32) (rr dns.RR) {
+	return &dns.CNAME{
+		Hdr: dns.RR_Header{
+			Rrtype: dns.TypeCNAME,
+			Class:  dns.ClassINET,
+			Ttl:    ttl,
+		},
+		Target: dns.Fqdn(target),
+	}
+}
@@ -0,0 +1,122 @@
+// Package aghtime contains the utilities for the timestamps in the HTTP API and
+// the instance timezone.
+package aghtime
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Layout is the layout of the timestamps in the HTTP API.  It's RFC 3339 with
+// the fractional seconds, if any, and always with a numeric offset, even for
+// UTC.
+const Layout = "2006-01-02T15:04:05.999999999-07:00"
+
+// settings are the instance settings.
+var settings = struct {
+	// mu protects the fields below.
+	mu sync.RWMutex
+
+	// loc is the instance timezone.
+	loc *time.Location
+
+	// legacy is true if the timestamps are formatted as they were before
+	// Layout has been introduced.
+	legacy bool
+}{
+	loc: time.Local,
+}
+
+// LoadLocation returns the location with the IANA name, for example
+// "Europe/Berlin".  The empty name is the local timezone of the system.
+func LoadLocation(name string) (loc *time.Location, err error) {
+	if name == "" {
+		return time.Local, nil
+	}
+
+	loc, err = time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("timezone %q: %w", name, err)
+	}
+
+	return loc, nil
+}
+
+// SetLocation sets the instance timezone used to format the timestamps and to
+// find the boundaries of the days.
+func SetLocation(loc *time.Location) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.loc = loc
+}
+
+// Location returns the instance timezone.
+func Location() (loc *time.Location) {
+	settings.mu.RLock()
+	defer settings.mu.RUnlock()
+
+	return settings.loc
+}
+
+// SetLegacy sets whether the timestamps are formatted as they were before.  The
+// legacy mode is kept for one release only.
+func SetLegacy(legacy bool) {
+	settings.mu.Lock()
+	defer settings.mu.Unlock()
+
+	settings.legacy = legacy
+}
+
+// Format returns t in the instance timezone formatted with Layout.  In the
+// legacy mode, t is formatted as is with legacyLayout.
+func Format(t time.Time, legacyLayout string) (s string) {
+	settings.mu.RLock()
+	defer settings.mu.RUnlock()
+
+	if settings.legacy {
+		return t.Format(legacyLayout)
+	}
+
+	return t.In(settings.loc).Format(Layout)
+}
+
+// Parse parses s, which is either an RFC 3339 timestamp or a number of seconds
+// since the Unix epoch, possibly fractional.
+func Parse(s string) (t time.Time, err error) {
+	if strings.ContainsAny(s, "-:T") {
+		return time.Parse(time.RFC3339Nano, s)
+	}
+
+	sec, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsInf(sec, 0) || math.IsNaN(sec) {
+		return time.Time{}, fmt.Errorf("bad timestamp %q: want rfc 3339 or unix seconds", s)
+	}
+
+	whole, frac := math.Modf(sec)
+
+	return time.Unix(int64(whole), int64(frac*1e9)), nil
+}
+
+// StartOfDay returns the start of the day of t in the instance timezone.
+func StartOfDay(t time.Time) (start time.Time) {
+	t = t.In(Location())
+	y, m, d := t.Date()
+
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// Time is a time.Time encoded into JSON with Format.
+type Time struct {
+	time.Time
+}
+
+// MarshalJSON implements the json.Marshaler interface for Time.
+func (t Time) MarshalJSON() (b []byte, err error) {
+	return json.Marshal(Format(t.Time, time.RFC3339Nano))
+}
@@ -0,0 +1,144 @@
+package aghtime
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// setTestSettings sets the instance settings for the duration of the test.
+func setTestSettings(t *testing.T, loc *time.Location, legacy bool) {
+	t.Helper()
+
+	prevLoc := Location()
+	SetLocation(loc)
+	SetLegacy(legacy)
+	t.Cleanup(func() {
+		SetLocation(prevLoc)
+		SetLegacy(false)
+	})
+}
+
+func TestFormat(t *testing.T) {
+	tm := time.Date(2021, 5, 3, 22, 30, 0, 500_000_000, time.UTC)
+
+	testCases := []struct {
+		name   string
+		loc    *time.Location
+		want   string
+		legacy bool
+	}{{
+		name:   "utc",
+		loc:    time.UTC,
+		want:   "2021-05-03T22:30:00.5+00:00",
+		legacy: false,
+	}, {
+		name:   "offset",
+		loc:    time.FixedZone("", 2*60*60),
+		want:   "2021-05-04T00:30:00.5+02:00",
+		legacy: false,
+	}, {
+		name:   "legacy",
+		loc:    time.FixedZone("", 2*60*60),
+		want:   "2021-05-03T22:30:00Z",
+		legacy: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setTestSettings(t, tc.loc, tc.legacy)
+
+			assert.Equal(t, tc.want, Format(tm, time.RFC3339))
+		})
+	}
+
+	t.Run("json", func(t *testing.T) {
+		setTestSettings(t, time.UTC, false)
+
+		b, err := json.Marshal(struct {
+			T Time `json:"t"`
+		}{
+			T: Time{Time: tm},
+		})
+		require.NoError(t, err)
+
+		assert.Equal(t, `{"t":"2021-05-03T22:30:00.5+00:00"}`, string(b))
+	})
+}
+
+func TestParse(t *testing.T) {
+	want := time.Date(2021, 5, 3, 22, 30, 0, 0, time.UTC)
+
+	testCases := []struct {
+		name    string
+		in      string
+		want    time.Time
+		wantErr bool
+	}{{
+		name:    "rfc3339",
+		in:      "2021-05-04T00:30:00+02:00",
+		want:    want,
+		wantErr: false,
+	}, {
+		name:    "rfc3339_utc",
+		in:      "2021-05-03T22:30:00Z",
+		want:    want,
+		wantErr: false,
+	}, {
+		name:    "unix",
+		in:      "1620081000",
+		want:    want,
+		wantErr: false,
+	}, {
+		name:    "unix_fractional",
+		in:      "1620081000.25",
+		want:    want.Add(250 * time.Millisecond),
+		wantErr: false,
+	}, {
+		name:    "bad",
+		in:      "yesterday",
+		wantErr: true,
+	}, {
+		name:    "bad_date",
+		in:      "2021-05-03",
+		wantErr: true,
+	}, {
+		name:    "empty",
+		in:      "",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := Parse(tc.in)
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.True(t, tc.want.Equal(got), "got %s", got)
+		})
+	}
+}
+
+func TestStartOfDay(t *testing.T) {
+	loc := time.FixedZone("", -5*60*60)
+	setTestSettings(t, loc, false)
+
+	got := StartOfDay(time.Date(2021, 5, 4, 3, 0, 0, 0, time.UTC))
+	assert.True(t, time.Date(2021, 5, 3, 0, 0, 0, 0, loc).Equal(got), "got %s", got)
+}
+
+func TestLoadLocation(t *testing.T) {
+	loc, err := LoadLocation("")
+	require.NoError(t, err)
+	assert.Same(t, time.Local, loc)
+
+	_, err = LoadLocation("No/Such_Zone")
+	assert.Error(t, err)
+}
@@ -0,0 +1,116 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package dhcpd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/mdlayher/ethernet"
+	"github.com/mdlayher/raw"
+)
+
+// The fields of the ARP packets for IPv4 over Ethernet.
+const (
+	arpPacketLen = 28
+
+	arpHTypeEthernet = 1
+	arpOpRequest     = 1
+)
+
+// newARPProbe returns the ARP probe for the target IP address sent from the
+// hardware address mac.  As defined by RFC 5227, the sender IP address of a
+// probe is unspecified, so that the probe doesn't change the ARP caches of
+// other hosts.
+func newARPProbe(mac net.HardwareAddr, target net.IP) (p []byte) {
+	p = make([]byte, arpPacketLen)
+	binary.BigEndian.PutUint16(p[0:2], arpHTypeEthernet)
+	binary.BigEndian.PutUint16(p[2:4], uint16(ethernet.EtherTypeIPv4))
+	p[4], p[5] = 6, 4
+	binary.BigEndian.PutUint16(p[6:8], arpOpRequest)
+	copy(p[8:14], mac)
+	copy(p[24:28], target.To4())
+
+	return p
+}
+
+// arpSender returns the sender hardware address of the ARP packet p if its
+// sender IP address is target.  Both a reply and a probe of another host
+// for target mean that the address is used.
+func arpSender(p []byte, target net.IP) (mac net.HardwareAddr, ok bool) {
+	if len(p) < arpPacketLen ||
+		binary.BigEndian.Uint16(p[0:2]) != arpHTypeEthernet ||
+		binary.BigEndian.Uint16(p[2:4]) != uint16(ethernet.EtherTypeIPv4) ||
+		p[4] != 6 || p[5] != 4 {
+		return nil, false
+	}
+
+	if !bytes.Equal(p[14:18], target.To4()) {
+		return nil, false
+	}
+
+	return net.HardwareAddr(append([]byte(nil), p[8:14]...)), true
+}
+
+// arpProbe sends the ARP probe for target through iface and waits for the
+// answer for timeout.  mac is the hardware address of the device using
+// target, it's nil if there is no answer.
+func arpProbe(iface *net.Interface, target net.IP, timeout time.Duration) (mac net.HardwareAddr, err error) {
+	conn, err := raw.ListenPacket(iface, uint16(ethernet.EtherTypeARP), nil)
+	if err != nil {
+		return nil, fmt.Errorf("listening: %w", err)
+	}
+	defer func() {
+		cerr := conn.Close()
+		if err == nil && cerr != nil {
+			err = fmt.Errorf("closing: %w", cerr)
+		}
+	}()
+
+	f := &ethernet.Frame{
+		Destination: ethernet.Broadcast,
+		Source:      iface.HardwareAddr,
+		EtherType:   ethernet.EtherTypeARP,
+		Payload:     newARPProbe(iface.HardwareAddr, target),
+	}
+
+	data, err := f.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("encoding probe: %w", err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	err = conn.SetReadDeadline(deadline)
+	if err != nil {
+		return nil, fmt.Errorf("setting deadline: %w", err)
+	}
+
+	_, err = conn.WriteTo(data, &raw.Addr{HardwareAddr: ethernet.Broadcast})
+	if err != nil {
+		return nil, fmt.Errorf("sending probe: %w", err)
+	}
+
+	buf := make([]byte, 1500)
+	for {
+		n, _, rerr := conn.ReadFrom(buf)
+		if rerr != nil {
+			if time.Now().Before(deadline) {
+				return nil, fmt.Errorf("reading: %w", rerr)
+			}
+
+			// The deadline is exceeded, so there is no answer.
+			return nil, nil
+		}
+
+		if f.UnmarshalBinary(buf[:n]) != nil || f.EtherType != ethernet.EtherTypeARP {
+			continue
+		}
+
+		if mac, ok := arpSender(f.Payload, target); ok {
+			return mac, nil
+		}
+	}
+}
@@ -0,0 +1,35 @@
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package dhcpd
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestARPSender(t *testing.T) {
+	mac := net.HardwareAddr{0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF}
+	target := net.IP{192, 168, 10, 100}
+
+	// A probe of another host for the same address.
+	probe := newARPProbe(mac, target)
+	_, ok := arpSender(probe, target)
+	assert.False(t, ok)
+
+	reply := make([]byte, len(probe))
+	copy(reply, probe)
+	reply[7] = 2
+	copy(reply[14:18], target)
+
+	got, ok := arpSender(reply, target)
+	assert.True(t, ok)
+	assert.Equal(t, mac, got)
+
+	_, ok = arpSender(reply, net.IP{192, 168, 10, 101})
+	assert.False(t, ok)
+
+	_, ok = arpSender(reply[:20], target)
+	assert.False(t, ok)
+}
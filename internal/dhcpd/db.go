@@ -10,6 +10,7 @@ import (
 	"os"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/google/renameio/maybe"
 )
@@ -21,6 +22,12 @@ type leaseJSON struct {
 	IP       []byte `json:"ip"`
 	Hostname string `json:"host"`
 	Expiry   int64  `json:"exp"`
+
+	Fingerprint *Fingerprint `json:"fp,omitempty"`
+
+	// ConflictHWAddr is the MAC address of the device using the IP address
+	// of an abandoned lease, if known.
+	ConflictHWAddr []byte `json:"cmac,omitempty"`
 }
 
 func normalizeIP(ip net.IP) net.IP {
@@ -68,6 +75,10 @@ func (s *Server) dbLoad() {
 			IP:       obj[i].IP,
 			Hostname: obj[i].Hostname,
 			Expiry:   time.Unix(obj[i].Expiry, 0),
+
+			Fingerprint: obj[i].Fingerprint,
+
+			conflictHWAddr: obj[i].ConflictHWAddr,
 		}
 
 		if len(obj[i].IP) == 16 {
@@ -113,6 +124,14 @@ func normalizeLeases(staticLeases, dynLeases []*Lease) []*Lease {
 	}
 
 	for i, lease := range dynLeases {
+		// The abandoned leases have the same MAC address, so they're
+		// never duplicates.
+		if lease.isAbandoned() {
+			leases = append(leases, lease)
+
+			continue
+		}
+
 		_, ok := index[lease.HWAddr.String()]
 		if ok {
 			continue // skip the lease with the same HW address
@@ -138,6 +157,10 @@ func (s *Server) dbStore() {
 			IP:       l.IP,
 			Hostname: l.Hostname,
 			Expiry:   l.Expiry.Unix(),
+
+			Fingerprint: l.Fingerprint,
+
+			ConflictHWAddr: l.conflictHWAddr,
 		}
 		leases = append(leases, lease)
 	}
@@ -164,13 +187,68 @@ func (s *Server) dbStore() {
 		return
 	}
 
-	err = maybe.WriteFile(s.conf.DBFilePath, data, 0o644)
-	if err != nil {
+	s.dbWrite(data, len(leases))
+}
+
+// dbWrite writes the encoded table of n leases into the database file.  While
+// the file system is read-only, the latest table is kept in memory, and the
+// write is retried once in aghos.ReadOnlyRetryIvl.
+func (s *Server) dbWrite(data []byte, n int) {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	if !s.conf.WriteGuard.Allow(time.Now()) {
+		s.dbKeep(data, n)
+
+		return
+	}
+
+	s.dbFlush(data, n)
+}
+
+// dbFlush writes the encoded table of n leases into the database file or keeps
+// it in memory, if the file system is read-only.  s.dbLock is expected to be
+// locked.
+func (s *Server) dbFlush(data []byte, n int) {
+	s.dbPending, s.dbPendingNum = nil, 0
+
+	writeFile := s.writeFile
+	if writeFile == nil {
+		writeFile = maybe.WriteFile
+	}
+
+	err := writeFile(s.conf.DBFilePath, data, 0o644)
+	if s.conf.WriteGuard.Report(err, time.Now()) {
+		s.dbKeep(data, n)
+
+		return
+	} else if err != nil {
 		log.Error("dhcp: can't store lease table on disk: %v  filename: %s",
 			err, s.conf.DBFilePath)
 
 		return
 	}
 
-	log.Info("dhcp: stored %d leases in DB", len(leases))
+	log.Info("dhcp: stored %d leases in DB", n)
+}
+
+// dbKeep keeps the encoded table of n leases in memory and schedules the retry
+// of writing it, if it isn't scheduled yet.  s.dbLock is expected to be
+// locked.
+func (s *Server) dbKeep(data []byte, n int) {
+	s.dbPending, s.dbPendingNum = data, n
+	if s.dbRetry == nil {
+		s.dbRetry = time.AfterFunc(aghos.ReadOnlyRetryIvl, s.dbRetryWrite)
+	}
+}
+
+// dbRetryWrite retries writing the leases kept in memory.
+func (s *Server) dbRetryWrite() {
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	s.dbRetry = nil
+	if s.dbPending != nil {
+		s.dbFlush(s.dbPending, s.dbPendingNum)
+	}
 }
@@ -6,10 +6,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -34,6 +38,32 @@ type Lease struct {
 	// Lease expiration time
 	// 1: static lease
 	Expiry time.Time `json:"expires"`
+
+	// Fingerprint are the options of the last DHCPv4 request of the client,
+	// which hint at the type of the device.  It's nil if there are none.
+	Fingerprint *Fingerprint `json:"-"`
+
+	// conflictHWAddr is the MAC address of the device, which has been found
+	// using the IP address of an abandoned lease.  It's nil if the lease
+	// isn't abandoned or if the address isn't known.
+	conflictHWAddr net.HardwareAddr
+}
+
+// isAbandoned returns true if l holds an IP address, which isn't offered
+// because another device has been found using it.  The MAC address of such
+// lease consists of zeros.
+func (l *Lease) isAbandoned() (ok bool) {
+	if len(l.HWAddr) == 0 {
+		return false
+	}
+
+	for _, b := range l.HWAddr {
+		if b != 0 {
+			return false
+		}
+	}
+
+	return true
 }
 
 // IsStatic returns true if the lease is static.
@@ -43,18 +73,22 @@ func (l *Lease) IsStatic() (ok bool) {
 	return l != nil && l.Expiry.Unix() == leaseExpireStatic
 }
 
-// MarshalJSON implements the json.Marshaler interface for *Lease.
-func (l *Lease) MarshalJSON() ([]byte, error) {
-	var expiryStr string
-	if !l.IsStatic() {
-		// The front-end is waiting for RFC 3999 format of the time
-		// value.  It also shouldn't got an Expiry field for static
+// expiryString returns the expiration time of l formatted for the HTTP API.
+func (l *Lease) expiryString() (s string) {
+	if l.IsStatic() {
+		// The front-end shouldn't get an Expiry field for static
 		// leases.
-		//
-		// See https://github.com/AdguardTeam/AdGuardHome/issues/2692.
-		expiryStr = l.Expiry.Format(time.RFC3339)
+		return ""
 	}
 
+	// The front-end is waiting for RFC 3999 format of the time value.
+	//
+	// See https://github.com/AdguardTeam/AdGuardHome/issues/2692.
+	return aghtime.Format(l.Expiry, time.RFC3339)
+}
+
+// MarshalJSON implements the json.Marshaler interface for *Lease.
+func (l *Lease) MarshalJSON() ([]byte, error) {
 	type lease Lease
 	return json.Marshal(&struct {
 		HWAddr string `json:"mac"`
@@ -62,7 +96,7 @@ func (l *Lease) MarshalJSON() ([]byte, error) {
 		*lease
 	}{
 		HWAddr: l.HWAddr.String(),
-		Expiry: expiryStr,
+		Expiry: l.expiryString(),
 		lease:  (*lease)(l),
 	})
 }
@@ -100,6 +134,15 @@ type ServerConfig struct {
 	WorkDir    string `yaml:"-"`
 	DBFilePath string `yaml:"-"` // path to DB file
 
+	// LocalDomainName is the domain name under which the hostnames of the
+	// DHCP clients are resolved.
+	LocalDomainName string `yaml:"-"`
+
+	// WriteGuard tracks the writes of the leases database, so that the
+	// leases are kept in memory while the file system is read-only.  It may
+	// be nil.
+	WriteGuard *aghos.WriteGuard `yaml:"-"`
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
@@ -116,6 +159,7 @@ const (
 	LeaseChangedAddedStatic
 	LeaseChangedRemovedStatic
 	LeaseChangedRemovedAll
+	LeaseChangedRemovedExpired
 
 	LeaseChangedDBStore
 )
@@ -127,8 +171,26 @@ type Server struct {
 
 	conf ServerConfig
 
+	// fingerprints is the table of the known fingerprints of the devices.
+	fingerprints fingerprintTable
+
 	// Called when the leases DB is modified
 	onLeaseChanged []OnLeaseChangedT
+
+	// writeFile writes the leases database file.  If it's nil,
+	// maybe.WriteFile is used.  It's only set in tests.
+	writeFile func(name string, data []byte, perm os.FileMode) (err error)
+
+	// dbLock protects the fields below.
+	dbLock sync.Mutex
+
+	// dbRetry is the timer of the retry of writing dbPending.
+	dbRetry *time.Timer
+
+	// dbPending is the encoded table of dbPendingNum leases, which is kept
+	// in memory while the file system is read-only.
+	dbPending    []byte
+	dbPendingNum int
 }
 
 // ServerInterface is an interface for servers.
@@ -145,7 +207,10 @@ func Create(conf ServerConfig) *Server {
 	s.conf.InterfaceName = conf.InterfaceName
 	s.conf.HTTPRegister = conf.HTTPRegister
 	s.conf.ConfigModified = conf.ConfigModified
+	s.conf.LocalDomainName = conf.LocalDomainName
+	s.conf.WriteGuard = conf.WriteGuard
 	s.conf.DBFilePath = filepath.Join(conf.WorkDir, dbFilename)
+	s.fingerprints = loadFingerprints(conf.WorkDir)
 
 	if !webHandlersRegistered && s.conf.HTTPRegister != nil {
 		if runtime.GOOS == "windows" {
@@ -260,6 +325,37 @@ func (s *Server) Start() (err error) {
 func (s *Server) Stop() {
 	s.srv4.Stop()
 	s.srv6.Stop()
+
+	s.dbLock.Lock()
+	defer s.dbLock.Unlock()
+
+	if s.dbRetry != nil {
+		s.dbRetry.Stop()
+		s.dbRetry = nil
+	}
+}
+
+// ifaceChecker is implemented by the DHCP servers which validate their
+// configuration against the addresses of the interface at runtime.
+type ifaceChecker interface {
+	// checkIface schedules an immediate validation.
+	checkIface()
+}
+
+// CheckIface makes the server validate its configuration against the
+// addresses of the interface with ifaceName right away, if it's the one the
+// server is configured for.  ok is true if the validation has been scheduled.
+func (s *Server) CheckIface(ifaceName string) (ok bool) {
+	if !s.conf.Enabled || s.conf.InterfaceName != ifaceName {
+		return false
+	}
+
+	c, ok := s.srv4.(ifaceChecker)
+	if ok {
+		c.checkIface()
+	}
+
+	return ok
 }
 
 // flags for Leases() function
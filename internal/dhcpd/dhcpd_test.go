@@ -3,11 +3,15 @@
 package dhcpd
 
 import (
+	"io/ioutil"
 	"net"
 	"os"
+	"path/filepath"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -125,3 +129,47 @@ func TestNormalizeLeases(t *testing.T) {
 	assert.Equal(t, leases[1].HWAddr, staticLeases[1].HWAddr)
 	assert.Equal(t, leases[2].HWAddr, dynLeases[1].HWAddr)
 }
+
+func TestNormalizeLeases_abandoned(t *testing.T) {
+	dynLeases := []*Lease{{
+		HWAddr: make(net.HardwareAddr, 6),
+		IP:     net.IP{192, 168, 10, 100},
+	}, {
+		HWAddr: make(net.HardwareAddr, 6),
+		IP:     net.IP{192, 168, 10, 101},
+	}}
+
+	leases := normalizeLeases(nil, dynLeases)
+	assert.Len(t, leases, 2)
+}
+
+func TestServer_dbWrite_readOnly(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			DBFilePath: filepath.Join(t.TempDir(), dbFilename),
+			WriteGuard: aghos.NewWriteGuard("dhcp_leases", nil),
+		},
+		writeFile: func(_ string, _ []byte, _ os.FileMode) (err error) {
+			return &os.PathError{Op: "open", Path: dbFilename, Err: syscall.EROFS}
+		},
+	}
+
+	s.dbWrite([]byte("[]"), 0)
+	assert.True(t, s.conf.WriteGuard.MemoryOnly())
+	assert.NotNil(t, s.dbRetry)
+
+	// The latest table replaces the one kept in memory.
+	s.dbWrite([]byte(`[{"mac":"qqqqqqqq"}]`), 1)
+	assert.Equal(t, []byte(`[{"mac":"qqqqqqqq"}]`), s.dbPending)
+
+	// Fire the retry timer without waiting for it.
+	require.True(t, s.dbRetry.Stop())
+	s.writeFile = nil
+	s.dbRetryWrite()
+	assert.False(t, s.conf.WriteGuard.MemoryOnly())
+	assert.Nil(t, s.dbPending)
+
+	data, err := ioutil.ReadFile(s.conf.DBFilePath)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(`[{"mac":"qqqqqqqq"}]`), data)
+}
@@ -0,0 +1,201 @@
+package dhcpd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/gobuffalo/packr"
+	"github.com/insomniacslk/dhcp/dhcpv4"
+)
+
+// fingerprintsFilename is the name of the file within the working directory,
+// which replaces the bundled fingerprint table if it exists.
+const fingerprintsFilename = "dhcp_fingerprints.json"
+
+// fingerprintsBox contains the bundled fingerprint table.
+var fingerprintsBox = packr.NewBox("./fingerprints")
+
+// Fingerprint are the DHCP options sent by a client, which hint at the type of
+// the device.
+type Fingerprint struct {
+	// Params is the parameter request list, option 55, as the decimal codes
+	// separated by commas in the original order.
+	Params string `json:"params,omitempty"`
+
+	// VendorClass is the vendor class identifier, option 60.
+	VendorClass string `json:"vendor_class,omitempty"`
+
+	// Hostname is the hostname, option 12, as sent by the client.
+	Hostname string `json:"hostname,omitempty"`
+}
+
+// newFingerprint returns the fingerprint of the client which has sent req or
+// nil if req contains none of the options.
+func newFingerprint(req *dhcpv4.DHCPv4) (fp *Fingerprint) {
+	codes := req.ParameterRequestList()
+	params := make([]string, 0, len(codes))
+	for _, c := range codes {
+		params = append(params, strconv.Itoa(int(c.Code())))
+	}
+
+	fp = &Fingerprint{
+		Params:      strings.Join(params, ","),
+		VendorClass: req.ClassIdentifier(),
+		Hostname:    req.HostName(),
+	}
+	if *fp == (Fingerprint{}) {
+		return nil
+	}
+
+	return fp
+}
+
+// DeviceSuggestion is the type and the name of a device guessed from its
+// fingerprint.  It's never applied automatically.
+type DeviceSuggestion struct {
+	// Type is the type of the device, for example "phone" or "tv".
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// fingerprintRule is an entry of the fingerprint table.  The fingerprint
+// matches the rule if it matches all the non-empty criteria of the rule.
+type fingerprintRule struct {
+	DeviceSuggestion
+
+	// Params is the exact parameter request list.
+	Params string `json:"params"`
+
+	// VendorClassPrefix and HostnamePrefix are the case-insensitive
+	// prefixes of the vendor class identifier and of the hostname.
+	VendorClassPrefix string `json:"vendor_class_prefix"`
+	HostnamePrefix    string `json:"hostname_prefix"`
+}
+
+// match returns the number of the criteria of r which fp matches or 0 if it
+// doesn't match r.
+func (r *fingerprintRule) match(fp *Fingerprint) (n int) {
+	for _, c := range []struct {
+		want string
+		ok   func(want string) bool
+	}{{
+		want: r.Params,
+		ok:   func(want string) bool { return fp.Params == want },
+	}, {
+		want: r.VendorClassPrefix,
+		ok:   func(want string) bool { return hasPrefixFold(fp.VendorClass, want) },
+	}, {
+		want: r.HostnamePrefix,
+		ok:   func(want string) bool { return hasPrefixFold(fp.Hostname, want) },
+	}} {
+		if c.want == "" {
+			continue
+		}
+
+		if !c.ok(c.want) {
+			return 0
+		}
+
+		n++
+	}
+
+	return n
+}
+
+// hasPrefixFold returns true if s begins with prefix ignoring the case.
+func hasPrefixFold(s, prefix string) (ok bool) {
+	return len(s) >= len(prefix) && strings.EqualFold(s[:len(prefix)], prefix)
+}
+
+// fingerprintTable is the table of the known fingerprints.
+type fingerprintTable []*fingerprintRule
+
+// suggest returns the suggestion of the rule which fp matches by the most
+// criteria, the earliest one if there are several.  ds is nil if there is
+// none.
+func (t fingerprintTable) suggest(fp *Fingerprint) (ds *DeviceSuggestion) {
+	if fp == nil {
+		return nil
+	}
+
+	best := 0
+	for _, r := range t {
+		if n := r.match(fp); n > best {
+			best = n
+			ds = &DeviceSuggestion{
+				Type: r.Type,
+				Name: r.Name,
+			}
+		}
+	}
+
+	return ds
+}
+
+// parseFingerprints parses the fingerprint table from data.  The rules without
+// the criteria or without the suggestion are invalid.
+func parseFingerprints(data []byte) (t fingerprintTable, err error) {
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, r := range t {
+		if r == nil || r.Type == "" || r.Name == "" {
+			return nil, fmt.Errorf("rule at index %d: no type or name", i)
+		}
+
+		if r.Params == "" && r.VendorClassPrefix == "" && r.HostnamePrefix == "" {
+			return nil, fmt.Errorf("rule at index %d: no criteria", i)
+		}
+	}
+
+	return t, nil
+}
+
+// loadFingerprints returns the fingerprint table from the file within workDir
+// if it exists or the bundled one otherwise.  The table is empty if it can't
+// be loaded.
+func loadFingerprints(workDir string) (t fingerprintTable) {
+	src := filepath.Join(workDir, fingerprintsFilename)
+	data, err := ioutil.ReadFile(src)
+	if errors.Is(err, os.ErrNotExist) {
+		src = "the bundled table"
+		data, err = fingerprintsBox.Find("fingerprints.json")
+	}
+
+	if err == nil {
+		t, err = parseFingerprints(data)
+	}
+
+	if err != nil {
+		log.Error("dhcp: loading fingerprints from %s: %s", src, err)
+
+		return nil
+	}
+
+	log.Debug("dhcp: loaded %d fingerprints from %s", len(t), src)
+
+	return t
+}
+
+// SuggestedDevices returns the types and the names of the devices guessed
+// from their DHCP fingerprints by the IP addresses of their leases.  The
+// unrecognized devices are skipped.  It's safe for concurrent use.
+func (s *Server) SuggestedDevices() (m map[string]*DeviceSuggestion) {
+	m = map[string]*DeviceSuggestion{}
+	for _, l := range s.Leases(LeasesAll) {
+		if ds := s.fingerprints.suggest(l.Fingerprint); ds != nil {
+			m[l.IP.String()] = ds
+		}
+	}
+
+	return m
+}
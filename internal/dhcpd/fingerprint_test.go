@@ -0,0 +1,110 @@
+package dhcpd
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/insomniacslk/dhcp/dhcpv4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewFingerprint(t *testing.T) {
+	mac := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+
+	req, err := dhcpv4.NewDiscovery(
+		mac,
+		dhcpv4.WithOption(dhcpv4.OptParameterRequestList(
+			dhcpv4.OptionSubnetMask,
+			dhcpv4.OptionClasslessStaticRoute,
+			dhcpv4.OptionRouter,
+		)),
+		dhcpv4.WithOption(dhcpv4.OptClassIdentifier("android-dhcp-11")),
+		dhcpv4.WithOption(dhcpv4.OptHostName("Pixel-5")),
+	)
+	require.NoError(t, err)
+
+	assert.Equal(t, &Fingerprint{
+		Params:      "1,121,3",
+		VendorClass: "android-dhcp-11",
+		Hostname:    "Pixel-5",
+	}, newFingerprint(req))
+
+	req, err = dhcpv4.New()
+	require.NoError(t, err)
+
+	assert.Nil(t, newFingerprint(req))
+}
+
+func TestFingerprintTable_suggest(t *testing.T) {
+	ft := loadFingerprints(t.TempDir())
+	require.NotEmpty(t, ft)
+
+	testCases := []struct {
+		fp   *Fingerprint
+		want *DeviceSuggestion
+		name string
+	}{{
+		fp:   &Fingerprint{Params: "1,121,3,6,15,119,252,95,44,46"},
+		want: &DeviceSuggestion{Type: "phone", Name: "iPhone or iPad"},
+		name: "params",
+	}, {
+		fp:   &Fingerprint{VendorClass: "MSFT 5.0"},
+		want: &DeviceSuggestion{Type: "computer", Name: "Windows PC"},
+		name: "vendor_class",
+	}, {
+		fp:   &Fingerprint{Hostname: "LGwebOSTV"},
+		want: &DeviceSuggestion{Type: "tv", Name: "LG TV"},
+		name: "hostname",
+	}, {
+		// The rule matching by more criteria wins.
+		fp: &Fingerprint{
+			Params:      "1,3,6,15,26,28,51,58,59,43",
+			VendorClass: "android-dhcp-11",
+			Hostname:    "Galaxy-S21",
+		},
+		want: &DeviceSuggestion{Type: "phone", Name: "Android device"},
+		name: "earliest",
+	}, {
+		fp:   &Fingerprint{Params: "1,3,6"},
+		want: nil,
+		name: "unknown",
+	}, {
+		fp:   nil,
+		want: nil,
+		name: "nil",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ft.suggest(tc.fp))
+		})
+	}
+}
+
+func TestLoadFingerprints(t *testing.T) {
+	dir := t.TempDir()
+	fn := filepath.Join(dir, fingerprintsFilename)
+
+	t.Run("file", func(t *testing.T) {
+		data := []byte(`[{"type":"printer","name":"Printer","vendor_class_prefix":"hp"}]`)
+		require.NoError(t, ioutil.WriteFile(fn, data, 0o644))
+
+		ft := loadFingerprints(dir)
+		require.Len(t, ft, 1)
+
+		assert.Equal(t, &DeviceSuggestion{
+			Type: "printer",
+			Name: "Printer",
+		}, ft.suggest(&Fingerprint{VendorClass: "HP LaserJet"}))
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		data := []byte(`[{"type":"printer","name":"Printer"}]`)
+		require.NoError(t, ioutil.WriteFile(fn, data, 0o644))
+
+		assert.Empty(t, loadFingerprints(dir))
+	})
+}
@@ -2,7 +2,6 @@ package dhcpd
 
 import (
 	"encoding/binary"
-	"fmt"
 	"net"
 )
 
@@ -14,19 +13,6 @@ func isTimeout(err error) bool {
 	return operr.Timeout()
 }
 
-func tryTo4(ip net.IP) (ip4 net.IP, err error) {
-	if ip == nil {
-		return nil, fmt.Errorf("%v is not an IP address", ip)
-	}
-
-	ip4 = ip.To4()
-	if ip4 == nil {
-		return nil, fmt.Errorf("%v is not an IPv4 address", ip)
-	}
-
-	return ip4, nil
-}
-
 // Return TRUE if subnet mask is correct (e.g. 255.255.255.0)
 func isValidSubnetMask(mask net.IP) bool {
 	var n uint32
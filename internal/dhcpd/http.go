@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -20,6 +22,98 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 	http.Error(w, text, code)
 }
 
+// warner is implemented by the DHCP servers which may stop serving the
+// requests at runtime.
+type warner interface {
+	// warning returns the reason why the server doesn't serve the
+	// requests or an empty string if it does.
+	warning() (msg string)
+}
+
+// abandoner is implemented by the DHCP servers which don't offer the addresses
+// found to be used by other devices.
+type abandoner interface {
+	// abandoned returns the addresses which aren't offered at now.
+	abandoned(now time.Time) (addrs []abandonedAddr)
+
+	// clearAbandoned makes the abandoned address ip or all of them, if ip is
+	// nil, offered again and returns the number of those.
+	clearAbandoned(ip net.IP) (n int)
+}
+
+// abandonedAddr is an address, which isn't offered because another device
+// has been found using it.
+type abandonedAddr struct {
+	// HWAddr is the hardware address of the device using IP, if known.
+	HWAddr net.HardwareAddr
+	IP     net.IP
+
+	// Until is the end of the cooldown, after which IP is offered again if
+	// it's no longer used.
+	Until time.Time
+}
+
+// abandonedAddrJSON is an abandoned address in the HTTP API.
+type abandonedAddrJSON struct {
+	// HWAddr is empty if the hardware address isn't known, for example if
+	// the device has only replied to ICMP.
+	HWAddr string `json:"mac,omitempty"`
+	IP     net.IP `json:"ip"`
+	Until  string `json:"until"`
+}
+
+// toAbandonedJSON converts the abandoned addresses into their HTTP API
+// representation.
+func toAbandonedJSON(addrs []abandonedAddr) (res []abandonedAddrJSON) {
+	res = make([]abandonedAddrJSON, 0, len(addrs))
+	for _, a := range addrs {
+		j := abandonedAddrJSON{
+			IP:    a.IP,
+			Until: aghtime.Format(a.Until, time.RFC3339),
+		}
+
+		if a.HWAddr != nil {
+			j.HWAddr = a.HWAddr.String()
+		}
+
+		res = append(res, j)
+	}
+
+	return res
+}
+
+// configErrorJSON is the response to a request with an inconsistent DHCP
+// configuration.
+type configErrorJSON struct {
+	// Field is the name of the inconsistent property, for example
+	// "range_start".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// httpConfigError responds with 400 Bad Request and the description of err if
+// it's a *configError.  Otherwise, it's the same as httpError.
+func httpConfigError(r *http.Request, w http.ResponseWriter, format string, err error) {
+	var cerr *configError
+	if !errors.As(err, &cerr) {
+		httpError(r, w, http.StatusBadRequest, format, err)
+
+		return
+	}
+
+	log.Info("DHCP: %s %s: %s", r.Method, r.URL, err)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	err = json.NewEncoder(w).Encode(configErrorJSON{
+		Field:   cerr.field,
+		Message: cerr.msg,
+	})
+	if err != nil {
+		log.Debug("dhcpd: writing config error: %s", err)
+	}
+}
+
 type v4ServerConfJSON struct {
 	GatewayIP     net.IP `json:"gateway_ip"`
 	SubnetMask    net.IP `json:"subnet_mask"`
@@ -58,14 +152,67 @@ func v6JSONToServerConf(j *v6ServerConfJSON) V6ServerConf {
 	}
 }
 
+// leaseStatus is a lease in the response for /control/dhcp/status endpoint.
+type leaseStatus struct {
+	HWAddr   string `json:"mac"`
+	IP       net.IP `json:"ip"`
+	Hostname string `json:"hostname"`
+
+	// DNSName is the fully qualified domain name under which the client
+	// is resolved.  It's empty if the lease has no hostname.
+	DNSName string `json:"dns_name,omitempty"`
+	Expiry  string `json:"expires,omitempty"`
+
+	// Fingerprint are the DHCPv4 options hinting at the type of the
+	// device, if any.
+	Fingerprint *Fingerprint `json:"fingerprint,omitempty"`
+
+	// SuggestedDevice is the device guessed from Fingerprint, if any.  It's
+	// only a suggestion, which is never applied automatically.
+	SuggestedDevice *DeviceSuggestion `json:"suggested_device,omitempty"`
+}
+
+// toLeaseStatus converts the leases into their HTTP API representation.
+// domain is the local domain name, t is the table used to suggest the devices.
+func toLeaseStatus(leases []Lease, domain string, t fingerprintTable) (ls []leaseStatus) {
+	ls = make([]leaseStatus, len(leases))
+	for i := range leases {
+		l := &leases[i]
+		ls[i] = leaseStatus{
+			HWAddr:   l.HWAddr.String(),
+			IP:       l.IP,
+			Hostname: l.Hostname,
+			Expiry:   l.expiryString(),
+
+			Fingerprint:     l.Fingerprint,
+			SuggestedDevice: t.suggest(l.Fingerprint),
+		}
+
+		if l.Hostname != "" && domain != "" {
+			ls[i].DNSName = strings.ToLower(l.Hostname) + "." + domain
+		}
+	}
+
+	return ls
+}
+
 // dhcpStatusResponse is the response for /control/dhcp/status endpoint.
 type dhcpStatusResponse struct {
-	Enabled      bool         `json:"enabled"`
-	IfaceName    string       `json:"interface_name"`
-	V4           V4ServerConf `json:"v4"`
-	V6           V6ServerConf `json:"v6"`
-	Leases       []Lease      `json:"leases"`
-	StaticLeases []Lease      `json:"static_leases"`
+	Enabled   bool   `json:"enabled"`
+	IfaceName string `json:"interface_name"`
+
+	// V4Warning is the reason why the DHCPv4 server doesn't serve the
+	// requests, if any.
+	V4Warning string `json:"v4_warning,omitempty"`
+
+	V4           V4ServerConf  `json:"v4"`
+	V6           V6ServerConf  `json:"v6"`
+	Leases       []leaseStatus `json:"leases"`
+	StaticLeases []leaseStatus `json:"static_leases"`
+
+	// Abandoned are the IPv4 addresses, which aren't offered because other
+	// devices have been found using them.
+	Abandoned []abandonedAddrJSON `json:"abandoned"`
 }
 
 func (s *Server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
@@ -79,8 +226,17 @@ func (s *Server) handleDHCPStatus(w http.ResponseWriter, r *http.Request) {
 	s.srv4.WriteDiskConfig4(&status.V4)
 	s.srv6.WriteDiskConfig6(&status.V6)
 
-	status.Leases = s.Leases(LeasesDynamic)
-	status.StaticLeases = s.Leases(LeasesStatic)
+	if w, ok := s.srv4.(warner); ok {
+		status.V4Warning = w.warning()
+	}
+
+	status.Abandoned = []abandonedAddrJSON{}
+	if a, ok := s.srv4.(abandoner); ok {
+		status.Abandoned = toAbandonedJSON(a.abandoned(time.Now()))
+	}
+
+	status.Leases = toLeaseStatus(s.Leases(LeasesDynamic), s.conf.LocalDomainName, s.fingerprints)
+	status.StaticLeases = toLeaseStatus(s.Leases(LeasesStatic), s.conf.LocalDomainName, s.fingerprints)
 
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(status)
@@ -178,12 +334,12 @@ func (s *Server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		s.srv4.WriteDiskConfig4(&c4)
 		v4Conf.notify = c4.notify
 		v4Conf.ICMPTimeout = c4.ICMPTimeout
+		v4Conf.ConflictCooldown = c4.ConflictCooldown
 		v4Conf.Options = c4.Options
 
 		s4, err = v4Create(v4Conf)
 		if err != nil {
-			httpError(r, w, http.StatusBadRequest,
-				"invalid dhcpv4 configuration: %s", err)
+			httpConfigError(r, w, "invalid dhcpv4 configuration: %s", err)
 
 			return
 		}
@@ -248,7 +404,11 @@ func (s *Server) handleDHCPSetConfig(w http.ResponseWriter, r *http.Request) {
 		var code int
 		code, err = s.enableDHCP(conf.InterfaceName)
 		if err != nil {
-			httpError(r, w, code, "enabling dhcp: %s", err)
+			if code == http.StatusBadRequest {
+				httpConfigError(r, w, "enabling dhcp: %s", err)
+			} else {
+				httpError(r, w, code, "enabling dhcp: %s", err)
+			}
 
 			return
 		}
@@ -504,6 +664,55 @@ func (s *Server) handleDHCPRemoveStaticLease(w http.ResponseWriter, r *http.Requ
 	}
 }
 
+// clearAbandonedReq is the request for making the abandoned addresses offered
+// again.
+type clearAbandonedReq struct {
+	// IP is the abandoned address to clear.  If it's empty, all of them are
+	// cleared.
+	IP net.IP `json:"ip"`
+}
+
+// clearAbandonedResp is the response to the POST
+// /control/dhcp/clear_abandoned request.
+type clearAbandonedResp struct {
+	Cleared int `json:"cleared"`
+}
+
+// handleDHCPClearAbandoned is the handler for the POST
+// /control/dhcp/clear_abandoned HTTP API.
+func (s *Server) handleDHCPClearAbandoned(w http.ResponseWriter, r *http.Request) {
+	req := clearAbandonedReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	ip := req.IP
+	if ip != nil {
+		ip = ip.To4()
+		if ip == nil {
+			httpError(r, w, http.StatusBadRequest, "%s is not an ipv4 address", req.IP)
+
+			return
+		}
+	}
+
+	resp := clearAbandonedResp{}
+	if a, ok := s.srv4.(abandoner); ok {
+		resp.Cleared = a.clearAbandoned(ip)
+	}
+
+	log.Info("dhcp: cleared %d abandoned addresses", resp.Cleared)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
 func (s *Server) handleReset(w http.ResponseWriter, r *http.Request) {
 	s.Stop()
 
@@ -538,6 +747,7 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/find_active_dhcp", s.handleDHCPFindActiveServer)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/add_static_lease", s.handleDHCPAddStaticLease)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", s.handleDHCPRemoveStaticLease)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/clear_abandoned", s.handleDHCPClearAbandoned)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", s.handleReset)
 }
 
@@ -578,5 +788,6 @@ func (s *Server) registerNotImplementedHandlers() {
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/find_active_dhcp", h)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/add_static_lease", h)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/remove_static_lease", h)
+	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/clear_abandoned", h)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dhcp/reset", h)
 }
@@ -46,10 +46,15 @@ type V4ServerConf struct {
 
 	LeaseDuration uint32 `yaml:"lease_duration" json:"lease_duration"` // in seconds
 
-	// IP conflict detector: time (ms) to wait for ICMP reply
+	// IP conflict detector: time (ms) to wait for ARP or ICMP reply
 	// 0: disable
 	ICMPTimeout uint32 `yaml:"icmp_timeout_msec" json:"-"`
 
+	// ConflictCooldown is the time in seconds during which an address found
+	// to be used by another device isn't offered.  0 means the lease
+	// duration.
+	ConflictCooldown uint32 `yaml:"conflict_cooldown" json:"-"`
+
 	// Custom Options.
 	//
 	// Option with arbitrary hexadecimal data:
@@ -65,6 +70,9 @@ type V4ServerConf struct {
 	leaseTime  time.Duration // the time during which a dynamic lease is considered valid
 	dnsIPAddrs []net.IP      // IPv4 addresses to return to DHCP clients as DNS server addresses
 
+	// conflictCooldown is the duration of ConflictCooldown.
+	conflictCooldown time.Duration
+
 	// subnet contains the DHCP server's subnet.  The IP is the IP of the
 	// gateway.
 	subnet *net.IPNet
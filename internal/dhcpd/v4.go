@@ -38,8 +38,36 @@ type v4Server struct {
 
 	// leasesLock protects leases and leasedOffsets.
 	leasesLock sync.Mutex
+
+	// expiryDone is closed when the server is stopped to stop watching for
+	// the expired leases and for the addresses of the interface.
+	expiryDone chan struct{}
+
+	// ifaceErrLock protects ifaceErr.
+	ifaceErrLock sync.Mutex
+
+	// ifaceErr is the inconsistency between the configuration and the
+	// current addresses of the interface.  The requests aren't served while
+	// it's not nil.
+	ifaceErr error
+
+	// ifaceCheck receives a value when the addresses of the interface
+	// should be validated before the next tick of ifaceCheckIvl.
+	ifaceCheck chan struct{}
+
+	// addrProbe checks if an address is used by another device before it's
+	// offered.  It's probeAddr unless replaced in tests.
+	addrProbe func(target net.IP) (used bool, mac net.HardwareAddr)
 }
 
+// expiryCheckIvl is the interval between the checks for the expired dynamic
+// leases.
+const expiryCheckIvl = 10 * time.Second
+
+// ifaceCheckIvl is the interval between the checks of the addresses of the
+// interface.
+const ifaceCheckIvl = 30 * time.Second
+
 // WriteDiskConfig4 - write configuration
 func (s *v4Server) WriteDiskConfig4(c *V4ServerConf) {
 	*c = s.conf
@@ -80,26 +108,6 @@ func (s *v4Server) getLeasesRef() []*Lease {
 	return s.leases
 }
 
-// isBlocklisted returns true if this lease holds a blocklisted IP.
-//
-// TODO(a.garipov): Make a method of *Lease?
-func (s *v4Server) isBlocklisted(l *Lease) (ok bool) {
-	if len(l.HWAddr) == 0 {
-		return false
-	}
-
-	ok = true
-	for _, b := range l.HWAddr {
-		if b != 0 {
-			ok = false
-
-			break
-		}
-	}
-
-	return ok
-}
-
 // GetLeases returns the list of current DHCP leases.  It is safe for concurrent
 // use.
 func (s *v4Server) GetLeases(flags int) (res []Lease) {
@@ -118,7 +126,7 @@ func (s *v4Server) GetLeases(flags int) (res []Lease) {
 
 	now := time.Now()
 	for _, l := range s.leases {
-		if getDynamic && l.Expiry.After(now) && !s.isBlocklisted(l) {
+		if getDynamic && l.Expiry.After(now) && !l.isAbandoned() {
 			res = append(res, *l)
 
 			continue
@@ -158,11 +166,89 @@ func (s *v4Server) FindMACbyIP(ip net.IP) net.HardwareAddr {
 // defaultHwAddrLen is the default length of a hardware (MAC) address.
 const defaultHwAddrLen = 6
 
-// Add the specified IP to the black list for a time period
-func (s *v4Server) blocklistLease(l *Lease) {
+// abandonLease makes l an abandoned lease, so that its IP address isn't
+// offered until the cooldown ends.  mac is the hardware address of the device
+// using the address, if known.
+func (s *v4Server) abandonLease(l *Lease, mac net.HardwareAddr) {
+	log.Info("dhcpv4: ip conflict: %s is already used by %s", l.IP, hwAddrOrUnknown(mac))
+
 	l.HWAddr = make(net.HardwareAddr, defaultHwAddrLen)
 	l.Hostname = ""
-	l.Expiry = time.Now().Add(s.conf.leaseTime)
+	l.Expiry = time.Now().Add(s.conf.conflictCooldown)
+	l.Fingerprint = nil
+	l.conflictHWAddr = mac
+}
+
+// hwAddrOrUnknown returns the string representation of mac or "unknown device"
+// if mac is nil.
+func hwAddrOrUnknown(mac net.HardwareAddr) (s string) {
+	if mac == nil {
+		return "unknown device"
+	}
+
+	return mac.String()
+}
+
+// rmExpiredAbandoned removes the abandoned leases, which cooldown has ended at
+// now, so that their addresses are probed again.  It returns true if any lease
+// is removed.
+func (s *v4Server) rmExpiredAbandoned(now time.Time) (ok bool) {
+	for i := 0; i < len(s.leases); {
+		if l := s.leases[i]; l.isAbandoned() && !l.Expiry.After(now) {
+			s.rmLeaseByIndex(i)
+			ok = true
+
+			continue
+		}
+
+		i++
+	}
+
+	return ok
+}
+
+// abandoned returns the abandoned addresses at now.  It's safe for concurrent
+// use.
+func (s *v4Server) abandoned(now time.Time) (addrs []abandonedAddr) {
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
+
+	addrs = []abandonedAddr{}
+	for _, l := range s.leases {
+		if l.isAbandoned() && l.Expiry.After(now) {
+			addrs = append(addrs, abandonedAddr{
+				IP:     l.IP,
+				HWAddr: l.conflictHWAddr,
+				Until:  l.Expiry,
+			})
+		}
+	}
+
+	return addrs
+}
+
+// clearAbandoned removes the abandoned lease with ip or all of them if ip is
+// nil, so that the addresses are offered again.  It returns the number of the
+// removed leases.  It's safe for concurrent use.
+func (s *v4Server) clearAbandoned(ip net.IP) (n int) {
+	s.leasesLock.Lock()
+	for i := 0; i < len(s.leases); {
+		if l := s.leases[i]; l.isAbandoned() && (ip == nil || ip.Equal(l.IP)) {
+			s.rmLeaseByIndex(i)
+			n++
+
+			continue
+		}
+
+		i++
+	}
+	s.leasesLock.Unlock()
+
+	if n > 0 {
+		s.conf.notify(LeaseChangedDBStore)
+	}
+
+	return n
 }
 
 // rmLeaseByIndex removes a lease by its index in the leases slice.
@@ -320,6 +406,8 @@ func (s *v4Server) AddStaticLease(l Lease) (err error) {
 			return
 		}
 
+		s.takeHostname(&l, l.Hostname)
+
 		err = s.addLease(&l)
 		if err != nil {
 			err = fmt.Errorf("adding static lease for %s (%s): %w", l.IP, l.HWAddr, err)
@@ -365,22 +453,42 @@ func (s *v4Server) RemoveStaticLease(l Lease) (err error) {
 	return nil
 }
 
-// Send ICMP to the specified machine
-// Return TRUE if it doesn't reply, which probably means that the IP is available
-func (s *v4Server) addrAvailable(target net.IP) bool {
+// probeAddr checks if target is used by another device.  It sends an ARP
+// probe and falls back to ICMP if ARP isn't available.  mac is the hardware
+// address of the device, if known.
+func (s *v4Server) probeAddr(target net.IP) (used bool, mac net.HardwareAddr) {
 	if s.conf.ICMPTimeout == 0 {
-		return true
+		return false, nil
 	}
 
+	timeout := time.Duration(s.conf.ICMPTimeout) * time.Millisecond
+
+	iface, err := net.InterfaceByName(s.conf.InterfaceName)
+	if err == nil {
+		mac, err = arpProbe(iface, target, timeout)
+	}
+
+	if err != nil {
+		log.Debug("dhcpv4: arp probe of %s: %s, trying icmp", target, err)
+
+		return s.pingAddr(target, timeout), nil
+	}
+
+	return mac != nil, mac
+}
+
+// pingAddr sends an ICMP Echo to target and returns true if it replies within
+// timeout, which means that the address is used by another device.
+func (s *v4Server) pingAddr(target net.IP, timeout time.Duration) (used bool) {
 	pinger, err := ping.NewPinger(target.String())
 	if err != nil {
 		log.Error("ping.NewPinger(): %v", err)
 
-		return true
+		return false
 	}
 
 	pinger.SetPrivileged(true)
-	pinger.Timeout = time.Duration(s.conf.ICMPTimeout) * time.Millisecond
+	pinger.Timeout = timeout
 	pinger.Count = 1
 	reply := false
 	pinger.OnRecv = func(_ *ping.Packet) {
@@ -391,16 +499,12 @@ func (s *v4Server) addrAvailable(target net.IP) bool {
 	err = pinger.Run()
 	if err != nil {
 		log.Error("pinger.Run(): %v", err)
-		return true
-	}
-
-	if reply {
-		log.Info("dhcpv4: IP conflict: %v is already used by another device", target)
 		return false
 	}
 
 	log.Debug("dhcpv4: ICMP procedure is complete: %v", target)
-	return true
+
+	return reply
 }
 
 // findLease finds a lease by its MAC-address.
@@ -451,6 +555,8 @@ func (s *v4Server) reserveLease(mac net.HardwareAddr) (l *Lease, err error) {
 
 	copy(l.HWAddr, mac)
 
+	s.rmExpiredAbandoned(time.Now())
+
 	l.IP = s.nextIP()
 	if l.IP == nil {
 		i := s.findExpiredLease()
@@ -510,8 +616,8 @@ func (s *v4Server) processDiscover(req, resp *dhcpv4.DHCPv4) (l *Lease, err erro
 
 			toStore = true
 
-			if !s.addrAvailable(l.IP) {
-				s.blocklistLease(l)
+			if used, conflictMAC := s.addrProbe(l.IP); used {
+				s.abandonLease(l, conflictMAC)
 				l = nil
 
 				continue
@@ -603,6 +709,124 @@ func (s *v4Server) validateHostname(name string) (err error) {
 	return nil
 }
 
+// findLeaseByHostname returns the lease with the hostname name or nil if there
+// is none.  s.leasesLock is expected to be locked.
+func (s *v4Server) findLeaseByHostname(name string) (l *Lease) {
+	for _, l = range s.leases {
+		if l.Hostname == name {
+			return l
+		}
+	}
+
+	return nil
+}
+
+// setHostname sets the hostname of l keeping s.leaseHosts in sync.
+// s.leasesLock is expected to be locked.
+func (s *v4Server) setHostname(l *Lease, name string) {
+	if l.Hostname == name {
+		return
+	}
+
+	if l.Hostname != "" {
+		s.leaseHosts.Del(l.Hostname)
+	}
+
+	l.Hostname = name
+	if name != "" {
+		s.leaseHosts.Add(name)
+	}
+}
+
+// hostnameAvailable returns true if name can be used as the hostname of l.
+// This is the case when it's not used by any other lease or when it's only used
+// by an expired dynamic lease, the hostname of which is then removed.
+// s.leasesLock is expected to be locked.
+func (s *v4Server) hostnameAvailable(l *Lease, name string) (ok bool) {
+	owner := s.findLeaseByHostname(name)
+	if owner == nil || owner == l {
+		return true
+	}
+
+	if owner.IsStatic() || owner.Expiry.After(time.Now()) {
+		return false
+	}
+
+	log.Debug("dhcpv4: taking hostname %q from expired lease for %s", name, owner.HWAddr)
+	s.setHostname(owner, "")
+
+	return true
+}
+
+// uniqueHostname returns a hostname for l based on name which isn't used by
+// any other active lease.  s.leasesLock is expected to be locked.
+func (s *v4Server) uniqueHostname(l *Lease, name string) (uniq string) {
+	if s.hostnameAvailable(l, name) {
+		return name
+	}
+
+	uniq = s.suffixedHostname(l, name)
+	log.Info("dhcpv4: hostname %q requested by %s is taken, using %q", name, l.HWAddr, uniq)
+
+	return uniq
+}
+
+// suffixedHostname returns a hostname for l made from name by appending the
+// last three bytes of the MAC address of l to it or, if that one is taken as
+// well, a number.  s.leasesLock is expected to be locked.
+func (s *v4Server) suffixedHostname(l *Lease, name string) (uniq string) {
+	mac := l.HWAddr
+	if len(mac) > 3 {
+		mac = mac[len(mac)-3:]
+	}
+
+	uniq = fmt.Sprintf("%s-%x", name, []byte(mac))
+	if aghnet.ValidateDomainName(uniq) == nil && s.hostnameAvailable(l, uniq) {
+		return uniq
+	}
+
+	for i := 2; ; i++ {
+		uniq = fmt.Sprintf("%s-%d", name, i)
+		if aghnet.ValidateDomainName(uniq) != nil {
+			// The name is too long to add any suffix to it.
+			return aghnet.GenerateHostname(l.IP)
+		}
+
+		if s.hostnameAvailable(l, uniq) {
+			return uniq
+		}
+	}
+}
+
+// takeHostname makes sure that the hostname name can be used by the static
+// lease l by renaming the dynamic lease which currently uses it, if any.
+// s.leasesLock is expected to be locked.
+func (s *v4Server) takeHostname(l *Lease, name string) {
+	if name == "" {
+		return
+	}
+
+	owner := s.findLeaseByHostname(name)
+	if owner == nil || owner.IsStatic() || bytes.Equal(owner.HWAddr, l.HWAddr) {
+		return
+	}
+
+	if owner.Expiry.Before(time.Now()) {
+		s.setHostname(owner, "")
+
+		return
+	}
+
+	s.setHostname(owner, s.suffixedHostname(owner, name))
+	log.Info(
+		"dhcpv4: hostname %q is taken by static lease for %s, renamed lease for %s to %q",
+		name,
+		l.HWAddr,
+		owner.HWAddr,
+		owner.Hostname,
+	)
+}
+
 // validateLease returns an error if the lease is invalid.
 func (s *v4Server) validateLease(l *Lease) (err error) {
 	defer agherr.Annotate("validating lease: %s", &err)
@@ -668,6 +892,9 @@ func (s *v4Server) processRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, ok bo
 			}
 
 			lease = l
+			if fp := newFingerprint(req); fp != nil {
+				lease.Fingerprint = fp
+			}
 
 			break
 		}
@@ -700,17 +927,13 @@ func (s *v4Server) processRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, ok bo
 				)
 			}
 
-			if lease.Hostname != hostname {
-				// Either a new lease or an old lease with a new
-				// hostname, so validate.
-				err = s.validateHostname(hostname)
-				if err != nil {
-					log.Error("dhcpv4: validating %s: %s", mac, err)
+			err = aghnet.ValidateDomainName(hostname)
+			if err != nil {
+				log.Error("dhcpv4: validating hostname for %s: %s", mac, err)
 
-					// Go on and assign a hostname made from
-					// the IP below.
-					hostname = ""
-				}
+				// Go on and assign a hostname made from the IP
+				// below.
+				hostname = ""
 			}
 		}
 
@@ -718,7 +941,10 @@ func (s *v4Server) processRequest(req, resp *dhcpv4.DHCPv4) (lease *Lease, ok bo
 			hostname = aghnet.GenerateHostname(reqIP)
 		}
 
-		lease.Hostname = hostname
+		s.leasesLock.Lock()
+		s.setHostname(lease, s.uniqueHostname(lease, hostname))
+		s.leasesLock.Unlock()
+
 		s.commitLease(lease)
 	} else if len(lease.Hostname) != 0 {
 		o := &optFQDN{
@@ -792,6 +1018,12 @@ func (s *v4Server) process(req, resp *dhcpv4.DHCPv4) int {
 func (s *v4Server) packetHandler(conn net.PacketConn, peer net.Addr, req *dhcpv4.DHCPv4) {
 	log.Debug("dhcpv4: received message: %s", req.Summary())
 
+	if msg := s.warning(); msg != "" {
+		log.Debug("dhcpv4: not serving requests: %s", msg)
+
+		return
+	}
+
 	switch req.MessageType() {
 	case dhcpv4.MessageTypeDiscover,
 		dhcpv4.MessageTypeRequest:
@@ -859,6 +1091,15 @@ func (s *v4Server) Start() (err error) {
 
 	s.conf.dnsIPAddrs = dnsIPAddrs
 
+	err = validateV4Iface(iface, ifaceName, s.conf.subnet, s.conf.ipRange)
+	if err != nil {
+		// Don't wrap the error to keep it a *configError for the HTTP
+		// API.
+		return err
+	}
+
+	s.setIfaceErr(nil)
+
 	laddr := &net.UDPAddr{
 		IP:   net.IP{0, 0, 0, 0},
 		Port: dhcpv4.ServerPort,
@@ -885,6 +1126,10 @@ func (s *v4Server) Start() (err error) {
 		}
 	}()
 
+	s.expiryDone = make(chan struct{})
+	go s.watchExpiry(s.expiryDone)
+	go s.watchIface(iface, s.expiryDone)
+
 	// Signal to the clients containers in packages home and dnsforward that
 	// it should reload the DHCP clients.
 	s.conf.notify(LeaseChangedAdded)
@@ -892,6 +1137,100 @@ func (s *v4Server) Start() (err error) {
 	return nil
 }
 
+// hasExpired returns true if any dynamic lease has expired after since and not
+// later than now.  It is safe for concurrent use.
+func (s *v4Server) hasExpired(since, now time.Time) (ok bool) {
+	s.leasesLock.Lock()
+	defer s.leasesLock.Unlock()
+
+	for _, l := range s.leases {
+		if !l.IsStatic() && l.Expiry.After(since) && !l.Expiry.After(now) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// watchExpiry signals about the expiration of dynamic leases so that their
+// hostnames are removed from DNS promptly.  It returns when done is closed.
+func (s *v4Server) watchExpiry(done <-chan struct{}) {
+	t := time.NewTicker(expiryCheckIvl)
+	defer t.Stop()
+
+	last := time.Now()
+	for {
+		select {
+		case now := <-t.C:
+			if s.hasExpired(last, now) {
+				log.Debug("dhcpv4: some leases have expired")
+				s.conf.notify(LeaseChangedRemovedExpired)
+			}
+
+			last = now
+		case <-done:
+			return
+		}
+	}
+}
+
+// setIfaceErr sets the inconsistency between the configuration and the
+// addresses of the interface and logs its changes.
+func (s *v4Server) setIfaceErr(err error) {
+	s.ifaceErrLock.Lock()
+	defer s.ifaceErrLock.Unlock()
+
+	if err != nil && (s.ifaceErr == nil || s.ifaceErr.Error() != err.Error()) {
+		log.Error("dhcpv4: not serving requests: %s", err)
+	} else if err == nil && s.ifaceErr != nil {
+		log.Info("dhcpv4: interface %s is consistent with the configuration again", s.conf.InterfaceName)
+	}
+
+	s.ifaceErr = err
+}
+
+// warning implements the warner interface for *v4Server.
+func (s *v4Server) warning() (msg string) {
+	s.ifaceErrLock.Lock()
+	defer s.ifaceErrLock.Unlock()
+
+	if s.ifaceErr == nil {
+		return ""
+	}
+
+	return s.ifaceErr.Error()
+}
+
+// watchIface re-validates the configuration against the addresses of iface,
+// which may change at runtime, and suspends serving the requests while they're
+// inconsistent.  It returns when done is closed.
+func (s *v4Server) watchIface(iface netIface, done <-chan struct{}) {
+	defer agherr.LogPanic("dhcpv4: watching interface")
+
+	t := time.NewTicker(ifaceCheckIvl)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-t.C:
+			s.setIfaceErr(validateV4Iface(iface, s.conf.InterfaceName, s.conf.subnet, s.conf.ipRange))
+		case <-s.ifaceCheck:
+			s.setIfaceErr(validateV4Iface(iface, s.conf.InterfaceName, s.conf.subnet, s.conf.ipRange))
+		case <-done:
+			return
+		}
+	}
+}
+
+// checkIface implements the ifaceChecker interface for *v4Server.
+func (s *v4Server) checkIface() {
+	select {
+	case s.ifaceCheck <- struct{}{}:
+	default:
+		// A check is pending already.
+	}
+}
+
 // Stop - stop server
 func (s *v4Server) Stop() {
 	if s.srv == nil {
@@ -899,6 +1238,8 @@ func (s *v4Server) Stop() {
 	}
 
 	log.Debug("dhcpv4: stopping")
+	close(s.expiryDone)
+
 	err := s.srv.Close()
 	if err != nil {
 		log.Error("dhcpv4: srv.Close: %s", err)
@@ -916,6 +1257,8 @@ func v4Create(conf V4ServerConf) (srv DHCPServer, err error) {
 	s := &v4Server{}
 	s.conf = conf
 	s.leaseHosts = aghstrings.NewSet()
+	s.ifaceCheck = make(chan struct{}, 1)
+	s.addrProbe = s.probeAddr
 
 	// TODO(a.garipov): Don't use a disabled server in other places or just
 	// use an interface.
@@ -923,22 +1266,11 @@ func v4Create(conf V4ServerConf) (srv DHCPServer, err error) {
 		return s, nil
 	}
 
-	var routerIP net.IP
-	routerIP, err = tryTo4(s.conf.GatewayIP)
+	s.conf.subnet, err = validateV4Subnet(conf.GatewayIP, conf.SubnetMask, conf.RangeStart, conf.RangeEnd)
 	if err != nil {
-		return s, fmt.Errorf("dhcpv4: %w", err)
-	}
-
-	if s.conf.SubnetMask == nil {
-		return s, fmt.Errorf("dhcpv4: invalid subnet mask: %v", s.conf.SubnetMask)
-	}
-
-	subnetMask := make([]byte, 4)
-	copy(subnetMask, s.conf.SubnetMask.To4())
-
-	s.conf.subnet = &net.IPNet{
-		IP:   routerIP,
-		Mask: subnetMask,
+		// Don't wrap the error to keep it a *configError for the HTTP
+		// API.
+		return s, err
 	}
 
 	s.conf.ipRange, err = newIPRange(conf.RangeStart, conf.RangeEnd)
@@ -955,6 +1287,12 @@ func v4Create(conf V4ServerConf) (srv DHCPServer, err error) {
 		s.conf.leaseTime = time.Second * time.Duration(conf.LeaseDuration)
 	}
 
+	if conf.ConflictCooldown == 0 {
+		s.conf.conflictCooldown = s.conf.leaseTime
+	} else {
+		s.conf.conflictCooldown = time.Second * time.Duration(conf.ConflictCooldown)
+	}
+
 	p := newDHCPOptionParser()
 
 	for i, o := range conf.Options {
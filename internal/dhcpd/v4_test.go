@@ -5,6 +5,7 @@ package dhcpd
 import (
 	"net"
 	"testing"
+	"time"
 
 	"github.com/insomniacslk/dhcp/dhcpv4"
 	"github.com/stretchr/testify/assert"
@@ -353,3 +354,208 @@ func TestNormalizeHostname(t *testing.T) {
 		})
 	}
 }
+
+// requestLease goes through the whole discover-request exchange with s for the
+// client with mac and hostname.
+func requestLease(t *testing.T, s *v4Server, mac net.HardwareAddr, hostname string) {
+	t.Helper()
+
+	req, err := dhcpv4.NewDiscovery(mac, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+	require.NoError(t, err)
+
+	resp, err := dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.process(req, resp))
+
+	req, err = dhcpv4.NewRequestFromOffer(resp, dhcpv4.WithOption(dhcpv4.OptHostName(hostname)))
+	require.NoError(t, err)
+
+	resp, err = dhcpv4.NewReplyFromRequest(req)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.process(req, resp))
+}
+
+func TestV4Server_hostnameConflicts(t *testing.T) {
+	sIface, err := v4Create(V4ServerConf{
+		Enabled:    true,
+		RangeStart: net.IP{192, 168, 10, 100},
+		RangeEnd:   net.IP{192, 168, 10, 200},
+		GatewayIP:  net.IP{192, 168, 10, 1},
+		SubnetMask: net.IP{255, 255, 255, 0},
+		notify:     notify4,
+	})
+	require.NoError(t, err)
+
+	s, ok := sIface.(*v4Server)
+	require.True(t, ok)
+
+	s.conf.dnsIPAddrs = []net.IP{{192, 168, 10, 1}}
+
+	macs := []net.HardwareAddr{
+		{0x11, 0x11, 0x11, 0xAA, 0xAA, 0xAA},
+		{0x22, 0x22, 0x22, 0xBB, 0xBB, 0xBB},
+		{0x33, 0x33, 0x33, 0xBB, 0xBB, 0xBB},
+	}
+	for _, mac := range macs {
+		requestLease(t, s, mac, "Android")
+	}
+
+	hostnames := func() (hosts map[string]string) {
+		hosts = map[string]string{}
+		for _, l := range s.GetLeases(LeasesAll) {
+			hosts[l.HWAddr.String()] = l.Hostname
+		}
+
+		return hosts
+	}
+
+	assert.Equal(t, map[string]string{
+		macs[0].String(): "android",
+		macs[1].String(): "android-bbbbbb",
+		macs[2].String(): "android-2",
+	}, hostnames())
+
+	t.Run("renew", func(t *testing.T) {
+		requestLease(t, s, macs[1], "android")
+
+		assert.Equal(t, "android-bbbbbb", hostnames()[macs[1].String()])
+	})
+
+	t.Run("static", func(t *testing.T) {
+		staticMAC := net.HardwareAddr{0x44, 0x44, 0x44, 0x44, 0x44, 0x44}
+		err = s.AddStaticLease(Lease{
+			HWAddr:   staticMAC,
+			IP:       net.IP{192, 168, 10, 10},
+			Hostname: "android",
+		})
+		require.NoError(t, err)
+
+		hosts := hostnames()
+		assert.Equal(t, "android", hosts[staticMAC.String()])
+		assert.Equal(t, "android-aaaaaa", hosts[macs[0].String()])
+
+		assert.True(t, s.leaseHosts.Has("android-aaaaaa"))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		now := time.Now()
+
+		s.leasesLock.Lock()
+		l := s.findLease(macs[2])
+		require.NotNil(t, l)
+
+		l.Expiry = now.Add(-time.Second)
+		s.leasesLock.Unlock()
+
+		assert.True(t, s.hasExpired(now.Add(-time.Minute), now))
+		assert.False(t, s.hasExpired(now, now.Add(time.Minute)))
+
+		_, ok = hostnames()[macs[2].String()]
+		assert.False(t, ok)
+
+		// The hostname of the expired lease can be taken.
+		requestLease(t, s, net.HardwareAddr{0x55, 0x55, 0x55, 0x55, 0x55, 0x55}, "android-2")
+
+		hosts := hostnames()
+		assert.Equal(t, "android-2", hosts["55:55:55:55:55:55"])
+	})
+}
+
+func TestV4Server_processDiscover_conflict(t *testing.T) {
+	sIface, err := v4Create(V4ServerConf{
+		Enabled:          true,
+		RangeStart:       net.IP{192, 168, 10, 100},
+		RangeEnd:         net.IP{192, 168, 10, 200},
+		GatewayIP:        net.IP{192, 168, 10, 1},
+		SubnetMask:       net.IP{255, 255, 255, 0},
+		ConflictCooldown: 60,
+		notify:           notify4,
+	})
+	require.NoError(t, err)
+
+	s, ok := sIface.(*v4Server)
+	require.True(t, ok)
+
+	printerMAC := net.HardwareAddr{0xBB, 0xBB, 0xBB, 0xBB, 0xBB, 0xBB}
+	used := map[string]net.HardwareAddr{
+		"192.168.10.100": printerMAC,
+		"192.168.10.101": nil,
+	}
+	s.addrProbe = func(target net.IP) (ok bool, mac net.HardwareAddr) {
+		mac, ok = used[target.String()]
+
+		return ok, mac
+	}
+
+	discover := func(t *testing.T, mac net.HardwareAddr) (l *Lease) {
+		t.Helper()
+
+		req, derr := dhcpv4.NewDiscovery(mac)
+		require.NoError(t, derr)
+
+		resp, derr := dhcpv4.NewReplyFromRequest(req)
+		require.NoError(t, derr)
+
+		l, derr = s.processDiscover(req, resp)
+		require.NoError(t, derr)
+		require.NotNil(t, l)
+
+		return l
+	}
+
+	laptopMAC := net.HardwareAddr{0xAA, 0xAA, 0xAA, 0xAA, 0xAA, 0xAA}
+	l := discover(t, laptopMAC)
+	assert.Equal(t, net.IP{192, 168, 10, 102}, l.IP)
+
+	now := time.Now()
+	abandoned := s.abandoned(now)
+	require.Len(t, abandoned, 2)
+
+	assert.Equal(t, net.IP{192, 168, 10, 100}, abandoned[0].IP)
+	assert.Equal(t, printerMAC, abandoned[0].HWAddr)
+	assert.WithinDuration(t, now.Add(time.Minute), abandoned[0].Until, time.Minute)
+
+	assert.Equal(t, net.IP{192, 168, 10, 101}, abandoned[1].IP)
+	assert.Nil(t, abandoned[1].HWAddr)
+
+	s.commitLease(l)
+	leases := s.GetLeases(LeasesDynamic)
+	require.Len(t, leases, 1)
+
+	assert.Equal(t, laptopMAC, leases[0].HWAddr)
+
+	t.Run("clear_one", func(t *testing.T) {
+		assert.Zero(t, s.clearAbandoned(net.IP{192, 168, 10, 150}))
+		assert.Equal(t, 1, s.clearAbandoned(net.IP{192, 168, 10, 101}))
+
+		abandoned = s.abandoned(time.Now())
+		require.Len(t, abandoned, 1)
+
+		assert.Equal(t, net.IP{192, 168, 10, 100}, abandoned[0].IP)
+
+		// The device has left, so the address is offered.
+		delete(used, "192.168.10.101")
+		l = discover(t, net.HardwareAddr{0xCC, 0xCC, 0xCC, 0xCC, 0xCC, 0xCC})
+		assert.Equal(t, net.IP{192, 168, 10, 101}, l.IP)
+	})
+
+	t.Run("cooldown", func(t *testing.T) {
+		for _, sl := range s.leases {
+			if sl.isAbandoned() {
+				sl.Expiry = time.Now().Add(-time.Second)
+			}
+		}
+
+		assert.Empty(t, s.abandoned(time.Now()))
+
+		// The address is probed again after the cooldown.
+		l = discover(t, net.HardwareAddr{0xDD, 0xDD, 0xDD, 0xDD, 0xDD, 0xDD})
+		assert.Equal(t, net.IP{192, 168, 10, 103}, l.IP)
+		require.Len(t, s.abandoned(time.Now()), 1)
+	})
+
+	t.Run("clear_all", func(t *testing.T) {
+		assert.Equal(t, 1, s.clearAbandoned(nil))
+		assert.Empty(t, s.abandoned(time.Now()))
+	})
+}
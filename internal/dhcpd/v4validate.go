@@ -0,0 +1,165 @@
+package dhcpd
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// configError is an inconsistency in the DHCP configuration.
+type configError struct {
+	// field is the name of the JSON property of the configuration, which
+	// is inconsistent, for example "range_start".
+	field string
+
+	// msg describes the inconsistency.
+	msg string
+}
+
+// Error implements the error interface for *configError.
+func (err *configError) Error() (msg string) {
+	return err.field + ": " + err.msg
+}
+
+// newConfigError returns a *configError for field with the formatted message.
+func newConfigError(field, format string, args ...interface{}) (err *configError) {
+	return &configError{
+		field: field,
+		msg:   fmt.Sprintf(format, args...),
+	}
+}
+
+// broadcastIP returns the broadcast address of the IPv4 subnet.
+func broadcastIP(subnet *net.IPNet) (ip net.IP) {
+	ip = make(net.IP, net.IPv4len)
+	for i, b := range subnet.IP.To4() {
+		ip[i] = b | ^subnet.Mask[i]
+	}
+
+	return ip
+}
+
+// validateV4Subnet checks that the gateway, the subnet mask, and the range of
+// the dynamic leases are consistent with each other and returns the subnet.
+// The IP of subnet is the gateway.  The errors are of type *configError.
+func validateV4Subnet(gw, mask, start, end net.IP) (subnet *net.IPNet, err error) {
+	gw4 := gw.To4()
+	if gw4 == nil {
+		return nil, newConfigError("gateway_ip", "%v is not an ipv4 address", gw)
+	}
+
+	mask4 := mask.To4()
+	if mask4 == nil || !isValidSubnetMask(mask4) {
+		return nil, newConfigError("subnet_mask", "%v is not a valid ipv4 subnet mask", mask)
+	}
+
+	if ones, _ := net.IPMask(mask4).Size(); ones > 30 {
+		return nil, newConfigError("subnet_mask", "subnet /%d has no addresses to lease", ones)
+	}
+
+	subnet = &net.IPNet{
+		IP:   gw4,
+		Mask: net.IPMask(mask4),
+	}
+	network := &net.IPNet{
+		IP:   gw4.Mask(subnet.Mask),
+		Mask: subnet.Mask,
+	}
+	bcast := broadcastIP(network)
+
+	if gw4.Equal(network.IP) {
+		return nil, newConfigError("gateway_ip", "%s is the address of the subnet %s", gw4, network)
+	} else if gw4.Equal(bcast) {
+		return nil, newConfigError("gateway_ip", "%s is the broadcast address of the subnet %s", gw4, network)
+	}
+
+	for _, r := range []struct {
+		ip    net.IP
+		field string
+	}{{
+		ip:    start,
+		field: "range_start",
+	}, {
+		ip:    end,
+		field: "range_end",
+	}} {
+		ip4 := r.ip.To4()
+		switch {
+		case ip4 == nil:
+			return nil, newConfigError(r.field, "%v is not an ipv4 address", r.ip)
+		case !network.Contains(ip4):
+			return nil, newConfigError(r.field, "%s is not within the subnet %s of the gateway", ip4, network)
+		case ip4.Equal(network.IP), ip4.Equal(bcast):
+			return nil, newConfigError(r.field, "%s is the address or the broadcast address of the subnet %s", ip4, network)
+		}
+	}
+
+	if bytes.Compare(start.To4(), end.To4()) > 0 {
+		return nil, newConfigError("range_end", "%s is less than range_start %s", end.To4(), start.To4())
+	}
+
+	if bytes.Compare(start.To4(), gw4) <= 0 && bytes.Compare(gw4, end.To4()) <= 0 {
+		return nil, newConfigError("gateway_ip", "%s is within the range %s-%s", gw4, start.To4(), end.To4())
+	}
+
+	return subnet, nil
+}
+
+// validateV4Iface checks that iface has an IPv4 address within subnet, with the
+// same mask, and outside of the range of the dynamic leases.  ifaceName is used
+// in the error messages.  The inconsistencies are of type *configError.
+func validateV4Iface(iface netIface, ifaceName string, subnet *net.IPNet, r *ipRange) (err error) {
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return fmt.Errorf("getting addresses of interface %s: %w", ifaceName, err)
+	}
+
+	var ifaceNets []string
+	for _, a := range addrs {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil {
+			continue
+		}
+
+		ifaceNets = append(ifaceNets, ipnet.String())
+		if !ipnet.Contains(subnet.IP) && !subnet.Contains(ipnet.IP) {
+			continue
+		}
+
+		ones, _ := ipnet.Mask.Size()
+		wantOnes, _ := subnet.Mask.Size()
+		if ones != wantOnes {
+			return newConfigError(
+				"subnet_mask",
+				"interface %s has the address %s, but the subnet mask is %s",
+				ifaceName,
+				ipnet,
+				net.IP(subnet.Mask),
+			)
+		}
+
+		if r.contains(ipnet.IP) {
+			return newConfigError(
+				"range_start",
+				"the range contains the address %s of interface %s",
+				ipnet.IP,
+				ifaceName,
+			)
+		}
+
+		return nil
+	}
+
+	if len(ifaceNets) == 0 {
+		return newConfigError("interface_name", "interface %s has no ipv4 addresses", ifaceName)
+	}
+
+	return newConfigError(
+		"interface_name",
+		"interface %s has no ipv4 address within the subnet of the gateway %s, its addresses are %s",
+		ifaceName,
+		subnet.IP,
+		strings.Join(ifaceNets, ", "),
+	)
+}
@@ -0,0 +1,146 @@
+package dhcpd
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateV4Subnet(t *testing.T) {
+	var (
+		gw    = net.IP{192, 168, 10, 1}
+		mask  = net.IP{255, 255, 255, 0}
+		start = net.IP{192, 168, 10, 100}
+		end   = net.IP{192, 168, 10, 200}
+	)
+
+	testCases := []struct {
+		gw, mask   net.IP
+		start, end net.IP
+		name       string
+		wantField  string
+	}{{
+		gw: gw, mask: mask, start: start, end: end,
+		name:      "valid",
+		wantField: "",
+	}, {
+		gw: net.ParseIP("fe80::1"), mask: mask, start: start, end: end,
+		name:      "gateway_ipv6",
+		wantField: "gateway_ip",
+	}, {
+		gw: gw, mask: net.IP{255, 0, 255, 0}, start: start, end: end,
+		name:      "mask_not_contiguous",
+		wantField: "subnet_mask",
+	}, {
+		gw: gw, mask: net.IP{255, 255, 255, 254}, start: start, end: end,
+		name:      "mask_too_narrow",
+		wantField: "subnet_mask",
+	}, {
+		gw: net.IP{192, 168, 10, 0}, mask: mask, start: start, end: end,
+		name:      "gateway_network",
+		wantField: "gateway_ip",
+	}, {
+		gw: net.IP{192, 168, 10, 255}, mask: mask, start: start, end: end,
+		name:      "gateway_broadcast",
+		wantField: "gateway_ip",
+	}, {
+		gw: gw, mask: mask, start: net.IP{192, 168, 11, 100}, end: end,
+		name:      "start_outside",
+		wantField: "range_start",
+	}, {
+		gw: gw, mask: mask, start: start, end: net.IP{192, 168, 10, 255},
+		name:      "end_broadcast",
+		wantField: "range_end",
+	}, {
+		gw: gw, mask: mask, start: end, end: start,
+		name:      "reversed",
+		wantField: "range_end",
+	}, {
+		gw: net.IP{192, 168, 10, 150}, mask: mask, start: start, end: end,
+		name:      "gateway_in_range",
+		wantField: "gateway_ip",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			subnet, err := validateV4Subnet(tc.gw, tc.mask, tc.start, tc.end)
+			if tc.wantField == "" {
+				require.NoError(t, err)
+				assert.Equal(t, "192.168.10.1/24", subnet.String())
+
+				return
+			}
+
+			var cerr *configError
+			require.True(t, errors.As(err, &cerr), "got %v", err)
+			assert.Equal(t, tc.wantField, cerr.field)
+			assert.NotEmpty(t, cerr.msg)
+		})
+	}
+}
+
+func TestValidateV4Iface(t *testing.T) {
+	subnet := &net.IPNet{
+		IP:   net.IP{192, 168, 10, 1},
+		Mask: net.CIDRMask(24, 32),
+	}
+	r, err := newIPRange(net.IP{192, 168, 10, 100}, net.IP{192, 168, 10, 200})
+	require.NoError(t, err)
+
+	ipnet := func(s string) (n *net.IPNet) {
+		ip, n, perr := net.ParseCIDR(s)
+		require.NoError(t, perr)
+
+		n.IP = ip
+
+		return n
+	}
+
+	testCases := []struct {
+		iface     *fakeIface
+		name      string
+		wantField string
+	}{{
+		iface:     &fakeIface{addrs: []net.Addr{ipnet("fe80::1/64"), ipnet("192.168.10.1/24")}},
+		name:      "valid",
+		wantField: "",
+	}, {
+		iface:     &fakeIface{addrs: []net.Addr{ipnet("192.168.10.1/16")}},
+		name:      "other_mask",
+		wantField: "subnet_mask",
+	}, {
+		iface:     &fakeIface{addrs: []net.Addr{ipnet("192.168.10.150/24")}},
+		name:      "address_in_range",
+		wantField: "range_start",
+	}, {
+		iface:     &fakeIface{addrs: []net.Addr{ipnet("10.0.0.1/8")}},
+		name:      "other_subnet",
+		wantField: "interface_name",
+	}, {
+		iface:     &fakeIface{addrs: []net.Addr{ipnet("fe80::1/64")}},
+		name:      "no_ipv4",
+		wantField: "interface_name",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			verr := validateV4Iface(tc.iface, "eth0", subnet, r)
+			if tc.wantField == "" {
+				assert.NoError(t, verr)
+
+				return
+			}
+
+			var cerr *configError
+			require.True(t, errors.As(verr, &cerr), "got %v", verr)
+			assert.Equal(t, tc.wantField, cerr.field)
+			assert.Contains(t, cerr.msg, "eth0")
+		})
+	}
+
+	verr := validateV4Iface(&fakeIface{err: errors.New("no iface")}, "eth0", subnet, r)
+	assert.Error(t, verr)
+}
@@ -0,0 +1,96 @@
+package dnsfilter
+
+// Sources of the applied settings.
+const (
+	SettingsSourceGlobal  = "global"
+	SettingsSourceClient  = "client"
+	SettingsSourceProfile = "profile"
+)
+
+// SettingsSources are the sources of the settings, which may be set for the
+// clients and the profiles.  Each is one of the SettingsSource constants, an
+// empty one means SettingsSourceGlobal.
+type SettingsSources struct {
+	Filtering       string `json:"filtering"`
+	SafeSearch      string `json:"safe_search"`
+	SafeBrowsing    string `json:"safe_browsing"`
+	Parental        string `json:"parental"`
+	BlockedServices string `json:"blocked_services"`
+	FilterGroups    string `json:"filter_groups"`
+}
+
+// AppliedSettings is the summary of the settings applied to a request and of
+// where those come from.
+type AppliedSettings struct {
+	// Client is the name of the persistent client, if any.
+	Client string `json:"client,omitempty"`
+
+	// ClientMatch is the identifier of the persistent client, by which it
+	// has been found: its ClientID, IP address, subnet, or MAC address.
+	ClientMatch string `json:"client_match,omitempty"`
+
+	// Profile is the name of the profile of the client, if any.
+	Profile string `json:"profile,omitempty"`
+
+	// Sources are the sources of the settings.
+	Sources SettingsSources `json:"sources"`
+
+	// BlockedServices are the names of the blocked services.
+	BlockedServices []string `json:"blocked_services"`
+
+	// FilterGroups are the groups of the blocklists.  nil means the
+	// globally enabled groups.
+	FilterGroups []string `json:"filter_groups,omitempty"`
+
+	// ProfileScheduled is true if the schedule of the profile has been
+	// active, so that its blocked services have applied.
+	ProfileScheduled bool `json:"profile_scheduled,omitempty"`
+
+	// The effective toggles.
+
+	Protection   bool `json:"protection"`
+	Filtering    bool `json:"filtering"`
+	SafeSearch   bool `json:"safe_search"`
+	SafeBrowsing bool `json:"safe_browsing"`
+	Parental     bool `json:"parental"`
+	AAAADisabled bool `json:"aaaa_disabled"`
+}
+
+// AppliedSummary returns the summary of the settings applied to a request
+// from s and the sources recorded in s.Applied.  protection is the effective
+// state of the protection.
+func (s *FilteringSettings) AppliedSummary(protection bool) (a *AppliedSettings) {
+	a = &AppliedSettings{}
+	*a = s.Applied
+
+	for _, src := range []*string{
+		&a.Sources.Filtering,
+		&a.Sources.SafeSearch,
+		&a.Sources.SafeBrowsing,
+		&a.Sources.Parental,
+		&a.Sources.BlockedServices,
+		&a.Sources.FilterGroups,
+	} {
+		if *src == "" {
+			*src = SettingsSourceGlobal
+		}
+	}
+
+	a.BlockedServices = make([]string, 0, len(s.ServicesRules))
+	for _, sr := range s.ServicesRules {
+		a.BlockedServices = append(a.BlockedServices, sr.Name)
+	}
+
+	if s.FilterGroups != nil {
+		a.FilterGroups = append([]string{}, s.FilterGroups...)
+	}
+
+	a.Protection = protection
+	a.Filtering = s.FilteringEnabled
+	a.SafeSearch = s.SafeSearchEnabled
+	a.SafeBrowsing = s.SafeBrowsingEnabled
+	a.Parental = s.ParentalEnabled
+	a.AAAADisabled = s.AAAADisabled
+
+	return a
+}
@@ -0,0 +1,50 @@
+package dnsfilter
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilteringSettings_AppliedSummary(t *testing.T) {
+	setts := &FilteringSettings{
+		ServicesRules: []ServiceEntry{{
+			Name: "youtube",
+		}},
+		FilteringEnabled: true,
+		ParentalEnabled:  true,
+		AAAADisabled:     true,
+		FilterGroups:     []string{"kids"},
+		Applied: AppliedSettings{
+			Client:      "tablet",
+			ClientMatch: "192.168.1.0/24",
+			Profile:     "kids",
+			Sources: SettingsSources{
+				Parental:     SettingsSourceProfile,
+				FilterGroups: SettingsSourceClient,
+			},
+			ProfileScheduled: true,
+		},
+	}
+
+	assert.Equal(t, &AppliedSettings{
+		Client:      "tablet",
+		ClientMatch: "192.168.1.0/24",
+		Profile:     "kids",
+		Sources: SettingsSources{
+			Filtering:       SettingsSourceGlobal,
+			SafeSearch:      SettingsSourceGlobal,
+			SafeBrowsing:    SettingsSourceGlobal,
+			Parental:        SettingsSourceProfile,
+			BlockedServices: SettingsSourceGlobal,
+			FilterGroups:    SettingsSourceClient,
+		},
+		BlockedServices:  []string{"youtube"},
+		FilterGroups:     []string{"kids"},
+		ProfileScheduled: true,
+		Protection:       false,
+		Filtering:        true,
+		Parental:         true,
+		AAAADisabled:     true,
+	}, setts.AppliedSummary(false))
+}
@@ -2,6 +2,7 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 
 	"github.com/AdguardTeam/golibs/log"
@@ -253,6 +254,18 @@ func BlockedSvcKnown(s string) bool {
 	return ok
 }
 
+// validateBlockedServices returns an error if any of the services in list is
+// unknown.
+func validateBlockedServices(list []string) (err error) {
+	for _, s := range list {
+		if !BlockedSvcKnown(s) {
+			return fmt.Errorf("unknown blocked service %q", s)
+		}
+	}
+
+	return nil
+}
+
 // ApplyBlockedServices - set blocked services settings for this DNS request
 func (d *DNSFilter) ApplyBlockedServices(setts *FilteringSettings, list []string, global bool) {
 	setts.ServicesRules = []ServiceEntry{}
@@ -297,6 +310,13 @@ func (d *DNSFilter) handleBlockedServicesSet(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	err = validateBlockedServices(list)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	d.confLock.Lock()
 	d.Config.BlockedServices = list
 	d.confLock.Unlock()
@@ -0,0 +1,147 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+)
+
+// CanonicalRule returns rule with the domain names written in the canonical
+// form, see NormalizeRule.  rule is returned as is if its domain names can't be
+// mapped.
+func CanonicalRule(rule string) (canon string) {
+	canon, err := NormalizeRule(rule)
+	if err != nil {
+		return rule
+	}
+
+	return canon
+}
+
+// NormalizeRule returns rule with the domain names written in the canonical
+// form, see aghnet.NormalizeDomain, so that the internationalized names are
+// written in punycode.  The domain names are normalized in the domain-only
+// rules, in the hosts-syntax rules, and in the adblock-syntax rules starting
+// with "||".  Other rules, like the comments and the regular expressions, are
+// returned as is.  err is returned if a domain name can't be mapped.
+func NormalizeRule(rule string) (norm string, err error) {
+	trimmed := strings.TrimSpace(rule)
+	if trimmed == "" || trimmed[0] == '!' || trimmed[0] == '#' {
+		return rule, nil
+	}
+
+	if strings.HasPrefix(trimmed, "||") || strings.HasPrefix(trimmed, "@@||") {
+		norm, err = normalizeAdblockRule(trimmed)
+		if err != nil || norm != trimmed {
+			return norm, err
+		}
+
+		return rule, nil
+	}
+
+	fields := strings.Fields(trimmed)
+	if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+		return normalizeHostsRule(rule, fields)
+	}
+
+	if len(fields) == 1 && isDomainRule(trimmed) {
+		return normalizeDomainRule(rule, trimmed)
+	}
+
+	return rule, nil
+}
+
+// isDomainRule returns true if the single-field rule may be a domain-only rule,
+// that is it's either written as an FQDN or contains an internationalized
+// domain name and no characters special for the other rule syntaxes.
+func isDomainRule(rule string) (ok bool) {
+	if !strings.HasSuffix(rule, ".") && !aghnet.HasIDN(rule) {
+		return false
+	}
+
+	return !strings.ContainsAny(rule, `/|^$@[](){}?+\`)
+}
+
+// normalizeDomainRule normalizes the domain-only rule, trimmed is the rule
+// without the surrounding spaces.
+func normalizeDomainRule(rule, trimmed string) (norm string, err error) {
+	host, err := aghnet.NormalizeDomain(trimmed)
+	if err != nil {
+		return "", err
+	}
+
+	if aghnet.ValidateDomainName(strings.TrimPrefix(host, "*.")) != nil {
+		return rule, nil
+	}
+
+	return host, nil
+}
+
+// normalizeAdblockRule normalizes the domain name of the adblock-syntax rule
+// starting with "||" or "@@||".
+func normalizeAdblockRule(rule string) (norm string, err error) {
+	start := strings.Index(rule, "||") + len("||")
+	end := strings.IndexAny(rule[start:], "^$|/")
+	if end < 0 {
+		end = len(rule)
+	} else {
+		end += start
+	}
+
+	// Don't change the rules matching the URL paths, since the trailing dot
+	// may be significant there.
+	if end < len(rule) && rule[end] == '/' {
+		return rule, nil
+	}
+
+	host := rule[start:end]
+	normHost, err := aghnet.NormalizeDomain(host)
+	if err != nil {
+		return "", err
+	} else if normHost == host {
+		return rule, nil
+	}
+
+	return rule[:start] + normHost + rule[end:], nil
+}
+
+// normalizeHostsRule normalizes the host names of the hosts-syntax rule, the
+// fields of which are fields.  rule is returned as is if it's already
+// normalized.
+func normalizeHostsRule(rule string, fields []string) (norm string, err error) {
+	changed := false
+	for i, f := range fields[1:] {
+		sharp := strings.IndexByte(f, '#')
+		if sharp == 0 {
+			break
+		}
+
+		host, comment := f, ""
+		if sharp > 0 {
+			host, comment = f[:sharp], f[sharp:]
+		}
+
+		var normHost string
+		normHost, err = aghnet.NormalizeDomain(host)
+		if err != nil {
+			return "", fmt.Errorf("host at index %d: %w", i, err)
+		}
+
+		if normHost != host {
+			fields[i+1] = normHost + comment
+			changed = true
+		}
+
+		if sharp > 0 {
+			break
+		}
+	}
+
+	if !changed {
+		return rule, nil
+	}
+
+	return strings.Join(fields, " "), nil
+}
@@ -0,0 +1,261 @@
+package dnsfilter
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCanonicalRule(t *testing.T) {
+	testCases := []struct {
+		name string
+		rule string
+		want string
+	}{{
+		name: "empty",
+		rule: "",
+		want: "",
+	}, {
+		name: "comment",
+		rule: "! Example.LAN.",
+		want: "! Example.LAN.",
+	}, {
+		name: "hash_comment",
+		rule: "# Example.LAN.",
+		want: "# Example.LAN.",
+	}, {
+		name: "adblock",
+		rule: "||Example.LAN.^",
+		want: "||example.lan^",
+	}, {
+		name: "adblock_modifiers",
+		rule: "@@||example.lan.^$client=Phone",
+		want: "@@||example.lan^$client=Phone",
+	}, {
+		name: "adblock_no_separator",
+		rule: "||example.lan.",
+		want: "||example.lan",
+	}, {
+		name: "adblock_canonical",
+		rule: "  ||example.lan^",
+		want: "  ||example.lan^",
+	}, {
+		name: "adblock_path",
+		rule: "||example.lan./path",
+		want: "||example.lan./path",
+	}, {
+		name: "hosts",
+		rule: "192.168.1.2\tNAS.lan. nas.",
+		want: "192.168.1.2 nas.lan nas",
+	}, {
+		name: "hosts_comment",
+		rule: "192.168.1.2 nas.lan.#NAS. router.lan.",
+		want: "192.168.1.2 nas.lan#NAS. router.lan.",
+	}, {
+		name: "hosts_canonical",
+		rule: "192.168.1.2\tnas.lan",
+		want: "192.168.1.2\tnas.lan",
+	}, {
+		name: "domain",
+		rule: "Example.LAN.",
+		want: "example.lan",
+	}, {
+		name: "wildcard",
+		rule: "*.example.lan.",
+		want: "*.example.lan",
+	}, {
+		name: "regexp",
+		rule: "/example.lan./",
+		want: "/example.lan./",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, CanonicalRule(tc.rule))
+		})
+	}
+}
+
+func TestNormalizeRule(t *testing.T) {
+	testCases := []struct {
+		name    string
+		rule    string
+		want    string
+		wantErr bool
+	}{{
+		name: "adblock_unicode",
+		rule: "||пример.рф^",
+		want: "||xn--e1afmkfd.xn--p1ai^",
+	}, {
+		name: "adblock_punycode",
+		rule: "||XN--E1AFMKFD.xn--p1ai^$important",
+		want: "||xn--e1afmkfd.xn--p1ai^$important",
+	}, {
+		name: "adblock_homoglyph",
+		rule: "@@||p\u0430ypal.com^",
+		want: "@@||xn--pypal-4ve.com^",
+	}, {
+		name: "hosts_unicode",
+		rule: "0.0.0.0 ПРИМЕР.РФ ｅｘａｍｐｌｅ.com",
+		want: "0.0.0.0 xn--e1afmkfd.xn--p1ai example.com",
+	}, {
+		name: "domain_unicode",
+		rule: "\u0430\u0440\u0440\u04cf\u0435.com",
+		want: "xn--80ak6aa92e.com",
+	}, {
+		name: "regexp_unicode",
+		rule: "/пример/",
+		want: "/пример/",
+	}, {
+		name: "comment_unicode",
+		rule: "! пример.рф",
+		want: "! пример.рф",
+	}, {
+		name:    "adblock_bad",
+		rule:    "||xn--a.com^",
+		wantErr: true,
+	}, {
+		name:    "hosts_bad",
+		rule:    "0.0.0.0 example.com \u2488.com",
+		wantErr: true,
+	}, {
+		name:    "domain_bidi",
+		rule:    "\u0627\u0644a.com",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			norm, err := NormalizeRule(tc.rule)
+			if tc.wantErr {
+				assert.Error(t, err)
+				assert.Equal(t, tc.rule, CanonicalRule(tc.rule))
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, norm)
+		})
+	}
+}
+
+// TestIDNMatrix checks that the internationalized domain names are matched the
+// same way regardless of the form used by the rules and the requests, and that
+// the homoglyphs aren't confused with the Latin letters.
+func TestIDNMatrix(t *testing.T) {
+	const (
+		unicodeName = "пример.рф"
+		punyName    = "xn--e1afmkfd.xn--p1ai"
+		homoglyph   = "p\u0430ypal.com"
+	)
+
+	for _, saved := range []string{unicodeName, punyName, "ПРИМЕР.РФ"} {
+		rules := strings.Join([]string{
+			CanonicalRule("||" + saved + "^"),
+			CanonicalRule("||" + homoglyph + "^"),
+		}, "\n")
+
+		d := newForTest(nil, []Filter{{ID: 0, Data: []byte(rules)}})
+		t.Cleanup(d.Close)
+
+		t.Run(saved, func(t *testing.T) {
+			for _, host := range []string{unicodeName, punyName, "XN--E1AFMKFD.XN--P1AI.", "sub." + punyName} {
+				res, err := d.CheckHost(host, dns.TypeA, &setts)
+				require.NoError(t, err)
+
+				assert.True(t, res.IsFiltered, host)
+			}
+
+			res, err := d.CheckHost("xn--pypal-4ve.com", dns.TypeA, &setts)
+			require.NoError(t, err)
+			assert.True(t, res.IsFiltered)
+
+			res, err = d.CheckHost("paypal.com", dns.TypeA, &setts)
+			require.NoError(t, err)
+			assert.False(t, res.IsFiltered)
+		})
+	}
+}
+
+// TestFQDNMatrix checks that the domain names with and without the trailing
+// dot are matched the same way by the features matching on names, regardless
+// of the form in which the names have been saved.
+func TestFQDNMatrix(t *testing.T) {
+	forms := []struct {
+		name  string
+		canon func(s string) (f string)
+	}{{
+		name:  "plain",
+		canon: func(s string) (f string) { return s },
+	}, {
+		name:  "fqdn",
+		canon: dns.Fqdn,
+	}, {
+		name:  "upper_fqdn",
+		canon: func(s string) (f string) { return dns.Fqdn(strings.ToUpper(s)) },
+	}}
+
+	rewriteIP := net.IP{1, 2, 3, 4}
+
+	for _, saved := range forms {
+		rules := strings.Join([]string{
+			CanonicalRule("||" + saved.canon("blocked.lan") + "^"),
+			CanonicalRule("0.0.0.0 " + saved.canon("hosts.lan")),
+			CanonicalRule(saved.canon("plain.lan")),
+		}, "\n")
+
+		d := newForTest(nil, []Filter{{ID: 0, Data: []byte(rules)}})
+		t.Cleanup(d.Close)
+
+		d.Rewrites = []RewriteEntry{{
+			Domain: saved.canon("rewrite.lan"),
+			Answer: rewriteIP.String(),
+		}, {
+			Domain: saved.canon("*.wildcard.lan"),
+			Answer: rewriteIP.String(),
+		}, {
+			Domain: saved.canon("alias.lan"),
+			Answer: saved.canon("rewrite.lan"),
+		}}
+		d.prepareRewrites()
+
+		for _, queried := range forms {
+			name := "saved_" + saved.name + "_queried_" + queried.name
+			t.Run(name, func(t *testing.T) {
+				for _, host := range []string{"blocked.lan", "sub.blocked.lan", "hosts.lan", "plain.lan"} {
+					res, err := d.CheckHost(queried.canon(host), dns.TypeA, &setts)
+					require.NoError(t, err)
+
+					assert.True(t, res.IsFiltered, host)
+				}
+
+				for _, host := range []string{"rewrite.lan", "a.wildcard.lan", "alias.lan"} {
+					res, err := d.CheckHost(queried.canon(host), dns.TypeA, &setts)
+					require.NoError(t, err)
+
+					assert.Equal(t, Rewritten, res.Reason, host)
+					assert.Equal(t, []net.IP{rewriteIP}, res.IPList, host)
+				}
+			})
+		}
+
+		t.Run("saved_"+saved.name+"_delete", func(t *testing.T) {
+			for _, queried := range forms {
+				assert.True(t, d.Rewrites[0].equals(RewriteEntry{
+					Domain: queried.canon("rewrite.lan"),
+					Answer: rewriteIP.String(),
+				}), queried.name)
+
+				assert.True(t, d.Rewrites[2].equals(RewriteEntry{
+					Domain: queried.canon("alias.lan"),
+					Answer: queried.canon("rewrite.lan"),
+				}), queried.name)
+			}
+		})
+	}
+}
@@ -4,22 +4,21 @@ package dnsfilter
 import (
 	"context"
 	"fmt"
-	"io/ioutil"
+	"math/rand"
 	"net"
 	"net/http"
-	"os"
-	"runtime"
 	"runtime/debug"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/filtering"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
-	"github.com/AdguardTeam/urlfilter"
-	"github.com/AdguardTeam/urlfilter/filterlist"
 	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 )
@@ -42,6 +41,23 @@ type FilteringSettings struct {
 	SafeSearchEnabled   bool
 	SafeBrowsingEnabled bool
 	ParentalEnabled     bool
+
+	// AAAADisabled means that AAAA requests of the client should be
+	// answered with an empty response.
+	AAAADisabled bool
+
+	// FilterGroups are the names of the groups of the blocklists applied to
+	// the request.  nil means the default groups, see SetFilterGroups.
+	FilterGroups []string
+
+	// BypassedHosts are the hosts, including their subdomains, to which the
+	// blocked services and the parental control don't apply for the client.
+	BypassedHosts []string
+
+	// Applied are the client, the profile, and the sources of the settings
+	// of the request.  The effective values are filled in by
+	// AppliedSummary.
+	Applied AppliedSettings
 }
 
 // Resolver is the interface for net.Resolver to simplify testing.
@@ -60,6 +76,11 @@ type Config struct {
 	ParentalCacheSize     uint `yaml:"parental_cache_size"`     // (in bytes)
 	CacheTime             uint `yaml:"cache_time"`              // Element's TTL (in minutes)
 
+	// MatchCacheSize is the maximum number of the recent decisions of the
+	// filtering rules cached by the hostname and the client settings.  Zero
+	// disables the cache.
+	MatchCacheSize uint `yaml:"match_cache_size"`
+
 	Rewrites []RewriteEntry `yaml:"rewrites"`
 
 	// Names of services to block (globally).
@@ -70,6 +91,10 @@ type Config struct {
 	// system configuration files (e.g. /etc/hosts).
 	EtcHosts *aghnet.EtcHostsContainer `yaml:"-"`
 
+	// Outbound controls the connections to the safe browsing and the
+	// parental control services.  It may be nil.
+	Outbound *aghnet.Outbound `yaml:"-"`
+
 	// Called when the configuration is changed by HTTP request
 	ConfigModified func() `yaml:"-"`
 
@@ -78,6 +103,20 @@ type Config struct {
 
 	// CustomResolver is the resolver used by DNSFilter.
 	CustomResolver Resolver `yaml:"-"`
+
+	// CompiledFilters tells if the simple rules of the downloaded blocklists
+	// are matched via the memory-mapped indexes stored next to the lists
+	// instead of being kept in memory.
+	CompiledFilters bool `yaml:"compiled_filters"`
+
+	// RewritePrecedence is how the requests matching both a rewrite entry
+	// and a blocking filtering rule are handled.  An empty value means
+	// RewritePrecedenceBlock.
+	RewritePrecedence RewritePrecedence `yaml:"rewrite_precedence"`
+
+	// FiltersApplied is called after the filtering engine has been built
+	// from the current filters, but not from a snapshot.
+	FiltersApplied func(blockFilters, allowFilters []Filter) `yaml:"-"`
 }
 
 // LookupStats store stats collected during safebrowsing or parental checks
@@ -95,6 +134,30 @@ type Stats struct {
 	Safesearch   LookupStats
 }
 
+// Sources of the filtering engine.
+const (
+	// EngineSourceLive means that the engine is built from the current
+	// filters.
+	EngineSourceLive = "live"
+
+	// EngineSourceSnapshot means that the engine is built from a snapshot
+	// of the filters which have been used before.
+	EngineSourceSnapshot = "snapshot"
+)
+
+// EngineGeneration describes a built filtering engine.
+type EngineGeneration struct {
+	// BuiltAt is the time when the engine has been built.
+	BuiltAt time.Time `json:"built_at"`
+
+	// Source is either EngineSourceLive or EngineSourceSnapshot.
+	Source string `json:"source"`
+
+	// ID is the number of the engine.  It's incremented each time a new
+	// engine is built.  Zero means that no engine has been built yet.
+	ID uint64 `json:"id"`
+}
+
 // Parameters to pass to filters-initializer goroutine
 type filtersInitializerParams struct {
 	allowFilters []Filter
@@ -103,16 +166,88 @@ type filtersInitializerParams struct {
 
 type hostChecker struct {
 	check func(host string, qtype uint16, setts *FilteringSettings) (res Result, err error)
+
+	// enabled returns false if the check is disabled for the client
+	// described by setts, in which case check isn't called.  If it's nil,
+	// the check is always enabled.
+	enabled func(setts *FilteringSettings) (ok bool)
+
 	name  string
+	stage Stage
+
+	// bypassable is true if the check is skipped for the hosts from
+	// FilteringSettings.BypassedHosts.
+	bypassable bool
+}
+
+// Stage is a stage of the filtering of a request.
+type Stage string
+
+// Stage values.
+const (
+	StageEtcHosts        Stage = "etc_hosts"
+	StageFiltering       Stage = "filtering"
+	StageBlockedServices Stage = "blocked_services"
+	StageSafeBrowsing    Stage = "safe_browsing"
+	StageParental        Stage = "parental"
+	StageSafeSearch      Stage = "safe_search"
+)
+
+// StageStatus is the outcome of a filtering stage.
+type StageStatus string
+
+// StageStatus values.
+const (
+	// StageDisabled means that the stage is disabled for the client and has
+	// been skipped.
+	StageDisabled StageStatus = "disabled"
+
+	// StageNotMatched means that the stage has been checked and hasn't
+	// matched.
+	StageNotMatched StageStatus = "not_matched"
+
+	// StageMatched means that the stage has matched, so the stages after it
+	// haven't been checked.
+	StageMatched StageStatus = "matched"
+
+	// StageBypassed means that the stage has been skipped, since the host is
+	// among the bypassed ones, see FilteringSettings.BypassedHosts.
+	StageBypassed StageStatus = "bypassed"
+)
+
+// StageResult is the outcome of a single filtering stage of a request.
+type StageResult struct {
+	Stage  Stage
+	Status StageStatus
 }
 
 // DNSFilter matches hostnames and DNS requests against filtering rules.
 type DNSFilter struct {
-	rulesStorage         *filterlist.RuleStorage
-	filteringEngine      *urlfilter.DNSEngine
-	rulesStorageAllow    *filterlist.RuleStorage
-	filteringEngineAllow *urlfilter.DNSEngine
-	engineLock           sync.RWMutex
+	// engine is the rule-based filtering engine.  It's protected by
+	// engineLock.
+	engine     *filtering.Engine
+	engineLock sync.RWMutex
+
+	// generation describes the current engine.  It's protected by
+	// engineLock.
+	generation EngineGeneration
+
+	// groupEngines are the engines of the groups of blocklists sorted by
+	// the name of the group.  They're protected by engineLock.
+	groupEngines []*groupEngine
+
+	// defaultGroups are the names of the groups applied to the requests
+	// without groups of their own.  nil means all groups.  It's protected
+	// by engineLock.
+	defaultGroups []string
+
+	// hits are the hit counters of the filter lists by their IDs.  The map
+	// is protected by engineLock and the counters are updated atomically.
+	hits map[int64]*uint64
+
+	// matchCache caches the decisions of the engines.  It's emptied under
+	// the write lock of engineLock each time the engines change.
+	matchCache *matchCache
 
 	parentalServer       string // access via methods
 	safeBrowsingServer   string // access via methods
@@ -132,6 +267,10 @@ type DNSFilter struct {
 	resolver Resolver
 
 	hostCheckers []hostChecker
+
+	// randIntn returns a random number in [0, n).  It's used to select the
+	// addresses of the rewrites with multiple ones.
+	randIntn func(n int) (i int)
 }
 
 // Filter represents a filter list
@@ -139,6 +278,11 @@ type Filter struct {
 	ID       int64  // auto-assigned when filter is added (see nextFilterID)
 	Data     []byte `yaml:"-"` // List of rules divided by '\n'
 	FilePath string `yaml:"-"` // Path to a filtering rules file
+
+	// Group is the name of the group of the filter list.  The blocklists of
+	// a group are applied only to the requests, for which the group is
+	// enabled.  The groups of the allowlists are ignored.
+	Group string `yaml:"group,omitempty"`
 }
 
 // Reason holds an enum detailing why it was filtered or not filtered
@@ -185,33 +329,94 @@ const (
 	//
 	// See https://github.com/AdguardTeam/AdGuardHome/issues/2499.
 	RewrittenRule
-)
 
-// TODO(a.garipov): Resync with actual code names or replace completely
-// in HTTP API v1.
-var reasonNames = []string{
-	NotFilteredNotFound:  "NotFilteredNotFound",
-	NotFilteredAllowList: "NotFilteredWhiteList",
-	NotFilteredError:     "NotFilteredError",
+	// FilteredAAAADisabled is returned when an AAAA request was answered
+	// with an empty response, because resolving IPv6 addresses is
+	// disabled globally or for the client.
+	FilteredAAAADisabled
+
+	// RewrittenSearchDomain is returned when a request for a single-label
+	// name was answered with the records of the name within the local
+	// domain.
+	RewrittenSearchDomain
+
+	// LocalOnlySingleLabel is returned when a request for a single-label
+	// name wasn't found in the local sources and was answered with
+	// NXDOMAIN instead of being forwarded.
+	LocalOnlySingleLabel
+
+	// LocalOnlyRoot is returned when a request for the root name was
+	// refused instead of being forwarded.
+	LocalOnlyRoot
+
+	// LocalOnlyWPAD is returned when a request for a WPAD name wasn't found
+	// in the local sources and was answered with NXDOMAIN instead of being
+	// forwarded.
+	LocalOnlyWPAD
+
+	// SelfAnswer is returned when a PTR request for an address of the
+	// server itself was answered with its hostname instead of being
+	// forwarded.
+	SelfAnswer
+
+	// reasonNum is the number of reasons.  It must be the last.
+	reasonNum
+)
 
-	FilteredBlockList:      "FilteredBlackList",
-	FilteredSafeBrowsing:   "FilteredSafeBrowsing",
-	FilteredParental:       "FilteredParental",
-	FilteredInvalid:        "FilteredInvalid",
-	FilteredSafeSearch:     "FilteredSafeSearch",
-	FilteredBlockedService: "FilteredBlockedService",
+// ReasonCode is the stable machine-readable code of a Reason.  Unlike the
+// legacy names returned by Reason.String, the codes are never renamed, so
+// scripts should match the codes instead of the names.
+type ReasonCode string
 
-	Rewritten:          "Rewrite",
-	RewrittenAutoHosts: "RewriteEtcHosts",
-	RewrittenRule:      "RewriteRule",
+// reasonInfos is the single source of truth for the names and the codes of all
+// reasons.  A new reason must be added here as well, see TestReasonInfos.
+//
+// TODO(a.garipov): Resync the names with actual code names or replace them
+// completely in HTTP API v1.
+var reasonInfos = [reasonNum]struct {
+	name string
+	code ReasonCode
+}{
+	NotFilteredNotFound:  {"NotFilteredNotFound", "not_filtered"},
+	NotFilteredAllowList: {"NotFilteredWhiteList", "allowlist"},
+	NotFilteredError:     {"NotFilteredError", "error"},
+
+	FilteredBlockList:      {"FilteredBlackList", "blocklist"},
+	FilteredSafeBrowsing:   {"FilteredSafeBrowsing", "safe_browsing"},
+	FilteredParental:       {"FilteredParental", "parental"},
+	FilteredInvalid:        {"FilteredInvalid", "invalid"},
+	FilteredSafeSearch:     {"FilteredSafeSearch", "safe_search"},
+	FilteredBlockedService: {"FilteredBlockedService", "blocked_service"},
+
+	Rewritten:          {"Rewrite", "rewrite"},
+	RewrittenAutoHosts: {"RewriteEtcHosts", "rewrite_etc_hosts"},
+	RewrittenRule:      {"RewriteRule", "rewrite_rule"},
+
+	FilteredAAAADisabled: {"FilteredAAAADisabled", "aaaa_disabled"},
+
+	RewrittenSearchDomain: {"RewriteSearchDomain", "rewrite_search_domain"},
+	LocalOnlySingleLabel:  {"LocalOnlySingleLabel", "local_only_single_label"},
+	LocalOnlyRoot:         {"LocalOnlyRoot", "local_only_root"},
+	LocalOnlyWPAD:         {"LocalOnlyWPAD", "local_only_wpad"},
+	SelfAnswer:            {"SelfAnswer", "self_answer"},
 }
 
+// String returns the legacy name of r, which is kept for display.
 func (r Reason) String() string {
-	if r < 0 || int(r) >= len(reasonNames) {
+	if r < 0 || r >= reasonNum {
 		return ""
 	}
 
-	return reasonNames[r]
+	return reasonInfos[r].name
+}
+
+// Code returns the stable machine-readable code of r.
+func (r Reason) Code() (c ReasonCode) {
+	if r < 0 || r >= reasonNum {
+		return ""
+	}
+
+	return reasonInfos[r].code
 }
 
 // In returns true if reasons include r.
@@ -271,24 +476,54 @@ func (d *DNSFilter) SetFilters(blockFilters, allowFilters []Filter, async bool)
 		return nil
 	}
 
-	err := d.initFiltering(allowFilters, blockFilters)
+	err := d.initFiltering(allowFilters, blockFilters, EngineSourceLive)
 	if err != nil {
 		log.Error("Can't initialize filtering subsystem: %s", err)
 		return err
 	}
 
+	d.onFiltersApplied(blockFilters, allowFilters)
+
 	return nil
 }
 
+// LoadSnapshot synchronously builds the filtering engine from the filters of
+// a snapshot.  The engine is replaced by the next call to SetFilters.
+func (d *DNSFilter) LoadSnapshot(blockFilters, allowFilters []Filter) (err error) {
+	err = d.initFiltering(allowFilters, blockFilters, EngineSourceSnapshot)
+	if err != nil {
+		return fmt.Errorf("loading snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// Generation returns the description of the current filtering engine.
+func (d *DNSFilter) Generation() (gen EngineGeneration) {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	return d.generation
+}
+
+// onFiltersApplied calls the FiltersApplied callback, if any.
+func (d *DNSFilter) onFiltersApplied(blockFilters, allowFilters []Filter) {
+	if d.FiltersApplied != nil {
+		d.FiltersApplied(blockFilters, allowFilters)
+	}
+}
+
 // Starts initializing new filters by signal from channel
 func (d *DNSFilter) filtersInitializer() {
 	for {
 		params := <-d.filtersInitializerChan
-		err := d.initFiltering(params.allowFilters, params.blockFilters)
+		err := d.initFiltering(params.allowFilters, params.blockFilters, EngineSourceLive)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			continue
 		}
+
+		d.onFiltersApplied(params.blockFilters, params.allowFilters)
 	}
 }
 
@@ -297,24 +532,21 @@ func (d *DNSFilter) Close() {
 	d.engineLock.Lock()
 	defer d.engineLock.Unlock()
 	d.reset()
+	d.matchCache.clear()
 }
 
 func (d *DNSFilter) reset() {
-	var err error
-
-	if d.rulesStorage != nil {
-		err = d.rulesStorage.Close()
+	if d.engine != nil {
+		err := d.engine.Close()
 		if err != nil {
-			log.Error("dnsfilter: rulesStorage.Close: %s", err)
+			log.Error("dnsfilter: closing engine: %s", err)
 		}
-	}
 
-	if d.rulesStorageAllow != nil {
-		err = d.rulesStorageAllow.Close()
-		if err != nil {
-			log.Error("dnsfilter: rulesStorageAllow.Close: %s", err)
-		}
+		d.engine = nil
 	}
+
+	closeGroupEngines(d.groupEngines)
+	d.groupEngines = nil
 }
 
 type dnsFilterContext struct {
@@ -325,6 +557,53 @@ type dnsFilterContext struct {
 
 var gctx dnsFilterContext // global dnsfilter context
 
+// caches returns the caches of the context which are initialized.
+func (c *dnsFilterContext) caches() (caches []cache.Cache) {
+	for _, ch := range []cache.Cache{
+		c.safebrowsingCache,
+		c.parentalCache,
+		c.safeSearchCache,
+	} {
+		if ch != nil {
+			caches = append(caches, ch)
+		}
+	}
+
+	return caches
+}
+
+// MemUsage implements the aghmem.Consumer interface for *DNSFilter.  It
+// returns the size of the safe browsing, parental control, and safe search
+// caches.
+func (d *DNSFilter) MemUsage() (n uint64) {
+	for _, ch := range gctx.caches() {
+		n += uint64(ch.Stats().Size)
+	}
+
+	return n
+}
+
+// ShedMem implements the aghmem.Consumer interface for *DNSFilter.  The caches
+// can't be shrunk partially, so they are cleared one by one, starting with the
+// largest one, until about n bytes are freed.
+func (d *DNSFilter) ShedMem(n uint64) (freed uint64) {
+	caches := gctx.caches()
+	sort.Slice(caches, func(i, j int) (less bool) {
+		return caches[i].Stats().Size > caches[j].Stats().Size
+	})
+
+	for _, ch := range caches {
+		if freed >= n {
+			break
+		}
+
+		freed += uint64(ch.Stats().Size)
+		ch.Clear()
+	}
+
+	return freed
+}
+
 // ResultRule contains information about applied rules.
 type ResultRule struct {
 	// FilterListID is the ID of the rule's filter list.
@@ -370,8 +649,31 @@ type Result struct {
 	// unless Reason is set to FilteredBlockedService.
 	ServiceName string `json:",omitempty"`
 
-	// DNSRewriteResult is the $dnsrewrite filter rule result.
+	// DNSRewriteResult is the $dnsrewrite filter rule result.  If Reason is
+	// set to Rewritten, it contains the local zone records.
 	DNSRewriteResult *DNSRewriteResult `json:",omitempty"`
+
+	// RewriteScope is the scope of the matched rewrite.  It is empty unless
+	// Reason is set to Rewritten and the rewrite is scoped.
+	RewriteScope string `json:",omitempty"`
+
+	// RewritePicked is the address picked by the weighted selection of the
+	// matched rewrite.  It is nil unless Reason is set to Rewritten and the
+	// rewrite has multiple addresses with the weighted selection.
+	RewritePicked net.IP `json:",omitempty"`
+
+	// RewriteConflict is the decision taken if the request matched both a
+	// rewrite entry and a blocking filtering rule.  It's empty otherwise.
+	RewriteConflict RewriteConflict `json:",omitempty"`
+
+	// Stages are the outcomes of the filtering stages in the order of
+	// checking.  It's empty if the request has been rewritten before them.
+	Stages []StageResult `json:",omitempty"`
+
+	// TTL is the TTL of the answers in seconds.  It's only set if Reason is
+	// Rewritten and the matched rewrites have their TTL configured.  Zero
+	// means the default TTL.
+	TTL uint32 `json:"-"`
 }
 
 // Matched returns true if any match at all was found regardless of
@@ -389,6 +691,18 @@ func (d *DNSFilter) CheckHostRules(host string, qtype uint16, setts *FilteringSe
 	return d.matchHost(host, qtype, setts)
 }
 
+// bypassed returns true if host is one of s.BypassedHosts or a subdomain of
+// one.
+func (s *FilteringSettings) bypassed(host string) (ok bool) {
+	for _, h := range s.BypassedHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+
+	return false
+}
+
 // CheckHost tries to match the host against filtering rules, then safebrowsing
 // and parental control rules, if they are enabled.
 func (d *DNSFilter) CheckHost(
@@ -402,25 +716,51 @@ func (d *DNSFilter) CheckHost(
 		return Result{Reason: NotFilteredNotFound}, nil
 	}
 
-	host = strings.ToLower(host)
+	// Map the internationalized names the same way the rules are, so that
+	// the Unicode and the punycode forms match the same rules.  The names
+	// which can't be mapped are matched as is.
+	if norm, nerr := aghnet.NormalizeDomain(host); nerr == nil {
+		host = norm
+	} else {
+		host = aghnet.CanonicalDomain(host)
+	}
 
-	res = d.processRewrites(host, qtype)
+	res = d.processRewrites(host, qtype, setts)
 	if res.Reason == Rewritten {
-		return res, nil
+		return d.checkRewriteConflict(host, qtype, setts, res)
 	}
 
+	stages := make([]StageResult, 0, len(d.hostCheckers))
 	for _, hc := range d.hostCheckers {
+		// Skip the disabled stages before doing any work, since some of
+		// them, like the safe browsing hashing, are expensive.
+		if hc.enabled != nil && !hc.enabled(setts) {
+			stages = append(stages, StageResult{Stage: hc.stage, Status: StageDisabled})
+
+			continue
+		}
+
+		if hc.bypassable && setts.bypassed(host) {
+			stages = append(stages, StageResult{Stage: hc.stage, Status: StageBypassed})
+
+			continue
+		}
+
 		res, err = hc.check(host, qtype, setts)
 		if err != nil {
 			return Result{}, fmt.Errorf("%s: %w", hc.name, err)
 		}
 
 		if res.Reason.Matched() {
+			res.Stages = append(stages, StageResult{Stage: hc.stage, Status: StageMatched})
+
 			return res, nil
 		}
+
+		stages = append(stages, StageResult{Stage: hc.stage, Status: StageNotMatched})
 	}
 
-	return Result{}, nil
+	return Result{Stages: stages}, nil
 }
 
 // checkEtcHosts compares the host against our /etc/hosts table.  The err is
@@ -469,13 +809,14 @@ func (d *DNSFilter) checkEtcHosts(
 //  . repeat for the new domain name (Note: we return only the last CNAME)
 // . Find A or AAAA record for a domain name (exact match or by wildcard)
 //  . if found, set IP addresses (IPv4 or IPv6 depending on qtype) in Result.IPList array
-func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
+func (d *DNSFilter) processRewrites(host string, qtype uint16, setts *FilteringSettings) (res Result) {
 	d.confLock.RLock()
 	defer d.confLock.RUnlock()
 
-	rr := findRewrites(d.Rewrites, host)
+	rr := findRewrites(d.Rewrites, host, setts)
 	if len(rr) != 0 {
 		res.Reason = Rewritten
+		res.RewriteScope = rr[0].Scope
 	}
 
 	cnames := aghstrings.NewSet()
@@ -498,13 +839,29 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 
 		cnames.Add(host)
 		res.CanonName = rr[0].Answer
-		rr = findRewrites(d.Rewrites, host)
+		rr = findRewrites(d.Rewrites, host, setts)
+		if len(rr) != 0 && rr[0].Scope != "" {
+			res.RewriteScope = rr[0].Scope
+		}
 	}
 
 	for _, r := range rr {
-		if (r.Type == dns.TypeA && qtype == dns.TypeA) ||
-			(r.Type == dns.TypeAAAA && qtype == dns.TypeAAAA) {
+		if r.Type != qtype {
+			continue
+		}
 
+		if r.Value != nil {
+			res.addRewriteRecord(qtype, r.Value)
+			log.Debug("rewrite: %s for %s is %v", r.RecordType, host, r.Value)
+		} else if len(r.Answers) > 0 {
+			ips := r.pickAnswers(d.randIntn)
+			if r.Selection == RewriteSelectionWeighted {
+				res.RewritePicked = ips[0]
+			}
+
+			res.IPList = append(res.IPList, ips...)
+			log.Debug("rewrite: %s for %s are %s", r.RecordType, host, ips)
+		} else if qtype == dns.TypeA || qtype == dns.TypeAAAA {
 			if r.IP == nil { // IP exception
 				res.Reason = 0
 				return res
@@ -512,12 +869,31 @@ func (d *DNSFilter) processRewrites(host string, qtype uint16) (res Result) {
 
 			res.IPList = append(res.IPList, r.IP)
 			log.Debug("rewrite: A/AAAA for %s is %s", host, r.IP)
+		} else {
+			continue
+		}
+
+		if r.TTL != 0 && (res.TTL == 0 || r.TTL < res.TTL) {
+			res.TTL = r.TTL
 		}
 	}
 
 	return res
 }
 
+// addRewriteRecord adds a local zone record of type rrType with the value v to
+// the response of res.
+func (res *Result) addRewriteRecord(rrType rules.RRType, v rules.RRValue) {
+	if res.DNSRewriteResult == nil {
+		res.DNSRewriteResult = &DNSRewriteResult{
+			Response: DNSRewriteResultResponse{},
+			RCode:    dns.RcodeSuccess,
+		}
+	}
+
+	res.DNSRewriteResult.Response[rrType] = append(res.DNSRewriteResult.Response[rrType], v)
+}
+
 // matchBlockedServicesRules checks the host against the blocked services rules
 // in settings, if any.  The err is always nil, it is only there to make this
 // a valid hostChecker function.
@@ -560,77 +936,72 @@ func matchBlockedServicesRules(
 // Adding rule and matching against the rules
 //
 
-// fileExists returns true if file exists.
-func fileExists(fn string) bool {
-	_, err := os.Stat(fn)
-	return err == nil
-}
-
-func createFilteringEngine(filters []Filter) (*filterlist.RuleStorage, *urlfilter.DNSEngine, error) {
-	listArray := []filterlist.RuleList{}
-	for _, f := range filters {
-		var list filterlist.RuleList
-
-		if f.ID == 0 {
-			list = &filterlist.StringRuleList{
-				ID:             0,
-				RulesText:      string(f.Data),
-				IgnoreCosmetic: true,
-			}
-		} else if !fileExists(f.FilePath) {
-			list = &filterlist.StringRuleList{
-				ID:             int(f.ID),
-				IgnoreCosmetic: true,
-			}
-		} else if runtime.GOOS == "windows" {
-			// On Windows we don't pass a file to urlfilter because
-			// it's difficult to update this file while it's being
-			// used.
-			data, err := ioutil.ReadFile(f.FilePath)
-			if err != nil {
-				return nil, nil, fmt.Errorf("ioutil.ReadFile(): %s: %w", f.FilePath, err)
-			}
-			list = &filterlist.StringRuleList{
-				ID:             int(f.ID),
-				RulesText:      string(data),
-				IgnoreCosmetic: true,
+// compiledIndexExt is the extension of the compiled indexes of the filter
+// files.
+const compiledIndexExt = ".idx"
+
+// filteringLists converts the filters into the lists for the filtering
+// engine.  The rules of the user filter, which has zero ID, are taken from
+// Data, and the rules of the other filters are read from their files.  If
+// compiled is true, the blocklists are compiled into the indexes next to their
+// files.
+func filteringLists(blockFilters, allowFilters []Filter, compiled bool) (lists []filtering.List) {
+	conv := func(fs []Filter, allow bool) {
+		for _, f := range fs {
+			l := filtering.List{
+				ID:        f.ID,
+				Allowlist: allow,
 			}
 
-		} else {
-			var err error
-			list, err = filterlist.NewFileRuleList(int(f.ID), f.FilePath, true)
-			if err != nil {
-				return nil, nil, fmt.Errorf("filterlist.NewFileRuleList(): %s: %w", f.FilePath, err)
+			if f.ID == filtering.UserRulesID {
+				l.Data = f.Data
+			} else {
+				l.FilePath = f.FilePath
+				if compiled && !allow {
+					l.IndexPath = f.FilePath + compiledIndexExt
+				}
 			}
+
+			lists = append(lists, l)
 		}
-		listArray = append(listArray, list)
 	}
 
-	rulesStorage, err := filterlist.NewRuleStorage(listArray)
-	if err != nil {
-		return nil, nil, fmt.Errorf("filterlist.NewRuleStorage(): %w", err)
-	}
-	filteringEngine := urlfilter.NewDNSEngine(rulesStorage)
-	return rulesStorage, filteringEngine, nil
+	conv(blockFilters, false)
+	conv(allowFilters, true)
+
+	return lists
 }
 
-// Initialize urlfilter objects.
-func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
-	rulesStorage, filteringEngine, err := createFilteringEngine(blockFilters)
+// initFiltering builds the filtering engine from the filters.  src is the source of the filters, either
+// EngineSourceLive or EngineSourceSnapshot.
+func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter, src string) error {
+	ungrouped, groups := splitGroups(blockFilters)
+	engine, err := filtering.NewEngine(filteringLists(ungrouped, allowFilters, d.CompiledFilters), nil)
 	if err != nil {
 		return err
 	}
-	rulesStorageAllow, filteringEngineAllow, err := createFilteringEngine(allowFilters)
+
+	groupEngines, err := newGroupEngines(groups, d.CompiledFilters)
 	if err != nil {
+		closeErr := engine.Close()
+		if closeErr != nil {
+			log.Error("dnsfilter: closing engine: %s", closeErr)
+		}
+
 		return err
 	}
 
 	d.engineLock.Lock()
 	d.reset()
-	d.rulesStorage = rulesStorage
-	d.filteringEngine = filteringEngine
-	d.rulesStorageAllow = rulesStorageAllow
-	d.filteringEngineAllow = filteringEngineAllow
+	d.matchCache.clear()
+	d.engine = engine
+	d.groupEngines = groupEngines
+	d.hits = newHits(d.hits, blockFilters, allowFilters)
+	d.generation = EngineGeneration{
+		BuiltAt: time.Now(),
+		Source:  src,
+		ID:      d.generation.ID + 1,
+	}
 	d.engineLock.Unlock()
 
 	// Make sure that the OS reclaims memory as soon as possible
@@ -640,77 +1011,6 @@ func (d *DNSFilter) initFiltering(allowFilters, blockFilters []Filter) error {
 	return nil
 }
 
-// matchHostProcessAllowList processes the allowlist logic of host
-// matching.
-func (d *DNSFilter) matchHostProcessAllowList(host string, dnsres urlfilter.DNSResult) (res Result, err error) {
-	var rule rules.Rule
-	if dnsres.NetworkRule != nil {
-		rule = dnsres.NetworkRule
-	} else if len(dnsres.HostRulesV4) > 0 {
-		rule = dnsres.HostRulesV4[0]
-	} else if len(dnsres.HostRulesV6) > 0 {
-		rule = dnsres.HostRulesV6[0]
-	}
-
-	if rule == nil {
-		return Result{}, fmt.Errorf("invalid dns result: rules are empty")
-	}
-
-	log.Debug("Filtering: found allowlist rule for host %q: %q  list_id: %d",
-		host, rule.Text(), rule.GetFilterListID())
-
-	return makeResult(rule, NotFilteredAllowList), nil
-}
-
-// matchHostProcessDNSResult processes the matched DNS filtering result.
-func (d *DNSFilter) matchHostProcessDNSResult(
-	qtype uint16,
-	dnsres urlfilter.DNSResult,
-) (res Result) {
-	if dnsres.NetworkRule != nil {
-		reason := FilteredBlockList
-		if dnsres.NetworkRule.Whitelist {
-			reason = NotFilteredAllowList
-		}
-
-		return makeResult(dnsres.NetworkRule, reason)
-	}
-
-	if qtype == dns.TypeA && dnsres.HostRulesV4 != nil {
-		rule := dnsres.HostRulesV4[0]
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = rule.IP.To4()
-
-		return res
-	}
-
-	if qtype == dns.TypeAAAA && dnsres.HostRulesV6 != nil {
-		rule := dnsres.HostRulesV6[0]
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = rule.IP.To16()
-
-		return res
-	}
-
-	if dnsres.HostRulesV4 != nil || dnsres.HostRulesV6 != nil {
-		// Question type doesn't match the host rules.  Return the first
-		// matched host rule, but without an IP address.
-		var rule rules.Rule
-		if dnsres.HostRulesV4 != nil {
-			rule = dnsres.HostRulesV4[0]
-		} else if dnsres.HostRulesV6 != nil {
-			rule = dnsres.HostRulesV6[0]
-		}
-
-		res = makeResult(rule, FilteredBlockList)
-		res.Rules[0].IP = net.IP{}
-
-		return res
-	}
-
-	return Result{}
-}
-
 // matchHost is a low-level way to check only if hostname is filtered by rules,
 // skipping expensive safebrowsing and parental lookups.
 func (d *DNSFilter) matchHost(
@@ -722,47 +1022,27 @@ func (d *DNSFilter) matchHost(
 		return Result{}, nil
 	}
 
+	// Hold the lock so that the engine isn't closed while it's used.
 	d.engineLock.RLock()
-	// Keep in mind that this lock must be held no just when calling Match()
-	//  but also while using the rules returned by it.
 	defer d.engineLock.RUnlock()
 
-	ureq := urlfilter.DNSRequest{
-		Hostname:         host,
-		SortedClientTags: setts.ClientTags,
-		// TODO(e.burkov): Wait for urlfilter update to pass net.IP.
-		ClientIP:   setts.ClientIP.String(),
-		ClientName: setts.ClientName,
-		DNSType:    qtype,
-	}
-
-	if d.filteringEngineAllow != nil {
-		dnsres, ok := d.filteringEngineAllow.MatchRequest(ureq)
-		if ok {
-			return d.matchHostProcessAllowList(host, dnsres)
-		}
-	}
-
-	if d.filteringEngine == nil {
+	if d.engine == nil {
 		return Result{}, nil
 	}
 
-	dnsres, ok := d.filteringEngine.MatchRequest(ureq)
-
-	// Check DNS rewrites first, because the API there is a bit awkward.
-	if dnsr := dnsres.DNSRewrites(); len(dnsr) > 0 {
-		res = d.processDNSRewrites(dnsr)
-		if res.Reason == RewrittenRule && res.CanonName == host {
-			// A rewrite of a host to itself.  Go on and try
-			// matching other things.
-		} else {
-			return res, nil
+	key := newMatchKey(host, qtype, setts)
+	fres, ok := d.matchCache.get(key)
+	if !ok {
+		fres, err = d.matchEngines(host, qtype, setts)
+		if err != nil {
+			return Result{}, err
 		}
-	} else if !ok {
-		return Result{}, nil
+
+		d.matchCache.set(key, fres)
 	}
 
-	res = d.matchHostProcessDNSResult(qtype, dnsres)
+	d.countHit(fres)
+	res = resultFromFiltering(fres)
 	if len(res.Rules) > 0 {
 		r := res.Rules[0]
 		log.Debug(
@@ -776,18 +1056,63 @@ func (d *DNSFilter) matchHost(
 	return res, nil
 }
 
-// makeResult returns a properly constructed Result.
-func makeResult(rule rules.Rule, reason Reason) Result {
-	res := Result{
-		Reason: reason,
-		Rules: []*ResultRule{{
-			FilterListID: int64(rule.GetFilterListID()),
-			Text:         rule.Text(),
-		}},
+// matchEngines matches host against the filtering engines.  d.engineLock is
+// expected to be locked for reading.
+func (d *DNSFilter) matchEngines(
+	host string,
+	qtype uint16,
+	setts *FilteringSettings,
+) (fres filtering.Result, err error) {
+	cli := &filtering.ClientContext{
+		Name: setts.ClientName,
+		IP:   setts.ClientIP,
+		Tags: setts.ClientTags,
+	}
+
+	fres, err = d.engine.Match(host, qtype, cli)
+	if err != nil {
+		return filtering.Result{}, err
+	}
+
+	if fres.Reason == filtering.NotMatched {
+		fres, err = d.matchGroups(host, qtype, cli, setts.FilterGroups)
+		if err != nil {
+			return filtering.Result{}, err
+		}
 	}
 
-	if reason == FilteredBlockList {
+	return fres, nil
+}
+
+// resultFromFiltering converts the result of the filtering engine.
+func resultFromFiltering(fres filtering.Result) (res Result) {
+	switch fres.Reason {
+	case filtering.Allowed:
+		res.Reason = NotFilteredAllowList
+	case filtering.Blocked:
+		res.Reason = FilteredBlockList
 		res.IsFiltered = true
+	case filtering.Rewritten:
+		res.Reason = RewrittenRule
+		if rw := fres.Rewrite; rw.CanonName != "" {
+			res.CanonName = rw.CanonName
+		} else {
+			res.DNSRewriteResult = &DNSRewriteResult{
+				Response: rw.Response,
+				RCode:    rw.RCode,
+			}
+		}
+	default:
+		return Result{}
+	}
+
+	res.Rules = make([]*ResultRule, 0, len(fres.Rules))
+	for _, r := range fres.Rules {
+		res.Rules = append(res.Rules, &ResultRule{
+			FilterListID: r.FilterListID,
+			Text:         r.Text,
+			IP:           r.IP,
+		})
 	}
 
 	return res
@@ -828,26 +1153,50 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 
 	d := &DNSFilter{
 		resolver: resolver,
+		randIntn: rand.Intn,
 	}
 
 	d.hostCheckers = []hostChecker{{
 		check: d.checkEtcHosts,
 		name:  "etchosts",
+		stage: StageEtcHosts,
 	}, {
 		check: d.matchHost,
+		enabled: func(setts *FilteringSettings) (ok bool) {
+			return setts.FilteringEnabled
+		},
 		name:  "filtering",
+		stage: StageFiltering,
 	}, {
 		check: matchBlockedServicesRules,
-		name:  "blocked services",
+		enabled: func(setts *FilteringSettings) (ok bool) {
+			return len(setts.ServicesRules) > 0
+		},
+		name:       "blocked services",
+		stage:      StageBlockedServices,
+		bypassable: true,
 	}, {
 		check: d.checkSafeBrowsing,
+		enabled: func(setts *FilteringSettings) (ok bool) {
+			return setts.SafeBrowsingEnabled
+		},
 		name:  "safe browsing",
+		stage: StageSafeBrowsing,
 	}, {
 		check: d.checkParental,
-		name:  "parental",
+		enabled: func(setts *FilteringSettings) (ok bool) {
+			return setts.ParentalEnabled
+		},
+		name:       "parental",
+		stage:      StageParental,
+		bypassable: true,
 	}, {
 		check: d.checkSafeSearch,
+		enabled: func(setts *FilteringSettings) (ok bool) {
+			return setts.SafeSearchEnabled
+		},
 		name:  "safe search",
+		stage: StageSafeSearch,
 	}}
 
 	err := d.initSecurityServices()
@@ -859,6 +1208,12 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 	if c != nil {
 		d.Config = *c
 		d.prepareRewrites()
+
+		if err = validRewritePrecedence(d.RewritePrecedence); err != nil {
+			log.Error("dnsfilter: %s, using %q", err, RewritePrecedenceBlock)
+			d.RewritePrecedence = RewritePrecedenceBlock
+		}
+		d.matchCache = newMatchCache(c.MatchCacheSize)
 	}
 
 	bsvcs := []string{}
@@ -872,7 +1227,7 @@ func New(c *Config, blockFilters []Filter) *DNSFilter {
 	d.BlockedServices = bsvcs
 
 	if blockFilters != nil {
-		err = d.initFiltering(nil, blockFilters)
+		err = d.initFiltering(nil, blockFilters, EngineSourceLive)
 		if err != nil {
 			log.Error("Can't initialize filtering subsystem: %s", err)
 			d.Close()
@@ -894,5 +1249,6 @@ func (d *DNSFilter) Start() {
 		d.registerSecurityHandlers()
 		d.registerRewritesHandlers()
 		d.registerBlockedServicesHandlers()
+		d.registerExportHandlers()
 	}
 }
@@ -5,6 +5,7 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"regexp"
 	"strings"
 	"testing"
 
@@ -784,8 +785,193 @@ func TestClientSettings(t *testing.T) {
 	}
 }
 
+func TestDNSFilter_Generation(t *testing.T) {
+	var applied [][]Filter
+	d := newForTest(&Config{
+		FiltersApplied: func(block, _ []Filter) {
+			applied = append(applied, block)
+		},
+	}, nil)
+	t.Cleanup(d.Close)
+
+	assert.Zero(t, d.Generation().ID)
+
+	snapFilters := []Filter{{ID: 0, Data: []byte("||snapshot.example^\n")}}
+	require.NoError(t, d.LoadSnapshot(snapFilters, nil))
+
+	gen := d.Generation()
+	assert.Equal(t, uint64(1), gen.ID)
+	assert.Equal(t, EngineSourceSnapshot, gen.Source)
+	assert.Empty(t, applied)
+
+	d.checkMatch(t, "snapshot.example")
+
+	liveFilters := []Filter{{ID: 0, Data: []byte("||live.example^\n")}}
+	require.NoError(t, d.SetFilters(liveFilters, nil, false))
+
+	gen = d.Generation()
+	assert.Equal(t, uint64(2), gen.ID)
+	assert.Equal(t, EngineSourceLive, gen.Source)
+	assert.Equal(t, [][]Filter{liveFilters}, applied)
+
+	d.checkMatch(t, "live.example")
+	d.checkMatchEmpty(t, "snapshot.example")
+}
+
+func TestDNSFilter_CheckHost_stages(t *testing.T) {
+	d := newForTest(&Config{SafeBrowsingEnabled: true, ParentalEnabled: true}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	ups := &aghtest.TestErrUpstream{}
+	d.SetSafeBrowsingUpstream(ups)
+	d.SetParentalUpstream(ups)
+
+	// The checks of the disabled stages would fail with the upstream above.
+	rsetts := &FilteringSettings{
+		FilteringEnabled: true,
+	}
+
+	res, err := d.CheckHost("allowed.example", dns.TypeA, rsetts)
+	require.NoError(t, err)
+
+	assert.Equal(t, []StageResult{
+		{Stage: StageEtcHosts, Status: StageNotMatched},
+		{Stage: StageFiltering, Status: StageNotMatched},
+		{Stage: StageBlockedServices, Status: StageDisabled},
+		{Stage: StageSafeBrowsing, Status: StageDisabled},
+		{Stage: StageParental, Status: StageDisabled},
+		{Stage: StageSafeSearch, Status: StageDisabled},
+	}, res.Stages)
+
+	res, err = d.CheckHost("blocked.example", dns.TypeA, rsetts)
+	require.NoError(t, err)
+
+	assert.True(t, res.IsFiltered)
+	assert.Equal(t, []StageResult{
+		{Stage: StageEtcHosts, Status: StageNotMatched},
+		{Stage: StageFiltering, Status: StageMatched},
+	}, res.Stages)
+
+	rsetts.SafeBrowsingEnabled = true
+	_, err = d.CheckHost("allowed.example", dns.TypeA, rsetts)
+	assert.Error(t, err)
+}
+
+func TestDNSFilter_CheckHost_bypassed(t *testing.T) {
+	d := newForTest(&Config{ParentalEnabled: true}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	d.SetParentalUpstream(&aghtest.TestBlockUpstream{
+		Hostname: "adult.example",
+		Block:    true,
+	})
+
+	rule, err := rules.NewNetworkRule("||service.example^", 0)
+	require.NoError(t, err)
+
+	rsetts := &FilteringSettings{
+		FilteringEnabled: true,
+		ParentalEnabled:  true,
+		ServicesRules: []ServiceEntry{{
+			Name:  "service",
+			Rules: []*rules.NetworkRule{rule},
+		}},
+		BypassedHosts: []string{"service.example", "adult.example", "blocked.example"},
+	}
+
+	testCases := []struct {
+		host       string
+		wantReason Reason
+	}{{
+		host:       "service.example",
+		wantReason: NotFilteredNotFound,
+	}, {
+		host:       "www.adult.example",
+		wantReason: NotFilteredNotFound,
+	}, {
+		// The filtering rules aren't bypassed.
+		host:       "blocked.example",
+		wantReason: FilteredBlockList,
+	}, {
+		host:       "notservice.example",
+		wantReason: NotFilteredNotFound,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.host, func(t *testing.T) {
+			res, cerr := d.CheckHost(tc.host, dns.TypeA, rsetts)
+			require.NoError(t, cerr)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+		})
+	}
+
+	res, err := d.CheckHost("service.example", dns.TypeA, rsetts)
+	require.NoError(t, err)
+
+	assert.Equal(t, []StageResult{
+		{Stage: StageEtcHosts, Status: StageNotMatched},
+		{Stage: StageFiltering, Status: StageNotMatched},
+		{Stage: StageBlockedServices, Status: StageBypassed},
+		{Stage: StageSafeBrowsing, Status: StageDisabled},
+		{Stage: StageParental, Status: StageBypassed},
+		{Stage: StageSafeSearch, Status: StageDisabled},
+	}, res.Stages)
+
+	rsetts.BypassedHosts = nil
+	res, err = d.CheckHost("service.example", dns.TypeA, rsetts)
+	require.NoError(t, err)
+
+	assert.Equal(t, FilteredBlockedService, res.Reason)
+}
+
 // Benchmarks.
 
+func BenchmarkDNSFilter_CheckHost_stages(b *testing.B) {
+	d := newForTest(&Config{SafeBrowsingEnabled: true, ParentalEnabled: true}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n/^ads[0-9]+\\./\n"),
+	}})
+	b.Cleanup(d.Close)
+
+	ups := &aghtest.TestBlockUpstream{
+		Hostname: "blocked.example",
+		Block:    true,
+	}
+	d.SetSafeBrowsingUpstream(ups)
+	d.SetParentalUpstream(ups)
+
+	const host = "www.allowed.example"
+
+	b.Run("all_enabled", func(b *testing.B) {
+		rsetts := &FilteringSettings{
+			FilteringEnabled:    true,
+			SafeBrowsingEnabled: true,
+			ParentalEnabled:     true,
+			SafeSearchEnabled:   true,
+		}
+
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, err := d.CheckHost(host, dns.TypeA, rsetts)
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("all_disabled", func(b *testing.B) {
+		rsetts := &FilteringSettings{}
+
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_, err := d.CheckHost(host, dns.TypeA, rsetts)
+			require.NoError(b, err)
+		}
+	})
+}
+
 func BenchmarkSafeBrowsing(b *testing.B) {
 	d := newForTest(&Config{SafeBrowsingEnabled: true}, nil)
 	b.Cleanup(d.Close)
@@ -839,3 +1025,28 @@ func BenchmarkSafeSearchParallel(b *testing.B) {
 		}
 	})
 }
+
+func TestReasonInfos(t *testing.T) {
+	codeRe := regexp.MustCompile(`^[a-z0-9]+(_[a-z0-9]+)*$`)
+
+	names := map[string]Reason{}
+	codes := map[ReasonCode]Reason{}
+	for r := Reason(0); r < reasonNum; r++ {
+		name, code := r.String(), r.Code()
+
+		require.NotEmpty(t, name, "reason %d", r)
+		assert.Regexp(t, codeRe, code, "reason %s", name)
+
+		prev, ok := names[name]
+		assert.False(t, ok, "reasons %d and %d share the name %q", prev, r, name)
+		names[name] = r
+
+		prev, ok = codes[code]
+		assert.False(t, ok, "reasons %s and %s share the code %q", prev, name, code)
+		codes[code] = r
+	}
+
+	assert.Empty(t, reasonNum.String())
+	assert.Empty(t, reasonNum.Code())
+	assert.Empty(t, Reason(-1).Code())
+}
@@ -0,0 +1,392 @@
+// Partial configuration export and import
+
+package dnsfilter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// exportVersion is the version of the format of the exported documents.
+const exportVersion = 1
+
+// checkExportVersion returns an error if the document of version v can't be
+// imported.
+func checkExportVersion(v int) (err error) {
+	if v != exportVersion {
+		return fmt.Errorf("unsupported version %d, want %d", v, exportVersion)
+	}
+
+	return nil
+}
+
+// exportRevision returns the revision of the exported data v, which is the
+// beginning of the hex-encoded SHA-256 checksum of its JSON form.
+func exportRevision(v interface{}) (rev string) {
+	// Don't check the error, since the exported data are always
+	// marshalable.
+	b, _ := json.Marshal(v)
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:8])
+}
+
+// importPreview is the part of the response to an import request, which is
+// only sent if the "dry_run" query parameter is true.
+type importPreview struct {
+	// Revision is the revision of the current state.  Passing it in the
+	// "revision" query parameter of the import request makes sure that the
+	// state hasn't been changed since the preview.
+	Revision string `json:"revision,omitempty"`
+
+	// Errors are the validation errors of the document.  The invalid
+	// entries aren't taken into account in the diff.
+	Errors []string `json:"errors,omitempty"`
+}
+
+// importParams returns the query parameters of an import request.
+func importParams(r *http.Request) (dryRun bool, rev string, err error) {
+	params := aghhttp.QueryParams(r.URL.Query())
+	dryRun = params.Bool("dry_run", false)
+	rev = params.String("revision", "")
+
+	return dryRun, rev, params.Err()
+}
+
+// checkImportRevision responds with 409 Conflict and returns false if rev
+// isn't empty and isn't the same as the revision of the current state, cur.
+func checkImportRevision(w http.ResponseWriter, r *http.Request, rev, cur string) (ok bool) {
+	if rev == "" || rev == cur {
+		return true
+	}
+
+	httpError(
+		r,
+		w,
+		http.StatusConflict,
+		"revision %q doesn't match the current one %q, the state has changed since the preview",
+		rev,
+		cur,
+	)
+
+	return false
+}
+
+// rewritesExport is the document exchanged by the GET and PUT
+// /control/rewrite/export HTTP APIs.
+type rewritesExport struct {
+	Rewrites []*rewriteEntryJSON `json:"rewrites"`
+	Version  int                 `json:"version"`
+}
+
+// rewritesDiff is the response to the PUT /control/rewrite/export request.
+type rewritesDiff struct {
+	Added   []*rewriteEntryJSON `json:"added"`
+	Removed []*rewriteEntryJSON `json:"removed"`
+
+	importPreview
+}
+
+// diffRewrites returns the entries of next missing from prev and vice versa.
+// The duplicates are counted.
+func diffRewrites(prev, next []RewriteEntry) (diff rewritesDiff) {
+	diff = rewritesDiff{
+		Added:   []*rewriteEntryJSON{},
+		Removed: []*rewriteEntryJSON{},
+	}
+
+	counts := map[string]int{}
+	for i := range prev {
+		counts[newRewriteEntryJSON(&prev[i]).key()]++
+	}
+
+	for i := range next {
+		jsent := newRewriteEntryJSON(&next[i])
+		if k := jsent.key(); counts[k] > 0 {
+			counts[k]--
+
+			continue
+		}
+
+		diff.Added = append(diff.Added, jsent)
+	}
+
+	for i := range prev {
+		jsent := newRewriteEntryJSON(&prev[i])
+		if k := jsent.key(); counts[k] > 0 {
+			counts[k]--
+			diff.Removed = append(diff.Removed, jsent)
+		}
+	}
+
+	return diff
+}
+
+// handleRewriteExport is the handler for the GET /control/rewrite/export HTTP
+// API.
+func (d *DNSFilter) handleRewriteExport(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rewritesExport{
+		Rewrites: d.rewritesJSON(),
+		Version:  exportVersion,
+	})
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// rewritesRevisionLocked returns the revision of the configured rewrites.
+// d.confLock is expected to be locked.
+func (d *DNSFilter) rewritesRevisionLocked() (rev string) {
+	arr := make([]*rewriteEntryJSON, 0, len(d.Config.Rewrites))
+	for i := range d.Config.Rewrites {
+		arr = append(arr, newRewriteEntryJSON(&d.Config.Rewrites[i]))
+	}
+
+	return exportRevision(arr)
+}
+
+// validateRewritesImport returns the valid rewrites of the imported document
+// and the validation errors.  Unless all is true, it stops at the first
+// error.
+func validateRewritesImport(jsents []*rewriteEntryJSON, all bool) (ents []RewriteEntry, errs []string) {
+	ents = make([]RewriteEntry, 0, len(jsents))
+	for i, jsent := range jsents {
+		if jsent == nil {
+			errs = append(errs, fmt.Sprintf("rewrite at index %d: null", i))
+		} else {
+			ent := jsent.toEntry()
+			err := validateRewrite(&ent, ents)
+			if err == nil {
+				ents = append(ents, ent)
+
+				continue
+			}
+
+			errs = append(errs, fmt.Sprintf("rewrite at index %d: %s", i, err))
+		}
+
+		if !all {
+			return nil, errs
+		}
+	}
+
+	return ents, errs
+}
+
+// handleRewriteImport is the handler for the PUT /control/rewrite/export HTTP
+// API.  It replaces all rewrites with the ones from the document if all of
+// them are valid.  If the "dry_run" query parameter is true, it only responds
+// with the diff, the validation errors, and the revision of the current
+// rewrites.  If the "revision" query parameter is set, the rewrites are only
+// replaced if their revision is the same.
+func (d *DNSFilter) handleRewriteImport(w http.ResponseWriter, r *http.Request) {
+	dryRun, rev, err := importParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	doc := rewritesExport{}
+	err = json.NewDecoder(r.Body).Decode(&doc)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	err = checkExportVersion(doc.Version)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	ents, errs := validateRewritesImport(doc.Rewrites, dryRun)
+	if len(errs) > 0 && !dryRun {
+		httpError(r, w, http.StatusBadRequest, "%s", errs[0])
+
+		return
+	}
+
+	d.confLock.Lock()
+	cur := d.rewritesRevisionLocked()
+	if !checkImportRevision(w, r, rev, cur) {
+		d.confLock.Unlock()
+
+		return
+	}
+
+	diff := diffRewrites(d.Config.Rewrites, ents)
+	if dryRun {
+		diff.Revision, diff.Errors = cur, errs
+	} else {
+		d.Config.Rewrites = ents
+	}
+	d.confLock.Unlock()
+
+	if !dryRun {
+		log.Debug("Rewrites: imported %d elements, %d added, %d removed", len(ents), len(diff.Added), len(diff.Removed))
+
+		d.Config.ConfigModified()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// blockedServicesExport is the document exchanged by the GET and PUT
+// /control/blocked_services/export HTTP APIs.
+type blockedServicesExport struct {
+	BlockedServices []string `json:"blocked_services"`
+	Version         int      `json:"version"`
+}
+
+// blockedServicesDiff is the response to the PUT
+// /control/blocked_services/export request.
+type blockedServicesDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+
+	importPreview
+}
+
+// diffBlockedServices returns the services of next missing from prev and vice
+// versa.
+func diffBlockedServices(prev, next []string) (diff blockedServicesDiff) {
+	diff = blockedServicesDiff{
+		Added:   []string{},
+		Removed: []string{},
+	}
+
+	prevSet, nextSet := aghstrings.NewSet(prev...), aghstrings.NewSet(next...)
+	for _, s := range next {
+		if !prevSet.Has(s) {
+			diff.Added = append(diff.Added, s)
+			prevSet.Add(s)
+		}
+	}
+
+	for _, s := range prev {
+		if !nextSet.Has(s) {
+			diff.Removed = append(diff.Removed, s)
+			nextSet.Add(s)
+		}
+	}
+
+	return diff
+}
+
+// handleBlockedServicesExport is the handler for the GET
+// /control/blocked_services/export HTTP API.
+func (d *DNSFilter) handleBlockedServicesExport(w http.ResponseWriter, r *http.Request) {
+	d.confLock.RLock()
+	list := aghstrings.CloneSliceOrEmpty(d.Config.BlockedServices)
+	d.confLock.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(blockedServicesExport{
+		BlockedServices: list,
+		Version:         exportVersion,
+	})
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// handleBlockedServicesImport is the handler for the PUT
+// /control/blocked_services/export HTTP API.  It replaces the list of the
+// blocked services with the one from the document if it's valid.  The
+// "dry_run" and the "revision" query parameters work the same way as in
+// handleRewriteImport.
+func (d *DNSFilter) handleBlockedServicesImport(w http.ResponseWriter, r *http.Request) {
+	dryRun, rev, err := importParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	doc := blockedServicesExport{}
+	err = json.NewDecoder(r.Body).Decode(&doc)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	err = checkExportVersion(doc.Version)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	list := aghstrings.CloneSliceOrEmpty(doc.BlockedServices)
+	var errs []string
+	if dryRun {
+		list = aghstrings.FilterOut(list, func(s string) (ok bool) {
+			verr := validateBlockedServices([]string{s})
+			if verr != nil {
+				errs = append(errs, verr.Error())
+			}
+
+			return verr != nil
+		})
+	} else {
+		err = validateBlockedServices(list)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
+	d.confLock.Lock()
+	cur := exportRevision(aghstrings.CloneSliceOrEmpty(d.Config.BlockedServices))
+	if !checkImportRevision(w, r, rev, cur) {
+		d.confLock.Unlock()
+
+		return
+	}
+
+	diff := diffBlockedServices(d.Config.BlockedServices, list)
+	if dryRun {
+		diff.Revision, diff.Errors = cur, errs
+	} else {
+		d.Config.BlockedServices = list
+	}
+	d.confLock.Unlock()
+
+	if !dryRun {
+		log.Debug("Imported blocked services list: %d", len(list))
+
+		d.ConfigModified()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(diff)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
+
+// registerExportHandlers registers the handlers of the partial configuration
+// export and import.
+func (d *DNSFilter) registerExportHandlers() {
+	d.Config.HTTPRegister(http.MethodGet, "/control/rewrite/export", d.handleRewriteExport)
+	d.Config.HTTPRegister(http.MethodPut, "/control/rewrite/export", d.handleRewriteImport)
+	d.Config.HTTPRegister(http.MethodGet, "/control/blocked_services/export", d.handleBlockedServicesExport)
+	d.Config.HTTPRegister(http.MethodPut, "/control/blocked_services/export", d.handleBlockedServicesImport)
+}
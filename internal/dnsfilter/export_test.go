@@ -0,0 +1,271 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newExportTestFilter returns a filter with rewrites and blocked services and
+// a pointer to the number of the configuration modifications.
+func newExportTestFilter(t *testing.T) (d *DNSFilter, modified *int) {
+	t.Helper()
+
+	initBlockedServices()
+
+	modified = new(int)
+	d = &DNSFilter{
+		Config: Config{
+			Rewrites: []RewriteEntry{{
+				Domain: "a.example",
+				Answer: "1.2.3.4",
+			}, {
+				Domain: "b.example",
+				Answer: "1.2.3.5",
+			}},
+			BlockedServices: []string{"youtube", "twitch"},
+			ConfigModified:  func() { *modified++ },
+		},
+	}
+	d.prepareRewrites()
+
+	return d, modified
+}
+
+func TestDNSFilter_handleRewriteExport(t *testing.T) {
+	d, _ := newExportTestFilter(t)
+
+	w := httptest.NewRecorder()
+	d.handleRewriteExport(w, httptest.NewRequest(http.MethodGet, "/control/rewrite/export", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	doc := rewritesExport{}
+	err := json.NewDecoder(w.Body).Decode(&doc)
+	require.NoError(t, err)
+
+	assert.Equal(t, exportVersion, doc.Version)
+	assert.Equal(t, []*rewriteEntryJSON{{
+		Domain: "a.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "b.example",
+		Answer: "1.2.3.5",
+	}}, doc.Rewrites)
+}
+
+func TestDNSFilter_handleRewriteImport(t *testing.T) {
+	testCases := []struct {
+		name         string
+		body         string
+		wantBody     string
+		wantDomains  []string
+		wantCode     int
+		wantModified int
+	}{{
+		name: "replace",
+		body: `{"version":1,"rewrites":[` +
+			`{"domain":"b.example","answer":"1.2.3.5"},` +
+			`{"domain":"c.example","answer":"c.example.org"}]}`,
+		wantBody: `{"added":[{"domain":"c.example","answer":"c.example.org"}],` +
+			`"removed":[{"domain":"a.example","answer":"1.2.3.4"}]}` + "\n",
+		wantDomains:  []string{"b.example", "c.example"},
+		wantCode:     http.StatusOK,
+		wantModified: 1,
+	}, {
+		name:         "empty",
+		body:         `{"version":1,"rewrites":[]}`,
+		wantBody:     "",
+		wantDomains:  []string{},
+		wantCode:     http.StatusOK,
+		wantModified: 1,
+	}, {
+		name:         "bad_version",
+		body:         `{"version":2,"rewrites":[]}`,
+		wantBody:     "unsupported version 2, want 1\n",
+		wantDomains:  []string{"a.example", "b.example"},
+		wantCode:     http.StatusBadRequest,
+		wantModified: 0,
+	}, {
+		name: "invalid",
+		body: `{"version":1,"rewrites":[` +
+			`{"domain":"c.example","answer":"c.example.org"},` +
+			`{"domain":"d.example","answer":"1.2.3.4","type":"AAAA"}]}`,
+		wantBody: `rewrite at index 1: invalid AAAA record value "1.2.3.4": ` +
+			"wrong address family\n",
+		wantDomains:  []string{"a.example", "b.example"},
+		wantCode:     http.StatusBadRequest,
+		wantModified: 0,
+	}, {
+		name: "ambiguous",
+		body: `{"version":1,"rewrites":[` +
+			`{"domain":"c.example","answer":"1.2.3.4","scope":"user_admin"},` +
+			`{"domain":"c.example","answer":"1.2.3.5","scope":"device_pc"}]}`,
+		wantBody: `rewrite at index 1: rewrite for c.example with scope "device_pc" ` +
+			`is ambiguous with the one with scope "user_admin"` + "\n",
+		wantDomains:  []string{"a.example", "b.example"},
+		wantCode:     http.StatusBadRequest,
+		wantModified: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, modified := newExportTestFilter(t)
+
+			r := httptest.NewRequest(http.MethodPut, "/control/rewrite/export", strings.NewReader(tc.body))
+			w := httptest.NewRecorder()
+			d.handleRewriteImport(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			if tc.wantBody != "" {
+				assert.Equal(t, tc.wantBody, w.Body.String())
+			}
+
+			domains := []string{}
+			for _, ent := range d.Rewrites {
+				domains = append(domains, ent.Domain)
+			}
+
+			assert.Equal(t, tc.wantDomains, domains)
+			assert.Equal(t, tc.wantModified, *modified)
+		})
+	}
+}
+
+func TestDNSFilter_handleBlockedServicesImport(t *testing.T) {
+	testCases := []struct {
+		name         string
+		body         string
+		wantBody     string
+		wantList     []string
+		wantCode     int
+		wantModified int
+	}{{
+		name:         "replace",
+		body:         `{"version":1,"blocked_services":["twitch","tiktok"]}`,
+		wantBody:     `{"added":["tiktok"],"removed":["youtube"]}` + "\n",
+		wantList:     []string{"twitch", "tiktok"},
+		wantCode:     http.StatusOK,
+		wantModified: 1,
+	}, {
+		name:         "null",
+		body:         `{"version":1,"blocked_services":null}`,
+		wantBody:     `{"added":[],"removed":["youtube","twitch"]}` + "\n",
+		wantList:     []string{},
+		wantCode:     http.StatusOK,
+		wantModified: 1,
+	}, {
+		name:         "unknown",
+		body:         `{"version":1,"blocked_services":["twitch","nosuchservice"]}`,
+		wantBody:     `unknown blocked service "nosuchservice"` + "\n",
+		wantList:     []string{"youtube", "twitch"},
+		wantCode:     http.StatusBadRequest,
+		wantModified: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d, modified := newExportTestFilter(t)
+
+			r := httptest.NewRequest(
+				http.MethodPut,
+				"/control/blocked_services/export",
+				strings.NewReader(tc.body),
+			)
+			w := httptest.NewRecorder()
+			d.handleBlockedServicesImport(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+			assert.Equal(t, tc.wantList, d.BlockedServices)
+			assert.Equal(t, tc.wantModified, *modified)
+		})
+	}
+}
+
+func TestDNSFilter_importDryRun(t *testing.T) {
+	d, modified := newExportTestFilter(t)
+
+	body := `{"version":1,"rewrites":[` +
+		`{"domain":"b.example","answer":"1.2.3.5"},` +
+		`{"domain":"c.example","answer":"1.2.3.4","type":"AAAA"},` +
+		`{"domain":"d.example","answer":"d.example.org"}]}`
+
+	r := httptest.NewRequest(
+		http.MethodPut,
+		"/control/rewrite/export?dry_run=true",
+		strings.NewReader(body),
+	)
+	w := httptest.NewRecorder()
+	d.handleRewriteImport(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	diff := rewritesDiff{}
+	err := json.NewDecoder(w.Body).Decode(&diff)
+	require.NoError(t, err)
+
+	assert.Equal(t, []*rewriteEntryJSON{{
+		Domain: "d.example",
+		Answer: "d.example.org",
+	}}, diff.Added)
+	assert.Equal(t, []*rewriteEntryJSON{{
+		Domain: "a.example",
+		Answer: "1.2.3.4",
+	}}, diff.Removed)
+	assert.Equal(t, []string{
+		`rewrite at index 1: invalid AAAA record value "1.2.3.4": wrong address family`,
+	}, diff.Errors)
+	require.NotEmpty(t, diff.Revision)
+
+	require.Len(t, d.Rewrites, 2)
+	assert.Zero(t, *modified)
+
+	body = `{"version":1,"rewrites":[{"domain":"d.example","answer":"d.example.org"}]}`
+	importWithRevision := func(rev string) (code int) {
+		r = httptest.NewRequest(
+			http.MethodPut,
+			"/control/rewrite/export?revision="+rev,
+			strings.NewReader(body),
+		)
+		w = httptest.NewRecorder()
+		d.handleRewriteImport(w, r)
+
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusConflict, importWithRevision("0123456789abcdef"))
+	assert.Zero(t, *modified)
+
+	assert.Equal(t, http.StatusOK, importWithRevision(diff.Revision))
+	assert.Equal(t, 1, *modified)
+
+	// The revision has changed along with the rewrites.
+	assert.Equal(t, http.StatusConflict, importWithRevision(diff.Revision))
+
+	t.Run("blocked_services", func(t *testing.T) {
+		r = httptest.NewRequest(
+			http.MethodPut,
+			"/control/blocked_services/export?dry_run=true",
+			strings.NewReader(`{"version":1,"blocked_services":["twitch","nosuchservice","tiktok"]}`),
+		)
+		w = httptest.NewRecorder()
+		d.handleBlockedServicesImport(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		bsDiff := blockedServicesDiff{}
+		err = json.NewDecoder(w.Body).Decode(&bsDiff)
+		require.NoError(t, err)
+
+		assert.Equal(t, []string{"tiktok"}, bsDiff.Added)
+		assert.Equal(t, []string{"youtube"}, bsDiff.Removed)
+		assert.Equal(t, []string{`unknown blocked service "nosuchservice"`}, bsDiff.Errors)
+		assert.NotEmpty(t, bsDiff.Revision)
+
+		assert.Equal(t, []string{"youtube", "twitch"}, d.BlockedServices)
+		assert.Equal(t, 1, *modified)
+	})
+}
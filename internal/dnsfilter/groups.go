@@ -0,0 +1,164 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// groupEngine is the filtering engine of a group of blocklists.
+type groupEngine struct {
+	engine *filtering.Engine
+	name   string
+}
+
+// splitGroups returns the ungrouped filters and the grouped ones by the name
+// of the group.
+func splitGroups(fs []Filter) (ungrouped []Filter, groups map[string][]Filter) {
+	groups = map[string][]Filter{}
+	for _, f := range fs {
+		if f.Group == "" {
+			ungrouped = append(ungrouped, f)
+		} else {
+			groups[f.Group] = append(groups[f.Group], f)
+		}
+	}
+
+	return ungrouped, groups
+}
+
+// newGroupEngines builds the engines of groups sorted by the name of the
+// group.  compiled is passed to filteringLists.
+func newGroupEngines(groups map[string][]Filter, compiled bool) (ges []*groupEngine, err error) {
+	names := make([]string, 0, len(groups))
+	for name := range groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		var e *filtering.Engine
+		e, err = filtering.NewEngine(filteringLists(groups[name], nil, compiled), nil)
+		if err != nil {
+			closeGroupEngines(ges)
+
+			return nil, fmt.Errorf("group %q: %w", name, err)
+		}
+
+		ges = append(ges, &groupEngine{
+			engine: e,
+			name:   name,
+		})
+	}
+
+	return ges, nil
+}
+
+// closeGroupEngines closes the engines of ges.
+func closeGroupEngines(ges []*groupEngine) {
+	for _, ge := range ges {
+		err := ge.engine.Close()
+		if err != nil {
+			log.Error("dnsfilter: closing engine of group %q: %s", ge.name, err)
+		}
+	}
+}
+
+// SetFilterGroups sets the names of the groups of the blocklists applied to
+// the requests, for which FilteringSettings.FilterGroups is nil.  nil groups
+// mean all groups.
+func (d *DNSFilter) SetFilterGroups(groups []string) {
+	d.engineLock.Lock()
+	defer d.engineLock.Unlock()
+
+	d.defaultGroups = aghstrings.CloneSlice(groups)
+	d.matchCache.clear()
+}
+
+// matchGroups matches host against the engines of the groups enabled for the
+// request.  The first blocking or rewriting match wins.  An exception rule of
+// a group only unblocks the host within that group, so the rest of the groups
+// are still checked.  d.engineLock is expected to be locked for reading.
+func (d *DNSFilter) matchGroups(
+	host string,
+	qtype uint16,
+	cli *filtering.ClientContext,
+	groups []string,
+) (res filtering.Result, err error) {
+	if groups == nil {
+		groups = d.defaultGroups
+	}
+
+	for _, ge := range d.groupEngines {
+		if groups != nil && !aghstrings.InSlice(groups, ge.name) {
+			continue
+		}
+
+		var gres filtering.Result
+		gres, err = ge.engine.Match(host, qtype, cli)
+		if err != nil {
+			return filtering.Result{}, fmt.Errorf("group %q: %w", ge.name, err)
+		}
+
+		switch gres.Reason {
+		case filtering.Blocked, filtering.Rewritten:
+			return gres, nil
+		case filtering.Allowed:
+			if res.Reason == filtering.NotMatched {
+				res = gres
+			}
+		default:
+			// Go on.
+		}
+	}
+
+	return res, nil
+}
+
+// newHits returns the hit counters of the filters.  The counters of the
+// filters present in old are kept, so that the counts survive the rebuilds
+// of the engine.
+func newHits(old map[int64]*uint64, filterSets ...[]Filter) (hits map[int64]*uint64) {
+	hits = map[int64]*uint64{}
+	for _, fs := range filterSets {
+		for _, f := range fs {
+			if n, ok := old[f.ID]; ok {
+				hits[f.ID] = n
+			} else {
+				hits[f.ID] = new(uint64)
+			}
+		}
+	}
+
+	return hits
+}
+
+// countHit increments the hit counter of the filter list of the first rule of
+// res.  d.engineLock is expected to be locked for reading.
+func (d *DNSFilter) countHit(res filtering.Result) {
+	if len(res.Rules) == 0 {
+		return
+	}
+
+	if n, ok := d.hits[res.Rules[0].FilterListID]; ok {
+		atomic.AddUint64(n, 1)
+	}
+}
+
+// FilterHits returns the numbers of the requests matched by the rules of each
+// filter list since the start by the ID of the list.
+func (d *DNSFilter) FilterHits() (hits map[int64]uint64) {
+	d.engineLock.RLock()
+	defer d.engineLock.RUnlock()
+
+	hits = make(map[int64]uint64, len(d.hits))
+	for id, n := range d.hits {
+		hits[id] = atomic.LoadUint64(n)
+	}
+
+	return hits
+}
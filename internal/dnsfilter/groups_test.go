@@ -0,0 +1,109 @@
+package dnsfilter
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_groups(t *testing.T) {
+	dir := t.TempDir()
+	newFilter := func(id int64, group, rules string) (f Filter) {
+		path := filepath.Join(dir, group+".txt")
+		require.NoError(t, ioutil.WriteFile(path, []byte(rules), 0o644))
+
+		return Filter{
+			ID:       id,
+			FilePath: path,
+			Group:    group,
+		}
+	}
+
+	blockFilters := []Filter{
+		{ID: 0, Data: []byte("||user.example^\n")},
+		newFilter(1, "ads", "||ads.example^\n||both.example^\n@@||allowed.example^\n"),
+		newFilter(2, "kids", "||games.example^\n||allowed.example^\n"),
+	}
+
+	d := newForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	require.NoError(t, d.SetFilters(blockFilters, nil, false))
+
+	testCases := []struct {
+		name        string
+		host        string
+		groups      []string
+		wantBlocked bool
+	}{{
+		name:        "user_rules",
+		host:        "user.example",
+		groups:      []string{},
+		wantBlocked: true,
+	}, {
+		name:        "all_groups",
+		host:        "games.example",
+		groups:      nil,
+		wantBlocked: true,
+	}, {
+		name:        "enabled_group",
+		host:        "ads.example",
+		groups:      []string{"ads"},
+		wantBlocked: true,
+	}, {
+		name:        "disabled_group",
+		host:        "games.example",
+		groups:      []string{"ads"},
+		wantBlocked: false,
+	}, {
+		name:        "exception_within_group",
+		host:        "allowed.example",
+		groups:      []string{"ads", "kids"},
+		wantBlocked: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.FilterGroups = tc.groups
+
+			res, err := d.CheckHost(tc.host, dns.TypeA, &s)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantBlocked, res.IsFiltered)
+		})
+	}
+
+	t.Run("default_groups", func(t *testing.T) {
+		d.SetFilterGroups([]string{"kids"})
+		t.Cleanup(func() { d.SetFilterGroups(nil) })
+
+		res, err := d.CheckHost("ads.example", dns.TypeA, &setts)
+		require.NoError(t, err)
+
+		assert.False(t, res.IsFiltered)
+
+		res, err = d.CheckHost("games.example", dns.TypeA, &setts)
+		require.NoError(t, err)
+
+		assert.True(t, res.IsFiltered)
+	})
+
+	t.Run("hits", func(t *testing.T) {
+		before := d.FilterHits()
+
+		_, err := d.CheckHost("both.example", dns.TypeA, &setts)
+		require.NoError(t, err)
+
+		// The counters survive the rebuilds.
+		require.NoError(t, d.SetFilters(blockFilters, nil, false))
+
+		hits := d.FilterHits()
+		assert.Equal(t, before[1]+1, hits[1])
+		assert.Equal(t, before[2], hits[2])
+	})
+}
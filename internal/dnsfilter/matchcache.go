@@ -0,0 +1,207 @@
+package dnsfilter
+
+import (
+	"container/list"
+	"hash/fnv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/filtering"
+)
+
+// MatchCacheStats are the counters of the cache of the filtering decisions.
+type MatchCacheStats struct {
+	// Hits is the number of the requests decided from the cache since the
+	// start.
+	Hits uint64
+
+	// Misses is the number of the requests matched against the filtering
+	// engines since the start.
+	Misses uint64
+
+	// Size is the current number of the cached decisions.
+	Size int
+
+	// Limit is the maximum number of the cached decisions.  Zero means that
+	// the cache is disabled.
+	Limit int
+}
+
+// matchKey is the key of a cached filtering decision.
+type matchKey struct {
+	// host is the lowercased hostname.
+	host string
+
+	// setts is the hash of the client settings, which affect the matching,
+	// see settingsHash.
+	setts uint64
+
+	qtype uint16
+}
+
+// matchEntry is a cached filtering decision.
+type matchEntry struct {
+	key matchKey
+	res filtering.Result
+}
+
+// matchCache is an LRU cache of the decisions of the rule-based filtering
+// engines.  The cache is emptied as a whole each time the engines or the
+// default groups of blocklists change, so it never serves the decisions of the
+// previous ones.  A nil *matchCache caches nothing.
+type matchCache struct {
+	// hits and misses are updated atomically.  They go first to be aligned
+	// on the 32-bit platforms.
+	hits   uint64
+	misses uint64
+
+	// mu protects entries and order.
+	mu sync.Mutex
+
+	// entries are the elements of order by their keys.
+	entries map[matchKey]*list.Element
+
+	// order contains the *matchEntry values with the most recently used one
+	// in front.
+	order *list.List
+
+	limit int
+}
+
+// newMatchCache returns a new cache of at most limit decisions.  c is nil if
+// limit is zero.
+func newMatchCache(limit uint) (c *matchCache) {
+	if limit == 0 {
+		return nil
+	}
+
+	return &matchCache{
+		entries: map[matchKey]*list.Element{},
+		order:   list.New(),
+		limit:   int(limit),
+	}
+}
+
+// settingsHash returns the hash of the parts of setts, which are used by the
+// filtering engines.
+func settingsHash(setts *FilteringSettings) (h uint64) {
+	hash := fnv.New64a()
+
+	// Write the zero bytes between the fields so that the different
+	// settings don't end up in the same byte sequence.
+	_, _ = hash.Write([]byte(setts.ClientName))
+	_, _ = hash.Write([]byte{0})
+	_, _ = hash.Write(setts.ClientIP)
+	_, _ = hash.Write([]byte{0})
+	for _, tag := range setts.ClientTags {
+		_, _ = hash.Write([]byte(tag))
+		_, _ = hash.Write([]byte{0})
+	}
+
+	// nil groups mean the default ones, which differ from no groups.
+	if setts.FilterGroups == nil {
+		_, _ = hash.Write([]byte{1})
+	} else {
+		_, _ = hash.Write([]byte{2})
+		for _, g := range setts.FilterGroups {
+			_, _ = hash.Write([]byte(g))
+			_, _ = hash.Write([]byte{0})
+		}
+	}
+
+	return hash.Sum64()
+}
+
+// newMatchKey returns the key of the decision for the request.
+func newMatchKey(host string, qtype uint16, setts *FilteringSettings) (k matchKey) {
+	return matchKey{
+		host:  strings.ToLower(host),
+		setts: settingsHash(setts),
+		qtype: qtype,
+	}
+}
+
+// get returns the cached decision for k, if any.
+func (c *matchCache) get(k matchKey) (res filtering.Result, ok bool) {
+	if c == nil {
+		return filtering.Result{}, false
+	}
+
+	c.mu.Lock()
+	e, ok := c.entries[k]
+	if ok {
+		c.order.MoveToFront(e)
+		res = e.Value.(*matchEntry).res
+	}
+	c.mu.Unlock()
+
+	if ok {
+		atomic.AddUint64(&c.hits, 1)
+	} else {
+		atomic.AddUint64(&c.misses, 1)
+	}
+
+	return res, ok
+}
+
+// set caches the decision res for k and removes the least recently used one,
+// if the cache is full.
+func (c *matchCache) set(k matchKey, res filtering.Result) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if e, ok := c.entries[k]; ok {
+		e.Value.(*matchEntry).res = res
+		c.order.MoveToFront(e)
+
+		return
+	}
+
+	c.entries[k] = c.order.PushFront(&matchEntry{key: k, res: res})
+	if c.order.Len() > c.limit {
+		last := c.order.Back()
+		c.order.Remove(last)
+		delete(c.entries, last.Value.(*matchEntry).key)
+	}
+}
+
+// clear removes all the cached decisions.
+func (c *matchCache) clear() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[matchKey]*list.Element{}
+	c.order.Init()
+}
+
+// stats returns the current counters of the cache.
+func (c *matchCache) stats() (s MatchCacheStats) {
+	if c == nil {
+		return MatchCacheStats{}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return MatchCacheStats{
+		Hits:   atomic.LoadUint64(&c.hits),
+		Misses: atomic.LoadUint64(&c.misses),
+		Size:   c.order.Len(),
+		Limit:  c.limit,
+	}
+}
+
+// MatchCacheStats returns the counters of the cache of the filtering
+// decisions.
+func (d *DNSFilter) MatchCacheStats() (s MatchCacheStats) {
+	return d.matchCache.stats()
+}
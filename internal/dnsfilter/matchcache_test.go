@@ -0,0 +1,137 @@
+package dnsfilter
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/filtering"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_matchCache(t *testing.T) {
+	d := newForTest(&Config{MatchCacheSize: 2}, []Filter{{
+		ID: 0, Data: []byte("||blocked.example^\n"),
+	}})
+	t.Cleanup(d.Close)
+
+	rsetts := &FilteringSettings{FilteringEnabled: true}
+	check := func(host string) (res Result) {
+		res, err := d.CheckHost(host, dns.TypeA, rsetts)
+		require.NoError(t, err)
+
+		return res
+	}
+
+	assert.True(t, check("blocked.example").IsFiltered)
+	assert.Equal(t, MatchCacheStats{Misses: 1, Size: 1, Limit: 2}, d.MatchCacheStats())
+
+	assert.True(t, check("BLOCKED.example").IsFiltered)
+	assert.EqualValues(t, 1, d.MatchCacheStats().Hits)
+
+	t.Run("skips_engine", func(t *testing.T) {
+		// Replace the engine bypassing the invalidation to make sure that
+		// the cached decision doesn't consult it.
+		empty, err := filtering.NewEngine(nil, nil)
+		require.NoError(t, err)
+
+		d.engineLock.Lock()
+		prev := d.engine
+		d.engine = empty
+		d.engineLock.Unlock()
+
+		assert.True(t, check("blocked.example").IsFiltered)
+
+		d.engineLock.Lock()
+		d.engine = prev
+		d.engineLock.Unlock()
+
+		assert.NoError(t, empty.Close())
+	})
+
+	t.Run("client_settings", func(t *testing.T) {
+		other := &FilteringSettings{
+			FilteringEnabled: true,
+			ClientIP:         net.IP{1, 2, 3, 4},
+		}
+
+		before := d.MatchCacheStats()
+		_, err := d.CheckHost("blocked.example", dns.TypeA, other)
+		require.NoError(t, err)
+		assert.Equal(t, before.Misses+1, d.MatchCacheStats().Misses)
+	})
+
+	t.Run("evicts_oldest", func(t *testing.T) {
+		check("a.example")
+		check("b.example")
+
+		s := d.MatchCacheStats()
+		assert.Equal(t, 2, s.Size)
+		check("a.example")
+		check("b.example")
+		assert.Equal(t, s.Hits+2, d.MatchCacheStats().Hits)
+	})
+
+	t.Run("invalidated", func(t *testing.T) {
+		require.NoError(t, d.initFiltering(nil, []Filter{{
+			ID: 0, Data: []byte("||other.example^\n"),
+		}}, EngineSourceLive))
+		assert.Zero(t, d.MatchCacheStats().Size)
+
+		assert.False(t, check("blocked.example").IsFiltered)
+		assert.True(t, check("other.example").IsFiltered)
+
+		d.SetFilterGroups([]string{"ads"})
+		assert.Zero(t, d.MatchCacheStats().Size)
+	})
+}
+
+func TestSettingsHash(t *testing.T) {
+	base := &FilteringSettings{ClientName: "client", ClientTags: []string{"user_child"}}
+	h := settingsHash(base)
+
+	assert.Equal(t, h, settingsHash(&FilteringSettings{
+		ClientName: "client",
+		ClientTags: []string{"user_child"},
+	}))
+	assert.NotEqual(t, h, settingsHash(&FilteringSettings{
+		ClientName: "clien",
+		ClientTags: []string{"tuser_child"},
+	}))
+	assert.NotEqual(t, h, settingsHash(&FilteringSettings{
+		ClientName:   "client",
+		ClientTags:   []string{"user_child"},
+		FilterGroups: []string{},
+	}))
+}
+
+func BenchmarkDNSFilter_matchHost_cache(b *testing.B) {
+	const n = 10_000
+
+	rules := &strings.Builder{}
+	for i := 0; i < n; i++ {
+		_, _ = fmt.Fprintf(rules, "||host%d.example^\n/^ads%d[a-z]+\\./\n", i, i)
+	}
+
+	filters := []Filter{{ID: 0, Data: []byte(rules.String())}}
+	rsetts := &FilteringSettings{
+		FilteringEnabled: true,
+		ClientIP:         net.IP{1, 2, 3, 4},
+	}
+
+	for _, size := range []uint{0, 1000} {
+		d := newForTest(&Config{MatchCacheSize: size}, filters)
+		b.Cleanup(d.Close)
+
+		b.Run(fmt.Sprintf("size_%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				_, err := d.matchHost("www.allowed.example", dns.TypeA, rsetts)
+				require.NoError(b, err)
+			}
+		})
+	}
+}
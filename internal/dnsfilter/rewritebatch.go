@@ -0,0 +1,150 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// rewriteBatchReq is the request for changing several rewrites at once.  The
+// deletions are applied before the additions.
+type rewriteBatchReq struct {
+	Add    []*rewriteEntryJSON `json:"add"`
+	Delete []*rewriteEntryJSON `json:"delete"`
+}
+
+// rewriteBatchResult is the result of a single item of a rewriteBatchReq.
+type rewriteBatchResult struct {
+	// Error is the validation error of the item, if any.
+	Error string `json:"error,omitempty"`
+
+	// Changed is true if the item has been added or if at least one entry
+	// has been deleted because of it.
+	Changed bool `json:"changed"`
+}
+
+// rewriteBatchResp is the response to a rewriteBatchReq.  The results are in
+// the same order as the items of the request.
+type rewriteBatchResp struct {
+	Added   []rewriteBatchResult `json:"added"`
+	Deleted []rewriteBatchResult `json:"deleted"`
+
+	// Applied is true if the batch has been applied, which only happens if
+	// all the items are valid.
+	Applied bool `json:"applied"`
+}
+
+// firstErr returns the first error among the results, if any.
+func (resp *rewriteBatchResp) firstErr() (msg string) {
+	for _, res := range resp.Added {
+		if res.Error != "" {
+			return res.Error
+		}
+	}
+
+	return ""
+}
+
+// applyRewriteBatch validates all the items of req and, if they are valid,
+// applies them to the rewrites and saves the configuration once.  Otherwise
+// nothing is changed.
+func (d *DNSFilter) applyRewriteBatch(req *rewriteBatchReq) (resp *rewriteBatchResp) {
+	resp = &rewriteBatchResp{
+		Added:   make([]rewriteBatchResult, len(req.Add)),
+		Deleted: make([]rewriteBatchResult, len(req.Delete)),
+	}
+
+	d.confLock.Lock()
+
+	rewrites := make([]RewriteEntry, 0, len(d.Config.Rewrites)+len(req.Add))
+	for _, ent := range d.Config.Rewrites {
+		deleted := false
+		for i, jsent := range req.Delete {
+			if ent.equals(jsent.toEntry()) {
+				log.Debug("Rewrites: removed element: %s -> %s", ent.Domain, ent.Answer)
+				resp.Deleted[i].Changed = true
+				deleted = true
+			}
+		}
+
+		if !deleted {
+			rewrites = append(rewrites, ent)
+		}
+	}
+
+	valid := true
+	for i, jsent := range req.Add {
+		ent := jsent.toEntry()
+		err := validateRewrite(&ent, rewrites)
+		if err != nil {
+			resp.Added[i].Error = err.Error()
+			valid = false
+
+			continue
+		}
+
+		rewrites = append(rewrites, ent)
+		resp.Added[i].Changed = true
+	}
+
+	if !valid {
+		d.confLock.Unlock()
+
+		// Nothing has been changed.
+		for i := range resp.Added {
+			resp.Added[i].Changed = false
+		}
+
+		for i := range resp.Deleted {
+			resp.Deleted[i].Changed = false
+		}
+
+		return resp
+	}
+
+	d.Config.Rewrites = rewrites
+	d.confLock.Unlock()
+
+	log.Debug("Rewrites: applied batch: %d added, %d deleted, %d total",
+		len(req.Add), len(req.Delete), len(rewrites))
+
+	resp.Applied = true
+	d.Config.ConfigModified()
+
+	return resp
+}
+
+// handleRewriteBatch is the handler for the POST /control/rewrite/batch HTTP
+// API.
+func (d *DNSFilter) handleRewriteBatch(w http.ResponseWriter, r *http.Request) {
+	req := &rewriteBatchReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	for _, ents := range [][]*rewriteEntryJSON{req.Add, req.Delete} {
+		for _, jsent := range ents {
+			if jsent == nil {
+				httpError(r, w, http.StatusBadRequest, "null rewrite entry")
+
+				return
+			}
+		}
+	}
+
+	resp := d.applyRewriteBatch(req)
+
+	w.Header().Set("Content-Type", "application/json")
+	if !resp.Applied {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		log.Debug("Rewrites: writing batch response: %s", err)
+	}
+}
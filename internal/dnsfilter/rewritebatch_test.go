@@ -0,0 +1,97 @@
+package dnsfilter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDNSFilter_handleRewriteBatch(t *testing.T) {
+	d, modified := newExportTestFilter(t)
+
+	post := func(t *testing.T, body string) (w *httptest.ResponseRecorder, resp *rewriteBatchResp) {
+		t.Helper()
+
+		w = httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/rewrite/batch", strings.NewReader(body))
+		d.handleRewriteBatch(w, r)
+
+		resp = &rewriteBatchResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return w, resp
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		w, resp := post(t, `{"add":[`+
+			`{"domain":"c.example","answer":"1.2.3.6"},`+
+			`{"domain":"f.example","answer":"1.2.3.7","scope":"1.2.3.0/99"}],`+
+			`"delete":[{"domain":"a.example","answer":"1.2.3.4"}]}`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.False(t, resp.Applied)
+
+		require.Len(t, resp.Added, 2)
+		assert.Empty(t, resp.Added[0].Error)
+		assert.NotEmpty(t, resp.Added[1].Error)
+		assert.Equal(t, []rewriteBatchResult{{Changed: false}}, resp.Deleted)
+
+		// Nothing is changed.
+		assert.Len(t, d.Config.Rewrites, 2)
+		assert.Zero(t, *modified)
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		w, resp := post(t, `{"add":[`+
+			`{"domain":"c.example","answer":"1.2.3.6"},`+
+			`{"domain":"d.example","answer":"1.2.3.7"}],`+
+			`"delete":[`+
+			`{"domain":"a.example","answer":"1.2.3.4"},`+
+			`{"domain":"x.example","answer":"1.2.3.4"}]}`)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.True(t, resp.Applied)
+
+		assert.Equal(t, []rewriteBatchResult{{Changed: true}, {Changed: true}}, resp.Added)
+		assert.Equal(t, []rewriteBatchResult{{Changed: true}, {Changed: false}}, resp.Deleted)
+
+		assert.Equal(t, []*rewriteEntryJSON{{
+			Domain: "b.example",
+			Answer: "1.2.3.5",
+		}, {
+			Domain: "c.example",
+			Answer: "1.2.3.6",
+		}, {
+			Domain: "d.example",
+			Answer: "1.2.3.7",
+		}}, d.rewritesJSON())
+
+		// The configuration is saved once.
+		assert.Equal(t, 1, *modified)
+	})
+
+	t.Run("single", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(
+			http.MethodPost,
+			"/control/rewrite/add",
+			strings.NewReader(`{"domain":"e.example","answer":"1.2.3.8"}`),
+		)
+		d.handleRewriteAdd(w, r)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Len(t, d.Config.Rewrites, 4)
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(
+			http.MethodPost,
+			"/control/rewrite/add",
+			strings.NewReader(`{"domain":"f.example","answer":"1.2.3.8","scope":"1.2.3.0/99"}`),
+		)
+		d.handleRewriteAdd(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Len(t, d.Config.Rewrites, 4)
+	})
+}
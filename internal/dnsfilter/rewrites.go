@@ -4,25 +4,258 @@ package dnsfilter
 
 import (
 	"encoding/json"
+	"fmt"
 	"net"
 	"net/http"
 	"sort"
 	"strings"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
 	"github.com/AdguardTeam/golibs/log"
+	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 )
 
+// RewriteSelection is how the addresses of a rewrite entry with multiple
+// addresses are served.
+type RewriteSelection string
+
+// RewriteSelection values.
+const (
+	// RewriteSelectionAll serves all the addresses in a random order.
+	// It's the default.
+	RewriteSelectionAll RewriteSelection = "all"
+
+	// RewriteSelectionWeighted serves a single address picked randomly
+	// according to the weights of the addresses.
+	RewriteSelectionWeighted RewriteSelection = "weighted"
+)
+
+// RewritePrecedence is how a request matching both a rewrite entry and a
+// blocking filtering rule is handled.
+type RewritePrecedence string
+
+// RewritePrecedence values.
+const (
+	// RewritePrecedenceBlock means that the request is blocked.  It's the
+	// default.
+	RewritePrecedenceBlock RewritePrecedence = "block"
+
+	// RewritePrecedenceRewrite means that the request is rewritten.
+	RewritePrecedenceRewrite RewritePrecedence = "rewrite"
+)
+
+// RewriteConflict is the decision taken for a request matching both a rewrite
+// entry and a blocking filtering rule.
+type RewriteConflict string
+
+// RewriteConflict values.
+const (
+	// RewriteConflictBlockWon means that the request has been blocked.
+	RewriteConflictBlockWon RewriteConflict = "block_won"
+
+	// RewriteConflictRewriteWon means that the request has been rewritten.
+	RewriteConflictRewriteWon RewriteConflict = "rewrite_won"
+)
+
+// maxRewriteWeight is the maximum weight of an address of a rewrite entry.
+const maxRewriteWeight = 1000
+
+// RewriteAnswer is an address of a rewrite entry with multiple addresses.
+type RewriteAnswer struct {
+	// Answer is the IP address.
+	Answer string `yaml:"answer"`
+
+	// Weight is the relative chance of the address to be picked by
+	// RewriteSelectionWeighted.  Zero means one.
+	Weight uint `yaml:"weight,omitempty"`
+
+	// ip is the parsed Answer.
+	ip net.IP
+}
+
+// weight returns the weight of a, which is at least one.
+func (a *RewriteAnswer) weight() (w int) {
+	if a.Weight == 0 {
+		return 1
+	}
+
+	return int(a.Weight)
+}
+
 // RewriteEntry is a rewrite array element
 type RewriteEntry struct {
 	Domain string `yaml:"domain"`
-	Answer string `yaml:"answer"` // IP address or canonical name
-	Type   uint16 `yaml:"-"`      // DNS record type: CNAME, A or AAAA
-	IP     net.IP `yaml:"-"`      // Parsed IP address (if Type is A or AAAA)
+	Answer string `yaml:"answer"` // IP address, canonical name, or the record value
+
+	// RecordType is the name of the DNS record type of a local zone record,
+	// for example "SRV".  If it's empty, the type is inferred from Answer.
+	// Otherwise, Answer is the value of the record in the same format as in
+	// the $dnsrewrite rules.
+	RecordType string `yaml:"type,omitempty"`
+
+	// TTL is the TTL of the answers in seconds.  If it's zero, the TTL of
+	// the blocked responses is used.
+	TTL uint32 `yaml:"ttl,omitempty"`
+
+	// Scope limits the clients to which the entry applies.  It's either an
+	// IP address, a CIDR, or a client tag.  If it's empty, the entry
+	// applies to all clients.
+	Scope string `yaml:"scope,omitempty"`
+
+	// Answers are the addresses of an entry with multiple A or AAAA
+	// records, in which case Answer must be empty.
+	Answers []RewriteAnswer `yaml:"answers,omitempty"`
+
+	// Selection is how the Answers are served.  If it's empty,
+	// RewriteSelectionAll is used.
+	Selection RewriteSelection `yaml:"selection,omitempty"`
+
+	Type  uint16        `yaml:"-"` // DNS record type
+	IP    net.IP        `yaml:"-"` // Parsed IP address (if Type is A or AAAA)
+	Value rules.RRValue `yaml:"-"` // Parsed value (if RecordType is set and Type is not A, AAAA, or CNAME)
+
+	// scopeNet is the parsed network of the scope, if the scope is an IP
+	// address or a CIDR.
+	scopeNet *net.IPNet
 }
 
+// equals returns true if b describes the same entry as r.  The domain names
+// are compared in the canonical form, and so are the answers of the CNAME
+// entries.  r is expected to be prepared.
 func (r *RewriteEntry) equals(b RewriteEntry) bool {
-	return r.Domain == b.Domain && r.Answer == b.Answer
+	answersEqual := r.Answer == b.Answer ||
+		(r.Type == dns.TypeCNAME && r.Answer == aghnet.CanonicalDomain(b.Answer))
+
+	return r.Domain == aghnet.CanonicalDomain(b.Domain) &&
+		answersEqual &&
+		multiAnswersEqual(r.Answers, b.Answers) &&
+		strings.EqualFold(r.RecordType, b.RecordType) &&
+		r.Scope == b.Scope
+}
+
+// multiAnswersEqual returns true if a and b contain the same addresses with
+// the same weights in the same order.
+func multiAnswersEqual(a, b []RewriteAnswer) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i].Answer != b[i].Answer || a[i].weight() != b[i].weight() {
+			return false
+		}
+	}
+
+	return true
+}
+
+// isValidClientTag returns true if tag has the syntax of a client tag, for
+// example "device_pc".
+func isValidClientTag(tag string) (ok bool) {
+	if tag == "" {
+		return false
+	}
+
+	for _, c := range tag {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && c != '_' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// prepareScope validates and parses the scope of the entry.
+func (r *RewriteEntry) prepareScope() (err error) {
+	r.scopeNet = nil
+	if r.Scope == "" {
+		return nil
+	}
+
+	if ip := net.ParseIP(r.Scope); ip != nil {
+		bits := net.IPv6len * 8
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, bits = ip4, net.IPv4len*8
+		}
+
+		r.scopeNet = &net.IPNet{
+			IP:   ip,
+			Mask: net.CIDRMask(bits, bits),
+		}
+
+		return nil
+	}
+
+	if strings.Contains(r.Scope, "/") {
+		_, r.scopeNet, err = net.ParseCIDR(r.Scope)
+		if err != nil {
+			return fmt.Errorf("invalid scope %q: %w", r.Scope, err)
+		}
+
+		return nil
+	}
+
+	if !isValidClientTag(r.Scope) {
+		return fmt.Errorf("invalid scope %q: not an ip address, a cidr, or a client tag", r.Scope)
+	}
+
+	return nil
+}
+
+// scopeMatches returns true if the entry applies to the client described by
+// setts.  Scoped entries never apply if setts is nil.
+func (r *RewriteEntry) scopeMatches(setts *FilteringSettings) (ok bool) {
+	if r.Scope == "" {
+		return true
+	} else if setts == nil {
+		return false
+	}
+
+	if r.scopeNet != nil {
+		return setts.ClientIP != nil && r.scopeNet.Contains(setts.ClientIP)
+	}
+
+	return aghstrings.InSlice(setts.ClientTags, r.Scope)
+}
+
+// tagScopeSpecificity is the specificity of the scopes which are client tags.
+// A tag is assigned to particular clients explicitly, so it's more specific
+// than any network.
+const tagScopeSpecificity = 1 + net.IPv6len*8 + 1
+
+// scopeSpecificity returns the specificity of the scope of the entry.  Zero
+// means no scope, the scopes with networks have the specificity of one plus
+// the length of the prefix, and tags have the tagScopeSpecificity.
+func (r *RewriteEntry) scopeSpecificity() (n int) {
+	if r.Scope == "" {
+		return 0
+	}
+
+	if r.scopeNet != nil {
+		ones, _ := r.scopeNet.Mask.Size()
+
+		return 1 + ones
+	}
+
+	return tagScopeSpecificity
+}
+
+// ambiguousWith returns true if r and b could both apply to the same query and
+// the same client without either of them being more specific.  That's the
+// case for the entries for the same domain and record type with two different
+// client tags, since a client can have both.
+func (r *RewriteEntry) ambiguousWith(b *RewriteEntry) (ok bool) {
+	if !strings.EqualFold(r.Domain, b.Domain) || r.Type != b.Type {
+		return false
+	}
+
+	return r.scopeNet == nil &&
+		b.scopeNet == nil &&
+		r.Scope != "" &&
+		b.Scope != "" &&
+		r.Scope != b.Scope
 }
 
 func isWildcard(host string) bool {
@@ -67,8 +300,207 @@ func (a rewritesArray) Less(i, j int) bool {
 	return len(a[i].Domain) > len(a[j].Domain)
 }
 
-// Prepare entry for use
-func (r *RewriteEntry) prepare() {
+// supportedRRTypes are the DNS record types the local zone records can have.
+var supportedRRTypes = []uint16{
+	dns.TypeA,
+	dns.TypeAAAA,
+	dns.TypeCNAME,
+	dns.TypeMX,
+	dns.TypePTR,
+	dns.TypeTXT,
+	dns.TypeSRV,
+	dns.TypeHTTPS,
+	dns.TypeSVCB,
+}
+
+// unsupportedRRTypeError returns the error about the unsupported record type.
+func unsupportedRRTypeError(typ string) (err error) {
+	names := make([]string, len(supportedRRTypes))
+	for i, t := range supportedRRTypes {
+		names[i] = dns.TypeToString[t]
+	}
+
+	return fmt.Errorf(
+		"unsupported record type %q, supported types are: %s",
+		typ,
+		strings.Join(names, ", "),
+	)
+}
+
+// prepare validates the entry and prepares it for use.
+func (r *RewriteEntry) prepare() (err error) {
+	r.Domain = aghnet.CanonicalDomain(r.Domain)
+
+	err = r.prepareScope()
+	if err != nil {
+		return err
+	}
+
+	if len(r.Answers) > 0 || r.Selection != "" {
+		return r.prepareMulti()
+	}
+
+	if r.RecordType == "" {
+		r.prepareInferred()
+
+		return nil
+	}
+
+	rrType, ok := dns.StringToType[strings.ToUpper(r.RecordType)]
+	if !ok {
+		return unsupportedRRTypeError(r.RecordType)
+	}
+
+	r.RecordType = dns.TypeToString[rrType]
+	r.IP, r.Value = nil, nil
+
+	switch rrType {
+	case dns.TypeA, dns.TypeAAAA:
+		ip := net.ParseIP(r.Answer)
+		if ip == nil {
+			return fmt.Errorf("invalid %s record value %q: not an ip address", r.RecordType, r.Answer)
+		}
+
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+
+		if (len(ip) == net.IPv4len) != (rrType == dns.TypeA) {
+			return fmt.Errorf("invalid %s record value %q: wrong address family", r.RecordType, r.Answer)
+		}
+
+		r.IP = ip
+	case dns.TypeCNAME:
+		r.Answer = aghnet.CanonicalDomain(r.Answer)
+		err = aghnet.ValidateDomainName(r.Answer)
+		if err != nil {
+			return fmt.Errorf("invalid CNAME record value %q: %w", r.Answer, err)
+		}
+	default:
+		r.Value, err = parseRRValue(rrType, r.Answer)
+		if err != nil {
+			return err
+		}
+	}
+
+	r.Type = rrType
+
+	return nil
+}
+
+// prepareMulti validates and prepares the entry with multiple addresses.
+func (r *RewriteEntry) prepareMulti() (err error) {
+	if len(r.Answers) == 0 {
+		return fmt.Errorf("selection %q requires answers", r.Selection)
+	} else if r.Answer != "" {
+		return fmt.Errorf("answer %q and answers are mutually exclusive", r.Answer)
+	}
+
+	switch r.Selection {
+	case "", RewriteSelectionAll, RewriteSelectionWeighted:
+		// Go on.
+	default:
+		return fmt.Errorf("invalid selection %q", r.Selection)
+	}
+
+	var rrType uint16
+	if r.RecordType != "" {
+		rrType = dns.StringToType[strings.ToUpper(r.RecordType)]
+		if rrType != dns.TypeA && rrType != dns.TypeAAAA {
+			return fmt.Errorf("record type %q doesn't support multiple answers", r.RecordType)
+		}
+
+		r.RecordType = dns.TypeToString[rrType]
+	}
+
+	for i := range r.Answers {
+		a := &r.Answers[i]
+		ip := net.ParseIP(a.Answer)
+		if ip == nil {
+			return fmt.Errorf("invalid answer at index %d %q: not an ip address", i, a.Answer)
+		}
+
+		ipType := dns.TypeAAAA
+		if ip4 := ip.To4(); ip4 != nil {
+			ip, ipType = ip4, dns.TypeA
+		}
+
+		if rrType == 0 {
+			rrType = ipType
+		} else if ipType != rrType {
+			return fmt.Errorf("invalid answer at index %d %q: wrong address family", i, a.Answer)
+		}
+
+		if a.Weight > maxRewriteWeight {
+			return fmt.Errorf("weight of answer at index %d is %d, max is %d", i, a.Weight, maxRewriteWeight)
+		}
+
+		a.ip = ip
+	}
+
+	r.IP, r.Value = nil, nil
+	r.Type = rrType
+
+	return nil
+}
+
+// pickAnswers returns the addresses of the entry with multiple addresses in
+// the order in which they should be served according to the selection.
+// intn must return a random number in [0, n).
+func (r *RewriteEntry) pickAnswers(intn func(n int) (i int)) (ips []net.IP) {
+	if r.Selection == RewriteSelectionWeighted {
+		total := 0
+		for i := range r.Answers {
+			total += r.Answers[i].weight()
+		}
+
+		n := intn(total)
+		for i := range r.Answers {
+			a := &r.Answers[i]
+			n -= a.weight()
+			if n < 0 {
+				return []net.IP{a.ip}
+			}
+		}
+	}
+
+	ips = make([]net.IP, len(r.Answers))
+	for i := range r.Answers {
+		ips[i] = r.Answers[i].ip
+	}
+
+	// Shuffle the addresses using the Fisher-Yates algorithm.
+	for i := len(ips) - 1; i > 0; i-- {
+		j := intn(i + 1)
+		ips[i], ips[j] = ips[j], ips[i]
+	}
+
+	return ips
+}
+
+// parseRRValue parses the value of the record of type rrType the same way the
+// values of the $dnsrewrite rules are parsed.
+func parseRRValue(rrType uint16, val string) (v rules.RRValue, err error) {
+	typ := dns.TypeToString[rrType]
+	escaped := strings.NewReplacer("$", `\$`, ",", `\,`).Replace(val)
+	ruleText := fmt.Sprintf("||example.org^$dnsrewrite=NOERROR;%s;%s", typ, escaped)
+
+	rule, err := rules.NewNetworkRule(ruleText, 0)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s record value %q: %w", typ, val, err)
+	}
+
+	dnsr := rule.DNSRewrite
+	if dnsr == nil || dnsr.Value == nil {
+		return nil, unsupportedRRTypeError(typ)
+	}
+
+	return dnsr.Value, nil
+}
+
+// prepareInferred prepares the entry with the record type inferred from the
+// answer.
+func (r *RewriteEntry) prepareInferred() {
 	if r.Answer == "AAAA" {
 		r.IP = nil
 		r.Type = dns.TypeAAAA
@@ -81,6 +513,7 @@ func (r *RewriteEntry) prepare() {
 
 	ip := net.ParseIP(r.Answer)
 	if ip == nil {
+		r.Answer = aghnet.CanonicalDomain(r.Answer)
 		r.Type = dns.TypeCNAME
 		return
 	}
@@ -97,15 +530,74 @@ func (r *RewriteEntry) prepare() {
 
 func (d *DNSFilter) prepareRewrites() {
 	for i := range d.Rewrites {
-		d.Rewrites[i].prepare()
+		r := &d.Rewrites[i]
+		err := r.prepare()
+		if err != nil {
+			// Keep the entry so that it isn't removed from the
+			// configuration file, but never match it.
+			log.Error("rewrite: %s: %s", r.Domain, err)
+			r.Type = dns.TypeNone
+		}
+	}
+}
+
+// validRewritePrecedence returns an error if p isn't a valid rewrite
+// precedence.  An empty p is valid and means RewritePrecedenceBlock.
+func validRewritePrecedence(p RewritePrecedence) (err error) {
+	switch p {
+	case "", RewritePrecedenceBlock, RewritePrecedenceRewrite:
+		return nil
+	default:
+		return fmt.Errorf("invalid rewrite precedence %q", p)
+	}
+}
+
+// checkRewriteConflict checks host, which has been rewritten with rwRes,
+// against the filtering rules.  If a blocking rule matches host as well, the
+// result is chosen according to the rewrite precedence.  The allowlist rules
+// don't conflict with the rewrites.  The matches of all kinds of rewrite
+// entries, exact, wildcard, and CNAME, are handled the same way, and a CNAME
+// rewrite is checked by the original host.
+func (d *DNSFilter) checkRewriteConflict(
+	host string,
+	qtype uint16,
+	setts *FilteringSettings,
+	rwRes Result,
+) (res Result, err error) {
+	blockRes, err := d.matchHost(host, qtype, setts)
+	if err != nil {
+		return Result{}, fmt.Errorf("filtering: %w", err)
+	}
+
+	if !blockRes.IsFiltered {
+		return rwRes, nil
 	}
+
+	d.confLock.RLock()
+	prec := d.RewritePrecedence
+	d.confLock.RUnlock()
+
+	if prec == RewritePrecedenceRewrite {
+		log.Debug("rewrite: %s is blocked as well, rewriting", host)
+		rwRes.RewriteConflict = RewriteConflictRewriteWon
+
+		return rwRes, nil
+	}
+
+	log.Debug("rewrite: %s is blocked as well, blocking", host)
+	blockRes.RewriteConflict = RewriteConflictBlockWon
+	blockRes.Stages = []StageResult{{Stage: StageFiltering, Status: StageMatched}}
+
+	return blockRes, nil
 }
 
 // Get the list of matched rewrite entries.
 // Priority: CNAME, A/AAAA;  exact, wildcard.
 // If matched exactly, don't return wildcard entries.
 // If matched by several wildcards, select the more specific one
-func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
+// Only the entries the scope of which matches the client described by setts
+// are considered, and only the ones with the most specific scope are returned.
+func findRewrites(a []RewriteEntry, host string, setts *FilteringSettings) []RewriteEntry {
 	rr := rewritesArray{}
 	for _, r := range a {
 		if r.Domain != host {
@@ -113,6 +605,11 @@ func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 				continue
 			}
 		}
+
+		if !r.scopeMatches(setts) {
+			continue
+		}
+
 		rr = append(rr, r)
 	}
 
@@ -120,7 +617,7 @@ func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 		return nil
 	}
 
-	sort.Sort(rr)
+	sort.Stable(rr)
 
 	for i, r := range rr {
 		if isWildcard(r.Domain) {
@@ -132,7 +629,31 @@ func findRewrites(a []RewriteEntry, host string) []RewriteEntry {
 		}
 	}
 
-	return rr
+	return mostSpecificScope(rr)
+}
+
+// mostSpecificScope returns the entries from rr with the most specific scope.
+// rr is modified.
+func mostSpecificScope(rr []RewriteEntry) (filtered []RewriteEntry) {
+	best := 0
+	for i := range rr {
+		if n := rr[i].scopeSpecificity(); n > best {
+			best = n
+		}
+	}
+
+	if best == 0 {
+		return rr
+	}
+
+	filtered = rr[:0]
+	for _, r := range rr {
+		if r.scopeSpecificity() == best {
+			filtered = append(filtered, r)
+		}
+	}
+
+	return filtered
 }
 
 func max(a, b int) int {
@@ -149,23 +670,110 @@ func rewriteArrayDup(a []RewriteEntry) []RewriteEntry {
 	return a2
 }
 
-type rewriteEntryJSON struct {
-	Domain string `json:"domain"`
+// rewriteAnswerJSON is the JSON form of RewriteAnswer.
+type rewriteAnswerJSON struct {
 	Answer string `json:"answer"`
+	Weight uint   `json:"weight,omitempty"`
 }
 
-func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
-	arr := []*rewriteEntryJSON{}
+type rewriteEntryJSON struct {
+	Domain    string              `json:"domain"`
+	Answer    string              `json:"answer"`
+	Type      string              `json:"type,omitempty"`
+	Scope     string              `json:"scope,omitempty"`
+	Selection RewriteSelection    `json:"selection,omitempty"`
+	Answers   []rewriteAnswerJSON `json:"answers,omitempty"`
+	TTL       uint32              `json:"ttl,omitempty"`
+}
 
-	d.confLock.Lock()
-	for _, ent := range d.Config.Rewrites {
-		jsent := rewriteEntryJSON{
-			Domain: ent.Domain,
-			Answer: ent.Answer,
+// newRewriteEntryJSON returns the JSON form of ent.
+func newRewriteEntryJSON(ent *RewriteEntry) (jsent *rewriteEntryJSON) {
+	jsent = &rewriteEntryJSON{
+		Domain:    ent.Domain,
+		Answer:    ent.Answer,
+		Type:      ent.RecordType,
+		Scope:     ent.Scope,
+		Selection: ent.Selection,
+		TTL:       ent.TTL,
+	}
+
+	for _, a := range ent.Answers {
+		jsent.Answers = append(jsent.Answers, rewriteAnswerJSON{
+			Answer: a.Answer,
+			Weight: a.Weight,
+		})
+	}
+
+	return jsent
+}
+
+// toEntry returns the entry described by jsent.  The entry isn't prepared.
+func (jsent *rewriteEntryJSON) toEntry() (ent RewriteEntry) {
+	ent = RewriteEntry{
+		Domain:     jsent.Domain,
+		Answer:     jsent.Answer,
+		RecordType: jsent.Type,
+		TTL:        jsent.TTL,
+		Scope:      jsent.Scope,
+		Selection:  jsent.Selection,
+	}
+
+	for _, a := range jsent.Answers {
+		ent.Answers = append(ent.Answers, RewriteAnswer{
+			Answer: a.Answer,
+			Weight: a.Weight,
+		})
+	}
+
+	return ent
+}
+
+// key returns a string identifying the entry described by jsent.
+func (jsent *rewriteEntryJSON) key() (k string) {
+	// Marshaling a struct of strings and numbers never fails.
+	b, _ := json.Marshal(jsent)
+
+	return string(b)
+}
+
+// validateRewrite prepares ent and returns an error if it's invalid or if it's
+// ambiguous with any of others.
+func validateRewrite(ent *RewriteEntry, others []RewriteEntry) (err error) {
+	err = ent.prepare()
+	if err != nil {
+		return err
+	}
+
+	for i := range others {
+		other := &others[i]
+		if ent.ambiguousWith(other) {
+			return fmt.Errorf(
+				"rewrite for %s with scope %q is ambiguous with the one with scope %q",
+				ent.Domain,
+				ent.Scope,
+				other.Scope,
+			)
 		}
-		arr = append(arr, &jsent)
 	}
-	d.confLock.Unlock()
+
+	return nil
+}
+
+// rewritesJSON returns the JSON forms of the configured rewrites.
+func (d *DNSFilter) rewritesJSON() (arr []*rewriteEntryJSON) {
+	d.confLock.Lock()
+	defer d.confLock.Unlock()
+
+	arr = make([]*rewriteEntryJSON, 0, len(d.Config.Rewrites))
+	for i := range d.Config.Rewrites {
+		arr = append(arr, newRewriteEntryJSON(&d.Config.Rewrites[i]))
+	}
+
+	return arr
+}
+
+func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
+	arr := d.rewritesJSON()
 
 	w.Header().Set("Content-Type", "application/json")
 	err := json.NewEncoder(w).Encode(arr)
@@ -175,57 +783,42 @@ func (d *DNSFilter) handleRewriteList(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// handleRewriteAdd is the handler for the POST /control/rewrite/add HTTP API.
+// It's a batch of a single addition, see handleRewriteBatch.
 func (d *DNSFilter) handleRewriteAdd(w http.ResponseWriter, r *http.Request) {
-	jsent := rewriteEntryJSON{}
-	err := json.NewDecoder(r.Body).Decode(&jsent)
+	jsent := &rewriteEntryJSON{}
+	err := json.NewDecoder(r.Body).Decode(jsent)
 	if err != nil {
 		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 		return
 	}
 
-	ent := RewriteEntry{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
+	resp := d.applyRewriteBatch(&rewriteBatchReq{Add: []*rewriteEntryJSON{jsent}})
+	if !resp.Applied {
+		httpError(r, w, http.StatusBadRequest, "%s", resp.firstErr())
+
+		return
 	}
-	ent.prepare()
-	d.confLock.Lock()
-	d.Config.Rewrites = append(d.Config.Rewrites, ent)
-	d.confLock.Unlock()
-	log.Debug("Rewrites: added element: %s -> %s [%d]",
-		ent.Domain, ent.Answer, len(d.Config.Rewrites))
 
-	d.Config.ConfigModified()
+	log.Debug("Rewrites: added element: %s -> %s", jsent.Domain, jsent.Answer)
 }
 
+// handleRewriteDelete is the handler for the POST /control/rewrite/delete HTTP
+// API.  It's a batch of a single deletion, see handleRewriteBatch.
 func (d *DNSFilter) handleRewriteDelete(w http.ResponseWriter, r *http.Request) {
-	jsent := rewriteEntryJSON{}
-	err := json.NewDecoder(r.Body).Decode(&jsent)
+	jsent := &rewriteEntryJSON{}
+	err := json.NewDecoder(r.Body).Decode(jsent)
 	if err != nil {
 		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
 		return
 	}
 
-	entDel := RewriteEntry{
-		Domain: jsent.Domain,
-		Answer: jsent.Answer,
-	}
-	arr := []RewriteEntry{}
-	d.confLock.Lock()
-	for _, ent := range d.Config.Rewrites {
-		if ent.equals(entDel) {
-			log.Debug("Rewrites: removed element: %s -> %s", ent.Domain, ent.Answer)
-			continue
-		}
-		arr = append(arr, ent)
-	}
-	d.Config.Rewrites = arr
-	d.confLock.Unlock()
-
-	d.Config.ConfigModified()
+	d.applyRewriteBatch(&rewriteBatchReq{Delete: []*rewriteEntryJSON{jsent}})
 }
 
 func (d *DNSFilter) registerRewritesHandlers() {
 	d.Config.HTTPRegister(http.MethodGet, "/control/rewrite/list", d.handleRewriteList)
 	d.Config.HTTPRegister(http.MethodPost, "/control/rewrite/add", d.handleRewriteAdd)
 	d.Config.HTTPRegister(http.MethodPost, "/control/rewrite/delete", d.handleRewriteDelete)
+	d.Config.HTTPRegister(http.MethodPost, "/control/rewrite/batch", d.handleRewriteBatch)
 }
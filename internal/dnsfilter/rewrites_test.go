@@ -4,6 +4,7 @@ import (
 	"net"
 	"testing"
 
+	"github.com/AdguardTeam/urlfilter/rules"
 	"github.com/miekg/dns"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -116,7 +117,7 @@ func TestRewrites(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			valsNum := len(tc.wantVals)
 
-			r := d.processRewrites(tc.host, tc.dtyp)
+			r := d.processRewrites(tc.host, tc.dtyp, nil)
 			if valsNum == 0 {
 				assert.Equal(t, NotFilteredNotFound, r.Reason)
 
@@ -172,7 +173,7 @@ func TestRewritesLevels(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			r := d.processRewrites(tc.host, dns.TypeA)
+			r := d.processRewrites(tc.host, dns.TypeA, nil)
 			assert.Equal(t, Rewritten, r.Reason)
 			require.Len(t, r.IPList, 1)
 		})
@@ -213,7 +214,7 @@ func TestRewritesExceptionCNAME(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
-			r := d.processRewrites(tc.host, dns.TypeA)
+			r := d.processRewrites(tc.host, dns.TypeA, nil)
 			if tc.want == nil {
 				assert.Equal(t, NotFilteredNotFound, r.Reason)
 
@@ -285,7 +286,7 @@ func TestRewritesExceptionIP(t *testing.T) {
 
 	for _, tc := range testCases {
 		t.Run(tc.name+"_"+tc.host, func(t *testing.T) {
-			r := d.processRewrites(tc.host, tc.dtyp)
+			r := d.processRewrites(tc.host, tc.dtyp, nil)
 			if tc.want == nil {
 				assert.Equal(t, NotFilteredNotFound, r.Reason)
 
@@ -300,3 +301,578 @@ func TestRewritesExceptionIP(t *testing.T) {
 		})
 	}
 }
+
+func TestRewriteEntry_prepare(t *testing.T) {
+	testCases := []struct {
+		name     string
+		ent      RewriteEntry
+		wantType uint16
+		wantErr  string
+	}{{
+		name:     "inferred",
+		ent:      RewriteEntry{Answer: "1.2.3.4"},
+		wantType: dns.TypeA,
+		wantErr:  "",
+	}, {
+		name:     "srv",
+		ent:      RewriteEntry{Answer: "10 60 5222 xmpp.lan", RecordType: "srv"},
+		wantType: dns.TypeSRV,
+		wantErr:  "",
+	}, {
+		name:     "txt_commas",
+		ent:      RewriteEntry{Answer: "v=spf1 a, mx, -all", RecordType: "TXT"},
+		wantType: dns.TypeTXT,
+		wantErr:  "",
+	}, {
+		name:     "mx",
+		ent:      RewriteEntry{Answer: "10 mail.lan", RecordType: "MX"},
+		wantType: dns.TypeMX,
+		wantErr:  "",
+	}, {
+		name:     "aaaa",
+		ent:      RewriteEntry{Answer: "::1", RecordType: "AAAA"},
+		wantType: dns.TypeAAAA,
+		wantErr:  "",
+	}, {
+		name:     "bad_mx",
+		ent:      RewriteEntry{Answer: "mail.lan", RecordType: "MX"},
+		wantType: 0,
+		wantErr:  `invalid MX record value "mail.lan": invalid mx: "mail.lan"`,
+	}, {
+		name:     "bad_a_family",
+		ent:      RewriteEntry{Answer: "::1", RecordType: "A"},
+		wantType: 0,
+		wantErr:  `invalid A record value "::1": wrong address family`,
+	}, {
+		name:     "unsupported",
+		ent:      RewriteEntry{Answer: "whatever", RecordType: "NAPTR"},
+		wantType: 0,
+		wantErr: `unsupported record type "NAPTR", supported types are: ` +
+			`A, AAAA, CNAME, MX, PTR, TXT, SRV, HTTPS, SVCB`,
+	}, {
+		name:     "unknown",
+		ent:      RewriteEntry{Answer: "whatever", RecordType: "BAD"},
+		wantType: 0,
+		wantErr: `unsupported record type "BAD", supported types are: ` +
+			`A, AAAA, CNAME, MX, PTR, TXT, SRV, HTTPS, SVCB`,
+	}, {
+		name: "multi",
+		ent: RewriteEntry{
+			Answers:   []RewriteAnswer{{Answer: "::1"}, {Answer: "::2", Weight: 3}},
+			Selection: RewriteSelectionWeighted,
+		},
+		wantType: dns.TypeAAAA,
+		wantErr:  "",
+	}, {
+		name: "multi_mixed_family",
+		ent: RewriteEntry{
+			Answers: []RewriteAnswer{{Answer: "1.2.3.4"}, {Answer: "::1"}},
+		},
+		wantType: 0,
+		wantErr:  `invalid answer at index 1 "::1": wrong address family`,
+	}, {
+		name: "multi_with_answer",
+		ent: RewriteEntry{
+			Answer:  "1.2.3.4",
+			Answers: []RewriteAnswer{{Answer: "1.2.3.5"}},
+		},
+		wantType: 0,
+		wantErr:  `answer "1.2.3.4" and answers are mutually exclusive`,
+	}, {
+		name: "multi_bad_type",
+		ent: RewriteEntry{
+			Answers:    []RewriteAnswer{{Answer: "1.2.3.4"}},
+			RecordType: "TXT",
+		},
+		wantType: 0,
+		wantErr:  `record type "TXT" doesn't support multiple answers`,
+	}, {
+		name:     "multi_no_answers",
+		ent:      RewriteEntry{Answer: "1.2.3.4", Selection: RewriteSelectionAll},
+		wantType: 0,
+		wantErr:  `selection "all" requires answers`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.ent.prepare()
+			if tc.wantErr != "" {
+				require.NotNil(t, err)
+				assert.Equal(t, tc.wantErr, err.Error())
+
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, tc.wantType, tc.ent.Type)
+		})
+	}
+}
+
+func TestRewritesLocalZone(t *testing.T) {
+	d := newForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain:     "_xmpp._tcp.lan",
+		Answer:     "10 60 5222 xmpp.lan",
+		RecordType: "SRV",
+		TTL:        300,
+	}, {
+		Domain:     "_xmpp._tcp.lan",
+		Answer:     "20 60 5222 xmpp2.lan",
+		RecordType: "SRV",
+		TTL:        600,
+	}, {
+		Domain:     "lan",
+		Answer:     "hello, world",
+		RecordType: "TXT",
+	}, {
+		Domain:     "broken.lan",
+		Answer:     "not a number",
+		RecordType: "MX",
+	}}
+	d.prepareRewrites()
+
+	t.Run("srv", func(t *testing.T) {
+		r := d.processRewrites("_xmpp._tcp.lan", dns.TypeSRV, nil)
+		require.Equal(t, Rewritten, r.Reason)
+		require.NotNil(t, r.DNSRewriteResult)
+
+		vals := r.DNSRewriteResult.Response[dns.TypeSRV]
+		require.Len(t, vals, 2)
+		assert.Equal(t, &rules.DNSSRV{
+			Target:   "xmpp.lan",
+			Priority: 10,
+			Weight:   60,
+			Port:     5222,
+		}, vals[0])
+		assert.Equal(t, uint32(300), r.TTL)
+	})
+
+	t.Run("txt", func(t *testing.T) {
+		r := d.processRewrites("lan", dns.TypeTXT, nil)
+		require.Equal(t, Rewritten, r.Reason)
+		require.NotNil(t, r.DNSRewriteResult)
+
+		assert.Equal(t, []rules.RRValue{"hello, world"}, r.DNSRewriteResult.Response[dns.TypeTXT])
+		assert.Zero(t, r.TTL)
+	})
+
+	t.Run("other_type", func(t *testing.T) {
+		r := d.processRewrites("lan", dns.TypeA, nil)
+		assert.Equal(t, Rewritten, r.Reason)
+		assert.Nil(t, r.DNSRewriteResult)
+		assert.Empty(t, r.IPList)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		r := d.processRewrites("broken.lan", dns.TypeMX, nil)
+		assert.Nil(t, r.DNSRewriteResult)
+	})
+}
+
+func TestRewritesScope(t *testing.T) {
+	d := newForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain: "nas.example.com",
+		Answer: "203.0.113.50",
+	}, {
+		Domain: "nas.example.com",
+		Answer: "192.168.1.50",
+		Scope:  "192.168.0.0/16",
+	}, {
+		Domain: "nas.example.com",
+		Answer: "192.168.1.51",
+		Scope:  "192.168.1.0/24",
+	}, {
+		Domain: "nas.example.com",
+		Answer: "10.0.0.50",
+		Scope:  "device_laptop",
+	}, {
+		Domain: "*.example.com",
+		Answer: "192.168.1.1",
+		Scope:  "192.168.0.0/16",
+	}}
+	d.prepareRewrites()
+
+	testCases := []struct {
+		name      string
+		host      string
+		wantScope string
+		setts     *FilteringSettings
+		want      []net.IP
+	}{{
+		name:      "unscoped",
+		host:      "nas.example.com",
+		wantScope: "",
+		setts:     &FilteringSettings{ClientIP: net.IP{203, 0, 113, 1}},
+		want:      []net.IP{{203, 0, 113, 50}},
+	}, {
+		name:      "no_client",
+		host:      "nas.example.com",
+		wantScope: "",
+		setts:     nil,
+		want:      []net.IP{{203, 0, 113, 50}},
+	}, {
+		name:      "network",
+		host:      "nas.example.com",
+		wantScope: "192.168.0.0/16",
+		setts:     &FilteringSettings{ClientIP: net.IP{192, 168, 2, 1}},
+		want:      []net.IP{{192, 168, 1, 50}},
+	}, {
+		name:      "narrower_network",
+		host:      "nas.example.com",
+		wantScope: "192.168.1.0/24",
+		setts:     &FilteringSettings{ClientIP: net.IP{192, 168, 1, 2}},
+		want:      []net.IP{{192, 168, 1, 51}},
+	}, {
+		name:      "tag",
+		host:      "nas.example.com",
+		wantScope: "device_laptop",
+		setts: &FilteringSettings{
+			ClientIP:   net.IP{192, 168, 1, 2},
+			ClientTags: []string{"device_laptop"},
+		},
+		want: []net.IP{{10, 0, 0, 50}},
+	}, {
+		name:      "wildcard_scoped",
+		host:      "other.example.com",
+		wantScope: "192.168.0.0/16",
+		setts:     &FilteringSettings{ClientIP: net.IP{192, 168, 1, 2}},
+		want:      []net.IP{{192, 168, 1, 1}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := d.processRewrites(tc.host, dns.TypeA, tc.setts)
+			require.Equal(t, Rewritten, r.Reason)
+
+			assert.Equal(t, tc.want, r.IPList)
+			assert.Equal(t, tc.wantScope, r.RewriteScope)
+		})
+	}
+
+	t.Run("wildcard_unscoped_client", func(t *testing.T) {
+		r := d.processRewrites("other.example.com", dns.TypeA, &FilteringSettings{
+			ClientIP: net.IP{203, 0, 113, 1},
+		})
+		assert.Equal(t, NotFilteredNotFound, r.Reason)
+	})
+}
+
+// seqIntn returns an intn function of pickAnswers returning the values from
+// vals in turn modulo n.
+func seqIntn(vals ...int) (intn func(n int) (i int)) {
+	return func(n int) (i int) {
+		i, vals = vals[0]%n, vals[1:]
+
+		return i
+	}
+}
+
+func TestRewritesMulti(t *testing.T) {
+	d := newForTest(nil, nil)
+	t.Cleanup(d.Close)
+
+	d.Rewrites = []RewriteEntry{{
+		Domain: "nas.lan",
+		Answers: []RewriteAnswer{
+			{Answer: "192.168.1.10", Weight: 70},
+			{Answer: "192.168.1.11", Weight: 30},
+		},
+		Selection: RewriteSelectionWeighted,
+	}, {
+		Domain: "proxy.lan",
+		Answers: []RewriteAnswer{
+			{Answer: "192.168.1.10"},
+			{Answer: "192.168.1.11"},
+			{Answer: "192.168.1.12"},
+		},
+	}}
+	d.prepareRewrites()
+
+	t.Run("weighted", func(t *testing.T) {
+		testCases := []struct {
+			want net.IP
+			n    int
+		}{{
+			want: net.IP{192, 168, 1, 10},
+			n:    0,
+		}, {
+			want: net.IP{192, 168, 1, 10},
+			n:    69,
+		}, {
+			want: net.IP{192, 168, 1, 11},
+			n:    70,
+		}, {
+			want: net.IP{192, 168, 1, 11},
+			n:    99,
+		}}
+
+		for _, tc := range testCases {
+			d.randIntn = seqIntn(tc.n)
+
+			r := d.processRewrites("nas.lan", dns.TypeA, nil)
+			require.Equal(t, Rewritten, r.Reason)
+
+			assert.Equal(t, []net.IP{tc.want}, r.IPList)
+			assert.Equal(t, tc.want, r.RewritePicked)
+		}
+	})
+
+	t.Run("all", func(t *testing.T) {
+		// Swap the last address with the first one and leave the rest.
+		d.randIntn = seqIntn(0, 1)
+
+		r := d.processRewrites("proxy.lan", dns.TypeA, nil)
+		require.Equal(t, Rewritten, r.Reason)
+
+		assert.Equal(t, []net.IP{
+			{192, 168, 1, 12},
+			{192, 168, 1, 11},
+			{192, 168, 1, 10},
+		}, r.IPList)
+		assert.Nil(t, r.RewritePicked)
+	})
+
+	t.Run("other_type", func(t *testing.T) {
+		r := d.processRewrites("proxy.lan", dns.TypeAAAA, nil)
+		require.Equal(t, Rewritten, r.Reason)
+
+		assert.Empty(t, r.IPList)
+	})
+}
+
+func TestRewriteEntry_prepareScope(t *testing.T) {
+	testCases := []struct {
+		name    string
+		scope   string
+		wantErr bool
+		wantN   int
+	}{{
+		name:    "empty",
+		scope:   "",
+		wantErr: false,
+		wantN:   0,
+	}, {
+		name:    "ipv4",
+		scope:   "192.168.1.2",
+		wantErr: false,
+		wantN:   33,
+	}, {
+		name:    "ipv6_cidr",
+		scope:   "2001:db8::/32",
+		wantErr: false,
+		wantN:   33,
+	}, {
+		name:    "tag",
+		scope:   "device_pc",
+		wantErr: false,
+		wantN:   tagScopeSpecificity,
+	}, {
+		name:    "bad_cidr",
+		scope:   "192.168.1.0/33",
+		wantErr: true,
+	}, {
+		name:    "bad_tag",
+		scope:   "Device PC",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := &RewriteEntry{
+				Domain: "example.org",
+				Answer: "1.2.3.4",
+				Scope:  tc.scope,
+			}
+
+			err := r.prepare()
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantN, r.scopeSpecificity())
+		})
+	}
+}
+
+func TestRewriteEntry_ambiguousWith(t *testing.T) {
+	entries := []*RewriteEntry{{
+		Domain: "nas.example.com",
+		Answer: "1.2.3.4",
+		Scope:  "device_pc",
+	}, {
+		Domain: "NAS.example.com",
+		Answer: "1.2.3.5",
+		Scope:  "user_admin",
+	}, {
+		Domain: "nas.example.com",
+		Answer: "1.2.3.6",
+		Scope:  "192.168.0.0/16",
+	}, {
+		Domain: "nas.example.com",
+		Answer: "::1",
+		Scope:  "user_child",
+	}}
+	for _, r := range entries {
+		require.NoError(t, r.prepare())
+	}
+
+	assert.True(t, entries[0].ambiguousWith(entries[1]))
+	assert.False(t, entries[0].ambiguousWith(entries[0]))
+	assert.False(t, entries[0].ambiguousWith(entries[2]))
+	assert.False(t, entries[1].ambiguousWith(entries[3]))
+}
+
+func TestDNSFilter_CheckHost_rewriteConflict(t *testing.T) {
+	const rules = `||exact.example^
+||sub.wild.example^
+||cname.example^
+||allowed.example^
+@@||allowed.example^
+||important.example^$important
+@@||important.example^
+`
+
+	rewrites := []RewriteEntry{{
+		Domain: "exact.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "*.wild.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "cname.example",
+		Answer: "target.example",
+	}, {
+		Domain: "target.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "allowed.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "important.example",
+		Answer: "1.2.3.4",
+	}, {
+		Domain: "notblocked.example",
+		Answer: "1.2.3.4",
+	}}
+
+	testCases := []struct {
+		name         string
+		host         string
+		wantReason   Reason
+		wantConflict RewriteConflict
+		prec         RewritePrecedence
+	}{{
+		name:         "exact_block_wins",
+		host:         "exact.example",
+		wantReason:   FilteredBlockList,
+		wantConflict: RewriteConflictBlockWon,
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "exact_rewrite_wins",
+		host:         "exact.example",
+		wantReason:   Rewritten,
+		wantConflict: RewriteConflictRewriteWon,
+		prec:         RewritePrecedenceRewrite,
+	}, {
+		name:         "wildcard_block_wins",
+		host:         "sub.wild.example",
+		wantReason:   FilteredBlockList,
+		wantConflict: RewriteConflictBlockWon,
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "wildcard_rewrite_wins",
+		host:         "sub.wild.example",
+		wantReason:   Rewritten,
+		wantConflict: RewriteConflictRewriteWon,
+		prec:         RewritePrecedenceRewrite,
+	}, {
+		name:         "wildcard_not_blocked",
+		host:         "other.wild.example",
+		wantReason:   Rewritten,
+		wantConflict: "",
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "cname_block_wins",
+		host:         "cname.example",
+		wantReason:   FilteredBlockList,
+		wantConflict: RewriteConflictBlockWon,
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "cname_rewrite_wins",
+		host:         "cname.example",
+		wantReason:   Rewritten,
+		wantConflict: RewriteConflictRewriteWon,
+		prec:         RewritePrecedenceRewrite,
+	}, {
+		name:         "allow_block_wins",
+		host:         "allowed.example",
+		wantReason:   Rewritten,
+		wantConflict: "",
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "allow_rewrite_wins",
+		host:         "allowed.example",
+		wantReason:   Rewritten,
+		wantConflict: "",
+		prec:         RewritePrecedenceRewrite,
+	}, {
+		name:         "important_block_wins",
+		host:         "important.example",
+		wantReason:   FilteredBlockList,
+		wantConflict: RewriteConflictBlockWon,
+		prec:         RewritePrecedenceBlock,
+	}, {
+		name:         "important_rewrite_wins",
+		host:         "important.example",
+		wantReason:   Rewritten,
+		wantConflict: RewriteConflictRewriteWon,
+		prec:         RewritePrecedenceRewrite,
+	}, {
+		name:         "not_blocked",
+		host:         "notblocked.example",
+		wantReason:   Rewritten,
+		wantConflict: "",
+		prec:         RewritePrecedenceBlock,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			d := newForTest(&Config{
+				Rewrites:          rewrites,
+				RewritePrecedence: tc.prec,
+			}, []Filter{{ID: 0, Data: []byte(rules)}})
+			t.Cleanup(d.Close)
+
+			res, err := d.CheckHost(tc.host, dns.TypeA, &FilteringSettings{
+				FilteringEnabled: true,
+			})
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.wantReason, res.Reason)
+			assert.Equal(t, tc.wantConflict, res.RewriteConflict)
+			assert.Equal(t, tc.wantReason == FilteredBlockList, res.IsFiltered)
+		})
+	}
+
+	t.Run("filtering_disabled", func(t *testing.T) {
+		d := newForTest(&Config{
+			Rewrites: rewrites,
+		}, []Filter{{ID: 0, Data: []byte(rules)}})
+		t.Cleanup(d.Close)
+
+		res, err := d.CheckHost("exact.example", dns.TypeA, &FilteringSettings{})
+		require.NoError(t, err)
+
+		assert.Equal(t, Rewritten, res.Reason)
+		assert.Empty(t, res.RewriteConflict)
+	})
+}
@@ -13,6 +13,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
 	"github.com/AdguardTeam/dnsproxy/upstream"
 	"github.com/AdguardTeam/golibs/cache"
@@ -71,6 +72,9 @@ func (d *DNSFilter) initSecurityServices() error {
 	}
 	d.SetSafeBrowsingUpstream(sbUps)
 
+	d.Config.Outbound.Expect(aghnet.OutboundSafeBrowsing, sbUps.Address())
+	d.Config.Outbound.Expect(aghnet.OutboundParental, parUps.Address())
+
 	return nil
 }
 
@@ -135,6 +139,10 @@ type sbCtx struct {
 	hashToHost map[[32]byte]string
 	cache      cache.Cache
 	cacheTime  uint
+
+	// outbound checks the requests to the service for purpose.
+	outbound *aghnet.Outbound
+	purpose  aghnet.OutboundPurpose
 }
 
 func hostnameToHashes(host string) map[[32]byte]string {
@@ -280,6 +288,13 @@ func check(c *sbCtx, r Result, u upstream.Upstream) (Result, error) {
 		return r, nil
 	}
 
+	err := c.outbound.Check(c.purpose, u.Address())
+	if err != nil {
+		log.Debug("%s: not checking %s: %s", c.svc, c.host, err)
+
+		return Result{}, nil
+	}
+
 	question := c.getQuestion()
 
 	log.Tracef("%s: checking %s: %s", c.svc, c.host, question)
@@ -320,6 +335,8 @@ func (d *DNSFilter) checkSafeBrowsing(
 		svc:       "SafeBrowsing",
 		cache:     gctx.safebrowsingCache,
 		cacheTime: d.Config.CacheTime,
+		outbound:  d.Config.Outbound,
+		purpose:   aghnet.OutboundSafeBrowsing,
 	}
 
 	res = Result{
@@ -353,6 +370,8 @@ func (d *DNSFilter) checkParental(
 		svc:       "Parental",
 		cache:     gctx.parentalCache,
 		cacheTime: d.Config.CacheTime,
+		outbound:  d.Config.Outbound,
+		purpose:   aghnet.OutboundParental,
 	}
 
 	res = Result{
@@ -5,6 +5,7 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
 	"github.com/AdguardTeam/golibs/cache"
 	"github.com/miekg/dns"
@@ -128,6 +129,32 @@ func TestSBPC_checkErrorUpstream(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestSBPC_outboundDisabled(t *testing.T) {
+	o := aghnet.NewOutbound()
+	o.SetConfig(true, nil, nil)
+
+	d := newForTest(&Config{SafeBrowsingEnabled: true, Outbound: o}, nil)
+	t.Cleanup(d.Close)
+
+	ups := &aghtest.TestErrUpstream{}
+
+	d.SetSafeBrowsingUpstream(ups)
+	d.SetParentalUpstream(ups)
+
+	setts := &FilteringSettings{
+		SafeBrowsingEnabled: true,
+		ParentalEnabled:     true,
+	}
+
+	res, err := d.checkSafeBrowsing("smthng.com", dns.TypeA, setts)
+	require.NoError(t, err)
+	assert.False(t, res.IsFiltered)
+
+	res, err = d.checkParental("smthng.com", dns.TypeA, setts)
+	require.NoError(t, err)
+	assert.False(t, res.IsFiltered)
+}
+
 func TestSBPC(t *testing.T) {
 	d := newForTest(&Config{SafeBrowsingEnabled: true}, nil)
 	t.Cleanup(d.Close)
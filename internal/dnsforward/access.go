@@ -8,7 +8,9 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/AdguardTeam/urlfilter"
 	"github.com/AdguardTeam/urlfilter/filterlist"
@@ -47,7 +49,7 @@ func newAccessCtx(allowedClients, disallowedClients, blockedHosts []string) (a *
 
 	b := &strings.Builder{}
 	for _, s := range blockedHosts {
-		aghstrings.WriteToBuilder(b, s, "\n")
+		aghstrings.WriteToBuilder(b, dnsfilter.CanonicalRule(s), "\n")
 	}
 
 	listArray := []filterlist.RuleList{}
@@ -130,6 +132,8 @@ func (a *accessCtx) IsBlockedIP(ip net.IP) (bool, string) {
 
 // IsBlockedDomain - return TRUE if this domain should be blocked
 func (a *accessCtx) IsBlockedDomain(host string) bool {
+	host = aghnet.CanonicalDomain(host)
+
 	a.lock.Lock()
 	_, ok := a.blockedHostsEngine.Match(host)
 	a.lock.Unlock()
@@ -192,6 +196,10 @@ func (s *Server) handleAccessSet(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	for i, h := range j.BlockedHosts {
+		j.BlockedHosts[i] = dnsfilter.CanonicalRule(h)
+	}
+
 	var a *accessCtx
 	a, err = newAccessCtx(j.AllowedClients, j.DisallowedClients, j.BlockedHosts)
 	if err != nil {
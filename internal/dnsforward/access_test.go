@@ -104,6 +104,9 @@ func TestIsBlockedDomain(t *testing.T) {
 		"host1",
 		"*.host.com",
 		"||host3.com^",
+		"Host4.LAN.",
+		"*.host5.lan.",
+		"||host6.lan.^",
 	})
 	require.NoError(t, err)
 
@@ -147,6 +150,26 @@ func TestIsBlockedDomain(t *testing.T) {
 		name:   "wildcard_type-2_mismatch",
 		domain: ".host3.com",
 		want:   false,
+	}, {
+		name:   "fqdn_rule_plain",
+		domain: "host4.lan",
+		want:   true,
+	}, {
+		name:   "fqdn_rule_fqdn",
+		domain: "HOST4.lan.",
+		want:   true,
+	}, {
+		name:   "fqdn_wildcard_type-1",
+		domain: "a.host5.lan.",
+		want:   true,
+	}, {
+		name:   "fqdn_wildcard_type-2",
+		domain: "a.host6.lan",
+		want:   true,
+	}, {
+		name:   "fqdn_wildcard_type-2_fqdn",
+		domain: "host6.lan.",
+		want:   true,
 	}}
 
 	for _, tc := range testCases {
@@ -0,0 +1,381 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Upstream benchmark limits.
+const (
+	// maxBenchmarkUpstreams is the maximum number of the upstreams in a
+	// single benchmark.
+	maxBenchmarkUpstreams = 10
+
+	// benchmarkWorkers is the number of the upstreams benchmarked
+	// simultaneously.
+	benchmarkWorkers = 4
+
+	// benchmarkTimeout is the time after which no new queries are made.
+	// The benchmark may take up to benchmarkQueryTimeout longer than that.
+	benchmarkTimeout = 30 * time.Second
+
+	// benchmarkQueryTimeout is the timeout of a single query.
+	benchmarkQueryTimeout = 5 * time.Second
+)
+
+// benchmarkDomains are the popular domain names resolved by the benchmark.
+var benchmarkDomains = []string{
+	"amazon.com",
+	"apple.com",
+	"cloudflare.com",
+	"facebook.com",
+	"github.com",
+	"google.com",
+	"microsoft.com",
+	"netflix.com",
+	"wikipedia.org",
+	"youtube.com",
+}
+
+// upstreamBenchmarkJSON is the result of the benchmark of a single upstream.
+type upstreamBenchmarkJSON struct {
+	Upstream string `json:"upstream"`
+
+	// Error is the reason the upstream couldn't be benchmarked, if any.
+	Error string `json:"error,omitempty"`
+
+	// FilteredDomains are the domain names, which the reference upstream
+	// resolves to public addresses and this upstream doesn't, for example
+	// because it blocks or redirects them.
+	FilteredDomains []string `json:"filtered_domains"`
+
+	// MedianMs and P95Ms are the median and the 95th percentile of the
+	// latencies of the successful queries in milliseconds.
+	MedianMs float64 `json:"median_ms"`
+	P95Ms    float64 `json:"p95_ms"`
+
+	// FailureRate is the share of the failed queries of all the queries
+	// made.
+	FailureRate float64 `json:"failure_rate"`
+
+	Queries  int `json:"queries"`
+	Failures int `json:"failures"`
+}
+
+// upstreamBenchmark measures the latencies and the failures of the
+// upstreams, and compares their answers with the ones of the reference
+// upstream.  The upstreams are created for the benchmark only, so the
+// queries aren't cached.
+type upstreamBenchmark struct {
+	reference upstream.Upstream
+
+	// isSpecial returns true if ip is a special-purpose address, such as
+	// the ones returned for the blocked domains.
+	isSpecial func(ip net.IP) (ok bool)
+
+	// deadline is the time after which no new queries are made.
+	deadline time.Time
+
+	// refPublic are the domains, which the reference upstream resolves to
+	// public addresses.  It's only written before the upstreams are
+	// benchmarked.
+	refPublic map[string]bool
+
+	domains []string
+
+	// done is the number of the benchmarked upstreams.
+	done int32
+}
+
+// newBenchmarkQuery returns a new A query for domain.
+func newBenchmarkQuery(domain string) (req *dns.Msg) {
+	return &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   dns.Fqdn(domain),
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+}
+
+// publicAddrs returns true if resp has the answer with at least one address
+// that isn't special-purpose.
+func (b *upstreamBenchmark) publicAddrs(resp *dns.Msg) (ok bool) {
+	if resp == nil || resp.Rcode != dns.RcodeSuccess {
+		return false
+	}
+
+	for _, rr := range resp.Answer {
+		if a, isA := rr.(*dns.A); isA && !b.isSpecial(a.A) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// expired returns true if no new queries should be made.
+func (b *upstreamBenchmark) expired() (ok bool) {
+	return time.Now().After(b.deadline)
+}
+
+// resolveReference resolves the domains using the reference upstream.
+func (b *upstreamBenchmark) resolveReference() {
+	b.refPublic = make(map[string]bool, len(b.domains))
+	for _, d := range b.domains {
+		if b.expired() {
+			return
+		}
+
+		resp, err := b.reference.Exchange(newBenchmarkQuery(d))
+		if err != nil {
+			log.Debug("dns: benchmark: reference %s: %s: %s", b.reference.Address(), d, err)
+
+			continue
+		}
+
+		b.refPublic[d] = b.publicAddrs(resp)
+	}
+}
+
+// measure benchmarks u.  incomplete is true if the deadline has been reached
+// before all the domains are resolved.
+func (b *upstreamBenchmark) measure(u upstream.Upstream) (res *upstreamBenchmarkJSON, incomplete bool) {
+	res = &upstreamBenchmarkJSON{
+		Upstream:        u.Address(),
+		FilteredDomains: []string{},
+	}
+
+	var latencies []time.Duration
+	for _, d := range b.domains {
+		if b.expired() {
+			incomplete = true
+
+			break
+		}
+
+		start := time.Now()
+		resp, err := u.Exchange(newBenchmarkQuery(d))
+		elapsed := time.Since(start)
+
+		res.Queries++
+		if err != nil || (resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+			res.Failures++
+
+			continue
+		}
+
+		latencies = append(latencies, elapsed)
+		if b.refPublic[d] && !b.publicAddrs(resp) {
+			res.FilteredDomains = append(res.FilteredDomains, d)
+		}
+	}
+
+	if res.Queries > 0 {
+		res.FailureRate = float64(res.Failures) / float64(res.Queries)
+	}
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	res.MedianMs = percentileMs(latencies, 0.5)
+	res.P95Ms = percentileMs(latencies, 0.95)
+
+	return res, incomplete
+}
+
+// percentileMs returns the p-th percentile of the sorted durations in
+// milliseconds using the nearest-rank method.  It returns zero if there are
+// no durations.
+func percentileMs(sorted []time.Duration, p float64) (ms float64) {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return float64(sorted[i]) / float64(time.Millisecond)
+}
+
+// run benchmarks ups with at most benchmarkWorkers of them at a time.  The
+// results are in the order of ups.  incomplete is true if the deadline has
+// been reached.
+func (b *upstreamBenchmark) run(ups []upstream.Upstream) (res []*upstreamBenchmarkJSON, incomplete bool) {
+	b.resolveReference()
+
+	res = make([]*upstreamBenchmarkJSON, len(ups))
+	sem := make(chan struct{}, benchmarkWorkers)
+	wg := &sync.WaitGroup{}
+
+	var incompleteFlag int32
+	for i, u := range ups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, u upstream.Upstream) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			var inc bool
+			res[i], inc = b.measure(u)
+			if inc {
+				atomic.StoreInt32(&incompleteFlag, 1)
+			}
+
+			done := atomic.AddInt32(&b.done, 1)
+			log.Info("dns: benchmark: %d/%d upstreams done", done, len(ups))
+		}(i, u)
+	}
+
+	wg.Wait()
+
+	return res, atomic.LoadInt32(&incompleteFlag) == 1
+}
+
+// benchmarkJSON is the request to benchmark the upstreams.
+type benchmarkJSON struct {
+	Upstreams    []string `json:"upstream_dns"`
+	BootstrapDNS []string `json:"bootstrap_dns"`
+
+	// Reference is the upstream the answers are compared with.  If empty,
+	// the default upstream is used.
+	Reference string `json:"reference"`
+}
+
+// benchmarkResultJSON is the response to the POST
+// /control/benchmark_upstreams request.
+type benchmarkResultJSON struct {
+	Reference string                   `json:"reference"`
+	Upstreams []*upstreamBenchmarkJSON `json:"upstreams"`
+
+	// Incomplete is true if the benchmark has reached its time limit
+	// before all the domains are resolved.
+	Incomplete bool `json:"incomplete"`
+}
+
+// newBenchmarkUpstream returns a new upstream for the benchmark.  addr mustn't
+// be reserved for domains.
+func newBenchmarkUpstream(addr string, bootstrap []string) (u upstream.Upstream, err error) {
+	_, useDefault, err := separateUpstream(addr)
+	if err != nil {
+		return nil, fmt.Errorf("wrong upstream format: %w", err)
+	}
+
+	if !useDefault {
+		return nil, fmt.Errorf("upstream %q is reserved for domains", addr)
+	}
+
+	if _, err = validateUpstream(addr); err != nil {
+		return nil, fmt.Errorf("wrong upstream format: %w", err)
+	}
+
+	return upstream.AddressToUpstream(addr, upstream.Options{
+		Bootstrap: bootstrap,
+		Timeout:   benchmarkQueryTimeout,
+	})
+}
+
+// handleBenchmarkUpstreams is the handler for the POST
+// /control/benchmark_upstreams HTTP API.  It doesn't change the configuration
+// of the upstreams.
+func (s *Server) handleBenchmarkUpstreams(w http.ResponseWriter, r *http.Request) {
+	req := &benchmarkJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json.Decode: %s", err)
+
+		return
+	}
+
+	addrs := aghstrings.FilterOut(req.Upstreams, aghstrings.IsCommentOrEmpty)
+	if l := len(addrs); l == 0 || l > maxBenchmarkUpstreams {
+		httpError(r, w, http.StatusBadRequest, "want from 1 to %d upstreams, got %d", maxBenchmarkUpstreams, l)
+
+		return
+	}
+
+	bootstrap := req.BootstrapDNS
+	if len(bootstrap) == 0 {
+		bootstrap = defaultBootstrap
+	}
+
+	refAddr := req.Reference
+	if refAddr == "" {
+		refAddr = defaultDNS[0]
+	}
+
+	ref, err := newBenchmarkUpstream(refAddr, bootstrap)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "reference: %s", err)
+
+		return
+	}
+
+	if !atomic.CompareAndSwapUint32(&s.benchmarking, 0, 1) {
+		httpError(r, w, http.StatusConflict, "another benchmark is in progress")
+
+		return
+	}
+	defer atomic.StoreUint32(&s.benchmarking, 0)
+
+	resp := &benchmarkResultJSON{
+		Reference: ref.Address(),
+		Upstreams: make([]*upstreamBenchmarkJSON, len(addrs)),
+	}
+
+	var ups []upstream.Upstream
+	var idxs []int
+	for i, addr := range addrs {
+		var u upstream.Upstream
+		u, err = newBenchmarkUpstream(addr, bootstrap)
+		if err != nil {
+			resp.Upstreams[i] = &upstreamBenchmarkJSON{
+				Upstream:        addr,
+				Error:           err.Error(),
+				FilteredDomains: []string{},
+			}
+
+			continue
+		}
+
+		ups, idxs = append(ups, u), append(idxs, i)
+	}
+
+	b := &upstreamBenchmark{
+		reference: ref,
+		isSpecial: s.subnetDetector.IsSpecialNetwork,
+		deadline:  time.Now().Add(benchmarkTimeout),
+		domains:   benchmarkDomains,
+	}
+
+	log.Info("dns: benchmark: starting with %d upstreams", len(ups))
+	res, incomplete := b.run(ups)
+	for i, ur := range res {
+		resp.Upstreams[idxs[i]] = ur
+	}
+	resp.Incomplete = incomplete
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
@@ -0,0 +1,78 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPercentileMs(t *testing.T) {
+	ms := func(n int) (d time.Duration) { return time.Duration(n) * time.Millisecond }
+
+	sorted := make([]time.Duration, 0, 20)
+	for i := 1; i <= 20; i++ {
+		sorted = append(sorted, ms(i))
+	}
+
+	assert.Equal(t, 10.0, percentileMs(sorted, 0.5))
+	assert.Equal(t, 19.0, percentileMs(sorted, 0.95))
+	assert.Equal(t, 1.0, percentileMs(sorted[:1], 0.95))
+	assert.Zero(t, percentileMs(nil, 0.5))
+}
+
+func TestUpstreamBenchmark_run(t *testing.T) {
+	public := net.IP{1, 2, 3, 4}
+	ref := &aghtest.TestUpstream{
+		Addr: "reference",
+		IPv4: map[string][]net.IP{
+			"example.org.": {public},
+			"example.com.": {public},
+		},
+	}
+	blocking := &aghtest.TestUpstream{
+		Addr: "blocking",
+		IPv4: map[string][]net.IP{
+			"example.org.": {public},
+			"example.com.": {net.IPv4zero},
+		},
+	}
+	failing := &aghtest.TestErrUpstream{Err: assert.AnError}
+
+	b := &upstreamBenchmark{
+		reference: ref,
+		isSpecial: func(ip net.IP) (ok bool) { return ip.IsUnspecified() },
+		deadline:  time.Now().Add(time.Minute),
+		domains:   []string{"example.org", "example.com"},
+	}
+
+	res, incomplete := b.run([]upstream.Upstream{ref, blocking, failing})
+	require.Len(t, res, 3)
+	assert.False(t, incomplete)
+
+	assert.Equal(t, "reference", res[0].Upstream)
+	assert.Equal(t, 2, res[0].Queries)
+	assert.Zero(t, res[0].Failures)
+	assert.Empty(t, res[0].FilteredDomains)
+
+	assert.Equal(t, "blocking", res[1].Upstream)
+	assert.Zero(t, res[1].FailureRate)
+	assert.Equal(t, []string{"example.com"}, res[1].FilteredDomains)
+
+	assert.Equal(t, 2, res[2].Failures)
+	assert.Equal(t, 1.0, res[2].FailureRate)
+	assert.Zero(t, res[2].MedianMs)
+
+	t.Run("expired", func(t *testing.T) {
+		b.deadline = time.Now().Add(-time.Second)
+		res, incomplete = b.run([]upstream.Upstream{ref})
+		require.Len(t, res, 1)
+
+		assert.True(t, incomplete)
+		assert.Zero(t, res[0].Queries)
+	})
+}
@@ -0,0 +1,239 @@
+package dnsforward
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// errBudgetExceeded is returned when the processing of a request has been
+// aborted because it has exceeded the time budget.
+const errBudgetExceeded agherr.Error = "query time budget exceeded"
+
+// queryStage is a stage of the processing of a request, which the requests
+// exceeding the time budget are counted by.
+type queryStage int
+
+// queryStage values.
+const (
+	// queryStageRequest are the checks of the request before the
+	// filtering, such as the access settings and the internal hosts.
+	queryStageRequest queryStage = iota
+
+	// queryStageFiltering is the filtering of the request, including the
+	// safe browsing and the parental control lookups.
+	queryStageFiltering
+
+	// queryStageLocal is the resolving of the local names and of the
+	// locally-served addresses.
+	queryStageLocal
+
+	// queryStageUpstream is the exchange with the upstream servers,
+	// including the waiting for an identical coalesced request.
+	queryStageUpstream
+
+	// queryStageResponse is the processing of the response, such as its
+	// filtering and the tarpit.
+	queryStageResponse
+
+	// queryStageNum is the number of the stages.
+	queryStageNum
+)
+
+// String implements the fmt.Stringer interface for queryStage.
+func (qs queryStage) String() (s string) {
+	switch qs {
+	case queryStageRequest:
+		return "request"
+	case queryStageFiltering:
+		return "filtering"
+	case queryStageLocal:
+		return "local"
+	case queryStageUpstream:
+		return "upstream"
+	case queryStageResponse:
+		return "response"
+	default:
+		return "unknown"
+	}
+}
+
+// newDeadline returns the deadline of the request received at start.  It's
+// zero if the time budget is disabled.
+func (s *Server) newDeadline(start time.Time) (deadline time.Time) {
+	if s.conf.QueryBudgetMs == 0 {
+		return time.Time{}
+	}
+
+	return start.Add(time.Duration(s.conf.QueryBudgetMs) * time.Millisecond)
+}
+
+// checkBudget returns true if the processing of the request from ctx has
+// exceeded its time budget by the end of stage.  In that case, the request is
+// answered with SERVFAIL and counted.
+func (s *Server) checkBudget(ctx *dnsContext, stage queryStage) (exceeded bool) {
+	if ctx.deadline.IsZero() || time.Now().Before(ctx.deadline) {
+		return false
+	}
+
+	d := ctx.proxyCtx
+	log.Debug("dns: %s: time budget exceeded at %s stage", d.Req.Question[0].Name, stage)
+
+	atomic.AddUint64(&s.budgetExceeded[stage], 1)
+	ctx.budgetStage, ctx.overBudget = stage, true
+	ctx.err = nil
+	d.Res = s.genServerFailure(d.Req)
+
+	return true
+}
+
+// wait waits until done is closed or until the deadline of ctx, if any.  ok is
+// false if the deadline has been reached first.
+func (ctx *dnsContext) wait(done <-chan struct{}) (ok bool) {
+	if ctx.deadline.IsZero() {
+		<-done
+
+		return true
+	}
+
+	t := time.NewTimer(time.Until(ctx.deadline))
+	defer t.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// requestSlots are the places taken by a request within the limits of the
+// requests processed simultaneously.
+type requestSlots struct {
+	// mu protects the fields below.  The slots may be released by the
+	// work abandoned at the deadline of the request.
+	mu       sync.Mutex
+	releases []func()
+	detached bool
+}
+
+// add adds the slot freed by release.
+func (rs *requestSlots) add(release func()) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.releases = append(rs.releases, release)
+}
+
+// release frees the slots, unless they have been detached.
+func (rs *requestSlots) release() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.detached {
+		return
+	}
+
+	for i := len(rs.releases) - 1; i >= 0; i-- {
+		rs.releases[i]()
+	}
+
+	rs.releases = nil
+}
+
+// detach makes release a no-op and returns the function freeing the slots
+// instead.  rs may be nil.
+func (rs *requestSlots) detach() (release func()) {
+	if rs == nil {
+		return func() {}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	rs.detached = true
+	releases := rs.releases
+	rs.releases = nil
+
+	return func() {
+		for i := len(releases) - 1; i >= 0; i-- {
+			releases[i]()
+		}
+	}
+}
+
+// resolveBudgeted calls resolve for the request from ctx within its time
+// budget.  If the request has a deadline, resolve is called on a copy of ctx,
+// which replaces the original one once resolve returns in time.  So resolve
+// may keep running after the deadline without changing the response already
+// sent to the client.  Such abandoned work keeps the slots of the request, so
+// that it's still bound by the limits of the requests processed
+// simultaneously.
+func resolveBudgeted(ctx *dnsContext, resolve func(uctx *dnsContext) (err error)) (err error) {
+	if ctx.deadline.IsZero() {
+		return resolve(ctx)
+	}
+
+	d := *ctx.proxyCtx
+	d.Req = d.Req.Copy()
+
+	uctx := *ctx
+	uctx.proxyCtx = &d
+
+	// mu protects finished and release, which hand the slots of the
+	// request over to the goroutine if it's abandoned.
+	mu := &sync.Mutex{}
+	var finished bool
+	var release func()
+
+	var resolveErr error
+	done := make(chan struct{})
+	go func() {
+		defer func() {
+			mu.Lock()
+			defer mu.Unlock()
+
+			finished = true
+			if release != nil {
+				release()
+			}
+		}()
+		defer close(done)
+		defer agherr.LogPanic("dns: resolving within budget")
+
+		resolveErr = resolve(&uctx)
+	}()
+
+	if !ctx.wait(done) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if !finished {
+			release = ctx.slots.detach()
+		}
+
+		return errBudgetExceeded
+	}
+
+	*ctx.proxyCtx = d
+	uctx.proxyCtx = ctx.proxyCtx
+	*ctx = uctx
+
+	return resolveErr
+}
+
+// BudgetExceeded returns the numbers of the requests answered with SERVFAIL
+// because their processing has exceeded the time budget by the stages.
+func (s *Server) BudgetExceeded() (be stats.BudgetExceeded) {
+	return stats.BudgetExceeded{
+		Request:   atomic.LoadUint64(&s.budgetExceeded[queryStageRequest]),
+		Filtering: atomic.LoadUint64(&s.budgetExceeded[queryStageFiltering]),
+		Local:     atomic.LoadUint64(&s.budgetExceeded[queryStageLocal]),
+		Upstream:  atomic.LoadUint64(&s.budgetExceeded[queryStageUpstream]),
+		Response:  atomic.LoadUint64(&s.budgetExceeded[queryStageResponse]),
+	}
+}
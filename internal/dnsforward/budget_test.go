@@ -0,0 +1,219 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_budget(t *testing.T) {
+	const (
+		budget = 200 * time.Millisecond
+
+		// epsilon is the time allowed for the processing of the request
+		// after the deadline and for the exchange itself.
+		epsilon = 100 * time.Millisecond
+	)
+
+	newServer := func(t *testing.T, budgetMs uint32, delay time.Duration) (s *Server, addr string) {
+		t.Helper()
+
+		s = createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{{}},
+			TCPListenAddrs: []*net.TCPAddr{{}},
+			FilteringConfig: FilteringConfig{
+				CoalesceQueries: true,
+				EnableEDE:       true,
+				QueryBudgetMs:   budgetMs,
+			},
+		}, nil)
+		s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{&countingUpstream{
+			delay: delay,
+		}}
+		startDeferStop(t, s)
+
+		return s, s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	}
+
+	// exchange sends the request for name to addr and returns the response
+	// along with the time it took.
+	exchange := func(t *testing.T, addr, name string) (resp *dns.Msg, elapsed time.Duration) {
+		t.Helper()
+
+		req := createTestMessage(name)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		c := &dns.Client{
+			Timeout: 5 * time.Second,
+		}
+
+		start := time.Now()
+		resp, _, err := c.Exchange(req, addr)
+		require.NoError(t, err)
+
+		return resp, time.Since(start)
+	}
+
+	budgetMs := uint32(budget / time.Millisecond)
+
+	t.Run("slow_upstream", func(t *testing.T) {
+		s, addr := newServer(t, budgetMs, 2*time.Second)
+
+		resp, elapsed := exchange(t, addr, "slow.example.")
+		assert.LessOrEqual(t, int64(elapsed), int64(budget+epsilon))
+		require.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+		text := "time budget exceeded at upstream stage"
+		want := append([]byte{0x00, 0x0f, 0x00, byte(2 + len(text)), 0x00, 0x00}, text...)
+		assert.Equal(t, want, edeOptionBytes(t, resp))
+
+		assert.Equal(t, stats.BudgetExceeded{Upstream: 1}, s.BudgetExceeded())
+	})
+
+	t.Run("coalesced", func(t *testing.T) {
+		s, addr := newServer(t, budgetMs, 2*time.Second)
+
+		const n = 3
+
+		wg := &sync.WaitGroup{}
+		wg.Add(n)
+		for i := 0; i < n; i++ {
+			go func() {
+				defer wg.Done()
+
+				resp, elapsed := exchange(t, addr, "coalesced.example.")
+				assert.LessOrEqual(t, int64(elapsed), int64(budget+epsilon))
+				assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+			}()
+		}
+		wg.Wait()
+
+		assert.Equal(t, stats.BudgetExceeded{Upstream: n}, s.BudgetExceeded())
+	})
+
+	t.Run("within_budget", func(t *testing.T) {
+		s, addr := newServer(t, budgetMs, 0)
+
+		resp, _ := exchange(t, addr, "fast.example.")
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Len(t, resp.Answer, 1)
+
+		assert.Equal(t, stats.BudgetExceeded{}, s.BudgetExceeded())
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		s, addr := newServer(t, 0, budget+epsilon)
+
+		resp, elapsed := exchange(t, addr, "slow.example.")
+		require.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.GreaterOrEqual(t, int64(elapsed), int64(budget+epsilon))
+
+		assert.Equal(t, stats.BudgetExceeded{}, s.BudgetExceeded())
+	})
+}
+
+func TestResolveBudgeted(t *testing.T) {
+	newCtx := func(budget time.Duration, l *inflightLimiter) (ctx *dnsContext) {
+		require.Equal(t, inflightOK, l.acquire())
+
+		slots := &requestSlots{}
+		slots.add(l.release)
+
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: createTestMessage("example.org."),
+			},
+			deadline: time.Now().Add(budget),
+			slots:    slots,
+		}
+	}
+
+	t.Run("in_time", func(t *testing.T) {
+		l := newInflightLimiter(&FilteringConfig{MaxInflightQueries: 1})
+		ctx := newCtx(time.Second, l)
+
+		err := resolveBudgeted(ctx, func(uctx *dnsContext) (err error) {
+			uctx.proxyCtx.Res = (&dns.Msg{}).SetReply(uctx.proxyCtx.Req)
+			uctx.ttlOverride = "example.org"
+
+			return errNoResponse
+		})
+		assert.Equal(t, errNoResponse, err)
+		assert.NotNil(t, ctx.proxyCtx.Res)
+		assert.Equal(t, "example.org", ctx.ttlOverride)
+
+		ctx.slots.release()
+		assert.Zero(t, l.stats().Active)
+	})
+
+	t.Run("abandoned", func(t *testing.T) {
+		l := newInflightLimiter(&FilteringConfig{MaxInflightQueries: 1})
+		ctx := newCtx(50*time.Millisecond, l)
+
+		unblock := make(chan struct{})
+		err := resolveBudgeted(ctx, func(uctx *dnsContext) (err error) {
+			<-unblock
+			uctx.proxyCtx.Res = (&dns.Msg{}).SetReply(uctx.proxyCtx.Req)
+
+			return errNoResponse
+		})
+		assert.Equal(t, errBudgetExceeded, err)
+
+		// The abandoned work still takes the place of the request.
+		ctx.slots.release()
+		assert.Equal(t, 1, l.stats().Active)
+
+		close(unblock)
+		assert.Eventually(t, func() bool {
+			return l.stats().Active == 0
+		}, time.Second, time.Millisecond)
+
+		// The response of the abandoned work isn't used.
+		assert.Nil(t, ctx.proxyCtx.Res)
+	})
+}
+
+func TestServer_processTarpit_deadline(t *testing.T) {
+	s := &Server{
+		tarpit: newTarpit(1, 60_000),
+	}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	newCtx := func(budget time.Duration) (ctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: req,
+				Res: (&dns.Msg{}).SetReply(req),
+			},
+			result: &dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredBlockList,
+			},
+			clientIP: net.IP{1, 2, 3, 4},
+			deadline: time.Now().Add(budget),
+		}
+	}
+
+	// The delays end before the deadline, so the blocked responses aren't
+	// replaced with SERVFAIL.
+	for i := 0; i < 3; i++ {
+		ctx := newCtx(100 * time.Millisecond)
+		require.Equal(t, resultCodeSuccess, s.processTarpit(ctx))
+		assert.False(t, s.checkBudget(ctx, queryStageResponse))
+	}
+	assert.Equal(t, uint64(2), s.tarpitted)
+
+	// There is no time left for the delay.
+	ctx := newCtx(tarpitDeadlineMargin / 2)
+	require.Equal(t, resultCodeSuccess, s.processTarpit(ctx))
+	assert.Equal(t, uint64(2), s.tarpitted)
+}
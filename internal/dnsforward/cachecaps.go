@@ -0,0 +1,208 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Default caps on the cached responses.
+const (
+	// defaultCacheMaxRecords is the maximum number of the resource records
+	// in a cached response used if FilteringConfig.CacheMaxRecords isn't
+	// set.
+	defaultCacheMaxRecords = 256
+
+	// defaultCacheMaxEntrySize is the maximum size of a cached response in
+	// bytes used if FilteringConfig.CacheMaxEntrySize isn't set.
+	defaultCacheMaxEntrySize = 16 * 1024
+)
+
+// rcodeUncacheable is the response code from the private use range with which
+// the responses exceeding the cache caps are marked while dnsproxy resolves
+// them.  dnsproxy can't be told to not cache a particular response, but it
+// never caches the responses with the response codes other than NOERROR and
+// NXDOMAIN.  Only the responses to the requests tracked by Server.resolve are
+// marked, and it restores the original response code before returning, so
+// neither the clients nor the server itself ever see it.
+//
+// See RFC 6895, section 2.3.
+const rcodeUncacheable = 3841
+
+// cacheRejection is the reason why a response isn't cached.
+type cacheRejection string
+
+// Reasons why a response isn't cached.
+const (
+	cacheRejectNone          cacheRejection = ""
+	cacheRejectTooMany       cacheRejection = "too many records"
+	cacheRejectTooLarge      cacheRejection = "too large"
+	cacheRejectOwnerMismatch cacheRejection = "owner name doesn't match question"
+)
+
+// cacheCaps are the caps on the responses of the upstream servers stored in
+// the cache.  The responses exceeding them are still sent to the clients.
+type cacheCaps struct {
+	// tooMany, tooLarge, and ownerMismatch are the numbers of the
+	// responses not cached for each reason.  They're accessed atomically.
+	tooMany       uint64
+	tooLarge      uint64
+	ownerMismatch uint64
+
+	// maxRecords and maxSize are the caps.  They're accessed atomically.
+	maxRecords uint32
+	maxSize    uint32
+}
+
+// setLimits sets the caps of c.  The zero values mean the defaults.
+func (c *cacheCaps) setLimits(maxRecords, maxSize uint32) {
+	if maxRecords == 0 {
+		maxRecords = defaultCacheMaxRecords
+	}
+
+	if maxSize == 0 {
+		maxSize = defaultCacheMaxEntrySize
+	}
+
+	atomic.StoreUint32(&c.maxRecords, maxRecords)
+	atomic.StoreUint32(&c.maxSize, maxSize)
+}
+
+// exceeds returns true if resp to req, received from the upstream with the
+// address addr, exceeds the caps.  The responses which wouldn't be cached
+// anyway are never reported.
+func (c *cacheCaps) exceeds(addr string, req, resp *dns.Msg) (ok bool) {
+	if resp.Truncated ||
+		len(req.Question) != 1 ||
+		(resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError) {
+		return false
+	}
+
+	reason := c.check(req.Question[0].Name, resp)
+	if reason == cacheRejectNone {
+		return false
+	}
+
+	log.Debug("dns: not caching response for %s from %s: %s", req.Question[0].Name, addr, reason)
+
+	return true
+}
+
+// check returns the reason why resp to the question for qname mustn't be
+// cached, if any, and counts it.
+func (c *cacheCaps) check(qname string, resp *dns.Msg) (reason cacheRejection) {
+	n := len(resp.Answer) + len(resp.Ns) + len(resp.Extra)
+	if resp.IsEdns0() != nil {
+		n--
+	}
+
+	if n > int(atomic.LoadUint32(&c.maxRecords)) {
+		atomic.AddUint64(&c.tooMany, 1)
+
+		return cacheRejectTooMany
+	}
+
+	if resp.Len() > int(atomic.LoadUint32(&c.maxSize)) {
+		atomic.AddUint64(&c.tooLarge, 1)
+
+		return cacheRejectTooLarge
+	}
+
+	if !ownersMatch(qname, resp.Answer) {
+		atomic.AddUint64(&c.ownerMismatch, 1)
+
+		return cacheRejectOwnerMismatch
+	}
+
+	return cacheRejectNone
+}
+
+// ownersMatch returns true if the owner names of all answer records are
+// either qname or the names which qname is aliased to by the CNAME and DNAME
+// records of answer, in any order.  The signatures of the DNAME records are
+// allowed as well.
+func ownersMatch(qname string, answer []dns.RR) (ok bool) {
+	names := map[string]struct{}{strings.ToLower(qname): {}}
+	dnames := map[string]struct{}{}
+
+	pending := answer
+	for len(pending) > 0 {
+		var rest []dns.RR
+		for _, rr := range pending {
+			if !acceptOwner(names, dnames, rr) {
+				rest = append(rest, rr)
+			}
+		}
+
+		if len(rest) == len(pending) {
+			return false
+		}
+
+		pending = rest
+	}
+
+	return true
+}
+
+// acceptOwner returns true if the owner name of rr is one of names or, for the
+// signatures, dnames.  The aliases introduced by the accepted CNAME and DNAME
+// records are added to names.
+func acceptOwner(names, dnames map[string]struct{}, rr dns.RR) (ok bool) {
+	owner := strings.ToLower(rr.Header().Name)
+
+	switch rr := rr.(type) {
+	case *dns.CNAME:
+		if _, ok = names[owner]; ok {
+			names[strings.ToLower(rr.Target)] = struct{}{}
+		}
+
+		return ok
+	case *dns.DNAME:
+		// The DNAME record itself is owned by an ancestor of the name
+		// it redirects.
+		target := strings.ToLower(rr.Target)
+
+		var aliases []string
+		for name := range names {
+			if name == owner {
+				ok = true
+			} else if dns.IsSubDomain(owner, name) {
+				ok = true
+				aliases = append(aliases, strings.TrimSuffix(name, owner)+target)
+			}
+		}
+
+		for _, a := range aliases {
+			names[a] = struct{}{}
+		}
+
+		if ok {
+			dnames[owner] = struct{}{}
+		}
+
+		return ok
+	case *dns.RRSIG:
+		if _, ok = dnames[owner]; ok {
+			return true
+		}
+	}
+
+	_, ok = names[owner]
+
+	return ok
+}
+
+// CacheRejections returns the numbers of the responses not cached since they
+// exceed the caps.
+func (s *Server) CacheRejections() (cr stats.CacheRejections) {
+	c := &s.cacheCaps
+
+	return stats.CacheRejections{
+		TooManyRecords: atomic.LoadUint64(&c.tooMany),
+		TooLarge:       atomic.LoadUint64(&c.tooLarge),
+		OwnerMismatch:  atomic.LoadUint64(&c.ownerMismatch),
+	}
+}
@@ -0,0 +1,246 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOwnersMatch(t *testing.T) {
+	const qname = "www.example.org."
+
+	rr := func(s string) (r dns.RR) {
+		r, err := dns.NewRR(s)
+		require.NoError(t, err)
+
+		return r
+	}
+
+	testCases := []struct {
+		name   string
+		answer []dns.RR
+		want   bool
+	}{{
+		name:   "empty",
+		answer: nil,
+		want:   true,
+	}, {
+		name:   "direct",
+		answer: []dns.RR{rr("WWW.example.org. 60 IN A 1.2.3.4")},
+		want:   true,
+	}, {
+		name: "cname_chain",
+		answer: []dns.RR{
+			rr("www.example.org. 60 IN CNAME cdn.example.net."),
+			rr("cdn.example.net. 60 IN CNAME edge.example.com."),
+			rr("edge.example.com. 60 IN A 1.2.3.4"),
+		},
+		want: true,
+	}, {
+		name: "cname_chain_unordered",
+		answer: []dns.RR{
+			rr("edge.example.com. 60 IN A 1.2.3.4"),
+			rr("cdn.example.net. 60 IN CNAME edge.example.com."),
+			rr("www.example.org. 60 IN CNAME cdn.example.net."),
+		},
+		want: true,
+	}, {
+		name: "dname",
+		answer: []dns.RR{
+			rr("example.org. 60 IN DNAME example.net."),
+			rr("example.org. 60 IN RRSIG DNAME 8 2 60 20300101000000 20200101000000 1 example.org. AAAA"),
+			rr("www.example.org. 60 IN CNAME www.example.net."),
+			rr("www.example.net. 60 IN A 1.2.3.4"),
+		},
+		want: true,
+	}, {
+		name: "poisoned",
+		answer: []dns.RR{
+			rr("www.example.org. 60 IN A 1.2.3.4"),
+			rr("bank.example. 60 IN A 1.2.3.4"),
+		},
+		want: false,
+	}, {
+		name: "poisoned_parent",
+		answer: []dns.RR{
+			rr("www.example.org. 60 IN A 1.2.3.4"),
+			rr("example.org. 60 IN A 1.2.3.4"),
+		},
+		want: false,
+	}, {
+		name: "unrelated_dname",
+		answer: []dns.RR{
+			rr("bank.example. 60 IN DNAME evil.example."),
+			rr("www.example.org. 60 IN A 1.2.3.4"),
+		},
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, ownersMatch(qname, tc.answer))
+		})
+	}
+}
+
+// answerUpstream is an upstream answering with the records returned by answer
+// and counting its exchanges.
+type answerUpstream struct {
+	answer func(name string) (rrs []dns.RR)
+
+	// n is the number of the exchanges.  It's accessed atomically.
+	n uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *answerUpstream.
+func (u *answerUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddUint32(&u.n, 1)
+
+	resp = (&dns.Msg{}).SetReply(m)
+	resp.Answer = u.answer(m.Question[0].Name)
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *answerUpstream.
+func (u *answerUpstream) Address() (addr string) {
+	return "answer"
+}
+
+func TestServer_cacheCaps(t *testing.T) {
+	newA := func(name string, i int) (rr dns.RR) {
+		return &dns.A{
+			Hdr: dns.RR_Header{
+				Name:   name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IP{10, 0, byte(i >> 8), byte(i)},
+		}
+	}
+
+	ups := &answerUpstream{
+		answer: func(name string) (rrs []dns.RR) {
+			switch name {
+			case "many.example.":
+				for i := 0; i < 300; i++ {
+					rrs = append(rrs, newA(name, i))
+				}
+			case "large.example.":
+				txt := strings.Repeat("a", 250)
+				for i := 0; i < 100; i++ {
+					rrs = append(rrs, &dns.TXT{
+						Hdr: dns.RR_Header{
+							Name:   name,
+							Rrtype: dns.TypeTXT,
+							Class:  dns.ClassINET,
+							Ttl:    60,
+						},
+						Txt: []string{txt},
+					})
+				}
+				rrs = append(rrs, newA(name, 0))
+			case "poisoned.example.":
+				rrs = []dns.RR{newA(name, 0), newA("bank.example.", 0)}
+			default:
+				rrs = []dns.RR{newA(name, 0)}
+			}
+
+			return rrs
+		},
+	}
+
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			CacheSize: 1024 * 1024,
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = s.upstreamTraces.wrapUpstreams([]upstream.Upstream{ups})
+	startDeferStop(t, s)
+
+	addr := s.dnsProxy.Addr(proxy.ProtoTCP).String()
+	c := &dns.Client{Net: "tcp"}
+
+	testCases := []struct {
+		name          string
+		host          string
+		wantAnswers   int
+		wantExchanges uint32
+	}{{
+		name:          "small",
+		host:          "small.example.",
+		wantAnswers:   1,
+		wantExchanges: 1,
+	}, {
+		name:          "too_many_records",
+		host:          "many.example.",
+		wantAnswers:   300,
+		wantExchanges: 2,
+	}, {
+		name:          "too_large",
+		host:          "large.example.",
+		wantAnswers:   101,
+		wantExchanges: 2,
+	}, {
+		name:          "owner_mismatch",
+		host:          "poisoned.example.",
+		wantAnswers:   2,
+		wantExchanges: 2,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			atomic.StoreUint32(&ups.n, 0)
+
+			for i := 0; i < 2; i++ {
+				resp, _, err := c.Exchange(createTestMessage(tc.host), addr)
+				require.NoError(t, err)
+
+				assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+				assert.Len(t, resp.Answer, tc.wantAnswers)
+			}
+
+			assert.Equal(t, tc.wantExchanges, atomic.LoadUint32(&ups.n))
+		})
+	}
+
+	t.Run("server", func(t *testing.T) {
+		atomic.StoreUint32(&ups.n, 0)
+
+		// The requests made by the server itself, like the cache warm-up
+		// ones, never see the mark either.
+		for i := 0; i < 2; i++ {
+			d := &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Req:   createTestMessage("many.example."),
+				Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+			}
+
+			_, err := s.resolve(s.dnsProxy, d, false)
+			require.NoError(t, err)
+			require.NotNil(t, d.Res)
+
+			assert.Equal(t, dns.RcodeSuccess, d.Res.Rcode)
+		}
+
+		assert.Equal(t, uint32(2), atomic.LoadUint32(&ups.n))
+	})
+
+	assert.Equal(t, stats.CacheRejections{
+		TooManyRecords: 4,
+		TooLarge:       2,
+		OwnerMismatch:  2,
+	}, s.CacheRejections())
+}
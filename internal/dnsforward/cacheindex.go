@@ -0,0 +1,360 @@
+package dnsforward
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/miekg/dns"
+)
+
+// defaultCacheListLimit is the number of the entries returned by the GET
+// /control/cache HTTP API if the limit isn't set.
+const defaultCacheListLimit = 100
+
+// cacheIndexEntry is a response stored in the cache of the DNS proxy.
+type cacheIndexEntry struct {
+	// expire is the time when the response expires in the cache.
+	expire time.Time
+
+	// name is the lowercased question name.
+	name string
+
+	// upstream is the address of the upstream which has sent the
+	// response.
+	upstream string
+
+	// ecs is the subnet of the EDNS Client Subnet option of the response
+	// with the scope as the prefix length, if any.
+	ecs string
+
+	// ansTTL and restTTL are the lowest TTLs of the records in the answer
+	// section and in the other sections.  Only the former are limited by
+	// the cache settings.  They're math.MaxUint32 if there are no records.
+	ansTTL  uint32
+	restTTL uint32
+
+	// size is the estimated size of the entry in the cache in bytes.
+	size uint64
+
+	qtype  uint16
+	qclass uint16
+
+	// negative is true if the response is either NXDOMAIN or has no
+	// answers.
+	negative bool
+}
+
+// cacheIndexKey is the key of a response in the cache of the DNS proxy.
+type cacheIndexKey struct {
+	name   string
+	ecs    string
+	qtype  uint16
+	qclass uint16
+}
+
+// key returns the key of e.
+func (e *cacheIndexEntry) key() (k cacheIndexKey) {
+	return cacheIndexKey{name: e.name, ecs: e.ecs, qtype: e.qtype, qclass: e.qclass}
+}
+
+// newCacheIndexEntry returns the entry for resp to req from the upstream with
+// the address addr, if the DNS proxy could cache it.  Whether it does also
+// depends on the TTL, see expiration.
+func newCacheIndexEntry(addr string, req, resp *dns.Msg) (e *cacheIndexEntry) {
+	if resp.Truncated || len(req.Question) != 1 {
+		return nil
+	}
+
+	q := req.Question[0]
+	switch resp.Rcode {
+	case dns.RcodeSuccess:
+		if (q.Qtype == dns.TypeA || q.Qtype == dns.TypeAAAA) && !hasAddrAnswer(resp) {
+			return nil
+		}
+	case dns.RcodeNameError:
+		// Go on.
+	default:
+		return nil
+	}
+
+	name := strings.ToLower(q.Name)
+
+	restTTL := lowestTTL(resp.Ns)
+	if ttl := lowestTTL(resp.Extra); ttl < restTTL {
+		restTTL = ttl
+	}
+
+	return &cacheIndexEntry{
+		name:     name,
+		upstream: addr,
+		ecs:      responseECS(resp),
+		ansTTL:   lowestTTL(resp.Answer),
+		restTTL:  restTTL,
+		// The key and the expiration time are stored along with the
+		// packed response.
+		size:     uint64(4 + len(name) + 4 + resp.Len()),
+		qtype:    q.Qtype,
+		qclass:   q.Qclass,
+		negative: resp.Rcode == dns.RcodeNameError || len(resp.Answer) == 0,
+	}
+}
+
+// lowestTTL returns the lowest TTL of rrs except the OPT records or
+// math.MaxUint32 if there are none.
+func lowestTTL(rrs []dns.RR) (ttl uint32) {
+	ttl = math.MaxUint32
+	for _, rr := range rrs {
+		if h := rr.Header(); h.Rrtype != dns.TypeOPT && h.Ttl < ttl {
+			ttl = h.Ttl
+		}
+	}
+
+	return ttl
+}
+
+// expiration returns the time when e expires in the cache of the proxy with
+// the minimum and maximum TTL of the answer records, which are applied before
+// the response is cached.  ok is false if the response isn't cached.
+func (e *cacheIndexEntry) expiration(now time.Time, minTTL, maxTTL uint32) (expire time.Time, ok bool) {
+	ttl := e.restTTL
+	if ans := e.ansTTL; ans != math.MaxUint32 {
+		if ans < minTTL {
+			ans = minTTL
+		} else if maxTTL != 0 && ans > maxTTL {
+			ans = maxTTL
+		}
+
+		if ans < ttl {
+			ttl = ans
+		}
+	}
+
+	if ttl == 0 || ttl == math.MaxUint32 {
+		return time.Time{}, false
+	}
+
+	return now.Add(time.Duration(ttl) * time.Second), true
+}
+
+// hasAddrAnswer returns true if resp has an A or AAAA record in the answer
+// section.
+func hasAddrAnswer(resp *dns.Msg) (ok bool) {
+	for _, rr := range resp.Answer {
+		if t := rr.Header().Rrtype; t == dns.TypeA || t == dns.TypeAAAA {
+			return true
+		}
+	}
+
+	return false
+}
+
+// responseECS returns the subnet of the EDNS Client Subnet option of resp with
+// the scope as the prefix length, if any.
+func responseECS(resp *dns.Msg) (subnet string) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return ""
+	}
+
+	for _, o := range opt.Option {
+		if sn, ok := o.(*dns.EDNS0_SUBNET); ok {
+			return fmt.Sprintf("%s/%d", sn.Address, sn.SourceScope)
+		}
+	}
+
+	return ""
+}
+
+// cacheIndex is the index of the responses stored in the cache of the DNS
+// proxy, which can't be inspected itself.  The entries are evicted in the order
+// they're stored once the estimated size of the cache is exceeded, which only
+// approximates the LRU eviction of the proxy, so the index may still list the
+// responses which the proxy has already evicted.
+type cacheIndex struct {
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// entries are the elements of order by the key of the response.
+	entries map[cacheIndexKey]*list.Element
+
+	// order contains *cacheIndexEntry from the most recently stored one.
+	order *list.List
+
+	// size and maxSize are the estimated and the maximum sizes of the cache
+	// in bytes.
+	size    uint64
+	maxSize uint64
+}
+
+// reset removes all entries from c and sets its maximum size, since the DNS
+// proxy is created with the empty cache.
+func (c *cacheIndex) reset(maxSize uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = map[cacheIndexKey]*list.Element{}
+	c.order = list.New()
+	c.size = 0
+	c.maxSize = maxSize
+}
+
+// add stores e, which expires at expire, in c.
+func (c *cacheIndex) add(e *cacheIndexEntry, expire time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.order == nil {
+		return
+	}
+
+	if el, ok := c.entries[e.key()]; ok {
+		c.remove(el)
+	}
+
+	stored := *e
+	stored.expire = expire
+	c.entries[e.key()] = c.order.PushFront(&stored)
+	c.size += stored.size
+
+	for c.size > c.maxSize && c.order.Len() > 1 {
+		c.remove(c.order.Back())
+	}
+}
+
+// remove removes el from c.  c.mu is expected to be locked.
+func (c *cacheIndex) remove(el *list.Element) {
+	e := el.Value.(*cacheIndexEntry)
+	c.size -= e.size
+	c.order.Remove(el)
+	delete(c.entries, e.key())
+}
+
+// cacheIndexSnapshot is the copy of the entries of the cache index.
+type cacheIndexSnapshot struct {
+	// entries are the matching entries from the most recently stored one.
+	entries []cacheIndexEntry
+
+	// total, negative, and matched are the numbers of all, negative, and
+	// matching unexpired entries.
+	total    int
+	negative int
+	matched  int
+
+	// size is the estimated size of the cache in bytes.
+	size uint64
+}
+
+// snapshot returns the copy of at most limit unexpired entries with the names
+// containing name.  The expired entries are removed.
+func (c *cacheIndex) snapshot(name string, limit int, now time.Time) (s cacheIndexSnapshot) {
+	name = strings.ToLower(name)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.order == nil {
+		return s
+	}
+
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+
+		e := el.Value.(*cacheIndexEntry)
+		if !now.Before(e.expire) {
+			c.remove(el)
+			el = next
+
+			continue
+		}
+
+		s.total++
+		if e.negative {
+			s.negative++
+		}
+
+		if strings.Contains(e.name, name) {
+			s.matched++
+			if len(s.entries) < limit {
+				s.entries = append(s.entries, *e)
+			}
+		}
+
+		el = next
+	}
+
+	s.size = c.size
+
+	return s
+}
+
+// cacheEntryJSON is an entry of the response to the GET /control/cache HTTP
+// API.
+type cacheEntryJSON struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Class    string `json:"class"`
+	Upstream string `json:"upstream"`
+	ECS      string `json:"ecs,omitempty"`
+	TTL      uint32 `json:"ttl"`
+	Negative bool   `json:"negative"`
+}
+
+// cacheJSON is the response to the GET /control/cache HTTP API.
+type cacheJSON struct {
+	Entries  []cacheEntryJSON `json:"entries"`
+	Total    int              `json:"total"`
+	Negative int              `json:"negative"`
+	Matched  int              `json:"matched"`
+	Size     uint64           `json:"size"`
+}
+
+// handleCache is the handler for the GET /control/cache HTTP API.  The
+// responses are only taken from the index under its lock and are serialized
+// after it's released.
+func (s *Server) handleCache(w http.ResponseWriter, r *http.Request) {
+	params := aghhttp.QueryParams(r.URL.Query())
+	name := strings.TrimSuffix(params.String("name", ""), ".")
+	limit := int(params.Int("limit", defaultCacheListLimit, 0, math.MaxInt32))
+	err := params.Err()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	now := time.Now()
+	snap := s.cacheIndex.snapshot(name, limit, now)
+
+	resp := cacheJSON{
+		Entries:  make([]cacheEntryJSON, 0, len(snap.entries)),
+		Total:    snap.total,
+		Negative: snap.negative,
+		Matched:  snap.matched,
+		Size:     snap.size,
+	}
+
+	for _, e := range snap.entries {
+		resp.Entries = append(resp.Entries, cacheEntryJSON{
+			Name:     strings.TrimSuffix(e.name, "."),
+			Type:     dns.Type(e.qtype).String(),
+			Class:    dns.Class(e.qclass).String(),
+			Upstream: e.upstream,
+			ECS:      e.ecs,
+			TTL:      uint32(e.expire.Sub(now).Round(time.Second) / time.Second),
+			Negative: e.negative,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
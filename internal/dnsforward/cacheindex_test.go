@@ -0,0 +1,215 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewCacheIndexEntry(t *testing.T) {
+	soa := &dns.SOA{
+		Hdr: dns.RR_Header{
+			Name:   "example.",
+			Rrtype: dns.TypeSOA,
+			Class:  dns.ClassINET,
+			Ttl:    30,
+		},
+	}
+
+	newEntry := func(rcode int, ans []dns.RR) (e *cacheIndexEntry) {
+		req := (&dns.Msg{}).SetQuestion("Host.Example.", dns.TypeA)
+		resp := (&dns.Msg{}).SetRcode(req, rcode)
+		resp.Answer = ans
+		resp.Ns = []dns.RR{soa}
+
+		return newCacheIndexEntry("upstream", req, resp)
+	}
+
+	a := &dns.A{
+		Hdr: dns.RR_Header{
+			Name:   "host.example.",
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    120,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}
+
+	now := time.Now()
+
+	t.Run("positive", func(t *testing.T) {
+		e := newEntry(dns.RcodeSuccess, []dns.RR{a})
+		require.NotNil(t, e)
+
+		assert.Equal(t, "host.example.", e.name)
+		assert.False(t, e.negative)
+
+		// The SOA record has the lowest TTL.
+		expire, ok := e.expiration(now, 0, 0)
+		require.True(t, ok)
+		assert.Equal(t, now.Add(30*time.Second), expire)
+
+		// Only the answer records are limited.
+		expire, ok = e.expiration(now, 0, 10)
+		require.True(t, ok)
+		assert.Equal(t, now.Add(10*time.Second), expire)
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		e := newEntry(dns.RcodeNameError, nil)
+		require.NotNil(t, e)
+
+		assert.True(t, e.negative)
+	})
+
+	t.Run("no_address", func(t *testing.T) {
+		assert.Nil(t, newEntry(dns.RcodeSuccess, nil))
+	})
+
+	t.Run("servfail", func(t *testing.T) {
+		assert.Nil(t, newEntry(dns.RcodeServerFailure, nil))
+	})
+
+	t.Run("marked", func(t *testing.T) {
+		assert.Nil(t, newEntry(rcodeUncacheable, []dns.RR{a}))
+	})
+}
+
+func TestCacheIndex(t *testing.T) {
+	newEntry := func(name string, negative bool) (e *cacheIndexEntry) {
+		return &cacheIndexEntry{
+			name:     name,
+			size:     100,
+			qtype:    dns.TypeA,
+			qclass:   dns.ClassINET,
+			negative: negative,
+		}
+	}
+
+	now := time.Now()
+
+	c := &cacheIndex{}
+	c.reset(300)
+
+	c.add(newEntry("expired.example.", false), now)
+	c.add(newEntry("a.example.", false), now.Add(time.Minute))
+	c.add(newEntry("b.example.", true), now.Add(time.Minute))
+
+	snap := c.snapshot("", 10, now)
+	assert.Equal(t, 2, snap.total)
+	assert.Equal(t, 1, snap.negative)
+	assert.Equal(t, 2, snap.matched)
+	assert.Equal(t, uint64(200), snap.size)
+
+	require.Len(t, snap.entries, 2)
+	assert.Equal(t, "b.example.", snap.entries[0].name)
+
+	// The oldest entry is evicted.
+	c.add(newEntry("c.example.", false), now.Add(time.Minute))
+	c.add(newEntry("d.example.", false), now.Add(time.Minute))
+
+	snap = c.snapshot("", 10, now)
+	assert.Equal(t, 3, snap.total)
+
+	snap = c.snapshot("A.EXAMPLE", 10, now)
+	assert.Equal(t, 0, snap.matched)
+
+	snap = c.snapshot("example", 1, now)
+	assert.Equal(t, 3, snap.matched)
+
+	require.Len(t, snap.entries, 1)
+	assert.Equal(t, "d.example.", snap.entries[0].name)
+
+	c.reset(300)
+	snap = c.snapshot("", 10, now)
+	assert.Equal(t, 0, snap.total)
+}
+
+func TestServer_handleCache(t *testing.T) {
+	ups := &answerUpstream{
+		answer: func(name string) (rrs []dns.RR) {
+			n := 1
+			if name == "many.example." {
+				n = 300
+			}
+
+			for i := 0; i < n; i++ {
+				rrs = append(rrs, &dns.A{
+					Hdr: dns.RR_Header{
+						Name:   name,
+						Rrtype: dns.TypeA,
+						Class:  dns.ClassINET,
+						Ttl:    60,
+					},
+					A: net.IP{10, 0, byte(i >> 8), byte(i)},
+				})
+			}
+
+			return rrs
+		},
+	}
+
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			CacheSize: 1024 * 1024,
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = s.upstreamTraces.wrapUpstreams([]upstream.Upstream{ups})
+	startDeferStop(t, s)
+
+	addr := s.dnsProxy.Addr(proxy.ProtoTCP).String()
+	c := &dns.Client{Net: "tcp"}
+
+	// The response to the second request is from the cache, and the
+	// response with too many records isn't cached at all.
+	for _, host := range []string{"small.example.", "small.example.", "many.example."} {
+		_, _, err := c.Exchange(createTestMessage(host), addr)
+		require.NoError(t, err)
+	}
+
+	get := func(t *testing.T, query string) (resp *cacheJSON) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		s.handleCache(w, httptest.NewRequest(http.MethodGet, "/control/cache?"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = &cacheJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp
+	}
+
+	resp := get(t, "name=small")
+	assert.Equal(t, 1, resp.Total)
+	assert.Equal(t, 1, resp.Matched)
+
+	require.Len(t, resp.Entries, 1)
+	e := resp.Entries[0]
+	assert.Equal(t, "small.example", e.Name)
+	assert.Equal(t, "A", e.Type)
+	assert.Equal(t, "IN", e.Class)
+	assert.Equal(t, ups.Address(), e.Upstream)
+	assert.False(t, e.Negative)
+	assert.InDelta(t, 60, e.TTL, 1)
+
+	resp = get(t, "name=other")
+	assert.Equal(t, 1, resp.Total)
+	assert.Empty(t, resp.Entries)
+
+	w := httptest.NewRecorder()
+	s.handleCache(w, httptest.NewRequest(http.MethodGet, "/control/cache?limit=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+}
@@ -0,0 +1,315 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// defaultCacheWarmupRate is the number of the warm-up queries per
+	// second used if FilteringConfig.CacheWarmupRate isn't set.
+	defaultCacheWarmupRate = 10
+
+	// maxCacheWarmupRate is the maximum number of the warm-up queries per
+	// second.
+	maxCacheWarmupRate = 1000
+)
+
+// Cache warm-up states.
+const (
+	CacheWarmupStateRunning  = "running"
+	CacheWarmupStateFinished = "finished"
+	CacheWarmupStateAborted  = "aborted"
+	CacheWarmupStateSkipped  = "skipped"
+)
+
+// CacheWarmupStatus is the state of the warm-up of the cache.
+type CacheWarmupStatus struct {
+	// StartedAt is the time the warm-up has started.  It's nil if it
+	// hasn't.
+	StartedAt *aghtime.Time `json:"started_at,omitempty"`
+
+	// State is one of the CacheWarmupState constants.  It's empty if the
+	// warm-up hasn't been requested.
+	State string `json:"state,omitempty"`
+
+	// Reason is the reason the warm-up has been aborted or skipped.
+	Reason string `json:"reason,omitempty"`
+
+	// Domains is the number of the domains to warm up.
+	Domains int `json:"domains"`
+
+	// Warmed is the number of the domains resolved successfully.
+	Warmed int `json:"warmed"`
+
+	// Failed is the number of the domains, which couldn't be resolved.
+	Failed int `json:"failed"`
+
+	// DurationMs is the duration of the warm-up in milliseconds.
+	DurationMs float64 `json:"duration_ms"`
+}
+
+// cacheWarmup resolves the popular domains in the background to fill the cache
+// after the start.
+//
+// The zero cacheWarmup is ready for use.
+type cacheWarmup struct {
+	// mu protects status and done.
+	mu sync.Mutex
+
+	status CacheWarmupStatus
+
+	// done is closed to abort the running warm-up.  It's nil if there is
+	// none.
+	done chan struct{}
+}
+
+// skip records that the warm-up of domains has been skipped for the reason.
+func (w *cacheWarmup) skip(domains []string, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.status = CacheWarmupStatus{
+		State:   CacheWarmupStateSkipped,
+		Reason:  reason,
+		Domains: len(domains),
+	}
+
+	log.Info("dns: cache warm-up skipped: %s", reason)
+}
+
+// begin records the start of the warm-up of domains and returns the channel,
+// which is closed when it's aborted.
+func (w *cacheWarmup) begin(domains []string, now time.Time) (done chan struct{}) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.status = CacheWarmupStatus{
+		StartedAt: &aghtime.Time{Time: now},
+		State:     CacheWarmupStateRunning,
+		Domains:   len(domains),
+	}
+	w.done = make(chan struct{})
+
+	return w.done
+}
+
+// resolved records the result of the warm-up of a single domain.
+func (w *cacheWarmup) resolved(ok bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if ok {
+		w.status.Warmed++
+	} else {
+		w.status.Failed++
+	}
+}
+
+// finish records the end of the warm-up with the state and the reason unless
+// it has been aborted already.
+func (w *cacheWarmup) finish(done chan struct{}, state, reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done == done {
+		w.finishLocked(state, reason)
+	}
+}
+
+// finishLocked records the end of the running warm-up with the state and the
+// reason.  w.mu is expected to be locked.
+func (w *cacheWarmup) finishLocked(state, reason string) {
+	w.done = nil
+	st := &w.status
+	st.State, st.Reason = state, reason
+	elapsed := time.Since(st.StartedAt.Time)
+	st.DurationMs = float64(elapsed) / float64(time.Millisecond)
+
+	log.Info(
+		"dns: cache warm-up %s: warmed %d of %d domains in %s",
+		state,
+		st.Warmed,
+		st.Domains,
+		elapsed.Round(time.Millisecond),
+	)
+	if reason != "" {
+		log.Info("dns: cache warm-up %s: %s", state, reason)
+	}
+}
+
+// abort aborts the running warm-up, if any, for the reason.
+func (w *cacheWarmup) abort(reason string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.done != nil {
+		close(w.done)
+		w.finishLocked(CacheWarmupStateAborted, reason)
+	}
+}
+
+// state returns a copy of the state of the warm-up.
+func (w *cacheWarmup) state() (st CacheWarmupStatus) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	st = w.status
+	if st.State == CacheWarmupStateRunning {
+		st.DurationMs = float64(time.Since(st.StartedAt.Time)) / float64(time.Millisecond)
+	}
+
+	return st
+}
+
+// WarmUpCache resolves domains in the background at the rate configured in
+// FilteringConfig.CacheWarmupRate, so that their responses are cached before
+// the clients ask for them.  The previous warm-up, if any, is aborted.  The
+// warm-up is skipped if the cache is disabled and stops once all the default
+// upstreams are considered down.  It's also aborted when s is stopped.
+func (s *Server) WarmUpCache(domains []string) {
+	s.warmup.abort("restarted")
+
+	s.RLock()
+	defer s.RUnlock()
+
+	if !s.isRunning {
+		s.warmup.skip(domains, "dns server is not running")
+
+		return
+	} else if s.conf.CacheSize == 0 {
+		s.warmup.skip(domains, "cache is disabled")
+
+		return
+	} else if len(domains) == 0 {
+		s.warmup.skip(domains, "no popular domains")
+
+		return
+	}
+
+	skipAAAA := s.conf.AAAADisabled
+	targets := s.probeTargets
+	if s.upstreamsDown(targets, time.Now()) {
+		s.warmup.skip(domains, "upstreams are down")
+
+		return
+	}
+
+	rate := s.conf.CacheWarmupRate
+	if rate == 0 {
+		rate = defaultCacheWarmupRate
+	} else if rate > maxCacheWarmupRate {
+		rate = maxCacheWarmupRate
+	}
+
+	ivl := time.Second / time.Duration(rate)
+	done := s.warmup.begin(domains, time.Now())
+	log.Info("dns: cache warm-up started for %d domains at %d queries per second", len(domains), rate)
+
+	go s.warmUp(done, s.dnsProxy, targets, domains, ivl, skipAAAA)
+}
+
+// upstreamsDown returns true if all the default upstreams among targets are
+// considered down by the passive tracking at now.
+func (s *Server) upstreamsDown(targets []*probeTarget, now time.Time) (down bool) {
+	var n int
+	for _, t := range targets {
+		if len(t.domains) > 0 {
+			continue
+		}
+
+		if !s.health.isDown(t.u.Address(), now) {
+			return false
+		}
+
+		n++
+	}
+
+	return n > 0
+}
+
+// warmUp resolves domains with p sending a query every ivl until done is
+// closed.  The AAAA queries are only sent unless skipAAAA is true.
+func (s *Server) warmUp(
+	done chan struct{},
+	p *proxy.Proxy,
+	targets []*probeTarget,
+	domains []string,
+	ivl time.Duration,
+	skipAAAA bool,
+) {
+	defer agherr.LogPanic("dns: cache warm-up")
+
+	qtypes := []uint16{dns.TypeA, dns.TypeAAAA}
+	if skipAAAA {
+		qtypes = qtypes[:1]
+	}
+
+	ticker := time.NewTicker(ivl)
+	defer ticker.Stop()
+
+	for _, d := range domains {
+		ok := true
+		for _, qt := range qtypes {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+
+			if s.upstreamsDown(targets, time.Now()) {
+				s.warmup.finish(done, CacheWarmupStateAborted, "upstreams are down")
+
+				return
+			}
+
+			ok = s.warmUpQuery(p, d, qt) && ok
+		}
+
+		s.warmup.resolved(ok)
+	}
+
+	s.warmup.finish(done, CacheWarmupStateFinished, "")
+}
+
+// warmUpQuery resolves the query of the type qt for domain with p, so that the
+// response is cached.  ok is false if the domain couldn't be resolved.
+func (s *Server) warmUpQuery(p *proxy.Proxy, domain string, qt uint16) (ok bool) {
+	req := &dns.Msg{}
+	req.SetQuestion(dns.Fqdn(domain), qt)
+	req.RecursionDesired = true
+
+	dctx := &proxy.DNSContext{
+		Proto: proxy.ProtoUDP,
+		Req:   req,
+		Addr:  &net.UDPAddr{IP: net.IP{127, 0, 0, 1}},
+	}
+
+	_, err := s.resolve(p, dctx, false)
+	if err != nil {
+		log.Debug("dns: cache warm-up: resolving %s: %s", domain, err)
+
+		return false
+	}
+
+	return true
+}
+
+// CacheWarmup returns the state of the warm-up of the cache.
+func (s *Server) CacheWarmup() (st CacheWarmupStatus) {
+	return s.warmup.state()
+}
+
+// handleCacheWarmupAbort is the handler for the POST /control/cache_warmup/abort
+// HTTP API.
+func (s *Server) handleCacheWarmupAbort(_ http.ResponseWriter, _ *http.Request) {
+	s.warmup.abort("aborted by user")
+}
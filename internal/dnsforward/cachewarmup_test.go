@@ -0,0 +1,96 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_WarmUpCache(t *testing.T) {
+	newServer := func(t *testing.T, fc FilteringConfig) (s *Server) {
+		t.Helper()
+
+		s = createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+			UDPListenAddrs:  []*net.UDPAddr{{}},
+			TCPListenAddrs:  []*net.TCPAddr{{}},
+			FilteringConfig: fc,
+		}, nil)
+		s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"a.example.": {{1, 2, 3, 4}},
+				"b.example.": {{1, 2, 3, 5}},
+			},
+		}}
+		startDeferStop(t, s)
+
+		return s
+	}
+
+	domains := []string{"a.example", "b.example"}
+
+	t.Run("finished", func(t *testing.T) {
+		s := newServer(t, FilteringConfig{
+			CacheSize:       4096,
+			CacheWarmupRate: maxCacheWarmupRate,
+		})
+
+		s.WarmUpCache(domains)
+		require.Eventually(t, func() bool {
+			return s.CacheWarmup().State == CacheWarmupStateFinished
+		}, time.Second, 10*time.Millisecond)
+
+		st := s.CacheWarmup()
+		assert.Equal(t, 2, st.Domains)
+		assert.Equal(t, 2, st.Warmed)
+		assert.Zero(t, st.Failed)
+		assert.NotNil(t, st.StartedAt)
+	})
+
+	t.Run("aborted", func(t *testing.T) {
+		s := newServer(t, FilteringConfig{
+			CacheSize:       4096,
+			CacheWarmupRate: 1,
+		})
+
+		s.WarmUpCache(domains)
+		assert.Equal(t, CacheWarmupStateRunning, s.CacheWarmup().State)
+
+		s.warmup.abort("test")
+		st := s.CacheWarmup()
+		assert.Equal(t, CacheWarmupStateAborted, st.State)
+		assert.Equal(t, "test", st.Reason)
+
+		// Aborting again changes nothing.
+		s.warmup.abort("again")
+		assert.Equal(t, "test", s.CacheWarmup().Reason)
+	})
+
+	t.Run("no_cache", func(t *testing.T) {
+		s := newServer(t, FilteringConfig{})
+
+		s.WarmUpCache(domains)
+		st := s.CacheWarmup()
+		assert.Equal(t, CacheWarmupStateSkipped, st.State)
+		assert.Equal(t, "cache is disabled", st.Reason)
+	})
+
+	t.Run("upstreams_down", func(t *testing.T) {
+		s := newServer(t, FilteringConfig{CacheSize: 4096})
+		for _, pt := range s.probeTargets {
+			for i := 0; i < passiveMaxFails; i++ {
+				s.health.exchanged(pt.u.Address(), assert.AnError, time.Now())
+			}
+		}
+
+		s.WarmUpCache(domains)
+		st := s.CacheWarmup()
+		assert.Equal(t, CacheWarmupStateSkipped, st.State)
+		assert.Equal(t, "upstreams are down", st.Reason)
+	})
+}
@@ -107,12 +107,17 @@ type quicSession interface {
 }
 
 // processClientID extracts the client's ID from the server name of the client's
-// DOT or DOQ request or the path of the client's DOH.
+// DOT or DOQ request or the path of the client's DOH.  The ClientID of the
+// clients of the UNIX socket is based on their user IDs.
 func processClientID(dctx *dnsContext) (rc resultCode) {
 	pctx := dctx.proxyCtx
 	proto := pctx.Proto
 	if proto == proxy.ProtoHTTPS {
 		return processClientIDHTTPS(dctx)
+	} else if peer, ok := pctx.Addr.(*unixPeerAddr); ok {
+		dctx.clientID = peer.clientID()
+
+		return resultCodeSuccess
 	} else if proto != proxy.ProtoTLS && proto != proxy.ProtoQUIC {
 		return resultCodeSuccess
 	}
@@ -152,7 +157,11 @@ func processClientID(dctx *dnsContext) (rc resultCode) {
 		return resultCodeError
 	}
 
-	dctx.clientID = clientID
+	if clientID != "" {
+		// Don't replace the ClientID of the requests from the
+		// trusted forwarders.
+		dctx.clientID = clientID
+	}
 
 	return resultCodeSuccess
 }
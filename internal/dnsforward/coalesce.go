@@ -0,0 +1,168 @@
+package dnsforward
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// errNoResponse is returned to the coalesced requests when the request they've
+// waited for has got no response.
+const errNoResponse agherr.Error = "no response"
+
+// coalesceKey identifies the requests, which may be answered with the same
+// response.
+type coalesceKey struct {
+	// name is the lowercased name of the question, so that the requests
+	// with the randomized case of the letters are coalesced as well.
+	name string
+
+	// client is the address of the client if the response depends on it,
+	// because the client has its own upstreams or the EDNS Client Subnet
+	// option is sent.  It's empty otherwise.
+	client string
+
+	qtype  uint16
+	qclass uint16
+
+	// edns, do, and cd are the EDNS(0) presence, the DNSSEC OK bit, and the
+	// Checking Disabled bit of the request.
+	edns bool
+	do   bool
+	cd   bool
+}
+
+// newCoalesceKey returns the key of the request from ctx.
+func newCoalesceKey(ctx *dnsContext) (k coalesceKey) {
+	req := ctx.proxyCtx.Req
+	q := req.Question[0]
+	k = coalesceKey{
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+		qclass: q.Qclass,
+		cd:     req.CheckingDisabled,
+	}
+
+	if opt := req.IsEdns0(); opt != nil {
+		k.edns, k.do = true, opt.Do()
+	}
+
+	if ctx.proxyCtx.CustomUpstreamConfig != nil || ctx.srv.conf.EnableEDNSClientSubnet {
+		k.client = ctx.clientIP.String()
+	}
+
+	return k
+}
+
+// coalescedCall is the resolving of a request, which the identical concurrent
+// requests wait for.
+type coalescedCall struct {
+	// done is closed when the fields below are set.
+	done chan struct{}
+
+	// resp is the response of the upstream.  It's nil if err isn't nil.
+	// It mustn't be modified, see reply.
+	resp *dns.Msg
+
+	// upstream is the upstream, which has answered.
+	upstream upstream.Upstream
+
+	err error
+
+	// ttlOverride is the pattern of the TTL override rule applied to resp,
+	// if any.
+	ttlOverride string
+}
+
+// reply returns the copy of c.resp as the response to req.  The identifier
+// and the question are the ones of req, so that the case of the letters chosen
+// by the client is preserved.
+func (c *coalescedCall) reply(req *dns.Msg) (resp *dns.Msg) {
+	resp = c.resp.Copy()
+	resp.Id = req.Id
+
+	var orig string
+	if len(resp.Question) > 0 {
+		orig = resp.Question[0].Name
+	}
+
+	q := req.Question[0]
+	resp.Question = []dns.Question{q}
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns} {
+		for _, rr := range rrs {
+			if h := rr.Header(); h.Name == orig {
+				h.Name = q.Name
+			}
+		}
+	}
+
+	return resp
+}
+
+// coalescer coalesces the identical concurrent requests into a single exchange
+// with the upstreams.
+type coalescer struct {
+	// mu protects calls.
+	mu sync.Mutex
+
+	// calls are the requests being resolved.
+	calls map[coalesceKey]*coalescedCall
+}
+
+// newCoalescer returns a new coalescer.  c is nil if enabled is false.
+func newCoalescer(enabled bool) (c *coalescer) {
+	if !enabled {
+		return nil
+	}
+
+	return &coalescer{
+		calls: map[coalesceKey]*coalescedCall{},
+	}
+}
+
+// join returns the call resolving the request with k.  If there is none, it's
+// created and leader is true, so that the caller must resolve the request and
+// call finish.
+func (c *coalescer) join(k coalesceKey) (call *coalescedCall, leader bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	call, ok := c.calls[k]
+	if ok {
+		return call, false
+	}
+
+	call = &coalescedCall{
+		done: make(chan struct{}),
+	}
+	c.calls[k] = call
+
+	return call, true
+}
+
+// finish records the result of call with k and wakes up the requests waiting
+// for it.  resp is copied.
+func (c *coalescer) finish(
+	k coalesceKey,
+	call *coalescedCall,
+	resp *dns.Msg,
+	ups upstream.Upstream,
+	ttlOverride string,
+	err error,
+) {
+	c.mu.Lock()
+	delete(c.calls, k)
+	c.mu.Unlock()
+
+	if resp != nil {
+		call.resp = resp.Copy()
+	} else if err == nil {
+		err = errNoResponse
+	}
+
+	call.upstream, call.ttlOverride, call.err = ups, ttlOverride, err
+	close(call.done)
+}
@@ -0,0 +1,109 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// countingUpstream is an upstream answering with an address after a delay and
+// counting its exchanges.
+type countingUpstream struct {
+	delay time.Duration
+
+	// n is the number of the exchanges.  It's accessed atomically.
+	n uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *countingUpstream.
+func (u *countingUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	atomic.AddUint32(&u.n, 1)
+	time.Sleep(u.delay)
+
+	resp = (&dns.Msg{}).SetReply(m)
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{1, 2, 3, 4},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *countingUpstream.
+func (u *countingUpstream) Address() (addr string) {
+	return "counting"
+}
+
+func TestServer_coalesce(t *testing.T) {
+	// Browsers send the same query several times at once, sometimes with
+	// the case of the letters randomized.
+	names := [][]string{
+		{"a.example.", "A.example.", "a.EXAMPLE."},
+		{"b.example.", "b.example.", "B.Example."},
+		{"c.example.", "C.EXAMPLE.", "c.example."},
+	}
+
+	// sendTriples sends the queries for names, each group in parallel, and
+	// returns the number of the exchanges with the upstream.
+	sendTriples := func(t *testing.T, coalesce bool) (exchanges uint32) {
+		t.Helper()
+
+		s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{{}},
+			TCPListenAddrs: []*net.TCPAddr{{}},
+			FilteringConfig: FilteringConfig{
+				CoalesceQueries: coalesce,
+			},
+		}, nil)
+
+		ups := &countingUpstream{
+			delay: 200 * time.Millisecond,
+		}
+		s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{ups}
+		startDeferStop(t, s)
+
+		addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+		wg := &sync.WaitGroup{}
+		for _, group := range names {
+			for _, name := range group {
+				wg.Add(1)
+				go func(name string) {
+					defer wg.Done()
+
+					req := createTestMessage(name)
+					resp, err := dns.Exchange(req, addr)
+					require.NoError(t, err)
+
+					require.Len(t, resp.Question, 1)
+					assert.Equal(t, name, resp.Question[0].Name)
+					require.Len(t, resp.Answer, 1)
+					assert.Equal(t, name, resp.Answer[0].Header().Name)
+				}(name)
+			}
+		}
+		wg.Wait()
+
+		return atomic.LoadUint32(&ups.n)
+	}
+
+	without := sendTriples(t, false)
+	with := sendTriples(t, true)
+
+	assert.EqualValues(t, 9, without)
+	assert.EqualValues(t, 3, with)
+	t.Logf("upstream exchanges: %d without coalescing, %d with", without, with)
+}
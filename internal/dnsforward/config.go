@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"sort"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxy"
@@ -42,6 +43,10 @@ type FilteringConfig struct {
 	BlockingIPv6       net.IP `yaml:"blocking_ipv6"`        // IP address to be returned for a blocked AAAA request
 	BlockedResponseTTL uint32 `yaml:"blocked_response_ttl"` // if 0, then default is used (3600)
 
+	// BlockedResponseSOA is the SOA record in the authority section of the
+	// NXDOMAIN and NODATA responses.
+	BlockedResponseSOA BlockedResponseSOA `yaml:"blocked_response_soa"`
+
 	// IP (or domain name) which is used to respond to DNS requests blocked by parental control or safe-browsing
 	ParentalBlockHost     string `yaml:"parental_block_host"`
 	SafeBrowsingBlockHost string `yaml:"safebrowsing_block_host"`
@@ -53,6 +58,61 @@ type FilteringConfig struct {
 	RatelimitWhitelist []string `yaml:"ratelimit_whitelist"` // a list of whitelisted client IP addresses
 	RefuseAny          bool     `yaml:"refuse_any"`          // if true, refuse ANY requests
 
+	// MaxUDPResponseSize is the size in bytes of the largest response sent
+	// over UDP to the clients outside of the locally-served networks.  The
+	// larger responses are replaced with the truncated ones, so that the
+	// clients retry over TCP.  Zero means no limit.
+	MaxUDPResponseSize uint16 `yaml:"max_udp_response_size"`
+
+	// AutoEDNSBufferSize makes the server limit the UDP responses to the
+	// clients within the subnets, where the large responses seem to be
+	// dropped, to the recommended buffer size, so that the clients retry
+	// over TCP right away instead of waiting for the timeout.
+	AutoEDNSBufferSize bool `yaml:"auto_edns_buffer_size"`
+
+	// ResponseBytesRatelimit is the maximum number of bytes per second sent
+	// over UDP to a single client outside of the locally-served networks.
+	// The responses over the limit are replaced with the truncated ones.
+	// The clients in RatelimitWhitelist aren't limited.  Zero means no
+	// limit.
+	ResponseBytesRatelimit uint32 `yaml:"response_bytes_ratelimit"`
+
+	// MinimalResponses tells if the authority and the additional sections
+	// of the positive responses are removed.
+	MinimalResponses bool `yaml:"minimal_responses"`
+
+	// TarpitThreshold is the number of the blocked requests for a domain
+	// per minute from a single client over which the blocked responses to
+	// it are delayed, the longer the further it's exceeded.  Zero disables
+	// the tarpit.
+	TarpitThreshold uint32 `yaml:"tarpit_threshold"`
+
+	// TarpitMaxDelayMs is the maximum delay of a blocked response in
+	// milliseconds.  Zero means two seconds.
+	TarpitMaxDelayMs uint32 `yaml:"tarpit_max_delay_ms"`
+
+	// QueryBudgetMs is the maximum time of the processing of a request in
+	// milliseconds, including the exchanges with the upstream servers.
+	// The requests exceeding it are answered with SERVFAIL.  The exchanges
+	// abandoned at the deadline still count against MaxInflightQueries
+	// until they end.  Zero disables the limit.
+	QueryBudgetMs uint32 `yaml:"query_budget_ms"`
+
+	// Trusted forwarders
+	// --
+
+	// TrustedForwarders are the IP addresses of the DNS servers forwarding
+	// the requests of their clients to this one.  They aren't rate limited,
+	// and the original client is used for the per-client settings,
+	// statistics, and query log, if the request carries its address.
+	TrustedForwarders []string `yaml:"trusted_forwarders"`
+
+	// ForwarderClientOption is the code of the EDNS(0) option in which the
+	// trusted forwarders send the address of the original client, four or
+	// sixteen bytes long.  ECS with a whole address is used as well.  Zero
+	// means that only ECS is used.
+	ForwarderClientOption uint16 `yaml:"forwarder_client_option"`
+
 	// Upstream DNS servers configuration
 	// --
 
@@ -62,6 +122,58 @@ type FilteringConfig struct {
 	AllServers          bool     `yaml:"all_servers"`   // if true, parallel queries to all configured upstream servers are enabled
 	FastestAddr         bool     `yaml:"fastest_addr"`  // use Fastest Address algorithm
 
+	// UpstreamOptions are the settings of the single upstreams overriding
+	// the common ones, such as the timeout.
+	UpstreamOptions []UpstreamOptions `yaml:"upstream_options"`
+
+	// UpstreamProbeInterval is the interval in minutes between the probes
+	// of the upstream servers.  Zero means that the upstreams aren't
+	// probed.
+	UpstreamProbeInterval uint32 `yaml:"upstream_probe_interval"`
+
+	// UpstreamProbeName is the domain name resolved by the probes of the
+	// default upstream servers.  The upstreams reserved for domains are
+	// probed with those domains.  If empty, defaultProbeName is used.
+	UpstreamProbeName string `yaml:"upstream_probe_name"`
+
+	// HijackProbeInterval is the interval in minutes between the probes of
+	// the plain DNS upstreams for the networks answering the DNS requests
+	// themselves.  Zero means that the upstreams aren't probed.
+	HijackProbeInterval uint32 `yaml:"hijack_probe_interval"`
+
+	// HijackPolicy defines what's done while a plain DNS upstream is
+	// hijacked, see the HijackPolicy* constants.  If empty,
+	// HijackPolicyWarn is used.
+	HijackPolicy string `yaml:"hijack_policy"`
+
+	// CacheWarmupDomains is the number of the most popular domains from the
+	// statistics resolved after the start to fill the cache.  Zero means
+	// that the cache isn't warmed up.
+	CacheWarmupDomains uint32 `yaml:"cache_warmup_domains"`
+
+	// CacheWarmupRate is the number of the warm-up queries per second.  If
+	// zero, defaultCacheWarmupRate is used.
+	CacheWarmupRate uint32 `yaml:"cache_warmup_rate"`
+
+	// CoalesceQueries tells if the identical concurrent requests are
+	// resolved with a single exchange with the upstreams.
+	CoalesceQueries bool `yaml:"coalesce_queries"`
+
+	// StatsSkipCoalesced tells if the coalesced requests are left out of
+	// the statistics, so that each group of the identical concurrent
+	// requests is counted once.  They're still written into the query log.
+	StatsSkipCoalesced bool `yaml:"statistics_skip_coalesced"`
+
+	// OutboundInterface is the name of the network interface the
+	// connections to the upstream servers are bound to.  It's only
+	// supported on Linux, see also OutboundSourceIP.
+	OutboundInterface string `yaml:"outbound_interface"`
+
+	// OutboundSourceIP is the source address of the connections to the
+	// upstream servers.  If OutboundInterface is also set, it must be one of
+	// the addresses of that interface.
+	OutboundSourceIP string `yaml:"outbound_source_ip"`
+
 	// Access settings
 	// --
 
@@ -76,6 +188,50 @@ type FilteringConfig struct {
 	CacheMinTTL uint32 `yaml:"cache_ttl_min"` // override TTL value (minimum) received from upstream server
 	CacheMaxTTL uint32 `yaml:"cache_ttl_max"` // override TTL value (maximum) received from upstream server
 
+	// CacheMaxRecords is the maximum number of the resource records in a
+	// cached response.  The larger responses are still sent to the clients
+	// but aren't cached.  If zero, defaultCacheMaxRecords is used.
+	CacheMaxRecords uint32 `yaml:"cache_max_records"`
+
+	// CacheMaxEntrySize is the maximum size of a cached response in bytes.
+	// The larger responses are still sent to the clients but aren't cached.
+	// If zero, defaultCacheMaxEntrySize is used.
+	CacheMaxEntrySize uint32 `yaml:"cache_max_entry_size"`
+
+	// TTLOverrides bound the TTLs of the answers for the matching domain
+	// names before they're cached.  The first matching rule is applied.
+	// The cache_ttl_min and cache_ttl_max bounds are applied after them.
+	TTLOverrides []TTLOverride `yaml:"ttl_overrides"`
+
+	// Local names
+	// --
+
+	// LocalSingleLabel makes the server answer the requests for the
+	// single-label names, such as "printer", only from the local sources:
+	// the hosts files, the DNS rewrites, and the DHCP leases.  The rest of
+	// such requests are answered with NXDOMAIN instead of being forwarded.
+	LocalSingleLabel bool `yaml:"local_single_label"`
+
+	// SearchLocalDomain makes the server look up the single-label names
+	// within the local domain, for example "printer.lan" for "printer",
+	// before giving up on them.
+	SearchLocalDomain bool `yaml:"search_local_domain"`
+
+	// AllowRootQueries makes the server forward the requests for the root
+	// name.  Otherwise, they're refused.
+	AllowRootQueries bool `yaml:"allow_root_queries"`
+
+	// AllowWPAD makes the server forward the requests for the names
+	// starting with the "wpad" label, which are used to discover the web
+	// proxy.  Otherwise, the ones not found in the local sources are
+	// answered with NXDOMAIN.
+	AllowWPAD bool `yaml:"allow_wpad"`
+
+	// InstanceHostname is the name the PTR requests for the addresses of
+	// the server itself are answered with.  Such requests are never
+	// forwarded.  If empty, the hostname of the machine is used.
+	InstanceHostname string `yaml:"instance_hostname"`
+
 	// Other settings
 	// --
 
@@ -83,14 +239,70 @@ type FilteringConfig struct {
 	AAAADisabled           bool     `yaml:"aaaa_disabled"`      // Respond with an empty answer to all AAAA requests
 	EnableDNSSEC           bool     `yaml:"enable_dnssec"`      // Set DNSSEC flag in outcoming DNS request
 	EnableEDNSClientSubnet bool     `yaml:"edns_client_subnet"` // Enable EDNS Client Subnet option
+	EnableDNSCookies       bool     `yaml:"enable_dns_cookies"` // Generate and validate DNS cookies for plain UDP clients
 	MaxGoroutines          uint32   `yaml:"max_goroutines"`     // Max. number of parallel goroutines for processing incoming requests
 
+	// StripDNSSECOK tells if the DNSSEC OK bit is removed from the requests
+	// forwarded upstream, unless EnableDNSSEC is set, so that the responses
+	// don't contain the signatures nobody checks.  The validating clients
+	// get no signatures to validate and see the responses as insecure.
+	StripDNSSECOK bool `yaml:"strip_dnssec_ok"`
+
+	// EnableEDE tells if the Extended DNS Errors, RFC 8914, are added to
+	// the blocked responses and to the ones generated after the upstreams
+	// have failed.  The ones sent by the upstreams are passed through.
+	EnableEDE bool `yaml:"enable_extended_dns_errors"`
+
+	// EDNSPaddingBlockSize is the block size in bytes to which the
+	// responses to the padded queries sent over the encrypted transports
+	// are padded.  Zero means the 468 bytes recommended by RFC 8467.
+	EDNSPaddingBlockSize uint16 `yaml:"edns_padding_block_size"`
+
+	// MaxInflightQueries is the maximum number of the requests processed
+	// simultaneously regardless of the protocol.  Zero means no limit.
+	MaxInflightQueries uint32 `yaml:"max_inflight_queries"`
+
+	// InflightQueueSize is the maximum number of the requests waiting once
+	// MaxInflightQueries is reached.  When the queue is full, the oldest
+	// waiting request is dropped.
+	InflightQueueSize uint32 `yaml:"inflight_queue_size"`
+
+	// LoadShedding makes the server answer REFUSED right away to the
+	// requests over MaxInflightQueries instead of queuing them.
+	LoadShedding bool `yaml:"load_shedding"`
+
+	// IngressPools are the worker pools of the ingress protocols by the
+	// names of the protocols.  If set, MaxGoroutines isn't used, and the
+	// requests of the protocols without a pool aren't limited.
+	IngressPools map[string]IngressPoolConfig `yaml:"ingress_pools"`
+
+	// UnixSocket is the configuration of the DNS listener on the UNIX
+	// socket for the local applications.
+	UnixSocket UnixSocketConfig `yaml:"unix_socket"`
+
 	// IPSET configuration - add IP addresses of the specified domain names to an ipset list
 	// Syntax:
 	// "DOMAIN[,DOMAIN].../IPSET_NAME"
 	IPSETList []string `yaml:"ipset"`
 }
 
+// BlockedResponseSOA is the configuration of the SOA record in the negative
+// responses.  The empty names are derived from the hostname of the machine.
+type BlockedResponseSOA struct {
+	// MName is the name of the primary name server.
+	MName string `yaml:"mname"`
+
+	// RName is the mailbox of the person responsible for the zone, with the
+	// first dot in place of the "@".
+	RName string `yaml:"rname"`
+
+	// NegativeTTL is the time in seconds for which the clients cache the
+	// negative responses.  It's used as both the TTL and the MINIMUM field
+	// of the record, since the lesser of them is used, see RFC 2308.  If
+	// zero, BlockedResponseTTL is used.
+	NegativeTTL uint32 `yaml:"negative_ttl"`
+}
+
 // TLSConfig is the TLS configuration for HTTPS, DNS-over-HTTPS, and DNS-over-TLS
 type TLSConfig struct {
 	TLSListenAddrs  []*net.TCPAddr `yaml:"-" json:"-"`
@@ -153,9 +365,41 @@ type ServerConfig struct {
 	// ResolveClients signals if the RDNS should resolve clients' addresses.
 	ResolveClients bool
 
+	// OnBlocked is called with the question host, the client, and the
+	// filtering reason of each blocked request.  It must not block and may be
+	// nil.
+	OnBlocked func(host string, client net.IP, reason dnsfilter.Reason)
+
+	// OnProtectionChanged is called when the protection is enabled or
+	// disabled via the HTTP API.  It must not block and may be nil.
+	OnProtectionChanged func(enabled bool)
+
+	// OnUpstreamsChanged is called when the upstream servers are changed via
+	// the HTTP API.  It must not block and may be nil.
+	OnUpstreamsChanged func()
+
+	// OnHijackChanged is called when a plain DNS upstream becomes hijacked
+	// by the network or stops being hijacked.  It must not block and may be
+	// nil.
+	OnHijackChanged func(e HijackEvent)
+
+	// FilterListName returns the name of the filter list with id.  It's
+	// used as the extra text of the Extended DNS Errors and may be nil.
+	FilterListName func(id int64) (name string)
+
+	// SafeMode disables the filtering, the rewrites, the access control,
+	// and the custom upstreams, so that the system resolvers are used as
+	// the upstreams.  It's used to recover from a broken configuration.
+	SafeMode bool
+
 	// LocalPTRResolvers is a slice of addresses to be used as upstreams for
 	// resolving PTR queries for local addresses.
 	LocalPTRResolvers []string
+
+	// LastKnownUpstreams are the upstream servers which have been used
+	// before.  They are used when the configured ones can't be loaded or
+	// parsed.
+	LastKnownUpstreams []string
 }
 
 // if any of ServerConfig values are zero, then default values from below are used
@@ -171,7 +415,7 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		UDPListenAddr:          s.conf.UDPListenAddrs,
 		TCPListenAddr:          s.conf.TCPListenAddrs,
 		Ratelimit:              int(s.conf.Ratelimit),
-		RatelimitWhitelist:     s.conf.RatelimitWhitelist,
+		RatelimitWhitelist:     s.ratelimitWhitelist(),
 		RefuseAny:              s.conf.RefuseAny,
 		CacheMinTTL:            s.conf.CacheMinTTL,
 		CacheMaxTTL:            s.conf.CacheMaxTTL,
@@ -182,6 +426,11 @@ func (s *Server) createProxyConfig() (proxy.Config, error) {
 		MaxGoroutines:          int(s.conf.MaxGoroutines),
 	}
 
+	if s.ingress != nil {
+		// The pools limit the requests instead.
+		proxyConfig.MaxGoroutines = 0
+	}
+
 	if s.conf.CacheSize != 0 {
 		proxyConfig.CacheEnabled = true
 		proxyConfig.CacheSizeBytes = int(s.conf.CacheSize)
@@ -258,6 +507,80 @@ func (s *Server) initDefaultSettings() {
 	}
 }
 
+// loadUpstreams returns the upstream lines either from the file or from the
+// settings.  Comments and empty lines are removed.
+func (s *Server) loadUpstreams() (upstreams []string, err error) {
+	if s.conf.UpstreamDNSFileName == "" {
+		return aghstrings.FilterOut(s.conf.UpstreamDNS, aghstrings.IsCommentOrEmpty), nil
+	}
+
+	data, err := ioutil.ReadFile(s.conf.UpstreamDNSFileName)
+	if err != nil {
+		return nil, err
+	}
+
+	d := string(data)
+	for len(d) != 0 {
+		upstreams = append(upstreams, aghstrings.SplitNext(&d, '\n'))
+	}
+
+	log.Debug("dns: using %d upstream servers from file %s", len(upstreams), s.conf.UpstreamDNSFileName)
+
+	return aghstrings.FilterOut(upstreams, aghstrings.IsCommentOrEmpty), nil
+}
+
+// safeModeUpstreams returns the system resolvers except the addresses of s
+// itself.  If there are none, the default upstreams are returned.
+func (s *Server) safeModeUpstreams() (upstreams []string, err error) {
+	sysRes, err := aghnet.NewSystemResolvers(0, nil)
+	if err != nil {
+		return nil, fmt.Errorf("getting system resolvers: %w", err)
+	}
+
+	ourAddrs, err := s.collectDNSIPAddrs()
+	if err != nil {
+		return nil, err
+	}
+
+	ourAddrsSet := aghstrings.NewSet(ourAddrs...)
+	upstreams = aghstrings.FilterOut(sysRes.Get(), func(s string) (ok bool) {
+		return ourAddrsSet.Has(s)
+	})
+	if len(upstreams) == 0 {
+		upstreams = defaultDNS
+	}
+
+	log.Info("dns: safe mode: using upstreams %v", upstreams)
+
+	return upstreams, nil
+}
+
+// parseUpstreams parses the upstream lines using the bootstrap servers and the
+// options of the single upstreams from the settings.
+func (s *Server) parseUpstreams(upstreams []string) (uc proxy.UpstreamConfig, err error) {
+	opts := upstream.Options{
+		Bootstrap: s.conf.BootstrapDNS,
+		Timeout:   DefaultTimeout,
+	}
+
+	uc, err = proxy.ParseUpstreamsConfig(upstreams, opts)
+	if err != nil {
+		return uc, fmt.Errorf("dns: proxy.ParseUpstreamsConfig: %w", err)
+	}
+
+	err = applyUpstreamOptions(&uc, s.conf.UpstreamOptions, opts)
+	if err != nil {
+		return uc, fmt.Errorf("dns: %w", err)
+	}
+
+	err = s.checkUpstreamLoops(&uc)
+	if err != nil {
+		return uc, fmt.Errorf("dns: %w", err)
+	}
+
+	return uc, nil
+}
+
 // prepareUpstreamSettings - prepares upstream DNS server settings
 func (s *Server) prepareUpstreamSettings() error {
 	// We're setting a customized set of RootCAs
@@ -272,35 +595,43 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstream.CipherSuites = s.conf.TLSCiphers
 	}
 
-	// Load upstreams either from the file, or from the settings
+	err := validateUpstreamOptions(s.conf.UpstreamOptions)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
 	var upstreams []string
-	if s.conf.UpstreamDNSFileName != "" {
-		data, err := ioutil.ReadFile(s.conf.UpstreamDNSFileName)
-		if err != nil {
-			return err
-		}
-		d := string(data)
-		for len(d) != 0 {
-			s := aghstrings.SplitNext(&d, '\n')
-			upstreams = append(upstreams, s)
-		}
-		log.Debug("dns: using %d upstream servers from file %s", len(upstreams), s.conf.UpstreamDNSFileName)
+	if s.conf.SafeMode {
+		upstreams, err = s.safeModeUpstreams()
 	} else {
-		upstreams = s.conf.UpstreamDNS
+		upstreams, err = s.loadUpstreams()
 	}
 
-	upstreams = aghstrings.FilterOut(upstreams, aghstrings.IsCommentOrEmpty)
-	upstreamConfig, err := proxy.ParseUpstreamsConfig(
-		upstreams,
-		upstream.Options{
-			Bootstrap: s.conf.BootstrapDNS,
-			Timeout:   DefaultTimeout,
-		},
-	)
+	var upstreamConfig proxy.UpstreamConfig
+	if err == nil {
+		upstreamConfig, err = s.parseUpstreams(upstreams)
+	}
+
+	fromLastKnown := false
 	if err != nil {
-		return fmt.Errorf("dns: proxy.ParseUpstreamsConfig: %w", err)
+		if len(s.conf.LastKnownUpstreams) == 0 || s.conf.SafeMode {
+			return err
+		}
+
+		log.Error("dns: %s; using the last known good upstreams", err)
+
+		upstreams = aghstrings.FilterOut(s.conf.LastKnownUpstreams, aghstrings.IsCommentOrEmpty)
+		upstreamConfig, err = s.parseUpstreams(upstreams)
+		if err != nil {
+			return fmt.Errorf("dns: parsing last known good upstreams: %w", err)
+		}
+
+		fromLastKnown = true
 	}
 
+	s.upstreams = upstreams
+	s.upstreamsFromLastKnown = fromLastKnown
+
 	if len(upstreamConfig.Upstreams) == 0 {
 		log.Info("warning: no default upstream servers specified, using %v", defaultDNS)
 		var uc proxy.UpstreamConfig
@@ -317,7 +648,39 @@ func (s *Server) prepareUpstreamSettings() error {
 		upstreamConfig.Upstreams = uc.Upstreams
 	}
 
-	s.conf.UpstreamConfig = &upstreamConfig
+	s.outbound, err = newOutboundBinder(&s.conf)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	if s.outbound != nil {
+		var bound *proxy.UpstreamConfig
+		bound, err = s.outbound.bindConfig(&upstreamConfig)
+		if err != nil {
+			return fmt.Errorf("dns: %w", err)
+		}
+
+		upstreamConfig = *bound
+	}
+
+	err = validateTTLOverrides(s.conf.TTLOverrides)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	s.ttlOverrides.set(s.conf.TTLOverrides)
+	s.upstreamTraces.ttls = &s.ttlOverrides
+	s.upstreamTraces.health = &s.health
+	s.upstreamTraces.hijack = &s.hijack
+	s.upstreamMetrics.reset(upstreamAddrs(&upstreamConfig))
+	s.upstreamTraces.metrics = &s.upstreamMetrics
+	s.upstreamTraces.caps = nil
+	if s.conf.CacheSize != 0 {
+		s.cacheCaps.setLimits(s.conf.CacheMaxRecords, s.conf.CacheMaxEntrySize)
+		s.upstreamTraces.caps = &s.cacheCaps
+	}
+
+	s.conf.UpstreamConfig = s.upstreamTraces.wrap(&upstreamConfig)
 	return nil
 }
 
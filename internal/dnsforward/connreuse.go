@@ -0,0 +1,274 @@
+package dnsforward
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// Idle timeouts of the client connections.
+const (
+	// tcpIdleTimeout is the idle timeout of the TCP and DoT connections.
+	// It's the deadline dnsproxy sets before reading each query.
+	tcpIdleTimeout = 10 * time.Second
+
+	// quicIdleTimeout is the idle timeout of the DoQ sessions set by
+	// dnsproxy.
+	quicIdleTimeout = 5 * time.Minute
+
+	// httpsIdleTimeout is the time after which a DoH connection without
+	// requests is considered closed.  dnsproxy doesn't close the idle DoH
+	// connections, so it's the idle timeout of the common HTTP clients.
+	httpsIdleTimeout = 90 * time.Second
+)
+
+// connQueriesBuckets are the upper bounds of the buckets of the histogram of
+// the numbers of the queries received over a single connection.  The last
+// bucket, which isn't listed here, contains the rest.
+var connQueriesBuckets = [...]uint64{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+const (
+	// maxTrackedConns is the maximum number of the simultaneously tracked
+	// connections.  The connections over the limit aren't tracked.
+	maxTrackedConns = 10_000
+
+	// connReuseSweepIvl is the minimum interval between the searches for
+	// the connections which have become idle.
+	connReuseSweepIvl = 10 * time.Second
+)
+
+// idleTimeout returns the time after which a connection over proto without
+// queries is considered closed.
+func idleTimeout(proto string) (d time.Duration) {
+	switch proto {
+	case proxy.ProtoQUIC:
+		return quicIdleTimeout
+	case proxy.ProtoHTTPS:
+		return httpsIdleTimeout
+	default:
+		return tcpIdleTimeout
+	}
+}
+
+// connKey returns the key identifying the connection over which the request
+// in d has been received.  ok is false if the protocol isn't
+// connection-oriented.
+func connKey(d *proxy.DNSContext) (key interface{}, ok bool) {
+	switch d.Proto {
+	case proxy.ProtoTCP, proxy.ProtoTLS:
+		if d.Conn != nil {
+			return d.Conn, true
+		}
+	case proxy.ProtoQUIC:
+		if d.QUICSession != nil {
+			return d.QUICSession, true
+		}
+	case proxy.ProtoHTTPS:
+		// The remote address of an HTTP request is the one of its
+		// connection.
+		if d.HTTPRequest != nil {
+			return d.HTTPRequest.RemoteAddr, true
+		}
+	}
+
+	return nil, false
+}
+
+// trackedConn is a client connection which is considered open.
+type trackedConn struct {
+	last    time.Time
+	proto   string
+	queries uint64
+}
+
+// connQueriesHist is the histogram of the numbers of the queries received over
+// the closed connections of a single protocol.
+type connQueriesHist struct {
+	buckets [len(connQueriesBuckets) + 1]uint64
+
+	// closed is the number of the closed connections.
+	closed uint64
+
+	// queries is the total number of the queries received over the closed
+	// connections.
+	queries uint64
+}
+
+// connReuse tracks the numbers of the queries received over the connections of
+// the connection-oriented protocols.  Since dnsproxy doesn't report the closed
+// connections, a connection is considered closed once it has been idle for
+// longer than its idle timeout.  The zero value is ready to use.
+type connReuse struct {
+	// mu protects all fields.
+	mu sync.Mutex
+
+	conns map[interface{}]*trackedConn
+	hists map[string]*connQueriesHist
+
+	lastSweep time.Time
+
+	// untracked is the number of the connections which haven't been
+	// tracked, since maxTrackedConns has been reached.
+	untracked uint64
+}
+
+// seen records the request in d received at now.
+func (r *connReuse) seen(d *proxy.DNSContext, now time.Time) {
+	key, ok := connKey(d)
+	if !ok {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if now.Sub(r.lastSweep) >= connReuseSweepIvl {
+		r.sweepLocked(now)
+	}
+
+	c, ok := r.conns[key]
+	if !ok {
+		if len(r.conns) >= maxTrackedConns {
+			r.untracked++
+
+			return
+		}
+
+		if r.conns == nil {
+			r.conns = map[interface{}]*trackedConn{}
+		}
+
+		c = &trackedConn{
+			proto: d.Proto,
+		}
+		r.conns[key] = c
+	}
+
+	c.queries++
+	c.last = now
+}
+
+// sweepLocked moves the connections which have been idle for longer than their
+// idle timeout into the histograms.  r.mu is expected to be locked.
+func (r *connReuse) sweepLocked(now time.Time) {
+	r.lastSweep = now
+
+	for key, c := range r.conns {
+		if now.Sub(c.last) <= idleTimeout(c.proto) {
+			continue
+		}
+
+		delete(r.conns, key)
+
+		if r.hists == nil {
+			r.hists = map[string]*connQueriesHist{}
+		}
+
+		h := r.hists[c.proto]
+		if h == nil {
+			h = &connQueriesHist{}
+			r.hists[c.proto] = h
+		}
+
+		i := sort.Search(len(connQueriesBuckets), func(i int) bool {
+			return connQueriesBuckets[i] >= c.queries
+		})
+		h.buckets[i]++
+		h.closed++
+		h.queries += c.queries
+	}
+}
+
+// ConnQueriesBucket is a bucket of the histogram of the numbers of the queries
+// received over a single connection.
+type ConnQueriesBucket struct {
+	// Le is the upper bound of the bucket.  It's nil for the last bucket,
+	// which has no upper bound.
+	Le *uint64 `json:"le"`
+
+	Count uint64 `json:"count"`
+}
+
+// ConnReuseProtoStats are the numbers of the queries received over the
+// connections of a single protocol.
+type ConnReuseProtoStats struct {
+	// Buckets is the histogram of the numbers of the queries received over
+	// the closed connections.
+	Buckets []ConnQueriesBucket `json:"buckets"`
+
+	// Open is the number of the connections considered open.
+	Open int `json:"open"`
+
+	// Closed is the number of the closed connections since the start.
+	Closed uint64 `json:"closed"`
+
+	// MeanQueries is the mean number of the queries received over a closed
+	// connection.
+	MeanQueries float64 `json:"mean_queries"`
+}
+
+// ConnReuseStats are the numbers of the queries received over the connections
+// of the connection-oriented protocols.
+type ConnReuseStats struct {
+	// Protocols are the statistics by the names of the protocols.
+	Protocols map[string]*ConnReuseProtoStats `json:"protocols"`
+
+	// Untracked is the number of the connections which haven't been
+	// tracked since too many connections have been open.
+	Untracked uint64 `json:"untracked"`
+}
+
+// stats returns the statistics of the connections at now.
+func (r *connReuse) stats(now time.Time) (st ConnReuseStats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweepLocked(now)
+
+	st = ConnReuseStats{
+		Protocols: map[string]*ConnReuseProtoStats{},
+		Untracked: r.untracked,
+	}
+
+	protoStats := func(proto string) (ps *ConnReuseProtoStats) {
+		ps = st.Protocols[proto]
+		if ps == nil {
+			ps = &ConnReuseProtoStats{
+				Buckets: make([]ConnQueriesBucket, len(connQueriesBuckets)+1),
+			}
+			for i := range connQueriesBuckets {
+				ps.Buckets[i].Le = &connQueriesBuckets[i]
+			}
+
+			st.Protocols[proto] = ps
+		}
+
+		return ps
+	}
+
+	for proto, h := range r.hists {
+		ps := protoStats(proto)
+		for i, n := range h.buckets {
+			ps.Buckets[i].Count = n
+		}
+
+		ps.Closed = h.closed
+		if h.closed > 0 {
+			ps.MeanQueries = float64(h.queries) / float64(h.closed)
+		}
+	}
+
+	for _, c := range r.conns {
+		protoStats(c.proto).Open++
+	}
+
+	return st
+}
+
+// ConnectionReuse returns the numbers of the queries received over the
+// connections of the connection-oriented protocols.
+func (s *Server) ConnectionReuse() (st ConnReuseStats) {
+	return s.connReuse.stats(time.Now())
+}
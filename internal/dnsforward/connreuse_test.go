@@ -0,0 +1,72 @@
+package dnsforward
+
+import (
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnReuse(t *testing.T) {
+	r := &connReuse{}
+	start := time.Now()
+
+	connA, connB := &net.TCPConn{}, &net.TCPConn{}
+	reqA := &proxy.DNSContext{Proto: proxy.ProtoTLS, Conn: connA}
+	reqB := &proxy.DNSContext{Proto: proxy.ProtoTLS, Conn: connB}
+	reqDoH := &proxy.DNSContext{
+		Proto:       proxy.ProtoHTTPS,
+		HTTPRequest: &http.Request{RemoteAddr: "1.2.3.4:12345"},
+	}
+
+	for i := 0; i < 12; i++ {
+		r.seen(reqA, start.Add(time.Duration(i)*time.Second))
+	}
+	r.seen(reqB, start)
+	r.seen(reqDoH, start)
+	r.seen(reqDoH, start.Add(time.Second))
+
+	// The requests over the connectionless protocols aren't tracked.
+	r.seen(&proxy.DNSContext{Proto: proxy.ProtoUDP}, start)
+
+	st := r.stats(start.Add(5 * time.Second))
+	require.Contains(t, st.Protocols, proxy.ProtoTLS)
+	assert.Equal(t, 2, st.Protocols[proxy.ProtoTLS].Open)
+	assert.Zero(t, st.Protocols[proxy.ProtoTLS].Closed)
+	assert.Equal(t, 1, st.Protocols[proxy.ProtoHTTPS].Open)
+	assert.NotContains(t, st.Protocols, proxy.ProtoUDP)
+
+	// Connection B has been idle for longer than the idle timeout, while
+	// connection A has kept receiving the queries.
+	st = r.stats(start.Add(tcpIdleTimeout + 2*time.Second))
+
+	dot := st.Protocols[proxy.ProtoTLS]
+	require.NotNil(t, dot)
+	assert.Equal(t, 1, dot.Open)
+	assert.Equal(t, uint64(1), dot.Closed)
+	assert.Equal(t, float64(1), dot.MeanQueries)
+	require.Len(t, dot.Buckets, len(connQueriesBuckets)+1)
+	require.NotNil(t, dot.Buckets[0].Le)
+	assert.Equal(t, uint64(1), *dot.Buckets[0].Le)
+	assert.Equal(t, uint64(1), dot.Buckets[0].Count)
+	assert.Nil(t, dot.Buckets[len(connQueriesBuckets)].Le)
+
+	// DoH connections have a longer idle timeout.
+	assert.Equal(t, 1, st.Protocols[proxy.ProtoHTTPS].Open)
+
+	st = r.stats(start.Add(time.Hour))
+	dot = st.Protocols[proxy.ProtoTLS]
+	assert.Zero(t, dot.Open)
+	assert.Equal(t, uint64(2), dot.Closed)
+	assert.Equal(t, 6.5, dot.MeanQueries)
+	// 12 queries are within the bucket up to 20.
+	assert.Equal(t, uint64(1), dot.Buckets[4].Count)
+
+	doh := st.Protocols[proxy.ProtoHTTPS]
+	assert.Equal(t, uint64(1), doh.Closed)
+	assert.Equal(t, uint64(1), doh.Buckets[1].Count)
+}
@@ -1,6 +1,7 @@
 package dnsforward
 
 import (
+	"fmt"
 	"net"
 	"strings"
 	"time"
@@ -8,6 +9,7 @@ import (
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -33,6 +35,13 @@ type dnsContext struct {
 	err error
 	// clientID is the clientID from DOH, DOQ, or DOT, if provided.
 	clientID string
+	// clientIP is the address of the client.  For the requests from the
+	// trusted forwarders, it's the address of the original client, if
+	// it's known.
+	clientIP net.IP
+	// clientPort is the source port of the request.  It's zero if the
+	// port of the original client isn't known.
+	clientPort uint16
 	// origQuestion is the question received from the client.  It is set
 	// when the request is modified by rewrites.
 	origQuestion dns.Question
@@ -48,6 +57,49 @@ type dnsContext struct {
 	// isLocalClient shows if client's IP address is from locally-served
 	// network.
 	isLocalClient bool
+	// clientCookie is the client DNS cookie received from the client, if
+	// the cookies are used.
+	clientCookie []byte
+	// reqEDNS shows if the original request from the client contains the
+	// OPT record.
+	reqEDNS bool
+	// reqDO shows if the DNSSEC OK bit of the original request from the
+	// client is set.  Unlike origReqDNSSEC, it's set regardless of the
+	// DNSSEC settings.
+	reqDO bool
+	// reqPadding shows if the original request from the client contains
+	// the padding option.
+	reqPadding bool
+	// reqKeepalive shows if the original request from the client contains
+	// the TCP keepalive option.
+	reqKeepalive bool
+	// upstreamAttempts are the exchanges with the upstream servers made to
+	// resolve the request.
+	upstreamAttempts []querylog.UpstreamAttempt
+	// upstreamElapsed is the total time spent waiting for the upstream
+	// servers.
+	upstreamElapsed time.Duration
+	// ttlOverride is the pattern of the TTL override rule applied to the
+	// response of the upstream server, if any.
+	ttlOverride string
+	// upstreamEDE is the Extended DNS Error option from the response of
+	// the upstream server, if any.
+	upstreamEDE dns.EDNS0
+	// coalesced shows if the request has been answered with the response
+	// to an identical concurrent request.
+	coalesced bool
+	// deadline is the time by which the response must be sent.  It's zero
+	// if the time budget is disabled.
+	deadline time.Time
+	// budgetStage is the stage of the processing at which the time budget
+	// has been exceeded.  It's only meaningful if overBudget is true.
+	budgetStage queryStage
+	// overBudget shows if the request has been answered with SERVFAIL
+	// because the time budget has been exceeded.
+	overBudget bool
+	// slots are the places of the request within the limits of the
+	// requests processed simultaneously.  It may be nil.
+	slots *requestSlots
 }
 
 // resultCode is the result of a request processing function.
@@ -65,14 +117,65 @@ const (
 	resultCodeError
 )
 
+// dropRequest drops the request which can't be processed because of the load.
+func (s *Server) dropRequest(d *proxy.DNSContext) {
+	if d.Proto != proxy.ProtoUDP {
+		// Don't keep the clients of the connection-based protocols
+		// waiting.
+		d.Res = s.genServerFailure(d.Req)
+	}
+}
+
 // handleDNSRequest filters the incoming DNS requests and writes them to the query log
 func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
+	s.RLock()
+	inflight, ingress := s.inflight, s.ingress
+	s.RUnlock()
+
+	s.connReuse.seen(d, time.Now())
+	s.checkFragRetry(d)
+
+	slots := &requestSlots{}
+	defer slots.release()
+
+	if inflight != nil {
+		switch inflight.acquire() {
+		case inflightOK:
+			slots.add(inflight.release)
+		case inflightRefused:
+			log.Debug("dns: too many requests, refusing request from %s", d.Addr)
+			d.Res = s.makeResponseREFUSED(d.Req)
+
+			return nil
+		default:
+			log.Debug("dns: too many requests, dropping request from %s", d.Addr)
+			s.dropRequest(d)
+
+			return nil
+		}
+	}
+
+	if ingress != nil {
+		release, ok := ingress.acquire(d.Proto)
+		if !ok {
+			log.Debug("dns: no free %s workers, dropping request from %s", d.Proto, d.Addr)
+			s.dropRequest(d)
+
+			return nil
+		}
+		slots.add(release)
+	}
+
 	ctx := &dnsContext{
-		srv:       s,
-		proxyCtx:  d,
-		result:    &dnsfilter.Result{},
-		startTime: time.Now(),
+		srv:        s,
+		proxyCtx:   d,
+		result:     &dnsfilter.Result{},
+		startTime:  time.Now(),
+		clientIP:   IPFromAddr(d.Addr),
+		clientPort: portFromAddr(d.Addr),
+		slots:      slots,
 	}
+	ctx.deadline = s.newDeadline(ctx.startTime)
 
 	type modProcessFunc func(ctx *dnsContext) (rc resultCode)
 
@@ -81,36 +184,62 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 	// out of range checking in any of the following functions, because the
 	// (*proxy.Proxy).handleDNSRequest method performs it before calling the
 	// appropriate handler.
-	mods := []modProcessFunc{
-		processInitial,
-		s.processDetermineLocal,
-		s.processInternalHosts,
-		s.processRestrictLocal,
-		s.processInternalIPAddrs,
-		processClientID,
-		processFilteringBeforeRequest,
-		s.processLocalPTR,
-		processUpstream,
-		processDNSSECAfterResponse,
-		processFilteringAfterResponse,
-		s.ipset.process,
-		processQueryLogsAndStats,
-	}
-	for _, process := range mods {
-		r := process(ctx)
-		switch r {
-		case resultCodeSuccess:
-			// continue: call the next filter
-
-		case resultCodeFinish:
-			return nil
+	mods := []struct {
+		process modProcessFunc
+		stage   queryStage
+	}{
+		{s.processForwarder, queryStageRequest},
+		{s.processEDNSOptions, queryStageRequest},
+		{processInitial, queryStageRequest},
+		{s.processDetermineLocal, queryStageRequest},
+		{s.processInternalHosts, queryStageRequest},
+		{s.processRestrictLocal, queryStageRequest},
+		{s.processSelfPTR, queryStageRequest},
+		{s.processInternalIPAddrs, queryStageRequest},
+		{processClientID, queryStageRequest},
+		{s.processAAAADisabled, queryStageRequest},
+		{processFilteringBeforeRequest, queryStageFiltering},
+		{s.processLocalNames, queryStageLocal},
+		{s.processLocalPTR, queryStageLocal},
+		{processUpstream, queryStageUpstream},
+		{processDNSSECAfterResponse, queryStageResponse},
+		{processFilteringAfterResponse, queryStageResponse},
+		{s.processOnBlocked, queryStageResponse},
+		{s.processTarpit, queryStageResponse},
+		{s.ipset.process, queryStageResponse},
+		{s.processResponseLimits, queryStageResponse},
+		{s.processFragmentation, queryStageResponse},
+	}
+
+	rc := resultCodeSuccess
+	for _, m := range mods {
+		rc = m.process(ctx)
+		if s.checkBudget(ctx, m.stage) {
+			// The SERVFAIL response is still written to the query
+			// log and the statistics.
+			rc = resultCodeSuccess
+
+			break
+		} else if rc != resultCodeSuccess {
+			break
+		}
+	}
 
-		case resultCodeError:
-			return ctx.err
+	switch rc {
+	case resultCodeSuccess:
+		processQueryLogsAndStats(ctx)
+	case resultCodeError:
+		if d.Res != nil {
+			s.setDNSSECFlags(ctx)
+			s.setEDNSOptions(ctx)
 		}
+
+		return ctx.err
 	}
 
 	if d.Res != nil {
+		s.setDNSSECFlags(ctx)
+		s.setEDNSOptions(ctx)
 		d.Res.Compress = true // some devices require DNS message compression
 	}
 	return nil
@@ -120,11 +249,6 @@ func (s *Server) handleDNSRequest(_ *proxy.Proxy, d *proxy.DNSContext) error {
 func processInitial(ctx *dnsContext) (rc resultCode) {
 	s := ctx.srv
 	d := ctx.proxyCtx
-	if s.conf.AAAADisabled && d.Req.Question[0].Qtype == dns.TypeAAAA {
-		_ = proxy.CheckDisabledAAAARequest(d, true)
-		return resultCodeFinish
-	}
-
 	if s.conf.OnDNSRequest != nil {
 		s.conf.OnDNSRequest(d)
 	}
@@ -140,18 +264,18 @@ func processInitial(ctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
-func (s *Server) setTableHostToIP(t hostToIPTable) {
+// setDHCPTables replaces both the forward and the reverse tables of DHCP
+// hostnames at once so that no query sees a new A record with an old PTR or
+// vice versa.
+func (s *Server) setDHCPTables(hostToIP hostToIPTable, ipToHost ipToHostTable) {
 	s.tableHostToIPLock.Lock()
 	defer s.tableHostToIPLock.Unlock()
 
-	s.tableHostToIP = t
-}
-
-func (s *Server) setTableIPToHost(t ipToHostTable) {
 	s.tableIPToHostLock.Lock()
 	defer s.tableIPToHostLock.Unlock()
 
-	s.tableIPToHost = t
+	s.tableHostToIP = hostToIP
+	s.tableIPToHost = ipToHost
 }
 
 func (s *Server) onDHCPLeaseChanged(flags int) {
@@ -161,7 +285,8 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 	switch flags {
 	case dhcpd.LeaseChangedAdded,
 		dhcpd.LeaseChangedAddedStatic,
-		dhcpd.LeaseChangedRemovedStatic:
+		dhcpd.LeaseChangedRemovedStatic,
+		dhcpd.LeaseChangedRemovedExpired:
 		// Go on.
 	case dhcpd.LeaseChangedRemovedAll:
 		add = false
@@ -178,6 +303,10 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 		ll := s.dhcpServer.Leases(dhcpd.LeasesAll)
 
 		for _, l := range ll {
+			if l.Hostname == "" {
+				continue
+			}
+
 			// TODO(a.garipov): Remove this after we're finished
 			// with the client hostname validations in the DHCP
 			// server code.
@@ -188,6 +317,8 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 					l.Hostname,
 					err,
 				)
+
+				continue
 			}
 
 			lowhost := strings.ToLower(l.Hostname)
@@ -202,17 +333,18 @@ func (s *Server) onDHCPLeaseChanged(flags int) {
 		log.Debug("dns: added %d A/PTR entries from DHCP", len(ipToHost))
 	}
 
-	s.setTableHostToIP(hostToIP)
-	s.setTableIPToHost(ipToHost)
+	s.setDHCPTables(hostToIP, ipToHost)
 }
 
 // processDetermineLocal determines if the client's IP address is from
-// locally-served network and saves the result into the context.
+// locally-served network and saves the result into the context.  For the
+// requests from the trusted forwarders, the address of the original client is
+// checked, so it must be called after processForwarder.
 func (s *Server) processDetermineLocal(dctx *dnsContext) (rc resultCode) {
 	rc = resultCodeSuccess
 
-	var ip net.IP
-	if ip = IPFromAddr(dctx.proxyCtx.Addr); ip == nil {
+	ip := dctx.clientIP
+	if ip == nil {
 		return rc
 	}
 
@@ -285,17 +417,24 @@ func (s *Server) processInternalHosts(dctx *dnsContext) (rc resultCode) {
 
 	log.Debug("dns: internal record: %s -> %s", q.Name, ip)
 
-	resp := s.makeResponse(req)
-	if q.Qtype == dns.TypeA {
+	dctx.proxyCtx.Res = s.genInternalHostResponse(req, ip)
+
+	return resultCodeSuccess
+}
+
+// genInternalHostResponse returns the response to req for an internal host
+// with ip.  The answer is empty for the AAAA requests.
+func (s *Server) genInternalHostResponse(req *dns.Msg, ip net.IP) (resp *dns.Msg) {
+	resp = s.makeResponse(req)
+	if req.Question[0].Qtype == dns.TypeA {
 		a := &dns.A{
 			Hdr: s.hdr(req, dns.TypeA),
 			A:   ip,
 		}
 		resp.Answer = append(resp.Answer, a)
 	}
-	dctx.proxyCtx.Res = resp
 
-	return resultCodeSuccess
+	return resp
 }
 
 // processRestrictLocal responds with NXDOMAIN to PTR requests for IP addresses
@@ -414,7 +553,9 @@ func (s *Server) processLocalPTR(ctx *dnsContext) (rc resultCode) {
 		return resultCodeSuccess
 	}
 
-	err := s.localResolvers.Resolve(d)
+	err := resolveBudgeted(ctx, func(uctx *dnsContext) (err error) {
+		return s.localResolvers.Resolve(uctx.proxyCtx)
+	})
 	if err != nil {
 		ctx.err = err
 
@@ -430,6 +571,39 @@ func (s *Server) processLocalPTR(ctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
+// processAAAADisabled responds to AAAA requests with an empty NOERROR
+// response if resolving IPv6 addresses is disabled either globally or for the
+// client.  Such requests are still written to the query log and statistics.
+func (s *Server) processAAAADisabled(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	if d.Res != nil || d.Req.Question[0].Qtype != dns.TypeAAAA {
+		return resultCodeSuccess
+	}
+
+	s.RLock()
+	disabled := s.conf.AAAADisabled
+	if s.dnsFilter != nil {
+		if ctx.setts == nil {
+			ctx.setts = s.getClientRequestFilteringSettings(ctx)
+		}
+
+		disabled = ctx.setts.AAAADisabled
+	}
+	s.RUnlock()
+
+	if !disabled {
+		return resultCodeSuccess
+	}
+
+	_ = proxy.CheckDisabledAAAARequest(d, true)
+	ctx.result = &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.FilteredAAAADisabled,
+	}
+
+	return resultCodeSuccess
+}
+
 // Apply filtering logic
 func processFilteringBeforeRequest(ctx *dnsContext) (rc resultCode) {
 	s := ctx.srv
@@ -448,7 +622,7 @@ func processFilteringBeforeRequest(ctx *dnsContext) (rc resultCode) {
 	//  (to prevent from hanging while waiting for unresponsive DNS server to respond).
 
 	var err error
-	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil
+	ctx.protectionEnabled = s.conf.ProtectionEnabled && s.dnsFilter != nil && !s.conf.SafeMode
 	if ctx.protectionEnabled {
 		if ctx.setts == nil {
 			ctx.setts = s.getClientRequestFilteringSettings(ctx)
@@ -474,12 +648,29 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 		return resultCodeSuccess // response is already set - nothing to do
 	}
 
-	if d.Addr != nil && s.conf.GetCustomUpstreamByClient != nil {
-		clientIP := IPStringFromAddr(d.Addr)
+	if ctx.clientIP != nil && s.conf.GetCustomUpstreamByClient != nil && !s.conf.SafeMode {
+		clientIP := ctx.clientIP.String()
 		upstreamsConf := s.conf.GetCustomUpstreamByClient(clientIP)
 		if upstreamsConf != nil {
 			log.Debug("Using custom upstreams for %s", clientIP)
-			d.CustomUpstreamConfig = upstreamsConf
+			if s.outbound != nil {
+				var err error
+				upstreamsConf, err = s.outbound.bindConfig(upstreamsConf)
+				if err != nil {
+					ctx.err = fmt.Errorf("binding custom upstreams: %w", err)
+
+					return resultCodeError
+				}
+			}
+
+			d.CustomUpstreamConfig = s.upstreamTraces.wrap(upstreamsConf)
+		}
+	}
+
+	stripDO := s.conf.StripDNSSECOK && !s.conf.EnableDNSSEC
+	if stripDO {
+		if opt := d.Req.IsEdns0(); opt != nil {
+			opt.SetDo(false)
 		}
 	}
 
@@ -496,7 +687,37 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 	}
 
 	// request was not filtered so let it be processed further
-	err := s.dnsProxy.Resolve(d)
+	var key coalesceKey
+	var call *coalescedCall
+	if c := s.coalescer; c != nil {
+		var leader bool
+		key = newCoalesceKey(ctx)
+		call, leader = c.join(key)
+		if !leader {
+			return processCoalesced(ctx, call)
+		}
+	}
+
+	err := resolveBudgeted(ctx, func(uctx *dnsContext) (err error) {
+		ud := uctx.proxyCtx
+
+		untag := s.tagLoop(uctx)
+		var trace *upstreamTrace
+		trace, err = s.resolve(s.dnsProxy, ud, stripDO)
+		untag()
+
+		uctx.upstreamAttempts, uctx.upstreamElapsed = trace.result()
+		uctx.ttlOverride = trace.ttlOverridePattern()
+		uctx.upstreamEDE = trace.edeOption()
+		if call != nil {
+			// Finish the call even if the deadline of this request
+			// is exceeded, since the identical requests may have the
+			// later ones.
+			s.coalescer.finish(key, call, ud.Res, ud.Upstream, uctx.ttlOverride, err)
+		}
+
+		return err
+	})
 	if err != nil {
 		ctx.err = err
 		return resultCodeError
@@ -506,6 +727,32 @@ func processUpstream(ctx *dnsContext) (rc resultCode) {
 	return resultCodeSuccess
 }
 
+// processCoalesced waits for call resolving the request identical to the one
+// from ctx and uses its response.
+func processCoalesced(ctx *dnsContext, call *coalescedCall) (rc resultCode) {
+	d := ctx.proxyCtx
+	if !ctx.wait(call.done) {
+		ctx.err = errBudgetExceeded
+
+		return resultCodeError
+	}
+
+	ctx.coalesced = true
+	if call.err != nil {
+		ctx.err = call.err
+		d.Res = ctx.srv.genServerFailure(d.Req)
+
+		return resultCodeError
+	}
+
+	d.Res = call.reply(d.Req)
+	d.Upstream = call.upstream
+	ctx.ttlOverride = call.ttlOverride
+	ctx.responseFromUpstream = true
+
+	return resultCodeSuccess
+}
+
 // Process DNSSEC after response from upstream server
 func processDNSSECAfterResponse(ctx *dnsContext) (rc resultCode) {
 	d := ctx.proxyCtx
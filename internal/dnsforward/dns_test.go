@@ -44,6 +44,7 @@ func TestServer_ProcessDetermineLocal(t *testing.T) {
 			}
 			dctx := &dnsContext{
 				proxyCtx: proxyCtx,
+				clientIP: IPFromAddr(proxyCtx.Addr),
 			}
 			s.processDetermineLocal(dctx)
 
@@ -52,6 +53,66 @@ func TestServer_ProcessDetermineLocal(t *testing.T) {
 	}
 }
 
+func TestServer_ProcessDetermineLocal_forwarder(t *testing.T) {
+	snd, err := aghnet.NewSubnetDetector()
+	require.NoError(t, err)
+
+	localIP := net.IP{192, 168, 0, 1}
+	externalIP := net.IP{250, 249, 0, 1}
+
+	testCases := []struct {
+		name    string
+		fwdIP   net.IP
+		innerIP net.IP
+		want    bool
+	}{{
+		name:    "local_forwarder",
+		fwdIP:   localIP,
+		innerIP: externalIP,
+		want:    false,
+	}, {
+		name:    "external_forwarder",
+		fwdIP:   externalIP,
+		innerIP: localIP,
+		want:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			tf, tfErr := newTrustedForwarders([]string{tc.fwdIP.String()}, 0)
+			require.NoError(t, tfErr)
+
+			s := &Server{
+				subnetDetector: snd,
+				forwarders:     tf,
+			}
+
+			req := createGoogleATestMessage()
+			req.SetEdns0(dns.DefaultMsgSize, false)
+			opt := req.IsEdns0()
+			opt.Option = []dns.EDNS0{newTestECS(tc.innerIP, 32)}
+
+			proxyCtx := &proxy.DNSContext{
+				Req: req,
+				Addr: &net.UDPAddr{
+					IP: tc.fwdIP,
+				},
+			}
+			dctx := &dnsContext{
+				proxyCtx: proxyCtx,
+				clientIP: IPFromAddr(proxyCtx.Addr),
+			}
+
+			require.Equal(t, resultCodeSuccess, s.processForwarder(dctx))
+			require.Equal(t, tc.innerIP, dctx.clientIP)
+
+			s.processDetermineLocal(dctx)
+
+			assert.Equal(t, tc.want, dctx.isLocalClient)
+		})
+	}
+}
+
 func TestServer_ProcessInternalHosts_localRestriction(t *testing.T) {
 	knownIP := net.IP{1, 2, 3, 4}
 
@@ -327,3 +388,114 @@ func TestLocalRestriction(t *testing.T) {
 		})
 	}
 }
+
+func TestServer_ProcessAAAADisabled(t *testing.T) {
+	const host = "example.com."
+
+	testCases := []struct {
+		name     string
+		qtype    uint16
+		disabled bool
+		wantRes  bool
+	}{{
+		name:     "aaaa_disabled",
+		qtype:    dns.TypeAAAA,
+		disabled: true,
+		wantRes:  true,
+	}, {
+		name:     "aaaa_enabled",
+		qtype:    dns.TypeAAAA,
+		disabled: false,
+		wantRes:  false,
+	}, {
+		name:     "a_disabled",
+		qtype:    dns.TypeA,
+		disabled: true,
+		wantRes:  false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			s.conf.AAAADisabled = tc.disabled
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessageWithType(host, tc.qtype),
+				},
+				result: &dnsfilter.Result{},
+			}
+
+			res := s.processAAAADisabled(dctx)
+			require.Equal(t, resultCodeSuccess, res)
+
+			if !tc.wantRes {
+				assert.Nil(t, dctx.proxyCtx.Res)
+				assert.Equal(t, dnsfilter.NotFilteredNotFound, dctx.result.Reason)
+
+				return
+			}
+
+			pctxRes := dctx.proxyCtx.Res
+			require.NotNil(t, pctxRes)
+			assert.Equal(t, dns.RcodeSuccess, pctxRes.Rcode)
+			assert.Empty(t, pctxRes.Answer)
+			assert.Equal(t, dnsfilter.FilteredAAAADisabled, dctx.result.Reason)
+		})
+	}
+}
+
+func TestServer_ProcessAAAADisabled_client(t *testing.T) {
+	disabledIP := net.IP{1, 2, 3, 4}
+	enabledIP := net.IP{1, 2, 3, 5}
+
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			AAAADisabled: true,
+			FilterHandler: func(ip net.IP, _ string, setts *dnsfilter.FilteringSettings) {
+				setts.AAAADisabled = ip.Equal(disabledIP)
+			},
+		},
+	}, nil)
+
+	testCases := []struct {
+		ip      net.IP
+		name    string
+		wantRes bool
+	}{{
+		ip:      disabledIP,
+		name:    "client_disabled",
+		wantRes: true,
+	}, {
+		ip:      enabledIP,
+		name:    "client_enabled",
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessageWithType("example.com.", dns.TypeAAAA),
+				},
+				result:   &dnsfilter.Result{},
+				clientIP: tc.ip,
+			}
+
+			res := s.processAAAADisabled(dctx)
+			require.Equal(t, resultCodeSuccess, res)
+
+			if !tc.wantRes {
+				assert.Nil(t, dctx.proxyCtx.Res)
+
+				return
+			}
+
+			require.NotNil(t, dctx.proxyCtx.Res)
+			assert.Empty(t, dctx.proxyCtx.Res.Answer)
+			assert.Equal(t, dnsfilter.FilteredAAAADisabled, dctx.result.Reason)
+		})
+	}
+}
@@ -63,6 +63,25 @@ type ipToHostTable = map[string]string
 //
 // The zero Server is empty and ready for use.
 type Server struct {
+	// loops is the number of the detected forwarding loops.  It's accessed
+	// atomically, so it's the first field to be 64-bit aligned.
+	loops uint64
+
+	// truncatedForced and bytesLimited are the numbers of the responses
+	// truncated because of their size and because of the response bytes
+	// rate limit.  They're accessed atomically.
+	truncatedForced uint64
+	bytesLimited    uint64
+
+	// tarpitted is the number of the blocked responses delayed by the
+	// tarpit.  It's accessed atomically.
+	tarpitted uint64
+
+	// budgetExceeded are the numbers of the requests which have exceeded
+	// the time budget by the stages of the processing.  They're accessed
+	// atomically.
+	budgetExceeded [queryStageNum]uint64
+
 	dnsProxy   *proxy.Proxy          // DNS proxy instance
 	dnsFilter  *dnsfilter.DNSFilter  // DNS filter instance
 	dhcpServer dhcpd.ServerInterface // DHCP server instance (optional)
@@ -90,6 +109,120 @@ type Server struct {
 
 	isRunning bool
 
+	// upstreams are the lines of the upstream servers which are currently
+	// used.
+	upstreams []string
+
+	// upstreamsFromLastKnown is true if upstreams have been taken from
+	// ServerConfig.LastKnownUpstreams.
+	upstreamsFromLastKnown bool
+
+	// edns counts the EDNS(0) options received from the clients.
+	edns ednsCounters
+
+	// upstreamTraces are the records of the exchanges with the upstream
+	// servers made for the requests being resolved.
+	upstreamTraces upstreamTraces
+
+	// ttlOverrides are the TTL override rules applied to the responses of
+	// the upstream servers.
+	ttlOverrides ttlOverrides
+
+	// cacheCaps are the caps on the responses of the upstream servers
+	// stored in the cache.
+	cacheCaps cacheCaps
+
+	// cacheIndex is the index of the responses stored in the cache of
+	// dnsProxy.
+	cacheIndex cacheIndex
+
+	// outbound binds the connections to the upstream servers to the
+	// configured interface or source address.  It's nil if there are no
+	// such settings.
+	outbound *outboundBinder
+
+	// bytesLimiter limits the bytes of the UDP responses sent to each
+	// client per second.  It's nil if there is no limit.
+	bytesLimiter *bytesLimiter
+
+	// tarpit delays the blocked responses to the clients repeating the
+	// blocked requests too often.  It's nil if it's disabled.
+	tarpit *tarpit
+
+	// benchmarking is 1 if an upstream benchmark is in progress.  It's
+	// accessed atomically.
+	benchmarking uint32
+
+	// inflight limits the number of the requests processed simultaneously.
+	// It's nil if there is no limit.
+	inflight *inflightLimiter
+
+	// coalescer coalesces the identical concurrent requests.  It's nil if
+	// the coalescing is disabled.
+	coalescer *coalescer
+
+	// ingress are the worker pools of the ingress protocols.  It's nil if
+	// they aren't configured.
+	ingress *ingressPools
+
+	// unix serves the requests received via the UNIX socket.  It's nil if
+	// the listener is disabled.
+	unix *unixServer
+
+	// inheritedFiles are the sockets of the plain DNS listeners received
+	// from the process which has restarted this one.  They're served from
+	// the next start.
+	inheritedFiles []*os.File
+
+	// inherited serves the requests received via the inherited sockets.
+	// It's nil if there are none.
+	inherited *inheritedServer
+
+	// blockedSOA is the configuration of the SOA record in the negative
+	// responses with the defaults filled in.
+	blockedSOA BlockedResponseSOA
+
+	// self is the data for answering the PTR requests for the addresses of
+	// the server itself.
+	self *selfPTR
+
+	// connReuse tracks the numbers of the queries received over the
+	// connections of the connection-oriented protocols.
+	connReuse connReuse
+
+	// frag detects the dropped fragmented UDP responses.
+	frag fragDetector
+
+	// health is the health of the upstream servers.
+	health upstreamHealth
+
+	// upstreamMetrics are the metrics of the exchanges with the upstream
+	// servers.
+	upstreamMetrics upstreamMetrics
+
+	// probeTargets are the configured upstream servers to probe.
+	probeTargets []*probeTarget
+
+	// prober probes probeTargets.  It's nil if the probes are disabled.
+	prober *upstreamProber
+
+	// hijack detects the interception of the DNS traffic to the plain DNS
+	// upstreams.
+	hijack hijackDetector
+
+	// warmup fills the cache after the start.
+	warmup cacheWarmup
+
+	// forwarders are the trusted forwarders.  It's nil if there are none.
+	forwarders *trustedForwarders
+
+	// cookieSecret is the secret used to generate the server DNS cookies.
+	cookieSecret []byte
+
+	// loopTag is the data of the EDNS(0) option tagging the queries sent
+	// upstream.  If it's empty, the queries aren't tagged.
+	loopTag []byte
+
 	sync.RWMutex
 	conf ServerConfig
 }
@@ -144,6 +277,16 @@ func NewServer(p DNSCreateParams) (s *Server, err error) {
 		localDomainSuffix: localDomainSuffix,
 	}
 
+	s.cookieSecret, err = newCookieSecret()
+	if err != nil {
+		return nil, fmt.Errorf("generating cookie secret: %w", err)
+	}
+
+	s.loopTag, err = newLoopTag()
+	if err != nil {
+		return nil, fmt.Errorf("generating loop tag: %w", err)
+	}
+
 	if p.DHCPServer != nil {
 		s.dhcpServer = p.DHCPServer
 		s.dhcpServer.SetOnLeaseChanged(s.onDHCPLeaseChanged)
@@ -184,12 +327,23 @@ func (s *Server) Close() {
 	s.Unlock()
 }
 
+// Upstreams returns the lines of the upstream servers which are currently used.
+// fromLastKnown is true if those are the last known good upstreams instead of
+// the configured ones.
+func (s *Server) Upstreams() (upstreams []string, fromLastKnown bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	return aghstrings.CloneSlice(s.upstreams), s.upstreamsFromLastKnown
+}
+
 // WriteDiskConfig - write configuration
 func (s *Server) WriteDiskConfig(c *FilteringConfig) {
 	s.RLock()
 	sc := s.conf.FilteringConfig
 	*c = sc
 	c.RatelimitWhitelist = aghstrings.CloneSlice(sc.RatelimitWhitelist)
+	c.TrustedForwarders = aghstrings.CloneSlice(sc.TrustedForwarders)
 	c.BootstrapDNS = aghstrings.CloneSlice(sc.BootstrapDNS)
 	c.AllowedClients = aghstrings.CloneSlice(sc.AllowedClients)
 	c.DisallowedClients = aghstrings.CloneSlice(sc.DisallowedClients)
@@ -294,11 +448,80 @@ func (s *Server) Start() error {
 
 // startLocked starts the DNS server without locking. For internal use only.
 func (s *Server) startLocked() error {
-	err := s.dnsProxy.Start()
-	if err == nil {
-		s.isRunning = true
+	err := s.startProxy()
+	if err != nil {
+		return err
 	}
-	return err
+
+	if s.unix != nil {
+		err = s.unix.start()
+		if err != nil {
+			_ = s.stopProxy()
+
+			return fmt.Errorf("dns: %w", err)
+		}
+	}
+
+	s.isRunning = true
+	s.prober.start()
+	s.hijack.start()
+
+	return nil
+}
+
+// startProxy starts the DNS proxy and serving the inherited sockets, if any.
+// The proxy doesn't listen on the addresses of the inherited sockets, and it's
+// only initialized for resolving if there are no other addresses, since it
+// can't start without listeners.
+func (s *Server) startProxy() (err error) {
+	s.inherited = newInheritedServer(s, s.inheritedFiles)
+	s.inheritedFiles = nil
+	if s.inherited == nil {
+		return s.dnsProxy.Start()
+	}
+
+	c := &s.dnsProxy.Config
+	c.UDPListenAddr, c.TCPListenAddr = s.inherited.uninherited(s.conf.UDPListenAddrs, s.conf.TCPListenAddrs)
+	if len(c.UDPListenAddr) > 0 ||
+		len(c.TCPListenAddr) > 0 ||
+		len(c.TLSListenAddr) > 0 ||
+		len(c.HTTPSListenAddr) > 0 ||
+		len(c.QUICListenAddr) > 0 ||
+		len(c.DNSCryptUDPListenAddr) > 0 ||
+		len(c.DNSCryptTCPListenAddr) > 0 {
+		err = s.dnsProxy.Start()
+	} else {
+		err = s.dnsProxy.Init()
+	}
+	if err != nil {
+		s.closeInherited()
+
+		return err
+	}
+
+	s.inherited.start()
+
+	return nil
+}
+
+// closeInherited stops serving the inherited sockets, if any, so that the DNS
+// proxy listens on all addresses from the next start.
+func (s *Server) closeInherited() {
+	if s.inherited == nil {
+		return
+	}
+
+	s.inherited.close()
+	s.inherited = nil
+	s.dnsProxy.UDPListenAddr = s.conf.UDPListenAddrs
+	s.dnsProxy.TCPListenAddr = s.conf.TCPListenAddrs
+}
+
+// stopProxy stops the DNS proxy and serving the inherited sockets, if any.
+func (s *Server) stopProxy() (err error) {
+	s.closeInherited()
+
+	return s.dnsProxy.Stop()
 }
 
 // defaultLocalTimeout is the default timeout for resolving addresses from
@@ -437,6 +660,56 @@ func (s *Server) Prepare(config *ServerConfig) error {
 		return err
 	}
 
+	err = s.prepareProber()
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	err = s.prepareHijack()
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	err = validateEDNSPadding(&s.conf.FilteringConfig)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	s.inflight = newInflightLimiter(&s.conf.FilteringConfig)
+	s.coalescer = newCoalescer(s.conf.CoalesceQueries)
+
+	s.ingress, err = newIngressPools(s.conf.IngressPools)
+	if err != nil {
+		return err
+	}
+
+	s.unix, err = newUnixServer(s, s.conf.UnixSocket)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	// Use the defaults if the hostname can't be got.
+	hostname, _ := os.Hostname()
+	s.blockedSOA, err = newBlockedSOA(s.conf.BlockedResponseSOA, s.conf.BlockedResponseTTL, hostname)
+	if err != nil {
+		return fmt.Errorf("dns: blocked response soa: %w", err)
+	}
+
+	err = s.prepareSelfPTR(hostname)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	s.forwarders, err = newTrustedForwarders(s.conf.TrustedForwarders, s.conf.ForwarderClientOption)
+	if err != nil {
+		return fmt.Errorf("dns: %w", err)
+	}
+
+	// The limiter uses the same allowlist as the requests rate limit, which
+	// includes the trusted forwarders.
+	s.bytesLimiter = newBytesLimiter(s.conf.ResponseBytesRatelimit, s.ratelimitWhitelist())
+	s.tarpit = newTarpit(s.conf.TarpitThreshold, s.conf.TarpitMaxDelayMs)
+
 	// Create DNS proxy configuration
 	// --
 	var proxyConfig proxy.Config
@@ -465,6 +738,14 @@ func (s *Server) Prepare(config *ServerConfig) error {
 	// --
 	s.dnsProxy = &proxy.Proxy{Config: proxyConfig}
 
+	// The responses with the EDNS Client Subnet option are stored in a
+	// separate cache of the same size.
+	cacheSize := uint64(proxyConfig.CacheSizeBytes)
+	if proxyConfig.EnableEDNSClientSubnet {
+		cacheSize *= 2
+	}
+	s.cacheIndex.reset(cacheSize)
+
 	err = s.setupResolvers(s.conf.LocalPTRResolvers)
 	if err != nil {
 		return fmt.Errorf("setting up resolvers: %w", err)
@@ -482,8 +763,19 @@ func (s *Server) Stop() error {
 
 // stopLocked stops the DNS server without locking. For internal use only.
 func (s *Server) stopLocked() error {
+	s.prober.stop()
+	s.hijack.stop()
+	s.warmup.abort("dns server stopped")
+
+	if s.unix != nil && s.isRunning {
+		err := s.unix.stop()
+		if err != nil {
+			log.Error("dns: %s", err)
+		}
+	}
+
 	if s.dnsProxy != nil {
-		err := s.dnsProxy.Stop()
+		err := s.stopProxy()
 		if err != nil {
 			return fmt.Errorf("could not stop the DNS server properly: %w", err)
 		}
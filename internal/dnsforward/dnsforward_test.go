@@ -13,6 +13,7 @@ import (
 	"math/big"
 	"net"
 	"os"
+	"path/filepath"
 	"sort"
 	"sync"
 	"testing"
@@ -485,29 +486,58 @@ func TestInvalidRequest(t *testing.T) {
 	assert.NoErrorf(t, err, "got a response to an invalid query")
 }
 
-func TestBlockedRequest(t *testing.T) {
+func TestServer_safeMode(t *testing.T) {
 	forwardConf := ServerConfig{
 		UDPListenAddrs: []*net.UDPAddr{{}},
 		TCPListenAddrs: []*net.TCPAddr{{}},
 		FilteringConfig: FilteringConfig{
 			ProtectionEnabled: true,
+			BlockedHosts:      []string{"blocked.example.org"},
 		},
+		SafeMode: true,
 	}
 	s := createTestServer(t, &dnsfilter.Config{}, forwardConf, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"nxdomain.example.org.": {{192, 168, 0, 1}},
+				"blocked.example.org.":  {{192, 168, 0, 2}},
+			},
+		},
+	}
+	s.conf.GetCustomUpstreamByClient = func(_ string) *proxy.UpstreamConfig {
+		panic("custom upstreams must not be used in safe mode")
+	}
 	startDeferStop(t, s)
 
 	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
 
-	// Default blocking.
-	req := createTestMessage("nxdomain.example.org.")
+	testCases := []struct {
+		name string
+		host string
+		want net.IP
+	}{{
+		name: "filtering",
+		host: "nxdomain.example.org.",
+		want: net.IP{192, 168, 0, 1},
+	}, {
+		name: "access",
+		host: "blocked.example.org.",
+		want: net.IP{192, 168, 0, 2},
+	}}
 
-	reply, err := dns.Exchange(req, addr.String())
-	require.NoErrorf(t, err, "couldn't talk to server %s: %s", addr, err)
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			reply, err := dns.Exchange(createTestMessage(tc.host), addr.String())
+			require.NoError(t, err)
 
-	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
+			require.Len(t, reply.Answer, 1)
+			a, ok := reply.Answer[0].(*dns.A)
+			require.True(t, ok)
 
-	require.Len(t, reply.Answer, 1)
-	assert.True(t, reply.Answer[0].(*dns.A).A.IsUnspecified())
+			assert.Equal(t, tc.want, a.A.To4())
+		})
+	}
 }
 
 func TestServerCustomClientUpstream(t *testing.T) {
@@ -547,6 +577,45 @@ func TestServerCustomClientUpstream(t *testing.T) {
 	assert.Equal(t, net.IP{192, 168, 0, 1}, reply.Answer[0].(*dns.A).A)
 }
 
+func TestServer_LastKnownUpstreams(t *testing.T) {
+	forwardConf := ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			UpstreamDNS: []string{"1.1.1.1"},
+		},
+	}
+
+	t.Run("configured", func(t *testing.T) {
+		conf := forwardConf
+		conf.LastKnownUpstreams = []string{"8.8.8.8"}
+		s := createTestServer(t, &dnsfilter.Config{}, conf, nil)
+
+		ups, fromLastKnown := s.Upstreams()
+		assert.Equal(t, []string{"1.1.1.1"}, ups)
+		assert.False(t, fromLastKnown)
+	})
+
+	conf := forwardConf
+	conf.UpstreamDNSFileName = filepath.Join(t.TempDir(), "nonexistent")
+
+	t.Run("no_last_known", func(t *testing.T) {
+		s, err := NewServer(DNSCreateParams{})
+		require.NoError(t, err)
+
+		assert.Error(t, s.Prepare(&conf))
+	})
+
+	t.Run("last_known", func(t *testing.T) {
+		conf.LastKnownUpstreams = []string{"# comment", "8.8.8.8"}
+		s := createTestServer(t, &dnsfilter.Config{}, conf, nil)
+
+		ups, fromLastKnown := s.Upstreams()
+		assert.Equal(t, []string{"8.8.8.8"}, ups)
+		assert.True(t, fromLastKnown)
+	})
+}
+
 // testCNAMEs is a map of names and CNAMEs necessary for the TestUpstream work.
 var testCNAMEs = map[string]string{
 	"badhost.":               "null.example.org.",
@@ -689,106 +758,6 @@ func TestClientRulesForCNAMEMatching(t *testing.T) {
 	assert.Equal(t, dns.RcodeSuccess, reply.Rcode)
 }
 
-func TestNullBlockedRequest(t *testing.T) {
-	forwardConf := ServerConfig{
-		UDPListenAddrs: []*net.UDPAddr{{}},
-		TCPListenAddrs: []*net.TCPAddr{{}},
-		FilteringConfig: FilteringConfig{
-			ProtectionEnabled: true,
-			BlockingMode:      "null_ip",
-		},
-	}
-	s := createTestServer(t, &dnsfilter.Config{}, forwardConf, nil)
-	startDeferStop(t, s)
-	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
-
-	// Nil filter blocking.
-	req := dns.Msg{
-		MsgHdr: dns.MsgHdr{
-			Id:               dns.Id(),
-			RecursionDesired: true,
-		},
-		Question: []dns.Question{{
-			Name:   "null.example.org.",
-			Qtype:  dns.TypeA,
-			Qclass: dns.ClassINET,
-		}},
-	}
-
-	reply, err := dns.Exchange(&req, addr.String())
-	require.NoErrorf(t, err, "couldn't talk to server %s: %s", addr, err)
-	require.Lenf(t, reply.Answer, 1, "dns server %s returned reply with wrong number of answers - %d", addr, len(reply.Answer))
-	a, ok := reply.Answer[0].(*dns.A)
-	require.Truef(t, ok, "dns server %s returned wrong answer type instead of A: %v", addr, reply.Answer[0])
-	assert.Truef(t, a.A.IsUnspecified(), "dns server %s returned wrong answer instead of 0.0.0.0: %v", addr, a.A)
-}
-
-func TestBlockedCustomIP(t *testing.T) {
-	rules := "||nxdomain.example.org^\n||null.example.org^\n127.0.0.1	host.example.org\n@@||whitelist.example.org^\n||127.0.0.255\n"
-	filters := []dnsfilter.Filter{{
-		ID:   0,
-		Data: []byte(rules),
-	}}
-
-	snd, err := aghnet.NewSubnetDetector()
-	require.NoError(t, err)
-	require.NotNil(t, snd)
-
-	var s *Server
-	s, err = NewServer(DNSCreateParams{
-		DNSFilter:      dnsfilter.New(&dnsfilter.Config{}, filters),
-		SubnetDetector: snd,
-	})
-	require.NoError(t, err)
-
-	conf := &ServerConfig{
-		UDPListenAddrs: []*net.UDPAddr{{}},
-		TCPListenAddrs: []*net.TCPAddr{{}},
-		FilteringConfig: FilteringConfig{
-			ProtectionEnabled: true,
-			BlockingMode:      "custom_ip",
-			BlockingIPv4:      nil,
-			UpstreamDNS:       []string{"8.8.8.8:53", "8.8.4.4:53"},
-		},
-	}
-
-	// Invalid BlockingIPv4.
-	err = s.Prepare(conf)
-	assert.Error(t, err)
-
-	conf.BlockingIPv4 = net.IP{0, 0, 0, 1}
-	conf.BlockingIPv6 = net.ParseIP("::1")
-
-	err = s.Prepare(conf)
-	require.NoError(t, err)
-
-	startDeferStop(t, s)
-
-	addr := s.dnsProxy.Addr(proxy.ProtoUDP)
-
-	req := createTestMessageWithType("null.example.org.", dns.TypeA)
-	reply, err := dns.Exchange(req, addr.String())
-	require.NoError(t, err)
-
-	require.Len(t, reply.Answer, 1)
-
-	a, ok := reply.Answer[0].(*dns.A)
-	require.True(t, ok)
-
-	assert.True(t, net.IP{0, 0, 0, 1}.Equal(a.A))
-
-	req = createTestMessageWithType("null.example.org.", dns.TypeAAAA)
-	reply, err = dns.Exchange(req, addr.String())
-	require.NoError(t, err)
-
-	require.Len(t, reply.Answer, 1)
-
-	a6, ok := reply.Answer[0].(*dns.AAAA)
-	require.True(t, ok)
-
-	assert.Equal(t, "::1", a6.AAAA.String())
-}
-
 func TestBlockedByHosts(t *testing.T) {
 	forwardConf := ServerConfig{
 		UDPListenAddrs: []*net.UDPAddr{{}},
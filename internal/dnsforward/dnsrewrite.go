@@ -113,3 +113,34 @@ func (s *Server) filterDNSRewrite(req *dns.Msg, res dnsfilter.Result, d *proxy.D
 
 	return nil
 }
+
+// addLocalZoneRecords adds the local zone records from the rewrite result to
+// resp, which is marked as authoritative.  name is the owner name of the
+// records.  If the TTL of the result is configured, it's set for all answers.
+func (s *Server) addLocalZoneRecords(req, resp *dns.Msg, name string, res *dnsfilter.Result) (err error) {
+	resp.Authoritative = true
+
+	if dnsrr := res.DNSRewriteResult; dnsrr != nil {
+		rr := req.Question[0].Qtype
+		for i, v := range dnsrr.Response[rr] {
+			var ans dns.RR
+			ans, err = s.filterDNSRewriteResponse(req, rr, v)
+			if err != nil {
+				return fmt.Errorf("local zone record for %d[%d]: %w", rr, i, err)
+			} else if ans == nil {
+				continue
+			}
+
+			ans.Header().Name = dns.Fqdn(name)
+			resp.Answer = append(resp.Answer, ans)
+		}
+	}
+
+	if res.TTL != 0 {
+		for _, ans := range resp.Answer {
+			ans.Header().Ttl = res.TTL
+		}
+	}
+
+	return nil
+}
@@ -203,3 +203,59 @@ func TestServer_FilterDNSRewrite(t *testing.T) {
 		assert.Equal(t, srvVal.Target, ans.Target)
 	})
 }
+
+func TestServer_AddLocalZoneRecords(t *testing.T) {
+	const name = "_xmpp._tcp.lan"
+
+	srv := &Server{}
+	req := &dns.Msg{
+		Question: []dns.Question{{
+			Name:  dns.Fqdn(name),
+			Qtype: dns.TypeSRV,
+		}},
+	}
+	srvVal := &rules.DNSSRV{
+		Target:   "xmpp.lan",
+		Priority: 10,
+		Weight:   60,
+		Port:     5222,
+	}
+
+	t.Run("records", func(t *testing.T) {
+		resp := srv.makeResponse(req)
+		res := &dnsfilter.Result{
+			Reason: dnsfilter.Rewritten,
+			DNSRewriteResult: &dnsfilter.DNSRewriteResult{
+				Response: dnsfilter.DNSRewriteResultResponse{
+					dns.TypeSRV: []rules.RRValue{srvVal},
+				},
+			},
+			TTL: 300,
+		}
+
+		err := srv.addLocalZoneRecords(req, resp, name, res)
+		require.Nil(t, err)
+
+		assert.True(t, resp.Authoritative)
+		require.Len(t, resp.Answer, 1)
+
+		ans, ok := resp.Answer[0].(*dns.SRV)
+		require.True(t, ok)
+
+		assert.Equal(t, dns.Fqdn(name), ans.Hdr.Name)
+		assert.Equal(t, uint32(300), ans.Hdr.Ttl)
+		assert.Equal(t, srvVal.Port, ans.Port)
+		assert.Equal(t, dns.Fqdn(srvVal.Target), ans.Target)
+	})
+
+	t.Run("no_records", func(t *testing.T) {
+		resp := srv.makeResponse(req)
+		err := srv.addLocalZoneRecords(req, resp, name, &dnsfilter.Result{
+			Reason: dnsfilter.Rewritten,
+		})
+		require.Nil(t, err)
+
+		assert.True(t, resp.Authoritative)
+		assert.Empty(t, resp.Answer)
+	})
+}
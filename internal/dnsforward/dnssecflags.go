@@ -0,0 +1,66 @@
+package dnsforward
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+// isSynthesized returns true if the response to ctx's request is made by
+// AdGuard Home itself instead of being received from an upstream as is.  These
+// are the blocked and rewritten responses and the answers from the local data.
+func isSynthesized(ctx *dnsContext) (ok bool) {
+	if !ctx.responseFromUpstream || ctx.origResp != nil {
+		return true
+	}
+
+	res := ctx.result
+	if res == nil {
+		return false
+	}
+
+	return res.IsFiltered ||
+		res.Reason == dnsfilter.Rewritten ||
+		res.Reason == dnsfilter.RewrittenRule
+}
+
+// setDNSSECFlags brings the DNSSEC-related flags of the response in line with
+// the original request from the client, so that the validating stub resolvers
+// neither treat the responses as bogus nor trust the synthesized ones:
+//
+//   - the CD bit is copied from the request, RFC 4035, section 3.1.6;
+//
+//   - the AD bit is cleared on the synthesized responses, since they have
+//     never been validated, and on the ones to the clients which have set
+//     neither DO nor AD, RFC 6840, section 5.8;
+//
+//   - the response contains the OPT record if, and only if, the request
+//     does, RFC 6891, section 7, and its DO bit is the one of the request,
+//     RFC 3225, section 3.
+func (s *Server) setDNSSECFlags(ctx *dnsContext) {
+	d := ctx.proxyCtx
+	resp := d.Res
+
+	resp.CheckingDisabled = d.Req.CheckingDisabled
+	if isSynthesized(ctx) || !(ctx.reqDO || d.Req.AuthenticatedData) {
+		resp.AuthenticatedData = false
+	}
+
+	if !ctx.reqEDNS {
+		removeOPT(resp)
+
+		return
+	}
+
+	if opt := resp.IsEdns0(); opt != nil {
+		opt.SetDo(ctx.reqDO)
+
+		return
+	}
+
+	size := uint16(dns.MinMsgSize)
+	if reqOpt := d.Req.IsEdns0(); reqOpt != nil {
+		size = reqOpt.UDPSize()
+	}
+
+	resp.SetEdns0(size, ctx.reqDO)
+}
@@ -0,0 +1,202 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// adUpstream is an upstream answering with the authenticated data and
+// remembering the DNSSEC OK bit of the last request.
+type adUpstream struct {
+	// do is 1 if the DNSSEC OK bit of the last request is set.  It's
+	// accessed atomically.
+	do uint32
+}
+
+// Exchange implements the upstream.Upstream interface for *adUpstream.
+func (u *adUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	var do uint32
+	if opt := m.IsEdns0(); opt != nil && opt.Do() {
+		do = 1
+	}
+	atomic.StoreUint32(&u.do, do)
+
+	resp = (&dns.Msg{}).SetReply(m)
+	resp.AuthenticatedData = true
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: net.IP{192, 168, 0, 1},
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *adUpstream.
+func (u *adUpstream) Address() (addr string) {
+	return "ad.upstream.example"
+}
+
+// requireValidatingStub checks resp the way a validating stub resolver which
+// has sent req does before accepting it.
+func requireValidatingStub(t *testing.T, req, resp *dns.Msg, wantAD bool) {
+	t.Helper()
+
+	reqOpt := req.IsEdns0()
+	respOpt := resp.IsEdns0()
+	if reqOpt == nil {
+		require.Nil(t, respOpt)
+	} else {
+		require.NotNil(t, respOpt)
+
+		assert.Equal(t, reqOpt.Do(), respOpt.Do())
+	}
+
+	assert.Equal(t, req.CheckingDisabled, resp.CheckingDisabled)
+	assert.Equal(t, wantAD, resp.AuthenticatedData)
+}
+
+func TestServer_setDNSSECFlags(t *testing.T) {
+	newServer := func(t *testing.T, fconf FilteringConfig, ups upstream.Upstream) (addr net.Addr) {
+		t.Helper()
+
+		s := createTestServer(t, &dnsfilter.Config{
+			Rewrites: []dnsfilter.RewriteEntry{{
+				Domain: "rewritten.example.org",
+				Answer: "1.2.3.4",
+				Type:   dns.TypeA,
+			}},
+		}, ServerConfig{
+			UDPListenAddrs:  []*net.UDPAddr{{}},
+			TCPListenAddrs:  []*net.TCPAddr{{}},
+			FilteringConfig: fconf,
+		}, nil)
+		s.conf.UpstreamConfig.Upstreams = s.upstreamTraces.wrapUpstreams([]upstream.Upstream{ups})
+		startDeferStop(t, s)
+
+		return s.dnsProxy.Addr(proxy.ProtoUDP)
+	}
+
+	exchange := func(t *testing.T, addr net.Addr, req *dns.Msg) (resp *dns.Msg) {
+		t.Helper()
+
+		resp, err := dns.Exchange(req, addr.String())
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	addr := newServer(t, FilteringConfig{
+		ProtectionEnabled: true,
+		CacheSize:         1024 * 1024,
+	}, &adUpstream{})
+
+	testCases := []struct {
+		name   string
+		host   string
+		edns   bool
+		do     bool
+		cd     bool
+		ad     bool
+		wantAD bool
+	}{{
+		name:   "blocked",
+		host:   "nxdomain.example.org.",
+		edns:   true,
+		do:     true,
+		cd:     true,
+		wantAD: false,
+	}, {
+		name:   "blocked_no_do",
+		host:   "null.example.org.",
+		edns:   true,
+		wantAD: false,
+	}, {
+		name:   "blocked_no_edns",
+		host:   "nxdomain.example.org.",
+		cd:     true,
+		wantAD: false,
+	}, {
+		name:   "rewritten",
+		host:   "rewritten.example.org.",
+		edns:   true,
+		do:     true,
+		ad:     true,
+		wantAD: false,
+	}, {
+		name:   "upstream",
+		host:   "upstream.example.org.",
+		edns:   true,
+		do:     true,
+		cd:     true,
+		wantAD: true,
+	}, {
+		// The same request is answered from the cache.
+		name:   "cached",
+		host:   "upstream.example.org.",
+		edns:   true,
+		do:     true,
+		cd:     true,
+		wantAD: true,
+	}, {
+		name:   "upstream_ad",
+		host:   "ad.example.org.",
+		ad:     true,
+		wantAD: true,
+	}, {
+		name:   "upstream_no_do_no_ad",
+		host:   "plain.example.org.",
+		edns:   true,
+		wantAD: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createTestMessage(tc.host)
+			req.CheckingDisabled = tc.cd
+			req.AuthenticatedData = tc.ad
+			if tc.edns {
+				req.SetEdns0(dns.DefaultMsgSize, tc.do)
+			}
+
+			resp := exchange(t, addr, req)
+			requireValidatingStub(t, req, resp, tc.wantAD)
+		})
+	}
+
+	for _, cacheSize := range []uint32{0, 1024 * 1024} {
+		// The cache requests the signatures from the upstreams on its
+		// misses, so check the request sent upstream with it too.
+		t.Run(fmt.Sprintf("strip_do_cache_%d", cacheSize), func(t *testing.T) {
+			ups := &adUpstream{}
+			stripAddr := newServer(t, FilteringConfig{
+				ProtectionEnabled: true,
+				StripDNSSECOK:     true,
+				CacheSize:         cacheSize,
+			}, ups)
+
+			req := createTestMessage("strip.example.org.")
+			req.SetEdns0(dns.DefaultMsgSize, true)
+
+			// The upstream response to the request without the DO bit
+			// doesn't authenticate anything for the client.
+			resp := exchange(t, stripAddr, req)
+			requireValidatingStub(t, req, resp, false)
+
+			assert.Zero(t, atomic.LoadUint32(&ups.do))
+		})
+	}
+}
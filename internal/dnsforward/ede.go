@@ -0,0 +1,85 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+// ednsOptionEDE is the code of the Extended DNS Error option, RFC 8914.  The
+// version of github.com/miekg/dns in use doesn't support it, so it's sent as
+// *dns.EDNS0_LOCAL.
+const ednsOptionEDE uint16 = 15
+
+// Extended DNS Error codes, see RFC 8914.
+const (
+	edeOther        uint16 = 0
+	edeBlocked      uint16 = 15
+	edeFiltered     uint16 = 17
+	edeNetworkError uint16 = 23
+)
+
+// edeTextNetworkError is the extra text of the Extended DNS Error sent with the
+// responses generated after the upstreams have failed.
+const edeTextNetworkError = "upstream exchange failed"
+
+// newEDE returns the Extended DNS Error option with the code and the extra
+// text.
+func newEDE(code uint16, text string) (o *dns.EDNS0_LOCAL) {
+	data := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(data, code)
+
+	return &dns.EDNS0_LOCAL{
+		Code: ednsOptionEDE,
+		Data: append(data, text...),
+	}
+}
+
+// filteringEDE returns the Extended DNS Error option describing the blocking of
+// the request by res, if any.  The blocklists and the blocked services are the
+// policy of the operator, so that Blocked is used for them, while the parental
+// control is requested for the client and is reported as Filtered.
+func (s *Server) filteringEDE(res *dnsfilter.Result) (o *dns.EDNS0_LOCAL) {
+	if res == nil || !res.IsFiltered {
+		return nil
+	}
+
+	switch res.Reason {
+	case dnsfilter.FilteredBlockList:
+		var text string
+		if len(res.Rules) > 0 && s.conf.FilterListName != nil {
+			text = s.conf.FilterListName(res.Rules[0].FilterListID)
+		}
+
+		return newEDE(edeBlocked, text)
+	case dnsfilter.FilteredBlockedService:
+		return newEDE(edeBlocked, "blocked service "+res.ServiceName)
+	case dnsfilter.FilteredSafeBrowsing:
+		return newEDE(edeBlocked, "safe browsing")
+	case dnsfilter.FilteredParental:
+		return newEDE(edeFiltered, "parental control")
+	default:
+		return nil
+	}
+}
+
+// ede returns the Extended DNS Error option for the response from ctx, if
+// any.  The option from the response of the upstream is passed through unless
+// the response is generated by s.  The requests which have exceeded the time
+// budget are reported as Other, since RFC 8914 defines no closer code.
+func (s *Server) ede(ctx *dnsContext) (o dns.EDNS0) {
+	if !s.conf.EnableEDE {
+		return nil
+	}
+
+	if ctx.overBudget {
+		return newEDE(edeOther, "time budget exceeded at "+ctx.budgetStage.String()+" stage")
+	} else if fo := s.filteringEDE(ctx.result); fo != nil {
+		return fo
+	} else if ctx.err != nil {
+		return newEDE(edeNetworkError, edeTextNetworkError)
+	}
+
+	return ctx.upstreamEDE
+}
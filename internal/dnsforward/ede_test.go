@@ -0,0 +1,214 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// edeUpstream is an upstream answering with an Extended DNS Error.
+type edeUpstream struct{}
+
+// Exchange implements the upstream.Upstream interface for edeUpstream.
+func (edeUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	resp = (&dns.Msg{}).SetRcode(m, dns.RcodeServerFailure)
+	resp.SetEdns0(dns.DefaultMsgSize, false)
+	opt := resp.IsEdns0()
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: ednsOptionEDE,
+		Data: []byte{0x00, 0x06, 'b', 'o', 'g', 'u', 's'},
+	})
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for edeUpstream.
+func (edeUpstream) Address() (addr string) {
+	return "ede.upstream.example"
+}
+
+// edeOptionBytes returns the wire representation of the OPT option from resp
+// with the Extended DNS Error code, if any.
+func edeOptionBytes(t *testing.T, resp *dns.Msg) (data []byte) {
+	t.Helper()
+
+	wire, err := resp.Pack()
+	require.NoError(t, err)
+
+	unpacked := &dns.Msg{}
+	require.NoError(t, unpacked.Unpack(wire))
+
+	opt := unpacked.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() != ednsOptionEDE {
+			continue
+		}
+
+		// Pack the whole OPT record and cut the option out of its
+		// RDATA to check the exact bytes on the wire.
+		buf := make([]byte, dns.Len(opt))
+		var off int
+		off, err = dns.PackRR(opt, buf, 0, nil, false)
+		require.NoError(t, err)
+
+		optData, ok := o.(*dns.EDNS0_LOCAL)
+		require.True(t, ok)
+
+		n := 4 + len(optData.Data)
+		require.GreaterOrEqual(t, off, n)
+
+		return buf[off-n : off]
+	}
+
+	return nil
+}
+
+func TestServer_ede(t *testing.T) {
+	newServer := func(t *testing.T, enabled bool, ups upstream.Upstream) (addr net.Addr) {
+		t.Helper()
+
+		s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{{}},
+			TCPListenAddrs: []*net.TCPAddr{{}},
+			FilteringConfig: FilteringConfig{
+				ProtectionEnabled: true,
+				EnableEDE:         enabled,
+			},
+			FilterListName: func(_ int64) (name string) {
+				return "Test List"
+			},
+		}, nil)
+		s.conf.UpstreamConfig.Upstreams = s.upstreamTraces.wrapUpstreams([]upstream.Upstream{ups})
+		startDeferStop(t, s)
+
+		return s.dnsProxy.Addr(proxy.ProtoUDP)
+	}
+
+	exchange := func(t *testing.T, addr net.Addr, host string, edns bool) (resp *dns.Msg) {
+		t.Helper()
+
+		req := createTestMessage(host)
+		if edns {
+			req.SetEdns0(dns.DefaultMsgSize, false)
+		}
+
+		resp, err := dns.Exchange(req, addr.String())
+		require.NoError(t, err)
+
+		return resp
+	}
+
+	okUps := &aghtest.TestUpstream{
+		IPv4: map[string][]net.IP{
+			"example.org.": {{192, 168, 0, 1}},
+		},
+	}
+
+	t.Run("blocked", func(t *testing.T) {
+		addr := newServer(t, true, okUps)
+
+		resp := exchange(t, addr, "nxdomain.example.org.", true)
+		want := append([]byte{0x00, 0x0f, 0x00, 0x0b, 0x00, 0x0f}, "Test List"...)
+		assert.Equal(t, want, edeOptionBytes(t, resp))
+	})
+
+	t.Run("no_edns", func(t *testing.T) {
+		addr := newServer(t, true, okUps)
+
+		resp := exchange(t, addr, "nxdomain.example.org.", false)
+		assert.Nil(t, resp.IsEdns0())
+	})
+
+	t.Run("not_blocked", func(t *testing.T) {
+		addr := newServer(t, true, okUps)
+
+		resp := exchange(t, addr, "example.org.", true)
+		assert.Nil(t, edeOptionBytes(t, resp))
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		addr := newServer(t, false, okUps)
+
+		resp := exchange(t, addr, "nxdomain.example.org.", true)
+		assert.Nil(t, edeOptionBytes(t, resp))
+	})
+
+	t.Run("network_error", func(t *testing.T) {
+		addr := newServer(t, true, &aghtest.TestErrUpstream{})
+
+		resp := exchange(t, addr, "example.org.", true)
+		require.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+
+		want := append([]byte{0x00, 0x0f, 0x00, 0x1a, 0x00, 0x17}, edeTextNetworkError...)
+		assert.Equal(t, want, edeOptionBytes(t, resp))
+	})
+
+	t.Run("pass_through", func(t *testing.T) {
+		addr := newServer(t, true, edeUpstream{})
+
+		resp := exchange(t, addr, "example.org.", true)
+		want := []byte{0x00, 0x0f, 0x00, 0x07, 0x00, 0x06, 'b', 'o', 'g', 'u', 's'}
+		assert.Equal(t, want, edeOptionBytes(t, resp))
+	})
+}
+
+func TestServer_filteringEDE(t *testing.T) {
+	s := &Server{}
+
+	testCases := []struct {
+		res      *dnsfilter.Result
+		name     string
+		wantData []byte
+	}{{
+		res:      nil,
+		name:     "nil",
+		wantData: nil,
+	}, {
+		res: &dnsfilter.Result{
+			IsFiltered:  true,
+			Reason:      dnsfilter.FilteredBlockedService,
+			ServiceName: "example",
+		},
+		name:     "service",
+		wantData: append([]byte{0x00, 0x0f}, "blocked service example"...),
+	}, {
+		res: &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredParental,
+		},
+		name:     "parental",
+		wantData: append([]byte{0x00, 0x11}, "parental control"...),
+	}, {
+		res: &dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredSafeSearch,
+		},
+		name:     "safe_search",
+		wantData: nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			o := s.filteringEDE(tc.res)
+			if tc.wantData == nil {
+				assert.Nil(t, o)
+
+				return
+			}
+
+			require.NotNil(t, o)
+			assert.Equal(t, tc.wantData, o.Data)
+		})
+	}
+}
@@ -0,0 +1,434 @@
+package dnsforward
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// The EDNS(0) options policy is the following:
+//
+//   - ECS is passed upstream as is, since dnsproxy handles it.
+//
+//   - Cookies, RFC 7873, are generated and validated for plain UDP clients if
+//     FilteringConfig.EnableDNSCookies is true.  They're never sent upstream.
+//
+//   - Padding, RFC 7830, is never sent upstream.  Responses to padded queries
+//     sent over encrypted transports are padded in accordance with RFC 8467
+//     to the multiple of FilteringConfig.EDNSPaddingBlockSize.
+//
+//   - TCP keepalive, RFC 7828, is never sent upstream.  Responses to the
+//     queries containing it sent over TCP and DoT contain it with the idle
+//     timeout of the connections.  It's never sent over DoH and DoQ, see RFC
+//     9250.
+//
+//   - The option tagging the queries sent upstream by this server, see
+//     loop.go, means a forwarding loop, and such queries are answered with
+//     SERVFAIL.
+//
+//   - Extended DNS Errors, RFC 8914, are added to the blocked responses and
+//     to the ones generated after the upstreams have failed if
+//     FilteringConfig.EnableEDE is true.  The ones sent by the upstreams are
+//     passed through, see ede.go.
+//
+//   - All other options, including the ones we don't understand, are
+//     stripped from the request and aren't echoed back to the client.
+
+// ednsAction is the action taken with an EDNS(0) option received from a
+// client.
+type ednsAction string
+
+// ednsAction values.
+const (
+	ednsActionPassed        ednsAction = "passed"
+	ednsActionStripped      ednsAction = "stripped"
+	ednsActionMalformed     ednsAction = "malformed"
+	ednsActionCookieNew     ednsAction = "cookie_new"
+	ednsActionCookieValid   ednsAction = "cookie_valid"
+	ednsActionCookieInvalid ednsAction = "cookie_invalid"
+	ednsActionPadded        ednsAction = "padded"
+	ednsActionAdvertised    ednsAction = "advertised"
+)
+
+// ednsOptionNames are the names of the known EDNS(0) options.
+var ednsOptionNames = map[uint16]string{
+	dns.EDNS0LLQ:          "LLQ",
+	dns.EDNS0UL:           "UL",
+	dns.EDNS0NSID:         "NSID",
+	dns.EDNS0DAU:          "DAU",
+	dns.EDNS0DHU:          "DHU",
+	dns.EDNS0N3U:          "N3U",
+	dns.EDNS0SUBNET:       "ECS",
+	dns.EDNS0EXPIRE:       "EXPIRE",
+	dns.EDNS0COOKIE:       "COOKIE",
+	dns.EDNS0TCPKEEPALIVE: "TCP_KEEPALIVE",
+	dns.EDNS0PADDING:      "PADDING",
+}
+
+// ednsOptionName returns the name of the option with code.  The options we
+// don't know are named by their decimal codes.
+func ednsOptionName(code uint16) (name string) {
+	name, ok := ednsOptionNames[code]
+	if ok {
+		return name
+	}
+
+	return strconv.FormatUint(uint64(code), 10)
+}
+
+// ednsCounters counts the EDNS(0) options received from the clients by the
+// option and the action taken.  The zero value is ready to use.
+type ednsCounters struct {
+	mu     sync.Mutex
+	counts map[string]map[ednsAction]uint64
+}
+
+// inc increments the counter of the option with code and act.
+func (c *ednsCounters) inc(code uint16, act ednsAction) {
+	name := ednsOptionName(code)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.counts == nil {
+		c.counts = map[string]map[ednsAction]uint64{}
+	}
+
+	acts := c.counts[name]
+	if acts == nil {
+		acts = map[ednsAction]uint64{}
+		c.counts[name] = acts
+	}
+
+	acts[act]++
+	log.Debug("dns: edns option %s %s, %d times", name, act, acts[act])
+}
+
+// EDNSOptionCounters returns the number of the EDNS(0) options received from
+// the clients by the name of the option and the action taken.
+func (s *Server) EDNSOptionCounters() (counts map[string]map[string]uint64) {
+	s.edns.mu.Lock()
+	defer s.edns.mu.Unlock()
+
+	counts = make(map[string]map[string]uint64, len(s.edns.counts))
+	for name, acts := range s.edns.counts {
+		m := make(map[string]uint64, len(acts))
+		for act, n := range acts {
+			m[string(act)] = n
+		}
+
+		counts[name] = m
+	}
+
+	return counts
+}
+
+// DNS cookie parameters.  The server cookie is the one from RFC 9018 with
+// HMAC-SHA256 in place of SipHash-2-4, since it's only validated by this
+// server.
+const (
+	clientCookieLen    = 8
+	serverCookieLen    = 16
+	minServerCookieLen = 8
+	maxServerCookieLen = 32
+
+	cookieVersion = 1
+
+	// cookieMaxAge is the maximum age of a valid server cookie.
+	cookieMaxAge = time.Hour
+
+	// cookieMaxSkew is the maximum time in the future at which a server
+	// cookie is still considered valid.
+	cookieMaxSkew = 5 * time.Minute
+)
+
+// cookieSecretLen is the length of the secret used to generate server cookies.
+const cookieSecretLen = 16
+
+// newCookieSecret returns a new random secret for server cookies.
+func newCookieSecret() (secret []byte, err error) {
+	secret = make([]byte, cookieSecretLen)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+// serverCookie returns the server cookie for client cookie sent from ip at
+// now.
+func (s *Server) serverCookie(client []byte, ip net.IP, now time.Time) (sc []byte) {
+	sc = make([]byte, 8, serverCookieLen)
+	sc[0] = cookieVersion
+	binary.BigEndian.PutUint32(sc[4:], uint32(now.Unix()))
+
+	mac := hmac.New(sha256.New, s.cookieSecret)
+	_, _ = mac.Write(client)
+	_, _ = mac.Write(sc)
+	_, _ = mac.Write(ip.To16())
+
+	return mac.Sum(sc)[:serverCookieLen]
+}
+
+// validServerCookie returns true if sc has been generated by this server for
+// the client cookie sent from ip and isn't expired at now.
+func (s *Server) validServerCookie(client, sc []byte, ip net.IP, now time.Time) (ok bool) {
+	if len(sc) != serverCookieLen || sc[0] != cookieVersion {
+		return false
+	}
+
+	ts := time.Unix(int64(binary.BigEndian.Uint32(sc[4:8])), 0)
+	if ts.Before(now.Add(-cookieMaxAge)) || ts.After(now.Add(cookieMaxSkew)) {
+		return false
+	}
+
+	return hmac.Equal(s.serverCookie(client, ip, ts), sc)
+}
+
+// checkCookie validates the cookie option received from the client and stores
+// the client cookie into ctx.  It returns false if the option is malformed.
+func (s *Server) checkCookie(ctx *dnsContext, o *dns.EDNS0_COOKIE) (ok bool) {
+	b, err := hex.DecodeString(o.Cookie)
+	if err != nil || ctx.clientCookie != nil {
+		return false
+	}
+
+	l := len(b)
+	if l != clientCookieLen &&
+		(l < clientCookieLen+minServerCookieLen || l > clientCookieLen+maxServerCookieLen) {
+		return false
+	}
+
+	client, sc := b[:clientCookieLen], b[clientCookieLen:]
+	ctx.clientCookie = client
+
+	act := ednsActionCookieNew
+	if len(sc) > 0 {
+		ip := IPFromAddr(ctx.proxyCtx.Addr)
+		if s.validServerCookie(client, sc, ip, time.Now()) {
+			act = ednsActionCookieValid
+		} else {
+			act = ednsActionCookieInvalid
+		}
+	}
+
+	s.edns.inc(dns.EDNS0COOKIE, act)
+
+	return true
+}
+
+// processEDNSOptions applies the EDNS(0) options policy to the request.  The
+// options left in the request are sent upstream.
+func (s *Server) processEDNSOptions(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	opt := d.Req.IsEdns0()
+	if opt == nil {
+		return resultCodeSuccess
+	}
+
+	ctx.reqEDNS, ctx.reqDO = true, opt.Do()
+
+	useCookies := s.conf.EnableDNSCookies && d.Proto == proxy.ProtoUDP
+
+	var kept []dns.EDNS0
+	for _, o := range opt.Option {
+		code := o.Option()
+		switch code {
+		case dns.EDNS0SUBNET:
+			kept = append(kept, o)
+			s.edns.inc(code, ednsActionPassed)
+		case dns.EDNS0PADDING:
+			ctx.reqPadding = true
+			s.edns.inc(code, ednsActionStripped)
+		case dns.EDNS0TCPKEEPALIVE:
+			// The clients must not send the timeout, RFC 7828,
+			// section 3.2.1.
+			if l, ok := o.(*dns.EDNS0_LOCAL); ok && len(l.Data) == 0 {
+				ctx.reqKeepalive = true
+				s.edns.inc(code, ednsActionStripped)
+			} else {
+				s.edns.inc(code, ednsActionMalformed)
+			}
+		case dns.EDNS0COOKIE:
+			if !useCookies {
+				s.edns.inc(code, ednsActionStripped)
+
+				continue
+			}
+
+			c, ok := o.(*dns.EDNS0_COOKIE)
+			if !ok || !s.checkCookie(ctx, c) {
+				s.edns.inc(code, ednsActionMalformed)
+				ctx.clientCookie = nil
+
+				resp := &dns.Msg{}
+				resp.SetRcode(d.Req, dns.RcodeFormatError)
+				d.Res = resp
+
+				return resultCodeFinish
+			}
+		case loopOptionCode:
+			if s.isLoop(o) {
+				n := atomic.AddUint64(&s.loops, 1)
+				log.Debug("dns: forwarding loop detected for %s, %d times", d.Req.Question[0].Name, n)
+				d.Res = s.genServerFailure(d.Req)
+
+				return resultCodeFinish
+			}
+
+			s.edns.inc(code, ednsActionStripped)
+		default:
+			s.edns.inc(code, ednsActionStripped)
+		}
+	}
+
+	opt.Option = kept
+
+	return resultCodeSuccess
+}
+
+// defaultEDNSPaddingBlockSize is the block size to which the responses are
+// padded used if FilteringConfig.EDNSPaddingBlockSize isn't set.  See RFC 8467,
+// section 4.1.
+const defaultEDNSPaddingBlockSize = 468
+
+// maxEDNSPaddingBlockSize is the largest allowed value of
+// FilteringConfig.EDNSPaddingBlockSize.
+const maxEDNSPaddingBlockSize = 4096
+
+// validateEDNSPadding returns an error if the padding block size in conf is
+// invalid.
+func validateEDNSPadding(conf *FilteringConfig) (err error) {
+	if conf.EDNSPaddingBlockSize > maxEDNSPaddingBlockSize {
+		return fmt.Errorf(
+			"edns_padding_block_size: must not be greater than %d, got %d",
+			maxEDNSPaddingBlockSize,
+			conf.EDNSPaddingBlockSize,
+		)
+	}
+
+	return nil
+}
+
+// paddingBlockSize returns the block size to which the responses are padded.
+func (s *Server) paddingBlockSize() (size int) {
+	if s.conf.EDNSPaddingBlockSize == 0 {
+		return defaultEDNSPaddingBlockSize
+	}
+
+	return int(s.conf.EDNSPaddingBlockSize)
+}
+
+// isEncryptedProto returns true if proto is an encrypted transport which needs
+// padding.  DNSCrypt pads the messages itself.
+func isEncryptedProto(proto string) (ok bool) {
+	switch proto {
+	case proxy.ProtoTLS, proxy.ProtoHTTPS, proxy.ProtoQUIC:
+		return true
+	default:
+		return false
+	}
+}
+
+// padMsg appends the padding option to opt, which must be the OPT record of
+// msg, so that the length of the compressed msg is a multiple of blockSize.
+func padMsg(msg *dns.Msg, opt *dns.OPT, blockSize int) {
+	pad := &dns.EDNS0_PADDING{}
+	opt.Option = append(opt.Option, pad)
+
+	msg.Compress = true
+	if r := msg.Len() % blockSize; r != 0 {
+		pad.Padding = make([]byte, blockSize-r)
+	}
+}
+
+// isKeepaliveProto returns true if proto is a transport over which the TCP
+// keepalive option is sent.
+func isKeepaliveProto(proto string) (ok bool) {
+	return proto == proxy.ProtoTCP || proto == proxy.ProtoTLS
+}
+
+// newKeepaliveOption returns the TCP keepalive option with the idle timeout of
+// the TCP and DoT connections.  dns.EDNS0_TCP_KEEPALIVE isn't used, since the
+// version of the dns module in use packs it incorrectly.
+func newKeepaliveOption() (o *dns.EDNS0_LOCAL) {
+	// The timeout is in the units of 100 milliseconds.
+	timeout := uint16(tcpIdleTimeout / (100 * time.Millisecond))
+
+	return &dns.EDNS0_LOCAL{
+		Code: dns.EDNS0TCPKEEPALIVE,
+		Data: []byte{byte(timeout >> 8), byte(timeout)},
+	}
+}
+
+// setEDNSOptions applies the EDNS(0) options policy to the response.  The
+// response only contains the options which have been passed upstream and the
+// ones AdGuard Home adds itself.
+func (s *Server) setEDNSOptions(ctx *dnsContext) {
+	d := ctx.proxyCtx
+	reqOpt := d.Req.IsEdns0()
+	if !ctx.reqEDNS || reqOpt == nil || d.Res == nil {
+		return
+	}
+
+	pad := ctx.reqPadding && isEncryptedProto(d.Proto)
+	keepalive := ctx.reqKeepalive && isKeepaliveProto(d.Proto)
+
+	opt := d.Res.IsEdns0()
+	var kept []dns.EDNS0
+	if opt != nil {
+		for _, o := range opt.Option {
+			if o.Option() == dns.EDNS0SUBNET {
+				kept = append(kept, o)
+			}
+		}
+	}
+
+	ede := s.ede(ctx)
+	if ede != nil {
+		kept = append(kept, ede)
+	}
+
+	if opt == nil {
+		if ctx.clientCookie == nil && !pad && !keepalive && ede == nil {
+			return
+		}
+
+		d.Res.SetEdns0(reqOpt.UDPSize(), ctx.reqDO)
+		opt = d.Res.IsEdns0()
+	}
+
+	if ctx.clientCookie != nil {
+		ip := IPFromAddr(d.Addr)
+		sc := s.serverCookie(ctx.clientCookie, ip, time.Now())
+		kept = append(kept, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(ctx.clientCookie) + hex.EncodeToString(sc),
+		})
+	}
+
+	if keepalive {
+		kept = append(kept, newKeepaliveOption())
+		s.edns.inc(dns.EDNS0TCPKEEPALIVE, ednsActionAdvertised)
+	}
+
+	opt.Option = kept
+
+	if pad {
+		padMsg(d.Res, opt, s.paddingBlockSize())
+		s.edns.inc(dns.EDNS0PADDING, ednsActionPadded)
+	}
+}
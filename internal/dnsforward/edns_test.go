@@ -0,0 +1,407 @@
+package dnsforward
+
+import (
+	"encoding/hex"
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newEDNSReq returns a new request with the OPT record containing opts.
+func newEDNSReq(opts ...dns.EDNS0) (req *dns.Msg) {
+	req = (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	opt := req.IsEdns0()
+	opt.Option = append(opt.Option, opts...)
+
+	return req
+}
+
+// newEDNSCtx returns a new context for req received from a client over proto.
+func newEDNSCtx(s *Server, req *dns.Msg, proto string) (ctx *dnsContext) {
+	return &dnsContext{
+		srv: s,
+		proxyCtx: &proxy.DNSContext{
+			Proto: proto,
+			Req:   req,
+			Addr:  &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 53},
+		},
+	}
+}
+
+// respondEDNS emulates the upstream answer to the request in ctx and applies
+// the policy to the response.
+func respondEDNS(s *Server, ctx *dnsContext) (res *dns.Msg) {
+	d := ctx.proxyCtx
+	if d.Res == nil {
+		d.Res = (&dns.Msg{}).SetReply(d.Req)
+		d.Res.SetEdns0(4096, false)
+		opt := d.Res.IsEdns0()
+		opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+			Code: dns.EDNS0LOCALSTART,
+			Data: []byte{1, 2, 3},
+		}, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+			Nsid: "0102",
+		})
+	}
+
+	s.setEDNSOptions(ctx)
+
+	return d.Res
+}
+
+// findCookie returns the decoded cookie from msg, if any.
+func findCookie(t *testing.T, msg *dns.Msg) (b []byte) {
+	t.Helper()
+
+	opt := msg.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		if c, ok := o.(*dns.EDNS0_COOKIE); ok {
+			var err error
+			b, err = hex.DecodeString(c.Cookie)
+			require.NoError(t, err)
+
+			return b
+		}
+	}
+
+	return nil
+}
+
+func TestServer_processEDNSOptions(t *testing.T) {
+	ecs := &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.IP{1, 2, 3, 0},
+	}
+
+	testCases := []struct {
+		name     string
+		opts     []dns.EDNS0
+		wantReq  []dns.EDNS0
+		wantCnts map[string]map[string]uint64
+	}{{
+		name:     "none",
+		opts:     nil,
+		wantReq:  nil,
+		wantCnts: map[string]map[string]uint64{},
+	}, {
+		name:    "ecs",
+		opts:    []dns.EDNS0{ecs},
+		wantReq: []dns.EDNS0{ecs},
+		wantCnts: map[string]map[string]uint64{
+			"ECS": {"passed": 1},
+		},
+	}, {
+		name: "unknown",
+		opts: []dns.EDNS0{&dns.EDNS0_LOCAL{
+			Code: 65001,
+			Data: []byte{1, 2, 3},
+		}, ecs, &dns.EDNS0_NSID{
+			Code: dns.EDNS0NSID,
+		}},
+		wantReq: []dns.EDNS0{ecs},
+		wantCnts: map[string]map[string]uint64{
+			"65001": {"stripped": 1},
+			"ECS":   {"passed": 1},
+			"NSID":  {"stripped": 1},
+		},
+	}, {
+		name: "padding_and_cookie",
+		opts: []dns.EDNS0{&dns.EDNS0_PADDING{
+			Padding: make([]byte, 16),
+		}, &dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: "0102030405060708",
+		}},
+		wantReq: nil,
+		wantCnts: map[string]map[string]uint64{
+			"COOKIE":  {"stripped": 1},
+			"PADDING": {"stripped": 1},
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			ctx := newEDNSCtx(s, newEDNSReq(tc.opts...), proxy.ProtoUDP)
+
+			rc := s.processEDNSOptions(ctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.wantReq, ctx.proxyCtx.Req.IsEdns0().Option)
+			assert.Equal(t, tc.wantCnts, s.EDNSOptionCounters())
+
+			res := respondEDNS(s, ctx)
+			opt := res.IsEdns0()
+			require.NotNil(t, opt)
+
+			assert.Empty(t, opt.Option)
+		})
+	}
+}
+
+func TestServer_processEDNSOptions_cookies(t *testing.T) {
+	secret, err := newCookieSecret()
+	require.NoError(t, err)
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				EnableDNSCookies: true,
+			},
+		},
+		cookieSecret: secret,
+	}
+
+	client := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	cookieReq := func(b []byte) (req *dns.Msg) {
+		return newEDNSReq(&dns.EDNS0_COOKIE{
+			Code:   dns.EDNS0COOKIE,
+			Cookie: hex.EncodeToString(b),
+		})
+	}
+
+	ctx := newEDNSCtx(s, cookieReq(client), proxy.ProtoUDP)
+	require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+	assert.Empty(t, ctx.proxyCtx.Req.IsEdns0().Option)
+
+	cookie := findCookie(t, respondEDNS(s, ctx))
+	require.Len(t, cookie, clientCookieLen+serverCookieLen)
+
+	assert.Equal(t, client, cookie[:clientCookieLen])
+
+	t.Run("valid", func(t *testing.T) {
+		ctx = newEDNSCtx(s, cookieReq(cookie), proxy.ProtoUDP)
+		require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+		assert.Len(t, findCookie(t, respondEDNS(s, ctx)), clientCookieLen+serverCookieLen)
+		assert.Equal(t, uint64(1), s.EDNSOptionCounters()["COOKIE"]["cookie_valid"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		bad := append([]byte{}, cookie...)
+		bad[len(bad)-1] ^= 0xff
+
+		ctx = newEDNSCtx(s, cookieReq(bad), proxy.ProtoUDP)
+		require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+		// A fresh server cookie is expected.
+		fresh := findCookie(t, respondEDNS(s, ctx))
+		require.Len(t, fresh, clientCookieLen+serverCookieLen)
+
+		assert.Equal(t, client, fresh[:clientCookieLen])
+		assert.Equal(t, uint64(1), s.EDNSOptionCounters()["COOKIE"]["cookie_invalid"])
+	})
+
+	t.Run("other_ip", func(t *testing.T) {
+		ctx = newEDNSCtx(s, cookieReq(cookie), proxy.ProtoUDP)
+		ctx.proxyCtx.Addr = &net.UDPAddr{IP: net.IP{4, 3, 2, 1}, Port: 53}
+		require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+		assert.Equal(t, uint64(2), s.EDNSOptionCounters()["COOKIE"]["cookie_invalid"])
+	})
+
+	t.Run("malformed", func(t *testing.T) {
+		ctx = newEDNSCtx(s, cookieReq(client[:4]), proxy.ProtoUDP)
+		require.Equal(t, resultCodeFinish, s.processEDNSOptions(ctx))
+		require.NotNil(t, ctx.proxyCtx.Res)
+
+		assert.Equal(t, dns.RcodeFormatError, ctx.proxyCtx.Res.Rcode)
+		assert.Nil(t, findCookie(t, respondEDNS(s, ctx)))
+		assert.Equal(t, uint64(1), s.EDNSOptionCounters()["COOKIE"]["malformed"])
+	})
+
+	t.Run("tcp", func(t *testing.T) {
+		ctx = newEDNSCtx(s, cookieReq(client), proxy.ProtoTCP)
+		require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+		assert.Nil(t, findCookie(t, respondEDNS(s, ctx)))
+		assert.Equal(t, uint64(1), s.EDNSOptionCounters()["COOKIE"]["stripped"])
+	})
+}
+
+func TestServer_setEDNSOptions_padding(t *testing.T) {
+	padding := &dns.EDNS0_PADDING{
+		Padding: make([]byte, 8),
+	}
+
+	testCases := []struct {
+		name    string
+		proto   string
+		opts    []dns.EDNS0
+		wantPad bool
+	}{{
+		name:    "tls",
+		proto:   proxy.ProtoTLS,
+		opts:    []dns.EDNS0{padding},
+		wantPad: true,
+	}, {
+		name:    "https",
+		proto:   proxy.ProtoHTTPS,
+		opts:    []dns.EDNS0{padding},
+		wantPad: true,
+	}, {
+		name:    "quic",
+		proto:   proxy.ProtoQUIC,
+		opts:    []dns.EDNS0{padding},
+		wantPad: true,
+	}, {
+		name:    "udp",
+		proto:   proxy.ProtoUDP,
+		opts:    []dns.EDNS0{padding},
+		wantPad: false,
+	}, {
+		name:    "tls_no_padding",
+		proto:   proxy.ProtoTLS,
+		opts:    nil,
+		wantPad: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			ctx := newEDNSCtx(s, newEDNSReq(tc.opts...), tc.proto)
+			require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+			res := respondEDNS(s, ctx)
+			opt := res.IsEdns0()
+			require.NotNil(t, opt)
+
+			if !tc.wantPad {
+				assert.Empty(t, opt.Option)
+
+				return
+			}
+
+			require.Len(t, opt.Option, 1)
+			assert.IsType(t, &dns.EDNS0_PADDING{}, opt.Option[0])
+
+			b, err := res.Pack()
+			require.NoError(t, err)
+
+			assert.Zero(t, len(b)%defaultEDNSPaddingBlockSize)
+		})
+	}
+}
+
+func TestServer_setEDNSOptions_paddingBlockSize(t *testing.T) {
+	const blockSize = 128
+
+	s := &Server{
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				EDNSPaddingBlockSize: blockSize,
+			},
+		},
+	}
+
+	req := newEDNSReq(&dns.EDNS0_PADDING{Padding: make([]byte, 8)})
+	ctx := newEDNSCtx(s, req, proxy.ProtoHTTPS)
+	require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+
+	b, err := respondEDNS(s, ctx).Pack()
+	require.NoError(t, err)
+
+	assert.Zero(t, len(b)%blockSize)
+	assert.Less(t, len(b), defaultEDNSPaddingBlockSize)
+
+	assert.NoError(t, validateEDNSPadding(&s.conf.FilteringConfig))
+	assert.Error(t, validateEDNSPadding(&FilteringConfig{
+		EDNSPaddingBlockSize: maxEDNSPaddingBlockSize + 1,
+	}))
+}
+
+func TestServer_setEDNSOptions_keepalive(t *testing.T) {
+	keepalive := &dns.EDNS0_LOCAL{
+		Code: dns.EDNS0TCPKEEPALIVE,
+	}
+
+	testCases := []struct {
+		name      string
+		proto     string
+		opts      []dns.EDNS0
+		wantCnts  map[string]uint64
+		wantAlive bool
+	}{{
+		name:      "tcp",
+		proto:     proxy.ProtoTCP,
+		opts:      []dns.EDNS0{keepalive},
+		wantCnts:  map[string]uint64{"stripped": 1, "advertised": 1},
+		wantAlive: true,
+	}, {
+		name:      "tls",
+		proto:     proxy.ProtoTLS,
+		opts:      []dns.EDNS0{keepalive},
+		wantCnts:  map[string]uint64{"stripped": 1, "advertised": 1},
+		wantAlive: true,
+	}, {
+		name:      "udp",
+		proto:     proxy.ProtoUDP,
+		opts:      []dns.EDNS0{keepalive},
+		wantCnts:  map[string]uint64{"stripped": 1},
+		wantAlive: false,
+	}, {
+		name:      "quic",
+		proto:     proxy.ProtoQUIC,
+		opts:      []dns.EDNS0{keepalive},
+		wantCnts:  map[string]uint64{"stripped": 1},
+		wantAlive: false,
+	}, {
+		name:  "with_timeout",
+		proto: proxy.ProtoTCP,
+		opts: []dns.EDNS0{&dns.EDNS0_LOCAL{
+			Code: dns.EDNS0TCPKEEPALIVE,
+			Data: []byte{0, 1},
+		}},
+		wantCnts:  map[string]uint64{"malformed": 1},
+		wantAlive: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{}
+			ctx := newEDNSCtx(s, newEDNSReq(tc.opts...), tc.proto)
+			require.Equal(t, resultCodeSuccess, s.processEDNSOptions(ctx))
+			assert.Empty(t, ctx.proxyCtx.Req.IsEdns0().Option)
+
+			res := respondEDNS(s, ctx)
+			assert.Equal(t, tc.wantCnts, s.EDNSOptionCounters()["TCP_KEEPALIVE"])
+
+			// Check the wire format, see newKeepaliveOption.
+			b, err := res.Pack()
+			require.NoError(t, err)
+
+			unpacked := &dns.Msg{}
+			require.NoError(t, unpacked.Unpack(b))
+
+			opt := unpacked.IsEdns0()
+			require.NotNil(t, opt)
+
+			if !tc.wantAlive {
+				assert.Empty(t, opt.Option)
+
+				return
+			}
+
+			require.Len(t, opt.Option, 1)
+			o, ok := opt.Option[0].(*dns.EDNS0_LOCAL)
+			require.True(t, ok)
+
+			assert.Equal(t, uint16(dns.EDNS0TCPKEEPALIVE), o.Code)
+			// The idle timeout in the units of 100 milliseconds.
+			assert.Equal(t, []byte{0, 100}, o.Data)
+		})
+	}
+}
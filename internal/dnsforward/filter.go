@@ -12,6 +12,10 @@ import (
 )
 
 func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool, error) {
+	if s.conf.SafeMode {
+		return true, nil
+	}
+
 	ip := IPFromAddr(d.Addr)
 	disallowed, _ := s.access.IsBlockedIP(ip)
 	if disallowed {
@@ -35,8 +39,9 @@ func (s *Server) beforeRequestHandler(_ *proxy.Proxy, d *proxy.DNSContext) (bool
 func (s *Server) getClientRequestFilteringSettings(ctx *dnsContext) *dnsfilter.FilteringSettings {
 	setts := s.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
+	setts.AAAADisabled = s.conf.AAAADisabled
 	if s.conf.FilterHandler != nil {
-		s.conf.FilterHandler(IPFromAddr(ctx.proxyCtx.Addr), ctx.clientID, &setts)
+		s.conf.FilterHandler(ctx.clientIP, ctx.clientID, &setts)
 	}
 
 	return &setts
@@ -59,7 +64,8 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 		d.Res = s.genDNSFilterMessage(d, &res)
 	} else if res.Reason.In(dnsfilter.Rewritten, dnsfilter.RewrittenRule) &&
 		res.CanonName != "" &&
-		len(res.IPList) == 0 {
+		len(res.IPList) == 0 &&
+		(res.Reason == dnsfilter.RewrittenRule || res.DNSRewriteResult == nil) {
 		// Resolve the new canonical name, not the original host
 		// name.  The original question is readded in
 		// processFilteringAfterResponse.
@@ -105,6 +111,13 @@ func (s *Server) filterDNSRequest(ctx *dnsContext) (*dnsfilter.Result, error) {
 			}
 		}
 
+		if res.Reason == dnsfilter.Rewritten {
+			err = s.addLocalZoneRecords(req, resp, name, &res)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		d.Res = resp
 	} else if res.Reason == dnsfilter.RewrittenRule {
 		err = s.filterDNSRewrite(req, res, d)
@@ -143,7 +156,7 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 		s.RLock()
 		// Synchronize access to s.dnsFilter so it won't be suddenly uninitialized while in use.
 		// This could happen after proxy server has been stopped, but its workers are not yet exited.
-		if !s.conf.ProtectionEnabled || s.dnsFilter == nil {
+		if !s.conf.ProtectionEnabled || s.dnsFilter == nil || s.conf.SafeMode {
 			s.RUnlock()
 			continue
 		}
@@ -161,3 +174,30 @@ func (s *Server) filterDNSResponse(ctx *dnsContext) (*dnsfilter.Result, error) {
 
 	return nil, nil
 }
+
+// isBlockedReason returns true if the requests filtered for the reason are
+// blocked, as opposed to rewritten or allowed.
+func isBlockedReason(reason dnsfilter.Reason) (ok bool) {
+	switch reason {
+	case
+		dnsfilter.FilteredBlockList,
+		dnsfilter.FilteredSafeBrowsing,
+		dnsfilter.FilteredParental,
+		dnsfilter.FilteredBlockedService:
+		return true
+	default:
+		return false
+	}
+}
+
+// processOnBlocked calls the OnBlocked callback for the blocked requests.
+func (s *Server) processOnBlocked(ctx *dnsContext) (rc resultCode) {
+	res := ctx.result
+	if s.conf.OnBlocked == nil || res == nil || !res.IsFiltered || !isBlockedReason(res.Reason) {
+		return resultCodeSuccess
+	}
+
+	s.conf.OnBlocked(ctx.proxyCtx.Req.Question[0].Name, ctx.clientIP, res.Reason)
+
+	return resultCodeSuccess
+}
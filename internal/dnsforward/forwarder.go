@@ -0,0 +1,135 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"sort"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// forwarderClientID is the ClientID of the requests from the trusted
+// forwarders which don't carry the address of the original client.  The
+// settings of the persistent client with this ID apply to them.
+const forwarderClientID = "forwarder"
+
+// trustedForwarders are the DNS servers which forward the requests of their
+// clients to this server.  A nil *trustedForwarders contains no forwarders.
+type trustedForwarders struct {
+	// ips are the normalized addresses of the forwarders.
+	ips *aghstrings.Set
+
+	// option is the code of the EDNS(0) option carrying the address of the
+	// original client.  Zero means that only ECS is used.
+	option uint16
+}
+
+// newTrustedForwarders returns the forwarders with addrs.  tf is nil if addrs
+// is empty.
+func newTrustedForwarders(addrs []string, option uint16) (tf *trustedForwarders, err error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	switch option {
+	case dns.EDNS0SUBNET, dns.EDNS0COOKIE, dns.EDNS0PADDING, loopOptionCode:
+		return nil, fmt.Errorf("forwarder client option: option %d is reserved", option)
+	default:
+		// Go on.
+	}
+
+	tf = &trustedForwarders{
+		ips:    aghstrings.NewSet(),
+		option: option,
+	}
+
+	for _, a := range addrs {
+		ip := net.ParseIP(a)
+		if ip == nil {
+			return nil, fmt.Errorf("trusted forwarder %q is not an ip address", a)
+		}
+
+		tf.ips.Add(ip.String())
+	}
+
+	return tf, nil
+}
+
+// has returns true if ip is the address of a forwarder.
+func (tf *trustedForwarders) has(ip net.IP) (ok bool) {
+	return tf != nil && ip != nil && tf.ips.Has(ip.String())
+}
+
+// innerClient returns the address of the original client carried by req.  The
+// configured option is preferred over ECS, and ECS is only used if it contains
+// a whole address instead of a subnet.  ip is nil if there is no address.
+func (tf *trustedForwarders) innerClient(req *dns.Msg) (ip net.IP) {
+	opt := req.IsEdns0()
+	if opt == nil {
+		return nil
+	}
+
+	for _, o := range opt.Option {
+		switch o := o.(type) {
+		case *dns.EDNS0_SUBNET:
+			if (o.Family == 1 && o.SourceNetmask == net.IPv4len*8) ||
+				(o.Family == 2 && o.SourceNetmask == net.IPv6len*8) {
+				ip = o.Address
+			}
+		case *dns.EDNS0_LOCAL:
+			if tf.option == 0 || o.Code != tf.option {
+				continue
+			}
+
+			if l := len(o.Data); l == net.IPv4len || l == net.IPv6len {
+				return append(net.IP(nil), o.Data...)
+			}
+		}
+	}
+
+	return ip
+}
+
+// ratelimitWhitelist returns the sorted addresses of the clients which aren't
+// rate limited, since the proxy looks them up using binary search.
+func (s *Server) ratelimitWhitelist() (ips []string) {
+	ips = aghstrings.CloneSlice(s.conf.RatelimitWhitelist)
+	if s.forwarders != nil {
+		ips = append(ips, s.forwarders.ips.Values()...)
+	}
+
+	sort.Strings(ips)
+
+	return ips
+}
+
+// processForwarder replaces the address of the client with the one of the
+// original client if the request is forwarded by a trusted forwarder.  If the
+// address isn't in the request, the request is attributed to the client with
+// forwarderClientID.  It must be called before the EDNS(0) options are
+// stripped.
+func (s *Server) processForwarder(ctx *dnsContext) (rc resultCode) {
+	s.RLock()
+	tf := s.forwarders
+	s.RUnlock()
+
+	if !tf.has(ctx.clientIP) {
+		return resultCodeSuccess
+	}
+
+	inner := tf.innerClient(ctx.proxyCtx.Req)
+	if inner == nil {
+		ctx.clientID = forwarderClientID
+
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: request from %s forwarded by %s", inner, ctx.clientIP)
+	ctx.clientIP = inner
+	// The port is the forwarder's one.
+	ctx.clientPort = 0
+
+	return resultCodeSuccess
+}
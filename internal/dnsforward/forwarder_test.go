@@ -0,0 +1,169 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testForwarderOption is the code of the option carrying the address of the
+// original client in tests.
+const testForwarderOption uint16 = 65100
+
+func TestNewTrustedForwarders(t *testing.T) {
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		addrs      []string
+		option     uint16
+	}{{
+		name:       "empty",
+		wantErrMsg: "",
+		addrs:      nil,
+		option:     0,
+	}, {
+		name:       "ok",
+		wantErrMsg: "",
+		addrs:      []string{"192.168.1.2", "fe80::1"},
+		option:     testForwarderOption,
+	}, {
+		name:       "bad_ip",
+		wantErrMsg: `trusted forwarder "192.168.1.0/24" is not an ip address`,
+		addrs:      []string{"192.168.1.0/24"},
+		option:     0,
+	}, {
+		name:       "reserved_option",
+		wantErrMsg: "forwarder client option: option 10 is reserved",
+		addrs:      []string{"192.168.1.2"},
+		option:     dns.EDNS0COOKIE,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := newTrustedForwarders(tc.addrs, tc.option)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestServer_processForwarder(t *testing.T) {
+	fwdIP := net.IP{192, 168, 1, 2}
+	innerIP := net.IP{192, 168, 1, 100}
+
+	tf, err := newTrustedForwarders([]string{fwdIP.String()}, testForwarderOption)
+	require.NoError(t, err)
+
+	s := &Server{
+		forwarders: tf,
+	}
+
+	testCases := []struct {
+		name         string
+		clientIP     net.IP
+		options      []dns.EDNS0
+		wantClientIP net.IP
+		wantClientID string
+	}{{
+		name:         "not_forwarder",
+		clientIP:     net.IP{192, 168, 1, 3},
+		options:      []dns.EDNS0{newTestECS(innerIP, 32)},
+		wantClientIP: net.IP{192, 168, 1, 3},
+		wantClientID: "",
+	}, {
+		name:         "no_inner",
+		clientIP:     fwdIP,
+		options:      nil,
+		wantClientIP: fwdIP,
+		wantClientID: forwarderClientID,
+	}, {
+		name:         "ecs",
+		clientIP:     fwdIP,
+		options:      []dns.EDNS0{newTestECS(innerIP, 32)},
+		wantClientIP: innerIP,
+		wantClientID: "",
+	}, {
+		name:         "ecs_subnet",
+		clientIP:     fwdIP,
+		options:      []dns.EDNS0{newTestECS(innerIP, 24)},
+		wantClientIP: fwdIP,
+		wantClientID: forwarderClientID,
+	}, {
+		name:     "option",
+		clientIP: fwdIP,
+		options: []dns.EDNS0{
+			newTestECS(net.IP{192, 168, 1, 101}, 32),
+			&dns.EDNS0_LOCAL{Code: testForwarderOption, Data: innerIP},
+		},
+		wantClientIP: innerIP,
+		wantClientID: "",
+	}, {
+		name:     "option_bad_length",
+		clientIP: fwdIP,
+		options: []dns.EDNS0{
+			&dns.EDNS0_LOCAL{Code: testForwarderOption, Data: []byte{1, 2, 3}},
+		},
+		wantClientIP: fwdIP,
+		wantClientID: forwarderClientID,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := createGoogleATestMessage()
+			if tc.options != nil {
+				req.SetEdns0(dns.DefaultMsgSize, false)
+				opt := req.IsEdns0()
+				opt.Option = tc.options
+			}
+
+			ctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: req,
+				},
+				clientIP: tc.clientIP,
+			}
+
+			rc := s.processForwarder(ctx)
+			assert.Equal(t, resultCodeSuccess, rc)
+
+			assert.Equal(t, tc.wantClientIP.To16(), ctx.clientIP.To16())
+			assert.Equal(t, tc.wantClientID, ctx.clientID)
+		})
+	}
+}
+
+// newTestECS returns an ECS option with a subnet of ip with length ones.
+func newTestECS(ip net.IP, ones uint8) (o *dns.EDNS0_SUBNET) {
+	return &dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: ones,
+		Address:       ip,
+	}
+}
+
+func TestServer_ratelimitWhitelist(t *testing.T) {
+	tf, err := newTrustedForwarders([]string{"192.168.1.2"}, 0)
+	require.NoError(t, err)
+
+	s := &Server{
+		forwarders: tf,
+		conf: ServerConfig{
+			FilteringConfig: FilteringConfig{
+				RatelimitWhitelist: []string{"192.168.1.3", "10.0.0.1"},
+			},
+		},
+	}
+
+	assert.Equal(t, []string{"10.0.0.1", "192.168.1.2", "192.168.1.3"}, s.ratelimitWhitelist())
+}
@@ -0,0 +1,383 @@
+package dnsforward
+
+import (
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Settings of the detection of the dropped fragmented UDP responses.
+const (
+	// fragSafeSize is the size of the UDP responses, which are unlikely to
+	// be fragmented on any network.  It's also the buffer size recommended
+	// to the networks where the fragmented responses are dropped.
+	//
+	// See https://dnsflagday.net/2020.
+	fragSafeSize = 1232
+
+	// fragRetryWindow is the time within which the TCP retry of a large UDP
+	// response is considered a sign of the response being dropped.
+	fragRetryWindow = 5 * time.Second
+
+	// fragMinDrops is the number of the probable drops within a subnet
+	// after which the lower buffer size is recommended for it.
+	fragMinDrops = 3
+
+	// maxFragPending is the maximum number of the large UDP responses
+	// waiting for the retries.  The responses over the limit aren't
+	// tracked.
+	maxFragPending = 10_000
+
+	// maxFragSubnets is the maximum number of the tracked subnets.  The
+	// subnets over the limit aren't tracked.
+	maxFragSubnets = 1_000
+
+	// fragTopSubnets is the number of the subnets reported in the status.
+	fragTopSubnets = 10
+)
+
+// Prefix lengths of the subnets, within which the drops are counted.
+const (
+	fragSubnetLenIPv4 = 24
+	fragSubnetLenIPv6 = 56
+)
+
+// fragKey identifies a large UDP response to a client.
+type fragKey struct {
+	subnet string
+	ip     string
+	name   string
+	qtype  uint16
+}
+
+// fragSubnet are the counters of a single subnet.
+type fragSubnet struct {
+	// lastDrop is the time of the last probable drop.
+	lastDrop time.Time
+
+	// large is the number of the UDP responses larger than fragSafeSize.
+	large uint64
+
+	// drops is the number of the large UDP responses probably dropped.
+	drops uint64
+
+	// truncated is the number of the UDP responses truncated to
+	// fragSafeSize.
+	truncated uint64
+}
+
+// fragDetector counts the large UDP responses followed shortly by the same
+// query over TCP from the same client, which is a sign of the fragmented
+// responses being silently dropped on the way to the client.
+type fragDetector struct {
+	// mu protects all the fields.
+	mu sync.Mutex
+
+	// pending are the times when the large UDP responses have been sent.
+	pending map[fragKey]time.Time
+
+	// subnets are the counters of the subnets by their CIDR notation.
+	subnets map[string]*fragSubnet
+
+	// lastSweep is the time of the last removal of the expired pending
+	// responses.
+	lastSweep time.Time
+
+	// total are the counters of all subnets.
+	total fragSubnet
+}
+
+// fragSubnetOf returns the subnet of ip within which the drops are counted in
+// the CIDR notation.
+func fragSubnetOf(ip net.IP) (subnet string) {
+	bits, ones := 8*net.IPv6len, fragSubnetLenIPv6
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits, ones = ip4, 8*net.IPv4len, fragSubnetLenIPv4
+	}
+
+	n := &net.IPNet{
+		IP:   ip.Mask(net.CIDRMask(ones, bits)),
+		Mask: net.CIDRMask(ones, bits),
+	}
+
+	return n.String()
+}
+
+// newFragKey returns the key of the response to q for the client with ip.
+func newFragKey(ip net.IP, q dns.Question) (k fragKey) {
+	return fragKey{
+		subnet: fragSubnetOf(ip),
+		ip:     ip.String(),
+		name:   strings.ToLower(q.Name),
+		qtype:  q.Qtype,
+	}
+}
+
+// subnetLocked returns the counters of subnet, creating them if there is room
+// for them.  f.mu is expected to be locked.
+func (f *fragDetector) subnetLocked(subnet string) (fs *fragSubnet) {
+	if f.subnets == nil {
+		f.subnets = map[string]*fragSubnet{}
+	}
+
+	fs, ok := f.subnets[subnet]
+	if !ok && len(f.subnets) < maxFragSubnets {
+		fs = &fragSubnet{}
+		f.subnets[subnet] = fs
+	}
+
+	return fs
+}
+
+// sent records that the UDP response larger than fragSafeSize to the query q
+// has been sent to the client with ip at now.
+func (f *fragDetector) sent(ip net.IP, q dns.Question, now time.Time) {
+	k := newFragKey(ip, q)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.total.large++
+	if fs := f.subnetLocked(k.subnet); fs != nil {
+		fs.large++
+	}
+
+	if now.Sub(f.lastSweep) >= fragRetryWindow {
+		for pk, t := range f.pending {
+			if now.Sub(t) > fragRetryWindow {
+				delete(f.pending, pk)
+			}
+		}
+
+		f.lastSweep = now
+	}
+
+	if f.pending == nil {
+		f.pending = map[fragKey]time.Time{}
+	}
+
+	if len(f.pending) < maxFragPending {
+		f.pending[k] = now
+	}
+}
+
+// retried checks if the query q received over TCP from the client with ip at
+// now repeats a recent large UDP response, and counts it as a probable drop if
+// so.
+func (f *fragDetector) retried(ip net.IP, q dns.Question, now time.Time) (ok bool) {
+	k := newFragKey(ip, q)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	t, ok := f.pending[k]
+	if !ok {
+		return false
+	}
+
+	delete(f.pending, k)
+	if now.Sub(t) > fragRetryWindow {
+		return false
+	}
+
+	f.total.drops++
+	f.total.lastDrop = now
+	if fs := f.subnetLocked(k.subnet); fs != nil {
+		fs.drops++
+		fs.lastDrop = now
+	}
+
+	return true
+}
+
+// lowered returns true if the responses to the client with ip should be
+// limited to fragSafeSize, since there have been enough probable drops within
+// its subnet.
+func (f *fragDetector) lowered(ip net.IP) (ok bool) {
+	subnet := fragSubnetOf(ip)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	fs := f.subnets[subnet]
+
+	return fs != nil && fs.drops >= fragMinDrops
+}
+
+// truncated records that the UDP response to the client with ip has been
+// truncated to fragSafeSize.
+func (f *fragDetector) truncated(ip net.IP) {
+	subnet := fragSubnetOf(ip)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.total.truncated++
+	if fs := f.subnets[subnet]; fs != nil {
+		fs.truncated++
+	}
+}
+
+// processFragmentation tracks the large UDP responses to detect the dropped
+// ones and, if FilteringConfig.AutoEDNSBufferSize is true, truncates the
+// responses to the clients within the subnets where they are probably dropped
+// to fragSafeSize.
+func (s *Server) processFragmentation(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	if d.Proto != proxy.ProtoUDP || d.Res == nil || d.Res.Truncated || ctx.clientIP == nil {
+		return resultCodeSuccess
+	}
+
+	f := &s.frag
+	if s.conf.AutoEDNSBufferSize && f.lowered(ctx.clientIP) {
+		if opt := d.Res.IsEdns0(); opt != nil && opt.UDPSize() > fragSafeSize {
+			opt.SetUDPSize(fragSafeSize)
+		}
+
+		d.Res.Compress = true
+		if d.Res.Len() > fragSafeSize {
+			log.Debug("dns: truncating response to %s to %d bytes", ctx.clientIP, fragSafeSize)
+			d.Res = newTruncatedResponse(d.Req, d.Res)
+			f.truncated(ctx.clientIP)
+		}
+
+		return resultCodeSuccess
+	}
+
+	d.Res.Compress = true
+	if d.Res.Len() > fragSafeSize {
+		f.sent(ctx.clientIP, d.Req.Question[0], time.Now())
+	}
+
+	return resultCodeSuccess
+}
+
+// checkFragRetry counts the request in d as a probable drop of the previous
+// UDP response if it's a TCP retry of it.
+func (s *Server) checkFragRetry(d *proxy.DNSContext) {
+	if d.Proto != proxy.ProtoTCP || len(d.Req.Question) != 1 {
+		return
+	}
+
+	ip := IPFromAddr(d.Addr)
+	if ip != nil && s.frag.retried(ip, d.Req.Question[0], time.Now()) {
+		log.Debug("dns: probable fragmentation drop for %s", ip)
+	}
+}
+
+// FragmentationSubnet is the state of the detection of the dropped fragmented
+// UDP responses within a single subnet.
+type FragmentationSubnet struct {
+	// LastDrop is the time of the last probable drop.  It's nil if there
+	// have been none.
+	LastDrop *aghtime.Time `json:"last_drop,omitempty"`
+
+	// Subnet is the subnet in the CIDR notation.
+	Subnet string `json:"subnet"`
+
+	// LargeResponses is the number of the UDP responses larger than the
+	// fragmentation-safe size.
+	LargeResponses uint64 `json:"large_responses"`
+
+	// ProbableDrops is the number of the large UDP responses followed by
+	// the same query over TCP shortly after.
+	ProbableDrops uint64 `json:"probable_drops"`
+
+	// Truncated is the number of the UDP responses truncated to the lower
+	// buffer size.
+	Truncated uint64 `json:"truncated"`
+
+	// Lowered is true if the lower buffer size is recommended for the
+	// subnet.
+	Lowered bool `json:"lowered"`
+}
+
+// FragmentationStatus is the state of the detection of the dropped fragmented
+// UDP responses.
+type FragmentationStatus struct {
+	// Subnets are the subnets with the most probable drops.
+	Subnets []*FragmentationSubnet `json:"subnets"`
+
+	// RecommendedBufferSize is the EDNS(0) buffer size recommended for the
+	// subnets with Lowered set.  It's zero if there are none.
+	RecommendedBufferSize uint16 `json:"recommended_edns_buffer_size"`
+
+	// AutoApplied is true if the recommended buffer size is applied to
+	// these subnets automatically.
+	AutoApplied bool `json:"auto_applied"`
+}
+
+// Fragmentation returns the state of the detection of the dropped fragmented
+// UDP responses.
+func (s *Server) Fragmentation() (st FragmentationStatus) {
+	s.RLock()
+	auto := s.conf.AutoEDNSBufferSize
+	s.RUnlock()
+
+	f := &s.frag
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	st = FragmentationStatus{
+		Subnets:     []*FragmentationSubnet{},
+		AutoApplied: auto,
+	}
+
+	for subnet, fs := range f.subnets {
+		if fs.drops == 0 {
+			continue
+		}
+
+		fsn := &FragmentationSubnet{
+			LastDrop:       &aghtime.Time{Time: fs.lastDrop},
+			Subnet:         subnet,
+			LargeResponses: fs.large,
+			ProbableDrops:  fs.drops,
+			Truncated:      fs.truncated,
+			Lowered:        fs.drops >= fragMinDrops,
+		}
+
+		if fsn.Lowered {
+			st.RecommendedBufferSize = fragSafeSize
+		}
+
+		st.Subnets = append(st.Subnets, fsn)
+	}
+
+	sort.Slice(st.Subnets, func(i, j int) (less bool) {
+		a, b := st.Subnets[i], st.Subnets[j]
+		if a.ProbableDrops != b.ProbableDrops {
+			return a.ProbableDrops > b.ProbableDrops
+		}
+
+		return a.Subnet < b.Subnet
+	})
+
+	if len(st.Subnets) > fragTopSubnets {
+		st.Subnets = st.Subnets[:fragTopSubnets]
+	}
+
+	return st
+}
+
+// FragmentationCounters returns the counters of the detection of the dropped
+// fragmented UDP responses since the start.
+func (s *Server) FragmentationCounters() (fc stats.Fragmentation) {
+	f := &s.frag
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return stats.Fragmentation{
+		LargeResponses: f.total.large,
+		ProbableDrops:  f.total.drops,
+		Truncated:      f.total.truncated,
+	}
+}
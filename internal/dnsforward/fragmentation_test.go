@@ -0,0 +1,129 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest/dnsstub"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragSubnetOf(t *testing.T) {
+	assert.Equal(t, "192.168.1.0/24", fragSubnetOf(net.IP{192, 168, 1, 42}))
+	assert.Equal(t, "2001:db8:0:ab00::/56", fragSubnetOf(net.ParseIP("2001:db8:0:abcd::1")))
+}
+
+func TestFragDetector(t *testing.T) {
+	s := &Server{}
+	f := &s.frag
+
+	ip1, ip2 := net.IP{192, 168, 1, 2}, net.IP{192, 168, 1, 3}
+	q := dns.Question{Name: "Example.org.", Qtype: dns.TypeTXT, Qclass: dns.ClassINET}
+	start := time.Now()
+
+	// Not a retry.
+	assert.False(t, f.retried(ip1, q, start))
+
+	f.sent(ip1, q, start)
+	assert.False(t, f.retried(ip2, q, start.Add(time.Second)))
+
+	q.Name = "example.org."
+	assert.True(t, f.retried(ip1, q, start.Add(time.Second)))
+	assert.False(t, f.retried(ip1, q, start.Add(time.Second)))
+
+	// Too late.
+	f.sent(ip1, q, start)
+	assert.False(t, f.retried(ip1, q, start.Add(2*fragRetryWindow)))
+
+	assert.False(t, f.lowered(ip2))
+
+	for i := 0; i < fragMinDrops-1; i++ {
+		f.sent(ip2, q, start)
+		require.True(t, f.retried(ip2, q, start))
+	}
+
+	assert.True(t, f.lowered(ip1))
+	assert.True(t, f.lowered(ip2))
+	assert.False(t, f.lowered(net.IP{192, 168, 2, 2}))
+
+	f.truncated(ip1)
+
+	st := s.Fragmentation()
+	require.Len(t, st.Subnets, 1)
+
+	sn := st.Subnets[0]
+	assert.Equal(t, "192.168.1.0/24", sn.Subnet)
+	assert.Equal(t, uint64(fragMinDrops+1), sn.LargeResponses)
+	assert.Equal(t, uint64(fragMinDrops), sn.ProbableDrops)
+	assert.Equal(t, uint64(1), sn.Truncated)
+	assert.True(t, sn.Lowered)
+	assert.Equal(t, uint16(fragSafeSize), st.RecommendedBufferSize)
+	assert.False(t, st.AutoApplied)
+
+	fc := s.FragmentationCounters()
+	assert.Equal(t, uint64(fragMinDrops), fc.ProbableDrops)
+}
+
+func TestIntegration_fragmentation(t *testing.T) {
+	const host = "dnssec.example."
+
+	var answer []dns.RR
+	for i := 0; i < 100; i++ {
+		answer = append(answer, dnsstub.A(net.IP{10, 0, 0, byte(i)}, 60))
+	}
+
+	ups := dnsstub.New(t)
+	ups.Set(host, &dnsstub.Response{Answer: answer})
+
+	h := newTestHarness(t, "", FilteringConfig{
+		AutoEDNSBufferSize: true,
+	}, ups)
+
+	udp := &dns.Client{Net: "udp", UDPSize: dns.DefaultMsgSize}
+	tcp := &dns.Client{Net: "tcp"}
+	udpAddr := h.srv.dnsProxy.Addr(proxy.ProtoUDP).String()
+	tcpAddr := h.srv.dnsProxy.Addr(proxy.ProtoTCP).String()
+
+	newReq := func() (req *dns.Msg) {
+		req = createTestMessage(host)
+		req.SetEdns0(dns.DefaultMsgSize, false)
+
+		return req
+	}
+
+	// The client doesn't receive the large UDP responses and retries over
+	// TCP.
+	for i := 0; i < fragMinDrops; i++ {
+		resp, _, err := udp.Exchange(newReq(), udpAddr)
+		require.NoError(t, err)
+		require.False(t, resp.Truncated)
+		require.Len(t, resp.Answer, len(answer))
+
+		_, _, err = tcp.Exchange(newReq(), tcpAddr)
+		require.NoError(t, err)
+	}
+
+	fc := h.srv.FragmentationCounters()
+	assert.Equal(t, uint64(fragMinDrops), fc.ProbableDrops)
+	assert.Equal(t, uint64(fragMinDrops), fc.LargeResponses)
+
+	// Now the responses are truncated, so that the clients retry over TCP
+	// right away.
+	resp, _, err := udp.Exchange(newReq(), udpAddr)
+	require.NoError(t, err)
+
+	assert.True(t, resp.Truncated)
+	assert.Empty(t, resp.Answer)
+
+	fc = h.srv.FragmentationCounters()
+	assert.Equal(t, uint64(1), fc.Truncated)
+
+	st := h.srv.Fragmentation()
+	require.Len(t, st.Subnets, 1)
+	assert.True(t, st.Subnets[0].Lowered)
+	assert.True(t, st.AutoApplied)
+}
@@ -0,0 +1,471 @@
+package dnsforward
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Hijack policies, which define what's done while the DNS traffic to a plain
+// DNS upstream is intercepted by the network.
+const (
+	// HijackPolicyWarn only reports the hijacked upstreams.
+	HijackPolicyWarn = "warn"
+
+	// HijackPolicyEncryptedOnly also stops using the hijacked upstreams,
+	// so that only the encrypted ones are used, as long as there are any
+	// among the default upstreams.
+	HijackPolicyEncryptedOnly = "encrypted_only"
+)
+
+// hijackCanaryZone is the zone of the names resolved by the hijack probes.
+// It's reserved by RFC 6761, so a genuine resolver never returns any records
+// for it, and any answer is forged.
+const hijackCanaryZone = "invalid."
+
+// errUpstreamHijacked is returned by the hijacked plain DNS upstreams when they
+// aren't used due to HijackPolicyEncryptedOnly.
+const errUpstreamHijacked agherr.Error = "upstream is hijacked by the network"
+
+// isPlainUpstream returns true if addr is the address of a plain DNS upstream,
+// which doesn't protect the traffic from the interception.
+func isPlainUpstream(addr string) (ok bool) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return true
+	}
+
+	switch addr[:i] {
+	case "udp", "tcp":
+		return true
+	default:
+		return false
+	}
+}
+
+// HijackEvent is a change of the state of a plain DNS upstream.
+type HijackEvent struct {
+	// Time is the time of the probe, which has detected the change.
+	Time time.Time
+
+	// Upstream is the address of the upstream.
+	Upstream string
+
+	// Answer are the forged records returned for the canary name.  It's
+	// empty if Hijacked is false.
+	Answer []string
+
+	// Hijacked is true if the hijacking has been detected and false if it
+	// has stopped.
+	Hijacked bool
+
+	// Disabled is true if the upstream isn't used while it's hijacked.
+	Disabled bool
+}
+
+// hijackState is the state of a single plain DNS upstream.
+type hijackState struct {
+	// since is the time when the hijacking has been detected.
+	since time.Time
+
+	// lastProbe is the time of the latest probe.
+	lastProbe time.Time
+
+	// err is the error of the latest probe, if it has failed.
+	err string
+
+	// answer are the forged records from the latest probe.
+	answer []string
+
+	hijacked bool
+}
+
+// hijackDetector probes the plain DNS upstreams in the background with the
+// canary names, which can't have any records, to detect the networks answering
+// the DNS requests themselves.
+//
+// The zero hijackDetector is empty and ready for use.
+type hijackDetector struct {
+	// mu protects all the fields except done.
+	mu sync.Mutex
+
+	// states are the states of the upstreams by their addresses.
+	states map[string]*hijackState
+
+	// onChange, if not nil, is called when an upstream becomes hijacked or
+	// stops being hijacked.
+	onChange func(e HijackEvent)
+
+	// done is closed to stop probing.  It's protected by the lock of the
+	// Server.
+	done chan struct{}
+
+	// targets are the plain DNS upstreams to probe.
+	targets []upstream.Upstream
+
+	ivl time.Duration
+
+	policy string
+
+	// disable is true if the hijacked upstreams aren't used.
+	disable bool
+}
+
+// newHijackTargets returns the plain DNS upstreams of uc and reports if there
+// are any encrypted ones among the default upstreams.
+func newHijackTargets(uc *proxy.UpstreamConfig) (targets []upstream.Upstream, hasEncrypted bool) {
+	if uc == nil {
+		return nil, false
+	}
+
+	seen := map[string]bool{}
+	add := func(ups []upstream.Upstream) {
+		for _, u := range ups {
+			if tu, ok := u.(*tracedUpstream); ok {
+				u = tu.Upstream
+			}
+
+			addr := u.Address()
+			if !isPlainUpstream(addr) || seen[addr] {
+				continue
+			}
+
+			seen[addr] = true
+			targets = append(targets, u)
+		}
+	}
+
+	add(uc.Upstreams)
+	for _, u := range uc.Upstreams {
+		if !isPlainUpstream(u.Address()) {
+			hasEncrypted = true
+
+			break
+		}
+	}
+
+	domains := make([]string, 0, len(uc.DomainReservedUpstreams))
+	for d := range uc.DomainReservedUpstreams {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	for _, d := range domains {
+		add(uc.DomainReservedUpstreams[d])
+	}
+
+	return targets, hasEncrypted
+}
+
+// configure sets the upstreams to probe and the policy.  The states of the
+// upstreams, which are still configured, are kept.
+func (h *hijackDetector) configure(
+	targets []upstream.Upstream,
+	ivl time.Duration,
+	policy string,
+	disable bool,
+	onChange func(e HijackEvent),
+) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	states := make(map[string]*hijackState, len(targets))
+	for _, u := range targets {
+		addr := u.Address()
+		if st, ok := h.states[addr]; ok {
+			states[addr] = st
+		} else {
+			states[addr] = &hijackState{}
+		}
+	}
+
+	h.states = states
+	h.targets = targets
+	h.ivl = ivl
+	h.policy = policy
+	h.disable = disable
+	h.onChange = onChange
+}
+
+// start starts probing in a separate goroutine.  The first round of the probes
+// is sent right away.
+func (h *hijackDetector) start() {
+	h.mu.Lock()
+	ivl, targets := h.ivl, h.targets
+	h.mu.Unlock()
+
+	if ivl == 0 || len(targets) == 0 || h.done != nil {
+		return
+	}
+
+	h.done = make(chan struct{})
+	go h.run(h.done, targets, ivl)
+}
+
+// stop stops probing.  The probes already sent aren't waited for.
+func (h *hijackDetector) stop() {
+	if h.done == nil {
+		return
+	}
+
+	close(h.done)
+	h.done = nil
+}
+
+// run probes targets every ivl until done is closed.
+func (h *hijackDetector) run(done <-chan struct{}, targets []upstream.Upstream, ivl time.Duration) {
+	defer agherr.LogPanic("dns: hijack detector")
+
+	t := time.NewTicker(ivl)
+	defer t.Stop()
+
+	for {
+		for _, u := range targets {
+			h.probe(u)
+		}
+
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			// Go on.
+		}
+	}
+}
+
+// forgedAnswers returns the records from resp to the canary request.  Either
+// of them means that the response is forged, including the addresses of the
+// advertisement pages in the NXDOMAIN responses.
+func forgedAnswers(resp *dns.Msg) (answer []string) {
+	for _, rr := range resp.Answer {
+		switch rr := rr.(type) {
+		case *dns.A:
+			answer = append(answer, rr.A.String())
+		case *dns.AAAA:
+			answer = append(answer, rr.AAAA.String())
+		case *dns.CNAME:
+			answer = append(answer, rr.Target)
+		default:
+			answer = append(answer, dns.TypeToString[rr.Header().Rrtype])
+		}
+	}
+
+	return answer
+}
+
+// probe resolves a random canary name with u and records the result.
+func (h *hijackDetector) probe(u upstream.Upstream) {
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   fmt.Sprintf("agh-%08x.%s", rand.Uint32(), hijackCanaryZone),
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	now := time.Now()
+	resp, err := u.Exchange(req)
+	if err == nil && resp == nil {
+		err = agherr.Error("no response")
+	}
+
+	h.probed(u.Address(), now, resp, err)
+}
+
+// probed records the result of the probe of the upstream with addr made at
+// now.  The failed probes don't change the state.
+func (h *hijackDetector) probed(addr string, now time.Time, resp *dns.Msg, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[addr]
+	if !ok {
+		// The upstream has been removed from the configuration.
+		return
+	}
+
+	st.lastProbe = now
+	if err != nil {
+		log.Debug("dns: probing upstream %s for hijacking: %s", addr, err)
+		st.err = err.Error()
+
+		return
+	}
+
+	st.err = ""
+	st.answer = forgedAnswers(resp)
+	hijacked := len(st.answer) > 0
+	if hijacked == st.hijacked {
+		return
+	}
+
+	st.hijacked = hijacked
+	if hijacked {
+		st.since = now
+		log.Info("dns: upstream %s is hijacked by the network, got %q", addr, st.answer)
+	} else {
+		st.since = time.Time{}
+		log.Info("dns: upstream %s is no longer hijacked", addr)
+	}
+
+	if h.onChange != nil {
+		h.onChange(HijackEvent{
+			Time:     now,
+			Upstream: addr,
+			Answer:   append([]string{}, st.answer...),
+			Hijacked: hijacked,
+			Disabled: hijacked && h.disable,
+		})
+	}
+}
+
+// disabled returns true if the upstream with addr isn't used, since it's
+// hijacked and the policy says so.
+func (h *hijackDetector) disabled(addr string) (ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.disable {
+		return false
+	}
+
+	st, ok := h.states[addr]
+
+	return ok && st.hijacked
+}
+
+// prepareHijack validates the configuration of the hijack probes and prepares
+// the detector of the configured plain DNS upstreams.  The previous probes, if
+// any, are stopped.
+func (s *Server) prepareHijack() (err error) {
+	policy := s.conf.HijackPolicy
+	switch policy {
+	case "":
+		policy = HijackPolicyWarn
+	case HijackPolicyWarn, HijackPolicyEncryptedOnly:
+		// Go on.
+	default:
+		return fmt.Errorf("hijack policy: unknown policy %q", policy)
+	}
+
+	s.hijack.stop()
+
+	targets, hasEncrypted := newHijackTargets(s.conf.UpstreamConfig)
+	disable := policy == HijackPolicyEncryptedOnly && hasEncrypted
+	if policy == HijackPolicyEncryptedOnly && !hasEncrypted {
+		log.Info("dns: warning: hijack policy %q has no effect without encrypted upstreams", policy)
+	}
+
+	ivl := time.Duration(s.conf.HijackProbeInterval) * time.Minute
+	s.hijack.configure(targets, ivl, policy, disable, s.conf.OnHijackChanged)
+
+	return nil
+}
+
+// HijackUpstream is the state of a single plain DNS upstream.
+type HijackUpstream struct {
+	// Since is the time when the hijacking has been detected.  It's nil if
+	// the upstream isn't hijacked.
+	Since *aghtime.Time `json:"since,omitempty"`
+
+	// LastProbe is nil if the upstream hasn't been probed yet.
+	LastProbe *aghtime.Time `json:"last_probe,omitempty"`
+
+	Address string `json:"address"`
+
+	// Error is the error of the latest probe, if it has failed.
+	Error string `json:"error,omitempty"`
+
+	// Answer are the forged records returned for the canary name.
+	Answer []string `json:"answer"`
+
+	Hijacked bool `json:"hijacked"`
+
+	// Disabled is true if the upstream isn't used while it's hijacked.
+	Disabled bool `json:"disabled"`
+}
+
+// HijackStatus is the state of the detection of the DNS hijacking.
+type HijackStatus struct {
+	// Upstreams are the probed plain DNS upstreams.
+	Upstreams []*HijackUpstream `json:"upstreams"`
+
+	Policy string `json:"policy"`
+
+	// ProbeInterval is the interval between the probes in minutes.  Zero
+	// means that the upstreams aren't probed.
+	ProbeInterval uint32 `json:"probe_interval"`
+
+	// Detected is true if any of the upstreams is hijacked.
+	Detected bool `json:"detected"`
+}
+
+// Hijacking returns the state of the detection of the DNS hijacking.
+func (s *Server) Hijacking() (st HijackStatus) {
+	h := &s.hijack
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st = HijackStatus{
+		Upstreams:     []*HijackUpstream{},
+		Policy:        h.policy,
+		ProbeInterval: uint32(h.ivl / time.Minute),
+	}
+
+	for _, u := range h.targets {
+		addr := u.Address()
+		hs := h.states[addr]
+		hu := &HijackUpstream{
+			Address:  addr,
+			Error:    hs.err,
+			Answer:   append([]string{}, hs.answer...),
+			Hijacked: hs.hijacked,
+			Disabled: hs.hijacked && h.disable,
+		}
+
+		if !hs.lastProbe.IsZero() {
+			hu.LastProbe = &aghtime.Time{Time: hs.lastProbe}
+		}
+
+		if hs.hijacked {
+			hu.Since = &aghtime.Time{Time: hs.since}
+			st.Detected = true
+		}
+
+		st.Upstreams = append(st.Upstreams, hu)
+	}
+
+	return st
+}
+
+// HijackWarnings returns the warnings about the hijacked plain DNS upstreams.
+func (s *Server) HijackWarnings() (warns []string) {
+	for _, u := range s.Hijacking().Upstreams {
+		if !u.Hijacked {
+			continue
+		}
+
+		w := fmt.Sprintf("dns requests to upstream %s are answered by the network", u.Address)
+		if u.Disabled {
+			w += ", the upstream isn't used"
+		}
+
+		warns = append(warns, w)
+	}
+
+	return warns
+}
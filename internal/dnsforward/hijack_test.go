@@ -0,0 +1,190 @@
+package dnsforward
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// hijackingUpstream is an upstream answering every A request with forged, if
+// it's set, and with NXDOMAIN otherwise.
+type hijackingUpstream struct {
+	// mu protects forged.
+	mu     sync.Mutex
+	forged net.IP
+
+	addr string
+}
+
+// setForged sets the forged address.
+func (u *hijackingUpstream) setForged(ip net.IP) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.forged = ip
+}
+
+// Exchange implements the upstream.Upstream interface for *hijackingUpstream.
+func (u *hijackingUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	resp = (&dns.Msg{}).SetReply(m)
+	if u.forged == nil {
+		resp.Rcode = dns.RcodeNameError
+
+		return resp, nil
+	}
+
+	resp.Answer = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{
+			Name:   m.Question[0].Name,
+			Rrtype: dns.TypeA,
+			Class:  dns.ClassINET,
+			Ttl:    60,
+		},
+		A: u.forged,
+	}}
+
+	return resp, nil
+}
+
+// Address implements the upstream.Upstream interface for *hijackingUpstream.
+func (u *hijackingUpstream) Address() (addr string) {
+	return u.addr
+}
+
+func TestIsPlainUpstream(t *testing.T) {
+	assert.True(t, isPlainUpstream("8.8.8.8:53"))
+	assert.True(t, isPlainUpstream("udp://8.8.8.8:53"))
+	assert.True(t, isPlainUpstream("tcp://8.8.8.8:53"))
+	assert.False(t, isPlainUpstream("tls://dns.example"))
+	assert.False(t, isPlainUpstream("https://dns.example/dns-query"))
+	assert.False(t, isPlainUpstream("quic://dns.example"))
+	assert.False(t, isPlainUpstream("sdns://AQcAAAAAAAAA"))
+}
+
+func TestNewHijackTargets(t *testing.T) {
+	plain := &aghtest.TestUpstream{Addr: "1.2.3.4:53"}
+	tcp := &aghtest.TestUpstream{Addr: "tcp://1.2.3.4:53"}
+	enc := &aghtest.TestUpstream{Addr: "tls://dns.example"}
+	local := &aghtest.TestUpstream{Addr: "192.168.1.1:53"}
+
+	ts := &upstreamTraces{}
+	uc := ts.wrap(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{plain, enc, tcp},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"lan.":     {local, plain},
+			"example.": {enc},
+		},
+	})
+
+	targets, hasEncrypted := newHijackTargets(uc)
+	assert.True(t, hasEncrypted)
+	assert.Equal(t, []upstream.Upstream{plain, tcp, local}, targets)
+
+	_, hasEncrypted = newHijackTargets(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{plain},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.": {enc},
+		},
+	})
+	assert.False(t, hasEncrypted)
+}
+
+func TestHijackDetector(t *testing.T) {
+	hijacking := &hijackingUpstream{addr: "1.2.3.4:53"}
+	genuine := &hijackingUpstream{addr: "5.6.7.8:53"}
+	failing := &aghtest.TestErrUpstream{}
+
+	var events []HijackEvent
+	s := &Server{}
+	h := &s.hijack
+	h.configure(
+		[]upstream.Upstream{hijacking, genuine, failing},
+		time.Minute,
+		HijackPolicyEncryptedOnly,
+		true,
+		func(e HijackEvent) { events = append(events, e) },
+	)
+
+	probeAll := func() {
+		for _, u := range h.targets {
+			h.probe(u)
+		}
+	}
+
+	ts := &upstreamTraces{hijack: h}
+	uc := ts.wrap(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{hijacking},
+	})
+
+	probeAll()
+	assert.Empty(t, events)
+	assert.False(t, h.disabled(hijacking.addr))
+
+	hijacking.setForged(net.IP{203, 0, 113, 1})
+	probeAll()
+	require.Len(t, events, 1)
+	assert.Equal(t, hijacking.addr, events[0].Upstream)
+	assert.Equal(t, []string{"203.0.113.1"}, events[0].Answer)
+	assert.True(t, events[0].Hijacked)
+	assert.True(t, events[0].Disabled)
+
+	assert.True(t, h.disabled(hijacking.addr))
+	assert.False(t, h.disabled(genuine.addr))
+
+	_, err := uc.Upstreams[0].Exchange(&dns.Msg{Question: []dns.Question{{
+		Name:  "example.org.",
+		Qtype: dns.TypeA,
+	}}})
+	assert.True(t, errors.Is(err, errUpstreamHijacked))
+
+	st := s.Hijacking()
+	assert.True(t, st.Detected)
+	assert.Equal(t, HijackPolicyEncryptedOnly, st.Policy)
+	assert.Equal(t, uint32(1), st.ProbeInterval)
+	require.Len(t, st.Upstreams, 3)
+
+	assert.True(t, st.Upstreams[0].Hijacked)
+	assert.True(t, st.Upstreams[0].Disabled)
+	assert.NotNil(t, st.Upstreams[0].Since)
+	assert.False(t, st.Upstreams[1].Hijacked)
+	assert.NotNil(t, st.Upstreams[1].LastProbe)
+	assert.NotEmpty(t, st.Upstreams[2].Error)
+
+	assert.Len(t, s.HijackWarnings(), 1)
+
+	// Probing the hijacked upstream goes on, so it's used again once the
+	// network stops answering for it.
+	hijacking.setForged(nil)
+	probeAll()
+	require.Len(t, events, 2)
+	assert.False(t, events[1].Hijacked)
+	assert.False(t, h.disabled(hijacking.addr))
+}
+
+func TestServer_prepareHijack(t *testing.T) {
+	s := &Server{}
+	s.conf.HijackPolicy = "unknown"
+	assert.Error(t, s.prepareHijack())
+
+	s.conf.HijackPolicy = HijackPolicyEncryptedOnly
+	s.conf.UpstreamConfig = &proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&aghtest.TestUpstream{Addr: "1.2.3.4:53"}},
+	}
+	require.NoError(t, s.prepareHijack())
+
+	// Without the encrypted upstreams, the plain ones are used anyway.
+	assert.False(t, s.hijack.disable)
+	assert.Equal(t, HijackPolicyEncryptedOnly, s.Hijacking().Policy)
+}
@@ -42,6 +42,10 @@ type dnsConfig struct {
 	CacheMaxTTL       *uint32   `json:"cache_ttl_max"`
 	ResolveClients    *bool     `json:"resolve_clients"`
 	LocalPTRUpstreams *[]string `json:"local_ptr_upstreams"`
+
+	TTLOverrides *[]TTLOverride `json:"ttl_overrides"`
+
+	UpstreamOptions *[]UpstreamOptions `json:"upstream_options"`
 }
 
 func (s *Server) getDNSConfig() dnsConfig {
@@ -62,6 +66,8 @@ func (s *Server) getDNSConfig() dnsConfig {
 	cacheSize := s.conf.CacheSize
 	cacheMinTTL := s.conf.CacheMinTTL
 	cacheMaxTTL := s.conf.CacheMaxTTL
+	ttlOverrides := append([]TTLOverride{}, s.conf.TTLOverrides...)
+	upstreamOptions := append([]UpstreamOptions{}, s.conf.UpstreamOptions...)
 	resolveClients := s.conf.ResolveClients
 	localPTRUpstreams := aghstrings.CloneSliceOrEmpty(s.conf.LocalPTRResolvers)
 	var upstreamMode string
@@ -86,6 +92,8 @@ func (s *Server) getDNSConfig() dnsConfig {
 		CacheSize:         &cacheSize,
 		CacheMinTTL:       &cacheMinTTL,
 		CacheMaxTTL:       &cacheMaxTTL,
+		TTLOverrides:      &ttlOverrides,
+		UpstreamOptions:   &upstreamOptions,
 		UpstreamMode:      &upstreamMode,
 		ResolveClients:    &resolveClients,
 		LocalPTRUpstreams: &localPTRUpstreams,
@@ -197,6 +205,12 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 			httpError(r, w, http.StatusBadRequest, "wrong upstreams specification: %s", err)
 			return
 		}
+
+		ups := aghstrings.FilterOut(*req.Upstreams, aghstrings.IsCommentOrEmpty)
+		if err := s.validateUpstreamLoops(ups); err != nil {
+			httpError(r, w, http.StatusBadRequest, "wrong upstreams specification: %s", err)
+			return
+		}
 	}
 
 	if errBoot, err := req.checkBootstrap(); err != nil {
@@ -219,6 +233,20 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	if req.TTLOverrides != nil {
+		if err := validateTTLOverrides(*req.TTLOverrides); err != nil {
+			httpError(r, w, http.StatusBadRequest, "ttl_overrides: %s", err)
+			return
+		}
+	}
+
+	if req.UpstreamOptions != nil {
+		if err := validateUpstreamOptions(*req.UpstreamOptions); err != nil {
+			httpError(r, w, http.StatusBadRequest, "upstream_options: %s", err)
+			return
+		}
+	}
+
 	restart := s.setConfig(req)
 	s.conf.ConfigModified()
 
@@ -232,7 +260,12 @@ func (s *Server) handleSetConfig(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) setConfigRestartable(dc dnsConfig) (restart bool) {
 	if dc.Upstreams != nil {
+		changed := !stringsEqual(s.conf.UpstreamDNS, *dc.Upstreams)
 		s.conf.UpstreamDNS = *dc.Upstreams
+		if changed && s.conf.OnUpstreamsChanged != nil {
+			s.conf.OnUpstreamsChanged()
+		}
+
 		restart = true
 	}
 
@@ -276,15 +309,46 @@ func (s *Server) setConfigRestartable(dc dnsConfig) (restart bool) {
 		restart = true
 	}
 
+	// Restart to flush the answers cached with the previous TTLs.
+	if dc.TTLOverrides != nil {
+		s.conf.TTLOverrides = *dc.TTLOverrides
+		restart = true
+	}
+
+	if dc.UpstreamOptions != nil {
+		s.conf.UpstreamOptions = *dc.UpstreamOptions
+		restart = true
+	}
+
 	return restart
 }
 
+// stringsEqual returns true if a and b contain the same strings in the same
+// order.
+func stringsEqual(a, b []string) (ok bool) {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 func (s *Server) setConfig(dc dnsConfig) (restart bool) {
 	s.Lock()
 	defer s.Unlock()
 
 	if dc.ProtectionEnabled != nil {
+		changed := s.conf.ProtectionEnabled != *dc.ProtectionEnabled
 		s.conf.ProtectionEnabled = *dc.ProtectionEnabled
+		if changed && s.conf.OnProtectionChanged != nil {
+			s.conf.OnProtectionChanged(s.conf.ProtectionEnabled)
+		}
 	}
 
 	if dc.BlockingMode != nil {
@@ -320,6 +384,10 @@ type upstreamJSON struct {
 	Upstreams        []string `json:"upstream_dns"`
 	BootstrapDNS     []string `json:"bootstrap_dns"`
 	PrivateUpstreams []string `json:"private_upstream"`
+
+	// UpstreamOptions are the options of the single upstreams to test
+	// with.  If nil, the current ones are used.
+	UpstreamOptions *[]UpstreamOptions `json:"upstream_options"`
 }
 
 // ValidateUpstreams validates each upstream and returns an error if any
@@ -509,7 +577,14 @@ func checkPrivateUpstreamExc(u upstream.Upstream) (err error) {
 	return nil
 }
 
-func checkDNS(input string, bootstrap []string, ef excFunc) (err error) {
+// checkDNS checks if the upstream from the line input works using ef.  The
+// options from byAddr apply to the upstream, if any.
+func checkDNS(
+	input string,
+	bootstrap []string,
+	byAddr map[string]*UpstreamOptions,
+	ef excFunc,
+) (err error) {
 	if aghstrings.IsCommentOrEmpty(input) {
 		return nil
 	}
@@ -534,15 +609,24 @@ func checkDNS(input string, bootstrap []string, ef excFunc) (err error) {
 	}
 
 	log.Debug("checking if dns server %q works...", input)
-	var u upstream.Upstream
-	u, err = upstream.AddressToUpstream(input, upstream.Options{
+	opts := upstream.Options{
 		Bootstrap: bootstrap,
 		Timeout:   DefaultTimeout,
-	})
+	}
+
+	var u upstream.Upstream
+	u, err = upstream.AddressToUpstream(input, opts)
 	if err != nil {
 		return fmt.Errorf("failed to choose upstream for %q: %w", input, err)
 	}
 
+	if o, ok := byAddr[u.Address()]; ok {
+		u, err = newOptionsUpstream(o, opts)
+		if err != nil {
+			return fmt.Errorf("failed to choose upstream for %q: %w", input, err)
+		}
+	}
+
 	if err = ef(u); err != nil {
 		return fmt.Errorf("upstream %q fails to exchange: %w", input, err)
 	}
@@ -552,6 +636,14 @@ func checkDNS(input string, bootstrap []string, ef excFunc) (err error) {
 	return nil
 }
 
+// CheckUpstream returns an error if the upstream from the upstream line addr
+// can't resolve a well-known name.  The upstreams reserved for domains aren't
+// checked.  bootstrap are the bootstrap servers and opts are the options of
+// the single upstreams.
+func CheckUpstream(addr string, bootstrap []string, opts []UpstreamOptions) (err error) {
+	return checkDNS(addr, bootstrap, upstreamOptionsByAddr(opts), checkDNSUpstreamExc)
+}
+
 func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	req := &upstreamJSON{}
 	err := json.NewDecoder(r.Body).Decode(req)
@@ -561,11 +653,27 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var upsOpts []UpstreamOptions
+	if req.UpstreamOptions != nil {
+		upsOpts = *req.UpstreamOptions
+		err = validateUpstreamOptions(upsOpts)
+		if err != nil {
+			httpError(r, w, http.StatusBadRequest, "upstream_options: %s", err)
+
+			return
+		}
+	} else {
+		s.RLock()
+		upsOpts = append([]UpstreamOptions{}, s.conf.UpstreamOptions...)
+		s.RUnlock()
+	}
+
 	result := map[string]string{}
 	bootstraps := req.BootstrapDNS
+	byAddr := upstreamOptionsByAddr(upsOpts)
 
 	for _, host := range req.Upstreams {
-		err = checkDNS(host, bootstraps, checkDNSUpstreamExc)
+		err = checkDNS(host, bootstraps, byAddr, checkDNSUpstreamExc)
 		if err != nil {
 			log.Info("%v", err)
 			result[host] = err.Error()
@@ -577,7 +685,7 @@ func (s *Server) handleTestUpstreamDNS(w http.ResponseWriter, r *http.Request) {
 	}
 
 	for _, host := range req.PrivateUpstreams {
-		err = checkDNS(host, bootstraps, checkPrivateUpstreamExc)
+		err = checkDNS(host, bootstraps, byAddr, checkPrivateUpstreamExc)
 		if err != nil {
 			log.Info("%v", err)
 			// TODO(e.burkov): If passed upstream have already
@@ -630,6 +738,11 @@ func (s *Server) registerHandlers() {
 	s.conf.HTTPRegister(http.MethodGet, "/control/dns_info", s.handleGetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/dns_config", s.handleSetConfig)
 	s.conf.HTTPRegister(http.MethodPost, "/control/test_upstream_dns", s.handleTestUpstreamDNS)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstream_health", s.handleUpstreamHealth)
+	s.conf.HTTPRegister(http.MethodGet, "/control/upstream_metrics", s.handleUpstreamMetrics)
+	s.conf.HTTPRegister(http.MethodPost, "/control/benchmark_upstreams", s.handleBenchmarkUpstreams)
+	s.conf.HTTPRegister(http.MethodPost, "/control/cache_warmup/abort", s.handleCacheWarmupAbort)
+	s.conf.HTTPRegister(http.MethodGet, "/control/cache", s.handleCache)
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/access/list", s.handleAccessList)
 	s.conf.HTTPRegister(http.MethodPost, "/control/access/set", s.handleAccessSet)
@@ -190,6 +190,13 @@ func TestDNSForwardHTTTP_handleSetConfig(t *testing.T) {
 	}, {
 		name:    "local_ptr_upstreams_null",
 		wantSet: "",
+	}, {
+		name:    "ttl_overrides_good",
+		wantSet: "",
+	}, {
+		name: "ttl_overrides_bad",
+		wantSet: `ttl_overrides: ttl override at index 0: ` +
+			`pattern "example.org": max 30 is less than min 60`,
 	}}
 
 	var data map[string]struct {
@@ -0,0 +1,164 @@
+package dnsforward
+
+import (
+	"container/list"
+	"sync"
+)
+
+// InflightStats is the current state of the limit on the number of the
+// requests processed simultaneously.
+type InflightStats struct {
+	// Limit is the maximum number of the requests processed simultaneously.
+	// Zero means no limit.
+	Limit int `json:"limit"`
+
+	// Active is the number of the requests being processed.
+	Active int `json:"active"`
+
+	// Queued is the number of the requests waiting for processing.
+	Queued int `json:"queued"`
+
+	// Dropped is the number of the oldest queued requests dropped since the
+	// start because the queue was full.
+	Dropped uint64 `json:"dropped"`
+
+	// Refused is the number of the requests over the limit answered with
+	// REFUSED since the start in the load-shedding mode.
+	Refused uint64 `json:"refused"`
+}
+
+// inflightLimiter limits the number of the requests processed simultaneously
+// regardless of the protocol.  The requests over the limit wait in a queue.
+// When the queue is full, the oldest waiting request is dropped to make room
+// for the new one, since its client has most likely given up on it already.
+// In the load-shedding mode, the requests over the limit aren't queued at all.
+type inflightLimiter struct {
+	// mu protects all the fields below.
+	mu sync.Mutex
+
+	// queue contains the chan bool of the waiting requests.  true is sent
+	// when the request may be processed and false when it's dropped.
+	queue *list.List
+
+	limit      int
+	queueLimit int
+	active     int
+
+	dropped uint64
+	refused uint64
+
+	// shed is true if the requests over the limit are refused right away.
+	shed bool
+}
+
+// newInflightLimiter returns a limiter for conf.  l is nil if there is no
+// limit.
+func newInflightLimiter(conf *FilteringConfig) (l *inflightLimiter) {
+	if conf.MaxInflightQueries == 0 {
+		return nil
+	}
+
+	return &inflightLimiter{
+		queue:      list.New(),
+		limit:      int(conf.MaxInflightQueries),
+		queueLimit: int(conf.InflightQueueSize),
+		shed:       conf.LoadShedding,
+	}
+}
+
+// inflightResult is the result of waiting for the limiter.
+type inflightResult int
+
+const (
+	// inflightOK means that the request may be processed.
+	inflightOK inflightResult = iota
+	// inflightDropped means that the request has been dropped from the
+	// queue.
+	inflightDropped
+	// inflightRefused means that the request must be refused.
+	inflightRefused
+)
+
+// acquire waits until the request may be processed.  release must be called
+// once the request is processed if res is inflightOK.
+func (l *inflightLimiter) acquire() (res inflightResult) {
+	l.mu.Lock()
+
+	if l.active < l.limit {
+		l.active++
+		l.mu.Unlock()
+
+		return inflightOK
+	}
+
+	if l.shed {
+		l.refused++
+		l.mu.Unlock()
+
+		return inflightRefused
+	}
+
+	if l.queue.Len() >= l.queueLimit {
+		l.dropped++
+		if l.queueLimit == 0 {
+			l.mu.Unlock()
+
+			return inflightDropped
+		}
+
+		oldest := l.queue.Remove(l.queue.Front()).(chan bool)
+		oldest <- false
+	}
+
+	ch := make(chan bool, 1)
+	l.queue.PushBack(ch)
+	l.mu.Unlock()
+
+	if <-ch {
+		return inflightOK
+	}
+
+	return inflightDropped
+}
+
+// release hands the place of a processed request over to the first waiting
+// one, if any.
+func (l *inflightLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if e := l.queue.Front(); e != nil {
+		l.queue.Remove(e).(chan bool) <- true
+
+		return
+	}
+
+	l.active--
+}
+
+// stats returns the current state of the limiter.
+func (l *inflightLimiter) stats() (st InflightStats) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return InflightStats{
+		Limit:   l.limit,
+		Active:  l.active,
+		Queued:  l.queue.Len(),
+		Dropped: l.dropped,
+		Refused: l.refused,
+	}
+}
+
+// InflightQueries returns the current state of the limit on the number of the
+// requests processed simultaneously.
+func (s *Server) InflightQueries() (st InflightStats) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.inflight == nil {
+		return InflightStats{}
+	}
+
+	return s.inflight.stats()
+}
@@ -0,0 +1,267 @@
+package dnsforward
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInflightLimiter(t *testing.T) {
+	t.Run("no_limit", func(t *testing.T) {
+		assert.Nil(t, newInflightLimiter(&FilteringConfig{}))
+	})
+
+	t.Run("drop_oldest", func(t *testing.T) {
+		l := newInflightLimiter(&FilteringConfig{
+			MaxInflightQueries: 1,
+			InflightQueueSize:  1,
+		})
+		require.Equal(t, inflightOK, l.acquire())
+
+		first := make(chan inflightResult, 1)
+		go func() { first <- l.acquire() }()
+		require.Eventually(t, func() bool {
+			return l.stats().Queued == 1
+		}, time.Second, time.Millisecond)
+
+		second := make(chan inflightResult, 1)
+		go func() { second <- l.acquire() }()
+
+		// The oldest waiting request makes room for the new one.
+		assert.Equal(t, inflightDropped, <-first)
+
+		l.release()
+		assert.Equal(t, inflightOK, <-second)
+
+		l.release()
+		assert.Equal(t, InflightStats{
+			Limit:   1,
+			Dropped: 1,
+		}, l.stats())
+	})
+
+	t.Run("no_queue", func(t *testing.T) {
+		l := newInflightLimiter(&FilteringConfig{
+			MaxInflightQueries: 1,
+		})
+		require.Equal(t, inflightOK, l.acquire())
+
+		assert.Equal(t, inflightDropped, l.acquire())
+	})
+
+	t.Run("shed", func(t *testing.T) {
+		l := newInflightLimiter(&FilteringConfig{
+			MaxInflightQueries: 1,
+			InflightQueueSize:  10,
+			LoadShedding:       true,
+		})
+		require.Equal(t, inflightOK, l.acquire())
+
+		assert.Equal(t, inflightRefused, l.acquire())
+		assert.EqualValues(t, 1, l.stats().Refused)
+	})
+}
+
+// slowUpstream is an upstream answering after a delay.
+type slowUpstream struct {
+	aghtest.TestUpstream
+
+	delay time.Duration
+}
+
+// Exchange implements the upstream.Upstream interface for *slowUpstream.
+func (u *slowUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	time.Sleep(u.delay)
+
+	return u.TestUpstream.Exchange(m)
+}
+
+// loadSample is the peak usage of the resources during a load test phase.
+type loadSample struct {
+	goroutines int
+	active     int
+	queued     int
+}
+
+// runLoad sends queries from clients concurrent clients to the TCP address of
+// s and returns the peak resource usage.
+func runLoad(t *testing.T, s *Server, clients, queries int) (peak loadSample) {
+	t.Helper()
+
+	addr := s.dnsProxy.Addr(proxy.ProtoTCP).String()
+
+	var answered, failed int64
+	wg := &sync.WaitGroup{}
+	wg.Add(clients)
+	for i := 0; i < clients; i++ {
+		go func() {
+			defer wg.Done()
+
+			c := &dns.Client{Net: proxy.ProtoTCP, Timeout: 5 * time.Second}
+			for j := 0; j < queries; j++ {
+				resp, _, err := c.Exchange(createGoogleATestMessage(), addr)
+				if err != nil || resp.Rcode != dns.RcodeSuccess {
+					atomic.AddInt64(&failed, 1)
+				} else {
+					atomic.AddInt64(&answered, 1)
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	tick := time.NewTicker(5 * time.Millisecond)
+	defer tick.Stop()
+
+	for {
+		select {
+		case <-done:
+			assert.EqualValues(t, clients*queries, answered+failed)
+			assert.NotZero(t, answered)
+
+			return peak
+		case <-tick.C:
+			if n := runtime.NumGoroutine(); n > peak.goroutines {
+				peak.goroutines = n
+			}
+
+			st := s.InflightQueries()
+			if st.Active > peak.active {
+				peak.active = st.Active
+			}
+			if st.Queued > peak.queued {
+				peak.queued = st.Queued
+			}
+		}
+	}
+}
+
+// settle waits for the goroutines left after a load test phase, such as the
+// ones serving the closed connections, to exit.  It returns the settled number
+// of goroutines and the heap allocated after the garbage collection.
+func settle(t *testing.T) (goroutines int, heapAlloc uint64) {
+	t.Helper()
+
+	const (
+		interval = 10 * time.Millisecond
+		stable   = 5
+	)
+
+	deadline := time.Now().Add(5 * time.Second)
+	goroutines = runtime.NumGoroutine()
+	for same := 0; same < stable && time.Now().Before(deadline); {
+		time.Sleep(interval)
+
+		n := runtime.NumGoroutine()
+		if n == goroutines {
+			same++
+		} else {
+			goroutines, same = n, 0
+		}
+	}
+
+	runtime.GC()
+
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+
+	return goroutines, ms.HeapAlloc
+}
+
+// TestServer_inflightLoad demonstrates that the resource usage stays within
+// the limits and doesn't grow over time at five times the ceiling.
+func TestServer_inflightLoad(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping the load test in short mode")
+	}
+
+	const (
+		limit   = 20
+		queue   = 20
+		clients = 5 * limit
+		queries = 20
+		phases  = 3
+
+		// maxHeapGrowth is the allowed growth of the heap retained after
+		// the first phase, such as the one of the caches.
+		maxHeapGrowth = 2 << 20
+	)
+
+	testCases := []struct {
+		name string
+		shed bool
+	}{{
+		name: "queue",
+		shed: false,
+	}, {
+		name: "shed",
+		shed: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+				UDPListenAddrs: []*net.UDPAddr{{}},
+				TCPListenAddrs: []*net.TCPAddr{{}},
+				FilteringConfig: FilteringConfig{
+					MaxInflightQueries: limit,
+					InflightQueueSize:  queue,
+					LoadShedding:       tc.shed,
+				},
+			}, nil)
+			s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{&slowUpstream{
+				TestUpstream: aghtest.TestUpstream{
+					IPv4: map[string][]net.IP{
+						"google-public-dns-a.google.com.": {{8, 8, 8, 8}},
+					},
+				},
+				delay: 10 * time.Millisecond,
+			}}
+			startDeferStop(t, s)
+
+			base, _ := settle(t)
+
+			heaps := make([]uint64, phases)
+			for i := range heaps {
+				p := runLoad(t, s, clients, queries)
+				assert.LessOrEqual(t, p.active, limit)
+				assert.LessOrEqual(t, p.queued, queue)
+
+				// Each client takes a few goroutines: its own and
+				// the ones serving its connection on both sides.
+				assert.LessOrEqual(t, p.goroutines, base+3*clients+limit+queue+50)
+
+				// Nothing is left over once the load is gone.
+				var n int
+				n, heaps[i] = settle(t)
+				assert.LessOrEqual(t, n, base+10)
+			}
+
+			// The memory retained doesn't grow as the load goes on.
+			assert.LessOrEqual(t, heaps[phases-1], heaps[0]+maxHeapGrowth)
+
+			st := s.InflightQueries()
+			assert.Zero(t, st.Active)
+			assert.Zero(t, st.Queued)
+			if tc.shed {
+				assert.NotZero(t, st.Refused)
+			}
+		})
+	}
+}
@@ -0,0 +1,186 @@
+package dnsforward
+
+import (
+	"fmt"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+)
+
+// IngressPoolConfig is the configuration of the worker pool of a single
+// ingress protocol.
+type IngressPoolConfig struct {
+	// Workers is the maximum number of the requests processed
+	// simultaneously.  It must be positive.
+	Workers uint32 `yaml:"workers"`
+
+	// Queue is the maximum number of the requests waiting for a worker.
+	// The requests which don't fit are dropped.
+	Queue uint32 `yaml:"queue"`
+}
+
+// ingressQueueTimeout is the maximum time a request waits for a worker.  The
+// clients usually retry by this time.
+const ingressQueueTimeout = 2 * time.Second
+
+// ingressPool limits the number of the requests of a single ingress protocol
+// processed simultaneously.
+type ingressPool struct {
+	// The following fields must be accessed atomically.  They go first to
+	// be properly aligned on 32-bit platforms.
+
+	queued    int64
+	processed uint64
+	dropped   uint64
+
+	// workers is the semaphore of the requests being processed.
+	workers chan struct{}
+
+	queueLimit int64
+
+	// encrypted is true if the pool is used for an encrypted transport.
+	encrypted bool
+}
+
+// ingressPools are the worker pools of the ingress protocols.  The requests of
+// the encrypted transports have priority: while any of them waits for a
+// worker, the unencrypted ones are only processed if there is a free worker
+// in their pool.
+type ingressPools struct {
+	// encWaiting is the number of the requests of the encrypted transports
+	// waiting for a worker.  It must be accessed atomically, so it goes
+	// first to be properly aligned on 32-bit platforms.
+	encWaiting int64
+
+	pools map[string]*ingressPool
+}
+
+// newIngressPools returns the pools for conf.  pools is nil if conf is empty.
+func newIngressPools(conf map[string]IngressPoolConfig) (pools *ingressPools, err error) {
+	if len(conf) == 0 {
+		return nil, nil
+	}
+
+	pools = &ingressPools{
+		pools: make(map[string]*ingressPool, len(conf)),
+	}
+
+	for proto, c := range conf {
+		switch proto {
+		case
+			proxy.ProtoUDP,
+			proxy.ProtoTCP,
+			proxy.ProtoTLS,
+			proxy.ProtoHTTPS,
+			proxy.ProtoQUIC,
+			proxy.ProtoDNSCrypt,
+			protoUnix:
+			// Go on.
+		default:
+			return nil, fmt.Errorf("ingress pool: unknown protocol %q", proto)
+		}
+
+		if c.Workers == 0 {
+			return nil, fmt.Errorf("ingress pool %s: workers must be positive", proto)
+		}
+
+		pools.pools[proto] = &ingressPool{
+			workers:    make(chan struct{}, c.Workers),
+			queueLimit: int64(c.Queue),
+			encrypted:  isEncryptedProto(proto) || proto == proxy.ProtoDNSCrypt,
+		}
+	}
+
+	return pools, nil
+}
+
+// acquire takes a worker from the pool of proto.  ok is false if the request
+// must be dropped.  If ok is true, release must be called once the request is
+// processed.
+func (pools *ingressPools) acquire(proto string) (release func(), ok bool) {
+	p := pools.pools[proto]
+	if p == nil {
+		return func() {}, true
+	}
+
+	release = func() {
+		<-p.workers
+		atomic.AddUint64(&p.processed, 1)
+	}
+
+	select {
+	case p.workers <- struct{}{}:
+		return release, true
+	default:
+		// Go on.
+	}
+
+	if !p.encrypted && atomic.LoadInt64(&pools.encWaiting) > 0 {
+		atomic.AddUint64(&p.dropped, 1)
+
+		return nil, false
+	}
+
+	if atomic.AddInt64(&p.queued, 1) > p.queueLimit {
+		atomic.AddInt64(&p.queued, -1)
+		atomic.AddUint64(&p.dropped, 1)
+
+		return nil, false
+	}
+	defer atomic.AddInt64(&p.queued, -1)
+
+	if p.encrypted {
+		atomic.AddInt64(&pools.encWaiting, 1)
+		defer atomic.AddInt64(&pools.encWaiting, -1)
+	}
+
+	t := time.NewTimer(ingressQueueTimeout)
+	defer t.Stop()
+
+	select {
+	case p.workers <- struct{}{}:
+		return release, true
+	case <-t.C:
+		atomic.AddUint64(&p.dropped, 1)
+
+		return nil, false
+	}
+}
+
+// stats returns the current state of the pools sorted by the protocol.
+func (pools *ingressPools) stats() (ps []stats.IngressPool) {
+	ps = make([]stats.IngressPool, 0, len(pools.pools))
+	for proto, p := range pools.pools {
+		ps = append(ps, stats.IngressPool{
+			Proto:      proto,
+			Workers:    cap(p.workers),
+			Busy:       len(p.workers),
+			QueueDepth: atomic.LoadInt64(&p.queued),
+			QueueLimit: p.queueLimit,
+			Processed:  atomic.LoadUint64(&p.processed),
+			Dropped:    atomic.LoadUint64(&p.dropped),
+		})
+	}
+
+	sort.Slice(ps, func(i, j int) (less bool) {
+		return ps[i].Proto < ps[j].Proto
+	})
+
+	return ps
+}
+
+// IngressPools returns the current state of the worker pools of the ingress
+// protocols.  It's empty if the pools aren't configured.
+func (s *Server) IngressPools() (ps []stats.IngressPool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if s.ingress == nil {
+		return []stats.IngressPool{}
+	}
+
+	return s.ingress.stats()
+}
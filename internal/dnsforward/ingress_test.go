@@ -0,0 +1,172 @@
+package dnsforward
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewIngressPools(t *testing.T) {
+	testCases := []struct {
+		conf       map[string]IngressPoolConfig
+		name       string
+		wantErrMsg string
+	}{{
+		conf:       nil,
+		name:       "empty",
+		wantErrMsg: "",
+	}, {
+		conf: map[string]IngressPoolConfig{
+			proxy.ProtoUDP: {Workers: 1},
+			proxy.ProtoTLS: {Workers: 1, Queue: 10},
+		},
+		name:       "valid",
+		wantErrMsg: "",
+	}, {
+		conf: map[string]IngressPoolConfig{
+			"smtp": {Workers: 1},
+		},
+		name:       "bad_proto",
+		wantErrMsg: `ingress pool: unknown protocol "smtp"`,
+	}, {
+		conf: map[string]IngressPoolConfig{
+			proxy.ProtoUDP: {Queue: 10},
+		},
+		name:       "no_workers",
+		wantErrMsg: "ingress pool udp: workers must be positive",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			pools, err := newIngressPools(tc.conf)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			if len(tc.conf) == 0 {
+				assert.Nil(t, pools)
+			} else {
+				assert.Len(t, pools.pools, len(tc.conf))
+			}
+		})
+	}
+}
+
+func TestIngressPools_acquire(t *testing.T) {
+	pools, err := newIngressPools(map[string]IngressPoolConfig{
+		proxy.ProtoUDP: {Workers: 1, Queue: 0},
+		proxy.ProtoTCP: {Workers: 1, Queue: 1},
+	})
+	require.NoError(t, err)
+
+	t.Run("no_pool", func(t *testing.T) {
+		release, ok := pools.acquire(proxy.ProtoHTTPS)
+		require.True(t, ok)
+
+		release()
+	})
+
+	t.Run("no_queue", func(t *testing.T) {
+		release, ok := pools.acquire(proxy.ProtoUDP)
+		require.True(t, ok)
+
+		_, ok = pools.acquire(proxy.ProtoUDP)
+		assert.False(t, ok)
+
+		release()
+
+		release, ok = pools.acquire(proxy.ProtoUDP)
+		require.True(t, ok)
+
+		release()
+	})
+
+	t.Run("queue", func(t *testing.T) {
+		release, ok := pools.acquire(proxy.ProtoTCP)
+		require.True(t, ok)
+
+		acquired := make(chan struct{})
+		go func() {
+			r, qok := pools.acquire(proxy.ProtoTCP)
+			if qok {
+				r()
+			}
+
+			close(acquired)
+		}()
+
+		p := pools.pools[proxy.ProtoTCP]
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&p.queued) == 1
+		}, time.Second, time.Millisecond)
+
+		// The queue is full.
+		_, ok = pools.acquire(proxy.ProtoTCP)
+		assert.False(t, ok)
+
+		release()
+		<-acquired
+	})
+
+	ps := pools.stats()
+	require.Len(t, ps, 2)
+
+	assert.Equal(t, proxy.ProtoTCP, ps[0].Proto)
+	assert.Equal(t, uint64(2), ps[0].Processed)
+	assert.Equal(t, uint64(1), ps[0].Dropped)
+	assert.Equal(t, int64(1), ps[0].QueueLimit)
+	assert.Zero(t, ps[0].QueueDepth)
+	assert.Zero(t, ps[0].Busy)
+
+	assert.Equal(t, proxy.ProtoUDP, ps[1].Proto)
+	assert.Equal(t, uint64(2), ps[1].Processed)
+	assert.Equal(t, uint64(1), ps[1].Dropped)
+	assert.Equal(t, 1, ps[1].Workers)
+}
+
+func TestIngressPools_acquire_encPriority(t *testing.T) {
+	pools, err := newIngressPools(map[string]IngressPoolConfig{
+		proxy.ProtoTCP: {Workers: 1, Queue: 10},
+		proxy.ProtoTLS: {Workers: 1, Queue: 10},
+	})
+	require.NoError(t, err)
+
+	releaseTCP, ok := pools.acquire(proxy.ProtoTCP)
+	require.True(t, ok)
+
+	releaseTLS, ok := pools.acquire(proxy.ProtoTLS)
+	require.True(t, ok)
+
+	acquired := make(chan struct{})
+	go func() {
+		r, qok := pools.acquire(proxy.ProtoTLS)
+		if qok {
+			r()
+		}
+
+		close(acquired)
+	}()
+
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt64(&pools.encWaiting) == 1
+	}, time.Second, time.Millisecond)
+
+	// While an encrypted request waits, the unencrypted ones aren't queued.
+	_, ok = pools.acquire(proxy.ProtoTCP)
+	assert.False(t, ok)
+
+	releaseTLS()
+	<-acquired
+
+	releaseTCP()
+}
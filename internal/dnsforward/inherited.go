@@ -0,0 +1,459 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/proxyutil"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// inheritedConnTimeout is the time a TCP connection to an inherited listener
+// may be idle before it's closed.  It's the same as the one of the DNS proxy.
+const inheritedConnTimeout = 10 * time.Second
+
+// inheritedServer serves the DNS requests received via the sockets of the plain
+// DNS listeners inherited from the process which has restarted this one.  The
+// DNS proxy can't use the existing sockets, so they're served the way the UNIX
+// socket is, see unixServer.
+type inheritedServer struct {
+	srv *Server
+
+	udp []*net.UDPConn
+	tcp []*net.TCPListener
+
+	// sema limits the number of the requests processed simultaneously the
+	// way MaxGoroutines limits the ones of the DNS proxy.  It's nil if there
+	// is no limit.
+	sema chan struct{}
+
+	// ratelimit limits the number of the UDP requests per second from each
+	// client the way the DNS proxy does.  It's nil if there is no limit.
+	ratelimit *bytesLimiter
+
+	// closed is 1 once the sockets are closed.  It's accessed atomically.
+	closed uint32
+}
+
+// newInheritedServer returns the server of the sockets in files, which are
+// either UDP or TCP listeners on the addresses from the configuration of s.
+// The files are closed, and so are the sockets on the other addresses.  i is
+// nil if there are no sockets to serve.
+func newInheritedServer(s *Server, files []*os.File) (i *inheritedServer) {
+	i = &inheritedServer{srv: s}
+	for _, f := range files {
+		i.add(f)
+	}
+
+	if len(i.udp) == 0 && len(i.tcp) == 0 {
+		return nil
+	}
+
+	if n := s.conf.MaxGoroutines; n > 0 && s.ingress == nil {
+		i.sema = make(chan struct{}, n)
+	}
+
+	// The limiter of the response bytes works for the requests as well.
+	i.ratelimit = newBytesLimiter(s.conf.Ratelimit, s.ratelimitWhitelist())
+
+	return i
+}
+
+// add takes the socket in f if it's a UDP or TCP listener on a configured
+// address and closes f.
+func (i *inheritedServer) add(f *os.File) {
+	defer func() { _ = f.Close() }()
+
+	if l, err := net.FileListener(f); err == nil {
+		tl, ok := l.(*net.TCPListener)
+		if ok {
+			a := tl.Addr().(*net.TCPAddr)
+			for _, ca := range i.srv.conf.TCPListenAddrs {
+				if sameListenAddr(a.IP, a.Port, ca.IP, ca.Port) {
+					i.tcp = append(i.tcp, tl)
+
+					return
+				}
+			}
+		}
+
+		log.Info("dns: inherited listener on %s isn't configured, closing", l.Addr())
+		_ = l.Close()
+
+		return
+	}
+
+	pc, err := net.FilePacketConn(f)
+	if err != nil {
+		log.Error("dns: using inherited socket %s: %s", f.Name(), err)
+
+		return
+	}
+
+	if uc, ok := pc.(*net.UDPConn); ok {
+		a := uc.LocalAddr().(*net.UDPAddr)
+		for _, ca := range i.srv.conf.UDPListenAddrs {
+			if sameListenAddr(a.IP, a.Port, ca.IP, ca.Port) {
+				i.udp = append(i.udp, uc)
+
+				return
+			}
+		}
+	}
+
+	log.Info("dns: inherited socket on %s isn't configured, closing", pc.LocalAddr())
+	_ = pc.Close()
+}
+
+// sameListenAddr returns true if the socket bound to ip and port is the one
+// the DNS proxy would have created for the configured address with lip and
+// lport.  The unspecified addresses are the same, since the DNS proxy listens
+// on them using the dual-stack sockets.
+func sameListenAddr(ip net.IP, port int, lip net.IP, lport int) (ok bool) {
+	if port != lport {
+		return false
+	}
+
+	if len(lip) == 0 || lip.IsUnspecified() {
+		return len(ip) == 0 || ip.IsUnspecified()
+	}
+
+	return ip.Equal(lip)
+}
+
+// uninherited returns the addresses from udp and tcp, which aren't served by
+// i.
+func (i *inheritedServer) uninherited(
+	udp []*net.UDPAddr,
+	tcp []*net.TCPAddr,
+) (restUDP []*net.UDPAddr, restTCP []*net.TCPAddr) {
+UDP:
+	for _, ca := range udp {
+		for _, c := range i.udp {
+			a := c.LocalAddr().(*net.UDPAddr)
+			if sameListenAddr(a.IP, a.Port, ca.IP, ca.Port) {
+				continue UDP
+			}
+		}
+
+		restUDP = append(restUDP, ca)
+	}
+
+TCP:
+	for _, ca := range tcp {
+		for _, l := range i.tcp {
+			a := l.Addr().(*net.TCPAddr)
+			if sameListenAddr(a.IP, a.Port, ca.IP, ca.Port) {
+				continue TCP
+			}
+		}
+
+		restTCP = append(restTCP, ca)
+	}
+
+	return restUDP, restTCP
+}
+
+// start starts serving the requests.
+func (i *inheritedServer) start() {
+	for _, c := range i.udp {
+		err := proxyutil.UDPSetOptions(c)
+		if err != nil {
+			log.Debug("dns: inherited socket on %s: setting options: %s", c.LocalAddr(), err)
+		}
+
+		log.Info("dns: serving inherited udp socket on %s", c.LocalAddr())
+		go i.serveUDP(c)
+	}
+
+	for _, l := range i.tcp {
+		log.Info("dns: serving inherited tcp listener on %s", l.Addr())
+		go i.serveTCP(l)
+	}
+}
+
+// close closes the sockets.  The requests being processed are completed, but
+// their responses may fail to be sent, which is the same as with the DNS proxy.
+func (i *inheritedServer) close() {
+	atomic.StoreUint32(&i.closed, 1)
+
+	for _, c := range i.udp {
+		_ = c.Close()
+	}
+
+	for _, l := range i.tcp {
+		_ = l.Close()
+	}
+}
+
+// files returns the duplicates of the sockets.  The ones already returned are
+// closed if there is an error.
+func (i *inheritedServer) files() (files []*os.File, err error) {
+	var f *os.File
+	for _, c := range i.udp {
+		f, err = c.File()
+		if err != nil {
+			closeFiles(files)
+
+			return nil, fmt.Errorf("socket on %s: %w", c.LocalAddr(), err)
+		}
+
+		files = append(files, f)
+	}
+
+	for _, l := range i.tcp {
+		f, err = l.File()
+		if err != nil {
+			closeFiles(files)
+
+			return nil, fmt.Errorf("listener on %s: %w", l.Addr(), err)
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// closeFiles closes files.
+func closeFiles(files []*os.File) {
+	for _, f := range files {
+		_ = f.Close()
+	}
+}
+
+// acquire waits for a free slot for processing a request, if the number of
+// them is limited.
+func (i *inheritedServer) acquire() {
+	if i.sema != nil {
+		i.sema <- struct{}{}
+	}
+}
+
+// release frees the slot taken by acquire.
+func (i *inheritedServer) release() {
+	if i.sema != nil {
+		<-i.sema
+	}
+}
+
+// serveUDP serves the requests received via c.
+func (i *inheritedServer) serveUDP(c *net.UDPConn) {
+	defer agherr.LogPanic("dns: inherited socket")
+
+	buf := make([]byte, dns.MaxMsgSize)
+	oobSize := proxyutil.UDPGetOOBSize()
+	for {
+		n, localIP, addr, err := proxyutil.UDPRead(c, buf, oobSize)
+		if err != nil {
+			if atomic.LoadUint32(&i.closed) == 0 {
+				log.Error("dns: inherited socket on %s: reading: %s", c.LocalAddr(), err)
+			}
+
+			return
+		}
+
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		i.acquire()
+		go func() {
+			defer agherr.LogPanic("dns: inherited socket")
+			defer i.release()
+
+			resp := i.handle(req, &proxy.DNSContext{
+				Proto: proxy.ProtoUDP,
+				Addr:  addr,
+				Conn:  c,
+			})
+			if resp == nil {
+				return
+			}
+
+			_, werr := proxyutil.UDPWrite(resp, c, addr, localIP)
+			if werr != nil {
+				log.Debug("dns: inherited socket: writing response: %s", werr)
+			}
+		}()
+	}
+}
+
+// serveTCP accepts the connections to l.
+func (i *inheritedServer) serveTCP(l *net.TCPListener) {
+	defer agherr.LogPanic("dns: inherited listener")
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if atomic.LoadUint32(&i.closed) == 0 {
+				log.Error("dns: inherited listener on %s: accepting: %s", l.Addr(), err)
+			}
+
+			return
+		}
+
+		i.acquire()
+		go func() {
+			defer i.release()
+
+			i.serveConn(conn)
+		}()
+	}
+}
+
+// serveConn serves the requests received via conn until it's closed or idle
+// for inheritedConnTimeout.  The connection takes a single slot, see acquire,
+// the same as with the DNS proxy.
+func (i *inheritedServer) serveConn(conn net.Conn) {
+	defer agherr.LogPanic("dns: inherited listener")
+	defer func() { _ = conn.Close() }()
+
+	for atomic.LoadUint32(&i.closed) == 0 {
+		err := conn.SetDeadline(time.Now().Add(inheritedConnTimeout))
+		if err != nil {
+			return
+		}
+
+		req, err := proxyutil.ReadPrefixed(conn)
+		if err != nil {
+			return
+		}
+
+		resp := i.handle(req, &proxy.DNSContext{
+			Proto: proxy.ProtoTCP,
+			Addr:  conn.RemoteAddr(),
+			Conn:  conn,
+		})
+		if resp == nil {
+			continue
+		}
+
+		err = proxyutil.WritePrefixed(resp, conn)
+		if err != nil {
+			log.Debug("dns: inherited listener: writing response: %s", err)
+
+			return
+		}
+	}
+}
+
+// handle processes the request in data, which is received as d describes, the
+// way dnsproxy processes the requests from its listeners and returns the packed
+// response.  resp is nil if there should be no response.
+func (i *inheritedServer) handle(data []byte, d *proxy.DNSContext) (resp []byte) {
+	req := &dns.Msg{}
+	err := req.Unpack(data)
+	if err != nil {
+		log.Debug("dns: inherited listener: unpacking request: %s", err)
+
+		return nil
+	} else if req.Response {
+		return nil
+	}
+
+	d.Req = req
+	d.StartTime = time.Now()
+
+	s := i.srv
+	ok, err := s.beforeRequestHandler(nil, d)
+	switch {
+	case err != nil:
+		log.Error("dns: inherited listener: %s", err)
+		d.Res = s.genServerFailure(req)
+	case !ok:
+		return nil
+	case d.Proto == proxy.ProtoUDP && i.isRatelimited(d.Addr):
+		return nil
+	case len(req.Question) != 1:
+		d.Res = s.genServerFailure(req)
+	case s.conf.RefuseAny && req.Question[0].Qtype == dns.TypeANY:
+		d.Res = s.genNotImpl(req)
+	default:
+		err = s.handleDNSRequest(nil, d)
+		if err != nil {
+			log.Debug("dns: inherited listener: %s", err)
+		}
+	}
+
+	if d.Res == nil {
+		d.Res = s.genServerFailure(req)
+	}
+
+	resp, err = d.Res.Pack()
+	if err != nil {
+		log.Error("dns: inherited listener: packing response: %s", err)
+
+		return nil
+	}
+
+	return resp
+}
+
+// isRatelimited returns true if the request from addr exceeds the ratelimit.
+func (i *inheritedServer) isRatelimited(addr net.Addr) (ok bool) {
+	if i.ratelimit == nil {
+		return false
+	}
+
+	ip := IPFromAddr(addr)
+
+	return ip != nil && !i.ratelimit.allow(ip, 1, time.Now())
+}
+
+// ListenerFiles returns the duplicates of the sockets of the plain DNS
+// listeners, so that another process serves them along with this one.  It
+// returns an error if the server isn't running or has other listeners, which
+// can't be shared.
+func (s *Server) ListenerFiles() (files []*os.File, err error) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if !s.isRunning {
+		return nil, agherr.Error("dns server isn't running")
+	}
+
+	c := &s.dnsProxy.Config
+	switch {
+	case s.unix != nil:
+		return nil, agherr.Error("unix socket listener can't be shared")
+	case len(c.TLSListenAddr) > 0, len(c.HTTPSListenAddr) > 0, len(c.QUICListenAddr) > 0:
+		return nil, agherr.Error("encrypted listeners can't be shared")
+	case len(c.DNSCryptUDPListenAddr) > 0, len(c.DNSCryptTCPListenAddr) > 0:
+		return nil, agherr.Error("dnscrypt listeners can't be shared")
+	}
+
+	if s.inherited != nil {
+		files, err = s.inherited.files()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addrs := append(s.dnsProxy.Addrs(proxy.ProtoUDP), s.dnsProxy.Addrs(proxy.ProtoTCP)...)
+	proxyFiles, err := socketFiles(addrs)
+	if err != nil {
+		closeFiles(files)
+
+		return nil, err
+	}
+
+	return append(files, proxyFiles...), nil
+}
+
+// InheritListeners makes the server serve the sockets of the plain DNS
+// listeners in files, which are received from the process which has restarted
+// this one, from the next start instead of creating its own ones on the same
+// addresses.  s takes the ownership of files.
+func (s *Server) InheritListeners(files []*os.File) {
+	s.Lock()
+	defer s.Unlock()
+
+	closeFiles(s.inheritedFiles)
+	s.inheritedFiles = files
+}
@@ -0,0 +1,148 @@
+// +build !windows
+
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_InheritListeners(t *testing.T) {
+	ups := &answerUpstream{
+		answer: func(name string) (rrs []dns.RR) {
+			return []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   name,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    60,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+		},
+	}
+
+	newServer := func(t *testing.T, udp *net.UDPAddr, tcp *net.TCPAddr) (s *Server) {
+		t.Helper()
+
+		s = createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{udp},
+			TCPListenAddrs: []*net.TCPAddr{tcp},
+		}, nil)
+		s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{ups}
+
+		return s
+	}
+
+	localhost := net.IP{127, 0, 0, 1}
+	prev := newServer(t, &net.UDPAddr{IP: localhost}, &net.TCPAddr{IP: localhost})
+	require.NoError(t, prev.Start())
+
+	udp := prev.dnsProxy.Addr(proxy.ProtoUDP).(*net.UDPAddr)
+	tcp := prev.dnsProxy.Addr(proxy.ProtoTCP).(*net.TCPAddr)
+
+	// The sockets of the DNS proxy are found by their addresses.
+	files, err := prev.ListenerFiles()
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+
+	s := newServer(t, udp, tcp)
+	s.InheritListeners(files)
+	startDeferStop(t, s)
+
+	// The proxy doesn't listen on the addresses itself.
+	assert.Nil(t, s.dnsProxy.Addr(proxy.ProtoUDP))
+	assert.Nil(t, s.dnsProxy.Addr(proxy.ProtoTCP))
+
+	// The sockets remain open in s.
+	require.NoError(t, prev.Stop())
+
+	for _, c := range []struct {
+		addr net.Addr
+		net  string
+	}{{
+		addr: udp,
+		net:  "udp",
+	}, {
+		addr: tcp,
+		net:  "tcp",
+	}} {
+		t.Run(c.net, func(t *testing.T) {
+			client := &dns.Client{Net: c.net}
+			resp, _, exErr := client.Exchange(createTestMessage("host.example."), c.addr.String())
+			require.NoError(t, exErr)
+
+			require.Len(t, resp.Answer, 1)
+			a, ok := resp.Answer[0].(*dns.A)
+			require.True(t, ok)
+
+			assert.Equal(t, net.IP{1, 2, 3, 4}, a.A.To4())
+		})
+	}
+
+	// The inherited sockets can be passed on.
+	files, err = s.ListenerFiles()
+	require.NoError(t, err)
+	closeFiles(files)
+
+	assert.Len(t, files, 2)
+}
+
+func TestSameListenAddr(t *testing.T) {
+	testCases := []struct {
+		name string
+		ip   net.IP
+		lip  net.IP
+		port int
+		want bool
+	}{{
+		name: "same",
+		ip:   net.IP{127, 0, 0, 1},
+		lip:  net.IP{127, 0, 0, 1},
+		port: 53,
+		want: true,
+	}, {
+		name: "mapped",
+		ip:   net.ParseIP("::ffff:127.0.0.1"),
+		lip:  net.IP{127, 0, 0, 1},
+		port: 53,
+		want: true,
+	}, {
+		name: "dual_stack",
+		ip:   net.IPv6unspecified,
+		lip:  net.IPv4zero,
+		port: 53,
+		want: true,
+	}, {
+		name: "nil",
+		ip:   net.IPv6unspecified,
+		lip:  nil,
+		port: 53,
+		want: true,
+	}, {
+		name: "other_ip",
+		ip:   net.IPv6unspecified,
+		lip:  net.IP{127, 0, 0, 1},
+		port: 53,
+		want: false,
+	}, {
+		name: "other_port",
+		ip:   net.IP{127, 0, 0, 1},
+		lip:  net.IP{127, 0, 0, 1},
+		port: 5353,
+		want: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, sameListenAddr(tc.ip, 53, tc.lip, tc.port))
+		})
+	}
+}
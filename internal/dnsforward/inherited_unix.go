@@ -0,0 +1,133 @@
+// +build !windows
+
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// fdDir is the directory listing the open file descriptors of the process.
+const fdDir = "/dev/fd"
+
+// socketFiles returns the duplicates of the sockets of this process listening
+// on addrs, which are *net.UDPAddr or *net.TCPAddr.  The sockets are looked up
+// among the open descriptors, since the DNS proxy doesn't expose its own ones.
+func socketFiles(addrs []net.Addr) (files []*os.File, err error) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	fds, err := openFDs()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, addr := range addrs {
+		var f *os.File
+		f, err = socketFile(fds, addr)
+		if err != nil {
+			closeFiles(files)
+
+			return nil, err
+		}
+
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// openFDs returns the open file descriptors of this process.
+func openFDs() (fds []int, err error) {
+	d, err := os.Open(fdDir)
+	if err != nil {
+		return nil, fmt.Errorf("listing descriptors: %w", err)
+	}
+	defer func() { _ = d.Close() }()
+
+	names, err := d.Readdirnames(-1)
+	if err != nil {
+		return nil, fmt.Errorf("listing descriptors: %w", err)
+	}
+
+	for _, name := range names {
+		fd, aerr := strconv.Atoi(name)
+		if aerr == nil {
+			fds = append(fds, fd)
+		}
+	}
+
+	return fds, nil
+}
+
+// socketFile returns the duplicate of the socket among fds listening on addr.
+func socketFile(fds []int, addr net.Addr) (f *os.File, err error) {
+	for _, fd := range fds {
+		if !isListening(fd, addr) {
+			continue
+		}
+
+		// Don't let the duplicate leak into the processes started
+		// meanwhile.
+		syscall.ForkLock.RLock()
+		var dup int
+		dup, err = syscall.Dup(fd)
+		if err == nil {
+			syscall.CloseOnExec(dup)
+		}
+		syscall.ForkLock.RUnlock()
+
+		if err != nil {
+			return nil, fmt.Errorf("duplicating socket on %s: %w", addr, err)
+		}
+
+		return os.NewFile(uintptr(dup), addr.Network()+" "+addr.String()), nil
+	}
+
+	return nil, fmt.Errorf("no %s socket on %s", addr.Network(), addr)
+}
+
+// isListening returns true if fd is the socket listening on addr.
+func isListening(fd int, addr net.Addr) (ok bool) {
+	sa, err := syscall.Getsockname(fd)
+	if err != nil {
+		return false
+	}
+
+	var ip net.IP
+	var port int
+	switch sa := sa.(type) {
+	case *syscall.SockaddrInet4:
+		ip, port = net.IP(sa.Addr[:]), sa.Port
+	case *syscall.SockaddrInet6:
+		ip, port = net.IP(sa.Addr[:]), sa.Port
+	default:
+		return false
+	}
+
+	sotype, err := syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_TYPE)
+	if err != nil {
+		return false
+	}
+
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return sotype == syscall.SOCK_DGRAM && port == addr.Port && ip.Equal(addr.IP)
+	case *net.TCPAddr:
+		if sotype != syscall.SOCK_STREAM || port != addr.Port || !ip.Equal(addr.IP) {
+			return false
+		}
+
+		// The accepted connections have the same local address.
+		var accepting int
+		accepting, err = syscall.GetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_ACCEPTCONN)
+
+		return err == nil && accepting != 0
+	default:
+		return false
+	}
+}
@@ -0,0 +1,16 @@
+// +build windows
+
+package dnsforward
+
+import (
+	"net"
+	"os"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+)
+
+// socketFiles isn't supported on Windows, since the processes aren't restarted
+// there.
+func socketFiles(_ []net.Addr) (files []*os.File, err error) {
+	return nil, agherr.Error("sharing sockets is not supported on windows")
+}
@@ -0,0 +1,407 @@
+package dnsforward
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest/dnsstub"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testHarness is a DNS server with the whole request processing pipeline
+// listening on the random ports of the loopback interface and forwarding the
+// requests to the stub upstream servers.
+type testHarness struct {
+	srv *Server
+
+	// workDir is the temporary working directory of the server, which
+	// contains the filter list.
+	workDir string
+}
+
+// newTestHarness starts a new server with the filtering rules written into
+// the filter list file within the temporary working directory, conf, and ups
+// as the upstream servers in that order.  The server is stopped in the cleanup
+// of t.
+func newTestHarness(
+	t *testing.T,
+	rules string,
+	conf FilteringConfig,
+	ups ...*dnsstub.Server,
+) (h *testHarness) {
+	t.Helper()
+
+	h = &testHarness{
+		workDir: t.TempDir(),
+	}
+
+	listPath := filepath.Join(h.workDir, "filters", "1.txt")
+	err := os.MkdirAll(filepath.Dir(listPath), 0o755)
+	require.NoError(t, err)
+
+	err = ioutil.WriteFile(listPath, []byte(rules), 0o644)
+	require.NoError(t, err)
+
+	snd, err := aghnet.NewSubnetDetector()
+	require.NoError(t, err)
+
+	h.srv, err = NewServer(DNSCreateParams{
+		DNSFilter: dnsfilter.New(&dnsfilter.Config{}, []dnsfilter.Filter{{
+			ID:       1,
+			FilePath: listPath,
+		}}),
+		SubnetDetector: snd,
+	})
+	require.NoError(t, err)
+
+	conf.UpstreamDNS = nil
+	for _, u := range ups {
+		conf.UpstreamDNS = append(conf.UpstreamDNS, u.Addr())
+	}
+
+	localhost := net.IP{127, 0, 0, 1}
+	err = h.srv.Prepare(&ServerConfig{
+		UDPListenAddrs:  []*net.UDPAddr{{IP: localhost}},
+		TCPListenAddrs:  []*net.TCPAddr{{IP: localhost}},
+		FilteringConfig: conf,
+	})
+	require.NoError(t, err)
+
+	startDeferStop(t, h.srv)
+
+	return h
+}
+
+// exchange sends the request for host of the type qt to h over network, which
+// is either "udp" or "tcp".
+func (h *testHarness) exchange(t *testing.T, network, host string, qt uint16) (resp *dns.Msg) {
+	t.Helper()
+
+	addr := h.srv.dnsProxy.Addr(proxy.ProtoUDP)
+	if network == "tcp" {
+		addr = h.srv.dnsProxy.Addr(proxy.ProtoTCP)
+	}
+
+	c := &dns.Client{
+		Net:     network,
+		Timeout: 5 * time.Second,
+	}
+
+	resp, _, err := c.Exchange(createTestMessageWithType(dns.Fqdn(host), qt), addr.String())
+	require.NoError(t, err)
+
+	return resp
+}
+
+func TestIntegration_blockingMode(t *testing.T) {
+	const rules = "||blocked.example^\n" +
+		"127.0.0.2 hosts.example\n"
+
+	ups := dnsstub.New(t)
+	for _, name := range []string{"blocked.example", "hosts.example"} {
+		ups.Set(name, &dnsstub.Response{
+			Answer: []dns.RR{dnsstub.A(net.IP{1, 2, 3, 4}, 60)},
+		})
+	}
+
+	// alias.example is blocked by the CNAME from the upstream.
+	target := dnsstub.A(net.IP{1, 2, 3, 4}, 60)
+	target.Header().Name = "blocked.example."
+	ups.Set("alias.example", &dnsstub.Response{
+		Answer: []dns.RR{dnsstub.CNAME("blocked.example", 60), target},
+	})
+
+	testCases := []struct {
+		name      string
+		mode      string
+		host      string
+		qt        uint16
+		wantRcode int
+		wantIP    net.IP
+	}{{
+		name:      "default",
+		mode:      "default",
+		host:      "blocked.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv4zero,
+	}, {
+		name:      "default_aaaa",
+		mode:      "default",
+		host:      "blocked.example",
+		qt:        dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv6zero,
+	}, {
+		name:      "default_hosts",
+		mode:      "default",
+		host:      "hosts.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{127, 0, 0, 2},
+	}, {
+		name:      "default_cname",
+		mode:      "default",
+		host:      "alias.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv4zero,
+	}, {
+		name:      "null_ip",
+		mode:      "null_ip",
+		host:      "blocked.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv4zero,
+	}, {
+		name:      "null_ip_hosts",
+		mode:      "null_ip",
+		host:      "hosts.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IPv4zero,
+	}, {
+		name:      "custom_ip",
+		mode:      "custom_ip",
+		host:      "blocked.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.IP{0, 0, 0, 1},
+	}, {
+		name:      "custom_ip_aaaa",
+		mode:      "custom_ip",
+		host:      "blocked.example",
+		qt:        dns.TypeAAAA,
+		wantRcode: dns.RcodeSuccess,
+		wantIP:    net.ParseIP("::1"),
+	}, {
+		name:      "nxdomain",
+		mode:      "nxdomain",
+		host:      "blocked.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+		wantIP:    nil,
+	}, {
+		name:      "refused",
+		mode:      "refused",
+		host:      "blocked.example",
+		qt:        dns.TypeA,
+		wantRcode: dns.RcodeRefused,
+		wantIP:    nil,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, rules, FilteringConfig{
+				ProtectionEnabled: true,
+				BlockingMode:      tc.mode,
+				BlockingIPv4:      net.IP{0, 0, 0, 1},
+				BlockingIPv6:      net.ParseIP("::1"),
+			}, ups)
+
+			before := ups.Queries("blocked.example")
+
+			resp := h.exchange(t, "udp", tc.host, tc.qt)
+			require.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if tc.wantIP == nil {
+				assert.Empty(t, resp.Answer)
+			} else {
+				require.Len(t, resp.Answer, 1)
+
+				var ip net.IP
+				switch a := resp.Answer[0].(type) {
+				case *dns.A:
+					ip = a.A
+				case *dns.AAAA:
+					ip = a.AAAA
+				}
+
+				assert.True(t, tc.wantIP.Equal(ip), "got %s", ip)
+			}
+
+			// The blocked names are never forwarded.
+			assert.Equal(t, before, ups.Queries("blocked.example"))
+		})
+	}
+
+	t.Run("custom_ip_invalid", func(t *testing.T) {
+		s, err := NewServer(DNSCreateParams{
+			DNSFilter: dnsfilter.New(&dnsfilter.Config{}, nil),
+		})
+		require.NoError(t, err)
+
+		err = s.Prepare(&ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{{}},
+			TCPListenAddrs: []*net.TCPAddr{{}},
+			FilteringConfig: FilteringConfig{
+				ProtectionEnabled: true,
+				BlockingMode:      "custom_ip",
+				UpstreamDNS:       []string{ups.Addr()},
+			},
+		})
+		assert.Error(t, err)
+	})
+}
+
+func TestIntegration_cache(t *testing.T) {
+	ups := dnsstub.New(t)
+	ups.Set("cached.example", &dnsstub.Response{
+		Answer: []dns.RR{dnsstub.A(net.IP{1, 2, 3, 4}, 60)},
+	})
+	ups.Set("zero-ttl.example", &dnsstub.Response{
+		Answer: []dns.RR{dnsstub.A(net.IP{1, 2, 3, 4}, 0)},
+	})
+	ups.Set("servfail.example", &dnsstub.Response{
+		Rcode: dns.RcodeServerFailure,
+	})
+
+	testCases := []struct {
+		name          string
+		host          string
+		cacheSize     uint32
+		wantExchanges uint32
+	}{{
+		name:          "cached",
+		host:          "cached.example",
+		cacheSize:     64 * 1024,
+		wantExchanges: 1,
+	}, {
+		name:          "disabled",
+		host:          "cached.example",
+		cacheSize:     0,
+		wantExchanges: 3,
+	}, {
+		name:          "zero_ttl",
+		host:          "zero-ttl.example",
+		cacheSize:     64 * 1024,
+		wantExchanges: 3,
+	}, {
+		name:          "servfail",
+		host:          "servfail.example",
+		cacheSize:     64 * 1024,
+		wantExchanges: 3,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newTestHarness(t, "", FilteringConfig{
+				CacheSize: tc.cacheSize,
+			}, ups)
+
+			before := ups.Queries(tc.host)
+			for i := 0; i < 3; i++ {
+				_ = h.exchange(t, "udp", tc.host, dns.TypeA)
+			}
+
+			assert.Equal(t, tc.wantExchanges, ups.Queries(tc.host)-before)
+		})
+	}
+}
+
+func TestIntegration_failover(t *testing.T) {
+	const (
+		host    = "failover.example"
+		timeout = 200
+	)
+
+	working := dnsstub.New(t)
+	working.Set(host, &dnsstub.Response{
+		Answer: []dns.RR{dnsstub.A(net.IP{1, 2, 3, 4}, 60)},
+	})
+
+	dropping := dnsstub.New(t)
+	dropping.Set(host, &dnsstub.Response{
+		DropEvery: 1,
+	})
+
+	malformed := dnsstub.New(t)
+	malformed.Set(host, &dnsstub.Response{
+		Malformed: true,
+	})
+
+	slow := dnsstub.New(t)
+	slow.Set(host, &dnsstub.Response{
+		Answer: []dns.RR{dnsstub.A(net.IP{1, 2, 3, 4}, 60)},
+		Delay:  2 * timeout * time.Millisecond,
+	})
+
+	testCases := []struct {
+		name      string
+		ups       []*dnsstub.Server
+		wantRcode int
+	}{{
+		name:      "dropping",
+		ups:       []*dnsstub.Server{dropping, working},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "malformed",
+		ups:       []*dnsstub.Server{malformed, working},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "slow",
+		ups:       []*dnsstub.Server{slow, working},
+		wantRcode: dns.RcodeSuccess,
+	}, {
+		name:      "all_failed",
+		ups:       []*dnsstub.Server{dropping, malformed},
+		wantRcode: dns.RcodeServerFailure,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := FilteringConfig{}
+			for _, u := range tc.ups {
+				conf.UpstreamOptions = append(conf.UpstreamOptions, UpstreamOptions{
+					Address:   u.Addr(),
+					TimeoutMs: timeout,
+				})
+			}
+
+			h := newTestHarness(t, "", conf, tc.ups...)
+
+			resp := h.exchange(t, "udp", host, dns.TypeA)
+			require.Equal(t, tc.wantRcode, resp.Rcode)
+
+			if tc.wantRcode == dns.RcodeSuccess {
+				require.Len(t, resp.Answer, 1)
+				assert.Equal(t, net.IP{1, 2, 3, 4}, resp.Answer[0].(*dns.A).A.To4())
+			}
+		})
+	}
+}
+
+func TestIntegration_truncation(t *testing.T) {
+	const host = "large.example"
+
+	ups := dnsstub.New(t)
+
+	var answer []dns.RR
+	for i := 0; i < 50; i++ {
+		answer = append(answer, dnsstub.A(net.IP{10, 0, 0, byte(i)}, 60))
+	}
+	ups.Set(host, &dnsstub.Response{Answer: answer})
+
+	h := newTestHarness(t, "", FilteringConfig{}, ups)
+
+	// The upstream truncates the response over UDP, so the request is
+	// retried over TCP, but the response to the client over UDP is
+	// truncated again.
+	resp := h.exchange(t, "udp", host, dns.TypeA)
+	assert.True(t, resp.Truncated)
+	assert.Less(t, len(resp.Answer), len(answer))
+	assert.Equal(t, uint32(2), ups.Queries(host))
+
+	resp = h.exchange(t, "tcp", host, dns.TypeA)
+	assert.False(t, resp.Truncated)
+	assert.Len(t, resp.Answer, len(answer))
+}
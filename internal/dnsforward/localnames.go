@@ -0,0 +1,159 @@
+package dnsforward
+
+import (
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// localNamesConfig is the part of the configuration which determines how the
+// requests for the root, the single-label, and the WPAD names are handled.
+type localNamesConfig struct {
+	localSingleLabel  bool
+	searchLocalDomain bool
+	allowRoot         bool
+	allowWPAD         bool
+}
+
+// isWPAD returns true if the fully-qualified name is used to discover the web
+// proxy.
+func isWPAD(name string) (ok bool) {
+	return strings.HasPrefix(name, "wpad.")
+}
+
+// processLocalNames keeps the requests for the root, the single-label, and
+// the WPAD names, which haven't been answered from the local sources, from
+// being forwarded to the upstream servers, unless it's allowed by the
+// configuration.  Such requests are still written to the query log with their
+// own reasons.
+func (s *Server) processLocalNames(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	if d.Res != nil || ctx.origQuestion.Name != "" {
+		// Answered or rewritten to another name already.
+		return resultCodeSuccess
+	}
+
+	s.RLock()
+	conf := localNamesConfig{
+		localSingleLabel:  s.conf.LocalSingleLabel,
+		searchLocalDomain: s.conf.SearchLocalDomain,
+		allowRoot:         s.conf.AllowRootQueries,
+		allowWPAD:         s.conf.AllowWPAD,
+	}
+	s.RUnlock()
+
+	req := d.Req
+	name := strings.ToLower(req.Question[0].Name)
+	switch {
+	case name == ".":
+		if conf.allowRoot {
+			return resultCodeSuccess
+		}
+
+		d.Res = s.makeResponseREFUSED(req)
+		ctx.result = &dnsfilter.Result{
+			Reason: dnsfilter.LocalOnlyRoot,
+		}
+	case isWPAD(name):
+		if conf.allowWPAD {
+			return resultCodeSuccess
+		}
+
+		d.Res = s.genNXDomain(req)
+		ctx.result = &dnsfilter.Result{
+			Reason: dnsfilter.LocalOnlyWPAD,
+		}
+	case dns.CountLabel(name) == 1:
+		s.processSingleLabel(ctx, name, conf)
+	default:
+		// Go on.
+	}
+
+	return resultCodeSuccess
+}
+
+// processSingleLabel answers the request for the single-label name according
+// to conf.  The hosts files and the DNS rewrites have been checked already.
+func (s *Server) processSingleLabel(ctx *dnsContext, name string, conf localNamesConfig) {
+	d := ctx.proxyCtx
+	host := strings.TrimSuffix(name, ".")
+	if conf.searchLocalDomain {
+		fqdn := host + s.localDomainSuffix
+		if resp, ok := s.searchLocalDomain(ctx, host, fqdn); ok {
+			log.Debug("dns: %q found as %q", name, fqdn)
+
+			d.Res = resp
+			ctx.result = &dnsfilter.Result{
+				Reason:    dnsfilter.RewrittenSearchDomain,
+				CanonName: strings.TrimSuffix(fqdn, "."),
+			}
+
+			return
+		}
+	} else if conf.localSingleLabel && ctx.isLocalClient {
+		if ip, ok := s.hostToIP(host); ok {
+			d.Res = s.genInternalHostResponse(d.Req, ip)
+
+			return
+		}
+	}
+
+	if conf.localSingleLabel {
+		d.Res = s.genNXDomain(d.Req)
+		ctx.result = &dnsfilter.Result{
+			Reason: dnsfilter.LocalOnlySingleLabel,
+		}
+	}
+}
+
+// searchLocalDomain looks up the fully-qualified name fqdn of host within the
+// local domain in the DHCP leases, which are only available to the local
+// clients, and in the hosts files and the DNS rewrites.  resp contains the
+// CNAME record pointing to fqdn followed by its addresses.
+func (s *Server) searchLocalDomain(ctx *dnsContext, host, fqdn string) (resp *dns.Msg, ok bool) {
+	req := ctx.proxyCtx.Req
+	qt := req.Question[0].Qtype
+
+	var ips []net.IP
+	if ip, found := s.hostToIP(host); found && ctx.isLocalClient {
+		ips = []net.IP{ip}
+	} else if ctx.protectionEnabled {
+		s.RLock()
+		res, err := s.dnsFilter.CheckHost(strings.TrimSuffix(fqdn, "."), qt, ctx.setts)
+		s.RUnlock()
+		if err != nil {
+			log.Debug("dns: checking %q: %s", fqdn, err)
+
+			return nil, false
+		}
+
+		if res.Reason.In(dnsfilter.Rewritten, dnsfilter.RewrittenAutoHosts) {
+			ips = res.IPList
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, false
+	}
+
+	resp = s.makeResponse(req)
+	resp.Answer = append(resp.Answer, s.genAnswerCNAME(req, fqdn))
+	for _, ip := range ips {
+		ip4 := ip.To4()
+		switch {
+		case qt == dns.TypeA && ip4 != nil:
+			a := s.genAnswerA(req, ip4)
+			a.Hdr.Name = fqdn
+			resp.Answer = append(resp.Answer, a)
+		case qt == dns.TypeAAAA && ip4 == nil:
+			a := s.genAnswerAAAA(req, ip)
+			a.Hdr.Name = fqdn
+			resp.Answer = append(resp.Answer, a)
+		}
+	}
+
+	return resp, true
+}
@@ -0,0 +1,161 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_ProcessLocalNames(t *testing.T) {
+	knownIP := net.IP{1, 2, 3, 4}
+
+	testCases := []struct {
+		name       string
+		host       string
+		conf       FilteringConfig
+		wantReason dnsfilter.Reason
+		wantRcode  int
+		wantAnswer []string
+		wantRes    bool
+	}{{
+		name:    "fqdn",
+		host:    "example.com",
+		wantRes: false,
+	}, {
+		name:       "root",
+		host:       ".",
+		wantReason: dnsfilter.LocalOnlyRoot,
+		wantRcode:  dns.RcodeRefused,
+		wantRes:    true,
+	}, {
+		name:    "root_allowed",
+		host:    ".",
+		conf:    FilteringConfig{AllowRootQueries: true},
+		wantRes: false,
+	}, {
+		name:       "wpad",
+		host:       "wpad.example.com",
+		wantReason: dnsfilter.LocalOnlyWPAD,
+		wantRcode:  dns.RcodeNameError,
+		wantRes:    true,
+	}, {
+		name:    "wpad_allowed",
+		host:    "wpad",
+		conf:    FilteringConfig{AllowWPAD: true},
+		wantRes: false,
+	}, {
+		name:    "single_label_forwarded",
+		host:    "printer",
+		wantRes: false,
+	}, {
+		name:       "single_label_local",
+		host:       "printer",
+		conf:       FilteringConfig{LocalSingleLabel: true},
+		wantReason: dnsfilter.NotFilteredNotFound,
+		wantRcode:  dns.RcodeSuccess,
+		wantAnswer: []string{"printer.\t10\tIN\tA\t1.2.3.4"},
+		wantRes:    true,
+	}, {
+		name:       "single_label_unknown",
+		host:       "scanner",
+		conf:       FilteringConfig{LocalSingleLabel: true},
+		wantReason: dnsfilter.LocalOnlySingleLabel,
+		wantRcode:  dns.RcodeNameError,
+		wantRes:    true,
+	}, {
+		name:       "search",
+		host:       "printer",
+		conf:       FilteringConfig{SearchLocalDomain: true},
+		wantReason: dnsfilter.RewrittenSearchDomain,
+		wantRcode:  dns.RcodeSuccess,
+		wantAnswer: []string{
+			"printer.\t10\tIN\tCNAME\tprinter.lan.",
+			"printer.lan.\t10\tIN\tA\t1.2.3.4",
+		},
+		wantRes: true,
+	}, {
+		name:    "search_unknown",
+		host:    "scanner",
+		conf:    FilteringConfig{SearchLocalDomain: true},
+		wantRes: false,
+	}, {
+		name: "search_unknown_local",
+		host: "scanner",
+		conf: FilteringConfig{
+			LocalSingleLabel:  true,
+			SearchLocalDomain: true,
+		},
+		wantReason: dnsfilter.LocalOnlySingleLabel,
+		wantRcode:  dns.RcodeNameError,
+		wantRes:    true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				localDomainSuffix: defaultLocalDomainSuffix,
+				tableHostToIP: hostToIPTable{
+					"printer": knownIP,
+				},
+			}
+			s.conf.FilteringConfig = tc.conf
+			s.conf.BlockedResponseTTL = 10
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Req: createTestMessage(dns.Fqdn(tc.host)),
+				},
+				result:        &dnsfilter.Result{},
+				isLocalClient: true,
+			}
+
+			res := s.processLocalNames(dctx)
+			require.Equal(t, resultCodeSuccess, res)
+
+			pctxRes := dctx.proxyCtx.Res
+			if !tc.wantRes {
+				assert.Nil(t, pctxRes)
+
+				return
+			}
+
+			require.NotNil(t, pctxRes)
+			assert.Equal(t, tc.wantRcode, pctxRes.Rcode)
+			assert.Equal(t, tc.wantReason, dctx.result.Reason)
+
+			var answer []string
+			for _, rr := range pctxRes.Answer {
+				answer = append(answer, rr.String())
+			}
+			assert.Equal(t, tc.wantAnswer, answer)
+		})
+	}
+
+	t.Run("external_client", func(t *testing.T) {
+		s := &Server{
+			localDomainSuffix: defaultLocalDomainSuffix,
+			tableHostToIP: hostToIPTable{
+				"printer": knownIP,
+			},
+		}
+		s.conf.LocalSingleLabel = true
+		s.conf.SearchLocalDomain = true
+
+		dctx := &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: createTestMessage("printer."),
+			},
+			result: &dnsfilter.Result{},
+		}
+
+		require.Equal(t, resultCodeSuccess, s.processLocalNames(dctx))
+		require.NotNil(t, dctx.proxyCtx.Res)
+		assert.Equal(t, dns.RcodeNameError, dctx.proxyCtx.Res.Rcode)
+		assert.Equal(t, dnsfilter.LocalOnlySingleLabel, dctx.result.Reason)
+	})
+}
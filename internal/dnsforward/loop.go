@@ -0,0 +1,278 @@
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// Forwarding loops are detected in two ways.  At configuration time, the
+// upstreams pointing at the listening addresses of the server are rejected.
+// At runtime, the queries sent upstream are tagged with an EDNS(0) option
+// which is unique for this server, so that a tagged query coming back to it is
+// answered with SERVFAIL instead of being forwarded once again.
+
+// loopOptionCode is the code of the EDNS(0) option tagging the queries sent
+// upstream.  It's from the range reserved for local use by RFC 6891.
+const loopOptionCode uint16 = 65432
+
+// loopTagLen is the length of the tag of the server.
+const loopTagLen = 8
+
+// newLoopTag returns a new random tag of the server.
+func newLoopTag() (tag []byte, err error) {
+	tag = make([]byte, loopTagLen)
+	_, err = rand.Read(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return tag, nil
+}
+
+// isLoop returns true if o is the option tagging the queries sent upstream by
+// this server.
+func (s *Server) isLoop(o dns.EDNS0) (ok bool) {
+	lo, ok := o.(*dns.EDNS0_LOCAL)
+
+	return ok && len(s.loopTag) > 0 && bytes.Equal(lo.Data, s.loopTag)
+}
+
+// tagLoop adds the option tagging the queries sent upstream by this server to
+// ctx's request.  untag removes it once the response is received.  If the
+// request had no OPT record, it's removed from both the request and the
+// response.  The added record advertises the minimum UDP message size, so that
+// the response is truncated for the client the same way it would be without
+// the record.
+func (s *Server) tagLoop(ctx *dnsContext) (untag func()) {
+	d := ctx.proxyCtx
+	if len(s.loopTag) == 0 {
+		return func() {}
+	}
+
+	opt := d.Req.IsEdns0()
+	added := opt == nil
+	if added {
+		d.Req.SetEdns0(dns.MinMsgSize, false)
+		opt = d.Req.IsEdns0()
+	}
+
+	opt.Option = append(opt.Option, &dns.EDNS0_LOCAL{
+		Code: loopOptionCode,
+		Data: s.loopTag,
+	})
+
+	return func() {
+		if added {
+			removeOPT(d.Req)
+			if d.Res != nil {
+				removeOPT(d.Res)
+			}
+
+			return
+		}
+
+		// Don't assume that the option is still the last one, since
+		// the proxy may add its own ones.
+		var kept []dns.EDNS0
+		for _, o := range opt.Option {
+			if o.Option() != loopOptionCode {
+				kept = append(kept, o)
+			}
+		}
+
+		opt.Option = kept
+	}
+}
+
+// removeOPT removes the OPT record from msg.  msg.Extra is copied, since msg
+// may be shared with the cache.
+func removeOPT(msg *dns.Msg) {
+	var extra []dns.RR
+	for _, rr := range msg.Extra {
+		if rr.Header().Rrtype != dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+
+	msg.Extra = extra
+}
+
+// ForwardingLoops returns the number of the queries recognized as sent
+// upstream by this server and answered with SERVFAIL since the start.
+func (s *Server) ForwardingLoops() (n uint64) {
+	return atomic.LoadUint64(&s.loops)
+}
+
+// upstreamDefaultPorts are the default ports of the upstream schemes which
+// can be served by this server.
+var upstreamDefaultPorts = map[string]int{
+	"udp":  53,
+	"tcp":  53,
+	"tls":  853,
+	"quic": 784,
+}
+
+// upstreamIPPort returns the IP address, the port, and the scheme of the
+// upstream address addr.  ok is false if addr isn't an IP address or the
+// upstream can't be served by this server.
+func upstreamIPPort(addr string) (ip net.IP, port int, scheme string, ok bool) {
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	u, err := url.Parse(addr)
+	if err != nil {
+		return nil, 0, "", false
+	}
+
+	port, ok = upstreamDefaultPorts[u.Scheme]
+	if !ok {
+		return nil, 0, "", false
+	}
+
+	ip = net.ParseIP(u.Hostname())
+	if ip == nil {
+		return nil, 0, "", false
+	}
+
+	if p := u.Port(); p != "" {
+		port, err = strconv.Atoi(p)
+		if err != nil {
+			return nil, 0, "", false
+		}
+	}
+
+	return ip, port, u.Scheme, true
+}
+
+// ownIPs returns the addresses of the network interfaces of the machine.  The
+// error is ignored, since the loopback addresses are checked anyway.
+func ownIPs() (ips []net.IP) {
+	addrs, _ := net.InterfaceAddrs()
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok {
+			ips = append(ips, n.IP)
+		}
+	}
+
+	return ips
+}
+
+// listensOn returns true if the listening address with listenIP and listenPort
+// accepts the queries sent to ip and port.  own are the addresses of the
+// machine.
+func listensOn(listenIP net.IP, listenPort int, ip net.IP, port int, own []net.IP) (ok bool) {
+	if listenPort == 0 || listenPort != port {
+		return false
+	}
+
+	if listenIP.Equal(ip) {
+		return true
+	}
+
+	if !listenIP.IsUnspecified() {
+		return false
+	}
+
+	if ip.IsLoopback() || ip.IsUnspecified() {
+		return true
+	}
+
+	for _, o := range own {
+		if o.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// checkUpstreamLoops returns an error if any of the upstreams in uc sends the
+// queries to one of the listening addresses of the server.
+func (s *Server) checkUpstreamLoops(uc *proxy.UpstreamConfig) (err error) {
+	type listenAddr struct {
+		ip   net.IP
+		port int
+	}
+
+	byScheme := map[string][]listenAddr{}
+	addUDP := func(scheme string, addrs []*net.UDPAddr) {
+		for _, a := range addrs {
+			byScheme[scheme] = append(byScheme[scheme], listenAddr{ip: a.IP, port: a.Port})
+		}
+	}
+	addTCP := func(scheme string, addrs []*net.TCPAddr) {
+		for _, a := range addrs {
+			byScheme[scheme] = append(byScheme[scheme], listenAddr{ip: a.IP, port: a.Port})
+		}
+	}
+
+	addUDP("udp", s.conf.UDPListenAddrs)
+	addTCP("tcp", s.conf.TCPListenAddrs)
+	addTCP("tls", s.conf.TLSListenAddrs)
+	addUDP("quic", s.conf.QUICListenAddrs)
+
+	var own []net.IP
+	check := func(ups []upstream.Upstream) (cerr error) {
+		for _, u := range ups {
+			ip, port, scheme, ok := upstreamIPPort(u.Address())
+			if !ok {
+				continue
+			}
+
+			if own == nil {
+				own = ownIPs()
+			}
+
+			for _, la := range byScheme[scheme] {
+				if listensOn(la.ip, la.port, ip, port, own) {
+					return fmt.Errorf(
+						"upstream %s is this server's own address %s, which would create a forwarding loop",
+						u.Address(),
+						net.JoinHostPort(la.ip.String(), strconv.Itoa(la.port)),
+					)
+				}
+			}
+		}
+
+		return nil
+	}
+
+	err = check(uc.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	for _, ups := range uc.DomainReservedUpstreams {
+		err = check(ups)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateUpstreamLoops parses upstreams and returns an error if any of them
+// sends the queries to one of the listening addresses of the server.
+func (s *Server) validateUpstreamLoops(upstreams []string) (err error) {
+	uc, err := proxy.ParseUpstreamsConfig(upstreams, upstream.Options{
+		Bootstrap: []string{},
+		Timeout:   DefaultTimeout,
+	})
+	if err != nil {
+		return err
+	}
+
+	return s.checkUpstreamLoops(&uc)
+}
@@ -0,0 +1,162 @@
+package dnsforward
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_validateUpstreamLoops(t *testing.T) {
+	s := &Server{
+		conf: ServerConfig{
+			UDPListenAddrs: []*net.UDPAddr{{IP: net.IPv4zero, Port: 53}},
+			TCPListenAddrs: []*net.TCPAddr{{IP: net.IPv4zero, Port: 53}},
+			TLSConfig: TLSConfig{
+				TLSListenAddrs: []*net.TCPAddr{{IP: net.IP{192, 168, 1, 1}, Port: 853}},
+			},
+		},
+	}
+
+	testCases := []struct {
+		name       string
+		upstream   string
+		wantErrMsg string
+	}{{
+		name:     "other",
+		upstream: "8.8.8.8",
+	}, {
+		name:     "other_port",
+		upstream: "127.0.0.1:5353",
+	}, {
+		name:     "loopback",
+		upstream: "127.0.0.1",
+		wantErrMsg: "upstream 127.0.0.1:53 is this server's own address 0.0.0.0:53, " +
+			"which would create a forwarding loop",
+	}, {
+		name:     "tcp",
+		upstream: "tcp://127.0.0.1",
+		wantErrMsg: "upstream tcp://127.0.0.1:53 is this server's own address " +
+			"0.0.0.0:53, which would create a forwarding loop",
+	}, {
+		name:     "domain",
+		upstream: "[/example.org/]127.0.0.1",
+		wantErrMsg: "upstream 127.0.0.1:53 is this server's own address 0.0.0.0:53, " +
+			"which would create a forwarding loop",
+	}, {
+		name:     "tls",
+		upstream: "tls://192.168.1.1",
+		wantErrMsg: "upstream tls://192.168.1.1:853 is this server's own address " +
+			"192.168.1.1:853, which would create a forwarding loop",
+	}, {
+		name:     "tls_other_ip",
+		upstream: "tls://127.0.0.1",
+	}, {
+		name:     "https",
+		upstream: "https://127.0.0.1/dns-query",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := s.validateUpstreamLoops([]string{tc.upstream})
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+// selfUpstream is an upstream forwarding the requests to the address set once
+// the server under test is started.
+type selfUpstream struct {
+	// addr is the address of the server.  It's accessed atomically.
+	addr atomic.Value
+}
+
+// Exchange implements the upstream.Upstream interface for *selfUpstream.
+func (u *selfUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	c := &dns.Client{
+		Timeout: time.Second,
+	}
+
+	resp, _, err = c.Exchange(m, u.Address())
+
+	return resp, err
+}
+
+// Address implements the upstream.Upstream interface for *selfUpstream.
+func (u *selfUpstream) Address() (addr string) {
+	addr, _ = u.addr.Load().(string)
+
+	return addr
+}
+
+func TestServer_forwardingLoop(t *testing.T) {
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+	}, nil)
+
+	// Point the server at itself bypassing the configuration checks, as if
+	// the loop went through another server.  The upstream is set before
+	// the server is started, since the proxy reads it while serving.
+	u := &selfUpstream{}
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{u}
+	startDeferStop(t, s)
+
+	addr := s.dnsProxy.Addr(proxy.ProtoUDP).String()
+	u.addr.Store(addr)
+
+	req := createGoogleATestMessage()
+	resp, err := dns.Exchange(req, addr)
+	require.NoError(t, err)
+
+	assert.Equal(t, dns.RcodeServerFailure, resp.Rcode)
+	assert.EqualValues(t, 1, s.ForwardingLoops())
+
+	// The tag mustn't be left in the request.
+	assert.Nil(t, req.IsEdns0())
+}
+
+func TestServer_tagLoop_truncation(t *testing.T) {
+	const host = "large.example.org."
+
+	ips := make([]net.IP, 40)
+	for i := range ips {
+		ips[i] = net.IP{192, 168, 0, byte(i)}
+	}
+
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{&aghtest.TestUpstream{
+		IPv4: map[string][]net.IP{host: ips},
+	}}
+	startDeferStop(t, s)
+
+	require.NotEmpty(t, s.loopTag)
+
+	// The client doesn't support EDNS(0), so the response, which is larger
+	// than the minimum message size, must be truncated even though the
+	// request sent upstream has the tag in its OPT record.
+	req := createTestMessage(host)
+	resp, err := dns.Exchange(req, s.dnsProxy.Addr(proxy.ProtoUDP).String())
+	require.NoError(t, err)
+
+	assert.True(t, resp.Truncated)
+	assert.Nil(t, resp.IsEdns0())
+}
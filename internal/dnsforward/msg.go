@@ -1,9 +1,12 @@
 package dnsforward
 
 import (
+	"fmt"
 	"net"
+	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxy"
 	"github.com/AdguardTeam/golibs/log"
@@ -32,7 +35,12 @@ func (s *Server) genDNSFilterMessage(d *proxy.DNSContext, result *dnsfilter.Resu
 
 	if m.Question[0].Qtype != dns.TypeA && m.Question[0].Qtype != dns.TypeAAAA {
 		if s.conf.BlockingMode == "null_ip" {
-			return s.makeResponse(m)
+			// Add the SOA record to the NODATA response so that
+			// the clients cache it.
+			resp := s.makeResponse(m)
+			resp.Ns = s.genSOA(m)
+
+			return resp
 		}
 		return s.genNXDomain(m)
 	}
@@ -92,6 +100,17 @@ func (s *Server) genServerFailure(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// genNotImpl returns the NOTIMP response to the ANY request the way the DNS
+// proxy does.  The OPT record is added, since the NOTIMP response without one is
+// taken as the lack of the EDNS(0) support.
+func (s *Server) genNotImpl(request *dns.Msg) *dns.Msg {
+	resp := dns.Msg{}
+	resp.SetRcode(request, dns.RcodeNotImplemented)
+	resp.RecursionAvailable = true
+	resp.SetEdns0(1452, false)
+	return &resp
+}
+
 func (s *Server) genARecord(request *dns.Msg, ip net.IP) *dns.Msg {
 	resp := s.makeResponse(request)
 	resp.Answer = append(resp.Answer, s.genAnswerA(request, ip))
@@ -209,7 +228,7 @@ func (s *Server) genBlockedHost(request *dns.Msg, newAddr string, d *proxy.DNSCo
 		Req:       &replReq,
 	}
 
-	err := s.dnsProxy.Resolve(newContext)
+	_, err := s.resolve(s.dnsProxy, newContext, false)
 	if err != nil {
 		log.Printf("Couldn't look up replacement host %q: %s", newAddr, err)
 		return s.genServerFailure(request)
@@ -242,36 +261,77 @@ func (s *Server) genNXDomain(request *dns.Msg) *dns.Msg {
 	return &resp
 }
 
+// defaultSOAMName is the primary name server in the SOA record if the hostname
+// of the machine isn't a valid domain name.
+const defaultSOAMName = "fake-for-negative-caching.adguard.com."
+
+// newBlockedSOA returns conf with the names made fully qualified and the empty
+// fields filled in using hostname and blockedTTL.
+func newBlockedSOA(conf BlockedResponseSOA, blockedTTL uint32, hostname string) (soa BlockedResponseSOA, err error) {
+	soa = conf
+	if soa.MName == "" {
+		soa.MName = defaultSOAMName
+		if aghnet.ValidateDomainName(hostname) == nil {
+			soa.MName = strings.ToLower(hostname)
+		}
+	} else if _, ok := dns.IsDomainName(soa.MName); !ok {
+		return BlockedResponseSOA{}, fmt.Errorf("mname %q is not a valid domain name", soa.MName)
+	}
+
+	soa.MName = dns.Fqdn(soa.MName)
+
+	if soa.RName == "" {
+		soa.RName = "hostmaster." + soa.MName
+	} else if _, ok := dns.IsDomainName(soa.RName); !ok {
+		return BlockedResponseSOA{}, fmt.Errorf("rname %q is not a valid domain name", soa.RName)
+	}
+
+	soa.RName = dns.Fqdn(soa.RName)
+
+	if soa.NegativeTTL == 0 {
+		soa.NegativeTTL = blockedTTL
+		if soa.NegativeTTL == 0 {
+			soa.NegativeTTL = defaultValues.BlockedResponseTTL
+		}
+	}
+
+	return soa, nil
+}
+
+// genSOA returns the SOA record for the authority section of the negative
+// response to request.
 func (s *Server) genSOA(request *dns.Msg) []dns.RR {
 	zone := ""
 	if len(request.Question) > 0 {
 		zone = request.Question[0].Name
 	}
 
+	conf := s.blockedSOA
+	if conf.MName == "" {
+		// The server hasn't been prepared.  An empty configuration is
+		// always valid.
+		conf, _ = newBlockedSOA(BlockedResponseSOA{}, s.conf.BlockedResponseTTL, "")
+	}
+
 	soa := dns.SOA{
 		// values copied from verisign's nonexistent .com domain
 		// their exact values are not important in our use case because they are used for domain transfers between primary/secondary DNS servers
 		Refresh: 1800,
 		Retry:   900,
 		Expire:  604800,
-		Minttl:  86400,
-		// copied from AdGuard DNS
-		Ns:     "fake-for-negative-caching.adguard.com.",
-		Serial: 100500,
-		// rest is request-specific
+		Serial:  100500,
+		// The negative responses are cached for the lesser of the TTL
+		// and the MINIMUM field, see RFC 2308.
+		Minttl: conf.NegativeTTL,
+		Ns:     conf.MName,
+		Mbox:   conf.RName,
 		Hdr: dns.RR_Header{
 			Name:   zone,
 			Rrtype: dns.TypeSOA,
-			Ttl:    s.conf.BlockedResponseTTL,
+			Ttl:    conf.NegativeTTL,
 			Class:  dns.ClassINET,
 		},
-		Mbox: "hostmaster.", // zone will be appended later if it's not empty or "."
-	}
-	if soa.Hdr.Ttl == 0 {
-		soa.Hdr.Ttl = defaultValues.BlockedResponseTTL
-	}
-	if len(zone) > 0 && zone[0] != '.' {
-		soa.Mbox += zone
 	}
+
 	return []dns.RR{&soa}
 }
@@ -0,0 +1,162 @@
+package dnsforward
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBlockedSOA(t *testing.T) {
+	testCases := []struct {
+		name       string
+		conf       BlockedResponseSOA
+		hostname   string
+		want       BlockedResponseSOA
+		wantErrMsg string
+		blockedTTL uint32
+	}{{
+		name:     "hostname",
+		conf:     BlockedResponseSOA{},
+		hostname: "Router.Example",
+		want: BlockedResponseSOA{
+			MName:       "router.example.",
+			RName:       "hostmaster.router.example.",
+			NegativeTTL: 10,
+		},
+		wantErrMsg: "",
+		blockedTTL: 10,
+	}, {
+		name:     "bad_hostname",
+		conf:     BlockedResponseSOA{},
+		hostname: "bad_host",
+		want: BlockedResponseSOA{
+			MName:       defaultSOAMName,
+			RName:       "hostmaster." + defaultSOAMName,
+			NegativeTTL: 3600,
+		},
+		wantErrMsg: "",
+		blockedTTL: 0,
+	}, {
+		name: "configured",
+		conf: BlockedResponseSOA{
+			MName:       "ns.example.org",
+			RName:       "admin.example.org.",
+			NegativeTTL: 60,
+		},
+		hostname: "router.example",
+		want: BlockedResponseSOA{
+			MName:       "ns.example.org.",
+			RName:       "admin.example.org.",
+			NegativeTTL: 60,
+		},
+		wantErrMsg: "",
+		blockedTTL: 10,
+	}, {
+		name: "bad_mname",
+		conf: BlockedResponseSOA{
+			MName: "ns..example.org",
+		},
+		hostname:   "router.example",
+		want:       BlockedResponseSOA{},
+		wantErrMsg: `mname "ns..example.org" is not a valid domain name`,
+		blockedTTL: 10,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			soa, err := newBlockedSOA(tc.conf, tc.blockedTTL, tc.hostname)
+			if tc.wantErrMsg != "" {
+				require.Error(t, err)
+				assert.Equal(t, tc.wantErrMsg, err.Error())
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, soa)
+		})
+	}
+}
+
+// negativeCacheTTL returns the time for which a client caches the negative
+// response resp in accordance with RFC 2308, section 5.
+func negativeCacheTTL(t *testing.T, resp *dns.Msg) (ttl uint32) {
+	t.Helper()
+
+	require.Len(t, resp.Ns, 1)
+
+	soa, ok := resp.Ns[0].(*dns.SOA)
+	require.True(t, ok)
+
+	ttl = soa.Hdr.Ttl
+	if soa.Minttl < ttl {
+		ttl = soa.Minttl
+	}
+
+	return ttl
+}
+
+func TestServer_genDNSFilterMessage_negative(t *testing.T) {
+	const negTTL = 60
+
+	soa, err := newBlockedSOA(BlockedResponseSOA{NegativeTTL: negTTL}, 3600, "router.example")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		mode      string
+		qtype     uint16
+		wantRcode int
+	}{{
+		name:      "nxdomain",
+		mode:      "nxdomain",
+		qtype:     dns.TypeA,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "nxdomain_other_type",
+		mode:      "default",
+		qtype:     dns.TypeTXT,
+		wantRcode: dns.RcodeNameError,
+	}, {
+		name:      "nodata",
+		mode:      "null_ip",
+		qtype:     dns.TypeTXT,
+		wantRcode: dns.RcodeSuccess,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				conf: ServerConfig{
+					FilteringConfig: FilteringConfig{
+						BlockingMode: tc.mode,
+					},
+				},
+				blockedSOA: soa,
+			}
+
+			req := &dns.Msg{}
+			req.SetQuestion("blocked.example.", tc.qtype)
+
+			resp := s.genDNSFilterMessage(&proxy.DNSContext{Req: req}, &dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredBlockList,
+			})
+			require.NotNil(t, resp)
+
+			assert.Equal(t, tc.wantRcode, resp.Rcode)
+			assert.Empty(t, resp.Answer)
+			assert.EqualValues(t, negTTL, negativeCacheTTL(t, resp))
+
+			rr, ok := resp.Ns[0].(*dns.SOA)
+			require.True(t, ok)
+
+			assert.Equal(t, "router.example.", rr.Ns)
+			assert.Equal(t, "hostmaster.router.example.", rr.Mbox)
+		})
+	}
+}
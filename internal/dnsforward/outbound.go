@@ -0,0 +1,614 @@
+package dnsforward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// outboundBinder binds the connections to the upstream servers to the
+// configured network interface or source address.  The addresses of the
+// interface are looked up on each connection, so that the changes, for
+// example after a VPN reconnects, are picked up.
+type outboundBinder struct {
+	// tlsConf is the base TLS configuration of the encrypted upstreams.
+	tlsConf *tls.Config
+
+	// mu protects ups.
+	mu sync.Mutex
+
+	// ups are the bound upstreams by address.  They're reused, so that
+	// the connections are reused as well.
+	ups map[string]upstream.Upstream
+
+	// iface is the name of the network interface, if any.
+	iface string
+
+	// sourceIP is the source address, if any.
+	sourceIP net.IP
+
+	// bootstrap are the addresses of the plain DNS servers resolving the
+	// hostnames of the upstreams.
+	bootstrap []string
+
+	timeout time.Duration
+}
+
+// newOutboundBinder returns a new binder with the outbound settings of conf.
+// It returns nil if there are no such settings.
+func newOutboundBinder(conf *ServerConfig) (b *outboundBinder, err error) {
+	if conf.OutboundInterface == "" && conf.OutboundSourceIP == "" {
+		return nil, nil
+	}
+
+	b = &outboundBinder{
+		tlsConf: &tls.Config{
+			RootCAs:      conf.TLSv12Roots,
+			CipherSuites: conf.TLSCiphers,
+			MinVersion:   tls.VersionTLS12,
+		},
+		ups:     map[string]upstream.Upstream{},
+		iface:   conf.OutboundInterface,
+		timeout: DefaultTimeout,
+	}
+
+	var addrs []net.Addr
+	if b.iface != "" {
+		var ifi *net.Interface
+		ifi, err = net.InterfaceByName(b.iface)
+		if err != nil {
+			return nil, fmt.Errorf("outbound_interface: %w", err)
+		}
+
+		addrs, err = ifi.Addrs()
+	} else {
+		addrs, err = net.InterfaceAddrs()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting interface addresses: %w", err)
+	}
+
+	if conf.OutboundSourceIP != "" {
+		b.sourceIP = net.ParseIP(conf.OutboundSourceIP)
+		if b.sourceIP == nil {
+			return nil, fmt.Errorf("outbound_source_ip: bad ip address %q", conf.OutboundSourceIP)
+		}
+
+		if !containsIP(addrs, b.sourceIP) {
+			return nil, fmt.Errorf("outbound_source_ip: %s isn't an address of %s", b.sourceIP, b.ifaceName())
+		}
+	}
+
+	bootstrap := conf.BootstrapDNS
+	if len(bootstrap) == 0 {
+		bootstrap = defaultBootstrap
+	}
+
+	for _, boot := range bootstrap {
+		var addr string
+		addr, err = plainServerAddr(boot)
+		if err != nil {
+			return nil, fmt.Errorf("bootstrap %q: %w", boot, err)
+		}
+
+		b.bootstrap = append(b.bootstrap, addr)
+	}
+
+	return b, nil
+}
+
+// containsIP returns true if ip is one of addrs.
+func containsIP(addrs []net.Addr, ip net.IP) (ok bool) {
+	for _, a := range addrs {
+		if ipn, isIPNet := a.(*net.IPNet); isIPNet && ipn.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// plainServerAddr returns the address of the plain DNS server s, which must
+// be an IP address with an optional port, with the port.
+func plainServerAddr(s string) (addr string, err error) {
+	if ip := net.ParseIP(s); ip != nil {
+		return net.JoinHostPort(s, "53"), nil
+	}
+
+	host, _, err := net.SplitHostPort(s)
+	if err != nil || net.ParseIP(host) == nil {
+		return "", agherr.Error("only plain dns servers with ip addresses can be used " +
+			"with outbound_interface and outbound_source_ip")
+	}
+
+	return s, nil
+}
+
+// ifaceName returns the description of the interface the upstreams are bound
+// to for the error messages.
+func (b *outboundBinder) ifaceName() (name string) {
+	if b.iface == "" {
+		return "any interface"
+	}
+
+	return fmt.Sprintf("interface %q", b.iface)
+}
+
+// String implements the fmt.Stringer interface for *outboundBinder.
+func (b *outboundBinder) String() (s string) {
+	if b.sourceIP != nil {
+		return fmt.Sprintf("outbound source address %s", b.sourceIP)
+	}
+
+	return fmt.Sprintf("outbound interface %q", b.iface)
+}
+
+// localIP returns the local address to use for connecting to remote.
+func (b *outboundBinder) localIP(remote net.IP) (ip net.IP, err error) {
+	wantV4 := remote.To4() != nil
+	if b.sourceIP != nil {
+		if (b.sourceIP.To4() != nil) != wantV4 {
+			return nil, fmt.Errorf("%s can't be used to connect to %s", b, remote)
+		}
+
+		return b.sourceIP, nil
+	}
+
+	ifi, err := net.InterfaceByName(b.iface)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b, err)
+	}
+
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("%s: getting addresses: %w", b, err)
+	}
+
+	for _, a := range addrs {
+		ipn, ok := a.(*net.IPNet)
+		if !ok || (ipn.IP.To4() != nil) != wantV4 {
+			continue
+		}
+
+		if ipn.IP.IsLinkLocalUnicast() && !remote.IsLinkLocalUnicast() {
+			continue
+		}
+
+		return ipn.IP, nil
+	}
+
+	fam := "ipv6"
+	if wantV4 {
+		fam = "ipv4"
+	}
+
+	return nil, fmt.Errorf("%s has no %s address", b, fam)
+}
+
+// dialer returns a dialer of the connections over network to remote.
+func (b *outboundBinder) dialer(network string, remote net.IP) (d *net.Dialer, err error) {
+	ip, err := b.localIP(remote)
+	if err != nil {
+		return nil, err
+	}
+
+	d = &net.Dialer{
+		Timeout: b.timeout,
+		Control: bindToDeviceControl(b.iface),
+	}
+
+	if strings.HasPrefix(network, "udp") {
+		d.LocalAddr = &net.UDPAddr{IP: ip}
+	} else {
+		d.LocalAddr = &net.TCPAddr{IP: ip}
+	}
+
+	return d, nil
+}
+
+// exchangePlain sends m over network to addr, which must be an IP address
+// with a port.
+func (b *outboundBinder) exchangePlain(m *dns.Msg, network, addr string) (resp *dns.Msg, err error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := b.dialer(network, net.ParseIP(host))
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dns.Client{
+		Net:     network,
+		Timeout: b.timeout,
+		Dialer:  d,
+	}
+	resp, _, err = c.Exchange(m, addr)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", b, err)
+	}
+
+	return resp, nil
+}
+
+// lookup resolves host using the bootstrap servers.
+func (b *outboundBinder) lookup(host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var errs []error
+	for _, boot := range b.bootstrap {
+		for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			req := &dns.Msg{}
+			req.SetQuestion(dns.Fqdn(host), qt)
+
+			var resp *dns.Msg
+			resp, err = b.exchangePlain(req, "udp", boot)
+			if err != nil {
+				errs = append(errs, err)
+
+				continue
+			}
+
+			for _, rr := range resp.Answer {
+				switch rr := rr.(type) {
+				case *dns.A:
+					ips = append(ips, rr.A)
+				case *dns.AAAA:
+					ips = append(ips, rr.AAAA)
+				}
+			}
+		}
+
+		if len(ips) > 0 {
+			return ips, nil
+		}
+	}
+
+	if len(errs) > 0 {
+		return nil, agherr.Many(fmt.Sprintf("resolving %q", host), errs...)
+	}
+
+	return nil, fmt.Errorf("resolving %q: no addresses", host)
+}
+
+// dial connects to addr over network using the bound dialer.
+func (b *outboundBinder) dial(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := b.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []error
+	for _, ip := range ips {
+		var d *net.Dialer
+		d, err = b.dialer(network, ip)
+		if err != nil {
+			errs = append(errs, err)
+
+			continue
+		}
+
+		conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", b, err))
+
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, agherr.Many(fmt.Sprintf("dialing %s", addr), errs...)
+}
+
+// bind returns the upstream with the same address as u, which connects using
+// b.  The bound upstreams use the common timeout and TLS settings, so only the
+// retries of the upstreams with their own options are kept.
+func (b *outboundBinder) bind(u upstream.Upstream) (bound upstream.Upstream, err error) {
+	if tu, ok := u.(*tracedUpstream); ok {
+		u = tu.Upstream
+	}
+
+	switch u := u.(type) {
+	case *boundUpstream:
+		return u, nil
+	case *optionsUpstream:
+		if _, ok := u.Upstream.(*boundUpstream); ok {
+			return u, nil
+		}
+
+		if u.opts.TimeoutMs != 0 || u.opts.hasTLSOptions() {
+			log.Info("dns: warning: only the retries of upstream %s apply with %s", u.opts.Address, b)
+		}
+
+		bound, err = b.bindAddr(u.opts.Address)
+		if err != nil {
+			return nil, err
+		}
+
+		return &optionsUpstream{Upstream: bound, opts: u.opts}, nil
+	default:
+		return b.bindAddr(u.Address())
+	}
+}
+
+// bindAddr returns the upstream with the address addr, which connects using b.
+func (b *outboundBinder) bindAddr(addr string) (bound upstream.Upstream, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if bound, ok := b.ups[addr]; ok {
+		return bound, nil
+	}
+
+	bound, err = newBoundUpstream(b, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	b.ups[addr] = bound
+
+	return bound, nil
+}
+
+// bindAll replaces the upstreams in ups with the bound ones.
+func (b *outboundBinder) bindAll(ups []upstream.Upstream) (err error) {
+	for i, u := range ups {
+		ups[i], err = b.bind(u)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindConfig returns a copy of uc with all the upstreams bound.  uc itself
+// isn't modified since it may be used elsewhere.
+func (b *outboundBinder) bindConfig(uc *proxy.UpstreamConfig) (bound *proxy.UpstreamConfig, err error) {
+	if uc == nil {
+		return nil, nil
+	}
+
+	bound = &proxy.UpstreamConfig{
+		Upstreams: append([]upstream.Upstream(nil), uc.Upstreams...),
+	}
+
+	err = b.bindAll(bound.Upstreams)
+	if err != nil {
+		return nil, err
+	}
+
+	if uc.DomainReservedUpstreams != nil {
+		bound.DomainReservedUpstreams = make(map[string][]upstream.Upstream, len(uc.DomainReservedUpstreams))
+		for domain, ups := range uc.DomainReservedUpstreams {
+			// Keep nil and empty slices, which have special meaning
+			// in the upstream configuration, as is.
+			if len(ups) == 0 {
+				bound.DomainReservedUpstreams[domain] = ups
+
+				continue
+			}
+
+			ups = append([]upstream.Upstream(nil), ups...)
+			err = b.bindAll(ups)
+			if err != nil {
+				return nil, err
+			}
+
+			bound.DomainReservedUpstreams[domain] = ups
+		}
+	}
+
+	return bound, nil
+}
+
+// boundUpstream is an upstream connecting using an outboundBinder.  It
+// supports the plain DNS, DNS-over-TLS, and DNS-over-HTTPS.
+type boundUpstream struct {
+	b *outboundBinder
+
+	// client is the HTTP client of the DNS-over-HTTPS upstreams.
+	client *http.Client
+
+	// addr is the address of the upstream as it's configured.
+	addr string
+
+	// proto is the protocol: "udp", "tcp", "tls", or "https".
+	proto string
+
+	// host and port are the server's host and port.  They're empty for
+	// the DNS-over-HTTPS upstreams.
+	host string
+	port string
+}
+
+// type check
+var _ upstream.Upstream = (*boundUpstream)(nil)
+
+// newBoundUpstream returns a new upstream with the address addr connecting
+// using b.
+func newBoundUpstream(b *outboundBinder, addr string) (u *boundUpstream, err error) {
+	u = &boundUpstream{
+		b:     b,
+		addr:  addr,
+		proto: "udp",
+	}
+
+	hostport := addr
+	defPort := "53"
+	if strings.Contains(addr, "://") {
+		var uu *url.URL
+		uu, err = url.Parse(addr)
+		if err != nil {
+			return nil, fmt.Errorf("upstream %q: %w", addr, err)
+		}
+
+		switch u.proto = uu.Scheme; u.proto {
+		case "tcp":
+			// Go on.
+		case "tls":
+			defPort = "853"
+		case "https":
+			u.client = u.newHTTPClient()
+
+			return u, nil
+		default:
+			return nil, fmt.Errorf("upstream %q: %s upstreams can't be used with %s", addr, u.proto, b)
+		}
+
+		hostport = uu.Host
+	}
+
+	u.host, u.port, err = net.SplitHostPort(hostport)
+	if err != nil {
+		u.host, u.port = strings.Trim(hostport, "[]"), defPort
+	}
+
+	return u, nil
+}
+
+// newHTTPClient returns a new HTTP client for the DNS-over-HTTPS upstream.
+func (u *boundUpstream) newHTTPClient() (c *http.Client) {
+	return &http.Client{
+		Timeout: u.b.timeout,
+		Transport: &http.Transport{
+			DialContext:       u.b.dial,
+			TLSClientConfig:   u.b.tlsConf.Clone(),
+			ForceAttemptHTTP2: true,
+			IdleConnTimeout:   5 * time.Minute,
+		},
+	}
+}
+
+// Address implements the upstream.Upstream interface for *boundUpstream.
+func (u *boundUpstream) Address() (addr string) {
+	return u.addr
+}
+
+// Exchange implements the upstream.Upstream interface for *boundUpstream.
+func (u *boundUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	switch u.proto {
+	case "https":
+		return u.exchangeHTTPS(m)
+	case "tls":
+		return u.exchangeTLS(m)
+	default:
+		return u.exchangePlain(m)
+	}
+}
+
+// exchangePlain sends m using the plain DNS falling back to TCP if the UDP
+// response is truncated.
+func (u *boundUpstream) exchangePlain(m *dns.Msg) (resp *dns.Msg, err error) {
+	ips, err := u.b.lookup(u.host)
+	if err != nil {
+		return nil, err
+	}
+
+	addr := net.JoinHostPort(ips[0].String(), u.port)
+	resp, err = u.b.exchangePlain(m, u.proto, addr)
+	if err == nil && u.proto == "udp" && resp.Truncated {
+		resp, err = u.b.exchangePlain(m, "tcp", addr)
+	}
+
+	return resp, err
+}
+
+// exchangeTLS sends m using DNS-over-TLS.
+func (u *boundUpstream) exchangeTLS(m *dns.Msg) (resp *dns.Msg, err error) {
+	ips, err := u.b.lookup(u.host)
+	if err != nil {
+		return nil, err
+	}
+
+	d, err := u.b.dialer("tcp", ips[0])
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConf := u.b.tlsConf.Clone()
+	tlsConf.ServerName = u.host
+
+	c := &dns.Client{
+		Net:       "tcp-tls",
+		Timeout:   u.b.timeout,
+		Dialer:    d,
+		TLSConfig: tlsConf,
+	}
+	resp, _, err = c.Exchange(m, net.JoinHostPort(ips[0].String(), u.port))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", u.b, err)
+	}
+
+	return resp, nil
+}
+
+// exchangeHTTPS sends m using DNS-over-HTTPS.
+func (u *boundUpstream) exchangeHTTPS(m *dns.Msg) (resp *dns.Msg, err error) {
+	// Use the zero ID to make the responses cacheable, as RFC 8484
+	// recommends.
+	req := m.Copy()
+	req.Id = 0
+
+	buf, err := req.Pack()
+	if err != nil {
+		return nil, fmt.Errorf("packing message: %w", err)
+	}
+
+	hreq, err := http.NewRequest(http.MethodPost, u.addr, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+
+	hreq.Header.Set("Content-Type", "application/dns-message")
+	hreq.Header.Set("Accept", "application/dns-message")
+
+	hresp, err := u.client.Do(hreq)
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", u.addr, err)
+	}
+	defer hresp.Body.Close()
+
+	if hresp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("requesting %s: got status code %d", u.addr, hresp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(hresp.Body, dns.MaxMsgSize))
+	if err != nil {
+		return nil, fmt.Errorf("reading response from %s: %w", u.addr, err)
+	}
+
+	resp = &dns.Msg{}
+	err = resp.Unpack(body)
+	if err != nil {
+		return nil, fmt.Errorf("unpacking response from %s: %w", u.addr, err)
+	}
+
+	resp.Id = m.Id
+
+	return resp, nil
+}
@@ -0,0 +1,35 @@
+// +build linux
+
+package dnsforward
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// bindToDeviceControl returns the Control function of net.Dialer binding the
+// socket to the network interface iface using SO_BINDTODEVICE.  It returns
+// nil if iface is empty.
+func bindToDeviceControl(iface string) (f func(network, address string, c syscall.RawConn) (err error)) {
+	if iface == "" {
+		return nil
+	}
+
+	return func(_, _ string, c syscall.RawConn) (err error) {
+		var opErr error
+		err = c.Control(func(fd uintptr) {
+			opErr = unix.SetsockoptString(int(fd), unix.SOL_SOCKET, unix.SO_BINDTODEVICE, iface)
+		})
+		if err != nil {
+			return err
+		}
+
+		if opErr != nil {
+			return fmt.Errorf("binding to interface %q: %w", iface, opErr)
+		}
+
+		return nil
+	}
+}
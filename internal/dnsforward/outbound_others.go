@@ -0,0 +1,12 @@
+// +build !linux
+
+package dnsforward
+
+import "syscall"
+
+// bindToDeviceControl returns nil, since binding the sockets to a network
+// interface isn't supported on this OS.  The connections are still bound to
+// the addresses of the interface.
+func bindToDeviceControl(_ string) (f func(network, address string, c syscall.RawConn) (err error)) {
+	return nil
+}
@@ -0,0 +1,201 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startLocalDNS starts a plain DNS server on the loopback interface over
+// network, which answers all A queries with 1.2.3.4, and returns its address.
+func startLocalDNS(t *testing.T, network string) (addr string) {
+	t.Helper()
+
+	h := dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		resp := (&dns.Msg{}).SetReply(req)
+		resp.Answer = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{
+				Name:   req.Question[0].Name,
+				Rrtype: dns.TypeA,
+				Class:  dns.ClassINET,
+				Ttl:    60,
+			},
+			A: net.IP{1, 2, 3, 4},
+		}}
+
+		_ = w.WriteMsg(resp)
+	})
+
+	srv := &dns.Server{Handler: h}
+	switch network {
+	case "udp":
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv.PacketConn = pc
+		addr = pc.LocalAddr().String()
+	default:
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+
+		srv.Listener = l
+		addr = l.Addr().String()
+	}
+
+	started := make(chan struct{})
+	srv.NotifyStartedFunc = func() { close(started) }
+	go func() { _ = srv.ActivateAndServe() }()
+	<-started
+
+	t.Cleanup(func() { _ = srv.Shutdown() })
+
+	return addr
+}
+
+func TestNewOutboundBinder(t *testing.T) {
+	testCases := []struct {
+		name     string
+		iface    string
+		sourceIP string
+		boot     []string
+		wantErr  string
+		wantNil  bool
+	}{{
+		name:    "none",
+		wantNil: true,
+	}, {
+		name:     "loopback",
+		sourceIP: "127.0.0.1",
+	}, {
+		name:    "unknown_iface",
+		iface:   "no-such-iface0",
+		wantErr: "outbound_interface: route ip+net: no such network interface",
+	}, {
+		name:     "bad_ip",
+		sourceIP: "bad",
+		wantErr:  `outbound_source_ip: bad ip address "bad"`,
+	}, {
+		name:     "foreign_ip",
+		sourceIP: "192.0.2.1",
+		wantErr:  "outbound_source_ip: 192.0.2.1 isn't an address of any interface",
+	}, {
+		name:     "encrypted_bootstrap",
+		sourceIP: "127.0.0.1",
+		boot:     []string{"tls://1.1.1.1"},
+		wantErr: `bootstrap "tls://1.1.1.1": only plain dns servers with ip addresses ` +
+			`can be used with outbound_interface and outbound_source_ip`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			conf := &ServerConfig{}
+			conf.OutboundInterface = tc.iface
+			conf.OutboundSourceIP = tc.sourceIP
+			conf.BootstrapDNS = tc.boot
+
+			b, err := newOutboundBinder(conf)
+			if tc.wantErr != "" {
+				assert.EqualError(t, err, tc.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantNil, b == nil)
+		})
+	}
+}
+
+func TestOutboundBinder_bind(t *testing.T) {
+	conf := &ServerConfig{}
+	conf.OutboundSourceIP = "127.0.0.1"
+
+	b, err := newOutboundBinder(conf)
+	require.NoError(t, err)
+
+	udpAddr := startLocalDNS(t, "udp")
+	tcpAddr := startLocalDNS(t, "tcp")
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	for _, addr := range []string{udpAddr, "tcp://" + tcpAddr} {
+		t.Run(addr, func(t *testing.T) {
+			var u upstream.Upstream
+			u, err = upstream.AddressToUpstream(addr, upstream.Options{})
+			require.NoError(t, err)
+
+			var bound upstream.Upstream
+			bound, err = b.bind(u)
+			require.NoError(t, err)
+			require.IsType(t, (*boundUpstream)(nil), bound)
+
+			assert.Equal(t, u.Address(), bound.Address())
+
+			var resp *dns.Msg
+			resp, err = bound.Exchange(req.Copy())
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+
+			a, ok := resp.Answer[0].(*dns.A)
+			require.True(t, ok)
+
+			assert.Equal(t, net.IP{1, 2, 3, 4}, a.A.To4())
+		})
+	}
+
+	t.Run("family_mismatch", func(t *testing.T) {
+		var bound upstream.Upstream
+		bound, err = newBoundUpstream(b, "[::1]:53")
+		require.NoError(t, err)
+
+		_, err = bound.Exchange(req.Copy())
+		assert.EqualError(t, err, "outbound source address 127.0.0.1 can't be used to connect to ::1")
+	})
+
+	t.Run("quic", func(t *testing.T) {
+		_, err = newBoundUpstream(b, "quic://dns.adguard.com")
+		assert.EqualError(t, err, `upstream "quic://dns.adguard.com": `+
+			"quic upstreams can't be used with outbound source address 127.0.0.1")
+	})
+}
+
+func TestOutboundBinder_bindConfig(t *testing.T) {
+	conf := &ServerConfig{}
+	conf.OutboundSourceIP = "127.0.0.1"
+
+	b, err := newOutboundBinder(conf)
+	require.NoError(t, err)
+
+	uc, err := proxy.ParseUpstreamsConfig([]string{
+		"1.1.1.1",
+		"[/example.org/]8.8.8.8",
+		"[/local/]#",
+	}, upstream.Options{})
+	require.NoError(t, err)
+
+	bound, err := b.bindConfig(&uc)
+	require.NoError(t, err)
+
+	require.Len(t, bound.Upstreams, 1)
+	assert.IsType(t, (*boundUpstream)(nil), bound.Upstreams[0])
+
+	// The original configuration mustn't be changed.
+	_, ok := uc.Upstreams[0].(*boundUpstream)
+	assert.False(t, ok)
+
+	reserved := bound.DomainReservedUpstreams["example.org."]
+	require.Len(t, reserved, 1)
+
+	assert.IsType(t, (*boundUpstream)(nil), reserved[0])
+	assert.Equal(t, "8.8.8.8:53", reserved[0].Address())
+
+	var local []upstream.Upstream
+	local, ok = bound.DomainReservedUpstreams["local."]
+	require.True(t, ok)
+
+	assert.Empty(t, local)
+}
@@ -0,0 +1,195 @@
+package dnsforward
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+)
+
+// maxByteBuckets is the number of the clients tracked by the response bytes
+// limiter after which the idle ones are forgotten.
+const maxByteBuckets = 10000
+
+// byteBucket is the token bucket of a single client.
+type byteBucket struct {
+	// last is the time when tokens have been updated.
+	last time.Time
+
+	// tokens is the number of bytes the client may be sent now.
+	tokens float64
+}
+
+// bytesLimiter limits the number of bytes per second sent to each client.  A
+// client may be sent up to a second's worth of bytes at once.
+type bytesLimiter struct {
+	// mu protects buckets.
+	mu sync.Mutex
+
+	buckets map[string]*byteBucket
+
+	// allowed are the addresses of the clients, which aren't limited.
+	allowed map[string]struct{}
+
+	// limit is the number of bytes per second.
+	limit float64
+}
+
+// newBytesLimiter returns a new limiter of limit bytes per second.  l is nil if
+// limit is zero.
+func newBytesLimiter(limit uint32, allowed []string) (l *bytesLimiter) {
+	if limit == 0 {
+		return nil
+	}
+
+	l = &bytesLimiter{
+		buckets: map[string]*byteBucket{},
+		allowed: make(map[string]struct{}, len(allowed)),
+		limit:   float64(limit),
+	}
+
+	for _, a := range allowed {
+		l.allowed[a] = struct{}{}
+	}
+
+	return l
+}
+
+// allow returns true if n bytes may be sent to the client with ip at now, and
+// takes them from the client's bucket if so.
+func (l *bytesLimiter) allow(ip net.IP, n int, now time.Time) (ok bool) {
+	key := ip.String()
+	if _, ok = l.allowed[key]; ok {
+		return true
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxByteBuckets {
+			l.forgetIdle(now)
+		}
+
+		b = &byteBucket{tokens: l.limit}
+		l.buckets[key] = b
+	} else {
+		b.tokens += now.Sub(b.last).Seconds() * l.limit
+		if b.tokens > l.limit {
+			b.tokens = l.limit
+		}
+	}
+
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+
+	b.tokens -= float64(n)
+
+	return true
+}
+
+// forgetIdle removes the buckets that would have been full at now, since
+// they're the same as the new ones.  l.mu is expected to be locked.
+func (l *bytesLimiter) forgetIdle(now time.Time) {
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limit >= l.limit {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// newTruncatedResponse returns a truncated copy of resp without any records
+// except the OPT one, so that the client retries over TCP.
+func newTruncatedResponse(req, resp *dns.Msg) (trunc *dns.Msg) {
+	trunc = (&dns.Msg{}).SetRcode(req, resp.Rcode)
+	trunc.Truncated = true
+	trunc.RecursionAvailable = resp.RecursionAvailable
+	trunc.AuthenticatedData = resp.AuthenticatedData
+
+	if opt := resp.IsEdns0(); opt != nil {
+		trunc.Extra = []dns.RR{opt}
+	}
+
+	return trunc
+}
+
+// minimizeResponse removes the authority and the additional sections of resp
+// except for the OPT record, if resp has answers.  The negative responses are
+// left intact, since the SOA records in their authority sections are used for
+// the negative caching, and so are the DNSSEC ones, since the authority
+// sections may contain the proofs.  resp's slices are replaced and not
+// modified, since resp may be shared with the cache.
+func minimizeResponse(resp *dns.Msg, dnssec bool) {
+	if dnssec || resp.Rcode != dns.RcodeSuccess || len(resp.Answer) == 0 {
+		return
+	}
+
+	resp.Ns = nil
+
+	var extra []dns.RR
+	if opt := resp.IsEdns0(); opt != nil {
+		extra = []dns.RR{opt}
+	}
+
+	resp.Extra = extra
+}
+
+// processResponseLimits applies the amplification protections to the
+// response: the minimal responses mode, the limit on the size of the UDP
+// responses, and the limit on the bytes sent per second to the clients
+// outside of the locally-served networks.  The EDNS(0) options added later in
+// the pipeline aren't taken into account.
+func (s *Server) processResponseLimits(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	if d.Res == nil {
+		return resultCodeSuccess
+	}
+
+	if s.conf.MinimalResponses {
+		minimizeResponse(d.Res, ctx.reqDO)
+	}
+
+	if d.Proto != proxy.ProtoUDP || ctx.isLocalClient {
+		return resultCodeSuccess
+	}
+
+	d.Res.Compress = true
+	size := d.Res.Len()
+
+	truncate := false
+	if maxSize := s.conf.MaxUDPResponseSize; maxSize != 0 && size > int(maxSize) {
+		truncate = true
+		atomic.AddUint64(&s.truncatedForced, 1)
+	}
+
+	if !truncate && s.bytesLimiter != nil {
+		ip := IPFromAddr(d.Addr)
+		if ip != nil && !s.bytesLimiter.allow(ip, size, time.Now()) {
+			truncate = true
+			atomic.AddUint64(&s.bytesLimited, 1)
+		}
+	}
+
+	if truncate {
+		d.Res = newTruncatedResponse(d.Req, d.Res)
+	}
+
+	return resultCodeSuccess
+}
+
+// ResponseLimits returns the numbers of the responses affected by the
+// amplification protections since the start.
+func (s *Server) ResponseLimits() (rl stats.ResponseLimits) {
+	return stats.ResponseLimits{
+		TruncatedForced: atomic.LoadUint64(&s.truncatedForced),
+		BytesLimited:    atomic.LoadUint64(&s.bytesLimited),
+		Tarpitted:       atomic.LoadUint64(&s.tarpitted),
+	}
+}
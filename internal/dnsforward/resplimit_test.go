@@ -0,0 +1,176 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesLimiter_allow(t *testing.T) {
+	l := newBytesLimiter(1000, []string{"1.1.1.1"})
+	require.NotNil(t, l)
+
+	ip := net.IP{1, 2, 3, 4}
+	now := time.Now()
+
+	assert.True(t, l.allow(ip, 600, now))
+	assert.False(t, l.allow(ip, 600, now))
+
+	// Half a second later, the bucket has enough bytes again.
+	assert.True(t, l.allow(ip, 600, now.Add(500*time.Millisecond)))
+
+	// The other clients have their own buckets.
+	assert.True(t, l.allow(net.IP{1, 2, 3, 5}, 1000, now))
+
+	// The allowed clients aren't limited.
+	allowedIP := net.IP{1, 1, 1, 1}
+	for i := 0; i < 3; i++ {
+		assert.True(t, l.allow(allowedIP, 1000, now))
+	}
+
+	assert.Nil(t, newBytesLimiter(0, nil))
+}
+
+func TestMinimizeResponse(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	req.SetEdns0(4096, false)
+
+	newResp := func(rcode int, answers int) (resp *dns.Msg) {
+		resp = (&dns.Msg{}).SetRcode(req, rcode)
+		for i := 0; i < answers; i++ {
+			resp.Answer = append(resp.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+				A:   net.IP{1, 2, 3, byte(i)},
+			})
+		}
+
+		resp.Ns = []dns.RR{&dns.NS{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeNS, Class: dns.ClassINET},
+			Ns:  "ns.example.org.",
+		}}
+		resp.Extra = []dns.RR{&dns.A{
+			Hdr: dns.RR_Header{Name: "ns.example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{1, 2, 3, 4},
+		}}
+		resp.SetEdns0(4096, false)
+
+		return resp
+	}
+
+	t.Run("positive", func(t *testing.T) {
+		resp := newResp(dns.RcodeSuccess, 1)
+		minimizeResponse(resp, false)
+
+		assert.Len(t, resp.Answer, 1)
+		assert.Empty(t, resp.Ns)
+		require.Len(t, resp.Extra, 1)
+
+		assert.NotNil(t, resp.IsEdns0())
+	})
+
+	t.Run("negative", func(t *testing.T) {
+		resp := newResp(dns.RcodeNameError, 0)
+		minimizeResponse(resp, false)
+
+		assert.Len(t, resp.Ns, 1)
+		assert.Len(t, resp.Extra, 2)
+	})
+
+	t.Run("dnssec", func(t *testing.T) {
+		resp := newResp(dns.RcodeSuccess, 1)
+		minimizeResponse(resp, true)
+
+		assert.Len(t, resp.Ns, 1)
+		assert.Len(t, resp.Extra, 2)
+	})
+}
+
+func TestServer_processResponseLimits(t *testing.T) {
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	resp := (&dns.Msg{}).SetReply(req)
+	for i := 0; i < 20; i++ {
+		resp.Answer = append(resp.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: "example.org.", Rrtype: dns.TypeA, Class: dns.ClassINET},
+			A:   net.IP{1, 2, 3, byte(i)},
+		})
+	}
+
+	extAddr := &net.UDPAddr{IP: net.IP{8, 8, 8, 8}, Port: 53}
+
+	testCases := []struct {
+		name          string
+		proto         string
+		maxSize       uint16
+		bytesLimit    uint32
+		isLocal       bool
+		wantTrunc     bool
+		wantTruncated uint64
+		wantLimited   uint64
+	}{{
+		name:      "no_limits",
+		proto:     proxy.ProtoUDP,
+		wantTrunc: false,
+	}, {
+		name:          "too_large",
+		proto:         proxy.ProtoUDP,
+		maxSize:       100,
+		wantTrunc:     true,
+		wantTruncated: 1,
+	}, {
+		name:      "too_large_local",
+		proto:     proxy.ProtoUDP,
+		maxSize:   100,
+		isLocal:   true,
+		wantTrunc: false,
+	}, {
+		name:      "too_large_tcp",
+		proto:     proxy.ProtoTCP,
+		maxSize:   100,
+		wantTrunc: false,
+	}, {
+		name:        "bytes_limited",
+		proto:       proxy.ProtoUDP,
+		bytesLimit:  100,
+		wantTrunc:   true,
+		wantLimited: 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := &Server{
+				bytesLimiter: newBytesLimiter(tc.bytesLimit, nil),
+			}
+			s.conf.MaxUDPResponseSize = tc.maxSize
+
+			dctx := &dnsContext{
+				proxyCtx: &proxy.DNSContext{
+					Proto: tc.proto,
+					Req:   req,
+					Res:   resp.Copy(),
+					Addr:  extAddr,
+				},
+				isLocalClient: tc.isLocal,
+			}
+
+			rc := s.processResponseLimits(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			res := dctx.proxyCtx.Res
+			assert.Equal(t, tc.wantTrunc, res.Truncated)
+			if tc.wantTrunc {
+				assert.Empty(t, res.Answer)
+			} else {
+				assert.Len(t, res.Answer, len(resp.Answer))
+			}
+
+			rl := s.ResponseLimits()
+			assert.Equal(t, tc.wantTruncated, rl.TruncatedForced)
+			assert.Equal(t, tc.wantLimited, rl.BytesLimited)
+		})
+	}
+}
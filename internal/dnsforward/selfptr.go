@@ -0,0 +1,110 @@
+package dnsforward
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// defaultInstanceHostname is the name the PTR requests for the addresses of
+// the server are answered with if the hostname of the machine isn't a valid
+// domain name.
+const defaultInstanceHostname = "adguard-home"
+
+// selfPTR is the data for answering the PTR requests for the addresses of the
+// server itself.
+type selfPTR struct {
+	// addrs are the addresses the server listens on.
+	addrs *aghstrings.Set
+
+	// host is the fully-qualified name of the server.
+	host string
+}
+
+// newSelfPTR returns the data for answering the PTR requests for addrs with
+// conf, or with hostname if the former is empty.
+func newSelfPTR(conf, hostname string, addrs []string) (p *selfPTR, err error) {
+	host := conf
+	if host == "" {
+		host = defaultInstanceHostname
+		if aghnet.ValidateDomainName(hostname) == nil {
+			host = hostname
+		}
+	} else if err = aghnet.ValidateDomainName(host); err != nil {
+		return nil, fmt.Errorf("instance hostname: %w", err)
+	}
+
+	p = &selfPTR{
+		addrs: aghstrings.NewSet(),
+		host:  dns.Fqdn(aghnet.CanonicalDomain(host)),
+	}
+
+	for _, a := range addrs {
+		// Store the addresses in the canonical form, so that
+		// "::ffff:1.2.3.4" and "1.2.3.4" are the same.
+		if ip := net.ParseIP(a); ip != nil {
+			p.addrs.Add(ip.String())
+		}
+	}
+
+	return p, nil
+}
+
+// has returns true if ip is an address of the server.
+func (p *selfPTR) has(ip net.IP) (ok bool) {
+	return p != nil && p.addrs.Has(ip.String())
+}
+
+// processSelfPTR answers the PTR requests for the exact addresses the server
+// listens on with its hostname instead of forwarding them.  The rest of the
+// addresses within the same networks are handled as usual.
+func (s *Server) processSelfPTR(ctx *dnsContext) (rc resultCode) {
+	d := ctx.proxyCtx
+	ip := ctx.unreversedReqIP
+	if d.Res != nil || ip == nil {
+		return resultCodeSuccess
+	}
+
+	s.RLock()
+	self := s.self
+	s.RUnlock()
+
+	if !self.has(ip) {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: self reverse-lookup: %s -> %s", ip, self.host)
+
+	req := d.Req
+	resp := s.makeResponse(req)
+	resp.Answer = append(resp.Answer, &dns.PTR{
+		Hdr: s.hdr(req, dns.TypePTR),
+		Ptr: self.host,
+	})
+
+	d.Res = resp
+	ctx.result = &dnsfilter.Result{
+		Reason: dnsfilter.SelfAnswer,
+	}
+
+	return resultCodeSuccess
+}
+
+// prepareSelfPTR sets up the answers to the PTR requests for the addresses of
+// s itself.
+func (s *Server) prepareSelfPTR(hostname string) (err error) {
+	addrs, err := s.collectDNSIPAddrs()
+	if err != nil {
+		return err
+	}
+
+	s.self, err = newSelfPTR(strings.TrimSpace(s.conf.InstanceHostname), hostname, addrs)
+
+	return err
+}
@@ -0,0 +1,124 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewSelfPTR(t *testing.T) {
+	testCases := []struct {
+		name     string
+		conf     string
+		hostname string
+		wantHost string
+		wantErr  bool
+	}{{
+		name:     "conf",
+		conf:     "DNS.Home.Example",
+		hostname: "machine",
+		wantHost: "dns.home.example.",
+	}, {
+		name:     "hostname",
+		hostname: "Machine",
+		wantHost: "machine.",
+	}, {
+		name:     "bad_hostname",
+		hostname: "bad_host name",
+		wantHost: defaultInstanceHostname + ".",
+	}, {
+		name:    "bad_conf",
+		conf:    "bad..name",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			p, err := newSelfPTR(tc.conf, tc.hostname, []string{"192.168.1.2"})
+			if tc.wantErr {
+				assert.Error(t, err)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tc.wantHost, p.host)
+		})
+	}
+}
+
+func TestServer_ProcessSelfPTR(t *testing.T) {
+	self, err := newSelfPTR("", "dns.lan", []string{"192.168.1.2", "::ffff:10.0.0.1", "fe80::1"})
+	require.NoError(t, err)
+
+	s := &Server{self: self}
+	s.conf.BlockedResponseTTL = 10
+
+	testCases := []struct {
+		name    string
+		ip      net.IP
+		wantRes bool
+	}{{
+		name:    "own_v4",
+		ip:      net.IP{192, 168, 1, 2},
+		wantRes: true,
+	}, {
+		name:    "own_mapped",
+		ip:      net.IP{10, 0, 0, 1},
+		wantRes: true,
+	}, {
+		name:    "own_v6",
+		ip:      net.ParseIP("fe80::1"),
+		wantRes: true,
+	}, {
+		name:    "same_subnet",
+		ip:      net.IP{192, 168, 1, 3},
+		wantRes: false,
+	}, {
+		name:    "not_ptr",
+		ip:      nil,
+		wantRes: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			name := "example.com."
+			if tc.ip != nil {
+				name = dns.Fqdn(aghnet.ReverseAddr(tc.ip))
+			}
+
+			req := createTestMessageWithType(name, dns.TypePTR)
+			dctx := &dnsContext{
+				proxyCtx:        &proxy.DNSContext{Req: req},
+				result:          &dnsfilter.Result{},
+				unreversedReqIP: tc.ip,
+			}
+
+			rc := s.processSelfPTR(dctx)
+			require.Equal(t, resultCodeSuccess, rc)
+
+			res := dctx.proxyCtx.Res
+			if !tc.wantRes {
+				assert.Nil(t, res)
+				assert.Equal(t, dnsfilter.NotFilteredNotFound, dctx.result.Reason)
+
+				return
+			}
+
+			require.NotNil(t, res)
+			require.Len(t, res.Answer, 1)
+
+			ptr, ok := res.Answer[0].(*dns.PTR)
+			require.True(t, ok)
+
+			assert.Equal(t, "dns.lan.", ptr.Ptr)
+			assert.Equal(t, dnsfilter.SelfAnswer, dctx.result.Reason)
+		})
+	}
+}
@@ -35,22 +35,39 @@ func processQueryLogsAndStats(ctx *dnsContext) (rc resultCode) {
 			OrigAnswer: ctx.origResp,
 			Result:     ctx.result,
 			Elapsed:    elapsed,
-			ClientIP:   IPFromAddr(pctx.Addr),
+			ClientIP:   ctx.clientIP,
+			ClientPort: ctx.clientPort,
 			ClientID:   ctx.clientID,
+
+			UpstreamAttempts: ctx.upstreamAttempts,
+			UpstreamElapsed:  ctx.upstreamElapsed,
+			TTLOverride:      ctx.ttlOverride,
+			Coalesced:        ctx.coalesced,
+		}
+
+		if ctx.setts != nil {
+			p.Applied = ctx.setts.AppliedSummary(ctx.protectionEnabled)
 		}
 
 		switch pctx.Proto {
 		case proxy.ProtoHTTPS:
 			p.ClientProto = querylog.ClientProtoDOH
+			if r := pctx.HTTPRequest; r != nil && r.ProtoMajor == 3 {
+				p.ClientProto = querylog.ClientProtoDOH3
+			}
 		case proxy.ProtoQUIC:
 			p.ClientProto = querylog.ClientProtoDOQ
 		case proxy.ProtoTLS:
 			p.ClientProto = querylog.ClientProtoDOT
 		case proxy.ProtoDNSCrypt:
 			p.ClientProto = querylog.ClientProtoDNSCrypt
+		case protoUnix:
+			p.ClientProto = querylog.ClientProtoUnix
+		case proxy.ProtoTCP:
+			p.ClientNet = querylog.ClientNetTCP
 		default:
-			// Consider this a plain DNS-over-UDP or DNS-over-TCP
-			// request.
+			// Consider this a plain DNS-over-UDP request.
+			p.ClientNet = querylog.ClientNetUDP
 		}
 
 		if pctx.Upstream != nil {
@@ -67,7 +84,7 @@ func processQueryLogsAndStats(ctx *dnsContext) (rc resultCode) {
 }
 
 func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration, res dnsfilter.Result) {
-	if s.stats == nil {
+	if s.stats == nil || (ctx.coalesced && s.conf.StatsSkipCoalesced) {
 		return
 	}
 
@@ -78,12 +95,14 @@ func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration, res dnsfilt
 
 	if clientID := ctx.clientID; clientID != "" {
 		e.Client = clientID
-	} else if ip := IPFromAddr(pctx.Addr); ip != nil {
+	} else if ip := ctx.clientIP; ip != nil {
 		e.Client = ip.String()
 	}
 
 	e.Time = uint32(elapsed / 1000)
+	e.UpstreamTime = uint32(ctx.upstreamElapsed / 1000)
 	e.Result = stats.RNotFiltered
+	e.Reason = res.Reason
 
 	switch res.Reason {
 	case dnsfilter.FilteredSafeBrowsing:
@@ -98,6 +117,8 @@ func (s *Server) updateStats(ctx *dnsContext, elapsed time.Duration, res dnsfilt
 		fallthrough
 	case dnsfilter.FilteredBlockedService:
 		e.Result = stats.RFiltered
+	case dnsfilter.FilteredAAAADisabled:
+		e.Result = stats.RAAAADisabled
 	}
 
 	s.stats.Update(e)
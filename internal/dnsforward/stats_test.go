@@ -2,6 +2,7 @@ package dnsforward
 
 import (
 	"net"
+	"net/http"
 	"testing"
 	"time"
 
@@ -48,6 +49,7 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		name           string
 		proto          string
 		addr           net.Addr
+		httpReq        *http.Request
 		clientID       string
 		wantLogProto   querylog.ClientProto
 		wantStatClient string
@@ -98,12 +100,24 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		name:           "success_https",
 		proto:          proxy.ProtoHTTPS,
 		addr:           &net.TCPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		httpReq:        &http.Request{ProtoMajor: 2},
 		clientID:       "",
 		wantLogProto:   querylog.ClientProtoDOH,
 		wantStatClient: "1.2.3.4",
 		wantCode:       resultCodeSuccess,
 		reason:         dnsfilter.NotFilteredNotFound,
 		wantStatResult: stats.RNotFiltered,
+	}, {
+		name:           "success_https3",
+		proto:          proxy.ProtoHTTPS,
+		addr:           &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		httpReq:        &http.Request{ProtoMajor: 3},
+		clientID:       "",
+		wantLogProto:   querylog.ClientProtoDOH3,
+		wantStatClient: "1.2.3.4",
+		wantCode:       resultCodeSuccess,
+		reason:         dnsfilter.NotFilteredNotFound,
+		wantStatResult: stats.RNotFiltered,
 	}, {
 		name:           "success_dnscrypt",
 		proto:          proxy.ProtoDNSCrypt,
@@ -154,6 +168,16 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 		wantCode:       resultCodeSuccess,
 		reason:         dnsfilter.FilteredParental,
 		wantStatResult: stats.RParental,
+	}, {
+		name:           "success_udp_aaaa_disabled",
+		proto:          proxy.ProtoUDP,
+		addr:           &net.UDPAddr{IP: net.IP{1, 2, 3, 4}, Port: 1234},
+		clientID:       "",
+		wantLogProto:   "",
+		wantStatClient: "1.2.3.4",
+		wantCode:       resultCodeSuccess,
+		reason:         dnsfilter.FilteredAAAADisabled,
+		wantStatResult: stats.RAAAADisabled,
 	}}
 
 	ups, err := upstream.AddressToUpstream("1.1.1.1", upstream.Options{})
@@ -167,11 +191,12 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 				}},
 			}
 			pctx := &proxy.DNSContext{
-				Proto:    tc.proto,
-				Req:      req,
-				Res:      &dns.Msg{},
-				Addr:     tc.addr,
-				Upstream: ups,
+				Proto:       tc.proto,
+				Req:         req,
+				Res:         &dns.Msg{},
+				Addr:        tc.addr,
+				Upstream:    ups,
+				HTTPRequest: tc.httpReq,
 			}
 
 			ql := &testQueryLog{}
@@ -187,6 +212,7 @@ func TestProcessQueryLogsAndStats(t *testing.T) {
 					Reason: tc.reason,
 				},
 				clientID: tc.clientID,
+				clientIP: IPFromAddr(tc.addr),
 			}
 
 			code := processQueryLogsAndStats(dctx)
@@ -0,0 +1,178 @@
+package dnsforward
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// maxTarpitEntries is the number of the client and domain pairs tracked
+	// by the tarpit after which the idle ones are forgotten.
+	maxTarpitEntries = 10000
+
+	// defaultTarpitMaxDelay is the maximum delay of a blocked response used
+	// if FilteringConfig.TarpitMaxDelayMs isn't set.
+	defaultTarpitMaxDelay = 2 * time.Second
+
+	// maxTarpitMaxDelay is the largest allowed maximum delay of a blocked
+	// response, so that the clients don't time out.
+	maxTarpitMaxDelay = 5 * time.Second
+
+	// tarpitDelayStep is the delay added for each blocked request over the
+	// threshold.
+	tarpitDelayStep = 50 * time.Millisecond
+
+	// tarpitDecay is the time constant of the exponential decay of the
+	// score, so that the score of a client sending a steady number of
+	// requests per minute approaches that number.
+	tarpitDecay = time.Minute
+
+	// tarpitDeadlineMargin is the time left before the deadline of the
+	// request by the delay for the rest of the processing of the response,
+	// so that the client still gets the blocked response.
+	tarpitDeadlineMargin = 50 * time.Millisecond
+)
+
+// tarpitKey is the client and the domain of the blocked requests.
+type tarpitKey struct {
+	client string
+	host   string
+}
+
+// tarpitEntry is the score of a client and domain pair.
+type tarpitEntry struct {
+	// last is the time when score has been updated.
+	last time.Time
+
+	// score is the decayed number of the blocked requests.
+	score float64
+}
+
+// decayed returns the score of e at now.
+func (e *tarpitEntry) decayed(now time.Time) (score float64) {
+	return e.score * math.Exp(-float64(now.Sub(e.last))/float64(tarpitDecay))
+}
+
+// tarpit delays the blocked responses to the clients, which repeat the same
+// blocked request too often, to pace their retries.
+type tarpit struct {
+	// mu protects entries.
+	mu sync.Mutex
+
+	entries map[tarpitKey]*tarpitEntry
+
+	// threshold is the score over which the responses are delayed.
+	threshold float64
+
+	// maxDelay is the maximum delay of a response.
+	maxDelay time.Duration
+}
+
+// newTarpit returns a new tarpit delaying the blocked responses once a client
+// sends more than threshold blocked requests for a domain per minute.  t is nil
+// if threshold is zero.
+func newTarpit(threshold, maxDelayMs uint32) (t *tarpit) {
+	if threshold == 0 {
+		return nil
+	}
+
+	maxDelay := time.Duration(maxDelayMs) * time.Millisecond
+	if maxDelay == 0 {
+		maxDelay = defaultTarpitMaxDelay
+	} else if maxDelay > maxTarpitMaxDelay {
+		log.Info("dns: warning: tarpit delay %s is too long, using %s", maxDelay, maxTarpitMaxDelay)
+		maxDelay = maxTarpitMaxDelay
+	}
+
+	return &tarpit{
+		entries:   map[tarpitKey]*tarpitEntry{},
+		threshold: float64(threshold),
+		maxDelay:  maxDelay,
+	}
+}
+
+// delay records a blocked request for host from client at now and returns the
+// delay of the response.
+func (t *tarpit) delay(client, host string, now time.Time) (d time.Duration) {
+	k := tarpitKey{
+		client: client,
+		host:   strings.ToLower(host),
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	e, ok := t.entries[k]
+	if !ok {
+		if len(t.entries) >= maxTarpitEntries {
+			t.forgetIdle(now)
+		}
+
+		e = &tarpitEntry{}
+		t.entries[k] = e
+	}
+
+	e.score = e.decayed(now) + 1
+	e.last = now
+
+	excess := e.score - t.threshold
+	if excess <= 0 {
+		return 0
+	}
+
+	d = time.Duration(math.Ceil(excess)) * tarpitDelayStep
+	if d > t.maxDelay {
+		d = t.maxDelay
+	}
+
+	return d
+}
+
+// forgetIdle removes the entries, which have decayed below a single request.
+// t.mu is expected to be locked.
+func (t *tarpit) forgetIdle(now time.Time) {
+	for k, e := range t.entries {
+		if e.decayed(now) < 1 {
+			delete(t.entries, k)
+		}
+	}
+}
+
+// processTarpit delays the blocked response if the client repeats the request
+// too often.  The responses, which aren't blocked, are never delayed.
+func (s *Server) processTarpit(ctx *dnsContext) (rc resultCode) {
+	t := s.tarpit
+	res := ctx.result
+	if t == nil || res == nil || !res.IsFiltered || !isBlockedReason(res.Reason) {
+		return resultCodeSuccess
+	}
+
+	d := ctx.proxyCtx
+	if d.Res == nil || ctx.clientIP == nil {
+		return resultCodeSuccess
+	}
+
+	now := time.Now()
+	delay := t.delay(ctx.clientIP.String(), d.Req.Question[0].Name, now)
+	if !ctx.deadline.IsZero() {
+		// Don't delay the response past the deadline.
+		if left := ctx.deadline.Sub(now) - tarpitDeadlineMargin; delay > left {
+			delay = left
+		}
+	}
+
+	if delay <= 0 {
+		return resultCodeSuccess
+	}
+
+	log.Debug("dns: tarpitting %s for %s by %s", d.Req.Question[0].Name, ctx.clientIP, delay)
+	atomic.AddUint64(&s.tarpitted, 1)
+	time.Sleep(delay)
+
+	return resultCodeSuccess
+}
@@ -0,0 +1,83 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTarpit_delay(t *testing.T) {
+	assert.Nil(t, newTarpit(0, 0))
+
+	tp := newTarpit(10, 200)
+	require.NotNil(t, tp)
+
+	now := time.Now()
+	for i := 0; i < 10; i++ {
+		assert.Zero(t, tp.delay("1.2.3.4", "blocked.example", now))
+	}
+
+	// The delay grows with each request over the threshold.
+	assert.Equal(t, tarpitDelayStep, tp.delay("1.2.3.4", "blocked.example", now))
+	assert.Equal(t, 2*tarpitDelayStep, tp.delay("1.2.3.4", "BLOCKED.example", now))
+
+	// The other pairs are tracked separately.
+	assert.Zero(t, tp.delay("1.2.3.5", "blocked.example", now))
+	assert.Zero(t, tp.delay("1.2.3.4", "other.example", now))
+
+	// The delay is bounded.
+	var d time.Duration
+	for i := 0; i < 100; i++ {
+		d = tp.delay("1.2.3.4", "blocked.example", now)
+	}
+	assert.Equal(t, 200*time.Millisecond, d)
+
+	// The score decays.
+	assert.Zero(t, tp.delay("1.2.3.4", "blocked.example", now.Add(10*tarpitDecay)))
+}
+
+func TestServer_processTarpit(t *testing.T) {
+	s := &Server{
+		tarpit: newTarpit(1, 1),
+	}
+
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	newCtx := func(res *dnsfilter.Result) (ctx *dnsContext) {
+		return &dnsContext{
+			proxyCtx: &proxy.DNSContext{
+				Req: req,
+				Res: (&dns.Msg{}).SetReply(req),
+			},
+			result:   res,
+			clientIP: net.IP{1, 2, 3, 4},
+		}
+	}
+
+	for i := 0; i < 5; i++ {
+		rc := s.processTarpit(newCtx(&dnsfilter.Result{}))
+		require.Equal(t, resultCodeSuccess, rc)
+
+		rc = s.processTarpit(newCtx(&dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredSafeSearch,
+		}))
+		require.Equal(t, resultCodeSuccess, rc)
+	}
+	assert.Zero(t, s.tarpitted)
+
+	for i := 0; i < 3; i++ {
+		rc := s.processTarpit(newCtx(&dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredBlockList,
+		}))
+		require.Equal(t, resultCodeSuccess, rc)
+	}
+	assert.Equal(t, uint64(2), s.tarpitted)
+	assert.Equal(t, uint64(2), s.ResponseLimits().Tarpitted)
+}
@@ -0,0 +1,130 @@
+package dnsforward
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/miekg/dns"
+)
+
+// TTLOverride is a rule bounding the TTLs of the answers for the matching
+// domain names.
+type TTLOverride struct {
+	// Pattern is either a domain name, which matches itself only, or a
+	// domain name with the "*." prefix, which matches its subdomains but not
+	// itself.
+	Pattern string `yaml:"pattern" json:"pattern"`
+
+	// Min is the minimum TTL in seconds.
+	Min uint32 `yaml:"min" json:"min"`
+
+	// Max is the maximum TTL in seconds.  Zero means no maximum.
+	Max uint32 `yaml:"max" json:"max"`
+}
+
+// validate returns an error if o is invalid.
+func (o *TTLOverride) validate() (err error) {
+	name := strings.TrimPrefix(o.Pattern, "*.")
+	err = aghnet.ValidateDomainName(name)
+	if err != nil {
+		return fmt.Errorf("pattern %q: %w", o.Pattern, err)
+	}
+
+	if o.Max != 0 && o.Max < o.Min {
+		return fmt.Errorf("pattern %q: max %d is less than min %d", o.Pattern, o.Max, o.Min)
+	}
+
+	return nil
+}
+
+// match returns true if host, which must be lowercased and have no trailing
+// dot, matches o.
+func (o *TTLOverride) match(host string) (ok bool) {
+	pat := strings.ToLower(o.Pattern)
+	if strings.HasPrefix(pat, "*.") {
+		return strings.HasSuffix(host, pat[1:])
+	}
+
+	return host == pat
+}
+
+// clamp returns ttl bounded by o.
+func (o *TTLOverride) clamp(ttl uint32) (clamped uint32) {
+	if ttl < o.Min {
+		return o.Min
+	}
+
+	if o.Max != 0 && ttl > o.Max {
+		return o.Max
+	}
+
+	return ttl
+}
+
+// validateTTLOverrides returns an error if any of rules is invalid.
+func validateTTLOverrides(rules []TTLOverride) (err error) {
+	for i := range rules {
+		err = rules[i].validate()
+		if err != nil {
+			return fmt.Errorf("ttl override at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// ttlOverrides are the TTL override rules applied to the responses of the
+// upstream servers.
+type ttlOverrides struct {
+	// mu protects rules.
+	mu    sync.RWMutex
+	rules []TTLOverride
+}
+
+// set replaces the rules of o.  rules must be valid.
+func (o *ttlOverrides) set(rules []TTLOverride) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.rules = append([]TTLOverride(nil), rules...)
+}
+
+// find returns a copy of the first rule matching host, if any.
+func (o *ttlOverrides) find(host string) (r *TTLOverride) {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+
+	for i := range o.rules {
+		if o.rules[i].match(host) {
+			rule := o.rules[i]
+
+			return &rule
+		}
+	}
+
+	return nil
+}
+
+// apply bounds the TTLs of the answer records of resp, which is the response
+// to req, with the first rule matching the question of req.  It returns the
+// applied rule, if any.
+func (o *ttlOverrides) apply(req, resp *dns.Msg) (r *TTLOverride) {
+	if resp == nil || len(resp.Answer) == 0 || len(req.Question) == 0 {
+		return nil
+	}
+
+	host := strings.ToLower(strings.TrimSuffix(req.Question[0].Name, "."))
+	r = o.find(host)
+	if r == nil {
+		return nil
+	}
+
+	for _, rr := range resp.Answer {
+		hdr := rr.Header()
+		hdr.Ttl = r.clamp(hdr.Ttl)
+	}
+
+	return r
+}
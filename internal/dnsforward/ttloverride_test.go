@@ -0,0 +1,181 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTTLOverride_validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		o       TTLOverride
+		wantErr string
+	}{{
+		name:    "domain",
+		o:       TTLOverride{Pattern: "example.org", Min: 60, Max: 0},
+		wantErr: "",
+	}, {
+		name:    "wildcard",
+		o:       TTLOverride{Pattern: "*.example.org", Min: 60, Max: 3600},
+		wantErr: "",
+	}, {
+		name: "bad_pattern",
+		o:    TTLOverride{Pattern: "*example.org"},
+		wantErr: `pattern "*example.org": invalid domain name label at index 0: ` +
+			`invalid char '*' at index 0 in "*example"`,
+	}, {
+		name:    "empty",
+		o:       TTLOverride{Pattern: ""},
+		wantErr: `pattern "": domain name is empty`,
+	}, {
+		name:    "bad_bounds",
+		o:       TTLOverride{Pattern: "example.org", Min: 60, Max: 30},
+		wantErr: `pattern "example.org": max 30 is less than min 60`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.o.validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestTTLOverrides_apply(t *testing.T) {
+	o := &ttlOverrides{}
+	o.set([]TTLOverride{{
+		Pattern: "*.example.org",
+		Min:     300,
+		Max:     3600,
+	}, {
+		Pattern: "example.org",
+		Min:     0,
+		Max:     10,
+	}, {
+		Pattern: "host.example.org",
+		Min:     0,
+		Max:     1,
+	}})
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantPattern string
+		ttl         uint32
+		wantTTL     uint32
+	}{{
+		name:        "raise",
+		host:        "www.example.org.",
+		wantPattern: "*.example.org",
+		ttl:         10,
+		wantTTL:     300,
+	}, {
+		name:        "lower",
+		host:        "WWW.example.org.",
+		wantPattern: "*.example.org",
+		ttl:         86400,
+		wantTTL:     3600,
+	}, {
+		name:        "first_match",
+		host:        "host.example.org.",
+		wantPattern: "*.example.org",
+		ttl:         10,
+		wantTTL:     300,
+	}, {
+		name:        "exact",
+		host:        "example.org.",
+		wantPattern: "example.org",
+		ttl:         60,
+		wantTTL:     10,
+	}, {
+		name:        "no_match",
+		host:        "example.com.",
+		wantPattern: "",
+		ttl:         60,
+		wantTTL:     60,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			resp := (&dns.Msg{}).SetReply(req)
+			resp.Answer = []dns.RR{&dns.A{
+				Hdr: dns.RR_Header{
+					Name:   tc.host,
+					Rrtype: dns.TypeA,
+					Class:  dns.ClassINET,
+					Ttl:    tc.ttl,
+				},
+				A: net.IP{1, 2, 3, 4},
+			}}
+
+			r := o.apply(req, resp)
+			if tc.wantPattern == "" {
+				assert.Nil(t, r)
+			} else {
+				require.NotNil(t, r)
+				assert.Equal(t, tc.wantPattern, r.Pattern)
+			}
+
+			assert.Equal(t, tc.wantTTL, resp.Answer[0].Header().Ttl)
+		})
+	}
+}
+
+func TestUpstreamTraces_ttlOverride(t *testing.T) {
+	ttls := &ttlOverrides{}
+	ttls.set([]TTLOverride{{Pattern: "example.org", Min: 300}})
+	ts := &upstreamTraces{ttls: ttls}
+
+	uc := ts.wrap(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{&aghtest.TestUpstream{
+			Addr: "ok",
+			IPv4: map[string][]net.IP{
+				"example.org.": {{1, 2, 3, 4}},
+				"example.com.": {{1, 2, 3, 4}},
+			},
+		}},
+	})
+
+	testCases := []struct {
+		name        string
+		host        string
+		wantPattern string
+		wantTTL     uint32
+	}{{
+		name:        "override",
+		host:        "example.org.",
+		wantPattern: "example.org",
+		wantTTL:     300,
+	}, {
+		name:        "none",
+		host:        "example.com.",
+		wantPattern: "",
+		wantTTL:     0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			req := (&dns.Msg{}).SetQuestion(tc.host, dns.TypeA)
+			trace, untrack := ts.track(req)
+			resp, err := uc.Upstreams[0].Exchange(req)
+			untrack()
+			require.NoError(t, err)
+			require.Len(t, resp.Answer, 1)
+
+			assert.Equal(t, tc.wantTTL, resp.Answer[0].Header().Ttl)
+			assert.Equal(t, tc.wantPattern, trace.ttlOverridePattern())
+		})
+	}
+}
@@ -0,0 +1,401 @@
+package dnsforward
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// protoUnix is the protocol name of the requests received via the UNIX socket.
+// It's also the name of its ingress pool.
+const protoUnix = "unix"
+
+// The networks of the UNIX socket.
+const (
+	unixNetDgram  = "unixgram"
+	unixNetStream = "unix"
+)
+
+const (
+	// defaultUnixSocketMode is the file mode of the UNIX socket used if
+	// UnixSocketConfig.Mode isn't set.
+	defaultUnixSocketMode os.FileMode = 0o660
+
+	// unixConnTimeout is the time a stream connection may be idle before
+	// it's closed.
+	unixConnTimeout = 10 * time.Second
+)
+
+// UnixSocketConfig is the configuration of the DNS listener on the UNIX socket
+// for the local applications.
+type UnixSocketConfig struct {
+	// Path is the path of the socket.  The listener is disabled if it's
+	// empty.
+	Path string `yaml:"path"`
+
+	// Network is either "unixgram", the default, for the datagram socket
+	// or "unix" for the stream one, which uses the DNS-over-TCP framing.
+	Network string `yaml:"network"`
+
+	// Mode is the file mode of the socket.  If zero, 0660 is used.
+	Mode uint32 `yaml:"mode"`
+}
+
+// unixPeerAddr is the address of the client of the UNIX socket.  The client is
+// considered to be on the loopback address, see IPFromAddr.
+type unixPeerAddr struct {
+	// uid is the user ID of the peer process or -1 if it isn't known.
+	uid int
+}
+
+// unixPeerIP is the IP address of the clients of the UNIX socket.
+var unixPeerIP = net.IP{127, 0, 0, 1}
+
+// Network implements the net.Addr interface for *unixPeerAddr.
+func (a *unixPeerAddr) Network() (n string) {
+	return protoUnix
+}
+
+// String implements the net.Addr interface for *unixPeerAddr.
+func (a *unixPeerAddr) String() (s string) {
+	if a.uid < 0 {
+		return protoUnix
+	}
+
+	return protoUnix + ":uid=" + strconv.Itoa(a.uid)
+}
+
+// clientID returns the ClientID of the peer, which is based on its user ID, so
+// that the persistent clients can be set up for the local users.
+func (a *unixPeerAddr) clientID() (id string) {
+	if a.uid < 0 {
+		return ""
+	}
+
+	return "uid-" + strconv.Itoa(a.uid)
+}
+
+// unixServer serves the DNS requests received via the UNIX socket.
+type unixServer struct {
+	srv  *Server
+	conf UnixSocketConfig
+
+	// dgram is the datagram socket, if used.
+	dgram *net.UnixConn
+
+	// stream is the listener of the stream socket, if used.
+	stream *net.UnixListener
+
+	wg sync.WaitGroup
+
+	// closed is 1 once the socket is closed.  It's accessed atomically.
+	closed uint32
+}
+
+// newUnixServer returns the UNIX socket server for conf.  u is nil if the
+// listener is disabled.
+func newUnixServer(s *Server, conf UnixSocketConfig) (u *unixServer, err error) {
+	if conf.Path == "" {
+		return nil, nil
+	}
+
+	switch conf.Network {
+	case "":
+		conf.Network = unixNetDgram
+	case unixNetDgram, unixNetStream:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("unix socket: bad network %q", conf.Network)
+	}
+
+	if conf.Mode&^uint32(os.ModePerm) != 0 {
+		return nil, fmt.Errorf("unix socket: bad mode %#o", conf.Mode)
+	}
+
+	return &unixServer{
+		srv:  s,
+		conf: conf,
+	}, nil
+}
+
+// removeStaleSocket removes the socket at path if no one listens on it.  It
+// returns an error if path is a live socket or isn't a socket at all.
+func removeStaleSocket(path string) (err error) {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and isn't a socket", path)
+	}
+
+	// The type of the existing socket isn't known, so try both.
+	for _, network := range []string{unixNetDgram, unixNetStream} {
+		var c net.Conn
+		c, err = net.DialTimeout(network, path, time.Second)
+		if err == nil {
+			_ = c.Close()
+
+			return fmt.Errorf("%s is in use", path)
+		}
+	}
+
+	log.Info("dns: removing stale unix socket %s", path)
+
+	return os.Remove(path)
+}
+
+// start creates the socket and starts serving the requests.
+func (u *unixServer) start() (err error) {
+	err = removeStaleSocket(u.conf.Path)
+	if err != nil {
+		return fmt.Errorf("unix socket: %w", err)
+	}
+
+	addr := &net.UnixAddr{Name: u.conf.Path, Net: u.conf.Network}
+	if u.conf.Network == unixNetDgram {
+		u.dgram, err = net.ListenUnixgram(unixNetDgram, addr)
+		if err == nil {
+			err = enablePeerCreds(u.dgram)
+		}
+	} else {
+		u.stream, err = net.ListenUnix(unixNetStream, addr)
+	}
+	if err != nil {
+		_ = u.close()
+
+		return fmt.Errorf("unix socket: listening: %w", err)
+	}
+
+	mode := os.FileMode(u.conf.Mode)
+	if mode == 0 {
+		mode = defaultUnixSocketMode
+	}
+
+	err = os.Chmod(u.conf.Path, mode)
+	if err != nil {
+		_ = u.close()
+
+		return fmt.Errorf("unix socket: %w", err)
+	}
+
+	u.wg.Add(1)
+	if u.dgram != nil {
+		go u.serveDgram()
+	} else {
+		go u.serveStream()
+	}
+
+	log.Info("dns: listening on unix socket %s (%s)", u.conf.Path, u.conf.Network)
+
+	return nil
+}
+
+// close closes the socket and removes its file.
+func (u *unixServer) close() (err error) {
+	atomic.StoreUint32(&u.closed, 1)
+
+	if u.dgram != nil {
+		err = u.dgram.Close()
+	} else if u.stream != nil {
+		// Don't let the listener remove the file, since it's removed
+		// below anyway.
+		u.stream.SetUnlinkOnClose(false)
+		err = u.stream.Close()
+	}
+
+	rerr := os.Remove(u.conf.Path)
+	if err == nil && !errors.Is(rerr, os.ErrNotExist) {
+		err = rerr
+	}
+
+	return err
+}
+
+// stop stops serving the requests and waits for the ones being processed.
+func (u *unixServer) stop() (err error) {
+	err = u.close()
+	u.wg.Wait()
+
+	if err != nil {
+		return fmt.Errorf("unix socket: closing: %w", err)
+	}
+
+	return nil
+}
+
+// serveDgram serves the requests received via the datagram socket.  The
+// clients must bind their sockets to receive the responses.
+func (u *unixServer) serveDgram() {
+	defer agherr.LogPanic("dns: unix socket")
+	defer u.wg.Done()
+
+	buf := make([]byte, dns.MaxMsgSize)
+	oob := make([]byte, peerCredsOOBSize)
+	for {
+		n, oobn, _, addr, err := u.dgram.ReadMsgUnix(buf, oob)
+		if err != nil {
+			if atomic.LoadUint32(&u.closed) == 0 {
+				log.Error("dns: unix socket: reading: %s", err)
+			}
+
+			return
+		}
+
+		if addr == nil || addr.Name == "" {
+			log.Debug("dns: unix socket: unbound client socket, can't respond")
+
+			continue
+		}
+
+		peer := &unixPeerAddr{uid: dgramPeerUID(oob[:oobn])}
+		req := make([]byte, n)
+		copy(req, buf[:n])
+
+		u.wg.Add(1)
+		go func() {
+			defer agherr.LogPanic("dns: unix socket")
+			defer u.wg.Done()
+
+			resp := u.handle(req, peer)
+			if resp == nil {
+				return
+			}
+
+			_, werr := u.dgram.WriteToUnix(resp, addr)
+			if werr != nil {
+				log.Debug("dns: unix socket: writing response: %s", werr)
+			}
+		}()
+	}
+}
+
+// serveStream accepts the connections to the stream socket.
+func (u *unixServer) serveStream() {
+	defer agherr.LogPanic("dns: unix socket")
+	defer u.wg.Done()
+
+	for {
+		conn, err := u.stream.AcceptUnix()
+		if err != nil {
+			if atomic.LoadUint32(&u.closed) == 0 {
+				log.Error("dns: unix socket: accepting: %s", err)
+			}
+
+			return
+		}
+
+		u.wg.Add(1)
+		go u.serveConn(conn)
+	}
+}
+
+// serveConn serves the requests received via conn until it's closed or idle
+// for unixConnTimeout.
+func (u *unixServer) serveConn(conn *net.UnixConn) {
+	defer agherr.LogPanic("dns: unix socket")
+	defer u.wg.Done()
+	defer func() { _ = conn.Close() }()
+
+	peer := &unixPeerAddr{uid: streamPeerUID(conn)}
+	for {
+		err := conn.SetDeadline(time.Now().Add(unixConnTimeout))
+		if err != nil {
+			return
+		}
+
+		var l uint16
+		err = binary.Read(conn, binary.BigEndian, &l)
+		if err != nil {
+			return
+		}
+
+		req := make([]byte, l)
+		_, err = io.ReadFull(conn, req)
+		if err != nil {
+			return
+		}
+
+		resp := u.handle(req, peer)
+		if resp == nil {
+			continue
+		}
+
+		msg := make([]byte, 2+len(resp))
+		binary.BigEndian.PutUint16(msg, uint16(len(resp)))
+		copy(msg[2:], resp)
+
+		_, err = conn.Write(msg)
+		if err != nil {
+			log.Debug("dns: unix socket: writing response: %s", err)
+
+			return
+		}
+	}
+}
+
+// handle processes the request in data from peer the way dnsproxy processes the
+// requests from the other listeners and returns the packed response.  resp is
+// nil if there should be no response.
+func (u *unixServer) handle(data []byte, peer *unixPeerAddr) (resp []byte) {
+	req := &dns.Msg{}
+	err := req.Unpack(data)
+	if err != nil {
+		log.Debug("dns: unix socket: unpacking request: %s", err)
+
+		return nil
+	} else if req.Response {
+		return nil
+	}
+
+	s := u.srv
+	d := &proxy.DNSContext{
+		Proto:     protoUnix,
+		Req:       req,
+		Addr:      peer,
+		StartTime: time.Now(),
+	}
+
+	ok, err := s.beforeRequestHandler(nil, d)
+	if err != nil {
+		log.Error("dns: unix socket: %s", err)
+		d.Res = s.genServerFailure(req)
+	} else if !ok {
+		return nil
+	} else if len(req.Question) != 1 {
+		d.Res = s.genServerFailure(req)
+	} else {
+		err = s.handleDNSRequest(nil, d)
+		if err != nil {
+			log.Debug("dns: unix socket: %s", err)
+		}
+	}
+
+	if d.Res == nil {
+		d.Res = s.genServerFailure(req)
+	}
+
+	resp, err = d.Res.Pack()
+	if err != nil {
+		log.Error("dns: unix socket: packing response: %s", err)
+
+		return nil
+	}
+
+	return resp
+}
@@ -0,0 +1,67 @@
+// +build linux
+
+package dnsforward
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredsOOBSize is the size of the ancillary data with the credentials of
+// the peer.
+var peerCredsOOBSize = syscall.CmsgSpace(syscall.SizeofUcred)
+
+// enablePeerCreds makes the kernel attach the credentials of the peers to the
+// datagrams received via c.
+func enablePeerCreds(c *net.UnixConn) (err error) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	cerr := rc.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_PASSCRED, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+
+	return err
+}
+
+// dgramPeerUID returns the user ID of the sender of a datagram from its
+// ancillary data oob or -1 if it's not there.
+func dgramPeerUID(oob []byte) (uid int) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return -1
+	}
+
+	for i := range msgs {
+		cred, cerr := syscall.ParseUnixCredentials(&msgs[i])
+		if cerr == nil {
+			return int(cred.Uid)
+		}
+	}
+
+	return -1
+}
+
+// streamPeerUID returns the user ID of the peer of c or -1 if it can't be
+// determined.
+func streamPeerUID(c *net.UnixConn) (uid int) {
+	rc, err := c.SyscallConn()
+	if err != nil {
+		return -1
+	}
+
+	uid = -1
+	_ = rc.Control(func(fd uintptr) {
+		cred, cerr := syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+		if cerr == nil {
+			uid = int(cred.Uid)
+		}
+	})
+
+	return uid
+}
@@ -0,0 +1,24 @@
+// +build !linux
+
+package dnsforward
+
+import "net"
+
+// peerCredsOOBSize is the size of the ancillary data with the credentials of
+// the peer.  The credentials aren't received on this platform.
+const peerCredsOOBSize = 0
+
+// enablePeerCreds is a no-op on this platform.
+func enablePeerCreds(_ *net.UnixConn) (err error) {
+	return nil
+}
+
+// dgramPeerUID always returns -1 on this platform.
+func dgramPeerUID(_ []byte) (uid int) {
+	return -1
+}
+
+// streamPeerUID always returns -1 on this platform.
+func streamPeerUID(_ *net.UnixConn) (uid int) {
+	return -1
+}
@@ -0,0 +1,163 @@
+// +build linux
+
+package dnsforward
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newUnixTestServer returns a started server listening on the UNIX socket of
+// network and a function returning the IP address and the ClientID of the last
+// filtered request.
+func newUnixTestServer(t *testing.T, network string) (path string, last func() (ip net.IP, id string)) {
+	t.Helper()
+
+	path = filepath.Join(t.TempDir(), "dns.sock")
+
+	var mu sync.Mutex
+	var lastIP net.IP
+	var lastID string
+
+	s := createTestServer(t, &dnsfilter.Config{}, ServerConfig{
+		UDPListenAddrs: []*net.UDPAddr{{}},
+		TCPListenAddrs: []*net.TCPAddr{{}},
+		FilteringConfig: FilteringConfig{
+			ProtectionEnabled: true,
+			UnixSocket: UnixSocketConfig{
+				Path:    path,
+				Network: network,
+				Mode:    0o600,
+			},
+			FilterHandler: func(ip net.IP, id string, _ *dnsfilter.FilteringSettings) {
+				mu.Lock()
+				defer mu.Unlock()
+
+				lastIP, lastID = ip, id
+			},
+		},
+	}, nil)
+	s.conf.UpstreamConfig.Upstreams = []upstream.Upstream{
+		&aghtest.TestUpstream{
+			IPv4: map[string][]net.IP{
+				"example.org.": {{1, 2, 3, 4}},
+			},
+		},
+	}
+	startDeferStop(t, s)
+
+	fi, err := os.Stat(path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), fi.Mode().Perm())
+
+	return path, func() (ip net.IP, id string) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return lastIP, lastID
+	}
+}
+
+// checkUnixResponse checks the response to the A request for example.org.
+func checkUnixResponse(t *testing.T, resp *dns.Msg, last func() (ip net.IP, id string)) {
+	t.Helper()
+
+	require.Len(t, resp.Answer, 1)
+	a, ok := resp.Answer[0].(*dns.A)
+	require.True(t, ok)
+	assert.Equal(t, net.IP{1, 2, 3, 4}, a.A.To4())
+
+	ip, id := last()
+	assert.Equal(t, unixPeerIP, ip)
+	assert.Equal(t, (&unixPeerAddr{uid: os.Getuid()}).clientID(), id)
+}
+
+func TestUnixServer_dgram(t *testing.T) {
+	path, last := newUnixTestServer(t, unixNetDgram)
+
+	laddr := &net.UnixAddr{Name: filepath.Join(t.TempDir(), "client.sock"), Net: unixNetDgram}
+	conn, err := net.DialUnix(unixNetDgram, laddr, &net.UnixAddr{Name: path, Net: unixNetDgram})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	dc := &dns.Conn{Conn: conn}
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	require.NoError(t, dc.WriteMsg(req))
+
+	resp, err := dc.ReadMsg()
+	require.NoError(t, err)
+
+	assert.Equal(t, req.Id, resp.Id)
+	checkUnixResponse(t, resp, last)
+}
+
+func TestUnixServer_stream(t *testing.T) {
+	path, last := newUnixTestServer(t, unixNetStream)
+
+	c := &dns.Client{Net: "tcp", Dialer: &net.Dialer{}}
+	conn, err := net.Dial(unixNetStream, path)
+	require.NoError(t, err)
+
+	// Hide the net.PacketConn methods of *net.UnixConn so that dns.Conn
+	// uses the stream framing.
+	dc := &dns.Conn{Conn: struct{ net.Conn }{conn}}
+	t.Cleanup(func() { _ = dc.Close() })
+
+	for i := 0; i < 2; i++ {
+		req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+		resp, _, xerr := c.ExchangeWithConn(req, dc)
+		require.NoError(t, xerr)
+
+		checkUnixResponse(t, resp, last)
+	}
+}
+
+func TestRemoveStaleSocket(t *testing.T) {
+	dir := t.TempDir()
+
+	t.Run("missing", func(t *testing.T) {
+		assert.NoError(t, removeStaleSocket(filepath.Join(dir, "missing.sock")))
+	})
+
+	t.Run("not_socket", func(t *testing.T) {
+		path := filepath.Join(dir, "file")
+		require.NoError(t, ioutil.WriteFile(path, nil, 0o644))
+
+		assert.Error(t, removeStaleSocket(path))
+		assert.FileExists(t, path)
+	})
+
+	t.Run("stale", func(t *testing.T) {
+		path := filepath.Join(dir, "stale.sock")
+		l, err := net.ListenUnix(unixNetStream, &net.UnixAddr{Name: path, Net: unixNetStream})
+		require.NoError(t, err)
+
+		l.SetUnlinkOnClose(false)
+		require.NoError(t, l.Close())
+		require.FileExists(t, path)
+
+		assert.NoError(t, removeStaleSocket(path))
+		assert.NoFileExists(t, path)
+	})
+
+	t.Run("in_use", func(t *testing.T) {
+		path := filepath.Join(dir, "live.sock")
+		conn, err := net.ListenUnixgram(unixNetDgram, &net.UnixAddr{Name: path, Net: unixNetDgram})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = conn.Close() })
+
+		assert.Error(t, removeStaleSocket(path))
+		assert.FileExists(t, path)
+	})
+}
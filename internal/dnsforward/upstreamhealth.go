@@ -0,0 +1,508 @@
+package dnsforward
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// passiveMaxFails is the number of the consecutive failed exchanges
+	// after which an upstream is considered down.
+	passiveMaxFails = 3
+
+	// passiveDownPeriod is the time since the last failed exchange for
+	// which an upstream is considered down, unless an exchange succeeds.
+	passiveDownPeriod = 1 * time.Minute
+)
+
+const (
+	// probeHistory is the period for which the probe results are kept.
+	probeHistory = 24 * time.Hour
+
+	// probeJitterDiv defines the jitter of the probes.  The probes of a
+	// single round are spread over the first 1/probeJitterDiv of the
+	// interval, and the rounds are shifted by up to the same amount.
+	probeJitterDiv = 10
+)
+
+// defaultProbeName is the name resolved by the probes of the default upstreams
+// if FilteringConfig.UpstreamProbeName isn't set.
+const defaultProbeName = "example.org"
+
+// Probe statuses.
+const (
+	probeStatusOK      = "ok"
+	probeStatusError   = "error"
+	probeStatusSkipped = "skipped"
+)
+
+// probeResult is the result of a single probe.
+type probeResult struct {
+	Time   aghtime.Time `json:"time"`
+	Status string       `json:"status"`
+
+	// Error is the error of the failed probe or the reason the probe has
+	// been skipped.
+	Error string `json:"error,omitempty"`
+
+	// ElapsedMs is the duration of the exchange in milliseconds.  It's zero
+	// for the skipped probes.
+	ElapsedMs float64 `json:"elapsed_ms"`
+}
+
+// probeRing is a ring buffer of the recent probe results.
+type probeRing struct {
+	buf []probeResult
+
+	// next is the index in buf of the next result.
+	next int
+
+	// full is true if buf has been filled at least once.
+	full bool
+}
+
+// push adds res to the ring, which keeps the size latest results.
+func (r *probeRing) push(res probeResult, size int) {
+	if size != len(r.buf) {
+		recent := r.results()
+		if len(recent) > size-1 {
+			recent = recent[len(recent)-(size-1):]
+		}
+
+		r.buf = make([]probeResult, size)
+		r.next = copy(r.buf, recent)
+		r.full = false
+	}
+
+	r.buf[r.next] = res
+	r.next++
+	if r.next == len(r.buf) {
+		r.next, r.full = 0, true
+	}
+}
+
+// results returns the results from the oldest to the latest.
+func (r *probeRing) results() (res []probeResult) {
+	if !r.full {
+		return append([]probeResult{}, r.buf[:r.next]...)
+	}
+
+	res = make([]probeResult, 0, len(r.buf))
+	res = append(res, r.buf[r.next:]...)
+
+	return append(res, r.buf[:r.next]...)
+}
+
+// upstreamState is the health of a single upstream.
+type upstreamState struct {
+	// downUntil is the time until which the upstream is considered down by
+	// the passive tracking.
+	downUntil time.Time
+
+	probes probeRing
+
+	// fails is the number of the consecutive failed exchanges.
+	fails int
+}
+
+// upstreamHealth is the health of the upstream servers.  It's tracked
+// passively by the results of the exchanges made for the requests of the
+// clients and actively by the probes.
+//
+// The zero upstreamHealth is empty and ready for use.
+type upstreamHealth struct {
+	// mu protects states.
+	mu sync.Mutex
+
+	// states are the states of the upstreams by their addresses.
+	states map[string]*upstreamState
+}
+
+// stateLocked returns the state of the upstream with addr, creating it if
+// necessary.  h.mu is expected to be locked.
+func (h *upstreamHealth) stateLocked(addr string) (st *upstreamState) {
+	if h.states == nil {
+		h.states = map[string]*upstreamState{}
+	}
+
+	st, ok := h.states[addr]
+	if !ok {
+		st = &upstreamState{}
+		h.states[addr] = st
+	}
+
+	return st
+}
+
+// exchanged records the result of the exchange of a client's request with the
+// upstream with addr.
+func (h *upstreamHealth) exchanged(addr string, err error, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st := h.stateLocked(addr)
+	if err == nil {
+		st.fails, st.downUntil = 0, time.Time{}
+
+		return
+	}
+
+	st.fails++
+	if st.fails >= passiveMaxFails {
+		st.downUntil = now.Add(passiveDownPeriod)
+	}
+}
+
+// isDown returns true if the upstream with addr is considered down by the
+// passive tracking at now.
+func (h *upstreamHealth) isDown(addr string, now time.Time) (down bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	st, ok := h.states[addr]
+
+	return ok && now.Before(st.downUntil)
+}
+
+// probed records the result of the probe of the upstream with addr keeping
+// the size latest results.
+func (h *upstreamHealth) probed(addr string, res probeResult, size int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.stateLocked(addr).probes.push(res, size)
+}
+
+// probeTarget is an upstream to probe.
+type probeTarget struct {
+	u upstream.Upstream
+
+	// name is the FQDN which the request would be routed to u with.
+	name string
+
+	// domains are the domains which u is reserved for.  It's empty for
+	// the default upstreams.
+	domains []string
+}
+
+// newProbeTargets returns the targets for the upstreams of uc.  The default
+// upstreams are probed with probeName, and the ones reserved only for domains
+// are probed with the first of those domains, so that the probes follow the
+// same routes as the requests.  The upstreams reserved for the unqualified
+// names are probed with the first label of probeName.
+func newProbeTargets(uc *proxy.UpstreamConfig, probeName string) (targets []*probeTarget) {
+	if uc == nil {
+		return nil
+	}
+
+	probeName = dns.Fqdn(probeName)
+	byAddr := map[string]*probeTarget{}
+	add := func(u upstream.Upstream, domain string) {
+		if tu, ok := u.(*tracedUpstream); ok {
+			u = tu.Upstream
+		}
+
+		t, ok := byAddr[u.Address()]
+		if !ok {
+			t = &probeTarget{
+				u:    u,
+				name: probeName,
+			}
+
+			if domain == proxy.UnqualifiedNames {
+				t.name = probeName[:strings.IndexByte(probeName, '.')+1]
+			} else if domain != "" {
+				t.name = domain
+			}
+
+			byAddr[u.Address()] = t
+			targets = append(targets, t)
+		}
+
+		if domain != "" {
+			t.domains = append(t.domains, domain)
+		}
+	}
+
+	for _, u := range uc.Upstreams {
+		add(u, "")
+	}
+
+	domains := make([]string, 0, len(uc.DomainReservedUpstreams))
+	for d := range uc.DomainReservedUpstreams {
+		domains = append(domains, d)
+	}
+	sort.Strings(domains)
+
+	for _, d := range domains {
+		for _, u := range uc.DomainReservedUpstreams[d] {
+			add(u, d)
+		}
+	}
+
+	return targets
+}
+
+// upstreamProber probes the upstreams in the background.
+type upstreamProber struct {
+	health  *upstreamHealth
+	done    chan struct{}
+	targets []*probeTarget
+
+	ivl time.Duration
+
+	// size is the number of the results kept for each upstream.
+	size int
+}
+
+// newUpstreamProber returns a prober of targets with the interval ivl.  p is
+// nil if ivl is zero.
+func newUpstreamProber(health *upstreamHealth, targets []*probeTarget, ivl time.Duration) (p *upstreamProber) {
+	if ivl == 0 {
+		return nil
+	}
+
+	return &upstreamProber{
+		health:  health,
+		targets: targets,
+		ivl:     ivl,
+		size:    int((probeHistory + ivl - 1) / ivl),
+	}
+}
+
+// start starts probing in a separate goroutine.
+func (p *upstreamProber) start() {
+	if p == nil || p.done != nil {
+		return
+	}
+
+	p.done = make(chan struct{})
+	go p.run(p.done)
+}
+
+// stop stops probing.  The probes already sent aren't waited for.
+func (p *upstreamProber) stop() {
+	if p == nil || p.done == nil {
+		return
+	}
+
+	close(p.done)
+	p.done = nil
+}
+
+// jitter returns a random duration up to 1/probeJitterDiv of the interval.
+func (p *upstreamProber) jitter() (d time.Duration) {
+	return time.Duration(rand.Int63n(int64(p.ivl/probeJitterDiv) + 1))
+}
+
+// run probes the upstreams until done is closed.
+func (p *upstreamProber) run(done <-chan struct{}) {
+	defer agherr.LogPanic("dns: upstream prober")
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-time.After(p.ivl - p.ivl/probeJitterDiv/2 + p.jitter()):
+			for _, t := range p.targets {
+				go p.probeAfter(done, t, p.jitter())
+			}
+		}
+	}
+}
+
+// probeAfter probes t after the delay unless done is closed before that.
+func (p *upstreamProber) probeAfter(done <-chan struct{}, t *probeTarget, delay time.Duration) {
+	defer agherr.LogPanic("dns: upstream probe")
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return
+	case <-timer.C:
+		p.probe(t)
+	}
+}
+
+// probe probes t once and records the result.  The upstreams considered down
+// by the passive tracking aren't probed.
+func (p *upstreamProber) probe(t *probeTarget) {
+	addr := t.u.Address()
+	start := time.Now()
+	if p.health.isDown(addr, start) {
+		p.health.probed(addr, probeResult{
+			Time:   aghtime.Time{Time: start},
+			Status: probeStatusSkipped,
+			Error:  "upstream is down",
+		}, p.size)
+
+		return
+	}
+
+	req := &dns.Msg{
+		MsgHdr: dns.MsgHdr{
+			Id:               dns.Id(),
+			RecursionDesired: true,
+		},
+		Question: []dns.Question{{
+			Name:   t.name,
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	resp, err := t.u.Exchange(req)
+	res := probeResult{
+		Time:      aghtime.Time{Time: start},
+		Status:    probeStatusOK,
+		ElapsedMs: float64(time.Since(start)) / float64(time.Millisecond),
+	}
+
+	if err == nil && resp.Rcode != dns.RcodeSuccess && resp.Rcode != dns.RcodeNameError {
+		err = fmt.Errorf("response code %s", dns.RcodeToString[resp.Rcode])
+	}
+
+	if err != nil {
+		log.Debug("dns: probing upstream %s: %s", addr, err)
+
+		res.Status, res.Error = probeStatusError, err.Error()
+	}
+
+	p.health.probed(addr, res, p.size)
+}
+
+// prepareProber validates the configuration of the probes and prepares the
+// prober of the configured upstreams.  The previous prober, if any, is
+// stopped.
+func (s *Server) prepareProber() (err error) {
+	name := s.conf.UpstreamProbeName
+	if name == "" {
+		name = defaultProbeName
+	}
+
+	err = aghnet.ValidateDomainName(strings.TrimSuffix(name, "."))
+	if err != nil {
+		return fmt.Errorf("upstream probe name: %w", err)
+	}
+
+	s.prober.stop()
+
+	s.probeTargets = newProbeTargets(s.conf.UpstreamConfig, name)
+	ivl := time.Duration(s.conf.UpstreamProbeInterval) * time.Minute
+	s.prober = newUpstreamProber(&s.health, s.probeTargets, ivl)
+
+	return nil
+}
+
+// upstreamStatusJSON is the health of a single upstream in the HTTP API.
+type upstreamStatusJSON struct {
+	DownUntil *aghtime.Time `json:"down_until,omitempty"`
+
+	Address   string   `json:"address"`
+	ProbeName string   `json:"probe_name"`
+	Domains   []string `json:"domains"`
+
+	Probes []probeResult `json:"probes"`
+
+	// Options are the options of the upstream, if it has its own.
+	Options *UpstreamOptions `json:"options,omitempty"`
+
+	ConsecutiveFailures int `json:"consecutive_failures"`
+
+	// Down is true if the upstream is considered down by the passive
+	// tracking, so that it isn't probed.
+	Down bool `json:"down"`
+}
+
+// upstreamHealthJSON is the response to the GET /control/upstream_health
+// request.
+type upstreamHealthJSON struct {
+	Upstreams []*upstreamStatusJSON `json:"upstreams"`
+
+	// ProbeInterval is the interval between the probes in minutes.  Zero
+	// means that the upstreams aren't probed.
+	ProbeInterval uint32 `json:"probe_interval"`
+}
+
+// statuses returns the health of targets at now.
+func (h *upstreamHealth) statuses(targets []*probeTarget, now time.Time) (sts []*upstreamStatusJSON) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sts = make([]*upstreamStatusJSON, 0, len(targets))
+	for _, t := range targets {
+		addr := t.u.Address()
+		st := &upstreamStatusJSON{
+			Address:   addr,
+			ProbeName: t.name,
+			Domains:   append([]string{}, t.domains...),
+			Probes:    []probeResult{},
+		}
+		sts = append(sts, st)
+
+		if ou, ok := t.u.(*optionsUpstream); ok {
+			opts := *ou.opts
+			st.Options = &opts
+		}
+
+		us, ok := h.states[addr]
+		if !ok {
+			continue
+		}
+
+		st.ConsecutiveFailures = us.fails
+		if now.Before(us.downUntil) {
+			st.Down, st.DownUntil = true, &aghtime.Time{Time: us.downUntil}
+		}
+
+		since := now.Add(-probeHistory)
+		for _, res := range us.probes.results() {
+			if res.Time.After(since) {
+				st.Probes = append(st.Probes, res)
+			}
+		}
+	}
+
+	return sts
+}
+
+// WriteUpstreamHealth writes the health of the upstreams to w as JSON in the
+// format of the GET /control/upstream_health HTTP API.
+func (s *Server) WriteUpstreamHealth(w io.Writer) (err error) {
+	s.RLock()
+	targets := s.probeTargets
+	ivl := s.conf.UpstreamProbeInterval
+	s.RUnlock()
+
+	return json.NewEncoder(w).Encode(upstreamHealthJSON{
+		Upstreams:     s.health.statuses(targets, time.Now()),
+		ProbeInterval: ivl,
+	})
+}
+
+// handleUpstreamHealth is the handler for the GET /control/upstream_health HTTP
+// API.
+func (s *Server) handleUpstreamHealth(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := s.WriteUpstreamHealth(w)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json.Encode: %s", err)
+	}
+}
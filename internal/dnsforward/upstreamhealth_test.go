@@ -0,0 +1,172 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProbeRing(t *testing.T) {
+	start := time.Unix(0, 0)
+	res := func(i int) (r probeResult) {
+		return probeResult{Time: aghtime.Time{Time: start.Add(time.Duration(i) * time.Minute)}}
+	}
+	times := func(rs []probeResult) (ms []int) {
+		ms = []int{}
+		for _, r := range rs {
+			ms = append(ms, int(r.Time.Sub(start)/time.Minute))
+		}
+
+		return ms
+	}
+
+	r := &probeRing{}
+	assert.Empty(t, r.results())
+
+	for i := 0; i < 5; i++ {
+		r.push(res(i), 3)
+	}
+	assert.Equal(t, []int{2, 3, 4}, times(r.results()))
+
+	// Growing keeps all the results.
+	r.push(res(5), 5)
+	assert.Equal(t, []int{2, 3, 4, 5}, times(r.results()))
+
+	// Shrinking keeps the latest ones.
+	r.push(res(6), 2)
+	assert.Equal(t, []int{5, 6}, times(r.results()))
+}
+
+func TestUpstreamHealth_exchanged(t *testing.T) {
+	const addr = "1.2.3.4:53"
+
+	h := &upstreamHealth{}
+	now := time.Now()
+
+	for i := 0; i < passiveMaxFails-1; i++ {
+		h.exchanged(addr, assert.AnError, now)
+	}
+	assert.False(t, h.isDown(addr, now))
+
+	h.exchanged(addr, assert.AnError, now)
+	assert.True(t, h.isDown(addr, now))
+	assert.False(t, h.isDown(addr, now.Add(passiveDownPeriod)))
+
+	h.exchanged(addr, nil, now)
+	assert.False(t, h.isDown(addr, now))
+	assert.False(t, h.isDown("5.6.7.8:53", now))
+}
+
+func TestNewProbeTargets(t *testing.T) {
+	def := &aghtest.TestUpstream{Addr: "default"}
+	both := &aghtest.TestUpstream{Addr: "both"}
+	reserved := &aghtest.TestUpstream{Addr: "reserved"}
+	local := &aghtest.TestUpstream{Addr: "local"}
+
+	ts := &upstreamTraces{}
+	uc := ts.wrap(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{def, both},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"b.example.":           {reserved},
+			"a.example.":           {reserved, both},
+			"excluded.a.example.":  nil,
+			proxy.UnqualifiedNames: {local},
+		},
+	})
+
+	targets := newProbeTargets(uc, "probe.example")
+	require.Len(t, targets, 4)
+
+	testCases := []struct {
+		u           upstream.Upstream
+		wantName    string
+		wantDomains []string
+	}{{
+		u:           def,
+		wantName:    "probe.example.",
+		wantDomains: nil,
+	}, {
+		u:           both,
+		wantName:    "probe.example.",
+		wantDomains: []string{"a.example."},
+	}, {
+		u:           reserved,
+		wantName:    "a.example.",
+		wantDomains: []string{"a.example.", "b.example."},
+	}, {
+		u:           local,
+		wantName:    "probe.",
+		wantDomains: []string{proxy.UnqualifiedNames},
+	}}
+
+	for i, tc := range testCases {
+		tgt := targets[i]
+		t.Run(tc.u.Address(), func(t *testing.T) {
+			// The probes mustn't be recorded as the exchanges of the
+			// requests.
+			assert.Same(t, tc.u, tgt.u)
+			assert.Equal(t, tc.wantName, tgt.name)
+			assert.Equal(t, tc.wantDomains, tgt.domains)
+		})
+	}
+}
+
+func TestUpstreamProber_probe(t *testing.T) {
+	ok := &probeTarget{
+		u: &aghtest.TestUpstream{
+			Addr: "ok",
+			IPv4: map[string][]net.IP{"probe.example.": {{1, 2, 3, 4}}},
+		},
+		name: "probe.example.",
+	}
+	failing := &probeTarget{
+		u:    &aghtest.TestErrUpstream{Err: assert.AnError},
+		name: "probe.example.",
+	}
+
+	h := &upstreamHealth{}
+	p := newUpstreamProber(h, []*probeTarget{ok, failing}, 5*time.Minute)
+	require.NotNil(t, p)
+	assert.Equal(t, 288, p.size)
+
+	p.probe(ok)
+	p.probe(failing)
+
+	// The upstreams considered down aren't probed.
+	for i := 0; i < passiveMaxFails; i++ {
+		h.exchanged(ok.u.Address(), assert.AnError, time.Now())
+	}
+	p.probe(ok)
+
+	sts := h.statuses([]*probeTarget{ok, failing}, time.Now())
+	require.Len(t, sts, 2)
+
+	okSt := sts[0]
+	assert.True(t, okSt.Down)
+	assert.NotNil(t, okSt.DownUntil)
+	assert.Equal(t, passiveMaxFails, okSt.ConsecutiveFailures)
+	require.Len(t, okSt.Probes, 2)
+	assert.Equal(t, probeStatusOK, okSt.Probes[0].Status)
+	assert.Equal(t, probeStatusSkipped, okSt.Probes[1].Status)
+
+	failSt := sts[1]
+	assert.False(t, failSt.Down)
+	require.Len(t, failSt.Probes, 1)
+	assert.Equal(t, probeStatusError, failSt.Probes[0].Status)
+	assert.Contains(t, failSt.Probes[0].Error, assert.AnError.Error())
+
+	// The results older than a day aren't reported.
+	sts = h.statuses([]*probeTarget{ok}, time.Now().Add(probeHistory))
+	require.Len(t, sts, 1)
+	assert.Empty(t, sts[0].Probes)
+	assert.False(t, sts[0].Down)
+
+	assert.Nil(t, newUpstreamProber(h, nil, 0))
+}
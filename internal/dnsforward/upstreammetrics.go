@@ -0,0 +1,302 @@
+package dnsforward
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+)
+
+// upstreamLatencyBuckets are the upper bounds of the buckets of the upstream
+// exchange duration histogram in seconds.  The last bucket, which isn't listed
+// here, contains the rest.
+var upstreamLatencyBuckets = [...]float64{
+	0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5,
+}
+
+// upstreamMetricsOther is the value of the upstream label of the series which
+// collects the exchanges with the upstreams missing from the configured
+// upstream list, for example the ones of the persistent clients.  It keeps
+// the cardinality of the metrics bounded.
+const upstreamMetricsOther = "other"
+
+// The names of the upstream metrics in the Prometheus text format.
+const (
+	metricUpstreamDuration    = "adguardhome_upstream_exchange_duration_seconds"
+	metricUpstreamTimeouts    = "adguardhome_upstream_timeouts_total"
+	metricUpstreamTLSFailures = "adguardhome_upstream_tls_handshake_failures_total"
+)
+
+// upstreamSeries are the metrics of the exchanges with a single upstream.
+type upstreamSeries struct {
+	// buckets is the duration histogram, see upstreamLatencyBuckets.  The
+	// counters are accessed atomically, so they're kept at the top for the
+	// alignment.
+	buckets [len(upstreamLatencyBuckets) + 1]uint64
+
+	// sumNs is the total duration of the exchanges in nanoseconds.
+	sumNs uint64
+
+	// timeouts and tlsFailures are the numbers of the exchanges failed due
+	// to a timeout and due to a TLS handshake failure.
+	timeouts    uint64
+	tlsFailures uint64
+
+	// upstream and proto are the values of the labels.
+	upstream string
+	proto    string
+}
+
+// record records an exchange, which has taken elapsed and failed with err, if
+// any.
+func (s *upstreamSeries) record(elapsed time.Duration, err error) {
+	i := sort.SearchFloat64s(upstreamLatencyBuckets[:], elapsed.Seconds())
+	atomic.AddUint64(&s.buckets[i], 1)
+	atomic.AddUint64(&s.sumNs, uint64(elapsed))
+
+	if err == nil {
+		return
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		atomic.AddUint64(&s.timeouts, 1)
+	} else if isTLSProto(s.proto) && isTLSFailure(err) {
+		atomic.AddUint64(&s.tlsFailures, 1)
+	}
+}
+
+// upstreamProto returns the value of the proto label for the upstream with
+// the address addr.
+func upstreamProto(addr string) (proto string) {
+	i := strings.Index(addr, "://")
+	if i < 0 {
+		return "udp"
+	}
+
+	switch scheme := addr[:i]; scheme {
+	case "sdns":
+		return "dnscrypt"
+	case "tcp", "tls", "https", "quic":
+		return scheme
+	default:
+		return upstreamMetricsOther
+	}
+}
+
+// isTLSProto returns true if the upstreams with proto perform TLS handshakes.
+func isTLSProto(proto string) (ok bool) {
+	return proto == "tls" || proto == "https" || proto == "quic"
+}
+
+// isTLSFailure returns true if err is caused by a failed TLS handshake.  The
+// errors of the TLS stack of QUIC only keep the message, so it's checked as
+// well.
+func isTLSFailure(err error) (ok bool) {
+	var (
+		hdrErr  tls.RecordHeaderError
+		authErr x509.UnknownAuthorityError
+		hostErr x509.HostnameError
+		certErr x509.CertificateInvalidError
+	)
+
+	if errors.As(err, &hdrErr) ||
+		errors.As(err, &authErr) ||
+		errors.As(err, &hostErr) ||
+		errors.As(err, &certErr) {
+		return true
+	}
+
+	msg := err.Error()
+
+	return strings.Contains(msg, "tls: ") || strings.Contains(msg, "handshake")
+}
+
+// upstreamMetrics are the metrics of the exchanges with the upstreams.  There
+// is a series for each configured upstream and one for the rest.
+type upstreamMetrics struct {
+	// mu protects series.
+	mu     sync.RWMutex
+	series map[string]*upstreamSeries
+
+	other *upstreamSeries
+}
+
+// reset sets the configured upstreams to the ones with addrs.  The series of
+// the upstreams which are still configured are kept.
+func (m *upstreamMetrics) reset(addrs []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	series := make(map[string]*upstreamSeries, len(addrs))
+	for _, addr := range addrs {
+		if s, ok := m.series[addr]; ok {
+			series[addr] = s
+		} else {
+			series[addr] = &upstreamSeries{
+				upstream: addr,
+				proto:    upstreamProto(addr),
+			}
+		}
+	}
+
+	m.series = series
+	if m.other == nil {
+		m.other = &upstreamSeries{
+			upstream: upstreamMetricsOther,
+			proto:    upstreamMetricsOther,
+		}
+	}
+}
+
+// exchanged records an exchange with the upstream with the address addr.
+func (m *upstreamMetrics) exchanged(addr string, elapsed time.Duration, err error) {
+	m.mu.RLock()
+	s, ok := m.series[addr]
+	if !ok {
+		s = m.other
+	}
+	m.mu.RUnlock()
+
+	if s != nil {
+		s.record(elapsed, err)
+	}
+}
+
+// sorted returns the series ordered by the upstream with the series of the
+// other upstreams in the end.
+func (m *upstreamMetrics) sorted() (series []*upstreamSeries) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	series = make([]*upstreamSeries, 0, len(m.series)+1)
+	for _, s := range m.series {
+		series = append(series, s)
+	}
+
+	sort.Slice(series, func(i, j int) bool {
+		return series[i].upstream < series[j].upstream
+	})
+
+	if m.other != nil {
+		series = append(series, m.other)
+	}
+
+	return series
+}
+
+// labelEscaper escapes the label values in the Prometheus text format.
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labels returns the labels of s in the Prometheus text format.
+func (s *upstreamSeries) labels() (l string) {
+	return fmt.Sprintf(`upstream="%s",proto="%s"`, labelEscaper.Replace(s.upstream), s.proto)
+}
+
+// formatFloat formats f in the Prometheus text format.
+func formatFloat(f float64) (s string) {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeTo writes the metrics in the Prometheus text format into w.
+func (m *upstreamMetrics) writeTo(w io.Writer) (err error) {
+	series := m.sorted()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "# HELP %s The duration of the exchanges with the upstream servers.\n", metricUpstreamDuration)
+	fmt.Fprintf(bw, "# TYPE %s histogram\n", metricUpstreamDuration)
+	for _, s := range series {
+		l := s.labels()
+
+		// Count the total from the buckets, so that it's consistent
+		// with them regardless of the concurrent exchanges.
+		var cum uint64
+		for i, le := range upstreamLatencyBuckets {
+			cum += atomic.LoadUint64(&s.buckets[i])
+			fmt.Fprintf(bw, "%s_bucket{%s,le=\"%s\"} %d\n", metricUpstreamDuration, l, formatFloat(le), cum)
+		}
+
+		cum += atomic.LoadUint64(&s.buckets[len(upstreamLatencyBuckets)])
+		fmt.Fprintf(bw, "%s_bucket{%s,le=\"+Inf\"} %d\n", metricUpstreamDuration, l, cum)
+
+		sum := time.Duration(atomic.LoadUint64(&s.sumNs)).Seconds()
+		fmt.Fprintf(bw, "%s_sum{%s} %s\n", metricUpstreamDuration, l, formatFloat(sum))
+		fmt.Fprintf(bw, "%s_count{%s} %d\n", metricUpstreamDuration, l, cum)
+	}
+
+	counters := []struct {
+		val  func(s *upstreamSeries) (n uint64)
+		name string
+		help string
+	}{{
+		val:  func(s *upstreamSeries) (n uint64) { return atomic.LoadUint64(&s.timeouts) },
+		name: metricUpstreamTimeouts,
+		help: "The number of the exchanges with the upstream servers failed due to a timeout.",
+	}, {
+		val:  func(s *upstreamSeries) (n uint64) { return atomic.LoadUint64(&s.tlsFailures) },
+		name: metricUpstreamTLSFailures,
+		help: "The number of the exchanges with the upstream servers failed due to a TLS handshake failure.",
+	}}
+
+	for _, c := range counters {
+		fmt.Fprintf(bw, "# HELP %s %s\n", c.name, c.help)
+		fmt.Fprintf(bw, "# TYPE %s counter\n", c.name)
+		for _, s := range series {
+			fmt.Fprintf(bw, "%s{%s} %d\n", c.name, s.labels(), c.val(s))
+		}
+	}
+
+	return bw.Flush()
+}
+
+// upstreamAddrs returns the addresses of the upstreams within uc without
+// duplicates.
+func upstreamAddrs(uc *proxy.UpstreamConfig) (addrs []string) {
+	seen := map[string]struct{}{}
+	add := func(ups []upstream.Upstream) {
+		for _, u := range ups {
+			addr := u.Address()
+			if _, ok := seen[addr]; !ok {
+				seen[addr] = struct{}{}
+				addrs = append(addrs, addr)
+			}
+		}
+	}
+
+	add(uc.Upstreams)
+	for _, ups := range uc.DomainReservedUpstreams {
+		add(ups)
+	}
+
+	return addrs
+}
+
+// WriteUpstreamMetrics writes the metrics of the exchanges with the upstreams
+// to w in the Prometheus text format in the format of the GET
+// /control/upstream_metrics HTTP API.
+func (s *Server) WriteUpstreamMetrics(w io.Writer) (err error) {
+	return s.upstreamMetrics.writeTo(w)
+}
+
+// handleUpstreamMetrics is the handler for the GET /control/upstream_metrics
+// HTTP API.
+func (s *Server) handleUpstreamMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	err := s.WriteUpstreamMetrics(w)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "writing metrics: %s", err)
+	}
+}
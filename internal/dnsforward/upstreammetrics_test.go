@@ -0,0 +1,172 @@
+package dnsforward
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUpstreamProto(t *testing.T) {
+	testCases := []struct {
+		addr string
+		want string
+	}{{
+		addr: "1.2.3.4:53",
+		want: "udp",
+	}, {
+		addr: "tcp://1.2.3.4:53",
+		want: "tcp",
+	}, {
+		addr: "tls://dns.example:853",
+		want: "tls",
+	}, {
+		addr: "https://dns.example:443/dns-query",
+		want: "https",
+	}, {
+		addr: "quic://dns.example:784",
+		want: "quic",
+	}, {
+		addr: "sdns://AQcAAAAAAAAADjE3Ni4xMDMuMTMwLjEz",
+		want: "dnscrypt",
+	}, {
+		addr: "gopher://dns.example",
+		want: upstreamMetricsOther,
+	}}
+
+	for _, tc := range testCases {
+		assert.Equal(t, tc.want, upstreamProto(tc.addr), tc.addr)
+	}
+}
+
+// labelValue returns the value of the label name of m.
+func labelValue(m *dto.Metric, name string) (val string) {
+	for _, l := range m.GetLabel() {
+		if l.GetName() == name {
+			return l.GetValue()
+		}
+	}
+
+	return ""
+}
+
+func TestUpstreamMetrics_writeTo(t *testing.T) {
+	const (
+		udpAddr = "1.2.3.4:53"
+		tlsAddr = "tls://dns.example:853"
+	)
+
+	udp := &aghtest.TestUpstream{Addr: udpAddr}
+	reserved := &aghtest.TestUpstream{Addr: tlsAddr}
+
+	m := &upstreamMetrics{}
+	m.reset(upstreamAddrs(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{udp},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"a.example.": {reserved, udp},
+		},
+	}))
+
+	// The exchanges through the traced upstreams are recorded.
+	ts := &upstreamTraces{metrics: m}
+	ups := ts.wrapUpstreams([]upstream.Upstream{udp})
+	req := (&dns.Msg{}).SetQuestion("example.org.", dns.TypeA)
+	for i := 0; i < 3; i++ {
+		_, err := ups[0].Exchange(req)
+		require.NoError(t, err)
+	}
+
+	m.exchanged(udpAddr, 2*time.Second, fmt.Errorf("reading: %w", os.ErrDeadlineExceeded))
+	m.exchanged(tlsAddr, 30*time.Millisecond, fmt.Errorf("dialing: %w", tls.RecordHeaderError{Msg: "bad"}))
+	m.exchanged(tlsAddr, 10*time.Second, nil)
+
+	// The upstreams which aren't configured only get into the series of the
+	// other upstreams.
+	for i := 0; i < 100; i++ {
+		m.exchanged(fmt.Sprintf("10.0.0.%d:53", i), time.Millisecond, nil)
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, m.writeTo(buf))
+
+	var p expfmt.TextParser
+	families, err := p.TextToMetricFamilies(buf)
+	require.NoError(t, err)
+	require.Len(t, families, 3)
+
+	hist := families[metricUpstreamDuration]
+	require.NotNil(t, hist)
+	require.Equal(t, dto.MetricType_HISTOGRAM, hist.GetType())
+	require.Len(t, hist.GetMetric(), 3)
+
+	histograms := map[string]*dto.Histogram{}
+	for _, met := range hist.GetMetric() {
+		histograms[labelValue(met, "upstream")+" "+labelValue(met, "proto")] = met.GetHistogram()
+	}
+
+	h := histograms[udpAddr+" udp"]
+	require.NotNil(t, h)
+	assert.Equal(t, uint64(4), h.GetSampleCount())
+	// The parser keeps the +Inf bucket.
+	require.Len(t, h.GetBucket(), len(upstreamLatencyBuckets)+1)
+	assert.Equal(t, 0.0005, h.GetBucket()[0].GetUpperBound())
+	// The bucket of the exchanges up to 1s.
+	assert.Equal(t, uint64(3), h.GetBucket()[10].GetCumulativeCount())
+	assert.Equal(t, uint64(4), h.GetBucket()[len(upstreamLatencyBuckets)-1].GetCumulativeCount())
+	assert.InDelta(t, 2, h.GetSampleSum(), 0.1)
+
+	h = histograms[tlsAddr+" tls"]
+	require.NotNil(t, h)
+	assert.Equal(t, uint64(2), h.GetSampleCount())
+	// The exchange longer than the last bucket is only counted in +Inf.
+	assert.Equal(t, uint64(1), h.GetBucket()[len(upstreamLatencyBuckets)-1].GetCumulativeCount())
+
+	h = histograms[upstreamMetricsOther+" "+upstreamMetricsOther]
+	require.NotNil(t, h)
+	assert.Equal(t, uint64(100), h.GetSampleCount())
+
+	counters := func(name string) (vals map[string]float64) {
+		fam := families[name]
+		require.NotNil(t, fam)
+		require.Equal(t, dto.MetricType_COUNTER, fam.GetType())
+		require.Len(t, fam.GetMetric(), 3)
+
+		vals = map[string]float64{}
+		for _, met := range fam.GetMetric() {
+			vals[labelValue(met, "upstream")] = met.GetCounter().GetValue()
+		}
+
+		return vals
+	}
+
+	assert.Equal(t, map[string]float64{
+		udpAddr:              1,
+		tlsAddr:              0,
+		upstreamMetricsOther: 0,
+	}, counters(metricUpstreamTimeouts))
+
+	assert.Equal(t, map[string]float64{
+		udpAddr:              0,
+		tlsAddr:              1,
+		upstreamMetricsOther: 0,
+	}, counters(metricUpstreamTLSFailures))
+
+	// The series of the removed upstreams are dropped and the rest are
+	// kept.
+	m.reset([]string{tlsAddr})
+	series := m.sorted()
+	require.Len(t, series, 2)
+	assert.Equal(t, tlsAddr, series[0].upstream)
+	assert.Equal(t, uint64(1), series[0].tlsFailures)
+}
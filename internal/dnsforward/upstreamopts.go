@@ -0,0 +1,387 @@
+package dnsforward
+
+import (
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+const (
+	// maxUpstreamTimeoutMs is the maximum timeout of a single upstream in
+	// milliseconds.
+	maxUpstreamTimeoutMs = 60 * 1000
+
+	// maxUpstreamRetries is the maximum number of the retries of a failed
+	// exchange with a single upstream.
+	maxUpstreamRetries = 5
+)
+
+// errNoServerCerts is returned when the upstream server hasn't sent any
+// certificates.
+const errNoServerCerts agherr.Error = "no server certificates"
+
+// defaultTLSPorts are the default ports of the encrypted upstreams by their
+// schemes.
+var defaultTLSPorts = map[string]string{
+	"tls":   "853",
+	"https": "443",
+	"quic":  "784",
+}
+
+// UpstreamOptions are the settings of a single upstream overriding the common
+// ones.
+type UpstreamOptions struct {
+	// Address is the address of the upstream as in the upstream lines, for
+	// example "tls://dns.example".
+	Address string `yaml:"address" json:"address"`
+
+	// CAFile is the path to the PEM file with the certificates of the
+	// authorities used instead of the system ones to verify the certificate
+	// of the encrypted upstream.
+	CAFile string `yaml:"ca_file" json:"ca_file"`
+
+	// ServerName is the name sent in the TLS Server Name Indication and
+	// expected in the certificate of the encrypted upstream instead of the
+	// host of Address, which must be an IP address then.
+	ServerName string `yaml:"server_name" json:"server_name"`
+
+	// TimeoutMs is the timeout of a single exchange in milliseconds.  Zero
+	// means the default timeout.
+	TimeoutMs uint32 `yaml:"timeout_ms" json:"timeout_ms"`
+
+	// Retries is the number of the times a failed exchange is retried.
+	Retries uint32 `yaml:"retries" json:"retries"`
+
+	// InsecureSkipVerify disables the verification of the certificate of the
+	// encrypted upstream.
+	InsecureSkipVerify bool `yaml:"insecure_skip_verify" json:"insecure_skip_verify"`
+}
+
+// hasTLSOptions returns true if o has any of the options, which only make
+// sense for the encrypted upstreams.
+func (o *UpstreamOptions) hasTLSOptions() (ok bool) {
+	return o.CAFile != "" || o.ServerName != "" || o.InsecureSkipVerify
+}
+
+// parseURL returns the parsed address of the upstream.  The plain DNS
+// addresses without a scheme have the "udp" one.
+func (o *UpstreamOptions) parseURL() (u *url.URL, err error) {
+	addr := o.Address
+	if !strings.Contains(addr, "://") {
+		addr = "udp://" + addr
+	}
+
+	return url.Parse(addr)
+}
+
+// validate returns an error if o is invalid.
+func (o *UpstreamOptions) validate() (err error) {
+	if o.Address == "" {
+		return agherr.Error("address is empty")
+	}
+
+	u, err := o.parseURL()
+	if err != nil {
+		return fmt.Errorf("address %q: %w", o.Address, err)
+	}
+
+	if o.TimeoutMs > maxUpstreamTimeoutMs {
+		return fmt.Errorf("timeout_ms %d is greater than %d", o.TimeoutMs, maxUpstreamTimeoutMs)
+	}
+
+	if o.Retries > maxUpstreamRetries {
+		return fmt.Errorf("retries %d is greater than %d", o.Retries, maxUpstreamRetries)
+	}
+
+	if !o.hasTLSOptions() {
+		return nil
+	}
+
+	if _, ok := defaultTLSPorts[u.Scheme]; !ok {
+		return fmt.Errorf("address %q: tls options require an encrypted upstream", o.Address)
+	}
+
+	if o.InsecureSkipVerify && o.CAFile != "" {
+		return agherr.Error("ca_file has no effect with insecure_skip_verify")
+	}
+
+	if o.CAFile != "" {
+		_, err = loadCAFile(o.CAFile)
+		if err != nil {
+			return fmt.Errorf("ca_file: %w", err)
+		}
+	}
+
+	if o.ServerName != "" {
+		err = aghnet.ValidateDomainName(o.ServerName)
+		if err != nil {
+			return fmt.Errorf("server_name: %w", err)
+		}
+
+		if net.ParseIP(u.Hostname()) == nil {
+			return fmt.Errorf("address %q: server_name requires an ip address", o.Address)
+		}
+	}
+
+	return nil
+}
+
+// validateUpstreamOptions returns an error if any of opts is invalid or if
+// there are several options for the same address.
+func validateUpstreamOptions(opts []UpstreamOptions) (err error) {
+	seen := map[string]bool{}
+	for i := range opts {
+		o := &opts[i]
+		err = o.validate()
+		if err != nil {
+			return fmt.Errorf("upstream options at index %d: %w", i, err)
+		}
+
+		if seen[o.Address] {
+			return fmt.Errorf("upstream options at index %d: duplicate address %q", i, o.Address)
+		}
+
+		seen[o.Address] = true
+	}
+
+	return nil
+}
+
+// loadCAFile returns the pool of the certificates from the PEM file at path.
+func loadCAFile(path string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates in %q", path)
+	}
+
+	return pool, nil
+}
+
+// newCertVerifier returns the function verifying the certificates of the server
+// with name using the authorities from pool.
+func newCertVerifier(
+	pool *x509.CertPool,
+	name string,
+) (verify func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error)) {
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) (err error) {
+		if len(rawCerts) == 0 {
+			return errNoServerCerts
+		}
+
+		certs := make([]*x509.Certificate, len(rawCerts))
+		for i, raw := range rawCerts {
+			certs[i], err = x509.ParseCertificate(raw)
+			if err != nil {
+				return fmt.Errorf("parsing server certificate: %w", err)
+			}
+		}
+
+		intermediates := x509.NewCertPool()
+		for _, c := range certs[1:] {
+			intermediates.AddCert(c)
+		}
+
+		_, err = certs[0].Verify(x509.VerifyOptions{
+			DNSName:       name,
+			Roots:         pool,
+			Intermediates: intermediates,
+		})
+
+		return err
+	}
+}
+
+// upstreamOptions returns the options for creating the upstream from o and the
+// address to create it with.  common are the options of the other upstreams.
+func (o *UpstreamOptions) upstreamOptions(common upstream.Options) (opts upstream.Options, addr string, err error) {
+	opts, addr = common, o.Address
+	if o.TimeoutMs != 0 {
+		opts.Timeout = time.Duration(o.TimeoutMs) * time.Millisecond
+	}
+
+	if !o.hasTLSOptions() {
+		return opts, addr, nil
+	}
+
+	u, err := o.parseURL()
+	if err != nil {
+		return opts, "", err
+	}
+
+	name := u.Hostname()
+	if o.ServerName != "" {
+		// Connect to the IP address from the address, but use the server
+		// name in the TLS handshake and in the DNS-over-HTTPS requests.
+		port := u.Port()
+		if port == "" {
+			port = defaultTLSPorts[u.Scheme]
+		}
+
+		opts.ServerIPAddrs = []net.IP{net.ParseIP(name)}
+		name = o.ServerName
+		u.Host = net.JoinHostPort(name, port)
+		addr = u.String()
+	}
+
+	if o.InsecureSkipVerify {
+		log.Info("dns: warning: certificate verification is disabled for upstream %s", o.Address)
+
+		opts.InsecureSkipVerify = true
+	} else if o.CAFile != "" {
+		var pool *x509.CertPool
+		pool, err = loadCAFile(o.CAFile)
+		if err != nil {
+			return opts, "", fmt.Errorf("ca_file: %w", err)
+		}
+
+		// Disable the verification against the system authorities, see
+		// newCertVerifier.
+		opts.InsecureSkipVerify = true
+		opts.VerifyServerCertificate = newCertVerifier(pool, name)
+	}
+
+	return opts, addr, nil
+}
+
+// optionsUpstream is an upstream with its own options.
+type optionsUpstream struct {
+	upstream.Upstream
+
+	opts *UpstreamOptions
+}
+
+// type check
+var _ upstream.Upstream = (*optionsUpstream)(nil)
+
+// newOptionsUpstream returns the upstream created from o.  common are the
+// options of the other upstreams.
+func newOptionsUpstream(o *UpstreamOptions, common upstream.Options) (u *optionsUpstream, err error) {
+	opts, addr, err := o.upstreamOptions(common)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", o.Address, err)
+	}
+
+	ups, err := upstream.AddressToUpstream(addr, opts)
+	if err != nil {
+		return nil, fmt.Errorf("upstream %q: %w", o.Address, err)
+	}
+
+	return &optionsUpstream{
+		Upstream: ups,
+		opts:     o,
+	}, nil
+}
+
+// Address implements the upstream.Upstream interface for *optionsUpstream.
+// It's the address as configured, even if the upstream is created with a
+// different one.
+func (u *optionsUpstream) Address() (addr string) {
+	return u.opts.Address
+}
+
+// Exchange implements the upstream.Upstream interface for *optionsUpstream.
+func (u *optionsUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	for i := uint32(0); ; i++ {
+		resp, err = u.Upstream.Exchange(m)
+		if err == nil || i >= u.opts.Retries {
+			return resp, err
+		}
+
+		log.Debug("dns: retrying exchange with %s: %s", u.opts.Address, err)
+	}
+}
+
+// upstreamOptionsByAddr returns opts by the addresses of the upstreams, both
+// as configured and normalized the same way the upstreams do.
+func upstreamOptionsByAddr(opts []UpstreamOptions) (byAddr map[string]*UpstreamOptions) {
+	byAddr = make(map[string]*UpstreamOptions, len(opts))
+	for i := range opts {
+		o := &opts[i]
+		byAddr[o.Address] = o
+		byAddr[normalizeUpstreamAddr(o.Address)] = o
+	}
+
+	return byAddr
+}
+
+// normalizeUpstreamAddr returns the address of the upstream as reported by the
+// upstream created with addr, or addr itself if it's invalid.
+func normalizeUpstreamAddr(addr string) (norm string) {
+	u, err := upstream.AddressToUpstream(addr, upstream.Options{Timeout: DefaultTimeout})
+	if err != nil {
+		return addr
+	}
+
+	return u.Address()
+}
+
+// applyUpstreamOptions replaces the upstreams of uc, which have the options
+// from opts, with the upstreams created with those.  common are the options
+// of the other upstreams.
+func applyUpstreamOptions(
+	uc *proxy.UpstreamConfig,
+	opts []UpstreamOptions,
+	common upstream.Options,
+) (err error) {
+	if len(opts) == 0 {
+		return nil
+	}
+
+	byAddr := upstreamOptionsByAddr(opts)
+	created := map[string]upstream.Upstream{}
+	replace := func(ups []upstream.Upstream) (err error) {
+		for i, u := range ups {
+			addr := u.Address()
+			if cu, ok := created[addr]; ok {
+				ups[i] = cu
+
+				continue
+			}
+
+			o, ok := byAddr[addr]
+			if !ok {
+				continue
+			}
+
+			var ou *optionsUpstream
+			ou, err = newOptionsUpstream(o, common)
+			if err != nil {
+				return err
+			}
+
+			created[addr], ups[i] = ou, ou
+		}
+
+		return nil
+	}
+
+	err = replace(uc.Upstreams)
+	if err != nil {
+		return err
+	}
+
+	for _, ups := range uc.DomainReservedUpstreams {
+		err = replace(ups)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,195 @@
+package dnsforward
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateUpstreamOptions(t *testing.T) {
+	_, certPem, _ := createServerTLSConfig(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, certPem, 0o600))
+
+	// Make the key file exist, but contain no certificates.
+	require.NoError(t, ioutil.WriteFile(caFile+".key", []byte("not a certificate"), 0o600))
+
+	testCases := []struct {
+		name    string
+		wantErr string
+		opts    []UpstreamOptions
+	}{{
+		name:    "valid",
+		wantErr: "",
+		opts: []UpstreamOptions{{
+			Address:   "1.1.1.1",
+			TimeoutMs: 5000,
+			Retries:   2,
+		}, {
+			Address: "tls://dns.example",
+			CAFile:  caFile,
+		}, {
+			Address:    "https://1.2.3.4/dns-query",
+			ServerName: "dns.example",
+		}},
+	}, {
+		name:    "empty_address",
+		wantErr: "upstream options at index 0: address is empty",
+		opts:    []UpstreamOptions{{}},
+	}, {
+		name:    "duplicate",
+		wantErr: `upstream options at index 1: duplicate address "1.1.1.1"`,
+		opts:    []UpstreamOptions{{Address: "1.1.1.1"}, {Address: "1.1.1.1"}},
+	}, {
+		name:    "timeout",
+		wantErr: "upstream options at index 0: timeout_ms 60001 is greater than 60000",
+		opts:    []UpstreamOptions{{Address: "1.1.1.1", TimeoutMs: 60001}},
+	}, {
+		name:    "retries",
+		wantErr: "upstream options at index 0: retries 6 is greater than 5",
+		opts:    []UpstreamOptions{{Address: "1.1.1.1", Retries: 6}},
+	}, {
+		name: "tls_plain",
+		wantErr: `upstream options at index 0: address "1.1.1.1": ` +
+			`tls options require an encrypted upstream`,
+		opts: []UpstreamOptions{{Address: "1.1.1.1", InsecureSkipVerify: true}},
+	}, {
+		name:    "insecure_ca",
+		wantErr: "upstream options at index 0: ca_file has no effect with insecure_skip_verify",
+		opts: []UpstreamOptions{{
+			Address:            "tls://dns.example",
+			CAFile:             caFile,
+			InsecureSkipVerify: true,
+		}},
+	}, {
+		name:    "bad_ca",
+		wantErr: `upstream options at index 0: ca_file: no certificates in "` + caFile + `.key"`,
+		opts: []UpstreamOptions{{
+			Address: "tls://dns.example",
+			CAFile:  caFile + ".key",
+		}},
+	}, {
+		name: "server_name_host",
+		wantErr: `upstream options at index 0: address "tls://dns.example": ` +
+			`server_name requires an ip address`,
+		opts: []UpstreamOptions{{
+			Address:    "tls://dns.example",
+			ServerName: "other.example",
+		}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateUpstreamOptions(tc.opts)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErr, err.Error())
+		})
+	}
+}
+
+func TestNewCertVerifier(t *testing.T) {
+	tlsConf, certPem, _ := createServerTLSConfig(t)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	require.NoError(t, ioutil.WriteFile(caFile, certPem, 0o600))
+
+	pool, err := loadCAFile(caFile)
+	require.NoError(t, err)
+
+	raw := tlsConf.Certificates[0].Certificate
+
+	assert.NoError(t, newCertVerifier(pool, tlsServerName)(raw, nil))
+	assert.Error(t, newCertVerifier(pool, "other.example")(raw, nil))
+	assert.Equal(t, errNoServerCerts, newCertVerifier(pool, tlsServerName)(nil, nil))
+}
+
+// flakyUpstream fails the first fails exchanges.
+type flakyUpstream struct {
+	fails int
+	calls int
+}
+
+// Address implements the upstream.Upstream interface for *flakyUpstream.
+func (u *flakyUpstream) Address() (addr string) {
+	return "flaky"
+}
+
+// Exchange implements the upstream.Upstream interface for *flakyUpstream.
+func (u *flakyUpstream) Exchange(m *dns.Msg) (resp *dns.Msg, err error) {
+	u.calls++
+	if u.calls <= u.fails {
+		return nil, agherr.Error("flaky")
+	}
+
+	return new(dns.Msg).SetReply(m), nil
+}
+
+func TestOptionsUpstream_Exchange(t *testing.T) {
+	req := new(dns.Msg).SetQuestion("example.org.", dns.TypeA)
+
+	t.Run("retried", func(t *testing.T) {
+		fu := &flakyUpstream{fails: 2}
+		u := &optionsUpstream{Upstream: fu, opts: &UpstreamOptions{Retries: 2}}
+
+		resp, err := u.Exchange(req)
+		require.NoError(t, err)
+
+		assert.NotNil(t, resp)
+		assert.Equal(t, 3, fu.calls)
+	})
+
+	t.Run("exhausted", func(t *testing.T) {
+		fu := &flakyUpstream{fails: 3}
+		u := &optionsUpstream{Upstream: fu, opts: &UpstreamOptions{Retries: 1}}
+
+		_, err := u.Exchange(req)
+		assert.Error(t, err)
+		assert.Equal(t, 2, fu.calls)
+	})
+}
+
+func TestApplyUpstreamOptions(t *testing.T) {
+	common := upstream.Options{Timeout: DefaultTimeout}
+	uc, err := proxy.ParseUpstreamsConfig([]string{
+		"1.1.1.1",
+		"tls://1.2.3.4",
+		"[/example.org/]tls://1.2.3.4",
+	}, common)
+	require.NoError(t, err)
+
+	opts := []UpstreamOptions{{
+		Address:    "tls://1.2.3.4",
+		ServerName: "dns.example",
+		Retries:    1,
+	}, {
+		Address: "8.8.8.8",
+	}}
+	require.NoError(t, applyUpstreamOptions(&uc, opts, common))
+
+	require.Len(t, uc.Upstreams, 2)
+	_, ok := uc.Upstreams[0].(*optionsUpstream)
+	assert.False(t, ok)
+
+	ou, ok := uc.Upstreams[1].(*optionsUpstream)
+	require.True(t, ok)
+
+	assert.Equal(t, "tls://1.2.3.4", ou.Address())
+	assert.Equal(t, "tls://dns.example:853", ou.Upstream.Address())
+
+	reserved := uc.DomainReservedUpstreams["example.org."]
+	require.Len(t, reserved, 1)
+
+	assert.Same(t, ou, reserved[0])
+}
@@ -0,0 +1,411 @@
+package dnsforward
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+)
+
+// upstreamTrace is the record of the exchanges with the upstream servers made
+// to resolve a single request.
+type upstreamTrace struct {
+	// mu protects the fields below.  The exchanges may be made
+	// simultaneously, depending on the upstream mode.
+	mu sync.Mutex
+
+	attempts []querylog.UpstreamAttempt
+
+	// start and end are the times of the start of the first exchange and
+	// the time of the end of the last one.
+	start time.Time
+	end   time.Time
+
+	// ttlOverride is the pattern of the TTL override rule applied to the
+	// response, if any.
+	ttlOverride string
+
+	// ede is the Extended DNS Error option from the response, if any.
+	ede dns.EDNS0
+
+	// stripDO tells if the DNSSEC OK bit is removed from the requests sent
+	// to the upstreams.  It's set before the exchanges start.
+	stripDO bool
+
+	// uncacheable are the original response codes of the responses marked
+	// with rcodeUncacheable.
+	uncacheable map[*dns.Msg]int
+
+	// cacheable are the entries of the cache index for the responses which
+	// the proxy could cache by the addresses of the upstreams.  The
+	// responses are modified by the proxy afterwards, so the entries are
+	// made once they're received.
+	cacheable map[string]*cacheIndexEntry
+}
+
+// add records an exchange, which has started at start, with the upstream
+// with the address addr.
+func (t *upstreamTrace) add(addr string, start time.Time, err error) {
+	now := time.Now()
+
+	outcome := querylog.UpstreamOutcomeSuccess
+	if err != nil {
+		outcome = querylog.UpstreamOutcomeError
+
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			outcome = querylog.UpstreamOutcomeTimeout
+		}
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.attempts = append(t.attempts, querylog.UpstreamAttempt{
+		Upstream: addr,
+		Outcome:  outcome,
+		Elapsed:  now.Sub(start),
+	})
+
+	if t.start.IsZero() || start.Before(t.start) {
+		t.start = start
+	}
+
+	if now.After(t.end) {
+		t.end = now
+	}
+}
+
+// result returns the recorded exchanges and the total time spent waiting for
+// the upstream servers.
+func (t *upstreamTrace) result() (attempts []querylog.UpstreamAttempt, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempts = make([]querylog.UpstreamAttempt, len(t.attempts))
+	copy(attempts, t.attempts)
+
+	return attempts, t.end.Sub(t.start)
+}
+
+// setTTLOverride records that the TTL override rule with pattern has been
+// applied to the response.
+func (t *upstreamTrace) setTTLOverride(pattern string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.ttlOverride = pattern
+}
+
+// ttlOverridePattern returns the pattern of the applied TTL override rule, if
+// any.
+func (t *upstreamTrace) ttlOverridePattern() (pattern string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ttlOverride
+}
+
+// setEDE records the Extended DNS Error option from resp, if any.  dnsproxy
+// removes the EDNS(0) options from the responses, so it's the only way to pass
+// it through to the client.
+func (t *upstreamTrace) setEDE(resp *dns.Msg) {
+	opt := resp.IsEdns0()
+	if opt == nil {
+		return
+	}
+
+	for _, o := range opt.Option {
+		if o.Option() == ednsOptionEDE {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+
+			t.ede = o
+
+			return
+		}
+	}
+}
+
+// edeOption returns the Extended DNS Error option from the response, if any.
+func (t *upstreamTrace) edeOption() (o dns.EDNS0) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.ede
+}
+
+// markUncacheable marks resp with rcodeUncacheable, so that it isn't cached,
+// and remembers its original response code.
+func (t *upstreamTrace) markUncacheable(resp *dns.Msg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.uncacheable == nil {
+		t.uncacheable = map[*dns.Msg]int{}
+	}
+
+	t.uncacheable[resp] = resp.Rcode
+	resp.Rcode = rcodeUncacheable
+}
+
+// restoreRcode sets the original response code of resp if it has been marked
+// with rcodeUncacheable.
+func (t *upstreamTrace) restoreRcode(resp *dns.Msg) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if rcode, ok := t.uncacheable[resp]; ok {
+		resp.Rcode = rcode
+	}
+}
+
+// setCacheable records the entry of the cache index for resp to req from the
+// upstream with the address addr, if the proxy could cache it.
+func (t *upstreamTrace) setCacheable(addr string, req, resp *dns.Msg) {
+	e := newCacheIndexEntry(addr, req, resp)
+	if e == nil {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.cacheable == nil {
+		t.cacheable = map[string]*cacheIndexEntry{}
+	}
+
+	t.cacheable[addr] = e
+}
+
+// cacheableEntry returns the entry of the cache index for the response from
+// the upstream with the address addr, if any.
+func (t *upstreamTrace) cacheableEntry(addr string) (e *cacheIndexEntry) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.cacheable[addr]
+}
+
+// upstreamTraces are the traces of the requests being resolved.  The upstreams
+// only receive the DNS message, so the traces are found by it.
+type upstreamTraces struct {
+	// mu protects traces.
+	mu     sync.Mutex
+	traces map[*dns.Msg]*upstreamTrace
+
+	// health, if not nil, tracks the results of all exchanges, including
+	// the ones of the requests which aren't tracked.
+	health *upstreamHealth
+
+	// hijack, if not nil, tells which of the upstreams aren't used since
+	// they're hijacked.
+	hijack *hijackDetector
+
+	// metrics, if not nil, are the metrics of all exchanges.
+	metrics *upstreamMetrics
+
+	// ttls, if not nil, are applied to the responses before they're cached.
+	ttls *ttlOverrides
+
+	// caps, if not nil, prevent the responses exceeding them from being
+	// cached.
+	caps *cacheCaps
+}
+
+// track starts recording the exchanges made for req.  untrack must be called
+// once req is resolved.
+func (ts *upstreamTraces) track(req *dns.Msg) (t *upstreamTrace, untrack func()) {
+	t = &upstreamTrace{}
+
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	if ts.traces == nil {
+		ts.traces = map[*dns.Msg]*upstreamTrace{}
+	}
+
+	ts.traces[req] = t
+
+	return t, func() {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+
+		delete(ts.traces, req)
+	}
+}
+
+// get returns the trace for req, if it's tracked.
+func (ts *upstreamTraces) get(req *dns.Msg) (t *upstreamTrace) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+
+	return ts.traces[req]
+}
+
+// resolve resolves d with p recording the exchanges with the upstreams into t.
+// stripDO tells if the DNSSEC OK bit is removed from the requests sent to the
+// upstreams.  All requests resolved by the server go through it, since the
+// original response codes of the responses marked with rcodeUncacheable are
+// restored here.
+func (s *Server) resolve(p *proxy.Proxy, d *proxy.DNSContext, stripDO bool) (t *upstreamTrace, err error) {
+	t, untrack := s.upstreamTraces.track(d.Req)
+	defer untrack()
+
+	// The proxy sets the DNSSEC OK bit again on the cache misses to cache
+	// the signatures, so it's removed by the upstreams.
+	t.stripDO = stripDO
+	err = p.Resolve(d)
+	t.restoreRcode(d.Res)
+
+	s.indexCached(p, d, t)
+
+	return t, err
+}
+
+// indexCached adds the response to d, which has been resolved by p, to the
+// cache index if p has cached it.  The responses from the cache and the ones
+// resolved with the custom upstreams aren't cached by p.
+func (s *Server) indexCached(p *proxy.Proxy, d *proxy.DNSContext, t *upstreamTrace) {
+	if !p.CacheEnabled || d.CustomUpstreamConfig != nil || d.Upstream == nil {
+		return
+	}
+
+	e := t.cacheableEntry(d.Upstream.Address())
+	if e == nil {
+		return
+	}
+
+	now := time.Now()
+	if expire, ok := e.expiration(now, p.CacheMinTTL, p.CacheMaxTTL); ok {
+		s.cacheIndex.add(e, expire)
+	}
+}
+
+// wrap returns a copy of uc with the upstreams recording their exchanges into
+// ts.  uc itself isn't modified since it may be used elsewhere.
+func (ts *upstreamTraces) wrap(uc *proxy.UpstreamConfig) (wrapped *proxy.UpstreamConfig) {
+	if uc == nil {
+		return nil
+	}
+
+	wrapped = &proxy.UpstreamConfig{
+		Upstreams: ts.wrapUpstreams(uc.Upstreams),
+	}
+
+	if uc.DomainReservedUpstreams != nil {
+		wrapped.DomainReservedUpstreams = make(map[string][]upstream.Upstream, len(uc.DomainReservedUpstreams))
+		for domain, ups := range uc.DomainReservedUpstreams {
+			wrapped.DomainReservedUpstreams[domain] = ts.wrapUpstreams(ups)
+		}
+	}
+
+	return wrapped
+}
+
+// wrapUpstreams returns a copy of ups with each upstream recording its
+// exchanges into ts.  The nil and empty slices, which have special meaning in
+// the upstream configuration, are returned as is.
+func (ts *upstreamTraces) wrapUpstreams(ups []upstream.Upstream) (wrapped []upstream.Upstream) {
+	if len(ups) == 0 {
+		return ups
+	}
+
+	wrapped = make([]upstream.Upstream, len(ups))
+	for i, u := range ups {
+		if tu, ok := u.(*tracedUpstream); ok {
+			u = tu.Upstream
+		}
+
+		wrapped[i] = &tracedUpstream{
+			Upstream: u,
+			traces:   ts,
+		}
+	}
+
+	return wrapped
+}
+
+// tracedUpstream is an upstream which records its exchanges into traces.
+type tracedUpstream struct {
+	upstream.Upstream
+
+	traces *upstreamTraces
+}
+
+// type check
+var _ upstream.Upstream = (*tracedUpstream)(nil)
+
+// Exchange implements the upstream.Upstream interface for *tracedUpstream.
+func (u *tracedUpstream) Exchange(req *dns.Msg) (resp *dns.Msg, err error) {
+	if h := u.traces.hijack; h != nil && h.disabled(u.Address()) {
+		return nil, fmt.Errorf("%s: %w", u.Address(), errUpstreamHijacked)
+	}
+
+	t := u.traces.get(req)
+
+	sent := req
+	if t != nil && t.stripDO {
+		sent = withoutDO(req)
+	}
+
+	start := time.Now()
+	resp, err = u.Upstream.Exchange(sent)
+	elapsed := time.Since(start)
+
+	var r *TTLOverride
+	if ttls := u.traces.ttls; ttls != nil && err == nil {
+		r = ttls.apply(req, resp)
+	}
+
+	if t != nil {
+		t.add(u.Address(), start, err)
+
+		// Only mark the responses of the tracked requests, since the
+		// mark is removed using the trace.
+		caps := u.traces.caps
+		if caps != nil && err == nil && resp != nil && caps.exceeds(u.Address(), req, resp) {
+			t.markUncacheable(resp)
+		}
+		if r != nil {
+			t.setTTLOverride(r.Pattern)
+		}
+
+		if err == nil && resp != nil {
+			t.setEDE(resp)
+
+			// The marked responses aren't cacheable.
+			t.setCacheable(u.Address(), req, resp)
+		}
+	}
+
+	if h := u.traces.health; h != nil {
+		h.exchanged(u.Address(), err, time.Now())
+	}
+
+	if m := u.traces.metrics; m != nil {
+		m.exchanged(u.Address(), elapsed, err)
+	}
+
+	return resp, err
+}
+
+// withoutDO returns req with the DNSSEC OK bit cleared.  req itself isn't
+// modified, since it may be sent to several upstreams at once.
+func withoutDO(req *dns.Msg) (stripped *dns.Msg) {
+	opt := req.IsEdns0()
+	if opt == nil || !opt.Do() {
+		return req
+	}
+
+	stripped = req.Copy()
+	stripped.IsEdns0().SetDo(false)
+
+	return stripped
+}
@@ -0,0 +1,79 @@
+package dnsforward
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/dnsproxy/proxy"
+	"github.com/AdguardTeam/dnsproxy/upstream"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// timeoutError is a net.Error which is always a timeout.
+type timeoutError struct{}
+
+// Error implements the error interface for timeoutError.
+func (timeoutError) Error() (msg string) { return "i/o timeout" }
+
+// Timeout implements the net.Error interface for timeoutError.
+func (timeoutError) Timeout() (ok bool) { return true }
+
+// Temporary implements the net.Error interface for timeoutError.
+func (timeoutError) Temporary() (ok bool) { return true }
+
+// type check
+var _ net.Error = timeoutError{}
+
+func TestUpstreamTraces(t *testing.T) {
+	ts := &upstreamTraces{}
+
+	ok := &aghtest.TestUpstream{Addr: "ok"}
+	uc := ts.wrap(&proxy.UpstreamConfig{
+		Upstreams: []upstream.Upstream{
+			&aghtest.TestErrUpstream{Err: timeoutError{}},
+			&aghtest.TestErrUpstream{Err: assert.AnError},
+			ok,
+		},
+		DomainReservedUpstreams: map[string][]upstream.Upstream{
+			"example.org.": nil,
+		},
+	})
+	require.Len(t, uc.Upstreams, 3)
+
+	// The special values must be kept as is.
+	ups, has := uc.DomainReservedUpstreams["example.org."]
+	require.True(t, has)
+	assert.Nil(t, ups)
+
+	// Wrapping twice mustn't record the exchanges twice.
+	uc = ts.wrap(uc)
+
+	req := (&dns.Msg{}).SetQuestion("example.com.", dns.TypeA)
+	trace, untrack := ts.track(req)
+	for _, u := range uc.Upstreams {
+		_, _ = u.Exchange(req)
+	}
+	untrack()
+
+	// The exchanges made after untracking aren't recorded.
+	_, err := uc.Upstreams[2].Exchange(req)
+	require.NoError(t, err)
+
+	attempts, elapsed := trace.result()
+	require.Len(t, attempts, 3)
+
+	assert.Equal(t, querylog.UpstreamOutcomeTimeout, attempts[0].Outcome)
+	assert.Equal(t, querylog.UpstreamOutcomeError, attempts[1].Outcome)
+	assert.Equal(t, querylog.UpstreamOutcomeSuccess, attempts[2].Outcome)
+	assert.Equal(t, ok.Addr, attempts[2].Upstream)
+
+	var sum int64
+	for _, a := range attempts {
+		sum += int64(a.Elapsed)
+	}
+	assert.GreaterOrEqual(t, int64(elapsed), sum)
+}
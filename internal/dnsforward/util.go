@@ -15,10 +15,24 @@ func IPFromAddr(addr net.Addr) (ip net.IP) {
 		return addr.IP
 	case *net.TCPAddr:
 		return addr.IP
+	case *unixPeerAddr:
+		return unixPeerIP
 	}
 	return nil
 }
 
+// portFromAddr returns the port of addr or zero if addr has none.
+func portFromAddr(addr net.Addr) (port uint16) {
+	switch addr := addr.(type) {
+	case *net.UDPAddr:
+		return uint16(addr.Port)
+	case *net.TCPAddr:
+		return uint16(addr.Port)
+	}
+
+	return 0
+}
+
 // IPStringFromAddr extracts IP address from net.Addr.
 // Note: we can't use net.SplitHostPort(a.String()) because of IPv6 zone:
 // https://github.com/AdguardTeam/AdGuardHome/internal/issues/1261
@@ -0,0 +1,231 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// apiLatencyBuckets are the upper bounds of the latency histogram buckets of
+// the HTTP API in milliseconds.  The last bucket, which isn't listed here,
+// contains the rest.
+var apiLatencyBuckets = [...]float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000, 10000}
+
+// routeStats are the statistics of the requests to a single route of the HTTP
+// API.  All fields are accessed atomically, so that the collection is cheap
+// enough to be always enabled.
+type routeStats struct {
+	// buckets is the latency histogram, see apiLatencyBuckets.
+	buckets [len(apiLatencyBuckets) + 1]uint64
+
+	// count is the total number of the requests.
+	count uint64
+
+	// clientErrors and serverErrors are the numbers of the responses with
+	// the 4xx and the 5xx status codes.
+	clientErrors uint64
+	serverErrors uint64
+
+	// totalNs is the total duration of the requests in nanoseconds.
+	totalNs uint64
+}
+
+// record records a request, which has been responded to with code in elapsed.
+func (s *routeStats) record(code int, elapsed time.Duration) {
+	ms := float64(elapsed) / float64(time.Millisecond)
+	i := sort.SearchFloat64s(apiLatencyBuckets[:], ms)
+
+	atomic.AddUint64(&s.buckets[i], 1)
+	atomic.AddUint64(&s.count, 1)
+	atomic.AddUint64(&s.totalNs, uint64(elapsed))
+
+	switch {
+	case code >= 500:
+		atomic.AddUint64(&s.serverErrors, 1)
+	case code >= 400:
+		atomic.AddUint64(&s.clientErrors, 1)
+	}
+}
+
+// statusRecorder is an http.ResponseWriter which remembers the status code of
+// the response.
+type statusRecorder struct {
+	http.ResponseWriter
+
+	code int
+}
+
+// WriteHeader implements the http.ResponseWriter interface for
+// *statusRecorder.
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.code == 0 {
+		r.code = code
+	}
+
+	r.ResponseWriter.WriteHeader(code)
+}
+
+// Write implements the http.ResponseWriter interface for *statusRecorder.
+func (r *statusRecorder) Write(b []byte) (n int, err error) {
+	if r.code == 0 {
+		r.code = http.StatusOK
+	}
+
+	return r.ResponseWriter.Write(b)
+}
+
+// Flush implements the http.Flusher interface for *statusRecorder, since some
+// handlers flush the response before doing the lengthy work.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// status returns the status code of the response.
+func (r *statusRecorder) status() (code int) {
+	if r.code == 0 {
+		return http.StatusOK
+	}
+
+	return r.code
+}
+
+// latencyBucketJSON is a bucket of the latency histogram in the HTTP API.
+type latencyBucketJSON struct {
+	// LeMs is the upper bound of the bucket in milliseconds.  It's nil for
+	// the last bucket, which has no upper bound.
+	LeMs *float64 `json:"le_ms"`
+
+	Count uint64 `json:"count"`
+}
+
+// routeStatsJSON are the statistics of a single route in the HTTP API.
+type routeStatsJSON struct {
+	Method string `json:"method"`
+	Path   string `json:"path"`
+
+	Buckets []latencyBucketJSON `json:"buckets"`
+
+	// The percentiles are the upper bounds of the histogram buckets
+	// containing them in milliseconds.  For the last bucket, the largest
+	// bound is used.
+	P50Ms float64 `json:"p50_ms"`
+	P95Ms float64 `json:"p95_ms"`
+	P99Ms float64 `json:"p99_ms"`
+
+	MeanMs float64 `json:"mean_ms"`
+
+	// ErrorRate is the share of the responses with the 5xx status codes.
+	ErrorRate float64 `json:"error_rate"`
+
+	Count        uint64 `json:"count"`
+	ClientErrors uint64 `json:"client_errors"`
+	ServerErrors uint64 `json:"server_errors"`
+}
+
+// histogramQuantile returns the upper bound of the bucket of counts, which
+// contains the q-th quantile of total values.
+func histogramQuantile(counts []uint64, total uint64, q float64) (ms float64) {
+	if total == 0 {
+		return 0
+	}
+
+	rank := uint64(q * float64(total))
+	if rank == 0 {
+		rank = 1
+	}
+
+	var sum uint64
+	for i, c := range counts {
+		sum += c
+		if sum >= rank && i < len(apiLatencyBuckets) {
+			return apiLatencyBuckets[i]
+		}
+	}
+
+	return apiLatencyBuckets[len(apiLatencyBuckets)-1]
+}
+
+// toJSON returns a snapshot of s in the HTTP API format.  The counters are
+// read one by one, so they may be slightly inconsistent with each other.
+func (s *routeStats) toJSON(method, path string) (j *routeStatsJSON) {
+	j = &routeStatsJSON{
+		Method:       method,
+		Path:         path,
+		Buckets:      make([]latencyBucketJSON, len(s.buckets)),
+		Count:        atomic.LoadUint64(&s.count),
+		ClientErrors: atomic.LoadUint64(&s.clientErrors),
+		ServerErrors: atomic.LoadUint64(&s.serverErrors),
+	}
+
+	counts := make([]uint64, len(s.buckets))
+	var total uint64
+	for i := range s.buckets {
+		counts[i] = atomic.LoadUint64(&s.buckets[i])
+		total += counts[i]
+
+		j.Buckets[i].Count = counts[i]
+		if i < len(apiLatencyBuckets) {
+			j.Buckets[i].LeMs = &apiLatencyBuckets[i]
+		}
+	}
+
+	j.P50Ms = histogramQuantile(counts, total, 0.5)
+	j.P95Ms = histogramQuantile(counts, total, 0.95)
+	j.P99Ms = histogramQuantile(counts, total, 0.99)
+
+	if j.Count > 0 {
+		totalMs := float64(atomic.LoadUint64(&s.totalNs)) / float64(time.Millisecond)
+		j.MeanMs = totalMs / float64(j.Count)
+		j.ErrorRate = float64(j.ServerErrors) / float64(j.Count)
+	}
+
+	return j
+}
+
+// apiStatsJSON is the response to the GET /control/debug/api_stats request.
+type apiStatsJSON struct {
+	// Routes are the statistics of the routes sorted by the path and the
+	// method.
+	Routes []*routeStatsJSON `json:"routes"`
+
+	// ActiveSessions is the number of the unexpired sessions of the web
+	// interface.
+	ActiveSessions int `json:"active_sessions"`
+}
+
+// handleDebugAPIStats is the handler for the GET /control/debug/api_stats
+// HTTP API.
+func handleDebugAPIStats(w http.ResponseWriter, _ *http.Request) {
+	resp := apiStatsJSON{
+		Routes: []*routeStatsJSON{},
+	}
+
+	for path, hs := range Context.apiHandlers {
+		for method, route := range hs {
+			resp.Routes = append(resp.Routes, route.stats.toJSON(method, path))
+		}
+	}
+
+	sort.Slice(resp.Routes, func(i, j int) bool {
+		ri, rj := resp.Routes[i], resp.Routes[j]
+		if ri.Path != rj.Path {
+			return ri.Path < rj.Path
+		}
+
+		return ri.Method < rj.Method
+	})
+
+	if Context.auth != nil {
+		resp.ActiveSessions = Context.auth.ActiveSessions()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
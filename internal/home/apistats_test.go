@@ -0,0 +1,80 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRouteStats(t *testing.T) {
+	s := &routeStats{}
+	for i := 0; i < 90; i++ {
+		s.record(http.StatusOK, 3*time.Millisecond)
+	}
+
+	for i := 0; i < 8; i++ {
+		s.record(http.StatusBadRequest, 40*time.Millisecond)
+	}
+
+	s.record(http.StatusInternalServerError, time.Second)
+	s.record(http.StatusOK, time.Minute)
+
+	j := s.toJSON(http.MethodGet, "/control/status")
+	assert.Equal(t, "/control/status", j.Path)
+	assert.EqualValues(t, 100, j.Count)
+	assert.EqualValues(t, 8, j.ClientErrors)
+	assert.EqualValues(t, 1, j.ServerErrors)
+	assert.Equal(t, 0.01, j.ErrorRate)
+
+	assert.Equal(t, 5.0, j.P50Ms)
+	assert.Equal(t, 50.0, j.P95Ms)
+	assert.Equal(t, 1000.0, j.P99Ms)
+
+	require.Len(t, j.Buckets, len(apiLatencyBuckets)+1)
+	assert.EqualValues(t, 90, j.Buckets[1].Count)
+	assert.EqualValues(t, 1, j.Buckets[8].Count)
+
+	last := j.Buckets[len(j.Buckets)-1]
+	assert.Nil(t, last.LeMs)
+	assert.EqualValues(t, 1, last.Count)
+
+	assert.Zero(t, (&routeStats{}).toJSON(http.MethodGet, "/").P50Ms)
+}
+
+func TestStatusRecorder(t *testing.T) {
+	testCases := []struct {
+		handler  http.HandlerFunc
+		name     string
+		wantCode int
+	}{{
+		handler:  func(w http.ResponseWriter, _ *http.Request) {},
+		name:     "empty",
+		wantCode: http.StatusOK,
+	}, {
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			_, _ = w.Write([]byte("ok"))
+			w.WriteHeader(http.StatusInternalServerError)
+		},
+		name:     "write",
+		wantCode: http.StatusOK,
+	}, {
+		handler: func(w http.ResponseWriter, _ *http.Request) {
+			http.Error(w, "bad", http.StatusBadRequest)
+		},
+		name:     "error",
+		wantCode: http.StatusBadRequest,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &statusRecorder{ResponseWriter: httptest.NewRecorder()}
+			tc.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+			assert.Equal(t, tc.wantCode, rec.status())
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package home
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The prefixes of the paths of the versions of the control HTTP API.  The
+// paths without a version are the same as the ones of the v1 API.
+const (
+	apiV1Prefix = "/control/v1/"
+	apiV2Prefix = "/control/v2/"
+)
+
+// unversionedAPIPath returns the path p of the v1 API without the version.
+// Other paths are returned as is.
+func unversionedAPIPath(p string) (unversioned string) {
+	if strings.HasPrefix(p, apiV1Prefix) {
+		return "/control/" + strings.TrimPrefix(p, apiV1Prefix)
+	}
+
+	return p
+}
+
+// handleAPIV1 serves the v1 API.  The v1 API is the frozen behavior of the
+// unversioned endpoints, so the requests are served by those with the version
+// removed from the path.  The responses of the endpoints, which have a v2
+// successor, are marked as deprecated.
+func handleAPIV1(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, apiV1Prefix)
+	if rest == "" || strings.HasPrefix(rest, "v1/") || strings.HasPrefix(rest, "v2/") {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	successor := apiV2Prefix + rest
+	if hs, ok := Context.apiHandlers[successor]; ok && hs[r.Method] != nil {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", successor))
+	}
+
+	unversioned := r.Clone(r.Context())
+	unversioned.URL.Path, unversioned.URL.RawPath = "/control/"+rest, ""
+
+	Context.mux.ServeHTTP(w, unversioned)
+}
@@ -0,0 +1,112 @@
+package home
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandleAPIV1(t *testing.T) {
+	pathHandler := func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(r.URL.Path))
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/stats", pathHandler)
+	mux.HandleFunc("/control/status", pathHandler)
+	mux.HandleFunc("/control/v2/stats", pathHandler)
+	mux.HandleFunc(apiV1Prefix, handleAPIV1)
+
+	Context = homeContext{
+		mux: mux,
+		apiHandlers: map[string]methodHandlers{
+			"/control/stats":    {http.MethodGet: &apiRoute{}},
+			"/control/status":   {http.MethodGet: &apiRoute{}},
+			"/control/v2/stats": {http.MethodGet: &apiRoute{}},
+		},
+	}
+	t.Cleanup(func() {
+		Context = homeContext{}
+	})
+
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		wantBody       string
+		wantLink       string
+		wantCode       int
+		wantDeprecated bool
+	}{{
+		name:           "successor",
+		method:         http.MethodGet,
+		path:           "/control/v1/stats",
+		wantBody:       "/control/stats",
+		wantLink:       `</control/v2/stats>; rel="successor-version"`,
+		wantCode:       http.StatusOK,
+		wantDeprecated: true,
+	}, {
+		name:           "successor_other_method",
+		method:         http.MethodPost,
+		path:           "/control/v1/stats",
+		wantBody:       "/control/stats",
+		wantLink:       "",
+		wantCode:       http.StatusOK,
+		wantDeprecated: false,
+	}, {
+		name:           "no_successor",
+		method:         http.MethodGet,
+		path:           "/control/v1/status",
+		wantBody:       "/control/status",
+		wantLink:       "",
+		wantCode:       http.StatusOK,
+		wantDeprecated: false,
+	}, {
+		name:           "nested_v1",
+		method:         http.MethodGet,
+		path:           "/control/v1/v1/stats",
+		wantBody:       "404 page not found\n",
+		wantLink:       "",
+		wantCode:       http.StatusNotFound,
+		wantDeprecated: false,
+	}, {
+		name:           "nested_v2",
+		method:         http.MethodGet,
+		path:           "/control/v1/v2/stats",
+		wantBody:       "404 page not found\n",
+		wantLink:       "",
+		wantCode:       http.StatusNotFound,
+		wantDeprecated: false,
+	}, {
+		name:           "empty",
+		method:         http.MethodGet,
+		path:           "/control/v1/",
+		wantBody:       "404 page not found\n",
+		wantLink:       "",
+		wantCode:       http.StatusNotFound,
+		wantDeprecated: false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(tc.method, tc.path, nil)
+			w := httptest.NewRecorder()
+
+			mux.ServeHTTP(w, r)
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+			assert.Equal(t, tc.wantLink, w.Header().Get("Link"))
+			assert.Equal(t, tc.wantDeprecated, w.Header().Get("Deprecation") == "true")
+			assert.Equal(t, tc.path, r.URL.Path)
+		})
+	}
+}
+
+func TestUnversionedAPIPath(t *testing.T) {
+	assert.Equal(t, "/control/stats", unversionedAPIPath("/control/v1/stats"))
+	assert.Equal(t, "/control/stats", unversionedAPIPath("/control/stats"))
+	assert.Equal(t, "/control/v2/stats", unversionedAPIPath("/control/v2/stats"))
+}
@@ -64,6 +64,7 @@ type Auth struct {
 	db         *bbolt.DB
 	sessions   map[string]*session
 	users      []User
+	apiTokens  []APIToken
 	lock       sync.Mutex
 	sessionTTL uint32
 }
@@ -72,6 +73,10 @@ type Auth struct {
 type User struct {
 	Name         string `yaml:"name"`
 	PasswordHash string `yaml:"password"` // bcrypt hash
+
+	// Role is the role of the user.  If empty, the user is an
+	// administrator.
+	Role Role `yaml:"role,omitempty"`
 }
 
 // InitAuth - create a global object
@@ -103,6 +108,22 @@ func (a *Auth) Close() {
 	_ = a.db.Close()
 }
 
+// reopen returns a new Auth with the users and the API tokens of a, which is
+// expected to be closed, and the database from dbFilename.  na is nil if the
+// database can't be opened.
+func (a *Auth) reopen(dbFilename string) (na *Auth) {
+	a.lock.Lock()
+	users, tokens := a.users, a.apiTokens
+	a.lock.Unlock()
+
+	na = InitAuth(dbFilename, users, a.sessionTTL)
+	if na != nil {
+		na.SetAPITokens(tokens)
+	}
+
+	return na
+}
+
 func bucketName() []byte {
 	return []byte("sessions-2")
 }
@@ -291,6 +312,22 @@ func (a *Auth) checkSession(sess string) (res checkSessionResult) {
 	return checkSessionOK
 }
 
+// ActiveSessions returns the number of the unexpired sessions.
+func (a *Auth) ActiveSessions() (n int) {
+	now := uint32(time.Now().UTC().Unix())
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, s := range a.sessions {
+		if s.expire > now {
+			n++
+		}
+	}
+
+	return n
+}
+
 // RemoveSession - remove session
 func (a *Auth) RemoveSession(sess string) {
 	key, _ := hex.DecodeString(sess)
@@ -478,8 +515,9 @@ func parseCookie(cookie string) string {
 	return ""
 }
 
-// optionalAuthThird return true if user should authenticate first.
-func optionalAuthThird(w http.ResponseWriter, r *http.Request) (authFirst bool) {
+// optionalAuthThird return true if user should authenticate first.  p is the
+// authenticated principal otherwise.
+func optionalAuthThird(w http.ResponseWriter, r *http.Request) (p principal, authFirst bool) {
 	authFirst = false
 
 	// redirect to login page if not authenticated
@@ -489,11 +527,20 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (authFirst bool)
 	if glProcessCookie(r) {
 		log.Debug("auth: authentification was handled by GL-Inet submodule")
 		ok = true
+		p = principal{kind: "glinet", role: RoleAdmin}
+	} else if checkCLIToken(r) {
+		ok = true
+		p = principal{kind: "cli", role: RoleAdmin}
+	} else if t, isToken := Context.auth.findAPIToken(r); isToken {
+		ok = true
+		p = principal{kind: "token", name: t.Name, role: t.Role}
 	} else if err == nil {
-		r := Context.auth.checkSession(cookie.Value)
-		if r == checkSessionOK {
-			ok = true
-		} else if r < 0 {
+		res := Context.auth.checkSession(cookie.Value)
+		if res == checkSessionOK {
+			u := Context.auth.getCurrentUser(r)
+			ok = u.Name != ""
+			p = principal{kind: "user", name: u.Name, role: userRole(u)}
+		} else if res < 0 {
 			log.Debug("auth: invalid cookie value: %s", cookie)
 		}
 	} else {
@@ -503,6 +550,7 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (authFirst bool)
 			u := Context.auth.UserFind(user, pass)
 			if len(u.Name) != 0 {
 				ok = true
+				p = principal{kind: "user", name: u.Name, role: userRole(u)}
 			} else {
 				log.Info("auth: invalid Basic Authorization value")
 			}
@@ -523,7 +571,7 @@ func optionalAuthThird(w http.ResponseWriter, r *http.Request) (authFirst bool)
 		authFirst = true
 	}
 
-	return authFirst
+	return p, authFirst
 }
 
 func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.ResponseWriter, *http.Request) {
@@ -549,9 +597,12 @@ func optionalAuth(handler func(http.ResponseWriter, *http.Request)) func(http.Re
 			// process as usual
 			// no additional auth requirements
 		} else if Context.auth != nil && Context.auth.AuthRequired() {
-			if optionalAuthThird(w, r) {
+			p, authFirst := optionalAuthThird(w, r)
+			if authFirst {
 				return
 			}
+
+			r = withPrincipal(r, p)
 		}
 
 		handler(w, r)
@@ -634,6 +685,14 @@ func (a *Auth) getCurrentUser(r *http.Request) User {
 	return User{}
 }
 
+// SetAPITokens sets the bearer tokens for the HTTP API.
+func (a *Auth) SetAPITokens(tokens []APIToken) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.apiTokens = tokens
+}
+
 // GetUsers - get users
 func (a *Auth) GetUsers() []User {
 	a.lock.Lock()
@@ -0,0 +1,610 @@
+package home
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Exit codes of the command-line client.
+const (
+	cliExitError       = 1
+	cliExitUnreachable = 2
+	cliExitUsage       = 64
+)
+
+// Errors of the command-line client.
+const (
+	// errUnreachable is returned when there is no running instance of
+	// AdGuard Home to query.
+	errUnreachable agherr.Error = "adguard home is unreachable"
+
+	// errCLIUsage is returned when the arguments are invalid.
+	errCLIUsage agherr.Error = "invalid arguments"
+)
+
+// cliCommand is a command of the command-line client which queries a running
+// instance of AdGuard Home.  The output is written to w.
+type cliCommand func(w io.Writer, args []string) (err error)
+
+// cliCommands are the available commands of the command-line client by their
+// names.
+var cliCommands = map[string]cliCommand{
+	"doctor":   cmdDoctor,
+	"stats":    cmdStats,
+	"querylog": cmdQueryLog,
+	"secrets":  cmdSecrets,
+	"config":   cmdConfig,
+}
+
+// runCLICommand runs cmd with args and returns the exit code.
+func runCLICommand(w io.Writer, name string, cmd cliCommand, args []string) (code int) {
+	err := cmd(w, args)
+	switch {
+	case err == nil, errors.Is(err, flag.ErrHelp):
+		return 0
+	case errors.Is(err, errCLIUsage):
+		code = cliExitUsage
+	case errors.Is(err, errUnreachable):
+		code = cliExitUnreachable
+	default:
+		code = cliExitError
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "%s: %s\n", name, err)
+
+	return code
+}
+
+// cliFlags are the flags common to all commands of the command-line client.
+type cliFlags struct {
+	confPath string
+	workDir  string
+	json     bool
+}
+
+// newCLIFlagSet returns a new flag set for the command with name with the
+// common flags stored into cf.
+func newCLIFlagSet(name string, cf *cliFlags) (fs *flag.FlagSet) {
+	fs = flag.NewFlagSet(name, flag.ContinueOnError)
+	for _, n := range []string{"config", "c"} {
+		fs.StringVar(&cf.confPath, n, "", "Path to the config file.")
+	}
+
+	for _, n := range []string{"work-dir", "w"} {
+		fs.StringVar(&cf.workDir, n, "", "Path to the working directory.")
+	}
+
+	fs.BoolVar(&cf.json, "json", false, "Print JSON instead of tables.")
+
+	return fs
+}
+
+// parseCLIFlags parses args using fs.
+func parseCLIFlags(fs *flag.FlagSet, args []string) (err error) {
+	err = fs.Parse(args)
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("%w: %s", errCLIUsage, err)
+	} else if fs.NArg() > 0 {
+		return fmt.Errorf("%w: unexpected argument %q", errCLIUsage, fs.Arg(0))
+	}
+
+	return nil
+}
+
+// cliTimeout is the timeout of the non-streaming requests of the command-line
+// client.
+const cliTimeout = 30 * time.Second
+
+// cliClient is the client of the HTTP API of a running instance of AdGuard
+// Home.
+type cliClient struct {
+	// baseURL is the URL of the HTTP API without the path.
+	baseURL *url.URL
+
+	// hc is used for the ordinary requests.
+	hc *http.Client
+
+	// stream is used for the streaming requests, so it has no timeout.
+	stream *http.Client
+
+	// token is the token from cliTokenFile.
+	token string
+}
+
+// newCLIClient returns a client for the instance of AdGuard Home using the
+// configuration file and the working directory from cf.
+func newCLIClient(cf *cliFlags) (c *cliClient, err error) {
+	opts := options{
+		configFilename: cf.confPath,
+		workDir:        cf.workDir,
+	}
+	initConfigFilename(opts)
+	initWorkingDir(opts)
+
+	data, err := ioutil.ReadFile(config.getConfigFilename())
+	if err != nil {
+		return nil, fmt.Errorf("reading config: %w", err)
+	}
+
+	conf := struct {
+		BindHost net.IP `yaml:"bind_host"`
+		BindPort int    `yaml:"bind_port"`
+	}{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("parsing config: %w", err)
+	}
+
+	token, err := ioutil.ReadFile(filepath.Join(Context.getDataDir(), cliTokenFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: no %s, it's created at startup", errUnreachable, cliTokenFile)
+	} else if err != nil {
+		return nil, fmt.Errorf("reading token: %w", err)
+	}
+
+	host := conf.BindHost
+	if host == nil || host.IsUnspecified() {
+		if host != nil && host.To4() == nil {
+			host = net.IPv6loopback
+		} else {
+			host = net.IP{127, 0, 0, 1}
+		}
+	}
+
+	return &cliClient{
+		baseURL: &url.URL{
+			Scheme: schemeHTTP,
+			Host:   net.JoinHostPort(host.String(), strconv.Itoa(conf.BindPort)),
+		},
+		hc: &http.Client{
+			Timeout: cliTimeout,
+		},
+		stream: &http.Client{},
+		token:  strings.TrimSpace(string(token)),
+	}, nil
+}
+
+// get sends a GET request to the HTTP API at path with q using hc.  The caller
+// must close body.
+func (c *cliClient) get(hc *http.Client, path string, q url.Values) (body io.ReadCloser, err error) {
+	u := *c.baseURL
+	u.Path = path
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	// Make sure that the streamed entries aren't held back by the
+	// compression.
+	req.Header.Set("Accept-Encoding", "identity")
+
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", errUnreachable, err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		defer func() { _ = resp.Body.Close() }()
+
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return nil, fmt.Errorf("%s %s: %s: %s", http.MethodGet, path, resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	return resp.Body, nil
+}
+
+// getData is like get but reads the whole response.
+func (c *cliClient) getData(path string, q url.Values) (data []byte, err error) {
+	body, err := c.get(c.hc, path, q)
+	if err != nil {
+		return nil, err
+	}
+	defer func() { _ = body.Close() }()
+
+	return ioutil.ReadAll(body)
+}
+
+// cliStats is the part of the GET /control/stats response printed by the
+// command-line client.
+type cliStats struct {
+	TimeUnits string `json:"time_units"`
+
+	NumDNSQueries           uint64 `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+
+	AvgProcessingTime float64 `json:"avg_processing_time"`
+	AvgUpstreamTime   float64 `json:"avg_upstream_time"`
+
+	TopQueried []map[string]uint64 `json:"top_queried_domains"`
+	TopClients []map[string]uint64 `json:"top_clients"`
+	TopBlocked []map[string]uint64 `json:"top_blocked_domains"`
+
+	ClientNames map[string]string `json:"client_names"`
+
+	DNSQueries []uint64 `json:"dns_queries"`
+}
+
+// printStats writes st to w as tables.
+func printStats(w io.Writer, st *cliStats) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	units := "days"
+	if st.TimeUnits == "hours" {
+		units = "hours"
+	}
+
+	_, _ = fmt.Fprintf(tw, "Period:\t%d %s\n", len(st.DNSQueries), units)
+	_, _ = fmt.Fprintf(tw, "DNS queries:\t%d\n", st.NumDNSQueries)
+	_, _ = fmt.Fprintf(tw, "Blocked by filters:\t%d\n", st.NumBlockedFiltering)
+	_, _ = fmt.Fprintf(tw, "Blocked malware/phishing:\t%d\n", st.NumReplacedSafebrowsing)
+	_, _ = fmt.Fprintf(tw, "Blocked adult websites:\t%d\n", st.NumReplacedParental)
+	_, _ = fmt.Fprintf(tw, "Enforced safe search:\t%d\n", st.NumReplacedSafesearch)
+	_, _ = fmt.Fprintf(tw, "Average processing time:\t%.3f ms\n", st.AvgProcessingTime*1000)
+	_, _ = fmt.Fprintf(tw, "Average upstream time:\t%.3f ms\n", st.AvgUpstreamTime*1000)
+
+	tops := []struct {
+		names map[string]string
+		title string
+		items []map[string]uint64
+	}{{
+		title: "TOP QUERIED DOMAINS",
+		items: st.TopQueried,
+	}, {
+		title: "TOP BLOCKED DOMAINS",
+		items: st.TopBlocked,
+	}, {
+		names: st.ClientNames,
+		title: "TOP CLIENTS",
+		items: st.TopClients,
+	}}
+
+	for _, top := range tops {
+		_, _ = fmt.Fprintf(tw, "\n%s\tQUERIES\n", top.title)
+		for _, item := range top.items {
+			for id, n := range item {
+				if name := top.names[id]; name != "" {
+					id = fmt.Sprintf("%s (%s)", name, id)
+				}
+
+				_, _ = fmt.Fprintf(tw, "%s\t%d\n", id, n)
+			}
+		}
+	}
+
+	return tw.Flush()
+}
+
+// cmdStats is the command printing the statistics.
+func cmdStats(w io.Writer, args []string) (err error) {
+	cf := &cliFlags{}
+	fs := newCLIFlagSet("stats", cf)
+	err = parseCLIFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	c, err := newCLIClient(cf)
+	if err != nil {
+		return err
+	}
+
+	return c.stats(w, cf.json)
+}
+
+// stats writes the statistics to w.
+func (c *cliClient) stats(w io.Writer, asJSON bool) (err error) {
+	data, err := c.getData("/control/stats", nil)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		_, err = w.Write(data)
+
+		return err
+	}
+
+	st := &cliStats{}
+	err = json.Unmarshal(data, st)
+	if err != nil {
+		return fmt.Errorf("decoding stats: %w", err)
+	}
+
+	return printStats(w, st)
+}
+
+// cliLogEntry is the part of a query log entry printed by the command-line
+// client.
+type cliLogEntry struct {
+	ClientInfo *struct {
+		Name string `json:"name"`
+	} `json:"client_info"`
+
+	Time     time.Time `json:"time"`
+	Client   string    `json:"client"`
+	Reason   string    `json:"reason"`
+	Status   string    `json:"status"`
+	Elapsed  string    `json:"elapsedMs"`
+	Question struct {
+		Host string `json:"host"`
+		Type string `json:"type"`
+	} `json:"question"`
+
+	// Attempts are only sent if the verbose parameter is set.
+	Attempts []struct {
+		Upstream string `json:"upstream"`
+		Outcome  string `json:"outcome"`
+		Elapsed  string `json:"elapsed_ms"`
+	} `json:"upstream_attempts"`
+}
+
+// cliLogFormat is the format of a line of the query log table.
+const cliLogFormat = "%-19s  %-24s  %-6s  %-40s  %-20s  %s\n"
+
+// printLogHeader writes the header of the query log table to w.
+func printLogHeader(w io.Writer) {
+	_, _ = fmt.Fprintf(w, cliLogFormat, "TIME", "CLIENT", "TYPE", "DOMAIN", "REASON", "ELAPSED")
+}
+
+// printLogEntry writes e to w as a line of the query log table.
+func printLogEntry(w io.Writer, e *cliLogEntry) {
+	client := e.Client
+	if e.ClientInfo != nil && e.ClientInfo.Name != "" {
+		client = fmt.Sprintf("%s (%s)", e.ClientInfo.Name, e.Client)
+	}
+
+	_, _ = fmt.Fprintf(
+		w,
+		cliLogFormat,
+		e.Time.Local().Format("2006-01-02 15:04:05"),
+		client,
+		e.Question.Type,
+		e.Question.Host,
+		e.Reason,
+		e.Elapsed+" ms",
+	)
+
+	for _, a := range e.Attempts {
+		_, _ = fmt.Fprintf(w, "    upstream %s: %s in %s ms\n", a.Upstream, a.Outcome, a.Elapsed)
+	}
+}
+
+// filteringStatusBlocked is the value of the response_status query parameter
+// of the query log HTTP API for the blocked queries.
+const filteringStatusBlocked = "blocked"
+
+// queryLogParams returns the query parameters of the query log HTTP API for
+// the command-line flags.
+func queryLogParams(client, search string, blocked, verbose bool, limit int) (q url.Values, err error) {
+	if client != "" && search != "" {
+		return nil, fmt.Errorf("%w: --client and --search can't be used together", errCLIUsage)
+	}
+
+	q = url.Values{}
+	if client != "" {
+		// Quotes mean the strict match of the search criterion.
+		q.Set("search", `"`+client+`"`)
+	} else if search != "" {
+		q.Set("search", search)
+	}
+
+	if blocked {
+		q.Set("response_status", filteringStatusBlocked)
+	}
+
+	if verbose {
+		q.Set("verbose", "true")
+	}
+
+	q.Set("limit", strconv.Itoa(limit))
+
+	return q, nil
+}
+
+// cmdQueryLog is the command printing the query log.
+func cmdQueryLog(w io.Writer, args []string) (err error) {
+	cf := &cliFlags{}
+	fs := newCLIFlagSet("querylog", cf)
+
+	var client, search string
+	var blocked, tail, verbose bool
+	var limit int
+	fs.StringVar(&client, "client", "", "Only show the queries from the client with this IP address, name, or client ID.")
+	fs.StringVar(&search, "search", "", "Only show the queries with domains or clients containing this text.")
+	fs.BoolVar(&blocked, "blocked", false, "Only show the blocked queries.")
+	fs.BoolVar(&tail, "tail", false, "Keep printing the new queries.")
+	fs.BoolVar(&verbose, "verbose", false, "Also print each exchange with the upstream servers.")
+	fs.IntVar(&limit, "limit", 20, "The number of the latest queries to print.")
+
+	err = parseCLIFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	q, err := queryLogParams(client, search, blocked, verbose, limit)
+	if err != nil {
+		return err
+	}
+
+	c, err := newCLIClient(cf)
+	if err != nil {
+		return err
+	}
+
+	if tail {
+		return c.tailQueryLog(w, q, cf.json)
+	}
+
+	return c.queryLog(w, q, cf.json)
+}
+
+// queryLogEntries requests the latest query log entries matching q and
+// returns them from the oldest to the newest.
+func (c *cliClient) queryLogEntries(q url.Values) (raws []json.RawMessage, ents []*cliLogEntry, err error) {
+	data, err := c.getData("/control/querylog", q)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resp := struct {
+		Data []json.RawMessage `json:"data"`
+	}{}
+	err = json.Unmarshal(data, &resp)
+	if err != nil {
+		return nil, nil, fmt.Errorf("decoding query log: %w", err)
+	}
+
+	l := len(resp.Data)
+	raws = make([]json.RawMessage, l)
+	ents = make([]*cliLogEntry, l)
+	for i, raw := range resp.Data {
+		e := &cliLogEntry{}
+		err = json.Unmarshal(raw, e)
+		if err != nil {
+			return nil, nil, fmt.Errorf("decoding query log entry: %w", err)
+		}
+
+		// The API returns the newest entries first.
+		raws[l-1-i], ents[l-1-i] = raw, e
+	}
+
+	return raws, ents, nil
+}
+
+// queryLog writes the latest query log entries matching q to w.
+func (c *cliClient) queryLog(w io.Writer, q url.Values, asJSON bool) (err error) {
+	if asJSON {
+		var data []byte
+		data, err = c.getData("/control/querylog", q)
+		if err != nil {
+			return err
+		}
+
+		_, err = w.Write(data)
+
+		return err
+	}
+
+	_, ents, err := c.queryLogEntries(q)
+	if err != nil {
+		return err
+	}
+
+	printLogHeader(w)
+	for _, e := range ents {
+		printLogEntry(w, e)
+	}
+
+	return nil
+}
+
+// cliStreamMaxLine is the maximum length of a line of the query log stream.
+const cliStreamMaxLine = 1024 * 1024
+
+// tailQueryLog writes the latest query log entries matching q to w and then
+// keeps writing the new ones.  In the JSON mode each entry is written as a
+// separate line.  The stream is reopened when the server closes it.
+func (c *cliClient) tailQueryLog(w io.Writer, q url.Values, asJSON bool) (err error) {
+	// Open the stream first so that no entries are missed between the
+	// requests.  The duplicates are skipped by their time.
+	stream, err := c.get(c.stream, "/control/querylog/stream", q)
+	if err != nil {
+		return err
+	}
+
+	raws, ents, err := c.queryLogEntries(q)
+	if err != nil {
+		_ = stream.Close()
+
+		return err
+	}
+
+	write := func(raw []byte, e *cliLogEntry) {
+		if asJSON {
+			_, _ = w.Write(raw)
+			_, _ = w.Write([]byte{'\n'})
+		} else {
+			printLogEntry(w, e)
+		}
+	}
+
+	if !asJSON {
+		printLogHeader(w)
+	}
+
+	var last time.Time
+	for i, e := range ents {
+		write(raws[i], e)
+		last = e.Time
+	}
+
+	for {
+		last, err = copyLogStream(stream, last, write)
+		_ = stream.Close()
+		if err != nil {
+			return err
+		}
+
+		stream, err = c.get(c.stream, "/control/querylog/stream", q)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// copyLogStream calls write for every entry from stream newer than last until the
+// stream ends.  newLast is the time of the last written entry.
+func copyLogStream(
+	stream io.Reader,
+	last time.Time,
+	write func(raw []byte, e *cliLogEntry),
+) (newLast time.Time, err error) {
+	sc := bufio.NewScanner(stream)
+	sc.Buffer(make([]byte, 0, 64*1024), cliStreamMaxLine)
+	for sc.Scan() {
+		raw := sc.Bytes()
+
+		e := &cliLogEntry{}
+		err = json.Unmarshal(raw, e)
+		if err != nil {
+			return last, fmt.Errorf("decoding query log entry: %w", err)
+		}
+
+		if !e.Time.After(last) {
+			continue
+		}
+
+		write(raw, e)
+		last = e.Time
+	}
+
+	// The server closes the stream on timeout, so errors on reading are
+	// handled by reopening it.
+	return last, nil
+}
@@ -0,0 +1,280 @@
+package home
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCLIClient returns a client of the HTTP API served by h.
+func newTestCLIClient(t *testing.T, h http.Handler) (c *cliClient) {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	u, err := url.Parse(srv.URL)
+	require.NoError(t, err)
+
+	return &cliClient{
+		baseURL: u,
+		hc:      srv.Client(),
+		stream:  srv.Client(),
+		token:   "secret",
+	}
+}
+
+func TestCLIClient_stats(t *testing.T) {
+	const statsJSON = `{"time_units":"hours","num_dns_queries":100,` +
+		`"num_blocked_filtering":10,"avg_processing_time":0.0125,"avg_upstream_time":0.01,` +
+		`"top_queried_domains":[{"example.org":42}],"top_blocked_domains":[],` +
+		`"top_clients":[{"1.2.3.4":100},{"1.2.3.5":1}],` +
+		`"client_names":{"1.2.3.4":"Thermostat"},"dns_queries":[1,2,3]}`
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/stats", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusForbidden)
+
+			return
+		}
+
+		_, _ = io.WriteString(w, statsJSON)
+	})
+
+	c := newTestCLIClient(t, mux)
+
+	t.Run("table", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		require.NoError(t, c.stats(out, false))
+
+		s := out.String()
+		assert.Contains(t, s, "Period:                    3 hours\n")
+		assert.Contains(t, s, "DNS queries:               100\n")
+		assert.Contains(t, s, "Blocked by filters:        10\n")
+		assert.Contains(t, s, "Average processing time:   12.500 ms\n")
+		assert.Contains(t, s, "Average upstream time:     10.000 ms\n")
+		assert.Contains(t, s, "example.org")
+		assert.Contains(t, s, "Thermostat (1.2.3.4)")
+		assert.Contains(t, s, "\n1.2.3.5 ")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		out := &bytes.Buffer{}
+		require.NoError(t, c.stats(out, true))
+
+		assert.Equal(t, statsJSON, out.String())
+	})
+
+	t.Run("forbidden", func(t *testing.T) {
+		bad := *c
+		bad.token = "bad"
+
+		err := bad.stats(&bytes.Buffer{}, false)
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "403")
+		assert.NotErrorIs(t, err, errUnreachable)
+	})
+}
+
+func TestCLIClient_unreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	addr := l.Addr().String()
+	require.NoError(t, l.Close())
+
+	c := &cliClient{
+		baseURL: &url.URL{Scheme: schemeHTTP, Host: addr},
+		hc:      &http.Client{},
+		stream:  &http.Client{},
+	}
+
+	err = c.stats(&bytes.Buffer{}, false)
+	assert.ErrorIs(t, err, errUnreachable)
+
+	code := runCLICommand(&bytes.Buffer{}, "stats", func(w io.Writer, _ []string) error {
+		return c.stats(w, false)
+	}, nil)
+	assert.Equal(t, cliExitUnreachable, code)
+}
+
+// testLogEntry returns a query log entry in JSON for domain at the second sec.
+func testLogEntry(sec int, domain string) (s string) {
+	return fmt.Sprintf(
+		`{"time":"2021-05-01T10:00:%02d.5Z","client":"1.2.3.4",`+
+			`"client_info":{"name":"phone"},"reason":"FilteredBlackList",`+
+			`"elapsedMs":"1.5","question":{"host":%q,"type":"A"}}`,
+		sec,
+		domain,
+	)
+}
+
+func TestCLIClient_tailQueryLog(t *testing.T) {
+	var streams int
+	mux := http.NewServeMux()
+	mux.HandleFunc("/control/querylog", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, `"1.2.3.4"`, r.URL.Query().Get("search"))
+		assert.Equal(t, "blocked", r.URL.Query().Get("response_status"))
+
+		_, _ = fmt.Fprintf(w, `{"data":[%s,%s],"oldest":""}`, testLogEntry(2, "two.example"), testLogEntry(1, "one.example"))
+	})
+	mux.HandleFunc("/control/querylog/stream", func(w http.ResponseWriter, r *http.Request) {
+		streams++
+		switch streams {
+		case 1:
+			// The entry received by both requests must be skipped.
+			_, _ = fmt.Fprintln(w, testLogEntry(2, "two.example"))
+			_, _ = fmt.Fprintln(w, testLogEntry(3, "three.example"))
+		case 2:
+			_, _ = fmt.Fprintln(w, testLogEntry(4, "four.example"))
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+
+	q, err := queryLogParams("1.2.3.4", "", true, false, 10)
+	require.NoError(t, err)
+
+	c := newTestCLIClient(t, mux)
+
+	t.Run("json", func(t *testing.T) {
+		streams = 0
+		out := &bytes.Buffer{}
+		err = c.tailQueryLog(out, q, true)
+		require.Error(t, err)
+
+		assert.Contains(t, err.Error(), "503")
+		assert.Equal(t, strings.Join([]string{
+			testLogEntry(1, "one.example"),
+			testLogEntry(2, "two.example"),
+			testLogEntry(3, "three.example"),
+			testLogEntry(4, "four.example"),
+		}, "\n")+"\n", out.String())
+	})
+
+	t.Run("table", func(t *testing.T) {
+		streams = 0
+		out := &bytes.Buffer{}
+		err = c.tailQueryLog(out, q, false)
+		require.Error(t, err)
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+		require.Len(t, lines, 5)
+
+		assert.True(t, strings.HasPrefix(lines[0], "TIME"))
+		for i, d := range []string{"one", "two", "three", "four"} {
+			assert.Contains(t, lines[i+1], "phone (1.2.3.4)")
+			assert.Contains(t, lines[i+1], d+".example")
+			assert.Contains(t, lines[i+1], "FilteredBlackList")
+		}
+	})
+}
+
+func TestQueryLogParams(t *testing.T) {
+	testCases := []struct {
+		name    string
+		client  string
+		search  string
+		want    string
+		blocked bool
+		verbose bool
+		wantErr bool
+	}{{
+		name: "none",
+		want: "limit=20",
+	}, {
+		name:    "client_blocked",
+		client:  "phone",
+		blocked: true,
+		want:    "limit=20&response_status=blocked&search=%22phone%22",
+	}, {
+		name:   "search",
+		search: "example",
+		want:   "limit=20&search=example",
+	}, {
+		name:    "verbose",
+		verbose: true,
+		want:    "limit=20&verbose=true",
+	}, {
+		name:    "both",
+		client:  "phone",
+		search:  "example",
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			q, err := queryLogParams(tc.client, tc.search, tc.blocked, tc.verbose, 20)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, errCLIUsage)
+
+				return
+			}
+
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, q.Encode())
+		})
+	}
+}
+
+func TestCheckCLIToken(t *testing.T) {
+	prev := Context.cliToken
+	Context.cliToken = "secret"
+	t.Cleanup(func() { Context.cliToken = prev })
+
+	testCases := []struct {
+		name   string
+		remote string
+		auth   string
+		want   bool
+	}{{
+		name:   "loopback",
+		remote: "127.0.0.1:1234",
+		auth:   "Bearer secret",
+		want:   true,
+	}, {
+		name:   "loopback_v6",
+		remote: "[::1]:1234",
+		auth:   "Bearer secret",
+		want:   true,
+	}, {
+		name:   "bad_token",
+		remote: "127.0.0.1:1234",
+		auth:   "Bearer secret2",
+		want:   false,
+	}, {
+		name:   "no_token",
+		remote: "127.0.0.1:1234",
+		auth:   "",
+		want:   false,
+	}, {
+		name:   "remote",
+		remote: "192.168.1.2:1234",
+		auth:   "Bearer secret",
+		want:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/control/stats", nil)
+			r.RemoteAddr = tc.remote
+			if tc.auth != "" {
+				r.Header.Set("Authorization", tc.auth)
+			}
+
+			assert.Equal(t, tc.want, checkCLIToken(r))
+		})
+	}
+}
@@ -41,8 +41,25 @@ type Client struct {
 	UseOwnBlockedServices bool // false: use global settings
 	BlockedServices       []string
 
+	// UseOwnFilterGroups means that only the blocklists of FilterGroups and
+	// the ungrouped ones are applied to the client's requests.
+	UseOwnFilterGroups bool
+	FilterGroups       []string
+
+	// Profile is the name of the profile of the client, if any.  See
+	// applyClientSettings.
+	Profile string
+
+	// AAAADisabled means that AAAA requests of the client are answered with
+	// an empty response regardless of the global setting.
+	AAAADisabled bool
+
 	Upstreams []string // list of upstream servers to be used for the client's requests
 
+	// Expires is the time when a guest client is removed.  It's zero for
+	// the clients, which aren't guests, see AddGuest.
+	Expires time.Time
+
 	// Custom upstream config for this client
 	// nil: not yet initialized
 	// not nil, but empty: initialized, no good upstreams
@@ -66,6 +83,9 @@ type RuntimeClient struct {
 	Host      string
 	Source    clientSource
 	WhoisInfo *RuntimeClientWhoisInfo
+
+	// discovered is the time when the client has been added.
+	discovered time.Time
 }
 
 // RuntimeClientWhoisInfo is the filtered WHOIS data for a runtime client.
@@ -85,6 +105,9 @@ type clientsContainer struct {
 
 	allTags *aghstrings.Set
 
+	// profiles are the profiles of the clients by name.
+	profiles map[string]*Profile
+
 	// dhcpServer is used for looking up clients IP addresses by MAC addresses
 	dhcpServer *dhcpd.Server
 
@@ -93,6 +116,16 @@ type clientsContainer struct {
 
 	etcHosts *aghnet.EtcHostsContainer // get entries from system hosts-files
 
+	// lastSeen are the times of the last requests of the clients by IP
+	// address.  It's protected by seenLock, so that marking the clients
+	// doesn't contend with the lookups.
+	lastSeen map[string]time.Time
+	seenLock sync.Mutex
+
+	// runtimeTTL is the period, after which the runtime clients, which
+	// haven't sent any requests, are expired.  Zero means never.
+	runtimeTTL time.Duration
+
 	testing bool // if TRUE, this object is used for internal tests
 }
 
@@ -101,6 +134,7 @@ type clientsContainer struct {
 // Note: this function must be called only once
 func (clients *clientsContainer) Init(
 	objects []clientObject,
+	profiles []*Profile,
 	dhcpServer *dhcpd.Server,
 	etcHosts *aghnet.EtcHostsContainer,
 ) {
@@ -115,6 +149,7 @@ func (clients *clientsContainer) Init(
 
 	clients.dhcpServer = dhcpServer
 	clients.etcHosts = etcHosts
+	clients.initProfiles(profiles)
 	clients.addFromConfig(objects)
 
 	if !clients.testing {
@@ -157,7 +192,18 @@ type clientObject struct {
 	UseGlobalBlockedServices bool     `yaml:"use_global_blocked_services"`
 	BlockedServices          []string `yaml:"blocked_services"`
 
+	UseOwnFilterGroups bool     `yaml:"use_own_filter_groups,omitempty"`
+	FilterGroups       []string `yaml:"filter_groups,omitempty"`
+
+	Profile string `yaml:"profile,omitempty"`
+
+	AAAADisabled bool `yaml:"aaaa_disabled"`
+
 	Upstreams []string `yaml:"upstreams"`
+
+	// Expires is the time when the guest client is removed, if it's a
+	// guest.
+	Expires time.Time `yaml:"expires,omitempty"`
 }
 
 func (clients *clientsContainer) tagKnown(tag string) (ok bool) {
@@ -165,7 +211,14 @@ func (clients *clientsContainer) tagKnown(tag string) (ok bool) {
 }
 
 func (clients *clientsContainer) addFromConfig(objects []clientObject) {
+	now := time.Now()
 	for _, cy := range objects {
+		if !cy.Expires.IsZero() && !cy.Expires.After(now) {
+			log.Debug("clients: skipping expired guest %q", cy.Name)
+
+			continue
+		}
+
 		cli := &Client{
 			Name:                cy.Name,
 			IDs:                 cy.IDs,
@@ -177,7 +230,16 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 
 			UseOwnBlockedServices: !cy.UseGlobalBlockedServices,
 
+			UseOwnFilterGroups: cy.UseOwnFilterGroups,
+			FilterGroups:       cy.FilterGroups,
+
+			Profile: cy.Profile,
+
+			AAAADisabled: cy.AAAADisabled,
+
 			Upstreams: cy.Upstreams,
+
+			Expires: cy.Expires,
 		}
 
 		for _, s := range cy.BlockedServices {
@@ -188,6 +250,11 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 			cli.BlockedServices = append(cli.BlockedServices, s)
 		}
 
+		if _, ok := clients.profiles[cli.Profile]; cli.Profile != "" && !ok {
+			log.Info("clients: client %q: skipping unknown profile %q", cli.Name, cli.Profile)
+			cli.Profile = ""
+		}
+
 		for _, t := range cy.Tags {
 			if !clients.tagKnown(t) {
 				log.Debug("clients: skipping unknown tag %q", t)
@@ -205,7 +272,9 @@ func (clients *clientsContainer) addFromConfig(objects []clientObject) {
 }
 
 // WriteDiskConfig - write configuration
-func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
+func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject, profiles *[]*Profile) {
+	clients.writeProfiles(profiles)
+
 	clients.lock.Lock()
 	for _, cli := range clients.list {
 		cy := clientObject{
@@ -216,11 +285,16 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 			SafeSearchEnabled:        cli.SafeSearchEnabled,
 			SafeBrowsingEnabled:      cli.SafeBrowsingEnabled,
 			UseGlobalBlockedServices: !cli.UseOwnBlockedServices,
+			UseOwnFilterGroups:       cli.UseOwnFilterGroups,
+			Profile:                  cli.Profile,
+			AAAADisabled:             cli.AAAADisabled,
+			Expires:                  cli.Expires,
 		}
 
 		cy.Tags = aghstrings.CloneSlice(cli.Tags)
 		cy.IDs = aghstrings.CloneSlice(cli.IDs)
 		cy.BlockedServices = aghstrings.CloneSlice(cli.BlockedServices)
+		cy.FilterGroups = aghstrings.CloneSlice(cli.FilterGroups)
 		cy.Upstreams = aghstrings.CloneSlice(cli.Upstreams)
 
 		*objects = append(*objects, cy)
@@ -231,6 +305,7 @@ func (clients *clientsContainer) WriteDiskConfig(objects *[]clientObject) {
 func (clients *clientsContainer) periodicUpdate() {
 	for {
 		clients.Reload()
+		clients.runExpiry(time.Now())
 		time.Sleep(clientsUpdatePeriod)
 	}
 }
@@ -239,7 +314,8 @@ func (clients *clientsContainer) onDHCPLeaseChanged(flags int) {
 	switch flags {
 	case dhcpd.LeaseChangedAdded,
 		dhcpd.LeaseChangedAddedStatic,
-		dhcpd.LeaseChangedRemovedStatic:
+		dhcpd.LeaseChangedRemovedStatic,
+		dhcpd.LeaseChangedRemovedExpired:
 		clients.updateFromDHCP(true)
 	case dhcpd.LeaseChangedRemovedAll:
 		clients.updateFromDHCP(false)
@@ -317,20 +393,43 @@ func (clients *clientsContainer) findMultiple(ids []string) (c *querylog.Client,
 	return nil, nil
 }
 
+// clientName returns the current name of the persistent or the runtime client
+// with the identifier id or an empty string if there is none.
+func (clients *clientsContainer) clientName(id string) (name string) {
+	if c, ok := clients.Find(id); ok {
+		return c.Name
+	}
+
+	if rc, ok := clients.FindRuntimeClient(id); ok {
+		return rc.Host
+	}
+
+	return ""
+}
+
 func (clients *clientsContainer) Find(id string) (c *Client, ok bool) {
+	c, _, ok = clients.findMatch(id)
+
+	return c, ok
+}
+
+// findMatch returns a copy of the client found by id and the identifier of
+// the client, which has matched id.
+func (clients *clientsContainer) findMatch(id string) (c *Client, matched string, ok bool) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
-	c, ok = clients.findLocked(id)
+	c, matched, ok = clients.findMatchLocked(id)
 	if !ok {
-		return nil, false
+		return nil, "", false
 	}
 
 	c.IDs = aghstrings.CloneSlice(c.IDs)
 	c.Tags = aghstrings.CloneSlice(c.Tags)
 	c.BlockedServices = aghstrings.CloneSlice(c.BlockedServices)
+	c.FilterGroups = aghstrings.CloneSlice(c.FilterGroups)
 	c.Upstreams = aghstrings.CloneSlice(c.Upstreams)
-	return c, true
+	return c, matched, true
 }
 
 // FindUpstreams looks for upstreams configured for the client
@@ -368,14 +467,23 @@ func (clients *clientsContainer) FindUpstreams(ip string) *proxy.UpstreamConfig
 
 // findLocked searches for a client by its ID.  For internal use only.
 func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
+	c, _, ok = clients.findMatchLocked(id)
+
+	return c, ok
+}
+
+// findMatchLocked searches for a client by its ID and returns the identifier
+// of the client, which has matched id: id itself, a subnet containing it,
+// or the MAC address leased it.  For internal use only.
+func (clients *clientsContainer) findMatchLocked(id string) (c *Client, matched string, ok bool) {
 	c, ok = clients.idIndex[id]
 	if ok {
-		return c, true
+		return c, id, true
 	}
 
 	ip := net.ParseIP(id)
 	if ip == nil {
-		return nil, false
+		return nil, "", false
 	}
 
 	for _, c = range clients.list {
@@ -386,18 +494,18 @@ func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
 			}
 
 			if ipnet.Contains(ip) {
-				return c, true
+				return c, id, true
 			}
 		}
 	}
 
 	if clients.dhcpServer == nil {
-		return nil, false
+		return nil, "", false
 	}
 
 	macFound := clients.dhcpServer.FindMACbyIP(ip)
 	if macFound == nil {
-		return nil, false
+		return nil, "", false
 	}
 
 	for _, c = range clients.list {
@@ -408,12 +516,12 @@ func (clients *clientsContainer) findLocked(id string) (c *Client, ok bool) {
 			}
 
 			if bytes.Equal(hwAddr, macFound) {
-				return c, true
+				return c, id, true
 			}
 		}
 	}
 
-	return nil, false
+	return nil, "", false
 }
 
 // FindRuntimeClient finds a runtime client by their IP.
@@ -482,6 +590,16 @@ func (clients *clientsContainer) check(c *Client) (err error) {
 	return nil
 }
 
+// checkProfileLocked returns an error if the profile of c doesn't exist.
+// clients.lock is expected to be locked.
+func (clients *clientsContainer) checkProfileLocked(c *Client) (err error) {
+	if _, ok := clients.profiles[c.Profile]; c.Profile != "" && !ok {
+		return fmt.Errorf("unknown profile %q", c.Profile)
+	}
+
+	return nil
+}
+
 // Add adds a new client object.  ok is false if such client already exists or
 // if an error occurred.
 func (clients *clientsContainer) Add(c *Client) (ok bool, err error) {
@@ -493,12 +611,23 @@ func (clients *clientsContainer) Add(c *Client) (ok bool, err error) {
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	return clients.addLocked(c)
+}
+
+// addLocked adds a new validated client object.  clients.lock is expected to
+// be locked.
+func (clients *clientsContainer) addLocked(c *Client) (ok bool, err error) {
 	// check Name index
 	_, ok = clients.list[c.Name]
 	if ok {
 		return false, nil
 	}
 
+	err = clients.checkProfileLocked(c)
+	if err != nil {
+		return false, err
+	}
+
 	// check ID index
 	for _, id := range c.IDs {
 		var c2 *Client
@@ -573,6 +702,11 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 		return agherr.Error("client not found")
 	}
 
+	err = clients.checkProfileLocked(c)
+	if err != nil {
+		return err
+	}
+
 	// First, check the name index.
 	if prev.Name != c.Name {
 		_, ok = clients.list[c.Name]
@@ -608,6 +742,9 @@ func (clients *clientsContainer) Update(name string, c *Client) (err error) {
 	// update upstreams cache
 	c.upstreamConfig = nil
 
+	// Updating a guest doesn't make it persistent.
+	c.Expires = prev.Expires
+
 	*prev = *c
 
 	return nil
@@ -635,7 +772,8 @@ func (clients *clientsContainer) SetWhoisInfo(ip string, wi *RuntimeClientWhoisI
 	// Create a RuntimeClient implicitly so that we don't do this check
 	// again.
 	rc = &RuntimeClient{
-		Source: ClientSourceWHOIS,
+		Source:     ClientSourceWHOIS,
+		discovered: time.Now(),
 	}
 
 	rc.WhoisInfo = wi
@@ -667,9 +805,10 @@ func (clients *clientsContainer) addHostLocked(ip, host string, src clientSource
 		rc.Source = src
 	} else {
 		rc = &RuntimeClient{
-			Host:      host,
-			Source:    src,
-			WhoisInfo: &RuntimeClientWhoisInfo{},
+			Host:       host,
+			Source:     src,
+			WhoisInfo:  &RuntimeClientWhoisInfo{},
+			discovered: time.Now(),
 		}
 
 		clients.ipToRC[ip] = rc
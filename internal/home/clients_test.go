@@ -16,7 +16,7 @@ func TestClients(t *testing.T) {
 	clients := clientsContainer{}
 	clients.testing = true
 
-	clients.Init(nil, nil, nil)
+	clients.Init(nil, nil, nil, nil)
 
 	t.Run("add_success", func(t *testing.T) {
 		c := &Client{
@@ -162,7 +162,7 @@ func TestClientsWhois(t *testing.T) {
 	clients := clientsContainer{
 		testing: true,
 	}
-	clients.Init(nil, nil, nil)
+	clients.Init(nil, nil, nil, nil)
 	whois := &RuntimeClientWhoisInfo{
 		Country: "AU",
 		Orgname: "Example Org",
@@ -211,7 +211,7 @@ func TestClientsAddExisting(t *testing.T) {
 	clients := clientsContainer{
 		testing: true,
 	}
-	clients.Init(nil, nil, nil)
+	clients.Init(nil, nil, nil, nil)
 
 	t.Run("simple", func(t *testing.T) {
 		// Add a client.
@@ -278,7 +278,7 @@ func TestClientsCustomUpstream(t *testing.T) {
 	clients := clientsContainer{
 		testing: true,
 	}
-	clients.Init(nil, nil, nil)
+	clients.Init(nil, nil, nil, nil)
 
 	// Add client with upstreams.
 	ok, err := clients.Add(&Client{
@@ -300,3 +300,134 @@ func TestClientsCustomUpstream(t *testing.T) {
 	assert.Len(t, config.Upstreams, 1)
 	assert.Len(t, config.DomainReservedUpstreams, 1)
 }
+
+func TestClientsContainer_expireRuntime(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	const ttl = time.Hour
+	now := time.Now()
+	long := now.Add(-2 * ttl)
+
+	for ip, src := range map[string]clientSource{
+		"1.1.1.1": ClientSourceRDNS,
+		"1.1.1.2": ClientSourceRDNS,
+		"1.1.1.3": ClientSourceHostsFile,
+		"1.1.1.4": ClientSourceRDNS,
+	} {
+		ok, err := clients.AddHost(ip, "host", src)
+		require.NoError(t, err)
+		require.True(t, ok)
+
+		clients.ipToRC[ip].discovered = long
+	}
+
+	// Discovered recently, but hasn't sent any requests yet.
+	ok, err := clients.AddHost("1.1.1.5", "host", ClientSourceRDNS)
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	clients.markSeen("1.1.1.1", now)
+	clients.markSeen("1.1.1.2", long)
+	clients.markSeen("1.1.1.3", long)
+
+	removed, forgotten := clients.expireRuntime(now, ttl)
+	assert.ElementsMatch(t, []string{"1.1.1.2", "1.1.1.4"}, removed)
+	assert.Equal(t, 2, forgotten)
+
+	for ip, want := range map[string]bool{
+		"1.1.1.1": true,
+		"1.1.1.2": false,
+		"1.1.1.3": true,
+		"1.1.1.4": false,
+		"1.1.1.5": true,
+	} {
+		_, ok = clients.FindRuntimeClient(ip)
+		assert.Equal(t, want, ok, ip)
+	}
+
+	assert.Equal(t, now, clients.lastSeenOf("1.1.1.1"))
+	assert.True(t, clients.lastSeenOf("1.1.1.2").IsZero())
+
+	removed, forgotten = clients.expireRuntime(now, 0)
+	assert.Empty(t, removed)
+	assert.Zero(t, forgotten)
+}
+
+func TestClientsContainer_AddGuest(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, nil, nil, nil)
+
+	ok, err := clients.Add(&Client{
+		IDs:  []string{"1.2.3.4", "192.168.0.0/24"},
+		Name: "persistent",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	now := time.Now()
+	const ttl = 24 * time.Hour
+
+	t.Run("covered", func(t *testing.T) {
+		for _, id := range []string{"1.2.3.4", "192.168.0.5"} {
+			err = clients.AddGuest(&Client{
+				IDs:  []string{id},
+				Name: "guest",
+			}, now, ttl)
+			assert.Error(t, err, id)
+		}
+
+		_, ok = clients.Find("guest")
+		assert.False(t, ok)
+	})
+
+	t.Run("not_ip", func(t *testing.T) {
+		err = clients.AddGuest(&Client{
+			IDs:  []string{"aa:aa:aa:aa:aa:aa"},
+			Name: "guest",
+		}, now, ttl)
+		assert.Error(t, err)
+	})
+
+	err = clients.AddGuest(&Client{
+		IDs:  []string{"1.2.3.5"},
+		Name: "guest",
+	}, now, ttl)
+	require.NoError(t, err)
+
+	c, ok := clients.Find("1.2.3.5")
+	require.True(t, ok)
+	assert.True(t, c.isGuest())
+	assert.Equal(t, now.Add(ttl), c.Expires)
+
+	cj := clientToJSON(c)
+	setGuestJSON(&cj, c, now.Add(time.Hour))
+	assert.True(t, cj.Guest)
+	assert.EqualValues(t, 23*60*60, cj.ExpiresIn)
+
+	t.Run("update_keeps_expiry", func(t *testing.T) {
+		err = clients.Update("guest", &Client{
+			IDs:              []string{"1.2.3.5"},
+			Name:             "guest",
+			FilteringEnabled: true,
+		})
+		require.NoError(t, err)
+
+		c, ok = clients.Find("1.2.3.5")
+		require.True(t, ok)
+		assert.Equal(t, now.Add(ttl), c.Expires)
+	})
+
+	assert.Empty(t, clients.expireGuests(now.Add(ttl-time.Second)))
+	assert.Equal(t, []string{"guest"}, clients.expireGuests(now.Add(ttl)))
+
+	_, ok = clients.Find("1.2.3.5")
+	assert.False(t, ok)
+
+	_, ok = clients.Find("1.2.3.4")
+	assert.True(t, ok)
+}
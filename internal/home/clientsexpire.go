@@ -0,0 +1,140 @@
+package home
+
+import (
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// defaultRuntimeClientsTTLHours is the default period in hours, after which
+// the runtime clients, which haven't sent any requests, are expired.
+const defaultRuntimeClientsTTLHours = 7 * 24
+
+// markSeen remembers that the client with ip has sent a request at now.
+func (clients *clientsContainer) markSeen(ip string, now time.Time) {
+	clients.seenLock.Lock()
+	defer clients.seenLock.Unlock()
+
+	if clients.lastSeen == nil {
+		clients.lastSeen = map[string]time.Time{}
+	}
+
+	clients.lastSeen[ip] = now
+}
+
+// lastSeenOf returns the time of the last request of the client with ip.  It's
+// zero if the client hasn't sent any requests since the start or since it's
+// been expired.
+func (clients *clientsContainer) lastSeenOf(ip string) (t time.Time) {
+	clients.seenLock.Lock()
+	defer clients.seenLock.Unlock()
+
+	return clients.lastSeen[ip]
+}
+
+// expirable returns true if the runtime clients from src may be expired.  The
+// clients from the hosts files, the DHCP leases, and the ARP table are kept,
+// since those are only removed along with their sources.
+func (src clientSource) expirable() (ok bool) {
+	return src == ClientSourceWHOIS || src == ClientSourceRDNS
+}
+
+// expireRuntime removes the runtime clients discovered by rDNS and WHOIS,
+// which haven't sent any requests for the ttl before now, and forgets when
+// all the clients not seen for ttl have been seen.  It returns the IP addresses
+// of the removed clients and the number of the forgotten addresses.
+func (clients *clientsContainer) expireRuntime(now time.Time, ttl time.Duration) (removed []string, forgotten int) {
+	if ttl == 0 {
+		return nil, 0
+	}
+
+	deadline := now.Add(-ttl)
+
+	clients.seenLock.Lock()
+	seen := make(map[string]time.Time, len(clients.lastSeen))
+	for ip, t := range clients.lastSeen {
+		if t.Before(deadline) {
+			delete(clients.lastSeen, ip)
+			forgotten++
+		} else {
+			seen[ip] = t
+		}
+	}
+	clients.seenLock.Unlock()
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for ip, rc := range clients.ipToRC {
+		if !rc.Source.expirable() {
+			continue
+		}
+
+		if _, ok := seen[ip]; ok {
+			continue
+		}
+
+		if rc.discovered.After(deadline) {
+			// The client has been discovered recently, but hasn't sent
+			// any requests since the start yet.
+			continue
+		}
+
+		delete(clients.ipToRC, ip)
+		removed = append(removed, ip)
+	}
+
+	return removed, forgotten
+}
+
+// expireGuests removes the guest clients, which have expired before now, and
+// returns their names.  The statistics and the query log of the guests are
+// kept, since those refer to the clients by their IP addresses.
+func (clients *clientsContainer) expireGuests(now time.Time) (names []string) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for name, c := range clients.list {
+		if !c.isGuest() || c.Expires.After(now) {
+			continue
+		}
+
+		delete(clients.list, name)
+		for _, id := range c.IDs {
+			delete(clients.idIndex, id)
+		}
+
+		names = append(names, name)
+	}
+
+	return names
+}
+
+// runExpiry expires the guest clients and the runtime clients not seen for the
+// configured period and logs a summary.  The statistics of the expired runtime
+// clients are folded into stats.ExpiredClients.
+func (clients *clientsContainer) runExpiry(now time.Time) {
+	guests := clients.expireGuests(now)
+	if len(guests) != 0 {
+		log.Info("clients: expired guests %q", guests)
+
+		onConfigModified()
+		Context.filters.refreshFilterGroups()
+	}
+
+	removed, forgotten := clients.expireRuntime(now, clients.runtimeTTL)
+	if len(removed) == 0 && forgotten == 0 {
+		return
+	}
+
+	if len(removed) != 0 && Context.stats != nil {
+		Context.stats.FoldClients(removed)
+	}
+
+	log.Info(
+		"clients: expired %d runtime clients and %d addresses not seen for %s",
+		len(removed),
+		forgotten,
+		clients.runtimeTTL,
+	)
+}
@@ -0,0 +1,129 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The limits of the period in hours, after which a guest client is removed.
+const (
+	defaultGuestTTLHours = 24
+	maxGuestTTLHours     = 30 * 24
+)
+
+// isGuest returns true if c is a guest client, which is removed once it
+// expires.
+func (c *Client) isGuest() (ok bool) {
+	return !c.Expires.IsZero()
+}
+
+// AddGuest adds c as a guest client, which is removed at now plus ttl.  The
+// identifiers of a guest must be IP addresses, none of which may belong to a
+// client other than a guest.
+func (clients *clientsContainer) AddGuest(c *Client, now time.Time, ttl time.Duration) (err error) {
+	err = clients.check(c)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range c.IDs {
+		if net.ParseIP(id) == nil {
+			return fmt.Errorf("guest id %q is not an ip address", id)
+		}
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	err = clients.checkProfileLocked(c)
+	if err != nil {
+		return err
+	}
+
+	for _, id := range c.IDs {
+		other, matched, ok := clients.findMatchLocked(id)
+		if ok && !other.isGuest() {
+			return fmt.Errorf("ip %s is already covered by persistent client %q with id %q", id, other.Name, matched)
+		}
+	}
+
+	c.Expires = now.Add(ttl)
+	ok, err := clients.addLocked(c)
+	if err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("client %q already exists", c.Name)
+	}
+
+	return nil
+}
+
+// guestJSON is the request for adding a guest client.
+type guestJSON struct {
+	clientJSON
+
+	// TTLHours is the period in hours, after which the guest is removed.
+	// Zero means defaultGuestTTLHours.
+	TTLHours uint32 `json:"ttl_hours"`
+}
+
+// setGuestJSON sets the guest fields of cj from c at now.
+func setGuestJSON(cj *clientJSON, c *Client, now time.Time) {
+	if !c.isGuest() {
+		return
+	}
+
+	cj.Guest = true
+	cj.Expires = aghtime.Format(c.Expires, time.RFC3339)
+	if left := c.Expires.Sub(now); left > 0 {
+		cj.ExpiresIn = uint64(left / time.Second)
+	}
+}
+
+// handleAddGuest is the handler for the POST /control/clients/guest HTTP API.
+func (clients *clientsContainer) handleAddGuest(w http.ResponseWriter, r *http.Request) {
+	gj := guestJSON{}
+	err := json.NewDecoder(r.Body).Decode(&gj)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if gj.TTLHours == 0 {
+		gj.TTLHours = defaultGuestTTLHours
+	} else if gj.TTLHours > maxGuestTTLHours {
+		httpError(w, http.StatusBadRequest, "ttl_hours must not be greater than %d", maxGuestTTLHours)
+
+		return
+	}
+
+	now := time.Now()
+	c := jsonToClient(gj.clientJSON)
+	err = clients.AddGuest(c, now, time.Duration(gj.TTLHours)*time.Hour)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	log.Info("clients: added guest %q until %s", c.Name, c.Expires.Format(time.RFC3339))
+
+	onConfigModified()
+	Context.filters.refreshFilterGroups()
+
+	cj := clientToJSON(c)
+	setGuestJSON(&cj, c, now)
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(cj)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "Failed to encode to json: %v", err)
+	}
+}
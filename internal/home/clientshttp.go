@@ -5,6 +5,10 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 )
 
 type clientJSON struct {
@@ -20,10 +24,36 @@ type clientJSON struct {
 	UseGlobalBlockedServices bool     `json:"use_global_blocked_services"`
 	BlockedServices          []string `json:"blocked_services"`
 
+	UseOwnFilterGroups bool     `json:"use_own_filter_groups"`
+	FilterGroups       []string `json:"filter_groups"`
+
+	// Profile is the name of the profile of the client, if any.
+	Profile string `json:"profile"`
+
+	DisableIPv6 bool `json:"disable_ipv6"`
+
 	Upstreams []string `json:"upstreams"`
 
 	WhoisInfo *RuntimeClientWhoisInfo `json:"whois_info"`
 
+	// Persistent is true if the client is configured and false if it's
+	// discovered at runtime.
+	Persistent bool `json:"persistent"`
+
+	// LastSeen is the time of the last request of a runtime client, if
+	// any.
+	LastSeen string `json:"last_seen,omitempty"`
+
+	// Guest is true if the client is a guest, which is removed once it
+	// expires.
+	Guest bool `json:"guest,omitempty"`
+
+	// Expires is the time when the guest is removed.
+	Expires string `json:"expires,omitempty"`
+
+	// ExpiresIn is the number of seconds left until the guest is removed.
+	ExpiresIn uint64 `json:"expires_in,omitempty"`
+
 	// Disallowed - if true -- client's IP is not disallowed
 	// Otherwise, it is blocked.
 	Disallowed bool `json:"disallowed"`
@@ -40,6 +70,25 @@ type runtimeClientJSON struct {
 	IP     string `json:"ip"`
 	Name   string `json:"name"`
 	Source string `json:"source"`
+
+	// LastSeen is the time of the last request of the client, if any since
+	// the start.
+	LastSeen string `json:"last_seen,omitempty"`
+
+	// SuggestedDevice is the device guessed from the DHCP fingerprint of
+	// the client, if any.  It's never applied automatically.
+	SuggestedDevice *dhcpd.DeviceSuggestion `json:"suggested_device,omitempty"`
+}
+
+// formatLastSeen returns the time of the last request of the client with ip
+// formatted for the HTTP API or an empty string if there is none.
+func (clients *clientsContainer) formatLastSeen(ip string) (s string) {
+	t := clients.lastSeenOf(ip)
+	if t.IsZero() {
+		return ""
+	}
+
+	return aghtime.Format(t, time.RFC3339)
 }
 
 type clientListJSON struct {
@@ -55,15 +104,26 @@ func (clients *clientsContainer) handleGetClients(w http.ResponseWriter, _ *http
 	clients.lock.Lock()
 	defer clients.lock.Unlock()
 
+	now := time.Now()
 	for _, c := range clients.list {
 		cj := clientToJSON(c)
+		setGuestJSON(&cj, c, now)
 		data.Clients = append(data.Clients, cj)
 	}
+
+	var devices map[string]*dhcpd.DeviceSuggestion
+	if clients.dhcpServer != nil {
+		devices = clients.dhcpServer.SuggestedDevices()
+	}
+
 	for ip, rc := range clients.ipToRC {
 		cj := runtimeClientJSON{
 			IP:        ip,
 			Name:      rc.Host,
 			WhoisInfo: rc.WhoisInfo,
+			LastSeen:  clients.formatLastSeen(ip),
+
+			SuggestedDevice: devices[ip],
 		}
 
 		cj.Source = "etc/hosts"
@@ -106,6 +166,13 @@ func jsonToClient(cj clientJSON) (c *Client) {
 		UseOwnBlockedServices: !cj.UseGlobalBlockedServices,
 		BlockedServices:       cj.BlockedServices,
 
+		UseOwnFilterGroups: cj.UseOwnFilterGroups,
+		FilterGroups:       cj.FilterGroups,
+
+		Profile: cj.Profile,
+
+		AAAADisabled: cj.DisableIPv6,
+
 		Upstreams: cj.Upstreams,
 	}
 }
@@ -125,9 +192,18 @@ func clientToJSON(c *Client) clientJSON {
 		UseGlobalBlockedServices: !c.UseOwnBlockedServices,
 		BlockedServices:          c.BlockedServices,
 
+		UseOwnFilterGroups: c.UseOwnFilterGroups,
+		FilterGroups:       c.FilterGroups,
+
+		Profile: c.Profile,
+
+		DisableIPv6: c.AAAADisabled,
+
 		Upstreams: c.Upstreams,
 
 		WhoisInfo: &RuntimeClientWhoisInfo{},
+
+		Persistent: true,
 	}
 
 	return cj
@@ -166,6 +242,7 @@ func (clients *clientsContainer) handleAddClient(w http.ResponseWriter, r *http.
 	}
 
 	onConfigModified()
+	Context.filters.refreshFilterGroups()
 }
 
 // Remove client
@@ -190,6 +267,7 @@ func (clients *clientsContainer) handleDelClient(w http.ResponseWriter, r *http.
 	}
 
 	onConfigModified()
+	Context.filters.refreshFilterGroups()
 }
 
 type updateJSON struct {
@@ -220,6 +298,7 @@ func (clients *clientsContainer) handleUpdateClient(w http.ResponseWriter, r *ht
 	}
 
 	onConfigModified()
+	Context.filters.refreshFilterGroups()
 }
 
 // Get the list of clients by IP address list
@@ -289,6 +368,7 @@ func (clients *clientsContainer) findRuntime(ip net.IP, idStr string) (cj client
 
 	cj = runtimeClientToJSON(idStr, rc)
 	cj.Disallowed, cj.DisallowedRule = clients.dnsServer.IsBlockedIP(ip)
+	cj.LastSeen = clients.formatLastSeen(idStr)
 
 	return cj, true
 }
@@ -300,4 +380,10 @@ func (clients *clientsContainer) registerWebHandlers() {
 	httpRegister(http.MethodPost, "/control/clients/delete", clients.handleDelClient)
 	httpRegister(http.MethodPost, "/control/clients/update", clients.handleUpdateClient)
 	httpRegister(http.MethodGet, "/control/clients/find", clients.handleFindClient)
+	httpRegister(http.MethodPost, "/control/clients/guest", clients.handleAddGuest)
+
+	httpRegister(http.MethodGet, "/control/profiles", clients.handleGetProfiles)
+	httpRegister(http.MethodPost, "/control/profiles/add", clients.handleAddProfile)
+	httpRegister(http.MethodPost, "/control/profiles/delete", clients.handleDelProfile)
+	httpRegister(http.MethodPost, "/control/profiles/update", clients.handleUpdateProfile)
 }
@@ -0,0 +1,91 @@
+package home
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// cliTokenFile is the name of the file within the data directory which
+// contains the token used by the command-line client to access the HTTP API.
+const cliTokenFile = "cli_token"
+
+// cliTokenLen is the length of the token in bytes before encoding.
+const cliTokenLen = 32
+
+// initCLIToken generates a new token for the command-line client and writes it
+// into the data directory, which must exist.  Only the users who can read the
+// file can use the token.
+func initCLIToken() {
+	b := make([]byte, cliTokenLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Error("generating cli token: %s", err)
+
+		return
+	}
+
+	token := hex.EncodeToString(b)
+	err = ioutil.WriteFile(filepath.Join(Context.getDataDir(), cliTokenFile), []byte(token), 0o600)
+	if err != nil {
+		log.Error("writing cli token: %s", err)
+
+		return
+	}
+
+	Context.cliToken = token
+}
+
+// isLocalRequest returns true if r has been sent from the same host.
+func isLocalRequest(r *http.Request) (ok bool) {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+
+	if ip.IsLoopback() {
+		return true
+	}
+
+	// The client may also connect to one of the addresses of this host.
+	laddr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	if !ok {
+		return false
+	}
+
+	lhost, _, err := net.SplitHostPort(laddr.String())
+	if err != nil {
+		return false
+	}
+
+	return ip.Equal(net.ParseIP(lhost))
+}
+
+// checkCLIToken returns true if r is a local request authorized with the token
+// of the command-line client.
+func checkCLIToken(r *http.Request) (ok bool) {
+	token := Context.cliToken
+	if token == "" {
+		return false
+	}
+
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) || !isLocalRequest(r) {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare([]byte(h[len(prefix):]), []byte(token)) == 1
+}
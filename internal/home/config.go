@@ -9,6 +9,7 @@ import (
 	"path/filepath"
 	"sync"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -52,6 +53,55 @@ type configuration struct {
 	RlimitNoFile uint   `yaml:"rlimit_nofile"`  // Maximum number of opened fd's per process (0: default)
 	DebugPProf   bool   `yaml:"debug_pprof"`    // Enable pprof HTTP server on port 6060
 
+	// APITokens are the bearer tokens for the HTTP API.
+	APITokens []APIToken `yaml:"api_tokens"`
+
+	// InstanceConflict defines what an instance started with an ID does
+	// when another live instance is the primary one: "refuse" to start,
+	// which is the default, or run as a "follower", which doesn't write
+	// the shared state.
+	InstanceConflict string `yaml:"instance_conflict"`
+
+	// ExecHooks are the external commands run on the events, such as the
+	// protection being disabled.
+	ExecHooks execHooksConfig `yaml:"exec_hooks"`
+
+	// MemoryBudgetMB is the total amount of memory in megabytes which the
+	// filtering caches, the query log buffer, and the statistics are allowed
+	// to use.  Zero means no limit.
+	MemoryBudgetMB uint64 `yaml:"memory_budget_mb"`
+
+	// Timezone is the IANA name of the timezone of the timestamps in the
+	// HTTP API and of the days in the statistics.  Empty means the timezone
+	// of the system.
+	Timezone string `yaml:"timezone"`
+
+	// LegacyTimeFormat makes the HTTP API format the timestamps as it did
+	// before the timezone has been added.  It will be removed in the next
+	// release.
+	LegacyTimeFormat bool `yaml:"legacy_time_format"`
+
+	// Outbound defines the connections to the external hosts, which AdGuard
+	// Home makes on its own.
+	Outbound outboundConfig `yaml:"outbound"`
+
+	// StrictAPI defines which HTTP API requests with the parameters unknown
+	// to the endpoints are rejected.
+	StrictAPI strictAPIConfig `yaml:"strict_api"`
+
+	// PublicStats defines the unauthenticated endpoint serving the reduced
+	// statistics.
+	PublicStats publicStatsConfig `yaml:"public_stats"`
+
+	// PINBypass defines the temporary bypasses of the blocked services and
+	// the parental control, which the clients create with the PIN.
+	PINBypass pinBypassConfig `yaml:"pin_bypass"`
+
+	// ReadOnlyWebhookURL, if not empty, is the URL to which the
+	// notifications about the file system becoming read-only and writable
+	// again are POSTed.
+	ReadOnlyWebhookURL string `yaml:"read_only_webhook_url"`
+
 	// TTL for a web session (in hours)
 	// An active session is automatically refreshed once a day.
 	WebSessionTTLHours uint32 `yaml:"web_session_ttl"`
@@ -63,11 +113,24 @@ type configuration struct {
 	WhitelistFilters []filter `yaml:"whitelist_filters"`
 	UserRules        []string `yaml:"user_rules"`
 
+	// FilterGroups are the global states of the groups of the filter
+	// lists.  See filterGroup.
+	FilterGroups []filterGroup `yaml:"filter_groups"`
+
 	DHCP dhcpd.ServerConfig `yaml:"dhcp"`
 
 	// Note: this array is filled only before file read/write and then it's cleared
 	Clients []clientObject `yaml:"clients"`
 
+	// RuntimeClientsTTLHours is the period in hours, after which the
+	// clients discovered by rDNS and WHOIS, which haven't sent any requests,
+	// are removed.  Zero means never.
+	RuntimeClientsTTLHours uint32 `yaml:"runtime_clients_ttl"`
+
+	// Profiles are the profiles of the clients.  Like Clients, it's only
+	// filled before reading and writing the file.
+	Profiles []*Profile `yaml:"profiles"`
+
 	logSettings `yaml:",inline"`
 
 	sync.RWMutex `yaml:"-"`
@@ -80,14 +143,45 @@ type dnsConfig struct {
 	BindHosts []net.IP `yaml:"bind_hosts"`
 	Port      int      `yaml:"port"`
 
+	// BindInterfaces are the names of the network interfaces, on the
+	// current addresses of which the DNS server listens in addition to
+	// BindHosts.  The server is rebound once those addresses change.
+	BindInterfaces []string `yaml:"bind_interfaces"`
+
 	// time interval for statistics (in days)
 	StatsInterval uint32 `yaml:"statistics_interval"`
 
+	// StatsTopLimit is the maximum number of the distinct domains and
+	// clients tracked per hour for each of the top lists of the
+	// statistics.
+	StatsTopLimit int `yaml:"statistics_top_limit"`
+
+	// StatsAlerts are the alert rules evaluated against the statistics.
+	StatsAlerts []stats.AlertRule `yaml:"statistics_alerts"`
+
+	// HijackWebhookURL, if not empty, is the URL to which the notifications
+	// about the plain DNS upstreams becoming hijacked by the network and
+	// stopping being hijacked are POSTed.
+	HijackWebhookURL string `yaml:"hijack_webhook_url"`
+
 	QueryLogEnabled     bool   `yaml:"querylog_enabled"`      // if true, query log is enabled
 	QueryLogFileEnabled bool   `yaml:"querylog_file_enabled"` // if true, query log will be written to a file
 	QueryLogInterval    uint32 `yaml:"querylog_interval"`     // time interval for query log (in days)
 	QueryLogMemSize     uint32 `yaml:"querylog_size_memory"`  // number of entries kept in memory before they are flushed to disk
 	AnonymizeClientIP   bool   `yaml:"anonymize_client_ip"`   // anonymize clients' IP addresses in logs and stats
+	AnonymizeClientPort bool   `yaml:"anonymize_client_port"` // don't record clients' source ports in logs
+
+	// QueryLogAnonymizeAfterHours is the age in hours after which the query
+	// log entries are anonymized.  Zero means never.
+	QueryLogAnonymizeAfterHours uint32 `yaml:"querylog_anonymize_after_hours"`
+
+	// QueryLogMode defines the requests written to the query log.  The
+	// statistics still count all requests.
+	QueryLogMode querylog.Mode `yaml:"querylog_mode"`
+
+	// QueryLogMaxFiles is the maximum number of the rotated query log
+	// files kept.
+	QueryLogMaxFiles uint32 `yaml:"querylog_max_files"`
 
 	dnsforward.FilteringConfig `yaml:",inline"`
 
@@ -95,6 +189,11 @@ type dnsConfig struct {
 	FiltersUpdateIntervalHours uint32           `yaml:"filters_update_interval"` // time period to update filters (in hours)
 	DnsfilterConf              dnsfilter.Config `yaml:",inline"`
 
+	// AllowPrivateLists allows downloading the filter lists from the
+	// private and special-purpose addresses and the addresses of this
+	// machine.
+	AllowPrivateLists bool `yaml:"allow_private_lists"`
+
 	// LocalDomainName is the domain name used for known internal hosts.
 	// For example, a machine called "myhost" can be addressed as
 	// "myhost.lan" when LocalDomainName is "lan".
@@ -116,6 +215,11 @@ type tlsConfigSettings struct {
 	PortDNSOverTLS  int    `yaml:"port_dns_over_tls" json:"port_dns_over_tls,omitempty"`   // DNS-over-TLS port. If 0, DOT will be disabled
 	PortDNSOverQUIC int    `yaml:"port_dns_over_quic" json:"port_dns_over_quic,omitempty"` // DNS-over-QUIC port. If 0, DoQ will be disabled
 
+	// ServeHTTP3 enables serving DNS-over-HTTPS and the web interface over
+	// HTTP/3 as well, on the UDP port with the same number as PortHTTPS.
+	// It doesn't affect the other versions of HTTP.
+	ServeHTTP3 bool `yaml:"serve_http3" json:"serve_http3"`
+
 	// PortDNSCrypt is the port for DNSCrypt requests.  If it's zero,
 	// DNSCrypt is disabled.
 	PortDNSCrypt int `yaml:"port_dnscrypt" json:"port_dnscrypt"`
@@ -137,10 +241,21 @@ var config = configuration{
 	BindPort:     3000,
 	BetaBindPort: 0,
 	BindHost:     net.IP{0, 0, 0, 0},
+	StrictAPI: strictAPIConfig{
+		JSON: true,
+	},
+	PublicStats: publicStatsConfig{
+		RequestsPerMinute: 30,
+	},
+	PINBypass: pinBypassConfig{
+		DurationMinutes: defaultPINBypassMinutes,
+		MaxAttempts:     defaultPINBypassAttempts,
+	},
 	DNS: dnsConfig{
 		BindHosts:     []net.IP{{0, 0, 0, 0}},
 		Port:          53,
 		StatsInterval: 1,
+		StatsTopLimit: 10_000,
 		FilteringConfig: dnsforward.FilteringConfig{
 			ProtectionEnabled:  true,      // whether or not use any of dnsfilter features
 			BlockingMode:       "default", // mode how to answer filtered requests
@@ -154,12 +269,31 @@ var config = configuration{
 			// https://github.com/AdguardTeam/AdGuardHome/issues/2015#issuecomment-674041912
 			// was later increased to 300 due to https://github.com/AdguardTeam/AdGuardHome/issues/2257
 			MaxGoroutines: 300,
+
+			// The ceiling on the requests processed simultaneously
+			// over all protocols, including DNS-over-HTTPS, which
+			// isn't limited by MaxGoroutines.
+			MaxInflightQueries: 1000,
+			InflightQueueSize:  1000,
+
+			// Resolve the identical queries sent by the browsers
+			// at once with a single upstream exchange.
+			CoalesceQueries: true,
+
+			// Tell the clients why the requests are blocked or
+			// failed.
+			EnableEDE: true,
+
+			// Answer the requests which take too long with SERVFAIL
+			// before the clients give up on them.
+			QueryBudgetMs: 5000,
 		},
 		FilteringEnabled:           true, // whether or not use filter lists
 		FiltersUpdateIntervalHours: 24,
 		LocalDomainName:            "lan",
 		ResolveClients:             true,
 	},
+	RuntimeClientsTTLHours: defaultRuntimeClientsTTLHours,
 	TLS: tlsConfigSettings{
 		PortHTTPS:       443,
 		PortDNSOverTLS:  853, // needs to be passed through to dnsproxy
@@ -183,11 +317,14 @@ func initConfig() {
 	config.DNS.QueryLogFileEnabled = true
 	config.DNS.QueryLogInterval = 90
 	config.DNS.QueryLogMemSize = 1000
+	config.DNS.QueryLogMaxFiles = 1
 
 	config.DNS.CacheSize = 4 * 1024 * 1024
 	config.DNS.DnsfilterConf.SafeBrowsingCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.SafeSearchCacheSize = 1 * 1024 * 1024
 	config.DNS.DnsfilterConf.ParentalCacheSize = 1 * 1024 * 1024
+	config.DNS.DnsfilterConf.MatchCacheSize = 10_000
+	config.DNS.DnsfilterConf.RewritePrecedence = dnsfilter.RewritePrecedenceBlock
 	config.DNS.DnsfilterConf.CacheTime = 30
 	config.Filters = defaultFilters()
 
@@ -239,6 +376,11 @@ func parseConfig() error {
 		return err
 	}
 	config.fileData = nil
+	yamlFile, err = decryptConfig(Context.secrets, yamlFile)
+	if err != nil {
+		return fmt.Errorf("decrypting config: %w", err)
+	}
+
 	err = yaml.Unmarshal(yamlFile, &config)
 	if err != nil {
 		log.Error("Couldn't parse config file: %s", err)
@@ -271,7 +413,46 @@ func (c *configuration) write() error {
 	c.Lock()
 	defer c.Unlock()
 
-	Context.clients.WriteDiskConfig(&config.Clients)
+	if Context.instance.isFollower() {
+		log.Debug("instance: follower, not writing the configuration file")
+
+		return nil
+	}
+
+	configFile := config.getConfigFilename()
+	log.Debug("Writing YAML file: %s", configFile)
+	yamlText, err := c.marshal()
+	if err != nil {
+		log.Error("Couldn't generate YAML file: %s", err)
+
+		return err
+	}
+
+	yamlText, err = encryptConfig(Context.secrets, yamlText)
+	if err != nil {
+		log.Error("Couldn't encrypt secrets: %s", err)
+
+		return err
+	}
+
+	err = maybe.WriteFile(configFile, yamlText, 0o644)
+	if err != nil {
+		// The configuration writer reports the read-only file system
+		// once, see writeGuards.
+		if !aghos.IsReadOnly(err) {
+			log.Error("Couldn't save YAML config: %s", err)
+		}
+
+		return err
+	}
+
+	return nil
+}
+
+// marshal updates the configuration with the current settings of the modules
+// and returns it as YAML.  c must be locked.
+func (c *configuration) marshal() (data []byte, err error) {
+	Context.clients.WriteDiskConfig(&config.Clients, &config.Profiles)
 
 	if Context.auth != nil {
 		config.Users = Context.auth.GetUsers()
@@ -286,6 +467,7 @@ func (c *configuration) write() error {
 		sdc := stats.DiskConfig{}
 		Context.stats.WriteDiskConfig(&sdc)
 		config.DNS.StatsInterval = sdc.Interval
+		config.DNS.StatsAlerts = sdc.Alerts
 	}
 
 	if Context.queryLog != nil {
@@ -296,6 +478,10 @@ func (c *configuration) write() error {
 		config.DNS.QueryLogInterval = dc.RotationIvl
 		config.DNS.QueryLogMemSize = dc.MemSize
 		config.DNS.AnonymizeClientIP = dc.AnonymizeClientIP
+		config.DNS.AnonymizeClientPort = dc.AnonymizeClientPort
+		config.DNS.QueryLogAnonymizeAfterHours = dc.AnonymizeAfterHours
+		config.DNS.QueryLogMode = dc.Mode
+		config.DNS.QueryLogMaxFiles = dc.MaxFiles
 	}
 
 	if Context.dnsFilter != nil {
@@ -318,22 +504,9 @@ func (c *configuration) write() error {
 		config.DHCP = c
 	}
 
-	configFile := config.getConfigFilename()
-	log.Debug("Writing YAML file: %s", configFile)
-	yamlText, err := yaml.Marshal(&config)
+	data, err = yaml.Marshal(&config)
 	config.Clients = nil
-	if err != nil {
-		log.Error("Couldn't generate YAML file: %s", err)
-
-		return err
-	}
-
-	err = maybe.WriteFile(configFile, yamlText, 0o644)
-	if err != nil {
-		log.Error("Couldn't save YAML config: %s", err)
+	config.Profiles = nil
 
-		return err
-	}
-
-	return nil
+	return data, err
 }
@@ -0,0 +1,122 @@
+package home
+
+import (
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+)
+
+// configWriteDelay is the time the configuration changes are collected before
+// the configuration file is written.
+const configWriteDelay = 1 * time.Second
+
+// configWriter coalesces the writes of the configuration file, so that a burst
+// of changes causes a single write.  The changes themselves are applied to the
+// in-memory configuration immediately.
+type configWriter struct {
+	// write writes the configuration file.
+	write func() (err error)
+
+	// guard, if not nil, tracks the writes, so that those are retried once
+	// in aghos.ReadOnlyRetryIvl while the file system is read-only.
+	guard *aghos.WriteGuard
+
+	// writeMu serializes the writes.
+	writeMu sync.Mutex
+
+	// mu protects the fields below.
+	mu sync.Mutex
+
+	// timer is the scheduled write, if any.
+	timer *time.Timer
+
+	// lastWritten is the time of the last successful write.
+	lastWritten time.Time
+
+	// delay is the time a write is postponed by.
+	delay time.Duration
+
+	// dirty is true if there are changes which aren't written yet.
+	dirty bool
+}
+
+// newConfigWriter returns a new configWriter which writes the configuration
+// using write at most once in delay.  lastWritten is the time the file has
+// been written before.
+func newConfigWriter(write func() (err error), delay time.Duration, lastWritten time.Time) (w *configWriter) {
+	return &configWriter{
+		write:       write,
+		lastWritten: lastWritten,
+		delay:       delay,
+	}
+}
+
+// markDirty schedules writing the configuration unless it's already scheduled.
+func (w *configWriter) markDirty() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.dirty = true
+	if w.timer == nil {
+		w.timer = time.AfterFunc(w.delay, func() {
+			_ = w.flush()
+		})
+	}
+}
+
+// flush writes the configuration immediately if there are any unwritten
+// changes.  It's used on shutdown and before the changes requiring a restart.
+func (w *configWriter) flush() (err error) {
+	w.writeMu.Lock()
+	defer w.writeMu.Unlock()
+
+	w.mu.Lock()
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+
+	dirty := w.dirty
+	w.dirty = false
+	w.mu.Unlock()
+
+	if !dirty {
+		return nil
+	}
+
+	now := time.Now()
+	err = w.write()
+	memOnly := w.guard.Report(err, now)
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err != nil {
+		// Don't retry in a loop, the next change or the shutdown will
+		// try again.  The changes kept while the file system is
+		// read-only are retried later, since there may be none of
+		// those.
+		w.dirty = true
+		if memOnly && w.timer == nil {
+			w.timer = time.AfterFunc(aghos.ReadOnlyRetryIvl, func() {
+				_ = w.flush()
+			})
+		}
+
+		return err
+	}
+
+	w.lastWritten = time.Now()
+
+	return nil
+}
+
+// state returns the time of the last successful write and whether there are
+// any unwritten changes.
+func (w *configWriter) state() (lastWritten time.Time, pending bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.lastWritten, w.dirty
+}
@@ -0,0 +1,103 @@
+package home
+
+import (
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConfigWriter(t *testing.T) {
+	var writes int32
+	written := make(chan struct{}, 10)
+	write := func() (err error) {
+		atomic.AddInt32(&writes, 1)
+		written <- struct{}{}
+
+		return nil
+	}
+
+	t.Run("coalesce", func(t *testing.T) {
+		atomic.StoreInt32(&writes, 0)
+		w := newConfigWriter(write, 10*time.Millisecond, time.Time{})
+
+		for i := 0; i < 5; i++ {
+			w.markDirty()
+		}
+
+		_, pending := w.state()
+		assert.True(t, pending)
+
+		select {
+		case <-written:
+		case <-time.After(time.Second):
+			t.Fatal("config hasn't been written")
+		}
+
+		last, pending := w.state()
+		assert.False(t, pending)
+		assert.False(t, last.IsZero())
+		assert.EqualValues(t, 1, atomic.LoadInt32(&writes))
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		atomic.StoreInt32(&writes, 0)
+		w := newConfigWriter(write, time.Hour, time.Time{})
+
+		// Nothing to write.
+		require.NoError(t, w.flush())
+		assert.Zero(t, atomic.LoadInt32(&writes))
+
+		w.markDirty()
+		require.NoError(t, w.flush())
+		<-written
+
+		_, pending := w.state()
+		assert.False(t, pending)
+		assert.EqualValues(t, 1, atomic.LoadInt32(&writes))
+	})
+
+	t.Run("error", func(t *testing.T) {
+		w := newConfigWriter(func() (err error) {
+			return assert.AnError
+		}, time.Hour, time.Time{})
+
+		w.markDirty()
+		assert.ErrorIs(t, w.flush(), assert.AnError)
+
+		last, pending := w.state()
+		assert.True(t, pending)
+		assert.True(t, last.IsZero())
+	})
+
+	t.Run("read_only", func(t *testing.T) {
+		var writeErr error = &os.PathError{Op: "open", Path: "AdGuardHome.yaml", Err: syscall.EROFS}
+		w := newConfigWriter(func() (err error) {
+			return writeErr
+		}, time.Hour, time.Time{})
+		w.guard = aghos.NewWriteGuard("config", nil)
+
+		w.markDirty()
+		require.Error(t, w.flush())
+		assert.True(t, w.guard.MemoryOnly())
+
+		// The retry is scheduled even without any further changes.
+		w.mu.Lock()
+		retry := w.timer
+		w.mu.Unlock()
+		require.NotNil(t, retry)
+		retry.Stop()
+
+		writeErr = nil
+		require.NoError(t, w.flush())
+		assert.False(t, w.guard.MemoryOnly())
+
+		_, pending := w.state()
+		assert.False(t, pending)
+	})
+}
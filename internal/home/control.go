@@ -7,11 +7,16 @@ import (
 	"net/http"
 	"net/url"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
 	"github.com/AdguardTeam/AdGuardHome/internal/version"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/NYTimes/gziphandler"
@@ -84,13 +89,9 @@ func appendDNSAddrsWithIfaces(dst []string, src []net.IP) (res []string, err err
 // collectDNSAddresses returns the list of DNS addresses the server is listening
 // on, including the addresses on all interfaces in cases of unspecified IPs.
 func collectDNSAddresses() (addrs []string, err error) {
-	if hosts := config.DNS.BindHosts; len(hosts) == 0 {
-		addrs = appendDNSAddrs(addrs, net.IP{127, 0, 0, 1})
-	} else {
-		addrs, err = appendDNSAddrsWithIfaces(addrs, hosts)
-		if err != nil {
-			return nil, fmt.Errorf("collecting dns addresses: %w", err)
-		}
+	addrs, err = appendDNSAddrsWithIfaces(addrs, dnsListenHosts(&config.DNS))
+	if err != nil {
+		return nil, fmt.Errorf("collecting dns addresses: %w", err)
 	}
 
 	de := getDNSEncryption()
@@ -121,6 +122,70 @@ type statusResponse struct {
 	IsRunning       bool   `json:"running"`
 	Version         string `json:"version"`
 	Language        string `json:"language"`
+
+	// Warnings are the descriptions of the firing statistics alerts.
+	Warnings []string `json:"warnings,omitempty"`
+
+	// Serving describes the state which is used to answer the queries.
+	Serving *servingJSON `json:"serving,omitempty"`
+
+	// ConfigWrittenAt is the time the configuration file has last been
+	// written.  It's empty if it hasn't been written since the start.
+	ConfigWrittenAt string `json:"config_written_at"`
+
+	// ConfigWritePending is true if there are changes of the
+	// configuration which aren't written to the file yet.
+	ConfigWritePending bool `json:"config_write_pending"`
+
+	// MemoryOnly are the names of the subsystems keeping their data in
+	// memory only, since the file system is read-only.
+	MemoryOnly []string `json:"memory_only,omitempty"`
+
+	// Instance is the state of the instance sharing the working directory
+	// with other ones, if it's started with an ID.
+	Instance *instanceJSON `json:"instance,omitempty"`
+
+	// ExecHooks is the state of the external commands run on the events,
+	// if those are enabled.
+	ExecHooks *execHooksJSON `json:"exec_hooks,omitempty"`
+
+	// NetworkChanges are the recent changes of the network interfaces and
+	// the actions taken on them, the latest first.
+	NetworkChanges []netChangeJSON `json:"network_changes,omitempty"`
+
+	// SafeMode is true if AdGuard Home is started with --safe-mode.
+	SafeMode bool `json:"safe_mode"`
+
+	// QueryLogRotation is the state of the rotation of the query log
+	// files, if those are written.
+	QueryLogRotation *querylog.RotationState `json:"querylog_rotation,omitempty"`
+
+	// ListenRollback is the last rollback of the listen addresses which
+	// couldn't be used, if any.
+	ListenRollback *listenRollbackJSON `json:"listen_rollback,omitempty"`
+}
+
+// servingJSON describes the state which is used to answer the queries.
+type servingJSON struct {
+	// Filtering is the current filtering engine.
+	Filtering dnsfilter.EngineGeneration `json:"filtering"`
+
+	// UpstreamsFromSnapshot is true if the upstreams are taken from the
+	// last known good snapshot, because the configured ones can't be
+	// loaded.
+	UpstreamsFromSnapshot bool `json:"upstreams_from_snapshot"`
+
+	// CacheWarmup is the state of the warm-up of the cache after the
+	// start.
+	CacheWarmup dnsforward.CacheWarmupStatus `json:"cache_warmup"`
+
+	// Fragmentation is the state of the detection of the dropped
+	// fragmented UDP responses.
+	Fragmentation dnsforward.FragmentationStatus `json:"fragmentation"`
+
+	// Hijacking is the state of the detection of the plain DNS upstreams
+	// hijacked by the network.
+	Hijacking dnsforward.HijackStatus `json:"hijacking"`
 }
 
 func handleStatus(w http.ResponseWriter, _ *http.Request) {
@@ -140,6 +205,16 @@ func handleStatus(w http.ResponseWriter, _ *http.Request) {
 		IsRunning: isRunning(),
 		Version:   version.Version(),
 		Language:  config.Language,
+		Instance:  Context.instance.status(),
+		ExecHooks: Context.execHooks.status(),
+
+		NetworkChanges: Context.netChanges.status(),
+		SafeMode:       Context.safeMode,
+		ListenRollback: Context.listenChecks.status(),
+	}
+
+	if Context.web != nil && Context.safeMode {
+		resp.HTTPPort = Context.web.conf.BindPort
 	}
 
 	var c *dnsforward.FilteringConfig
@@ -147,6 +222,43 @@ func handleStatus(w http.ResponseWriter, _ *http.Request) {
 		c = &dnsforward.FilteringConfig{}
 		Context.dnsServer.WriteDiskConfig(c)
 		resp.IsProtectionEnabled = c.ProtectionEnabled
+
+		resp.Serving = &servingJSON{}
+		_, resp.Serving.UpstreamsFromSnapshot = Context.dnsServer.Upstreams()
+		resp.Serving.CacheWarmup = Context.dnsServer.CacheWarmup()
+		resp.Serving.Fragmentation = Context.dnsServer.Fragmentation()
+		resp.Serving.Hijacking = Context.dnsServer.Hijacking()
+		if Context.dnsFilter != nil {
+			resp.Serving.Filtering = Context.dnsFilter.Generation()
+		}
+	}
+
+	if Context.stats != nil {
+		resp.Warnings = Context.stats.AlertWarnings()
+	}
+
+	if Context.queryLog != nil {
+		resp.QueryLogRotation = Context.queryLog.Rotation()
+	}
+
+	resp.Warnings = append(resp.Warnings, hijackWarnings()...)
+
+	if warn, ok := Context.writeGuards.warning(); ok {
+		resp.Warnings = append(resp.Warnings, warn)
+	}
+
+	resp.MemoryOnly, _ = Context.writeGuards.memoryOnly()
+
+	if Context.safeMode {
+		resp.Warnings = append([]string{safeModeWarning}, resp.Warnings...)
+	}
+
+	if Context.configWriter != nil {
+		var written time.Time
+		written, resp.ConfigWritePending = Context.configWriter.state()
+		if !written.IsZero() {
+			resp.ConfigWrittenAt = aghtime.Format(written, time.RFC3339)
+		}
 	}
 
 	// IsDHCPAvailable field is now false by default for Windows.
@@ -165,12 +277,16 @@ func handleStatus(w http.ResponseWriter, _ *http.Request) {
 
 type profileJSON struct {
 	Name string `json:"name"`
+	Role Role   `json:"role"`
 }
 
 func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 	pj := profileJSON{}
 	u := Context.auth.getCurrentUser(r)
 	pj.Name = u.Name
+	if p, ok := requestPrincipal(r); ok {
+		pj.Role = p.role
+	}
 
 	data, err := json.Marshal(pj)
 	if err != nil {
@@ -185,15 +301,37 @@ func handleGetProfile(w http.ResponseWriter, r *http.Request) {
 // ------------------------
 func registerControlHandlers() {
 	httpRegister(http.MethodGet, "/control/status", handleStatus)
+	sh := &summaryHandler{}
+	httpRegister(http.MethodGet, "/control/summary", sh.handleSummary)
 	httpRegister(http.MethodPost, "/control/i18n/change_language", handleI18nChangeLanguage)
 	httpRegister(http.MethodGet, "/control/i18n/current_language", handleI18nCurrentLanguage)
 	Context.mux.HandleFunc("/control/version.json", postInstall(optionalAuth(handleGetVersionJSON)))
 	httpRegister(http.MethodPost, "/control/update", handleUpdate)
+	httpRegister(http.MethodPost, "/control/restart", handleRestart)
 	httpRegister(http.MethodGet, "/control/profile", handleGetProfile)
+	httpRegister(http.MethodGet, "/control/debug/runtime", handleDebugRuntime)
+	httpRegister(http.MethodGet, "/control/debug/api_stats", handleDebugAPIStats)
+	httpRegister(http.MethodGet, "/control/doctor", handleDoctor)
+	httpRegister(http.MethodGet, "/control/support_bundle", handleSupportBundle)
+	httpRegister(http.MethodGet, "/control/effective_config", handleEffectiveConfig)
+	httpRegister(http.MethodPost, "/control/check_listen", handleCheckListen)
+	httpRegister(http.MethodPost, "/control/listen_config", handleListenConfig)
+	registerOutboundHandlers()
+
+	// The v1 API is served by the unversioned endpoints, see handleAPIV1.
+	Context.mux.HandleFunc(apiV1Prefix, handleAPIV1)
 
 	// No auth is necessary for DOH/DOT configurations
 	Context.mux.HandleFunc("/apple/doh.mobileconfig", postInstall(handleMobileConfigDOH))
 	Context.mux.HandleFunc("/apple/dot.mobileconfig", postInstall(handleMobileConfigDOT))
+
+	// The public statistics are served without auth if enabled.
+	psh := &publicStatsHandler{}
+	Context.mux.Handle("/control/stats_public", postInstallHandler(ensureHandler(http.MethodGet, psh.ServeHTTP)))
+
+	// The clients submit the PIN without auth, see handlePINBypass.
+	Context.mux.Handle("/control/pin_bypass", postInstallHandler(ensureHandler(http.MethodPost, Context.pinBypasses.handlePINBypass)))
+	httpRegister(http.MethodPost, "/control/pin_bypass/config", Context.pinBypasses.handlePINBypassConfig)
 	RegisterAuthHandlers()
 }
 
@@ -204,7 +342,60 @@ func httpRegister(method, url string, handler func(http.ResponseWriter, *http.Re
 		return
 	}
 
-	Context.mux.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(ensureHandler(method, handler)))))
+	hs, ok := Context.apiHandlers[url]
+	if !ok {
+		hs = methodHandlers{}
+		Context.apiHandlers[url] = hs
+		Context.mux.Handle(url, postInstallHandler(optionalAuthHandler(gziphandler.GzipHandler(hs))))
+	}
+
+	hs[method] = &apiRoute{
+		handler: ensureHandler(method, handler),
+		stats:   &routeStats{},
+		role:    requiredRole(method, url),
+	}
+}
+
+// apiRoute is a handler of the HTTP API with its metadata.
+type apiRoute struct {
+	handler http.Handler
+
+	// stats are the statistics of the requests to the handler.
+	stats *routeStats
+
+	// role is the role required to use the handler.
+	role Role
+}
+
+// methodHandlers are the handlers of a single URL of the HTTP API by method.
+// They allow registering several methods for the same URL, which
+// http.ServeMux doesn't.
+type methodHandlers map[string]*apiRoute
+
+// ServeHTTP implements the http.Handler interface for methodHandlers.
+func (hs methodHandlers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	route, ok := hs[r.Method]
+	if !ok {
+		methods := make([]string, 0, len(hs))
+		for m := range hs {
+			methods = append(methods, m)
+		}
+		sort.Strings(methods)
+
+		http.Error(w, "This request must be "+strings.Join(methods, " or "), http.StatusMethodNotAllowed)
+
+		return
+	}
+
+	start := time.Now()
+	rec := &statusRecorder{ResponseWriter: w}
+	defer func() { route.stats.record(rec.status(), time.Since(start)) }()
+
+	if !checkRole(rec, r, route.role) || !checkParams(rec, r) {
+		return
+	}
+
+	route.handler.ServeHTTP(rec, r)
 }
 
 // ----------------------------------
@@ -294,7 +485,9 @@ func handleHTTPSRedirect(w http.ResponseWriter, r *http.Request) (ok bool) {
 		return false
 	}
 
-	if r.TLS == nil && web.forceHTTPS {
+	// The command-line client connects over the loopback, so don't force it
+	// to use the certificate issued for the public name.
+	if r.TLS == nil && web.forceHTTPS && !checkCLIToken(r) {
 		hostPort := host
 		if port := web.conf.PortHTTPS; port != defaultHTTPSPort {
 			portStr := strconv.Itoa(port)
@@ -1,6 +1,8 @@
 package home
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -65,8 +67,59 @@ func TestValidateCertificates(t *testing.T) {
 		assert.Equal(t, "RSA", data.KeyType)
 		assert.Equal(t, "CN=AdGuard Home,O=AdGuard Ltd", data.Subject)
 		assert.Equal(t, "CN=AdGuard Home,O=AdGuard Ltd", data.Issuer)
-		assert.Equal(t, notBefore, data.NotBefore)
-		assert.Equal(t, notAfter, data.NotAfter)
+		assert.Equal(t, notBefore, data.NotBefore.Time)
+		assert.Equal(t, notAfter, data.NotAfter.Time)
 		assert.True(t, data.ValidPair)
 	})
 }
+
+func TestMethodHandlers(t *testing.T) {
+	hs := methodHandlers{
+		http.MethodGet: &apiRoute{
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("get"))
+			}),
+			stats: &routeStats{},
+			role:  RoleViewer,
+		},
+		http.MethodPut: &apiRoute{
+			handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				_, _ = w.Write([]byte("put"))
+			}),
+			stats: &routeStats{},
+			role:  RoleOperator,
+		},
+	}
+
+	testCases := []struct {
+		method   string
+		wantBody string
+		wantCode int
+	}{{
+		method:   http.MethodGet,
+		wantBody: "get",
+		wantCode: http.StatusOK,
+	}, {
+		method:   http.MethodPut,
+		wantBody: "put",
+		wantCode: http.StatusOK,
+	}, {
+		method:   http.MethodPost,
+		wantBody: "This request must be GET or PUT\n",
+		wantCode: http.StatusMethodNotAllowed,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.method, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(tc.method, "/control/test", nil)
+			hs.ServeHTTP(w, withPrincipal(r, principal{kind: "user", name: "admin", role: RoleAdmin}))
+
+			assert.Equal(t, tc.wantCode, w.Code)
+			assert.Equal(t, tc.wantBody, w.Body.String())
+		})
+	}
+
+	assert.EqualValues(t, 1, hs[http.MethodGet].stats.count)
+	assert.EqualValues(t, 1, hs[http.MethodPut].stats.count)
+}
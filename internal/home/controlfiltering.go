@@ -9,9 +9,13 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
-	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
 )
@@ -36,15 +40,24 @@ func validateFilterURL(urlStr string) (err error) {
 		return fmt.Errorf("checking filter url: invalid scheme %q", s)
 	}
 
+	err = validateFilterURLHost(url)
+	if err != nil {
+		return fmt.Errorf("checking filter url: %w", err)
+	}
+
 	return nil
 }
 
 type filterAddJSON struct {
 	Name      string `json:"name"`
 	URL       string `json:"url"`
+	Group     string `json:"group"`
 	Whitelist bool   `json:"whitelist"`
 }
 
+// errAllowlistGroup is returned when a group is set for an allowlist.
+const errAllowlistGroup agherr.Error = "groups are only supported for blocklists"
+
 func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request) {
 	fj := filterAddJSON{}
 	err := json.NewDecoder(r.Body).Decode(&fj)
@@ -61,6 +74,12 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if fj.Whitelist && fj.Group != "" {
+		httpError(w, http.StatusBadRequest, "%s", errAllowlistGroup)
+
+		return
+	}
+
 	// Check for duplicates
 	if filterExists(fj.URL) {
 		httpError(w, http.StatusBadRequest, "Filter URL already added -- %s", fj.URL)
@@ -75,6 +94,7 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 		white:   fj.Whitelist,
 	}
 	filt.ID = assignUniqueFilterID()
+	filt.Group = fj.Group
 
 	// Download the filter contents
 	ok, err := f.update(&filt)
@@ -95,6 +115,7 @@ func (f *Filtering) handleFilteringAddURL(w http.ResponseWriter, r *http.Request
 
 	onConfigModified()
 	enableFilters(true)
+	annotateStats(stats.AnnotationListAdded, filterTitle(&filt))
 
 	_, err = fmt.Fprintf(w, "OK %d rules\n", filt.RulesCount)
 	if err != nil {
@@ -143,6 +164,9 @@ func (f *Filtering) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 
 	onConfigModified()
 	enableFilters(true)
+	if deleted.URL != "" {
+		annotateStats(stats.AnnotationListRemoved, filterTitle(&deleted))
+	}
 
 	// NOTE: The old files "filter.txt.old" aren't deleted.  It's not really
 	// necessary, but will require the additional complicated code to run
@@ -159,6 +183,7 @@ func (f *Filtering) handleFilteringRemoveURL(w http.ResponseWriter, r *http.Requ
 type filterURLJSON struct {
 	Name    string `json:"name"`
 	URL     string `json:"url"`
+	Group   string `json:"group"`
 	Enabled bool   `json:"enabled"`
 }
 
@@ -184,11 +209,18 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if fj.Whitelist && fj.Data.Group != "" {
+		httpError(w, http.StatusBadRequest, "%s", errAllowlistGroup)
+
+		return
+	}
+
 	filt := filter{
 		Enabled: fj.Data.Enabled,
 		Name:    fj.Data.Name,
 		URL:     fj.Data.URL,
 	}
+	filt.Group = fj.Data.Group
 	status := f.filterSetProperties(fj.URL, filt, fj.Whitelist)
 	if (status & statusFound) == 0 {
 		http.Error(w, "URL doesn't exist", http.StatusBadRequest)
@@ -201,7 +233,7 @@ func (f *Filtering) handleFilteringSetURL(w http.ResponseWriter, r *http.Request
 
 	onConfigModified()
 	restart := false
-	if (status & statusEnabledChanged) != 0 {
+	if (status & (statusEnabledChanged | statusGroupChanged)) != 0 {
 		// we must add or remove filter rules
 		restart = true
 	}
@@ -232,9 +264,20 @@ func (f *Filtering) handleFilteringSetRules(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	config.UserRules = strings.Split(string(body), "\n")
+	lines := splitUserRules(string(body))
+	invalid := validateUserRules(lines)
+	if len(invalid) != 0 {
+		httpError(w, http.StatusBadRequest, "%s", invalid[0])
+
+		return
+	}
+
+	f.setUserRules(lines)
+
 	onConfigModified()
 	enableFilters(true)
+
+	writeRulesAnalysis(w, lines)
 }
 
 func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Request) {
@@ -275,6 +318,13 @@ func (f *Filtering) handleFilteringRefresh(w http.ResponseWriter, r *http.Reques
 	_, _ = w.Write(js)
 }
 
+// Filter list statuses.
+const (
+	filterStatusEnabled  = "enabled"
+	filterStatusDisabled = "disabled"
+	filterStatusFailed   = "failed"
+)
+
 type filterJSON struct {
 	ID          int64  `json:"id"`
 	Enabled     bool   `json:"enabled"`
@@ -282,6 +332,20 @@ type filterJSON struct {
 	Name        string `json:"name"`
 	RulesCount  uint32 `json:"rules_count"`
 	LastUpdated string `json:"last_updated"`
+
+	// Group is the name of the group of the list, if any.
+	Group string `json:"group,omitempty"`
+
+	// Hits is the number of the requests matched by the rules of the list
+	// since the start.
+	Hits uint64 `json:"hits"`
+
+	// Status is one of the filterStatus* constants.  It allows to tell
+	// lists disabled by user from the ones that couldn't be updated.
+	Status string `json:"status"`
+	// LastError is the message of the last error occurred while loading
+	// or updating the list, if any.
+	LastError string `json:"last_error,omitempty"`
 }
 
 type filteringConfig struct {
@@ -290,6 +354,18 @@ type filteringConfig struct {
 	Filters          []filterJSON `json:"filters"`
 	WhitelistFilters []filterJSON `json:"whitelist_filters"`
 	UserRules        []string     `json:"user_rules"`
+
+	// Groups are the states of the groups of the blocklists.  It's only
+	// sent in responses.
+	Groups []filterGroupJSON `json:"groups"`
+
+	// UserRulesRevision is the revision of the user rules.  It's only sent
+	// in responses.
+	UserRulesRevision uint64 `json:"user_rules_revision"`
+
+	// Bypasses are the active bypasses created with the PIN.  It's only
+	// sent in responses.
+	Bypasses []*pinBypassJSON `json:"bypasses"`
 }
 
 func filterToJSON(f filter) filterJSON {
@@ -299,10 +375,24 @@ func filterToJSON(f filter) filterJSON {
 		URL:        f.URL,
 		Name:       f.Name,
 		RulesCount: uint32(f.RulesCount),
+		Group:      f.Group,
 	}
 
 	if !f.LastUpdated.IsZero() {
-		fj.LastUpdated = f.LastUpdated.Format(time.RFC3339)
+		fj.LastUpdated = aghtime.Format(f.LastUpdated, time.RFC3339)
+	}
+
+	switch {
+	case !f.Enabled:
+		fj.Status = filterStatusDisabled
+	case f.lastErr != nil:
+		fj.Status = filterStatusFailed
+	default:
+		fj.Status = filterStatusEnabled
+	}
+
+	if f.lastErr != nil {
+		fj.LastError = f.lastErr.Error()
 	}
 
 	return fj
@@ -310,31 +400,42 @@ func filterToJSON(f filter) filterJSON {
 
 // Get filtering configuration
 func (f *Filtering) handleFilteringStatus(w http.ResponseWriter, r *http.Request) {
-	resp := filteringConfig{}
+	jsonVal, err := json.Marshal(f.status())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(jsonVal)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "http write: %s", err)
+	}
+}
+
+// status returns the current filtering status.
+func (f *Filtering) status() (resp filteringConfig) {
+	hits := Context.dnsFilter.FilterHits()
 	config.RLock()
 	resp.Enabled = config.DNS.FilteringEnabled
 	resp.Interval = config.DNS.FiltersUpdateIntervalHours
 	for _, f := range config.Filters {
 		fj := filterToJSON(f)
+		fj.Hits = hits[f.ID]
 		resp.Filters = append(resp.Filters, fj)
 	}
 	for _, f := range config.WhitelistFilters {
 		fj := filterToJSON(f)
+		fj.Hits = hits[f.ID]
 		resp.WhitelistFilters = append(resp.WhitelistFilters, fj)
 	}
+	resp.Groups = filterGroupsToJSON(hits)
 	resp.UserRules = config.UserRules
+	resp.UserRulesRevision = f.userRulesRev
 	config.RUnlock()
 
-	jsonVal, err := json.Marshal(resp)
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
-		return
-	}
-	w.Header().Set("Content-Type", "application/json")
-	_, err = w.Write(jsonVal)
-	if err != nil {
-		httpError(w, http.StatusInternalServerError, "http write: %s", err)
-	}
+	resp.Bypasses = Context.pinBypasses.list(time.Now())
+
+	return resp
 }
 
 // Set filtering configuration
@@ -363,8 +464,13 @@ type checkHostRespRule struct {
 }
 
 type checkHostResp struct {
+	// Reason is the legacy name of the filtering reason, kept for display.
 	Reason string `json:"reason"`
 
+	// ReasonCode is the stable machine-readable code of the filtering
+	// reason.
+	ReasonCode dnsfilter.ReasonCode `json:"reason_code"`
+
 	// FilterID is the ID of the rule's filter list.
 	//
 	// Deprecated: Use Rules[*].FilterListID.
@@ -386,8 +492,14 @@ type checkHostResp struct {
 }
 
 func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
-	q := r.URL.Query()
-	host := q.Get("name")
+	params := aghhttp.QueryParams(r.URL.Query())
+	params.Required("name")
+	host := params.String("name", "")
+	if err := params.Err(); err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
 
 	setts := Context.dnsFilter.GetConfig()
 	setts.FilteringEnabled = true
@@ -400,6 +512,7 @@ func (f *Filtering) handleCheckHost(w http.ResponseWriter, r *http.Request) {
 
 	resp := checkHostResp{}
 	resp.Reason = result.Reason.String()
+	resp.ReasonCode = result.Reason.Code()
 	resp.SvcName = result.ServiceName
 	resp.CanonName = result.CanonName
 	resp.IPList = result.IPList
@@ -433,9 +546,17 @@ func (f *Filtering) RegisterFilteringHandlers() {
 	httpRegister(http.MethodPost, "/control/filtering/add_url", f.handleFilteringAddURL)
 	httpRegister(http.MethodPost, "/control/filtering/remove_url", f.handleFilteringRemoveURL)
 	httpRegister(http.MethodPost, "/control/filtering/set_url", f.handleFilteringSetURL)
+	httpRegister(http.MethodPost, "/control/filtering/set_group", f.handleFilteringSetGroup)
 	httpRegister(http.MethodPost, "/control/filtering/refresh", f.handleFilteringRefresh)
 	httpRegister(http.MethodPost, "/control/filtering/set_rules", f.handleFilteringSetRules)
+	httpRegister(http.MethodGet, "/control/filtering/rules/export", f.handleFilteringRulesExport)
+	httpRegister(http.MethodPost, "/control/filtering/rules/import", f.handleFilteringRulesImport)
+	httpRegister(http.MethodPost, "/control/filtering/rules/batch", f.handleFilteringRulesBatch)
+	httpRegister(http.MethodGet, "/control/filtering/rules/analyze", f.handleFilteringRulesAnalyze)
 	httpRegister(http.MethodGet, "/control/filtering/check_host", f.handleCheckHost)
+	httpRegister(http.MethodGet, "/control/filtering/export", f.handleFilteringExport)
+	httpRegister(http.MethodPost, "/control/filtering/rule_from_entry", f.handleFilteringRuleFromEntry)
+	httpRegister(http.MethodPost, "/control/filtering/preview_url", f.handleFilteringPreviewURL)
 }
 
 func checkFiltersUpdateIntervalHours(i uint32) bool {
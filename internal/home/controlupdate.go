@@ -98,6 +98,9 @@ func handleUpdate(w http.ResponseWriter, _ *http.Request) {
 		return
 	}
 
+	// The new version reads the configuration from the file.
+	writeConfigNow()
+
 	err := Context.updater.Update()
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "%s", err)
@@ -7,8 +7,10 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
@@ -19,9 +21,30 @@ import (
 	yaml "gopkg.in/yaml.v2"
 )
 
-// Called by other modules when configuration is changed
+// onConfigModified is called by other modules when the configuration is
+// changed.  The configuration file is written shortly after, so that the
+// changes made in quick succession are written at once.
 func onConfigModified() {
-	_ = config.write()
+	if Context.configWriter == nil {
+		_ = config.write()
+
+		return
+	}
+
+	Context.configWriter.markDirty()
+}
+
+// writeConfigNow writes the changes of the configuration immediately.  It's
+// used before the changes which restart AdGuard Home or its servers.
+func writeConfigNow() {
+	if Context.configWriter == nil {
+		_ = config.write()
+
+		return
+	}
+
+	Context.configWriter.markDirty()
+	_ = Context.configWriter.flush()
 }
 
 // initDNSServer creates an instance of the dnsforward.Server
@@ -32,34 +55,58 @@ func initDNSServer() error {
 	baseDir := Context.getDataDir()
 
 	statsConf := stats.Config{
-		Filename:          filepath.Join(baseDir, "stats.db"),
+		Filename:          filepath.Join(baseDir, Context.instance.fileName("stats.db")),
 		LimitDays:         config.DNS.StatsInterval,
+		TopLimit:          config.DNS.StatsTopLimit,
 		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
 		ConfigModified:    onConfigModified,
 		HTTPRegister:      httpRegister,
+		HTTPClient:        newOutboundClient(aghnet.OutboundWebhooks),
+		Alerts:            config.DNS.StatsAlerts,
+		IngressPools:      ingressPools,
+		ForwardingLoops:   forwardingLoops,
+		ResponseLimits:    responseLimits,
+		Fragmentation:     fragmentation,
+		FilterCache:       filterCache,
+		BudgetExceeded:    budgetExceeded,
+		CacheRejections:   cacheRejections,
+		ClientName:        Context.clients.clientName,
+		WriteGuard:        Context.writeGuards.stats,
 	}
 	Context.stats, err = stats.New(statsConf)
 	if err != nil {
 		return fmt.Errorf("couldn't initialize statistics module")
 	}
 
+	queryLogPeerFiles := func() (fns []string) {
+		return Context.instance.peerFiles(baseDir, querylog.FileName)
+	}
 	conf := querylog.Config{
-		ConfigModified:    onConfigModified,
-		HTTPRegister:      httpRegister,
-		FindClient:        Context.clients.findMultiple,
-		BaseDir:           baseDir,
-		RotationIvl:       config.DNS.QueryLogInterval,
-		MemSize:           config.DNS.QueryLogMemSize,
-		Enabled:           config.DNS.QueryLogEnabled,
-		FileEnabled:       config.DNS.QueryLogFileEnabled,
-		AnonymizeClientIP: config.DNS.AnonymizeClientIP,
+		ConfigModified:      onConfigModified,
+		HTTPRegister:        httpRegister,
+		FindClient:          Context.clients.findMultiple,
+		BaseDir:             baseDir,
+		FileName:            Context.instance.fileName(querylog.FileName),
+		PeerFiles:           queryLogPeerFiles,
+		RotationIvl:         config.DNS.QueryLogInterval,
+		MemSize:             config.DNS.QueryLogMemSize,
+		MaxFiles:            config.DNS.QueryLogMaxFiles,
+		Enabled:             config.DNS.QueryLogEnabled,
+		FileEnabled:         config.DNS.QueryLogFileEnabled,
+		AnonymizeClientIP:   config.DNS.AnonymizeClientIP,
+		AnonymizeClientPort: config.DNS.AnonymizeClientPort,
+		AnonymizeAfterHours: config.DNS.QueryLogAnonymizeAfterHours,
+		Mode:                config.DNS.QueryLogMode,
+		WriteGuard:          Context.writeGuards.queryLog,
 	}
 	Context.queryLog = querylog.New(conf)
 
 	filterConf := config.DNS.DnsfilterConf
 	filterConf.EtcHosts = Context.etcHosts
+	filterConf.Outbound = Context.outbound
 	filterConf.ConfigModified = onConfigModified
 	filterConf.HTTPRegister = httpRegister
+	filterConf.FiltersApplied = onFiltersApplied
 	Context.dnsFilter = dnsfilter.New(&filterConf, nil)
 
 	p := dnsforward.DNSCreateParams{
@@ -81,6 +128,8 @@ func initDNSServer() error {
 	}
 
 	Context.clients.dnsServer = Context.dnsServer
+
+	initSnapshot()
 	dnsConfig, err := generateServerConfig()
 	if err != nil {
 		closeDNSServer()
@@ -94,13 +143,97 @@ func initDNSServer() error {
 		return fmt.Errorf("dnsServer.Prepare: %w", err)
 	}
 
-	Context.rdns = NewRDNS(Context.dnsServer, &Context.clients)
-	Context.whois = initWhois(&Context.clients)
+	lookupSem := make(chan struct{}, defaultLookupConcurrency)
+	Context.rdns = NewRDNS(Context.dnsServer, &Context.clients, lookupSem)
+	Context.whois = initWhois(&Context.clients, lookupSem)
 
 	Context.filters.Init()
+
+	Context.memManager = newMemManager()
+
 	return nil
 }
 
+// ingressPools returns the current state of the worker pools of the ingress
+// protocols of the DNS server.
+func ingressPools() (ps []stats.IngressPool) {
+	if Context.dnsServer == nil {
+		return []stats.IngressPool{}
+	}
+
+	return Context.dnsServer.IngressPools()
+}
+
+// forwardingLoops returns the number of the forwarding loops detected by the
+// DNS server.
+func forwardingLoops() (n uint64) {
+	if Context.dnsServer == nil {
+		return 0
+	}
+
+	return Context.dnsServer.ForwardingLoops()
+}
+
+// responseLimits returns the numbers of the responses affected by the
+// amplification protections of the DNS server.
+func responseLimits() (rl stats.ResponseLimits) {
+	if Context.dnsServer == nil {
+		return stats.ResponseLimits{}
+	}
+
+	return Context.dnsServer.ResponseLimits()
+}
+
+// fragmentation returns the counters of the detection of the dropped
+// fragmented UDP responses of the DNS server.
+func fragmentation() (f stats.Fragmentation) {
+	if Context.dnsServer == nil {
+		return stats.Fragmentation{}
+	}
+
+	return Context.dnsServer.FragmentationCounters()
+}
+
+// filterCache returns the counters of the cache of the filtering decisions.
+func filterCache() (fc stats.FilterCache) {
+	if Context.dnsFilter == nil {
+		return stats.FilterCache{}
+	}
+
+	s := Context.dnsFilter.MatchCacheStats()
+	fc = stats.FilterCache{
+		Hits:   s.Hits,
+		Misses: s.Misses,
+		Size:   s.Size,
+		Limit:  s.Limit,
+	}
+	if total := s.Hits + s.Misses; total > 0 {
+		fc.HitRate = float64(s.Hits) / float64(total)
+	}
+
+	return fc
+}
+
+// budgetExceeded returns the numbers of the requests of the DNS server which
+// have exceeded the time budget.
+func budgetExceeded() (be stats.BudgetExceeded) {
+	if Context.dnsServer == nil {
+		return stats.BudgetExceeded{}
+	}
+
+	return Context.dnsServer.BudgetExceeded()
+}
+
+// cacheRejections returns the numbers of the responses of the upstream servers
+// not cached by the DNS server.
+func cacheRejections() (cr stats.CacheRejections) {
+	if Context.dnsServer == nil {
+		return stats.CacheRejections{}
+	}
+
+	return Context.dnsServer.CacheRejections()
+}
+
 func isRunning() bool {
 	return Context.dnsServer != nil && Context.dnsServer.IsRunning()
 }
@@ -112,6 +245,8 @@ func onDNSRequest(d *proxy.DNSContext) {
 		return
 	}
 
+	Context.clients.markSeen(ip.String(), time.Now())
+
 	if config.DNS.ResolveClients && !ip.IsLoopback() {
 		Context.rdns.Begin(ip)
 	}
@@ -154,10 +289,7 @@ func ipsToUDPAddrs(ips []net.IP, port int) (udpAddrs []*net.UDPAddr) {
 
 func generateServerConfig() (newConf dnsforward.ServerConfig, err error) {
 	dnsConf := config.DNS
-	hosts := dnsConf.BindHosts
-	if len(hosts) == 0 {
-		hosts = []net.IP{{127, 0, 0, 1}}
-	}
+	hosts := dnsListenHosts(&dnsConf)
 
 	newConf = dnsforward.ServerConfig{
 		UDPListenAddrs:  ipsToUDPAddrs(hosts, dnsConf.Port),
@@ -193,6 +325,15 @@ func generateServerConfig() (newConf dnsforward.ServerConfig, err error) {
 	}
 
 	newConf.TLSv12Roots = Context.tlsRoots
+	newConf.LastKnownUpstreams = lastKnownUpstreams()
+	newConf.SafeMode = Context.safeMode
+	newConf.FilterListName = filterListName
+	if h := Context.execHooks; h != nil {
+		newConf.OnBlocked = h.onBlocked
+	}
+	newConf.OnProtectionChanged = onProtectionChanged
+	newConf.OnUpstreamsChanged = onUpstreamsChanged
+	newConf.OnHijackChanged = onHijackChanged
 	newConf.TLSCiphers = Context.tlsCiphers
 	newConf.TLSAllowUnencryptedDOH = tlsConf.AllowUnencryptedDOH
 
@@ -290,10 +431,11 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *dnsfilt
 	}
 
 	setts.ClientIP = clientAddr
+	setts.BypassedHosts = Context.pinBypasses.hosts(clientAddr, time.Now())
 
-	c, ok := Context.clients.Find(clientID)
+	c, matched, ok := Context.clients.findMatch(clientID)
 	if !ok {
-		c, ok = Context.clients.Find(clientAddr.String())
+		c, matched, ok = Context.clients.findMatch(clientAddr.String())
 		if !ok {
 			return
 		}
@@ -301,21 +443,23 @@ func applyAdditionalFiltering(clientAddr net.IP, clientID string, setts *dnsfilt
 
 	log.Debug("using settings for client %s with ip %s and id %q", c.Name, clientAddr, clientID)
 
-	if c.UseOwnBlockedServices {
-		Context.dnsFilter.ApplyBlockedServices(setts, c.BlockedServices, false)
+	var p *Profile
+	if c.Profile != "" {
+		p, _ = Context.clients.FindProfile(c.Profile)
+	}
+
+	services, global := applyClientSettings(setts, c, p, time.Now())
+	if !global {
+		Context.dnsFilter.ApplyBlockedServices(setts, services, false)
 	}
 
 	setts.ClientName = c.Name
 	setts.ClientTags = c.Tags
+	setts.Applied.Client, setts.Applied.ClientMatch = c.Name, matched
 
-	if !c.UseOwnSettings {
-		return
-	}
-
-	setts.FilteringEnabled = c.FilteringEnabled
-	setts.SafeSearchEnabled = c.SafeSearchEnabled
-	setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
-	setts.ParentalEnabled = c.ParentalEnabled
+	// Resolving IPv6 addresses may be disabled for the client even if it
+	// uses the global settings.
+	setts.AAAADisabled = setts.AAAADisabled || c.AAAADisabled
 }
 
 func startDNSServer() error {
@@ -323,19 +467,36 @@ func startDNSServer() error {
 		return fmt.Errorf("unable to start forwarding DNS server: Already running")
 	}
 
-	enableFilters(false)
+	// Answer the queries using the last known good filters while the
+	// current ones are loading, if possible.
+	fromSnapshot := loadFiltersSnapshot()
+	if !fromSnapshot {
+		enableFilters(false)
+	}
 
 	Context.clients.Start()
 
-	err := Context.dnsServer.Start()
+	files, err := Context.handover.requestFiles(handoverListeners)
+	if err != nil {
+		return fmt.Errorf("taking over dns listeners: %w", err)
+	}
+
+	Context.dnsServer.InheritListeners(files)
+
+	err = Context.dnsServer.Start()
 	if err != nil {
 		return fmt.Errorf("couldn't start forwarding DNS server: %w", err)
 	}
 
 	Context.dnsFilter.Start()
+	if fromSnapshot {
+		enableFilters(true)
+	}
+
 	Context.filters.Start()
 	Context.stats.Start()
 	Context.queryLog.Start()
+	Context.memManager.Start(memCheckIvl)
 
 	const topClientsNumber = 100 // the number of clients to get
 	for _, ip := range Context.stats.GetTopClientsIP(topClientsNumber) {
@@ -347,6 +508,10 @@ func startDNSServer() error {
 		}
 	}
 
+	if n := config.DNS.CacheWarmupDomains; n != 0 {
+		Context.dnsServer.WarmUpCache(Context.stats.GetTopDomains(uint(n)))
+	}
+
 	return nil
 }
 
@@ -380,6 +545,11 @@ func stopDNSServer() error {
 }
 
 func closeDNSServer() {
+	if Context.memManager != nil {
+		Context.memManager.Close()
+		Context.memManager = nil
+	}
+
 	// DNS forward module must be closed BEFORE stats or queryLog because it depends on them
 	if Context.dnsServer != nil {
 		Context.dnsServer.Close()
@@ -0,0 +1,549 @@
+package home
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Statuses of the checks of the doctor.
+const (
+	doctorPass = "pass"
+	doctorWarn = "warn"
+	doctorFail = "fail"
+)
+
+// errDoctorFailed is returned by the doctor command when some of the checks
+// have failed.
+const errDoctorFailed agherr.Error = "some checks have failed"
+
+const (
+	// doctorMinYear is the year before which the system clock is surely
+	// wrong.
+	doctorMinYear = 2021
+
+	// doctorCertExpiryWarn is the time before the expiry of the certificate
+	// since which it's reported.
+	doctorCertExpiryWarn = 30 * 24 * time.Hour
+
+	// doctorFailSpace and doctorWarnSpace are the amounts of the free disk
+	// space below which the check fails and warns respectively.
+	doctorFailSpace = 16 << 20
+	doctorWarnSpace = 256 << 20
+)
+
+// doctorCheck is the result of a single check of the doctor.
+type doctorCheck struct {
+	// Name is the name of the check, for example "config".
+	Name string `json:"name"`
+
+	// Status is one of the doctor statuses.
+	Status string `json:"status"`
+
+	// Message describes the result.
+	Message string `json:"message"`
+}
+
+// doctorReport is the response to the GET /control/doctor request.
+type doctorReport struct {
+	Checks []doctorCheck `json:"checks"`
+
+	// Failed is true if any of the checks have failed.
+	Failed bool `json:"failed"`
+}
+
+// doctorResult accumulates the problems found by a single check.  The worst
+// status wins.
+type doctorResult struct {
+	status   string
+	problems []string
+}
+
+// add records the problem with the status.
+func (r *doctorResult) add(status, format string, args ...interface{}) {
+	if r.status != doctorFail {
+		r.status = status
+	}
+
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+// check returns the check with name and the message okMsg if there are no
+// problems.
+func (r *doctorResult) check(name, okMsg string) (c doctorCheck) {
+	if len(r.problems) == 0 {
+		return doctorCheck{Name: name, Status: doctorPass, Message: okMsg}
+	}
+
+	return doctorCheck{Name: name, Status: r.status, Message: strings.Join(r.problems, "; ")}
+}
+
+// doctorConf is the part of the configuration checked by the doctor.
+type doctorConf struct {
+	bindHost  net.IP
+	dnsHosts  []net.IP
+	tls       tlsConfigSettings
+	upstreams []string
+	bootstrap []string
+	upsOpts   []dnsforward.UpstreamOptions
+	upsFile   string
+	bindPort  int
+	dnsPort   int
+}
+
+// newDoctorConf returns the part of c checked by the doctor.  c is expected
+// to be locked.
+func newDoctorConf(c *configuration) (dc *doctorConf) {
+	return &doctorConf{
+		bindHost:  c.BindHost,
+		dnsHosts:  append([]net.IP{}, c.DNS.BindHosts...),
+		tls:       c.TLS,
+		upstreams: aghstrings.CloneSlice(c.DNS.UpstreamDNS),
+		bootstrap: aghstrings.CloneSlice(c.DNS.BootstrapDNS),
+		upsOpts:   append([]dnsforward.UpstreamOptions{}, c.DNS.UpstreamOptions...),
+		upsFile:   c.DNS.UpstreamDNSFileName,
+		bindPort:  c.BindPort,
+		dnsPort:   c.DNS.Port,
+	}
+}
+
+// doctor runs the checks of the installation.
+type doctor struct {
+	// conf is the parsed configuration.  It's nil if the file couldn't be
+	// parsed.
+	conf *doctorConf
+
+	confPath string
+	workDir  string
+	dataDir  string
+
+	// running is true if the checks are made by the running instance, so
+	// that its ports are in use.
+	running bool
+}
+
+// run makes all the checks at now.
+func (d *doctor) run(now time.Time) (rep *doctorReport) {
+	rep = &doctorReport{}
+	checks := []func(now time.Time) (c doctorCheck){
+		d.checkConfig,
+		d.checkFiles,
+		d.checkPorts,
+		d.checkClock,
+		d.checkTLS,
+		d.checkUpstreams,
+		d.checkDiskSpace,
+	}
+
+	for _, check := range checks {
+		c := check(now)
+		rep.Checks = append(rep.Checks, c)
+		rep.Failed = rep.Failed || c.Status == doctorFail
+	}
+
+	return rep
+}
+
+// noConfCheck returns the result of the check with name, which requires the
+// valid configuration file.
+func noConfCheck(name string) (c doctorCheck) {
+	return doctorCheck{
+		Name:    name,
+		Status:  doctorWarn,
+		Message: "skipped, because the configuration can't be read",
+	}
+}
+
+// checkConfig checks that the configuration file is readable, writable, and
+// valid.  It parses the configuration into d.conf unless it's set already.
+func (d *doctor) checkConfig(_ time.Time) (c doctorCheck) {
+	res := &doctorResult{}
+	data, err := ioutil.ReadFile(d.confPath)
+	if err != nil {
+		res.add(doctorFail, "reading %s: %s", d.confPath, err)
+
+		return res.check("config", "")
+	}
+
+	b, err := secretBoxFromEnv()
+	if err == nil {
+		data, err = decryptConfig(b, data)
+	}
+
+	if err != nil {
+		res.add(doctorFail, "decrypting %s: %s", d.confPath, err)
+
+		return res.check("config", "")
+	}
+
+	// Open without truncation, so that nothing is changed.
+	f, err := os.OpenFile(d.confPath, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		res.add(doctorFail, "%s isn't writable, so the settings can't be saved: %s", d.confPath, err)
+	} else {
+		_ = f.Close()
+	}
+
+	conf := &configuration{}
+	err = yaml.Unmarshal(data, conf)
+	if err != nil {
+		res.add(doctorFail, "parsing %s: %s", d.confPath, err)
+	} else if d.conf == nil {
+		d.conf = newDoctorConf(conf)
+	}
+
+	return res.check("config", fmt.Sprintf("%s is readable, writable, and valid", d.confPath))
+}
+
+// checkPath checks that the file or the directory at path is writable by the
+// current user and is owned by them.  Missing files are fine.
+func checkPath(res *doctorResult, path string) {
+	fi, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		res.add(doctorFail, "%s: %s", path, err)
+
+		return
+	}
+
+	if fi.IsDir() {
+		var f *os.File
+		f, err = ioutil.TempFile(path, ".doctor")
+		if err == nil {
+			_ = f.Close()
+			err = os.Remove(f.Name())
+		}
+	} else {
+		var f *os.File
+		f, err = os.OpenFile(path, os.O_RDWR, 0)
+		if err == nil {
+			_ = f.Close()
+		}
+	}
+
+	if err != nil {
+		res.add(doctorFail, "%s isn't writable: %s", path, err)
+	}
+
+	uid, ok := aghos.FileOwner(fi)
+	if euid := os.Geteuid(); ok && euid >= 0 && uid != euid {
+		res.add(doctorWarn, "%s is owned by uid %d, but adguard home runs as uid %d", path, uid, euid)
+	}
+}
+
+// checkFiles checks the working directory and the files of the query log, the
+// statistics, the sessions, the filters, and the DHCP leases.
+func (d *doctor) checkFiles(_ time.Time) (c doctorCheck) {
+	res := &doctorResult{}
+	fi, err := os.Stat(d.dataDir)
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		res.add(doctorWarn, "%s doesn't exist, it's created at the first start", d.dataDir)
+	case err != nil:
+		res.add(doctorFail, "%s: %s", d.dataDir, err)
+	case !fi.IsDir():
+		res.add(doctorFail, "%s isn't a directory", d.dataDir)
+	}
+
+	paths := []string{d.workDir, d.dataDir}
+	for _, name := range []string{
+		"querylog.json",
+		"querylog.json.1",
+		"stats.db",
+		"sessions.db",
+		"filters",
+	} {
+		paths = append(paths, filepath.Join(d.dataDir, name))
+	}
+	paths = append(paths, filepath.Join(d.workDir, "leases.db"))
+
+	for _, p := range paths {
+		checkPath(res, p)
+	}
+
+	return res.check("files", fmt.Sprintf("the files in %s are writable", d.workDir))
+}
+
+// checkPort adds the problem with binding to the port of the protocol proto
+// at host to res, if any.
+func checkPort(res *doctorResult, proto string, host net.IP, port int, err error) {
+	if err == nil {
+		return
+	}
+
+	addr := net.JoinHostPort(host.String(), fmt.Sprint(port))
+	if errors.Is(err, os.ErrPermission) {
+		res.add(doctorFail, "no permission to bind to %s/%s", addr, proto)
+	} else {
+		res.add(doctorWarn, "%s/%s is in use, maybe by a running instance: %s", addr, proto, err)
+	}
+}
+
+// checkPorts checks that the ports of the web interface and the DNS server can
+// be bound to.
+func (d *doctor) checkPorts(_ time.Time) (c doctorCheck) {
+	if d.running {
+		return doctorCheck{
+			Name:    "ports",
+			Status:  doctorPass,
+			Message: "the ports are served by the running instance",
+		}
+	} else if d.conf == nil {
+		return noConfCheck("ports")
+	}
+
+	res := &doctorResult{}
+	conf := d.conf
+	if conf.bindPort != 0 {
+		host := conf.bindHost
+		if host == nil {
+			host = net.IPv4zero
+		}
+
+		checkPort(res, "tcp", host, conf.bindPort, aghnet.CheckPortAvailable(host, conf.bindPort))
+	}
+
+	if conf.dnsPort != 0 {
+		hosts := conf.dnsHosts
+		if len(hosts) == 0 {
+			hosts = []net.IP{net.IPv4zero}
+		}
+
+		for _, h := range hosts {
+			checkPort(res, "tcp", h, conf.dnsPort, aghnet.CheckPortAvailable(h, conf.dnsPort))
+			checkPort(res, "udp", h, conf.dnsPort, aghnet.CheckPacketPortAvailable(h, conf.dnsPort))
+		}
+	}
+
+	return res.check("ports", "the ports can be bound to")
+}
+
+// checkClock checks that the system clock is sane: it isn't far in the past
+// and the configuration file hasn't been modified in the future.
+func (d *doctor) checkClock(now time.Time) (c doctorCheck) {
+	res := &doctorResult{}
+	if now.Year() < doctorMinYear {
+		res.add(doctorFail, "the system clock is set to %s", now.Format(time.RFC3339))
+	}
+
+	fi, err := os.Stat(d.confPath)
+	if err == nil && fi.ModTime().After(now.Add(time.Hour)) {
+		res.add(
+			doctorWarn,
+			"%s has been modified at %s, which is in the future",
+			d.confPath,
+			fi.ModTime().Format(time.RFC3339),
+		)
+	}
+
+	return res.check("clock", fmt.Sprintf("the system clock is set to %s", now.Format(time.RFC3339)))
+}
+
+// checkTLS checks that the certificate and the private key are valid and that
+// the certificate isn't expired.
+func (d *doctor) checkTLS(now time.Time) (c doctorCheck) {
+	if d.conf == nil {
+		return noConfCheck("tls")
+	} else if !d.conf.tls.Enabled {
+		return doctorCheck{Name: "tls", Status: doctorPass, Message: "encryption is disabled"}
+	}
+
+	res := &doctorResult{}
+	setts := d.conf.tls
+	status := &tlsConfigStatus{}
+	if !tlsLoadConfig(&setts, status) {
+		res.add(doctorFail, "loading the certificate: %s", status.WarningValidation)
+
+		return res.check("tls", "")
+	}
+
+	*status = validateCertificates(string(setts.CertificateChainData), string(setts.PrivateKeyData), setts.ServerName)
+	if !status.ValidPair {
+		res.add(doctorFail, "%s", status.WarningValidation)
+
+		return res.check("tls", "")
+	}
+
+	notAfter := status.NotAfter.Time
+	switch {
+	case now.After(notAfter):
+		res.add(doctorFail, "the certificate has expired at %s", notAfter.Format(time.RFC3339))
+	case now.Before(status.NotBefore.Time):
+		res.add(doctorFail, "the certificate isn't valid until %s", status.NotBefore.Format(time.RFC3339))
+	case notAfter.Sub(now) < doctorCertExpiryWarn:
+		res.add(doctorWarn, "the certificate expires at %s", notAfter.Format(time.RFC3339))
+	}
+
+	if !status.ValidChain {
+		res.add(doctorWarn, "%s", status.WarningValidation)
+	}
+
+	return res.check("tls", fmt.Sprintf("the certificate is valid until %s", notAfter.Format(time.RFC3339)))
+}
+
+// checkUpstreams checks that the default upstream servers resolve a well-known
+// name.  It fails if none of them do.
+func (d *doctor) checkUpstreams(_ time.Time) (c doctorCheck) {
+	if d.conf == nil {
+		return noConfCheck("upstreams")
+	}
+
+	res := &doctorResult{}
+	lines := d.conf.upstreams
+	if d.conf.upsFile != "" {
+		data, err := ioutil.ReadFile(d.conf.upsFile)
+		if err != nil {
+			res.add(doctorFail, "reading %s: %s", d.conf.upsFile, err)
+
+			return res.check("upstreams", "")
+		}
+
+		lines = strings.Split(string(data), "\n")
+	}
+
+	lines = aghstrings.FilterOut(lines, aghstrings.IsCommentOrEmpty)
+	if len(lines) == 0 {
+		res.add(doctorWarn, "no upstreams configured")
+
+		return res.check("upstreams", "")
+	}
+
+	errs := make([]error, len(lines))
+	wg := &sync.WaitGroup{}
+	for i, l := range lines {
+		wg.Add(1)
+		go func(i int, l string) {
+			defer wg.Done()
+
+			errs[i] = dnsforward.CheckUpstream(l, d.conf.bootstrap, d.conf.upsOpts)
+		}(i, l)
+	}
+	wg.Wait()
+
+	var failed int
+	for _, err := range errs {
+		if err != nil {
+			failed++
+			res.add(doctorWarn, "%s", err)
+		}
+	}
+
+	if failed == len(lines) {
+		res.status = doctorFail
+	}
+
+	return res.check("upstreams", fmt.Sprintf("%d upstreams are reachable", len(lines)))
+}
+
+// checkDiskSpace checks that there is enough free space for the query log and
+// the statistics.
+func (d *doctor) checkDiskSpace(_ time.Time) (c doctorCheck) {
+	res := &doctorResult{}
+	free, err := aghos.FreeSpace(d.workDir)
+	if err != nil {
+		res.add(doctorWarn, "getting free space of %s: %s", d.workDir, err)
+
+		return res.check("disk_space", "")
+	}
+
+	msg := fmt.Sprintf("%d MiB free on the file system of %s", free>>20, d.workDir)
+	switch {
+	case free < doctorFailSpace:
+		res.add(doctorFail, "%s", msg)
+	case free < doctorWarnSpace:
+		res.add(doctorWarn, "%s", msg)
+	}
+
+	return res.check("disk_space", msg)
+}
+
+// printDoctorReport writes rep to w as a table.
+func printDoctorReport(w io.Writer, rep *doctorReport) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "STATUS\tCHECK\tMESSAGE")
+	for _, c := range rep.Checks {
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", strings.ToUpper(c.Status), c.Name, c.Message)
+	}
+
+	return tw.Flush()
+}
+
+// cmdDoctor is the command checking the configuration, the files, and the
+// environment of AdGuard Home.  Unlike the other commands, it doesn't need a
+// running instance.
+func cmdDoctor(w io.Writer, args []string) (err error) {
+	cf := &cliFlags{}
+	fs := newCLIFlagSet("doctor", cf)
+	err = parseCLIFlags(fs, args)
+	if err != nil {
+		return err
+	}
+
+	opts := options{
+		configFilename: cf.confPath,
+		workDir:        cf.workDir,
+	}
+	initConfigFilename(opts)
+	initWorkingDir(opts)
+
+	d := &doctor{
+		confPath: config.getConfigFilename(),
+		workDir:  Context.workDir,
+		dataDir:  Context.getDataDir(),
+	}
+	rep := d.run(time.Now())
+
+	if cf.json {
+		err = json.NewEncoder(w).Encode(rep)
+	} else {
+		err = printDoctorReport(w, rep)
+	}
+
+	if err != nil {
+		return err
+	} else if rep.Failed {
+		return errDoctorFailed
+	}
+
+	return nil
+}
+
+// handleDoctor is the handler for the GET /control/doctor HTTP API.  It makes
+// the same checks as the doctor command using the current configuration.
+func handleDoctor(w http.ResponseWriter, _ *http.Request) {
+	config.RLock()
+	d := &doctor{
+		conf:     newDoctorConf(&config),
+		confPath: config.getConfigFilename(),
+		workDir:  Context.workDir,
+		dataDir:  Context.getDataDir(),
+		running:  true,
+	}
+	config.RUnlock()
+
+	rep := d.run(time.Now())
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(rep)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
@@ -0,0 +1,65 @@
+package home
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDoctor_run(t *testing.T) {
+	dir := t.TempDir()
+	confPath := filepath.Join(dir, "AdGuardHome.yaml")
+	newDoctor := func(t *testing.T, conf string) (d *doctor) {
+		t.Helper()
+
+		require.NoError(t, ioutil.WriteFile(confPath, []byte(conf), 0o600))
+
+		return &doctor{
+			confPath: confPath,
+			workDir:  dir,
+			dataDir:  filepath.Join(dir, dataDir),
+		}
+	}
+
+	statuses := func(rep *doctorReport) (sts map[string]string) {
+		sts = map[string]string{}
+		for _, c := range rep.Checks {
+			sts[c.Name] = c.Status
+		}
+
+		return sts
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		d := newDoctor(t, "bind_port: 0\ndns:\n  port: 0\n  upstream_dns: []\n")
+		rep := d.run(time.Now())
+
+		assert.False(t, rep.Failed)
+		sts := statuses(rep)
+		assert.Equal(t, doctorPass, sts["config"])
+		assert.Equal(t, doctorPass, sts["ports"])
+		assert.Equal(t, doctorPass, sts["clock"])
+		assert.Equal(t, doctorPass, sts["tls"])
+		assert.Equal(t, doctorWarn, sts["upstreams"])
+
+		// The data directory hasn't been created yet.
+		assert.Equal(t, doctorWarn, sts["files"])
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		d := newDoctor(t, "dns: [")
+		rep := d.run(time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		assert.True(t, rep.Failed)
+		sts := statuses(rep)
+		assert.Equal(t, doctorFail, sts["config"])
+		assert.Equal(t, doctorFail, sts["clock"])
+		assert.Equal(t, doctorWarn, sts["ports"])
+		assert.Equal(t, doctorWarn, sts["tls"])
+		assert.Equal(t, doctorWarn, sts["upstreams"])
+	})
+}
@@ -0,0 +1,341 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"text/tabwriter"
+
+	"github.com/AdguardTeam/golibs/log"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// configSource is the source of a value of the effective configuration.
+type configSource string
+
+// configSource values.
+const (
+	// configSourceDefault means that the value is the default one.
+	configSourceDefault configSource = "default"
+
+	// configSourceFile means that the value is the one read from the
+	// configuration file at the start.
+	configSourceFile configSource = "file"
+
+	// configSourceFlag means that the value is set by a command-line flag.
+	configSourceFlag configSource = "flag"
+
+	// configSourceAPI means that the value has been changed since the start,
+	// for example through the HTTP API.
+	configSourceAPI configSource = "api"
+)
+
+// configSecretRedactions are the redactions of the secrets within the
+// effective configuration.  Unlike configRedactions, the client identifiers
+// are kept.  The paths are the same as in configSecrets.
+var configSecretRedactions = map[string]func(r *redactor, s string) (res string){
+	"users.password":               (*redactor).secret,
+	"api_tokens.token_hash":        (*redactor).secret,
+	"pin_bypass.pin_hash":          (*redactor).secret,
+	"http_proxy":                   (*redactor).plainURL,
+	"dns.upstream_dns":             (*redactor).upstream,
+	"dns.upstream_options.address": (*redactor).upstream,
+	"clients.upstreams":            (*redactor).upstream,
+	"tls.private_key":              (*redactor).secret,
+}
+
+// configBaseline are the values of the configuration at the start by their
+// paths, which are used to find the sources of the values of the effective
+// configuration.  The paths are the same as in configRedactions, and the values
+// are encoded in YAML.
+type configBaseline struct {
+	// defaults are the default values.
+	defaults map[string]string
+
+	// file are the values after the configuration file has been read.
+	file map[string]string
+
+	// flags are the values set by the command-line flags, which are kept in
+	// the configuration and may be changed later.
+	flags map[string]string
+
+	// overrides are the values of the command-line flags, which override
+	// the values of the configuration without changing those.
+	overrides map[string]interface{}
+}
+
+// newConfigBaseline returns a new baseline with the current values of the
+// configuration as the defaults.
+func newConfigBaseline() (b *configBaseline) {
+	return &configBaseline{
+		defaults:  snapshotConfig(),
+		file:      map[string]string{},
+		flags:     map[string]string{},
+		overrides: map[string]interface{}{},
+	}
+}
+
+// snapshotConfig returns the current values of the configuration by their
+// paths.  It's only used at the start, when the modules aren't initialized.
+func snapshotConfig() (vals map[string]string) {
+	vals = map[string]string{}
+
+	data, err := yaml.Marshal(&config)
+	if err != nil {
+		log.Error("effective config: encoding snapshot: %s", err)
+
+		return vals
+	}
+
+	conf := yaml.MapSlice{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		log.Error("effective config: decoding snapshot: %s", err)
+
+		return vals
+	}
+
+	flattenConfig("", conf, func(path string, v interface{}) {
+		vals[path] = yamlString(v)
+	})
+
+	return vals
+}
+
+// setFlags records the values set by the command-line flags from args.  It
+// must be called after those are applied to the configuration.
+func (b *configBaseline) setFlags(args options) {
+	snap := snapshotConfig()
+	if args.bindHost != nil {
+		b.flags["bind_host"] = snap["bind_host"]
+	}
+
+	if args.bindPort != 0 {
+		b.flags["bind_port"] = snap["bind_port"]
+	}
+
+	if args.verbose {
+		b.overrides["verbose"] = true
+	}
+
+	if args.logFile != "" {
+		b.overrides["log_file"] = args.logFile
+	}
+}
+
+// source returns the source of the value v at path.
+func (b *configBaseline) source(path string, v interface{}) (src configSource) {
+	s := yamlString(v)
+	switch {
+	case b.flags[path] == s:
+		return configSourceFlag
+	case b.defaults[path] == s:
+		return configSourceDefault
+	case b.file[path] == s:
+		return configSourceFile
+	default:
+		return configSourceAPI
+	}
+}
+
+// flattenConfig calls f for each value of the YAML node v located at path.
+// The sequences and the scalars are the values, and the mappings are walked.
+func flattenConfig(path string, v interface{}, f func(path string, v interface{})) {
+	ms, ok := v.(yaml.MapSlice)
+	if !ok {
+		f(path, v)
+
+		return
+	}
+
+	for _, item := range ms {
+		key := fmt.Sprint(item.Key)
+		if path != "" {
+			key = path + "." + key
+		}
+
+		flattenConfig(key, item.Value, f)
+	}
+}
+
+// yamlString returns v encoded in YAML for comparison.
+func yamlString(v interface{}) (s string) {
+	data, err := yaml.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+
+	return string(data)
+}
+
+// yamlToJSON converts the YAML node v into the values which can be encoded in
+// JSON.
+func yamlToJSON(v interface{}) (res interface{}) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		m := make(map[string]interface{}, len(v))
+		for _, item := range v {
+			m[fmt.Sprint(item.Key)] = yamlToJSON(item.Value)
+		}
+
+		return m
+	case []interface{}:
+		elems := make([]interface{}, len(v))
+		for i, elem := range v {
+			elems[i] = yamlToJSON(elem)
+		}
+
+		return elems
+	default:
+		return v
+	}
+}
+
+// effectiveConfigField is a value of the effective configuration.
+type effectiveConfigField struct {
+	Value  interface{}  `json:"value"`
+	Path   string       `json:"path"`
+	Source configSource `json:"source"`
+}
+
+// effectiveConfigJSON is the response to the GET /control/effective_config
+// request.
+type effectiveConfigJSON struct {
+	Fields []*effectiveConfigField `json:"fields"`
+}
+
+// newEffectiveConfig returns the effective configuration from the YAML data
+// with the secrets redacted and the sources found using b.
+func newEffectiveConfig(data []byte, b *configBaseline) (ec *effectiveConfigJSON, err error) {
+	conf, redacted := yaml.MapSlice{}, yaml.MapSlice{}
+	for _, ms := range []*yaml.MapSlice{&conf, &redacted} {
+		err = yaml.Unmarshal(data, ms)
+		if err != nil {
+			return nil, fmt.Errorf("decoding config: %w", err)
+		}
+	}
+
+	r, err := newRedactor()
+	if err != nil {
+		return nil, err
+	}
+
+	r.redactions = configSecretRedactions
+	r.node("", redacted)
+
+	ec = &effectiveConfigJSON{
+		Fields: []*effectiveConfigField{},
+	}
+
+	flattenConfig("", conf, func(path string, v interface{}) {
+		f := &effectiveConfigField{
+			Path:   path,
+			Source: b.source(path, v),
+		}
+
+		if ov, ok := b.overrides[path]; ok {
+			f.Value, f.Source = ov, configSourceFlag
+		}
+
+		ec.Fields = append(ec.Fields, f)
+	})
+
+	i := 0
+	flattenConfig("", redacted, func(_ string, v interface{}) {
+		if f := ec.Fields[i]; f.Value == nil {
+			f.Value = yamlToJSON(v)
+		}
+
+		i++
+	})
+
+	return ec, nil
+}
+
+// handleEffectiveConfig is the handler for the GET /control/effective_config
+// HTTP API.  The configuration is taken from the modules, not from the file, so
+// the changes not written to the file yet are included.
+func handleEffectiveConfig(w http.ResponseWriter, _ *http.Request) {
+	config.Lock()
+	data, err := config.marshal()
+	config.Unlock()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "encoding config: %s", err)
+
+		return
+	}
+
+	ec, err := newEffectiveConfig(data, Context.confBaseline)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(ec)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// cmdConfig is the command inspecting the configuration of a running instance.
+// The only subcommand is dump, which prints the effective configuration.
+func cmdConfig(w io.Writer, args []string) (err error) {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: expected dump", errCLIUsage)
+	}
+
+	sub := args[0]
+	if sub != "dump" {
+		return fmt.Errorf("%w: unknown subcommand %q", errCLIUsage, sub)
+	}
+
+	cf := &cliFlags{}
+	fs := newCLIFlagSet("config dump", cf)
+	err = parseCLIFlags(fs, args[1:])
+	if err != nil {
+		return err
+	}
+
+	c, err := newCLIClient(cf)
+	if err != nil {
+		return err
+	}
+
+	data, err := c.getData("/control/effective_config", nil)
+	if err != nil {
+		return err
+	}
+
+	if cf.json {
+		_, err = w.Write(data)
+
+		return err
+	}
+
+	ec := &effectiveConfigJSON{}
+	err = json.Unmarshal(data, ec)
+	if err != nil {
+		return fmt.Errorf("decoding config: %w", err)
+	}
+
+	return printEffectiveConfig(w, ec)
+}
+
+// printEffectiveConfig writes ec to w as a table.
+func printEffectiveConfig(w io.Writer, ec *effectiveConfigJSON) (err error) {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "PATH\tSOURCE\tVALUE")
+	for _, f := range ec.Fields {
+		v, verr := json.Marshal(f.Value)
+		if verr != nil {
+			return fmt.Errorf("encoding %s: %w", f.Path, verr)
+		}
+
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", f.Path, f.Source, v)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,423 @@
+package home
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Events on which the exec hooks are run.
+const (
+	hookEventProtectionDisabled = "protection_disabled"
+	hookEventProtectionEnabled  = "protection_enabled"
+	hookEventDomainBlocked      = "domain_blocked"
+)
+
+// The environment variables passed to the commands of the exec hooks.  No other
+// variables are passed, the environment of AdGuard Home isn't inherited.
+const (
+	hookEnvEvent  = "AGH_EVENT"
+	hookEnvDomain = "AGH_DOMAIN"
+	hookEnvClient = "AGH_CLIENT"
+	hookEnvReason = "AGH_REASON"
+)
+
+const (
+	// defaultHookTimeout is the timeout of a command used if
+	// execHookConfig.TimeoutMs isn't set.
+	defaultHookTimeout = 5 * time.Second
+
+	// maxHookTimeout is the longest allowed timeout of a command.
+	maxHookTimeout = time.Minute
+
+	// maxHookOutput is the largest number of bytes of the output of a
+	// command written into the log.
+	maxHookOutput = 4096
+)
+
+// errHooksRoot is the error of the exec hooks not started since AdGuard Home
+// is running as root.
+const errHooksRoot agherr.Error = "refusing to run exec hooks as root, set allow_root to force"
+
+// execHooksConfig is the configuration of the external commands run on the
+// events.
+type execHooksConfig struct {
+	// Hooks are the commands and their events.
+	Hooks []*execHookConfig `yaml:"hooks"`
+
+	// Enabled tells if the hooks are run.
+	Enabled bool `yaml:"enabled"`
+
+	// AllowRoot allows running the commands when AdGuard Home is running as
+	// root.
+	AllowRoot bool `yaml:"allow_root"`
+}
+
+// execHookConfig is the configuration of a single exec hook.
+type execHookConfig struct {
+	// Name is the unique name of the hook used in the log and in the
+	// status.
+	Name string `yaml:"name"`
+
+	// Event is one of the hookEvent* constants.
+	Event string `yaml:"event"`
+
+	// Command is the absolute path to the executable followed by its
+	// arguments.
+	Command []string `yaml:"command"`
+
+	// Domains, if not empty, are the domains, along with their subdomains,
+	// the domain_blocked event is limited to.
+	Domains []string `yaml:"domains"`
+
+	// TimeoutMs is the timeout of the command in milliseconds.  If zero,
+	// defaultHookTimeout is used.
+	TimeoutMs uint32 `yaml:"timeout_ms"`
+}
+
+// validate returns an error if c is invalid.
+func (c *execHookConfig) validate() (err error) {
+	switch c.Event {
+	case hookEventProtectionDisabled, hookEventProtectionEnabled, hookEventDomainBlocked:
+		// Go on.
+	default:
+		return fmt.Errorf("bad event %q", c.Event)
+	}
+
+	if len(c.Command) == 0 {
+		return agherr.Error("no command")
+	} else if !filepath.IsAbs(c.Command[0]) {
+		return fmt.Errorf("command %q: path must be absolute", c.Command[0])
+	}
+
+	if c.Domains != nil && c.Event != hookEventDomainBlocked {
+		return fmt.Errorf("domains are only allowed for %s", hookEventDomainBlocked)
+	}
+
+	if time.Duration(c.TimeoutMs)*time.Millisecond > maxHookTimeout {
+		return fmt.Errorf("timeout_ms must not be greater than %d", maxHookTimeout.Milliseconds())
+	}
+
+	return nil
+}
+
+// hookEvent is an event on which the exec hooks are run.
+type hookEvent struct {
+	// kind is one of the hookEvent* constants.
+	kind   string
+	domain string
+	client string
+
+	// reason is the stable code of the filtering reason of the blocked
+	// domain, see dnsfilter.ReasonCode.
+	reason dnsfilter.ReasonCode
+}
+
+// env returns the environment of the commands run on e.
+func (e *hookEvent) env() (env []string) {
+	return []string{
+		hookEnvEvent + "=" + e.kind,
+		hookEnvDomain + "=" + e.domain,
+		hookEnvClient + "=" + e.client,
+		hookEnvReason + "=" + string(e.reason),
+	}
+}
+
+// execHook is a command run on an event.  Only one instance of the command
+// runs at a time, the events occurring meanwhile are dropped.
+type execHook struct {
+	// runs, failures, and dropped are the numbers of the runs, of the
+	// failed runs, and of the dropped events since the start.  They're
+	// accessed atomically, so they're kept at the top for the alignment.
+	runs     uint64
+	failures uint64
+	dropped  uint64
+
+	conf *execHookConfig
+
+	// mu protects lastRun and lastErr.
+	mu sync.Mutex
+
+	lastRun time.Time
+	lastErr error
+
+	// domains are the normalized execHookConfig.Domains.
+	domains []string
+
+	timeout time.Duration
+
+	// busy is 1 while the command runs.  It's accessed atomically.
+	busy uint32
+}
+
+// matches returns true if the hook should be run on e.
+func (h *execHook) matches(e *hookEvent) (ok bool) {
+	if h.conf.Event != e.kind {
+		return false
+	} else if len(h.domains) == 0 {
+		return true
+	}
+
+	for _, d := range h.domains {
+		if e.domain == d || strings.HasSuffix(e.domain, "."+d) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// run runs the command of h on e unless the previous run hasn't finished yet.
+func (h *execHook) run(e *hookEvent) {
+	if !atomic.CompareAndSwapUint32(&h.busy, 0, 1) {
+		atomic.AddUint64(&h.dropped, 1)
+		log.Debug("exec hook %q: still running, dropping %s", h.conf.Name, e.kind)
+
+		return
+	}
+
+	go func() {
+		defer agherr.LogPanic("exec hook")
+		defer atomic.StoreUint32(&h.busy, 0)
+
+		h.exec(e)
+	}()
+}
+
+// exec runs the command of h on e and writes its output into the log.
+func (h *execHook) exec(e *hookEvent) {
+	// Write the output into a file, since waiting for a pipe would also wait
+	// for the children of the command, which are still running after it's
+	// been killed on timeout.
+	out, err := ioutil.TempFile("", "agh-hook-*")
+	if err != nil {
+		h.finish(time.Now(), fmt.Errorf("creating output file: %w", err))
+
+		return
+	}
+	defer func() {
+		_ = out.Close()
+		_ = os.Remove(out.Name())
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	// The event data is only passed through the environment, never as the
+	// arguments.
+	cmd := exec.CommandContext(ctx, h.conf.Command[0], h.conf.Command[1:]...)
+	cmd.Env = e.env()
+	cmd.Stdout, cmd.Stderr = out, out
+
+	start := time.Now()
+	err = cmd.Run()
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", h.timeout)
+	}
+
+	if err != nil {
+		log.Error("exec hook %q: %s: %s", h.conf.Name, e.kind, err)
+	} else {
+		log.Debug("exec hook %q: %s: finished in %s", h.conf.Name, e.kind, time.Since(start))
+	}
+
+	_, serr := out.Seek(0, io.SeekStart)
+	if serr == nil {
+		s := bufio.NewScanner(io.LimitReader(out, maxHookOutput))
+		for s.Scan() {
+			log.Info("exec hook %q: %s", h.conf.Name, s.Text())
+		}
+	}
+
+	h.finish(start, err)
+}
+
+// finish records the run of the command started at start, which has finished
+// with err.
+func (h *execHook) finish(start time.Time, err error) {
+	atomic.AddUint64(&h.runs, 1)
+	if err != nil {
+		atomic.AddUint64(&h.failures, 1)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastRun, h.lastErr = start, err
+}
+
+// execHooks runs the external commands on the events.  The methods of the nil
+// *execHooks are valid and do nothing.
+type execHooks struct {
+	hooks []*execHook
+
+	// err is the reason why the hooks aren't run, if any.
+	err error
+}
+
+// newExecHooks returns the exec hooks from conf.  isRoot tells if AdGuard Home
+// is running as root.  h is nil if the hooks are disabled.  The errors are
+// kept to be shown in the status, so that the rest of AdGuard Home is started.
+func newExecHooks(conf *execHooksConfig, isRoot bool) (h *execHooks) {
+	if !conf.Enabled {
+		return nil
+	}
+
+	h = &execHooks{}
+	defer func() {
+		if h.err != nil {
+			log.Error("exec hooks: %s", h.err)
+			h.hooks = nil
+		}
+	}()
+
+	if isRoot && !conf.AllowRoot {
+		h.err = errHooksRoot
+
+		return h
+	}
+
+	names := map[string]struct{}{}
+	for i, c := range conf.Hooks {
+		if err := c.validate(); err != nil {
+			h.err = fmt.Errorf("hook at index %d: %w", i, err)
+
+			return h
+		}
+
+		if _, ok := names[c.Name]; ok || c.Name == "" {
+			h.err = fmt.Errorf("hook at index %d: bad or duplicate name %q", i, c.Name)
+
+			return h
+		}
+		names[c.Name] = struct{}{}
+
+		hook := &execHook{
+			conf:    c,
+			timeout: time.Duration(c.TimeoutMs) * time.Millisecond,
+		}
+		if hook.timeout == 0 {
+			hook.timeout = defaultHookTimeout
+		}
+
+		for _, d := range c.Domains {
+			hook.domains = append(hook.domains, strings.ToLower(strings.Trim(d, ".")))
+		}
+
+		h.hooks = append(h.hooks, hook)
+	}
+
+	return h
+}
+
+// fire runs the hooks matching e.
+func (h *execHooks) fire(e *hookEvent) {
+	if h == nil {
+		return
+	}
+
+	for _, hook := range h.hooks {
+		if hook.matches(e) {
+			hook.run(e)
+		}
+	}
+}
+
+// onBlocked is the dnsforward.ServerConfig.OnBlocked callback.
+func (h *execHooks) onBlocked(host string, client net.IP, reason dnsfilter.Reason) {
+	e := &hookEvent{
+		kind:   hookEventDomainBlocked,
+		domain: strings.ToLower(strings.TrimSuffix(host, ".")),
+		reason: reason.Code(),
+	}
+	if client != nil {
+		e.client = client.String()
+	}
+
+	h.fire(e)
+}
+
+// onProtectionChanged fires the hooks of the protection events.  It's called
+// from the dnsforward.ServerConfig.OnProtectionChanged callback.
+func (h *execHooks) onProtectionChanged(enabled bool) {
+	e := &hookEvent{
+		kind: hookEventProtectionDisabled,
+	}
+	if enabled {
+		e.kind = hookEventProtectionEnabled
+	}
+
+	h.fire(e)
+}
+
+// execHookJSON is the state of an exec hook within the status response.
+type execHookJSON struct {
+	LastRun   *aghtime.Time `json:"last_run,omitempty"`
+	Name      string        `json:"name"`
+	Event     string        `json:"event"`
+	LastError string        `json:"last_error,omitempty"`
+	Runs      uint64        `json:"runs"`
+	Failures  uint64        `json:"failures"`
+	Dropped   uint64        `json:"dropped"`
+}
+
+// execHooksJSON is the state of the exec hooks within the status response.
+type execHooksJSON struct {
+	Hooks []*execHookJSON `json:"hooks"`
+
+	// Error is the reason why the hooks aren't run, if any.
+	Error string `json:"error,omitempty"`
+}
+
+// status returns the state of h for the status response.  st is nil if h is
+// nil.
+func (h *execHooks) status() (st *execHooksJSON) {
+	if h == nil {
+		return nil
+	}
+
+	st = &execHooksJSON{
+		Hooks: make([]*execHookJSON, 0, len(h.hooks)),
+	}
+	if h.err != nil {
+		st.Error = h.err.Error()
+	}
+
+	for _, hook := range h.hooks {
+		hj := &execHookJSON{
+			Name:     hook.conf.Name,
+			Event:    hook.conf.Event,
+			Runs:     atomic.LoadUint64(&hook.runs),
+			Failures: atomic.LoadUint64(&hook.failures),
+			Dropped:  atomic.LoadUint64(&hook.dropped),
+		}
+
+		hook.mu.Lock()
+		if !hook.lastRun.IsZero() {
+			hj.LastRun = &aghtime.Time{Time: hook.lastRun}
+		}
+		if hook.lastErr != nil {
+			hj.LastError = hook.lastErr.Error()
+		}
+		hook.mu.Unlock()
+
+		st.Hooks = append(st.Hooks, hj)
+	}
+
+	return st
+}
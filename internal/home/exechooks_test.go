@@ -0,0 +1,220 @@
+package home
+
+import (
+	"io/ioutil"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestHookScript writes a shell script with body into a temporary directory
+// and returns its path.
+func newTestHookScript(t *testing.T, body string) (fn string) {
+	t.Helper()
+
+	if runtime.GOOS == "windows" {
+		t.Skip("the test scripts require a unix shell")
+	}
+
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skipf("no shell: %s", err)
+	}
+
+	fn = filepath.Join(t.TempDir(), "hook.sh")
+	err = ioutil.WriteFile(fn, []byte("#!"+sh+"\n"+body+"\n"), 0o755)
+	require.NoError(t, err)
+
+	return fn
+}
+
+// waitHook waits until the command of the only hook of h has been run n times.
+func waitHook(t *testing.T, h *execHooks, n uint64) {
+	t.Helper()
+
+	require.Len(t, h.hooks, 1)
+	hook := h.hooks[0]
+	require.Eventually(t, func() bool {
+		return atomic.LoadUint64(&hook.runs) >= n && atomic.LoadUint32(&hook.busy) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestNewExecHooks(t *testing.T) {
+	assert.Nil(t, newExecHooks(&execHooksConfig{}, false))
+
+	valid := &execHookConfig{
+		Name:    "led",
+		Event:   hookEventProtectionDisabled,
+		Command: []string{"/bin/true"},
+	}
+
+	h := newExecHooks(&execHooksConfig{
+		Enabled: true,
+		Hooks:   []*execHookConfig{valid},
+	}, true)
+	require.NotNil(t, h)
+	assert.Empty(t, h.hooks)
+	assert.Equal(t, errHooksRoot.Error(), h.status().Error)
+
+	h = newExecHooks(&execHooksConfig{
+		Enabled:   true,
+		AllowRoot: true,
+		Hooks:     []*execHookConfig{valid},
+	}, true)
+	require.NotNil(t, h)
+	assert.NoError(t, h.err)
+	assert.Len(t, h.hooks, 1)
+
+	testCases := []struct {
+		conf *execHookConfig
+		name string
+	}{{
+		conf: &execHookConfig{Name: "a", Event: "bad", Command: []string{"/bin/true"}},
+		name: "bad_event",
+	}, {
+		conf: &execHookConfig{Name: "a", Event: hookEventDomainBlocked, Command: []string{"true"}},
+		name: "relative_command",
+	}, {
+		conf: &execHookConfig{Name: "a", Event: hookEventDomainBlocked},
+		name: "no_command",
+	}, {
+		conf: &execHookConfig{
+			Name:    "a",
+			Event:   hookEventProtectionEnabled,
+			Command: []string{"/bin/true"},
+			Domains: []string{"example.org"},
+		},
+		name: "domains_not_allowed",
+	}, {
+		conf: &execHookConfig{
+			Name:      "a",
+			Event:     hookEventDomainBlocked,
+			Command:   []string{"/bin/true"},
+			TimeoutMs: 2 * 60 * 1000,
+		},
+		name: "long_timeout",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			h = newExecHooks(&execHooksConfig{
+				Enabled: true,
+				Hooks:   []*execHookConfig{tc.conf},
+			}, false)
+			require.NotNil(t, h)
+			assert.Error(t, h.err)
+			assert.Empty(t, h.hooks)
+		})
+	}
+}
+
+func TestExecHooks_env(t *testing.T) {
+	out := filepath.Join(t.TempDir(), "env.txt")
+	script := newTestHookScript(t, "env > "+out)
+
+	h := newExecHooks(&execHooksConfig{
+		Enabled: true,
+		Hooks: []*execHookConfig{{
+			Name:    "led",
+			Event:   hookEventDomainBlocked,
+			Command: []string{script},
+			Domains: []string{"example.org"},
+		}},
+	}, false)
+	require.NotNil(t, h)
+	require.NoError(t, h.err)
+
+	// Not matching the domains.
+	h.onBlocked("example.com.", net.IP{1, 2, 3, 4}, dnsfilter.FilteredBlockList)
+	assert.Zero(t, atomic.LoadUint64(&h.hooks[0].runs))
+
+	h.onBlocked("Sub.Example.Org.", net.IP{1, 2, 3, 4}, dnsfilter.FilteredBlockedService)
+	waitHook(t, h, 1)
+
+	data, err := ioutil.ReadFile(out)
+	require.NoError(t, err)
+
+	var env []string
+	for _, kv := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		// Some shells set their own variables regardless of the
+		// environment.
+		if strings.HasPrefix(kv, "AGH_") {
+			env = append(env, kv)
+		} else {
+			assert.NotContains(t, kv, "HOME=")
+		}
+	}
+	sort.Strings(env)
+
+	assert.Equal(t, []string{
+		"AGH_CLIENT=1.2.3.4",
+		"AGH_DOMAIN=sub.example.org",
+		"AGH_EVENT=domain_blocked",
+		"AGH_REASON=blocked_service",
+	}, env)
+
+	st := h.status()
+	require.Len(t, st.Hooks, 1)
+	assert.Equal(t, uint64(1), st.Hooks[0].Runs)
+	assert.Zero(t, st.Hooks[0].Failures)
+	assert.NotNil(t, st.Hooks[0].LastRun)
+}
+
+func TestExecHooks_concurrency(t *testing.T) {
+	script := newTestHookScript(t, "sleep 0.5")
+
+	h := newExecHooks(&execHooksConfig{
+		Enabled: true,
+		Hooks: []*execHookConfig{{
+			Name:    "slow",
+			Event:   hookEventProtectionDisabled,
+			Command: []string{script},
+		}},
+	}, false)
+	require.NotNil(t, h)
+	require.NoError(t, h.err)
+
+	h.onProtectionChanged(false)
+	h.onProtectionChanged(false)
+	h.onProtectionChanged(true)
+	waitHook(t, h, 1)
+
+	st := h.status()
+	require.Len(t, st.Hooks, 1)
+	assert.Equal(t, uint64(1), st.Hooks[0].Runs)
+	assert.Equal(t, uint64(1), st.Hooks[0].Dropped)
+}
+
+func TestExecHooks_failure(t *testing.T) {
+	script := newTestHookScript(t, "sleep 5")
+
+	h := newExecHooks(&execHooksConfig{
+		Enabled: true,
+		Hooks: []*execHookConfig{{
+			Name:      "timeout",
+			Event:     hookEventProtectionEnabled,
+			Command:   []string{script},
+			TimeoutMs: 100,
+		}},
+	}, false)
+	require.NotNil(t, h)
+	require.NoError(t, h.err)
+
+	h.onProtectionChanged(true)
+	waitHook(t, h, 1)
+
+	st := h.status()
+	require.Len(t, st.Hooks, 1)
+	assert.Equal(t, uint64(1), st.Hooks[0].Failures)
+	assert.Contains(t, st.Hooks[0].LastError, "timed out")
+}
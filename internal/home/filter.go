@@ -2,6 +2,7 @@ package home
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"hash/crc32"
 	"io"
@@ -16,7 +17,9 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -25,9 +28,24 @@ var nextFilterID = time.Now().Unix() // semi-stable way to generate an unique ID
 // Filtering - module object
 type Filtering struct {
 	// conf FilteringConf
-	refreshStatus     uint32 // 0:none; 1:in progress
+	refreshStatus uint32 // 0:none; 1:in progress
+
+	// previewing is 1 while a list is previewed, see
+	// handleFilteringPreviewURL.  It's accessed atomically.
+	previewing uint32
+
 	refreshLock       sync.Mutex
 	filterTitleRegexp *regexp.Regexp
+
+	// userRulesRev is the revision of the user rules.  It's incremented
+	// each time the user rules are changed.  It's protected by config.
+	userRulesRev uint64
+
+	// activeGroups are the sorted names of the groups, the lists of which
+	// have been loaded into the filtering engine last time.  It's
+	// protected by activeGroupsLock.
+	activeGroups     []string
+	activeGroupsLock sync.Mutex
 }
 
 // Init - initialize the module
@@ -73,6 +91,10 @@ type filter struct {
 	checksum    uint32    // checksum of the file data
 	white       bool
 
+	// lastErr is the error from the last attempt to load or update the
+	// filter list, if any.
+	lastErr error
+
 	dnsfilter.Filter `yaml:",inline"`
 }
 
@@ -92,6 +114,7 @@ const (
 	statusURLChanged     = 4
 	statusURLExists      = 8
 	statusUpdateRequired = 0x10
+	statusGroupChanged   = 0x20
 )
 
 // Update properties for a filter specified by its URL
@@ -114,25 +137,35 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 
 		log.Debug("filter: set properties: %s: {%s %s %v}",
 			filt.URL, newf.Name, newf.URL, newf.Enabled)
-		filt.Name = newf.Name
 
 		if filt.URL != newf.URL {
-			r |= statusURLChanged | statusUpdateRequired
 			if filterExistsNoLock(newf.URL) {
-				return statusURLExists
+				return statusFound | statusURLExists
 			}
+
+			r |= statusURLChanged | statusUpdateRequired
 			filt.URL = newf.URL
+			filt.lastErr = nil
 			filt.unload()
 			filt.LastUpdated = time.Time{}
 			filt.checksum = 0
 			filt.RulesCount = 0
 		}
 
+		filt.Name = newf.Name
+
+		if filt.Group != newf.Group {
+			r |= statusGroupChanged
+			filt.Group = newf.Group
+		}
+
 		if filt.Enabled != newf.Enabled {
 			r |= statusEnabledChanged
 			filt.Enabled = newf.Enabled
 			if filt.Enabled {
 				if (r & statusURLChanged) == 0 {
+					// Use the previously downloaded copy, so that
+					// re-enabling the filter doesn't require network.
 					e := f.load(filt)
 					if e != nil {
 						// This isn't a fatal error,
@@ -140,10 +173,13 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 						filt.LastUpdated = time.Time{}
 						filt.checksum = 0
 						filt.RulesCount = 0
+						filt.lastErr = e
 						r |= statusUpdateRequired
 					}
 				}
 			} else {
+				// Keep the file on disk, only the rules are removed
+				// from the filtering engine.
 				filt.unload()
 			}
 		}
@@ -153,6 +189,33 @@ func (f *Filtering) filterSetProperties(url string, newf filter, whitelist bool)
 	return 0
 }
 
+// filterListName returns the name of the filter list with id, its URL if it has
+// no name, or an empty string if there is no such list.
+func filterListName(id int64) (name string) {
+	if id == 0 {
+		return "custom filtering rules"
+	}
+
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, fs := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range fs {
+			if f.ID != id {
+				continue
+			}
+
+			if f.Name != "" {
+				return f.Name
+			}
+
+			return f.URL
+		}
+	}
+
+	return ""
+}
+
 // Return TRUE if a filter with this URL exists
 func filterExists(url string) bool {
 	config.RLock()
@@ -211,6 +274,7 @@ func (f *Filtering) loadFilters(array []filter) {
 		err := f.load(filter)
 		if err != nil {
 			log.Error("Couldn't load filter %d contents due to %s", filter.ID, err)
+			filter.lastErr = err
 		}
 	}
 }
@@ -253,7 +317,12 @@ func (f *Filtering) periodicallyRefreshFilters() {
 	intval := 5 // use a dynamically increasing time interval
 	for {
 		isNetworkErr := false
-		if config.DNS.FiltersUpdateIntervalHours != 0 && atomic.CompareAndSwapUint32(&f.refreshStatus, 0, 1) {
+		// The followers only use the filters updated by the primary
+		// instance, and the filtering is disabled in safe mode.
+		if config.DNS.FiltersUpdateIntervalHours != 0 &&
+			!Context.instance.isFollower() &&
+			!Context.safeMode &&
+			atomic.CompareAndSwapUint32(&f.refreshStatus, 0, 1) {
 			f.refreshLock.Lock()
 			_, isNetworkErr = f.refreshFiltersIfNecessary(filterRefreshBlocklists | filterRefreshAllowlists)
 			f.refreshLock.Unlock()
@@ -330,10 +399,25 @@ func (f *Filtering) refreshFiltersArray(filters *[]filter, force bool) (int, []f
 		if err != nil {
 			nfail++
 			log.Printf("Failed to update filter %s: %s\n", uf.URL, err)
+			annotateStats(stats.AnnotationListFailed, fmt.Sprintf("%s: %s", filterTitle(uf), err))
 			continue
 		}
 	}
 
+	// Remember the results of the update to report them in the filtering
+	// status.
+	config.Lock()
+	for i := range updateFilters {
+		uf := &updateFilters[i]
+		for k := range *filters {
+			f := &(*filters)[k]
+			if f.ID == uf.ID && f.URL == uf.URL {
+				f.lastErr = uf.lastErr
+			}
+		}
+	}
+	config.Unlock()
+
 	if nfail == len(updateFilters) {
 		return 0, nil, nil, true
 	}
@@ -489,6 +573,7 @@ func (f *Filtering) parseFilterContents(file io.Reader) (int, uint32, string) {
 func (f *Filtering) update(filter *filter) (bool, error) {
 	b, err := f.updateIntl(filter)
 	filter.LastUpdated = time.Now()
+	filter.lastErr = err
 	if !b {
 		e := os.Chtimes(filter.Path(), filter.LastUpdated, filter.LastUpdated)
 		if e != nil {
@@ -507,6 +592,9 @@ func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (in
 	for {
 		n, err := reader.Read(buf)
 		total += n
+		if total > maxFilterSize {
+			return total, fmt.Errorf("data is greater than the maximum of %d bytes", maxFilterSize)
+		}
 
 		if htmlTest {
 			num := len(firstChunk) - firstChunkLen
@@ -546,6 +634,131 @@ func (f *Filtering) read(reader io.Reader, tmpFile *os.File, filter *filter) (in
 	}
 }
 
+// normalizeListIDN maps the internationalized domain names within the rules
+// of the downloaded list file into punycode, see dnsfilter.NormalizeRule, so
+// that the rules match the requests regardless of the form used by the list.
+// The rules which can't be mapped are dropped with a warning.  file is only
+// rewritten if there is anything to map, and is left at its start.  url is the
+// source of the list.
+func normalizeListIDN(file *os.File, url string) (err error) {
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	ok, err := hasIDNRules(file)
+	if err != nil {
+		return err
+	} else if !ok {
+		_, err = file.Seek(0, io.SeekStart)
+
+		return err
+	}
+
+	buf, err := ioutil.TempFile(filepath.Dir(file.Name()), "idn-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = buf.Close()
+		derr := os.Remove(buf.Name())
+		if err == nil {
+			err = derr
+		}
+	}()
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	err = writeNormalizedRules(buf, file, url)
+	if err != nil {
+		return err
+	}
+
+	// Copy the rules back, so that the callers keep using file.
+	_, err = buf.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(file, buf)
+	if err != nil {
+		return err
+	}
+
+	err = file.Truncate(n)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Seek(0, io.SeekStart)
+
+	return err
+}
+
+// hasIDNRules returns true if any line read from r may contain an
+// internationalized domain name.
+func hasIDNRules(r io.Reader) (ok bool, err error) {
+	br := bufio.NewReader(r)
+	for {
+		line, rerr := br.ReadString('\n')
+		if aghnet.HasIDN(line) {
+			return true, nil
+		}
+
+		if rerr == io.EOF {
+			return false, nil
+		} else if rerr != nil {
+			return false, rerr
+		}
+	}
+}
+
+// writeNormalizedRules writes the rules read from r into w with the domain
+// names normalized.  url is the source of the list, used in the warnings.
+func writeNormalizedRules(w io.Writer, r io.Reader, url string) (err error) {
+	bw := bufio.NewWriter(w)
+	br := bufio.NewReader(r)
+	rejected := 0
+	for n := 1; ; n++ {
+		line, rerr := br.ReadString('\n')
+		if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+
+		if line != "" {
+			rule := strings.TrimRight(line, "\r\n")
+			norm, nerr := dnsfilter.NormalizeRule(rule)
+			if nerr != nil {
+				log.Info("filter %s: line %d: rejecting rule %q: %s", url, n, rule, nerr)
+				rejected++
+			} else {
+				_, err = bw.WriteString(norm + "\n")
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if rerr == io.EOF {
+			break
+		}
+	}
+
+	if rejected > 0 {
+		log.Info("filter %s: rejected %d rules with invalid domain names", url, rejected)
+	}
+
+	return bw.Flush()
+}
+
 // updateIntl returns true if filter update performed successfully.
 func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 	updated = false
@@ -569,37 +782,22 @@ func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 		}
 	}()
 
-	var reader io.Reader
-	if filepath.IsAbs(filter.URL) {
-		var f io.ReadCloser
-		f, err = os.Open(filter.URL)
-		if err != nil {
-			return updated, fmt.Errorf("open file: %w", err)
-		}
-
-		defer f.Close()
-		reader = f
-	} else {
-		var resp *http.Response
-		resp, err = Context.client.Get(filter.URL)
-		if err != nil {
-			log.Printf("Couldn't request filter from URL %s, skipping: %s", filter.URL, err)
-			return updated, err
-		}
-		defer resp.Body.Close()
-
-		if resp.StatusCode != http.StatusOK {
-			log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, filter.URL)
-			return updated, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
-		}
-		reader = resp.Body
+	rc, err := openFilterSource(context.Background(), filter.URL)
+	if err != nil {
+		return updated, err
 	}
+	defer rc.Close()
 
-	total, err := f.read(reader, tmpFile, filter)
+	total, err := f.read(rc, tmpFile, filter)
 	if err != nil {
 		return updated, err
 	}
 
+	err = normalizeListIDN(tmpFile, filter.URL)
+	if err != nil {
+		return updated, fmt.Errorf("normalizing rules: %w", err)
+	}
+
 	// Extract filter name and count number of rules
 	_, _ = tmpFile.Seek(0, io.SeekStart)
 	rulesCount, checksum, filterName := f.parseFilterContents(tmpFile)
@@ -631,6 +829,53 @@ func (f *Filtering) updateIntl(filter *filter) (updated bool, err error) {
 	return updated, nil
 }
 
+// openFilterSource opens the filter list at src, which is either an absolute
+// path or an HTTP(S) URL.
+func openFilterSource(ctx context.Context, src string) (rc io.ReadCloser, err error) {
+	if filepath.IsAbs(src) {
+		rc, err = os.Open(src)
+		if err != nil {
+			return nil, fmt.Errorf("open file: %w", err)
+		}
+
+		return rc, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, src, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkFilterRequest(req)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := Context.filterClient.Do(req)
+	if err != nil {
+		log.Printf("Couldn't request filter from URL %s, skipping: %s", src, err)
+
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		_ = resp.Body.Close()
+		log.Printf("Got status code %d from URL %s, skipping", resp.StatusCode, src)
+
+		return nil, fmt.Errorf("got status code != 200: %d", resp.StatusCode)
+	}
+
+	err = checkFilterResponse(resp)
+	if err != nil {
+		_ = resp.Body.Close()
+		log.Printf("Got bad response from URL %s, skipping: %s", src, err)
+
+		return nil, err
+	}
+
+	return resp.Body, nil
+}
+
 // loads filter contents from the file in dataDir
 func (f *Filtering) load(filter *filter) error {
 	filterFilePath := filter.Path()
@@ -655,6 +900,7 @@ func (f *Filtering) load(filter *filter) error {
 	filter.RulesCount = rulesCount
 	filter.checksum = checksum
 	filter.LastUpdated = filter.LastTimeUpdated()
+	filter.lastErr = nil
 
 	return nil
 }
@@ -691,6 +937,10 @@ func (filter *filter) LastTimeUpdated() time.Time {
 func enableFilters(async bool) {
 	var filters []dnsfilter.Filter
 	var whiteFilters []dnsfilter.Filter
+
+	global, groups := activeFilterGroups()
+	Context.dnsFilter.SetFilterGroups(global)
+
 	if config.DNS.FilteringEnabled {
 		// convert array of filters
 
@@ -706,9 +956,14 @@ func enableFilters(async bool) {
 				continue
 			}
 
+			if !groups.Has(filter.Group) {
+				continue
+			}
+
 			f = dnsfilter.Filter{
 				ID:       filter.ID,
 				FilePath: filter.Path(),
+				Group:    filter.Group,
 			}
 			filters = append(filters, f)
 		}
@@ -725,5 +980,6 @@ func enableFilters(async bool) {
 		}
 	}
 
+	Context.filters.setActiveGroups(groups)
 	_ = Context.dnsFilter.SetFilters(filters, whiteFilters, async)
 }
@@ -2,6 +2,7 @@ package home
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"os"
@@ -47,7 +48,7 @@ func TestFilters(t *testing.T) {
 
 	Context = homeContext{
 		workDir: dir,
-		client: &http.Client{
+		filterClient: &http.Client{
 			Timeout: 5 * time.Second,
 		},
 	}
@@ -74,3 +75,113 @@ func TestFilters(t *testing.T) {
 	f.unload()
 	require.Nil(t, os.Remove(f.Path()))
 }
+
+func TestFiltering_filterSetProperties(t *testing.T) {
+	l := testStartFilterListener(t)
+	dir := t.TempDir()
+
+	Context = homeContext{
+		workDir: dir,
+		filterClient: &http.Client{
+			Timeout: 5 * time.Second,
+		},
+	}
+	Context.filters.Init()
+
+	u := fmt.Sprintf("http://127.0.0.1:%d/filters/1.txt", l.Addr().(*net.TCPAddr).Port)
+	f := filter{
+		Enabled: true,
+		URL:     u,
+		Name:    "Test",
+	}
+	f.ID = assignUniqueFilterID()
+
+	ok, err := Context.filters.update(&f)
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	prevFilters := config.Filters
+	config.Filters = []filter{f}
+	t.Cleanup(func() {
+		config.Filters = prevFilters
+	})
+
+	t.Run("disable", func(t *testing.T) {
+		newf := filter{Enabled: false, URL: u, Name: "Test"}
+		status := Context.filters.filterSetProperties(u, newf, false)
+		assert.Equal(t, statusFound|statusEnabledChanged, status)
+
+		fj := filterToJSON(config.Filters[0])
+		assert.Equal(t, filterStatusDisabled, fj.Status)
+		assert.Empty(t, fj.LastError)
+
+		_, err = os.Stat(f.Path())
+		assert.Nil(t, err)
+	})
+
+	t.Run("enable", func(t *testing.T) {
+		// No statusUpdateRequired means the downloaded copy is used.
+		newf := filter{Enabled: true, URL: u, Name: "Test"}
+		status := Context.filters.filterSetProperties(u, newf, false)
+		assert.Equal(t, statusFound|statusEnabledChanged, status)
+
+		fj := filterToJSON(config.Filters[0])
+		assert.Equal(t, filterStatusEnabled, fj.Status)
+		assert.EqualValues(t, 3, fj.RulesCount)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		uf := config.Filters[0]
+		uf.URL = fmt.Sprintf("http://127.0.0.1:%d/filters/404.txt", l.Addr().(*net.TCPAddr).Port)
+		_, err = Context.filters.update(&uf)
+		require.NotNil(t, err)
+
+		fj := filterToJSON(uf)
+		assert.Equal(t, filterStatusFailed, fj.Status)
+		assert.NotEmpty(t, fj.LastError)
+	})
+
+	t.Run("url_exists", func(t *testing.T) {
+		config.Filters = append(config.Filters, filter{URL: "http://example.org/2.txt"})
+
+		newf := filter{Enabled: true, URL: "http://example.org/2.txt", Name: "Other"}
+		status := Context.filters.filterSetProperties(u, newf, false)
+		assert.Equal(t, statusFound|statusURLExists, status)
+		assert.Equal(t, "Test", config.Filters[0].Name)
+	})
+}
+
+func TestNormalizeListIDN(t *testing.T) {
+	testCases := []struct {
+		name string
+		list string
+		want string
+	}{{
+		name: "ascii",
+		list: "||example.org^\r\n0.0.0.0 Example.COM\n",
+		want: "||example.org^\r\n0.0.0.0 Example.COM\n",
+	}, {
+		name: "idn",
+		list: "! Title: пример\n||пример.рф^\r\n0.0.0.0 p\u0430ypal.com\n||xn--a.com^\n||example.org^",
+		want: "! Title: пример\n||xn--e1afmkfd.xn--p1ai^\n0.0.0.0 xn--pypal-4ve.com\n||example.org^\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			f, err := ioutil.TempFile(t.TempDir(), "")
+			require.NoError(t, err)
+			t.Cleanup(func() { assert.NoError(t, f.Close()) })
+
+			_, err = f.WriteString(tc.list)
+			require.NoError(t, err)
+
+			err = normalizeListIDN(f, "http://example.org/list.txt")
+			require.NoError(t, err)
+
+			data, err := ioutil.ReadAll(f)
+			require.NoError(t, err)
+
+			assert.Equal(t, tc.want, string(data))
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package home
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Formats of the export of the blocked domains.
+const (
+	blockExportHosts = "hosts"
+	blockExportRPZ   = "rpz"
+)
+
+// blockExportTTL is the TTL of the records of the RPZ export.
+const blockExportTTL = 300
+
+// blockExport is the set of the domains blocked by the rules, which can be
+// expressed as a hosts file or a response policy zone.
+type blockExport struct {
+	// exact are the domains blocked without their subdomains, as by the
+	// hosts-syntax rules.
+	exact *aghstrings.Set
+
+	// withSubdomains are the domains blocked along with their subdomains,
+	// as by the "||example.org^" rules.
+	withSubdomains *aghstrings.Set
+
+	// skipped is the number of the rules, which couldn't be expressed:
+	// regular expressions, wildcards, exceptions, rules with modifiers, and
+	// so on.
+	skipped int
+}
+
+// newBlockExport returns a new empty export.
+func newBlockExport() (e *blockExport) {
+	return &blockExport{
+		exact:          aghstrings.NewSet(),
+		withSubdomains: aghstrings.NewSet(),
+	}
+}
+
+// exportableHost returns the lowercased host and true if host can be
+// exported.  The IP addresses and the names without dots, such as
+// "localhost", can't.
+func exportableHost(host string) (lower string, ok bool) {
+	if !strings.Contains(host, ".") || net.ParseIP(host) != nil {
+		return "", false
+	}
+
+	if aghnet.ValidateDomainName(host) != nil {
+		return "", false
+	}
+
+	return strings.ToLower(host), true
+}
+
+// addRule adds the domains blocked by the rule in line to e or counts it as
+// skipped.
+func (e *blockExport) addRule(line string) {
+	line = strings.TrimSpace(line)
+	if aghstrings.IsCommentOrEmpty(line) || line[0] == '!' {
+		return
+	}
+
+	if strings.HasPrefix(line, "||") && strings.HasSuffix(line, "^") {
+		host, ok := exportableHost(line[len("||") : len(line)-len("^")])
+		if ok {
+			e.withSubdomains.Add(host)
+		} else {
+			e.skipped++
+		}
+
+		return
+	}
+
+	fields := strings.Fields(line)
+	ip := net.ParseIP(fields[0])
+	if ip == nil {
+		host, ok := exportableHost(line)
+		if ok {
+			e.exact.Add(host)
+		} else {
+			e.skipped++
+		}
+
+		return
+	}
+
+	if !ip.IsUnspecified() && !ip.IsLoopback() {
+		// The rule rewrites the hosts to a real address.
+		e.skipped++
+
+		return
+	}
+
+	for _, f := range fields[1:] {
+		if f[0] == '#' {
+			break
+		}
+
+		host, ok := exportableHost(f)
+		if ok {
+			e.exact.Add(host)
+		} else {
+			e.skipped++
+		}
+	}
+}
+
+// addFile adds the rules from the file at path.
+func (e *blockExport) addFile(path string) (err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e.addRule(s.Text())
+	}
+
+	return s.Err()
+}
+
+// sorted returns the sorted domains of set.
+func sorted(set *aghstrings.Set) (domains []string) {
+	domains = set.Values()
+	sort.Strings(domains)
+
+	return domains
+}
+
+// writeHosts writes e as a hosts file.  The subdomains of the blocked domains
+// can't be expressed in the hosts files, so they're omitted.
+func (e *blockExport) writeHosts(w io.Writer) (err error) {
+	all := aghstrings.NewSet(e.exact.Values()...)
+	for _, d := range e.withSubdomains.Values() {
+		all.Add(d)
+	}
+
+	b := &strings.Builder{}
+	aghstrings.WriteToBuilder(b, "# Blocked domains exported by AdGuard Home\n")
+	_, _ = fmt.Fprintf(b, "# Skipped rules: %d\n", e.skipped)
+	for _, d := range sorted(all) {
+		aghstrings.WriteToBuilder(b, "0.0.0.0 ", d, "\n")
+	}
+
+	_, err = io.WriteString(w, b.String())
+
+	return err
+}
+
+// writeRPZ writes e as a response policy zone with the serial number serial.
+// The blocked domains are answered with NXDOMAIN.
+func (e *blockExport) writeRPZ(w io.Writer, serial uint32) (err error) {
+	b := &strings.Builder{}
+	aghstrings.WriteToBuilder(b, "; Blocked domains exported by AdGuard Home\n")
+	_, _ = fmt.Fprintf(b, "; Skipped rules: %d\n", e.skipped)
+	_, _ = fmt.Fprintf(b, "$TTL %d\n", blockExportTTL)
+	_, _ = fmt.Fprintf(
+		b,
+		"@ IN SOA localhost. root.localhost. %d 3600 600 86400 %d\n",
+		serial,
+		blockExportTTL,
+	)
+	aghstrings.WriteToBuilder(b, "@ IN NS localhost.\n")
+
+	for _, d := range sorted(e.withSubdomains) {
+		aghstrings.WriteToBuilder(b, d, " CNAME .\n*.", d, " CNAME .\n")
+	}
+
+	for _, d := range sorted(e.exact) {
+		if !e.withSubdomains.Has(d) {
+			aghstrings.WriteToBuilder(b, d, " CNAME .\n")
+		}
+	}
+
+	_, err = io.WriteString(w, b.String())
+
+	return err
+}
+
+// activeBlockRules returns the user rules and the paths of the files of the
+// blocklists used by the filtering engine for the requests without their own
+// groups.  Both are empty if the filtering is disabled.
+func activeBlockRules() (userRules, paths []string) {
+	config.RLock()
+	defer config.RUnlock()
+
+	if !config.DNS.FilteringEnabled {
+		return nil, nil
+	}
+
+	for _, f := range config.Filters {
+		if f.Enabled && filterGroupEnabled(f.Group) {
+			paths = append(paths, f.Path())
+		}
+	}
+
+	return aghstrings.CloneSlice(config.UserRules), paths
+}
+
+// handleFilteringExport is the handler for the GET /control/filtering/export
+// HTTP API.  It renders the domains blocked by the user rules and the enabled
+// blocklists as a hosts file or a response policy zone depending on the
+// "format" query parameter.  The Last-Modified header is the time when the
+// current filtering engine has been built, so that the consumers can poll
+// with If-Modified-Since.
+func (f *Filtering) handleFilteringExport(w http.ResponseWriter, r *http.Request) {
+	params := aghhttp.QueryParams(r.URL.Query())
+	format := params.Enum("format", blockExportHosts, blockExportHosts, blockExportRPZ)
+	err := params.Err()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	builtAt := Context.dnsFilter.Generation().BuiltAt.Truncate(time.Second)
+	if !builtAt.IsZero() {
+		if ims, perr := http.ParseTime(r.Header.Get("If-Modified-Since")); perr == nil && !builtAt.After(ims) {
+			w.WriteHeader(http.StatusNotModified)
+
+			return
+		}
+	}
+
+	userRules, paths := activeBlockRules()
+	e := newBlockExport()
+	for _, rule := range userRules {
+		e.addRule(rule)
+	}
+
+	for _, p := range paths {
+		err = e.addFile(p)
+		if err != nil {
+			// The lists, which haven't been downloaded yet, aren't
+			// used by the engine either.
+			log.Debug("filtering: export: reading %q: %s", p, err)
+		}
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "text/plain; charset=utf-8")
+	if !builtAt.IsZero() {
+		h.Set("Last-Modified", builtAt.UTC().Format(http.TimeFormat))
+	}
+
+	if format == blockExportRPZ {
+		var serial uint32 = 1
+		if !builtAt.IsZero() {
+			serial = uint32(builtAt.Unix())
+		}
+
+		err = e.writeRPZ(w, serial)
+	} else {
+		err = e.writeHosts(w)
+	}
+
+	if err != nil {
+		log.Debug("filtering: export: writing response: %s", err)
+	}
+}
@@ -0,0 +1,55 @@
+package home
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlockExport(t *testing.T) {
+	e := newBlockExport()
+	for _, rule := range []string{
+		"! Comment",
+		"# Comment",
+		"",
+		"||Ads.example^",
+		"||ads.example^",
+		"0.0.0.0 tracker.example other.example # Trackers",
+		"127.0.0.1 localhost",
+		"1.2.3.4 rewritten.example",
+		"plain.example",
+		"ads.example",
+		"/ads[0-9]+\\.example/",
+		"||wild*.example^",
+		"@@||allowed.example^",
+		"||modified.example^$client=1.2.3.4",
+	} {
+		e.addRule(rule)
+	}
+
+	assert.Equal(t, 6, e.skipped)
+
+	b := &strings.Builder{}
+	require.NoError(t, e.writeHosts(b))
+	assert.Equal(t, "# Blocked domains exported by AdGuard Home\n"+
+		"# Skipped rules: 6\n"+
+		"0.0.0.0 ads.example\n"+
+		"0.0.0.0 other.example\n"+
+		"0.0.0.0 plain.example\n"+
+		"0.0.0.0 tracker.example\n", b.String())
+
+	b.Reset()
+	require.NoError(t, e.writeRPZ(b, 1622548800))
+	assert.Equal(t, "; Blocked domains exported by AdGuard Home\n"+
+		"; Skipped rules: 6\n"+
+		"$TTL 300\n"+
+		"@ IN SOA localhost. root.localhost. 1622548800 3600 600 86400 300\n"+
+		"@ IN NS localhost.\n"+
+		"ads.example CNAME .\n"+
+		"*.ads.example CNAME .\n"+
+		"other.example CNAME .\n"+
+		"plain.example CNAME .\n"+
+		"tracker.example CNAME .\n", b.String())
+}
@@ -0,0 +1,246 @@
+package home
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Filter list download limits.
+const (
+	// maxFilterRedirects is the maximum number of the redirects followed
+	// while downloading a filter list.
+	maxFilterRedirects = 5
+
+	// maxFilterSize is the maximum size of a filter list in bytes.
+	maxFilterSize = 128 * 1024 * 1024
+
+	// filterDownloadTimeout is the timeout of a single download of a
+	// filter list including the redirects.
+	filterDownloadTimeout = 5 * time.Minute
+)
+
+// errFilterAddrForbidden is returned when a filter list URL points to an
+// address, from which the lists mustn't be downloaded.
+const errFilterAddrForbidden agherr.Error = "the address is private, special-purpose, " +
+	"or belongs to this machine; set allow_private_lists to allow it"
+
+// checkFilterIP returns an error if the filter lists mustn't be downloaded
+// from ip.  Those are the special-purpose addresses, which include the
+// loopback, the link-local, and the private ones, and the addresses of this
+// machine, unless allow_private_lists is set.
+func checkFilterIP(ip net.IP) (err error) {
+	if config.DNS.AllowPrivateLists {
+		return nil
+	}
+
+	if ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		(Context.subnetDetector != nil && Context.subnetDetector.IsSpecialNetwork(ip)) {
+		return fmt.Errorf("%s: %w", ip, errFilterAddrForbidden)
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return fmt.Errorf("getting own addresses: %w", err)
+	}
+
+	for _, a := range addrs {
+		if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(ip) {
+			return fmt.Errorf("%s: %w", ip, errFilterAddrForbidden)
+		}
+	}
+
+	return nil
+}
+
+// lookupFilterHost returns the addresses of host the same way the HTTP client
+// resolves them.
+func lookupFilterHost(ctx context.Context, host string) (ips []net.IP, err error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, nil
+	}
+
+	var addrs []net.IPAddr
+	if config.DNS.Port != 0 && Context.dnsServer != nil {
+		addrs, err = Context.dnsServer.Resolve(host)
+	} else {
+		addrs, err = net.DefaultResolver.LookupIPAddr(ctx, host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("couldn't lookup host: %s", host)
+	}
+
+	ips = make([]net.IP, len(addrs))
+	for i, a := range addrs {
+		ips[i] = a.IP
+	}
+
+	return ips, nil
+}
+
+// checkFilterHost returns an error if any of the addresses of host is
+// forbidden by checkFilterIP.  The lookup errors are ignored, since the host
+// may be unavailable temporarily, and the download reports them anyway.
+func checkFilterHost(ctx context.Context, host string) (err error) {
+	if config.DNS.AllowPrivateLists {
+		return nil
+	}
+
+	ips, err := lookupFilterHost(ctx, host)
+	if err != nil {
+		log.Debug("filters: checking host %q: %s", host, err)
+
+		return nil
+	}
+
+	for _, ip := range ips {
+		err = checkFilterIP(ip)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// filterDialContext is the DialContext of filterHTTPClient.  It refuses to
+// connect if any of the addresses of the host is forbidden, which also
+// protects from the DNS rebinding since the checked addresses are the ones
+// used.
+func filterDialContext(ctx context.Context, network, addr string) (conn net.Conn, err error) {
+	if config.ProxyURL != "" {
+		// The proxy is set by the administrator, and the hosts of the
+		// lists are checked before the requests in checkFilterRequest.
+		return customDialContext(ctx, network, addr)
+	}
+
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	ips, err := lookupFilterHost(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range ips {
+		err = checkFilterIP(ip)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	dialer := &net.Dialer{
+		Timeout: time.Minute * 5,
+	}
+
+	var dialErrs []error
+	for _, ip := range ips {
+		conn, err = dialer.DialContext(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err != nil {
+			dialErrs = append(dialErrs, err)
+
+			continue
+		}
+
+		return conn, nil
+	}
+
+	return nil, agherr.Many(fmt.Sprintf("couldn't dial to %s", addr), dialErrs...)
+}
+
+// checkFilterRequest returns an error if the filter list mustn't be
+// downloaded with req.  The addresses are checked here only if a proxy is
+// used, since otherwise filterDialContext checks them.
+func checkFilterRequest(req *http.Request) (err error) {
+	if s := req.URL.Scheme; s != schemeHTTP && s != schemeHTTPS {
+		return fmt.Errorf("invalid scheme %q", s)
+	}
+
+	if config.ProxyURL == "" {
+		return nil
+	}
+
+	return checkFilterHost(req.Context(), req.URL.Hostname())
+}
+
+// filterCheckRedirect is the CheckRedirect of filterHTTPClient.
+func filterCheckRedirect(req *http.Request, via []*http.Request) (err error) {
+	if len(via) > maxFilterRedirects {
+		return fmt.Errorf("more than %d redirects", maxFilterRedirects)
+	}
+
+	err = checkFilterRequest(req)
+	if err != nil {
+		return fmt.Errorf("redirect to %s: %w", req.URL, err)
+	}
+
+	return nil
+}
+
+// newFilterHTTPClient returns a new HTTP client for downloading the filter
+// lists.
+func newFilterHTTPClient(tlsConf *tls.Config) (c *http.Client) {
+	return &http.Client{
+		Timeout:       filterDownloadTimeout,
+		CheckRedirect: filterCheckRedirect,
+		Transport: &http.Transport{
+			DialContext:     filterDialContext,
+			Proxy:           getHTTPProxy,
+			TLSClientConfig: tlsConf,
+		},
+	}
+}
+
+// checkFilterResponse returns an error if resp doesn't look like a filter
+// list.
+func checkFilterResponse(resp *http.Response) (err error) {
+	if resp.ContentLength > maxFilterSize {
+		return fmt.Errorf("size %d is greater than the maximum of %d bytes", resp.ContentLength, maxFilterSize)
+	}
+
+	ct := resp.Header.Get("Content-Type")
+	if ct == "" {
+		return nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("bad content type %q: %w", ct, err)
+	}
+
+	switch {
+	case
+		mt == "text/html",
+		strings.HasPrefix(mt, "audio/"),
+		strings.HasPrefix(mt, "font/"),
+		strings.HasPrefix(mt, "image/"),
+		strings.HasPrefix(mt, "video/"):
+		return fmt.Errorf("content type %q is not plain text", mt)
+	default:
+		return nil
+	}
+}
+
+// validateFilterURLHost returns an error if the filter lists mustn't be
+// downloaded from the host of u.
+func validateFilterURLHost(u *url.URL) (err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	return checkFilterHost(ctx, u.Hostname())
+}
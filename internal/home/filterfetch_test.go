@@ -0,0 +1,171 @@
+package home
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckFilterIP(t *testing.T) {
+	snd, err := aghnet.NewSubnetDetector()
+	require.NoError(t, err)
+
+	prevSND := Context.subnetDetector
+	Context.subnetDetector = snd
+	t.Cleanup(func() {
+		Context.subnetDetector = prevSND
+		config.DNS.AllowPrivateLists = false
+	})
+
+	testCases := []struct {
+		name    string
+		ip      net.IP
+		wantErr bool
+	}{{
+		name:    "public",
+		ip:      net.IP{94, 140, 14, 14},
+		wantErr: false,
+	}, {
+		name:    "loopback",
+		ip:      net.IP{127, 0, 0, 1},
+		wantErr: true,
+	}, {
+		name:    "metadata",
+		ip:      net.IP{169, 254, 169, 254},
+		wantErr: true,
+	}, {
+		name:    "private",
+		ip:      net.IP{192, 168, 1, 1},
+		wantErr: true,
+	}, {
+		name:    "unspecified",
+		ip:      net.IPv4zero,
+		wantErr: true,
+	}, {
+		name:    "ipv6_loopback",
+		ip:      net.IPv6loopback,
+		wantErr: true,
+	}, {
+		name:    "ipv6_ula",
+		ip:      net.ParseIP("fd00::1"),
+		wantErr: true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config.DNS.AllowPrivateLists = false
+			err = checkFilterIP(tc.ip)
+			if tc.wantErr {
+				assert.ErrorIs(t, err, errFilterAddrForbidden)
+			} else {
+				assert.NoError(t, err)
+			}
+
+			config.DNS.AllowPrivateLists = true
+			assert.NoError(t, checkFilterIP(tc.ip))
+		})
+	}
+}
+
+func TestCheckFilterResponse(t *testing.T) {
+	testCases := []struct {
+		name    string
+		ct      string
+		wantErr string
+		size    int64
+	}{{
+		name:    "plain",
+		ct:      "text/plain; charset=utf-8",
+		wantErr: "",
+		size:    1024,
+	}, {
+		name:    "no_type",
+		ct:      "",
+		wantErr: "",
+		size:    -1,
+	}, {
+		name:    "html",
+		ct:      "text/html",
+		wantErr: `content type "text/html" is not plain text`,
+		size:    1024,
+	}, {
+		name:    "image",
+		ct:      "image/png",
+		wantErr: `content type "image/png" is not plain text`,
+		size:    1024,
+	}, {
+		name:    "too_big",
+		ct:      "text/plain",
+		wantErr: "size 134217729 is greater than the maximum of 134217728 bytes",
+		size:    maxFilterSize + 1,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := &http.Response{
+				Header:        http.Header{},
+				ContentLength: tc.size,
+			}
+			if tc.ct != "" {
+				resp.Header.Set("Content-Type", tc.ct)
+			}
+
+			err := checkFilterResponse(resp)
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestFilterHTTPClient(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, "/redirect", http.StatusFound)
+
+			return
+		}
+
+		_, _ = w.Write([]byte("||example.org^\n"))
+	}))
+	t.Cleanup(srv.Close)
+
+	c := newFilterHTTPClient(nil)
+
+	t.Run("forbidden", func(t *testing.T) {
+		config.DNS.AllowPrivateLists = false
+
+		_, err := c.Get(srv.URL)
+		assert.ErrorIs(t, err, errFilterAddrForbidden)
+	})
+
+	t.Run("allowed", func(t *testing.T) {
+		config.DNS.AllowPrivateLists = true
+		t.Cleanup(func() { config.DNS.AllowPrivateLists = false })
+
+		resp, err := c.Get(srv.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("redirects", func(t *testing.T) {
+		config.DNS.AllowPrivateLists = true
+		t.Cleanup(func() { config.DNS.AllowPrivateLists = false })
+
+		_, err := c.Get(srv.URL + "/redirect")
+		var uerr *url.Error
+		require.ErrorAs(t, err, &uerr)
+
+		assert.EqualError(t, uerr.Err, "more than 5 redirects")
+	})
+}
@@ -0,0 +1,235 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+)
+
+// filterGroup is the global state of a group of filter lists.  The groups,
+// which aren't in the configuration, are enabled.
+type filterGroup struct {
+	Name    string `yaml:"name" json:"name"`
+	Enabled bool   `yaml:"enabled" json:"enabled"`
+}
+
+// filterGroupEnabled returns true if the group with name is enabled globally.
+// The ungrouped lists are always enabled.
+func filterGroupEnabled(name string) (ok bool) {
+	if name == "" {
+		return true
+	}
+
+	for _, g := range config.FilterGroups {
+		if g.Name == name {
+			return g.Enabled
+		}
+	}
+
+	return true
+}
+
+// activeFilterGroups returns the sorted names of the groups of the enabled
+// blocklists, which are enabled globally, and the set of the groups, the
+// blocklists of which should be loaded.  The latter also contains the groups
+// referenced by the clients and the profiles, and the empty name of the
+// ungrouped lists.
+func activeFilterGroups() (global []string, active *aghstrings.Set) {
+	active = Context.clients.referencedFilterGroups()
+	active.Add("")
+
+	global = []string{}
+	seen := aghstrings.NewSet()
+	for _, f := range config.Filters {
+		if !f.Enabled || f.Group == "" || seen.Has(f.Group) {
+			continue
+		}
+
+		seen.Add(f.Group)
+		if filterGroupEnabled(f.Group) {
+			global = append(global, f.Group)
+			active.Add(f.Group)
+		}
+	}
+
+	sort.Strings(global)
+
+	return global, active
+}
+
+// setActiveGroups remembers the groups of the lists loaded into the filtering
+// engine.
+func (f *Filtering) setActiveGroups(active *aghstrings.Set) {
+	vals := active.Values()
+	sort.Strings(vals)
+
+	f.activeGroupsLock.Lock()
+	defer f.activeGroupsLock.Unlock()
+
+	f.activeGroups = vals
+}
+
+// refreshFilterGroups rebuilds the filtering engine if the set of the groups,
+// the lists of which should be loaded, has changed since the last rebuild.
+// It's called after the groups of the clients or the profiles are changed.
+func (f *Filtering) refreshFilterGroups() {
+	_, active := activeFilterGroups()
+	vals := active.Values()
+	sort.Strings(vals)
+
+	f.activeGroupsLock.Lock()
+	changed := strings.Join(vals, "\n") != strings.Join(f.activeGroups, "\n")
+	f.activeGroupsLock.Unlock()
+
+	if changed {
+		enableFilters(true)
+	}
+}
+
+// referencedFilterGroups returns the set of the groups referenced by the
+// clients with their own groups and by the profiles.
+func (clients *clientsContainer) referencedFilterGroups() (groups *aghstrings.Set) {
+	groups = aghstrings.NewSet()
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, c := range clients.list {
+		if !c.UseOwnFilterGroups {
+			continue
+		}
+
+		for _, g := range c.FilterGroups {
+			groups.Add(g)
+		}
+	}
+
+	for _, p := range clients.profiles {
+		for _, g := range p.FilterGroups {
+			groups.Add(g)
+		}
+	}
+
+	return groups
+}
+
+// filterGroupJSON is the state of a group of filter lists in the filtering
+// status.
+type filterGroupJSON struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+
+	// Lists is the number of the blocklists in the group.
+	Lists int `json:"lists"`
+
+	// RulesCount is the number of the rules of the enabled lists of the
+	// group.
+	RulesCount uint32 `json:"rules_count"`
+
+	// Hits is the number of the requests matched by the rules of the lists
+	// of the group since the start.
+	Hits uint64 `json:"hits"`
+}
+
+// filterGroupsToJSON aggregates the states of the blocklists by their groups.
+// The result is sorted by the name of the group.  config is expected to be
+// locked for reading.
+func filterGroupsToJSON(hits map[int64]uint64) (groups []filterGroupJSON) {
+	byName := map[string]*filterGroupJSON{}
+	for _, f := range config.Filters {
+		if f.Group == "" {
+			continue
+		}
+
+		g, ok := byName[f.Group]
+		if !ok {
+			g = &filterGroupJSON{
+				Name:    f.Group,
+				Enabled: filterGroupEnabled(f.Group),
+			}
+			byName[f.Group] = g
+		}
+
+		g.Lists++
+		g.Hits += hits[f.ID]
+		if f.Enabled {
+			g.RulesCount += uint32(f.RulesCount)
+		}
+	}
+
+	groups = make([]filterGroupJSON, 0, len(byName))
+	for _, g := range byName {
+		groups = append(groups, *g)
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+
+	return groups
+}
+
+// setFilterGroup sets the global state of the group with name.  It returns
+// false if there are no blocklists in the group.
+func setFilterGroup(name string, enabled bool) (ok bool) {
+	config.Lock()
+	defer config.Unlock()
+
+	for _, f := range config.Filters {
+		if f.Group == name {
+			ok = true
+
+			break
+		}
+	}
+
+	if !ok {
+		return false
+	}
+
+	for i := range config.FilterGroups {
+		if g := &config.FilterGroups[i]; g.Name == name {
+			g.Enabled = enabled
+
+			return true
+		}
+	}
+
+	config.FilterGroups = append(config.FilterGroups, filterGroup{
+		Name:    name,
+		Enabled: enabled,
+	})
+
+	return true
+}
+
+// handleFilteringSetGroup is the handler for the POST
+// /control/filtering/set_group HTTP API.  The filtering engine is rebuilt once
+// for all the lists of the group.
+func (f *Filtering) handleFilteringSetGroup(w http.ResponseWriter, r *http.Request) {
+	req := filterGroup{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	if req.Name == "" {
+		httpError(w, http.StatusBadRequest, "group name is required")
+
+		return
+	}
+
+	if !setFilterGroup(req.Name, req.Enabled) {
+		httpError(w, http.StatusBadRequest, "group %q not found", req.Name)
+
+		return
+	}
+
+	onConfigModified()
+	enableFilters(true)
+}
@@ -0,0 +1,63 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterGroups(t *testing.T) {
+	prevFilters, prevGroups := config.Filters, config.FilterGroups
+	t.Cleanup(func() {
+		config.Filters, config.FilterGroups = prevFilters, prevGroups
+	})
+
+	config.FilterGroups = nil
+	config.Filters = []filter{{
+		Enabled:    true,
+		RulesCount: 10,
+		Filter:     dnsfilter.Filter{ID: 1, Group: "ads"},
+	}, {
+		Enabled:    false,
+		RulesCount: 20,
+		Filter:     dnsfilter.Filter{ID: 2, Group: "ads"},
+	}, {
+		Enabled:    true,
+		RulesCount: 30,
+		Filter:     dnsfilter.Filter{ID: 3, Group: "malware"},
+	}, {
+		Enabled:    true,
+		RulesCount: 40,
+		Filter:     dnsfilter.Filter{ID: 4},
+	}}
+
+	require.True(t, setFilterGroup("malware", false))
+	assert.False(t, setFilterGroup("unknown", false))
+
+	assert.True(t, filterGroupEnabled("ads"))
+	assert.False(t, filterGroupEnabled("malware"))
+	assert.True(t, filterGroupEnabled(""))
+
+	global, active := activeFilterGroups()
+	assert.Equal(t, []string{"ads"}, global)
+	assert.True(t, active.Has(""))
+	assert.True(t, active.Has("ads"))
+	assert.False(t, active.Has("malware"))
+
+	groups := filterGroupsToJSON(map[int64]uint64{1: 5, 2: 1, 3: 7, 4: 100})
+	assert.Equal(t, []filterGroupJSON{{
+		Name:       "ads",
+		Enabled:    true,
+		Lists:      2,
+		RulesCount: 10,
+		Hits:       6,
+	}, {
+		Name:       "malware",
+		Enabled:    false,
+		Lists:      1,
+		RulesCount: 30,
+		Hits:       7,
+	}}, groups)
+}
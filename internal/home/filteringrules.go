@@ -0,0 +1,224 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Actions for the generated rules.
+const (
+	ruleActionBlock = "block"
+	ruleActionAllow = "allow"
+)
+
+// errNoQueryLog is returned when the query log entry is requested, but the
+// query log isn't initialized.
+const errNoQueryLog agherr.Error = "query log is not initialized"
+
+// ruleClientModifier returns the value of the $client modifier for the given
+// client.  IP addresses and CIDRs are used as-is, names are quoted.
+func ruleClientModifier(client string) (val string) {
+	if net.ParseIP(client) != nil {
+		return client
+	}
+
+	if _, _, err := net.ParseCIDR(client); err == nil {
+		return client
+	}
+
+	return "'" + strings.ReplaceAll(client, "'", `\'`) + "'"
+}
+
+// newUserRule returns the rule blocking or, if allow is true, unblocking host
+// and its subdomains.  If client is not empty, the rule is scoped to it.
+func newUserRule(host string, allow bool, client string) (rule string, err error) {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	err = aghnet.ValidateDomainName(host)
+	if err != nil {
+		return "", fmt.Errorf("validating host: %w", err)
+	}
+
+	rule = "||" + host + "^"
+	if allow {
+		rule = "@@" + rule
+	}
+
+	if client != "" {
+		rule += "$client=" + ruleClientModifier(client)
+	}
+
+	_, err = rules.NewNetworkRule(rule, 0)
+	if err != nil {
+		return "", fmt.Errorf("validating rule %q: %w", rule, err)
+	}
+
+	return rule, nil
+}
+
+// entryClient returns the value used to scope the rules to the client of the
+// query log entry.  The name of the persistent client is preferred, since the
+// $client modifier doesn't match client IDs.
+func entryClient(ei *querylog.EntryInfo) (client string) {
+	for _, id := range []string{ei.ClientID, ei.ClientIP.String()} {
+		if id == "" {
+			continue
+		}
+
+		if c, ok := Context.clients.Find(id); ok {
+			return c.Name
+		}
+	}
+
+	return ei.ClientIP.String()
+}
+
+// addUserRule appends rule to the user rules unless it's already there and
+// returns the current revision of the user rules.  It's a batch of a single
+// addition, see applyUserRulesBatch.
+func (f *Filtering) addUserRule(rule string) (added bool, rev uint64) {
+	resp := f.applyUserRulesBatch(&rulesBatchReq{Add: []string{rule}})
+
+	return resp.Applied, resp.UserRulesRevision
+}
+
+// ruleFromEntryReq is the request for generating a filtering rule.
+type ruleFromEntryReq struct {
+	// ID is the ID of the query log entry, which is the value of its "time"
+	// field.  If set, Host is ignored.
+	ID string `json:"id"`
+
+	// Host is the hostname to generate the rule for.
+	Host string `json:"host"`
+
+	// Action is either ruleActionBlock or ruleActionAllow.  If empty and ID
+	// is set, the entry's result is reverted.
+	Action string `json:"action"`
+
+	// Client, if not empty, is the client to scope the rule to.
+	Client string `json:"client"`
+
+	// ScopeToClient, if true, scopes the rule to the client of the query
+	// log entry.
+	ScopeToClient bool `json:"scope_to_client"`
+
+	// Apply, if true, means that the rule should be appended to the user
+	// rules.
+	Apply bool `json:"apply"`
+}
+
+// ruleFromEntryResp is the response to a ruleFromEntryReq.
+type ruleFromEntryResp struct {
+	// Rule is the generated rule.
+	Rule string `json:"rule"`
+
+	// Applied is true if the rule has been appended to the user rules.
+	// It's false if the same rule is already there.
+	Applied bool `json:"applied"`
+
+	// UserRulesRevision is the revision of the user rules after the
+	// request.
+	UserRulesRevision uint64 `json:"user_rules_revision"`
+}
+
+// parseRuleFromEntryReq returns the host, the client, and whether the rule
+// should unblock the host for the request.
+func parseRuleFromEntryReq(req *ruleFromEntryReq) (host, client string, allow bool, err error) {
+	host, client = req.Host, req.Client
+	switch req.Action {
+	case ruleActionBlock, ruleActionAllow:
+		allow = req.Action == ruleActionAllow
+	case "":
+		if req.ID == "" {
+			return "", "", false, agherr.Error("action is required when host is set")
+		}
+	default:
+		return "", "", false, fmt.Errorf("unknown action %q", req.Action)
+	}
+
+	if req.ID == "" {
+		if host == "" {
+			return "", "", false, agherr.Error("either id or host is required")
+		}
+
+		return host, client, allow, nil
+	}
+
+	if Context.queryLog == nil {
+		return "", "", false, errNoQueryLog
+	}
+
+	t, err := aghtime.Parse(req.ID)
+	if err != nil {
+		return "", "", false, fmt.Errorf("parsing id: %w", err)
+	}
+
+	ei, ok := Context.queryLog.Entry(t)
+	if !ok {
+		return "", "", false, fmt.Errorf("no query log entry with id %q", req.ID)
+	}
+
+	host = ei.Host
+	if req.Action == "" {
+		allow = ei.Result.IsFiltered
+	}
+
+	if req.ScopeToClient && client == "" {
+		client = entryClient(ei)
+	}
+
+	return host, client, allow, nil
+}
+
+// handleFilteringRuleFromEntry is the handler for the
+// POST /control/filtering/rule_from_entry HTTP API.
+func (f *Filtering) handleFilteringRuleFromEntry(w http.ResponseWriter, r *http.Request) {
+	req := &ruleFromEntryReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	host, client, allow, err := parseRuleFromEntryReq(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	resp := ruleFromEntryResp{}
+	resp.Rule, err = newUserRule(host, allow, client)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if req.Apply {
+		resp.Applied, resp.UserRulesRevision = f.addUserRule(resp.Rule)
+	} else {
+		config.RLock()
+		resp.UserRulesRevision = f.userRulesRev
+		config.RUnlock()
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
@@ -0,0 +1,158 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewUserRule(t *testing.T) {
+	testCases := []struct {
+		name    string
+		host    string
+		client  string
+		want    string
+		wantErr bool
+		allow   bool
+	}{{
+		name:    "block",
+		host:    "Example.org.",
+		client:  "",
+		want:    "||example.org^",
+		wantErr: false,
+		allow:   false,
+	}, {
+		name:    "allow",
+		host:    "example.org",
+		client:  "",
+		want:    "@@||example.org^",
+		wantErr: false,
+		allow:   true,
+	}, {
+		name:    "client_ip",
+		host:    "example.org",
+		client:  "1.2.3.4",
+		want:    "||example.org^$client=1.2.3.4",
+		wantErr: false,
+		allow:   false,
+	}, {
+		name:    "client_name",
+		host:    "example.org",
+		client:  "Frank's laptop",
+		want:    `@@||example.org^$client='Frank\'s laptop'`,
+		wantErr: false,
+		allow:   true,
+	}, {
+		name:    "bad_host",
+		host:    "example..org",
+		client:  "",
+		want:    "",
+		wantErr: true,
+		allow:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			rule, err := newUserRule(tc.host, tc.allow, tc.client)
+			if tc.wantErr {
+				assert.NotNil(t, err)
+
+				return
+			}
+
+			require.Nil(t, err)
+			assert.Equal(t, tc.want, rule)
+		})
+	}
+}
+
+// testQueryLog is a querylog.QueryLog implementation for tests.
+type testQueryLog struct {
+	// QueryLog is embedded here simply to make testQueryLog
+	// a querylog.QueryLog without actually implementing all methods.
+	querylog.QueryLog
+
+	entry *querylog.EntryInfo
+}
+
+// Entry implements the querylog.QueryLog interface for *testQueryLog.
+func (l *testQueryLog) Entry(t time.Time) (ei *querylog.EntryInfo, ok bool) {
+	if l.entry == nil || !l.entry.Time.Equal(t) {
+		return nil, false
+	}
+
+	return l.entry, true
+}
+
+func TestParseRuleFromEntryReq(t *testing.T) {
+	entryTime := time.Date(2021, 4, 1, 12, 0, 0, 123, time.UTC)
+
+	Context = homeContext{
+		queryLog: &testQueryLog{
+			entry: &querylog.EntryInfo{
+				Time:     entryTime,
+				ClientIP: net.IP{1, 2, 3, 4},
+				Host:     "blocked.example.org",
+				Result: dnsfilter.Result{
+					IsFiltered: true,
+					Reason:     dnsfilter.FilteredBlockList,
+				},
+			},
+		},
+	}
+	t.Cleanup(func() {
+		Context = homeContext{}
+	})
+
+	id := entryTime.Format(time.RFC3339Nano)
+
+	t.Run("entry", func(t *testing.T) {
+		host, client, allow, err := parseRuleFromEntryReq(&ruleFromEntryReq{
+			ID: id,
+		})
+		require.Nil(t, err)
+
+		assert.Equal(t, "blocked.example.org", host)
+		assert.Empty(t, client)
+		assert.True(t, allow)
+	})
+
+	t.Run("entry_action", func(t *testing.T) {
+		_, client, allow, err := parseRuleFromEntryReq(&ruleFromEntryReq{
+			ID:     id,
+			Action: ruleActionBlock,
+			Client: "laptop",
+		})
+		require.Nil(t, err)
+
+		assert.Equal(t, "laptop", client)
+		assert.False(t, allow)
+	})
+
+	t.Run("unknown_entry", func(t *testing.T) {
+		_, _, _, err := parseRuleFromEntryReq(&ruleFromEntryReq{
+			ID: entryTime.Add(time.Second).Format(time.RFC3339Nano),
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("host_no_action", func(t *testing.T) {
+		_, _, _, err := parseRuleFromEntryReq(&ruleFromEntryReq{
+			Host: "example.org",
+		})
+		assert.NotNil(t, err)
+	})
+
+	t.Run("bad_action", func(t *testing.T) {
+		_, _, _, err := parseRuleFromEntryReq(&ruleFromEntryReq{
+			Host:   "example.org",
+			Action: "drop",
+		})
+		assert.NotNil(t, err)
+	})
+}
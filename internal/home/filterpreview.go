@@ -0,0 +1,417 @@
+package home
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/miekg/dns"
+)
+
+// Filter list preview limits.
+const (
+	// defaultPreviewHours is the number of the last hours of the query log
+	// evaluated if filterPreviewReq.Hours isn't set.
+	defaultPreviewHours = 24
+
+	// maxPreviewHours is the largest allowed filterPreviewReq.Hours.
+	maxPreviewHours = 90 * 24
+
+	// defaultPreviewLimit is the number of the top domains and clients
+	// returned if filterPreviewReq.Limit isn't set.
+	defaultPreviewLimit = 20
+
+	// maxPreviewLimit is the largest allowed filterPreviewReq.Limit.
+	maxPreviewLimit = 100
+
+	// previewDownloadTimeout is the timeout of the download of the list.
+	previewDownloadTimeout = time.Minute
+
+	// previewTimeBudget is the longest time spent on the evaluation of the
+	// query log.  The partial results are returned after it.
+	previewTimeBudget = 20 * time.Second
+
+	// maxPreviewKeys is the maximum number of the distinct domains and of
+	// the distinct clients counted.  The newly blocked requests for the
+	// rest are only counted in the totals.
+	maxPreviewKeys = 100_000
+)
+
+// previewListID is the filter list ID of the previewed list.  It doesn't
+// collide with the IDs of the real lists, which are Unix times.
+const previewListID = -1
+
+// filterPreviewReq is the request to the POST /control/filtering/preview_url
+// HTTP API.
+type filterPreviewReq struct {
+	// URL is the URL or the absolute path of the list.
+	URL string `json:"url"`
+
+	// Hours is the number of the last hours of the query log to evaluate
+	// the list against.
+	Hours uint32 `json:"hours"`
+
+	// Limit is the number of the top domains and clients to return.
+	Limit uint32 `json:"limit"`
+}
+
+// previewDomainJSON is a domain, which would be newly blocked by the previewed
+// list.
+type previewDomainJSON struct {
+	Domain string `json:"domain"`
+
+	// Rule is the text of the first rule of the list, which has blocked the
+	// domain.
+	Rule string `json:"rule"`
+
+	Count uint64 `json:"count"`
+}
+
+// previewClientJSON is a client, the requests of which would be newly blocked
+// by the previewed list.
+type previewClientJSON struct {
+	// Client is the ClientID or the IP address of the client.
+	Client string `json:"client"`
+
+	Count uint64 `json:"count"`
+}
+
+// filterPreviewResp is the response to the POST /control/filtering/preview_url
+// HTTP API.
+type filterPreviewResp struct {
+	// TopDomains are the domains most often newly blocked.
+	TopDomains []*previewDomainJSON `json:"top_domains"`
+
+	// TopClients are the clients most often affected.
+	TopClients []*previewClientJSON `json:"top_clients"`
+
+	// RulesCount is the number of the rules in the list.
+	RulesCount int `json:"rules_count"`
+
+	// AffectedClients is the number of the distinct affected clients.
+	AffectedClients int `json:"affected_clients"`
+
+	// Scanned is the number of the evaluated query log entries.
+	Scanned uint64 `json:"scanned"`
+
+	// AlreadyFiltered is the number of the evaluated entries, which have
+	// already been filtered.
+	AlreadyFiltered uint64 `json:"already_filtered"`
+
+	// NewlyBlocked is the number of the evaluated entries, which would
+	// also be blocked by the list.
+	NewlyBlocked uint64 `json:"newly_blocked"`
+
+	// FilteredPercentage is the share of AlreadyFiltered in Scanned.
+	FilteredPercentage float64 `json:"filtered_percentage"`
+
+	// AdditionalPercentage is the share of NewlyBlocked in Scanned.
+	AdditionalPercentage float64 `json:"additional_percentage"`
+
+	// Complete is false if the evaluation has been stopped before all the
+	// entries within the requested period have been evaluated, so the
+	// results are partial.
+	Complete bool `json:"complete"`
+}
+
+// previewDomain is the count of the newly blocked requests for a domain.
+type previewDomain struct {
+	rule  string
+	count uint64
+}
+
+// listPreview evaluates a filter list against the query log entries.
+type listPreview struct {
+	engine *filtering.Engine
+
+	domains map[string]*previewDomain
+	clients map[string]uint64
+
+	scanned         uint64
+	alreadyFiltered uint64
+	newlyBlocked    uint64
+}
+
+// newListPreview returns a new preview of the list matched by engine.
+func newListPreview(engine *filtering.Engine) (p *listPreview) {
+	return &listPreview{
+		engine:  engine,
+		domains: map[string]*previewDomain{},
+		clients: map[string]uint64{},
+	}
+}
+
+// add evaluates the list against ei.  It's used as the callback of
+// querylog.QueryLog.Scan.
+func (p *listPreview) add(ei *querylog.EntryInfo) (cont bool) {
+	p.scanned++
+
+	switch {
+	case ei.Result.IsFiltered:
+		p.alreadyFiltered++
+
+		return true
+	case ei.Result.Reason == dnsfilter.NotFilteredAllowList:
+		// The allowlists have priority over any blocklist.
+		return true
+	}
+
+	host := strings.ToLower(ei.Host)
+	cli := &filtering.ClientContext{
+		IP: ei.ClientIP,
+	}
+
+	res, err := p.engine.Match(host, dns.StringToType[ei.QType], cli)
+	if err != nil {
+		log.Debug("filtering: preview: matching %q: %s", host, err)
+
+		return true
+	} else if res.Reason != filtering.Blocked {
+		return true
+	}
+
+	p.newlyBlocked++
+
+	if d, ok := p.domains[host]; ok {
+		d.count++
+	} else if len(p.domains) < maxPreviewKeys {
+		d = &previewDomain{count: 1}
+		if len(res.Rules) > 0 {
+			d.rule = res.Rules[0].Text
+		}
+
+		p.domains[host] = d
+	}
+
+	client := ei.ClientID
+	if client == "" && ei.ClientIP != nil {
+		client = ei.ClientIP.String()
+	}
+
+	if _, ok := p.clients[client]; ok || len(p.clients) < maxPreviewKeys {
+		p.clients[client]++
+	}
+
+	return true
+}
+
+// percentage returns the share of n in total in percents.
+func percentage(n, total uint64) (pct float64) {
+	if total == 0 {
+		return 0
+	}
+
+	return float64(n) * 100 / float64(total)
+}
+
+// result returns the results of the preview with at most limit top domains and
+// clients.
+func (p *listPreview) result(limit int, complete bool) (resp *filterPreviewResp) {
+	resp = &filterPreviewResp{
+		TopDomains:           make([]*previewDomainJSON, 0, len(p.domains)),
+		TopClients:           make([]*previewClientJSON, 0, len(p.clients)),
+		AffectedClients:      len(p.clients),
+		Scanned:              p.scanned,
+		AlreadyFiltered:      p.alreadyFiltered,
+		NewlyBlocked:         p.newlyBlocked,
+		FilteredPercentage:   percentage(p.alreadyFiltered, p.scanned),
+		AdditionalPercentage: percentage(p.newlyBlocked, p.scanned),
+		Complete:             complete,
+	}
+
+	for host, d := range p.domains {
+		resp.TopDomains = append(resp.TopDomains, &previewDomainJSON{
+			Domain: host,
+			Rule:   d.rule,
+			Count:  d.count,
+		})
+	}
+
+	sort.Slice(resp.TopDomains, func(i, j int) bool {
+		a, b := resp.TopDomains[i], resp.TopDomains[j]
+
+		return a.Count > b.Count || (a.Count == b.Count && a.Domain < b.Domain)
+	})
+
+	if len(resp.TopDomains) > limit {
+		resp.TopDomains = resp.TopDomains[:limit]
+	}
+
+	for client, n := range p.clients {
+		resp.TopClients = append(resp.TopClients, &previewClientJSON{
+			Client: client,
+			Count:  n,
+		})
+	}
+
+	sort.Slice(resp.TopClients, func(i, j int) bool {
+		a, b := resp.TopClients[i], resp.TopClients[j]
+
+		return a.Count > b.Count || (a.Count == b.Count && a.Client < b.Client)
+	})
+
+	if len(resp.TopClients) > limit {
+		resp.TopClients = resp.TopClients[:limit]
+	}
+
+	return resp
+}
+
+// validate returns an error if req is invalid and fills in the defaults.
+func (req *filterPreviewReq) validate() (err error) {
+	err = validateFilterURL(req.URL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+
+	if req.Hours == 0 {
+		req.Hours = defaultPreviewHours
+	} else if req.Hours > maxPreviewHours {
+		return fmt.Errorf("hours must not be greater than %d", maxPreviewHours)
+	}
+
+	if req.Limit == 0 {
+		req.Limit = defaultPreviewLimit
+	} else if req.Limit > maxPreviewLimit {
+		return fmt.Errorf("limit must not be greater than %d", maxPreviewLimit)
+	}
+
+	return nil
+}
+
+// downloadPreviewList downloads the list from src into a new temporary file
+// and returns its path and the number of the rules in it.  The file must be
+// removed by the caller.
+func (f *Filtering) downloadPreviewList(ctx context.Context, src string) (fn string, rulesCount int, err error) {
+	tmpFile, err := ioutil.TempFile(filepath.Join(Context.getDataDir(), filterDir), "preview-")
+	if err != nil {
+		return "", 0, err
+	}
+	defer func() {
+		derr := tmpFile.Close()
+		if err == nil {
+			err = derr
+		}
+
+		if err != nil {
+			_ = os.Remove(tmpFile.Name())
+		}
+	}()
+
+	rc, err := openFilterSource(ctx, src)
+	if err != nil {
+		return "", 0, err
+	}
+	defer rc.Close()
+
+	_, err = f.read(rc, tmpFile, &filter{URL: src})
+	if err != nil {
+		return "", 0, err
+	}
+
+	// normalizeListIDN leaves the file at its start.
+	err = normalizeListIDN(tmpFile, src)
+	if err != nil {
+		return "", 0, fmt.Errorf("normalizing rules: %w", err)
+	}
+
+	rulesCount, _, _ = f.parseFilterContents(tmpFile)
+
+	return tmpFile.Name(), rulesCount, nil
+}
+
+// handleFilteringPreviewURL is the handler for the
+// POST /control/filtering/preview_url HTTP API.  It downloads the list without
+// adding it and evaluates it against the last hours of the query log.  Only
+// one preview runs at a time.
+func (f *Filtering) handleFilteringPreviewURL(w http.ResponseWriter, r *http.Request) {
+	req := &filterPreviewReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = req.validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if Context.queryLog == nil {
+		httpError(w, http.StatusBadRequest, "%s", errNoQueryLog)
+
+		return
+	}
+
+	if !atomic.CompareAndSwapUint32(&f.previewing, 0, 1) {
+		httpError(w, http.StatusTooManyRequests, "another preview is in progress")
+
+		return
+	}
+	defer atomic.StoreUint32(&f.previewing, 0)
+
+	dlCtx, cancel := context.WithTimeout(r.Context(), previewDownloadTimeout)
+	defer cancel()
+
+	fn, rulesCount, err := f.downloadPreviewList(dlCtx, req.URL)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "fetching list from %s: %s", req.URL, err)
+
+		return
+	}
+	defer func() {
+		if rerr := os.Remove(fn); rerr != nil {
+			log.Error("filtering: preview: removing list: %s", rerr)
+		}
+	}()
+
+	engine, err := filtering.NewEngine([]filtering.List{{
+		FilePath: fn,
+		ID:       previewListID,
+	}}, nil)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "parsing list: %s", err)
+
+		return
+	}
+	defer func() {
+		if cerr := engine.Close(); cerr != nil {
+			log.Error("filtering: preview: closing engine: %s", cerr)
+		}
+	}()
+
+	scanCtx, scanCancel := context.WithTimeout(r.Context(), previewTimeBudget)
+	defer scanCancel()
+
+	p := newListPreview(engine)
+	since := time.Now().Add(-time.Duration(req.Hours) * time.Hour)
+	complete := Context.queryLog.Scan(scanCtx, since, p.add)
+
+	resp := p.result(int(req.Limit), complete)
+	resp.RulesCount = rulesCount
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
@@ -0,0 +1,122 @@
+package home
+
+import (
+	"net"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/filtering"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/AdGuardHome/internal/querylog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilterPreviewReq_validate(t *testing.T) {
+	req := &filterPreviewReq{URL: "https://lists.example/list.txt"}
+	require.NoError(t, req.validate())
+
+	assert.Equal(t, uint32(defaultPreviewHours), req.Hours)
+	assert.Equal(t, uint32(defaultPreviewLimit), req.Limit)
+
+	req = &filterPreviewReq{URL: "not a url"}
+	assert.Error(t, req.validate())
+
+	req = &filterPreviewReq{
+		URL:   "https://lists.example/list.txt",
+		Hours: maxPreviewHours + 1,
+	}
+	assert.Error(t, req.validate())
+
+	req = &filterPreviewReq{
+		URL:   "https://lists.example/list.txt",
+		Limit: maxPreviewLimit + 1,
+	}
+	assert.Error(t, req.validate())
+}
+
+func TestListPreview(t *testing.T) {
+	engine, err := filtering.NewEngine([]filtering.List{{
+		Data: []byte("||ads.example^\n||tracker.example^$dnstype=AAAA\n"),
+		ID:   previewListID,
+	}}, nil)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, engine.Close())
+	})
+
+	ip1, ip2 := net.IP{1, 2, 3, 4}, net.IP{1, 2, 3, 5}
+	entries := []*querylog.EntryInfo{{
+		Host:     "ads.example",
+		QType:    "A",
+		ClientIP: ip1,
+	}, {
+		Host:     "sub.ADS.example",
+		QType:    "A",
+		ClientIP: ip1,
+	}, {
+		Host:     "ads.example",
+		QType:    "A",
+		ClientIP: ip2,
+		ClientID: "phone",
+	}, {
+		Host:     "tracker.example",
+		QType:    "A",
+		ClientIP: ip1,
+	}, {
+		Host:     "tracker.example",
+		QType:    "AAAA",
+		ClientIP: ip2,
+	}, {
+		Host:     "ads.example",
+		QType:    "A",
+		ClientIP: ip1,
+		Result: dnsfilter.Result{
+			IsFiltered: true,
+			Reason:     dnsfilter.FilteredBlockList,
+		},
+	}, {
+		Host:     "ads.example",
+		QType:    "A",
+		ClientIP: ip1,
+		Result: dnsfilter.Result{
+			Reason: dnsfilter.NotFilteredAllowList,
+		},
+	}, {
+		Host:     "good.example",
+		QType:    "A",
+		ClientIP: ip1,
+	}}
+
+	p := newListPreview(engine)
+	for _, ei := range entries {
+		require.True(t, p.add(ei))
+	}
+
+	resp := p.result(2, false)
+
+	assert.False(t, resp.Complete)
+	assert.Equal(t, uint64(len(entries)), resp.Scanned)
+	assert.Equal(t, uint64(1), resp.AlreadyFiltered)
+	assert.Equal(t, uint64(4), resp.NewlyBlocked)
+	assert.InDelta(t, 12.5, resp.FilteredPercentage, 0.01)
+	assert.InDelta(t, 50, resp.AdditionalPercentage, 0.01)
+
+	assert.Equal(t, []*previewDomainJSON{{
+		Domain: "ads.example",
+		Rule:   "||ads.example^",
+		Count:  2,
+	}, {
+		Domain: "sub.ads.example",
+		Rule:   "||ads.example^",
+		Count:  1,
+	}}, resp.TopDomains)
+
+	assert.Equal(t, 3, resp.AffectedClients)
+	assert.Equal(t, []*previewClientJSON{{
+		Client: ip1.String(),
+		Count:  2,
+	}, {
+		Client: ip2.String(),
+		Count:  1,
+	}}, resp.TopClients)
+}
@@ -0,0 +1,88 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Hijack states reported to the webhook.
+const (
+	hijackStateDetected = "detected"
+	hijackStateResolved = "resolved"
+)
+
+// hijackNotification is the body of the webhook request about a change of the
+// state of a plain DNS upstream.
+type hijackNotification struct {
+	Time     time.Time `json:"time"`
+	Upstream string    `json:"upstream"`
+	State    string    `json:"state"`
+	Answer   []string  `json:"answer"`
+	Disabled bool      `json:"disabled"`
+}
+
+// onHijackChanged is the dnsforward.ServerConfig.OnHijackChanged callback.
+func onHijackChanged(e dnsforward.HijackEvent) {
+	config.RLock()
+	u := config.DNS.HijackWebhookURL
+	config.RUnlock()
+
+	if u == "" {
+		return
+	}
+
+	n := &hijackNotification{
+		Time:     e.Time,
+		Upstream: e.Upstream,
+		State:    hijackStateResolved,
+		Answer:   e.Answer,
+		Disabled: e.Disabled,
+	}
+	if e.Hijacked {
+		n.State = hijackStateDetected
+	}
+
+	if n.Answer == nil {
+		n.Answer = []string{}
+	}
+
+	b, err := json.Marshal(n)
+	if err != nil {
+		log.Error("dns: encoding hijack notification: %s", err)
+
+		return
+	}
+
+	go sendHijackNotification(u, b)
+}
+
+// sendHijackNotification POSTs the notification body b to u.
+func sendHijackNotification(u string, b []byte) {
+	c := newOutboundClient(aghnet.OutboundWebhooks)
+	resp, err := c.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Error("dns: sending hijack notification: %s", err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Error("dns: sending hijack notification: got status code %d", resp.StatusCode)
+	}
+}
+
+// hijackWarnings returns the warnings about the hijacked plain DNS upstreams
+// of the DNS server.
+func hijackWarnings() (warns []string) {
+	if Context.dnsServer == nil {
+		return nil
+	}
+
+	return Context.dnsServer.HijackWarnings()
+}
@@ -22,8 +22,10 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghmem"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/AdGuardHome/internal/dhcpd"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
@@ -59,12 +61,36 @@ type homeContext struct {
 	tls        *TLSMod                   // TLS module
 	etcHosts   *aghnet.EtcHostsContainer // IP-hostname pairs taken from system configuration (e.g. /etc/hosts) files
 	updater    *updater.Updater
+	memManager *aghmem.Manager // memory budget manager
+
+	// snapshot is the last known good state.  It's protected by
+	// snapshotLock.
+	snapshot *snapshot
+
+	// confBaseline are the values of the configuration at the start, see
+	// handleEffectiveConfig.
+	confBaseline *configBaseline
+
+	// cliToken is the token which authorizes the local requests of the
+	// command-line client.  It's empty if it couldn't be generated.
+	cliToken string
 
 	subnetDetector *aghnet.SubnetDetector
 
 	// mux is our custom http.ServeMux.
 	mux *http.ServeMux
 
+	// configWriter writes the configuration file.  See onConfigModified.
+	configWriter *configWriter
+
+	// writeGuards keep the data of the subsystems in memory while the file
+	// system is read-only.
+	writeGuards *writeGuards
+
+	// apiHandlers are the handlers of the HTTP API registered in mux by
+	// URL, see httpRegister.
+	apiHandlers map[string]methodHandlers
+
 	// Runtime properties
 	// --
 
@@ -72,15 +98,57 @@ type homeContext struct {
 	workDir          string // Location of our directory, used to protect against CWD being somewhere else
 	firstRun         bool   // if set to true, don't run any services except HTTP web inteface, and serve only first-run html
 	pidFileName      string // PID file name.  Empty if no PID file was created.
+	logFile          string // Path to the log file.  Empty if the log isn't written into a file.
 	disableUpdate    bool   // If set, don't check for updates
 	controlLock      sync.Mutex
 	tlsRoots         *x509.CertPool // list of root CAs for TLSv1.2
 	tlsCiphers       []uint16       // list of TLS ciphers to use
 	transport        *http.Transport
-	client           *http.Client
+	filterClient     *http.Client   // client for downloading the filter lists, see newFilterHTTPClient
 	appSignalChannel chan os.Signal // Channel for receiving OS signals by the console app
+
+	// outbound controls and records the connections to the external hosts.
+	// The HTTP clients making such connections must be created with
+	// newOutboundClient.
+	outbound *aghnet.Outbound
+
 	// runningAsService flag is set to true when options are passed from the service runner
 	runningAsService bool
+
+	// instance is the instance sharing the working directory with other
+	// ones.  It's nil if there is the only instance.
+	instance *instance
+
+	// handover is the connection to the process which has restarted this
+	// one.  It's nil if this process hasn't been restarted.
+	handover *handover
+
+	// execHooks are the external commands run on the events.  It's nil if
+	// those are disabled.
+	execHooks *execHooks
+
+	// ifaceWatcher reports the changes of the network interfaces.  It's
+	// nil on the first run.
+	ifaceWatcher *aghnet.IfaceWatcher
+
+	// netChanges are the recent changes of the network interfaces.
+	netChanges netChanges
+
+	// listenChecks are the checks of the listen addresses proposed by the
+	// user and the last rollback of the listeners.
+	listenChecks listenChecks
+
+	// pinBypasses are the temporary bypasses created by the clients with
+	// the PIN.
+	pinBypasses *pinBypasses
+
+	// safeMode is true if AdGuard Home is started with --safe-mode.  The
+	// configuration file is then only written after the changes made by
+	// the user.
+	safeMode bool
+	// secrets encrypts the secrets within the configuration file.  It's
+	// nil if the key isn't set, so the secrets are written as is.
+	secrets *secretBox
 }
 
 // getDataDir returns path to the directory where we store databases and filters
@@ -93,6 +161,12 @@ var Context homeContext
 
 // Main is the entry point
 func Main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := cliCommands[os.Args[1]]; ok {
+			os.Exit(runCLICommand(os.Stdout, os.Args[1], cmd, os.Args[2:]))
+		}
+	}
+
 	// config can be specified, which reads options from there, but other command line flags have to override config values
 	// therefore, we must do it manually instead of using a lib
 	args := loadOptions()
@@ -127,6 +201,10 @@ func Main() {
 
 func setupContext(args options) {
 	Context.runningAsService = args.runningAsService
+	Context.safeMode = args.safeMode
+	if Context.safeMode {
+		log.Info("warning: running in safe mode: filtering, rewrites, access control, and custom upstreams are disabled")
+	}
 	Context.disableUpdate = args.disableUpdate ||
 		version.Channel() == version.ChannelDevelopment
 
@@ -137,6 +215,7 @@ func setupContext(args options) {
 	}
 
 	initConfig()
+	Context.confBaseline = newConfigBaseline()
 
 	Context.tlsRoots = LoadSystemRootCAs()
 	Context.tlsCiphers = InitTLSCiphers()
@@ -148,14 +227,21 @@ func setupContext(args options) {
 			MinVersion: tls.VersionTLS12,
 		},
 	}
-	Context.client = &http.Client{
-		Timeout:   time.Minute * 5,
-		Transport: Context.transport,
+	Context.outbound = aghnet.NewOutbound()
+	Context.filterClient = Context.outbound.HTTPClient(
+		aghnet.OutboundFilters,
+		newFilterHTTPClient(Context.transport.TLSClientConfig),
+	)
+
+	var err error
+	Context.secrets, err = secretBoxFromEnv()
+	if err != nil {
+		log.Fatalf("loading secrets key: %s", err)
 	}
 
 	if !Context.firstRun {
 		// Do the upgrade if necessary
-		err := upgradeConfig()
+		err = upgradeConfig()
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -167,6 +253,8 @@ func setupContext(args options) {
 			os.Exit(1)
 		}
 
+		Context.confBaseline.file = snapshotConfig()
+
 		if args.checkConfig {
 			log.Info("configuration file is ok")
 
@@ -174,13 +262,21 @@ func setupContext(args options) {
 		}
 	}
 
+	applyOutboundConfig()
+
 	Context.mux = http.NewServeMux()
+	Context.apiHandlers = map[string]methodHandlers{}
 }
 
 func setupConfig(args options) {
+	Context.writeGuards = newWriteGuards()
+	Context.pinBypasses = newPINBypasses()
+
 	config.DHCP.WorkDir = Context.workDir
 	config.DHCP.HTTPRegister = httpRegister
 	config.DHCP.ConfigModified = onConfigModified
+	config.DHCP.LocalDomainName = config.DNS.LocalDomainName
+	config.DHCP.WriteGuard = Context.writeGuards.leases
 
 	Context.dhcpServer = dhcpd.Create(config.DHCP)
 	if Context.dhcpServer == nil {
@@ -188,7 +284,7 @@ func setupConfig(args options) {
 	}
 
 	Context.updater = updater.NewUpdater(&updater.Config{
-		Client:   Context.client,
+		Client:   newOutboundClient(aghnet.OutboundUpdates),
 		Version:  version.Version(),
 		Channel:  version.Channel(),
 		GOARCH:   runtime.GOARCH,
@@ -198,13 +294,18 @@ func setupConfig(args options) {
 		WorkDir:  Context.workDir,
 		ConfName: config.getConfigFilename(),
 	})
+	if u, err := url.Parse(Context.updater.VersionCheckURL()); err == nil {
+		Context.outbound.Expect(aghnet.OutboundUpdates, u.Hostname())
+	}
 
 	if !args.noEtcHosts {
 		Context.etcHosts = &aghnet.EtcHostsContainer{}
 		Context.etcHosts.Init("")
 	}
-	Context.clients.Init(config.Clients, Context.dhcpServer, Context.etcHosts)
+	Context.clients.Init(config.Clients, config.Profiles, Context.dhcpServer, Context.etcHosts)
+	Context.clients.runtimeTTL = time.Duration(config.RuntimeClientsTTLHours) * time.Hour
 	config.Clients = nil
+	config.Profiles = nil
 
 	if (runtime.GOOS == "linux" || runtime.GOOS == "darwin") &&
 		config.RlimitNoFile != 0 {
@@ -218,6 +319,9 @@ func setupConfig(args options) {
 	if args.bindPort != 0 {
 		config.BindPort = args.bindPort
 	}
+
+	Context.confBaseline.setFlags(args)
+
 	if len(args.pidFile) != 0 && writePIDFile(args.pidFile) {
 		Context.pidFileName = args.pidFile
 	}
@@ -253,11 +357,38 @@ func run(args options) {
 
 	setupConfig(args)
 
+	var err error
+	// Now that the configuration is known to be good, take over the files
+	// of the process which has restarted this one, if any.
+	Context.handover, err = newHandover()
+	if err != nil {
+		log.Fatalf("restart: %s", err)
+	}
+
+	err = Context.handover.request(handoverFiles)
+	if err != nil {
+		log.Fatalf("restart: %s", err)
+	}
+
+	Context.instance, err = newInstance(args.instanceID, config.InstanceConflict, Context.getDataDir())
+	if err != nil {
+		log.Fatalf("instance: %s", err)
+	}
+
+	isRoot, _ := aghos.HaveAdminRights()
+	Context.execHooks = newExecHooks(&config.ExecHooks, isRoot)
+
+	Context.configWriter = newConfigWriter(config.write, configWriteDelay, time.Time{})
+	Context.configWriter.guard = Context.writeGuards.config
 	if !Context.firstRun {
-		// Save the updated config
-		err := config.write()
-		if err != nil {
-			log.Fatal(err)
+		// Save the updated config unless nothing may be written in
+		// safe mode.
+		if !Context.safeMode {
+			Context.configWriter.markDirty()
+			err = Context.configWriter.flush()
+			if err != nil && !Context.writeGuards.config.MemoryOnly() {
+				log.Fatal(err)
+			}
 		}
 
 		if config.DebugPProf {
@@ -275,18 +406,33 @@ func run(args options) {
 		}
 	}
 
-	err := os.MkdirAll(Context.getDataDir(), 0o755)
+	err = os.MkdirAll(Context.getDataDir(), 0o755)
 	if err != nil {
 		log.Fatalf("Cannot create DNS data dir at %s: %s", Context.getDataDir(), err)
 	}
 
-	sessFilename := filepath.Join(Context.getDataDir(), "sessions.db")
+	initCLIToken()
+
+	loc, err := aghtime.LoadLocation(config.Timezone)
+	if err != nil {
+		log.Fatalf("Invalid timezone: %s", err)
+	}
+	aghtime.SetLocation(loc)
+	aghtime.SetLegacy(config.LegacyTimeFormat)
+
+	err = validateRoles(config.Users, config.APITokens)
+	if err != nil {
+		log.Fatalf("Invalid users or api tokens: %s", err)
+	}
+
+	sessFilename := filepath.Join(Context.getDataDir(), Context.instance.fileName("sessions.db"))
 	GLMode = args.glinetMode
 	Context.auth = InitAuth(sessFilename, config.Users, config.WebSessionTTLHours*60*60)
 	if Context.auth == nil {
 		log.Fatalf("Couldn't initialize Auth module")
 	}
 	config.Users = nil
+	Context.auth.SetAPITokens(config.APITokens)
 
 	Context.tls = tlsCreate(config.TLS)
 	if Context.tls == nil {
@@ -303,6 +449,12 @@ func run(args options) {
 		ReadHeaderTimeout: readHdrTimeout,
 		WriteTimeout:      writeTimeout,
 	}
+	if Context.safeMode {
+		// Only use the default address unless it's overridden from the
+		// console, since the configured one may be the broken one.
+		webConf.BindHost, webConf.BindPort = safeModeWebAddr(args)
+	}
+
 	Context.web = CreateWeb(&webConf)
 	if Context.web == nil {
 		log.Fatalf("Can't initialize Web module")
@@ -328,14 +480,21 @@ func run(args options) {
 				closeDNSServer()
 				log.Fatal(serr)
 			}
+
+			Context.handover.ready()
 		}()
 
-		if Context.dhcpServer != nil {
+		if Context.instance.isFollower() {
+			log.Info("instance: follower, not starting the dhcp server")
+		} else if Context.dhcpServer != nil {
 			err = Context.dhcpServer.Start()
 			if err != nil {
 				log.Error("starting dhcp server: %s", err)
 			}
 		}
+
+		Context.ifaceWatcher = newIfaceWatcher()
+		Context.ifaceWatcher.Start()
 	}
 
 	Context.web.Start()
@@ -503,6 +662,8 @@ func configureLogger(args options) {
 			log.Fatalf("cannot create a log file: %s", err)
 		}
 
+		Context.logFile = logFilePath
+
 		log.SetOutput(&lumberjack.Logger{
 			Filename:   logFilePath,
 			Compress:   ls.LogCompress, // disabled by default
@@ -522,11 +683,24 @@ func cleanup(ctx context.Context) {
 		Context.web.Close(ctx)
 		Context.web = nil
 	}
+
+	// Write the last changes while all the modules are still there.
+	if Context.configWriter != nil {
+		_ = Context.configWriter.flush()
+	}
+
 	if Context.auth != nil {
 		Context.auth.Close()
 		Context.auth = nil
 	}
 
+	if Context.ifaceWatcher != nil {
+		err := Context.ifaceWatcher.Close()
+		if err != nil {
+			log.Error("closing interface watcher: %s", err)
+		}
+	}
+
 	err := stopDNSServer()
 	if err != nil {
 		log.Error("Couldn't stop DNS server: %s", err)
@@ -542,6 +716,8 @@ func cleanup(ctx context.Context) {
 		Context.tls.Close()
 		Context.tls = nil
 	}
+
+	Context.instance.close()
 }
 
 // This function is called before application exits
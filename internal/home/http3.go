@@ -0,0 +1,79 @@
+package home
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/lucas-clemente/quic-go/http3"
+)
+
+// http3Server serves the same handler as the HTTPS server over HTTP/3.
+type http3Server struct {
+	srv *http3.Server
+
+	// conn is the UDP socket of srv.  It's opened separately so that the
+	// errors of binding are reported right away and so that closing srv
+	// doesn't race with opening it.  quic-go sizes its receive buffer.
+	conn net.PacketConn
+}
+
+// newHTTP3Server opens the UDP socket on addr and returns a server of h using
+// tlsConf.
+func newHTTP3Server(addr string, tlsConf *tls.Config, h http.Handler) (s *http3Server, err error) {
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("listening on udp %s: %w", addr, err)
+	}
+
+	return &http3Server{
+		srv: &http3.Server{
+			Server: &http.Server{
+				// Use the actual address, since the port of addr may
+				// be zero.
+				Addr:      conn.LocalAddr().String(),
+				TLSConfig: tlsConf,
+				Handler:   h,
+			},
+		},
+		conn: conn,
+	}, nil
+}
+
+// serve serves the requests until s is closed.
+func (s *http3Server) serve() {
+	// Serve only returns when the socket is closed or fails, so there is
+	// nothing to do with the error besides logging it.
+	err := s.srv.Serve(s.conn)
+	log.Debug("web: http3: serving on %s: %s", s.conn.LocalAddr(), err)
+}
+
+// advertise returns a handler which announces s in the Alt-Svc header of the
+// responses of h served over the previous versions of HTTP.
+func (s *http3Server) advertise(h http.Handler) (wrapped http.Handler) {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ProtoMajor < 3 {
+			err := s.srv.SetQuicHeaders(w.Header())
+			if err != nil {
+				log.Debug("web: http3: setting alt-svc: %s", err)
+			}
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
+
+// close stops s and closes its socket.
+func (s *http3Server) close() {
+	err := s.srv.Close()
+	if err != nil {
+		log.Error("web: http3: closing server: %s", err)
+	}
+
+	err = s.conn.Close()
+	if err != nil {
+		log.Error("web: http3: closing socket: %s", err)
+	}
+}
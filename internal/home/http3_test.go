@@ -0,0 +1,108 @@
+package home
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTP3Server_advertise(t *testing.T) {
+	s, err := newHTTP3Server("127.0.0.1:0", &tls.Config{}, nil)
+	require.NoError(t, err)
+	t.Cleanup(s.close)
+
+	_, port, err := net.SplitHostPort(s.conn.LocalAddr().String())
+	require.NoError(t, err)
+
+	h := s.advertise(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	t.Run("http2", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+		r.ProtoMajor = 2
+
+		h.ServeHTTP(w, r)
+
+		altSvc := w.Header().Get("Alt-Svc")
+		assert.True(t, strings.Contains(altSvc, `=":`+port+`"`), altSvc)
+	})
+
+	t.Run("http3", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/dns-query", nil)
+		r.ProtoMajor = 3
+
+		h.ServeHTTP(w, r)
+
+		assert.Empty(t, w.Header().Get("Alt-Svc"))
+	})
+}
+
+func TestValidateHTTP3Port(t *testing.T) {
+	const dnsPort = 53
+
+	setts := tlsConfigSettings{
+		PortHTTPS:       443,
+		PortDNSOverQUIC: 784,
+		PortDNSCrypt:    5443,
+		ServeHTTP3:      true,
+	}
+
+	testCases := []struct {
+		name       string
+		wantErrMsg string
+		port       int
+		serve      bool
+	}{{
+		name:       "ok",
+		wantErrMsg: "",
+		port:       443,
+		serve:      true,
+	}, {
+		name:       "plain_dns",
+		wantErrMsg: "udp port 53 is used by plain dns, cannot serve http/3 on it",
+		port:       dnsPort,
+		serve:      true,
+	}, {
+		name:       "doq",
+		wantErrMsg: "udp port 784 is used by dns-over-quic, cannot serve http/3 on it",
+		port:       784,
+		serve:      true,
+	}, {
+		name:       "dnscrypt",
+		wantErrMsg: "udp port 5443 is used by dnscrypt, cannot serve http/3 on it",
+		port:       5443,
+		serve:      true,
+	}, {
+		name:       "disabled",
+		wantErrMsg: "",
+		port:       dnsPort,
+		serve:      false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			s := setts
+			s.PortHTTPS = tc.port
+			s.ServeHTTP3 = tc.serve
+
+			err := validateHTTP3Port(s, dnsPort)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
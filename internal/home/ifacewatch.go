@@ -0,0 +1,207 @@
+package home
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// The parameters of watching the network interfaces.
+const (
+	// ifaceDebounce is the period without further changes, after which
+	// the changes of the interfaces are handled.
+	ifaceDebounce = 2 * time.Second
+
+	// ifaceMaxDelay is the longest period for which the changes of a
+	// flapping interface may be postponed.
+	ifaceMaxDelay = 30 * time.Second
+
+	// ifacePollIvl is the interval of the checks of the interfaces on the
+	// platforms without the notifications about them.
+	ifacePollIvl = 10 * time.Second
+)
+
+// maxNetChanges is the maximum number of the network changes kept for the
+// status.
+const maxNetChanges = 10
+
+// The actions taken on the network changes.
+const (
+	netActionDNSRebound     = "dns_listeners_rebound"
+	netActionDNSOwnAddrs    = "dns_own_addresses_updated"
+	netActionDNSFailed      = "dns_reconfigure_failed"
+	netActionDHCPRevalidate = "dhcp_revalidated"
+)
+
+// netChangeJSON is a change of the network interfaces and the actions taken
+// on it.
+type netChangeJSON struct {
+	// Time is the time of the change in RFC 3339 format.
+	Time string `json:"time"`
+
+	// Error is the error of the action, if any.
+	Error string `json:"error,omitempty"`
+
+	Changes []aghnet.IfaceChange `json:"changes"`
+
+	// Actions are the netAction* constants.
+	Actions []string `json:"actions"`
+}
+
+// netChanges are the recent changes of the network interfaces.
+type netChanges struct {
+	// mu protects changes.
+	mu sync.Mutex
+
+	// changes are the recent changes, the latest last.
+	changes []netChangeJSON
+}
+
+// add adds ch to the recent changes dropping the oldest ones if needed.  It's
+// safe for concurrent use.
+func (nc *netChanges) add(ch netChangeJSON) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	nc.changes = append(nc.changes, ch)
+	if l := len(nc.changes); l > maxNetChanges {
+		nc.changes = append([]netChangeJSON(nil), nc.changes[l-maxNetChanges:]...)
+	}
+}
+
+// status returns the recent changes, the latest first.  It's safe for
+// concurrent use.
+func (nc *netChanges) status() (changes []netChangeJSON) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+
+	for i := len(nc.changes) - 1; i >= 0; i-- {
+		changes = append(changes, nc.changes[i])
+	}
+
+	return changes
+}
+
+// bindIfacesAddrs returns the addresses of the interfaces with names, to
+// which the DNS server should bind.  The missing interfaces are skipped, since
+// those may appear later.
+func bindIfacesAddrs(names []string) (ips []net.IP) {
+	for _, name := range names {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			log.Debug("dns: bind interface %q: %s", name, err)
+
+			continue
+		}
+
+		var addrs []net.Addr
+		addrs, err = iface.Addrs()
+		if err != nil {
+			log.Debug("dns: addresses of bind interface %q: %s", name, err)
+
+			continue
+		}
+
+		for _, a := range addrs {
+			ipnet, ok := a.(*net.IPNet)
+			// Don't bind to the IPv6 link-local addresses, since those
+			// require the zone.
+			if ok && !(ipnet.IP.To4() == nil && ipnet.IP.IsLinkLocalUnicast()) {
+				ips = append(ips, ipnet.IP)
+			}
+		}
+	}
+
+	return ips
+}
+
+// listensUnspecified returns true if the DNS server listens on an unspecified
+// address, like "0.0.0.0".
+func listensUnspecified(dnsConf *dnsConfig) (ok bool) {
+	for _, h := range dnsConf.BindHosts {
+		if h.IsUnspecified() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// dnsListenHosts returns the addresses the DNS server should listen on.  Those
+// are the bind hosts and the current addresses of the bind interfaces, unless
+// the former already include an unspecified address.  The loopback address is
+// used if there are none.
+func dnsListenHosts(dnsConf *dnsConfig) (hosts []net.IP) {
+	hosts = append(hosts, dnsConf.BindHosts...)
+	if !listensUnspecified(dnsConf) {
+		hosts = append(hosts, bindIfacesAddrs(dnsConf.BindInterfaces)...)
+	}
+
+	if len(hosts) == 0 {
+		hosts = []net.IP{{127, 0, 0, 1}}
+	}
+
+	return hosts
+}
+
+// newIfaceWatcher returns a new watcher of the network interfaces, which calls
+// onIfacesChanged.
+func newIfaceWatcher() (w *aghnet.IfaceWatcher) {
+	return aghnet.NewIfaceWatcher(aghnet.IfaceWatcherConfig{
+		OnChange: onIfacesChanged,
+		Debounce: ifaceDebounce,
+		MaxDelay: ifaceMaxDelay,
+		PollIvl:  ifacePollIvl,
+	})
+}
+
+// onIfacesChanged rebinds the DNS server if its bind interfaces have changed,
+// updates its own addresses if it listens on all of them, and makes the DHCP
+// server revalidate its interface.
+func onIfacesChanged(changes []aghnet.IfaceChange) {
+	ch := netChangeJSON{
+		Time:    time.Now().Format(time.RFC3339),
+		Changes: changes,
+		Actions: []string{},
+	}
+
+	unspec := listensUnspecified(&config.DNS)
+	var rebind, ownAddrs bool
+	for _, c := range changes {
+		if aghstrings.InSlice(config.DNS.BindInterfaces, c.Iface) {
+			rebind = true
+		} else if unspec && (len(c.Added) != 0 || len(c.Removed) != 0) {
+			ownAddrs = true
+		}
+
+		if Context.dhcpServer != nil && Context.dhcpServer.CheckIface(c.Iface) {
+			ch.Actions = append(ch.Actions, netActionDHCPRevalidate)
+		}
+	}
+
+	if (rebind || ownAddrs) && isRunning() {
+		Context.controlLock.Lock()
+		err := reconfigureDNSServer()
+		Context.controlLock.Unlock()
+
+		switch {
+		case err != nil:
+			log.Error("network change: %s", err)
+
+			ch.Error = err.Error()
+			ch.Actions = append(ch.Actions, netActionDNSFailed)
+		case rebind:
+			ch.Actions = append(ch.Actions, netActionDNSRebound)
+		default:
+			ch.Actions = append(ch.Actions, netActionDNSOwnAddrs)
+		}
+	}
+
+	log.Info("network change: %d interfaces changed, actions: %q", len(changes), ch.Actions)
+
+	Context.netChanges.add(ch)
+}
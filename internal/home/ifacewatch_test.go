@@ -0,0 +1,64 @@
+package home
+
+import (
+	"net"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNetChanges(t *testing.T) {
+	nc := &netChanges{}
+	assert.Empty(t, nc.status())
+
+	for i := 0; i < maxNetChanges+2; i++ {
+		nc.add(netChangeJSON{Time: strconv.Itoa(i)})
+	}
+
+	changes := nc.status()
+	require.Len(t, changes, maxNetChanges)
+
+	// The latest first.
+	assert.Equal(t, strconv.Itoa(maxNetChanges+1), changes[0].Time)
+	assert.Equal(t, "2", changes[maxNetChanges-1].Time)
+}
+
+func TestDNSListenHosts(t *testing.T) {
+	testCases := []struct {
+		name string
+		conf dnsConfig
+		want []net.IP
+	}{{
+		name: "empty",
+		conf: dnsConfig{},
+		want: []net.IP{{127, 0, 0, 1}},
+	}, {
+		name: "missing_iface",
+		conf: dnsConfig{
+			BindInterfaces: []string{"no-such-iface0"},
+		},
+		want: []net.IP{{127, 0, 0, 1}},
+	}, {
+		name: "unspecified",
+		conf: dnsConfig{
+			BindHosts:      []net.IP{net.IPv4zero},
+			BindInterfaces: []string{"no-such-iface0"},
+		},
+		want: []net.IP{net.IPv4zero},
+	}, {
+		name: "hosts",
+		conf: dnsConfig{
+			BindHosts:      []net.IP{{192, 168, 0, 1}},
+			BindInterfaces: []string{"no-such-iface0"},
+		},
+		want: []net.IP{{192, 168, 0, 1}},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, dnsListenHosts(&tc.conf))
+		})
+	}
+}
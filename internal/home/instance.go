@@ -0,0 +1,401 @@
+package home
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// instancesDir is the directory within the data directory, which
+	// contains the heartbeat files of the instances and the lock of the
+	// primary one.
+	instancesDir = "instances"
+
+	// primaryLockName is the name of the lock file of the primary instance.
+	// It contains the ID of the instance holding it.
+	primaryLockName = "primary.lock"
+
+	// instanceHeartbeatIvl is the interval between the updates of the
+	// heartbeat file of the instance.
+	instanceHeartbeatIvl = 10 * time.Second
+
+	// instanceHeartbeatTTL is the age of the heartbeat file after which the
+	// instance is considered dead.
+	instanceHeartbeatTTL = 3 * instanceHeartbeatIvl
+)
+
+// Instance roles.
+const (
+	instanceRolePrimary  = "primary"
+	instanceRoleFollower = "follower"
+)
+
+// Policies of handling another live instance sharing the working directory,
+// see configuration.InstanceConflict.
+const (
+	instanceConflictRefuse   = "refuse"
+	instanceConflictFollower = "follower"
+)
+
+// errInstanceLocked is returned when another live instance holds the lock of
+// the primary one and the policy is instanceConflictRefuse.
+const errInstanceLocked agherr.Error = "another instance is running"
+
+// instanceIDRe matches the valid instance IDs.  Those are used in file names.
+var instanceIDRe = regexp.MustCompile(`^[a-zA-Z0-9_-]{1,64}$`)
+
+// instanceInfo is the content of the heartbeat file of an instance.
+type instanceInfo struct {
+	StartedAt time.Time `json:"started_at"`
+	Heartbeat time.Time `json:"heartbeat"`
+	ID        string    `json:"id"`
+	Hostname  string    `json:"hostname"`
+	Role      string    `json:"role"`
+	PID       int       `json:"pid"`
+}
+
+// live returns true if the heartbeat of the instance is fresh at now.
+func (i *instanceInfo) live(now time.Time) (ok bool) {
+	return now.Sub(i.Heartbeat) < instanceHeartbeatTTL
+}
+
+// instanceJSON is the state of the instance within the status response.
+type instanceJSON struct {
+	ID   string `json:"id"`
+	Role string `json:"role"`
+
+	// Peers are the other live instances sharing the working directory.
+	Peers []*instanceInfo `json:"peers"`
+}
+
+// instance is the running AdGuard Home, which shares the working directory with
+// other ones.  The primary instance owns the shared state, the configuration
+// file, the filters, and the DHCP leases, while the followers only read it.
+// The statistics and the query log are written to the files of each instance.
+//
+// The methods of the nil *instance are valid and describe the only instance.
+type instance struct {
+	// mu protects info.
+	mu sync.Mutex
+
+	info instanceInfo
+
+	// dir is the path to the instancesDir.
+	dir string
+
+	// done is closed to stop the heartbeat.
+	done chan struct{}
+}
+
+// newInstance registers the instance with id in dataDir and takes the lock of
+// the primary instance.  If another live instance holds it, the policy defines
+// whether inst becomes a follower or errInstanceLocked is returned.  An empty
+// id means that the instance doesn't share the directory, so inst is nil.
+func newInstance(id, policy, dataDir string) (inst *instance, err error) {
+	if id == "" {
+		return nil, nil
+	} else if !instanceIDRe.MatchString(id) {
+		return nil, fmt.Errorf("bad instance id %q: must match %s", id, instanceIDRe)
+	}
+
+	switch policy {
+	case "", instanceConflictRefuse, instanceConflictFollower:
+		// Go on.
+	default:
+		return nil, fmt.Errorf("bad instance_conflict %q", policy)
+	}
+
+	now := time.Now()
+	inst = &instance{
+		info: instanceInfo{
+			StartedAt: now,
+			Heartbeat: now,
+			ID:        id,
+			Role:      instanceRolePrimary,
+			PID:       os.Getpid(),
+		},
+		dir:  filepath.Join(dataDir, instancesDir),
+		done: make(chan struct{}),
+	}
+	inst.info.Hostname, _ = os.Hostname()
+
+	err = os.MkdirAll(inst.dir, 0o755)
+	if err != nil {
+		return nil, fmt.Errorf("creating instances dir: %w", err)
+	}
+
+	locked, owner, err := inst.lock(now)
+	if err != nil {
+		return nil, fmt.Errorf("locking primary instance: %w", err)
+	}
+
+	if !locked {
+		if policy != instanceConflictFollower {
+			return nil, fmt.Errorf("%w: %q holds %s", errInstanceLocked, owner, primaryLockName)
+		}
+
+		log.Info("instance: %q is the primary instance, running as a follower", owner)
+		inst.info.Role = instanceRoleFollower
+	}
+
+	err = inst.writeHeartbeat(now)
+	if err != nil {
+		inst.unlock()
+
+		return nil, err
+	}
+
+	log.Info("instance: running as %q, role %s", id, inst.info.Role)
+
+	go inst.heartbeat()
+
+	return inst, nil
+}
+
+// lock tries to take the lock of the primary instance.  The lock is taken over
+// if its owner is dead or is this very instance, which has been restarted.  If
+// another live instance holds it, locked is false and owner is its ID.
+func (inst *instance) lock(now time.Time) (locked bool, owner string, err error) {
+	fn := filepath.Join(inst.dir, primaryLockName)
+	for i := 0; i < 2; i++ {
+		var f *os.File
+		f, err = os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if err == nil {
+			_, err = f.WriteString(inst.info.ID)
+			cerr := f.Close()
+			if err == nil {
+				err = cerr
+			}
+
+			if err != nil {
+				return false, "", fmt.Errorf("writing lock: %w", err)
+			}
+
+			return true, "", nil
+		} else if !errors.Is(err, os.ErrExist) {
+			return false, "", err
+		}
+
+		var data []byte
+		data, err = ioutil.ReadFile(fn)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, "", err
+		}
+
+		owner = strings.TrimSpace(string(data))
+		if owner != "" && owner != inst.info.ID {
+			peer, perr := inst.readInfo(owner)
+			if perr == nil && peer.live(now) {
+				return false, owner, nil
+			}
+		}
+
+		log.Info("instance: taking over the stale lock of %q", owner)
+		err = os.Remove(fn)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return false, "", err
+		}
+	}
+
+	// Another instance has taken the lock after the stale one has been
+	// removed.
+	return false, owner, nil
+}
+
+// unlock releases the lock of the primary instance, if inst holds it.
+func (inst *instance) unlock() {
+	if inst.info.Role != instanceRolePrimary {
+		return
+	}
+
+	fn := filepath.Join(inst.dir, primaryLockName)
+	data, err := ioutil.ReadFile(fn)
+	if err != nil || strings.TrimSpace(string(data)) != inst.info.ID {
+		return
+	}
+
+	err = os.Remove(fn)
+	if err != nil {
+		log.Error("instance: removing lock: %s", err)
+	}
+}
+
+// infoPath returns the path to the heartbeat file of the instance with id.
+func (inst *instance) infoPath(id string) (fn string) {
+	return filepath.Join(inst.dir, id+".json")
+}
+
+// readInfo reads the heartbeat file of the instance with id.
+func (inst *instance) readInfo(id string) (info *instanceInfo, err error) {
+	data, err := ioutil.ReadFile(inst.infoPath(id))
+	if err != nil {
+		return nil, err
+	}
+
+	info = &instanceInfo{}
+	err = json.Unmarshal(data, info)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", id, err)
+	}
+
+	return info, nil
+}
+
+// writeHeartbeat writes the heartbeat file of inst with the time now.
+func (inst *instance) writeHeartbeat(now time.Time) (err error) {
+	inst.mu.Lock()
+	inst.info.Heartbeat = now
+	data, err := json.Marshal(inst.info)
+	inst.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("encoding heartbeat: %w", err)
+	}
+
+	fn := inst.infoPath(inst.info.ID)
+	tmp := fn + ".tmp"
+	err = ioutil.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing heartbeat: %w", err)
+	}
+
+	err = os.Rename(tmp, fn)
+	if err != nil {
+		return fmt.Errorf("writing heartbeat: %w", err)
+	}
+
+	return nil
+}
+
+// heartbeat updates the heartbeat file of inst until it's closed.
+func (inst *instance) heartbeat() {
+	defer agherr.LogPanic("instance: heartbeat")
+
+	ticker := time.NewTicker(instanceHeartbeatIvl)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-inst.done:
+			return
+		case now := <-ticker.C:
+			err := inst.writeHeartbeat(now)
+			if err != nil {
+				log.Error("instance: %s", err)
+			}
+		}
+	}
+}
+
+// peers returns the information about the other instances, which have written
+// their heartbeat files into the directory.  If live is true, only the live
+// ones are returned.
+func (inst *instance) peers(now time.Time, live bool) (peers []*instanceInfo) {
+	fns, err := filepath.Glob(filepath.Join(inst.dir, "*.json"))
+	if err != nil {
+		log.Error("instance: listing instances: %s", err)
+
+		return nil
+	}
+
+	for _, fn := range fns {
+		id := strings.TrimSuffix(filepath.Base(fn), ".json")
+		if id == inst.info.ID {
+			continue
+		}
+
+		info, rerr := inst.readInfo(id)
+		if rerr != nil {
+			log.Debug("instance: reading %s: %s", fn, rerr)
+
+			continue
+		}
+
+		if !live || info.live(now) {
+			peers = append(peers, info)
+		}
+	}
+
+	return peers
+}
+
+// isFollower returns true if inst is a follower, so that it mustn't write the
+// shared state.
+func (inst *instance) isFollower() (ok bool) {
+	return inst != nil && inst.info.Role == instanceRoleFollower
+}
+
+// fileName returns the name of the per-instance file for the shared file name,
+// for example "querylog.json" becomes "querylog.<id>.json".
+func (inst *instance) fileName(name string) (instName string) {
+	if inst == nil {
+		return name
+	}
+
+	ext := filepath.Ext(name)
+
+	return fmt.Sprintf("%s.%s%s", strings.TrimSuffix(name, ext), inst.info.ID, ext)
+}
+
+// peerFiles returns the paths to the per-instance files for the shared file
+// name of the other instances, which exist within dir.
+func (inst *instance) peerFiles(dir, name string) (fns []string) {
+	if inst == nil {
+		return nil
+	}
+
+	ext := filepath.Ext(name)
+	for _, p := range inst.peers(time.Now(), false) {
+		fn := filepath.Join(dir, fmt.Sprintf("%s.%s%s", strings.TrimSuffix(name, ext), p.ID, ext))
+		if _, err := os.Stat(fn); err == nil {
+			fns = append(fns, fn)
+		}
+	}
+
+	return fns
+}
+
+// status returns the state of inst for the status response.  st is nil if inst
+// is nil.
+func (inst *instance) status() (st *instanceJSON) {
+	if inst == nil {
+		return nil
+	}
+
+	peers := inst.peers(time.Now(), true)
+	if peers == nil {
+		peers = []*instanceInfo{}
+	}
+
+	return &instanceJSON{
+		ID:    inst.info.ID,
+		Role:  inst.info.Role,
+		Peers: peers,
+	}
+}
+
+// close stops the heartbeat, removes the heartbeat file, and releases the lock
+// of the primary instance.
+func (inst *instance) close() {
+	if inst == nil {
+		return
+	}
+
+	close(inst.done)
+	inst.unlock()
+
+	err := os.Remove(inst.infoPath(inst.info.ID))
+	if err != nil {
+		log.Error("instance: removing heartbeat: %s", err)
+	}
+}
@@ -0,0 +1,79 @@
+package home
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewInstance(t *testing.T) {
+	dir := t.TempDir()
+
+	inst, err := newInstance("", instanceConflictRefuse, dir)
+	require.NoError(t, err)
+	assert.Nil(t, inst)
+	assert.False(t, inst.isFollower())
+	assert.Nil(t, inst.status())
+	assert.Equal(t, "stats.db", inst.fileName("stats.db"))
+
+	_, err = newInstance("../a", instanceConflictRefuse, dir)
+	assert.Error(t, err)
+
+	a, err := newInstance("a", instanceConflictRefuse, dir)
+	require.NoError(t, err)
+	t.Cleanup(a.close)
+
+	assert.False(t, a.isFollower())
+	assert.Equal(t, "querylog.a.json", a.fileName("querylog.json"))
+
+	_, err = newInstance("b", instanceConflictRefuse, dir)
+	assert.True(t, errors.Is(err, errInstanceLocked))
+
+	b, err := newInstance("b", instanceConflictFollower, dir)
+	require.NoError(t, err)
+
+	assert.True(t, b.isFollower())
+
+	st := a.status()
+	require.NotNil(t, st)
+	assert.Equal(t, instanceRolePrimary, st.Role)
+	require.Len(t, st.Peers, 1)
+	assert.Equal(t, "b", st.Peers[0].ID)
+	assert.Equal(t, instanceRoleFollower, st.Peers[0].Role)
+
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "querylog.b.json"), nil, 0o644))
+	assert.Equal(t, []string{filepath.Join(dir, "querylog.b.json")}, a.peerFiles(dir, "querylog.json"))
+
+	b.close()
+	assert.Empty(t, a.status().Peers)
+}
+
+func TestNewInstance_stale(t *testing.T) {
+	dir := t.TempDir()
+
+	a, err := newInstance("a", instanceConflictRefuse, dir)
+	require.NoError(t, err)
+
+	// Pretend that the instance has died without cleaning up.
+	close(a.done)
+	require.NoError(t, a.writeHeartbeat(time.Now().Add(-2*instanceHeartbeatTTL)))
+
+	b, err := newInstance("b", instanceConflictRefuse, dir)
+	require.NoError(t, err)
+	t.Cleanup(b.close)
+
+	assert.False(t, b.isFollower())
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, instancesDir, primaryLockName))
+	require.NoError(t, err)
+	assert.Equal(t, "b", string(data))
+
+	_, err = os.Stat(a.infoPath("a"))
+	assert.NoError(t, err)
+}
@@ -0,0 +1,433 @@
+package home
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// listenTokenTTL is the time for which the token of a successful check of the
+// listen addresses is accepted by the apply endpoint.
+const listenTokenTTL = 5 * time.Minute
+
+// listenTokenLen is the length of the token in bytes before encoding.
+const listenTokenLen = 16
+
+// The listeners which can be rolled back.
+const (
+	listenerWeb = "web"
+	listenerDNS = "dns"
+)
+
+// listenAddrsJSON are the addresses of the web UI and of the DNS server.
+type listenAddrsJSON struct {
+	WebIP   net.IP   `json:"web_ip"`
+	WebPort int      `json:"web_port"`
+	DNSIPs  []net.IP `json:"dns_ips"`
+	DNSPort int      `json:"dns_port"`
+}
+
+// validate returns an error if a is incomplete.
+func (a *listenAddrsJSON) validate() (err error) {
+	switch {
+	case a.WebIP == nil:
+		return fmt.Errorf("web_ip is required")
+	case len(a.DNSIPs) == 0:
+		return fmt.Errorf("dns_ips are required")
+	case a.WebPort <= 0 || a.WebPort > 65535:
+		return fmt.Errorf("bad web_port %d", a.WebPort)
+	case a.DNSPort <= 0 || a.DNSPort > 65535:
+		return fmt.Errorf("bad dns_port %d", a.DNSPort)
+	}
+
+	for i, ip := range a.DNSIPs {
+		if ip == nil {
+			return fmt.Errorf("dns_ips: bad ip at index %d", i)
+		}
+
+		// The DNS server also listens on TCP.
+		if a.DNSPort == a.WebPort && (ip.Equal(a.WebIP) || ip.IsUnspecified() || a.WebIP.IsUnspecified()) {
+			return fmt.Errorf("dns address %s conflicts with the web address", ip)
+		}
+	}
+
+	return nil
+}
+
+// key returns the canonical form of a, which doesn't depend on the order of
+// the DNS addresses.
+func (a *listenAddrsJSON) key() (k string) {
+	dnsIPs := make([]string, 0, len(a.DNSIPs))
+	for _, ip := range a.DNSIPs {
+		dnsIPs = append(dnsIPs, ip.String())
+	}
+	sort.Strings(dnsIPs)
+
+	return fmt.Sprintf("%s %d %s %d", a.WebIP, a.WebPort, strings.Join(dnsIPs, ","), a.DNSPort)
+}
+
+// listenProbeJSON is the result of probing an address.
+type listenProbeJSON struct {
+	// Listener is either listenerWeb or listenerDNS.
+	Listener string `json:"listener"`
+
+	// Proto is either "tcp" or "udp".
+	Proto string `json:"proto"`
+	Addr  string `json:"addr"`
+
+	// Error is the reason why the address isn't available, if any.
+	Error string `json:"error,omitempty"`
+
+	// Process is the name of the process which listens on the address, if
+	// it's detectable.
+	Process string `json:"process,omitempty"`
+	PID     int    `json:"pid,omitempty"`
+
+	Available bool `json:"available"`
+
+	// Own is true if the address is already used by AdGuard Home itself,
+	// so it isn't probed.
+	Own bool `json:"own"`
+}
+
+// checkListenResp is the response to the POST /control/check_listen HTTP API.
+type checkListenResp struct {
+	Probes []*listenProbeJSON `json:"probes"`
+
+	// Token is the token which the apply endpoint requires.  It's only set
+	// if all the addresses are available.
+	Token string `json:"token,omitempty"`
+
+	// ExpiresAt is the time after which Token isn't accepted.
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// listenConfigReq is the request to the POST /control/listen_config HTTP API.
+type listenConfigReq struct {
+	listenAddrsJSON
+
+	// Token is the token of a recent successful check of the same
+	// addresses.
+	Token string `json:"token"`
+}
+
+// listenRollbackJSON is the rollback of a listener which couldn't be started
+// on the new addresses.
+type listenRollbackJSON struct {
+	// Time is the time of the rollback in RFC 3339 format.
+	Time string `json:"time"`
+
+	// Listener is either listenerWeb or listenerDNS.
+	Listener string `json:"listener"`
+
+	// Addrs are the addresses which the listener has failed to use.
+	Addrs []string `json:"addresses"`
+
+	// Error is the reason of the failure.
+	Error string `json:"error"`
+
+	// RollbackError is the error of the rollback itself, if any.
+	RollbackError string `json:"rollback_error,omitempty"`
+}
+
+// listenChecks are the tokens of the successful checks of the listen
+// addresses and the last rollback of the listeners.
+type listenChecks struct {
+	// mu protects tokens and rollback.
+	mu sync.Mutex
+
+	// tokens are the keys of the checked addresses by the tokens.
+	tokens map[string]*listenToken
+
+	// rollback is the last rollback, if any.
+	rollback *listenRollbackJSON
+}
+
+// listenToken is the token of a successful check of the listen addresses.
+type listenToken struct {
+	expires time.Time
+	key     string
+}
+
+// add returns a new token for the addresses a, which is valid until the
+// returned expiration time.  It's safe for concurrent use.
+func (lc *listenChecks) add(a *listenAddrsJSON, now time.Time) (token string, expires time.Time, err error) {
+	b := make([]byte, listenTokenLen)
+	_, err = rand.Read(b)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("generating token: %w", err)
+	}
+
+	token = hex.EncodeToString(b)
+	expires = now.Add(listenTokenTTL)
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.tokens == nil {
+		lc.tokens = map[string]*listenToken{}
+	}
+
+	for t, lt := range lc.tokens {
+		if !now.Before(lt.expires) {
+			delete(lc.tokens, t)
+		}
+	}
+
+	lc.tokens[token] = &listenToken{
+		expires: expires,
+		key:     a.key(),
+	}
+
+	return token, expires, nil
+}
+
+// take returns true if token has been issued for the addresses a and hasn't
+// expired yet.  The token can only be taken once.  It's safe for concurrent
+// use.
+func (lc *listenChecks) take(token string, a *listenAddrsJSON, now time.Time) (ok bool) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lt, ok := lc.tokens[token]
+	if !ok {
+		return false
+	}
+
+	delete(lc.tokens, token)
+
+	return now.Before(lt.expires) && lt.key == a.key()
+}
+
+// setRollback records the rollback of the listener.  It's safe for concurrent
+// use.
+func (lc *listenChecks) setRollback(listener string, addrs []string, err, rollbackErr error) {
+	rb := &listenRollbackJSON{
+		Time:     time.Now().Format(time.RFC3339),
+		Listener: listener,
+		Addrs:    addrs,
+		Error:    err.Error(),
+	}
+	if rollbackErr != nil {
+		rb.RollbackError = rollbackErr.Error()
+	}
+
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	lc.rollback = rb
+}
+
+// status returns the last rollback of the listeners.  It's safe for
+// concurrent use.
+func (lc *listenChecks) status() (rb *listenRollbackJSON) {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	return lc.rollback
+}
+
+// webListenAddr returns the address of the plain HTTP server.
+func webListenAddr() (ip net.IP, port int) {
+	if web := Context.web; web != nil {
+		web.listenerLock.Lock()
+		defer web.listenerLock.Unlock()
+
+		return web.conf.BindHost, web.conf.BindPort
+	}
+
+	return config.BindHost, config.BindPort
+}
+
+// probeListen performs the real bind-and-release probes of the addresses a.
+// The addresses used by AdGuard Home itself aren't probed.  ok is true if all
+// the addresses are available.
+func probeListen(a *listenAddrsJSON) (probes []*listenProbeJSON, ok bool) {
+	ok = true
+	probe := func(listener, proto string, ip net.IP, port int, own bool, check func(net.IP, int) error) {
+		p := &listenProbeJSON{
+			Listener:  listener,
+			Proto:     proto,
+			Addr:      net.JoinHostPort(ip.String(), strconv.Itoa(port)),
+			Available: true,
+			Own:       own,
+		}
+		probes = append(probes, p)
+		if own {
+			return
+		}
+
+		err := check(ip, port)
+		if err == nil {
+			return
+		}
+
+		ok = false
+		p.Available = false
+		p.Error = err.Error()
+		if !aghnet.ErrorIsAddrInUse(err) {
+			return
+		}
+
+		o, oerr := aghnet.FindPortOwner(proto, port)
+		if oerr != nil {
+			log.Debug("check listen: owner of %s %s: %s", proto, p.Addr, oerr)
+
+			return
+		}
+
+		p.Process, p.PID = o.Name, o.PID
+	}
+
+	webIP, webPort := webListenAddr()
+	probe(listenerWeb, "tcp", a.WebIP, a.WebPort, a.WebIP.Equal(webIP) && a.WebPort == webPort, aghnet.CheckPortAvailable)
+
+	dnsOwn := isRunning() && a.DNSPort == config.DNS.Port
+	for _, ip := range a.DNSIPs {
+		probe(listenerDNS, "udp", ip, a.DNSPort, dnsOwn, aghnet.CheckPacketPortAvailable)
+		probe(listenerDNS, "tcp", ip, a.DNSPort, dnsOwn, aghnet.CheckPortAvailable)
+	}
+
+	return probes, ok
+}
+
+// handleCheckListen is the handler for the POST /control/check_listen HTTP
+// API.  It probes the proposed addresses and issues the token for changing the
+// listen addresses to them if they are all available.
+func handleCheckListen(w http.ResponseWriter, r *http.Request) {
+	a := &listenAddrsJSON{}
+	err := json.NewDecoder(r.Body).Decode(a)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = a.validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	resp := &checkListenResp{}
+	var ok bool
+	resp.Probes, ok = probeListen(a)
+	if ok {
+		var expires time.Time
+		resp.Token, expires, err = Context.listenChecks.add(a, time.Now())
+		if err != nil {
+			httpError(w, http.StatusInternalServerError, "%s", err)
+
+			return
+		}
+
+		resp.ExpiresAt = expires.Format(time.RFC3339)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// applyDNSListen changes the addresses of the DNS server and restarts it.  If
+// the server can't be started, the previous addresses are restored.
+func applyDNSListen(ips []net.IP, port int) (err error) {
+	prevIPs, prevPort := config.DNS.BindHosts, config.DNS.Port
+	config.DNS.BindHosts, config.DNS.Port = ips, port
+	if !isRunning() {
+		return nil
+	}
+
+	err = reconfigureDNSServer()
+	if err == nil {
+		return nil
+	}
+
+	config.DNS.BindHosts, config.DNS.Port = prevIPs, prevPort
+	rollbackErr := reconfigureDNSServer()
+
+	var addrs []string
+	for _, ip := range ips {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	Context.listenChecks.setRollback(listenerDNS, addrs, err, rollbackErr)
+	log.Error("listen config: dns: %s, rolled back, rollback error: %v", err, rollbackErr)
+
+	return fmt.Errorf("%w; rolled back to the previous addresses", err)
+}
+
+// handleListenConfig is the handler for the POST /control/listen_config HTTP
+// API.  It changes the listen addresses of the web UI and of the DNS server to
+// the ones which have been checked recently.
+func handleListenConfig(w http.ResponseWriter, r *http.Request) {
+	req := &listenConfigReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	a := &req.listenAddrsJSON
+	err = a.validate()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if Context.safeMode || Context.web == nil {
+		httpError(w, http.StatusBadRequest, "changing listen addresses is not available in safe mode")
+
+		return
+	}
+
+	if !Context.listenChecks.take(req.Token, a, time.Now()) {
+		httpError(w, http.StatusBadRequest, "no recent successful check of these addresses, use /control/check_listen")
+
+		return
+	}
+
+	err = applyDNSListen(a.DNSIPs, a.DNSPort)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	web := Context.web
+	rebindWeb := web.setListenAddr(a.WebIP, a.WebPort)
+	config.BindHost, config.BindPort = a.WebIP, a.WebPort
+	writeConfigNow()
+
+	returnOK(w)
+	if !rebindWeb {
+		return
+	}
+
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// Method http.(*Server).Shutdown needs to be called in a separate
+	// goroutine and with its own context, because it waits until all
+	// requests are handled and will be blocked by it's own caller.
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	go shutdownSrv(ctx, cancel, web.httpServer)
+	go shutdownSrv(ctx, cancel, web.httpServerBeta)
+}
@@ -0,0 +1,145 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenChecks_take(t *testing.T) {
+	now := time.Now()
+	a := &listenAddrsJSON{
+		WebIP:   net.IP{127, 0, 0, 1},
+		WebPort: 3000,
+		DNSIPs:  []net.IP{{127, 0, 0, 1}, {192, 168, 0, 1}},
+		DNSPort: 53,
+	}
+
+	lc := &listenChecks{}
+	add := func(t *testing.T) (token string) {
+		t.Helper()
+
+		token, expires, err := lc.add(a, now)
+		require.NoError(t, err)
+		require.NotEmpty(t, token)
+		assert.Equal(t, now.Add(listenTokenTTL), expires)
+
+		return token
+	}
+
+	t.Run("once", func(t *testing.T) {
+		token := add(t)
+
+		// The order of the DNS addresses doesn't matter.
+		reordered := *a
+		reordered.DNSIPs = []net.IP{{192, 168, 0, 1}, {127, 0, 0, 1}}
+		assert.True(t, lc.take(token, &reordered, now.Add(time.Minute)))
+		assert.False(t, lc.take(token, a, now.Add(time.Minute)))
+	})
+
+	t.Run("other_addrs", func(t *testing.T) {
+		token := add(t)
+
+		other := *a
+		other.WebPort = 8080
+		assert.False(t, lc.take(token, &other, now))
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		token := add(t)
+
+		assert.False(t, lc.take(token, a, now.Add(listenTokenTTL)))
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		assert.False(t, lc.take("", a, now))
+	})
+}
+
+func TestListenAddrsJSON_validate(t *testing.T) {
+	testCases := []struct {
+		name       string
+		a          listenAddrsJSON
+		wantErrMsg string
+	}{{
+		name: "valid",
+		a: listenAddrsJSON{
+			WebIP:   net.IP{0, 0, 0, 0},
+			WebPort: 80,
+			DNSIPs:  []net.IP{{0, 0, 0, 0}},
+			DNSPort: 53,
+		},
+		wantErrMsg: "",
+	}, {
+		name: "no_dns",
+		a: listenAddrsJSON{
+			WebIP:   net.IP{0, 0, 0, 0},
+			WebPort: 80,
+			DNSPort: 53,
+		},
+		wantErrMsg: "dns_ips are required",
+	}, {
+		name: "bad_port",
+		a: listenAddrsJSON{
+			WebIP:   net.IP{0, 0, 0, 0},
+			WebPort: 65536,
+			DNSIPs:  []net.IP{{0, 0, 0, 0}},
+			DNSPort: 53,
+		},
+		wantErrMsg: "bad web_port 65536",
+	}, {
+		name: "conflict",
+		a: listenAddrsJSON{
+			WebIP:   net.IP{0, 0, 0, 0},
+			WebPort: 53,
+			DNSIPs:  []net.IP{{127, 0, 0, 1}},
+			DNSPort: 53,
+		},
+		wantErrMsg: "dns address 127.0.0.1 conflicts with the web address",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.a.validate()
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestProbeListen(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = l.Close() })
+
+	busy := l.Addr().(*net.TCPAddr).Port
+
+	probes, ok := probeListen(&listenAddrsJSON{
+		WebIP:   net.IP{127, 0, 0, 1},
+		WebPort: busy,
+		DNSIPs:  []net.IP{{127, 0, 0, 1}},
+		DNSPort: 0,
+	})
+	assert.False(t, ok)
+	require.Len(t, probes, 3)
+
+	web := probes[0]
+	assert.Equal(t, listenerWeb, web.Listener)
+	assert.False(t, web.Available)
+	assert.NotEmpty(t, web.Error)
+
+	for _, p := range probes[1:] {
+		assert.Equal(t, listenerDNS, p.Listener)
+		assert.True(t, p.Available)
+		assert.False(t, p.Own)
+	}
+}
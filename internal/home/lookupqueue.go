@@ -0,0 +1,353 @@
+package home
+
+import (
+	"container/heap"
+	"encoding/binary"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/cache"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Default values of the client lookup queues.
+const (
+	// defaultLookupQueueSize is the maximum number of the addresses waiting
+	// for a lookup in a queue.
+	defaultLookupQueueSize = 256
+
+	// defaultLookupConcurrency is the maximum number of the lookups of all
+	// queues performed simultaneously.
+	defaultLookupConcurrency = 4
+
+	// defaultLookupCacheSize is the maximum number of the addresses the
+	// results of the lookups of which are remembered.
+	defaultLookupCacheSize = 10000
+
+	// lookupItemTTL is the time after which a queued address of a client not
+	// seen since then is removed from the queue.
+	lookupItemTTL = 10 * time.Minute
+
+	// lookupResultTTL is the time after which a successfully looked up
+	// address is looked up again.
+	lookupResultTTL = 1 * time.Hour
+
+	// lookupRetryMin and lookupRetryMax are the bounds of the time after
+	// which a failed lookup is retried.  The time doubles with each
+	// consecutive failure.
+	lookupRetryMin = 5 * time.Minute
+	lookupRetryMax = 24 * time.Hour
+)
+
+// lookupFunc looks up ip and stores the result.
+type lookupFunc func(ip net.IP) (err error)
+
+// lookupItem is an address waiting for a lookup.
+type lookupItem struct {
+	ip net.IP
+
+	// seen is the time of the last request from ip.
+	seen time.Time
+
+	// index is the index of the item within the heap.
+	index int
+}
+
+// lookupHeap is a heap of the queued items with the most recently seen one on
+// top.  It implements heap.Interface.
+type lookupHeap []*lookupItem
+
+// type check
+var _ heap.Interface = (*lookupHeap)(nil)
+
+// Len implements the heap.Interface interface for *lookupHeap.
+func (h *lookupHeap) Len() (n int) { return len(*h) }
+
+// Less implements the heap.Interface interface for *lookupHeap.
+func (h *lookupHeap) Less(i, j int) (less bool) { return (*h)[i].seen.After((*h)[j].seen) }
+
+// Swap implements the heap.Interface interface for *lookupHeap.
+func (h *lookupHeap) Swap(i, j int) {
+	items := *h
+	items[i], items[j] = items[j], items[i]
+	items[i].index, items[j].index = i, j
+}
+
+// Push implements the heap.Interface interface for *lookupHeap.  x must be a
+// *lookupItem.
+func (h *lookupHeap) Push(x interface{}) {
+	item := x.(*lookupItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+// Pop implements the heap.Interface interface for *lookupHeap.
+func (h *lookupHeap) Pop() (x interface{}) {
+	items := *h
+	n := len(items) - 1
+	item := items[n]
+	items[n] = nil
+	*h = items[:n]
+
+	return item
+}
+
+// lookupQueueStats are the numbers of the lookups of a queue.
+type lookupQueueStats struct {
+	// Depth is the number of the addresses waiting for a lookup.
+	Depth int `json:"depth"`
+
+	// Completed is the number of the successful lookups.
+	Completed uint64 `json:"completed"`
+
+	// Failed is the number of the failed lookups.
+	Failed uint64 `json:"failed"`
+
+	// Dropped is the number of the addresses removed from the queue without
+	// a lookup, since the queue was full or since the client hasn't been
+	// seen again before its turn.
+	Dropped uint64 `json:"dropped"`
+}
+
+// lookupQueue is a bounded queue of the addresses of the clients to look up.
+// The addresses of the most recently seen clients are looked up first.  The
+// failed lookups are retried with an increasing delay.
+type lookupQueue struct {
+	// lookup performs the lookup.
+	lookup lookupFunc
+
+	// skip, if not nil, returns true if ip needn't be looked up.  The
+	// skipped addresses are checked again after lookupResultTTL.
+	skip func(ip net.IP) (ok bool)
+
+	// sem limits the number of the simultaneous lookups.  It's shared
+	// between the queues.
+	sem chan struct{}
+
+	// wake notifies the worker about the new items.
+	wake chan struct{}
+
+	// mu protects the fields below.
+	mu *sync.Mutex
+
+	// items are the queued items.
+	items lookupHeap
+
+	// index is the queued items by the string representations of their
+	// addresses.
+	index map[string]*lookupItem
+
+	// results contains the time of the next lookup and the number of the
+	// consecutive failures by the addresses which have been looked up.
+	results cache.Cache
+
+	// stats are the numbers of the lookups.  Depth isn't used.
+	stats lookupQueueStats
+
+	// name is used for logging.
+	name string
+
+	// maxLen is the maximum number of the queued items.
+	maxLen int
+}
+
+// newLookupQueue returns a new lookup queue.  sem is shared by the queues to
+// limit the total number of the simultaneous lookups.
+func newLookupQueue(name string, lookup lookupFunc, sem chan struct{}) (q *lookupQueue) {
+	return &lookupQueue{
+		lookup: lookup,
+		sem:    sem,
+		wake:   make(chan struct{}, 1),
+		mu:     &sync.Mutex{},
+		index:  map[string]*lookupItem{},
+		results: cache.New(cache.Config{
+			EnableLRU: true,
+			MaxCount:  defaultLookupCacheSize,
+		}),
+		name:   name,
+		maxLen: defaultLookupQueueSize,
+	}
+}
+
+// lookupResultLen is the length of the values of lookupQueue.results: the
+// Unix time of the next lookup and the number of the consecutive failures.
+const lookupResultLen = 16
+
+// add queues ip, a client of which is seen at now, unless it's been looked up
+// recently.  If ip is already queued, it's moved up.  It's safe for
+// concurrent use.
+func (q *lookupQueue) add(ip net.IP, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	key := ip.String()
+	if item, ok := q.index[key]; ok {
+		item.seen = now
+		heap.Fix(&q.items, item.index)
+
+		return
+	}
+
+	if res := q.results.Get(ip); len(res) == lookupResultLen {
+		if int64(binary.BigEndian.Uint64(res)) > now.Unix() {
+			return
+		}
+	}
+
+	if q.skip != nil && q.skip(ip) {
+		q.setResult(ip, now.Add(lookupResultTTL), 0)
+
+		return
+	}
+
+	if len(q.items) >= q.maxLen {
+		q.dropOldest()
+	}
+
+	item := &lookupItem{
+		ip:   ip,
+		seen: now,
+	}
+	heap.Push(&q.items, item)
+	q.index[key] = item
+
+	log.Tracef("%s: %q added to queue", q.name, ip)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// dropOldest removes the least recently seen item from the queue.  q.mu is
+// expected to be locked.
+func (q *lookupQueue) dropOldest() {
+	oldest := 0
+	for i, item := range q.items {
+		if item.seen.Before(q.items[oldest].seen) {
+			oldest = i
+		}
+	}
+
+	item := heap.Remove(&q.items, oldest).(*lookupItem)
+	delete(q.index, item.ip.String())
+	q.stats.Dropped++
+
+	log.Tracef("%s: queue is full, dropped %q", q.name, item.ip)
+}
+
+// pop removes the most recently seen item from the queue and returns its
+// address.  The items not seen since lookupItemTTL before now are dropped.
+// ok is false if there are no items.  It's safe for concurrent use.
+func (q *lookupQueue) pop(now time.Time) (ip net.IP, ok bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.items) == 0 {
+		return nil, false
+	}
+
+	item := heap.Pop(&q.items).(*lookupItem)
+	delete(q.index, item.ip.String())
+	if now.Sub(item.seen) <= lookupItemTTL {
+		return item.ip, true
+	}
+
+	// The top item is the most recently seen one, so all the others have
+	// expired as well.
+	q.stats.Dropped += uint64(len(q.items) + 1)
+	q.items = q.items[:0]
+	q.index = map[string]*lookupItem{}
+
+	return nil, false
+}
+
+// finish records the result of the lookup of ip finished at now.  It's safe
+// for concurrent use.
+func (q *lookupQueue) finish(ip net.IP, err error, now time.Time) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err == nil {
+		q.stats.Completed++
+		q.setResult(ip, now.Add(lookupResultTTL), 0)
+
+		return
+	}
+
+	q.stats.Failed++
+
+	var failures uint64
+	if res := q.results.Get(ip); len(res) == lookupResultLen {
+		failures = binary.BigEndian.Uint64(res[8:])
+	}
+
+	retry := lookupRetryMin
+	for i := uint64(0); i < failures && retry < lookupRetryMax; i++ {
+		retry *= 2
+	}
+
+	if retry > lookupRetryMax {
+		retry = lookupRetryMax
+	}
+
+	q.setResult(ip, now.Add(retry), failures+1)
+
+	log.Debug("%s: looking up %q: %s; retrying in %s", q.name, ip, err, retry)
+}
+
+// setResult remembers the time of the next lookup of ip and the number of the
+// consecutive failures.  q.mu is expected to be locked.
+func (q *lookupQueue) setResult(ip net.IP, next time.Time, failures uint64) {
+	res := make([]byte, lookupResultLen)
+	binary.BigEndian.PutUint64(res, uint64(next.Unix()))
+	binary.BigEndian.PutUint64(res[8:], failures)
+	q.results.Set(ip, res)
+}
+
+// queueStats returns the numbers of the lookups.  It's safe for concurrent use.
+func (q *lookupQueue) queueStats() (st lookupQueueStats) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	st = q.stats
+	st.Depth = len(q.items)
+
+	return st
+}
+
+// workerLoop looks up the queued addresses as long as the limit of the
+// simultaneous lookups allows.
+func (q *lookupQueue) workerLoop() {
+	defer agherr.LogPanic(q.name)
+
+	for range q.wake {
+		for q.dispatch() {
+		}
+	}
+}
+
+// dispatch starts the lookup of the next queued address once the limit of the
+// simultaneous lookups allows it.  It returns false if the queue is empty.
+func (q *lookupQueue) dispatch() (ok bool) {
+	q.sem <- struct{}{}
+
+	ip, ok := q.pop(time.Now())
+	if !ok {
+		<-q.sem
+
+		return false
+	}
+
+	go func() {
+		defer agherr.LogPanic(q.name)
+		defer func() { <-q.sem }()
+
+		err := q.lookup(ip)
+		q.finish(ip, err, time.Now())
+	}()
+
+	return true
+}
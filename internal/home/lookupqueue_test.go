@@ -0,0 +1,164 @@
+package home
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestLookupQueue returns a new lookup queue with the maximum length of
+// maxLen which doesn't perform lookups.
+func newTestLookupQueue(maxLen int) (q *lookupQueue) {
+	q = newLookupQueue("test", nil, nil)
+	q.maxLen = maxLen
+
+	return q
+}
+
+func TestLookupQueue_pop(t *testing.T) {
+	now := time.Now()
+	ip1, ip2, ip3 := net.IP{1, 2, 3, 1}, net.IP{1, 2, 3, 2}, net.IP{1, 2, 3, 3}
+
+	t.Run("priority", func(t *testing.T) {
+		q := newTestLookupQueue(3)
+
+		q.add(ip1, now)
+		q.add(ip2, now.Add(time.Second))
+		q.add(ip3, now.Add(2*time.Second))
+
+		// Seen again, ip1 is moved up.
+		q.add(ip1, now.Add(3*time.Second))
+
+		for _, want := range []net.IP{ip1, ip3, ip2} {
+			ip, ok := q.pop(now.Add(time.Minute))
+			require.True(t, ok)
+
+			assert.Equal(t, want, ip)
+		}
+
+		_, ok := q.pop(now.Add(time.Minute))
+		assert.False(t, ok)
+	})
+
+	t.Run("full", func(t *testing.T) {
+		q := newTestLookupQueue(2)
+
+		q.add(ip1, now)
+		q.add(ip2, now.Add(time.Second))
+		q.add(ip3, now.Add(2*time.Second))
+
+		st := q.queueStats()
+		assert.Equal(t, 2, st.Depth)
+		assert.Equal(t, uint64(1), st.Dropped)
+
+		ip, ok := q.pop(now)
+		require.True(t, ok)
+		assert.Equal(t, ip3, ip)
+
+		ip, ok = q.pop(now)
+		require.True(t, ok)
+		assert.Equal(t, ip2, ip)
+	})
+
+	t.Run("expired", func(t *testing.T) {
+		q := newTestLookupQueue(3)
+
+		q.add(ip1, now)
+		q.add(ip2, now.Add(time.Second))
+
+		_, ok := q.pop(now.Add(lookupItemTTL + time.Minute))
+		assert.False(t, ok)
+
+		st := q.queueStats()
+		assert.Equal(t, 0, st.Depth)
+		assert.Equal(t, uint64(2), st.Dropped)
+	})
+}
+
+func TestLookupQueue_finish(t *testing.T) {
+	now := time.Now()
+	ip := net.IP{1, 2, 3, 4}
+	testErr := errors.New("test")
+
+	q := newTestLookupQueue(1)
+	depthAt := func(tm time.Time) (depth int) {
+		q.add(ip, tm)
+		depth = q.queueStats().Depth
+		_, _ = q.pop(tm)
+
+		return depth
+	}
+
+	q.finish(ip, testErr, now)
+	assert.Equal(t, 0, depthAt(now.Add(lookupRetryMin-time.Second)))
+	assert.Equal(t, 1, depthAt(now.Add(lookupRetryMin)))
+
+	// The delay doubles with each consecutive failure.
+	q.finish(ip, testErr, now)
+	assert.Equal(t, 0, depthAt(now.Add(2*lookupRetryMin-time.Second)))
+	assert.Equal(t, 1, depthAt(now.Add(2*lookupRetryMin)))
+
+	for i := 0; i < 20; i++ {
+		q.finish(ip, testErr, now)
+	}
+	assert.Equal(t, 1, depthAt(now.Add(lookupRetryMax)))
+
+	q.finish(ip, nil, now)
+	assert.Equal(t, 0, depthAt(now.Add(lookupResultTTL-time.Second)))
+	assert.Equal(t, 1, depthAt(now.Add(lookupResultTTL)))
+
+	st := q.queueStats()
+	assert.Equal(t, uint64(1), st.Completed)
+	assert.Equal(t, uint64(22), st.Failed)
+}
+
+func TestLookupQueue_workerLoop(t *testing.T) {
+	const concurrency = 2
+
+	var mu sync.Mutex
+	var active, maxActive int
+	var wg sync.WaitGroup
+
+	release := make(chan struct{})
+	lookup := func(_ net.IP) (err error) {
+		defer wg.Done()
+
+		mu.Lock()
+		active++
+		if active > maxActive {
+			maxActive = active
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		active--
+		mu.Unlock()
+
+		return nil
+	}
+
+	sem := make(chan struct{}, concurrency)
+	q1 := newLookupQueue("test1", lookup, sem)
+	q2 := newLookupQueue("test2", lookup, sem)
+	go q1.workerLoop()
+	go q2.workerLoop()
+
+	const n = 3
+	wg.Add(2 * n)
+	for i := 0; i < n; i++ {
+		q1.add(net.IP{1, 2, 3, byte(i)}, time.Now())
+		q2.add(net.IP{1, 2, 4, byte(i)}, time.Now())
+	}
+
+	close(release)
+	wg.Wait()
+
+	assert.LessOrEqual(t, maxActive, concurrency)
+}
@@ -1,10 +1,15 @@
 package home
 
 import (
+	"encoding/json"
+	"net/http"
 	"os"
+	"runtime"
 	"runtime/debug"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghmem"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -38,3 +43,126 @@ func memoryUsage(args options) {
 		}
 	}()
 }
+
+// memCheckIvl is the interval between the checks of the memory budget.
+const memCheckIvl = 1 * time.Minute
+
+// Priorities of the memory consumers.  The filtering caches are the cheapest to
+// rebuild, so they are shed first, and the query log buffer is only flushed
+// when nothing else helps.
+const (
+	memPrioFilterCaches = iota
+	memPrioStats
+	memPrioQueryLog
+)
+
+// newMemManager returns a new memory budget manager with the DNS modules
+// registered in it.  It must be called after the modules are initialized.
+//
+// The response cache of the DNS server isn't registered, since dnsproxy
+// neither reports its usage nor allows to shrink it without restarting the
+// proxy.  Its size is limited by the cache_size setting instead.
+func newMemManager() (m *aghmem.Manager) {
+	m = aghmem.NewManager(config.MemoryBudgetMB * 1024 * 1024)
+
+	m.Register("filtering_caches", memPrioFilterCaches, Context.dnsFilter)
+	m.Register("stats", memPrioStats, Context.stats)
+	m.Register("querylog", memPrioQueryLog, Context.queryLog)
+
+	return m
+}
+
+// debugRuntimeJSON is the response to the GET /control/debug/runtime request.
+type debugRuntimeJSON struct {
+	// Subsystems is the memory usage of the subsystems which are kept within
+	// the memory budget.  It's empty when the DNS modules aren't
+	// initialized.
+	Subsystems []aghmem.Usage `json:"subsystems"`
+
+	// EDNSOptions are the numbers of the EDNS(0) options received from the
+	// clients by the option and the action taken.  It's empty when the DNS
+	// server isn't initialized.
+	EDNSOptions map[string]map[string]uint64 `json:"edns_options"`
+
+	// InflightQueries is the current state of the limit on the number of
+	// the DNS requests processed simultaneously.
+	InflightQueries dnsforward.InflightStats `json:"inflight_queries"`
+
+	// ConnectionReuse are the numbers of the queries received over the
+	// connections of the connection-oriented protocols.
+	ConnectionReuse dnsforward.ConnReuseStats `json:"connection_reuse"`
+
+	// ClientLookups are the numbers of the lookups of the clients' addresses
+	// by the kind of the lookup, "rdns" or "whois".  It's empty when the DNS
+	// server isn't initialized.
+	ClientLookups map[string]lookupQueueStats `json:"client_lookups"`
+
+	// MemoryBudget is the memory budget in bytes.  Zero means no limit.
+	MemoryBudget uint64 `json:"memory_budget"`
+
+	// HeapAlloc is the number of bytes of allocated heap objects.
+	HeapAlloc uint64 `json:"heap_alloc"`
+
+	// Sys is the total number of bytes of memory obtained from the OS.
+	Sys uint64 `json:"sys"`
+
+	// NumGC is the number of completed GC cycles.
+	NumGC uint32 `json:"num_gc"`
+
+	// NumGoroutine is the number of goroutines that currently exist.
+	NumGoroutine int `json:"num_goroutine"`
+}
+
+// debugRuntime returns the current runtime metrics.
+func debugRuntime() (resp debugRuntimeJSON) {
+	ms := &runtime.MemStats{}
+	runtime.ReadMemStats(ms)
+
+	resp = debugRuntimeJSON{
+		Subsystems:    []aghmem.Usage{},
+		EDNSOptions:   map[string]map[string]uint64{},
+		ClientLookups: map[string]lookupQueueStats{},
+		ConnectionReuse: dnsforward.ConnReuseStats{
+			Protocols: map[string]*dnsforward.ConnReuseProtoStats{},
+		},
+		MemoryBudget: config.MemoryBudgetMB * 1024 * 1024,
+		HeapAlloc:    ms.HeapAlloc,
+		Sys:          ms.Sys,
+		NumGC:        ms.NumGC,
+		NumGoroutine: runtime.NumGoroutine(),
+	}
+
+	if m := Context.memManager; m != nil {
+		resp.Subsystems = m.Usage()
+	}
+
+	if Context.dnsServer != nil {
+		resp.EDNSOptions = Context.dnsServer.EDNSOptionCounters()
+		resp.InflightQueries = Context.dnsServer.InflightQueries()
+		resp.ConnectionReuse = Context.dnsServer.ConnectionReuse()
+	}
+
+	if Context.rdns != nil {
+		resp.ClientLookups["rdns"] = Context.rdns.queue.queueStats()
+	}
+
+	if Context.whois != nil {
+		resp.ClientLookups["whois"] = Context.whois.queue.queueStats()
+	}
+
+	return resp
+}
+
+// handleDebugRuntime is the handler for the GET /control/debug/runtime HTTP
+// API.
+func handleDebugRuntime(w http.ResponseWriter, _ *http.Request) {
+	js, err := json.Marshal(debugRuntime())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
@@ -42,9 +42,12 @@ func expectsLargerRequests(r *http.Request) (ok bool) {
 		return false
 	}
 
-	p := r.URL.Path
+	p := unversionedAPIPath(r.URL.Path)
 	return p == "/control/access/set" ||
-		p == "/control/filtering/set_rules"
+		p == "/control/filtering/set_rules" ||
+		p == "/control/filtering/rules/import" ||
+		p == "/control/filtering/rules/batch" ||
+		p == "/control/rewrite/batch"
 }
 
 // limitRequestBody wraps underlying handler h, making it's request's body Read
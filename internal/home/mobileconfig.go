@@ -7,6 +7,7 @@ import (
 	"net/url"
 	"path"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
 	"github.com/AdguardTeam/golibs/log"
 	uuid "github.com/satori/go.uuid"
@@ -102,8 +103,8 @@ func getMobileConfig(d dnsSettings) ([]byte, error) {
 func handleMobileConfig(w http.ResponseWriter, r *http.Request, dnsp string) {
 	var err error
 
-	q := r.URL.Query()
-	host := q.Get("host")
+	params := aghhttp.QueryParams(r.URL.Query())
+	host := params.String("host", "")
 	if host == "" {
 		host = Context.tls.conf.ServerName
 	}
@@ -122,21 +123,20 @@ func handleMobileConfig(w http.ResponseWriter, r *http.Request, dnsp string) {
 		return
 	}
 
-	clientID := q.Get("client_id")
-	if clientID != "" {
-		err = dnsforward.ValidateClientID(clientID)
-		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-
-			err = json.NewEncoder(w).Encode(&jsonError{
-				Message: err.Error(),
-			})
-			if err != nil {
-				log.Debug("writing 400 json response: %s", err)
-			}
+	clientID := params.String("client_id", "")
+	params.Value("client_id", "a valid client id", dnsforward.ValidateClientID)
+	err = params.Err()
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
 
-			return
+		err = json.NewEncoder(w).Encode(&jsonError{
+			Message: err.Error(),
+		})
+		if err != nil {
+			log.Debug("writing 400 json response: %s", err)
 		}
+
+		return
 	}
 
 	d := dnsSettings{
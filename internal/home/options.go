@@ -36,6 +36,15 @@ type options struct {
 	// noEtcHosts flag should be provided when /etc/hosts file shouldn't be
 	// used.
 	noEtcHosts bool
+
+	// instanceID is the ID of the instance sharing the working directory
+	// with other ones.  Empty means that there is the only instance.
+	instanceID string
+
+	// safeMode flag disables the filtering, the rewrites, the access
+	// control, and the custom upstreams without changing the
+	// configuration file.
+	safeMode bool
 }
 
 // functions used for their side-effects
@@ -234,6 +243,26 @@ var noEtcHostsArg = arg{
 	serialize:       func(o options) []string { return boolSliceOrNil(o.noEtcHosts) },
 }
 
+var instanceIDArg = arg{
+	description:     "ID of the instance sharing the working directory with other ones.",
+	longName:        "instance-id",
+	shortName:       "",
+	updateWithValue: func(o options, v string) (options, error) { o.instanceID = v; return o, nil },
+	updateNoValue:   nil,
+	effect:          nil,
+	serialize:       func(o options) []string { return stringSliceOrNil(o.instanceID) },
+}
+
+var safeModeArg = arg{
+	description:     "Start with the filtering, the rewrites, the access control, and the custom upstreams disabled and the web interface on the default address.",
+	longName:        "safe-mode",
+	shortName:       "",
+	updateWithValue: nil,
+	updateNoValue:   func(o options) (options, error) { o.safeMode = true; return o, nil },
+	effect:          nil,
+	serialize:       func(o options) []string { return boolSliceOrNil(o.safeMode) },
+}
+
 func init() {
 	args = []arg{
 		configArg,
@@ -247,6 +276,8 @@ func init() {
 		noCheckUpdateArg,
 		disableMemoryOptimizationArg,
 		noEtcHostsArg,
+		instanceIDArg,
+		safeModeArg,
 		verboseArg,
 		glinetArg,
 		versionArg,
@@ -259,6 +290,10 @@ func getUsageLines(exec string, args []arg) []string {
 		"Usage:",
 		"",
 		fmt.Sprintf("%s [options]", exec),
+		fmt.Sprintf("%s doctor [--json] [--help]", exec),
+		fmt.Sprintf("%s stats [--json] [--help]", exec),
+		fmt.Sprintf("%s querylog [--client CLIENT] [--blocked] [--tail] [--verbose] [--json] [--help]", exec),
+		fmt.Sprintf("%s config dump [--json] [--help]", exec),
 		"",
 		"Options:",
 	}
@@ -0,0 +1,234 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+)
+
+// outboundConfig defines the connections to the external hosts, which AdGuard
+// Home makes on its own.  The connections to the upstream DNS servers are
+// always allowed.
+type outboundConfig struct {
+	// Disabled are the purposes for which the connections are disabled.
+	Disabled []aghnet.OutboundPurpose `yaml:"disabled"`
+
+	// DisabledHosts are the hosts to which the connections are disabled for
+	// all purposes.
+	DisabledHosts []string `yaml:"disabled_hosts"`
+
+	// Offline disables the connections for all purposes.
+	Offline bool `yaml:"offline"`
+}
+
+// outboundDescriptions are the descriptions of the purposes of the outbound
+// connections.
+var outboundDescriptions = map[aghnet.OutboundPurpose]string{
+	aghnet.OutboundFilters:      "Downloading the filter lists.",
+	aghnet.OutboundUpdates:      "Checking for and downloading the updates.",
+	aghnet.OutboundWebhooks:     "Sending the statistics alerts to the webhooks.",
+	aghnet.OutboundWHOIS:        "Looking up the WHOIS information of the clients.",
+	aghnet.OutboundSafeBrowsing: "Checking the hosts with the safe browsing service.",
+	aghnet.OutboundParental:     "Checking the hosts with the parental control service.",
+}
+
+// outboundClientTimeout is the timeout of the HTTP clients returned by
+// newOutboundClient.
+const outboundClientTimeout = 5 * time.Minute
+
+// newOutboundClient returns a new HTTP client for the requests made for p.
+// All HTTP clients making requests on their own must be created with it, so
+// that the requests are checked and reported.
+func newOutboundClient(p aghnet.OutboundPurpose) (c *http.Client) {
+	return Context.outbound.HTTPClient(p, &http.Client{
+		Timeout:   outboundClientTimeout,
+		Transport: Context.transport,
+	})
+}
+
+// applyOutboundConfig applies the outbound configuration from config.
+func applyOutboundConfig() {
+	config.RLock()
+	defer config.RUnlock()
+
+	c := config.Outbound
+	Context.outbound.SetConfig(c.Offline, c.Disabled, c.DisabledHosts)
+}
+
+// outboundDestJSON is an external host in the outbound connections report.
+type outboundDestJSON struct {
+	// LastContact is nil if the host hasn't been contacted since the start.
+	LastContact *aghtime.Time `json:"last_contact,omitempty"`
+
+	Host     string `json:"host"`
+	Contacts uint64 `json:"contacts"`
+	Refused  uint64 `json:"refused"`
+	Enabled  bool   `json:"enabled"`
+}
+
+// outboundPurposeJSON is a purpose in the outbound connections report.
+type outboundPurposeJSON struct {
+	Purpose      aghnet.OutboundPurpose `json:"purpose"`
+	Description  string                 `json:"description"`
+	Destinations []*outboundDestJSON    `json:"destinations"`
+	Enabled      bool                   `json:"enabled"`
+}
+
+// outboundJSON is the outbound connections report.
+type outboundJSON struct {
+	Purposes      []*outboundPurposeJSON   `json:"purposes"`
+	Disabled      []aghnet.OutboundPurpose `json:"disabled"`
+	DisabledHosts []string                 `json:"disabled_hosts"`
+	Offline       bool                     `json:"offline"`
+}
+
+// expectOutbound adds the hosts from the configuration, which may be contacted
+// later, to the reported destinations.
+func expectOutbound() {
+	o := Context.outbound
+
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, fs := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range fs {
+			if u, err := url.Parse(f.URL); err == nil && u.Host != "" && f.Enabled {
+				o.Expect(aghnet.OutboundFilters, u.Hostname())
+			}
+		}
+	}
+
+	webhooks := []string{config.DNS.HijackWebhookURL, config.ReadOnlyWebhookURL}
+	for _, r := range config.DNS.StatsAlerts {
+		webhooks = append(webhooks, r.WebhookURL)
+	}
+
+	for _, wh := range webhooks {
+		if u, err := url.Parse(wh); err == nil && u.Host != "" {
+			o.Expect(aghnet.OutboundWebhooks, u.Hostname())
+		}
+	}
+}
+
+// handleOutbound is the handler for the GET /control/outbound HTTP API.
+func handleOutbound(w http.ResponseWriter, _ *http.Request) {
+	expectOutbound()
+
+	o := Context.outbound
+	byPurpose := map[aghnet.OutboundPurpose]*outboundPurposeJSON{}
+
+	config.RLock()
+	resp := &outboundJSON{
+		Purposes:      make([]*outboundPurposeJSON, 0, len(aghnet.OutboundPurposes)),
+		Disabled:      append([]aghnet.OutboundPurpose{}, config.Outbound.Disabled...),
+		DisabledHosts: append([]string{}, config.Outbound.DisabledHosts...),
+		Offline:       config.Outbound.Offline,
+	}
+	config.RUnlock()
+
+	for _, p := range aghnet.OutboundPurposes {
+		pj := &outboundPurposeJSON{
+			Purpose:      p,
+			Description:  outboundDescriptions[p],
+			Destinations: []*outboundDestJSON{},
+			Enabled:      o.Allowed(p, ""),
+		}
+		byPurpose[p] = pj
+		resp.Purposes = append(resp.Purposes, pj)
+	}
+
+	for _, d := range o.Destinations() {
+		pj, ok := byPurpose[d.Purpose]
+		if !ok {
+			continue
+		}
+
+		dj := &outboundDestJSON{
+			Host:     d.Host,
+			Contacts: d.Contacts,
+			Refused:  d.Refused,
+			Enabled:  o.Allowed(d.Purpose, d.Host),
+		}
+		if !d.LastContact.IsZero() {
+			dj.LastContact = &aghtime.Time{Time: d.LastContact}
+		}
+
+		pj.Destinations = append(pj.Destinations, dj)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "encoding outbound report: %s", err)
+	}
+}
+
+// outboundConfigJSON is the request to change the outbound configuration.  The
+// nil fields aren't changed.
+type outboundConfigJSON struct {
+	Disabled      *[]aghnet.OutboundPurpose `json:"disabled"`
+	DisabledHosts *[]string                 `json:"disabled_hosts"`
+	Offline       *bool                     `json:"offline"`
+}
+
+// validateOutboundPurposes returns an error if any of ps is unknown.
+func validateOutboundPurposes(ps []aghnet.OutboundPurpose) (err error) {
+	for _, p := range ps {
+		if _, ok := outboundDescriptions[p]; !ok {
+			return fmt.Errorf("unknown purpose %q", p)
+		}
+	}
+
+	return nil
+}
+
+// handleOutboundConfig is the handler for the POST /control/outbound/config
+// HTTP API.
+func handleOutboundConfig(w http.ResponseWriter, r *http.Request) {
+	req := &outboundConfigJSON{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "decoding request: %s", err)
+
+		return
+	}
+
+	if req.Disabled != nil {
+		err = validateOutboundPurposes(*req.Disabled)
+		if err != nil {
+			httpError(w, http.StatusBadRequest, "%s", err)
+
+			return
+		}
+	}
+
+	config.Lock()
+	c := &config.Outbound
+	if req.Disabled != nil {
+		c.Disabled = *req.Disabled
+	}
+
+	if req.DisabledHosts != nil {
+		c.DisabledHosts = *req.DisabledHosts
+	}
+
+	if req.Offline != nil {
+		c.Offline = *req.Offline
+	}
+	config.Unlock()
+
+	applyOutboundConfig()
+	onConfigModified()
+}
+
+// registerOutboundHandlers registers the HTTP handlers of the outbound
+// connections report.
+func registerOutboundHandlers() {
+	httpRegister(http.MethodGet, "/control/outbound", handleOutbound)
+	httpRegister(http.MethodPost, "/control/outbound/config", handleOutboundConfig)
+}
@@ -0,0 +1,412 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/golibs/log"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// pinBypassConfig defines the temporary bypasses of the blocked services and
+// the parental control, which a client creates for a domain by submitting the
+// PIN.
+type pinBypassConfig struct {
+	// PINHash is the bcrypt hash of the PIN.  Empty means that the bypasses
+	// are disabled.
+	PINHash string `yaml:"pin_hash"`
+
+	// DurationMinutes is the duration of a bypass in minutes.
+	DurationMinutes uint32 `yaml:"duration_minutes"`
+
+	// MaxAttempts is the number of the failed attempts to submit the PIN a
+	// single IPv4 address or IPv6 /64 network may make within
+	// pinBypassAttemptsWindow.
+	MaxAttempts uint32 `yaml:"max_attempts"`
+}
+
+// The defaults and the limits of pinBypassConfig.
+const (
+	defaultPINBypassMinutes  = 30
+	maxPINBypassMinutes      = 24 * 60
+	defaultPINBypassAttempts = 5
+	minPINLen                = 4
+)
+
+// pinBypassAttemptsWindow is the duration of the window of the limit of the
+// failed attempts to submit the PIN.
+const pinBypassAttemptsWindow = 15 * time.Minute
+
+// pinBypass is an active bypass of a domain for a client.
+type pinBypass struct {
+	expires time.Time
+	client  string
+	host    string
+}
+
+// pinAttempts are the attempts to submit the PIN from an IP address, which
+// either have failed or are being checked.
+type pinAttempts struct {
+	windowStart time.Time
+	failed      uint32
+}
+
+// pinBypasses are the active bypasses and the failed attempts to create them.
+// The bypasses aren't persisted, so they end with a restart.
+type pinBypasses struct {
+	// mu protects all the fields.
+	mu *sync.Mutex
+
+	// active are the active bypasses by the IP addresses of the clients.
+	active map[string][]*pinBypass
+
+	// attempts are the failed attempts by the keys of the IP addresses
+	// returned by pinAttemptsKey.
+	attempts map[string]*pinAttempts
+}
+
+// newPINBypasses returns a new properly initialized *pinBypasses.
+func newPINBypasses() (b *pinBypasses) {
+	return &pinBypasses{
+		mu:       &sync.Mutex{},
+		active:   map[string][]*pinBypass{},
+		attempts: map[string]*pinAttempts{},
+	}
+}
+
+// hosts returns the bypassed hosts of the client with ip at now.  The expired
+// bypasses of the client are removed.  It's safe for concurrent use.
+func (b *pinBypasses) hosts(ip net.IP, now time.Time) (hosts []string) {
+	key := ip.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bps := b.active[key]
+	if len(bps) == 0 {
+		return nil
+	}
+
+	active := bps[:0]
+	for _, bp := range bps {
+		if now.Before(bp.expires) {
+			active = append(active, bp)
+			hosts = append(hosts, bp.host)
+		}
+	}
+
+	if len(active) == 0 {
+		delete(b.active, key)
+	} else {
+		b.active[key] = active
+	}
+
+	return hosts
+}
+
+// add adds the bypass of host for the client with ip, which expires at now
+// plus dur.  The previous bypass of host for the client, if any, is extended.
+// It's safe for concurrent use.
+func (b *pinBypasses) add(ip net.IP, host string, now time.Time, dur time.Duration) (bp *pinBypass) {
+	key := ip.String()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, bp = range b.active[key] {
+		if bp.host == host {
+			bp.expires = now.Add(dur)
+
+			return bp
+		}
+	}
+
+	bp = &pinBypass{
+		expires: now.Add(dur),
+		client:  key,
+		host:    host,
+	}
+	b.active[key] = append(b.active[key], bp)
+
+	return bp
+}
+
+// pinAttemptsIPv6PrefixLen is the length of the prefix of the IPv6 addresses
+// which share the limit of the failed attempts, since a single client usually
+// has the whole /64 network.
+const pinAttemptsIPv6PrefixLen = 64
+
+// pinAttemptsKey returns the key of ip within the failed attempts.
+func pinAttemptsKey(ip net.IP) (key string) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.String()
+	}
+
+	mask := net.CIDRMask(pinAttemptsIPv6PrefixLen, net.IPv6len*8)
+
+	return fmt.Sprintf("%s/%d", ip.Mask(mask), pinAttemptsIPv6PrefixLen)
+}
+
+// reserve records an attempt of ip at now as a failed one in advance, so that
+// the simultaneous attempts can't exceed the limit while the PIN is checked.
+// ok is false if ip has made max failed attempts within the window already.
+// The attempt must be released with release if it succeeds.  It's safe for
+// concurrent use.
+func (b *pinBypasses) reserve(ip net.IP, now time.Time, max uint32) (ok bool) {
+	key := pinAttemptsKey(ip)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	a, ok := b.attempts[key]
+	if !ok || now.Sub(a.windowStart) >= pinBypassAttemptsWindow {
+		a = &pinAttempts{
+			windowStart: now,
+		}
+		b.attempts[key] = a
+	} else if a.failed >= max {
+		return false
+	}
+
+	a.failed++
+
+	return true
+}
+
+// release rolls back the attempt of ip reserved with reserve, since it has
+// succeeded.  It's safe for concurrent use.
+func (b *pinBypasses) release(ip net.IP) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if a, ok := b.attempts[pinAttemptsKey(ip)]; ok && a.failed > 0 {
+		a.failed--
+	}
+}
+
+// pinBypassJSON is an active bypass in the HTTP API.
+type pinBypassJSON struct {
+	Client  string `json:"client"`
+	Domain  string `json:"domain"`
+	Expires string `json:"expires"`
+
+	// ExpiresIn is the number of seconds before the bypass expires.
+	ExpiresIn uint64 `json:"expires_in"`
+}
+
+// list returns the active bypasses at now ordered by their expiry.  It's safe
+// for concurrent use.
+func (b *pinBypasses) list(now time.Time) (bps []*pinBypassJSON) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bps = []*pinBypassJSON{}
+	for _, cbps := range b.active {
+		for _, bp := range cbps {
+			left := bp.expires.Sub(now)
+			if left <= 0 {
+				continue
+			}
+
+			bps = append(bps, &pinBypassJSON{
+				Client:    bp.client,
+				Domain:    bp.host,
+				Expires:   aghtime.Format(bp.expires, time.RFC3339),
+				ExpiresIn: uint64(left / time.Second),
+			})
+		}
+	}
+
+	sort.Slice(bps, func(i, j int) (less bool) {
+		if bps[i].ExpiresIn != bps[j].ExpiresIn {
+			return bps[i].ExpiresIn < bps[j].ExpiresIn
+		}
+
+		return bps[i].Client+bps[i].Domain < bps[j].Client+bps[j].Domain
+	})
+
+	return bps
+}
+
+// pinBypassReq is the request for creating a bypass.
+type pinBypassReq struct {
+	Domain string `json:"domain"`
+	PIN    string `json:"pin"`
+}
+
+// handlePINBypass is the handler for the POST /control/pin_bypass HTTP API.
+// It's served without auth, so that a client can submit the PIN by itself, and
+// the bypass only applies to the client, which has made the request.  The
+// proxy headers aren't trusted here, since they would allow a client to evade
+// the limit of the attempts.
+func (b *pinBypasses) handlePINBypass(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	conf := config.PINBypass
+	config.RUnlock()
+
+	if conf.PINHash == "" {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	host, err := aghnet.SplitHost(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	if err != nil || ip == nil {
+		httpError(w, http.StatusBadRequest, "bad remote address %q", r.RemoteAddr)
+
+		return
+	}
+
+	req := pinBypassReq{}
+	err = json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	domain, err := aghnet.NormalizeDomain(req.Domain)
+	if err == nil {
+		err = aghnet.ValidateDomainName(domain)
+	}
+
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "domain: %s", err)
+
+		return
+	}
+
+	now := time.Now()
+	if !b.reserve(ip, now, conf.MaxAttempts) {
+		w.Header().Set("Retry-After", strconv.Itoa(int(pinBypassAttemptsWindow/time.Second)))
+		http.Error(w, "too many attempts", http.StatusTooManyRequests)
+
+		return
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(conf.PINHash), []byte(req.PIN))
+	if err != nil {
+		log.Info("audit: denied pin bypass of %q to %s: wrong pin", domain, ip)
+		http.Error(w, "wrong pin", http.StatusForbidden)
+
+		return
+	}
+
+	b.release(ip)
+
+	bp := b.add(ip, domain, now, time.Duration(conf.DurationMinutes)*time.Minute)
+	log.Info("audit: pin bypass of %q for %s until %s", domain, ip, bp.expires.Format(time.RFC3339))
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(&pinBypassJSON{
+		Client:    bp.client,
+		Domain:    bp.host,
+		Expires:   aghtime.Format(bp.expires, time.RFC3339),
+		ExpiresIn: uint64(bp.expires.Sub(now) / time.Second),
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// pinBypassConfigReq is the request for configuring the bypasses.
+type pinBypassConfigReq struct {
+	// PIN is the new PIN.  Empty means that the current PIN is kept.
+	PIN string `json:"pin"`
+
+	// Enabled false removes the PIN and the active bypasses.
+	Enabled bool `json:"enabled"`
+
+	// DurationMinutes and MaxAttempts are the same as in pinBypassConfig.
+	// Zero means the default value.
+	DurationMinutes uint32 `json:"duration_minutes"`
+	MaxAttempts     uint32 `json:"max_attempts"`
+}
+
+// newPINBypassConfig returns the configuration set by req, which is applied to
+// the current one, cur.
+func newPINBypassConfig(req *pinBypassConfigReq, cur pinBypassConfig) (conf pinBypassConfig, err error) {
+	if !req.Enabled {
+		return pinBypassConfig{
+			DurationMinutes: cur.DurationMinutes,
+			MaxAttempts:     cur.MaxAttempts,
+		}, nil
+	}
+
+	conf = pinBypassConfig{
+		PINHash:         cur.PINHash,
+		DurationMinutes: req.DurationMinutes,
+		MaxAttempts:     req.MaxAttempts,
+	}
+
+	if conf.DurationMinutes == 0 {
+		conf.DurationMinutes = defaultPINBypassMinutes
+	} else if conf.DurationMinutes > maxPINBypassMinutes {
+		return conf, fmt.Errorf("duration_minutes must not be greater than %d", maxPINBypassMinutes)
+	}
+
+	if conf.MaxAttempts == 0 {
+		conf.MaxAttempts = defaultPINBypassAttempts
+	}
+
+	if req.PIN == "" {
+		if conf.PINHash == "" {
+			return conf, fmt.Errorf("pin is required")
+		}
+
+		return conf, nil
+	} else if len(req.PIN) < minPINLen {
+		return conf, fmt.Errorf("pin must be at least %d characters long", minPINLen)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.PIN), bcrypt.DefaultCost)
+	if err != nil {
+		return conf, fmt.Errorf("hashing pin: %w", err)
+	}
+
+	conf.PINHash = string(hash)
+
+	return conf, nil
+}
+
+// handlePINBypassConfig is the handler for the POST /control/pin_bypass/config
+// HTTP API.
+func (b *pinBypasses) handlePINBypassConfig(w http.ResponseWriter, r *http.Request) {
+	req := &pinBypassConfigReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	config.Lock()
+	conf, err := newPINBypassConfig(req, config.PINBypass)
+	if err == nil {
+		config.PINBypass = conf
+	}
+	config.Unlock()
+
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	if !req.Enabled {
+		b.mu.Lock()
+		b.active = map[string][]*pinBypass{}
+		b.mu.Unlock()
+	}
+
+	onConfigModified()
+}
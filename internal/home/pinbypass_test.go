@@ -0,0 +1,222 @@
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestPINBypasses(t *testing.T) {
+	b := newPINBypasses()
+	ip := net.IP{192, 168, 1, 2}
+	now := time.Now()
+
+	b.add(ip, "example.org", now, time.Minute)
+	b.add(ip, "example.net", now, time.Hour)
+	assert.Equal(t, []string{"example.org", "example.net"}, b.hosts(ip, now))
+	assert.Empty(t, b.hosts(net.IP{192, 168, 1, 3}, now))
+
+	// Adding the same host again extends the bypass.
+	b.add(ip, "example.org", now.Add(30*time.Second), time.Minute)
+	assert.Equal(t, []string{"example.org", "example.net"}, b.hosts(ip, now.Add(time.Minute)))
+
+	bps := b.list(now.Add(time.Minute))
+	require.Len(t, bps, 2)
+	assert.Equal(t, "example.org", bps[0].Domain)
+	assert.EqualValues(t, 30, bps[0].ExpiresIn)
+	assert.Equal(t, "example.net", bps[1].Domain)
+	assert.Equal(t, "192.168.1.2", bps[1].Client)
+
+	assert.Equal(t, []string{"example.net"}, b.hosts(ip, now.Add(2*time.Minute)))
+	assert.Empty(t, b.hosts(ip, now.Add(time.Hour)))
+	assert.Empty(t, b.list(now.Add(time.Hour)))
+}
+
+func TestPINBypasses_reserve(t *testing.T) {
+	b := newPINBypasses()
+	ip := net.IP{192, 168, 1, 2}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		require.True(t, b.reserve(ip, now, 3))
+	}
+
+	assert.False(t, b.reserve(ip, now, 3))
+	assert.True(t, b.reserve(net.IP{192, 168, 1, 3}, now, 3))
+	assert.True(t, b.reserve(ip, now.Add(pinBypassAttemptsWindow), 3))
+
+	t.Run("release", func(t *testing.T) {
+		rb := newPINBypasses()
+		require.True(t, rb.reserve(ip, now, 1))
+		require.False(t, rb.reserve(ip, now, 1))
+
+		// The successful attempts don't count.
+		rb.release(ip)
+		assert.True(t, rb.reserve(ip, now, 1))
+	})
+
+	t.Run("ipv6", func(t *testing.T) {
+		vb := newPINBypasses()
+		require.True(t, vb.reserve(net.ParseIP("2001:db8::1"), now, 1))
+
+		// The addresses from the same /64 network share the limit.
+		assert.False(t, vb.reserve(net.ParseIP("2001:db8::ffff:2"), now, 1))
+		assert.True(t, vb.reserve(net.ParseIP("2001:db8:0:1::1"), now, 1))
+	})
+}
+
+func TestPINBypasses_handlePINBypass(t *testing.T) {
+	prevConf := config.PINBypass
+	t.Cleanup(func() { config.PINBypass = prevConf })
+
+	b := newPINBypasses()
+	post := func(body string) (w *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodPost, "/control/pin_bypass", strings.NewReader(body))
+		r.RemoteAddr = "192.168.1.2:1234"
+		r.Header.Set("X-Real-IP", "192.168.1.3")
+		w = httptest.NewRecorder()
+		b.handlePINBypass(w, r)
+
+		return w
+	}
+
+	config.PINBypass = pinBypassConfig{}
+	assert.Equal(t, http.StatusNotFound, post(`{"domain":"example.org","pin":"1234"}`).Code)
+
+	conf, err := newPINBypassConfig(&pinBypassConfigReq{
+		PIN:         "1234",
+		Enabled:     true,
+		MaxAttempts: 2,
+	}, config.PINBypass)
+	require.NoError(t, err)
+	require.EqualValues(t, defaultPINBypassMinutes, conf.DurationMinutes)
+	config.PINBypass = conf
+
+	assert.Equal(t, http.StatusBadRequest, post(`{"domain":"bad..domain","pin":"1234"}`).Code)
+	assert.Equal(t, http.StatusForbidden, post(`{"domain":"example.org","pin":"0000"}`).Code)
+
+	w := post(`{"domain":"Example.ORG.","pin":"1234"}`)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	bp := &pinBypassJSON{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(bp))
+	assert.Equal(t, "192.168.1.2", bp.Client)
+	assert.Equal(t, "example.org", bp.Domain)
+	assert.EqualValues(t, defaultPINBypassMinutes*60, bp.ExpiresIn)
+
+	// The bypass only applies to the client, which has made the request.
+	assert.Equal(t, []string{"example.org"}, b.hosts(net.IP{192, 168, 1, 2}, time.Now()))
+	assert.Empty(t, b.hosts(net.IP{192, 168, 1, 3}, time.Now()))
+
+	// The second failure reaches the limit.
+	assert.Equal(t, http.StatusForbidden, post(`{"domain":"example.org","pin":"0000"}`).Code)
+	assert.Equal(t, http.StatusTooManyRequests, post(`{"domain":"example.org","pin":"1234"}`).Code)
+}
+
+func TestPINBypasses_handlePINBypass_concurrent(t *testing.T) {
+	prevConf := config.PINBypass
+	t.Cleanup(func() { config.PINBypass = prevConf })
+
+	const (
+		maxAttempts = 3
+		requests    = 20
+	)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("1234"), bcrypt.MinCost)
+	require.NoError(t, err)
+
+	config.PINBypass = pinBypassConfig{
+		PINHash:         string(hash),
+		DurationMinutes: defaultPINBypassMinutes,
+		MaxAttempts:     maxAttempts,
+	}
+
+	b := newPINBypasses()
+	codes := make(chan int, requests)
+	start := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	wg.Add(requests)
+	for i := 0; i < requests; i++ {
+		go func() {
+			defer wg.Done()
+
+			r := httptest.NewRequest(
+				http.MethodPost,
+				"/control/pin_bypass",
+				strings.NewReader(`{"domain":"example.org","pin":"0000"}`),
+			)
+			r.RemoteAddr = "192.168.1.2:1234"
+			w := httptest.NewRecorder()
+
+			<-start
+			b.handlePINBypass(w, r)
+			codes <- w.Code
+		}()
+	}
+
+	close(start)
+	wg.Wait()
+	close(codes)
+
+	got := map[int]int{}
+	for c := range codes {
+		got[c]++
+	}
+
+	// No more wrong PINs than allowed are checked, however many requests
+	// come at once.
+	assert.Equal(t, map[int]int{
+		http.StatusForbidden:       maxAttempts,
+		http.StatusTooManyRequests: requests - maxAttempts,
+	}, got)
+}
+
+func TestNewPINBypassConfig(t *testing.T) {
+	cur := pinBypassConfig{
+		DurationMinutes: 10,
+		MaxAttempts:     3,
+	}
+
+	_, err := newPINBypassConfig(&pinBypassConfigReq{Enabled: true}, cur)
+	assert.EqualError(t, err, "pin is required")
+
+	_, err = newPINBypassConfig(&pinBypassConfigReq{Enabled: true, PIN: "12"}, cur)
+	assert.EqualError(t, err, "pin must be at least 4 characters long")
+
+	_, err = newPINBypassConfig(&pinBypassConfigReq{
+		Enabled:         true,
+		PIN:             "1234",
+		DurationMinutes: maxPINBypassMinutes + 1,
+	}, cur)
+	assert.EqualError(t, err, "duration_minutes must not be greater than 1440")
+
+	conf, err := newPINBypassConfig(&pinBypassConfigReq{
+		Enabled:         true,
+		PIN:             "1234",
+		DurationMinutes: 60,
+	}, cur)
+	require.NoError(t, err)
+	assert.NotEmpty(t, conf.PINHash)
+	assert.NotContains(t, conf.PINHash, "1234")
+	assert.EqualValues(t, 60, conf.DurationMinutes)
+	assert.EqualValues(t, defaultPINBypassAttempts, conf.MaxAttempts)
+
+	// The PIN is kept if it isn't changed.
+	kept, err := newPINBypassConfig(&pinBypassConfigReq{Enabled: true}, conf)
+	require.NoError(t, err)
+	assert.Equal(t, conf.PINHash, kept.PINHash)
+
+	disabled, err := newPINBypassConfig(&pinBypassConfigReq{}, conf)
+	require.NoError(t, err)
+	assert.Empty(t, disabled.PINHash)
+	assert.EqualValues(t, 60, disabled.DurationMinutes)
+}
@@ -0,0 +1,463 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Profile is a named set of the filtering settings assigned to the clients
+// by reference, so that changing the profile changes the settings of all of
+// its clients.
+type Profile struct {
+	Name string `yaml:"name" json:"name"`
+
+	// BlockedServices are blocked for the clients of the profile within the
+	// Schedule.
+	BlockedServices []string `yaml:"blocked_services" json:"blocked_services"`
+
+	// Schedule are the weekly time ranges, within which BlockedServices are
+	// blocked.  If empty, they are always blocked.
+	Schedule []*scheduleRange `yaml:"schedule" json:"schedule"`
+
+	SafeSearchEnabled bool `yaml:"safesearch_enabled" json:"safesearch_enabled"`
+	ParentalEnabled   bool `yaml:"parental_enabled" json:"parental_enabled"`
+
+	// FilterGroups are the groups of the blocklists applied to the requests
+	// of the clients of the profile.  If empty, the global ones are.
+	FilterGroups []string `yaml:"filter_groups,omitempty" json:"filter_groups"`
+}
+
+// clone returns a deep copy of p.  The schedule ranges aren't copied, since
+// they're never changed after the validation.
+func (p *Profile) clone() (c *Profile) {
+	c = &Profile{}
+	*c = *p
+	c.BlockedServices = aghstrings.CloneSlice(p.BlockedServices)
+	c.FilterGroups = aghstrings.CloneSlice(p.FilterGroups)
+	c.Schedule = append([]*scheduleRange(nil), p.Schedule...)
+
+	return c
+}
+
+// validate returns an error if p is invalid.  It also prepares the schedule.
+func (p *Profile) validate() (err error) {
+	if p.Name == "" {
+		return agherr.Error("profile name is required")
+	}
+
+	for _, s := range p.BlockedServices {
+		if !dnsfilter.BlockedSvcKnown(s) {
+			return fmt.Errorf("unknown blocked service %q", s)
+		}
+	}
+
+	for i, r := range p.Schedule {
+		err = r.validate()
+		if err != nil {
+			return fmt.Errorf("schedule range at index %d: %w", i, err)
+		}
+	}
+
+	return nil
+}
+
+// scheduled returns true if the blocked services of p are blocked at t.
+func (p *Profile) scheduled(t time.Time) (ok bool) {
+	if len(p.Schedule) == 0 {
+		return true
+	}
+
+	t = t.In(aghtime.Location())
+	for _, r := range p.Schedule {
+		if r.contains(t) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// scheduleRange is a range of time during some days of the week in the
+// instance timezone.
+type scheduleRange struct {
+	// Days are the three-letter names of the days of the week, for example
+	// "mon".  If empty, the range is applied every day.
+	Days []string `yaml:"days" json:"days"`
+
+	// Start and End are the start and the end of the range in the "15:04"
+	// format.  End may be "24:00" and must be after Start.
+	Start string `yaml:"start" json:"start"`
+	End   string `yaml:"end" json:"end"`
+
+	// days is the set of the days of the week, the index of which is a
+	// time.Weekday.
+	days [7]bool
+
+	// startMin and endMin are Start and End in minutes since midnight.
+	startMin int
+	endMin   int
+}
+
+// weekdays are the names of the days of the week in the order of
+// time.Weekday.
+var weekdays = [7]string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// parseDayTime parses s in the "15:04" format and returns the number of
+// minutes since midnight.
+func parseDayTime(s string) (min int, err error) {
+	if s == "24:00" {
+		return 24 * 60, nil
+	}
+
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("bad time %q: want hh:mm", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// validate returns an error if r is invalid.  It also fills the unexported
+// fields.
+func (r *scheduleRange) validate() (err error) {
+	r.days = [7]bool{}
+	for _, d := range r.Days {
+		found := false
+		for i, wd := range weekdays {
+			if strings.EqualFold(d, wd) {
+				r.days[i], found = true, true
+
+				break
+			}
+		}
+
+		if !found {
+			return fmt.Errorf("unknown day %q", d)
+		}
+	}
+
+	if len(r.Days) == 0 {
+		r.days = [7]bool{true, true, true, true, true, true, true}
+	}
+
+	r.startMin, err = parseDayTime(r.Start)
+	if err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+
+	r.endMin, err = parseDayTime(r.End)
+	if err != nil {
+		return fmt.Errorf("end: %w", err)
+	}
+
+	if r.endMin <= r.startMin {
+		return fmt.Errorf("end %s is not after start %s", r.End, r.Start)
+	}
+
+	return nil
+}
+
+// contains returns true if t, which must be in the instance timezone, is
+// within r.
+func (r *scheduleRange) contains(t time.Time) (ok bool) {
+	if !r.days[t.Weekday()] {
+		return false
+	}
+
+	min := t.Hour()*60 + t.Minute()
+
+	return min >= r.startMin && min < r.endMin
+}
+
+// applyClientSettings sets the filtering settings of the client c with the
+// profile p, which may be nil, in setts, which initially contains the global
+// settings.  Each setting is resolved in this order:
+//
+//  1. The client's own setting, if the client doesn't use the global ones.
+//
+//  2. The profile's setting, if the profile has one.  The profiles have
+//     the safe search, the parental control, the groups of the
+//     blocklists, if not empty, and the blocked services, the latter only
+//     within the profile's schedule.
+//
+//  3. The global setting.
+//
+// It returns the blocked services of the client.  global is true if those are
+// the global ones, which setts already contains.  The sources of the settings
+// are recorded in setts.Applied.
+func applyClientSettings(
+	setts *dnsfilter.FilteringSettings,
+	c *Client,
+	p *Profile,
+	now time.Time,
+) (services []string, global bool) {
+	srcs := &setts.Applied.Sources
+	if p != nil {
+		setts.Applied.Profile = p.Name
+		setts.Applied.ProfileScheduled = p.scheduled(now)
+	}
+
+	switch {
+	case c.UseOwnBlockedServices:
+		services = c.BlockedServices
+		srcs.BlockedServices = dnsfilter.SettingsSourceClient
+	case p != nil && setts.Applied.ProfileScheduled:
+		services = p.BlockedServices
+		srcs.BlockedServices = dnsfilter.SettingsSourceProfile
+	default:
+		global = true
+	}
+
+	switch {
+	case c.UseOwnFilterGroups:
+		setts.FilterGroups = aghstrings.CloneSliceOrEmpty(c.FilterGroups)
+		srcs.FilterGroups = dnsfilter.SettingsSourceClient
+	case p != nil && len(p.FilterGroups) > 0:
+		setts.FilterGroups = p.FilterGroups
+		srcs.FilterGroups = dnsfilter.SettingsSourceProfile
+	default:
+		// Use the global groups.
+	}
+
+	if c.UseOwnSettings {
+		setts.FilteringEnabled = c.FilteringEnabled
+		setts.SafeSearchEnabled = c.SafeSearchEnabled
+		setts.SafeBrowsingEnabled = c.SafeBrowsingEnabled
+		setts.ParentalEnabled = c.ParentalEnabled
+
+		srcs.Filtering = dnsfilter.SettingsSourceClient
+		srcs.SafeSearch = dnsfilter.SettingsSourceClient
+		srcs.SafeBrowsing = dnsfilter.SettingsSourceClient
+		srcs.Parental = dnsfilter.SettingsSourceClient
+	} else if p != nil {
+		setts.SafeSearchEnabled = p.SafeSearchEnabled
+		setts.ParentalEnabled = p.ParentalEnabled
+
+		srcs.SafeSearch = dnsfilter.SettingsSourceProfile
+		srcs.Parental = dnsfilter.SettingsSourceProfile
+	}
+
+	return services, global
+}
+
+// initProfiles adds the valid profiles from the configuration file.
+func (clients *clientsContainer) initProfiles(profiles []*Profile) {
+	clients.profiles = make(map[string]*Profile, len(profiles))
+	for _, p := range profiles {
+		err := clients.AddProfile(p)
+		if err != nil {
+			log.Error("clients: skipping profile %q: %s", p.Name, err)
+		}
+	}
+}
+
+// FindProfile returns a copy of the profile with name.
+func (clients *clientsContainer) FindProfile(name string) (p *Profile, ok bool) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	p, ok = clients.profiles[name]
+	if !ok {
+		return nil, false
+	}
+
+	return p.clone(), true
+}
+
+// AddProfile adds a new profile.
+func (clients *clientsContainer) AddProfile(p *Profile) (err error) {
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	if _, ok := clients.profiles[p.Name]; ok {
+		return fmt.Errorf("profile %q already exists", p.Name)
+	}
+
+	clients.profiles[p.Name] = p
+
+	return nil
+}
+
+// UpdateProfile replaces the profile with name by p.  If the profile is
+// renamed, so are the references to it.
+func (clients *clientsContainer) UpdateProfile(name string, p *Profile) (err error) {
+	err = p.validate()
+	if err != nil {
+		return err
+	}
+
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	if _, ok := clients.profiles[name]; !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+
+	if p.Name != name {
+		if _, ok := clients.profiles[p.Name]; ok {
+			return fmt.Errorf("profile %q already exists", p.Name)
+		}
+
+		for _, c := range clients.list {
+			if c.Profile == name {
+				c.Profile = p.Name
+			}
+		}
+
+		delete(clients.profiles, name)
+	}
+
+	clients.profiles[p.Name] = p
+
+	return nil
+}
+
+// DelProfile removes the profile with name, unless it's assigned to a client.
+func (clients *clientsContainer) DelProfile(name string) (err error) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	if _, ok := clients.profiles[name]; !ok {
+		return fmt.Errorf("profile %q not found", name)
+	}
+
+	for _, c := range clients.list {
+		if c.Profile == name {
+			return fmt.Errorf("profile %q is assigned to client %q", name, c.Name)
+		}
+	}
+
+	delete(clients.profiles, name)
+
+	return nil
+}
+
+// writeProfiles appends the profiles sorted by name to profiles.
+func (clients *clientsContainer) writeProfiles(profiles *[]*Profile) {
+	clients.lock.Lock()
+	defer clients.lock.Unlock()
+
+	for _, p := range clients.profiles {
+		*profiles = append(*profiles, p.clone())
+	}
+
+	sort.Slice(*profiles, func(i, j int) bool {
+		return (*profiles)[i].Name < (*profiles)[j].Name
+	})
+}
+
+// profileListJSON is the response to the GET /control/profiles request.
+type profileListJSON struct {
+	Profiles []*Profile `json:"profiles"`
+}
+
+// handleGetProfiles is the handler for the GET /control/profiles HTTP API.
+func (clients *clientsContainer) handleGetProfiles(w http.ResponseWriter, _ *http.Request) {
+	data := profileListJSON{
+		Profiles: []*Profile{},
+	}
+	clients.writeProfiles(&data.Profiles)
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "encoding response: %s", err)
+	}
+}
+
+// handleAddProfile is the handler for the POST /control/profiles/add HTTP API.
+func (clients *clientsContainer) handleAddProfile(w http.ResponseWriter, r *http.Request) {
+	p := &Profile{}
+	err := json.NewDecoder(r.Body).Decode(p)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = clients.AddProfile(p)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+	Context.filters.refreshFilterGroups()
+}
+
+// profileNameJSON is the request to delete a profile.
+type profileNameJSON struct {
+	Name string `json:"name"`
+}
+
+// handleDelProfile is the handler for the POST /control/profiles/delete HTTP
+// API.
+func (clients *clientsContainer) handleDelProfile(w http.ResponseWriter, r *http.Request) {
+	req := profileNameJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	err = clients.DelProfile(req.Name)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+	Context.filters.refreshFilterGroups()
+}
+
+// profileUpdateJSON is the request to update a profile.
+type profileUpdateJSON struct {
+	Data *Profile `json:"data"`
+	Name string   `json:"name"`
+}
+
+// handleUpdateProfile is the handler for the POST /control/profiles/update
+// HTTP API.
+func (clients *clientsContainer) handleUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	req := profileUpdateJSON{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "failed to process request body: %s", err)
+
+		return
+	}
+
+	if req.Data == nil {
+		httpError(w, http.StatusBadRequest, "data is required")
+
+		return
+	}
+
+	err = clients.UpdateProfile(req.Name, req.Data)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	onConfigModified()
+	Context.filters.refreshFilterGroups()
+}
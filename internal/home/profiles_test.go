@@ -0,0 +1,319 @@
+package home
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScheduleRange_validate(t *testing.T) {
+	testCases := []struct {
+		name    string
+		r       scheduleRange
+		wantErr string
+	}{{
+		name:    "valid",
+		r:       scheduleRange{Days: []string{"Mon", "fri"}, Start: "08:00", End: "24:00"},
+		wantErr: "",
+	}, {
+		name:    "bad_day",
+		r:       scheduleRange{Days: []string{"monday"}, Start: "08:00", End: "09:00"},
+		wantErr: `unknown day "monday"`,
+	}, {
+		name:    "bad_time",
+		r:       scheduleRange{Start: "8am", End: "09:00"},
+		wantErr: `start: bad time "8am": want hh:mm`,
+	}, {
+		name:    "empty",
+		r:       scheduleRange{Start: "09:00", End: "09:00"},
+		wantErr: "end 09:00 is not after start 09:00",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.r.validate()
+			if tc.wantErr == "" {
+				assert.NoError(t, err)
+			} else {
+				assert.EqualError(t, err, tc.wantErr)
+			}
+		})
+	}
+}
+
+func TestProfile_scheduled(t *testing.T) {
+	loc := time.FixedZone("", 2*60*60)
+	prev := aghtime.Location()
+	aghtime.SetLocation(loc)
+	t.Cleanup(func() { aghtime.SetLocation(prev) })
+
+	p := &Profile{
+		Name: "child",
+		Schedule: []*scheduleRange{{
+			Days:  []string{"mon"},
+			Start: "20:00",
+			End:   "24:00",
+		}},
+	}
+	require.NoError(t, p.validate())
+
+	// 2021-05-03 is a Monday.
+	assert.True(t, p.scheduled(time.Date(2021, 5, 3, 21, 0, 0, 0, loc)))
+	assert.True(t, p.scheduled(time.Date(2021, 5, 3, 18, 0, 0, 0, time.UTC)))
+	assert.False(t, p.scheduled(time.Date(2021, 5, 3, 19, 59, 0, 0, loc)))
+	assert.False(t, p.scheduled(time.Date(2021, 5, 4, 21, 0, 0, 0, loc)))
+
+	assert.True(t, (&Profile{}).scheduled(time.Now()))
+}
+
+func TestApplyClientSettings(t *testing.T) {
+	dnsfilter.InitModule()
+
+	global := dnsfilter.FilteringSettings{
+		FilteringEnabled:    true,
+		SafeSearchEnabled:   false,
+		SafeBrowsingEnabled: true,
+		ParentalEnabled:     false,
+	}
+
+	strict := &Profile{
+		Name:              "strict",
+		BlockedServices:   []string{"youtube"},
+		SafeSearchEnabled: true,
+		ParentalEnabled:   true,
+	}
+	require.NoError(t, strict.validate())
+
+	never := &Profile{
+		Name:            "never",
+		BlockedServices: []string{"youtube"},
+		Schedule: []*scheduleRange{{
+			Days:  []string{},
+			Start: "00:00",
+			End:   "00:01",
+		}},
+	}
+	require.NoError(t, never.validate())
+
+	kids := &Profile{
+		Name:            "kids",
+		BlockedServices: []string{},
+		FilterGroups:    []string{"kids"},
+	}
+	require.NoError(t, kids.validate())
+
+	noon := time.Date(2021, 5, 3, 12, 0, 0, 0, aghtime.Location())
+
+	testCases := []struct {
+		name         string
+		c            *Client
+		p            *Profile
+		wantSetts    dnsfilter.FilteringSettings
+		wantServices []string
+		wantGlobal   bool
+	}{{
+		name:         "global",
+		c:            &Client{},
+		p:            nil,
+		wantSetts:    global,
+		wantServices: nil,
+		wantGlobal:   true,
+	}, {
+		name: "profile",
+		c:    &Client{},
+		p:    strict,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled:    true,
+			SafeSearchEnabled:   true,
+			SafeBrowsingEnabled: true,
+			ParentalEnabled:     true,
+			Applied: dnsfilter.AppliedSettings{
+				Profile:          "strict",
+				ProfileScheduled: true,
+				Sources: dnsfilter.SettingsSources{
+					SafeSearch:      dnsfilter.SettingsSourceProfile,
+					Parental:        dnsfilter.SettingsSourceProfile,
+					BlockedServices: dnsfilter.SettingsSourceProfile,
+				},
+			},
+		},
+		wantServices: []string{"youtube"},
+		wantGlobal:   false,
+	}, {
+		name: "profile_unscheduled",
+		c:    &Client{},
+		p:    never,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled:    true,
+			SafeSearchEnabled:   false,
+			SafeBrowsingEnabled: true,
+			ParentalEnabled:     false,
+			Applied: dnsfilter.AppliedSettings{
+				Profile: "never",
+				Sources: dnsfilter.SettingsSources{
+					SafeSearch: dnsfilter.SettingsSourceProfile,
+					Parental:   dnsfilter.SettingsSourceProfile,
+				},
+			},
+		},
+		wantServices: nil,
+		wantGlobal:   true,
+	}, {
+		name: "client_explicit",
+		c: &Client{
+			UseOwnSettings:        true,
+			FilteringEnabled:      true,
+			UseOwnBlockedServices: true,
+			BlockedServices:       []string{"twitch"},
+		},
+		p: strict,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled: true,
+			Applied: dnsfilter.AppliedSettings{
+				Profile:          "strict",
+				ProfileScheduled: true,
+				Sources: dnsfilter.SettingsSources{
+					Filtering:       dnsfilter.SettingsSourceClient,
+					SafeSearch:      dnsfilter.SettingsSourceClient,
+					SafeBrowsing:    dnsfilter.SettingsSourceClient,
+					Parental:        dnsfilter.SettingsSourceClient,
+					BlockedServices: dnsfilter.SettingsSourceClient,
+				},
+			},
+		},
+		wantServices: []string{"twitch"},
+		wantGlobal:   false,
+	}, {
+		name: "client_own_services",
+		c: &Client{
+			UseOwnBlockedServices: true,
+			BlockedServices:       []string{},
+		},
+		p: strict,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled:    true,
+			SafeSearchEnabled:   true,
+			SafeBrowsingEnabled: true,
+			ParentalEnabled:     true,
+			Applied: dnsfilter.AppliedSettings{
+				Profile:          "strict",
+				ProfileScheduled: true,
+				Sources: dnsfilter.SettingsSources{
+					SafeSearch:      dnsfilter.SettingsSourceProfile,
+					Parental:        dnsfilter.SettingsSourceProfile,
+					BlockedServices: dnsfilter.SettingsSourceClient,
+				},
+			},
+		},
+		wantServices: []string{},
+		wantGlobal:   false,
+	}, {
+		name: "profile_groups",
+		c:    &Client{},
+		p:    kids,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled:    true,
+			SafeBrowsingEnabled: true,
+			FilterGroups:        []string{"kids"},
+			Applied: dnsfilter.AppliedSettings{
+				Profile:          "kids",
+				ProfileScheduled: true,
+				Sources: dnsfilter.SettingsSources{
+					SafeSearch:      dnsfilter.SettingsSourceProfile,
+					Parental:        dnsfilter.SettingsSourceProfile,
+					BlockedServices: dnsfilter.SettingsSourceProfile,
+					FilterGroups:    dnsfilter.SettingsSourceProfile,
+				},
+			},
+		},
+		wantServices: []string{},
+		wantGlobal:   false,
+	}, {
+		name: "client_own_groups",
+		c: &Client{
+			UseOwnFilterGroups: true,
+		},
+		p: kids,
+		wantSetts: dnsfilter.FilteringSettings{
+			FilteringEnabled:    true,
+			SafeBrowsingEnabled: true,
+			FilterGroups:        []string{},
+			Applied: dnsfilter.AppliedSettings{
+				Profile:          "kids",
+				ProfileScheduled: true,
+				Sources: dnsfilter.SettingsSources{
+					SafeSearch:      dnsfilter.SettingsSourceProfile,
+					Parental:        dnsfilter.SettingsSourceProfile,
+					BlockedServices: dnsfilter.SettingsSourceProfile,
+					FilterGroups:    dnsfilter.SettingsSourceClient,
+				},
+			},
+		},
+		wantServices: []string{},
+		wantGlobal:   false,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			setts := global
+			services, isGlobal := applyClientSettings(&setts, tc.c, tc.p, noon)
+
+			assert.Equal(t, tc.wantSetts, setts)
+			assert.Equal(t, tc.wantServices, services)
+			assert.Equal(t, tc.wantGlobal, isGlobal)
+		})
+	}
+}
+
+func TestClientsContainer_profiles(t *testing.T) {
+	clients := clientsContainer{
+		testing: true,
+	}
+	clients.Init(nil, []*Profile{{Name: "teen"}, {Name: ""}}, nil, nil)
+
+	_, ok := clients.FindProfile("teen")
+	require.True(t, ok)
+
+	_, err := clients.Add(&Client{
+		IDs:     []string{"1.2.3.4"},
+		Name:    "kid",
+		Profile: "child",
+	})
+	require.EqualError(t, err, `unknown profile "child"`)
+
+	ok, err = clients.Add(&Client{
+		IDs:     []string{"1.2.3.4"},
+		Name:    "kid",
+		Profile: "teen",
+	})
+	require.NoError(t, err)
+	require.True(t, ok)
+
+	err = clients.AddProfile(&Profile{Name: "teen"})
+	assert.EqualError(t, err, `profile "teen" already exists`)
+
+	err = clients.UpdateProfile("teen", &Profile{Name: "child", SafeSearchEnabled: true})
+	require.NoError(t, err)
+
+	c, ok := clients.Find("1.2.3.4")
+	require.True(t, ok)
+	assert.Equal(t, "child", c.Profile)
+
+	p, ok := clients.FindProfile("child")
+	require.True(t, ok)
+	assert.True(t, p.SafeSearchEnabled)
+
+	err = clients.DelProfile("child")
+	assert.EqualError(t, err, `profile "child" is assigned to client "kid"`)
+
+	require.True(t, clients.Del("kid"))
+	require.NoError(t, clients.DelProfile("child"))
+
+	var profiles []*Profile
+	clients.writeProfiles(&profiles)
+	assert.Empty(t, profiles)
+}
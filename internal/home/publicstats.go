@@ -0,0 +1,136 @@
+package home
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// publicStatsConfig defines the unauthenticated endpoint serving the reduced
+// statistics, which contain neither the client identifiers nor the query log.
+type publicStatsConfig struct {
+	// Enabled makes the endpoint serve the statistics.  It responds with
+	// 404 Not Found otherwise.
+	Enabled bool `yaml:"enabled"`
+
+	// RequestsPerMinute is the number of the requests a single IP address
+	// may make per minute.  Zero means no limit.
+	RequestsPerMinute uint `yaml:"requests_per_minute"`
+}
+
+// publicStatsCacheTTL is the time the public statistics are served from the
+// cache.
+const publicStatsCacheTTL = 1 * time.Minute
+
+// publicStatsWindow is the duration of the window of the rate limit of the
+// public statistics.
+const publicStatsWindow = 1 * time.Minute
+
+// publicStatsHandler serves the public statistics from the cache and limits
+// the rate of the requests.
+type publicStatsHandler struct {
+	// mu protects all the fields.
+	mu sync.Mutex
+
+	// data is the cached response.
+	data []byte
+
+	// cachedAt is the time data has been cached.
+	cachedAt time.Time
+
+	// counts are the numbers of the requests within the current window by
+	// the IP address.
+	counts map[string]uint
+
+	// windowStart is the start of the current window of the rate limit.
+	windowStart time.Time
+}
+
+// allow returns true if the request from ip at now is within limit.
+func (h *publicStatsHandler) allow(ip string, now time.Time, limit uint) (ok bool) {
+	if limit == 0 {
+		return true
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.counts == nil || now.Sub(h.windowStart) >= publicStatsWindow {
+		h.counts = map[string]uint{}
+		h.windowStart = now
+	}
+
+	h.counts[ip]++
+
+	return h.counts[ip] <= limit
+}
+
+// cached returns the cached response or refreshes it, if it's expired.
+func (h *publicStatsHandler) cached(now time.Time) (data []byte, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.data != nil && now.Sub(h.cachedAt) < publicStatsCacheTTL {
+		return h.data, true
+	}
+
+	ps, ok := Context.stats.PublicStats()
+	if !ok {
+		return nil, false
+	}
+
+	data, err := json.Marshal(ps)
+	if err != nil {
+		log.Error("public stats: encoding: %s", err)
+
+		return nil, false
+	}
+
+	h.data, h.cachedAt = data, now
+
+	return data, true
+}
+
+// ServeHTTP implements the http.Handler interface for *publicStatsHandler.
+func (h *publicStatsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	config.RLock()
+	conf := config.PublicStats
+	config.RUnlock()
+
+	if !conf.Enabled || Context.stats == nil {
+		http.NotFound(w, r)
+
+		return
+	}
+
+	now := time.Now()
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !h.allow(ip, now, conf.RequestsPerMinute) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+
+		return
+	}
+
+	data, ok := h.cached(now)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, "couldn't get statistics data")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=60")
+	_, err = w.Write(data)
+	if err != nil {
+		log.Debug("public stats: writing response: %s", err)
+	}
+}
@@ -0,0 +1,64 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicStatsHandler(t *testing.T) {
+	s, err := stats.New(stats.Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	s.Update(stats.Entry{
+		Domain: "blocked.example",
+		Client: "192.168.1.2",
+		Result: stats.RFiltered,
+	})
+
+	prevStats, prevConf := Context.stats, config.PublicStats
+	t.Cleanup(func() {
+		Context.stats = prevStats
+		config.PublicStats = prevConf
+	})
+	Context.stats = s
+
+	h := &publicStatsHandler{}
+	get := func(remoteAddr string) (w *httptest.ResponseRecorder) {
+		r := httptest.NewRequest(http.MethodGet, "/control/stats_public", nil)
+		r.RemoteAddr = remoteAddr
+		w = httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+
+		return w
+	}
+
+	config.PublicStats = publicStatsConfig{Enabled: false}
+	assert.Equal(t, http.StatusNotFound, get("192.168.1.2:1234").Code)
+
+	config.PublicStats = publicStatsConfig{Enabled: true, RequestsPerMinute: 2}
+
+	w := get("192.168.1.2:1234")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := map[string]json.RawMessage{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	assert.NotContains(t, resp, "top_clients")
+	assert.JSONEq(t, `[{"blocked.example":1}]`, string(resp["top_blocked_domains"]))
+	assert.JSONEq(t, `1`, string(resp["num_blocked_filtering"]))
+
+	assert.Equal(t, http.StatusOK, get("192.168.1.2:1234").Code)
+	assert.Equal(t, http.StatusTooManyRequests, get("192.168.1.2:1234").Code)
+	assert.Equal(t, http.StatusOK, get("192.168.1.3:1234").Code)
+}
@@ -0,0 +1,153 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Memory-only states reported to the webhook.
+const (
+	memOnlyStateEntered = "memory_only"
+	memOnlyStateResumed = "resumed"
+)
+
+// writeGuards are the guards of the subsystems persisting their data in the
+// working directory.  Once the file system becomes read-only, those keep the
+// data in memory until it's writable again.
+type writeGuards struct {
+	config   *aghos.WriteGuard
+	queryLog *aghos.WriteGuard
+	stats    *aghos.WriteGuard
+	leases   *aghos.WriteGuard
+
+	// mu protects active.
+	mu sync.Mutex
+
+	// active is true if any of the subsystems is in the memory-only mode.
+	active bool
+}
+
+// newWriteGuards returns the guards of all the subsystems.
+func newWriteGuards() (g *writeGuards) {
+	g = &writeGuards{}
+	g.config = aghos.NewWriteGuard("config", g.onChange)
+	g.queryLog = aghos.NewWriteGuard("querylog", g.onChange)
+	g.stats = aghos.NewWriteGuard("stats", g.onChange)
+	g.leases = aghos.NewWriteGuard("dhcp_leases", g.onChange)
+
+	return g
+}
+
+// memoryOnly returns the names of the subsystems in the memory-only mode and
+// the earliest time any of those has entered it.
+func (g *writeGuards) memoryOnly() (names []string, since time.Time) {
+	if g == nil {
+		return nil, time.Time{}
+	}
+
+	for _, wg := range []*aghos.WriteGuard{g.config, g.queryLog, g.stats, g.leases} {
+		memOnly, s := wg.State()
+		if !memOnly {
+			continue
+		}
+
+		names = append(names, wg.Name())
+		if since.IsZero() || s.Before(since) {
+			since = s
+		}
+	}
+
+	return names, since
+}
+
+// warning returns the single status warning about the subsystems in the
+// memory-only mode, if there are any.
+func (g *writeGuards) warning() (warn string, ok bool) {
+	names, since := g.memoryOnly()
+	if len(names) == 0 {
+		return "", false
+	}
+
+	return fmt.Sprintf(
+		"the file system is read-only since %s: %s data is kept in memory only and is lost on restart",
+		since.Format(time.RFC3339),
+		strings.Join(names, ", "),
+	), true
+}
+
+// memOnlyNotification is the body of the webhook request about the subsystems
+// entering or leaving the memory-only mode.
+type memOnlyNotification struct {
+	Time       time.Time `json:"time"`
+	State      string    `json:"state"`
+	Subsystems []string  `json:"subsystems"`
+}
+
+// onChange is the callback of the guards.  It sends a single webhook request
+// once the first subsystem enters the memory-only mode and once the last one
+// leaves it.
+func (g *writeGuards) onChange(_ string, _ bool) {
+	names, _ := g.memoryOnly()
+	active := len(names) > 0
+
+	g.mu.Lock()
+	changed := active != g.active
+	g.active = active
+	g.mu.Unlock()
+
+	if !changed {
+		return
+	}
+
+	config.RLock()
+	u := config.ReadOnlyWebhookURL
+	config.RUnlock()
+
+	if u == "" {
+		return
+	}
+
+	n := &memOnlyNotification{
+		Time:       time.Now(),
+		State:      memOnlyStateResumed,
+		Subsystems: names,
+	}
+	if active {
+		n.State = memOnlyStateEntered
+	} else {
+		n.Subsystems = []string{}
+	}
+
+	b, err := json.Marshal(n)
+	if err != nil {
+		log.Error("read-only: encoding notification: %s", err)
+
+		return
+	}
+
+	go sendMemOnlyNotification(u, b)
+}
+
+// sendMemOnlyNotification POSTs the notification body b to u.
+func sendMemOnlyNotification(u string, b []byte) {
+	c := newOutboundClient(aghnet.OutboundWebhooks)
+	resp, err := c.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Error("read-only: sending notification: %s", err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Error("read-only: sending notification: got status code %d", resp.StatusCode)
+	}
+}
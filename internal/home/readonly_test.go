@@ -0,0 +1,40 @@
+package home
+
+import (
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriteGuards(t *testing.T) {
+	g := newWriteGuards()
+
+	_, ok := g.warning()
+	assert.False(t, ok)
+
+	now := time.Now()
+	g.stats.Report(syscall.EROFS, now)
+	g.queryLog.Report(syscall.EROFS, now.Add(time.Second))
+	assert.True(t, g.active)
+
+	names, since := g.memoryOnly()
+	assert.Equal(t, []string{"querylog", "stats"}, names)
+	assert.True(t, since.Equal(now))
+
+	// A single warning covers all the subsystems.
+	warn, ok := g.warning()
+	require.True(t, ok)
+	assert.Contains(t, warn, "querylog, stats")
+
+	g.stats.Report(nil, now.Add(time.Minute))
+	assert.True(t, g.active)
+
+	g.queryLog.Report(nil, now.Add(time.Minute))
+	assert.False(t, g.active)
+
+	_, ok = g.warning()
+	assert.False(t, ok)
+}
@@ -0,0 +1,426 @@
+package home
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+const (
+	// listenerFDEnv is the environment variable containing the file
+	// descriptor of the listener of the plain HTTP server inherited from the
+	// process which has restarted this one.
+	listenerFDEnv = "ADGUARDHOME_HTTP_LISTENER_FD"
+
+	// restartFDEnv is the environment variable containing the file
+	// descriptor of the connection to the process which has restarted this
+	// one.
+	restartFDEnv = "ADGUARDHOME_RESTART_FD"
+)
+
+// The requests of the new process to the one which has restarted it.  Each of
+// them is sent as a line once the new process is ready for the next step.
+const (
+	// handoverFiles requests to stop serving the web interface and the DHCP
+	// and to close the databases.  The DNS server keeps serving.
+	handoverFiles = "files"
+
+	// handoverListeners requests the sockets of the plain DNS listeners,
+	// which are sent along with the reply.  The DNS server keeps serving
+	// them until the new process is ready.  If it has other listeners, it's
+	// stopped instead, and no sockets are sent.
+	handoverListeners = "listeners"
+
+	// handoverReady tells that the new process serves, so that the previous
+	// one exits.
+	handoverReady = "ready"
+
+	// handoverOK is the reply to the requests, which is sent once the
+	// resources are released.
+	handoverOK = "ok"
+)
+
+// restartTimeout is the time the new process is given for each step of the
+// restart.
+const restartTimeout = 2 * time.Minute
+
+// maxHandoverFiles is the maximum number of the files sent along with a reply
+// to the new process.
+const maxHandoverFiles = 64
+
+// checkRestart returns an error if the executable can't start with the
+// current configuration, so that the restart wouldn't leave AdGuard Home
+// stopped.
+func checkRestart(exe string) (err error) {
+	cmd := exec.Command(
+		exe,
+		"--check-config",
+		"-c", config.getConfigFilename(),
+		"-w", Context.workDir,
+	)
+
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("checking configuration: %w: %s", err, out)
+	}
+
+	return nil
+}
+
+// restartUnsupported returns an error if the process can't be replaced by a
+// new one, since nothing would keep it running or its supervisor would stop
+// it.
+func restartUnsupported() (err error) {
+	switch {
+	case runtime.GOOS == "windows":
+		return fmt.Errorf("restarting is not supported on %s", runtime.GOOS)
+	case os.Getpid() == 1:
+		return agherr.Error("restarting the init process is not supported")
+	case Context.runningAsService && os.Getenv("NOTIFY_SOCKET") == "":
+		// The service manager must be told about the new main process.
+		return agherr.Error("restarting the service is only supported by systemd, reinstall the service")
+	default:
+		return nil
+	}
+}
+
+// handleRestart is the handler for the POST /control/restart HTTP API.
+func handleRestart(w http.ResponseWriter, _ *http.Request) {
+	err := restartUnsupported()
+	if err != nil {
+		httpError(w, http.StatusNotImplemented, "%s", err)
+
+		return
+	}
+
+	exe, err := os.Executable()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "getting executable: %s", err)
+
+		return
+	}
+
+	// The new process reads the configuration from the file.
+	writeConfigNow()
+
+	err = checkRestart(exe)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "%s", err)
+
+		return
+	}
+
+	returnOK(w)
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	// The handler holds the control lock, which the restart takes, so
+	// restart in a separate goroutine.
+	go restart(context.Background(), exe)
+}
+
+// restart starts a new instance of exe and hands the resources over to it
+// once it requests them.  This process exits once the new one serves, and
+// reacquires the released resources and keeps serving if the new one fails.
+//
+// Both processes serve the sockets of the plain DNS listeners until the new one
+// is ready, so that the DNS requests aren't dropped.  If the DNS server has the
+// encrypted or the UNIX socket listeners, it's stopped before the new one
+// starts instead, since those can't be shared, so there is a short break.  The
+// connections to the plain HTTP server are queued until the new process accepts
+// them.
+func restart(ctx context.Context, exe string) {
+	// Don't let the settings change while the new process is starting.
+	Context.controlLock.Lock()
+	defer Context.controlLock.Unlock()
+
+	l, err := Context.web.listenerFile()
+	if err != nil {
+		log.Error("restart: http listener isn't inherited: %s", err)
+	}
+
+	log.Info("restart: starting %v", os.Args)
+	proc, conn, err := startChild(exe, l)
+	if l != nil {
+		_ = l.Close()
+	}
+	if err != nil {
+		log.Error("restart: starting: %s", err)
+
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	undos, err := handOver(ctx, conn, []restartStep{{
+		name:    handoverFiles,
+		release: releaseFiles,
+	}, {
+		name:    handoverListeners,
+		release: releaseListeners,
+	}, {
+		name: handoverReady,
+	}})
+	if err != nil {
+		log.Error("restart: %s, resuming", err)
+
+		_ = proc.Kill()
+		_, _ = proc.Wait()
+		for i := len(undos) - 1; i >= 0; i-- {
+			undos[i]()
+		}
+
+		// The new process could have overwritten or removed the file.
+		if Context.pidFileName != "" {
+			_ = writePIDFile(Context.pidFileName)
+		}
+
+		return
+	}
+
+	pid := proc.Pid
+	err = notifyMainPID(pid)
+	if err != nil {
+		log.Error("restart: %s", err)
+	}
+
+	log.Info("restart: process %d has taken over, exiting", pid)
+
+	// The PID file belongs to the new process now.
+	Context.pidFileName = ""
+
+	Context.web.Close(ctx)
+	closeDNSServer()
+	cleanupAlways()
+
+	os.Exit(0)
+}
+
+// restartStep is a step of handing the resources over to the new process.
+type restartStep struct {
+	// release frees the resources for the new process and returns the files
+	// to send to it along with the reply and the function reacquiring the
+	// resources, if any.  If release is nil, the request isn't replied to.
+	release func(ctx context.Context) (files []*os.File, undo func())
+
+	// name is the request of the new process.
+	name string
+}
+
+// handOver serves the requests of the new process on conn in the order of
+// steps.  undos are the functions reacquiring the released resources in the
+// order of release.
+func handOver(ctx context.Context, conn net.Conn, steps []restartStep) (undos []func(), err error) {
+	r := bufio.NewReader(conn)
+	for _, s := range steps {
+		_ = conn.SetDeadline(time.Now().Add(restartTimeout))
+
+		var req string
+		req, err = r.ReadString('\n')
+		if err != nil {
+			return undos, fmt.Errorf("waiting for %s: %w", s.name, err)
+		}
+
+		req = strings.TrimSuffix(req, "\n")
+		if req != s.name {
+			return undos, fmt.Errorf("unexpected request %q, want %q", req, s.name)
+		}
+
+		if s.release == nil {
+			continue
+		}
+
+		log.Info("restart: releasing %s", s.name)
+		files, undo := s.release(ctx)
+		if undo != nil {
+			undos = append(undos, undo)
+		}
+
+		err = sendReply(conn, handoverOK, files)
+		for _, f := range files {
+			_ = f.Close()
+		}
+
+		if err != nil {
+			return undos, fmt.Errorf("replying to %s: %w", s.name, err)
+		}
+	}
+
+	return undos, nil
+}
+
+// releaseFiles stops serving the web interface and the DHCP, closes the
+// databases, and releases the lock of the instance.  The statistics of the
+// requests served meanwhile aren't written.
+func releaseFiles(ctx context.Context) (_ []*os.File, undo func()) {
+	web := Context.web
+	web.suspend(ctx)
+
+	dhcp := Context.dhcpServer != nil && !Context.instance.isFollower()
+	if dhcp {
+		Context.dhcpServer.Stop()
+	}
+
+	// The path isn't known once the database is closed.
+	auth := Context.auth
+	authFile := auth.db.Path()
+	auth.Close()
+
+	if Context.stats != nil {
+		Context.stats.Suspend()
+	}
+
+	inst := Context.instance
+	inst.close()
+
+	return nil, func() {
+		var err error
+		if inst != nil {
+			Context.instance, err = newInstance(inst.info.ID, config.InstanceConflict, Context.getDataDir())
+			if err != nil {
+				log.Error("restart: instance: %s", err)
+			}
+		}
+
+		if Context.stats != nil {
+			err = Context.stats.Resume()
+			if err != nil {
+				log.Error("restart: stats: %s", err)
+			}
+		}
+
+		if na := auth.reopen(authFile); na != nil {
+			Context.auth = na
+		}
+
+		if dhcp {
+			err = Context.dhcpServer.Start()
+			if err != nil {
+				log.Error("restart: starting dhcp server: %s", err)
+			}
+		}
+
+		web.resume()
+	}
+}
+
+// releaseListeners returns the sockets of the plain DNS listeners, which the
+// DNS server keeps serving.  If they can't be shared, it stops the DNS server
+// instead.
+func releaseListeners(_ context.Context) (files []*os.File, undo func()) {
+	if !isRunning() {
+		return nil, nil
+	}
+
+	files, err := Context.dnsServer.ListenerFiles()
+	if err == nil && len(files) > maxHandoverFiles {
+		for _, f := range files {
+			_ = f.Close()
+		}
+
+		err = fmt.Errorf("more than %d sockets", maxHandoverFiles)
+	}
+
+	if err == nil {
+		return files, nil
+	}
+
+	log.Info("restart: dns listeners can't be shared: %s, stopping dns server", err)
+
+	err = Context.dnsServer.Stop()
+	if err != nil {
+		log.Error("restart: stopping dns server: %s", err)
+	}
+
+	return nil, func() {
+		serr := Context.dnsServer.Start()
+		if serr != nil {
+			log.Error("restart: starting dns server: %s", serr)
+		}
+	}
+}
+
+// handover is the connection of the new process to the one which has
+// restarted it.
+type handover struct {
+	conn net.Conn
+}
+
+// newHandover returns the connection to the process which has restarted this
+// one.  h is nil if this process hasn't been restarted.
+func newHandover() (h *handover, err error) {
+	conn, err := inheritedConn(restartFDEnv)
+	if conn == nil {
+		return nil, err
+	}
+
+	return &handover{
+		conn: conn,
+	}, nil
+}
+
+// request asks the previous process to release the resources for step and
+// waits until it does.  h may be nil.
+func (h *handover) request(step string) (err error) {
+	files, err := h.requestFiles(step)
+	for _, f := range files {
+		_ = f.Close()
+	}
+
+	return err
+}
+
+// requestFiles is like request but also returns the files sent by the previous
+// process along with the reply.  h may be nil.
+func (h *handover) requestFiles(step string) (files []*os.File, err error) {
+	if h == nil {
+		return nil, nil
+	}
+
+	_ = h.conn.SetDeadline(time.Now().Add(restartTimeout))
+
+	_, err = io.WriteString(h.conn, step+"\n")
+	if err != nil {
+		return nil, fmt.Errorf("requesting %s: %w", step, err)
+	}
+
+	resp, files, err := readReply(h.conn)
+	if err != nil {
+		return nil, fmt.Errorf("waiting for %s: %w", step, err)
+	}
+
+	if resp != handoverOK {
+		for _, f := range files {
+			_ = f.Close()
+		}
+
+		return nil, fmt.Errorf("unexpected reply %q to %s", resp, step)
+	}
+
+	return files, nil
+}
+
+// ready tells the previous process that this one serves, so that it exits, and
+// closes the connection.  h may be nil.
+func (h *handover) ready() {
+	if h == nil {
+		return
+	}
+	defer func() { _ = h.conn.Close() }()
+
+	_, err := io.WriteString(h.conn, handoverReady+"\n")
+	if err != nil {
+		log.Error("restart: reporting readiness: %s", err)
+	}
+}
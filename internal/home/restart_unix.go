@@ -0,0 +1,264 @@
+// +build !windows
+
+package home
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// startChild starts exe with the arguments of the current process passing it
+// l, if it's not nil, and one end of the connection to the new process, which
+// is returned as conn.
+func startChild(exe string, l *os.File) (proc *os.Process, conn net.Conn, err error) {
+	// SOCK_CLOEXEC isn't supported everywhere, so don't let the sockets
+	// leak into the processes started meanwhile the way package os does.
+	syscall.ForkLock.RLock()
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	if err == nil {
+		syscall.CloseOnExec(fds[0])
+		syscall.CloseOnExec(fds[1])
+	}
+	syscall.ForkLock.RUnlock()
+
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating socket pair: %w", err)
+	}
+	defer func() { _ = syscall.Close(fds[1]) }()
+
+	parent := os.NewFile(uintptr(fds[0]), "restart parent")
+	defer func() { _ = parent.Close() }()
+
+	conn, err = net.FileConn(parent)
+	if err != nil {
+		return nil, nil, fmt.Errorf("creating connection: %w", err)
+	}
+
+	// The descriptors after the standard ones start with 3 in the new
+	// process.
+	files := []uintptr{0, 1, 2, uintptr(fds[1])}
+	env := append(os.Environ(), fmt.Sprintf("%s=%d", restartFDEnv, 3))
+	if l != nil {
+		// Don't use l.Fd, since it makes the descriptor blocking, which
+		// affects the listener of the current process too, since they
+		// share the description.
+		var rc syscall.RawConn
+		rc, err = l.SyscallConn()
+		if err == nil {
+			err = rc.Control(func(fd uintptr) { files = append(files, fd) })
+		}
+
+		if err != nil {
+			log.Error("restart: http listener isn't inherited: %s", err)
+		} else {
+			env = append(env, fmt.Sprintf("%s=%d", listenerFDEnv, 4))
+		}
+	}
+
+	pid, err := syscall.ForkExec(exe, os.Args, &syscall.ProcAttr{
+		Env:   env,
+		Files: files,
+	})
+	if err != nil {
+		_ = conn.Close()
+
+		return nil, nil, err
+	}
+
+	// Never fails on Unix.
+	proc, _ = os.FindProcess(pid)
+
+	return proc, conn, nil
+}
+
+// sendReply sends reply to the new process on conn along with files.
+func sendReply(conn net.Conn, reply string, files []*os.File) (err error) {
+	if len(files) == 0 {
+		_, err = io.WriteString(conn, reply+"\n")
+
+		return err
+	}
+
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return fmt.Errorf("can't send files over %T", conn)
+	}
+
+	fds := make([]int, 0, len(files))
+	for _, f := range files {
+		// Don't use f.Fd for the same reason as in startChild.
+		var rc syscall.RawConn
+		rc, err = f.SyscallConn()
+		if err == nil {
+			err = rc.Control(func(fd uintptr) { fds = append(fds, int(fd)) })
+		}
+
+		if err != nil {
+			return fmt.Errorf("getting descriptor of %s: %w", f.Name(), err)
+		}
+	}
+
+	_, _, err = uc.WriteMsgUnix([]byte(reply+"\n"), syscall.UnixRights(fds...), nil)
+
+	return err
+}
+
+// readReply reads a reply of the previous process from conn along with the
+// files sent with it.
+func readReply(conn net.Conn) (reply string, files []*os.File, err error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return "", nil, fmt.Errorf("can't receive files over %T", conn)
+	}
+
+	var b []byte
+	buf := make([]byte, 64)
+	oob := make([]byte, syscall.CmsgSpace(maxHandoverFiles*4))
+	for !bytes.HasSuffix(b, []byte{'\n'}) {
+		n, oobn, _, _, rerr := uc.ReadMsgUnix(buf, oob)
+		files = append(files, receivedFiles(oob[:oobn])...)
+		if rerr == nil && n == 0 {
+			rerr = io.EOF
+		}
+
+		if rerr != nil {
+			for _, f := range files {
+				_ = f.Close()
+			}
+
+			return "", nil, rerr
+		}
+
+		b = append(b, buf[:n]...)
+	}
+
+	return string(b[:len(b)-1]), files, nil
+}
+
+// receivedFiles returns the files received in the ancillary data oob.
+func receivedFiles(oob []byte) (files []*os.File) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		log.Error("restart: parsing control messages: %s", err)
+
+		return nil
+	}
+
+	for i := range msgs {
+		fds, perr := syscall.ParseUnixRights(&msgs[i])
+		if perr != nil {
+			// Not the descriptors.
+			continue
+		}
+
+		for _, fd := range fds {
+			syscall.CloseOnExec(fd)
+			files = append(files, os.NewFile(uintptr(fd), "inherited socket"))
+		}
+	}
+
+	return files
+}
+
+// inheritedConn returns the connection to the process which has restarted
+// this one, if any, from the environment variable with name.
+func inheritedConn(name string) (conn net.Conn, err error) {
+	f, err := inheritedFile(name, "restart")
+	if f == nil {
+		return nil, err
+	}
+	defer func() { _ = f.Close() }()
+
+	return net.FileConn(f)
+}
+
+// inheritedFile returns the file with the descriptor from the environment
+// variable with name, if it's set.  The variable is unset, since the file is
+// only inherited once.
+func inheritedFile(name, fileName string) (f *os.File, err error) {
+	v, ok := os.LookupEnv(name)
+	if !ok {
+		return nil, nil
+	}
+
+	_ = os.Unsetenv(name)
+
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		return nil, fmt.Errorf("bad descriptor %q: %w", v, err)
+	}
+
+	syscall.CloseOnExec(fd)
+
+	return os.NewFile(uintptr(fd), fileName), nil
+}
+
+// inheritedListener returns the listener inherited from the process which has
+// restarted this one, if it's on addr.  Otherwise, it returns nil and closes
+// the listener, if any.
+func inheritedListener(addr string) (l *net.TCPListener) {
+	f, err := inheritedFile(listenerFDEnv, "http listener")
+	if err != nil {
+		log.Error("web: bad inherited listener: %s", err)
+
+		return nil
+	} else if f == nil {
+		return nil
+	}
+	defer func() { _ = f.Close() }()
+
+	fl, err := net.FileListener(f)
+	if err != nil {
+		log.Error("web: using inherited listener: %s", err)
+
+		return nil
+	}
+
+	l, ok := fl.(*net.TCPListener)
+	if !ok {
+		log.Error("web: inherited listener is %T, closing", fl)
+		_ = fl.Close()
+
+		return nil
+	}
+
+	want, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		log.Error("web: resolving %q: %s", addr, err)
+	} else if got := l.Addr().(*net.TCPAddr); got.Port == want.Port && got.IP.Equal(want.IP) {
+		log.Info("web: using inherited listener on %s", got)
+
+		return l
+	}
+
+	log.Info("web: inherited listener on %s isn't on %s, closing", l.Addr(), addr)
+	_ = l.Close()
+
+	return nil
+}
+
+// notifyMainPID tells the service manager, if it's systemd, that the process
+// with pid is the main process of the service now.
+func notifyMainPID(pid int) (err error) {
+	sock := os.Getenv("NOTIFY_SOCKET")
+	if sock == "" {
+		return nil
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("connecting to systemd: %w", err)
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, err = fmt.Fprintf(conn, "MAINPID=%d", pid)
+
+	return err
+}
@@ -0,0 +1,219 @@
+// +build !windows
+
+package home
+
+import (
+	"context"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInheritedListener(t *testing.T) {
+	// newListenerFD returns the descriptor of a duplicate of a new listener
+	// on a random port and the address of the listener.
+	newListenerFD := func(t *testing.T) (fd, addr string) {
+		t.Helper()
+
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = l.Close() })
+
+		f, err := l.(*net.TCPListener).File()
+		require.NoError(t, err)
+		defer func() { require.NoError(t, f.Close()) }()
+
+		// Use a bare descriptor, since inheritedListener closes it.
+		dup, err := syscall.Dup(int(f.Fd()))
+		require.NoError(t, err)
+
+		return strconv.Itoa(dup), l.Addr().String()
+	}
+
+	t.Run("none", func(t *testing.T) {
+		assert.Nil(t, inheritedListener("127.0.0.1:3000"))
+	})
+
+	t.Run("same_addr", func(t *testing.T) {
+		fd, addr := newListenerFD(t)
+		require.NoError(t, os.Setenv(listenerFDEnv, fd))
+
+		l := inheritedListener(addr)
+		require.NotNil(t, l)
+		t.Cleanup(func() { _ = l.Close() })
+
+		assert.Equal(t, addr, l.Addr().String())
+
+		_, ok := os.LookupEnv(listenerFDEnv)
+		assert.False(t, ok)
+	})
+
+	t.Run("other_addr", func(t *testing.T) {
+		fd, _ := newListenerFD(t)
+		require.NoError(t, os.Setenv(listenerFDEnv, fd))
+
+		assert.Nil(t, inheritedListener("127.0.0.1:1"))
+	})
+
+	t.Run("bad_fd", func(t *testing.T) {
+		require.NoError(t, os.Setenv(listenerFDEnv, "fd"))
+
+		assert.Nil(t, inheritedListener("127.0.0.1:3000"))
+	})
+}
+
+func TestHandOver(t *testing.T) {
+	// newSteps returns the steps recording the releases and the undos into
+	// calls.
+	newSteps := func(calls *[]string, sent []*os.File) (steps []restartStep) {
+		release := func(name string, files []*os.File) func(context.Context) ([]*os.File, func()) {
+			return func(_ context.Context) (_ []*os.File, undo func()) {
+				*calls = append(*calls, "release "+name)
+
+				return files, func() { *calls = append(*calls, "undo "+name) }
+			}
+		}
+
+		return []restartStep{{
+			name:    handoverFiles,
+			release: release(handoverFiles, nil),
+		}, {
+			name:    handoverListeners,
+			release: release(handoverListeners, sent),
+		}, {
+			name: handoverReady,
+		}}
+	}
+
+	// newConns returns the connections of the previous and the new
+	// processes.
+	newConns := func(t *testing.T) (prev net.Conn, h *handover) {
+		t.Helper()
+
+		fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+		require.NoError(t, err)
+
+		newConn := func(fd int) (c net.Conn) {
+			f := os.NewFile(uintptr(fd), "handover")
+			defer func() { require.NoError(t, f.Close()) }()
+
+			c, err = net.FileConn(f)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = c.Close() })
+
+			return c
+		}
+
+		return newConn(fds[0]), &handover{
+			conn: newConn(fds[1]),
+		}
+	}
+
+	t.Run("ready", func(t *testing.T) {
+		var calls []string
+		prev, h := newConns(t)
+
+		// The socket of the DNS listener is sent along with the reply.
+		c, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = c.Close() })
+
+		sent, err := c.File()
+		require.NoError(t, err)
+
+		errCh := make(chan error, 1)
+		filesCh := make(chan []*os.File, 1)
+		go func() {
+			var files []*os.File
+			err := h.request(handoverFiles)
+			if err == nil {
+				files, err = h.requestFiles(handoverListeners)
+			}
+			if err == nil {
+				h.ready()
+			}
+
+			filesCh <- files
+			errCh <- err
+		}()
+
+		undos, err := handOver(context.Background(), prev, newSteps(&calls, []*os.File{sent}))
+		require.NoError(t, err)
+		require.NoError(t, <-errCh)
+
+		files := <-filesCh
+		require.Len(t, files, 1)
+		defer func() { _ = files[0].Close() }()
+
+		pc, err := net.FilePacketConn(files[0])
+		require.NoError(t, err)
+		defer func() { _ = pc.Close() }()
+
+		assert.Equal(t, c.LocalAddr(), pc.LocalAddr())
+
+		assert.Len(t, undos, 2)
+		assert.Equal(t, []string{
+			"release " + handoverFiles,
+			"release " + handoverListeners,
+		}, calls)
+	})
+
+	t.Run("failed", func(t *testing.T) {
+		var calls []string
+		prev, h := newConns(t)
+
+		errCh := make(chan error, 1)
+		go func() {
+			err := h.request(handoverFiles)
+
+			// The new process fails before taking over the
+			// listeners.
+			_ = h.conn.Close()
+
+			errCh <- err
+		}()
+
+		undos, err := handOver(context.Background(), prev, newSteps(&calls, nil))
+		require.Error(t, err)
+		require.NoError(t, <-errCh)
+
+		require.Len(t, undos, 1)
+		undos[0]()
+
+		assert.Equal(t, []string{
+			"release " + handoverFiles,
+			"undo " + handoverFiles,
+		}, calls)
+	})
+
+	t.Run("unexpected", func(t *testing.T) {
+		var calls []string
+		prev, h := newConns(t)
+
+		go func() {
+			_ = h.request(handoverListeners)
+		}()
+
+		undos, err := handOver(context.Background(), prev, newSteps(&calls, nil))
+		require.Error(t, err)
+
+		assert.Empty(t, undos)
+		assert.Empty(t, calls)
+	})
+}
+
+func TestHandover_nil(t *testing.T) {
+	var h *handover
+	assert.NoError(t, h.request(handoverFiles))
+
+	files, err := h.requestFiles(handoverListeners)
+	assert.NoError(t, err)
+	assert.Empty(t, files)
+
+	assert.NotPanics(t, h.ready)
+}
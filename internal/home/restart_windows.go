@@ -0,0 +1,50 @@
+// +build windows
+
+package home
+
+import (
+	"io"
+	"net"
+	"os"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+)
+
+// startChild isn't supported on Windows.
+func startChild(_ string, _ *os.File) (proc *os.Process, conn net.Conn, err error) {
+	return nil, nil, agherr.Error("restarting is not supported on windows")
+}
+
+// sendReply sends reply to the new process on conn.  Files can't be sent on
+// Windows.
+func sendReply(conn net.Conn, reply string, files []*os.File) (err error) {
+	if len(files) > 0 {
+		return agherr.Error("sending files is not supported on windows")
+	}
+
+	_, err = io.WriteString(conn, reply+"\n")
+
+	return err
+}
+
+// readReply isn't supported on Windows.
+func readReply(_ net.Conn) (reply string, files []*os.File, err error) {
+	return "", nil, agherr.Error("restarting is not supported on windows")
+}
+
+// inheritedConn always returns nil, since the processes aren't restarted on
+// Windows.
+func inheritedConn(_ string) (conn net.Conn, err error) {
+	return nil, nil
+}
+
+// inheritedListener always returns nil, since the listeners aren't inherited
+// on Windows.
+func inheritedListener(_ string) (l *net.TCPListener) {
+	return nil
+}
+
+// notifyMainPID does nothing on Windows.
+func notifyMainPID(_ int) (err error) {
+	return nil
+}
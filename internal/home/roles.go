@@ -0,0 +1,266 @@
+package home
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Role is the permission level of a user or an API token.
+type Role string
+
+// Roles from the least to the most privileged.
+const (
+	// RoleViewer may only use the read-only endpoints.
+	RoleViewer Role = "viewer"
+
+	// RoleOperator may also toggle protection and manage the filtering
+	// rules, clients, and the like, but not the listeners, TLS, updates,
+	// or users.
+	RoleOperator Role = "operator"
+
+	// RoleAdmin may do everything.
+	RoleAdmin Role = "admin"
+)
+
+// rank returns the privilege rank of r or -1 if r isn't a valid role.
+func (r Role) rank() (n int) {
+	switch r {
+	case RoleViewer:
+		return 0
+	case RoleOperator:
+		return 1
+	case RoleAdmin:
+		return 2
+	default:
+		return -1
+	}
+}
+
+// allows returns true if r grants everything required grants.
+func (r Role) allows(required Role) (ok bool) {
+	return r.rank() >= required.rank()
+}
+
+// userRole returns the role of u.  The users without a role are
+// administrators, as they were before the roles have been introduced.
+func userRole(u User) (r Role) {
+	if u.Role == "" {
+		return RoleAdmin
+	}
+
+	return u.Role
+}
+
+// APIToken is a bearer token for the HTTP API.
+type APIToken struct {
+	// Name is the name of the token used in the audit log.
+	Name string `yaml:"name"`
+
+	// TokenHash is the hex-encoded SHA-256 hash of the token.
+	TokenHash string `yaml:"token_hash"`
+
+	// Role is the role of the token.  It's required.
+	Role Role `yaml:"role"`
+}
+
+// validateRoles returns an error if any of the users or of the tokens has an
+// invalid role or if a token is malformed.
+func validateRoles(users []User, tokens []APIToken) (err error) {
+	for _, u := range users {
+		if u.Role != "" && u.Role.rank() < 0 {
+			return fmt.Errorf("user %q: unknown role %q", u.Name, u.Role)
+		}
+	}
+
+	for _, t := range tokens {
+		if t.Name == "" {
+			return fmt.Errorf("api token: name is required")
+		}
+
+		if t.Role.rank() < 0 {
+			return fmt.Errorf("api token %q: unknown role %q", t.Name, t.Role)
+		}
+
+		var h []byte
+		h, err = hex.DecodeString(t.TokenHash)
+		if err != nil || len(h) != sha256.Size {
+			return fmt.Errorf("api token %q: token_hash must be a hex-encoded sha-256 hash", t.Name)
+		}
+	}
+
+	return nil
+}
+
+// findAPIToken returns the API token from the bearer authorization of r.
+func (a *Auth) findAPIToken(r *http.Request) (t APIToken, ok bool) {
+	const prefix = "Bearer "
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, prefix) {
+		return APIToken{}, false
+	}
+
+	sum := sha256.Sum256([]byte(h[len(prefix):]))
+	hash := hex.EncodeToString(sum[:])
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, t = range a.apiTokens {
+		if subtle.ConstantTimeCompare([]byte(strings.ToLower(t.TokenHash)), []byte(hash)) == 1 {
+			return t, true
+		}
+	}
+
+	return APIToken{}, false
+}
+
+// principal is the authenticated originator of a request.
+type principal struct {
+	// kind is the kind of the principal, for example "user" or "token".
+	kind string
+
+	// name is the name of the user or of the token.  It's empty for the
+	// principals which aren't named.
+	name string
+
+	role Role
+}
+
+// String implements the fmt.Stringer interface for principal.
+func (p principal) String() (s string) {
+	if p.name == "" {
+		return p.kind
+	}
+
+	return fmt.Sprintf("%s %q", p.kind, p.name)
+}
+
+// principalCtxKey is the key of the principal in the context of a request.
+type principalCtxKey struct{}
+
+// withPrincipal returns a copy of r with p in its context.
+func withPrincipal(r *http.Request, p principal) (withP *http.Request) {
+	return r.WithContext(context.WithValue(r.Context(), principalCtxKey{}, p))
+}
+
+// requestPrincipal returns the principal of r.  If the authentication isn't
+// required, the requests without a principal are made by an anonymous
+// administrator.
+func requestPrincipal(r *http.Request) (p principal, ok bool) {
+	p, ok = r.Context().Value(principalCtxKey{}).(principal)
+	if ok {
+		return p, true
+	}
+
+	if Context.auth == nil || !Context.auth.AuthRequired() {
+		return principal{kind: "anonymous", role: RoleAdmin}, true
+	}
+
+	return principal{}, false
+}
+
+// routeRoles are the roles required by the endpoints which don't follow the
+// default rule of requiredRole.
+var routeRoles = map[string]Role{
+	// Everyone may change the language of the interface.
+	"/control/i18n/change_language": RoleViewer,
+
+	// The Grafana annotations are read-only despite the method.
+	"/control/grafana/annotations": RoleViewer,
+
+	// Listeners, TLS, and updates.
+	"/control/dhcp/find_active_dhcp": RoleAdmin,
+	"/control/dhcp/reset":            RoleAdmin,
+	"/control/dhcp/set_config":       RoleAdmin,
+	"/control/tls/configure":         RoleAdmin,
+	"/control/tls/validate":          RoleAdmin,
+	"/control/update":                RoleAdmin,
+	"/control/restart":               RoleAdmin,
+	"/control/check_listen":          RoleAdmin,
+	"/control/listen_config":         RoleAdmin,
+
+	// The diagnostics reveal the paths and query the upstreams.
+	"/control/doctor": RoleAdmin,
+
+	// The support bundle and the effective configuration contain the
+	// configuration.
+	"/control/support_bundle":   RoleAdmin,
+	"/control/effective_config": RoleAdmin,
+
+	// Disabling the outbound connections may also disable the updates.
+	"/control/outbound/config": RoleAdmin,
+
+	// The PIN lifts the parental control.
+	"/control/pin_bypass/config": RoleAdmin,
+}
+
+// requiredRole returns the role required to make a request to url with
+// method.  By default, the read-only methods require a viewer and the rest
+// require an operator.  The v2 endpoints require the same roles as the
+// unversioned ones.
+func requiredRole(method, url string) (r Role) {
+	if strings.HasPrefix(url, apiV2Prefix) {
+		url = "/control/" + strings.TrimPrefix(url, apiV2Prefix)
+	}
+
+	if r, ok := routeRoles[url]; ok {
+		return r
+	}
+
+	switch method {
+	case http.MethodGet, http.MethodHead:
+		return RoleViewer
+	default:
+		return RoleOperator
+	}
+}
+
+// roleErrorJSON is the response to a request beyond the role of the principal.
+type roleErrorJSON struct {
+	// Code names the required role, for example "role_admin_required".
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// checkRole returns true if the principal of r may make a request that
+// requires the role required.  Otherwise, it responds with 403 Forbidden.
+// All requests which change anything are written into the audit log.
+func checkRole(w http.ResponseWriter, r *http.Request, required Role) (ok bool) {
+	p, ok := requestPrincipal(r)
+	if !ok {
+		http.Error(w, "Forbidden", http.StatusForbidden)
+
+		return false
+	}
+
+	readOnly := r.Method == http.MethodGet || r.Method == http.MethodHead
+	if p.role.allows(required) {
+		if !readOnly {
+			log.Info("audit: %s %s by %s with role %s", r.Method, r.URL.Path, p, p.role)
+		}
+
+		return true
+	}
+
+	log.Info("audit: denied %s %s to %s with role %s, requires %s", r.Method, r.URL.Path, p, p.role, required)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusForbidden)
+	err := json.NewEncoder(w).Encode(roleErrorJSON{
+		Code:    fmt.Sprintf("role_%s_required", required),
+		Message: fmt.Sprintf("this request requires the %s role", required),
+	})
+	if err != nil {
+		log.Debug("writing role error: %s", err)
+	}
+
+	return false
+}
@@ -0,0 +1,166 @@
+package home
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequiredRole(t *testing.T) {
+	testCases := []struct {
+		method string
+		url    string
+		want   Role
+	}{{
+		method: http.MethodGet,
+		url:    "/control/querylog",
+		want:   RoleViewer,
+	}, {
+		method: http.MethodPost,
+		url:    "/control/filtering/set_rules",
+		want:   RoleOperator,
+	}, {
+		method: http.MethodPost,
+		url:    "/control/tls/configure",
+		want:   RoleAdmin,
+	}, {
+		method: http.MethodPost,
+		url:    "/control/v2/tls/configure",
+		want:   RoleAdmin,
+	}, {
+		method: http.MethodGet,
+		url:    "/control/v2/stats",
+		want:   RoleViewer,
+	}, {
+		method: http.MethodPost,
+		url:    "/control/i18n/change_language",
+		want:   RoleViewer,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.method+" "+tc.url, func(t *testing.T) {
+			assert.Equal(t, tc.want, requiredRole(tc.method, tc.url))
+		})
+	}
+}
+
+func TestValidateRoles(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	hash := hex.EncodeToString(sum[:])
+
+	testCases := []struct {
+		name       string
+		users      []User
+		tokens     []APIToken
+		wantErrMsg string
+	}{{
+		name:       "valid",
+		users:      []User{{Name: "a"}, {Name: "b", Role: RoleViewer}},
+		tokens:     []APIToken{{Name: "t", TokenHash: hash, Role: RoleOperator}},
+		wantErrMsg: "",
+	}, {
+		name:       "bad_user_role",
+		users:      []User{{Name: "a", Role: "root"}},
+		wantErrMsg: `user "a": unknown role "root"`,
+	}, {
+		name:       "no_token_role",
+		tokens:     []APIToken{{Name: "t", TokenHash: hash}},
+		wantErrMsg: `api token "t": unknown role ""`,
+	}, {
+		name:       "bad_token_hash",
+		tokens:     []APIToken{{Name: "t", TokenHash: "secret", Role: RoleViewer}},
+		wantErrMsg: `api token "t": token_hash must be a hex-encoded sha-256 hash`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := validateRoles(tc.users, tc.tokens)
+			if tc.wantErrMsg == "" {
+				assert.NoError(t, err)
+
+				return
+			}
+
+			require.Error(t, err)
+			assert.Equal(t, tc.wantErrMsg, err.Error())
+		})
+	}
+}
+
+func TestAuth_findAPIToken(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	a := &Auth{}
+	a.SetAPITokens([]APIToken{{
+		Name:      "grafana",
+		TokenHash: hex.EncodeToString(sum[:]),
+		Role:      RoleViewer,
+	}})
+
+	r := httptest.NewRequest(http.MethodGet, "/control/stats", nil)
+	_, ok := a.findAPIToken(r)
+	assert.False(t, ok)
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	_, ok = a.findAPIToken(r)
+	assert.False(t, ok)
+
+	r.Header.Set("Authorization", "Bearer secret")
+	tok, ok := a.findAPIToken(r)
+	require.True(t, ok)
+	assert.Equal(t, "grafana", tok.Name)
+}
+
+func TestCheckRole(t *testing.T) {
+	testCases := []struct {
+		name     string
+		role     Role
+		required Role
+		wantBody string
+		wantOK   bool
+	}{{
+		name:     "viewer_read",
+		role:     RoleViewer,
+		required: RoleViewer,
+		wantBody: "",
+		wantOK:   true,
+	}, {
+		name:     "viewer_write",
+		role:     RoleViewer,
+		required: RoleOperator,
+		wantBody: `{"code":"role_operator_required",` +
+			`"message":"this request requires the operator role"}` + "\n",
+		wantOK: false,
+	}, {
+		name:     "operator_admin",
+		role:     RoleOperator,
+		required: RoleAdmin,
+		wantBody: `{"code":"role_admin_required",` +
+			`"message":"this request requires the admin role"}` + "\n",
+		wantOK: false,
+	}, {
+		name:     "admin",
+		role:     RoleAdmin,
+		required: RoleAdmin,
+		wantBody: "",
+		wantOK:   true,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/control/test", nil)
+			r = withPrincipal(r, principal{kind: "user", name: "partner", role: tc.role})
+			w := httptest.NewRecorder()
+
+			assert.Equal(t, tc.wantOK, checkRole(w, r, tc.required))
+			assert.Equal(t, tc.wantBody, w.Body.String())
+			if !tc.wantOK {
+				assert.Equal(t, http.StatusForbidden, w.Code)
+			}
+		})
+	}
+}
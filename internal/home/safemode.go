@@ -0,0 +1,30 @@
+package home
+
+import "net"
+
+const (
+	// safeModeBindPort is the port of the web interface in safe mode
+	// unless it's overridden from the console.
+	safeModeBindPort = 3000
+
+	// safeModeWarning is the warning shown in the status response in safe
+	// mode.
+	safeModeWarning = "running in safe mode: filtering, rewrites, access control, " +
+		"and custom upstreams are disabled; restart without --safe-mode " +
+		"to enable them"
+)
+
+// safeModeWebAddr returns the address of the web interface in safe mode: the
+// default one or the one from the console.
+func safeModeWebAddr(args options) (host net.IP, port int) {
+	host, port = net.IP{0, 0, 0, 0}, safeModeBindPort
+	if args.bindHost != nil {
+		host = args.bindHost
+	}
+
+	if args.bindPort != 0 {
+		port = args.bindPort
+	}
+
+	return host, port
+}
@@ -0,0 +1,435 @@
+package home
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/google/renameio/maybe"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Environment variables with the key of the secrets within the configuration
+// file.
+const (
+	// envSecretsKey is the base64-encoded key itself.
+	envSecretsKey = "AGH_SECRETS_KEY"
+
+	// envSecretsKeyFile is the path to the file with the base64-encoded
+	// key.  It's only used if envSecretsKey isn't set.
+	envSecretsKeyFile = "AGH_SECRETS_KEY_FILE"
+)
+
+// secretsKeyLen is the length of the key of the secrets, which makes the
+// cipher AES-256.
+const secretsKeyLen = 32
+
+// secretPrefix is the prefix of the encrypted values within the configuration
+// file.  The version allows changing the format without breaking the older
+// files.
+const secretPrefix = "enc:v1:"
+
+// errSecretsNoKey is returned when the configuration file contains encrypted
+// values, but the key isn't set.
+const errSecretsNoKey agherr.Error = "the configuration file contains encrypted secrets, " +
+	"but neither " + envSecretsKey + " nor " + envSecretsKeyFile + " is set"
+
+// configSecrets are the paths of the values within the configuration file,
+// which are encrypted if the key is set.  The paths are the same as in
+// configRedactions.
+var configSecrets = map[string]bool{
+	"users.password":               true,
+	"api_tokens.token_hash":        true,
+	"pin_bypass.pin_hash":          true,
+	"http_proxy":                   true,
+	"dns.upstream_dns":             true,
+	"dns.upstream_options.address": true,
+	"clients.upstreams":            true,
+	"tls.private_key":              true,
+}
+
+// secretBox encrypts and decrypts the secrets within the configuration file
+// with AES-256-GCM.  A nil *secretBox leaves the values as is.
+type secretBox struct {
+	aead cipher.AEAD
+
+	// mu protects sealed.
+	mu sync.Mutex
+
+	// sealed are the encrypted values from the last read or write of the
+	// configuration file by their plain text, so that the values which
+	// haven't changed keep their ciphertexts between the writes.
+	sealed map[string]string
+}
+
+// newSecretBox returns a new box with key, which must be secretsKeyLen bytes
+// long.
+func newSecretBox(key []byte) (b *secretBox, err error) {
+	if len(key) != secretsKeyLen {
+		return nil, fmt.Errorf("key must be %d bytes long, got %d", secretsKeyLen, len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &secretBox{aead: aead}, nil
+}
+
+// parseSecretsKey decodes the base64-encoded key s and returns a box with it.
+func parseSecretsKey(s string) (b *secretBox, err error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decoding key: %w", err)
+	}
+
+	return newSecretBox(key)
+}
+
+// readSecretsKeyFile returns a box with the key from the file at path.
+func readSecretsKeyFile(path string) (b *secretBox, err error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading key file: %w", err)
+	}
+
+	return parseSecretsKey(string(data))
+}
+
+// secretBoxFromEnv returns a box with the key from envSecretsKey or
+// envSecretsKeyFile.  b is nil if neither is set.
+func secretBoxFromEnv() (b *secretBox, err error) {
+	if s, ok := os.LookupEnv(envSecretsKey); ok {
+		b, err = parseSecretsKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envSecretsKey, err)
+		}
+
+		return b, nil
+	}
+
+	if path := os.Getenv(envSecretsKeyFile); path != "" {
+		b, err = readSecretsKeyFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", envSecretsKeyFile, err)
+		}
+
+		return b, nil
+	}
+
+	return nil, nil
+}
+
+// newSecretsKey returns a new random base64-encoded key.
+func newSecretsKey() (s string, err error) {
+	key := make([]byte, secretsKeyLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return "", fmt.Errorf("generating key: %w", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(key), nil
+}
+
+// seal returns s encrypted with a random nonce and prefixed with secretPrefix.
+// s is returned as is if it's empty or encrypted already.
+func (b *secretBox) seal(s string) (enc string, err error) {
+	if b == nil || s == "" || strings.HasPrefix(s, secretPrefix) {
+		return s, nil
+	}
+
+	nonce := make([]byte, b.aead.NonceSize())
+	_, err = rand.Read(nonce)
+	if err != nil {
+		return "", fmt.Errorf("generating nonce: %w", err)
+	}
+
+	data := b.aead.Seal(nonce, nonce, []byte(s), nil)
+
+	return secretPrefix + base64.StdEncoding.EncodeToString(data), nil
+}
+
+// open returns the decrypted value of s.  s is returned as is if it's not
+// encrypted, so that the plain values are encrypted on the next write.
+func (b *secretBox) open(enc string) (s string, err error) {
+	if !strings.HasPrefix(enc, secretPrefix) {
+		return enc, nil
+	} else if b == nil {
+		return "", errSecretsNoKey
+	}
+
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(enc, secretPrefix))
+	if err != nil {
+		return "", fmt.Errorf("decoding: %w", err)
+	}
+
+	n := b.aead.NonceSize()
+	if len(data) < n {
+		return "", fmt.Errorf("value is too short")
+	}
+
+	plain, err := b.aead.Open(nil, data[:n], data[n:], nil)
+	if err != nil {
+		// Most probably, the key is wrong.
+		return "", fmt.Errorf("authenticating: %w", err)
+	}
+
+	s = string(plain)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.sealed == nil {
+		b.sealed = map[string]string{}
+	}
+
+	b.sealed[s] = enc
+
+	return s, nil
+}
+
+// encryptConfig returns the configuration file data with the values at the
+// configSecrets paths encrypted with b.  The values which haven't changed since
+// the last read or write keep their ciphertexts, so that the file only changes
+// where the configuration does.  data is returned as is if b is nil.
+func encryptConfig(b *secretBox, data []byte) (res []byte, err error) {
+	if b == nil {
+		return data, nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sealed := map[string]string{}
+	res, err = mapConfigSecrets(data, func(s string) (enc string, err error) {
+		var ok bool
+		enc, ok = b.sealed[s]
+		if !ok {
+			enc, err = b.seal(s)
+			if err != nil {
+				return "", err
+			}
+		}
+
+		if enc != s {
+			sealed[s] = enc
+		}
+
+		return enc, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	b.sealed = sealed
+
+	return res, nil
+}
+
+// decryptConfig returns the configuration file data with the encrypted values
+// decrypted with b.  It returns errSecretsNoKey if there are encrypted values,
+// but b is nil.
+func decryptConfig(b *secretBox, data []byte) (res []byte, err error) {
+	if !bytes.Contains(data, []byte(secretPrefix)) {
+		return data, nil
+	}
+
+	return mapConfigSecrets(data, b.open)
+}
+
+// mapConfigSecrets returns the configuration file data with the values at the
+// configSecrets paths replaced with the results of f.
+func mapConfigSecrets(data []byte, f func(s string) (res string, err error)) (res []byte, err error) {
+	conf := yaml.MapSlice{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	err = mapSecretsNode("", conf, f)
+	if err != nil {
+		return nil, err
+	}
+
+	return yaml.Marshal(conf)
+}
+
+// mapSecretsNode replaces the values within the YAML node v located at path
+// with the results of f.  The traversal is the same as in (*redactor).node.
+func mapSecretsNode(path string, v interface{}, f func(s string) (res string, err error)) (err error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key := fmt.Sprint(item.Key)
+			if path != "" {
+				key = path + "." + key
+			}
+
+			if configSecrets[key] {
+				v[i].Value, err = mapSecretsValue(item.Value, f)
+				if err != nil {
+					return fmt.Errorf("%s: %w", key, err)
+				}
+			} else {
+				err = mapSecretsNode(key, item.Value, f)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	case []interface{}:
+		for _, elem := range v {
+			err = mapSecretsNode(path, elem, f)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// mapSecretsValue returns the string v or the sequence of strings v with the
+// strings replaced with the results of f.  The other values are returned as
+// is.
+func mapSecretsValue(v interface{}, f func(s string) (res string, err error)) (res interface{}, err error) {
+	switch v := v.(type) {
+	case string:
+		return f(v)
+	case []interface{}:
+		for i, elem := range v {
+			v[i], err = mapSecretsValue(elem, f)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return v, nil
+	default:
+		return v, nil
+	}
+}
+
+// cmdSecrets is the command managing the key of the secrets within the
+// configuration file.  The subcommands are:
+//
+//   - keygen prints a new random key;
+//   - rotate re-encrypts the secrets with the key from --new-key-file, or
+//     decrypts them with --decrypt.
+//
+// Like the doctor command, it doesn't need a running instance.  The instance
+// must be restarted with the new key after the rotation.
+func cmdSecrets(w io.Writer, args []string) (err error) {
+	if len(args) == 0 {
+		return fmt.Errorf("%w: expected keygen or rotate", errCLIUsage)
+	}
+
+	switch sub := args[0]; sub {
+	case "keygen":
+		var key string
+		key, err = newSecretsKey()
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintln(w, key)
+
+		return err
+	case "rotate":
+		return rotateSecrets(w, args[1:])
+	default:
+		return fmt.Errorf("%w: unknown subcommand %q", errCLIUsage, sub)
+	}
+}
+
+// rotateSecrets decrypts the secrets within the configuration file with the
+// current key from the environment and encrypts them with the new one.
+func rotateSecrets(w io.Writer, args []string) (err error) {
+	cf := &cliFlags{}
+	fs := newCLIFlagSet("secrets rotate", cf)
+
+	var newKeyFile string
+	fs.StringVar(&newKeyFile, "new-key-file", "", "Path to the file with the new key.")
+
+	var decrypt bool
+	fs.BoolVar(&decrypt, "decrypt", false, "Write the secrets in plain text.")
+
+	err = parseCLIFlags(fs, args)
+	if err != nil {
+		return err
+	} else if (newKeyFile == "") == !decrypt {
+		return fmt.Errorf("%w: expected either --new-key-file or --decrypt", errCLIUsage)
+	}
+
+	cur, err := secretBoxFromEnv()
+	if err != nil {
+		return fmt.Errorf("current key: %w", err)
+	}
+
+	var next *secretBox
+	if !decrypt {
+		next, err = readSecretsKeyFile(newKeyFile)
+		if err != nil {
+			return fmt.Errorf("new key: %w", err)
+		}
+	}
+
+	opts := options{
+		configFilename: cf.confPath,
+		workDir:        cf.workDir,
+	}
+	initConfigFilename(opts)
+	initWorkingDir(opts)
+
+	confFile := config.getConfigFilename()
+	data, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	data, err = reencryptConfig(cur, next, data)
+	if err != nil {
+		return err
+	}
+
+	err = maybe.WriteFile(confFile, data, 0o644)
+	if err != nil {
+		return fmt.Errorf("writing config: %w", err)
+	}
+
+	_, err = fmt.Fprintf(w, "%s is updated, restart AdGuard Home with the new key\n", confFile)
+
+	return err
+}
+
+// reencryptConfig returns the configuration file data with the secrets
+// decrypted with cur and encrypted with next.  The secrets are left in plain
+// text if next is nil.
+func reencryptConfig(cur, next *secretBox, data []byte) (res []byte, err error) {
+	res, err = decryptConfig(cur, data)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting config: %w", err)
+	}
+
+	res, err = encryptConfig(next, res)
+	if err != nil {
+		return nil, fmt.Errorf("encrypting config: %w", err)
+	}
+
+	return res, nil
+}
@@ -337,6 +337,7 @@ var launchdConfig = `<?xml version='1.0' encoding='UTF-8'?>
 // Note: we should keep it in sync with the template from service_systemd_linux.go file
 // Add "After=" setting for systemd service file, because we must be started only after network is online
 // Set "RestartSec" to 10
+// Set "NotifyAccess" to all, so that the restarted process is told to be the main one
 const systemdScript = `[Unit]
 Description={{.Description}}
 ConditionFileIsExecutable={{.Path|cmdEscape}}
@@ -357,6 +358,7 @@ StandardError=file:/var/log/{{.Name}}.err
 {{- end}}
 Restart=always
 RestartSec=10
+NotifyAccess=all
 EnvironmentFile=-/etc/sysconfig/{{.Name}}
 
 [Install]
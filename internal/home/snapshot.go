@@ -0,0 +1,407 @@
+package home
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// snapshotDir is the name of the directory within the data directory which
+// contains the last known good snapshot of the filters and upstreams.
+const snapshotDir = "snapshot"
+
+// snapshotManifest is the name of the file with the description of the
+// snapshot.
+const snapshotManifest = "snapshot.json"
+
+// snapshotFilter is a filter list saved into a snapshot.
+type snapshotFilter struct {
+	// File is the name of the file with the rules within the snapshot
+	// directory.
+	File string `json:"file"`
+
+	// ID is the ID of the filter list.
+	ID int64 `json:"id"`
+
+	// Group is the name of the group of the filter list, if any.
+	Group string `json:"group,omitempty"`
+
+	// Size and ModTime are the size and the modification time of the
+	// downloaded filter list file, so that the snapshot is only saved again
+	// once the list changes.  They're zero for the user rules.
+	Size    int64     `json:"size,omitempty"`
+	ModTime time.Time `json:"mod_time"`
+}
+
+// snapshot is the last known good state which is used to answer the queries
+// until the current filters are loaded.
+type snapshot struct {
+	// SavedAt is the time when the snapshot has been saved.
+	SavedAt time.Time `json:"saved_at"`
+
+	// Filters are the blocklists.
+	Filters []snapshotFilter `json:"filters"`
+
+	// AllowFilters are the allowlists.
+	AllowFilters []snapshotFilter `json:"allow_filters"`
+
+	// Upstreams are the lines of the upstream servers.
+	Upstreams []string `json:"upstreams"`
+}
+
+// snapshotLock protects Context.snapshot and the snapshot directory.
+var snapshotLock = &sync.Mutex{}
+
+// filters returns the filters of snap located in dir.  The user rules, which
+// have zero ID, are read into memory, since the filtering engine only reads
+// them from there.
+func (snap *snapshot) filters(dir string) (block, allow []dnsfilter.Filter, err error) {
+	conv := func(sfs []snapshotFilter) (fs []dnsfilter.Filter, cerr error) {
+		for _, sf := range sfs {
+			f := dnsfilter.Filter{
+				ID:       sf.ID,
+				FilePath: filepath.Join(dir, sf.File),
+				Group:    sf.Group,
+			}
+
+			if f.ID == 0 {
+				f.Data, cerr = ioutil.ReadFile(f.FilePath)
+				if cerr != nil {
+					return nil, cerr
+				}
+			}
+
+			fs = append(fs, f)
+		}
+
+		return fs, nil
+	}
+
+	block, err = conv(snap.Filters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	allow, err = conv(snap.AllowFilters)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return block, allow, nil
+}
+
+// writeCompactRules writes the rules from r into the file at path.  Comments
+// and empty lines, which the filtering engine skips anyway, are omitted.
+func writeCompactRules(path string, r io.Reader) (err error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	br := bufio.NewReader(r)
+	for {
+		var line string
+		line, err = br.ReadString('\n')
+		if trimmed := strings.TrimSpace(line); trimmed != "" && trimmed[0] != '!' {
+			_, _ = w.WriteString(trimmed)
+			_ = w.WriteByte('\n')
+		}
+
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+// saveFilter writes the rules of f into the file at path.
+func saveFilter(path string, f dnsfilter.Filter) (err error) {
+	if f.Data != nil {
+		return writeCompactRules(path, bytes.NewReader(f.Data))
+	}
+
+	src, err := os.Open(f.FilePath)
+	if os.IsNotExist(err) {
+		// The filter hasn't been downloaded yet, so the engine uses an
+		// empty list in its place.
+		return writeCompactRules(path, strings.NewReader(""))
+	} else if err != nil {
+		return err
+	}
+	defer func() { _ = src.Close() }()
+
+	return writeCompactRules(path, src)
+}
+
+// listFileState returns the size and the modification time of the file of the
+// downloaded filter list f.  Both are zero for the user rules and the lists
+// which haven't been downloaded yet.
+func listFileState(f dnsfilter.Filter) (size int64, modTime time.Time) {
+	if f.ID == 0 {
+		return 0, time.Time{}
+	}
+
+	fi, err := os.Stat(f.FilePath)
+	if err != nil {
+		return 0, time.Time{}
+	}
+
+	return fi.Size(), fi.ModTime()
+}
+
+// listsChanged returns true if the set or the contents of the downloaded
+// filter lists of filters differ from the ones saved in sfs.  The user rules
+// aren't compared, since they're taken from the configuration when the
+// snapshot is loaded.
+func listsChanged(sfs []snapshotFilter, filters []dnsfilter.Filter) (changed bool) {
+	if len(sfs) != len(filters) {
+		return true
+	}
+
+	for i, f := range filters {
+		sf := sfs[i]
+		if sf.ID != f.ID || sf.Group != f.Group {
+			return true
+		}
+
+		size, modTime := listFileState(f)
+		if sf.Size != size || !sf.ModTime.Equal(modTime) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// saveFilters writes the rules of filters into dir and returns their
+// descriptions.  prefix distinguishes the kinds of the filter lists.
+func saveFilters(dir, prefix string, filters []dnsfilter.Filter) (sfs []snapshotFilter, err error) {
+	for _, f := range filters {
+		sf := snapshotFilter{
+			File:  fmt.Sprintf("%s-%d.txt", prefix, f.ID),
+			ID:    f.ID,
+			Group: f.Group,
+		}
+
+		// Get the state before reading the list, so that a change made
+		// meanwhile is noticed next time.
+		sf.Size, sf.ModTime = listFileState(f)
+
+		err = saveFilter(filepath.Join(dir, sf.File), f)
+		if err != nil {
+			return nil, fmt.Errorf("saving filter %d: %w", f.ID, err)
+		}
+
+		sfs = append(sfs, sf)
+	}
+
+	return sfs, nil
+}
+
+// writeSnapshot saves snap along with the rules of the filters into dir.  The
+// previous snapshot is replaced only when the new one is completely written.
+func writeSnapshot(dir string, snap *snapshot, block, allow []dnsfilter.Filter) (err error) {
+	tmpDir := dir + ".tmp"
+	err = os.RemoveAll(tmpDir)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(tmpDir, 0o755)
+	if err != nil {
+		return err
+	}
+
+	snap.Filters, err = saveFilters(tmpDir, "block", block)
+	if err != nil {
+		return err
+	}
+
+	snap.AllowFilters, err = saveFilters(tmpDir, "allow", allow)
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+
+	err = ioutil.WriteFile(filepath.Join(tmpDir, snapshotManifest), data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = os.RemoveAll(dir)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpDir, dir)
+}
+
+// readSnapshot reads the snapshot from dir.  snap is nil if there is no
+// snapshot.
+func readSnapshot(dir string) (snap *snapshot, err error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, snapshotManifest))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+
+		return nil, err
+	}
+
+	snap = &snapshot{}
+	err = json.Unmarshal(data, snap)
+	if err != nil {
+		return nil, fmt.Errorf("decoding %s: %w", snapshotManifest, err)
+	}
+
+	return snap, nil
+}
+
+// initSnapshot reads the last known good snapshot into Context.snapshot.
+func initSnapshot() {
+	snap, err := readSnapshot(filepath.Join(Context.getDataDir(), snapshotDir))
+	if err != nil {
+		log.Error("reading snapshot: %s", err)
+
+		return
+	}
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	Context.snapshot = snap
+}
+
+// lastKnownUpstreams returns the upstreams of the last known good snapshot, if
+// any.
+func lastKnownUpstreams() (upstreams []string) {
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	if Context.snapshot == nil {
+		return nil
+	}
+
+	return Context.snapshot.Upstreams
+}
+
+// loadFiltersSnapshot synchronously builds the filtering engine from the last
+// known good snapshot.  It returns false if there is no snapshot or it can't
+// be loaded.
+func loadFiltersSnapshot() (ok bool) {
+	if !config.DNS.FilteringEnabled {
+		return false
+	}
+
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+
+	snap := Context.snapshot
+	if snap == nil {
+		return false
+	}
+
+	block, allow, err := snap.filters(filepath.Join(Context.getDataDir(), snapshotDir))
+	if err == nil {
+		// The snapshot isn't saved again when only the user rules
+		// change, so use the current ones.
+		useCurrentUserRules(block)
+		useCurrentUserRules(allow)
+
+		err = Context.dnsFilter.LoadSnapshot(block, allow)
+	}
+
+	if err != nil {
+		log.Error("%s", err)
+
+		return false
+	}
+
+	log.Info("using the snapshot saved at %s until the filters are loaded", snap.SavedAt)
+
+	return true
+}
+
+// useCurrentUserRules replaces the rules of the user rules filter within
+// filters, if any, with the ones from the configuration.
+func useCurrentUserRules(filters []dnsfilter.Filter) {
+	for i, f := range filters {
+		if f.ID == 0 {
+			filters[i].Data = userFilter().Data
+		}
+	}
+}
+
+// onFiltersApplied saves the filters which have just been applied successfully
+// as the last known good snapshot.  The snapshot is only saved again once the
+// downloaded filter lists or the upstreams change, and not on the edits of the
+// user rules or the rewrites, which also apply the filters.
+func onFiltersApplied(block, allow []dnsfilter.Filter) {
+	if Context.safeMode {
+		// The upstreams used in safe mode aren't the configured ones.
+		return
+	}
+
+	go func() {
+		snapshotLock.Lock()
+		defer snapshotLock.Unlock()
+
+		snap := &snapshot{
+			SavedAt: time.Now(),
+		}
+
+		var fromLastKnown bool
+		if Context.dnsServer != nil {
+			snap.Upstreams, fromLastKnown = Context.dnsServer.Upstreams()
+		}
+
+		if (fromLastKnown || len(snap.Upstreams) == 0) && Context.snapshot != nil {
+			// Keep the upstreams which are known to be good.
+			snap.Upstreams = Context.snapshot.Upstreams
+		}
+
+		if prev := Context.snapshot; prev != nil &&
+			!listsChanged(prev.Filters, block) &&
+			!listsChanged(prev.AllowFilters, allow) &&
+			equalStringSlices(prev.Upstreams, snap.Upstreams) {
+			log.Debug("filter lists and upstreams haven't changed, keeping snapshot")
+
+			return
+		}
+
+		err := writeSnapshot(filepath.Join(Context.getDataDir(), snapshotDir), snap, block, allow)
+		if err != nil {
+			log.Error("writing snapshot: %s", err)
+
+			return
+		}
+
+		Context.snapshot = snap
+		log.Debug("saved snapshot with %d filters", len(snap.Filters)+len(snap.AllowFilters))
+	}()
+}
@@ -0,0 +1,127 @@
+package home
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), snapshotDir)
+
+	t.Run("none", func(t *testing.T) {
+		snap, err := readSnapshot(dir)
+		require.NoError(t, err)
+
+		assert.Nil(t, snap)
+	})
+
+	listPath := filepath.Join(t.TempDir(), "1.txt")
+	err := ioutil.WriteFile(listPath, []byte("! Title: List\n\n||list.example^\n"), 0o644)
+	require.NoError(t, err)
+
+	block := []dnsfilter.Filter{{
+		ID:   0,
+		Data: []byte("# hosts\n  ||user.example^  \r\n"),
+	}, {
+		ID:       1,
+		FilePath: listPath,
+	}}
+	allow := []dnsfilter.Filter{{
+		ID:       2,
+		FilePath: listPath,
+	}}
+
+	savedAt := time.Date(2021, 4, 1, 12, 0, 0, 0, time.UTC)
+	err = writeSnapshot(dir, &snapshot{
+		SavedAt:   savedAt,
+		Upstreams: []string{"1.1.1.1"},
+	}, block, allow)
+	require.NoError(t, err)
+
+	snap, err := readSnapshot(dir)
+	require.NoError(t, err)
+	require.NotNil(t, snap)
+
+	assert.True(t, savedAt.Equal(snap.SavedAt))
+	assert.Equal(t, []string{"1.1.1.1"}, snap.Upstreams)
+
+	gotBlock, gotAllow, err := snap.filters(dir)
+	require.NoError(t, err)
+	require.Len(t, gotBlock, 2)
+	require.Len(t, gotAllow, 1)
+
+	testCases := []struct {
+		name string
+		f    dnsfilter.Filter
+		id   int64
+		want string
+	}{{
+		name: "user",
+		f:    gotBlock[0],
+		id:   0,
+		want: "# hosts\n||user.example^\n",
+	}, {
+		name: "block",
+		f:    gotBlock[1],
+		id:   1,
+		want: "||list.example^\n",
+	}, {
+		name: "allow",
+		f:    gotAllow[0],
+		id:   2,
+		want: "||list.example^\n",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.id, tc.f.ID)
+
+			data, rerr := ioutil.ReadFile(tc.f.FilePath)
+			require.NoError(t, rerr)
+
+			assert.Equal(t, tc.want, string(data))
+			if tc.id == 0 {
+				assert.Equal(t, tc.want, string(tc.f.Data))
+			}
+		})
+	}
+
+	t.Run("changed", func(t *testing.T) {
+		assert.False(t, listsChanged(snap.Filters, block))
+		assert.False(t, listsChanged(snap.AllowFilters, allow))
+
+		// The edits of the user rules don't require a new snapshot.
+		edited := []dnsfilter.Filter{{
+			ID:   0,
+			Data: []byte("||other.example^\n"),
+		}, block[1]}
+		assert.False(t, listsChanged(snap.Filters, edited))
+
+		assert.True(t, listsChanged(snap.Filters, block[:1]))
+		assert.True(t, listsChanged(snap.AllowFilters, append(allow, block[1])))
+
+		werr := ioutil.WriteFile(listPath, []byte("||list.example^\n||new.example^\n"), 0o644)
+		require.NoError(t, werr)
+
+		assert.True(t, listsChanged(snap.Filters, block))
+		assert.True(t, listsChanged(snap.AllowFilters, allow))
+	})
+
+	t.Run("replace", func(t *testing.T) {
+		err = writeSnapshot(dir, &snapshot{}, nil, nil)
+		require.NoError(t, err)
+
+		snap, err = readSnapshot(dir)
+		require.NoError(t, err)
+		require.NotNil(t, snap)
+
+		assert.Empty(t, snap.Filters)
+		assert.NoFileExists(t, gotBlock[1].FilePath)
+	})
+}
@@ -0,0 +1,47 @@
+package home
+
+import (
+	"fmt"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+)
+
+// annotateStats stores an annotation of kind with the description text in the
+// statistics, if they're initialized.
+func annotateStats(kind stats.AnnotationKind, text string) {
+	if Context.stats != nil {
+		Context.stats.Annotate(kind, text)
+	}
+}
+
+// filterTitle returns the description of the filter list f used in the
+// annotations.
+func filterTitle(f *filter) (title string) {
+	if f.Name == "" {
+		return f.URL
+	}
+
+	return fmt.Sprintf("%s (%s)", f.Name, f.URL)
+}
+
+// onProtectionChanged is the dnsforward.ServerConfig.OnProtectionChanged
+// callback.  It's called under the lock of the DNS server, so the annotation
+// is stored in a separate goroutine.
+func onProtectionChanged(enabled bool) {
+	if h := Context.execHooks; h != nil {
+		h.onProtectionChanged(enabled)
+	}
+
+	kind := stats.AnnotationProtectionDisabled
+	if enabled {
+		kind = stats.AnnotationProtectionEnabled
+	}
+
+	go annotateStats(kind, "")
+}
+
+// onUpstreamsChanged is the dnsforward.ServerConfig.OnUpstreamsChanged
+// callback.
+func onUpstreamsChanged() {
+	go annotateStats(stats.AnnotationUpstreamsChanged, "")
+}
@@ -0,0 +1,404 @@
+package home
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/gobuffalo/packr"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// strictAPIConfig defines which HTTP API requests with the parameters unknown
+// to the endpoints are rejected.  The known parameters are the ones from the
+// OpenAPI document.
+type strictAPIConfig struct {
+	// JSON makes the endpoints reject the JSON bodies with unknown fields.
+	JSON bool `yaml:"json"`
+
+	// Query makes the endpoints reject the unknown query string and form
+	// parameters.
+	Query bool `yaml:"query"`
+}
+
+// apiBasePath is the path of the OpenAPI document's server, which is the
+// prefix of the paths of its operations.
+const apiBasePath = "/control"
+
+// apiParams are the parameters of an HTTP API operation from the OpenAPI
+// document.
+type apiParams struct {
+	// query are the names of the query string parameters.
+	query []string
+
+	// jsonBody are the names of the fields of the JSON body.  They aren't
+	// checked if it's nil.
+	jsonBody []string
+
+	// formBody are the names of the fields of the form body.  They aren't
+	// checked if it's nil.
+	formBody []string
+}
+
+// apiSpec are the parameters of the HTTP API operations by the method and the
+// path, such as "POST /control/dns_config".
+type apiSpec map[string]*apiParams
+
+// openAPIBox contains the OpenAPI document.
+var openAPIBox = packr.NewBox("../../openapi")
+
+// loadedAPISpec returns the parameters of the HTTP API operations from the
+// OpenAPI document.  It's only loaded once.  It's nil if the document can't be
+// loaded, and then the parameters aren't checked.
+var loadedAPISpec = func() (f func() (spec apiSpec)) {
+	var once sync.Once
+	var spec apiSpec
+
+	return func() (s apiSpec) {
+		once.Do(func() {
+			doc, err := openAPIBox.Find("openapi.yaml")
+			if err == nil {
+				spec, err = parseAPISpec(doc)
+			}
+
+			if err != nil {
+				log.Error("strict api: loading openapi document: %s; not checking parameters", err)
+			}
+		})
+
+		return spec
+	}
+}()
+
+// yamlMap is an object decoded from YAML.
+type yamlMap = map[interface{}]interface{}
+
+// specResolver resolves the references within the OpenAPI document.
+type specResolver struct {
+	doc yamlMap
+}
+
+// resolve returns v or the value it references using "$ref".  The references
+// to the other documents aren't supported.
+func (sr *specResolver) resolve(v interface{}) (m yamlMap) {
+	// Limit the depth in case of reference loops.
+	for i := 0; i < 10; i++ {
+		m, _ = v.(yamlMap)
+		ref, ok := m["$ref"].(string)
+		if !ok {
+			return m
+		}
+
+		v = sr.doc
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			v = sr.resolve(v)[name]
+		}
+	}
+
+	return nil
+}
+
+// properties returns the sorted names of the properties of the object schema
+// s.  ok is false if the object may have other properties or s isn't an object
+// schema.
+func (sr *specResolver) properties(s interface{}) (names []string, ok bool) {
+	m := sr.resolve(s)
+	if m == nil {
+		return nil, false
+	}
+
+	if addl, has := m["additionalProperties"]; has && addl != false {
+		return nil, false
+	}
+
+	for _, key := range []string{"anyOf", "oneOf"} {
+		if _, has := m[key]; has {
+			return nil, false
+		}
+	}
+
+	props, hasProps := m["properties"].(yamlMap)
+	allOf, hasAllOf := m["allOf"].([]interface{})
+	if !hasProps && !hasAllOf {
+		return nil, false
+	}
+
+	for name := range props {
+		names = append(names, fmt.Sprint(name))
+	}
+
+	for _, sub := range allOf {
+		subNames, subOK := sr.properties(sub)
+		if !subOK {
+			return nil, false
+		}
+
+		names = append(names, subNames...)
+	}
+
+	sort.Strings(names)
+
+	return names, true
+}
+
+// operation returns the parameters of the operation op.
+func (sr *specResolver) operation(op yamlMap, common []interface{}) (p *apiParams) {
+	p = &apiParams{query: []string{}}
+
+	params, _ := op["parameters"].([]interface{})
+	for _, v := range append(common, params...) {
+		param := sr.resolve(v)
+		if param["in"] == "query" {
+			p.query = append(p.query, fmt.Sprint(param["name"]))
+		}
+	}
+
+	sort.Strings(p.query)
+
+	content, _ := sr.resolve(op["requestBody"])["content"].(yamlMap)
+	if media := sr.resolve(content["application/json"]); media != nil {
+		p.jsonBody, _ = sr.properties(media["schema"])
+	}
+
+	if media := sr.resolve(content["application/x-www-form-urlencoded"]); media != nil {
+		p.formBody, _ = sr.properties(media["schema"])
+	}
+
+	return p
+}
+
+// parseAPISpec returns the parameters of the operations of the OpenAPI
+// document doc.
+func parseAPISpec(doc []byte) (spec apiSpec, err error) {
+	sr := &specResolver{}
+	err = yaml.Unmarshal(doc, &sr.doc)
+	if err != nil {
+		return nil, fmt.Errorf("decoding: %w", err)
+	}
+
+	paths, ok := sr.doc["paths"].(yamlMap)
+	if !ok {
+		return nil, fmt.Errorf("no paths")
+	}
+
+	spec = apiSpec{}
+	for p, v := range paths {
+		item := sr.resolve(v)
+		common, _ := item["parameters"].([]interface{})
+		for method, opv := range item {
+			op, isOp := opv.(yamlMap)
+			methodStr := strings.ToUpper(fmt.Sprint(method))
+			if !isOp || methodStr == "PARAMETERS" {
+				continue
+			}
+
+			key := methodStr + " " + path.Join(apiBasePath, fmt.Sprint(p))
+			spec[key] = sr.operation(op, common)
+		}
+	}
+
+	return spec, nil
+}
+
+// unknownParam is a parameter unknown to an endpoint.
+type unknownParam struct {
+	// Name is the name of the parameter.
+	Name string `json:"name"`
+
+	// Suggestion is the closest known name, if there is a close enough one.
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// unknownParamsErrorJSON is the response to a request with the parameters
+// unknown to the endpoint.
+type unknownParamsErrorJSON struct {
+	// Code is always "unknown_parameters".
+	Code    string          `json:"code"`
+	Message string          `json:"message"`
+	Unknown []*unknownParam `json:"unknown"`
+}
+
+// editDistance returns the Levenshtein distance between a and b.
+func editDistance(a, b string) (d int) {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+// minInt returns the lesser of a and b.
+func minInt(a, b int) (m int) {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// closestName returns the name from known closest to name or an empty string
+// if none is close enough to be a typo.
+func closestName(name string, known []string) (closest string) {
+	best := len(name)/3 + 1
+	for _, k := range known {
+		if d := editDistance(name, k); d <= best {
+			best, closest = d, k
+		}
+	}
+
+	return closest
+}
+
+// unknownParams returns the names from names missing in known along with the
+// suggestions.
+func unknownParams(names, known []string) (unknown []*unknownParam) {
+	for _, name := range names {
+		i := sort.SearchStrings(known, name)
+		if i < len(known) && known[i] == name {
+			continue
+		}
+
+		unknown = append(unknown, &unknownParam{
+			Name:       name,
+			Suggestion: closestName(name, known),
+		})
+	}
+
+	sort.Slice(unknown, func(i, j int) (less bool) { return unknown[i].Name < unknown[j].Name })
+
+	return unknown
+}
+
+// requestParams returns the names of the parameters of r unknown to the
+// operation p according to conf.  The body is read from r and replaced with
+// a copy.
+func requestParams(r *http.Request, p *apiParams, conf strictAPIConfig) (unknown []*unknownParam, err error) {
+	if conf.Query {
+		var names []string
+		for name := range r.URL.Query() {
+			names = append(names, name)
+		}
+
+		unknown = unknownParams(names, p.query)
+	}
+
+	var known []string
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch {
+	case p.formBody != nil && conf.Query && mediaType == "application/x-www-form-urlencoded":
+		known = p.formBody
+	case p.jsonBody != nil && conf.JSON && mediaType != "application/x-www-form-urlencoded":
+		known = p.jsonBody
+	default:
+		return unknown, nil
+	}
+
+	if r.Body == nil {
+		return unknown, nil
+	}
+
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading body: %w", err)
+	}
+
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	var names []string
+	if mediaType == "application/x-www-form-urlencoded" {
+		form, ferr := url.ParseQuery(string(body))
+		if ferr != nil {
+			// Let the handler report the invalid body.
+			return unknown, nil
+		}
+
+		for name := range form {
+			names = append(names, name)
+		}
+	} else {
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(body, &obj) != nil {
+			// Let the handler report the invalid body, which may also be a
+			// JSON value other than an object.
+			return unknown, nil
+		}
+
+		for name := range obj {
+			names = append(names, name)
+		}
+	}
+
+	return append(unknown, unknownParams(names, known)...), nil
+}
+
+// checkParams returns true if the request r has no parameters unknown to its
+// endpoint.  Otherwise, it responds with 400 Bad Request.
+func checkParams(w http.ResponseWriter, r *http.Request) (ok bool) {
+	config.RLock()
+	conf := config.StrictAPI
+	config.RUnlock()
+
+	if !conf.JSON && !conf.Query {
+		return true
+	}
+
+	p := loadedAPISpec()[r.Method+" "+r.URL.Path]
+	if p == nil {
+		return true
+	}
+
+	unknown, err := requestParams(r, p, conf)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return false
+	} else if len(unknown) == 0 {
+		return true
+	}
+
+	names := make([]string, 0, len(unknown))
+	for _, u := range unknown {
+		names = append(names, u.Name)
+	}
+
+	msg := fmt.Sprintf("unknown parameters: %s", strings.Join(names, ", "))
+	log.Info("strict api: %s %s: %s", r.Method, r.URL.Path, msg)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	err = json.NewEncoder(w).Encode(unknownParamsErrorJSON{
+		Code:    "unknown_parameters",
+		Message: msg,
+		Unknown: unknown,
+	})
+	if err != nil {
+		log.Debug("writing unknown parameters error: %s", err)
+	}
+
+	return false
+}
@@ -0,0 +1,237 @@
+package home
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAPIDoc = `
+'paths':
+  '/things':
+    'parameters':
+    - 'name': 'common'
+      'in': 'query'
+    'get':
+      'parameters':
+      - '$ref': '#/components/parameters/Limit'
+      - 'name': 'X-Header'
+        'in': 'header'
+    'post':
+      'requestBody':
+        '$ref': '#/components/requestBodies/Thing'
+  '/things/free':
+    'post':
+      'requestBody':
+        'content':
+          'application/json':
+            'schema':
+              'type': 'object'
+              'additionalProperties':
+                'type': 'string'
+  '/things/form':
+    'post':
+      'requestBody':
+        'content':
+          'application/x-www-form-urlencoded':
+            'schema':
+              'type': 'object'
+              'properties':
+                'name':
+                  'type': 'string'
+'components':
+  'parameters':
+    'Limit':
+      'name': 'limit'
+      'in': 'query'
+  'requestBodies':
+    'Thing':
+      'content':
+        'application/json':
+          'schema':
+            '$ref': '#/components/schemas/Thing'
+  'schemas':
+    'Base':
+      'type': 'object'
+      'properties':
+        'name':
+          'type': 'string'
+    'Thing':
+      'allOf':
+      - '$ref': '#/components/schemas/Base'
+      - 'type': 'object'
+        'properties':
+          'enabled':
+            'type': 'boolean'
+`
+
+func TestParseAPISpec(t *testing.T) {
+	spec, err := parseAPISpec([]byte(testAPIDoc))
+	require.NoError(t, err)
+
+	require.Len(t, spec, 4)
+
+	p := spec["GET /control/things"]
+	require.NotNil(t, p)
+	assert.Equal(t, []string{"common", "limit"}, p.query)
+	assert.Nil(t, p.jsonBody)
+
+	p = spec["POST /control/things"]
+	require.NotNil(t, p)
+	assert.Equal(t, []string{"common"}, p.query)
+	assert.Equal(t, []string{"enabled", "name"}, p.jsonBody)
+
+	p = spec["POST /control/things/free"]
+	require.NotNil(t, p)
+	assert.Nil(t, p.jsonBody)
+
+	p = spec["POST /control/things/form"]
+	require.NotNil(t, p)
+	assert.Nil(t, p.jsonBody)
+	assert.Equal(t, []string{"name"}, p.formBody)
+}
+
+func TestClosestName(t *testing.T) {
+	known := []string{"enabled", "interval", "anonymize_client_ip"}
+
+	assert.Equal(t, "enabled", closestName("enbaled", known))
+	assert.Equal(t, "interval", closestName("intervall", known))
+	assert.Equal(t, "anonymize_client_ip", closestName("anonymise_client_ip", known))
+	assert.Empty(t, closestName("upstream_dns", known))
+}
+
+func TestCheckParams(t *testing.T) {
+	prev := config.StrictAPI
+	t.Cleanup(func() { config.StrictAPI = prev })
+
+	require.NotNil(t, loadedAPISpec())
+
+	check := func(t *testing.T, method, target, contentType, body string) (w *httptest.ResponseRecorder, ok bool) {
+		t.Helper()
+
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+
+		w = httptest.NewRecorder()
+		ok = checkParams(w, r)
+		if ok {
+			// The body is still available to the handler.
+			b, err := ioutil.ReadAll(r.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, string(b))
+		}
+
+		return w, ok
+	}
+
+	config.StrictAPI = strictAPIConfig{JSON: true}
+
+	t.Run("json_known", func(t *testing.T) {
+		_, ok := check(t, http.MethodPost, "/control/querylog_config", "", `{"enabled":true,"interval":7}`)
+		assert.True(t, ok)
+	})
+
+	t.Run("json_unknown", func(t *testing.T) {
+		w, ok := check(t, http.MethodPost, "/control/querylog_config", "application/json", `{"enbaled":true,"foo":1}`)
+		require.False(t, ok)
+		require.Equal(t, http.StatusBadRequest, w.Code)
+
+		resp := &unknownParamsErrorJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		assert.Equal(t, "unknown_parameters", resp.Code)
+		assert.Equal(t, []*unknownParam{{
+			Name:       "enbaled",
+			Suggestion: "enabled",
+		}, {
+			Name: "foo",
+		}}, resp.Unknown)
+	})
+
+	t.Run("json_invalid", func(t *testing.T) {
+		_, ok := check(t, http.MethodPost, "/control/querylog_config", "", `[1, 2]`)
+		assert.True(t, ok)
+	})
+
+	t.Run("query_legacy", func(t *testing.T) {
+		_, ok := check(t, http.MethodGet, "/control/querylog?limt=10", "", "")
+		assert.True(t, ok)
+	})
+
+	config.StrictAPI = strictAPIConfig{JSON: true, Query: true}
+
+	t.Run("query_unknown", func(t *testing.T) {
+		w, ok := check(t, http.MethodGet, "/control/querylog?limt=10&search=a", "", "")
+		require.False(t, ok)
+
+		resp := &unknownParamsErrorJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		assert.Equal(t, []*unknownParam{{Name: "limt", Suggestion: "limit"}}, resp.Unknown)
+	})
+
+	config.StrictAPI = strictAPIConfig{}
+
+	t.Run("disabled", func(t *testing.T) {
+		_, ok := check(t, http.MethodPost, "/control/querylog_config", "", `{"enbaled":true}`)
+		assert.True(t, ok)
+	})
+}
+
+// jsonFields returns the names of the JSON fields of the struct type typ,
+// including the ones of the embedded structs.
+func jsonFields(typ reflect.Type) (names []string) {
+	for i := 0; i < typ.NumField(); i++ {
+		f := typ.Field(i)
+		name := strings.Split(f.Tag.Get("json"), ",")[0]
+		if f.Anonymous && f.Type.Kind() == reflect.Struct && name == "" {
+			names = append(names, jsonFields(f.Type)...)
+		} else if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+
+	return names
+}
+
+// TestAPISpec_handlers checks that the OpenAPI document knows all the fields
+// the handlers accept, so that the strict mode doesn't reject them.
+func TestAPISpec_handlers(t *testing.T) {
+	testCases := []struct {
+		typ interface{}
+		op  string
+		// respOnly are the fields which are only sent in the responses.
+		respOnly *aghstrings.Set
+	}{{
+		typ:      clientJSON{},
+		op:       "POST /control/clients/add",
+		respOnly: aghstrings.NewSet("disallowed", "disallowed_rule", "whois_info"),
+	}, {
+		typ: tlsConfigSettings{},
+		op:  "POST /control/tls/configure",
+	}}
+
+	spec := loadedAPISpec()
+	for _, tc := range testCases {
+		t.Run(tc.op, func(t *testing.T) {
+			p := spec[tc.op]
+			require.NotNil(t, p)
+			require.NotNil(t, p.jsonBody)
+
+			for _, name := range jsonFields(reflect.TypeOf(tc.typ)) {
+				if !tc.respOnly.Has(name) {
+					assert.Contains(t, p.jsonBody, name)
+				}
+			}
+		})
+	}
+}
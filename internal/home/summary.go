@@ -0,0 +1,168 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsforward"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// summaryCacheTTL is the time the summary is served from the cache, so that
+// it's cheap for several clients to poll it every few seconds.
+const summaryCacheTTL = 5 * time.Second
+
+// summaryHours is the number of the hours in the hourly numbers of the
+// requests within the summary.
+const summaryHours = 24
+
+// Names of the unhealthy subsystems in the summary.
+const (
+	summaryUnhealthyDNS       = "dns"
+	summaryUnhealthyUpstreams = "upstreams"
+	summaryUnhealthyNetwork   = "network"
+	summaryUnhealthyFilters   = "filters"
+	summaryUnhealthyStorage   = "storage"
+	summaryUnhealthyStats     = "stats"
+)
+
+// summaryJSON is the response to the GET /control/summary request.  Its shape
+// is stable: all fields are always present and the arrays are never null.
+type summaryJSON struct {
+	// UpdatedAt is the time the summary has been assembled.
+	UpdatedAt string `json:"updated_at"`
+
+	// Unhealthy are the names of the unhealthy subsystems.
+	Unhealthy []string `json:"unhealthy"`
+
+	// HourlyDNSQueries are the numbers of the requests within each of the
+	// last summaryHours hours, the oldest first.  There are always
+	// summaryHours of them.
+	HourlyDNSQueries []uint64 `json:"hourly_dns_queries"`
+
+	DNSQueriesToday uint64  `json:"dns_queries_today"`
+	BlockedToday    uint64  `json:"blocked_today"`
+	BlockedPercent  float64 `json:"blocked_percent"`
+
+	ProtectionEnabled bool `json:"protection_enabled"`
+	Healthy           bool `json:"healthy"`
+}
+
+// summaryHandler serves the summary from the cache.
+type summaryHandler struct {
+	// mu protects all the fields.  It's held while the summary is
+	// assembled, so that the simultaneous requests do it only once.
+	mu sync.Mutex
+
+	// data is the cached response.
+	data []byte
+
+	// cachedAt is the time data has been cached.
+	cachedAt time.Time
+}
+
+// cached returns the cached response or refreshes it, if it's expired.
+func (h *summaryHandler) cached(now time.Time) (data []byte, err error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.data != nil && now.Sub(h.cachedAt) < summaryCacheTTL {
+		return h.data, nil
+	}
+
+	data, err = json.Marshal(newSummary(now))
+	if err != nil {
+		return nil, err
+	}
+
+	h.data, h.cachedAt = data, now
+
+	return data, nil
+}
+
+// newSummary assembles the summary from the statistics and the state of the
+// subsystems without reading the query log.
+func newSummary(now time.Time) (s *summaryJSON) {
+	s = &summaryJSON{
+		UpdatedAt:        aghtime.Format(now, time.RFC3339),
+		Unhealthy:        []string{},
+		HourlyDNSQueries: make([]uint64, summaryHours),
+	}
+
+	if Context.stats != nil {
+		if sum, ok := Context.stats.Summary(); ok {
+			copy(s.HourlyDNSQueries, sum.Hourly)
+			s.DNSQueriesToday = sum.DNSQueries
+			s.BlockedToday = sum.BlockedFiltering
+			if sum.DNSQueries > 0 {
+				s.BlockedPercent = float64(sum.BlockedFiltering) / float64(sum.DNSQueries) * 100
+			}
+		} else {
+			s.Unhealthy = append(s.Unhealthy, summaryUnhealthyStats)
+		}
+	}
+
+	if srv := Context.dnsServer; srv != nil && srv.IsRunning() {
+		c := dnsforward.FilteringConfig{}
+		srv.WriteDiskConfig(&c)
+		s.ProtectionEnabled = c.ProtectionEnabled
+
+		if _, fromSnapshot := srv.Upstreams(); fromSnapshot {
+			s.Unhealthy = append(s.Unhealthy, summaryUnhealthyUpstreams)
+		}
+
+		if srv.Hijacking().Detected {
+			s.Unhealthy = append(s.Unhealthy, summaryUnhealthyNetwork)
+		}
+	} else {
+		s.Unhealthy = append(s.Unhealthy, summaryUnhealthyDNS)
+	}
+
+	if filtersFailed() {
+		s.Unhealthy = append(s.Unhealthy, summaryUnhealthyFilters)
+	}
+
+	if memOnly, _ := Context.writeGuards.memoryOnly(); len(memOnly) > 0 {
+		s.Unhealthy = append(s.Unhealthy, summaryUnhealthyStorage)
+	}
+
+	s.Healthy = len(s.Unhealthy) == 0
+
+	return s
+}
+
+// filtersFailed returns true if any of the enabled filter lists has failed to
+// load or update last time.
+func filtersFailed() (failed bool) {
+	config.RLock()
+	defer config.RUnlock()
+
+	for _, fs := range [][]filter{config.Filters, config.WhitelistFilters} {
+		for _, f := range fs {
+			if f.Enabled && f.lastErr != nil {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// handleSummary is the handler for the GET /control/summary HTTP API.
+func (h *summaryHandler) handleSummary(w http.ResponseWriter, _ *http.Request) {
+	data, err := h.cached(time.Now())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "encoding summary: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, err = w.Write(data)
+	if err != nil {
+		log.Debug("summary: writing response: %s", err)
+	}
+}
@@ -0,0 +1,88 @@
+package home
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSummaryHandler(t *testing.T) {
+	s, err := stats.New(stats.Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	for _, res := range []stats.Result{stats.RFiltered, stats.RNotFiltered, stats.RNotFiltered, stats.RNotFiltered} {
+		s.Update(stats.Entry{
+			Domain: "example.org",
+			Client: "192.168.1.2",
+			Result: res,
+		})
+	}
+
+	prevStats, prevServer := Context.stats, Context.dnsServer
+	prevFilters, prevAllowlists := config.Filters, config.WhitelistFilters
+	t.Cleanup(func() {
+		Context.stats = prevStats
+		Context.dnsServer = prevServer
+		config.Filters, config.WhitelistFilters = prevFilters, prevAllowlists
+	})
+	Context.stats = s
+	Context.dnsServer = nil
+	config.Filters, config.WhitelistFilters = nil, nil
+
+	h := &summaryHandler{}
+	get := func() (resp *summaryJSON) {
+		r := httptest.NewRequest(http.MethodGet, "/control/summary", nil)
+		w := httptest.NewRecorder()
+		h.handleSummary(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = &summaryJSON{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp
+	}
+
+	resp := get()
+	assert.EqualValues(t, 4, resp.DNSQueriesToday)
+	assert.EqualValues(t, 1, resp.BlockedToday)
+	assert.Equal(t, 25.0, resp.BlockedPercent)
+
+	require.Len(t, resp.HourlyDNSQueries, summaryHours)
+	assert.EqualValues(t, 4, resp.HourlyDNSQueries[summaryHours-1])
+
+	// The DNS server isn't running.
+	assert.False(t, resp.Healthy)
+	assert.Equal(t, []string{summaryUnhealthyDNS}, resp.Unhealthy)
+	assert.False(t, resp.ProtectionEnabled)
+
+	// The response is served from the cache.
+	s.Update(stats.Entry{
+		Domain: "example.org",
+		Client: "192.168.1.2",
+		Result: stats.RNotFiltered,
+	})
+	assert.EqualValues(t, 4, get().DNSQueriesToday)
+
+	h.cachedAt = h.cachedAt.Add(-summaryCacheTTL)
+	assert.EqualValues(t, 5, get().DNSQueriesToday)
+
+	t.Run("no_stats", func(t *testing.T) {
+		Context.stats = nil
+
+		sum := newSummary(time.Now())
+		assert.Len(t, sum.HourlyDNSQueries, summaryHours)
+		assert.Zero(t, sum.DNSQueriesToday)
+		assert.NotNil(t, sum.Unhealthy)
+	})
+}
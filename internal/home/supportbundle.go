@@ -0,0 +1,552 @@
+package home
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/version"
+	yaml "gopkg.in/yaml.v2"
+)
+
+const (
+	// defaultSupportLogLines is the number of the last lines of the log
+	// included into the support bundle by default.
+	defaultSupportLogLines = 1000
+
+	// maxSupportLogLines is the largest number of the last lines of the log
+	// included into the support bundle.
+	maxSupportLogLines = 10000
+
+	// maxSupportLogLineLen is the expected length of a log line used to
+	// bound the part of the log file read.
+	maxSupportLogLineLen = 1024
+
+	// maxSupportQueryLogEntries is the largest number of the query log
+	// entries included into the support bundle.
+	maxSupportQueryLogEntries = 1000
+
+	// redactedValue replaces the secrets within the support bundle.
+	redactedValue = "REDACTED"
+
+	// minScrubLen is the length of the shortest redacted value, which is
+	// also scrubbed from the rest of the bundle.  The shorter ones are too
+	// likely to be parts of unrelated words.
+	minScrubLen = 4
+)
+
+// Names of the files within the support bundle.
+const (
+	bundleFileVersion   = "version.txt"
+	bundleFileConfig    = "config_redacted.yaml"
+	bundleFileLog       = "log_tail.txt"
+	bundleFileUpstreams = "upstream_health.json"
+	bundleFileFiltering = "filtering_status.json"
+	bundleFileRuntime   = "debug_runtime.json"
+	bundleFileQueryLog  = "querylog_sample_anonymized.json"
+)
+
+// redactor replaces the secrets and the client identifiers within the support
+// bundle.  The identifiers are replaced with their keyed hashes, so that the
+// same identifier looks the same across the bundle but can't be guessed.
+type redactor struct {
+	// key is the random key of the hashes.  It's different for each
+	// bundle.
+	key []byte
+
+	// replacements maps the redacted values to their replacements, so that
+	// these are scrubbed from the rest of the bundle as well.
+	replacements map[string]string
+
+	// redactions are the redactions of the values within the configuration
+	// file by their paths, see configRedactions.
+	redactions map[string]func(r *redactor, s string) (res string)
+}
+
+// newRedactor returns a new redactor with a random key.
+func newRedactor() (r *redactor, err error) {
+	key := make([]byte, sha256.Size)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generating hash key: %w", err)
+	}
+
+	return &redactor{
+		key:          key,
+		replacements: map[string]string{},
+		redactions:   configRedactions,
+	}, nil
+}
+
+// record makes the scrub replace s with repl.
+func (r *redactor) record(s, repl string) {
+	if len(s) >= minScrubLen {
+		r.replacements[s] = repl
+	}
+}
+
+// secret returns the replacement of the secret s.
+func (r *redactor) secret(s string) (res string) {
+	if s == "" {
+		return ""
+	}
+
+	r.record(s, redactedValue)
+
+	return redactedValue
+}
+
+// hash returns the keyed hash of the identifier s.
+func (r *redactor) hash(s string) (res string) {
+	if s == "" {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, r.key)
+	_, _ = mac.Write([]byte(s))
+	res = "hash:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	r.record(s, res)
+
+	return res
+}
+
+// url returns s with the credentials and the query redacted.  If hashPath is
+// true, the path is hashed as well, since some DNS-over-HTTPS providers
+// identify the accounts by it.  s is returned as is if it isn't a URL.
+func (r *redactor) url(s string, hashPath bool) (res string) {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" || u.Host == "" {
+		return s
+	}
+
+	changed := false
+	if u.User != nil {
+		r.record(u.User.Username(), redactedValue)
+		if p, ok := u.User.Password(); ok {
+			r.record(p, redactedValue)
+		}
+
+		u.User, changed = url.User(redactedValue), true
+	}
+
+	if u.RawQuery != "" {
+		r.record(u.RawQuery, redactedValue)
+		u.RawQuery, changed = redactedValue, true
+	}
+
+	if hashPath && u.Path != "" && u.Path != "/" && u.Path != "/dns-query" {
+		u.Path, changed = "/"+r.hash(strings.TrimPrefix(u.Path, "/")), true
+	}
+
+	if !changed {
+		return s
+	}
+
+	res = u.String()
+	r.record(s, res)
+
+	return res
+}
+
+// plainURL returns the URL s with the credentials and the query redacted.
+func (r *redactor) plainURL(s string) (res string) {
+	return r.url(s, false)
+}
+
+// upstream returns the upstream line s with the address redacted.
+func (r *redactor) upstream(s string) (res string) {
+	var prefix string
+	if strings.HasPrefix(s, "[/") {
+		if i := strings.Index(s, "]"); i > 0 {
+			prefix, s = s[:i+1], s[i+1:]
+		}
+	}
+
+	return prefix + r.url(s, true)
+}
+
+// configRedactions are the redactions of the values within the configuration
+// file by their paths.  The path is the keys of the nested mappings joined with
+// dots, the sequences aren't reflected in it.  The redaction of a sequence
+// applies to each of its elements.
+var configRedactions = map[string]func(r *redactor, s string) (res string){
+	"users.name":                   (*redactor).hash,
+	"users.password":               (*redactor).secret,
+	"api_tokens.token_hash":        (*redactor).secret,
+	"pin_bypass.pin_hash":          (*redactor).secret,
+	"http_proxy":                   (*redactor).plainURL,
+	"dns.allowed_clients":          (*redactor).hash,
+	"dns.disallowed_clients":       (*redactor).hash,
+	"dns.ratelimit_whitelist":      (*redactor).hash,
+	"dns.upstream_dns":             (*redactor).upstream,
+	"dns.bootstrap_dns":            (*redactor).upstream,
+	"dns.local_ptr_upstreams":      (*redactor).upstream,
+	"dns.upstream_options.address": (*redactor).upstream,
+	"tls.certificate_chain":        (*redactor).secret,
+	"tls.private_key":              (*redactor).secret,
+	"filters.url":                  (*redactor).plainURL,
+	"whitelist_filters.url":        (*redactor).plainURL,
+	"user_rules":                   (*redactor).hash,
+	"clients.name":                 (*redactor).hash,
+	"clients.ids":                  (*redactor).hash,
+	"clients.upstreams":            (*redactor).upstream,
+}
+
+// config returns the configuration file data with the secrets and the client
+// identifiers redacted.
+func (r *redactor) config(data []byte) (res []byte, err error) {
+	conf := yaml.MapSlice{}
+	err = yaml.Unmarshal(data, &conf)
+	if err != nil {
+		return nil, fmt.Errorf("decoding config: %w", err)
+	}
+
+	r.node("", conf)
+
+	return yaml.Marshal(conf)
+}
+
+// node redacts the values within the YAML node v located at path.
+func (r *redactor) node(path string, v interface{}) (res interface{}) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i, item := range v {
+			key := fmt.Sprint(item.Key)
+			if path != "" {
+				key = path + "." + key
+			}
+
+			if redact, ok := r.redactions[key]; ok {
+				v[i].Value = r.apply(redact, item.Value)
+			} else {
+				v[i].Value = r.node(key, item.Value)
+			}
+		}
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = r.node(path, elem)
+		}
+	}
+
+	return v
+}
+
+// apply redacts the scalar v or each element of the sequence v with redact.
+// The mappings are replaced altogether.
+func (r *redactor) apply(redact func(r *redactor, s string) (res string), v interface{}) (res interface{}) {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return redact(r, v)
+	case []interface{}:
+		for i, elem := range v {
+			v[i] = r.apply(redact, elem)
+		}
+
+		return v
+	case yaml.MapSlice:
+		return redactedValue
+	default:
+		return redact(r, fmt.Sprint(v))
+	}
+}
+
+// scrub replaces all the values redacted so far within data.
+func (r *redactor) scrub(data []byte) (res []byte) {
+	olds := make([]string, 0, len(r.replacements))
+	for s := range r.replacements {
+		olds = append(olds, s)
+	}
+
+	// Replace the longer values first, since those may contain the shorter
+	// ones.
+	sort.Slice(olds, func(i, j int) bool {
+		return len(olds[i]) > len(olds[j])
+	})
+
+	pairs := make([]string, 0, 2*len(olds))
+	for _, s := range olds {
+		pairs = append(pairs, s, r.replacements[s])
+	}
+
+	return []byte(strings.NewReplacer(pairs...).Replace(string(data)))
+}
+
+// tailLines returns the last n lines of the file fn.
+func tailLines(fn string, n int) (data []byte, err error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
+
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	off := fi.Size() - int64(n*maxSupportLogLineLen)
+	if off > 0 {
+		_, err = f.Seek(off, io.SeekStart)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	data, err = ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := bytes.SplitAfter(data, []byte{'\n'})
+	if off > 0 && len(lines) > 0 {
+		// The first line is most probably cut.
+		lines = lines[1:]
+	}
+
+	if len(lines) > 0 && len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return bytes.Join(lines, nil), nil
+}
+
+// supportBundleParams are the sources of the support bundle data.
+type supportBundleParams struct {
+	// config is the data of the configuration file.
+	config []byte
+
+	// logFile is the path to the log file.  It's empty if the log isn't
+	// written into a file.
+	logFile string
+
+	// logLines is the number of the last lines of the log to include.
+	logLines int
+
+	// queryLogEntries is the number of the last query log entries to
+	// include.  Zero means none.
+	queryLogEntries int
+}
+
+// supportBundle writes the files of the support bundle into a ZIP archive.
+type supportBundle struct {
+	r  *redactor
+	zw *zip.Writer
+}
+
+// add writes the file with name and data into the bundle.  The redacted values
+// are scrubbed from data unless it's the redacted configuration itself.
+func (b *supportBundle) add(name string, data []byte) (err error) {
+	if name != bundleFileConfig {
+		data = b.r.scrub(data)
+	}
+
+	fw, err := b.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("adding %s: %w", name, err)
+	}
+
+	_, err = fw.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// addJSON writes v encoded as JSON into the bundle as the file with name.
+func (b *supportBundle) addJSON(name string, v interface{}) (err error) {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encoding %s: %w", name, err)
+	}
+
+	return b.add(name, data)
+}
+
+// writeSupportBundle writes the support bundle into w as a ZIP archive.  The
+// configuration is redacted first, so that the values it has redacted are
+// scrubbed from the rest of the files.
+func writeSupportBundle(w io.Writer, p *supportBundleParams) (err error) {
+	r, err := newRedactor()
+	if err != nil {
+		return err
+	}
+
+	b := &supportBundle{
+		r:  r,
+		zw: zip.NewWriter(w),
+	}
+
+	conf, err := r.config(p.config)
+	if err != nil {
+		return err
+	}
+
+	err = b.add(bundleFileConfig, conf)
+	if err != nil {
+		return err
+	}
+
+	err = b.add(bundleFileVersion, []byte(version.Verbose()+"\n"))
+	if err != nil {
+		return err
+	}
+
+	logData := []byte("the log isn't written into a file\n")
+	if p.logFile != "" {
+		logData, err = tailLines(p.logFile, p.logLines)
+		if err != nil {
+			logData = []byte(fmt.Sprintf("reading log: %s\n", err))
+		}
+	}
+
+	err = b.add(bundleFileLog, logData)
+	if err != nil {
+		return err
+	}
+
+	if s := Context.dnsServer; s != nil {
+		buf := &bytes.Buffer{}
+		err = s.WriteUpstreamHealth(buf)
+		if err != nil {
+			return fmt.Errorf("encoding %s: %w", bundleFileUpstreams, err)
+		}
+
+		err = b.add(bundleFileUpstreams, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	if Context.dnsFilter != nil {
+		st := Context.filters.status()
+		// The configuration contains the hashes of the user rules.
+		st.UserRules = nil
+
+		err = b.addJSON(bundleFileFiltering, st)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = b.addJSON(bundleFileRuntime, debugRuntime())
+	if err != nil {
+		return err
+	}
+
+	if ql := Context.queryLog; ql != nil && p.queryLogEntries > 0 {
+		buf := &bytes.Buffer{}
+		err = ql.WriteAnonymizedSample(buf, p.queryLogEntries)
+		if err != nil {
+			return fmt.Errorf("writing %s: %w", bundleFileQueryLog, err)
+		}
+
+		err = b.add(bundleFileQueryLog, buf.Bytes())
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.zw.Close()
+}
+
+// supportBundleParam returns the value of the integer query parameter name from
+// q.  def is returned if it isn't set.
+func supportBundleParam(q url.Values, name string, def, max int) (n int, err error) {
+	s := q.Get(name)
+	if s == "" {
+		return def, nil
+	}
+
+	n, err = strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", name, err)
+	} else if n < 0 || n > max {
+		return 0, fmt.Errorf("%s must be between 0 and %d", name, max)
+	}
+
+	return n, nil
+}
+
+// handleSupportBundle is the handler for the GET /control/support_bundle HTTP
+// API.  The configuration is read from the file, so the changes not written
+// yet aren't reflected in it.
+func handleSupportBundle(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	p := &supportBundleParams{
+		logFile: Context.logFile,
+	}
+
+	var err error
+	p.logLines, err = supportBundleParam(q, "log_lines", defaultSupportLogLines, maxSupportLogLines)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	p.queryLogEntries, err = supportBundleParam(q, "querylog_entries", 0, maxSupportQueryLogEntries)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	p.config, err = ioutil.ReadFile(config.getConfigFilename())
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "reading config: %s", err)
+
+		return
+	}
+
+	// Decrypt the secrets, so that they are redacted and scrubbed from the
+	// rest of the bundle as the plain ones are.
+	p.config, err = decryptConfig(Context.secrets, p.config)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "decrypting config: %s", err)
+
+		return
+	}
+
+	buf := &bytes.Buffer{}
+	err = writeSupportBundle(buf, p)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "writing support bundle: %s", err)
+
+		return
+	}
+
+	fn := fmt.Sprintf("AdGuardHome-support-%s.zip", time.Now().UTC().Format("20060102-150405"))
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", fn))
+	_, _ = w.Write(buf.Bytes())
+}
@@ -22,6 +22,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/golibs/log"
 	"golang.org/x/sys/cpu"
 )
@@ -49,6 +50,7 @@ func tlsCreate(conf tlsConfigSettings) *TLSMod {
 				PortHTTPS:           conf.PortHTTPS,
 				PortDNSOverTLS:      conf.PortDNSOverTLS,
 				PortDNSOverQUIC:     conf.PortDNSOverQUIC,
+				ServeHTTP3:          conf.ServeHTTP3,
 				AllowUnencryptedDOH: conf.AllowUnencryptedDOH,
 			}}
 		}
@@ -189,13 +191,13 @@ func tlsLoadConfig(tls *tlsConfigSettings, status *tlsConfigStatus) bool {
 }
 
 type tlsConfigStatus struct {
-	ValidCert  bool      `json:"valid_cert"`           // ValidCert is true if the specified certificates chain is a valid chain of X509 certificates
-	ValidChain bool      `json:"valid_chain"`          // ValidChain is true if the specified certificates chain is verified and issued by a known CA
-	Subject    string    `json:"subject,omitempty"`    // Subject is the subject of the first certificate in the chain
-	Issuer     string    `json:"issuer,omitempty"`     // Issuer is the issuer of the first certificate in the chain
-	NotBefore  time.Time `json:"not_before,omitempty"` // NotBefore is the NotBefore field of the first certificate in the chain
-	NotAfter   time.Time `json:"not_after,omitempty"`  // NotAfter is the NotAfter field of the first certificate in the chain
-	DNSNames   []string  `json:"dns_names"`            // DNSNames is the value of SubjectAltNames field of the first certificate in the chain
+	ValidCert  bool         `json:"valid_cert"`           // ValidCert is true if the specified certificates chain is a valid chain of X509 certificates
+	ValidChain bool         `json:"valid_chain"`          // ValidChain is true if the specified certificates chain is verified and issued by a known CA
+	Subject    string       `json:"subject,omitempty"`    // Subject is the subject of the first certificate in the chain
+	Issuer     string       `json:"issuer,omitempty"`     // Issuer is the issuer of the first certificate in the chain
+	NotBefore  aghtime.Time `json:"not_before,omitempty"` // NotBefore is the NotBefore field of the first certificate in the chain
+	NotAfter   aghtime.Time `json:"not_after,omitempty"`  // NotAfter is the NotAfter field of the first certificate in the chain
+	DNSNames   []string     `json:"dns_names"`            // DNSNames is the value of SubjectAltNames field of the first certificate in the chain
 
 	// key status
 	ValidKey bool   `json:"valid_key"`          // ValidKey is true if the key is a valid private key
@@ -224,6 +226,29 @@ func (t *TLSMod) handleTLSStatus(w http.ResponseWriter, _ *http.Request) {
 	marshalTLS(w, data)
 }
 
+// validateHTTP3Port returns an error if HTTP/3 is enabled in setts and its UDP
+// port is the same as the one of the DNS-over-UDP, DNS-over-QUIC, or DNSCrypt
+// listener.  dnsPort is the port of the plain DNS.
+func validateHTTP3Port(setts tlsConfigSettings, dnsPort int) (err error) {
+	if !setts.ServeHTTP3 || setts.PortHTTPS == 0 {
+		return nil
+	}
+
+	var proto string
+	switch setts.PortHTTPS {
+	case dnsPort:
+		proto = "plain dns"
+	case setts.PortDNSOverQUIC:
+		proto = "dns-over-quic"
+	case setts.PortDNSCrypt:
+		proto = "dnscrypt"
+	default:
+		return nil
+	}
+
+	return fmt.Errorf("udp port %d is used by %s, cannot serve http/3 on it", setts.PortHTTPS, proto)
+}
+
 func (t *TLSMod) handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 	setts, err := unmarshalTLS(r)
 	if err != nil {
@@ -236,6 +261,13 @@ func (t *TLSMod) handleTLSValidate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = validateHTTP3Port(setts, config.DNS.Port)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	status := tlsConfigStatus{}
 	if tlsLoadConfig(&setts, &status) {
 		status = validateCertificates(string(setts.CertificateChainData), string(setts.PrivateKeyData), setts.ServerName)
@@ -260,6 +292,13 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	err = validateHTTP3Port(data, config.DNS.Port)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
 	status := tlsConfigStatus{}
 	if !tlsLoadConfig(&data, &status) {
 		data2 := tlsConfig{
@@ -283,6 +322,7 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 	t.conf.PortHTTPS = data.PortHTTPS
 	t.conf.PortDNSOverTLS = data.PortDNSOverTLS
 	t.conf.PortDNSOverQUIC = data.PortDNSOverQUIC
+	t.conf.ServeHTTP3 = data.ServeHTTP3
 	t.conf.CertificateChain = data.CertificateChain
 	t.conf.CertificatePath = data.CertificatePath
 	t.conf.CertificateChainData = data.CertificateChainData
@@ -292,7 +332,7 @@ func (t *TLSMod) handleTLSConfigure(w http.ResponseWriter, r *http.Request) {
 	t.status = status
 	t.confLock.Unlock()
 	t.setCertFileTime()
-	onConfigModified()
+	writeConfigNow()
 	err = reconfigureDNSServer()
 	if err != nil {
 		httpError(w, http.StatusInternalServerError, "%s", err)
@@ -388,8 +428,8 @@ func verifyCertChain(data *tlsConfigStatus, certChain, serverName string) error
 		notAfter := mainCert.NotAfter
 		data.Subject = mainCert.Subject.String()
 		data.Issuer = mainCert.Issuer.String()
-		data.NotAfter = notAfter
-		data.NotBefore = mainCert.NotBefore
+		data.NotAfter = aghtime.Time{Time: notAfter}
+		data.NotBefore = aghtime.Time{Time: mainCert.NotBefore}
 		data.DNSNames = mainCert.DNSNames
 	}
 
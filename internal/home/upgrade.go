@@ -2,6 +2,7 @@ package home
 
 import (
 	"fmt"
+	"net"
 	"net/url"
 	"os"
 	"path"
@@ -11,6 +12,7 @@ import (
 	"strings"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/google/renameio/maybe"
 	"golang.org/x/crypto/bcrypt"
@@ -18,7 +20,7 @@ import (
 )
 
 // currentSchemaVersion is the current schema version.
-const currentSchemaVersion = 10
+const currentSchemaVersion = 11
 
 // These aliases are provided for convenience.
 type (
@@ -36,6 +38,11 @@ func upgradeConfig() error {
 		return err
 	}
 
+	body, err = decryptConfig(Context.secrets, body)
+	if err != nil {
+		return fmt.Errorf("decrypting config: %w", err)
+	}
+
 	err = yaml.Unmarshal(body, &diskConf)
 	if err != nil {
 		log.Printf("Couldn't parse config file: %s", err)
@@ -80,6 +87,7 @@ func upgradeConfigSchema(oldVersion int, diskConf yobj) (err error) {
 		upgradeSchema7to8,
 		upgradeSchema8to9,
 		upgradeSchema9to10,
+		upgradeSchema10to11,
 	}
 
 	n := 0
@@ -104,6 +112,19 @@ func upgradeConfigSchema(oldVersion int, diskConf yobj) (err error) {
 	}
 
 	config.fileData = body
+	if Context.safeMode {
+		log.Info("safe mode: not saving the upgraded configuration")
+
+		return nil
+	}
+
+	// Keep the plain configuration in memory, but don't write the
+	// secrets in plain text.
+	body, err = encryptConfig(Context.secrets, body)
+	if err != nil {
+		return fmt.Errorf("encrypting new config: %w", err)
+	}
+
 	confFile := config.getConfigFilename()
 	err = maybe.WriteFile(confFile, body, 0o644)
 	if err != nil {
@@ -612,6 +633,121 @@ func upgradeSchema9to10(diskConf yobj) (err error) {
 	return nil
 }
 
+// canonicalRewriteAnswer returns the canonical form of the answer ans of the
+// rewrite with the record type typ.  Only the CNAME answers are domain names.
+func canonicalRewriteAnswer(typ, ans string) (canon string) {
+	isCNAME := strings.EqualFold(typ, "CNAME") ||
+		(typ == "" && ans != "A" && ans != "AAAA" && net.ParseIP(ans) == nil)
+	if !isCNAME {
+		return ans
+	}
+
+	return aghnet.CanonicalDomain(ans)
+}
+
+// canonicalizeStrings replaces each string in the array under key in obj with
+// the result of canon.  name is the full name of the key used in the errors.
+func canonicalizeStrings(obj yobj, key, name string, canon func(s string) (c string)) (err error) {
+	val, ok := obj[key]
+	if !ok || val == nil {
+		return nil
+	}
+
+	arr, ok := val.(yarr)
+	if !ok {
+		return fmt.Errorf("unexpected type of %s: %T", name, val)
+	}
+
+	for i, elemVal := range arr {
+		var elem string
+		elem, ok = elemVal.(string)
+		if !ok {
+			return fmt.Errorf("unexpected type of %s[%d]: %T", name, i, elemVal)
+		}
+
+		arr[i] = canon(elem)
+	}
+
+	return nil
+}
+
+// upgradeSchema10to11 performs the following changes:
+//
+//   # BEFORE:
+//   'dns':
+//     'blocked_hosts':
+//     - 'Blocked.LAN.'
+//     'rewrites':
+//     - 'domain': 'Example.LAN.'
+//       'answer': 'Target.LAN.'
+//   'user_rules':
+//   - '||Ads.LAN.^'
+//
+//   # AFTER:
+//   'dns':
+//     'blocked_hosts':
+//     - 'blocked.lan'
+//     'rewrites':
+//     - 'domain': 'example.lan'
+//       'answer': 'target.lan'
+//   'user_rules':
+//   - '||ads.lan^'
+//
+func upgradeSchema10to11(diskConf yobj) (err error) {
+	log.Printf("Upgrade yaml: 10 to 11")
+
+	diskConf["schema_version"] = 11
+
+	err = canonicalizeStrings(diskConf, "user_rules", "user_rules", dnsfilter.CanonicalRule)
+	if err != nil {
+		return err
+	}
+
+	dnsVal, ok := diskConf["dns"]
+	if !ok {
+		return nil
+	}
+
+	dns, ok := dnsVal.(yobj)
+	if !ok {
+		return fmt.Errorf("unexpected type of dns: %T", dnsVal)
+	}
+
+	err = canonicalizeStrings(dns, "blocked_hosts", "dns.blocked_hosts", dnsfilter.CanonicalRule)
+	if err != nil {
+		return err
+	}
+
+	rewritesVal, ok := dns["rewrites"]
+	if !ok || rewritesVal == nil {
+		return nil
+	}
+
+	rewrites, ok := rewritesVal.(yarr)
+	if !ok {
+		return fmt.Errorf("unexpected type of dns.rewrites: %T", rewritesVal)
+	}
+
+	for i, rwVal := range rewrites {
+		var rw yobj
+		rw, ok = rwVal.(yobj)
+		if !ok {
+			return fmt.Errorf("unexpected type of dns.rewrites[%d]: %T", i, rwVal)
+		}
+
+		if domain, isStr := rw["domain"].(string); isStr {
+			rw["domain"] = aghnet.CanonicalDomain(domain)
+		}
+
+		typ, _ := rw["type"].(string)
+		if ans, isStr := rw["answer"].(string); isStr {
+			rw["answer"] = canonicalRewriteAnswer(typ, ans)
+		}
+	}
+
+	return nil
+}
+
 // TODO(a.garipov): Replace with log.Output when we port it to our logging
 // package.
 func funcName() string {
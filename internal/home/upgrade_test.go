@@ -368,3 +368,60 @@ func TestUpgradeSchema9to10(t *testing.T) {
 		assert.Equal(t, "unexpected type of dns: int", err.Error())
 	})
 }
+
+func TestUpgradeSchema10to11(t *testing.T) {
+	conf := yobj{
+		"dns": yobj{
+			"blocked_hosts": yarr{"Blocked.LAN.", "||ads.lan.^", "*.track.lan."},
+			"rewrites": yarr{
+				yobj{"domain": "Example.LAN.", "answer": "Target.LAN."},
+				yobj{"domain": "*.example.lan.", "answer": "1.2.3.4"},
+				yobj{"domain": "aaaa.lan.", "answer": "AAAA"},
+				yobj{"domain": "txt.lan.", "answer": "Some Text.", "type": "TXT"},
+				yobj{"domain": "cname.lan", "answer": "Other.LAN.", "type": "cname"},
+			},
+		},
+		"user_rules": yarr{
+			"! Comment.",
+			"||Ads.LAN.^$important",
+			"192.168.1.2 NAS.lan.",
+			"/regexp.lan./",
+		},
+		"schema_version": 10,
+	}
+
+	err := upgradeSchema10to11(conf)
+	require.NoError(t, err)
+	require.Equal(t, conf["schema_version"], 11)
+
+	assert.Equal(t, yarr{
+		"! Comment.",
+		"||ads.lan^$important",
+		"192.168.1.2 nas.lan",
+		"/regexp.lan./",
+	}, conf["user_rules"])
+
+	dnsConf, ok := conf["dns"].(yobj)
+	require.True(t, ok)
+
+	assert.Equal(t, yarr{"blocked.lan", "||ads.lan^", "*.track.lan"}, dnsConf["blocked_hosts"])
+	assert.Equal(t, yarr{
+		yobj{"domain": "example.lan", "answer": "target.lan"},
+		yobj{"domain": "*.example.lan", "answer": "1.2.3.4"},
+		yobj{"domain": "aaaa.lan", "answer": "AAAA"},
+		yobj{"domain": "txt.lan", "answer": "Some Text.", "type": "TXT"},
+		yobj{"domain": "cname.lan", "answer": "other.lan", "type": "cname"},
+	}, dnsConf["rewrites"])
+
+	t.Run("no_dns", func(t *testing.T) {
+		err = upgradeSchema10to11(yobj{})
+		require.NoError(t, err)
+	})
+
+	t.Run("bad_rules", func(t *testing.T) {
+		err = upgradeSchema10to11(yobj{"user_rules": 42})
+		require.Error(t, err)
+
+		assert.Equal(t, "unexpected type of user_rules: int", err.Error())
+	})
+}
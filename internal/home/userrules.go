@@ -0,0 +1,411 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/urlfilter/rules"
+)
+
+// Modes of importing the user rules.
+const (
+	rulesImportReplace = "replace"
+	rulesImportAppend  = "append"
+)
+
+// invalidRule is a line of the user rules which couldn't be parsed.
+type invalidRule struct {
+	// Text is the text of the line.
+	Text string `json:"text"`
+
+	// Error is the description of the parsing error.
+	Error string `json:"error"`
+
+	// Line is the number of the line starting from 1.
+	Line int `json:"line"`
+}
+
+// String implements the fmt.Stringer interface for invalidRule.
+func (r invalidRule) String() (s string) {
+	return fmt.Sprintf("line %d: invalid rule %q: %s", r.Line, r.Text, r.Error)
+}
+
+// splitUserRules splits text into lines and canonicalizes the domain names in
+// them, see dnsfilter.CanonicalRule.  The comments and the empty lines are
+// kept, but the final line break doesn't produce an empty rule.
+func splitUserRules(text string) (lines []string) {
+	text = strings.TrimSuffix(text, "\n")
+	lines = strings.Split(text, "\n")
+	for i, l := range lines {
+		lines[i] = dnsfilter.CanonicalRule(strings.TrimSuffix(l, "\r"))
+	}
+
+	return lines
+}
+
+// validateUserRules returns the lines which can't be parsed as filtering rules.
+// Empty lines and comments are valid.
+func validateUserRules(lines []string) (invalid []invalidRule) {
+	for i, l := range lines {
+		_, err := rules.NewRule(l, 0)
+		if err != nil {
+			invalid = append(invalid, invalidRule{
+				Text:  l,
+				Error: err.Error(),
+				Line:  i + 1,
+			})
+		}
+	}
+
+	return invalid
+}
+
+// setUserRules replaces the user rules with lines.
+func (f *Filtering) setUserRules(lines []string) (rev uint64) {
+	config.Lock()
+	defer config.Unlock()
+
+	config.UserRules = lines
+	f.userRulesRev++
+
+	return f.userRulesRev
+}
+
+// rulesDiff is the difference between two versions of the user rules.  The
+// lines are compared after trimming the spaces, the empty lines are ignored.
+type rulesDiff struct {
+	Added     int `json:"added"`
+	Removed   int `json:"removed"`
+	Unchanged int `json:"unchanged"`
+}
+
+// diffUserRules returns the difference between the old and the new rules.
+func diffUserRules(oldRules, newRules []string) (d rulesDiff) {
+	counts := map[string]int{}
+	for _, l := range oldRules {
+		if l = strings.TrimSpace(l); l != "" {
+			counts[l]++
+		}
+	}
+
+	for _, l := range newRules {
+		l = strings.TrimSpace(l)
+		if l == "" {
+			continue
+		}
+
+		if counts[l] > 0 {
+			counts[l]--
+			d.Unchanged++
+		} else {
+			d.Added++
+		}
+	}
+
+	for _, n := range counts {
+		d.Removed += n
+	}
+
+	return d
+}
+
+// handleFilteringRulesExport is the handler for the
+// GET /control/filtering/rules/export HTTP API.
+func (f *Filtering) handleFilteringRulesExport(w http.ResponseWriter, _ *http.Request) {
+	config.RLock()
+	text := strings.Join(config.UserRules, "\n")
+	config.RUnlock()
+
+	if text != "" {
+		text += "\n"
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", `attachment; filename="user_rules.txt"`)
+	_, _ = w.Write([]byte(text))
+}
+
+// rulesImportResp is the response to the POST /control/filtering/rules/import
+// request.
+type rulesImportResp struct {
+	rulesDiff
+
+	// Invalid are the lines which couldn't be parsed.
+	Invalid []invalidRule `json:"invalid"`
+
+	// Warnings are the rules, which are redundant or have no effect, in the
+	// resulting user rules.
+	Warnings []ruleWarning `json:"warnings"`
+
+	// UserRulesRevision is the revision of the user rules after the
+	// request.
+	UserRulesRevision uint64 `json:"user_rules_revision"`
+
+	// Applied is true if the rules have been changed.
+	Applied bool `json:"applied"`
+}
+
+// handleFilteringRulesImport is the handler for the
+// POST /control/filtering/rules/import HTTP API.  The body is the text of the
+// rules.  The "mode" query parameter is either rulesImportReplace, the
+// default, or rulesImportAppend.  If the "dry_run" query parameter is true, the
+// rules are only validated and compared with the current ones.  If the
+// "revision" query parameter is set, the rules are only changed if their
+// revision is the same.
+func (f *Filtering) handleFilteringRulesImport(w http.ResponseWriter, r *http.Request) {
+	params := aghhttp.QueryParams(r.URL.Query())
+	mode := params.Enum("mode", rulesImportReplace, rulesImportReplace, rulesImportAppend)
+	dryRun := params.Bool("dry_run", false)
+	hasRev := params.Has("revision")
+	rev := params.Int("revision", 0, 0, math.MaxInt64)
+	err := params.Err()
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	// This use of ReadAll is safe, because request's body is now limited.
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "Failed to read request body: %s", err)
+
+		return
+	}
+
+	lines := splitUserRules(string(body))
+	resp := rulesImportResp{
+		Invalid: validateUserRules(lines),
+	}
+
+	if len(resp.Invalid) != 0 && !dryRun {
+		httpError(w, http.StatusBadRequest, "%d invalid rules, first at %s", len(resp.Invalid), resp.Invalid[0])
+
+		return
+	}
+
+	config.RLock()
+	old := config.UserRules
+	resp.UserRulesRevision = f.userRulesRev
+	config.RUnlock()
+
+	if hasRev && uint64(rev) != resp.UserRulesRevision {
+		httpError(
+			w,
+			http.StatusConflict,
+			"revision %d doesn't match the current one %d, the rules have changed since the preview",
+			rev,
+			resp.UserRulesRevision,
+		)
+
+		return
+	}
+
+	if mode == rulesImportAppend {
+		lines = append(append([]string{}, old...), lines...)
+	}
+
+	resp.rulesDiff = diffUserRules(old, lines)
+	resp.Warnings = analyzeUserRules(lines)
+	if !dryRun {
+		resp.UserRulesRevision = f.setUserRules(lines)
+		resp.Applied = true
+
+		onConfigModified()
+		enableFilters(true)
+	}
+
+	if resp.Invalid == nil {
+		resp.Invalid = []invalidRule{}
+	}
+
+	if resp.Warnings == nil {
+		resp.Warnings = []ruleWarning{}
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// rulesBatchReq is the request for changing several user rules at once.  The
+// removals are applied before the additions.
+type rulesBatchReq struct {
+	Add    []string `json:"add"`
+	Remove []string `json:"remove"`
+}
+
+// rulesBatchResult is the result of a single item of a rulesBatchReq.
+type rulesBatchResult struct {
+	// Rule is the canonicalized rule.
+	Rule string `json:"rule"`
+
+	// Error is the validation error of the rule, if any.
+	Error string `json:"error,omitempty"`
+
+	// Changed is true if the rule has been added or if at least one line
+	// has been removed because of it.  An added rule isn't changed if it's
+	// already there.
+	Changed bool `json:"changed"`
+}
+
+// rulesBatchResp is the response to a rulesBatchReq.  The results are in the
+// same order as the items of the request.
+type rulesBatchResp struct {
+	Added   []rulesBatchResult `json:"added"`
+	Removed []rulesBatchResult `json:"removed"`
+
+	// UserRulesRevision is the revision of the user rules after the
+	// request.
+	UserRulesRevision uint64 `json:"user_rules_revision"`
+
+	// Applied is true if the user rules have been changed, which only
+	// happens if all the added rules are valid.
+	Applied bool `json:"applied"`
+}
+
+// changed returns true if any of the items has changed the user rules.
+func (resp *rulesBatchResp) changed() (ok bool) {
+	for _, results := range [][]rulesBatchResult{resp.Added, resp.Removed} {
+		for _, res := range results {
+			if res.Changed {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// batchUserRules returns the user rules after applying req to old and the
+// results of the items.  If any of the added rules is invalid, lines is nil.
+// old isn't modified.
+func batchUserRules(old []string, req *rulesBatchReq) (lines []string, resp *rulesBatchResp) {
+	resp = &rulesBatchResp{
+		Added:   make([]rulesBatchResult, len(req.Add)),
+		Removed: make([]rulesBatchResult, len(req.Remove)),
+	}
+
+	valid := true
+	for i, rule := range req.Add {
+		res := &resp.Added[i]
+		res.Rule = dnsfilter.CanonicalRule(strings.TrimSpace(rule))
+		if res.Rule == "" {
+			res.Error = "empty rule"
+			valid = false
+
+			continue
+		}
+
+		_, err := rules.NewRule(res.Rule, 0)
+		if err != nil {
+			res.Error = err.Error()
+			valid = false
+		}
+	}
+
+	if !valid {
+		return nil, resp
+	}
+
+	removed := map[string]int{}
+	for i, rule := range req.Remove {
+		resp.Removed[i].Rule = dnsfilter.CanonicalRule(strings.TrimSpace(rule))
+		removed[resp.Removed[i].Rule] = i
+	}
+
+	present := map[string]bool{}
+	lines = make([]string, 0, len(old)+len(req.Add))
+	for _, l := range old {
+		trimmed := strings.TrimSpace(l)
+		if i, ok := removed[trimmed]; ok && trimmed != "" {
+			resp.Removed[i].Changed = true
+
+			continue
+		}
+
+		lines = append(lines, l)
+		present[trimmed] = true
+	}
+
+	for i := range resp.Added {
+		res := &resp.Added[i]
+		if present[res.Rule] {
+			continue
+		}
+
+		lines = append(lines, res.Rule)
+		present[res.Rule] = true
+		res.Changed = true
+	}
+
+	return lines, resp
+}
+
+// applyUserRulesBatch applies req to the user rules.  If the rules have been
+// changed, the configuration is saved and the filters are rebuilt once.
+func (f *Filtering) applyUserRulesBatch(req *rulesBatchReq) (resp *rulesBatchResp) {
+	config.Lock()
+
+	lines, resp := batchUserRules(config.UserRules, req)
+	if lines != nil && resp.changed() {
+		config.UserRules = lines
+		f.userRulesRev++
+		resp.Applied = true
+	}
+
+	resp.UserRulesRevision = f.userRulesRev
+	config.Unlock()
+
+	if resp.Applied {
+		onConfigModified()
+		enableFilters(true)
+	}
+
+	return resp
+}
+
+// handleFilteringRulesBatch is the handler for the
+// POST /control/filtering/rules/batch HTTP API.
+func (f *Filtering) handleFilteringRulesBatch(w http.ResponseWriter, r *http.Request) {
+	req := &rulesBatchReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	resp := f.applyUserRulesBatch(req)
+	code := http.StatusOK
+	for _, res := range resp.Added {
+		if res.Error != "" {
+			code = http.StatusBadRequest
+
+			break
+		}
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_, _ = w.Write(js)
+}
@@ -0,0 +1,202 @@
+package home
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitUserRules(t *testing.T) {
+	testCases := []struct {
+		name string
+		text string
+		want []string
+	}{{
+		name: "empty",
+		text: "",
+		want: []string{""},
+	}, {
+		name: "final_newline",
+		text: "||example.org^\n",
+		want: []string{"||example.org^"},
+	}, {
+		name: "sections",
+		text: "! Ads\r\n||ads.example.org^\r\n\r\n! Trackers\r\n||track.example.org^",
+		want: []string{
+			"! Ads",
+			"||ads.example.org^",
+			"",
+			"! Trackers",
+			"||track.example.org^",
+		},
+	}, {
+		name: "fqdn",
+		text: "||Example.LAN.^\n192.168.1.2 nas.lan. # NAS\nrouter.lan.\n",
+		want: []string{
+			"||example.lan^",
+			"192.168.1.2 nas.lan # NAS",
+			"router.lan",
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, splitUserRules(tc.text))
+		})
+	}
+}
+
+func TestValidateUserRules(t *testing.T) {
+	invalid := validateUserRules([]string{
+		"! Comment",
+		"# Another comment",
+		"",
+		"||example.org^",
+		"127.0.0.1 example.com",
+		"||example.net^$unknownmodifier",
+	})
+	require.Len(t, invalid, 1)
+
+	assert.Equal(t, 6, invalid[0].Line)
+	assert.Equal(t, "||example.net^$unknownmodifier", invalid[0].Text)
+}
+
+func TestBatchUserRules(t *testing.T) {
+	old := []string{
+		"! Ads",
+		"||ads.example.org^",
+		"",
+		"||track.example.org^",
+	}
+
+	t.Run("invalid", func(t *testing.T) {
+		lines, resp := batchUserRules(old, &rulesBatchReq{
+			Add:    []string{"||new.example.org^", "||example.net^$unknownmodifier", " "},
+			Remove: []string{"||ads.example.org^"},
+		})
+		assert.Nil(t, lines)
+		require.Len(t, resp.Added, 3)
+		assert.Empty(t, resp.Added[0].Error)
+		assert.NotEmpty(t, resp.Added[1].Error)
+		assert.NotEmpty(t, resp.Added[2].Error)
+		assert.False(t, resp.changed())
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		lines, resp := batchUserRules(old, &rulesBatchReq{
+			Add: []string{
+				"||New.Example.org.^",
+				"||track.example.org^",
+				"||new.example.org^",
+			},
+			Remove: []string{" ||ads.example.org^", "||missing.example.org^"},
+		})
+		assert.Equal(t, []string{
+			"! Ads",
+			"",
+			"||track.example.org^",
+			"||new.example.org^",
+		}, lines)
+		assert.Equal(t, []rulesBatchResult{{
+			Rule:    "||new.example.org^",
+			Changed: true,
+		}, {
+			Rule: "||track.example.org^",
+		}, {
+			Rule: "||new.example.org^",
+		}}, resp.Added)
+		assert.Equal(t, []rulesBatchResult{{
+			Rule:    "||ads.example.org^",
+			Changed: true,
+		}, {
+			Rule: "||missing.example.org^",
+		}}, resp.Removed)
+		assert.True(t, resp.changed())
+
+		// The original rules are kept intact.
+		assert.Len(t, old, 4)
+		assert.Equal(t, "||ads.example.org^", old[1])
+	})
+}
+
+func TestDiffUserRules(t *testing.T) {
+	oldRules := []string{
+		"! Ads",
+		"||ads.example.org^",
+		"",
+		"||track.example.org^",
+	}
+	newRules := []string{
+		"! Ads",
+		" ||ads.example.org^",
+		"",
+		"",
+		"||new.example.org^",
+		"||new.example.org^",
+	}
+
+	assert.Equal(t, rulesDiff{
+		Added:     2,
+		Removed:   1,
+		Unchanged: 2,
+	}, diffUserRules(oldRules, newRules))
+}
+
+func TestAnalyzeUserRules(t *testing.T) {
+	lines := []string{
+		"! Ads",
+		"||example.org^",
+		"sub.example.org",
+		"0.0.0.0 Example.org",
+		"||EXAMPLE.org^",
+		"||other.example^",
+		"@@||other.example^",
+		"@@||allowed.example^",
+		"0.0.0.0 www.allowed.example # Comment",
+		"@@||sub.allowed.example^",
+		"||modified.example^$important",
+		"||modified.example^$important",
+		"1.2.3.4 rewritten.example.org",
+		"/regex/",
+	}
+
+	assert.Equal(t, []ruleWarning{{
+		Text:      "sub.example.org",
+		Kind:      ruleWarningSubsumed,
+		Line:      3,
+		OtherLine: 2,
+	}, {
+		Text:      "0.0.0.0 Example.org",
+		Kind:      ruleWarningSubsumed,
+		Line:      4,
+		OtherLine: 2,
+	}, {
+		Text:      "||EXAMPLE.org^",
+		Kind:      ruleWarningDuplicate,
+		Line:      5,
+		OtherLine: 2,
+	}, {
+		Text:      "||other.example^",
+		Kind:      ruleWarningAllowlisted,
+		Line:      6,
+		OtherLine: 7,
+	}, {
+		Text:      "0.0.0.0 www.allowed.example # Comment",
+		Kind:      ruleWarningAllowlisted,
+		Line:      9,
+		OtherLine: 8,
+	}, {
+		Text:      "@@||sub.allowed.example^",
+		Kind:      ruleWarningSubsumed,
+		Line:      10,
+		OtherLine: 8,
+	}, {
+		Text:      "||modified.example^$important",
+		Kind:      ruleWarningDuplicate,
+		Line:      12,
+		OtherLine: 11,
+	}}, analyzeUserRules(lines))
+
+	assert.Empty(t, analyzeUserRules([]string{"||example.org^", "@@||sub.example.org^"}))
+}
@@ -0,0 +1,240 @@
+package home
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
+)
+
+// Kinds of the warnings about the user rules.
+const (
+	// ruleWarningDuplicate means that the rule is the same as an earlier
+	// one, ignoring the case of the domain and the syntax, for example
+	// "0.0.0.0 example.org" and "example.org".
+	ruleWarningDuplicate = "duplicate"
+
+	// ruleWarningSubsumed means that the rule only affects the domains
+	// already affected by a broader rule of the same kind, for example
+	// "sub.example.org" and "||example.org^".
+	ruleWarningSubsumed = "subsumed"
+
+	// ruleWarningAllowlisted means that the blocking rule never applies,
+	// because the domain is unblocked by an exception rule.
+	ruleWarningAllowlisted = "allowlisted"
+)
+
+// ruleWarning is a user rule which has no effect or is redundant.
+type ruleWarning struct {
+	// Text is the text of the line.
+	Text string `json:"text"`
+
+	// Kind is the kind of the warning.  See the ruleWarning constants.
+	Kind string `json:"kind"`
+
+	// Line is the number of the line starting from 1.
+	Line int `json:"line"`
+
+	// OtherLine is the number of the line with the rule, which makes this
+	// one redundant.
+	OtherLine int `json:"other_line"`
+}
+
+// simpleRule is the domain affected by a user rule without any modifiers.
+type simpleRule struct {
+	domain string
+
+	// withSubdomains is true for the "||example.org^" rules.
+	withSubdomains bool
+
+	// allow is true for the exception rules.
+	allow bool
+}
+
+// parseSimpleRule returns the domain affected by the rule in line.  ok is
+// false if the rule has modifiers, rewrites the domain to a real address,
+// contains several domains, or otherwise can't be compared with the others.
+func parseSimpleRule(line string) (r simpleRule, ok bool) {
+	if strings.HasPrefix(line, "@@") {
+		r.allow = true
+		line = line[len("@@"):]
+	}
+
+	if strings.HasPrefix(line, "||") && strings.HasSuffix(line, "^") {
+		r.domain, ok = exportableHost(line[len("||") : len(line)-len("^")])
+		r.withSubdomains = true
+
+		return r, ok
+	}
+
+	fields := strings.Fields(line)
+	if len(fields) == 1 {
+		r.domain, ok = exportableHost(fields[0])
+
+		return r, ok
+	}
+
+	ip := net.ParseIP(fields[0])
+	if r.allow || ip == nil || !(ip.IsUnspecified() || ip.IsLoopback()) {
+		return r, false
+	}
+
+	if len(fields) > 2 && fields[2][0] != '#' {
+		return r, false
+	}
+
+	r.domain, ok = exportableHost(fields[1])
+
+	return r, ok
+}
+
+// broaderRule returns the index of the "||example.org^" rule from
+// withSubdomains, which covers r.  It's -1 if there is none.
+func broaderRule(r simpleRule, withSubdomains map[string]int) (idx int) {
+	d := r.domain
+	if r.withSubdomains {
+		// Only the proper parents of the domain are broader.
+		d = parentDomain(d)
+	}
+
+	for ; d != ""; d = parentDomain(d) {
+		if i, ok := withSubdomains[d]; ok {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// parentDomain returns the domain with the first label of d removed or an
+// empty string if d has only one label.
+func parentDomain(d string) (parent string) {
+	i := strings.IndexByte(d, '.')
+	if i < 0 {
+		return ""
+	}
+
+	return d[i+1:]
+}
+
+// analyzeUserRules returns the warnings about the rules in lines, which
+// duplicate the earlier ones, are covered by the broader rules, or are
+// unblocked by the exception rules, sorted by the line.  There is at most one
+// warning per rule.  The rules with modifiers are only checked for duplicates.
+func analyzeUserRules(lines []string) (warnings []ruleWarning) {
+	seen := map[string]int{}
+	parsed := make([]simpleRule, len(lines))
+	simple := make([]bool, len(lines))
+	// blocking and allowing are the indexes of the first "||example.org^"
+	// rule for each domain.
+	blocking, allowing := map[string]int{}, map[string]int{}
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if aghstrings.IsCommentOrEmpty(l) || l[0] == '!' {
+			continue
+		}
+
+		key := l
+		r, ok := parseSimpleRule(l)
+		if ok {
+			parsed[i], simple[i] = r, true
+			key = fmt.Sprintf("%t %t %s", r.allow, r.withSubdomains, r.domain)
+			if r.withSubdomains {
+				byDomain := blocking
+				if r.allow {
+					byDomain = allowing
+				}
+
+				if _, exists := byDomain[r.domain]; !exists {
+					byDomain[r.domain] = i
+				}
+			}
+		}
+
+		if j, dup := seen[key]; dup {
+			warnings = append(warnings, ruleWarning{
+				Text:      lines[i],
+				Kind:      ruleWarningDuplicate,
+				Line:      i + 1,
+				OtherLine: j + 1,
+			})
+			simple[i] = false
+
+			continue
+		}
+
+		seen[key] = i
+	}
+
+	for i, r := range parsed {
+		if !simple[i] {
+			continue
+		}
+
+		kind, j := ruleWarningSubsumed, -1
+		if r.allow {
+			j = broaderRule(r, allowing)
+		} else if j = broaderRule(simpleRule{domain: r.domain}, allowing); j >= 0 {
+			kind = ruleWarningAllowlisted
+		} else {
+			j = broaderRule(r, blocking)
+		}
+
+		if j >= 0 {
+			warnings = append(warnings, ruleWarning{
+				Text:      lines[i],
+				Kind:      kind,
+				Line:      i + 1,
+				OtherLine: j + 1,
+			})
+		}
+	}
+
+	sort.SliceStable(warnings, func(i, j int) bool {
+		return warnings[i].Line < warnings[j].Line
+	})
+
+	return warnings
+}
+
+// rulesAnalysisResp is the response to the GET /control/filtering/rules/analyze
+// and the POST /control/filtering/set_rules requests.
+type rulesAnalysisResp struct {
+	// Warnings are the rules, which are redundant or have no effect.
+	Warnings []ruleWarning `json:"warnings"`
+}
+
+// writeRulesAnalysis writes the warnings about lines as the JSON response.
+func writeRulesAnalysis(w http.ResponseWriter, lines []string) {
+	resp := rulesAnalysisResp{
+		Warnings: analyzeUserRules(lines),
+	}
+	if resp.Warnings == nil {
+		resp.Warnings = []ruleWarning{}
+	}
+
+	js, err := json.Marshal(resp)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(js)
+}
+
+// handleFilteringRulesAnalyze is the handler for the
+// GET /control/filtering/rules/analyze HTTP API.  It reports the current user
+// rules, which are redundant or have no effect.  Nothing is changed.
+func (f *Filtering) handleFilteringRulesAnalyze(w http.ResponseWriter, _ *http.Request) {
+	config.RLock()
+	lines := aghstrings.CloneSlice(config.UserRules)
+	config.RUnlock()
+
+	writeRulesAnalysis(w, lines)
+}
@@ -3,8 +3,10 @@ package home
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"net"
 	"net/http"
+	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -60,6 +62,17 @@ type HTTPSServer struct {
 	shutdown bool // if TRUE, don't restart the server
 	enabled  bool
 	cert     tls.Certificate
+
+	// suspended is true if the server mustn't be started until the web
+	// module is resumed.
+	suspended bool
+
+	// serveHTTP3 is true if the handler is also served over HTTP/3.
+	serveHTTP3 bool
+
+	// server3 is the HTTP/3 server, if it's running.  It's protected by
+	// condLock.
+	server3 *http3Server
 }
 
 // Web - module object
@@ -76,6 +89,72 @@ type Web struct {
 
 	// httpServerBeta is a server for new client.
 	httpServerBeta *http.Server
+
+	// listenerLock protects httpListener and prevAddr.
+	listenerLock sync.Mutex
+	// httpListener is the listener of httpServer.
+	httpListener *pausableListener
+
+	// prevAddr is the previous address of httpServer, which is restored if
+	// it can't listen on the new one.  It's only set until httpServer
+	// listens on the new address.
+	prevAddr *webAddr
+}
+
+// webAddr is the address of the plain HTTP server.
+type webAddr struct {
+	host net.IP
+	port int
+}
+
+// setListenAddr changes the address of the plain HTTP server.  The previous
+// one is restored if the server can't listen on the new one.  rebind is true
+// if the address has changed, so the server must be restarted.
+func (web *Web) setListenAddr(host net.IP, port int) (rebind bool) {
+	web.listenerLock.Lock()
+	defer web.listenerLock.Unlock()
+
+	if web.conf.BindHost.Equal(host) && web.conf.BindPort == port {
+		return false
+	}
+
+	web.prevAddr = &webAddr{
+		host: web.conf.BindHost,
+		port: web.conf.BindPort,
+	}
+	web.conf.BindHost, web.conf.BindPort = host, port
+
+	return true
+}
+
+// rollBack restores the previous address of the plain HTTP server after it
+// has failed to listen on the new one with err.  ok is false if there is no
+// previous address.
+func (web *Web) rollBack(err error) (ok bool) {
+	web.listenerLock.Lock()
+	prev := web.prevAddr
+	web.prevAddr = nil
+	failed := net.JoinHostPort(web.conf.BindHost.String(), strconv.Itoa(web.conf.BindPort))
+	if prev != nil {
+		web.conf.BindHost, web.conf.BindPort = prev.host, prev.port
+	}
+	web.listenerLock.Unlock()
+
+	if prev == nil {
+		return false
+	}
+
+	log.Error("web: listening on %s: %s, rolling back", failed, err)
+
+	Context.controlLock.Lock()
+	defer Context.controlLock.Unlock()
+
+	config.BindHost, config.BindPort = prev.host, prev.port
+	writeConfigNow()
+
+	Context.listenChecks.setRollback(listenerWeb, []string{failed}, err, nil)
+
+	return true
 }
 
 // CreateWeb - create module
@@ -130,7 +209,9 @@ func WebCheckPortAvailable(port int) bool {
 func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings) {
 	log.Debug("Web: applying new TLS configuration")
 	web.conf.PortHTTPS = tlsConf.PortHTTPS
-	web.forceHTTPS = (tlsConf.ForceHTTPS && tlsConf.Enabled && tlsConf.PortHTTPS != 0)
+	// Don't redirect in safe mode, since the TLS settings may be the broken
+	// ones.
+	web.forceHTTPS = tlsConf.ForceHTTPS && tlsConf.Enabled && tlsConf.PortHTTPS != 0 && !Context.safeMode
 
 	enabled := tlsConf.Enabled &&
 		tlsConf.PortHTTPS != 0 &&
@@ -151,9 +232,11 @@ func (web *Web) TLSConfigChanged(ctx context.Context, tlsConf tlsConfigSettings)
 		ctx, cancel = context.WithTimeout(ctx, shutdownTimeout)
 		shutdownSrv(ctx, cancel, web.httpsServer.server)
 	}
+	web.closeHTTP3()
 
 	web.httpsServer.enabled = enabled
 	web.httpsServer.cert = cert
+	web.httpsServer.serveHTTP3 = tlsConf.ServeHTTP3
 	web.httpsServer.cond.Broadcast()
 	web.httpsServer.cond.L.Unlock()
 }
@@ -178,28 +261,25 @@ func (web *Web) Start() {
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
 		}
+		l, err := web.listenHTTP(web.httpServer.Addr)
+		if err != nil {
+			if web.rollBack(err) {
+				continue
+			}
+
+			cleanupAlways()
+			log.Fatal(err)
+		}
+
 		go func() {
-			errs <- web.httpServer.ListenAndServe()
+			errs <- web.httpServer.Serve(l)
 		}()
 
 		if web.conf.BetaBindPort != 0 {
-			web.httpServerBeta = &http.Server{
-				ErrorLog:          log.StdLog("web: plain", log.DEBUG),
-				Addr:              net.JoinHostPort(hostStr, strconv.Itoa(web.conf.BetaBindPort)),
-				Handler:           withMiddlewares(Context.mux, limitRequestBody, web.wrapIndexBeta),
-				ReadTimeout:       web.conf.ReadTimeout,
-				ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
-				WriteTimeout:      web.conf.WriteTimeout,
-			}
-			go func() {
-				betaErr := web.httpServerBeta.ListenAndServe()
-				if betaErr != nil {
-					log.Error("starting beta http server: %s", betaErr)
-				}
-			}()
+			web.serveBeta()
 		}
 
-		err := <-errs
+		err = <-errs
 		if err != http.ErrServerClosed {
 			cleanupAlways()
 			log.Fatal(err)
@@ -208,12 +288,128 @@ func (web *Web) Start() {
 	}
 }
 
+// serveBeta starts the server for the new client.
+func (web *Web) serveBeta() {
+	web.httpServerBeta = &http.Server{
+		ErrorLog:          log.StdLog("web: plain", log.DEBUG),
+		Addr:              net.JoinHostPort(web.conf.BindHost.String(), strconv.Itoa(web.conf.BetaBindPort)),
+		Handler:           withMiddlewares(Context.mux, limitRequestBody, web.wrapIndexBeta),
+		ReadTimeout:       web.conf.ReadTimeout,
+		ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
+		WriteTimeout:      web.conf.WriteTimeout,
+	}
+	go func(srv *http.Server) {
+		betaErr := srv.ListenAndServe()
+		if betaErr != nil && betaErr != http.ErrServerClosed {
+			log.Error("starting beta http server: %s", betaErr)
+		}
+	}(web.httpServerBeta)
+}
+
+// listenHTTP returns the listener for the plain HTTP server on addr.  The
+// listener inherited from the process which has restarted this one is used if
+// it's on the same address.
+func (web *Web) listenHTTP(addr string) (l *pausableListener, err error) {
+	tl := inheritedListener(addr)
+	if tl == nil {
+		var nl net.Listener
+		nl, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+
+		tl = nl.(*net.TCPListener)
+	}
+
+	l = newPausableListener(tl)
+
+	web.listenerLock.Lock()
+	defer web.listenerLock.Unlock()
+
+	web.httpListener = l
+	web.prevAddr = nil
+
+	return l, nil
+}
+
+// listenerFile returns a duplicate of the listener of the plain HTTP server,
+// which remains open after the server is closed.
+func (web *Web) listenerFile() (f *os.File, err error) {
+	web.listenerLock.Lock()
+	defer web.listenerLock.Unlock()
+
+	if web.httpListener == nil {
+		return nil, fmt.Errorf("no http listener")
+	}
+
+	return web.httpListener.File()
+}
+
+// suspend stops accepting the connections to the plain HTTP server, so that
+// another process sharing its listener accepts them, and shuts down the other
+// HTTP servers until resume is called.
+func (web *Web) suspend(ctx context.Context) {
+	web.listenerLock.Lock()
+	l := web.httpListener
+	web.listenerLock.Unlock()
+
+	if l != nil {
+		l.pause()
+	}
+
+	if web.httpServer != nil {
+		// Close the idle connections, so that the requests are sent to
+		// the new connections.
+		web.httpServer.SetKeepAlivesEnabled(false)
+	}
+
+	web.httpsServer.cond.L.Lock()
+	web.httpsServer.suspended = true
+	if web.httpsServer.server != nil {
+		sctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		shutdownSrv(sctx, cancel, web.httpsServer.server)
+	}
+	web.closeHTTP3()
+	web.httpsServer.cond.L.Unlock()
+
+	if web.httpServerBeta != nil {
+		bctx, cancel := context.WithTimeout(ctx, shutdownTimeout)
+		shutdownSrv(bctx, cancel, web.httpServerBeta)
+		web.httpServerBeta = nil
+	}
+}
+
+// resume restarts serving after suspend.
+func (web *Web) resume() {
+	if web.httpServer != nil {
+		web.httpServer.SetKeepAlivesEnabled(true)
+	}
+
+	web.listenerLock.Lock()
+	l := web.httpListener
+	web.listenerLock.Unlock()
+
+	if l != nil {
+		l.resume()
+	}
+
+	web.httpsServer.cond.L.Lock()
+	web.httpsServer.suspended = false
+	web.httpsServer.cond.Broadcast()
+	web.httpsServer.cond.L.Unlock()
+
+	if web.conf.BetaBindPort != 0 {
+		web.serveBeta()
+	}
+}
+
 // Close gracefully shuts down the HTTP servers.
 func (web *Web) Close(ctx context.Context) {
 	log.Info("stopping http server...")
 
 	web.httpsServer.cond.L.Lock()
 	web.httpsServer.shutdown = true
+	web.closeHTTP3()
 	web.httpsServer.cond.L.Unlock()
 
 	var cancel context.CancelFunc
@@ -235,7 +431,7 @@ func (web *Web) tlsServerLoop() {
 		}
 
 		// this mechanism doesn't let us through until all conditions are met
-		for !web.httpsServer.enabled { // sleep until necessary data is supplied
+		for !web.httpsServer.enabled || web.httpsServer.suspended { // sleep until necessary data is supplied
 			web.httpsServer.cond.Wait()
 			if web.httpsServer.shutdown {
 				web.httpsServer.cond.L.Unlock()
@@ -243,20 +439,28 @@ func (web *Web) tlsServerLoop() {
 			}
 		}
 
+		serveHTTP3 := web.httpsServer.serveHTTP3
 		web.httpsServer.cond.L.Unlock()
 
 		// prepare HTTPS server
 		address := net.JoinHostPort(web.conf.BindHost.String(), strconv.Itoa(web.conf.PortHTTPS))
+		tlsConf := &tls.Config{
+			Certificates: []tls.Certificate{web.httpsServer.cert},
+			MinVersion:   tls.VersionTLS12,
+			RootCAs:      Context.tlsRoots,
+			CipherSuites: Context.tlsCiphers,
+		}
+
+		handler := withMiddlewares(Context.mux, limitRequestBody)
+		if serveHTTP3 {
+			handler = web.startHTTP3(address, tlsConf, handler)
+		}
+
 		web.httpsServer.server = &http.Server{
-			ErrorLog: log.StdLog("web: https", log.DEBUG),
-			Addr:     address,
-			TLSConfig: &tls.Config{
-				Certificates: []tls.Certificate{web.httpsServer.cert},
-				MinVersion:   tls.VersionTLS12,
-				RootCAs:      Context.tlsRoots,
-				CipherSuites: Context.tlsCiphers,
-			},
-			Handler:           withMiddlewares(Context.mux, limitRequestBody),
+			ErrorLog:          log.StdLog("web: https", log.DEBUG),
+			Addr:              address,
+			TLSConfig:         tlsConf,
+			Handler:           handler,
 			ReadTimeout:       web.conf.ReadTimeout,
 			ReadHeaderTimeout: web.conf.ReadHeaderTimeout,
 			WriteTimeout:      web.conf.WriteTimeout,
@@ -270,3 +474,120 @@ func (web *Web) tlsServerLoop() {
 		}
 	}
 }
+
+// startHTTP3 starts serving h over HTTP/3 on the UDP address addr and returns
+// the handler for the previous versions of HTTP, which advertises it.  HTTP/3
+// is optional, so if the server can't be started, the error is only logged and
+// h is returned as is.
+func (web *Web) startHTTP3(addr string, tlsConf *tls.Config, h http.Handler) (wrapped http.Handler) {
+	s, err := newHTTP3Server(addr, tlsConf, h)
+	if err != nil {
+		log.Error("web: http3: %s", err)
+
+		return h
+	}
+
+	web.httpsServer.cond.L.Lock()
+	web.httpsServer.server3 = s
+	web.httpsServer.cond.L.Unlock()
+
+	log.Info("web: serving http/3 on udp %s", addr)
+	go s.serve()
+
+	return s.advertise(h)
+}
+
+// closeHTTP3 stops the HTTP/3 server, if it's running.  web.httpsServer.cond.L
+// must be locked.
+func (web *Web) closeHTTP3() {
+	if web.httpsServer.server3 != nil {
+		web.httpsServer.server3.close()
+		web.httpsServer.server3 = nil
+	}
+}
+
+// pausableListener is a TCP listener, which leaves the connections in the
+// backlog while it's paused, so that another process sharing the socket
+// accepts them.
+type pausableListener struct {
+	*net.TCPListener
+
+	// cond is signaled when paused or closed changes.
+	cond *sync.Cond
+
+	// mu protects paused and closed.
+	mu sync.Mutex
+
+	paused bool
+	closed bool
+}
+
+// newPausableListener returns a new pausableListener accepting the
+// connections on l.
+func newPausableListener(l *net.TCPListener) (pl *pausableListener) {
+	pl = &pausableListener{
+		TCPListener: l,
+	}
+	pl.cond = sync.NewCond(&pl.mu)
+
+	return pl
+}
+
+// Accept implements the net.Listener interface for *pausableListener.
+func (l *pausableListener) Accept() (conn net.Conn, err error) {
+	for {
+		l.mu.Lock()
+		for l.paused && !l.closed {
+			l.cond.Wait()
+		}
+		l.mu.Unlock()
+
+		conn, err = l.TCPListener.Accept()
+		if err == nil {
+			return conn, nil
+		}
+
+		l.mu.Lock()
+		interrupted := l.paused && !l.closed
+		l.mu.Unlock()
+
+		// The pending call is interrupted by the deadline set by pause.
+		if !interrupted {
+			return nil, err
+		}
+	}
+}
+
+// Close implements the net.Listener interface for *pausableListener.
+func (l *pausableListener) Close() (err error) {
+	// Close the listener first, so that the woken up Accept doesn't accept
+	// connections.
+	err = l.TCPListener.Close()
+
+	l.mu.Lock()
+	l.closed = true
+	l.cond.Broadcast()
+	l.mu.Unlock()
+
+	return err
+}
+
+// pause stops accepting the connections until resume is called.
+func (l *pausableListener) pause() {
+	l.mu.Lock()
+	l.paused = true
+	l.mu.Unlock()
+
+	// Interrupt the pending call to Accept.
+	_ = l.SetDeadline(time.Unix(1, 0))
+}
+
+// resume accepts the connections again.
+func (l *pausableListener) resume() {
+	_ = l.SetDeadline(time.Time{})
+
+	l.mu.Lock()
+	l.paused = false
+	l.cond.Broadcast()
+	l.mu.Unlock()
+}
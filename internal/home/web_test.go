@@ -0,0 +1,62 @@
+package home
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPausableListener(t *testing.T) {
+	tl, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IP{127, 0, 0, 1}})
+	require.NoError(t, err)
+
+	l := newPausableListener(tl)
+	t.Cleanup(func() { _ = l.Close() })
+
+	accepted := make(chan error, 1)
+	go func() {
+		for {
+			conn, aerr := l.Accept()
+			if aerr != nil {
+				accepted <- aerr
+
+				return
+			}
+
+			_ = conn.Close()
+			accepted <- nil
+		}
+	}()
+
+	dial := func(t *testing.T) {
+		t.Helper()
+
+		conn, derr := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, derr)
+		t.Cleanup(func() { _ = conn.Close() })
+	}
+
+	dial(t)
+	require.NoError(t, <-accepted)
+
+	// The pending call to Accept is interrupted, and the connection is
+	// left in the backlog.
+	l.pause()
+	dial(t)
+
+	select {
+	case aerr := <-accepted:
+		t.Fatalf("accepted while paused: %v", aerr)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	l.resume()
+	require.NoError(t, <-accepted)
+
+	l.pause()
+	require.NoError(t, l.Close())
+	assert.Error(t, <-accepted)
+}
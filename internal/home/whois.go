@@ -2,7 +2,6 @@ package home
 
 import (
 	"context"
-	"encoding/binary"
 	"fmt"
 	"io/ioutil"
 	"net"
@@ -10,8 +9,8 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/aghio"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
-	"github.com/AdguardTeam/golibs/cache"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -19,41 +18,38 @@ const (
 	defaultServer  = "whois.arin.net"
 	defaultPort    = "43"
 	maxValueLength = 250
-	whoisTTL       = 1 * 60 * 60 // 1 hour
 )
 
 // Whois - module context
 type Whois struct {
 	clients *clientsContainer
-	ipChan  chan net.IP
 
 	// dialContext specifies the dial function for creating unencrypted TCP
 	// connections.
 	dialContext func(ctx context.Context, network, addr string) (conn net.Conn, err error)
 
-	// Contains IP addresses of clients
-	// An active IP address is resolved once again after it expires.
-	// If IP address couldn't be resolved, it stays here for some time to prevent further attempts to resolve the same IP.
-	ipAddrs cache.Cache
+	// queue contains the IP addresses of clients to be looked up.  An
+	// active IP address is looked up once again after the result expires.
+	queue *lookupQueue
 
 	// TODO(a.garipov): Rewrite to use time.Duration.  Like, seriously, why?
 	timeoutMsec uint
 }
 
-// initWhois creates the Whois module context.
-func initWhois(clients *clientsContainer) *Whois {
+// initWhois creates the Whois module context.  sem limits the number of the
+// simultaneous lookups of clients.
+func initWhois(clients *clientsContainer, sem chan struct{}) *Whois {
 	w := Whois{
 		timeoutMsec: 5000,
 		clients:     clients,
-		ipAddrs: cache.New(cache.Config{
-			EnableLRU: true,
-			MaxCount:  10000,
-		}),
-		dialContext: customDialContext,
-		ipChan:      make(chan net.IP, 255),
+		dialContext: Context.outbound.DialContext(aghnet.OutboundWHOIS, customDialContext),
 	}
 
-	go w.workerLoop()
+	w.queue = newLookupQueue("whois", w.lookup, sem)
+
+	Context.outbound.Expect(aghnet.OutboundWHOIS, defaultServer)
+
+	go w.queue.workerLoop()
 
 	return &w
 }
@@ -187,12 +183,10 @@ func (w *Whois) queryAll(ctx context.Context, target string) (string, error) {
 }
 
 // Request WHOIS information
-func (w *Whois) process(ctx context.Context, ip net.IP) (wi *RuntimeClientWhoisInfo) {
+func (w *Whois) process(ctx context.Context, ip net.IP) (wi *RuntimeClientWhoisInfo, err error) {
 	resp, err := w.queryAll(ctx, ip.String())
 	if err != nil {
-		log.Debug("Whois: error: %s  IP:%s", err, ip)
-
-		return nil
+		return nil, err
 	}
 
 	log.Debug("Whois: IP:%s  response: %d bytes", ip, len(resp))
@@ -208,46 +202,27 @@ func (w *Whois) process(ctx context.Context, ip net.IP) (wi *RuntimeClientWhoisI
 	// Don't return an empty struct so that the frontend doesn't get
 	// confused.
 	if *wi == (RuntimeClientWhoisInfo{}) {
-		return nil
+		return nil, nil
 	}
 
-	return wi
+	return wi, nil
 }
 
 // Begin - begin requesting WHOIS info
 func (w *Whois) Begin(ip net.IP) {
-	now := uint64(time.Now().Unix())
-	expire := w.ipAddrs.Get([]byte(ip))
-	if len(expire) != 0 {
-		exp := binary.BigEndian.Uint64(expire)
-		if exp > now {
-			return
-		}
-		// TTL expired
-	}
-	expire = make([]byte, 8)
-	binary.BigEndian.PutUint64(expire, now+whoisTTL)
-	_ = w.ipAddrs.Set([]byte(ip), expire)
-
-	log.Debug("Whois: adding %s", ip)
-	select {
-	case w.ipChan <- ip:
-		//
-	default:
-		log.Debug("Whois: queue is full")
-	}
+	w.queue.add(ip, time.Now())
 }
 
-// workerLoop processes the IP addresses it got from the channel and associates
-// the retrieving WHOIS info with a client.
-func (w *Whois) workerLoop() {
-	for ip := range w.ipChan {
-		info := w.process(context.Background(), ip)
-		if info == nil {
-			continue
-		}
+// lookup retrieves the WHOIS info of ip and associates it with a client.
+func (w *Whois) lookup(ip net.IP) (err error) {
+	info, err := w.process(context.Background(), ip)
+	if err != nil {
+		return err
+	}
 
-		id := ip.String()
-		w.clients.SetWhoisInfo(id, info)
+	if info != nil {
+		w.clients.SetWhoisInfo(ip.String(), info)
 	}
+
+	return nil
 }
@@ -0,0 +1,244 @@
+package querylog
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+const (
+	// anonymizeIvl is the interval between the anonymization passes.
+	anonymizeIvl = 1 * time.Hour
+
+	// hashKeyFileName is the name of the file with the key of the hashes of
+	// the anonymized hosts within the base directory.
+	hashKeyFileName = "querylog.key"
+
+	// hashKeyLen is the length of the key of the hashes in bytes.
+	hashKeyLen = 32
+
+	// hostHashLen is the length of the hash of an anonymized host in bytes.
+	hostHashLen = 16
+
+	// maxAnonymizeAfterHours is the longest retention of the log entries in
+	// hours, since the files are rotated every 90 days at most and the
+	// previous one is kept.
+	maxAnonymizeAfterHours = 2 * 90 * 24
+)
+
+// anonymizeIP returns the subnet of ip.
+func anonymizeIP(ip net.IP) (subnet net.IP) {
+	const AnonymizeClientIPv4Mask = 16
+	const AnonymizeClientIPv6Mask = 112
+
+	if ip.To4() != nil {
+		return ip.Mask(net.CIDRMask(AnonymizeClientIPv4Mask, 32))
+	}
+
+	return ip.Mask(net.CIDRMask(AnonymizeClientIPv6Mask, 128))
+}
+
+// anonymizer removes the personal data from the old log entries.
+type anonymizer struct {
+	// key is the key of the hashes of the hosts.
+	key []byte
+}
+
+// loadHashKey reads the key of the hashes of the hosts from the file within
+// dir or creates a new one, so that the hashes stay the same between restarts.
+func loadHashKey(dir string) (key []byte, err error) {
+	fn := filepath.Join(dir, hashKeyFileName)
+	key, err = ioutil.ReadFile(fn)
+	if err == nil && len(key) == hashKeyLen {
+		return key, nil
+	} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading hash key: %w", err)
+	}
+
+	key = make([]byte, hashKeyLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generating hash key: %w", err)
+	}
+
+	err = maybe.WriteFile(fn, key, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("writing hash key: %w", err)
+	}
+
+	return key, nil
+}
+
+// hashHost returns the keyed hash of host.  It's the same for the same host,
+// so the anonymized entries can still be counted, but the host can't be
+// restored from it.
+func (a *anonymizer) hashHost(host string) (h string) {
+	mac := hmac.New(sha256.New, a.key)
+	_, _ = mac.Write([]byte(host))
+
+	return hex.EncodeToString(mac.Sum(nil)[:hostHashLen])
+}
+
+// anonymize replaces the client of e with its subnet and the host with its
+// hash and removes the rest of the data revealing either of them.
+func (a *anonymizer) anonymize(e *logEntry) {
+	if e.IP != nil {
+		e.IP = anonymizeIP(e.IP)
+	}
+
+	e.QHost = a.hashHost(e.QHost)
+	e.ClientID = ""
+	e.ClientPort = 0
+	e.Answer = nil
+	e.OrigAnswer = nil
+
+	// The pattern may be the domain name itself.
+	e.TTLOverride = ""
+
+	if e.Applied != nil {
+		applied := *e.Applied
+		applied.Client, applied.ClientMatch = "", ""
+		e.Applied = &applied
+	}
+
+	res := dnsfilter.Result{
+		IsFiltered:  e.Result.IsFiltered,
+		Reason:      e.Result.Reason,
+		ServiceName: e.Result.ServiceName,
+	}
+	for _, r := range e.Result.Rules {
+		res.Rules = append(res.Rules, &dnsfilter.ResultRule{
+			FilterListID: r.FilterListID,
+		})
+	}
+	e.Result = res
+
+	e.Anonymized = true
+}
+
+// periodicAnonymize anonymizes the entries older than the configured age
+// every anonymizeIvl.
+func (l *queryLog) periodicAnonymize() {
+	for {
+		l.anonymizeOld(time.Now())
+
+		time.Sleep(anonymizeIvl)
+	}
+}
+
+// anonymizeOld anonymizes the entries older than the configured age both in
+// the memory buffer and in the files.
+func (l *queryLog) anonymizeOld(now time.Time) {
+	hours := l.conf.AnonymizeAfterHours
+	if hours == 0 {
+		return
+	}
+
+	if l.anonKey == nil {
+		key, err := loadHashKey(l.conf.BaseDir)
+		if err != nil {
+			log.Error("querylog: anonymizing: %s", err)
+
+			return
+		}
+
+		l.anonKey = key
+	}
+
+	a := &anonymizer{key: l.anonKey}
+	before := now.Add(-time.Duration(hours) * time.Hour)
+
+	n := 0
+	l.bufferLock.Lock()
+	for _, e := range l.buffer {
+		if !e.Anonymized && e.Time.Before(before) {
+			a.anonymize(e)
+			n++
+		}
+	}
+	l.bufferLock.Unlock()
+
+	for _, fn := range logFileNames(l.logFile) {
+		fileN, err := l.anonymizeFile(a, fn, before)
+		if err != nil {
+			log.Error("querylog: anonymizing %q: %s", fn, err)
+		}
+
+		n += fileN
+	}
+
+	if n > 0 {
+		log.Debug("querylog: anonymized %d entries older than %s", n, before)
+	}
+}
+
+// anonymizeFile anonymizes the entries older than before in the file fn and
+// returns their number.  The file is only rewritten if there are any.  The
+// lines which can't be decoded are kept as is.
+func (l *queryLog) anonymizeFile(a *anonymizer, fn string, before time.Time) (n int, err error) {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	data, err := ioutil.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	beforeNano := before.UnixNano()
+	buf := &bytes.Buffer{}
+	enc := json.NewEncoder(buf)
+
+	for _, b := range bytes.Split(data, []byte{'\n'}) {
+		if len(b) == 0 {
+			continue
+		}
+
+		line := string(b)
+		ts := readQLogTimestamp(line)
+		if ts == 0 || ts >= beforeNano || !json.Valid(b) {
+			buf.Write(b)
+			buf.WriteByte('\n')
+
+			continue
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, line)
+		if e.Anonymized {
+			buf.Write(b)
+			buf.WriteByte('\n')
+
+			continue
+		}
+
+		a.anonymize(e)
+		err = enc.Encode(e)
+		if err != nil {
+			return 0, fmt.Errorf("encoding entry: %w", err)
+		}
+
+		n++
+	}
+
+	if n == 0 {
+		return 0, nil
+	}
+
+	return n, maybe.WriteFile(fn, buf.Bytes(), 0o644)
+}
@@ -0,0 +1,135 @@
+package querylog
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadHashKey(t *testing.T) {
+	dir := t.TempDir()
+
+	key, err := loadHashKey(dir)
+	require.NoError(t, err)
+	assert.Len(t, key, hashKeyLen)
+
+	again, err := loadHashKey(dir)
+	require.NoError(t, err)
+	assert.Equal(t, key, again)
+}
+
+func TestQueryLog_anonymizeOld(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:             true,
+		FileEnabled:         true,
+		RotationIvl:         1,
+		MemSize:             100,
+		BaseDir:             t.TempDir(),
+		AnonymizeAfterHours: 24,
+	})
+
+	now := time.Now()
+	old := now.Add(-48 * time.Hour)
+	newEntry := func(host string, tm time.Time) (e *logEntry) {
+		return &logEntry{
+			IP:       net.IP{1, 2, 3, 4},
+			Time:     tm,
+			QHost:    host,
+			QType:    "A",
+			QClass:   "IN",
+			ClientID: "cli",
+			Answer:   []byte{1, 2, 3},
+			Result: dnsfilter.Result{
+				IsFiltered: true,
+				Reason:     dnsfilter.FilteredBlockList,
+				Rules: []*dnsfilter.ResultRule{{
+					FilterListID: 1,
+					Text:         "||" + host + "^",
+				}},
+			},
+		}
+	}
+
+	// Add the disk entries.
+	require.NoError(t, l.flushToFile([]*logEntry{
+		newEntry("old.example", old),
+		newEntry("new.example", now),
+	}))
+
+	// Add a memory entry.
+	l.buffer = []*logEntry{newEntry("old.example", old)}
+
+	l.anonymizeOld(now)
+
+	entries, _, _ := l.search(newSearchParams())
+	require.Len(t, entries, 3)
+
+	anonymized := map[bool][]*logEntry{}
+	for _, e := range entries {
+		anonymized[e.Anonymized] = append(anonymized[e.Anonymized], e)
+	}
+
+	require.Len(t, anonymized[false], 1)
+	assert.Equal(t, "new.example", anonymized[false][0].QHost)
+	assert.Equal(t, "cli", anonymized[false][0].ClientID)
+
+	require.Len(t, anonymized[true], 2)
+	for _, e := range anonymized[true] {
+		// The hashes are the same both in memory and on disk.
+		assert.Equal(t, anonymized[true][0].QHost, e.QHost)
+		assert.NotEqual(t, "old.example", e.QHost)
+
+		assert.Equal(t, net.IP{1, 2, 0, 0}, e.IP.To4())
+		assert.Empty(t, e.ClientID)
+		assert.Empty(t, e.Answer)
+
+		assert.Equal(t, dnsfilter.FilteredBlockList, e.Result.Reason)
+		require.Len(t, e.Result.Rules, 1)
+		assert.Equal(t, int64(1), e.Result.Rules[0].FilterListID)
+		assert.Empty(t, e.Result.Rules[0].Text)
+	}
+
+	// The anonymized entries aren't rewritten again.
+	n, err := l.anonymizeFile(&anonymizer{key: l.anonKey}, l.logFile, now.Add(-24*time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestQueryLog_WriteAnonymizedSample(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	e := &logEntry{
+		IP:       net.IP{192, 168, 77, 13},
+		Time:     time.Now(),
+		QHost:    "private.example",
+		QType:    "A",
+		QClass:   "IN",
+		ClientID: "laptop",
+		Answer:   []byte{1, 2, 3},
+	}
+	l.buffer = []*logEntry{e}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, l.WriteAnonymizedSample(buf, 10))
+
+	data := buf.String()
+	assert.NotContains(t, data, "private.example")
+	assert.NotContains(t, data, "laptop")
+	assert.NotContains(t, data, "192.168.77.13")
+	assert.Contains(t, data, "192.168.0.0")
+
+	// The shared entry must stay intact.
+	assert.Equal(t, "private.example", e.QHost)
+	assert.False(t, e.Anonymized)
+}
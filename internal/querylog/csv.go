@@ -0,0 +1,98 @@
+package querylog
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/miekg/dns"
+)
+
+// csvColumns are the names of the columns of the query log in CSV.
+var csvColumns = []string{
+	"time",
+	"client",
+	"client_port",
+	"client_id",
+	"client_name",
+	"transport",
+	"host",
+	"type",
+	"class",
+	"status",
+	"reason",
+	"rule",
+	"filter_id",
+	"upstream",
+	"elapsed_ms",
+}
+
+// writeEntriesCSV writes the entries to w in CSV.
+func (l *queryLog) writeEntriesCSV(w http.ResponseWriter, entries []*logEntry) (err error) {
+	cw, err := aghhttp.NewCSVWriter(w, csvColumns...)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		err = cw.Write(l.logEntryToCSV(e)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cw.Flush()
+}
+
+// logEntryToCSV returns the values of the columns of entry, see csvColumns.
+func (l *queryLog) logEntryToCSV(entry *logEntry) (vals []string) {
+	var client string
+	if ip := l.getClientIP(entry.IP); ip != nil {
+		client = ip.String()
+	}
+
+	// The port is already zero if it's anonymized.
+	var port string
+	if entry.ClientPort != 0 {
+		port = strconv.FormatUint(uint64(entry.ClientPort), 10)
+	}
+
+	var name string
+	if entry.client != nil {
+		name = entry.client.Name
+	}
+
+	var status string
+	if len(entry.Answer) > 0 {
+		msg := &dns.Msg{}
+		if msg.Unpack(entry.Answer) == nil {
+			status = dns.RcodeToString[msg.Rcode]
+		}
+	}
+
+	var rule, filterID string
+	if rules := entry.Result.Rules; len(rules) > 0 && rules[0].Text != "" {
+		rule = rules[0].Text
+		filterID = strconv.FormatInt(rules[0].FilterListID, 10)
+	}
+
+	return []string{
+		aghtime.Format(entry.Time, time.RFC3339Nano),
+		client,
+		port,
+		entry.ClientID,
+		name,
+		entry.transport(),
+		entry.QHost,
+		entry.QType,
+		entry.QClass,
+		status,
+		entry.Result.Reason.String(),
+		rule,
+		filterID,
+		entry.Upstream,
+		formatElapsedMs(entry.Elapsed),
+	}
+}
@@ -0,0 +1,92 @@
+package querylog
+
+import (
+	"encoding/csv"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleQueryLog_csv(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	q := &dns.Msg{
+		Question: []dns.Question{{
+			Name:   "port.example.org.",
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+	l.Add(AddParams{
+		Question:   q,
+		ClientIP:   net.IPv4(2, 2, 2, 2),
+		ClientPort: 5353,
+	})
+
+	l.conf.AnonymizeClientPort = true
+	l.Add(AddParams{
+		Question:   q,
+		ClientIP:   net.IPv4(2, 2, 2, 3),
+		ClientPort: 5354,
+	})
+
+	r := httptest.NewRequest(http.MethodGet, "/control/querylog", nil)
+	r.Header.Set("Accept", "text/csv")
+
+	w := httptest.NewRecorder()
+	l.handleQueryLog(w, r)
+	require.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+	rows, err := csv.NewReader(w.Body).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, rows, 4)
+
+	assert.Equal(t, csvColumns, rows[0])
+
+	byClient := map[string]map[string]string{}
+	for _, vals := range rows[1:] {
+		row := map[string]string{}
+		for i, col := range csvColumns {
+			row[col] = vals[i]
+		}
+
+		byClient[row["client"]] = row
+	}
+
+	assert.Equal(t, "5353", byClient["2.2.2.2"]["client_port"])
+	assert.Empty(t, byClient["2.2.2.3"]["client_port"])
+
+	row := byClient["2.2.2.1"]
+	require.NotNil(t, row)
+
+	assert.Empty(t, row["client_port"])
+	assert.Equal(t, "example.org", row["host"])
+	assert.Equal(t, "A", row["type"])
+	assert.Equal(t, "NOERROR", row["status"])
+	assert.Equal(t, "Rewrite", row["reason"])
+	assert.Equal(t, "SomeRule", row["rule"])
+	assert.Equal(t, "1", row["filter_id"])
+	assert.Equal(t, "upstream", row["upstream"])
+
+	t.Run("json", func(t *testing.T) {
+		r.Header.Set("Accept", "application/xml")
+
+		w = httptest.NewRecorder()
+		l.handleQueryLog(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	})
+}
@@ -5,6 +5,7 @@ import (
 	"encoding/json"
 	"io"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -81,6 +82,61 @@ var logEntryHandlers = map[string]logEntryHandler{
 		ent.ClientProto, err = NewClientProto(v)
 		return err
 	},
+	"AN": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.Anonymized = v
+
+		return nil
+	},
+	"CO": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(bool)
+		if !ok {
+			return nil
+		}
+
+		ent.Coalesced = v
+
+		return nil
+	},
+	"TTLO": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.TTLOverride = v
+
+		return nil
+	},
+	"CN": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.ClientNet = ClientNet(v)
+
+		return nil
+	},
+	"CPort": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(json.Number)
+		if !ok {
+			return nil
+		}
+
+		port, err := strconv.ParseUint(string(v), 10, 16)
+		if err != nil {
+			return err
+		}
+
+		ent.ClientPort = uint16(port)
+
+		return nil
+	},
 	"Answer": func(t json.Token, ent *logEntry) error {
 		v, ok := t.(string)
 		if !ok {
@@ -119,6 +175,21 @@ var logEntryHandlers = map[string]logEntryHandler{
 		ent.Elapsed = time.Duration(i)
 		return nil
 	},
+	"UpstreamElapsed": func(t json.Token, ent *logEntry) error {
+		v, ok := t.(json.Number)
+		if !ok {
+			return nil
+		}
+
+		i, err := v.Int64()
+		if err != nil {
+			return err
+		}
+
+		ent.UpstreamElapsed = time.Duration(i)
+
+		return nil
+	},
 }
 
 var resultHandlers = map[string]logEntryHandler{
@@ -197,6 +268,36 @@ var resultHandlers = map[string]logEntryHandler{
 
 		ent.Result.CanonName = s
 
+		return nil
+	},
+	"RewriteScope": func(t json.Token, ent *logEntry) error {
+		s, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.Result.RewriteScope = s
+
+		return nil
+	},
+	"RewriteConflict": func(t json.Token, ent *logEntry) error {
+		s, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.Result.RewriteConflict = dnsfilter.RewriteConflict(s)
+
+		return nil
+	},
+	"RewritePicked": func(t json.Token, ent *logEntry) error {
+		s, ok := t.(string)
+		if !ok {
+			return nil
+		}
+
+		ent.Result.RewritePicked = net.ParseIP(s)
+
 		return nil
 	},
 }
@@ -505,6 +606,10 @@ func decodeResult(dec *json.Decoder, ent *logEntry) {
 		case "DNSRewriteResult":
 			decodeResultDNSRewriteResult(dec, ent)
 
+			continue
+		case "Stages":
+			decodeResultStages(dec, ent)
+
 			continue
 		default:
 			// Go on.
@@ -528,6 +633,40 @@ func decodeResult(dec *json.Decoder, ent *logEntry) {
 	}
 }
 
+// decodeResultStages decodes the outcomes of the filtering stages as a whole,
+// since their keys would otherwise be confused with the keys of the result.
+func decodeResultStages(dec *json.Decoder, ent *logEntry) {
+	err := dec.Decode(&ent.Result.Stages)
+	if err != nil {
+		log.Debug("decodeResultStages err: %s", err)
+
+		ent.Result.Stages = nil
+	}
+}
+
+// decodeAttempts decodes the exchanges with the upstream servers.  The objects
+// are decoded as a whole, since their keys would otherwise be confused with
+// the keys of the entry.
+func decodeAttempts(dec *json.Decoder, ent *logEntry) {
+	err := dec.Decode(&ent.Attempts)
+	if err != nil {
+		log.Debug("decodeAttempts err: %s", err)
+
+		ent.Attempts = nil
+	}
+}
+
+// decodeApplied decodes the summary of the applied settings as a whole, since
+// its keys would otherwise be confused with the keys of the entry.
+func decodeApplied(dec *json.Decoder, ent *logEntry) {
+	err := dec.Decode(&ent.Applied)
+	if err != nil {
+		log.Debug("decodeApplied err: %s", err)
+
+		ent.Applied = nil
+	}
+}
+
 func decodeLogEntry(ent *logEntry, str string) {
 	dec := json.NewDecoder(strings.NewReader(str))
 	dec.UseNumber()
@@ -558,6 +697,18 @@ func decodeLogEntry(ent *logEntry, str string) {
 			continue
 		}
 
+		if key == "Attempts" {
+			decodeAttempts(dec, ent)
+
+			continue
+		}
+
+		if key == "AS" {
+			decodeApplied(dec, ent)
+
+			continue
+		}
+
 		handler, ok := logEntryHandlers[key]
 		if !ok {
 			continue
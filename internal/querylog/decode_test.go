@@ -41,8 +41,24 @@ func TestDecodeLogEntry(t *testing.T) {
 			`{"FilterListID":43,"Text":"||an2.yandex.ru","IP":"127.0.0.3"}],` +
 			`"CanonName":"example.com",` +
 			`"ServiceName":"example.org",` +
+			`"RewriteScope":"device_pc",` +
+			`"RewritePicked":"127.0.0.2",` +
+			`"RewriteConflict":"block_won",` +
+			`"Stages":[{"Stage":"safe_browsing","Status":"disabled"},` +
+			`{"Stage":"filtering","Status":"matched"}],` +
 			`"DNSRewriteResult":{"RCode":0,"Response":{"1":["127.0.0.2"]}}},` +
-			`"Elapsed":837429}`
+			`"Elapsed":837429,` +
+			`"Attempts":[{"U":"1.1.1.1:53","O":"timeout","E":500000},` +
+			`{"U":"8.8.8.8:53","O":"success","E":300000}],` +
+			`"UpstreamElapsed":800000,` +
+			`"CO":true,` +
+			`"AS":{"client":"laptop","client_match":"127.0.0.1","profile":"kids",` +
+			`"sources":{"filtering":"global","safe_search":"profile",` +
+			`"safe_browsing":"global","parental":"profile",` +
+			`"blocked_services":"global","filter_groups":"global"},` +
+			`"blocked_services":[],"protection":true,"filtering":true,` +
+			`"safe_search":true,"safe_browsing":false,"parental":true,` +
+			`"aaaa_disabled":false}}`
 
 		ans, err := base64.StdEncoding.DecodeString(ansStr)
 		assert.Nil(t, err)
@@ -78,8 +94,47 @@ func TestDecodeLogEntry(t *testing.T) {
 						dns.TypeA: []rules.RRValue{net.IPv4(127, 0, 0, 2)},
 					},
 				},
+				RewriteScope:    "device_pc",
+				RewritePicked:   net.IPv4(127, 0, 0, 2),
+				RewriteConflict: dnsfilter.RewriteConflictBlockWon,
+				Stages: []dnsfilter.StageResult{{
+					Stage:  dnsfilter.StageSafeBrowsing,
+					Status: dnsfilter.StageDisabled,
+				}, {
+					Stage:  dnsfilter.StageFiltering,
+					Status: dnsfilter.StageMatched,
+				}},
 			},
 			Elapsed: 837429,
+			Attempts: []UpstreamAttempt{{
+				Upstream: "1.1.1.1:53",
+				Outcome:  UpstreamOutcomeTimeout,
+				Elapsed:  500000,
+			}, {
+				Upstream: "8.8.8.8:53",
+				Outcome:  UpstreamOutcomeSuccess,
+				Elapsed:  300000,
+			}},
+			UpstreamElapsed: 800000,
+			Coalesced:       true,
+			Applied: &dnsfilter.AppliedSettings{
+				Client:      "laptop",
+				ClientMatch: "127.0.0.1",
+				Profile:     "kids",
+				Sources: dnsfilter.SettingsSources{
+					Filtering:       dnsfilter.SettingsSourceGlobal,
+					SafeSearch:      dnsfilter.SettingsSourceProfile,
+					SafeBrowsing:    dnsfilter.SettingsSourceGlobal,
+					Parental:        dnsfilter.SettingsSourceProfile,
+					BlockedServices: dnsfilter.SettingsSourceGlobal,
+					FilterGroups:    dnsfilter.SettingsSourceGlobal,
+				},
+				BlockedServices: []string{},
+				Protection:      true,
+				Filtering:       true,
+				SafeSearch:      true,
+				Parental:        true,
+			},
 		}
 
 		got := &logEntry{}
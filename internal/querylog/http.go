@@ -3,28 +3,44 @@ package querylog
 import (
 	"encoding/json"
 	"fmt"
+	"math"
 	"net/http"
 	"net/url"
 	"strconv"
-	"time"
+	"strings"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghstrings"
-	"github.com/AdguardTeam/golibs/jsonutil"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/golibs/log"
 )
 
 type qlogConfig struct {
-	Enabled           bool   `json:"enabled"`
-	Interval          uint32 `json:"interval"`
-	AnonymizeClientIP bool   `json:"anonymize_client_ip"`
+	Enabled             bool   `json:"enabled"`
+	Interval            uint32 `json:"interval"`
+	AnonymizeClientIP   bool   `json:"anonymize_client_ip"`
+	AnonymizeClientPort bool   `json:"anonymize_client_port"`
+
+	// AnonymizeAfterHours is the age in hours after which the entries are
+	// anonymized.  Zero means never.
+	AnonymizeAfterHours uint32 `json:"anonymize_after_hours"`
+
+	// Mode defines the requests written to the log.
+	Mode Mode `json:"mode"`
+
+	// MaxFiles is the maximum number of the rotated log files kept.
+	MaxFiles uint32 `json:"max_files"`
 }
 
 // Register web handlers
 func (l *queryLog) initWeb() {
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog", l.handleQueryLog)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog/stream", l.handleQueryLogStream)
 	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_info", l.handleQueryLogInfo)
+	l.conf.HTTPRegister(http.MethodGet, "/control/querylog_summary", l.handleQueryLogSummary)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_clear", l.handleQueryLogClear)
 	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_config", l.handleQueryLogConfig)
+	l.conf.HTTPRegister(http.MethodPost, "/control/querylog_rotate", l.handleQueryLogRotate)
 }
 
 func httpError(r *http.Request, w http.ResponseWriter, code int, format string, args ...interface{}) {
@@ -35,6 +51,9 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 	http.Error(w, text, code)
 }
 
+// handleQueryLog is the handler for the GET /control/querylog HTTP API.  The
+// entries are sent in CSV if the client prefers it, see
+// aghhttp.ResponseFormat.
 func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	params, err := l.parseSearchParams(r)
 	if err != nil {
@@ -43,10 +62,30 @@ func (l *queryLog) handleQueryLog(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// search for the log entries
-	entries, oldest := l.search(params)
+	entries, oldest, warnings := l.search(params)
+
+	if params.format == aghhttp.FormatCSV {
+		err = l.writeEntriesCSV(w, entries)
+		if err != nil {
+			log.Debug("QueryLog: writing csv: %s", err)
+		}
+
+		return
+	}
 
 	// convert log entries to JSON
-	data := l.entriesToJSON(entries, oldest)
+	data := l.entriesToJSON(entries, oldest, params.verbose)
+
+	// The unreadable parts of the log files are skipped so that the rest of
+	// the entries are still shown.
+	if warnings == nil {
+		warnings = []*readWarning{}
+	}
+	data["warnings"] = warnings
+
+	// The mode is returned so that the UI can explain why some requests
+	// aren't in the log.
+	data["mode"] = l.conf.Mode.effective()
 
 	jsonVal, err := json.Marshal(data)
 	if err != nil {
@@ -65,12 +104,39 @@ func (l *queryLog) handleQueryLogClear(_ http.ResponseWriter, _ *http.Request) {
 	l.clear()
 }
 
+// handleQueryLogRotate is the handler for the POST /control/querylog_rotate
+// HTTP API.  It writes the buffered entries to the log file and rotates it
+// regardless of its age.
+func (l *queryLog) handleQueryLogRotate(w http.ResponseWriter, r *http.Request) {
+	if !l.conf.FileEnabled {
+		httpError(r, w, http.StatusBadRequest, "writing to file is disabled")
+
+		return
+	}
+
+	err := l.flushLogBuffer(true)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "flushing entries: %s", err)
+
+		return
+	}
+
+	err = l.rotate()
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "rotating: %s", err)
+	}
+}
+
 // Get configuration
 func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
 	resp := qlogConfig{}
 	resp.Enabled = l.conf.Enabled
 	resp.Interval = l.conf.RotationIvl
 	resp.AnonymizeClientIP = l.conf.AnonymizeClientIP
+	resp.AnonymizeClientPort = l.conf.AnonymizeClientPort
+	resp.AnonymizeAfterHours = l.conf.AnonymizeAfterHours
+	resp.Mode = l.conf.Mode.effective()
+	resp.MaxFiles = uint32(l.maxFiles())
 
 	jsonVal, err := json.Marshal(resp)
 	if err != nil {
@@ -86,33 +152,55 @@ func (l *queryLog) handleQueryLogInfo(w http.ResponseWriter, r *http.Request) {
 
 // Set configuration
 func (l *queryLog) handleQueryLogConfig(w http.ResponseWriter, r *http.Request) {
-	d := qlogConfig{}
-	req, err := jsonutil.DecodeObject(&d, r.Body)
+	params, err := aghhttp.JSONParams(r.Body)
 	if err != nil {
 		httpError(r, w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
-	if req.Exists("interval") && !checkInterval(d.Interval) {
-		httpError(r, w, http.StatusBadRequest, "Unsupported interval")
-		return
-	}
-
 	l.lock.Lock()
 	// copy data, modify it, then activate.  Other threads (readers) don't need to use this lock.
 	conf := *l.conf
-	if req.Exists("enabled") {
-		conf.Enabled = d.Enabled
-	}
-	if req.Exists("interval") {
-		conf.RotationIvl = d.Interval
-	}
-	if req.Exists("anonymize_client_ip") {
-		conf.AnonymizeClientIP = d.AnonymizeClientIP
+	conf.Enabled = params.Bool("enabled", conf.Enabled)
+	params.Value("interval", "one of 1, 7, 30, 90", func(s string) (perr error) {
+		var ivl uint64
+		ivl, perr = strconv.ParseUint(s, 10, 32)
+		if perr != nil {
+			return perr
+		} else if !checkInterval(uint32(ivl)) {
+			return strconv.ErrRange
+		}
+
+		conf.RotationIvl = uint32(ivl)
+
+		return nil
+	})
+	conf.AnonymizeClientIP = params.Bool("anonymize_client_ip", conf.AnonymizeClientIP)
+	conf.AnonymizeClientPort = params.Bool("anonymize_client_port", conf.AnonymizeClientPort)
+	conf.AnonymizeAfterHours = uint32(params.Int(
+		"anonymize_after_hours",
+		int64(conf.AnonymizeAfterHours),
+		0,
+		maxAnonymizeAfterHours,
+	))
+	conf.Mode = Mode(params.Enum("mode", string(conf.Mode), modeValues...))
+	conf.MaxFiles = uint32(params.Int("max_files", int64(conf.MaxFiles), 1, maxMaxFiles))
+
+	err = params.Err()
+	if err == nil {
+		l.conf = &conf
 	}
-	l.conf = &conf
 	l.lock.Unlock()
 
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	// Don't wait for the next rotation if the limit has been lowered.
+	l.trimRotated()
+
 	l.conf.ConfigModified()
 }
 
@@ -142,7 +230,17 @@ func (l *queryLog) parseSearchCriterion(q url.Values, name string, ct criterionT
 	}
 
 	if ct == ctFilteringStatus && !aghstrings.InSlice(filteringStatusValues, c.value) {
-		return false, c, fmt.Errorf("invalid value %s", c.value)
+		return false, c, &aghhttp.ParamError{
+			Name:     name,
+			Expected: "one of " + strings.Join(filteringStatusValues, ", "),
+			Value:    c.value,
+		}
+	} else if ct == ctTransport && !aghstrings.InSlice(transportValues, c.value) {
+		return false, c, &aghhttp.ParamError{
+			Name:     name,
+			Expected: "one of " + strings.Join(transportValues, ", "),
+			Value:    c.value,
+		}
 	}
 
 	return true, c, nil
@@ -153,31 +251,34 @@ func (l *queryLog) parseSearchParams(r *http.Request) (p *searchParams, err erro
 	p = newSearchParams()
 
 	q := r.URL.Query()
-	olderThan := q.Get("older_than")
-	if len(olderThan) != 0 {
-		p.olderThan, err = time.Parse(time.RFC3339Nano, olderThan)
-		if err != nil {
-			return nil, err
-		}
-	}
+	params := aghhttp.QueryParams(q)
+	params.Value("older_than", "a time in rfc 3339 format or unix seconds", func(s string) (perr error) {
+		p.olderThan, perr = aghtime.Parse(s)
 
-	var limit64 int64
-	if limit64, err = strconv.ParseInt(q.Get("limit"), 10, 64); err == nil {
-		p.limit = int(limit64)
-	}
+		return perr
+	})
 
-	var offset64 int64
-	if offset64, err = strconv.ParseInt(q.Get("offset"), 10, 64); err == nil {
-		p.offset = int(offset64)
+	p.limit = int(params.Int("limit", int64(p.limit), 0, math.MaxInt32))
+	if params.Has("offset") {
+		p.offset = int(params.Int("offset", 0, 0, math.MaxInt32))
 
 		// If we don't use "olderThan" and use offset/limit instead, we should change the default behavior
 		// and scan all log records until we found enough log entries
 		p.maxFileScanEntries = 0
 	}
 
+	p.verbose = params.Bool("verbose", false)
+	p.format = aghhttp.ResponseFormat(r, params)
+
+	err = params.Err()
+	if err != nil {
+		return nil, err
+	}
+
 	paramNames := map[string]criterionType{
 		"search":          ctDomainOrClient,
 		"response_status": ctFilteringStatus,
+		"transport":       ctTransport,
 	}
 
 	for k, v := range paramNames {
@@ -7,6 +7,8 @@ import (
 	"strings"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -17,14 +19,7 @@ import (
 // Get Client IP address
 func (l *queryLog) getClientIP(ip net.IP) (clientIP net.IP) {
 	if l.conf.AnonymizeClientIP && ip != nil {
-		const AnonymizeClientIPv4Mask = 16
-		const AnonymizeClientIPv6Mask = 112
-
-		if ip.To4() != nil {
-			return ip.Mask(net.CIDRMask(AnonymizeClientIPv4Mask, 32))
-		}
-
-		return ip.Mask(net.CIDRMask(AnonymizeClientIPv6Mask, 128))
+		return anonymizeIP(ip)
 	}
 
 	return ip
@@ -33,14 +28,15 @@ func (l *queryLog) getClientIP(ip net.IP) (clientIP net.IP) {
 // jobject is a JSON object alias.
 type jobject = map[string]interface{}
 
-// entriesToJSON converts query log entries to JSON.
-func (l *queryLog) entriesToJSON(entries []*logEntry, oldest time.Time) (res jobject) {
+// entriesToJSON converts query log entries to JSON.  If verbose is true, the
+// exchanges with the upstream servers are included.
+func (l *queryLog) entriesToJSON(entries []*logEntry, oldest time.Time, verbose bool) (res jobject) {
 	data := []jobject{}
 
 	// the elements order is already reversed (from newer to older)
 	for i := 0; i < len(entries); i++ {
 		entry := entries[i]
-		jsonEntry := l.logEntryToJSONEntry(entry)
+		jsonEntry := l.logEntryToJSONEntry(entry, verbose)
 		data = append(data, jsonEntry)
 	}
 
@@ -49,13 +45,13 @@ func (l *queryLog) entriesToJSON(entries []*logEntry, oldest time.Time) (res job
 		"oldest": "",
 	}
 	if !oldest.IsZero() {
-		res["oldest"] = oldest.Format(time.RFC3339Nano)
+		res["oldest"] = aghtime.Format(oldest, time.RFC3339Nano)
 	}
 
 	return res
 }
 
-func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
+func (l *queryLog) logEntryToJSONEntry(entry *logEntry, verbose bool) (jsonEntry jobject) {
 	var msg *dns.Msg
 
 	if len(entry.Answer) > 0 {
@@ -68,23 +64,63 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
 
 	jsonEntry = jobject{
 		"reason":       entry.Result.Reason.String(),
-		"elapsedMs":    strconv.FormatFloat(entry.Elapsed.Seconds()*1000, 'f', -1, 64),
-		"time":         entry.Time.Format(time.RFC3339Nano),
+		"reason_code":  entry.Result.Reason.Code(),
+		"elapsedMs":    formatElapsedMs(entry.Elapsed),
+		"time":         aghtime.Format(entry.Time, time.RFC3339Nano),
 		"client":       l.getClientIP(entry.IP),
 		"client_info":  entry.client,
 		"client_proto": entry.ClientProto,
+		"transport":    entry.transport(),
 		"upstream":     entry.Upstream,
-		"question": jobject{
-			"host":  entry.QHost,
-			"type":  entry.QType,
-			"class": entry.QClass,
-		},
 	}
 
+	question := jobject{
+		"host":  entry.QHost,
+		"type":  entry.QType,
+		"class": entry.QClass,
+	}
+
+	// Show the display form of the internationalized names next to the
+	// punycode one.
+	if u := aghnet.UnicodeDomain(entry.QHost); u != entry.QHost {
+		question["unicode_name"] = u
+	}
+
+	jsonEntry["question"] = question
+
 	if entry.ClientID != "" {
 		jsonEntry["client_id"] = entry.ClientID
 	}
 
+	if entry.Anonymized {
+		jsonEntry["anonymized"] = true
+	}
+
+	if entry.Coalesced {
+		jsonEntry["coalesced"] = true
+	}
+
+	if entry.TTLOverride != "" {
+		jsonEntry["ttl_override"] = entry.TTLOverride
+	}
+
+	if entry.ClientPort != 0 {
+		jsonEntry["client_port"] = entry.ClientPort
+	}
+
+	if len(entry.Attempts) > 0 {
+		jsonEntry["upstream_elapsed_ms"] = formatElapsedMs(entry.UpstreamElapsed)
+		jsonEntry["retries"] = len(entry.Attempts) - 1
+
+		if verbose {
+			jsonEntry["upstream_attempts"] = attemptsToJSON(entry.Attempts)
+		}
+	}
+
+	if verbose && entry.Applied != nil {
+		jsonEntry["applied_settings"] = entry.Applied
+	}
+
 	if msg != nil {
 		jsonEntry["status"] = dns.RcodeToString[msg.Rcode]
 
@@ -108,6 +144,22 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
 		jsonEntry["service_name"] = entry.Result.ServiceName
 	}
 
+	if entry.Result.RewriteScope != "" {
+		jsonEntry["rewrite_scope"] = entry.Result.RewriteScope
+	}
+
+	if entry.Result.RewriteConflict != "" {
+		jsonEntry["rewrite_conflict"] = entry.Result.RewriteConflict
+	}
+
+	if len(entry.Result.Stages) > 0 {
+		jsonEntry["filtering_stages"] = stagesToJSON(entry.Result.Stages)
+	}
+
+	if entry.Result.RewritePicked != nil {
+		jsonEntry["rewrite_picked"] = entry.Result.RewritePicked.String()
+	}
+
 	answers := answerToMap(msg)
 	if answers != nil {
 		jsonEntry["answer"] = answers
@@ -129,6 +181,38 @@ func (l *queryLog) logEntryToJSONEntry(entry *logEntry) (jsonEntry jobject) {
 	return jsonEntry
 }
 
+// formatElapsedMs formats d as a number of milliseconds.
+func formatElapsedMs(d time.Duration) (s string) {
+	return strconv.FormatFloat(d.Seconds()*1000, 'f', -1, 64)
+}
+
+// attemptsToJSON converts the exchanges with the upstream servers to JSON.
+func attemptsToJSON(attempts []UpstreamAttempt) (jsonAttempts []jobject) {
+	jsonAttempts = make([]jobject, len(attempts))
+	for i, a := range attempts {
+		jsonAttempts[i] = jobject{
+			"upstream":   a.Upstream,
+			"outcome":    a.Outcome,
+			"elapsed_ms": formatElapsedMs(a.Elapsed),
+		}
+	}
+
+	return jsonAttempts
+}
+
+// stagesToJSON returns the JSON form of the outcomes of the filtering stages.
+func stagesToJSON(stages []dnsfilter.StageResult) (jsonStages []jobject) {
+	jsonStages = make([]jobject, len(stages))
+	for i, s := range stages {
+		jsonStages[i] = jobject{
+			"stage":  s.Stage,
+			"status": s.Status,
+		}
+	}
+
+	return jsonStages
+}
+
 func resultRulesToJSONRules(rules []*dnsfilter.ResultRule) (jsonRules []jobject) {
 	jsonRules = make([]jobject, len(rules))
 	for i, r := range rules {
@@ -0,0 +1,87 @@
+package querylog
+
+import (
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/miekg/dns"
+)
+
+// Mode is the mode of the query log, which defines the requests written to
+// the log.  The requests not written are still counted in the statistics.
+type Mode string
+
+// Mode values.
+const (
+	// ModeAll means that all the requests are logged.  The empty mode
+	// means the same.
+	ModeAll Mode = "all"
+
+	// ModeBlockedOnly means that only the blocked requests are logged.
+	ModeBlockedOnly Mode = "blocked_only"
+
+	// ModeErrorsAndBlocked means that only the blocked and the failed
+	// requests are logged.
+	ModeErrorsAndBlocked Mode = "errors_and_blocked"
+
+	// ModeNone means that no requests are logged, while the entries already
+	// logged are still available.
+	ModeNone Mode = "none"
+)
+
+// modeValues are all the valid values of Mode.
+var modeValues = []string{
+	string(ModeAll),
+	string(ModeBlockedOnly),
+	string(ModeErrorsAndBlocked),
+	string(ModeNone),
+}
+
+// isValid returns true if m is a valid mode.
+func (m Mode) isValid() (ok bool) {
+	switch m {
+	case "", ModeAll, ModeBlockedOnly, ModeErrorsAndBlocked, ModeNone:
+		return true
+	default:
+		return false
+	}
+}
+
+// effective returns m or ModeAll if m is empty.
+func (m Mode) effective() (eff Mode) {
+	if m == "" {
+		return ModeAll
+	}
+
+	return m
+}
+
+// isBlocked returns true if p describes a request blocked by the filters, the
+// blocked services, the Safe Browsing, or the Parental Control.
+func isBlocked(p *AddParams) (ok bool) {
+	return p.Result != nil && p.Result.IsFiltered && p.Result.Reason.In(
+		dnsfilter.FilteredBlockList,
+		dnsfilter.FilteredBlockedService,
+		dnsfilter.FilteredSafeBrowsing,
+		dnsfilter.FilteredParental,
+	)
+}
+
+// isFailed returns true if p describes a request, which hasn't been responded
+// to or has been responded to with SERVFAIL.
+func isFailed(p *AddParams) (ok bool) {
+	return p.Answer == nil || p.Answer.Rcode == dns.RcodeServerFailure
+}
+
+// logs returns true if the request described by p should be logged in the
+// mode m.
+func (m Mode) logs(p *AddParams) (ok bool) {
+	switch m.effective() {
+	case ModeAll:
+		return true
+	case ModeBlockedOnly:
+		return isBlocked(p)
+	case ModeErrorsAndBlocked:
+		return isBlocked(p) || isFailed(p)
+	default:
+		return false
+	}
+}
@@ -15,9 +15,8 @@ import (
 	"github.com/miekg/dns"
 )
 
-const (
-	queryLogFileName = "querylog.json" // .gz added during compression
-)
+// FileName is the default name of the query log file.
+const FileName = "querylog.json"
 
 // queryLog is a structure that writes and reads the DNS query log
 type queryLog struct {
@@ -35,6 +34,26 @@ type queryLog struct {
 	fileFlushLock sync.Mutex // synchronize a file-flushing goroutine and main thread
 	flushPending  bool       // don't start another goroutine while the previous one is still running
 	fileWriteLock sync.Mutex
+
+	// refs keeps track of the readers of the log files.
+	refs fileRefs
+
+	// appendFile appends the data to the log file.  It's only replaced in
+	// tests.
+	appendFile func(name string, data []byte) (err error)
+
+	// subsLock protects subs.
+	subsLock sync.Mutex
+	// subs are the channels of the clients of the entries stream.
+	subs map[chan *logEntry]struct{}
+
+	// summaryLock protects the file with the summaries of the expired
+	// entries.
+	summaryLock sync.Mutex
+
+	// anonKey is the key of the hashes of the anonymized hosts.  It's only
+	// used by the anonymization pass.
+	anonKey []byte
 }
 
 // ClientProto values are names of the client protocols.
@@ -43,21 +62,35 @@ type ClientProto string
 // Client protocol names.
 const (
 	ClientProtoDOH      ClientProto = "doh"
+	ClientProtoDOH3     ClientProto = "doh3"
 	ClientProtoDOQ      ClientProto = "doq"
 	ClientProtoDOT      ClientProto = "dot"
 	ClientProtoDNSCrypt ClientProto = "dnscrypt"
+	ClientProtoUnix     ClientProto = "unix"
 	ClientProtoPlain    ClientProto = ""
 )
 
+// ClientNet values are the names of the networks the plain DNS requests are
+// received over.
+type ClientNet string
+
+// Client network names.
+const (
+	ClientNetUDP ClientNet = "udp"
+	ClientNetTCP ClientNet = "tcp"
+)
+
 // NewClientProto validates that the client protocol name is valid and returns
 // the name as a ClientProto.
 func NewClientProto(s string) (cp ClientProto, err error) {
 	switch cp = ClientProto(s); cp {
 	case
 		ClientProtoDOH,
+		ClientProtoDOH3,
 		ClientProtoDOQ,
 		ClientProtoDOT,
 		ClientProtoDNSCrypt,
+		ClientProtoUnix,
 		ClientProtoPlain:
 
 		return cp, nil
@@ -74,6 +107,10 @@ type logEntry struct {
 	IP   net.IP    `json:"IP"` // Client IP
 	Time time.Time `json:"T"`
 
+	// ClientPort is the source port of the request.  It's zero if it's
+	// unknown or not recorded.
+	ClientPort uint16 `json:"CPort,omitempty"`
+
 	QHost  string `json:"QH"`
 	QType  string `json:"QT"`
 	QClass string `json:"QC"`
@@ -81,12 +118,51 @@ type logEntry struct {
 	ClientID    string      `json:"CID,omitempty"`
 	ClientProto ClientProto `json:"CP"`
 
+	// ClientNet is the network of the plain DNS requests.  It's empty for
+	// the encrypted ones and the entries written before it was recorded.
+	ClientNet ClientNet `json:"CN,omitempty"`
+
 	Answer     []byte `json:",omitempty"` // sometimes empty answers happen like binerdunt.top or rev2.globalrootservers.net
 	OrigAnswer []byte `json:",omitempty"`
 
 	Result   dnsfilter.Result
 	Elapsed  time.Duration
 	Upstream string `json:",omitempty"` // if empty, means it was cached
+
+	// Attempts are the exchanges with the upstream servers.  There is more
+	// than one if the upstreams have been retried or queried in parallel.
+	Attempts []UpstreamAttempt `json:",omitempty"`
+
+	// UpstreamElapsed is the part of Elapsed spent waiting for the upstream
+	// servers.
+	UpstreamElapsed time.Duration `json:",omitempty"`
+
+	// TTLOverride is the pattern of the TTL override rule applied to the
+	// response of the upstream server, if any.
+	TTLOverride string `json:"TTLO,omitempty"`
+
+	// Applied is the summary of the settings applied to the request.
+	Applied *dnsfilter.AppliedSettings `json:"AS,omitempty"`
+
+	// Coalesced is true if the request has been answered with the response
+	// to an identical concurrent request.
+	Coalesced bool `json:"CO,omitempty"`
+
+	// Anonymized is true if the entry has been anonymized after the
+	// retention window.  Such entries have the subnet of the client instead
+	// of its address and the keyed hash of the host instead of the host.
+	Anonymized bool `json:"AN,omitempty"`
+}
+
+// transport returns the name of the transport the request is received over,
+// which is the client protocol for the encrypted requests and the network for
+// the plain ones.
+func (e *logEntry) transport() (tr string) {
+	if e.ClientProto != ClientProtoPlain {
+		return string(e.ClientProto)
+	}
+
+	return string(e.ClientNet)
 }
 
 func (l *queryLog) Start() {
@@ -94,6 +170,7 @@ func (l *queryLog) Start() {
 		l.initWeb()
 	}
 	go l.periodicRotate()
+	go l.periodicAnonymize()
 }
 
 func (l *queryLog) Close() {
@@ -118,15 +195,18 @@ func (l *queryLog) clear() {
 	l.flushPending = false
 	l.bufferLock.Unlock()
 
-	oldLogFile := l.logFile + ".1"
-	err := os.Remove(oldLogFile)
-	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing old log file %q: %s", oldLogFile, err)
+	l.refs.mu.Lock()
+	for _, fn := range logFileNames(l.logFile) {
+		l.refs.remove(fn)
 	}
+	l.refs.mu.Unlock()
 
-	err = os.Remove(l.logFile)
+	sumFile := summaryFileName(l.logFile)
+	l.summaryLock.Lock()
+	err := os.Remove(sumFile)
+	l.summaryLock.Unlock()
 	if err != nil && !errors.Is(err, os.ErrNotExist) {
-		log.Error("removing log file %q: %s", l.logFile, err)
+		log.Error("removing summaries file %q: %s", sumFile, err)
 	}
 
 	log.Debug("Query log: cleared")
@@ -146,6 +226,10 @@ func (l *queryLog) Add(params AddParams) {
 		return
 	}
 
+	if !l.conf.Mode.logs(&params) {
+		return
+	}
+
 	if params.Result == nil {
 		params.Result = &dnsfilter.Result{}
 	}
@@ -160,7 +244,18 @@ func (l *queryLog) Add(params AddParams) {
 		Upstream:    params.Upstream,
 		ClientID:    params.ClientID,
 		ClientProto: params.ClientProto,
+		ClientNet:   params.ClientNet,
+
+		Attempts:        params.UpstreamAttempts,
+		UpstreamElapsed: params.UpstreamElapsed,
+		TTLOverride:     params.TTLOverride,
+		Applied:         params.Applied,
+		Coalesced:       params.Coalesced,
+	}
+	if !l.conf.AnonymizeClientPort {
+		entry.ClientPort = params.ClientPort
 	}
+
 	q := params.Question.Question[0]
 	entry.QHost = strings.ToLower(q.Name[:len(q.Name)-1]) // remove the last dot
 	entry.QType = dns.Type(q.Qtype).String()
@@ -207,6 +302,11 @@ func (l *queryLog) Add(params AddParams) {
 	}
 	l.bufferLock.Unlock()
 
+	// Publish a copy, since the entries in the buffer are modified while
+	// searching.
+	pub := entry
+	l.publish(&pub)
+
 	// if buffer needs to be flushed to disk, do it now
 	if needFlush {
 		go func() {
@@ -214,3 +314,59 @@ func (l *queryLog) Add(params AddParams) {
 		}()
 	}
 }
+
+// entryOverhead is the estimate of the memory used by a log entry in addition
+// to the lengths of its variable-length fields.
+const entryOverhead = 512
+
+// entryMemUsage returns the estimate of the memory used by e.
+func entryMemUsage(e *logEntry) (n uint64) {
+	return entryOverhead + uint64(len(e.QHost)+len(e.Answer)+len(e.OrigAnswer)+len(e.Upstream))
+}
+
+// MemUsage implements the aghmem.Consumer interface for *queryLog.
+func (l *queryLog) MemUsage() (n uint64) {
+	l.bufferLock.RLock()
+	defer l.bufferLock.RUnlock()
+
+	for _, e := range l.buffer {
+		n += entryMemUsage(e)
+	}
+
+	return n
+}
+
+// ShedMem implements the aghmem.Consumer interface for *queryLog.  The oldest
+// entries are removed from the memory buffer and, if writing to file is
+// enabled, flushed to it.
+func (l *queryLog) ShedMem(n uint64) (freed uint64) {
+	l.fileFlushLock.Lock()
+	defer l.fileFlushLock.Unlock()
+
+	l.bufferLock.Lock()
+	var i int
+	for ; i < len(l.buffer) && freed < n; i++ {
+		freed += entryMemUsage(l.buffer[i])
+	}
+
+	shed := l.buffer[:i]
+	l.buffer = append([]*logEntry(nil), l.buffer[i:]...)
+	l.bufferLock.Unlock()
+
+	if !l.conf.FileEnabled {
+		return freed
+	}
+
+	// The shed entries are lost while the file system is read-only.
+	now := time.Now()
+	if !l.conf.WriteGuard.Allow(now) {
+		return freed
+	}
+
+	err := l.flushToFile(shed)
+	if !l.conf.WriteGuard.Report(err, now) && err != nil {
+		log.Error("querylog: flushing shed entries: %s", err)
+	}
+
+	return freed
+}
@@ -4,10 +4,13 @@ import (
 	"fmt"
 	"math/rand"
 	"net"
+	"os"
 	"sort"
+	"syscall"
 	"testing"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/dnsproxy/proxyutil"
@@ -116,7 +119,7 @@ func TestQueryLog(t *testing.T) {
 			params := newSearchParams()
 			params.searchCriteria = tc.sCr
 
-			entries, _ := l.search(params)
+			entries, _, _ := l.search(params)
 			require.Len(t, entries, len(tc.want))
 			for _, want := range tc.want {
 				assertLogEntry(t, entries[want.num], want.host, want.answer, want.client)
@@ -186,7 +189,7 @@ func TestQueryLogOffsetLimit(t *testing.T) {
 		t.Run(tc.name, func(t *testing.T) {
 			params.offset = tc.offset
 			params.limit = tc.limit
-			entries, _ := l.search(params)
+			entries, _, _ := l.search(params)
 
 			require.Len(t, entries, tc.wantLen)
 
@@ -220,7 +223,7 @@ func TestQueryLogMaxFileScanEntries(t *testing.T) {
 	for _, maxFileScanEntries := range []int{5, 0} {
 		t.Run(fmt.Sprintf("limit_%d", maxFileScanEntries), func(t *testing.T) {
 			params.maxFileScanEntries = maxFileScanEntries
-			entries, _ := l.search(params)
+			entries, _, _ := l.search(params)
 			assert.Len(t, entries, entNum-maxFileScanEntries)
 		})
 	}
@@ -241,12 +244,112 @@ func TestQueryLogFileDisabled(t *testing.T) {
 	addEntry(l, "example3.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
 
 	params := newSearchParams()
-	ll, _ := l.search(params)
+	ll, _, _ := l.search(params)
 	require.Len(t, ll, 2)
 	assert.Equal(t, "example3.org", ll[0].QHost)
 	assert.Equal(t, "example2.org", ll[1].QHost)
 }
 
+func TestQueryLog_ShedMem(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: false,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "example1.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "example2.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "example3.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+
+	usage := l.MemUsage()
+	require.NotZero(t, usage)
+
+	// Shed a single entry.
+	freed := l.ShedMem(1)
+	assert.Equal(t, usage-freed, l.MemUsage())
+
+	params := newSearchParams()
+	ll, _, _ := l.search(params)
+	require.Len(t, ll, 2)
+	assert.Equal(t, "example3.org", ll[0].QHost)
+	assert.Equal(t, "example2.org", ll[1].QHost)
+
+	usage = l.MemUsage()
+	assert.Equal(t, usage, l.ShedMem(usage))
+	assert.Zero(t, l.MemUsage())
+}
+
+func TestQueryLog_readOnly(t *testing.T) {
+	var changes []bool
+	guard := aghos.NewWriteGuard("querylog", func(_ string, memOnly bool) {
+		changes = append(changes, memOnly)
+	})
+
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+		WriteGuard:  guard,
+	})
+
+	writes := 0
+	l.appendFile = func(_ string, _ []byte) (err error) {
+		writes++
+
+		return &os.PathError{Op: "open", Path: l.logFile, Err: syscall.EROFS}
+	}
+
+	addEntry(l, "example1.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.Error(t, l.flushLogBuffer(true))
+	assert.Equal(t, []bool{true}, changes)
+	assert.True(t, guard.MemoryOnly())
+
+	// The requests are still logged and the entries are kept in memory.
+	addEntry(l, "example2.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	ll, _, _ := l.search(newSearchParams())
+	require.Len(t, ll, 2)
+	assert.Equal(t, "example2.org", ll[0].QHost)
+	assert.Equal(t, "example1.org", ll[1].QHost)
+
+	// The writes aren't retried too often.
+	l.conf.MemSize = 1
+	require.NoError(t, l.flushLogBuffer(false))
+	assert.Equal(t, 1, writes)
+
+	ll, _, _ = l.search(newSearchParams())
+	assert.Len(t, ll, 2)
+
+	// Once the file system is writable, the accumulated entries are
+	// written.
+	l.appendFile = appendToFile
+	require.NoError(t, l.flushLogBuffer(true))
+	assert.Equal(t, []bool{true, false}, changes)
+	assert.False(t, guard.MemoryOnly())
+
+	l.conf.MemSize = 100
+	ll, _, _ = l.search(newSearchParams())
+	require.Len(t, ll, 2)
+	assert.Equal(t, "example2.org", ll[0].QHost)
+	assert.Zero(t, l.MemUsage())
+}
+
+func TestTrimMemOnly(t *testing.T) {
+	buf := make([]*logEntry, maxMemOnlyEntries+2)
+	for i := range buf {
+		buf[i] = &logEntry{QHost: fmt.Sprint(i)}
+	}
+
+	trimmed := trimMemOnly(buf)
+	require.Len(t, trimmed, maxMemOnlyEntries)
+	assert.Equal(t, "2", trimmed[0].QHost)
+
+	assert.Len(t, trimMemOnly(buf[:3]), 3)
+}
+
 func addEntry(l *queryLog, host string, answerStr, client net.IP) {
 	q := dns.Msg{
 		Question: []dns.Question{{
@@ -373,3 +476,75 @@ func TestLogEntriesByTime_sort(t *testing.T) {
 			"%s %s", entries[i+1].Time, entries[i].Time)
 	}
 }
+
+func TestQueryLog_mode(t *testing.T) {
+	q := &dns.Msg{}
+	q.SetQuestion("example.org.", dns.TypeA)
+
+	okAns := (&dns.Msg{}).SetReply(q)
+	failAns := (&dns.Msg{}).SetRcode(q, dns.RcodeServerFailure)
+
+	blocked := &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.FilteredBlockList,
+	}
+	rewritten := &dnsfilter.Result{
+		IsFiltered: true,
+		Reason:     dnsfilter.Rewritten,
+	}
+
+	params := []AddParams{{
+		Answer: okAns,
+	}, {
+		Answer: okAns,
+		Result: blocked,
+	}, {
+		Answer: okAns,
+		Result: rewritten,
+	}, {
+		Answer: failAns,
+	}, {
+		Answer: nil,
+	}}
+
+	testCases := []struct {
+		mode Mode
+		want int
+	}{{
+		mode: "",
+		want: 5,
+	}, {
+		mode: ModeAll,
+		want: 5,
+	}, {
+		mode: ModeBlockedOnly,
+		want: 1,
+	}, {
+		mode: ModeErrorsAndBlocked,
+		want: 3,
+	}, {
+		mode: ModeNone,
+		want: 0,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			l := newQueryLog(Config{
+				Enabled:     true,
+				RotationIvl: 1,
+				MemSize:     100,
+				BaseDir:     t.TempDir(),
+				Mode:        tc.mode,
+			})
+
+			for _, p := range params {
+				p.Question = q
+				p.ClientIP = net.IP{1, 2, 3, 4}
+				l.Add(p)
+			}
+
+			ll, _, _ := l.search(newSearchParams())
+			assert.Len(t, ll, tc.want)
+		})
+	}
+}
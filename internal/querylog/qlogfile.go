@@ -35,6 +35,10 @@ type QLogFile struct {
 	file     *os.File // the query log file
 	position int64    // current position in the file
 
+	// lineStart is the position of the line returned by the last ReadNext
+	// call.
+	lineStart int64
+
 	buffer      []byte // buffer that we've read from the file
 	bufferStart int64  // start of the buffer (in the file)
 	bufferLen   int    // buffer len
@@ -197,6 +201,8 @@ func (q *QLogFile) ReadNext() (string, error) {
 		return "", err
 	}
 
+	q.lineStart = lineIdx
+
 	// Shift position
 	if lineIdx == 0 {
 		q.position = 0
@@ -22,36 +22,74 @@ type QLogReader struct {
 	qFiles []*QLogFile
 
 	currentFile int // Index of the current file
+
+	// warnings describe the parts of the files which have been skipped.
+	warnings []*readWarning
+
+	// release is called once the reader is closed, if it's not nil.
+	release func()
+}
+
+// maxReadWarnings is the maximum number of warnings a QLogReader keeps.  The
+// rest are only logged.
+const maxReadWarnings = 10
+
+// readWarning describes a part of a query log file which has been skipped
+// because it could not be read.
+type readWarning struct {
+	File   string `json:"file"`
+	Error  string `json:"error"`
+	Offset int64  `json:"offset"`
+}
+
+// warn records that the data at offset in the file with name has been skipped
+// because of err.
+func (r *QLogReader) warn(name string, offset int64, err error) {
+	log.Error("querylog: skipping %s at offset %d: %s", name, offset, err)
+
+	if len(r.warnings) < maxReadWarnings {
+		r.warnings = append(r.warnings, &readWarning{
+			File:   name,
+			Error:  err.Error(),
+			Offset: offset,
+		})
+	}
 }
 
-// NewQLogReader initializes a QLogReader instance
-// with the specified files
+// warnLine records that the line returned by the last ReadNext call has been
+// skipped because of err.
+func (r *QLogReader) warnLine(err error) {
+	if r.currentFile < 0 || r.currentFile >= len(r.qFiles) {
+		return
+	}
+
+	q := r.qFiles[r.currentFile]
+	r.warn(q.file.Name(), q.lineStart, err)
+}
+
+// NewQLogReader initializes a QLogReader instance with the specified files.
+// The files which can't be opened are skipped with a warning.
 func NewQLogReader(files []string) (*QLogReader, error) {
-	qFiles := make([]*QLogFile, 0)
+	r := &QLogReader{
+		qFiles: make([]*QLogFile, 0),
+	}
 
 	for _, f := range files {
 		q, err := NewQLogFile(f)
 		if err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				continue
-			}
-
-			// Close what we've already opened.
-			cerr := closeQFiles(qFiles)
-			if cerr != nil {
-				log.Debug("querylog: closing files: %s", cerr)
+			if !errors.Is(err, os.ErrNotExist) {
+				r.warn(f, 0, err)
 			}
 
-			return nil, err
+			continue
 		}
 
-		qFiles = append(qFiles, q)
+		r.qFiles = append(r.qFiles, q)
 	}
 
-	return &QLogReader{
-		qFiles:      qFiles,
-		currentFile: (len(qFiles) - 1),
-	}, nil
+	r.currentFile = len(r.qFiles) - 1
+
+	return r, nil
 }
 
 // SeekTS performs binary search of a query log record with the specified
@@ -112,24 +150,28 @@ func (r *QLogReader) ReadNext() (string, error) {
 	for r.currentFile >= 0 {
 		q := r.qFiles[r.currentFile]
 		line, err := q.ReadNext()
-		if err != nil {
-			// Shift to the older file
-			r.currentFile--
-			if r.currentFile < 0 {
-				break
-			}
+		if err == nil {
+			return line, nil
+		}
+
+		if err != io.EOF {
+			// Skip the rest of the unreadable file.
+			r.warn(q.file.Name(), q.position, err)
+		}
 
-			q = r.qFiles[r.currentFile]
+		// Shift to the older file
+		r.currentFile--
+		if r.currentFile < 0 {
+			break
+		}
 
-			// Set it's position to the start right away
-			_, err = q.SeekStart()
+		q = r.qFiles[r.currentFile]
 
-			// This is unexpected, return an error right away
-			if err != nil {
-				return "", err
-			}
-		} else {
-			return line, nil
+		// Set it's position to the start right away.  If that fails,
+		// the file is skipped on the next iteration.
+		_, err = q.SeekStart()
+		if err != nil {
+			r.warn(q.file.Name(), 0, err)
 		}
 	}
 
@@ -139,6 +181,11 @@ func (r *QLogReader) ReadNext() (string, error) {
 
 // Close closes the QLogReader
 func (r *QLogReader) Close() error {
+	if r.release != nil {
+		defer r.release()
+		r.release = nil
+	}
+
 	return closeQFiles(r.qFiles)
 }
 
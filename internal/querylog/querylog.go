@@ -1,12 +1,16 @@
 package querylog
 
 import (
+	"context"
+	"io"
 	"net"
 	"net/http"
 	"path/filepath"
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghmem"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	"github.com/miekg/dns"
@@ -14,6 +18,8 @@ import (
 
 // QueryLog - main interface
 type QueryLog interface {
+	aghmem.Consumer
+
 	Start()
 
 	// Close query log object
@@ -22,8 +28,27 @@ type QueryLog interface {
 	// Add a log entry
 	Add(params AddParams)
 
+	// Entry returns the information about the log entry with exactly the
+	// given time, if there is one.
+	Entry(t time.Time) (ei *EntryInfo, ok bool)
+
+	// Scan calls f for each entry newer than since from the newest to the
+	// oldest, including the ones of the other instances sharing the log
+	// directory, until f returns false or ctx is done.  complete is true if
+	// all such entries have been passed to f.
+	Scan(ctx context.Context, since time.Time, f func(ei *EntryInfo) (cont bool)) (complete bool)
+
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(c *Config)
+
+	// Rotation returns the state of the rotation of the log files.  rs is
+	// nil if the log isn't written to files.
+	Rotation() (rs *RotationState)
+
+	// WriteAnonymizedSample writes the latest limit entries to w as JSON
+	// lines.  The entries are anonymized as the old ones are, regardless of
+	// the configuration.
+	WriteAnonymizedSample(w io.Writer, limit int) (err error)
 }
 
 // Config - configuration object
@@ -41,11 +66,24 @@ type Config struct {
 	// BaseDir is the base directory for log files.
 	BaseDir string
 
+	// FileName is the name of the log file within BaseDir.  An empty name
+	// means FileName.
+	FileName string
+
+	// PeerFiles returns the paths to the log files of the other instances
+	// sharing BaseDir, which are searched along with the own ones.  It may
+	// be nil.
+	PeerFiles func() (fns []string)
+
 	// RotationIvl is the interval for log rotation, in days.  After that
 	// period, the old log file will be renamed, NOT deleted, so the actual
-	// log retention time is twice the interval.
+	// log retention time is MaxFiles plus one intervals.
 	RotationIvl uint32
 
+	// MaxFiles is the maximum number of the rotated log files kept.  The
+	// oldest ones over it are removed.  Zero means one.
+	MaxFiles uint32
+
 	// MemSize is the number of entries kept in a memory buffer before they
 	// are flushed to disk.
 	MemSize uint32
@@ -59,6 +97,25 @@ type Config struct {
 	// AnonymizeClientIP tells if the query log should anonymize clients' IP
 	// addresses.
 	AnonymizeClientIP bool
+
+	// AnonymizeClientPort tells if the query log shouldn't record the
+	// source ports of the requests.
+	AnonymizeClientPort bool
+
+	// AnonymizeAfterHours is the age in hours after which the entries are
+	// anonymized: the client is replaced by its subnet and the host by its
+	// keyed hash.  Zero means that the entries are kept intact.
+	AnonymizeAfterHours uint32
+
+	// WriteGuard tracks the writes of the log files, so that the entries
+	// are kept in memory while the file system is read-only.  It may be
+	// nil.
+	WriteGuard *aghos.WriteGuard
+
+	// Mode defines the requests written to the log.  The other requests
+	// are kept neither in memory nor on disk.  An empty mode means
+	// ModeAll.
+	Mode Mode
 }
 
 // AddParams - parameters for Add()
@@ -70,8 +127,79 @@ type AddParams struct {
 	Elapsed     time.Duration     // Time spent for processing the request
 	ClientID    string
 	ClientIP    net.IP
+	ClientPort  uint16
 	Upstream    string // Upstream server URL
 	ClientProto ClientProto
+
+	// ClientNet is the network of the plain DNS requests.  It must be empty
+	// for the encrypted ones.
+	ClientNet ClientNet
+
+	// UpstreamAttempts are the exchanges with the upstream servers made to
+	// resolve the request, if any.
+	UpstreamAttempts []UpstreamAttempt
+
+	// UpstreamElapsed is the part of Elapsed spent waiting for the upstream
+	// servers.
+	UpstreamElapsed time.Duration
+
+	// TTLOverride is the pattern of the TTL override rule applied to the
+	// response of the upstream server, if any.
+	TTLOverride string
+
+	// Applied is the summary of the settings applied to the request, if
+	// the request has been filtered.
+	Applied *dnsfilter.AppliedSettings
+
+	// Coalesced is true if the request has been answered with the response
+	// to an identical request from another client, which has been
+	// resolved at the same time.
+	Coalesced bool
+}
+
+// UpstreamOutcome is the outcome of an exchange with an upstream server.
+type UpstreamOutcome string
+
+// UpstreamOutcome values.
+const (
+	UpstreamOutcomeSuccess UpstreamOutcome = "success"
+	UpstreamOutcomeTimeout UpstreamOutcome = "timeout"
+	UpstreamOutcomeError   UpstreamOutcome = "error"
+)
+
+// UpstreamAttempt is a single exchange with an upstream server.
+type UpstreamAttempt struct {
+	// Upstream is the address of the upstream server.
+	Upstream string `json:"U"`
+
+	// Outcome is the outcome of the exchange.
+	Outcome UpstreamOutcome `json:"O"`
+
+	// Elapsed is the duration of the exchange.
+	Elapsed time.Duration `json:"E"`
+}
+
+// EntryInfo is the information about a single query log entry.
+type EntryInfo struct {
+	// Time is the time of the entry.  It's also used as the ID of the
+	// entry in the HTTP API.
+	Time time.Time
+
+	// ClientIP is the IP address of the client.  It may be anonymized.
+	ClientIP net.IP
+
+	// Host is the requested hostname without the trailing dot.
+	Host string
+
+	// QType is the type of the question, for example "AAAA".
+	QType string
+
+	// ClientID is the ID sent by the client for encrypted requests, if
+	// there was any.
+	ClientID string
+
+	// Result is the filtering result.
+	Result dnsfilter.Result
 }
 
 // validate returns an error if the parameters aren't valid.
@@ -104,10 +232,16 @@ func newQueryLog(conf Config) (l *queryLog) {
 		}
 	}
 
+	fileName := conf.FileName
+	if fileName == "" {
+		fileName = FileName
+	}
+
 	l = &queryLog{
 		findClient: findClient,
+		appendFile: appendToFile,
 
-		logFile: filepath.Join(conf.BaseDir, queryLogFileName),
+		logFile: filepath.Join(conf.BaseDir, fileName),
 	}
 
 	l.conf = &Config{}
@@ -121,5 +255,19 @@ func newQueryLog(conf Config) (l *queryLog) {
 		l.conf.RotationIvl = 1
 	}
 
+	if conf.MaxFiles > maxMaxFiles {
+		log.Info(
+			"querylog: warning: too many rotated files %d, setting to %d",
+			conf.MaxFiles,
+			maxMaxFiles,
+		)
+		l.conf.MaxFiles = maxMaxFiles
+	}
+
+	if !conf.Mode.isValid() {
+		log.Info("querylog: warning: unsupported mode %q, setting to %q", conf.Mode, ModeAll)
+		l.conf.Mode = ModeAll
+	}
+
 	return l
 }
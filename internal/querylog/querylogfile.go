@@ -4,13 +4,31 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"os"
 	"time"
 
 	"github.com/AdguardTeam/golibs/log"
 )
 
-// flushLogBuffer flushes the current buffer to file and resets the current buffer
+// maxMemOnlyEntries is the maximum number of the entries kept in the memory
+// buffer while the log file can't be written since the file system is
+// read-only.  The oldest entries over the limit are dropped.
+const maxMemOnlyEntries = 10_000
+
+// trimMemOnly returns the latest maxMemOnlyEntries of buf.
+func trimMemOnly(buf []*logEntry) (trimmed []*logEntry) {
+	if len(buf) <= maxMemOnlyEntries {
+		return buf
+	}
+
+	return append([]*logEntry(nil), buf[len(buf)-maxMemOnlyEntries:]...)
+}
+
+// flushLogBuffer flushes the current buffer to file and resets the current
+// buffer.  While the file system is read-only, the entries are kept in the
+// buffer and the writes are only retried once in aghos.ReadOnlyRetryIvl,
+// unless fullFlush is true.
 func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	if !l.conf.FileEnabled {
 		return nil
@@ -19,6 +37,8 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 	l.fileFlushLock.Lock()
 	defer l.fileFlushLock.Unlock()
 
+	now := time.Now()
+
 	// flush remainder to file
 	l.bufferLock.Lock()
 	needFlush := len(l.buffer) >= int(l.conf.MemSize)
@@ -26,11 +46,30 @@ func (l *queryLog) flushLogBuffer(fullFlush bool) error {
 		l.bufferLock.Unlock()
 		return nil
 	}
+
+	if !fullFlush && !l.conf.WriteGuard.Allow(now) {
+		l.buffer = trimMemOnly(l.buffer)
+		l.flushPending = false
+		l.bufferLock.Unlock()
+
+		return nil
+	}
+
 	flushBuffer := l.buffer
 	l.buffer = nil
 	l.flushPending = false
 	l.bufferLock.Unlock()
 	err := l.flushToFile(flushBuffer)
+	if l.conf.WriteGuard.Report(err, now) {
+		// Put the entries back in front of the ones added meanwhile, so
+		// that they're written once the file system is writable again.
+		l.bufferLock.Lock()
+		l.buffer = trimMemOnly(append(flushBuffer, l.buffer...))
+		l.bufferLock.Unlock()
+
+		return err
+	}
+
 	if err != nil {
 		log.Error("Saving querylog to file failed: %s", err)
 		return err
@@ -66,34 +105,65 @@ func (l *queryLog) flushToFile(buffer []*logEntry) error {
 
 	l.fileWriteLock.Lock()
 	defer l.fileWriteLock.Unlock()
-	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+
+	err = l.appendFile(filename, zb.Bytes())
 	if err != nil {
-		log.Error("failed to create file \"%s\": %s", filename, err)
 		return err
 	}
-	defer f.Close()
 
-	n, err := f.Write(zb.Bytes())
+	log.Debug("querylog: ok \"%s\": %v bytes written", filename, zb.Len())
+
+	return nil
+}
+
+// appendToFile appends data to the file with name creating it if necessary.
+func appendToFile(name string, data []byte) (err error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
 	if err != nil {
-		log.Error("Couldn't write to file: %s", err)
-		return err
+		return fmt.Errorf("opening file: %w", err)
 	}
+	defer func() {
+		cerr := f.Close()
+		if err == nil {
+			err = cerr
+		}
+	}()
 
-	log.Debug("querylog: ok \"%s\": %v bytes written", filename, n)
+	_, err = f.Write(data)
+	if err != nil {
+		return fmt.Errorf("writing file: %w", err)
+	}
 
 	return nil
 }
 
+// rotate renames the log file to the first rotated one, shifting the other
+// rotated files, and removes the oldest rotated files over the limit.
 func (l *queryLog) rotate() error {
 	from := l.logFile
 	to := l.logFile + ".1"
 
-	err := os.Rename(from, to)
+	// Don't let the anonymization pass rewrite the file being renamed.
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	_, err := os.Stat(from)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+
+	l.refs.mu.Lock()
+	defer l.refs.mu.Unlock()
+
+	err = l.shiftRotated()
 	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return nil
-		}
+		log.Error("querylog: failed to shift rotated files: %s", err)
 
+		return err
+	}
+
+	err = os.Rename(from, to)
+	if err != nil {
 		log.Error("querylog: failed to rename file: %s", err)
 
 		return err
@@ -101,11 +171,27 @@ func (l *queryLog) rotate() error {
 
 	log.Debug("querylog: renamed %s -> %s", from, to)
 
+	l.removeExcess(time.Now())
+
 	return nil
 }
 
-func (l *queryLog) readFileFirstTimeValue() int64 {
-	f, err := os.Open(l.logFile)
+// trimRotated removes the oldest rotated files over the limit, which may be
+// left after the limit has been lowered.
+func (l *queryLog) trimRotated() {
+	l.fileWriteLock.Lock()
+	defer l.fileWriteLock.Unlock()
+
+	l.refs.mu.Lock()
+	defer l.refs.mu.Unlock()
+
+	l.removeExcess(time.Now())
+}
+
+// readFileFirstTimeValue returns the time of the first entry of the file with
+// the path fn in Unix seconds or -1 if it can't be read.
+func readFileFirstTimeValue(fn string) int64 {
+	f, err := os.Open(fn)
 	if err != nil {
 		return -1
 	}
@@ -124,18 +210,21 @@ func (l *queryLog) readFileFirstTimeValue() int64 {
 		return -1
 	}
 
-	log.Debug("querylog: the oldest log entry: %s", val)
+	log.Debug("querylog: the oldest entry of %s: %s", fn, val)
 	return t.Unix()
 }
 
 func (l *queryLog) periodicRotate() {
 	intervalSeconds := uint64(l.conf.RotationIvl) * 24 * 60 * 60
 	for {
-		oldest := l.readFileFirstTimeValue()
+		oldest := readFileFirstTimeValue(l.logFile)
 		if uint64(oldest)+intervalSeconds <= uint64(time.Now().Unix()) {
 			_ = l.rotate()
 		}
 
+		// The limit may have been lowered since the last rotation.
+		l.trimRotated()
+
 		time.Sleep(24 * time.Hour)
 	}
 }
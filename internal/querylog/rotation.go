@@ -0,0 +1,282 @@
+package querylog
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// maxMaxFiles is the maximum number of the rotated log files which can be
+// kept.
+const maxMaxFiles = 1000
+
+// removedSuffix is the suffix of the rotated log files over the limit which
+// are still read.  They're removed once the reading is finished.
+const removedSuffix = ".removed"
+
+// rotatedFileNames returns the paths to the rotated log files of the log file
+// with the path logFile, the oldest first.  The rotated files have the number
+// suffixes, the greater ones being the older ones.
+func rotatedFileNames(logFile string) (fns []string) {
+	dir, base := filepath.Split(logFile)
+	readDir := dir
+	if readDir == "" {
+		readDir = "."
+	}
+
+	infos, err := ioutil.ReadDir(readDir)
+	if err != nil {
+		log.Debug("querylog: listing rotated files: %s", err)
+
+		return nil
+	}
+
+	nums := map[string]int{}
+	prefix := base + "."
+	for _, fi := range infos {
+		name := fi.Name()
+		if fi.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		n, perr := strconv.Atoi(name[len(prefix):])
+		if perr != nil || n < 1 {
+			continue
+		}
+
+		fn := filepath.Join(dir, name)
+		nums[fn] = n
+		fns = append(fns, fn)
+	}
+
+	sort.Slice(fns, func(i, j int) (less bool) {
+		return nums[fns[i]] > nums[fns[j]]
+	})
+
+	return fns
+}
+
+// logFileNames returns the paths to the rotated log files of the log file with
+// the path logFile and to logFile itself, the oldest first.
+func logFileNames(logFile string) (fns []string) {
+	return append(rotatedFileNames(logFile), logFile)
+}
+
+// fileRefs keeps track of the readers of the log files, so that the rotated
+// files over the limit are never removed while they're read.
+type fileRefs struct {
+	// mu protects readers and doomed.  It's also held while the log files
+	// are opened by a reader and while they're renamed by the rotation, so
+	// that the reader never opens a file by a stale name.
+	mu sync.Mutex
+
+	// readers is the number of the open readers.
+	readers int
+
+	// doomed are the paths to the files which are removed once there are
+	// no readers.
+	doomed []string
+}
+
+// open returns the reader of the log file with the path logFile and its
+// rotated files.  The files aren't removed until the reader is closed.
+func (fr *fileRefs) open(logFile string) (r *QLogReader, err error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	r, err = NewQLogReader(logFileNames(logFile))
+	if err != nil {
+		return nil, err
+	}
+
+	fr.readers++
+	r.release = fr.release
+
+	return r, nil
+}
+
+// release unregisters a reader and removes the doomed files if it's the last
+// one.
+func (fr *fileRefs) release() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+
+	fr.readers--
+	if fr.readers > 0 {
+		return
+	}
+
+	for _, fn := range fr.doomed {
+		removeFile(fn)
+	}
+
+	fr.doomed = nil
+}
+
+// remove removes the file with the path fn or, if there are readers, takes it
+// out of the sequence of the rotated files and defers the removal until
+// they're done.  fr.mu is expected to be locked.
+func (fr *fileRefs) remove(fn string) {
+	if fr.readers == 0 {
+		removeFile(fn)
+
+		return
+	}
+
+	doomed := fn + removedSuffix
+	err := os.Rename(fn, doomed)
+	if err != nil {
+		log.Error("querylog: deferring removal of %q: %s", fn, err)
+
+		return
+	}
+
+	fr.doomed = append(fr.doomed, doomed)
+}
+
+// removeFile removes the file with the path fn logging the error, if any.
+func removeFile(fn string) {
+	err := os.Remove(fn)
+	if err != nil && !os.IsNotExist(err) {
+		log.Error("querylog: removing %q: %s", fn, err)
+
+		return
+	}
+
+	log.Debug("querylog: removed %q", fn)
+}
+
+// maxFiles returns the maximum number of the rotated log files.
+func (l *queryLog) maxFiles() (n int) {
+	if l.conf.MaxFiles == 0 {
+		return 1
+	}
+
+	return int(l.conf.MaxFiles)
+}
+
+// shiftRotated renames each rotated log file to the one with the next number,
+// so that the number one is free.  The oldest ones are renamed first, so that
+// none is overwritten.  l.refs.mu is expected to be locked.
+func (l *queryLog) shiftRotated() (err error) {
+	prefix := filepath.Base(l.logFile) + "."
+	for _, fn := range rotatedFileNames(l.logFile) {
+		// rotatedFileNames only returns the files with valid numbers.
+		n, _ := strconv.Atoi(strings.TrimPrefix(filepath.Base(fn), prefix))
+		to := fmt.Sprintf("%s.%d", l.logFile, n+1)
+
+		err = os.Rename(fn, to)
+		if err != nil {
+			return fmt.Errorf("renaming %q: %w", fn, err)
+		}
+	}
+
+	return nil
+}
+
+// removeExcess summarizes and removes the oldest rotated log files over the
+// limit.  l.fileWriteLock and l.refs.mu are expected to be locked.
+func (l *queryLog) removeExcess(now time.Time) {
+	rotated := rotatedFileNames(l.logFile)
+	excess := len(rotated) - l.maxFiles()
+	for i := 0; i < excess; i++ {
+		fn := rotated[i]
+
+		// The entries of the removed file expire now, so keep their
+		// summaries.
+		err := l.summarizeExpired(fn, now)
+		if err != nil {
+			log.Error("querylog: summarizing expired entries: %s", err)
+		}
+
+		l.refs.remove(fn)
+	}
+}
+
+// RotationState is the state of the rotation of the log files.
+type RotationState struct {
+	// Oldest is the time of the oldest entry within the log files.  It's
+	// empty if there are no entries.
+	Oldest string `json:"oldest,omitempty"`
+
+	// Newest is the time of the newest entry within the log files.  It's
+	// empty if there are no entries.
+	Newest string `json:"newest,omitempty"`
+
+	// ActiveSize is the size of the file the entries are written to, in
+	// bytes.
+	ActiveSize int64 `json:"active_size"`
+
+	// TotalSize is the size of all the log files, in bytes.
+	TotalSize int64 `json:"total_size"`
+
+	// RotatedFiles is the number of the rotated log files.
+	RotatedFiles int `json:"rotated_files"`
+
+	// MaxFiles is the maximum number of the rotated log files.
+	MaxFiles int `json:"max_files"`
+}
+
+// Rotation implements the QueryLog interface for *queryLog.
+func (l *queryLog) Rotation() (rs *RotationState) {
+	if !l.conf.FileEnabled {
+		return nil
+	}
+
+	rs = &RotationState{
+		MaxFiles: l.maxFiles(),
+	}
+
+	r, err := l.refs.open(l.logFile)
+	if err != nil {
+		log.Error("querylog: opening files: %s", err)
+
+		return rs
+	}
+	defer r.Close()
+
+	for _, q := range r.qFiles {
+		fi, serr := q.file.Stat()
+		if serr != nil {
+			continue
+		}
+
+		rs.TotalSize += fi.Size()
+		if q.file.Name() == l.logFile {
+			rs.ActiveSize = fi.Size()
+		} else {
+			rs.RotatedFiles++
+		}
+	}
+
+	if len(r.qFiles) == 0 {
+		return rs
+	}
+
+	if ts := readFileFirstTimeValue(r.qFiles[0].file.Name()); ts > 0 {
+		rs.Oldest = aghtime.Format(time.Unix(ts, 0), time.RFC3339)
+	}
+
+	if r.SeekStart() != nil {
+		return rs
+	}
+
+	line, err := r.ReadNext()
+	if err != nil && err != io.EOF {
+		log.Debug("querylog: reading newest entry: %s", err)
+	} else if ts := readQLogTimestamp(line); ts > 0 {
+		rs.Newest = aghtime.Format(time.Unix(0, ts), time.RFC3339)
+	}
+
+	return rs
+}
@@ -0,0 +1,151 @@
+package querylog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeTestLogFile writes the entries with times ts to the file with the path
+// fn.
+func writeTestLogFile(t *testing.T, fn string, ts ...time.Time) {
+	t.Helper()
+
+	var data []byte
+	for _, tm := range ts {
+		line := fmt.Sprintf(`{"IP":"1.2.3.4","T":%q,"QH":"example.org","QT":"A","QC":"IN"}`+"\n", tm.Format(time.RFC3339Nano))
+		data = append(data, line...)
+	}
+
+	require.NoError(t, ioutil.WriteFile(fn, data, 0o644))
+}
+
+func TestRotatedFileNames(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, FileName)
+
+	for _, name := range []string{
+		FileName,
+		FileName + ".1",
+		FileName + ".10",
+		FileName + ".2",
+		FileName + ".0",
+		FileName + ".bak",
+		FileName + ".3" + removedSuffix,
+		"other.json.4",
+	} {
+		writeTestLogFile(t, filepath.Join(dir, name))
+	}
+
+	assert.Equal(t, []string{
+		logFile + ".10",
+		logFile + ".2",
+		logFile + ".1",
+		logFile,
+	}, logFileNames(logFile))
+}
+
+func TestQueryLog_rotate(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+
+	newLog := func(t *testing.T, maxFiles uint32) (l *queryLog) {
+		t.Helper()
+
+		return newQueryLog(Config{
+			Enabled:     true,
+			FileEnabled: true,
+			RotationIvl: 1,
+			MemSize:     100,
+			MaxFiles:    maxFiles,
+			BaseDir:     t.TempDir(),
+		})
+	}
+
+	t.Run("max_files", func(t *testing.T) {
+		l := newLog(t, 2)
+
+		for i := 0; i < 4; i++ {
+			writeTestLogFile(t, l.logFile, now.Add(time.Duration(i)*time.Minute))
+			require.NoError(t, l.rotate())
+		}
+
+		assert.Equal(t, []string{l.logFile + ".2", l.logFile + ".1"}, rotatedFileNames(l.logFile))
+
+		// The entries of the removed files are summarized.
+		_, err := os.Stat(summaryFileName(l.logFile))
+		assert.NoError(t, err)
+
+		l.conf.MaxFiles = 1
+		l.trimRotated()
+		assert.Equal(t, []string{l.logFile + ".1"}, rotatedFileNames(l.logFile))
+	})
+
+	t.Run("reader", func(t *testing.T) {
+		l := newLog(t, 1)
+
+		writeTestLogFile(t, l.logFile, now)
+		require.NoError(t, l.rotate())
+		writeTestLogFile(t, l.logFile, now.Add(time.Minute))
+
+		r, err := l.refs.open(l.logFile)
+		require.NoError(t, err)
+		require.Len(t, r.qFiles, 2)
+
+		require.NoError(t, l.rotate())
+
+		// The file over the limit is kept while it's read.
+		doomed := l.logFile + ".2" + removedSuffix
+		_, err = os.Stat(doomed)
+		require.NoError(t, err)
+		assert.Equal(t, []string{l.logFile + ".1"}, rotatedFileNames(l.logFile))
+
+		require.NoError(t, r.SeekStart())
+		n := 0
+		for _, err = r.ReadNext(); err == nil; _, err = r.ReadNext() {
+			n++
+		}
+		assert.Equal(t, 2, n)
+
+		require.NoError(t, r.Close())
+
+		_, err = os.Stat(doomed)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("state", func(t *testing.T) {
+		l := newLog(t, 3)
+
+		rs := l.Rotation()
+		require.NotNil(t, rs)
+		assert.Equal(t, &RotationState{MaxFiles: 3}, rs)
+
+		oldest, newest := now.Add(-time.Hour), now
+		writeTestLogFile(t, l.logFile, oldest)
+		require.NoError(t, l.rotate())
+		writeTestLogFile(t, l.logFile, now.Add(-time.Minute), newest)
+
+		rs = l.Rotation()
+		require.NotNil(t, rs)
+
+		active, err := os.Stat(l.logFile)
+		require.NoError(t, err)
+		rotated, err := os.Stat(l.logFile + ".1")
+		require.NoError(t, err)
+
+		assert.Equal(t, 1, rs.RotatedFiles)
+		assert.Equal(t, active.Size(), rs.ActiveSize)
+		assert.Equal(t, active.Size()+rotated.Size(), rs.TotalSize)
+		assert.Equal(t, aghtime.Format(oldest, time.RFC3339), rs.Oldest)
+		assert.Equal(t, aghtime.Format(newest, time.RFC3339), rs.Newest)
+
+		l.conf.FileEnabled = false
+		assert.Nil(t, l.Rotation())
+	})
+}
@@ -0,0 +1,40 @@
+package querylog
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// WriteAnonymizedSample implements the QueryLog interface for *queryLog.  The
+// hosts are hashed with a new random key, so that the hashes can't be matched
+// against the ones from the anonymized entries of the log files.
+func (l *queryLog) WriteAnonymizedSample(w io.Writer, limit int) (err error) {
+	key := make([]byte, hashKeyLen)
+	_, err = rand.Read(key)
+	if err != nil {
+		return fmt.Errorf("generating hash key: %w", err)
+	}
+
+	a := &anonymizer{key: key}
+
+	params := newSearchParams()
+	params.limit = limit
+	entries, _, _ := l.search(params)
+
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		// The entries from the memory buffer are shared, so anonymize a
+		// copy.
+		ec := *e
+		a.anonymize(&ec)
+
+		err = enc.Encode(&ec)
+		if err != nil {
+			return fmt.Errorf("encoding entry: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,109 @@
+package querylog
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// scanCheckIvl is the number of the entries between the checks of the context
+// of a scan.
+const scanCheckIvl = 256
+
+// Scan implements the QueryLog interface for *queryLog.  The entries of the
+// memory buffer go first, and then the ones of each log file.
+func (l *queryLog) Scan(ctx context.Context, since time.Time, f func(ei *EntryInfo) (cont bool)) (complete bool) {
+	l.bufferLock.Lock()
+	buf := make([]*logEntry, len(l.buffer))
+	copy(buf, l.buffer)
+	l.bufferLock.Unlock()
+
+	for i := len(buf) - 1; i >= 0; i-- {
+		e := buf[i]
+		if e.Time.Before(since) {
+			break
+		}
+
+		if i%scanCheckIvl == 0 && ctx.Err() != nil {
+			return false
+		}
+
+		if !f(e.info()) {
+			return false
+		}
+	}
+
+	logFiles := []string{l.logFile}
+	if l.conf.PeerFiles != nil {
+		logFiles = append(logFiles, l.conf.PeerFiles()...)
+	}
+
+	for _, fn := range logFiles {
+		if !l.scanLogFile(ctx, fn, since, f) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// scanLogFile calls f for each entry newer than since of the log file with the
+// path logFile and its rotated predecessors the same way Scan does.
+func (l *queryLog) scanLogFile(
+	ctx context.Context,
+	logFile string,
+	since time.Time,
+	f func(ei *EntryInfo) (cont bool),
+) (ok bool) {
+	r, err := l.refs.open(logFile)
+	if err != nil {
+		log.Error("querylog: failed to open qlog reader: %s", err)
+
+		return true
+	}
+	defer r.Close()
+
+	err = r.SeekStart()
+	if err != nil {
+		log.Debug("querylog: cannot seek to start: %s", err)
+
+		return true
+	}
+
+	sinceNano := since.UnixNano()
+	for n := 1; ; n++ {
+		if n%scanCheckIvl == 0 && ctx.Err() != nil {
+			return false
+		}
+
+		var line string
+		line, err = r.ReadNext()
+		if err == io.EOF {
+			return true
+		} else if err != nil {
+			log.Error("querylog: reading next entry: %s", err)
+
+			continue
+		}
+
+		ts := readQLogTimestamp(line)
+		if ts != 0 && ts < sinceNano {
+			return true
+		}
+
+		if !json.Valid([]byte(line)) {
+			r.warnLine(errCorruptEntry)
+
+			continue
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, line)
+		if !f(e.info()) {
+			return false
+		}
+	}
+}
@@ -1,13 +1,18 @@
 package querylog
 
 import (
+	"encoding/json"
 	"io"
 	"sort"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
 	"github.com/AdguardTeam/golibs/log"
 )
 
+// errCorruptEntry is the warning about a log record which isn't valid JSON.
+const errCorruptEntry agherr.Error = "corrupt log record"
+
 // client finds the client info, if any, by its client ID and IP address,
 // optionally checking the provided cache.  It will use the IP address
 // regardless of if the IP anonymization is enabled now, because the
@@ -71,24 +76,25 @@ func (l *queryLog) searchMemory(params *searchParams, cache clientCache) (entrie
 	return entries, len(l.buffer)
 }
 
-// search - searches log entries in the query log using specified parameters
-// returns the list of entries found + time of the oldest entry
-func (l *queryLog) search(params *searchParams) ([]*logEntry, time.Time) {
+// search searches log entries in the query log using specified parameters.  It
+// returns the entries found, the time of the oldest entry, and the warnings
+// about the parts of the log files which have been skipped, if any.
+func (l *queryLog) search(params *searchParams) (entries []*logEntry, oldest time.Time, warnings []*readWarning) {
 	now := time.Now()
 
 	if params.limit == 0 {
-		return []*logEntry{}, time.Time{}
+		return []*logEntry{}, time.Time{}, nil
 	}
 
 	cache := clientCache{}
-	fileEntries, oldest, total := l.searchFiles(params, cache)
+	fileEntries, oldest, total, warnings := l.searchFiles(params, cache)
 	memoryEntries, bufLen := l.searchMemory(params, cache)
 	total += bufLen
 
 	totalLimit := params.offset + params.limit
 
 	// now let's get a unified collection
-	entries := append(memoryEntries, fileEntries...)
+	entries = append(memoryEntries, fileEntries...)
 	if len(entries) > totalLimit {
 		// remove extra records
 		entries = entries[:totalLimit]
@@ -119,28 +125,86 @@ func (l *queryLog) search(params *searchParams) ([]*logEntry, time.Time) {
 	log.Debug("QueryLog: prepared data (%d/%d) older than %s in %s",
 		len(entries), total, params.olderThan, time.Since(now))
 
-	return entries, oldest
+	return entries, oldest, warnings
 }
 
-// searchFiles looks up log records from all log files.  It optionally uses the
-// client cache, if provided.  searchFiles does not scan more than
-// maxFileScanEntries so callers may need to call it several times to get all
+// searchFiles looks up log records from all log files, including the ones of
+// the other instances sharing the directory.  It optionally uses the client
+// cache, if provided.  searchFiles does not scan more than maxFileScanEntries
+// of each instance so callers may need to call it several times to get all
 // results.  oldset and total are the time of the oldest processed entry and the
 // total number of processed entries, including discarded ones, correspondingly.
+// The unreadable parts of the files are skipped and described by warnings.
 func (l *queryLog) searchFiles(
 	params *searchParams,
 	cache clientCache,
-) (entries []*logEntry, oldest time.Time, total int) {
-	files := []string{
-		l.logFile + ".1",
-		l.logFile,
+) (entries []*logEntry, oldest time.Time, total int, warnings []*readWarning) {
+	var peers []string
+	if l.conf.PeerFiles != nil {
+		peers = l.conf.PeerFiles()
+	}
+
+	entries, oldest, total, warnings, eof := l.searchLogFile(l.logFile, params, cache)
+	if len(peers) == 0 {
+		return entries, oldest, total, warnings
+	}
+
+	// The entries of different instances interleave, so only the ones
+	// newer than the oldest entry of the instances, which have more
+	// entries to scan, are returned.  The rest are returned by the next
+	// search.
+	var bound time.Time
+	if !eof {
+		bound = oldest
+	}
+
+	for _, fn := range peers {
+		pe, po, pt, pw, peof := l.searchLogFile(fn, params, cache)
+		entries = append(entries, pe...)
+		total += pt
+		warnings = append(warnings, pw...)
+		if !peof && po.After(bound) {
+			bound = po
+		}
+
+		if oldest.IsZero() || (!po.IsZero() && po.Before(oldest)) {
+			oldest = po
+		}
+	}
+
+	sort.SliceStable(entries, func(i, j int) (less bool) {
+		return entries[i].Time.After(entries[j].Time)
+	})
+
+	if !bound.IsZero() {
+		oldest = bound
+		i := sort.Search(len(entries), func(i int) (ok bool) {
+			return entries[i].Time.Before(bound)
+		})
+		entries = entries[:i]
+	}
+
+	if totalLimit := params.offset + params.limit; len(entries) > totalLimit {
+		entries = entries[:totalLimit]
+		oldest = entries[totalLimit-1].Time
 	}
 
-	r, err := NewQLogReader(files)
+	return entries, oldest, total, warnings
+}
+
+// searchLogFile looks up log records from the log file with the path logFile
+// and its rotated predecessors the same way searchFiles does.  eof is true if
+// all the records older than the requested time have been scanned.
+func (l *queryLog) searchLogFile(
+	logFile string,
+	params *searchParams,
+	cache clientCache,
+) (entries []*logEntry, oldest time.Time, total int, warnings []*readWarning, eof bool) {
+	r, err := l.refs.open(logFile)
 	if err != nil {
 		log.Error("querylog: failed to open qlog reader: %s", err)
 
-		return entries, oldest, 0
+		return entries, oldest, 0, nil, true
 	}
 	defer r.Close()
 
@@ -158,7 +222,7 @@ func (l *queryLog) searchFiles(
 	if err != nil {
 		log.Debug("querylog: cannot seek to %s: %s", params.olderThan, err)
 
-		return entries, oldest, 0
+		return entries, oldest, 0, r.warnings, true
 	}
 
 	totalLimit := params.offset + params.limit
@@ -175,13 +239,17 @@ func (l *queryLog) searchFiles(
 		e, ts, err = l.readNextEntry(r, params, cache)
 		if err != nil {
 			if err == io.EOF {
+				eof = true
+
 				break
 			}
 
 			log.Error("querylog: reading next entry: %s", err)
 		}
 
-		oldestNano = ts
+		if ts != 0 {
+			oldestNano = ts
+		}
 		total++
 
 		if e != nil {
@@ -196,7 +264,7 @@ func (l *queryLog) searchFiles(
 		oldest = time.Unix(0, oldestNano)
 	}
 
-	return entries, oldest, total
+	return entries, oldest, total, r.warnings, eof
 }
 
 // quickMatchClientFinder is a wrapper around the usual client finding function
@@ -248,6 +316,13 @@ func (l *queryLog) readNextEntry(
 		return nil, ts, nil
 	}
 
+	if !json.Valid([]byte(line)) {
+		// Most probably, the file has been truncated or damaged.
+		r.warnLine(errCorruptEntry)
+
+		return nil, 0, nil
+	}
+
 	e = &logEntry{}
 	decodeLogEntry(e, line)
 
@@ -272,3 +347,92 @@ func (l *queryLog) readNextEntry(
 
 	return e, ts, nil
 }
+
+// Entry implements the QueryLog interface for *queryLog.
+func (l *queryLog) Entry(t time.Time) (ei *EntryInfo, ok bool) {
+	e := l.findEntry(t)
+	if e == nil {
+		return nil, false
+	}
+
+	return e.info(), true
+}
+
+// info returns the information about e.
+func (e *logEntry) info() (ei *EntryInfo) {
+	return &EntryInfo{
+		Time:     e.Time,
+		ClientIP: e.IP,
+		Host:     e.QHost,
+		QType:    e.QType,
+		ClientID: e.ClientID,
+		Result:   e.Result,
+	}
+}
+
+// findEntry looks up the log record with exactly the given time in the
+// in-memory buffer first, and then in the log files.  e is nil if there is no
+// such record.
+func (l *queryLog) findEntry(t time.Time) (e *logEntry) {
+	l.bufferLock.Lock()
+	for i := len(l.buffer) - 1; i >= 0; i-- {
+		if l.buffer[i].Time.Equal(t) {
+			e = l.buffer[i]
+
+			break
+		}
+	}
+	l.bufferLock.Unlock()
+
+	if e != nil {
+		return e
+	}
+
+	logFiles := []string{l.logFile}
+	if l.conf.PeerFiles != nil {
+		logFiles = append(logFiles, l.conf.PeerFiles()...)
+	}
+
+	for _, fn := range logFiles {
+		e = l.findFileEntry(fn, t)
+		if e != nil {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// findFileEntry looks up the log record with exactly the given time in the log
+// file with the path logFile and its rotated predecessors.
+func (l *queryLog) findFileEntry(logFile string, t time.Time) (e *logEntry) {
+	r, err := l.refs.open(logFile)
+	if err != nil {
+		log.Error("querylog: failed to open qlog reader: %s", err)
+
+		return nil
+	}
+	defer r.Close()
+
+	err = r.SeekTS(t.UnixNano())
+	if err != nil {
+		log.Debug("querylog: cannot seek to %s: %s", t, err)
+
+		return nil
+	}
+
+	line, err := r.ReadNext()
+	if err != nil {
+		log.Debug("querylog: reading entry at %s: %s", t, err)
+
+		return nil
+	}
+
+	e = &logEntry{}
+	decodeLogEntry(e, line)
+	if !e.Time.Equal(t) {
+		return nil
+	}
+
+	return e
+}
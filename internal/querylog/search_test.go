@@ -1,7 +1,13 @@
 package querylog
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -79,7 +85,7 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 		olderThan: time.Now().Add(10 * time.Second),
 		limit:     3,
 	}
-	entries, _ := l.search(sp)
+	entries, _, _ := l.search(sp)
 	assert.Equal(t, 2, findClientCalls)
 
 	require.Len(t, entries, 3)
@@ -91,3 +97,288 @@ func TestQueryLog_Search_findClient(t *testing.T) {
 
 	assert.Equal(t, knownClientName, gotClient.Name)
 }
+
+func TestQueryLog_Entry(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	// Add a disk entry.
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.Nil(t, l.flushLogBuffer(true))
+	// Add a memory entry.
+	addEntry(l, "example.com", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+
+	entries, _, _ := l.search(newSearchParams())
+	require.Len(t, entries, 2)
+
+	for _, e := range entries {
+		ei, ok := l.Entry(e.Time)
+		require.True(t, ok)
+		require.NotNil(t, ei)
+
+		assert.Equal(t, e.QHost, ei.Host)
+		assert.True(t, e.IP.Equal(ei.ClientIP))
+		assert.Equal(t, e.Result.Reason, ei.Result.Reason)
+	}
+
+	_, ok := l.Entry(entries[0].Time.Add(time.Second))
+	assert.False(t, ok)
+}
+
+func TestQueryLog_Search_peers(t *testing.T) {
+	dir := t.TempDir()
+	newLog := func(fileName string, peers ...string) (l *queryLog) {
+		l = newQueryLog(Config{
+			Enabled:     true,
+			FileEnabled: true,
+			RotationIvl: 1,
+			MemSize:     100,
+			BaseDir:     dir,
+			FileName:    fileName,
+			PeerFiles: func() (fns []string) {
+				return peers
+			},
+		})
+		t.Cleanup(l.Close)
+
+		return l
+	}
+
+	peer := newLog("querylog.b.json")
+	addEntry(peer, "peer-1.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	require.NoError(t, peer.flushLogBuffer(true))
+
+	own := newLog("querylog.a.json", peer.logFile)
+	addEntry(own, "own.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, own.flushLogBuffer(true))
+
+	addEntry(peer, "peer-2.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+	require.NoError(t, peer.flushLogBuffer(true))
+
+	entries, _, _ := own.search(newSearchParams())
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, "peer-2.example", entries[0].QHost)
+	assert.Equal(t, "own.example", entries[1].QHost)
+	assert.Equal(t, "peer-1.example", entries[2].QHost)
+
+	ei, ok := own.Entry(entries[2].Time)
+	require.True(t, ok)
+
+	assert.Equal(t, "peer-1.example", ei.Host)
+}
+
+func TestQueryLog_handleQueryLog_truncated(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	t.Cleanup(l.Close)
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.NoError(t, l.flushLogBuffer(true))
+
+	// Cut the second record in half, as if the process has been killed
+	// while writing it.
+	data, err := ioutil.ReadFile(l.logFile)
+	require.NoError(t, err)
+
+	firstLen := bytes.IndexByte(data, '\n') + 1
+	require.Positive(t, firstLen)
+
+	truncLen := firstLen + (len(data)-firstLen)/2
+	require.NoError(t, ioutil.WriteFile(l.logFile, data[:truncLen], 0o644))
+
+	w := httptest.NewRecorder()
+	l.handleQueryLog(w, httptest.NewRequest(http.MethodGet, "/control/querylog", nil))
+	require.Equal(t, http.StatusOK, w.Code)
+
+	resp := struct {
+		Data     []map[string]interface{} `json:"data"`
+		Warnings []*readWarning           `json:"warnings"`
+	}{}
+	require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+	require.Len(t, resp.Data, 1)
+	assert.Equal(t, "first.example", resp.Data[0]["question"].(map[string]interface{})["host"])
+
+	require.Len(t, resp.Warnings, 1)
+	assert.Equal(t, &readWarning{
+		File:   l.logFile,
+		Error:  string(errCorruptEntry),
+		Offset: int64(firstLen),
+	}, resp.Warnings[0])
+}
+
+func TestQueryLog_handleQueryLog_transport(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+	t.Cleanup(l.Close)
+
+	q := &dns.Msg{
+		Question: []dns.Question{{
+			Name:   "example.org.",
+			Qtype:  dns.TypeA,
+			Qclass: dns.ClassINET,
+		}},
+	}
+
+	// Add a disk entry.
+	l.Add(AddParams{
+		Question:   q,
+		ClientIP:   net.IPv4(1, 2, 3, 4),
+		ClientPort: 5353,
+		ClientNet:  ClientNetTCP,
+	})
+	require.NoError(t, l.flushLogBuffer(true))
+
+	// Add memory entries.
+	l.Add(AddParams{
+		Question:   q,
+		ClientIP:   net.IPv4(1, 2, 3, 4),
+		ClientPort: 5354,
+		ClientNet:  ClientNetUDP,
+	})
+	l.Add(AddParams{
+		Question:    q,
+		ClientIP:    net.IPv4(1, 2, 3, 4),
+		ClientPort:  5355,
+		ClientProto: ClientProtoDOH,
+	})
+
+	l.conf.AnonymizeClientPort = true
+	l.Add(AddParams{
+		Question:    q,
+		ClientIP:    net.IPv4(1, 2, 3, 4),
+		ClientPort:  5356,
+		ClientProto: ClientProtoDOH,
+	})
+
+	testCases := []struct {
+		name      string
+		transport string
+		wantPorts []interface{}
+	}{{
+		name:      "all",
+		transport: "",
+		wantPorts: []interface{}{nil, 5355.0, 5354.0, 5353.0},
+	}, {
+		name:      "tcp",
+		transport: "tcp",
+		wantPorts: []interface{}{5353.0},
+	}, {
+		name:      "udp",
+		transport: "udp",
+		wantPorts: []interface{}{5354.0},
+	}, {
+		name:      "doh",
+		transport: "doh",
+		wantPorts: []interface{}{nil, 5355.0},
+	}, {
+		name:      "dot",
+		transport: "dot",
+		wantPorts: []interface{}{},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			target := "/control/querylog"
+			if tc.transport != "" {
+				target += "?transport=" + tc.transport
+			}
+
+			w := httptest.NewRecorder()
+			l.handleQueryLog(w, httptest.NewRequest(http.MethodGet, target, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			resp := struct {
+				Data []map[string]interface{} `json:"data"`
+			}{}
+			require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+			ports := []interface{}{}
+			for _, e := range resp.Data {
+				if tc.transport != "" {
+					assert.Equal(t, tc.transport, e["transport"])
+				}
+
+				ports = append(ports, e["client_port"])
+			}
+
+			assert.Equal(t, tc.wantPorts, ports)
+		})
+	}
+
+	t.Run("bad", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		l.handleQueryLog(w, httptest.NewRequest(http.MethodGet, "/control/querylog?transport=smtp", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+func TestQueryLog_Scan(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	addEntry(l, "first.example", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "second.example", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	require.Nil(t, l.flushLogBuffer(true))
+	addEntry(l, "third.example", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+
+	var hosts []string
+	collect := func(ei *EntryInfo) (cont bool) {
+		hosts = append(hosts, ei.Host)
+		assert.Equal(t, "A", ei.QType)
+
+		return true
+	}
+
+	complete := l.Scan(context.Background(), time.Time{}, collect)
+	assert.True(t, complete)
+	assert.Equal(t, []string{"third.example", "second.example", "first.example"}, hosts)
+
+	hosts = nil
+	complete = l.Scan(context.Background(), time.Now().Add(time.Hour), collect)
+	assert.True(t, complete)
+	assert.Empty(t, hosts)
+
+	t.Run("stopped", func(t *testing.T) {
+		n := 0
+		complete = l.Scan(context.Background(), time.Time{}, func(_ *EntryInfo) (cont bool) {
+			n++
+
+			return n < 2
+		})
+		assert.False(t, complete)
+		assert.Equal(t, 2, n)
+	})
+
+	t.Run("canceled", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		complete = l.Scan(ctx, time.Time{}, func(_ *EntryInfo) (cont bool) {
+			return true
+		})
+		assert.False(t, complete)
+	})
+}
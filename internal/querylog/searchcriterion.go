@@ -16,6 +16,10 @@ const (
 	//
 	// See (*searchCriterion).ctFilteringStatusCase for details.
 	ctFilteringStatus
+	// ctTransport is for searching by the transport of the request, which
+	// is the network for the plain DNS requests and the client protocol
+	// for the encrypted ones.
+	ctTransport
 )
 
 const (
@@ -40,6 +44,13 @@ var filteringStatusValues = []string{
 	filteringStatusProcessed,
 }
 
+// transportValues are all possible values of the transport criterion.
+var transportValues = []string{
+	string(ClientNetUDP), string(ClientNetTCP), string(ClientProtoDOT),
+	string(ClientProtoDOH), string(ClientProtoDOH3), string(ClientProtoDOQ),
+	string(ClientProtoDNSCrypt), string(ClientProtoUnix),
+}
+
 // searchCriterion is a search criterion that is used to match a record.
 type searchCriterion struct {
 	value         string
@@ -109,6 +120,13 @@ func (c *searchCriterion) quickMatch(line string, findClient quickMatchClientFun
 		// Go on, as we currently don't do quick matches against
 		// filtering statuses.
 		return true
+	case ctTransport:
+		e := &logEntry{
+			ClientProto: ClientProto(readJSONValue(line, `"CP":"`)),
+			ClientNet:   ClientNet(readJSONValue(line, `"CN":"`)),
+		}
+
+		return e.transport() == c.value
 	default:
 		return true
 	}
@@ -121,6 +139,8 @@ func (c *searchCriterion) match(entry *logEntry) bool {
 		return c.ctDomainOrClientCase(entry)
 	case ctFilteringStatus:
 		return c.ctFilteringStatusCase(entry.Result)
+	case ctTransport:
+		return entry.transport() == c.value
 	}
 
 	return false
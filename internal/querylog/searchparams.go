@@ -1,6 +1,10 @@
 package querylog
 
-import "time"
+import (
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+)
 
 // searchParams represent the search query sent by the client
 type searchParams struct {
@@ -14,6 +18,14 @@ type searchParams struct {
 	offset             int // offset for the search
 	limit              int // limit the number of records returned
 	maxFileScanEntries int // maximum log entries to scan in query log files. if 0 - no limit
+
+	// verbose tells if the exchanges with the upstream servers should be
+	// included into the entries.
+	verbose bool
+
+	// format is the format of the response.  The entries in CSV contain
+	// fewer details than the ones in JSON.
+	format aghhttp.Format
 }
 
 // newSearchParams - creates an empty instance of searchParams
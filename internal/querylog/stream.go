@@ -0,0 +1,104 @@
+package querylog
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// streamBufSize is the number of the new entries buffered for a single
+// subscriber.  The entries which don't fit are dropped for that subscriber.
+const streamBufSize = 64
+
+// subscribe returns a channel which receives the entries added to l from now
+// on.  unsubscribe must be called once the channel is no longer used.
+func (l *queryLog) subscribe() (ch chan *logEntry, unsubscribe func()) {
+	ch = make(chan *logEntry, streamBufSize)
+
+	l.subsLock.Lock()
+	defer l.subsLock.Unlock()
+
+	if l.subs == nil {
+		l.subs = map[chan *logEntry]struct{}{}
+	}
+
+	l.subs[ch] = struct{}{}
+
+	return ch, func() {
+		l.subsLock.Lock()
+		defer l.subsLock.Unlock()
+
+		delete(l.subs, ch)
+	}
+}
+
+// publish sends e to each subscriber which isn't lagging behind.
+func (l *queryLog) publish(e *logEntry) {
+	l.subsLock.Lock()
+	defer l.subsLock.Unlock()
+
+	for ch := range l.subs {
+		select {
+		case ch <- e:
+		default:
+			// Don't let a slow subscriber slow down the DNS queries.
+		}
+	}
+}
+
+// handleQueryLogStream is the handler for the GET /control/querylog/stream HTTP
+// API.  It writes the new entries matching the same search parameters as the
+// ones of GET /control/querylog, one JSON object per line, until the client
+// disconnects.
+func (l *queryLog) handleQueryLogStream(w http.ResponseWriter, r *http.Request) {
+	params, err := l.parseSearchParams(r)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "failed to parse params: %s", err)
+
+		return
+	}
+
+	f, ok := w.(http.Flusher)
+	if !ok {
+		httpError(r, w, http.StatusInternalServerError, "streaming is not supported")
+
+		return
+	}
+
+	ch, unsubscribe := l.subscribe()
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	f.Flush()
+
+	enc := json.NewEncoder(w)
+	cache := clientCache{}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			// Don't modify the entry shared with the other subscribers.
+			ent := *e
+			ent.client, err = l.client(ent.ClientID, ent.IP.String(), cache)
+			if err != nil {
+				log.Error("querylog: enriching streamed record for client %q: %s", ent.IP, err)
+			}
+
+			if !params.match(&ent) {
+				continue
+			}
+
+			err = enc.Encode(l.logEntryToJSONEntry(&ent, params.verbose))
+			if err != nil {
+				log.Debug("querylog: streaming: %s", err)
+
+				return
+			}
+
+			f.Flush()
+		}
+	}
+}
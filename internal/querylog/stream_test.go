@@ -0,0 +1,81 @@
+package querylog
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_handleQueryLogStream(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	srv := httptest.NewServer(http.HandlerFunc(l.handleQueryLogStream))
+	t.Cleanup(srv.Close)
+
+	resp, err := http.Get(srv.URL + "?search=example.com")
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = resp.Body.Close() })
+
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "application/x-ndjson", resp.Header.Get("Content-Type"))
+
+	// The headers are only sent after subscribing.
+	addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	addEntry(l, "example.com", net.IPv4(1, 1, 1, 2), net.IPv4(2, 2, 2, 2))
+	addEntry(l, "test.example.com", net.IPv4(1, 1, 1, 3), net.IPv4(2, 2, 2, 3))
+
+	sc := bufio.NewScanner(resp.Body)
+	for _, want := range []string{"example.com", "test.example.com"} {
+		require.True(t, sc.Scan())
+
+		var ent struct {
+			Question struct {
+				Host string `json:"host"`
+			} `json:"question"`
+		}
+		require.NoError(t, json.Unmarshal(sc.Bytes(), &ent))
+
+		assert.Equal(t, want, ent.Question.Host)
+	}
+
+	l.subsLock.Lock()
+	defer l.subsLock.Unlock()
+
+	assert.Len(t, l.subs, 1)
+}
+
+func TestQueryLog_publish(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		RotationIvl: 1,
+		MemSize:     1000,
+		BaseDir:     t.TempDir(),
+	})
+
+	ch, unsubscribe := l.subscribe()
+
+	// A lagging subscriber must not block adding entries.
+	for i := 0; i < streamBufSize*2; i++ {
+		addEntry(l, "example.org", net.IPv4(1, 1, 1, 1), net.IPv4(2, 2, 2, 1))
+	}
+
+	assert.Len(t, ch, streamBufSize)
+
+	unsubscribe()
+
+	l.subsLock.Lock()
+	defer l.subsLock.Unlock()
+
+	assert.Empty(t, l.subs)
+}
@@ -0,0 +1,345 @@
+package querylog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/golibs/log"
+	"github.com/google/renameio/maybe"
+)
+
+const (
+	// summaryDateLayout is the layout of the dates of the summaries.
+	summaryDateLayout = "2006-01-02"
+
+	// summaryRetentionDays is the number of days for which the summaries of
+	// the expired entries are kept.
+	summaryRetentionDays = 2 * 365
+
+	// summaryTopDomains is the number of the most requested domains kept in
+	// a summary.
+	summaryTopDomains = 20
+)
+
+// summaryFileName returns the path to the file with the per-day summaries of
+// the expired entries of the log file logFile.
+func summaryFileName(logFile string) (fn string) {
+	return strings.TrimSuffix(logFile, ".json") + "_summary.json"
+}
+
+// DomainCount is the number of the requests for a domain.
+type DomainCount struct {
+	// Domain is the requested domain.
+	Domain string `json:"domain"`
+
+	// Count is the number of the requests.
+	Count uint64 `json:"count"`
+}
+
+// DaySummary is the summary of the requests of a single client during a single
+// day.
+type DaySummary struct {
+	// Date is the day in the local time zone in the "2006-01-02" format.
+	Date string `json:"date"`
+
+	// Client is the ClientID of the client, if it has sent any, or its IP
+	// address.  It's the subnet for the anonymized entries.
+	Client string `json:"client"`
+
+	// ClientName is the current name of the client.  It's not stored and is
+	// only resolved when the summaries are requested, so that renaming the
+	// client also applies to the past summaries.
+	ClientName string `json:"client_name,omitempty"`
+
+	// TopDomains are the most requested domains, the most requested first.
+	// The anonymized entries aren't counted here, since their hosts are
+	// hashed.
+	TopDomains []*DomainCount `json:"top_domains"`
+
+	// Total is the number of the requests.
+	Total uint64 `json:"total"`
+
+	// Blocked is the number of the filtered requests.
+	Blocked uint64 `json:"blocked"`
+}
+
+// summaryKey identifies a summary.
+type summaryKey struct {
+	date   string
+	client string
+}
+
+// summaryAcc is a summary being built.
+type summaryAcc struct {
+	domains map[string]uint64
+	total   uint64
+	blocked uint64
+}
+
+// summaryAccs are the summaries being built from the expired entries.
+type summaryAccs map[summaryKey]*summaryAcc
+
+// get returns the summary for k, creating it if necessary.
+func (accs summaryAccs) get(k summaryKey) (acc *summaryAcc) {
+	acc, ok := accs[k]
+	if !ok {
+		acc = &summaryAcc{domains: map[string]uint64{}}
+		accs[k] = acc
+	}
+
+	return acc
+}
+
+// add adds e to the summaries.
+func (accs summaryAccs) add(e *logEntry) {
+	client := e.ClientID
+	if client == "" {
+		client = e.IP.String()
+	}
+
+	acc := accs.get(summaryKey{
+		date:   e.Time.Local().Format(summaryDateLayout),
+		client: client,
+	})
+
+	acc.total++
+	if e.Result.IsFiltered {
+		acc.blocked++
+	}
+
+	if !e.Anonymized {
+		acc.domains[e.QHost]++
+	}
+}
+
+// merge adds the previously stored summary s to the summaries.
+func (accs summaryAccs) merge(s *DaySummary) {
+	acc := accs.get(summaryKey{date: s.Date, client: s.Client})
+	acc.total += s.Total
+	acc.blocked += s.Blocked
+	for _, dc := range s.TopDomains {
+		acc.domains[dc.Domain] += dc.Count
+	}
+}
+
+// summaries returns the summaries not older than oldest sorted by date and
+// client.  Only the summaryTopDomains most requested domains are kept in each.
+func (accs summaryAccs) summaries(oldest string) (sums []*DaySummary) {
+	for k, acc := range accs {
+		if k.date < oldest {
+			continue
+		}
+
+		s := &DaySummary{
+			Date:       k.date,
+			Client:     k.client,
+			TopDomains: make([]*DomainCount, 0, len(acc.domains)),
+			Total:      acc.total,
+			Blocked:    acc.blocked,
+		}
+
+		for d, n := range acc.domains {
+			s.TopDomains = append(s.TopDomains, &DomainCount{Domain: d, Count: n})
+		}
+
+		sort.Slice(s.TopDomains, func(i, j int) (less bool) {
+			a, b := s.TopDomains[i], s.TopDomains[j]
+			if a.Count != b.Count {
+				return a.Count > b.Count
+			}
+
+			return a.Domain < b.Domain
+		})
+
+		if len(s.TopDomains) > summaryTopDomains {
+			s.TopDomains = s.TopDomains[:summaryTopDomains]
+		}
+
+		sums = append(sums, s)
+	}
+
+	sort.Slice(sums, func(i, j int) (less bool) {
+		a, b := sums[i], sums[j]
+		if a.Date != b.Date {
+			return a.Date < b.Date
+		}
+
+		return a.Client < b.Client
+	})
+
+	return sums
+}
+
+// readSummaries returns the summaries stored in the file fn.
+func readSummaries(fn string) (sums []*DaySummary, err error) {
+	data, err := ioutil.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, &sums)
+	if err != nil {
+		return nil, fmt.Errorf("decoding summaries: %w", err)
+	}
+
+	return sums, nil
+}
+
+// summarizeExpired folds the entries of the file fn, which is about to be
+// removed, into the stored per-day summaries.  Only the expiring file is read,
+// so every entry is summarized exactly once.  l.fileWriteLock is expected to be
+// locked.
+func (l *queryLog) summarizeExpired(fn string, now time.Time) (err error) {
+	data, err := ioutil.ReadFile(fn)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	accs := summaryAccs{}
+	n := 0
+	for _, b := range bytes.Split(data, []byte{'\n'}) {
+		line := string(b)
+		if readQLogTimestamp(line) == 0 || !json.Valid(b) {
+			continue
+		}
+
+		e := &logEntry{}
+		decodeLogEntry(e, line)
+		accs.add(e)
+		n++
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	sumFile := summaryFileName(l.logFile)
+
+	l.summaryLock.Lock()
+	defer l.summaryLock.Unlock()
+
+	stored, err := readSummaries(sumFile)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stored {
+		accs.merge(s)
+	}
+
+	oldest := now.AddDate(0, 0, -summaryRetentionDays).Format(summaryDateLayout)
+	data, err = json.Marshal(accs.summaries(oldest))
+	if err != nil {
+		return fmt.Errorf("encoding summaries: %w", err)
+	}
+
+	err = maybe.WriteFile(sumFile, data, 0o644)
+	if err != nil {
+		return err
+	}
+
+	log.Debug("querylog: summarized %d expired entries", n)
+
+	return nil
+}
+
+// summariesResp is the response to the request of the summaries.
+type summariesResp struct {
+	Summaries []*DaySummary `json:"summaries"`
+}
+
+// clientName returns the current name of the client with the identifier id
+// using and filling cache.
+func (l *queryLog) clientName(id string, cache map[string]string) (name string) {
+	name, ok := cache[id]
+	if ok {
+		return name
+	}
+
+	c, err := l.findClient([]string{id})
+	if err != nil {
+		log.Debug("querylog: finding client %q: %s", id, err)
+	} else if c != nil {
+		name = c.Name
+	}
+
+	cache[id] = name
+
+	return name
+}
+
+// handleQueryLogSummary is the handler for the GET /control/querylog_summary
+// HTTP API.
+func (l *queryLog) handleQueryLogSummary(w http.ResponseWriter, r *http.Request) {
+	params := aghhttp.QueryParams(r.URL.Query())
+
+	var from, to string
+	parseDate := func(dst *string) (parse func(s string) (err error)) {
+		return func(s string) (err error) {
+			_, err = time.Parse(summaryDateLayout, s)
+			if err != nil {
+				return err
+			}
+
+			*dst = s
+
+			return nil
+		}
+	}
+
+	const expDate = "a date in the 2006-01-02 format"
+	if params.Value("date", expDate, parseDate(&from)) {
+		to = from
+	}
+	params.Value("from", expDate, parseDate(&from))
+	params.Value("to", expDate, parseDate(&to))
+	client := params.String("client", "")
+
+	err := params.Err()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	l.summaryLock.Lock()
+	stored, err := readSummaries(summaryFileName(l.logFile))
+	l.summaryLock.Unlock()
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "reading summaries: %s", err)
+
+		return
+	}
+
+	resp := summariesResp{Summaries: []*DaySummary{}}
+	names := map[string]string{}
+	for _, s := range stored {
+		if (from != "" && s.Date < from) ||
+			(to != "" && s.Date > to) ||
+			(client != "" && s.Client != client) {
+			continue
+		}
+
+		s.ClientName = l.clientName(s.Client, names)
+		resp.Summaries = append(resp.Summaries, s)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "encoding summaries: %s", err)
+	}
+}
@@ -0,0 +1,137 @@
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLog_summarizeExpired(t *testing.T) {
+	l := newQueryLog(Config{
+		Enabled:     true,
+		FileEnabled: true,
+		RotationIvl: 1,
+		MemSize:     100,
+		BaseDir:     t.TempDir(),
+	})
+
+	now := time.Now()
+	day1 := time.Date(now.Year(), now.Month(), now.Day(), 12, 0, 0, 0, time.Local).AddDate(0, 0, -10)
+	day2 := day1.AddDate(0, 0, 1)
+	date1, date2 := day1.Format(summaryDateLayout), day2.Format(summaryDateLayout)
+	newEntry := func(ip net.IP, host string, tm time.Time, blocked bool) (e *logEntry) {
+		return &logEntry{
+			IP:     ip,
+			Time:   tm,
+			QHost:  host,
+			QType:  "A",
+			QClass: "IN",
+			Result: dnsfilter.Result{IsFiltered: blocked},
+		}
+	}
+
+	ip1, ip2 := net.IP{1, 2, 3, 4}, net.IP{1, 2, 3, 5}
+
+	var entries []*logEntry
+	for i := 0; i < summaryTopDomains+5; i++ {
+		host := fmt.Sprintf("host%02d.example", i)
+		entries = append(entries, newEntry(ip1, host, day1, false))
+	}
+	entries = append(
+		entries,
+		newEntry(ip1, "host00.example", day1, true),
+		newEntry(ip2, "other.example", day1, false),
+		newEntry(ip1, "host00.example", day2, false),
+	)
+
+	rotate := func(entries ...*logEntry) {
+		require.NoError(t, l.flushToFile(entries))
+		require.NoError(t, l.rotate())
+	}
+
+	// The first rotation only renames the file, and the second one expires
+	// its entries.
+	rotate(entries...)
+	rotate(newEntry(ip1, "host00.example", day2, true))
+
+	// The rotations without a new file don't expire anything.
+	require.NoError(t, l.rotate())
+
+	// The summaries are merged with the stored ones.
+	rotate(newEntry(ip2, "new.example", now, false))
+
+	get := func(t *testing.T, query string) (sums []*DaySummary) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog_summary?"+query, nil)
+		w := httptest.NewRecorder()
+		l.handleQueryLogSummary(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &summariesResp{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp.Summaries
+	}
+
+	sums := get(t, "")
+	require.Len(t, sums, 3)
+
+	s := sums[0]
+	assert.Equal(t, date1, s.Date)
+	assert.Equal(t, ip1.String(), s.Client)
+	assert.Equal(t, uint64(summaryTopDomains+6), s.Total)
+	assert.Equal(t, uint64(1), s.Blocked)
+	require.Len(t, s.TopDomains, summaryTopDomains)
+	assert.Equal(t, &DomainCount{Domain: "host00.example", Count: 2}, s.TopDomains[0])
+
+	s = sums[2]
+	assert.Equal(t, date2, s.Date)
+	assert.Equal(t, uint64(2), s.Total)
+	assert.Equal(t, uint64(1), s.Blocked)
+	assert.Equal(t, []*DomainCount{{Domain: "host00.example", Count: 2}}, s.TopDomains)
+
+	sums = get(t, "date="+date1+"&client=1.2.3.5")
+	require.Len(t, sums, 1)
+	assert.Equal(t, uint64(1), sums[0].Total)
+	assert.Empty(t, sums[0].ClientName)
+
+	// The names are resolved when the summaries are requested.
+	l.findClient = func(ids []string) (c *Client, err error) {
+		if ids[0] == ip2.String() {
+			return &Client{Name: "thermostat"}, nil
+		}
+
+		return nil, nil
+	}
+
+	sums = get(t, "date="+date1+"&client=1.2.3.5")
+	require.Len(t, sums, 1)
+	assert.Equal(t, "thermostat", sums[0].ClientName)
+
+	sums = get(t, "from="+date2)
+	require.Len(t, sums, 1)
+	assert.Equal(t, date2, sums[0].Date)
+
+	t.Run("bad_date", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodGet, "/control/querylog_summary?to=yesterday", nil)
+		w := httptest.NewRecorder()
+		l.handleQueryLogSummary(w, r)
+
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("clear", func(t *testing.T) {
+		l.clear()
+
+		assert.Empty(t, get(t, ""))
+	})
+}
@@ -0,0 +1,539 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// Alert metrics.  The names are the same as the names of the corresponding
+// series in the statistics response.
+const (
+	alertMetricDNSQueries           = "dns_queries"
+	alertMetricBlockedFiltering     = "blocked_filtering"
+	alertMetricReplacedSafebrowsing = "replaced_safebrowsing"
+	alertMetricReplacedParental     = "replaced_parental"
+)
+
+// alertMetricResults maps the alert metrics to the results they count.  Zero
+// result means all queries.
+var alertMetricResults = map[string]Result{
+	alertMetricDNSQueries:           0,
+	alertMetricBlockedFiltering:     RFiltered,
+	alertMetricReplacedSafebrowsing: RSafeBrowsing,
+	alertMetricReplacedParental:     RParental,
+}
+
+const (
+	// alertMaxWindow is the maximum window of an alert rule in minutes.
+	alertMaxWindow = 60
+
+	// alertCheckIvl is the interval between the evaluations of the alert
+	// rules.
+	alertCheckIvl = 1 * time.Minute
+)
+
+// Alert states reported to the webhooks.
+const (
+	alertStateFiring   = "firing"
+	alertStateResolved = "resolved"
+)
+
+// AlertRule is a rule for alerting when the number of queries with a certain
+// result within a time window exceeds the threshold.
+type AlertRule struct {
+	// Name is the unique name of the rule.
+	Name string `yaml:"name" json:"name"`
+
+	// Metric is the series of the statistics to check, e.g.
+	// "blocked_filtering".
+	Metric string `yaml:"metric" json:"metric"`
+
+	// WebhookURL, if not empty, is the URL to which the notifications about
+	// the alert firing and resolving are POSTed.
+	WebhookURL string `yaml:"webhook_url" json:"webhook_url"`
+
+	// Threshold is the number of queries within the window above which the
+	// alert fires.
+	Threshold uint64 `yaml:"threshold" json:"threshold"`
+
+	// ClearThreshold is the number of queries within the window at or below
+	// which the firing alert is resolved.  If zero, 80% of Threshold is
+	// used.
+	ClearThreshold uint64 `yaml:"clear_threshold" json:"clear_threshold"`
+
+	// WindowMinutes is the length of the window in minutes.
+	WindowMinutes uint32 `yaml:"window_minutes" json:"window_minutes"`
+
+	// PerClient, if true, means that the queries of every client are counted
+	// separately.
+	PerClient bool `yaml:"per_client" json:"per_client"`
+}
+
+// validate returns an error if the rule is invalid.
+func (r *AlertRule) validate() (err error) {
+	switch {
+	case r.Name == "":
+		return agherr.Error("name is required")
+	case r.Threshold == 0:
+		return agherr.Error("threshold must be greater than zero")
+	case r.ClearThreshold >= r.Threshold:
+		return agherr.Error("clear_threshold must be less than threshold")
+	case r.WindowMinutes == 0 || r.WindowMinutes > alertMaxWindow:
+		return fmt.Errorf("window_minutes must be between 1 and %d", alertMaxWindow)
+	}
+
+	if _, ok := alertMetricResults[r.Metric]; !ok {
+		return fmt.Errorf("unknown metric %q", r.Metric)
+	}
+
+	if r.WebhookURL != "" {
+		var u *url.URL
+		u, err = url.Parse(r.WebhookURL)
+		if err != nil {
+			return fmt.Errorf("parsing webhook_url: %w", err)
+		}
+
+		if u.Scheme != "http" && u.Scheme != "https" {
+			return fmt.Errorf("webhook_url: bad scheme %q", u.Scheme)
+		}
+	}
+
+	return nil
+}
+
+// clearThreshold returns the number of queries at or below which the firing
+// alert is resolved.
+func (r *AlertRule) clearThreshold() (n uint64) {
+	if r.ClearThreshold != 0 {
+		return r.ClearThreshold
+	}
+
+	return r.Threshold * 4 / 5
+}
+
+// minuteCounters are the numbers of queries per result within a minute.
+type minuteCounters struct {
+	// clients are the numbers of queries per result for each client.  It's
+	// only filled when there are per-client rules.
+	clients map[string]*[rLast]uint64
+
+	// minute is the number of minutes since the Unix epoch.
+	minute  int64
+	nResult [rLast]uint64
+}
+
+// alertNotification is the body of the webhook request.
+type alertNotification struct {
+	Time          time.Time `json:"time"`
+	Rule          string    `json:"rule"`
+	State         string    `json:"state"`
+	Metric        string    `json:"metric"`
+	Client        string    `json:"client,omitempty"`
+	Value         uint64    `json:"value"`
+	Threshold     uint64    `json:"threshold"`
+	WindowMinutes uint32    `json:"window_minutes"`
+
+	// url is the URL of the webhook.
+	url string
+}
+
+// alerter evaluates the alert rules against the per-minute counters.
+type alerter struct {
+	// mu protects all fields below.
+	mu *sync.Mutex
+
+	rules []*AlertRule
+
+	// firing are the values of the metrics for which the rules are firing
+	// by the rule name and the client.  The client is empty for the rules
+	// which are not per-client.
+	firing map[string]map[string]uint64
+
+	// minutes is the ring of counters for the last alertMaxWindow minutes.
+	minutes [alertMaxWindow]minuteCounters
+
+	// trackClients is true if there are per-client rules.
+	trackClients bool
+
+	// client is used to send the webhook requests.
+	client *http.Client
+}
+
+// newAlerter returns a new alerter with the validated rules.
+func newAlerter(rules []AlertRule, client *http.Client) (a *alerter) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	a = &alerter{
+		mu:     &sync.Mutex{},
+		firing: map[string]map[string]uint64{},
+		client: client,
+	}
+
+	for i := range rules {
+		r := rules[i]
+		err := r.validate()
+		if err != nil {
+			log.Error("stats: alert rule %q: %s", r.Name, err)
+
+			continue
+		}
+
+		a.rules = append(a.rules, &r)
+	}
+
+	a.updateTrackClients()
+
+	return a
+}
+
+// updateTrackClients updates the trackClients field.  a.mu is expected to be
+// locked.
+func (a *alerter) updateTrackClients() {
+	a.trackClients = false
+	for _, r := range a.rules {
+		if r.PerClient {
+			a.trackClients = true
+
+			return
+		}
+	}
+}
+
+// countersFor returns the counters for the minute of now, resetting the
+// stale ones.  a.mu is expected to be locked.
+func (a *alerter) countersFor(now time.Time) (c *minuteCounters) {
+	minute := now.Unix() / 60
+	c = &a.minutes[minute%alertMaxWindow]
+	if c.minute != minute {
+		*c = minuteCounters{
+			minute: minute,
+		}
+	}
+
+	return c
+}
+
+// count adds the query with result res from clientID to the counters.
+func (a *alerter) count(now time.Time, res Result, clientID string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if len(a.rules) == 0 {
+		return
+	}
+
+	c := a.countersFor(now)
+	c.nResult[res]++
+
+	if !a.trackClients {
+		return
+	}
+
+	if c.clients == nil {
+		c.clients = map[string]*[rLast]uint64{}
+	}
+
+	cc, ok := c.clients[clientID]
+	if !ok {
+		cc = &[rLast]uint64{}
+		c.clients[clientID] = cc
+	}
+
+	cc[res]++
+}
+
+// sumResult returns the number of queries with the result res in counts.  Zero
+// res means all queries.
+func sumResult(counts *[rLast]uint64, res Result) (n uint64) {
+	if res != 0 {
+		return counts[res]
+	}
+
+	for _, v := range counts {
+		n += v
+	}
+
+	return n
+}
+
+// values returns the values of the rule's metric within its window by the
+// client.  a.mu is expected to be locked.
+func (a *alerter) values(now time.Time, r *AlertRule) (vals map[string]uint64) {
+	res := alertMetricResults[r.Metric]
+	cur := now.Unix() / 60
+	vals = map[string]uint64{}
+
+	for i := int64(0); i < int64(r.WindowMinutes); i++ {
+		minute := cur - i
+		c := &a.minutes[minute%alertMaxWindow]
+		if c.minute != minute {
+			continue
+		}
+
+		if !r.PerClient {
+			vals[""] += sumResult(&c.nResult, res)
+
+			continue
+		}
+
+		for id, cc := range c.clients {
+			vals[id] += sumResult(cc, res)
+		}
+	}
+
+	return vals
+}
+
+// evaluate checks the rules and returns the notifications about the alerts
+// which have fired or resolved since the previous evaluation.
+func (a *alerter) evaluate(now time.Time) (notes []*alertNotification) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for _, r := range a.rules {
+		vals := a.values(now, r)
+		firing := a.firing[r.Name]
+		if firing == nil {
+			firing = map[string]uint64{}
+			a.firing[r.Name] = firing
+		}
+
+		newNote := func(state, client string, val uint64) (n *alertNotification) {
+			return &alertNotification{
+				Time:          now,
+				Rule:          r.Name,
+				State:         state,
+				Metric:        r.Metric,
+				Client:        client,
+				Value:         val,
+				Threshold:     r.Threshold,
+				WindowMinutes: r.WindowMinutes,
+				url:           r.WebhookURL,
+			}
+		}
+
+		for client, val := range vals {
+			if _, ok := firing[client]; ok {
+				firing[client] = val
+			} else if val > r.Threshold {
+				firing[client] = val
+				notes = append(notes, newNote(alertStateFiring, client, val))
+			}
+		}
+
+		for client := range firing {
+			val := vals[client]
+			if val <= r.clearThreshold() {
+				delete(firing, client)
+				notes = append(notes, newNote(alertStateResolved, client, val))
+			}
+		}
+	}
+
+	return notes
+}
+
+// notify sends the notifications to the webhooks.
+func (a *alerter) notify(notes []*alertNotification) {
+	for _, n := range notes {
+		log.Info("stats: alert %q for client %q is %s: %d", n.Rule, n.Client, n.State, n.Value)
+
+		if n.url == "" {
+			continue
+		}
+
+		b, err := json.Marshal(n)
+		if err != nil {
+			log.Error("stats: encoding alert notification: %s", err)
+
+			continue
+		}
+
+		go a.send(n.url, b)
+	}
+}
+
+// send POSTs the notification body b to u.
+func (a *alerter) send(u string, b []byte) {
+	resp, err := a.client.Post(u, "application/json", bytes.NewReader(b))
+	if err != nil {
+		log.Error("stats: sending alert notification: %s", err)
+
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		log.Error("stats: sending alert notification: got status code %d", resp.StatusCode)
+	}
+}
+
+// run evaluates the rules every alertCheckIvl until done is closed.
+func (a *alerter) run(done <-chan struct{}) {
+	t := time.NewTicker(alertCheckIvl)
+	defer t.Stop()
+
+	for {
+		select {
+		case now := <-t.C:
+			a.notify(a.evaluate(now))
+		case <-done:
+			return
+		}
+	}
+}
+
+// alertJSON is the alert rule with its state.
+type alertJSON struct {
+	AlertRule
+
+	// FiringClients are the clients for which the per-client rule is
+	// firing.
+	FiringClients []string `json:"firing_clients,omitempty"`
+
+	// Firing is true if the rule is firing for any client.
+	Firing bool `json:"firing"`
+}
+
+// list returns the rules with their states.
+func (a *alerter) list() (alerts []alertJSON) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	alerts = make([]alertJSON, 0, len(a.rules))
+	for _, r := range a.rules {
+		aj := alertJSON{
+			AlertRule: *r,
+		}
+
+		firing := a.firing[r.Name]
+		aj.Firing = len(firing) != 0
+		if r.PerClient {
+			for c := range firing {
+				aj.FiringClients = append(aj.FiringClients, c)
+			}
+
+			sort.Strings(aj.FiringClients)
+		}
+
+		alerts = append(alerts, aj)
+	}
+
+	return alerts
+}
+
+// warnings returns the human-readable descriptions of the firing alerts.
+func (a *alerter) warnings() (warns []string) {
+	for _, aj := range a.list() {
+		if !aj.Firing {
+			continue
+		}
+
+		w := fmt.Sprintf("alert %q is firing", aj.Name)
+		if len(aj.FiringClients) != 0 {
+			w = fmt.Sprintf("%s for clients %v", w, aj.FiringClients)
+		}
+
+		warns = append(warns, w)
+	}
+
+	return warns
+}
+
+// ruleIndex returns the index of the rule with the name or -1.  a.mu is
+// expected to be locked.
+func (a *alerter) ruleIndex(name string) (i int) {
+	for i, r := range a.rules {
+		if r.Name == name {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// add validates and adds a new rule.
+func (a *alerter) add(r AlertRule) (err error) {
+	err = r.validate()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.ruleIndex(r.Name) != -1 {
+		return fmt.Errorf("alert rule %q already exists", r.Name)
+	}
+
+	a.rules = append(a.rules, &r)
+	a.updateTrackClients()
+
+	return nil
+}
+
+// update validates r and replaces the rule with the name by it.  The state of
+// the rule is reset.
+func (a *alerter) update(name string, r AlertRule) (err error) {
+	err = r.validate()
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := a.ruleIndex(name)
+	if i == -1 {
+		return fmt.Errorf("no alert rule %q", name)
+	}
+
+	if r.Name != name && a.ruleIndex(r.Name) != -1 {
+		return fmt.Errorf("alert rule %q already exists", r.Name)
+	}
+
+	a.rules[i] = &r
+	delete(a.firing, name)
+	a.updateTrackClients()
+
+	return nil
+}
+
+// remove removes the rule with the name.
+func (a *alerter) remove(name string) (err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	i := a.ruleIndex(name)
+	if i == -1 {
+		return fmt.Errorf("no alert rule %q", name)
+	}
+
+	a.rules = append(a.rules[:i], a.rules[i+1:]...)
+	delete(a.firing, name)
+	a.updateTrackClients()
+
+	return nil
+}
+
+// writeRules writes the current rules to rules.
+func (a *alerter) writeRules(rules *[]AlertRule) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	*rules = make([]AlertRule, len(a.rules))
+	for i, r := range a.rules {
+		(*rules)[i] = *r
+	}
+}
@@ -0,0 +1,196 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertRule_validate(t *testing.T) {
+	valid := AlertRule{
+		Name:          "spike",
+		Metric:        alertMetricBlockedFiltering,
+		Threshold:     10,
+		WindowMinutes: 10,
+	}
+
+	testCases := []struct {
+		name    string
+		modify  func(r *AlertRule)
+		wantErr string
+	}{{
+		name:    "valid",
+		modify:  func(_ *AlertRule) {},
+		wantErr: "",
+	}, {
+		name:    "no_name",
+		modify:  func(r *AlertRule) { r.Name = "" },
+		wantErr: "name is required",
+	}, {
+		name:    "bad_metric",
+		modify:  func(r *AlertRule) { r.Metric = "bad" },
+		wantErr: `unknown metric "bad"`,
+	}, {
+		name:    "bad_clear_threshold",
+		modify:  func(r *AlertRule) { r.ClearThreshold = 10 },
+		wantErr: "clear_threshold must be less than threshold",
+	}, {
+		name:    "bad_window",
+		modify:  func(r *AlertRule) { r.WindowMinutes = 61 },
+		wantErr: "window_minutes must be between 1 and 60",
+	}, {
+		name:    "bad_webhook",
+		modify:  func(r *AlertRule) { r.WebhookURL = "ftp://example.org" },
+		wantErr: `webhook_url: bad scheme "ftp"`,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			r := valid
+			tc.modify(&r)
+
+			err := r.validate()
+			if tc.wantErr == "" {
+				assert.Nil(t, err)
+
+				return
+			}
+
+			require.NotNil(t, err)
+			assert.Equal(t, tc.wantErr, err.Error())
+		})
+	}
+}
+
+func TestAlerter_evaluate(t *testing.T) {
+	a := newAlerter([]AlertRule{{
+		Name:          "total",
+		Metric:        alertMetricBlockedFiltering,
+		Threshold:     4,
+		WindowMinutes: 2,
+	}, {
+		Name:          "client",
+		Metric:        alertMetricDNSQueries,
+		Threshold:     2,
+		WindowMinutes: 1,
+		PerClient:     true,
+	}}, nil)
+
+	start := time.Unix(0, 0).Add(time.Hour)
+	countN := func(now time.Time, n int, res Result, client string) {
+		for i := 0; i < n; i++ {
+			a.count(now, res, client)
+		}
+	}
+
+	countN(start, 3, RFiltered, "1.2.3.4")
+	countN(start, 2, RFiltered, "1.2.3.5")
+	countN(start, 1, RNotFiltered, "1.2.3.5")
+
+	notes := a.evaluate(start)
+	require.Len(t, notes, 3)
+
+	states := map[string]string{}
+	for _, n := range notes {
+		states[n.Rule+"/"+n.Client] = n.State
+	}
+	assert.Equal(t, map[string]string{
+		"total/":         alertStateFiring,
+		"client/1.2.3.4": alertStateFiring,
+		"client/1.2.3.5": alertStateFiring,
+	}, states)
+
+	// The values are still above the clear thresholds, so nothing changes.
+	notes = a.evaluate(start.Add(time.Second))
+	assert.Empty(t, notes)
+	assert.Len(t, a.warnings(), 2)
+
+	// A minute later, the first client is still above the clear threshold,
+	// while the second one has no queries.
+	next := start.Add(time.Minute)
+	countN(next, 2, RFiltered, "1.2.3.4")
+
+	notes = a.evaluate(next)
+	require.Len(t, notes, 1)
+	assert.Equal(t, "client", notes[0].Rule)
+	assert.Equal(t, "1.2.3.5", notes[0].Client)
+	assert.Equal(t, alertStateResolved, notes[0].State)
+
+	// Two minutes later, the total window only contains two queries.
+	notes = a.evaluate(start.Add(2 * time.Minute))
+	require.Len(t, notes, 2)
+	for _, n := range notes {
+		assert.Equal(t, alertStateResolved, n.State)
+	}
+
+	assert.Empty(t, a.warnings())
+}
+
+func TestAlerter_notify(t *testing.T) {
+	got := make(chan *alertNotification, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := &alertNotification{}
+		err := json.NewDecoder(r.Body).Decode(n)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+
+			return
+		}
+
+		got <- n
+	}))
+	t.Cleanup(srv.Close)
+
+	a := newAlerter([]AlertRule{{
+		Name:          "spike",
+		Metric:        alertMetricBlockedFiltering,
+		WebhookURL:    srv.URL,
+		Threshold:     1,
+		WindowMinutes: 1,
+	}}, srv.Client())
+
+	now := time.Now()
+	a.count(now, RFiltered, "1.2.3.4")
+	a.count(now, RFiltered, "1.2.3.4")
+
+	a.notify(a.evaluate(now))
+
+	select {
+	case n := <-got:
+		assert.Equal(t, "spike", n.Rule)
+		assert.Equal(t, alertStateFiring, n.State)
+		assert.Equal(t, uint64(2), n.Value)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification received")
+	}
+}
+
+func TestAlerter_crud(t *testing.T) {
+	a := newAlerter(nil, nil)
+	rule := AlertRule{
+		Name:          "spike",
+		Metric:        alertMetricBlockedFiltering,
+		Threshold:     1,
+		WindowMinutes: 1,
+	}
+
+	require.Nil(t, a.add(rule))
+	assert.NotNil(t, a.add(rule))
+
+	rule.Name = "renamed"
+	require.Nil(t, a.update("spike", rule))
+	assert.NotNil(t, a.update("spike", rule))
+
+	var rules []AlertRule
+	a.writeRules(&rules)
+	assert.Equal(t, []AlertRule{rule}, rules)
+
+	require.Nil(t, a.remove("renamed"))
+	assert.NotNil(t, a.remove("renamed"))
+	assert.Empty(t, a.list())
+}
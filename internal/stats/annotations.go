@@ -0,0 +1,322 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/golibs/log"
+	bolt "go.etcd.io/bbolt"
+)
+
+// AnnotationKind is the kind of an annotation.
+type AnnotationKind string
+
+// Annotation kinds.
+const (
+	AnnotationProtectionEnabled  AnnotationKind = "protection_enabled"
+	AnnotationProtectionDisabled AnnotationKind = "protection_disabled"
+	AnnotationListAdded          AnnotationKind = "list_added"
+	AnnotationListRemoved        AnnotationKind = "list_removed"
+	AnnotationListFailed         AnnotationKind = "list_failed"
+	AnnotationUpstreamsChanged   AnnotationKind = "upstreams_changed"
+)
+
+// maxAnnotations is the maximum number of the stored annotations.  The oldest
+// ones are removed first.
+const maxAnnotations = 10_000
+
+// annotationsBucket is the name of the database bucket of the annotations.  It
+// can't collide with the names of the units, which are 8 bytes long.
+var annotationsBucket = []byte("annotations")
+
+// annotationDB is an annotation stored in the database.  The time of the
+// annotation is the key.
+type annotationDB struct {
+	Kind AnnotationKind `json:"kind"`
+	Text string         `json:"text"`
+}
+
+// Annotation is an event which may explain a change in the statistics, for
+// example an unexpected drop of the number of the blocked requests.
+type Annotation struct {
+	Time aghtime.Time   `json:"time"`
+	Kind AnnotationKind `json:"kind"`
+
+	// Text is the description of the event, for example the name of the
+	// filter list.
+	Text string `json:"text"`
+}
+
+// Annotate implements the Stats interface for *statsCtx.
+func (s *statsCtx) Annotate(kind AnnotationKind, text string) {
+	now := time.Now()
+
+	data, err := json.Marshal(&annotationDB{
+		Kind: kind,
+		Text: text,
+	})
+	if err != nil {
+		log.Error("stats: encoding annotation: %s", err)
+
+		return
+	}
+
+	tx := s.beginTxn(true)
+	if tx == nil {
+		return
+	}
+
+	err = s.putAnnotation(tx, now, data)
+	if err != nil {
+		log.Error("stats: storing annotation: %s", err)
+		_ = tx.Rollback()
+
+		return
+	}
+
+	s.commitTxn(tx)
+}
+
+// annotationKey returns the database key of the annotation made at t.  The
+// times before the Unix epoch are mapped to the epoch.
+func annotationKey(t time.Time) (k []byte) {
+	if t.Before(time.Unix(0, 0)) {
+		return itob(0)
+	}
+
+	return itob(uint64(t.UnixNano()))
+}
+
+// putAnnotation stores the annotation encoded in data with the time t and
+// removes the ones which are too old.
+func (s *statsCtx) putAnnotation(tx *bolt.Tx, t time.Time, data []byte) (err error) {
+	bkt, err := tx.CreateBucketIfNotExists(annotationsBucket)
+	if err != nil {
+		return err
+	}
+
+	// Never overwrite the annotations made at the same nanosecond.
+	ns := btoi(annotationKey(t))
+	for bkt.Get(itob(ns)) != nil {
+		ns++
+	}
+
+	err = bkt.Put(itob(ns), data)
+	if err != nil {
+		return err
+	}
+
+	oldest := annotationKey(t.Add(-time.Duration(s.conf.limit) * time.Hour))
+	extra := bkt.Stats().KeyN - maxAnnotations
+
+	c := bkt.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		if extra <= 0 && bytes.Compare(k, oldest) >= 0 {
+			break
+		}
+
+		err = c.Delete()
+		if err != nil {
+			return err
+		}
+
+		extra--
+	}
+
+	return nil
+}
+
+// annotations returns the annotations of kinds made within the range from
+// from to to inclusively, oldest first.  If kinds are empty, the annotations
+// of all kinds are returned.  The zero to means no upper bound.
+func (s *statsCtx) annotations(from, to time.Time, kinds []AnnotationKind) (anns []Annotation) {
+	anns = []Annotation{}
+
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return anns
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	bkt := tx.Bucket(annotationsBucket)
+	if bkt == nil {
+		return anns
+	}
+
+	var last []byte
+	if !to.IsZero() {
+		last = annotationKey(to)
+	}
+
+	c := bkt.Cursor()
+	for k, v := c.Seek(annotationKey(from)); k != nil; k, v = c.Next() {
+		if last != nil && bytes.Compare(k, last) > 0 {
+			break
+		}
+
+		adb := annotationDB{}
+		err := json.Unmarshal(v, &adb)
+		if err != nil {
+			log.Debug("stats: decoding annotation: %s", err)
+
+			continue
+		}
+
+		if len(kinds) > 0 && !hasKind(kinds, adb.Kind) {
+			continue
+		}
+
+		anns = append(anns, Annotation{
+			Time: aghtime.Time{Time: time.Unix(0, int64(btoi(k)))},
+			Kind: adb.Kind,
+			Text: adb.Text,
+		})
+	}
+
+	return anns
+}
+
+// hasKind returns true if kinds contain k.
+func hasKind(kinds []AnnotationKind, k AnnotationKind) (ok bool) {
+	for _, kind := range kinds {
+		if kind == k {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseKinds parses the comma-separated list of the annotation kinds.
+func parseKinds(s string) (kinds []AnnotationKind) {
+	for _, k := range strings.Split(s, ",") {
+		k = strings.TrimSpace(k)
+		if k != "" {
+			kinds = append(kinds, AnnotationKind(k))
+		}
+	}
+
+	return kinds
+}
+
+// annotationsResp is the response to the GET /control/stats_annotations HTTP
+// API.
+type annotationsResp struct {
+	Annotations []Annotation `json:"annotations"`
+}
+
+// handleStatsAnnotations is the handler for the GET /control/stats_annotations
+// HTTP API.  The optional from and to parameters limit the time range, and
+// the optional kinds parameter is the comma-separated list of the kinds.
+func (s *statsCtx) handleStatsAnnotations(w http.ResponseWriter, r *http.Request) {
+	var from, to time.Time
+
+	params := aghhttp.QueryParams(r.URL.Query())
+	const expTime = "a time in rfc 3339 format or unix seconds"
+	params.Value("from", expTime, func(v string) (perr error) {
+		from, perr = aghtime.Parse(v)
+
+		return perr
+	})
+	params.Value("to", expTime, func(v string) (perr error) {
+		to, perr = aghtime.Parse(v)
+
+		return perr
+	})
+	kinds := parseKinds(params.String("kinds", ""))
+
+	err := params.Err()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	resp := &annotationsResp{
+		Annotations: s.annotations(from, to, kinds),
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// grafanaAnnotationsReq is the request of the Grafana JSON data sources to the
+// annotations endpoint.
+type grafanaAnnotationsReq struct {
+	Range struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+
+	// Annotation is the annotation query of the dashboard.  It's returned
+	// as is within each annotation.  Its query property, if any, is the
+	// comma-separated list of the kinds.
+	Annotation json.RawMessage `json:"annotation"`
+}
+
+// grafanaAnnotation is an annotation in the format of the Grafana JSON data
+// sources.
+type grafanaAnnotation struct {
+	Annotation json.RawMessage `json:"annotation,omitempty"`
+	Title      string          `json:"title"`
+	Text       string          `json:"text"`
+	Tags       []string        `json:"tags"`
+
+	// Time is the time of the annotation in milliseconds since the Unix
+	// epoch.
+	Time int64 `json:"time"`
+}
+
+// handleGrafanaAnnotations is the handler for the POST
+// /control/grafana/annotations HTTP API, which serves the annotations to the
+// Grafana JSON data sources with the URL /control/grafana.
+func (s *statsCtx) handleGrafanaAnnotations(w http.ResponseWriter, r *http.Request) {
+	req := &grafanaAnnotationsReq{}
+	err := json.NewDecoder(r.Body).Decode(req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	var query struct {
+		Query string `json:"query"`
+	}
+	if len(req.Annotation) > 0 {
+		// The annotation query is optional and is only used for the
+		// kinds, so ignore its malformed contents.
+		_ = json.Unmarshal(req.Annotation, &query)
+	}
+
+	anns := s.annotations(req.Range.From, req.Range.To, parseKinds(query.Query))
+	resp := make([]*grafanaAnnotation, 0, len(anns))
+	for _, a := range anns {
+		resp = append(resp, &grafanaAnnotation{
+			Annotation: req.Annotation,
+			Title:      string(a.Kind),
+			Text:       a.Text,
+			Tags:       []string{string(a.Kind)},
+			Time:       a.Time.UnixNano() / int64(time.Millisecond),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(w).Encode(resp)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
+
+// handleGrafanaTest is the handler for the GET /control/grafana HTTP API, which
+// Grafana uses to test the data source.
+func (s *statsCtx) handleGrafanaTest(w http.ResponseWriter, _ *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,139 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStatsCtx_annotations(t *testing.T) {
+	conf := Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	}
+
+	s, err := createObject(conf)
+	require.NoError(t, err)
+
+	start := time.Now()
+	s.Annotate(AnnotationProtectionDisabled, "")
+	s.Annotate(AnnotationListFailed, "List (https://lists.example/list.txt): timeout")
+	s.Annotate(AnnotationProtectionEnabled, "")
+
+	anns := s.annotations(time.Time{}, time.Time{}, nil)
+	require.Len(t, anns, 3)
+
+	assert.Equal(t, AnnotationProtectionDisabled, anns[0].Kind)
+	assert.Equal(t, AnnotationListFailed, anns[1].Kind)
+	assert.Equal(t, "List (https://lists.example/list.txt): timeout", anns[1].Text)
+	assert.Equal(t, AnnotationProtectionEnabled, anns[2].Kind)
+	assert.False(t, anns[0].Time.Before(start))
+
+	anns = s.annotations(time.Time{}, time.Time{}, []AnnotationKind{AnnotationListFailed})
+	require.Len(t, anns, 1)
+	assert.Equal(t, AnnotationListFailed, anns[0].Kind)
+
+	assert.Empty(t, s.annotations(start.Add(time.Hour), time.Time{}, nil))
+	assert.Empty(t, s.annotations(time.Time{}, start.Add(-time.Hour), nil))
+
+	// The annotations survive the restart.
+	s.Close()
+
+	s, err = createObject(conf)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	anns = s.annotations(time.Time{}, time.Time{}, nil)
+	require.Len(t, anns, 3)
+
+	t.Run("retention", func(t *testing.T) {
+		tx := s.beginTxn(true)
+		require.NotNil(t, tx)
+
+		data := []byte(`{"kind":"list_added","text":"old"}`)
+		require.NoError(t, s.putAnnotation(tx, start.Add(-48*time.Hour), data))
+		s.commitTxn(tx)
+
+		// The old annotation is only removed when the next one is
+		// stored.
+		s.Annotate(AnnotationUpstreamsChanged, "")
+
+		anns = s.annotations(time.Time{}, time.Time{}, nil)
+		require.Len(t, anns, 4)
+		assert.Equal(t, AnnotationUpstreamsChanged, anns[3].Kind)
+
+		err = s.db.View(func(tx *bolt.Tx) (verr error) {
+			assert.Equal(t, 4, tx.Bucket(annotationsBucket).Stats().KeyN)
+
+			return nil
+		})
+		require.NoError(t, err)
+	})
+
+	t.Run("http", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/control/stats_annotations?kinds=protection_enabled,protection_disabled", nil)
+		s.handleStatsAnnotations(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := &struct {
+			Annotations []struct {
+				Time time.Time      `json:"time"`
+				Kind AnnotationKind `json:"kind"`
+			} `json:"annotations"`
+		}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+		require.Len(t, resp.Annotations, 2)
+		assert.Equal(t, AnnotationProtectionDisabled, resp.Annotations[0].Kind)
+
+		w = httptest.NewRecorder()
+		r = httptest.NewRequest(http.MethodGet, "/control/stats_annotations?from=bad", nil)
+		s.handleStatsAnnotations(w, r)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+
+	t.Run("grafana", func(t *testing.T) {
+		body := `{
+			"range": {
+				"from": "` + start.Add(-time.Minute).UTC().Format(time.RFC3339Nano) + `",
+				"to": "` + time.Now().Add(time.Minute).UTC().Format(time.RFC3339Nano) + `"
+			},
+			"annotation": {
+				"name": "AdGuard Home",
+				"enable": true,
+				"query": "list_failed"
+			}
+		}`
+
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "/control/grafana/annotations", strings.NewReader(body))
+		s.handleGrafanaAnnotations(w, r)
+		require.Equal(t, http.StatusOK, w.Code)
+
+		var resp []*struct {
+			Annotation struct {
+				Name string `json:"name"`
+			} `json:"annotation"`
+			Title string   `json:"title"`
+			Text  string   `json:"text"`
+			Tags  []string `json:"tags"`
+			Time  int64    `json:"time"`
+		}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.Len(t, resp, 1)
+
+		a := resp[0]
+		assert.Equal(t, "AdGuard Home", a.Annotation.Name)
+		assert.Equal(t, string(AnnotationListFailed), a.Title)
+		assert.Equal(t, []string{string(AnnotationListFailed)}, a.Tags)
+		assert.InDelta(t, start.UnixNano()/int64(time.Millisecond), a.Time, 1000)
+	})
+}
@@ -0,0 +1,171 @@
+package stats
+
+import "github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+
+// Lengths of the compared periods in days.  The days are the days in the
+// instance timezone and the weeks start on Monday.
+const (
+	daysPerDay  = 1
+	daysPerWeek = 7
+)
+
+// countComparison is the number of queries in the elapsed part of the current
+// period and in the same part of the previous one.  The numbers are nil if the
+// statistics don't reach back far enough.
+type countComparison struct {
+	Current  *uint64 `json:"current"`
+	Previous *uint64 `json:"previous"`
+
+	// DeltaPercent is the change from Previous to Current in percent.  It's
+	// nil if any of them is nil or if Previous is zero.
+	DeltaPercent *float64 `json:"delta_percent"`
+}
+
+// newCountComparison returns the comparison of cur with prev.
+func newCountComparison(cur, prev *uint64) (c countComparison) {
+	c = countComparison{
+		Current:  cur,
+		Previous: prev,
+	}
+
+	if cur != nil && prev != nil && *prev != 0 {
+		d := (float64(*cur) - float64(*prev)) / float64(*prev) * 100
+		c.DeltaPercent = &d
+	}
+
+	return c
+}
+
+// periodComparison compares the elapsed part of the current period with the
+// same part of the previous one.
+type periodComparison struct {
+	DNSQueries       countComparison `json:"dns_queries"`
+	BlockedFiltering countComparison `json:"blocked_filtering"`
+
+	// Hours is the length of the compared parts including the current,
+	// unfinished hour.
+	Hours uint32 `json:"hours"`
+}
+
+// compareResp is the response to the GET /control/stats_compare request.
+type compareResp struct {
+	Day  periodComparison `json:"day"`
+	Week periodComparison `json:"week"`
+}
+
+// unitSpan is a range of the consecutive units, the last of which is the
+// current one.
+type unitSpan struct {
+	// units are the units, units[i] has the ID firstID+i.
+	units []*unitDB
+
+	firstID uint32
+
+	// oldestID is the ID of the oldest unit with the statistics.  The units
+	// before it are empty because there was nothing collected yet, not
+	// because there were no queries.
+	oldestID uint32
+}
+
+// sums returns the number of all queries and of the blocked ones in n units
+// beginning with the one with first ID.  The numbers are nil if the units
+// aren't all kept.
+func (us *unitSpan) sums(first, n uint32) (total, blocked *uint64) {
+	if first < us.firstID {
+		return nil, nil
+	}
+
+	var t, b uint64
+	i := first - us.firstID
+	for _, u := range us.units[i : i+n] {
+		t += u.NTotal
+		b += u.NResult[RFiltered]
+	}
+
+	return &t, &b
+}
+
+// compare returns the comparison of the elapsed part of the period beginning
+// with the unit with start ID with the same part of the previous period
+// beginning with the unit with prevStart ID.
+func (us *unitSpan) compare(start, prevStart uint32) (pc periodComparison) {
+	curID := us.firstID + uint32(len(us.units)) - 1
+	n := curID - start + 1
+
+	total, blocked := us.sums(start, n)
+
+	// The current period is compared as is even if the statistics have
+	// been collected only since its middle, but the previous one must be
+	// covered completely.
+	var prevTotal, prevBlocked *uint64
+	if prevStart >= us.oldestID {
+		prevTotal, prevBlocked = us.sums(prevStart, n)
+	}
+
+	return periodComparison{
+		DNSQueries:       newCountComparison(total, prevTotal),
+		BlockedFiltering: newCountComparison(blocked, prevBlocked),
+		Hours:            n,
+	}
+}
+
+// periodStarts returns the IDs of the first units of the period of days
+// containing the unit with id and of the period before it.  If days is
+// daysPerWeek, the periods are the weeks.
+func periodStarts(id uint32, days int) (start, prevStart uint32) {
+	t := aghtime.StartOfDay(unitTime(id))
+	if days == daysPerWeek {
+		// Begin the week on Monday.
+		t = t.AddDate(0, 0, -(int(t.Weekday())+6)%7)
+	}
+
+	return firstUnitSince(t), firstUnitSince(t.AddDate(0, 0, -days))
+}
+
+// oldestUnitID returns the ID of the oldest unit stored in the database or
+// curID if there are none.
+func (s *statsCtx) oldestUnitID(curID uint32) (id uint32) {
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return curID
+	}
+	defer func() { _ = tx.Rollback() }()
+
+	// The names of the buckets are the big-endian unit IDs, so the first
+	// one is the oldest.
+	k, _ := tx.Cursor().First()
+	if k == nil {
+		return curID
+	}
+
+	id = uint32(btoi(k))
+	if id > curID {
+		return curID
+	}
+
+	return id
+}
+
+// compare returns the comparisons of the current day and week with the
+// previous ones.  ok is false if the statistics can't be loaded.
+func (s *statsCtx) compare() (resp compareResp, ok bool) {
+	units, firstID := s.loadUnits(s.conf.limit)
+	if units == nil {
+		return compareResp{}, false
+	}
+
+	curID := firstID + uint32(len(units)) - 1
+	us := &unitSpan{
+		units:    units,
+		firstID:  firstID,
+		oldestID: s.oldestUnitID(curID),
+	}
+
+	dayStart, prevDayStart := periodStarts(curID, daysPerDay)
+	weekStart, prevWeekStart := periodStarts(curID, daysPerWeek)
+
+	return compareResp{
+		Day:  us.compare(dayStart, prevDayStart),
+		Week: us.compare(weekStart, prevWeekStart),
+	}, true
+}
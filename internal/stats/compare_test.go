@@ -0,0 +1,280 @@
+package stats
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testMonday is the ID of the unit of 2021-05-03 00:00 UTC, a Monday.
+const testMonday = 450_000
+
+// The lengths of the periods in units in the timezones without DST.
+const (
+	unitsPerDay  = 24
+	unitsPerWeek = 7 * unitsPerDay
+)
+
+// setTestLocation sets the instance timezone for the duration of the test.
+func setTestLocation(t *testing.T, loc *time.Location) {
+	t.Helper()
+
+	prev := aghtime.Location()
+	aghtime.SetLocation(loc)
+	t.Cleanup(func() { aghtime.SetLocation(prev) })
+}
+
+func TestPeriodStarts(t *testing.T) {
+	setTestLocation(t, time.UTC)
+
+	testCases := []struct {
+		name          string
+		id            uint32
+		days          int
+		wantStart     uint32
+		wantPrevStart uint32
+	}{{
+		name:          "day",
+		id:            testMonday + 10,
+		days:          daysPerDay,
+		wantStart:     testMonday,
+		wantPrevStart: testMonday - unitsPerDay,
+	}, {
+		name:          "week_first",
+		id:            testMonday,
+		days:          daysPerWeek,
+		wantStart:     testMonday,
+		wantPrevStart: testMonday - unitsPerWeek,
+	}, {
+		name:          "week_last",
+		id:            testMonday + unitsPerWeek - 1,
+		days:          daysPerWeek,
+		wantStart:     testMonday,
+		wantPrevStart: testMonday - unitsPerWeek,
+	}, {
+		name:          "week_before",
+		id:            testMonday - 1,
+		days:          daysPerWeek,
+		wantStart:     testMonday - unitsPerWeek,
+		wantPrevStart: testMonday - 2*unitsPerWeek,
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			start, prevStart := periodStarts(tc.id, tc.days)
+			assert.EqualValues(t, tc.wantStart, start)
+			assert.EqualValues(t, tc.wantPrevStart, prevStart)
+		})
+	}
+
+	t.Run("offset", func(t *testing.T) {
+		// The day begins at 22:00 UTC of the previous day in UTC+2.
+		setTestLocation(t, time.FixedZone("", 2*60*60))
+
+		start, prevStart := periodStarts(testMonday+10, daysPerDay)
+		assert.EqualValues(t, testMonday-2, start)
+		assert.EqualValues(t, testMonday-2-unitsPerDay, prevStart)
+	})
+
+	t.Run("dst", func(t *testing.T) {
+		loc, err := time.LoadLocation("Europe/Berlin")
+		if err != nil {
+			t.Skipf("no timezone database: %s", err)
+		}
+		setTestLocation(t, loc)
+
+		// 2021-03-28, the day the DST begins, is 23 hours long in Berlin.
+		// Its midnight is at 23:00 UTC of the previous day.
+		day := firstUnitSince(time.Date(2021, 3, 27, 23, 0, 0, 0, time.UTC))
+		start, prevStart := periodStarts(day+30, daysPerDay)
+		assert.EqualValues(t, day+23, start)
+		assert.EqualValues(t, day, prevStart)
+	})
+}
+
+// newTestUnitSpan returns the span of two weeks ending with curID.  There are
+// two queries in every unit of the current week and one query in every unit
+// before that.  One query of every unit is blocked.
+func newTestUnitSpan(curID, oldestID uint32) (us *unitSpan) {
+	const n = 2 * unitsPerWeek
+
+	us = &unitSpan{
+		units:    make([]*unitDB, n),
+		firstID:  curID - n + 1,
+		oldestID: oldestID,
+	}
+
+	for i := range us.units {
+		u := &unitDB{
+			NTotal:  1,
+			NResult: make([]uint64, rLast),
+		}
+		if us.firstID+uint32(i) >= testMonday {
+			u.NTotal = 2
+		}
+		u.NResult[RFiltered] = 1
+
+		us.units[i] = u
+	}
+
+	return us
+}
+
+func TestUnitSpan_compare(t *testing.T) {
+	// Wednesday, 10:00 UTC.
+	const curID = testMonday + 2*unitsPerDay + 10
+	const dayStart = curID / unitsPerDay * unitsPerDay
+
+	u64 := func(n uint64) (p *uint64) { return &n }
+	f64 := func(f float64) (p *float64) { return &f }
+
+	testCases := []struct {
+		name      string
+		us        *unitSpan
+		start     uint32
+		prevStart uint32
+		want      periodComparison
+	}{{
+		name:      "day",
+		us:        newTestUnitSpan(curID, 0),
+		start:     dayStart,
+		prevStart: dayStart - unitsPerDay,
+		want: periodComparison{
+			DNSQueries: countComparison{
+				Current:      u64(22),
+				Previous:     u64(22),
+				DeltaPercent: f64(0),
+			},
+			BlockedFiltering: countComparison{
+				Current:      u64(11),
+				Previous:     u64(11),
+				DeltaPercent: f64(0),
+			},
+			Hours: 11,
+		},
+	}, {
+		name:      "week",
+		us:        newTestUnitSpan(curID, 0),
+		start:     testMonday,
+		prevStart: testMonday - unitsPerWeek,
+		want: periodComparison{
+			DNSQueries: countComparison{
+				Current:      u64(118),
+				Previous:     u64(59),
+				DeltaPercent: f64(100),
+			},
+			BlockedFiltering: countComparison{
+				Current:      u64(59),
+				Previous:     u64(59),
+				DeltaPercent: f64(0),
+			},
+			Hours: 59,
+		},
+	}, {
+		name:      "week_no_history",
+		us:        newTestUnitSpan(curID, testMonday-1),
+		start:     testMonday,
+		prevStart: testMonday - unitsPerWeek,
+		want: periodComparison{
+			DNSQueries: countComparison{
+				Current: u64(118),
+			},
+			BlockedFiltering: countComparison{
+				Current: u64(59),
+			},
+			Hours: 59,
+		},
+	}, {
+		name: "week_retention",
+		us: &unitSpan{
+			units:    newTestUnitSpan(curID, 0).units[unitsPerWeek:],
+			firstID:  curID - unitsPerWeek + 1,
+			oldestID: 0,
+		},
+		start:     testMonday,
+		prevStart: testMonday - unitsPerWeek,
+		want: periodComparison{
+			DNSQueries: countComparison{
+				Current: u64(118),
+			},
+			BlockedFiltering: countComparison{
+				Current: u64(59),
+			},
+			Hours: 59,
+		},
+	}, {
+		name:      "day_partial",
+		us:        newTestUnitSpan(curID, dayStart+1),
+		start:     dayStart,
+		prevStart: dayStart - unitsPerDay,
+		want: periodComparison{
+			DNSQueries: countComparison{
+				Current: u64(22),
+			},
+			BlockedFiltering: countComparison{
+				Current: u64(11),
+			},
+			Hours: 11,
+		},
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.want, tc.us.compare(tc.start, tc.prevStart))
+		})
+	}
+
+	t.Run("zero_previous", func(t *testing.T) {
+		us := newTestUnitSpan(curID, 0)
+		for _, u := range us.units[:unitsPerWeek] {
+			u.NTotal, u.NResult[RFiltered] = 0, 0
+		}
+
+		pc := us.compare(testMonday, testMonday-unitsPerWeek)
+		require.NotNil(t, pc.DNSQueries.Previous)
+
+		assert.Zero(t, *pc.DNSQueries.Previous)
+		assert.Nil(t, pc.DNSQueries.DeltaPercent)
+	})
+}
+
+func TestStatsCtx_compare(t *testing.T) {
+	setTestLocation(t, time.UTC)
+
+	conf := Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 7,
+		UnitID: func() (id uint32) {
+			return testMonday + 10
+		},
+	}
+
+	s, err := createObject(conf)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		s.Close()
+		assert.NoError(t, os.Remove(conf.Filename))
+	})
+
+	s.Update(Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: RFiltered,
+	})
+
+	resp, ok := s.compare()
+	require.True(t, ok)
+
+	cmp := resp.Day.BlockedFiltering
+	require.NotNil(t, cmp.Current)
+
+	assert.EqualValues(t, 1, *cmp.Current)
+	// There is no history in a new database.
+	assert.Nil(t, cmp.Previous)
+	assert.EqualValues(t, 11, resp.Week.Hours)
+}
@@ -0,0 +1,144 @@
+package stats
+
+import (
+	"net"
+	"time"
+
+	"github.com/AdguardTeam/golibs/log"
+)
+
+// ExpiredClients is the name of the aggregate, into which the counts of the
+// expired clients are folded.
+const ExpiredClients = "expired clients"
+
+// foldCounts moves the counts of keys in m into the count of into.  The sum of
+// the counts isn't changed, and neither is the number of the keys increased.
+// It returns true if any of keys has been found.
+func foldCounts(m map[string]uint64, keys []string, into string) (ok bool) {
+	for _, k := range keys {
+		n, found := m[k]
+		if !found || k == into {
+			continue
+		}
+
+		delete(m, k)
+		m[into] += n
+		ok = true
+	}
+
+	return ok
+}
+
+// fold moves the counts of keys into the count of into.
+func (c *topCounter) fold(keys []string, into string) (ok bool) {
+	return foldCounts(c.counts, keys, into)
+}
+
+// foldPairs returns pairs with the counts of keys moved into the count of into,
+// sorted in descending order.  ok is false if none of keys is among pairs, and
+// then pairs are returned as is.
+func foldPairs(pairs []countPair, keys []string, into string) (folded []countPair, ok bool) {
+	m := make(map[string]uint64, len(pairs))
+	for _, p := range pairs {
+		m[p.Name] += p.Count
+	}
+
+	if !foldCounts(m, keys, into) {
+		return pairs, false
+	}
+
+	return convertMapToSlice(m, len(m)), true
+}
+
+// FoldClients implements the Stats interface for *statsCtx.
+func (s *statsCtx) FoldClients(ids []string) {
+	if s.conf.AnonymizeClientIP {
+		// The requests of a client are counted along with the ones of
+		// its network, so there is nothing of its own to fold.
+		var filtered []string
+		for _, id := range ids {
+			if net.ParseIP(id) == nil {
+				filtered = append(filtered, id)
+			}
+		}
+
+		ids = filtered
+	}
+
+	if len(ids) == 0 {
+		return
+	}
+
+	// Fold the current unit first.  A unit retired after that is already
+	// pending, see retireUnit, and the pending units are only flushed
+	// under s.pendingLock, which is held until the database is updated.
+	s.unitLock.Lock()
+	s.unit.clients.fold(ids, ExpiredClients)
+	curID := s.unit.id
+	s.unitLock.Unlock()
+
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	for id, udb := range s.pending {
+		folded, ok := foldPairs(udb.Clients, ids, ExpiredClients)
+		if !ok {
+			continue
+		}
+
+		// The readers use the pending units without the lock, see
+		// pendingUnits, so replace the unit instead of changing it.
+		cp := *udb
+		cp.Clients = folded
+		s.pending[id] = &cp
+	}
+
+	s.foldDBClients(curID, ids)
+}
+
+// foldDBClients folds the counts of the clients with ids in the units written
+// into the database before the current unit with curID.  The units are kept as
+// is while the file system is read-only.  s.pendingLock is expected to be
+// locked.
+func (s *statsCtx) foldDBClients(curID uint32, ids []string) {
+	if s.conf.WriteGuard.MemoryOnly() {
+		log.Debug("stats: not folding expired clients on read-only file system")
+
+		return
+	}
+
+	tx := s.beginTxn(true)
+	if tx == nil {
+		return
+	}
+
+	changed := false
+	for id := curID - s.conf.limit + 1; id != curID; id++ {
+		if _, ok := s.pending[id]; ok {
+			continue
+		}
+
+		udb := s.loadUnitFromDB(tx, id)
+		if udb == nil {
+			continue
+		}
+
+		var ok bool
+		udb.Clients, ok = foldPairs(udb.Clients, ids, ExpiredClients)
+		if ok {
+			changed = s.flushUnitToDB(tx, id, udb) || changed
+		}
+	}
+
+	if !changed {
+		_ = tx.Rollback()
+
+		return
+	}
+
+	err := s.commit(tx)
+	s.conf.WriteGuard.Report(err, time.Now())
+	if err != nil {
+		log.Debug("stats: folding expired clients: tx.Commit: %s", err)
+	}
+}
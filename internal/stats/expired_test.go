@@ -0,0 +1,108 @@
+package stats
+
+import (
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCtx_FoldClients(t *testing.T) {
+	var hour uint32 = 1
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() uint32 { return atomic.LoadUint32(&hour) },
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	update := func(clients ...string) {
+		for _, c := range clients {
+			s.Update(Entry{
+				Domain: "example.org",
+				Client: c,
+				Result: RNotFiltered,
+				Time:   123,
+			})
+		}
+	}
+
+	// The first unit is written into the database.
+	update("1.1.1.1", "1.1.1.1", "1.1.1.2", "1.1.1.3")
+	atomic.StoreUint32(&hour, 2)
+	s.rotateUnit(2, time.Now())
+	require.Empty(t, s.pendingUnits())
+
+	// The second one is pending.
+	update("1.1.1.1", "1.1.1.3")
+	nu := unit{}
+	s.initUnit(&nu, 3)
+	atomic.StoreUint32(&hour, 3)
+	_ = s.retireUnit(&nu)
+	require.Len(t, s.pendingUnits(), 1)
+
+	// The third one is the current.
+	update("1.1.1.2", "1.1.1.3", "1.1.1.3")
+
+	clientCounts := func() (counts map[string]uint64, total uint64) {
+		t.Helper()
+
+		d, ok := s.getData()
+		require.True(t, ok)
+
+		counts = map[string]uint64{}
+		for _, top := range d.TopClients {
+			for c, n := range top {
+				counts[c] += n
+			}
+		}
+
+		return counts, d.NumDNSQueries
+	}
+
+	before, total := clientCounts()
+	require.Equal(t, map[string]uint64{
+		"1.1.1.1": 3,
+		"1.1.1.2": 2,
+		"1.1.1.3": 4,
+	}, before)
+	require.EqualValues(t, 9, total)
+
+	t.Run("anonymized", func(t *testing.T) {
+		s.conf.AnonymizeClientIP = true
+		t.Cleanup(func() { s.conf.AnonymizeClientIP = false })
+
+		s.FoldClients([]string{"1.1.1.1"})
+
+		counts, _ := clientCounts()
+		assert.Equal(t, before, counts)
+	})
+
+	s.FoldClients([]string{"1.1.1.1", "1.1.1.2", "1.1.1.4"})
+
+	want := map[string]uint64{
+		"1.1.1.3":      4,
+		ExpiredClients: 5,
+	}
+
+	counts, foldedTotal := clientCounts()
+	assert.Equal(t, want, counts)
+	assert.Equal(t, total, foldedTotal)
+
+	// The folded units are kept once written.
+	s.flushPending(3, time.Now(), true)
+	require.Empty(t, s.pendingUnits())
+
+	counts, foldedTotal = clientCounts()
+	assert.Equal(t, want, counts)
+	assert.Equal(t, total, foldedTotal)
+
+	ips := s.GetTopClientsIP(10)
+	require.Len(t, ips, 1)
+
+	assert.Equal(t, "1.1.1.3", ips[0].String())
+}
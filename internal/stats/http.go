@@ -6,8 +6,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghhttp"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 )
 
@@ -23,39 +26,398 @@ func httpError(r *http.Request, w http.ResponseWriter, code int, format string,
 type statsResponse struct {
 	TimeUnits string `json:"time_units"`
 
+	// TimeUnitStarts are the starts of the hours or of the days of the per
+	// time unit counters.
+	TimeUnitStarts []string `json:"time_unit_starts"`
+
 	NumDNSQueries           uint64 `json:"num_dns_queries"`
 	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
 	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
 	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
 	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+	NumAAAADisabled         uint64 `json:"num_aaaa_disabled"`
 
-	AvgProcessingTime float64 `json:"avg_processing_time"`
+	// NumByReason is the number of requests per the stable code of the
+	// filtering reason, see dnsfilter.ReasonCode.
+	NumByReason map[dnsfilter.ReasonCode]uint64 `json:"num_by_reason"`
+
+	// AvgProcessingTime is the average processing time in seconds.  It's
+	// only sent with the API version 1.
+	//
+	// Deprecated: Use AvgProcessingTimeMs.
+	AvgProcessingTime *float64 `json:"avg_processing_time,omitempty"`
+
+	// AvgUpstreamTime is the part of AvgProcessingTime spent waiting for
+	// the upstream servers.  It's only sent with the API version 1.
+	//
+	// Deprecated: Use AvgUpstreamTimeMs.
+	AvgUpstreamTime *float64 `json:"avg_upstream_time,omitempty"`
+
+	// AvgProcessingTimeMs is the average processing time in milliseconds.
+	AvgProcessingTimeMs float64 `json:"avg_processing_time_ms"`
+
+	// AvgUpstreamTimeMs is the part of AvgProcessingTimeMs spent waiting for
+	// the upstream servers.
+	AvgUpstreamTimeMs float64 `json:"avg_upstream_time_ms"`
+
+	// procTime and upstreamTime are the average times the fields above are
+	// set from, see setTimes.
+	procTime     time.Duration
+	upstreamTime time.Duration
 
 	TopQueried []map[string]uint64 `json:"top_queried_domains"`
 	TopClients []map[string]uint64 `json:"top_clients"`
 	TopBlocked []map[string]uint64 `json:"top_blocked_domains"`
 
+	// ClientNames are the current names of the clients from TopClients by
+	// their identifiers.  The statistics only store the identifiers, and the
+	// names are resolved when the statistics are requested, so that
+	// renaming a client also applies to the past statistics.
+	ClientNames map[string]string `json:"client_names"`
+
 	DNSQueries []uint64 `json:"dns_queries"`
 
+	// IngressPools are the current state of the worker pools of the
+	// ingress protocols of the DNS server.
+	IngressPools []IngressPool `json:"ingress_pools"`
+
+	// ForwardingLoops is the number of the forwarding loops detected by the
+	// DNS server since the start.
+	ForwardingLoops uint64 `json:"forwarding_loops"`
+
+	// ResponseLimits are the numbers of the responses affected by the
+	// amplification protections since the start.
+	ResponseLimits ResponseLimits `json:"response_limits"`
+
+	// Fragmentation are the counters of the detection of the dropped
+	// fragmented UDP responses since the start.
+	Fragmentation Fragmentation `json:"fragmentation"`
+
+	// FilterCache are the counters of the cache of the filtering decisions
+	// since the start.
+	FilterCache FilterCache `json:"filter_cache"`
+
+	// BudgetExceeded are the numbers of the requests which have exceeded
+	// the time budget since the start.
+	BudgetExceeded BudgetExceeded `json:"budget_exceeded"`
+
+	// CacheRejections are the numbers of the responses of the upstream
+	// servers not cached since the start.
+	CacheRejections CacheRejections `json:"cache_rejections"`
+
 	BlockedFiltering     []uint64 `json:"blocked_filtering"`
 	ReplacedSafebrowsing []uint64 `json:"replaced_safebrowsing"`
 	ReplacedParental     []uint64 `json:"replaced_parental"`
+	AAAADisabled         []uint64 `json:"aaaa_disabled"`
 }
 
-// handleStats is a handler for getting statistics.
-func (s *statsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
+// The versions of the GET /control/stats HTTP API, which differ in the units
+// of the average times.
+const (
+	// apiVersionSeconds is the version, which sends the average times both
+	// in seconds and in milliseconds.  It's the default one during the
+	// deprecation of the fields in seconds.
+	apiVersionSeconds = 1
+
+	// apiVersionMs is the version, which only sends the average times in
+	// milliseconds.
+	apiVersionMs = 2
+
+	// apiVersionMax is the latest version.
+	apiVersionMax = apiVersionMs
+)
+
+// setTimes sets the average time fields of resp from resp.procTime and
+// resp.upstreamTime according to the API version v.
+func (resp *statsResponse) setTimes(v int64) {
+	resp.AvgProcessingTimeMs = durationMs(resp.procTime)
+	resp.AvgUpstreamTimeMs = durationMs(resp.upstreamTime)
+
+	resp.AvgProcessingTime, resp.AvgUpstreamTime = nil, nil
+	if v == apiVersionSeconds {
+		proc, upstream := resp.procTime.Seconds(), resp.upstreamTime.Seconds()
+		resp.AvgProcessingTime, resp.AvgUpstreamTime = &proc, &upstream
+	}
+}
+
+// durationMs returns d in milliseconds.
+func durationMs(d time.Duration) (ms float64) {
+	return float64(d) / float64(time.Millisecond)
+}
+
+// PublicStats are the reduced statistics, which may be shown without
+// authentication.  The fields are an explicit allowlist, so a field must only
+// be added here if it contains neither the client identifiers nor the data from
+// the query log.
+type PublicStats struct {
+	TimeUnits string `json:"time_units"`
+
+	TopBlocked []map[string]uint64 `json:"top_blocked_domains"`
+
+	NumDNSQueries           uint64 `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+
+	// AvgProcessingTime is the average processing time in seconds.
+	//
+	// Deprecated: Use AvgProcessingTimeMs.
+	AvgProcessingTime float64 `json:"avg_processing_time"`
+
+	// AvgProcessingTimeMs is the average processing time in milliseconds.
+	AvgProcessingTimeMs float64 `json:"avg_processing_time_ms"`
+}
+
+// newPublicStats returns the public part of resp.  The fields must be copied
+// one by one, see PublicStats.
+func newPublicStats(resp *statsResponse) (ps *PublicStats) {
+	return &PublicStats{
+		TimeUnits:               resp.TimeUnits,
+		TopBlocked:              resp.TopBlocked,
+		NumDNSQueries:           resp.NumDNSQueries,
+		NumBlockedFiltering:     resp.NumBlockedFiltering,
+		NumReplacedSafebrowsing: resp.NumReplacedSafebrowsing,
+		NumReplacedSafesearch:   resp.NumReplacedSafesearch,
+		NumReplacedParental:     resp.NumReplacedParental,
+		AvgProcessingTime:       resp.procTime.Seconds(),
+		AvgProcessingTimeMs:     durationMs(resp.procTime),
+	}
+}
+
+// PublicStats implements the Stats interface for *statsCtx.
+func (s *statsCtx) PublicStats() (ps *PublicStats, ok bool) {
+	resp, ok := s.getData()
+	if !ok {
+		return nil, false
+	}
+
+	return newPublicStats(&resp), true
+}
+
+// clientNames returns the current names of the clients from tops by their
+// identifiers.  The clients without names are skipped.
+func (s *statsCtx) clientNames(tops []map[string]uint64) (names map[string]string) {
+	names = map[string]string{}
+	if s.conf.ClientName == nil {
+		return names
+	}
+
+	for _, top := range tops {
+		for id := range top {
+			if name := s.conf.ClientName(id); name != "" {
+				names[id] = name
+			}
+		}
+	}
+
+	return names
+}
+
+// fullData returns the statistics with the names of the top clients and the
+// counters of the DNS server since the start.  It's shared by all versions of
+// the HTTP API.
+func (s *statsCtx) fullData() (resp statsResponse, ok bool) {
 	start := time.Now()
-	response, ok := s.getData()
+	resp, ok = s.getData()
 	log.Debug("Stats: prepared data in %v", time.Since(start))
 
+	if !ok {
+		return resp, false
+	}
+
+	resp.ClientNames = s.clientNames(resp.TopClients)
+
+	resp.IngressPools = []IngressPool{}
+	if s.conf.IngressPools != nil {
+		resp.IngressPools = s.conf.IngressPools()
+	}
+
+	if s.conf.ForwardingLoops != nil {
+		resp.ForwardingLoops = s.conf.ForwardingLoops()
+	}
+
+	if s.conf.ResponseLimits != nil {
+		resp.ResponseLimits = s.conf.ResponseLimits()
+	}
+
+	if s.conf.Fragmentation != nil {
+		resp.Fragmentation = s.conf.Fragmentation()
+	}
+
+	if s.conf.FilterCache != nil {
+		resp.FilterCache = s.conf.FilterCache()
+	}
+
+	if s.conf.BudgetExceeded != nil {
+		resp.BudgetExceeded = s.conf.BudgetExceeded()
+	}
+
+	if s.conf.CacheRejections != nil {
+		resp.CacheRejections = s.conf.CacheRejections()
+	}
+
+	return resp, true
+}
+
+// handleStats is a handler for getting statistics.  The optional api_version
+// parameter selects the units of the average times, see apiVersionSeconds.
+// The response is in CSV if the client prefers it, see aghhttp.ResponseFormat,
+// and the table parameter selects the table sent in CSV, see statsTable.
+func (s *statsCtx) handleStats(w http.ResponseWriter, r *http.Request) {
+	params := aghhttp.QueryParams(r.URL.Query())
+	v := params.Int("api_version", apiVersionSeconds, apiVersionSeconds, apiVersionMax)
+	format := aghhttp.ResponseFormat(r, params)
+	table := statsTable(params.Enum(
+		"table",
+		string(statsTableHistory),
+		string(statsTableHistory),
+		string(statsTableTopQueried),
+		string(statsTableTopBlocked),
+		string(statsTableTopClients),
+	))
+	err := params.Err()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	response, ok := s.fullData()
 	if !ok {
 		httpError(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
 
 		return
 	}
 
+	response.setTimes(v)
+
+	if format == aghhttp.FormatCSV {
+		err = writeStatsCSV(w, &response, table)
+		if err != nil {
+			log.Debug("Stats: writing csv: %s", err)
+		}
+
+		return
+	}
+
 	w.Header().Set("Content-Type", "application/json")
-	err := json.NewEncoder(w).Encode(response)
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+}
+
+// statsTable is the table of the statistics sent in CSV.
+type statsTable string
+
+// statsTable values.
+const (
+	// statsTableHistory is the table of the numbers of the requests per
+	// time unit.
+	statsTableHistory statsTable = "history"
+
+	// statsTableTopQueried, statsTableTopBlocked, and statsTableTopClients
+	// are the tables of the top domains and clients.
+	statsTableTopQueried statsTable = "top_queried_domains"
+	statsTableTopBlocked statsTable = "top_blocked_domains"
+	statsTableTopClients statsTable = "top_clients"
+)
+
+// writeStatsCSV writes the table of resp to w in CSV.
+func writeStatsCSV(w http.ResponseWriter, resp *statsResponse, table statsTable) (err error) {
+	switch table {
+	case statsTableTopQueried:
+		return writeTopCSV(w, "domain", resp.TopQueried, nil)
+	case statsTableTopBlocked:
+		return writeTopCSV(w, "domain", resp.TopBlocked, nil)
+	case statsTableTopClients:
+		return writeTopCSV(w, "client", resp.TopClients, resp.ClientNames)
+	}
+
+	cw, err := aghhttp.NewCSVWriter(
+		w,
+		"time_unit_start",
+		"dns_queries",
+		"blocked_filtering",
+		"replaced_safebrowsing",
+		"replaced_parental",
+		"aaaa_disabled",
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, start := range resp.TimeUnitStarts {
+		err = cw.Write(
+			start,
+			csvCounter(resp.DNSQueries, i),
+			csvCounter(resp.BlockedFiltering, i),
+			csvCounter(resp.ReplacedSafebrowsing, i),
+			csvCounter(resp.ReplacedParental, i),
+			csvCounter(resp.AAAADisabled, i),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return cw.Flush()
+}
+
+// writeTopCSV writes the top entries to w in CSV.  If names isn't nil, the
+// names of the entries are written as well.
+func writeTopCSV(w http.ResponseWriter, column string, top []map[string]uint64, names map[string]string) (err error) {
+	columns := []string{column, "count"}
+	if names != nil {
+		columns = []string{column, "name", "count"}
+	}
+
+	cw, err := aghhttp.NewCSVWriter(w, columns...)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range top {
+		for k, n := range m {
+			vals := []string{k, strconv.FormatUint(n, 10)}
+			if names != nil {
+				vals = []string{k, names[k], vals[1]}
+			}
+
+			err = cw.Write(vals...)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return cw.Flush()
+}
+
+// csvCounter returns the i-th counter of ns in CSV.
+func csvCounter(ns []uint64, i int) (s string) {
+	if i >= len(ns) {
+		return ""
+	}
+
+	return strconv.FormatUint(ns[i], 10)
+}
+
+// handleStatsCompare is the handler for the GET /control/stats_compare HTTP
+// API.
+func (s *statsCtx) handleStatsCompare(w http.ResponseWriter, r *http.Request) {
+	resp, ok := s.compare()
+	if !ok {
+		httpError(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
 		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
 
@@ -86,19 +448,32 @@ func (s *statsCtx) handleStatsInfo(w http.ResponseWriter, r *http.Request) {
 
 // Set configuration
 func (s *statsCtx) handleStatsConfig(w http.ResponseWriter, r *http.Request) {
-	reqData := config{}
-	err := json.NewDecoder(r.Body).Decode(&reqData)
+	params, err := aghhttp.JSONParams(r.Body)
 	if err != nil {
-		httpError(r, w, http.StatusBadRequest, "json decode: %s", err)
+		httpError(r, w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
-	if !checkInterval(reqData.IntervalDays) {
-		httpError(r, w, http.StatusBadRequest, "Unsupported interval")
+	var ivl uint64
+	params.Required("interval")
+	params.Value("interval", "one of 1, 7, 30, 90", func(s string) (perr error) {
+		ivl, perr = strconv.ParseUint(s, 10, 32)
+		if perr != nil {
+			return perr
+		} else if !checkInterval(uint32(ivl)) {
+			return strconv.ErrRange
+		}
+
+		return nil
+	})
+
+	err = params.Err()
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
 		return
 	}
 
-	s.setLimit(int(reqData.IntervalDays))
+	s.setLimit(int(ivl))
 	s.conf.ConfigModified()
 }
 
@@ -107,6 +482,100 @@ func (s *statsCtx) handleStatsReset(w http.ResponseWriter, r *http.Request) {
 	s.clear()
 }
 
+// alertsResp is the response to the GET /control/stats_alerts request.
+type alertsResp struct {
+	Alerts []alertJSON `json:"alerts"`
+}
+
+// handleStatsAlerts is the handler for the GET /control/stats_alerts HTTP API.
+func (s *statsCtx) handleStatsAlerts(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(alertsResp{
+		Alerts: s.alerts.list(),
+	})
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(data)
+}
+
+// handleStatsAlertsAdd is the handler for the POST /control/stats_alerts/add
+// HTTP API.
+func (s *statsCtx) handleStatsAlertsAdd(w http.ResponseWriter, r *http.Request) {
+	rule := AlertRule{}
+	err := json.NewDecoder(r.Body).Decode(&rule)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = s.alerts.add(rule)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	s.conf.ConfigModified()
+}
+
+// alertUpdateReq is the request for updating an alert rule.
+type alertUpdateReq struct {
+	Name string    `json:"name"`
+	Data AlertRule `json:"data"`
+}
+
+// handleStatsAlertsUpdate is the handler for the POST
+// /control/stats_alerts/update HTTP API.
+func (s *statsCtx) handleStatsAlertsUpdate(w http.ResponseWriter, r *http.Request) {
+	req := alertUpdateReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = s.alerts.update(req.Name, req.Data)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	s.conf.ConfigModified()
+}
+
+// alertDeleteReq is the request for deleting an alert rule.
+type alertDeleteReq struct {
+	Name string `json:"name"`
+}
+
+// handleStatsAlertsDelete is the handler for the POST
+// /control/stats_alerts/delete HTTP API.
+func (s *statsCtx) handleStatsAlertsDelete(w http.ResponseWriter, r *http.Request) {
+	req := alertDeleteReq{}
+	err := json.NewDecoder(r.Body).Decode(&req)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "json decode: %s", err)
+
+		return
+	}
+
+	err = s.alerts.remove(req.Name)
+	if err != nil {
+		httpError(r, w, http.StatusBadRequest, "%s", err)
+
+		return
+	}
+
+	s.conf.ConfigModified()
+}
+
 // Register web handlers
 func (s *statsCtx) initWeb() {
 	if s.conf.HTTPRegister == nil {
@@ -114,7 +583,16 @@ func (s *statsCtx) initWeb() {
 	}
 
 	s.conf.HTTPRegister(http.MethodGet, "/control/stats", s.handleStats)
+	s.conf.HTTPRegister(http.MethodGet, "/control/v2/stats", s.handleStatsV2)
 	s.conf.HTTPRegister(http.MethodPost, "/control/stats_reset", s.handleStatsReset)
 	s.conf.HTTPRegister(http.MethodPost, "/control/stats_config", s.handleStatsConfig)
 	s.conf.HTTPRegister(http.MethodGet, "/control/stats_info", s.handleStatsInfo)
+	s.conf.HTTPRegister(http.MethodGet, "/control/stats_compare", s.handleStatsCompare)
+	s.conf.HTTPRegister(http.MethodGet, "/control/stats_alerts", s.handleStatsAlerts)
+	s.conf.HTTPRegister(http.MethodPost, "/control/stats_alerts/add", s.handleStatsAlertsAdd)
+	s.conf.HTTPRegister(http.MethodPost, "/control/stats_alerts/update", s.handleStatsAlertsUpdate)
+	s.conf.HTTPRegister(http.MethodPost, "/control/stats_alerts/delete", s.handleStatsAlertsDelete)
+	s.conf.HTTPRegister(http.MethodGet, "/control/stats_annotations", s.handleStatsAnnotations)
+	s.conf.HTTPRegister(http.MethodGet, "/control/grafana", s.handleGrafanaTest)
+	s.conf.HTTPRegister(http.MethodPost, "/control/grafana/annotations", s.handleGrafanaAnnotations)
 }
@@ -0,0 +1,140 @@
+package stats
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
+)
+
+// topEntryV2 is an entry of a top list of domains in the v2 HTTP API.
+type topEntryV2 struct {
+	Name  string `json:"name"`
+	Count uint64 `json:"count"`
+}
+
+// topClientV2 is an entry of the top list of clients in the v2 HTTP API.
+type topClientV2 struct {
+	// ID is the identifier of the client, usually its IP address.
+	ID string `json:"id"`
+
+	// Name is the current name of the client.  It's empty if the client
+	// has none.
+	Name  string `json:"name,omitempty"`
+	Count uint64 `json:"count"`
+}
+
+// statsResponseV2 is the response to the GET /control/v2/stats request.
+// Unlike statsResponse, the top lists are the ordered arrays of objects
+// instead of the arrays of single-key maps, the names of the top clients are
+// within the entries, and the average times are only sent in milliseconds.
+type statsResponseV2 struct {
+	// TimeUnits is either "hours" or "days".
+	TimeUnits string `json:"time_units"`
+
+	// TimeUnitStarts are the starts of the time units of the per time unit
+	// counters in RFC 3339 format.
+	TimeUnitStarts []string `json:"time_unit_starts"`
+
+	NumByReason map[dnsfilter.ReasonCode]uint64 `json:"num_by_reason"`
+
+	TopQueried []topEntryV2  `json:"top_queried_domains"`
+	TopClients []topClientV2 `json:"top_clients"`
+	TopBlocked []topEntryV2  `json:"top_blocked_domains"`
+
+	DNSQueries           []uint64 `json:"dns_queries"`
+	BlockedFiltering     []uint64 `json:"blocked_filtering"`
+	ReplacedSafebrowsing []uint64 `json:"replaced_safebrowsing"`
+	ReplacedParental     []uint64 `json:"replaced_parental"`
+	AAAADisabled         []uint64 `json:"aaaa_disabled"`
+
+	IngressPools    []IngressPool   `json:"ingress_pools"`
+	ResponseLimits  ResponseLimits  `json:"response_limits"`
+	Fragmentation   Fragmentation   `json:"fragmentation"`
+	FilterCache     FilterCache     `json:"filter_cache"`
+	BudgetExceeded  BudgetExceeded  `json:"budget_exceeded"`
+	CacheRejections CacheRejections `json:"cache_rejections"`
+
+	NumDNSQueries           uint64 `json:"num_dns_queries"`
+	NumBlockedFiltering     uint64 `json:"num_blocked_filtering"`
+	NumReplacedSafebrowsing uint64 `json:"num_replaced_safebrowsing"`
+	NumReplacedSafesearch   uint64 `json:"num_replaced_safesearch"`
+	NumReplacedParental     uint64 `json:"num_replaced_parental"`
+	NumAAAADisabled         uint64 `json:"num_aaaa_disabled"`
+	ForwardingLoops         uint64 `json:"forwarding_loops"`
+
+	AvgProcessingTimeMs float64 `json:"avg_processing_time_ms"`
+	AvgUpstreamTimeMs   float64 `json:"avg_upstream_time_ms"`
+}
+
+// topToV2 converts the top list from statsResponse into the v2 one.
+func topToV2(top []map[string]uint64) (entries []topEntryV2) {
+	entries = make([]topEntryV2, 0, len(top))
+	for _, m := range top {
+		for name, n := range m {
+			entries = append(entries, topEntryV2{
+				Name:  name,
+				Count: n,
+			})
+		}
+	}
+
+	return entries
+}
+
+// newStatsResponseV2 returns the v2 response with the data of resp.
+func newStatsResponseV2(resp *statsResponse) (v2 *statsResponseV2) {
+	clients := make([]topClientV2, 0, len(resp.TopClients))
+	for _, e := range topToV2(resp.TopClients) {
+		clients = append(clients, topClientV2{
+			ID:    e.Name,
+			Name:  resp.ClientNames[e.Name],
+			Count: e.Count,
+		})
+	}
+
+	return &statsResponseV2{
+		TimeUnits:               resp.TimeUnits,
+		TimeUnitStarts:          resp.TimeUnitStarts,
+		NumByReason:             resp.NumByReason,
+		TopQueried:              topToV2(resp.TopQueried),
+		TopClients:              clients,
+		TopBlocked:              topToV2(resp.TopBlocked),
+		DNSQueries:              resp.DNSQueries,
+		BlockedFiltering:        resp.BlockedFiltering,
+		ReplacedSafebrowsing:    resp.ReplacedSafebrowsing,
+		ReplacedParental:        resp.ReplacedParental,
+		AAAADisabled:            resp.AAAADisabled,
+		IngressPools:            resp.IngressPools,
+		ResponseLimits:          resp.ResponseLimits,
+		Fragmentation:           resp.Fragmentation,
+		FilterCache:             resp.FilterCache,
+		BudgetExceeded:          resp.BudgetExceeded,
+		CacheRejections:         resp.CacheRejections,
+		NumDNSQueries:           resp.NumDNSQueries,
+		NumBlockedFiltering:     resp.NumBlockedFiltering,
+		NumReplacedSafebrowsing: resp.NumReplacedSafebrowsing,
+		NumReplacedSafesearch:   resp.NumReplacedSafesearch,
+		NumReplacedParental:     resp.NumReplacedParental,
+		NumAAAADisabled:         resp.NumAAAADisabled,
+		ForwardingLoops:         resp.ForwardingLoops,
+		AvgProcessingTimeMs:     durationMs(resp.procTime),
+		AvgUpstreamTimeMs:       durationMs(resp.upstreamTime),
+	}
+}
+
+// handleStatsV2 is the handler for the GET /control/v2/stats HTTP API.
+func (s *statsCtx) handleStatsV2(w http.ResponseWriter, r *http.Request) {
+	resp, ok := s.fullData()
+	if !ok {
+		httpError(r, w, http.StatusInternalServerError, "Couldn't get statistics data")
+
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(newStatsResponseV2(&resp))
+	if err != nil {
+		httpError(r, w, http.StatusInternalServerError, "json encode: %s", err)
+	}
+}
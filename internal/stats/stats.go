@@ -5,6 +5,10 @@ package stats
 import (
 	"net"
 	"net/http"
+
+	"github.com/AdguardTeam/AdGuardHome/internal/aghmem"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 )
 
 type unitIDCallback func() uint32
@@ -12,6 +16,9 @@ type unitIDCallback func() uint32
 // DiskConfig - configuration settings that are stored on disk
 type DiskConfig struct {
 	Interval uint32 `yaml:"statistics_interval"` // time interval for statistics (in days)
+
+	// Alerts are the alert rules.
+	Alerts []AlertRule `yaml:"statistics_alerts"`
 }
 
 // Config - module configuration
@@ -27,9 +34,181 @@ type Config struct {
 	// Register an HTTP handler
 	HTTPRegister func(string, string, func(http.ResponseWriter, *http.Request))
 
+	// HTTPClient is used to send the alert notifications to the webhooks.
+	// If nil, http.DefaultClient is used.
+	HTTPClient *http.Client
+
+	// Alerts are the alert rules.  The invalid ones are skipped.
+	Alerts []AlertRule
+
+	// IngressPools returns the current state of the worker pools of the
+	// ingress protocols of the DNS server.  It may be nil.
+	IngressPools func() (ps []IngressPool)
+
+	// ForwardingLoops returns the number of the forwarding loops detected by
+	// the DNS server since the start.  It may be nil.
+	ForwardingLoops func() (n uint64)
+
+	// ResponseLimits returns the numbers of the responses affected by the
+	// amplification protections of the DNS server since the start.  It
+	// may be nil.
+	ResponseLimits func() (rl ResponseLimits)
+
+	// Fragmentation returns the counters of the detection of the dropped
+	// fragmented UDP responses of the DNS server since the start.  It may
+	// be nil.
+	Fragmentation func() (f Fragmentation)
+
+	// FilterCache returns the counters of the cache of the filtering
+	// decisions.  It may be nil.
+	FilterCache func() (fc FilterCache)
+
+	// BudgetExceeded returns the numbers of the requests of the DNS server
+	// which have exceeded the time budget since the start.  It may be nil.
+	BudgetExceeded func() (be BudgetExceeded)
+
+	// CacheRejections returns the numbers of the responses of the upstream
+	// servers not cached by the DNS server since the start.  It may be nil.
+	CacheRejections func() (cr CacheRejections)
+
+	// ClientName returns the current name of the client with the identifier
+	// id or an empty string if the client has no name.  It may be nil.
+	ClientName func(id string) (name string)
+
+	// WriteGuard tracks the writes of the database, so that the units are
+	// kept in memory while the file system is read-only.  It may be nil.
+	WriteGuard *aghos.WriteGuard
+
+	// TopLimit is the maximum number of the distinct domains and clients
+	// tracked for each of the top lists of the current hour.  The rarest
+	// ones are pruned once there are more.  If it's less than minTopLimit,
+	// minTopLimit is used.  Zero means defaultTopLimit.
+	TopLimit int
+
 	limit uint32 // maximum time we need to keep data for (in hours)
 }
 
+// ResponseLimits are the numbers of the responses affected by the
+// amplification protections of the DNS server.
+type ResponseLimits struct {
+	// TruncatedForced is the number of the UDP responses truncated because
+	// they were larger than the limit.
+	TruncatedForced uint64 `json:"truncated_forced"`
+
+	// BytesLimited is the number of the UDP responses truncated because of
+	// the response bytes rate limit.
+	BytesLimited uint64 `json:"bytes_limited"`
+
+	// Tarpitted is the number of the blocked responses delayed because the
+	// client has repeated the blocked request too often.
+	Tarpitted uint64 `json:"tarpitted"`
+}
+
+// Fragmentation are the counters of the detection of the dropped fragmented
+// UDP responses of the DNS server.
+type Fragmentation struct {
+	// LargeResponses is the number of the UDP responses larger than the
+	// fragmentation-safe size.
+	LargeResponses uint64 `json:"large_responses"`
+
+	// ProbableDrops is the number of the large UDP responses followed by the
+	// same query over TCP shortly after.
+	ProbableDrops uint64 `json:"probable_drops"`
+
+	// Truncated is the number of the UDP responses truncated to the lower
+	// buffer size.
+	Truncated uint64 `json:"truncated"`
+}
+
+// FilterCache are the counters of the cache of the decisions of the filtering
+// rules.
+type FilterCache struct {
+	// Hits is the number of the requests decided from the cache since the
+	// start.
+	Hits uint64 `json:"hits"`
+
+	// Misses is the number of the requests matched against the rules since
+	// the start.
+	Misses uint64 `json:"misses"`
+
+	// HitRate is the share of Hits among all the lookups, from 0 to 1.
+	HitRate float64 `json:"hit_rate"`
+
+	// Size is the current number of the cached decisions.
+	Size int `json:"size"`
+
+	// Limit is the maximum number of the cached decisions.  Zero means that
+	// the cache is disabled.
+	Limit int `json:"limit"`
+}
+
+// BudgetExceeded are the numbers of the requests answered with SERVFAIL because
+// their processing has exceeded the time budget, by the stage of the
+// processing at which it has been exceeded.
+type BudgetExceeded struct {
+	// Request is the number of the requests which have exceeded the budget
+	// during the checks preceding the filtering.
+	Request uint64 `json:"request"`
+
+	// Filtering is the number of the requests which have exceeded the
+	// budget during the filtering of the request.
+	Filtering uint64 `json:"filtering"`
+
+	// Local is the number of the requests which have exceeded the budget
+	// during the resolving of the local names and addresses.
+	Local uint64 `json:"local"`
+
+	// Upstream is the number of the requests which have exceeded the
+	// budget during the exchange with the upstream servers.
+	Upstream uint64 `json:"upstream"`
+
+	// Response is the number of the requests which have exceeded the
+	// budget during the processing of the response.
+	Response uint64 `json:"response"`
+}
+
+// CacheRejections are the numbers of the responses of the upstream servers
+// which have been sent to the clients but not cached, by the reason.
+type CacheRejections struct {
+	// TooManyRecords is the number of the responses with more resource
+	// records than the cache allows.
+	TooManyRecords uint64 `json:"too_many_records"`
+
+	// TooLarge is the number of the responses larger than the cache allows.
+	TooLarge uint64 `json:"too_large"`
+
+	// OwnerMismatch is the number of the responses with the answer records
+	// for the names other than the one from the question and its aliases.
+	OwnerMismatch uint64 `json:"owner_mismatch"`
+}
+
+// IngressPool is the state of the worker pool of an ingress protocol of the DNS
+// server.
+type IngressPool struct {
+	// Proto is the name of the protocol.
+	Proto string `json:"proto"`
+
+	// QueueDepth is the number of the requests waiting for a worker.
+	QueueDepth int64 `json:"queue_depth"`
+
+	// QueueLimit is the maximum number of the requests waiting for a
+	// worker.
+	QueueLimit int64 `json:"queue_limit"`
+
+	// Processed is the number of the requests processed since the start.
+	Processed uint64 `json:"processed"`
+
+	// Dropped is the number of the requests dropped since the start.
+	Dropped uint64 `json:"dropped"`
+
+	// Workers is the maximum number of the requests processed
+	// simultaneously.
+	Workers int `json:"workers"`
+
+	// Busy is the number of the requests being processed.
+	Busy int `json:"busy"`
+}
+
 // New - create object
 func New(conf Config) (Stats, error) {
 	return createObject(conf)
@@ -37,6 +216,8 @@ func New(conf Config) (Stats, error) {
 
 // Stats - main interface
 type Stats interface {
+	aghmem.Consumer
+
 	Start()
 
 	// Close object.
@@ -44,12 +225,47 @@ type Stats interface {
 	//  (can't be called in parallel with any other function of this interface).
 	Close()
 
+	// Suspend writes the current statistics and closes the database, so
+	// that another process can open it.  The statistics are only kept in
+	// memory until Resume reopens the database.
+	Suspend()
+
+	// Resume reopens the database closed by Suspend.
+	Resume() (err error)
+
 	// Update counters
 	Update(e Entry)
 
+	// FoldClients moves the counts of the requests of the clients with ids
+	// into the aggregate named ExpiredClients, so that the totals are kept
+	// once the clients are gone.
+	FoldClients(ids []string)
+
 	// Get IP addresses of the clients with the most number of requests
 	GetTopClientsIP(limit uint) []net.IP
 
+	// GetTopDomains returns at most limit domains with the most number of
+	// requests.
+	GetTopDomains(limit uint) (domains []string)
+
+	// AlertWarnings returns the descriptions of the firing alerts.
+	AlertWarnings() (warns []string)
+
+	// PublicStats returns the reduced statistics, which may be shown
+	// without authentication.  ok is false if the statistics can't be
+	// read.
+	PublicStats() (ps *PublicStats, ok bool)
+
+	// Summary returns the brief statistics of the current day without
+	// aggregating all the kept ones.  ok is false if the statistics can't
+	// be read.
+	Summary() (sum *Summary, ok bool)
+
+	// Annotate stores an annotation of kind with the description text made
+	// at the current time.  The annotations are kept as long as the
+	// statistics.
+	Annotate(kind AnnotationKind, text string)
+
 	// WriteDiskConfig - write configuration
 	WriteDiskConfig(dc *DiskConfig)
 }
@@ -73,6 +289,9 @@ const (
 	RSafeBrowsing
 	RSafeSearch
 	RParental
+	// RAAAADisabled is the result for AAAA requests answered with an empty
+	// response because resolving IPv6 addresses is disabled.
+	RAAAADisabled
 	rLast
 )
 
@@ -85,5 +304,13 @@ type Entry struct {
 
 	Domain string
 	Result Result
-	Time   uint32 // processing time (msec)
+	Time   uint32 // processing time (usec)
+
+	// Reason is the filtering reason of the request.  Unlike Result, it
+	// isn't aggregated, so the requests are also counted per reason code.
+	Reason dnsfilter.Reason
+
+	// UpstreamTime is the part of Time spent waiting for the upstream
+	// servers, in the same units.
+	UpstreamTime uint32
 }
@@ -1,15 +1,27 @@
 package stats
 
 import (
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/AdguardTeam/AdGuardHome/internal/aghos"
 	"github.com/AdguardTeam/AdGuardHome/internal/aghtest"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 func TestMain(m *testing.M) {
@@ -49,12 +61,15 @@ func TestStats(t *testing.T) {
 		Client: "127.0.0.1",
 		Result: RFiltered,
 		Time:   123456,
+		Reason: dnsfilter.FilteredBlockList,
 	})
 	s.Update(Entry{
 		Domain: "domain",
 		Client: "127.0.0.1",
 		Result: RNotFiltered,
 		Time:   123456,
+
+		UpstreamTime: 100000,
 	})
 
 	d, ok := s.getData()
@@ -89,11 +104,295 @@ func TestStats(t *testing.T) {
 	assert.EqualValues(t, 0, d.NumReplacedSafebrowsing)
 	assert.EqualValues(t, 0, d.NumReplacedSafesearch)
 	assert.EqualValues(t, 0, d.NumReplacedParental)
-	assert.EqualValues(t, 0.123456, d.AvgProcessingTime)
+	assert.EqualValues(t, 0, d.NumAAAADisabled)
+	assert.Equal(t, map[dnsfilter.ReasonCode]uint64{
+		"blocklist":    1,
+		"not_filtered": 1,
+	}, d.NumByReason)
+	require.NotNil(t, d.AvgProcessingTime)
+	assert.EqualValues(t, 0.123456, *d.AvgProcessingTime)
+	assert.EqualValues(t, 123.456, d.AvgProcessingTimeMs)
+	require.NotNil(t, d.AvgUpstreamTime)
+	assert.EqualValues(t, 0.05, *d.AvgUpstreamTime)
+	assert.EqualValues(t, 50, d.AvgUpstreamTimeMs)
 
 	topClients := s.GetTopClientsIP(2)
 	require.NotEmpty(t, topClients)
 	assert.True(t, net.IP{127, 0, 0, 1}.Equal(topClients[0]))
+
+	assert.Equal(t, []string{"domain"}, s.GetTopDomains(2))
+}
+
+func TestStatsCtx_handleStats_clientNames(t *testing.T) {
+	names := map[string]string{"192.168.1.47": "Old name"}
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		ClientName: func(id string) (name string) {
+			return names[id]
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	for _, c := range []string{"192.168.1.47", "192.168.1.48"} {
+		s.Update(Entry{
+			Domain: "example.org",
+			Client: c,
+			Result: RNotFiltered,
+		})
+	}
+
+	get := func(t *testing.T) (resp *statsResponse) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = &statsResponse{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(resp))
+
+		return resp
+	}
+
+	assert.Equal(t, map[string]string{"192.168.1.47": "Old name"}, get(t).ClientNames)
+
+	// The rename applies to the already collected statistics.
+	names["192.168.1.47"] = "Thermostat"
+	resp := get(t)
+	assert.Equal(t, map[string]string{"192.168.1.47": "Thermostat"}, resp.ClientNames)
+	assert.Len(t, resp.TopClients, 2)
+}
+
+func TestStatsCtx_handleStats_csv(t *testing.T) {
+	s, err := createObject(Config{
+		Filename:   filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays:  1,
+		UnitID:     func() uint32 { return 1 },
+		ClientName: func(id string) (name string) { return "Name, with comma" },
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	s.Update(Entry{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RFiltered,
+	})
+
+	get := func(t *testing.T, accept, query string) (w *httptest.ResponseRecorder) {
+		t.Helper()
+
+		r := httptest.NewRequest(http.MethodGet, "/control/stats"+query, nil)
+		r.Header.Set("Accept", accept)
+
+		w = httptest.NewRecorder()
+		s.handleStats(w, r)
+
+		return w
+	}
+
+	t.Run("history", func(t *testing.T) {
+		w := get(t, "text/csv", "")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", w.Header().Get("Content-Type"))
+
+		rows, rerr := csv.NewReader(w.Body).ReadAll()
+		require.NoError(t, rerr)
+		require.Len(t, rows, 25)
+
+		assert.Equal(t, []string{
+			"time_unit_start",
+			"dns_queries",
+			"blocked_filtering",
+			"replaced_safebrowsing",
+			"replaced_parental",
+			"aaaa_disabled",
+		}, rows[0])
+		assert.Equal(t, []string{"1", "1", "0", "0", "0"}, rows[24][1:])
+	})
+
+	t.Run("top_clients", func(t *testing.T) {
+		w := get(t, "text/csv", "?table=top_clients")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "client,name,count\n1.2.3.4,\"Name, with comma\",1\n", w.Body.String())
+	})
+
+	t.Run("top_blocked_domains", func(t *testing.T) {
+		w := get(t, "application/json", "?format=csv&table=top_blocked_domains")
+		require.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "domain,count\nexample.org,1\n", w.Body.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		for _, accept := range []string{"", "application/xml", "text/csv;q=0.5, */*"} {
+			w := get(t, accept, "")
+			require.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+		}
+	})
+
+	t.Run("bad_table", func(t *testing.T) {
+		w := get(t, "text/csv", "?table=unknown")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
+}
+
+// TestStatsCtx_handleStats_golden pins the responses of the versions of the
+// HTTP API, so that the v1 ones don't change.  The v1 API is served by the
+// unversioned handler.
+func TestStatsCtx_handleStats_golden(t *testing.T) {
+	prevLoc := aghtime.Location()
+	aghtime.SetLocation(time.UTC)
+	t.Cleanup(func() { aghtime.SetLocation(prevLoc) })
+
+	// 2021-05-01 00:00:00 UTC.
+	const hour = 451176
+
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() uint32 { return hour },
+		ClientName: func(id string) (name string) {
+			if id == "192.168.1.2" {
+				return "Laptop"
+			}
+
+			return ""
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	for _, e := range []Entry{{
+		Domain:       "example.org",
+		Client:       "192.168.1.2",
+		Result:       RNotFiltered,
+		Time:         2000,
+		UpstreamTime: 1000,
+	}, {
+		Domain: "example.org",
+		Client: "192.168.1.2",
+		Result: RNotFiltered,
+		Time:   4000,
+	}, {
+		Domain: "ads.example",
+		Client: "192.168.1.3",
+		Result: RFiltered,
+		Reason: dnsfilter.FilteredBlockList,
+		Time:   1000,
+	}} {
+		s.Update(e)
+	}
+
+	goldens := map[string]json.RawMessage{}
+	data, err := ioutil.ReadFile(filepath.Join("testdata", t.Name()+".json"))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(data, &goldens))
+
+	testCases := []struct {
+		handler http.HandlerFunc
+		name    string
+		query   string
+	}{{
+		handler: s.handleStats,
+		name:    "v1",
+		query:   "",
+	}, {
+		handler: s.handleStats,
+		name:    "v1_api_version_2",
+		query:   "?api_version=2",
+	}, {
+		handler: s.handleStatsV2,
+		name:    "v2",
+		query:   "",
+	}}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			want, ok := goldens[tc.name]
+			require.True(t, ok)
+
+			w := httptest.NewRecorder()
+			tc.handler(w, httptest.NewRequest(http.MethodGet, "/control/stats"+tc.query, nil))
+			require.Equal(t, http.StatusOK, w.Code)
+
+			assert.JSONEq(t, string(want), w.Body.String())
+		})
+	}
+}
+
+func TestStatsCtx_handleStats_times(t *testing.T) {
+	var hour uint32 = 1
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() uint32 { return atomic.LoadUint32(&hour) },
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	get := func(t *testing.T, query string) (resp map[string]interface{}) {
+		t.Helper()
+
+		w := httptest.NewRecorder()
+		s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats"+query, nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp = map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+
+		return resp
+	}
+
+	for _, tm := range []uint32{1000, 3000} {
+		s.Update(Entry{
+			Domain:       "example.org",
+			Client:       "1.2.3.4",
+			Result:       RNotFiltered,
+			Time:         tm,
+			UpstreamTime: tm / 2,
+		})
+	}
+
+	// The requests are in the current unit.
+	cur := get(t, "")
+	assert.Equal(t, 0.002, cur["avg_processing_time"])
+	assert.Equal(t, 2.0, cur["avg_processing_time_ms"])
+	assert.Equal(t, 0.001, cur["avg_upstream_time"])
+	assert.Equal(t, 1.0, cur["avg_upstream_time_ms"])
+
+	// The same requests are read from the database.
+	atomic.StoreUint32(&hour, 2)
+	s.rotateUnit(2, time.Now())
+	require.Empty(t, s.pendingUnits())
+
+	flushed := get(t, "")
+	assert.Equal(t, cur["avg_processing_time"], flushed["avg_processing_time"])
+	assert.Equal(t, cur["avg_processing_time_ms"], flushed["avg_processing_time_ms"])
+	assert.Equal(t, cur["avg_upstream_time"], flushed["avg_upstream_time"])
+	assert.Equal(t, cur["avg_upstream_time_ms"], flushed["avg_upstream_time_ms"])
+
+	// A request in the current unit doesn't outweigh the previous ones.
+	s.Update(Entry{
+		Domain: "example.org",
+		Client: "1.2.3.4",
+		Result: RNotFiltered,
+		Time:   5000,
+	})
+	assert.Equal(t, 3.0, get(t, "")["avg_processing_time_ms"])
+
+	t.Run("api_version", func(t *testing.T) {
+		resp := get(t, "?api_version=2")
+		assert.Equal(t, 3.0, resp["avg_processing_time_ms"])
+		assert.NotContains(t, resp, "avg_processing_time")
+		assert.NotContains(t, resp, "avg_upstream_time")
+
+		w := httptest.NewRecorder()
+		s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats?api_version=3", nil))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+	})
 }
 
 func TestLargeNumbers(t *testing.T) {
@@ -158,3 +457,208 @@ func TestStatsCollector(t *testing.T) {
 		}
 	})
 }
+
+func TestTimeBuckets(t *testing.T) {
+	// The day begins at 22:00 UTC of the previous day in UTC+2.
+	loc := time.FixedZone("", 2*60*60)
+	setTestLocation(t, loc)
+
+	bs := timeBuckets(3*unitsPerDay, testMonday, Days)
+	require.Len(t, bs, 3)
+
+	testCases := []struct {
+		wantStart time.Time
+		wantFirst int
+		wantEnd   int
+	}{{
+		wantStart: time.Date(2021, 5, 4, 0, 0, 0, 0, loc),
+		wantFirst: 22,
+		wantEnd:   46,
+	}, {
+		wantStart: time.Date(2021, 5, 5, 0, 0, 0, 0, loc),
+		wantFirst: 46,
+		wantEnd:   70,
+	}, {
+		wantStart: time.Date(2021, 5, 6, 0, 0, 0, 0, loc),
+		wantFirst: 70,
+		wantEnd:   72,
+	}}
+
+	for i, tc := range testCases {
+		b := bs[i]
+		assert.True(t, tc.wantStart.Equal(b.start), "%d: got start %s", i, b.start)
+		assert.Equal(t, tc.wantFirst, b.first, i)
+		assert.Equal(t, tc.wantEnd, b.end, i)
+	}
+
+	bs = timeBuckets(2, testMonday, Hours)
+	require.Len(t, bs, 2)
+	assert.True(t, unitTime(testMonday+1).Equal(bs[1].start))
+	assert.Equal(t, 1, bs[1].first)
+}
+
+func TestStatsCtx_readOnly(t *testing.T) {
+	var hour uint32 = 1
+	conf := Config{
+		Filename:   filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays:  1,
+		UnitID:     func() uint32 { return atomic.LoadUint32(&hour) },
+		WriteGuard: aghos.NewWriteGuard("stats", nil),
+	}
+	s, err := createObject(conf)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	commit := s.commit
+	s.commit = func(tx *bolt.Tx) (err error) {
+		_ = tx.Rollback()
+
+		return fmt.Errorf("committing: %w", syscall.EROFS)
+	}
+
+	now := time.Now()
+	update := func() {
+		s.Update(Entry{
+			Domain: "example.org",
+			Client: "1.2.3.4",
+			Result: RNotFiltered,
+			Time:   123,
+		})
+	}
+
+	update()
+	atomic.StoreUint32(&hour, 2)
+	s.rotateUnit(2, now)
+	assert.True(t, conf.WriteGuard.MemoryOnly())
+
+	update()
+	atomic.StoreUint32(&hour, 3)
+	s.rotateUnit(3, now.Add(time.Second))
+
+	// The units are served from memory.
+	d, ok := s.getData()
+	require.True(t, ok)
+	assert.EqualValues(t, 2, d.NumDNSQueries)
+	assert.Len(t, s.pendingUnits(), 2)
+
+	s.commit = commit
+	update()
+	atomic.StoreUint32(&hour, 4)
+
+	// The writes are only retried once in the interval.
+	s.rotateUnit(4, now.Add(2*time.Second))
+	assert.True(t, conf.WriteGuard.MemoryOnly())
+
+	s.rotateUnit(4, now.Add(aghos.ReadOnlyRetryIvl+time.Second))
+	assert.False(t, conf.WriteGuard.MemoryOnly())
+	assert.Empty(t, s.pendingUnits())
+
+	d, ok = s.getData()
+	require.True(t, ok)
+	assert.EqualValues(t, 3, d.NumDNSQueries)
+}
+
+func TestStatsCtx_handleStats_rotation(t *testing.T) {
+	var hour uint32 = 1
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() uint32 { return atomic.LoadUint32(&hour) },
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	const rotations = 2000
+
+	// Each unit gets exactly one request before it's rotated.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		for i := 0; i < rotations; i++ {
+			s.Update(Entry{
+				Domain: "example.org",
+				Client: "1.2.3.4",
+				Result: RNotFiltered,
+				Time:   123,
+			})
+
+			s.rotateUnit(atomic.AddUint32(&hour, 1), time.Now())
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+
+		w := httptest.NewRecorder()
+		s.handleStats(w, httptest.NewRequest(http.MethodGet, "/control/stats", nil))
+		require.Equal(t, http.StatusOK, w.Code)
+
+		resp := struct {
+			DNSQueries []uint64 `json:"dns_queries"`
+		}{}
+		require.NoError(t, json.NewDecoder(w.Body).Decode(&resp))
+		require.NotEmpty(t, resp.DNSQueries)
+
+		// The units before the first one are empty, and the current unit
+		// may not have got its request yet.  All the others must have
+		// exactly one.
+		last := len(resp.DNSQueries) - 1
+		seen := false
+		for i, n := range resp.DNSQueries[:last] {
+			require.LessOrEqualf(t, n, uint64(1), "interval %d of %v", i, resp.DNSQueries)
+
+			if n == 1 {
+				seen = true
+			} else {
+				require.Falsef(t, seen, "interval %d of %v", i, resp.DNSQueries)
+			}
+		}
+
+		require.LessOrEqual(t, resp.DNSQueries[last], uint64(1))
+	}
+}
+
+func TestStatsCtx_Suspend(t *testing.T) {
+	conf := Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+		UnitID:    func() uint32 { return 100 },
+	}
+	s, err := createObject(conf)
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	update := func(s *statsCtx) {
+		s.Update(Entry{
+			Domain: "example.org",
+			Client: "1.2.3.4",
+			Result: RNotFiltered,
+			Time:   123,
+		})
+	}
+
+	update(s)
+	s.Suspend()
+
+	// Another process opens the database with the current unit.
+	other, err := createObject(conf)
+	require.NoError(t, err)
+
+	d, ok := other.getData()
+	require.True(t, ok)
+	assert.EqualValues(t, 1, d.NumDNSQueries)
+
+	other.Close()
+
+	require.NoError(t, s.Resume())
+	update(s)
+
+	d, ok = s.getData()
+	require.True(t, ok)
+	assert.EqualValues(t, 2, d.NumDNSQueries)
+}
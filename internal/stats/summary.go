@@ -0,0 +1,56 @@
+package stats
+
+// summaryHours is the number of the last hours, the requests within each of
+// which are counted in the summary.
+const summaryHours = 24
+
+// summaryUnits is the number of the units loaded for the summary.  It covers
+// both the last summaryHours hours and the current day, which is 25 hours long
+// when the clocks are turned back.
+const summaryUnits = summaryHours + 1
+
+// Summary is the brief statistics of the current day, which is cheap to get.
+type Summary struct {
+	// Hourly are the numbers of the requests within each of the last
+	// summaryHours hours, the oldest first.  The last one is the current,
+	// unfinished hour.
+	Hourly []uint64
+
+	// DNSQueries is the number of the requests since the start of the
+	// current day in the instance timezone.
+	DNSQueries uint64
+
+	// BlockedFiltering is the number of those of DNSQueries blocked by the
+	// filters.
+	BlockedFiltering uint64
+}
+
+// Summary implements the Stats interface for *statsCtx.
+func (s *statsCtx) Summary() (sum *Summary, ok bool) {
+	units, firstID := s.loadUnits(summaryUnits)
+	if units == nil {
+		return nil, false
+	}
+
+	sum = &Summary{
+		Hourly: make([]uint64, summaryHours),
+	}
+
+	for i, u := range units[len(units)-summaryHours:] {
+		sum.Hourly[i] = u.NTotal
+	}
+
+	curID := firstID + uint32(len(units)) - 1
+	us := &unitSpan{
+		units:   units,
+		firstID: firstID,
+	}
+
+	dayStart, _ := periodStarts(curID, daysPerDay)
+	total, blocked := us.sums(dayStart, curID-dayStart+1)
+	if total != nil {
+		sum.DNSQueries, sum.BlockedFiltering = *total, *blocked
+	}
+
+	return sum, true
+}
@@ -0,0 +1,65 @@
+package stats
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatsCtx_Summary(t *testing.T) {
+	setTestLocation(t, time.UTC)
+
+	const curID = testMonday + 10
+
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 7,
+		UnitID: func() (id uint32) {
+			return curID
+		},
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	newUnit := func(total, blocked uint64) (u *unitDB) {
+		u = &unitDB{
+			NTotal:  total,
+			NResult: make([]uint64, rLast),
+		}
+		u.NResult[RFiltered] = blocked
+
+		return u
+	}
+
+	tx := s.beginTxn(true)
+	require.NotNil(t, tx)
+
+	// The last hour of the previous day is within the last 24 hours, but
+	// not within the current day.
+	require.True(t, s.flushUnitToDB(tx, testMonday-1, newUnit(5, 5)))
+	require.True(t, s.flushUnitToDB(tx, testMonday+2, newUnit(3, 1)))
+	// The unit older than 24 hours isn't counted.
+	require.True(t, s.flushUnitToDB(tx, curID-summaryHours, newUnit(7, 0)))
+	s.commitTxn(tx)
+
+	s.Update(Entry{
+		Domain: "example.org",
+		Client: "127.0.0.1",
+		Result: RFiltered,
+	})
+
+	sum, ok := s.Summary()
+	require.True(t, ok)
+
+	assert.EqualValues(t, 4, sum.DNSQueries)
+	assert.EqualValues(t, 2, sum.BlockedFiltering)
+
+	want := make([]uint64, summaryHours)
+	want[summaryHours-1-(curID-(testMonday-1))] = 5
+	want[summaryHours-1-(curID-(testMonday+2))] = 3
+	want[summaryHours-1] = 1
+	assert.Equal(t, want, sum.Hourly)
+}
@@ -0,0 +1,116 @@
+package stats
+
+import (
+	"sort"
+)
+
+// The limits of the number of the keys tracked by a topCounter.
+const (
+	// defaultTopLimit is the number of the keys tracked by default.
+	defaultTopLimit = 10_000
+
+	// minTopLimit is the least number of the keys tracked.  It's enough
+	// to keep the pruning from affecting the keys stored in the database
+	// in the common case.
+	minTopLimit = 10 * maxDomains
+)
+
+// topCounter counts the requests per key, such as a domain name or a client
+// ID, within a bounded amount of memory.  It tracks at most limit keys.  Once
+// there are more, it's pruned in the manner of the Misra-Gries algorithm: the
+// count of the (limit/2+1)-th most frequent key is subtracted from all counts
+// and the keys with no count left are removed.
+//
+// Each pruning subtracts its threshold from at least limit/2+1 counts, which
+// together never exceed the total number of the requests, so the sum of all
+// the thresholds is at most total/(limit/2+1).  Therefore:
+//
+//   - the counts are exact unless there have been more than limit distinct
+//     keys at once;
+//   - a count is never greater than the actual one, and is less by at most
+//     errBound, which never exceeds total/(limit/2+1);
+//   - any key occurring more than total/(limit/2+1) times is tracked.
+//
+// The pruning costs O(limit*log(limit)) and happens at most once per limit/2
+// new keys, so the amortized cost of inc is O(log(limit)).
+type topCounter struct {
+	// counts are the counts of the tracked keys.
+	counts map[string]uint64
+
+	// limit is the maximum number of the tracked keys.
+	limit int
+
+	// total is the number of all counted requests.
+	total uint64
+
+	// errBound is the sum of the pruning thresholds, which is the greatest
+	// possible difference between a count and the actual one.
+	errBound uint64
+}
+
+// newTopCounter returns a new counter tracking at most limit keys.  Zero limit
+// means defaultTopLimit, and limit is raised to minTopLimit if it's less.
+func newTopCounter(limit int) (c *topCounter) {
+	if limit == 0 {
+		limit = defaultTopLimit
+	} else if limit < minTopLimit {
+		limit = minTopLimit
+	}
+
+	return &topCounter{
+		counts: map[string]uint64{},
+		limit:  limit,
+	}
+}
+
+// inc counts a request for key.
+func (c *topCounter) inc(key string) {
+	c.add(key, 1)
+}
+
+// add counts n requests for key.
+func (c *topCounter) add(key string, n uint64) {
+	c.counts[key] += n
+	c.total += n
+	if len(c.counts) > c.limit {
+		c.prune()
+	}
+}
+
+// prune reduces the number of the tracked keys to at most limit/2.
+func (c *topCounter) prune() {
+	counts := make([]uint64, 0, len(c.counts))
+	for _, n := range c.counts {
+		counts = append(counts, n)
+	}
+
+	sort.Slice(counts, func(i, j int) bool { return counts[i] > counts[j] })
+
+	threshold := counts[c.limit/2]
+	for k, n := range c.counts {
+		if n <= threshold {
+			delete(c.counts, k)
+		} else {
+			c.counts[k] = n - threshold
+		}
+	}
+
+	c.errBound += threshold
+}
+
+// top returns at most max keys with the biggest counts in descending order.
+func (c *topCounter) top(max int) (pairs []countPair) {
+	return convertMapToSlice(c.counts, max)
+}
+
+// memUsage returns the estimate of the memory used by c.
+func (c *topCounter) memUsage() (n uint64) {
+	return mapMemUsage(c.counts)
+}
+
+// trim removes all keys except for max ones with the biggest counts and
+// returns the estimate of the memory freed.  The counts of the other keys are
+// lost, so the bounds of topCounter don't hold for them afterwards.
+func (c *topCounter) trim(max int) (freed uint64) {
+	return trimMap(c.counts, max)
+}
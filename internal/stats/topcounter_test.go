@@ -0,0 +1,119 @@
+package stats
+
+import (
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTopCounter_exact(t *testing.T) {
+	c := newTopCounter(0)
+	require.Equal(t, defaultTopLimit, c.limit)
+
+	exact := map[string]uint64{}
+	for i := 0; i < defaultTopLimit; i++ {
+		name := fmt.Sprintf("host-%d.example", i)
+		for j := 0; j <= i%7; j++ {
+			c.inc(name)
+			exact[name]++
+		}
+	}
+
+	// The counts are exact while the keys fit.
+	assert.Zero(t, c.errBound)
+	assert.Equal(t, exact, c.counts)
+}
+
+func TestTopCounter_bounds(t *testing.T) {
+	const (
+		limit = minTopLimit
+		heavy = 100
+		dga   = 200_000
+	)
+
+	// Emulate heavy hitters with Zipf-like frequencies, which are
+	// interleaved with the lookups of the unique generated names.
+	var keys []string
+	exact := map[string]uint64{}
+	for i := 0; i < heavy; i++ {
+		name := fmt.Sprintf("popular-%d.example", i)
+		n := 20_000 / (i + 1)
+		for j := 0; j < n; j++ {
+			keys = append(keys, name)
+		}
+
+		exact[name] = uint64(n)
+	}
+
+	for i := 0; i < dga; i++ {
+		name := fmt.Sprintf("dga-%d.example", i)
+		keys = append(keys, name)
+		exact[name] = 1
+	}
+
+	r := rand.New(rand.NewSource(1))
+	r.Shuffle(len(keys), func(i, j int) { keys[i], keys[j] = keys[j], keys[i] })
+
+	c := newTopCounter(limit)
+	for _, k := range keys {
+		c.inc(k)
+	}
+
+	total := uint64(len(keys))
+	require.Equal(t, total, c.total)
+
+	assert.LessOrEqual(t, len(c.counts), limit)
+
+	// The documented bound holds.
+	maxErr := total / (limit/2 + 1)
+	assert.NotZero(t, c.errBound)
+	assert.LessOrEqual(t, c.errBound, maxErr)
+
+	for k, n := range c.counts {
+		assert.LessOrEqualf(t, n, exact[k], "key %q", k)
+		assert.GreaterOrEqualf(t, n+c.errBound, exact[k], "key %q", k)
+	}
+
+	guaranteed := 0
+	for k, n := range exact {
+		if n > maxErr {
+			assert.Containsf(t, c.counts, k, "frequent key %q is lost", k)
+			guaranteed++
+		}
+	}
+	assert.NotZero(t, guaranteed)
+
+	// None of the generated names make it to the top.
+	for _, p := range c.top(guaranteed) {
+		assert.Contains(t, p.Name, "popular-")
+	}
+}
+
+func TestStatsCtx_Update_canonical(t *testing.T) {
+	s, err := createObject(Config{
+		Filename:  filepath.Join(t.TempDir(), "stats.db"),
+		LimitDays: 1,
+	})
+	require.NoError(t, err)
+	t.Cleanup(s.Close)
+
+	for _, d := range []string{"Example.ORG.", "example.org", "EXAMPLE.org", "."} {
+		s.Update(Entry{
+			Domain: d,
+			Client: "127.0.0.1",
+			Result: RNotFiltered,
+		})
+	}
+
+	d, ok := s.getData()
+	require.True(t, ok)
+
+	assert.Equal(t, []map[string]uint64{
+		{"example.org": 3},
+		{".": 1},
+	}, d.TopQueried)
+}
@@ -13,6 +13,9 @@ import (
 	"time"
 
 	"github.com/AdguardTeam/AdGuardHome/internal/agherr"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghnet"
+	"github.com/AdguardTeam/AdGuardHome/internal/aghtime"
+	"github.com/AdguardTeam/AdGuardHome/internal/dnsfilter"
 	"github.com/AdguardTeam/golibs/log"
 	bolt "go.etcd.io/bbolt"
 )
@@ -32,6 +35,22 @@ type statsCtx struct {
 
 	unit     *unit      // the current unit
 	unitLock sync.Mutex // protect 'unit'
+
+	// alerts evaluates the alert rules.
+	alerts *alerter
+
+	// alertsDone is closed when the module is closed.
+	alertsDone chan struct{}
+
+	// pending are the finished units, which haven't been written to the
+	// database yet, by their IDs.  They're only kept while the file system
+	// is read-only.  It's protected by pendingLock.
+	pending     map[uint32]*unitDB
+	pendingLock sync.Mutex
+
+	// commit commits the write transactions of the units.  It's only
+	// replaced in tests.
+	commit func(tx *bolt.Tx) (err error)
 }
 
 // data for 1 time unit
@@ -42,10 +61,17 @@ type unit struct {
 	nResult []uint64 // number of requests per one result
 	timeSum uint64   // sum of processing time of all requests (usec)
 
+	// upstreamTimeSum is the sum of the time spent waiting for the
+	// upstream servers by all requests (usec).
+	upstreamTimeSum uint64
+
+	// nReason is the number of requests per filtering reason.
+	nReason map[dnsfilter.ReasonCode]uint64
+
 	// top:
-	domains        map[string]uint64 // number of requests per domain
-	blockedDomains map[string]uint64 // number of blocked requests per domain
-	clients        map[string]uint64 // number of requests per client
+	domains        *topCounter // number of requests per domain
+	blockedDomains *topCounter // number of blocked requests per domain
+	clients        *topCounter // number of requests per client
 }
 
 // name-count pair
@@ -59,11 +85,19 @@ type unitDB struct {
 	NTotal  uint64
 	NResult []uint64
 
+	// NReason is the number of requests per filtering reason.  The stable
+	// codes are stored, so that renaming a reason doesn't break the data.
+	NReason map[dnsfilter.ReasonCode]uint64
+
 	Domains        []countPair
 	BlockedDomains []countPair
 	Clients        []countPair
 
 	TimeAvg uint32 // usec
+
+	// UpstreamTimeAvg is the average time spent waiting for the upstream
+	// servers per request (usec).
+	UpstreamTimeAvg uint32
 }
 
 func createObject(conf Config) (s *statsCtx, err error) {
@@ -79,6 +113,11 @@ func createObject(conf Config) (s *statsCtx, err error) {
 		s.conf.UnitID = newUnitID
 	}
 
+	s.alerts = newAlerter(conf.Alerts, conf.HTTPClient)
+	s.alertsDone = make(chan struct{})
+	s.pending = map[uint32]*unitDB{}
+	s.commit = (*bolt.Tx).Commit
+
 	if !s.dbOpen() {
 		return nil, fmt.Errorf("open database")
 	}
@@ -95,6 +134,10 @@ func createObject(conf Config) (s *statsCtx, err error) {
 		// like a rather bizarre solution.
 		errStop := agherr.Error("stop iteration")
 		forEachBkt := func(name []byte, _ *bolt.Bucket) (cberr error) {
+			if bytes.Equal(name, annotationsBucket) {
+				return nil
+			}
+
 			nameID := uint32(btoi(name))
 			if nameID < firstID {
 				cberr = tx.DeleteBucket(name)
@@ -145,6 +188,7 @@ func createObject(conf Config) (s *statsCtx, err error) {
 func (s *statsCtx) Start() {
 	s.initWeb()
 	go s.periodicFlush()
+	go s.alerts.run(s.alertsDone)
 }
 
 func checkInterval(days uint32) bool {
@@ -176,6 +220,23 @@ func (s *statsCtx) swapUnit(new *unit) *unit {
 	return u
 }
 
+// retireUnit replaces the current unit with nu and makes the previous one
+// pending at once, so that the readers, see loadUnits, always find it either as
+// the current unit or among the pending ones.  It returns the previous unit.
+func (s *statsCtx) retireUnit(nu *unit) (u *unit) {
+	s.unitLock.Lock()
+	defer s.unitLock.Unlock()
+
+	u = s.unit
+	s.unit = nu
+
+	s.pendingLock.Lock()
+	s.pending[u.id] = serialize(u)
+	s.pendingLock.Unlock()
+
+	return u
+}
+
 // Get unit ID for the current hour
 func newUnitID() uint32 {
 	return uint32(time.Now().Unix() / (60 * 60))
@@ -185,9 +246,10 @@ func newUnitID() uint32 {
 func (s *statsCtx) initUnit(u *unit, id uint32) {
 	u.id = id
 	u.nResult = make([]uint64, rLast)
-	u.domains = make(map[string]uint64)
-	u.blockedDomains = make(map[string]uint64)
-	u.clients = make(map[string]uint64)
+	u.nReason = map[dnsfilter.ReasonCode]uint64{}
+	u.domains = newTopCounter(s.conf.TopLimit)
+	u.blockedDomains = newTopCounter(s.conf.TopLimit)
+	u.clients = newTopCounter(s.conf.TopLimit)
 }
 
 // Open a DB transaction
@@ -253,32 +315,97 @@ func (s *statsCtx) periodicFlush() {
 
 		id := s.conf.UnitID()
 		if ptr.id == id {
+			// Retry writing the units kept in memory, if any.
+			s.flushPending(id, time.Now(), false)
 			time.Sleep(time.Second)
 
 			continue
 		}
 
-		tx := s.beginTxn(true)
+		s.rotateUnit(id, time.Now())
+	}
 
-		nu := unit{}
-		s.initUnit(&nu, id)
-		u := s.swapUnit(&nu)
-		udb := serialize(u)
+	log.Tracef("periodicFlush() exited")
+}
 
-		if tx == nil {
-			continue
-		}
+// rotateUnit replaces the current unit with the new one with id and writes the
+// previous one into the database.
+func (s *statsCtx) rotateUnit(id uint32, now time.Time) {
+	nu := unit{}
+	s.initUnit(&nu, id)
+	_ = s.retireUnit(&nu)
 
-		ok1 := s.flushUnitToDB(tx, u.id, udb)
-		ok2 := s.deleteUnit(tx, id-s.conf.limit)
-		if ok1 || ok2 {
-			s.commitTxn(tx)
-		} else {
-			_ = tx.Rollback()
+	s.flushPending(id, now, false)
+}
+
+// flushPending writes the pending units into the database and deletes the unit
+// expired by the current unit with id.  The units are kept pending if the file
+// system is read-only, and then the writes are only retried once in
+// aghos.ReadOnlyRetryIvl, unless force is true.
+func (s *statsCtx) flushPending(id uint32, now time.Time, force bool) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	if len(s.pending) == 0 || (!force && !s.conf.WriteGuard.Allow(now)) {
+		return
+	}
+
+	tx := s.beginTxn(true)
+	if tx == nil {
+		s.dropExpired(id)
+
+		return
+	}
+
+	ok := s.deleteUnit(tx, id-s.conf.limit)
+	for uid, udb := range s.pending {
+		ok = s.flushUnitToDB(tx, uid, udb) || ok
+	}
+
+	if !ok {
+		_ = tx.Rollback()
+		s.pending = map[uint32]*unitDB{}
+
+		return
+	}
+
+	err := s.commit(tx)
+	if s.conf.WriteGuard.Report(err, now) {
+		s.dropExpired(id)
+
+		return
+	}
+
+	if err != nil {
+		log.Debug("tx.Commit: %s", err)
+	} else {
+		log.Tracef("tx.Commit")
+	}
+
+	s.pending = map[uint32]*unitDB{}
+}
+
+// dropExpired removes the pending units expired by the current unit with id.
+// s.pendingLock is expected to be locked.
+func (s *statsCtx) dropExpired(id uint32) {
+	for uid := range s.pending {
+		if id-uid >= s.conf.limit {
+			delete(s.pending, uid)
 		}
 	}
+}
 
-	log.Tracef("periodicFlush() exited")
+// pendingUnits returns a copy of the pending units.
+func (s *statsCtx) pendingUnits() (units map[uint32]*unitDB) {
+	s.pendingLock.Lock()
+	defer s.pendingLock.Unlock()
+
+	units = make(map[uint32]*unitDB, len(s.pending))
+	for id, udb := range s.pending {
+		units[id] = udb
+	}
+
+	return units
 }
 
 // Delete unit's data from file
@@ -313,12 +440,77 @@ func convertMapToSlice(m map[string]uint64, max int) []countPair {
 	return a[:max]
 }
 
-func convertSliceToMap(a []countPair) map[string]uint64 {
-	m := map[string]uint64{}
+// mapEntryOverhead is the estimate of the memory used by an entry of a top map
+// in addition to the length of its key.
+const mapEntryOverhead = 64
+
+// mapMemUsage returns the estimate of the memory used by m.
+func mapMemUsage(m map[string]uint64) (n uint64) {
+	for k := range m {
+		n += mapEntryOverhead + uint64(len(k))
+	}
+
+	return n
+}
+
+// trimMap removes all entries from m except for max ones with the biggest
+// counts and returns the estimate of the memory freed.
+func trimMap(m map[string]uint64, max int) (freed uint64) {
+	if len(m) <= max {
+		return 0
+	}
+
+	keep := convertMapToSlice(m, max)
+	before := mapMemUsage(m)
+	for k := range m {
+		delete(m, k)
+	}
+
+	for _, p := range keep {
+		m[p.Name] = p.Count
+	}
+
+	return before - mapMemUsage(m)
+}
+
+// MemUsage implements the aghmem.Consumer interface for *statsCtx.
+func (s *statsCtx) MemUsage() (n uint64) {
+	s.unitLock.Lock()
+	defer s.unitLock.Unlock()
+
+	u := s.unit
+	if u == nil {
+		return 0
+	}
+
+	return u.domains.memUsage() + u.blockedDomains.memUsage() + u.clients.memUsage()
+}
+
+// ShedMem implements the aghmem.Consumer interface for *statsCtx.  The top
+// maps of the current unit are trimmed to the sizes stored in the database,
+// so n is ignored.
+func (s *statsCtx) ShedMem(_ uint64) (freed uint64) {
+	s.unitLock.Lock()
+	defer s.unitLock.Unlock()
+
+	u := s.unit
+	if u == nil {
+		return 0
+	}
+
+	freed += u.domains.trim(maxDomains)
+	freed += u.blockedDomains.trim(maxDomains)
+	freed += u.clients.trim(maxClients)
+
+	return freed
+}
+
+// addPairs adds the counts from a to c.  The pairs with the same name are
+// summed, since the older databases may contain those.
+func addPairs(c *topCounter, a []countPair) {
 	for _, it := range a {
-		m[it.Name] = it.Count
+		c.add(it.Name, it.Count)
 	}
-	return m
 }
 
 func serialize(u *unit) *unitDB {
@@ -327,13 +519,21 @@ func serialize(u *unit) *unitDB {
 
 	udb.NResult = append(udb.NResult, u.nResult...)
 
+	if len(u.nReason) != 0 {
+		udb.NReason = make(map[dnsfilter.ReasonCode]uint64, len(u.nReason))
+		for c, n := range u.nReason {
+			udb.NReason[c] = n
+		}
+	}
+
 	if u.nTotal != 0 {
 		udb.TimeAvg = uint32(u.timeSum / u.nTotal)
+		udb.UpstreamTimeAvg = uint32(u.upstreamTimeSum / u.nTotal)
 	}
 
-	udb.Domains = convertMapToSlice(u.domains, maxDomains)
-	udb.BlockedDomains = convertMapToSlice(u.blockedDomains, maxDomains)
-	udb.Clients = convertMapToSlice(u.clients, maxClients)
+	udb.Domains = u.domains.top(maxDomains)
+	udb.BlockedDomains = u.blockedDomains.top(maxDomains)
+	udb.Clients = u.clients.top(maxClients)
 
 	return &udb
 }
@@ -342,17 +542,22 @@ func deserialize(u *unit, udb *unitDB) {
 	u.nTotal = udb.NTotal
 
 	n := len(udb.NResult)
-	if n < len(u.nResult) {
+	if n > len(u.nResult) {
 		n = len(u.nResult) // n = min(len(udb.NResult), len(u.nResult))
 	}
 	for i := 1; i < n; i++ {
 		u.nResult[i] = udb.NResult[i]
 	}
 
-	u.domains = convertSliceToMap(udb.Domains)
-	u.blockedDomains = convertSliceToMap(udb.BlockedDomains)
-	u.clients = convertSliceToMap(udb.Clients)
+	for c, n := range udb.NReason {
+		u.nReason[c] = n
+	}
+
+	addPairs(u.domains, udb.Domains)
+	addPairs(u.blockedDomains, udb.BlockedDomains)
+	addPairs(u.clients, udb.Clients)
 	u.timeSum = uint64(udb.TimeAvg) * u.nTotal
+	u.upstreamTimeSum = uint64(udb.UpstreamTimeAvg) * u.nTotal
 }
 
 func (s *statsCtx) flushUnitToDB(tx *bolt.Tx, id uint32, udb *unitDB) bool {
@@ -399,6 +604,11 @@ func (s *statsCtx) loadUnitFromDB(tx *bolt.Tx, id uint32) *unitDB {
 		return nil
 	}
 
+	// Units stored by older versions may have fewer results.
+	if n := len(udb.NResult); n < int(rLast) {
+		udb.NResult = append(udb.NResult, make([]uint64, int(rLast)-n)...)
+	}
+
 	return &udb
 }
 
@@ -421,19 +631,19 @@ func (s *statsCtx) setLimit(limitDays int) {
 
 func (s *statsCtx) WriteDiskConfig(dc *DiskConfig) {
 	dc.Interval = s.conf.limit / 24
+	s.alerts.writeRules(&dc.Alerts)
+}
+
+// AlertWarnings implements the Stats interface for *statsCtx.
+func (s *statsCtx) AlertWarnings() (warns []string) {
+	return s.alerts.warnings()
 }
 
 func (s *statsCtx) Close() {
-	u := s.swapUnit(nil)
-	udb := serialize(u)
-	tx := s.beginTxn(true)
-	if tx != nil {
-		if s.flushUnitToDB(tx, u.id, udb) {
-			s.commitTxn(tx)
-		} else {
-			_ = tx.Rollback()
-		}
-	}
+	close(s.alertsDone)
+
+	u := s.retireUnit(nil)
+	s.flushPending(u.id, time.Now(), true)
 
 	if s.db != nil {
 		log.Tracef("db.Close...")
@@ -444,6 +654,47 @@ func (s *statsCtx) Close() {
 	log.Debug("stats: closed")
 }
 
+// Suspend implements the Stats interface for *statsCtx.
+func (s *statsCtx) Suspend() {
+	s.unitLock.Lock()
+	u := s.unit
+	if u != nil {
+		s.pendingLock.Lock()
+		s.pending[u.id] = serialize(u)
+		s.pendingLock.Unlock()
+	}
+	s.unitLock.Unlock()
+
+	if u != nil {
+		// The current unit is written once more when it's retired, which
+		// replaces the copy written now.
+		s.flushPending(u.id, time.Now(), true)
+	}
+
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return
+	}
+
+	db := s.db
+	s.db = nil
+	_ = tx.Rollback()
+	_ = db.Close()
+
+	log.Debug("stats: suspended")
+}
+
+// Resume implements the Stats interface for *statsCtx.
+func (s *statsCtx) Resume() (err error) {
+	if !s.dbOpen() {
+		return fmt.Errorf("open database")
+	}
+
+	log.Debug("stats: resumed")
+
+	return nil
+}
+
 // Reset counters and clear database
 func (s *statsCtx) clear() {
 	tx := s.beginTxn(true)
@@ -462,6 +713,10 @@ func (s *statsCtx) clear() {
 	s.initUnit(&u, s.conf.UnitID())
 	_ = s.swapUnit(&u)
 
+	s.pendingLock.Lock()
+	s.pending = map[uint32]*unitDB{}
+	s.pendingLock.Unlock()
+
 	err := os.Remove(s.conf.Filename)
 	if err != nil {
 		log.Error("os.Remove: %s", err)
@@ -496,46 +751,71 @@ func (s *statsCtx) Update(e Entry) {
 		return
 	}
 
+	// Count the names differing only in case or in the trailing dot as
+	// one.
+	domain := aghnet.CanonicalDomain(e.Domain)
+	if domain == "" {
+		return
+	}
+
 	clientID := e.Client
 	if ip := net.ParseIP(clientID); ip != nil {
 		ip = s.getClientIP(ip)
 		clientID = ip.String()
 	}
 
+	s.alerts.count(time.Now(), e.Result, clientID)
+
 	s.unitLock.Lock()
 	defer s.unitLock.Unlock()
 
 	u := s.unit
 
 	u.nResult[e.Result]++
+	if c := e.Reason.Code(); c != "" {
+		u.nReason[c]++
+	}
 
-	if e.Result == RNotFiltered {
-		u.domains[e.Domain]++
+	if e.Result == RNotFiltered || e.Result == RAAAADisabled {
+		u.domains.inc(domain)
 	} else {
-		u.blockedDomains[e.Domain]++
+		u.blockedDomains.inc(domain)
 	}
 
-	u.clients[clientID]++
+	u.clients.inc(clientID)
 	u.timeSum += uint64(e.Time)
+	u.upstreamTimeSum += uint64(e.UpstreamTime)
 	u.nTotal++
 }
 
 func (s *statsCtx) loadUnits(limit uint32) ([]*unitDB, uint32) {
-	tx := s.beginTxn(false)
-	if tx == nil {
-		return nil, 0
-	}
-
+	// Read the current unit first.  A unit rotated before that is already
+	// pending, see retireUnit, and flushPending only removes the pending
+	// units after they're committed, so the unit is either among the
+	// pending ones read next or within the transaction opened after that.
+	// Get the pending units before opening the transaction, since
+	// flushPending opens one while holding the lock.
 	s.unitLock.Lock()
 	curUnit := serialize(s.unit)
 	curID := s.unit.id
 	s.unitLock.Unlock()
 
+	pending := s.pendingUnits()
+
+	tx := s.beginTxn(false)
+	if tx == nil {
+		return nil, 0
+	}
+
 	// Per-hour units.
 	units := []*unitDB{}
 	firstID := curID - limit + 1
 	for i := firstID; i != curID; i++ {
-		u := s.loadUnitFromDB(tx, i)
+		u, ok := pending[i]
+		if !ok {
+			u = s.loadUnitFromDB(tx, i)
+		}
+
 		if u == nil {
 			u = &unitDB{}
 			u.NResult = make([]uint64, rLast)
@@ -557,35 +837,96 @@ func (s *statsCtx) loadUnits(limit uint32) ([]*unitDB, uint32) {
 // numsGetter is a signature for statsCollector argument.
 type numsGetter func(u *unitDB) (num uint64)
 
-// statsCollector collects statisctics for the given *unitDB slice by specified
-// timeUnit using ng to retrieve data.
-func statsCollector(units []*unitDB, firstID uint32, timeUnit TimeUnit, ng numsGetter) (nums []uint64) {
+// unitTime returns the start of the unit with id.
+func unitTime(id uint32) (t time.Time) {
+	return time.Unix(int64(id)*60*60, 0)
+}
+
+// firstUnitSince returns the ID of the first unit which starts at t or later.
+func firstUnitSince(t time.Time) (id uint32) {
+	sec := t.Unix()
+	if sec <= 0 {
+		return 0
+	}
+
+	const unitSec = 60 * 60
+
+	return uint32((sec + unitSec - 1) / unitSec)
+}
+
+// timeBucket is a range of units shown as a single element of the per time
+// unit counters.
+type timeBucket struct {
+	// start is the start of the hour or of the day in the instance
+	// timezone.
+	start time.Time
+
+	// first and end are the indexes of the first unit of the bucket and of
+	// the unit after the last one.
+	first int
+	end   int
+}
+
+// timeBuckets returns the buckets of n units beginning with the unit with
+// firstID.  The days are the days in the instance timezone, there are n/24 of
+// them, and the last one is the current day.  The units before the first day
+// are skipped.
+func timeBuckets(n int, firstID uint32, timeUnit TimeUnit) (bs []timeBucket) {
 	if timeUnit == Hours {
-		for _, u := range units {
-			nums = append(nums, ng(u))
+		bs = make([]timeBucket, n)
+		for i := range bs {
+			bs[i] = timeBucket{
+				start: unitTime(firstID + uint32(i)),
+				first: i,
+				end:   i + 1,
+			}
 		}
-	} else {
-		// Per time unit counters: 720 hours may span 31 days, so we
-		// skip data for the first day in this case.
-		// align_ceil(24)
-		firstDayID := (firstID + 24 - 1) / 24 * 24
 
-		var sum uint64
-		id := firstDayID
-		nextDayID := firstDayID + 24
-		for i := int(firstDayID - firstID); i != len(units); i++ {
-			sum += ng(units[i])
-			if id == nextDayID {
-				nums = append(nums, sum)
-				sum = 0
-				nextDayID += 24
-			}
-			id++
+		return bs
+	}
+
+	bs = make([]timeBucket, n/24)
+	if len(bs) == 0 {
+		return bs
+	}
+
+	// Walk from the current day backwards, because the days are not always
+	// 24 units long, for example when the DST begins or ends.
+	end := n
+	dayStart := aghtime.StartOfDay(unitTime(firstID + uint32(n) - 1))
+	for i := len(bs) - 1; i >= 0; i-- {
+		first := int(firstUnitSince(dayStart)) - int(firstID)
+		if first < 0 {
+			first = 0
+		} else if first > end {
+			first = end
 		}
-		if id <= nextDayID {
-			nums = append(nums, sum)
+
+		bs[i] = timeBucket{
+			start: dayStart,
+			first: first,
+			end:   end,
 		}
+
+		end = first
+		dayStart = dayStart.AddDate(0, 0, -1)
 	}
+
+	return bs
+}
+
+// statsCollector collects statisctics for the given *unitDB slice by specified
+// timeUnit using ng to retrieve data.
+func statsCollector(units []*unitDB, firstID uint32, timeUnit TimeUnit, ng numsGetter) (nums []uint64) {
+	for _, b := range timeBuckets(len(units), firstID, timeUnit) {
+		var sum uint64
+		for _, u := range units[b.first:b.end] {
+			sum += ng(u)
+		}
+
+		nums = append(nums, sum)
+	}
+
 	return nums
 }
 
@@ -616,8 +957,9 @@ func topsCollector(units []*unitDB, max int, pg pairsGetter) []map[string]uint64
   * blocked/time-unit
   * safebrowsing-blocked/time-unit
   * parental-blocked/time-unit
+  * aaaa-disabled/time-unit
   If time-unit is an hour, just add values from each unit to an array.
-  If time-unit is a day, aggregate per-hour data into days.
+  If time-unit is a day, aggregate per-hour data into days of the instance timezone.
  * top counters:
   * queries/domain
   * queries/blocked-domain
@@ -630,6 +972,7 @@ func topsCollector(units []*unitDB, max int, pg pairsGetter) []map[string]uint64
   * safebrowsing-blocked
   * safesearch-blocked
   * parental-blocked
+  * aaaa-disabled
   These values are just the sum of data for all units.
 */
 func (s *statsCtx) getData() (statsResponse, bool) {
@@ -655,26 +998,28 @@ func (s *statsCtx) getData() (statsResponse, bool) {
 		BlockedFiltering:     statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RFiltered] }),
 		ReplacedSafebrowsing: statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RSafeBrowsing] }),
 		ReplacedParental:     statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RParental] }),
+		AAAADisabled:         statsCollector(units, firstID, timeUnit, func(u *unitDB) (num uint64) { return u.NResult[RAAAADisabled] }),
 		TopQueried:           topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) { return u.Domains }),
 		TopBlocked:           topsCollector(units, maxDomains, func(u *unitDB) (pairs []countPair) { return u.BlockedDomains }),
 		TopClients:           topsCollector(units, maxClients, func(u *unitDB) (pairs []countPair) { return u.Clients }),
+		NumByReason:          map[dnsfilter.ReasonCode]uint64{},
 	}
 
 	// Total counters:
 	sum := unitDB{
 		NResult: make([]uint64, rLast),
 	}
-	timeN := 0
 	for _, u := range units {
 		sum.NTotal += u.NTotal
-		sum.TimeAvg += u.TimeAvg
-		if u.TimeAvg != 0 {
-			timeN++
-		}
 		sum.NResult[RFiltered] += u.NResult[RFiltered]
 		sum.NResult[RSafeBrowsing] += u.NResult[RSafeBrowsing]
 		sum.NResult[RSafeSearch] += u.NResult[RSafeSearch]
 		sum.NResult[RParental] += u.NResult[RParental]
+		sum.NResult[RAAAADisabled] += u.NResult[RAAAADisabled]
+
+		for c, n := range u.NReason {
+			data.NumByReason[c] += n
+		}
 	}
 
 	data.NumDNSQueries = sum.NTotal
@@ -682,9 +1027,13 @@ func (s *statsCtx) getData() (statsResponse, bool) {
 	data.NumReplacedSafebrowsing = sum.NResult[RSafeBrowsing]
 	data.NumReplacedSafesearch = sum.NResult[RSafeSearch]
 	data.NumReplacedParental = sum.NResult[RParental]
+	data.NumAAAADisabled = sum.NResult[RAAAADisabled]
 
-	if timeN != 0 {
-		data.AvgProcessingTime = float64(sum.TimeAvg/uint32(timeN)) / 1000000
+	data.procTime, data.upstreamTime = avgTimes(units)
+	data.setTimes(apiVersionSeconds)
+
+	for _, b := range timeBuckets(len(units), firstID, timeUnit) {
+		data.TimeUnitStarts = append(data.TimeUnitStarts, aghtime.Format(b.start, time.RFC3339))
 	}
 
 	data.TimeUnits = "hours"
@@ -695,6 +1044,26 @@ func (s *statsCtx) getData() (statsResponse, bool) {
 	return data, true
 }
 
+// avgTimes returns the average processing and upstream times of the requests
+// from units.  The averages of the units are weighted by the numbers of the
+// requests, so that the result doesn't depend on whether the requests are in
+// the current unit or in the ones written to the database.
+func avgTimes(units []*unitDB) (proc, upstream time.Duration) {
+	var n, procSum, upstreamSum uint64
+	for _, u := range units {
+		n += u.NTotal
+		procSum += uint64(u.TimeAvg) * u.NTotal
+		upstreamSum += uint64(u.UpstreamTimeAvg) * u.NTotal
+	}
+
+	if n == 0 {
+		return 0, 0
+	}
+
+	return time.Duration(procSum/n) * time.Microsecond,
+		time.Duration(upstreamSum/n) * time.Microsecond
+}
+
 func (s *statsCtx) GetTopClientsIP(maxCount uint) []net.IP {
 	units, _ := s.loadUnits(s.conf.limit)
 	if units == nil {
@@ -708,6 +1077,8 @@ func (s *statsCtx) GetTopClientsIP(maxCount uint) []net.IP {
 			m[it.Name] += it.Count
 		}
 	}
+	delete(m, ExpiredClients)
+
 	a := convertMapToSlice(m, int(maxCount))
 	d := []net.IP{}
 	for _, it := range a {
@@ -715,3 +1086,26 @@ func (s *statsCtx) GetTopClientsIP(maxCount uint) []net.IP {
 	}
 	return d
 }
+
+// GetTopDomains implements the Stats interface for *statsCtx.
+func (s *statsCtx) GetTopDomains(limit uint) (domains []string) {
+	units, _ := s.loadUnits(s.conf.limit)
+	if units == nil {
+		return nil
+	}
+
+	m := map[string]uint64{}
+	for _, u := range units {
+		for _, it := range u.Domains {
+			m[it.Name] += it.Count
+		}
+	}
+
+	top := convertMapToSlice(m, int(limit))
+	domains = make([]string, 0, len(top))
+	for _, it := range top {
+		domains = append(domains, it.Name)
+	}
+
+	return domains
+}
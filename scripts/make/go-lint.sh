@@ -153,7 +153,7 @@ exit_on_output() (
 
 # Constants
 
-readonly go_files='./main.go ./tools.go ./internal/'
+readonly go_files='./main.go ./tools.go ./filtering/ ./internal/'
 
 
 